@@ -0,0 +1,273 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// ipamd-cli calls the gRPC API of ipamd with JSON requests, for debugging
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/aws/amazon-vpc-cni-k8s/rpc"
+)
+
+const (
+	// StatusInvalidArguments indicates specified invalid arguments.
+	StatusInvalidArguments = 1
+	// StatusConnectionFailure indicates connection failed.
+	StatusConnectionFailure = 2
+	// StatusRPCFailure indicates rpc failed.
+	StatusRPCFailure = 3
+)
+
+// method calls one unary method of ipamd with a JSON request
+type method func(ctx context.Context, conn *grpc.ClientConn, request string) (proto.Message, error)
+
+// methods are the methods call supports, by full and short name
+var methods = map[string]method{
+	"rpc.CNIBackend/AddNetwork": func(ctx context.Context, conn *grpc.ClientConn, request string) (proto.Message, error) {
+		in := &pb.AddNetworkRequest{}
+		if err := jsonpb.UnmarshalString(request, in); err != nil {
+			return nil, err
+		}
+		return pb.NewCNIBackendClient(conn).AddNetwork(ctx, in)
+	},
+	"rpc.CNIBackend/DelNetwork": func(ctx context.Context, conn *grpc.ClientConn, request string) (proto.Message, error) {
+		in := &pb.DelNetworkRequest{}
+		if err := jsonpb.UnmarshalString(request, in); err != nil {
+			return nil, err
+		}
+		return pb.NewCNIBackendClient(conn).DelNetwork(ctx, in)
+	},
+	"rpc.CNIBackend/BulkAddNetwork": func(ctx context.Context, conn *grpc.ClientConn, request string) (proto.Message, error) {
+		in := &pb.BulkAddNetworkRequest{}
+		if err := jsonpb.UnmarshalString(request, in); err != nil {
+			return nil, err
+		}
+		return pb.NewCNIBackendClient(conn).BulkAddNetwork(ctx, in)
+	},
+	"grpc.health.v1.Health/Check": func(ctx context.Context, conn *grpc.ClientConn, request string) (proto.Message, error) {
+		in := &healthpb.HealthCheckRequest{}
+		if err := jsonpb.UnmarshalString(request, in); err != nil {
+			return nil, err
+		}
+		return healthpb.NewHealthClient(conn).Check(ctx, in)
+	},
+}
+
+func usage() {
+	_, _ = fmt.Fprintf(os.Stderr, `Usage: %s [flags] <command>
+
+Commands:
+  list                    list the services and methods of ipamd, needs AWS_VPC_K8S_CNI_GRPC_REFLECTION=true
+  call <method> [request] call a method with a JSON request, read from stdin when omitted, e.g.
+                          call DelNetwork '{"K8S_POD_NAME": "nginx", "K8S_POD_NAMESPACE": "default"}'
+
+Methods:
+  %s
+
+Flags:
+`, os.Args[0], strings.Join(methodNames(), "\n  "))
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	addr := flag.String("addr", "127.0.0.1:50051", "tcp host:port of ipamd")
+	timeout := flag.Duration("timeout", 5*time.Second, "timeout for connecting and for the rpc")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 || (args[0] == "call" && (len(args) < 2 || len(args) > 3)) || (args[0] != "call" && args[0] != "list") {
+		usage()
+		os.Exit(StatusInvalidArguments)
+	}
+
+	var call method
+	request := ""
+	if args[0] == "call" {
+		var ok bool
+		if call, ok = lookupMethod(args[1]); !ok {
+			log.Printf("error: unknown method %q, must be one of %s", args[1], strings.Join(methodNames(), ", "))
+			os.Exit(StatusInvalidArguments)
+		}
+		if len(args) == 3 {
+			request = args[2]
+		} else {
+			input, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				log.Printf("error: failed to read the request: %v", err)
+				os.Exit(StatusInvalidArguments)
+			}
+			request = string(input)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, *addr, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		log.Printf("error: failed to connect to ipamd at %q: %v", *addr, err)
+		os.Exit(StatusConnectionFailure)
+	}
+	defer conn.Close()
+
+	if call == nil {
+		err = list(ctx, conn, os.Stdout)
+	} else {
+		err = invoke(ctx, conn, call, request, os.Stdout)
+	}
+	if err != nil {
+		if stat, ok := status.FromError(err); ok && stat.Code() == codes.Unimplemented && call == nil {
+			log.Printf("error: ipamd does not serve gRPC reflection, set AWS_VPC_K8S_CNI_GRPC_REFLECTION=true to enable it")
+		} else {
+			log.Printf("error: %v", err)
+		}
+		os.Exit(StatusRPCFailure)
+	}
+}
+
+// methodNames returns the full names of the methods call supports
+func methodNames() []string {
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupMethod finds a method by its full name, e.g. rpc.CNIBackend/AddNetwork, or only its method name
+func lookupMethod(name string) (method, bool) {
+	name = strings.TrimPrefix(name, "/")
+	if m, ok := methods[name]; ok {
+		return m, true
+	}
+	for full, m := range methods {
+		if strings.HasSuffix(full, "/"+name) {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// invoke calls a method and prints its reply as JSON
+func invoke(ctx context.Context, conn *grpc.ClientConn, call method, request string, out io.Writer) error {
+	if strings.TrimSpace(request) == "" {
+		request = "{}"
+	}
+	reply, err := call(ctx, conn, request)
+	if err != nil {
+		return err
+	}
+	marshaler := jsonpb.Marshaler{Indent: "  ", EmitDefaults: true, OrigName: true}
+	if err := marshaler.Marshal(out, reply); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out)
+	return err
+}
+
+// list prints the methods of each service ipamd serves, as described by the gRPC reflection service
+func list(ctx context.Context, conn *grpc.ClientConn, out io.Writer) error {
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = stream.CloseSend() }()
+
+	resp, err := reflect(stream, &reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{ListServices: "*"}})
+	if err != nil {
+		return err
+	}
+	var services []string
+	for _, service := range resp.GetListServicesResponse().GetService() {
+		services = append(services, service.GetName())
+	}
+	sort.Strings(services)
+
+	for _, service := range services {
+		resp, err := reflect(stream, &reflectionpb.ServerReflectionRequest{
+			MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: service}})
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintln(out, service)
+		for _, raw := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			file := &descriptor.FileDescriptorProto{}
+			if err := proto.Unmarshal(raw, file); err != nil {
+				return err
+			}
+			for _, s := range file.GetService() {
+				if qualify(file.GetPackage(), s.GetName()) != service {
+					continue
+				}
+				for _, m := range s.GetMethod() {
+					_, _ = fmt.Fprintf(out, "  %s/%s(%s%s) returns (%s%s)\n", service, m.GetName(),
+						streamPrefix(m.GetClientStreaming()), strings.TrimPrefix(m.GetInputType(), "."),
+						streamPrefix(m.GetServerStreaming()), strings.TrimPrefix(m.GetOutputType(), "."))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// reflect sends one request on the reflection stream and returns its response
+func reflect(stream reflectionpb.ServerReflection_ServerReflectionInfoClient,
+	req *reflectionpb.ServerReflectionRequest) (*reflectionpb.ServerReflectionResponse, error) {
+	if err := stream.Send(req); err != nil {
+		return nil, err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if e := resp.GetErrorResponse(); e != nil {
+		return nil, status.Error(codes.Code(e.GetErrorCode()), e.GetErrorMessage())
+	}
+	return resp, nil
+}
+
+func qualify(pkg, name string) string {
+	if pkg == "" {
+		return name
+	}
+	return pkg + "." + name
+}
+
+func streamPrefix(streaming bool) string {
+	if streaming {
+		return "stream "
+	}
+	return ""
+}
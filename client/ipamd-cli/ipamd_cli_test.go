@@ -0,0 +1,109 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+
+	pb "github.com/aws/amazon-vpc-cni-k8s/rpc"
+)
+
+type testBackend struct{}
+
+func (testBackend) AddNetwork(ctx context.Context, in *pb.AddNetworkRequest) (*pb.AddNetworkReply, error) {
+	return &pb.AddNetworkReply{Success: true, IPv4Addr: "10.0.0.1", DeviceNumber: 1}, nil
+}
+
+func (testBackend) DelNetwork(ctx context.Context, in *pb.DelNetworkRequest) (*pb.DelNetworkReply, error) {
+	return &pb.DelNetworkReply{Success: in.K8S_POD_NAME == "nginx"}, nil
+}
+
+func (testBackend) BulkAddNetwork(ctx context.Context, in *pb.BulkAddNetworkRequest) (*pb.BulkAddNetworkReply, error) {
+	reply := &pb.BulkAddNetworkReply{}
+	for range in.Requests {
+		reply.Replies = append(reply.Replies, &pb.AddNetworkReply{Success: true, IPv4Addr: "10.0.0.1", DeviceNumber: 1})
+	}
+	return reply, nil
+}
+
+func dialTestServer(t *testing.T, withReflection bool) (*grpc.ClientConn, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := grpc.NewServer()
+	pb.RegisterCNIBackendServer(s, testBackend{})
+	if withReflection {
+		reflection.Register(s)
+	}
+	go func() { _ = s.Serve(lis) }()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	assert.NoError(t, err)
+	return conn, func() {
+		_ = conn.Close()
+		s.Stop()
+	}
+}
+
+func TestCall(t *testing.T) {
+	conn, stop := dialTestServer(t, false)
+	defer stop()
+
+	call, ok := lookupMethod("DelNetwork")
+	assert.True(t, ok)
+	var out bytes.Buffer
+	err := invoke(context.Background(), conn, call, `{"K8S_POD_NAME": "nginx"}`, &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), `"Success": true`)
+
+	call, ok = lookupMethod("rpc.CNIBackend/AddNetwork")
+	assert.True(t, ok)
+	out.Reset()
+	err = invoke(context.Background(), conn, call, "", &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), `"IPv4Addr": "10.0.0.1"`)
+
+	err = invoke(context.Background(), conn, call, `{"Unknown": 1}`, &out)
+	assert.Error(t, err)
+
+	call, ok = lookupMethod("BulkAddNetwork")
+	assert.True(t, ok)
+	out.Reset()
+	err = invoke(context.Background(), conn, call, `{"Requests": [{"K8S_POD_NAME": "job-0"}, {"K8S_POD_NAME": "job-1"}]}`, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, bytes.Count(out.Bytes(), []byte(`"IPv4Addr": "10.0.0.1"`)))
+
+	_, ok = lookupMethod("Attach")
+	assert.False(t, ok)
+}
+
+func TestList(t *testing.T) {
+	conn, stop := dialTestServer(t, true)
+	defer stop()
+
+	var out bytes.Buffer
+	assert.NoError(t, list(context.Background(), conn, &out))
+	assert.Contains(t, out.String(), "rpc.CNIBackend/AddNetwork(rpc.AddNetworkRequest) returns (rpc.AddNetworkReply)")
+	assert.Contains(t, out.String(), "ServerReflectionInfo(stream ")
+
+	conn, stop = dialTestServer(t, false)
+	defer stop()
+	assert.Error(t, list(context.Background(), conn, &out))
+}
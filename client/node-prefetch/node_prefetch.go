@@ -0,0 +1,72 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// node-prefetch writes the prefetch cache of aws-node while an AMI is built, so that the first start of aws-node on the
+// nodes launched from it skips probing the node. It must run in the aws-node image, with the network namespace of the
+// host, so that it probes the same iptables as aws-node.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/prefetch"
+)
+
+const (
+	// StatusInvalidArguments indicates specified invalid arguments.
+	StatusInvalidArguments = 1
+	// StatusFailure indicates the cache could not be written.
+	StatusFailure = 2
+)
+
+func main() {
+	log.SetFlags(0)
+	output := flag.String("output", prefetch.DefaultPath, "file the cache is written to")
+	instanceLimits := flag.String("instance-limits", "",
+		"limits of instance types aws-node does not know yet, e.g. m6i.large=3:10,m6i.xlarge=4:15 for 3 ENIs of 10 IPs")
+	clusterName := flag.String("cluster-name", "", "name of the cluster, only for an AMI used by a single cluster")
+	clusterID := flag.String("cluster-id", "", "ID of the cluster, only for an AMI used by a single cluster")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s [flags]\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(StatusInvalidArguments)
+	}
+
+	limits, err := prefetch.ParseInstanceLimits(*instanceLimits)
+	if err != nil {
+		log.Printf("error: %v", err)
+		os.Exit(StatusInvalidArguments)
+	}
+	cache, err := prefetch.New()
+	if err != nil {
+		log.Printf("error: %v", err)
+		os.Exit(StatusFailure)
+	}
+	if len(limits) > 0 {
+		cache.InstanceLimits = limits
+	}
+	cache.ClusterName = *clusterName
+	cache.ClusterID = *clusterID
+	if err := prefetch.Write(*output, cache); err != nil {
+		log.Printf("error: %v", err)
+		os.Exit(StatusFailure)
+	}
+	log.Printf("Wrote the prefetch cache %s for kernel %s", *output, cache.KernelVersion)
+}
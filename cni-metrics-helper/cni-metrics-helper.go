@@ -18,6 +18,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,6 +35,11 @@ type options struct {
 	pullInterval int
 	pullCNI      bool
 	submitCW     bool
+	scrapeMode   string
+	aggregation  string
+	byNodegroup  bool
+	nodegroupKey string
+	ipThreshold  float64
 	help         bool
 }
 
@@ -46,6 +52,15 @@ func main() {
 	flags.Lookup("logtostderr").DefValue = "true"
 	flags.Lookup("logtostderr").NoOptDefVal = "true"
 	flags.BoolVar(&options.submitCW, "cloudwatch", true, "a bool")
+	flags.StringVar(&options.scrapeMode, "scrape-mode", string(metrics.ScrapeModeAuto),
+		"how to scrape the aws-node pods: auto, direct or proxy")
+	flags.StringVar(&options.aggregation, "aggregation-rules", "",
+		"comma separated <metric>=<sum|max|avg> rules to aggregate the gauges of the nodes, sum by default")
+	flags.BoolVar(&options.byNodegroup, "aggregate-by-nodegroup", false, "also publish the metrics of each nodegroup")
+	flags.StringVar(&options.nodegroupKey, "nodegroup-label", metrics.DefaultNodegroupLabel,
+		"node label holding the nodegroup of a node")
+	flags.Float64Var(&options.ipThreshold, "ip-utilization-threshold", metrics.DefaultIPUtilizationThreshold,
+		"IP utilization, in percent, above which a node is counted in nodesAboveIPUtilizationThreshold")
 
 	flags.Usage = func() {
 		_, _ = fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
@@ -77,7 +92,41 @@ func main() {
 		}
 	}
 
-	glog.Infof("Starting CNIMetricsHelper. Sending metrics to CloudWatch: %v", options.submitCW)
+	if modeENV, found := os.LookupEnv("SCRAPE_MODE"); found {
+		options.scrapeMode = modeENV
+	}
+	scrapeMode, err := metrics.ParseScrapeMode(options.scrapeMode)
+	if err != nil {
+		glog.Fatalf("Error on parsing scrape mode: %s", err)
+	}
+
+	if rulesENV, found := os.LookupEnv("AGGREGATION_RULES"); found {
+		options.aggregation = rulesENV
+	}
+	rules, err := metrics.ParseAggregationRules(options.aggregation)
+	if err != nil {
+		glog.Fatalf("Error on parsing aggregation rules: %s", err)
+	}
+	nodegroupENV, found := os.LookupEnv("AGGREGATE_BY_NODEGROUP")
+	if found {
+		if strings.Compare(nodegroupENV, "yes") == 0 || strings.Compare(nodegroupENV, "true") == 0 {
+			options.byNodegroup = true
+		}
+		if strings.Compare(nodegroupENV, "no") == 0 || strings.Compare(nodegroupENV, "false") == 0 {
+			options.byNodegroup = false
+		}
+	}
+	if labelENV, found := os.LookupEnv("NODEGROUP_LABEL"); found {
+		options.nodegroupKey = labelENV
+	}
+	if thresholdENV, found := os.LookupEnv("IP_UTILIZATION_THRESHOLD"); found {
+		options.ipThreshold, err = strconv.ParseFloat(thresholdENV, 64)
+		if err != nil {
+			glog.Fatalf("Error on parsing IP_UTILIZATION_THRESHOLD: %s", err)
+		}
+	}
+
+	glog.Infof("Starting CNIMetricsHelper. Sending metrics to CloudWatch: %v, scrape mode: %s", options.submitCW, scrapeMode)
 
 	kubeClient, err := k8sapi.CreateKubeClient()
 	if err != nil {
@@ -104,7 +153,13 @@ func main() {
 	}
 
 	var cniMetric *metrics.CNIMetricsTarget
-	cniMetric = metrics.CNIMetricsNew(kubeClient, cw, discoverController, options.submitCW)
+	cniMetric = metrics.CNIMetricsNew(kubeClient, cw, discoverController, options.submitCW, scrapeMode,
+		metrics.AggregationConfig{
+			Rules:                  rules,
+			ByNodegroup:            options.byNodegroup,
+			NodegroupLabel:         options.nodegroupKey,
+			IPUtilizationThreshold: options.ipThreshold,
+		})
 
 	// metric loop
 	var pullInterval = 30 // seconds
@@ -0,0 +1,278 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metrics
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/publisher"
+)
+
+// AggregationType defines how the values of a gauge on each node are combined
+type AggregationType string
+
+const (
+	// AggregateSum adds up the values of the nodes
+	AggregateSum AggregationType = "sum"
+	// AggregateMax keeps the highest value of the nodes
+	AggregateMax AggregationType = "max"
+	// AggregateAvg averages the values of the nodes
+	AggregateAvg AggregationType = "avg"
+)
+
+const (
+	// DefaultNodegroupLabel is the node label holding the name of the nodegroup of a node
+	DefaultNodegroupLabel = "eks.amazonaws.com/nodegroup"
+	// DefaultIPUtilizationThreshold is the IP utilization, in percent, above which a node is counted in
+	// nodesAboveIPUtilizationThreshold
+	DefaultIPUtilizationThreshold = 90.0
+
+	// nodegroupDimension is the CloudWatch dimension of the per nodegroup metrics
+	nodegroupDimension = "NODEGROUP"
+	// unlabeledNodegroup groups the nodes which do not have the nodegroup label
+	unlabeledNodegroup = "none"
+
+	assignedIPsMetric = "awscni_assigned_ip_addresses"
+	maxIPsMetric      = "awscni_ip_max"
+)
+
+// AggregationConfig defines how the metrics of the nodes are aggregated before being published
+type AggregationConfig struct {
+	// Rules maps CloudWatch metric names of gauges to the way their values are aggregated, sum by default
+	Rules map[string]AggregationType
+	// ByNodegroup also publishes the gauges and derived metrics of each nodegroup
+	ByNodegroup bool
+	// NodegroupLabel is the node label holding the name of the nodegroup of a node
+	NodegroupLabel string
+	// IPUtilizationThreshold is the IP utilization, in percent, above which a node is counted as running out of IPs
+	IPUtilizationThreshold float64
+}
+
+// ParseAggregationRules parses a comma separated list of <CloudWatch metric>=<sum|max|avg>
+func ParseAggregationRules(s string) (map[string]AggregationType, error) {
+	known := make(map[string]bool)
+	for _, convert := range InterestingCNIMetrics {
+		for _, action := range convert.actions {
+			known[action.cwMetricName] = true
+		}
+	}
+
+	rules := make(map[string]AggregationType)
+	for _, rule := range strings.Split(s, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid aggregation rule %q, must be <metric>=<sum|max|avg>", rule)
+		}
+		name := strings.TrimSpace(parts[0])
+		if !known[name] {
+			return nil, errors.Errorf("invalid aggregation rule %q, unknown metric %s", rule, name)
+		}
+		switch how := AggregationType(strings.ToLower(strings.TrimSpace(parts[1]))); how {
+		case AggregateSum, AggregateMax, AggregateAvg:
+			rules[name] = how
+		default:
+			return nil, errors.Errorf("invalid aggregation rule %q, must be one of sum, max or avg", rule)
+		}
+	}
+	return rules, nil
+}
+
+// aggregation keeps the gauges of each target of a poll to aggregate them per cluster and per nodegroup
+type aggregation struct {
+	config AggregationConfig
+	// nodegroupOf returns the nodegroup of the node a target runs on
+	nodegroupOf func(target string) string
+	// samples maps each target to the values of its gauges in the current poll
+	samples map[string]map[string]float64
+}
+
+func newAggregation(config AggregationConfig, nodegroupOf func(target string) string) *aggregation {
+	return &aggregation{
+		config:      config,
+		nodegroupOf: nodegroupOf,
+		samples:     make(map[string]map[string]float64),
+	}
+}
+
+func (a *aggregation) reset() {
+	a.samples = make(map[string]map[string]float64)
+}
+
+// observe records the gauges of a target, adding up their series
+func (a *aggregation) observe(target string, families map[string]*dto.MetricFamily) {
+	values := make(map[string]float64)
+	for name, family := range families {
+		if family.GetType() != dto.MetricType_GAUGE {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			values[name] += metric.GetGauge().GetValue()
+		}
+	}
+	a.samples[target] = values
+}
+
+// clusterTargets returns all the targets of the poll
+func (a *aggregation) clusterTargets() []string {
+	targets := make([]string, 0, len(a.samples))
+	for target := range a.samples {
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// groups returns the targets of the poll under "" for the whole cluster and, when enabled, by nodegroup
+func (a *aggregation) groups() map[string][]string {
+	groups := map[string][]string{"": a.clusterTargets()}
+	for target := range a.samples {
+		if !a.config.ByNodegroup {
+			continue
+		}
+		group := a.nodegroupOf(target)
+		if group == "" {
+			group = unlabeledNodegroup
+		}
+		groups[group] = append(groups[group], target)
+	}
+	return groups
+}
+
+// aggregate combines the values of metric on targets, it returns false when none of them reported it
+func (a *aggregation) aggregate(metric string, how AggregationType, targets []string) (float64, bool) {
+	var result float64
+	count := 0
+	for _, target := range targets {
+		value, ok := a.samples[target][metric]
+		if !ok {
+			continue
+		}
+		switch {
+		case count == 0:
+			result = value
+		case how == AggregateMax:
+			if value > result {
+				result = value
+			}
+		default:
+			result += value
+		}
+		count++
+	}
+	if count == 0 {
+		return 0, false
+	}
+	if how == AggregateAvg {
+		result /= float64(count)
+	}
+	return result, true
+}
+
+// ipUtilization returns the percentage of the IPs the targets can assign that are assigned, and how many of the
+// targets are above the utilization threshold
+func (a *aggregation) ipUtilization(targets []string) (float64, int) {
+	var assigned, max float64
+	above := 0
+	for _, target := range targets {
+		nodeAssigned, nodeMax := a.samples[target][assignedIPsMetric], a.samples[target][maxIPsMetric]
+		if nodeMax <= 0 {
+			continue
+		}
+		assigned += nodeAssigned
+		max += nodeMax
+		if nodeAssigned/nodeMax*100 > a.config.IPUtilizationThreshold {
+			above++
+		}
+	}
+	if max == 0 {
+		return 0, above
+	}
+	return assigned / max * 100, above
+}
+
+// rule returns how the gauge published as cwMetricName is aggregated
+func (a *aggregation) rule(cwMetricName string) AggregationType {
+	if how, ok := a.config.Rules[cwMetricName]; ok {
+		return how
+	}
+	return AggregateSum
+}
+
+// produceAggregatedMetrics publishes the derived metrics of the cluster and, when enabled, the gauges and derived
+// metrics of each nodegroup
+func produceAggregatedMetrics(t metricsTarget, a *aggregation, families map[string]*dto.MetricFamily,
+	convertDef map[string]metricsConvert, cw publisher.Publisher) {
+	groups := a.groups()
+	names := make([]string, 0, len(groups))
+	for group := range groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+
+	for _, group := range names {
+		targets := groups[group]
+		var dimensions []*cloudwatch.Dimension
+		if group != "" {
+			dimensions = []*cloudwatch.Dimension{{Name: aws.String(nodegroupDimension), Value: aws.String(group)}}
+
+			for key, family := range families {
+				if family.GetType() != dto.MetricType_GAUGE {
+					continue
+				}
+				for _, action := range convertDef[key].actions {
+					value, ok := a.aggregate(key, a.rule(action.cwMetricName), targets)
+					if !ok {
+						continue
+					}
+					glog.Infof("Produce GAUGE metrics: %s, nodegroup: %s, value: %f", action.cwMetricName, group, value)
+					if t.submitCloudWatch() {
+						cw.Publish(&cloudwatch.MetricDatum{
+							MetricName: aws.String(action.cwMetricName),
+							Unit:       aws.String(cloudwatch.StandardUnitCount),
+							Value:      aws.Float64(value),
+							Dimensions: dimensions,
+						})
+					}
+				}
+			}
+		}
+
+		utilization, above := a.ipUtilization(targets)
+		glog.Infof("Produce derived metrics, nodegroup: %q, ipUtilization: %f, nodesAboveIPUtilizationThreshold: %d",
+			group, utilization, above)
+		if t.submitCloudWatch() {
+			cw.Publish(&cloudwatch.MetricDatum{
+				MetricName: aws.String("ipUtilization"),
+				Unit:       aws.String(cloudwatch.StandardUnitPercent),
+				Value:      aws.Float64(utilization),
+				Dimensions: dimensions,
+			}, &cloudwatch.MetricDatum{
+				MetricName: aws.String("nodesAboveIPUtilizationThreshold"),
+				Unit:       aws.String(cloudwatch.StandardUnitCount),
+				Value:      aws.Float64(float64(above)),
+				Dimensions: dimensions,
+			})
+		}
+	}
+}
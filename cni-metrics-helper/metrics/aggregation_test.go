@@ -0,0 +1,151 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/publisher"
+)
+
+type recordingPublisher struct {
+	data []*cloudwatch.MetricDatum
+}
+
+func (p *recordingPublisher) Publish(metricDataPoints ...*cloudwatch.MetricDatum) {
+	p.data = append(p.data, metricDataPoints...)
+}
+
+func (p *recordingPublisher) Start() {}
+
+func (p *recordingPublisher) Stop() {}
+
+func (p *recordingPublisher) find(name, nodegroup string) (float64, bool) {
+	for _, datum := range p.data {
+		group := ""
+		for _, dimension := range datum.Dimensions {
+			if aws.StringValue(dimension.Name) == nodegroupDimension {
+				group = aws.StringValue(dimension.Value)
+			}
+		}
+		if aws.StringValue(datum.MetricName) == name && group == nodegroup {
+			return aws.Float64Value(datum.Value), true
+		}
+	}
+	return 0, false
+}
+
+type aggregationTestTarget struct {
+	testMetricsTarget
+	agg *aggregation
+	cw  *recordingPublisher
+}
+
+func (target *aggregationTestTarget) getCWMetricsPublisher() publisher.Publisher {
+	return target.cw
+}
+
+func (target *aggregationTestTarget) submitCloudWatch() bool {
+	return true
+}
+
+func (target *aggregationTestTarget) getAggregation() *aggregation {
+	return target.agg
+}
+
+func TestParseAggregationRules(t *testing.T) {
+	rules, err := ParseAggregationRules("assignIPAddresses=avg, eniAllocated=MAX")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]AggregationType{"assignIPAddresses": AggregateAvg, "eniAllocated": AggregateMax}, rules)
+
+	_, err = ParseAggregationRules("assignIPAddresses=median")
+	assert.Error(t, err)
+	_, err = ParseAggregationRules("unknownMetric=sum")
+	assert.Error(t, err)
+	_, err = ParseAggregationRules("assignIPAddresses")
+	assert.Error(t, err)
+}
+
+func TestAggregation(t *testing.T) {
+	nodegroups := map[string]string{"node-a": "ng-1", "node-b": "ng-1", "node-c": "ng-2", "node-d": ""}
+	agg := newAggregation(AggregationConfig{
+		Rules:                  map[string]AggregationType{"assignIPAddresses": AggregateAvg, "totalIPAddresses": AggregateMax},
+		ByNodegroup:            true,
+		IPUtilizationThreshold: DefaultIPUtilizationThreshold,
+	}, func(target string) string { return nodegroups[target] })
+	agg.samples = map[string]map[string]float64{
+		"node-a": {assignedIPsMetric: 28, "awscni_total_ip_addresses": 30, maxIPsMetric: 29},
+		"node-b": {assignedIPsMetric: 2, "awscni_total_ip_addresses": 10, maxIPsMetric: 29},
+		"node-c": {assignedIPsMetric: 10, "awscni_total_ip_addresses": 20, maxIPsMetric: 10},
+		"node-d": {assignedIPsMetric: 0, "awscni_total_ip_addresses": 5, maxIPsMetric: 0},
+	}
+
+	value, ok := agg.aggregate(assignedIPsMetric, AggregateSum, agg.clusterTargets())
+	assert.True(t, ok)
+	assert.Equal(t, 40.0, value)
+	value, _ = agg.aggregate(assignedIPsMetric, AggregateAvg, agg.clusterTargets())
+	assert.Equal(t, 10.0, value)
+	value, _ = agg.aggregate("awscni_total_ip_addresses", AggregateMax, agg.clusterTargets())
+	assert.Equal(t, 30.0, value)
+	_, ok = agg.aggregate("awscni_eni_allocated", AggregateSum, agg.clusterTargets())
+	assert.False(t, ok)
+
+	// node-a and node-c are above 90% of their IPs, node-d cannot assign any IP and is left out
+	utilization, above := agg.ipUtilization(agg.clusterTargets())
+	assert.InDelta(t, 40.0/68*100, utilization, 0.001)
+	assert.Equal(t, 2, above)
+
+	groups := agg.groups()
+	assert.Len(t, groups, 4)
+	assert.ElementsMatch(t, []string{"node-a", "node-b"}, groups["ng-1"])
+	assert.Equal(t, []string{"node-d"}, groups[unlabeledNodegroup])
+}
+
+func TestProduceAggregatedMetrics(t *testing.T) {
+	target := &aggregationTestTarget{
+		// Own definitions, to not touch the counters of InterestingCNIMetrics
+		testMetricsTarget: *newTestMetricsTarget("cni_test1.data", map[string]metricsConvert{
+			"awscni_assigned_ip_addresses": {actions: []metricsAction{{cwMetricName: "assignIPAddresses",
+				matchFunc: matchAny, actionFunc: metricsAdd, data: &dataPoints{}}}},
+			"awscni_total_ip_addresses": {actions: []metricsAction{{cwMetricName: "totalIPAddresses",
+				matchFunc: matchAny, actionFunc: metricsAdd, data: &dataPoints{}}}},
+		}),
+		agg: newAggregation(AggregationConfig{
+			Rules:                  map[string]AggregationType{"totalIPAddresses": AggregateMax},
+			ByNodegroup:            true,
+			IPUtilizationThreshold: DefaultIPUtilizationThreshold,
+		}, func(target string) string { return "ng-1" }),
+		cw: &recordingPublisher{},
+	}
+
+	Handler(target)
+
+	for _, nodegroup := range []string{"", "ng-1"} {
+		value, ok := target.cw.find("assignIPAddresses", nodegroup)
+		assert.True(t, ok)
+		assert.Equal(t, 1.0, value)
+		value, ok = target.cw.find("totalIPAddresses", nodegroup)
+		assert.True(t, ok)
+		assert.Equal(t, 10.0, value)
+		_, ok = target.cw.find("ipUtilization", nodegroup)
+		assert.True(t, ok)
+		value, ok = target.cw.find("nodesAboveIPUtilizationThreshold", nodegroup)
+		assert.True(t, ok)
+		assert.Equal(t, 0.0, value)
+	}
+}
@@ -15,6 +15,9 @@
 package metrics
 
 import (
+	"net/http"
+	"sync"
+
 	"github.com/golang/glog"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	clientset "k8s.io/client-go/kubernetes"
@@ -72,6 +75,20 @@ var InterestingCNIMetrics = map[string]metricsConvert{
 				actionFunc: metricsAdd,
 				data:       &dataPoints{},
 				logToFile:  true}}},
+	"awscni_ec2_api_errors_total": {
+		actions: []metricsAction{
+			{cwMetricName: "ec2APIErr",
+				matchFunc:  matchAny,
+				actionFunc: metricsAdd,
+				data:       &dataPoints{},
+				logToFile:  true}}},
+	"awscni_ec2_api_throttles_total": {
+		actions: []metricsAction{
+			{cwMetricName: "ec2APIThrottle",
+				matchFunc:  matchAny,
+				actionFunc: metricsAdd,
+				data:       &dataPoints{},
+				logToFile:  true}}},
 	"awscni_aws_utils_error_count": {
 		actions: []metricsAction{
 			{cwMetricName: "awsUtilErr",
@@ -124,22 +141,61 @@ type CNIMetricsTarget struct {
 	cniPods             []string
 	discoveryController *k8sapi.Controller
 	submitCW            bool
+	scrapeMode          ScrapeMode
+	httpClient          *http.Client
+	port                int
+	aggregation         *aggregation
+	// podNodes maps the scraped pods to their node, and nodegroups the nodes to their nodegroup
+	podNodes   sync.Map
+	nodegroups sync.Map
+	// proxiedPods remembers the pods already reported as unreachable directly, to only log the fallback once
+	proxiedPods sync.Map
 }
 
 // CNIMetricsNew creates a new metricsTarget
-func CNIMetricsNew(c clientset.Interface, cw publisher.Publisher, d *k8sapi.Controller, submitCW bool) *CNIMetricsTarget {
-	return &CNIMetricsTarget{
+func CNIMetricsNew(c clientset.Interface, cw publisher.Publisher, d *k8sapi.Controller, submitCW bool, scrapeMode ScrapeMode,
+	aggregationConfig AggregationConfig) *CNIMetricsTarget {
+	t := &CNIMetricsTarget{
 		interestingMetrics:  InterestingCNIMetrics,
 		cwMetricsPublisher:  cw,
 		kubeClient:          c,
 		discoveryController: d,
 		submitCW:            submitCW,
+		scrapeMode:          scrapeMode,
+		httpClient:          &http.Client{Timeout: directScrapeTimeout},
+		port:                metricsPort,
 	}
+	t.aggregation = newAggregation(aggregationConfig, t.nodegroupOf)
+	return t
 }
 
 func (t *CNIMetricsTarget) grabMetricsFromTarget(cniPod string) ([]byte, error) {
 	glog.Infof("Grabbing metrics from CNI: %s", cniPod)
-	output, err := getMetricsFromPod(t.kubeClient, cniPod, metav1.NamespaceSystem, metricsPort)
+	pod, err := t.kubeClient.CoreV1().Pods(metav1.NamespaceSystem).Get(cniPod, metav1.GetOptions{})
+	if err != nil {
+		glog.Errorf("grabMetricsFromTarget: Failed to get CNI pod %s: %v", cniPod, err)
+		return nil, err
+	}
+	if err = verifyCNIPod(pod); err != nil {
+		glog.Errorf("grabMetricsFromTarget: Refusing to scrape %s: %v", cniPod, err)
+		return nil, err
+	}
+
+	t.podNodes.Store(cniPod, pod.Spec.NodeName)
+
+	var output []byte
+	if t.scrapeMode != ScrapeModeProxy {
+		output, err = getMetricsDirect(t.httpClient, pod.Status.PodIP, t.port)
+		if err != nil && t.scrapeMode == ScrapeModeAuto {
+			if _, logged := t.proxiedPods.LoadOrStore(cniPod, true); !logged {
+				glog.Warningf("grabMetricsFromTarget: Failed to scrape %s directly, falling back to the API server proxy: %v",
+					cniPod, err)
+			}
+		}
+	}
+	if t.scrapeMode == ScrapeModeProxy || (err != nil && t.scrapeMode == ScrapeModeAuto) {
+		output, err = getMetricsFromPod(t.kubeClient, cniPod, metav1.NamespaceSystem, t.port)
+	}
 	if err != nil {
 		glog.Errorf("grabMetricsFromTarget: Failed to grab CNI endpoint: %v", err)
 		return nil, err
@@ -165,3 +221,26 @@ func (t *CNIMetricsTarget) getTargetList() []string {
 func (t *CNIMetricsTarget) submitCloudWatch() bool {
 	return t.submitCW
 }
+
+func (t *CNIMetricsTarget) getAggregation() *aggregation {
+	return t.aggregation
+}
+
+// nodegroupOf returns the nodegroup of the node the CNI pod runs on, the label of a node is only read once
+func (t *CNIMetricsTarget) nodegroupOf(cniPod string) string {
+	nodeName, ok := t.podNodes.Load(cniPod)
+	if !ok {
+		return ""
+	}
+	if group, ok := t.nodegroups.Load(nodeName); ok {
+		return group.(string)
+	}
+	node, err := t.kubeClient.CoreV1().Nodes().Get(nodeName.(string), metav1.GetOptions{})
+	if err != nil {
+		glog.Errorf("nodegroupOf: Failed to get node %s: %v", nodeName, err)
+		return ""
+	}
+	group := node.Labels[t.aggregation.config.NodegroupLabel]
+	t.nodegroups.Store(nodeName, group)
+	return group
+}
@@ -22,6 +22,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/golang/glog"
+	"github.com/pkg/errors"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 	clientset "k8s.io/client-go/kubernetes"
@@ -38,6 +39,7 @@ type metricsTarget interface {
 	getCWMetricsPublisher() publisher.Publisher
 	getTargetList() []string
 	submitCloudWatch() bool
+	getAggregation() *aggregation
 }
 
 type metricsConvert struct {
@@ -347,12 +349,16 @@ func produceCloudWatchMetrics(t metricsTarget, families map[string]*dto.MetricFa
 					cw.Publish(dataPoint)
 				}
 			case dto.MetricType_GAUGE:
-				glog.Infof("Produce GAUGE metrics: %s, value: %f", action.cwMetricName, action.data.curSingleDataPoint)
+				value := action.data.curSingleDataPoint
+				if agg := t.getAggregation(); agg != nil {
+					value, _ = agg.aggregate(key, agg.rule(action.cwMetricName), agg.clusterTargets())
+				}
+				glog.Infof("Produce GAUGE metrics: %s, value: %f", action.cwMetricName, value)
 				if t.submitCloudWatch() {
 					dataPoint := &cloudwatch.MetricDatum{
 						MetricName: aws.String(action.cwMetricName),
 						Unit:       aws.String(cloudwatch.StandardUnitCount),
-						Value:      aws.Float64(action.data.curSingleDataPoint),
+						Value:      aws.Float64(value),
 					}
 					cw.Publish(dataPoint)
 				}
@@ -395,10 +401,18 @@ func metricsListGrabAggregateConvert(t metricsTarget) (map[string]*dto.MetricFam
 
 	interestingMetrics := t.getInterestingMetrics()
 	resetMetrics(interestingMetrics)
+	agg := t.getAggregation()
+	if agg != nil {
+		agg.reset()
+	}
 
 	targetList := t.getTargetList()
 	glog.Info("targetList: ", targetList)
 	glog.Info("len(targetList)", len(targetList))
+	if len(targetList) == 0 {
+		return nil, nil, true, errors.New("no CNI pods to scrape")
+	}
+	scraped := 0
 	for _, target := range targetList {
 		glog.Infof("Grab/Aggregate metrics from %v", target)
 		rawOutput, err := t.grabMetricsFromTarget(target)
@@ -407,6 +421,7 @@ func metricsListGrabAggregateConvert(t metricsTarget) (map[string]*dto.MetricFam
 			// it may take times to remove some metric targets
 			continue
 		}
+		scraped++
 
 		parser := &expfmt.TextParser{}
 		origFamilies, err := parser.TextToMetricFamilies(bytes.NewReader(rawOutput))
@@ -421,6 +436,9 @@ func metricsListGrabAggregateConvert(t metricsTarget) (map[string]*dto.MetricFam
 			glog.Warning("Failed to filter metrics:", err)
 			return nil, nil, true, err
 		}
+		if agg != nil {
+			agg.observe(target, families)
+		}
 
 		for _, family := range families {
 			convert := interestingMetrics[family.GetName()]
@@ -434,6 +452,10 @@ func metricsListGrabAggregateConvert(t metricsTarget) (map[string]*dto.MetricFam
 		}
 	}
 
+	if scraped == 0 {
+		return nil, nil, true, errors.Errorf("failed to scrape any of the %d CNI pods", len(targetList))
+	}
+
 	// TODO resetDetected is NOT right for cniMetrics, so force it for now
 	if len(targetList) > 1 {
 		resetDetected = false
@@ -446,10 +468,17 @@ func metricsListGrabAggregateConvert(t metricsTarget) (map[string]*dto.MetricFam
 func Handler(t metricsTarget) {
 	families, interestingMetrics, resetDetected, err := metricsListGrabAggregateConvert(t)
 
-	if err != nil || resetDetected {
-		glog.Info("Skipping 1st poll after reset, error:", err)
+	if err != nil {
+		glog.Errorf("Not publishing metrics: %v", err)
+		return
+	}
+	if resetDetected {
+		glog.Info("Skipping 1st poll after reset")
 	}
 
 	cw := t.getCWMetricsPublisher()
 	produceCloudWatchMetrics(t, families, interestingMetrics, cw)
+	if agg := t.getAggregation(); agg != nil {
+		produceAggregatedMetrics(t, agg, families, interestingMetrics, cw)
+	}
 }
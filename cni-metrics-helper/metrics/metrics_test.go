@@ -56,6 +56,10 @@ func (target *testMetricsTarget) submitCloudWatch() bool {
 	return false
 }
 
+func (target *testMetricsTarget) getAggregation() *aggregation {
+	return nil
+}
+
 func TestAPIServerMetric(t *testing.T) {
 	testTarget := newTestMetricsTarget("cni_test1.data", InterestingCNIMetrics)
 
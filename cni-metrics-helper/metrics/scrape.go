@@ -0,0 +1,94 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// cniDaemonSetName is the name of the daemon set that runs ipamd
+	cniDaemonSetName = "aws-node"
+	// cniServiceAccountName is the service account the aws-node pods run as
+	cniServiceAccountName = "aws-node"
+	// directScrapeTimeout is how long to wait for a pod to answer a direct scrape
+	directScrapeTimeout = 5 * time.Second
+)
+
+// ScrapeMode defines how the metrics of the aws-node pods are fetched
+type ScrapeMode string
+
+const (
+	// ScrapeModeAuto scrapes the pods directly and falls back to the API server proxy when they cannot be reached
+	ScrapeModeAuto ScrapeMode = "auto"
+	// ScrapeModeDirect only scrapes the pods directly on their pod IP
+	ScrapeModeDirect ScrapeMode = "direct"
+	// ScrapeModeProxy only scrapes the pods through the API server proxy
+	ScrapeModeProxy ScrapeMode = "proxy"
+)
+
+// ParseScrapeMode returns the scrape mode named by s
+func ParseScrapeMode(s string) (ScrapeMode, error) {
+	switch mode := ScrapeMode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case ScrapeModeAuto, ScrapeModeDirect, ScrapeModeProxy:
+		return mode, nil
+	}
+	return "", errors.Errorf("invalid scrape mode %q, must be one of auto, direct or proxy", s)
+}
+
+// verifyCNIPod makes sure pod is an ipamd pod of the aws-node daemon set running as the aws-node service account,
+// so that pods which merely share the name prefix are never scraped
+func verifyCNIPod(pod *v1.Pod) error {
+	if pod.Namespace != "kube-system" {
+		return errors.Errorf("pod %s is in namespace %s, not kube-system", pod.Name, pod.Namespace)
+	}
+	owned := false
+	for _, owner := range pod.OwnerReferences {
+		if owner.Kind == "DaemonSet" && owner.Name == cniDaemonSetName {
+			owned = true
+			break
+		}
+	}
+	if !owned {
+		return errors.Errorf("pod %s is not owned by the %s daemon set", pod.Name, cniDaemonSetName)
+	}
+	if pod.Spec.ServiceAccountName != cniServiceAccountName {
+		return errors.Errorf("pod %s runs as service account %q, not %s",
+			pod.Name, pod.Spec.ServiceAccountName, cniServiceAccountName)
+	}
+	if pod.Status.Phase != v1.PodRunning || pod.Status.PodIP == "" {
+		return errors.Errorf("pod %s is not running", pod.Name)
+	}
+	return nil
+}
+
+// getMetricsDirect scrapes the metrics endpoint of ipamd on the pod IP
+func getMetricsDirect(client *http.Client, podIP string, port int) ([]byte, error) {
+	resp, err := client.Get(fmt.Sprintf("http://%s:%d/metrics", podIP, port))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
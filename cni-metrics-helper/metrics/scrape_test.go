@@ -0,0 +1,102 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func cniPod(name, podIP string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       metav1.NamespaceSystem,
+			OwnerReferences: []metav1.OwnerReference{{Kind: "DaemonSet", Name: cniDaemonSetName}},
+		},
+		Spec:   v1.PodSpec{ServiceAccountName: cniServiceAccountName},
+		Status: v1.PodStatus{Phase: v1.PodRunning, PodIP: podIP},
+	}
+}
+
+func TestVerifyCNIPod(t *testing.T) {
+	assert.NoError(t, verifyCNIPod(cniPod("aws-node-abcde", "10.0.0.1")))
+
+	impostor := cniPod("aws-node-termination-handler-abcde", "10.0.0.2")
+	impostor.OwnerReferences[0].Name = "aws-node-termination-handler"
+	assert.Error(t, verifyCNIPod(impostor))
+
+	wrongAccount := cniPod("aws-node-abcde", "10.0.0.1")
+	wrongAccount.Spec.ServiceAccountName = "default"
+	assert.Error(t, verifyCNIPod(wrongAccount))
+
+	pending := cniPod("aws-node-abcde", "")
+	pending.Status.Phase = v1.PodPending
+	assert.Error(t, verifyCNIPod(pending))
+}
+
+func TestParseScrapeMode(t *testing.T) {
+	mode, err := ParseScrapeMode("Proxy")
+	assert.NoError(t, err)
+	assert.Equal(t, ScrapeModeProxy, mode)
+
+	_, err = ParseScrapeMode("ssh")
+	assert.Error(t, err)
+}
+
+func TestGrabMetricsDirect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/metrics", r.URL.Path)
+		_, _ = w.Write([]byte("awscni_assigned_ip_addresses 3\n"))
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	target := CNIMetricsNew(fake.NewSimpleClientset(cniPod("aws-node-abcde", host)), nil, nil, false, ScrapeModeDirect, AggregationConfig{})
+	target.port, _ = strconv.Atoi(port)
+
+	output, err := target.grabMetricsFromTarget("aws-node-abcde")
+	assert.NoError(t, err)
+	assert.Equal(t, "awscni_assigned_ip_addresses 3\n", string(output))
+
+	// Pods that fail verification are never scraped
+	impostor := cniPod("aws-node-impostor", host)
+	impostor.Spec.ServiceAccountName = "default"
+	target.kubeClient = fake.NewSimpleClientset(impostor)
+	_, err = target.grabMetricsFromTarget("aws-node-impostor")
+	assert.Error(t, err)
+}
+
+type unreachableTarget struct {
+	testMetricsTarget
+}
+
+func (target *unreachableTarget) grabMetricsFromTarget(targetName string) ([]byte, error) {
+	return nil, assert.AnError
+}
+
+func TestNothingScraped(t *testing.T) {
+	target := &unreachableTarget{*newTestMetricsTarget("cni_test1.data", InterestingCNIMetrics)}
+
+	_, _, _, err := metricsListGrabAggregateConvert(target)
+	assert.Error(t, err)
+}
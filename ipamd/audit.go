@@ -0,0 +1,295 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/awsutils"
+)
+
+const (
+	// envAuditInterval is the name of the environment variable with how often the IPs of the ENIs in EC2 are compared
+	// with the datastore and the routes of pods. Defaults to empty, off.
+	envAuditInterval = "AWS_VPC_K8S_CNI_AUDIT_INTERVAL"
+
+	// envAuditHeal is the name of the environment variable that allows the auditor to add the IPs that EC2 has and the
+	// datastore does not to the datastore. The other discrepancies are only reported. Defaults to false.
+	envAuditHeal = "AWS_VPC_K8S_CNI_AUDIT_HEAL"
+)
+
+// The kinds of discrepancies found by an audit
+const (
+	// AuditEC2Only is a secondary IP of an ENI in EC2 that is not in the datastore. It is safe to add.
+	AuditEC2Only = "ec2-only"
+	// AuditDatastoreOnly is an IP in the datastore that the ENI does not have in EC2. A pod using it has no
+	// connectivity.
+	AuditDatastoreOnly = "datastore-only"
+	// AuditENINotInEC2 is an ENI in the datastore that EC2 does not know
+	AuditENINotInEC2 = "eni-not-in-ec2"
+	// AuditENINotInDatastore is an ENI attached to the instance that is not in the datastore
+	AuditENINotInDatastore = "eni-not-in-datastore"
+	// AuditKernelMissing is an IP assigned to a pod in the datastore without a host route to a veth
+	AuditKernelMissing = "kernel-missing"
+	// AuditKernelOnly is a host route to a veth for an IP that no pod in the datastore has
+	AuditKernelOnly = "kernel-only"
+)
+
+var auditKinds = []string{AuditEC2Only, AuditDatastoreOnly, AuditENINotInEC2, AuditENINotInDatastore, AuditKernelMissing,
+	AuditKernelOnly}
+
+var auditDiscrepancies = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "awscni_audit_discrepancies",
+		Help: "The number of discrepancies between EC2, the datastore and the kernel found by the last audit",
+	},
+	[]string{"kind"},
+)
+
+// AuditDiscrepancy is a difference between EC2, the datastore and the kernel
+type AuditDiscrepancy struct {
+	Kind string
+	ENI  string `json:",omitempty"`
+	IP   string `json:",omitempty"`
+	// Pod is the name_namespace_container key of the pod using the IP in the datastore
+	Pod    string `json:",omitempty"`
+	Healed bool   `json:",omitempty"`
+}
+
+// AuditReport is the outcome of an audit, as shown by the introspection endpoint
+type AuditReport struct {
+	Time          time.Time
+	Duration      string
+	ENIs          int
+	Discrepancies []AuditDiscrepancy
+	// Errors are the ENIs that could not be audited
+	Errors []string `json:",omitempty"`
+}
+
+// auditState holds the last audit, which runs periodically or on demand
+type auditState struct {
+	// lock serializes the audits
+	lock sync.Mutex
+	last *AuditReport
+}
+
+func getAuditInterval() time.Duration {
+	value := os.Getenv(envAuditInterval)
+	if value == "" {
+		return 0
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval < 0 {
+		log.Errorf("Failed to parse %s %q, auditing is off", envAuditInterval, value)
+		return 0
+	}
+	return interval
+}
+
+func auditHealEnabled() bool {
+	return getEnvBoolWithDefault(envAuditHeal, false)
+}
+
+// StartAuditor periodically audits the IPs of the node, if an interval is set
+func (c *IPAMContext) StartAuditor() {
+	interval := getAuditInterval()
+	if interval == 0 {
+		return
+	}
+	log.Infof("Started auditing the IPs of the node every %v", interval)
+	for {
+		time.Sleep(interval)
+		c.audit()
+	}
+}
+
+// getAuditReport returns the last audit, or nil if none ran
+func (c *IPAMContext) getAuditReport() *AuditReport {
+	c.auditor.lock.Lock()
+	defer c.auditor.lock.Unlock()
+	return c.auditor.last
+}
+
+// audit compares the secondary IPs of the ENIs in EC2 with the datastore, and the IPs of pods in the datastore with
+// their host routes, then reports the discrepancies in metrics and the introspection endpoint
+func (c *IPAMContext) audit() *AuditReport {
+	c.auditor.lock.Lock()
+	defer c.auditor.lock.Unlock()
+
+	start := time.Now()
+	report := &AuditReport{Time: start, Discrepancies: []AuditDiscrepancy{}}
+	c.auditENIs(report)
+	c.auditKernel(report)
+	sort.SliceStable(report.Discrepancies, func(i, j int) bool {
+		a, b := report.Discrepancies[i], report.Discrepancies[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.ENI != b.ENI {
+			return a.ENI < b.ENI
+		}
+		return a.IP < b.IP
+	})
+	report.Duration = time.Since(start).String()
+
+	counts := make(map[string]int)
+	for _, discrepancy := range report.Discrepancies {
+		if !discrepancy.Healed {
+			counts[discrepancy.Kind]++
+		}
+	}
+	for _, kind := range auditKinds {
+		auditDiscrepancies.WithLabelValues(kind).Set(float64(counts[kind]))
+	}
+	c.recordMismatches(counts[AuditKernelMissing] + counts[AuditKernelOnly])
+	if len(report.Discrepancies) > 0 {
+		log.Warnf("Audit found %d discrepancies between EC2, the datastore and the kernel: %v",
+			len(report.Discrepancies), counts)
+	} else {
+		log.Debugf("Audit of %d ENIs found no discrepancies", report.ENIs)
+	}
+	c.auditor.last = report
+	return report
+}
+
+// auditENIs compares the IPv4 addresses of the ENIs in EC2 with the datastore
+func (c *IPAMContext) auditENIs(report *AuditReport) {
+	eniInfos := c.dataStore.GetENIInfos()
+	enis := make(map[string]bool, len(eniInfos.ENIIPPools))
+	for eni := range eniInfos.ENIIPPools {
+		enis[eni] = true
+	}
+	attached, err := c.awsClient.GetAttachedENIs()
+	if err != nil {
+		report.Errors = append(report.Errors, errors.Wrap(err, "failed to get the attached ENIs").Error())
+	}
+	for _, eni := range attached {
+		if !enis[eni.ENIID] {
+			report.Discrepancies = append(report.Discrepancies, AuditDiscrepancy{Kind: AuditENINotInDatastore, ENI: eni.ENIID})
+		}
+	}
+
+	podIPs := c.podIPsByAddress()
+	heal := auditHealEnabled()
+	for eni := range enis {
+		report.ENIs++
+		ec2Addrs, _, err := c.awsClient.DescribeENI(eni)
+		if err == awsutils.ErrENINotFound {
+			report.Discrepancies = append(report.Discrepancies, AuditDiscrepancy{Kind: AuditENINotInEC2, ENI: eni})
+			continue
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, errors.Wrapf(err, "failed to describe ENI %s", eni).Error())
+			continue
+		}
+		ec2IPs := make(map[string]bool, len(ec2Addrs))
+		for _, ec2Addr := range ec2Addrs {
+			ec2IPs[aws.StringValue(ec2Addr.PrivateIpAddress)] = true
+		}
+
+		pool := eniInfos.ENIIPPools[eni]
+		for ip := range ec2IPs {
+			if pool.IPv4Address(ip) != nil || ip == c.primaryIP[eni] || c.auditSkipsIP(ip) {
+				continue
+			}
+			discrepancy := AuditDiscrepancy{Kind: AuditEC2Only, ENI: eni, IP: ip}
+			if heal && c.validateENIAddress(eni, ip) {
+				if err := c.dataStore.AddIPv4AddressFromStore(eni, ip); err != nil {
+					log.Warnf("Audit failed to add IP %s of ENI %s to the datastore: %v", ip, eni, err)
+				} else {
+					log.Infof("Audit added IP %s of ENI %s to the datastore", ip, eni)
+					reconcileCnt.With(prometheus.Labels{"fn": "auditHealIP"}).Inc()
+					discrepancy.Healed = true
+				}
+			}
+			report.Discrepancies = append(report.Discrepancies, discrepancy)
+		}
+		for _, addr := range pool.IPv4Addresses {
+			// The addresses of prefixes are not secondary IPs of the ENI
+			if ip := addr.Address.String(); !addr.Prefix.IsValid() && !ec2IPs[ip] {
+				report.Discrepancies = append(report.Discrepancies,
+					AuditDiscrepancy{Kind: AuditDatastoreOnly, ENI: eni, IP: ip, Pod: podIPs[ip]})
+			}
+		}
+	}
+}
+
+// auditSkipsIP returns whether an IP that EC2 has and the datastore does not is expected: it was just released to EC2,
+// or is quarantined
+func (c *IPAMContext) auditSkipsIP(ip string) bool {
+	if found, recentlyFreed := c.reconcileCooldownCache.RecentlyFreed(ip); found && recentlyFreed {
+		return true
+	}
+	c.quarantine.lock.Lock()
+	defer c.quarantine.lock.Unlock()
+	_, quarantined := c.quarantine.ips[ip]
+	return quarantined
+}
+
+// auditKernel compares the IPs of pods in the datastore with the host routes to veths
+func (c *IPAMContext) auditKernel(report *AuditReport) {
+	veths, err := c.networkClient.GetPodVeths()
+	if err != nil {
+		report.Errors = append(report.Errors, errors.Wrap(err, "failed to list the veths of pods").Error())
+		return
+	}
+	routed := make(map[string]bool)
+	for _, veth := range veths {
+		for _, ip := range veth.IPs {
+			routed[ip.String()] = true
+		}
+	}
+	podIPs := c.podIPsByAddress()
+	for ip, pod := range podIPs {
+		// The IPs reserved for the fast path are routed once the plugin sets up a pod with them
+		if !routed[ip] && !isFastPathPlaceholder(pod) {
+			report.Discrepancies = append(report.Discrepancies, AuditDiscrepancy{Kind: AuditKernelMissing, IP: ip, Pod: pod})
+		}
+	}
+	for ip := range routed {
+		if _, ok := podIPs[ip]; !ok {
+			report.Discrepancies = append(report.Discrepancies, AuditDiscrepancy{Kind: AuditKernelOnly, IP: ip})
+		}
+	}
+}
+
+// podIPsByAddress maps the IPv4 and IPv6 addresses of the pods in the datastore to their keys
+func (c *IPAMContext) podIPsByAddress() map[string]string {
+	podIPs := make(map[string]string)
+	for key, pod := range *c.dataStore.GetPodInfos() {
+		if pod.IP != "" {
+			podIPs[pod.IP] = key
+		}
+		if pod.IPv6 != "" {
+			podIPs[pod.IPv6] = key
+		}
+	}
+	return podIPs
+}
+
+// getAuditConfigForDebug returns the auditor configuration
+func getAuditConfigForDebug() map[string]interface{} {
+	return map[string]interface{}{
+		envAuditInterval: getAuditInterval().String(),
+		envAuditHeal:     auditHealEnabled(),
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"net"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/bgp"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/cidr"
+)
+
+// bgpSyncInterval is how often the advertised pod IPs are refreshed from the datastore
+const bgpSyncInterval = 5 * time.Second
+
+// StartBGPSpeaker advertises the pod IPs of this node to the configured BGP peers, if enabled
+func (c *IPAMContext) StartBGPSpeaker() {
+	if !bgp.Enabled() {
+		return
+	}
+	if !c.networkClient.UseExternalSNAT() {
+		log.Warn("BGP speaker is enabled but SNAT is not disabled, peers will only see pod IPs as traffic destinations")
+	}
+
+	speaker, err := bgp.New(cidr.IP(c.awsClient.GetLocalIPv4()))
+	if err != nil {
+		log.Errorf("Failed to start BGP speaker: %v", err)
+		return
+	}
+	speaker.Start()
+	log.Info("Started BGP speaker")
+
+	for {
+		speaker.SetPrefixes(c.podPrefixes())
+		time.Sleep(bgpSyncInterval)
+	}
+}
+
+// podPrefixes returns a /32 for every IP currently assigned to a pod, without the IPs reserved for the fast path
+func (c *IPAMContext) podPrefixes() []*net.IPNet {
+	var prefixes []*net.IPNet
+	for key, podInfo := range *c.dataStore.GetPodInfos() {
+		ip := net.ParseIP(podInfo.IP)
+		if ip == nil || ip.To4() == nil || isFastPathPlaceholder(key) {
+			continue
+		}
+		prefixes = append(prefixes, &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)})
+	}
+	return prefixes
+}
@@ -0,0 +1,644 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/awsutils"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+)
+
+const (
+	// PodSecurityGroupsAnnotation is the annotation of the pods that get a branch ENI with their own security groups,
+	// a comma separated list of security group IDs
+	PodSecurityGroupsAnnotation = "vpc.amazonaws.com/pod-security-groups"
+
+	// PodENIResourceName is the extended resource of the node set to the number of branch ENIs its trunk ENI has room
+	// for. The pods annotated with security groups request one, so that the scheduler places no more of them on the
+	// node than it can give a branch ENI.
+	PodENIResourceName = "vpc.amazonaws.com/pod-eni"
+
+	// envWarmBranchENITarget is the name of the environment variable that sets how many branch ENIs without a pod are
+	// kept associated with the trunk ENI, so that a pod with security groups only waits for its security groups to be
+	// set on one instead of a branch ENI to be created and associated. Defaults to 0.
+	envWarmBranchENITarget     = "WARM_BRANCH_ENI_TARGET"
+	defaultWarmBranchENITarget = 0
+
+	// envMaxBranchENI is the name of the environment variable that limits the number of branch ENIs of the node below
+	// the one of its instance type, or sets it for an instance type ipamd does not know. Not set or 0, only the limit
+	// of the instance type applies.
+	envMaxBranchENI = "MAX_BRANCH_ENI"
+
+	// minVlanID and maxVlanID are the VLANs the branch ENIs are associated with the trunk ENI with
+	minVlanID = 1
+	maxVlanID = 4094
+
+	// trunkENICheckInterval is how often ipamd checks that the trunk ENI is still attached to the node
+	trunkENICheckInterval = 60 * time.Second
+
+	// trunkENILostReason is the reason of the event on the node when the trunk ENI was deleted or detached outside of
+	// ipamd
+	trunkENILostReason = "TrunkENILost"
+	// trunkENIRecreatedReason is the reason of the event on the node when a trunk ENI was attached in place of a lost one
+	trunkENIRecreatedReason = "TrunkENIRecreated"
+	// branchENILostReason is the reason of the events on the pods whose branch ENI lost its trunk ENI
+	branchENILostReason = "BranchENILost"
+)
+
+var (
+	branchENIsAssigned = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "awscni_branch_enis_assigned",
+			Help: "The number of branch ENIs assigned to pods",
+		},
+	)
+	branchENIsQuarantined = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "awscni_branch_enis_quarantined",
+			Help: "The number of branch ENIs of pods whose trunk ENI was lost, until the pods are deleted",
+		},
+	)
+	branchENIsWarm = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "awscni_branch_enis_warm",
+			Help: "The number of branch ENIs without a pod, kept for the next pods with security groups",
+		},
+	)
+	branchENIsMax = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "awscni_branch_enis_max",
+			Help: "The number of branch ENIs the trunk ENI of the node has room for, 0 if unknown",
+		},
+	)
+	branchENIsAvailable = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "awscni_branch_enis_available",
+			Help: "The number of pods with security groups the trunk ENI of the node still has room for",
+		},
+	)
+)
+
+// branchENIState holds the trunk ENI of the node and the branch ENIs of the pods, keyed by the namespace/name of the
+// pod. It is not persisted: the branch ENIs are tagged with their pod, and found again through the associations of the
+// trunk ENI after a restart of ipamd.
+type branchENIState struct {
+	lock sync.Mutex
+	// trunk is the trunk ENI of the node, with an empty ID if it could not be set up
+	trunk awsutils.TrunkENI
+	// subnet is the IPv4 CIDR of the subnet of the primary ENI, where the branch ENIs are created
+	subnet   netip.Prefix
+	assigned map[string]podBranchENI
+	// quarantined are the branch ENIs of the pods whose trunk ENI was deleted or detached outside of ipamd. The pods have
+	// no connectivity, their VLAN is not used again until their DEL tears down its interface and route table.
+	quarantined map[string]podBranchENI
+	// stale are the branch ENIs of deleted pods that could not be freed yet, keyed by their VLAN, which is not used
+	// again until they are
+	stale map[int]awsutils.BranchENI
+	// warm are the branch ENIs without a pod, with the security groups of the primary ENI until they are assigned.
+	// They are not tagged with a pod, so that they are freed as stale after a restart of ipamd.
+	warm []awsutils.BranchENI
+	// limit is the number of branch ENIs the trunk ENI has room for, 0 if unknown. It is set by nodeInit.
+	limit int
+	// creating are the VLANs of the branch ENIs being created or assigned to a pod, which are not used again until
+	// they are
+	creating map[int]bool
+	// advertised is set once the pod-eni resource of the node is set, only used by nodeInit and the loop of the pool
+	advertised bool
+	// trunkSlot is set once the slot of an ENI is left to the trunk ENI
+	trunkSlot bool
+	// lastCheck is when the trunk ENI was last checked, only used by the loop of the pool
+	lastCheck time.Time
+}
+
+type podBranchENI struct {
+	branch awsutils.BranchENI
+	// container is the sandbox of the pod the branch ENI was assigned to, empty for the branch ENIs found again on
+	// startup until their pod is recovered
+	container string
+}
+
+func branchPodKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// podSecurityGroups returns the security groups of the annotation of the pod, nil if it gets no branch ENI
+func (c *IPAMContext) podSecurityGroups(meta *podMetadata) ([]string, error) {
+	if !c.podENI {
+		return nil, nil
+	}
+	annotations, err := meta.getPodAnnotations()
+	if err != nil {
+		return nil, err
+	}
+	var securityGroups []string
+	for _, item := range strings.Split(annotations[PodSecurityGroupsAnnotation], ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.HasPrefix(item, "sg-") {
+			return nil, errors.Errorf("invalid security group %q in %s", item, PodSecurityGroupsAnnotation)
+		}
+		securityGroups = append(securityGroups, item)
+	}
+	return securityGroups, nil
+}
+
+// setupTrunkENI finds the trunk ENI of the node, or attaches a new one, and the branch ENIs of its pods. It returns
+// whether the node has a trunk ENI, which takes the slot of an ENI.
+func (c *IPAMContext) setupTrunkENI() bool {
+	c.branchENIs.lock.Lock()
+	defer c.branchENIs.lock.Unlock()
+	c.branchENIs.assigned = make(map[string]podBranchENI)
+	c.branchENIs.quarantined = make(map[string]podBranchENI)
+	c.branchENIs.stale = make(map[int]awsutils.BranchENI)
+	c.branchENIs.warm = nil
+	c.branchENIs.trunk = awsutils.TrunkENI{}
+
+	trunk, err := c.attachTrunkENI()
+	if err != nil {
+		// The pods annotated with security groups fail to start rather than getting an IP without them
+		log.Errorf("Failed to set up the trunk ENI, pods will not get a branch ENI: %v", err)
+		ipamdErrInc("setupTrunkENIFailed")
+		return false
+	}
+	c.branchENIs.trunk = trunk
+
+	branches, err := c.awsClient.GetBranchENIs(trunk.ENIID)
+	if err != nil {
+		log.Errorf("Failed to list the branch ENIs of trunk ENI %s: %v", trunk.ENIID, err)
+		ipamdErrInc("getBranchENIsFailed")
+	}
+	for _, branch := range branches {
+		if branch.PodName == "" {
+			c.branchENIs.stale[branch.VlanID] = branch
+			continue
+		}
+		c.branchENIs.assigned[branchPodKey(branch.PodNamespace, branch.PodName)] = podBranchENI{branch: branch}
+	}
+	c.setBranchENIGauges()
+	log.Infof("Using trunk ENI %s with %d branch ENIs", trunk.ENIID, len(branches))
+	return true
+}
+
+// attachTrunkENI returns the trunk ENI attached to the node, attaching a new one if there is none
+func (c *IPAMContext) attachTrunkENI() (awsutils.TrunkENI, error) {
+	trunk, err := c.awsClient.GetTrunkENI()
+	if err == nil && trunk.ENIID == "" {
+		log.Info("No trunk ENI attached to the node, attaching one")
+		trunk, err = c.awsClient.AllocTrunkENI()
+	}
+	return trunk, err
+}
+
+// getMaxBranchENI returns the number of branch ENIs the trunk ENI of the node has room for, 0 if unknown
+func (c *IPAMContext) getMaxBranchENI() int {
+	instanceMax, err := c.awsClient.GetBranchENILimit()
+	if err != nil {
+		log.Warnf("Failed to get the branch ENI limit of the instance type: %v", err)
+	}
+	envMax := getNonNegativeIntEnvVar(envMaxBranchENI, 0)
+	if envMax > 0 && (instanceMax == 0 || envMax < instanceMax) {
+		return envMax
+	}
+	return instanceMax
+}
+
+func getWarmBranchENITarget() int {
+	return getNonNegativeIntEnvVar(envWarmBranchENITarget, defaultWarmBranchENITarget)
+}
+
+// advertisePodENIs sets the pod-eni resource of the node to the number of branch ENIs its trunk ENI has room for, once
+// the node has a trunk ENI. It is only called by nodeInit and by the loop of the pool.
+func (c *IPAMContext) advertisePodENIs() {
+	c.branchENIs.lock.Lock()
+	limit, hasTrunk := c.branchENIs.limit, c.branchENIs.trunk.ENIID != ""
+	c.branchENIs.lock.Unlock()
+	if c.branchENIs.advertised || limit == 0 || !hasTrunk {
+		return
+	}
+	if err := c.k8sClient.K8SSetNodeExtendedResource(PodENIResourceName, int64(limit)); err != nil {
+		log.Warnf("Failed to set resource %s of the node, retrying on the next check: %v", PodENIResourceName, err)
+		ipamdErrInc("advertisePodENIsFailed")
+		return
+	}
+	c.branchENIs.advertised = true
+	log.Infof("Set resource %s of the node to %d", PodENIResourceName, limit)
+}
+
+// usedBranchENIs returns the number of branch ENIs associated with the trunk ENI or holding a VLAN, with
+// branchENIs.lock held
+func (c *IPAMContext) usedBranchENIs() int {
+	return len(c.branchENIs.assigned) + len(c.branchENIs.quarantined) + len(c.branchENIs.stale) +
+		len(c.branchENIs.warm) + len(c.branchENIs.creating)
+}
+
+// setBranchENIGauges sets the metrics of the branch ENIs, with branchENIs.lock held
+func (c *IPAMContext) setBranchENIGauges() {
+	branchENIsAssigned.Set(float64(len(c.branchENIs.assigned)))
+	branchENIsQuarantined.Set(float64(len(c.branchENIs.quarantined)))
+	branchENIsWarm.Set(float64(len(c.branchENIs.warm)))
+	branchENIsMax.Set(float64(c.branchENIs.limit))
+	if c.branchENIs.limit > 0 {
+		// The warm branch ENIs are there for the next pods
+		branchENIsAvailable.Set(float64(c.branchENIs.limit - c.usedBranchENIs() + len(c.branchENIs.warm)))
+	}
+}
+
+// reserveTrunkENISlot leaves the slot of an ENI to the trunk ENI, once. It is only called by nodeInit and by the loop of
+// the pool, which own maxENI.
+func (c *IPAMContext) reserveTrunkENISlot() {
+	if c.branchENIs.trunkSlot {
+		return
+	}
+	c.branchENIs.trunkSlot = true
+	c.maxENI--
+	enisMax.Set(float64(c.maxENI))
+}
+
+// checkTrunkENI runs every `interval` and checks that the trunk ENI is still attached to the node. When it was deleted
+// or detached outside of ipamd, the branch ENIs of the pods are quarantined, the pods get an event telling they must be
+// recreated, and a new trunk ENI is attached for the next pods, so that the node does not need to be replaced. A trunk
+// ENI that could not be set up, on startup or in place of a lost one, is attached again.
+func (c *IPAMContext) checkTrunkENI(interval time.Duration) {
+	if !c.podENI || time.Since(c.branchENIs.lastCheck) <= interval {
+		return
+	}
+	c.branchENIs.lastCheck = time.Now()
+	// The resource is set once the node has a trunk ENI, maybe only the one attached in place of a lost one
+	defer c.advertisePodENIs()
+
+	c.branchENIs.lock.Lock()
+	trunk := c.branchENIs.trunk
+	c.branchENIs.lock.Unlock()
+	if trunk.ENIID != "" {
+		_, attachmentID, err := c.awsClient.DescribeENI(trunk.ENIID)
+		if err != nil && err != awsutils.ErrENINotFound {
+			log.Warnf("Failed to check whether trunk ENI %s is attached with EC2, retrying on the next check: %v",
+				trunk.ENIID, err)
+			return
+		}
+		if err == nil && attachmentID != nil {
+			return
+		}
+		c.quarantineBranchENIs(trunk)
+	}
+
+	trunk, err := c.attachTrunkENI()
+	if err != nil {
+		log.Errorf("Failed to attach a trunk ENI, retrying on the next check: %v", err)
+		ipamdErrInc("recreateTrunkENIFailed")
+		return
+	}
+	c.branchENIs.lock.Lock()
+	c.branchENIs.trunk = trunk
+	c.branchENIs.lock.Unlock()
+	c.reserveTrunkENISlot()
+	reconcileCnt.With(prometheus.Labels{"fn": "trunkENIRecreated"}).Inc()
+	c.emitNodeEvent(v1.EventTypeNormal, trunkENIRecreatedReason,
+		fmt.Sprintf("Attached trunk ENI %s for the branch ENIs of the next pods", trunk.ENIID))
+}
+
+// quarantineBranchENIs moves the branch ENIs of the lost trunk ENI to the quarantine, and records events on the node
+// and on their pods
+func (c *IPAMContext) quarantineBranchENIs(trunk awsutils.TrunkENI) {
+	c.branchENIs.lock.Lock()
+	c.branchENIs.trunk = awsutils.TrunkENI{}
+	var lost []awsutils.BranchENI
+	for key, assigned := range c.branchENIs.assigned {
+		c.branchENIs.quarantined[key] = assigned
+		delete(c.branchENIs.assigned, key)
+		lost = append(lost, assigned.branch)
+	}
+	// The warm branch ENIs lost their association too, they are deleted
+	for _, warm := range c.branchENIs.warm {
+		c.branchENIs.stale[warm.VlanID] = warm
+	}
+	c.branchENIs.warm = nil
+	c.setBranchENIGauges()
+	c.branchENIs.lock.Unlock()
+
+	message := fmt.Sprintf("Trunk ENI %s was deleted or detached outside of the CNI plugin while %d pods used its "+
+		"branch ENIs", trunk.ENIID, len(lost))
+	log.Warn(message)
+	c.emitNodeEvent(v1.EventTypeWarning, trunkENILostReason, message)
+	reconcileCnt.With(prometheus.Labels{"fn": "trunkENILost"}).Inc()
+	for _, branch := range lost {
+		message := fmt.Sprintf("Trunk ENI %s of branch ENI %s was deleted or detached outside of the CNI plugin, the pod "+
+			"has no connectivity until it is recreated", trunk.ENIID, branch.ENIID)
+		if err := c.k8sClient.K8SEmitPodEvent(branch.PodNamespace, branch.PodName, v1.EventTypeWarning,
+			branchENILostReason, message); err != nil {
+			log.Warnf("Failed to record event %s on pod %s/%s: %v", branchENILostReason, branch.PodNamespace,
+				branch.PodName, err)
+		}
+	}
+}
+
+// assignBranchENI returns the branch ENI of the pod, a warm one or one created with the security groups if it has none
+// yet, with the name of the interface of the trunk ENI on the host. It runs on the ENI queue, before the warm pool
+// operations, which then replace the warm branch ENI it took.
+func (c *IPAMContext) assignBranchENI(namespace, name, container string, securityGroups []string) (branch awsutils.BranchENI, trunkIfName string, err error) {
+	c.eniQueue.run(eniOpPodBlocking, "assignBranchENI", func() {
+		branch, trunkIfName, err = c.assignBranchENIUnsafe(namespace, name, container, securityGroups)
+	})
+	if err == nil && getWarmBranchENITarget() > 0 {
+		c.eniQueue.submit(eniOpWarmPool, "fillWarmBranchENIs", c.fillWarmBranchENIs)
+	}
+	return branch, trunkIfName, err
+}
+
+// assignBranchENIUnsafe creates the branch ENI of the pod, on the ENI queue. The EC2 calls are made without
+// branchENIs.lock held, with the VLAN of the branch ENI reserved, so that the DELs of other pods do not wait for them.
+func (c *IPAMContext) assignBranchENIUnsafe(namespace, name, container string, securityGroups []string) (awsutils.BranchENI, string, error) {
+	c.freeStaleBranchENIs()
+	c.branchENIs.lock.Lock()
+	trunk := c.branchENIs.trunk
+	if trunk.ENIID == "" {
+		c.branchENIs.lock.Unlock()
+		return awsutils.BranchENI{}, "", errors.New("the node has no trunk ENI")
+	}
+	trunkIfName, err := c.networkClient.GetInterfaceName(trunk.MAC)
+	if err != nil {
+		c.branchENIs.lock.Unlock()
+		return awsutils.BranchENI{}, "", errors.Wrapf(err, "failed to find the interface of trunk ENI %s", trunk.ENIID)
+	}
+
+	key := branchPodKey(namespace, name)
+	if assigned, ok := c.branchENIs.assigned[key]; ok {
+		// The pod is added again, e.g. with a new sandbox
+		c.branchENIs.assigned[key] = podBranchENI{branch: assigned.branch, container: container}
+		c.branchENIs.lock.Unlock()
+		return assigned.branch, trunkIfName, nil
+	}
+
+	var warm *awsutils.BranchENI
+	var vlanID int
+	if len(c.branchENIs.warm) > 0 {
+		first := c.branchENIs.warm[0]
+		warm = &first
+		c.branchENIs.warm = c.branchENIs.warm[1:]
+		vlanID = warm.VlanID
+	} else {
+		if c.branchENIs.limit > 0 && c.usedBranchENIs() >= c.branchENIs.limit {
+			c.branchENIs.lock.Unlock()
+			return awsutils.BranchENI{}, "", errors.Errorf("trunk ENI %s has no room for another branch ENI, it has %d",
+				trunk.ENIID, c.branchENIs.limit)
+		}
+		if vlanID, err = c.freeVlanID(); err != nil {
+			c.branchENIs.lock.Unlock()
+			return awsutils.BranchENI{}, "", err
+		}
+	}
+	c.reserveVlanID(vlanID)
+	c.branchENIs.lock.Unlock()
+
+	var branch awsutils.BranchENI
+	if warm != nil {
+		branch, err = c.awsClient.AssignBranchENI(*warm, securityGroups, namespace, name)
+	} else {
+		branch, err = c.awsClient.AllocBranchENI(trunk.ENIID, vlanID, securityGroups, namespace, name)
+	}
+
+	c.branchENIs.lock.Lock()
+	defer c.branchENIs.lock.Unlock()
+	delete(c.branchENIs.creating, vlanID)
+	if err != nil {
+		if warm != nil {
+			// The warm branch ENI stays warm if it can not be assigned, e.g. since a security group of the pod does
+			// not exist, which would fail to create a branch ENI too
+			c.branchENIs.warm = append([]awsutils.BranchENI{*warm}, c.branchENIs.warm...)
+		}
+		return awsutils.BranchENI{}, "", err
+	}
+	c.branchENIs.assigned[key] = podBranchENI{branch: branch, container: container}
+	c.setBranchENIGauges()
+	log.Infof("Assigned branch ENI %s with VLAN %d to pod %s, namespace %s", branch.ENIID, branch.VlanID, name,
+		namespace)
+	return branch, trunkIfName, nil
+}
+
+// fillWarmBranchENIs creates branch ENIs without a pod until WARM_BRANCH_ENI_TARGET of them are associated with the
+// trunk ENI, as long as it has room for them, and frees the ones above the target and the stale ones, on the ENI
+// queue. Their VLANs are reserved while they are created without branchENIs.lock held.
+func (c *IPAMContext) fillWarmBranchENIs() {
+	if !c.podENI {
+		return
+	}
+	target := getWarmBranchENITarget()
+	c.branchENIs.lock.Lock()
+	if c.branchENIs.trunk.ENIID == "" {
+		c.branchENIs.lock.Unlock()
+		return
+	}
+	for len(c.branchENIs.warm) > target {
+		last := c.branchENIs.warm[len(c.branchENIs.warm)-1]
+		c.branchENIs.warm = c.branchENIs.warm[:len(c.branchENIs.warm)-1]
+		c.branchENIs.stale[last.VlanID] = last
+	}
+	c.branchENIs.lock.Unlock()
+	c.freeStaleBranchENIs()
+
+	c.branchENIs.lock.Lock()
+	trunk := c.branchENIs.trunk
+	var vlanIDs []int
+	for len(c.branchENIs.warm)+len(vlanIDs) < target {
+		if c.branchENIs.limit > 0 && c.usedBranchENIs() >= c.branchENIs.limit {
+			break
+		}
+		vlanID, err := c.freeVlanID()
+		if err != nil {
+			break
+		}
+		c.reserveVlanID(vlanID)
+		vlanIDs = append(vlanIDs, vlanID)
+	}
+	c.branchENIs.lock.Unlock()
+
+	for i, vlanID := range vlanIDs {
+		branch, err := c.awsClient.AllocBranchENI(trunk.ENIID, vlanID, nil, "", "")
+		c.branchENIs.lock.Lock()
+		delete(c.branchENIs.creating, vlanID)
+		if err != nil {
+			// The VLANs of the branch ENIs that are not created are free again
+			for _, rest := range vlanIDs[i+1:] {
+				delete(c.branchENIs.creating, rest)
+			}
+			c.branchENIs.lock.Unlock()
+			log.Warnf("Failed to create a warm branch ENI, retrying later: %v", err)
+			ipamdErrInc("allocWarmBranchENIFailed")
+			return
+		}
+		if c.branchENIs.trunk.ENIID == trunk.ENIID {
+			c.branchENIs.warm = append(c.branchENIs.warm, branch)
+			log.Infof("Created warm branch ENI %s with VLAN %d", branch.ENIID, vlanID)
+		} else {
+			// The trunk ENI was lost in the meantime, the branch ENI is freed with the other ones of the lost trunk ENI
+			c.branchENIs.stale[vlanID] = branch
+		}
+		c.setBranchENIGauges()
+		c.branchENIs.lock.Unlock()
+	}
+}
+
+// reserveVlanID keeps the VLAN from being used by another branch ENI while one is created or assigned with it, with
+// branchENIs.lock held
+func (c *IPAMContext) reserveVlanID(vlanID int) {
+	if c.branchENIs.creating == nil {
+		c.branchENIs.creating = make(map[int]bool)
+	}
+	c.branchENIs.creating[vlanID] = true
+}
+
+// freeVlanID returns the lowest VLAN no branch ENI uses, with branchENIs.lock held
+func (c *IPAMContext) freeVlanID() (int, error) {
+	used := make(map[int]bool)
+	for _, assigned := range c.branchENIs.assigned {
+		used[assigned.branch.VlanID] = true
+	}
+	for _, quarantined := range c.branchENIs.quarantined {
+		used[quarantined.branch.VlanID] = true
+	}
+	for vlanID := range c.branchENIs.stale {
+		used[vlanID] = true
+	}
+	for _, warm := range c.branchENIs.warm {
+		used[warm.VlanID] = true
+	}
+	for vlanID := range c.branchENIs.creating {
+		used[vlanID] = true
+	}
+	for vlanID := minVlanID; vlanID <= maxVlanID; vlanID++ {
+		if !used[vlanID] {
+			return vlanID, nil
+		}
+	}
+	return 0, errors.Errorf("no free VLAN on trunk ENI %s", c.branchENIs.trunk.ENIID)
+}
+
+// freeStaleBranchENIs tries to free the branch ENIs of deleted pods, on the ENI queue. They are freed without
+// branchENIs.lock held, and their VLANs are not used again until they are.
+func (c *IPAMContext) freeStaleBranchENIs() {
+	c.branchENIs.lock.Lock()
+	stale := make([]awsutils.BranchENI, 0, len(c.branchENIs.stale))
+	for _, branch := range c.branchENIs.stale {
+		stale = append(stale, branch)
+	}
+	c.branchENIs.lock.Unlock()
+	for _, branch := range stale {
+		if err := c.awsClient.FreeBranchENI(branch); err != nil {
+			log.Warnf("Failed to free branch ENI %s with VLAN %d, freeing it later: %v", branch.ENIID, branch.VlanID, err)
+			ipamdErrInc("freeBranchENIFailed")
+			continue
+		}
+		c.branchENIs.lock.Lock()
+		delete(c.branchENIs.stale, branch.VlanID)
+		c.setBranchENIGauges()
+		c.branchENIs.lock.Unlock()
+	}
+}
+
+// releaseBranchENI frees the branch ENI of the pod, assigned or quarantined, and returns it and whether the pod had
+// one. A branch ENI assigned to another sandbox of the pod is left alone. The branch ENI is freed on the ENI queue,
+// after the pod blocking and warm pool operations, and its VLAN is not used again until then.
+func (c *IPAMContext) releaseBranchENI(namespace, name, container string) (awsutils.BranchENI, bool) {
+	c.branchENIs.lock.Lock()
+	key := branchPodKey(namespace, name)
+	assigned, ok := takePodBranchENI(c.branchENIs.assigned, key, container)
+	if !ok {
+		assigned, ok = takePodBranchENI(c.branchENIs.quarantined, key, container)
+	}
+	if !ok {
+		c.branchENIs.lock.Unlock()
+		return awsutils.BranchENI{}, false
+	}
+	c.branchENIs.stale[assigned.branch.VlanID] = assigned.branch
+	c.setBranchENIGauges()
+	c.branchENIs.lock.Unlock()
+	c.eniQueue.submit(eniOpScaleDown, "freeBranchENIs", c.freeStaleBranchENIs)
+	log.Infof("Released branch ENI %s with VLAN %d of pod %s, namespace %s", assigned.branch.ENIID,
+		assigned.branch.VlanID, name, namespace)
+	return assigned.branch, true
+}
+
+// takePodBranchENI removes the branch ENI of the pod from the map and returns it, unless it belongs to another sandbox
+func takePodBranchENI(branches map[string]podBranchENI, key, container string) (podBranchENI, bool) {
+	assigned, ok := branches[key]
+	if !ok || (assigned.container != "" && assigned.container != container) {
+		return podBranchENI{}, false
+	}
+	delete(branches, key)
+	return assigned, true
+}
+
+// recoverBranchENIPod returns whether the pod has a branch ENI, whose IP is not in the datastore, and assigns the
+// branch ENI to its sandbox
+func (c *IPAMContext) recoverBranchENIPod(pod *k8sapi.K8SPodInfo) bool {
+	c.branchENIs.lock.Lock()
+	defer c.branchENIs.lock.Unlock()
+	key := branchPodKey(pod.Namespace, pod.Name)
+	assigned, ok := c.branchENIs.assigned[key]
+	if !ok {
+		return false
+	}
+	if assigned.container == "" {
+		c.branchENIs.assigned[key] = podBranchENI{branch: assigned.branch, container: pod.Container}
+	}
+	log.Infof("Recovered branch ENI %s with VLAN %d of pod %s, namespace %s", assigned.branch.ENIID,
+		assigned.branch.VlanID, pod.Name, pod.Namespace)
+	return true
+}
+
+// releaseOrphanedBranchENIs frees the branch ENIs found on startup whose pod is not on the node anymore, e.g. since it
+// was deleted while ipamd was not running
+func (c *IPAMContext) releaseOrphanedBranchENIs(localPods []*k8sapi.K8SPodInfo) {
+	onNode := make(map[string]bool)
+	for _, pod := range localPods {
+		onNode[branchPodKey(pod.Namespace, pod.Name)] = true
+	}
+	c.branchENIs.lock.Lock()
+	var orphaned []podBranchENI
+	for key, assigned := range c.branchENIs.assigned {
+		if assigned.container == "" && !onNode[key] {
+			orphaned = append(orphaned, assigned)
+		}
+	}
+	c.branchENIs.lock.Unlock()
+	for _, assigned := range orphaned {
+		c.releaseBranchENI(assigned.branch.PodNamespace, assigned.branch.PodName, "")
+	}
+}
+
+// branchENIIPs returns the IPs of the pods with a branch ENI, assigned or quarantined
+func (c *IPAMContext) branchENIIPs() []string {
+	c.branchENIs.lock.Lock()
+	defer c.branchENIs.lock.Unlock()
+	var ips []string
+	for _, assigned := range c.branchENIs.assigned {
+		ips = append(ips, assigned.branch.IPv4Addr)
+	}
+	for _, quarantined := range c.branchENIs.quarantined {
+		ips = append(ips, quarantined.branch.IPv4Addr)
+	}
+	return ips
+}
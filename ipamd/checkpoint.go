@@ -0,0 +1,221 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/aws/amazon-vpc-cni-k8s/ipamd/datastore"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+)
+
+const (
+	// envAPIServerOptional is the name of the environment variable that lets ipamd start and keep running while the
+	// Kubernetes API server can not be reached, e.g. during an outage of the control plane of a private cluster. The
+	// IPs of the pods are then recovered from the checkpoint instead of the API server. Defaults to false.
+	envAPIServerOptional = "AWS_VPC_K8S_CNI_API_SERVER_OPTIONAL"
+
+	// envCheckpointPath is the name of the environment variable that sets the file the IPs of the pods are saved to
+	// when AWS_VPC_K8S_CNI_API_SERVER_OPTIONAL is set or the checkpoint datastore backend is selected
+	envCheckpointPath     = "AWS_VPC_K8S_CNI_CHECKPOINT_PATH"
+	defaultCheckpointPath = "/var/run/aws-node/ipam.json"
+
+	checkpointVersion = 1
+
+	// apiServerSyncCheckInterval is how often ipamd checks whether it synced with the API server after starting
+	// without it
+	apiServerSyncCheckInterval = 10 * time.Second
+)
+
+var apiServerUnavailable = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "awscni_api_server_unavailable",
+		Help: "Set to 1 while ipamd runs without the Kubernetes API server, from its checkpoint",
+	},
+)
+
+// checkpointState is where the IPs of the pods are saved, so that ipamd can recover them without the API server
+type checkpointState struct {
+	lock sync.Mutex
+	// path is the file of the checkpoint, empty if no checkpoint is kept
+	path string
+}
+
+// checkpointData is the content of the checkpoint file
+type checkpointData struct {
+	Version int             `json:"version"`
+	Pods    []checkpointPod `json:"pods"`
+}
+
+// checkpointPod is a pod and the IPs assigned to it
+type checkpointPod struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Container string `json:"container,omitempty"`
+	IPv4      string `json:"ipv4"`
+	IPv6      string `json:"ipv6,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+}
+
+// APIServerOptional returns true if ipamd runs without the API server when it can not be reached
+func APIServerOptional() bool {
+	return getEnvBoolWithDefault(envAPIServerOptional, false)
+}
+
+func getCheckpointPath() string {
+	if path := os.Getenv(envCheckpointPath); path != "" {
+		return path
+	}
+	return defaultCheckpointPath
+}
+
+// writeCheckpoint saves the pods of the datastore and their IPs, if a checkpoint is kept
+func (c *IPAMContext) writeCheckpoint() {
+	// Until the pods of the node are recovered, the checkpoint still holds the ones that may have to be restored from it
+	if c.checkpoint.path == "" || c.recoveryPending() {
+		return
+	}
+	// The checkpoint backend saves the pods itself on every change
+	if _, ok := c.dataStore.(*checkpointStore); ok {
+		return
+	}
+	c.checkpoint.lock.Lock()
+	defer c.checkpoint.lock.Unlock()
+	if err := writeCheckpointFile(c.checkpoint.path, checkpointFromStore(c.dataStore)); err != nil {
+		log.Errorf("Failed to write the checkpoint %s: %v", c.checkpoint.path, err)
+		ipamdErrInc("writeCheckpointFailed")
+	}
+}
+
+// checkpointFromStore returns the pods of the datastore, with the tenant of the ENI of their IP
+func checkpointFromStore(store datastore.Store) checkpointData {
+	tenants := make(map[string]string)
+	for _, eni := range store.GetENIInfos().ENIIPPools {
+		if eni.Tenant == "" {
+			continue
+		}
+		for _, addr := range eni.IPv4Addresses {
+			tenants[addr.Address.String()] = eni.Tenant
+		}
+	}
+	data := checkpointData{Version: checkpointVersion, Pods: []checkpointPod{}}
+	for key, info := range *store.GetPodInfos() {
+		// Pod names and namespaces can not contain an underscore
+		parts := strings.SplitN(key, "_", 3)
+		// The leases of the fast path are withdrawn on restart, their IPs are free again
+		if len(parts) != 3 || isFastPathPlaceholder(key) {
+			continue
+		}
+		data.Pods = append(data.Pods, checkpointPod{
+			Name:      parts[0],
+			Namespace: parts[1],
+			Container: parts[2],
+			IPv4:      info.IP,
+			IPv6:      info.IPv6,
+			Tenant:    tenants[info.IP],
+		})
+	}
+	sort.Slice(data.Pods, func(i, j int) bool {
+		if data.Pods[i].Namespace != data.Pods[j].Namespace {
+			return data.Pods[i].Namespace < data.Pods[j].Namespace
+		}
+		return data.Pods[i].Name < data.Pods[j].Name
+	})
+	return data
+}
+
+// writeCheckpointFile replaces the checkpoint at once, so that it is never read half written
+func writeCheckpointFile(path string, data checkpointData) error {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode the checkpoint")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrap(err, "failed to create the directory of the checkpoint")
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return errors.Wrap(err, "failed to write the checkpoint")
+	}
+	return errors.Wrap(os.Rename(tmpPath, path), "failed to replace the checkpoint")
+}
+
+// readCheckpointFile returns the pods saved in the checkpoint
+func readCheckpointFile(path string) ([]*k8sapi.K8SPodInfo, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var data checkpointData
+	if err := json.Unmarshal(content, &data); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the checkpoint %s", path)
+	}
+	if data.Version != checkpointVersion {
+		return nil, errors.Errorf("unsupported version %d of the checkpoint %s", data.Version, path)
+	}
+	pods := make([]*k8sapi.K8SPodInfo, 0, len(data.Pods))
+	for _, pod := range data.Pods {
+		pods = append(pods, &k8sapi.K8SPodInfo{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+			Container: pod.Container,
+			IP:        pod.IPv4,
+			IPv6:      pod.IPv6,
+			Tenant:    pod.Tenant,
+		})
+	}
+	return pods, nil
+}
+
+// restoreLocalPods returns the pods saved in the checkpoint, for when the API server can not be reached at startup.
+// Without a checkpoint, there is nothing to restore only if no pod has been set up on this node yet.
+func (c *IPAMContext) restoreLocalPods(podIPsInRules int) ([]*k8sapi.K8SPodInfo, error) {
+	if c.checkpoint.path == "" {
+		return nil, errors.New("no checkpoint is kept")
+	}
+	pods, err := readCheckpointFile(c.checkpoint.path)
+	if os.IsNotExist(err) && podIPsInRules == 0 {
+		log.Infof("No checkpoint %s and no pod has been set up on this node yet", c.checkpoint.path)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to restore the pods from the checkpoint")
+	}
+	log.Infof("Restored %d pods from the checkpoint %s", len(pods), c.checkpoint.path)
+	return pods, nil
+}
+
+// waitForAPIServerSync reports when ipamd, started without the API server, synced with it
+func (c *IPAMContext) waitForAPIServerSync() {
+	apiServerUnavailable.Set(1)
+	for {
+		if _, err := c.k8sClient.K8SGetLocalPodIPs(); err == nil {
+			log.Info("Synced with the API server, features that need it are available again")
+			apiServerUnavailable.Set(0)
+			return
+		}
+		time.Sleep(apiServerSyncCheckInterval)
+	}
+}
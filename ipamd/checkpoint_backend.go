@@ -0,0 +1,264 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"net/netip"
+	"os"
+	"sync"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/aws/amazon-vpc-cni-k8s/ipamd/datastore"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/cidr"
+)
+
+// checkpointBackend is the name of the datastore backend that saves the pods of the node to the checkpoint on every
+// change, and gives them their IPs back as soon as the IPs are added again after a restart
+const checkpointBackend = "checkpoint"
+
+func init() {
+	datastore.RegisterBackend(checkpointBackend, func() (datastore.Store, error) {
+		return newCheckpointStore(getCheckpointPath()), nil
+	})
+}
+
+// checkpointStore is the DataStore, with its pods saved to the checkpoint. When ipamd starts, the saved pods get
+// their IPs back while the ENIs are set up, before any pod is added, then the ones that are gone are forgotten once
+// the pods of the node are recovered.
+type checkpointStore struct {
+	*datastore.DataStore
+	path string
+
+	lock sync.Mutex
+	// pending are the saved pods whose IPv4 address has not been added again yet, by IPv4 address
+	pending map[string]*k8sapi.K8SPodInfo
+	// pendingIPv6 are the restored pods whose IPv6 address has not been added again yet, by IPv6 address
+	pendingIPv6 map[string]*k8sapi.K8SPodInfo
+	// restored are the saved pods that got their IPv4 address back
+	restored []*k8sapi.K8SPodInfo
+}
+
+func newCheckpointStore(path string) *checkpointStore {
+	s := &checkpointStore{
+		DataStore:   datastore.NewDataStore(),
+		path:        path,
+		pending:     make(map[string]*k8sapi.K8SPodInfo),
+		pendingIPv6: make(map[string]*k8sapi.K8SPodInfo),
+	}
+	pods, err := readCheckpointFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Failed to read the checkpoint %s, starting without the pods saved in it: %v", path, err)
+			ipamdErrInc("readCheckpointFailed")
+		}
+		return s
+	}
+	for _, pod := range pods {
+		if pod.IP != "" {
+			s.pending[pod.IP] = pod
+		}
+	}
+	log.Infof("Loaded %d pods from the checkpoint %s", len(s.pending), path)
+	return s
+}
+
+// save writes the pods of the datastore to the checkpoint, with the saved pods that did not get their IPs back yet
+func (s *checkpointStore) save() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.saveUnsafe()
+}
+
+func (s *checkpointStore) saveUnsafe() {
+	data := checkpointFromStore(s.DataStore)
+	for _, pod := range s.pending {
+		data.Pods = append(data.Pods, checkpointPod{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+			Container: pod.Container,
+			IPv4:      pod.IP,
+			IPv6:      pod.IPv6,
+			Tenant:    pod.Tenant,
+		})
+	}
+	if err := writeCheckpointFile(s.path, data); err != nil {
+		log.Errorf("Failed to write the checkpoint %s: %v", s.path, err)
+		ipamdErrInc("writeCheckpointFailed")
+	}
+}
+
+// restoreUnsafe gives the saved pod its IPs back
+func (s *checkpointStore) restoreUnsafe(pod *k8sapi.K8SPodInfo) {
+	delete(s.pending, pod.IP)
+	if _, _, err := s.DataStore.AssignPodIPv4Address(pod); err != nil {
+		log.Warnf("Failed to restore IP %s of pod %s, namespace %s: %v", pod.IP, pod.Name, pod.Namespace, err)
+		return
+	}
+	log.Infof("Restored IP %s of pod %s, namespace %s from the checkpoint", pod.IP, pod.Name, pod.Namespace)
+	s.restored = append(s.restored, pod)
+	if pod.IPv6 == "" {
+		return
+	}
+	if _, err := s.DataStore.AssignPodIPv6Address(pod); err != nil {
+		s.pendingIPv6[pod.IPv6] = pod
+	}
+}
+
+// AddIPv4AddressFromStore adds a secondary IPv4 address of an ENI, and gives it back to the saved pod that had it
+func (s *checkpointStore) AddIPv4AddressFromStore(eniID string, ipv4 string) error {
+	if err := s.DataStore.AddIPv4AddressFromStore(eniID, ipv4); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if pod, ok := s.pending[ipv4]; ok {
+		s.restoreUnsafe(pod)
+	}
+	return nil
+}
+
+// AddIPv4PrefixToStore adds the IPv4 addresses of a prefix of an ENI, and gives them back to the saved pods that had
+// them
+func (s *checkpointStore) AddIPv4PrefixToStore(eniID string, prefix netip.Prefix) error {
+	if err := s.DataStore.AddIPv4PrefixToStore(eniID, prefix); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for ip, pod := range s.pending {
+		if addr, err := cidr.ParseAddr(ip); err == nil && prefix.Contains(addr) {
+			s.restoreUnsafe(pod)
+		}
+	}
+	return nil
+}
+
+// AddIPv6AddressFromStore adds an IPv6 address of an ENI, and gives it back to the restored pod that had it
+func (s *checkpointStore) AddIPv6AddressFromStore(eniID string, ipv6 string) error {
+	if err := s.DataStore.AddIPv6AddressFromStore(eniID, ipv6); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if pod, ok := s.pendingIPv6[ipv6]; ok {
+		delete(s.pendingIPv6, ipv6)
+		if _, err := s.DataStore.AssignPodIPv6Address(pod); err != nil {
+			log.Warnf("Failed to restore IPv6 %s of pod %s, namespace %s: %v", ipv6, pod.Name, pod.Namespace, err)
+		}
+	}
+	return nil
+}
+
+// forgetStalePods releases the IPs of the restored pods that are no longer on the node, and drops the saved pods that
+// did not get their IPs back, once the pods of the node are known
+func (s *checkpointStore) forgetStalePods(localPods []*k8sapi.K8SPodInfo) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	running := make(map[string]bool)
+	for _, pod := range localPods {
+		running[pod.Name+"_"+pod.Namespace+"_"+pod.Container+"_"+pod.IP] = true
+	}
+	for _, pod := range s.restored {
+		if running[pod.Name+"_"+pod.Namespace+"_"+pod.Container+"_"+pod.IP] {
+			continue
+		}
+		log.Infof("Pod %s, namespace %s, saved in the checkpoint is gone, releasing IP %s", pod.Name, pod.Namespace, pod.IP)
+		if pod.IPv6 != "" {
+			_, _ = s.DataStore.UnassignPodIPv6Address(pod)
+		}
+		if _, _, err := s.DataStore.UnassignPodIPv4Address(pod); err != nil {
+			log.Warnf("Failed to release IP %s of pod %s, namespace %s: %v", pod.IP, pod.Name, pod.Namespace, err)
+		}
+	}
+	for _, pod := range s.pending {
+		log.Infof("IP %s of pod %s, namespace %s, saved in the checkpoint is no longer on the node", pod.IP, pod.Name,
+			pod.Namespace)
+	}
+	s.pending = make(map[string]*k8sapi.K8SPodInfo)
+	s.pendingIPv6 = make(map[string]*k8sapi.K8SPodInfo)
+	s.restored = nil
+	s.saveUnsafe()
+}
+
+// AssignPodIPv4Address assigns an IPv4 address to a pod and saves it
+func (s *checkpointStore) AssignPodIPv4Address(k8sPod *k8sapi.K8SPodInfo) (string, int, error) {
+	ip, deviceNumber, err := s.DataStore.AssignPodIPv4Address(k8sPod)
+	if err == nil {
+		s.save()
+	}
+	return ip, deviceNumber, err
+}
+
+// AssignPodIPv4Addresses assigns IPv4 addresses to a batch of pods and saves them at once
+func (s *checkpointStore) AssignPodIPv4Addresses(k8sPods []*k8sapi.K8SPodInfo) []datastore.AssignedIPv4Address {
+	assigned := s.DataStore.AssignPodIPv4Addresses(k8sPods)
+	s.save()
+	return assigned
+}
+
+// TransferPodIPv4Address hands the IPv4 address of a pod over to another pod and saves it
+func (s *checkpointStore) TransferPodIPv4Address(from, to *k8sapi.K8SPodInfo) error {
+	err := s.DataStore.TransferPodIPv4Address(from, to)
+	if err == nil {
+		s.save()
+	}
+	return err
+}
+
+// UnassignPodIPv4Address releases the IPv4 address of a pod and saves it
+func (s *checkpointStore) UnassignPodIPv4Address(k8sPod *k8sapi.K8SPodInfo) (string, int, error) {
+	ip, deviceNumber, err := s.DataStore.UnassignPodIPv4Address(k8sPod)
+	if err == nil {
+		s.save()
+	}
+	return ip, deviceNumber, err
+}
+
+// AssignPodIPv6Address assigns an IPv6 address to a pod and saves it
+func (s *checkpointStore) AssignPodIPv6Address(k8sPod *k8sapi.K8SPodInfo) (string, error) {
+	ip, err := s.DataStore.AssignPodIPv6Address(k8sPod)
+	if err == nil {
+		s.save()
+	}
+	return ip, err
+}
+
+// UnassignPodIPv6Address releases the IPv6 address of a pod and saves it
+func (s *checkpointStore) UnassignPodIPv6Address(k8sPod *k8sapi.K8SPodInfo) (string, error) {
+	ip, err := s.DataStore.UnassignPodIPv6Address(k8sPod)
+	if err == nil {
+		s.save()
+	}
+	return ip, err
+}
+
+// EvictIPv4Address removes an IPv4 address even if a pod uses it, and saves the pods without that pod
+func (s *checkpointStore) EvictIPv4Address(eniID string, ipv4 string) (*k8sapi.K8SPodInfo, error) {
+	pod, err := s.DataStore.EvictIPv4Address(eniID, ipv4)
+	if err == nil && pod != nil {
+		s.save()
+	}
+	return pod, err
+}
+
+// EvictENI removes an ENI even if pods use it, and saves the pods without those pods
+func (s *checkpointStore) EvictENI(eni string) ([]*k8sapi.K8SPodInfo, error) {
+	pods, err := s.DataStore.EvictENI(eni)
+	if err == nil && len(pods) > 0 {
+		s.save()
+	}
+	return pods, err
+}
@@ -0,0 +1,51 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"sync/atomic"
+
+	log "github.com/cihub/seelog"
+)
+
+// ReloadConfig makes the pool manager read again the settings that can change without restarting ipamd. The other
+// settings take effect on the next restart.
+func (c *IPAMContext) ReloadConfig() {
+	atomic.StoreInt32(&c.configReloadPending, 1)
+}
+
+// Restart makes ipamd stop serving and exit, so that it starts again with settings that are only read on start
+func (c *IPAMContext) Restart(reason string) {
+	select {
+	case c.restartRequests <- reason:
+	default:
+		log.Debugf("ipamd restart already requested, ignoring: %s", reason)
+	}
+}
+
+// reloadConfigIfRequested reads again the settings of the pool if ReloadConfig was called. It runs in the pool manager,
+// so that the settings don't change in the middle of a decision.
+func (c *IPAMContext) reloadConfigIfRequested() {
+	if !atomic.CompareAndSwapInt32(&c.configReloadPending, 1, 0) {
+		return
+	}
+	c.warmENITarget = getWarmENITarget()
+	c.warmIPTarget = getWarmIPTarget()
+	c.resolveWarmTargetPercents()
+	c.prewarmPendingPods = prewarmPendingPodsEnabled()
+	c.pacing.cooldown = getScaleDownCooldown()
+	c.pacing.surgeBufferPercent = getScaleDownSurgeBuffer()
+	c.dataStore.SetMinENILifetime(getMinENILifetime())
+	log.Infof("Reloaded the configuration: WARM_ENI_TARGET %d, WARM_IP_TARGET %d", c.warmENITarget, c.warmIPTarget)
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datastore
+
+import (
+	"encoding/binary"
+	"net/netip"
+
+	"github.com/pkg/errors"
+)
+
+// The address pools of the ENIs are keyed by the bytes of the addresses rather than by their text form: a key takes 4
+// or 16 bytes inline in the map, and holds no pointer, so the garbage collector does not scan the maps of a node with
+// thousands of addresses. The keys still show as addresses in the introspection output.
+
+// ipv4Key is the key of an IPv4 address in the pool of an ENI, its 4 bytes as a number
+type ipv4Key uint32
+
+// ipv6Key is the key of an IPv6 address in the pool of an ENI, its 16 bytes
+type ipv6Key [16]byte
+
+// newIPv4Key returns the key of an IPv4 address
+func newIPv4Key(addr netip.Addr) ipv4Key {
+	b := addr.As4()
+	return ipv4Key(binary.BigEndian.Uint32(b[:]))
+}
+
+// parseIPv4Key returns the key of an IPv4 address in text form, false if it is not one
+func parseIPv4Key(ip string) (ipv4Key, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Unmap().Is4() {
+		return 0, false
+	}
+	return newIPv4Key(addr.Unmap()), true
+}
+
+func (k ipv4Key) addr() netip.Addr {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(k))
+	return netip.AddrFrom4(b)
+}
+
+// MarshalText returns the address of the key in dot-decimal notation
+func (k ipv4Key) MarshalText() ([]byte, error) {
+	return k.addr().MarshalText()
+}
+
+// UnmarshalText sets the key to an IPv4 address in dot-decimal notation
+func (k *ipv4Key) UnmarshalText(text []byte) error {
+	key, ok := parseIPv4Key(string(text))
+	if !ok {
+		return errors.Errorf("datastore: invalid IPv4 address %q", text)
+	}
+	*k = key
+	return nil
+}
+
+// newIPv6Key returns the key of an IPv6 address
+func newIPv6Key(addr netip.Addr) ipv6Key {
+	return addr.As16()
+}
+
+// parseIPv6Key returns the key of an IPv6 address in text form, false if it is not one
+func parseIPv6Key(ip string) (ipv6Key, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is6() || addr.Is4In6() {
+		return ipv6Key{}, false
+	}
+	return newIPv6Key(addr), true
+}
+
+func (k ipv6Key) addr() netip.Addr {
+	return netip.AddrFrom16(k)
+}
+
+// MarshalText returns the address of the key in canonical notation
+func (k ipv6Key) MarshalText() ([]byte, error) {
+	return k.addr().MarshalText()
+}
+
+// UnmarshalText sets the key to an IPv6 address
+func (k *ipv6Key) UnmarshalText(text []byte) error {
+	key, ok := parseIPv6Key(string(text))
+	if !ok {
+		return errors.Errorf("datastore: invalid IPv6 address %q", text)
+	}
+	*k = key
+	return nil
+}
@@ -14,6 +14,8 @@
 package datastore
 
 import (
+	"net/netip"
+	"sort"
 	"sync"
 	"time"
 
@@ -25,6 +27,7 @@ import (
 )
 
 const (
+	// minLifeTime is the default of how long an ENI must have been attached before it can be freed
 	minLifeTime = 1 * time.Minute
 	// addressENICoolingPeriod is used to ensure ENI will NOT get freed back to EC2 control plane if one of
 	// its secondary IP addresses is used for a Pod within last addressENICoolingPeriod
@@ -51,6 +54,19 @@ const (
 
 	// UnknownENIError is an error when caller tries to access an ENI which is unknown to datastore
 	UnknownENIError = "datastore: unknown ENI"
+
+	// DuplicatePrefixError is an error when caller tries to add an duplicate IPv4 prefix to data store
+	DuplicatePrefixError = "datastore: duplicated prefix"
+
+	// UnknownPrefixError is an error when caller tries to delete an IPv4 prefix which is unknown to data store
+	UnknownPrefixError = "datastore: unknown prefix"
+
+	// PrefixInUseError is an error when caller tries to delete an IPv4 prefix where an IP of it is still assigned to a Pod
+	PrefixInUseError = "datastore: prefix is used and can not be deleted"
+
+	// maxPrefixAddresses is the largest number of addresses of an IPv4 prefix that can be carved into pod IPs, EC2
+	// assigns /28 prefixes
+	maxPrefixAddresses = 256
 )
 
 // ErrUnknownPod is an error when there is no pod in data store matching pod name, namespace, container id
@@ -59,6 +75,9 @@ var ErrUnknownPod = errors.New("datastore: unknown pod")
 // ErrUnknownPodIP is an error where pod's IP address is not found in data store
 var ErrUnknownPodIP = errors.New("datastore: pod using unknown IP address")
 
+// ErrNoAvailableIPv4Address is an error when no IPv4 address of the pool is free for a pod
+var ErrNoAvailableIPv4Address = errors.New("assignPodIPv4AddressUnsafe: no available IP addresses")
+
 var (
 	enis = prometheus.NewGauge(
 		prometheus.GaugeOpts{
@@ -78,6 +97,13 @@ var (
 			Help: "The number of IP addresses assigned to pods",
 		},
 	)
+	numaAssignments = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "awscni_numa_assignments_count",
+			Help: "The number of IPs assigned to pods with a NUMA node, by whether the ENI is local to the NUMA node",
+		},
+		[]string{"local"},
+	)
 	prometheusRegistered = false
 )
 
@@ -92,16 +118,27 @@ type ENIIPPool struct {
 	DeviceNumber int
 	// AssignedIPv4Addresses is the number of IP addresses already been assigned
 	AssignedIPv4Addresses int
-	// IPv4Addresses shows whether each address is assigned, the key is IP address, which must
-	// be in dot-decimal notation with no leading zeros and no whitespace(eg: "10.1.0.253")
-	IPv4Addresses map[string]*AddressInfo
+	// Tenant is the tenant whose pods are using the ENI in multi-tenant mode. Only pods of this tenant get IPs
+	// from the ENI until all of them are released.
+	Tenant string
+	// NUMANode is the NUMA node of the network card of the ENI, -1 if unknown
+	NUMANode int
+	// IPv4Addresses shows whether each address is assigned, the key is the IP address, which is marshaled in
+	// dot-decimal notation (eg: "10.1.0.253")
+	IPv4Addresses map[ipv4Key]*AddressInfo
+	// IPv6Addresses shows whether each IPv6 address is assigned in dual-stack clusters, the key is the IP address,
+	// which is marshaled in canonical notation (eg: "2001:db8::1")
+	IPv6Addresses map[ipv6Key]*AddressInfo
 }
 
 // AddressInfo contains information about an IP, Exported fields will be marshaled for introspection.
 type AddressInfo struct {
-	Address        string
+	Address        netip.Addr
 	Assigned       bool // true if it is assigned to a pod
 	UnassignedTime time.Time
+	// Prefix is the IPv4 prefix the address is carved out of in prefix delegation mode, the zero Prefix for a
+	// secondary IP
+	Prefix netip.Prefix `json:",omitzero"`
 }
 
 // PodKey is used to locate pod IP
@@ -117,6 +154,8 @@ type PodIPInfo struct {
 	IP string
 	// DeviceNumber is the device number of  pod
 	DeviceNumber int
+	// IPv6 is the IPv6 address of pod in dual-stack clusters
+	IPv6 string
 }
 
 // DataStore contains node level ENI/IP
@@ -126,6 +165,14 @@ type DataStore struct {
 	eniIPPools map[string]*ENIIPPool
 	podsIP     map[PodKey]PodIPInfo
 	lock       sync.RWMutex
+	// minENILifetime is how long an ENI must have been attached before it can be freed
+	minENILifetime time.Duration
+	// keepFreeENI keeps the last free secondary ENI from being freed, so that a new tenant can claim it
+	keepFreeENI bool
+	// reserved are the IPv4 addresses that are not assigned to new pods, only to pods asking for them by IP
+	reserved map[ipv4Key]bool
+	// strs keeps one copy of the pod namespaces
+	strs stringInterner
 }
 
 // PodInfos contains pods IP information which uses key name_namespace_container
@@ -146,6 +193,7 @@ func prometheusRegister() {
 		prometheus.MustRegister(enis)
 		prometheus.MustRegister(totalIPs)
 		prometheus.MustRegister(assignedIPs)
+		prometheus.MustRegister(numaAssignments)
 		prometheusRegistered = true
 	}
 }
@@ -154,11 +202,26 @@ func prometheusRegister() {
 func NewDataStore() *DataStore {
 	prometheusRegister()
 	return &DataStore{
-		eniIPPools: make(map[string]*ENIIPPool),
-		podsIP:     make(map[PodKey]PodIPInfo),
+		eniIPPools:     make(map[string]*ENIIPPool),
+		podsIP:         make(map[PodKey]PodIPInfo),
+		minENILifetime: minLifeTime,
 	}
 }
 
+// SetMinENILifetime sets how long an ENI must have been attached before it can be freed
+func (ds *DataStore) SetMinENILifetime(minENILifetime time.Duration) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	ds.minENILifetime = minENILifetime
+}
+
+// SetKeepFreeENI sets whether the last free secondary ENI is kept for a new tenant instead of being freed
+func (ds *DataStore) SetKeepFreeENI(keepFreeENI bool) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	ds.keepFreeENI = keepFreeENI
+}
+
 // AddENI add ENI to data store
 func (ds *DataStore) AddENI(eniID string, deviceNumber int, isPrimary bool) error {
 	ds.lock.Lock()
@@ -175,11 +238,26 @@ func (ds *DataStore) AddENI(eniID string, deviceNumber int, isPrimary bool) erro
 		IsPrimary:     isPrimary,
 		ID:            eniID,
 		DeviceNumber:  deviceNumber,
-		IPv4Addresses: make(map[string]*AddressInfo)}
+		NUMANode:      -1,
+		IPv4Addresses: make(map[ipv4Key]*AddressInfo),
+		IPv6Addresses: make(map[ipv6Key]*AddressInfo)}
 	enis.Set(float64(len(ds.eniIPPools)))
 	return nil
 }
 
+// SetENINUMANode sets the NUMA node of the network card of an ENI
+func (ds *DataStore) SetENINUMANode(eniID string, node int) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	eni, ok := ds.eniIPPools[eniID]
+	if !ok {
+		return errors.New(UnknownENIError)
+	}
+	eni.NUMANode = node
+	return nil
+}
+
 // AddIPv4AddressFromStore add an IP of an ENI to data store
 func (ds *DataStore) AddIPv4AddressFromStore(eniID string, ipv4 string) error {
 	ds.lock.Lock()
@@ -193,7 +271,11 @@ func (ds *DataStore) AddIPv4AddressFromStore(eniID string, ipv4 string) error {
 		return errors.New("add ENI's IP to datastore: unknown ENI")
 	}
 
-	_, ok = curENI.IPv4Addresses[ipv4]
+	key, ok := parseIPv4Key(ipv4)
+	if !ok {
+		return errors.Errorf("add ENI's IP to datastore: invalid IPv4 address %q", ipv4)
+	}
+	_, ok = curENI.IPv4Addresses[key]
 	if ok {
 		return errors.New(DuplicateIPError)
 	}
@@ -202,7 +284,7 @@ func (ds *DataStore) AddIPv4AddressFromStore(eniID string, ipv4 string) error {
 	// Prometheus gauge
 	totalIPs.Set(float64(ds.total))
 
-	curENI.IPv4Addresses[ipv4] = &AddressInfo{Address: ipv4, Assigned: false}
+	curENI.IPv4Addresses[key] = &AddressInfo{Address: key.addr(), Assigned: false}
 	log.Infof("Added ENI(%s)'s IP %s to datastore", eniID, ipv4)
 	return nil
 }
@@ -219,8 +301,8 @@ func (ds *DataStore) DelIPv4AddressFromStore(eniID string, ipv4 string) error {
 		return errors.New(UnknownENIError)
 	}
 
-	ipAddr, ok := curENI.IPv4Addresses[ipv4]
-	if !ok {
+	ipAddr := curENI.IPv4Address(ipv4)
+	if ipAddr == nil {
 		return errors.New(UnknownIPError)
 	}
 
@@ -232,18 +314,284 @@ func (ds *DataStore) DelIPv4AddressFromStore(eniID string, ipv4 string) error {
 	// Prometheus gauge
 	totalIPs.Set(float64(ds.total))
 
-	delete(curENI.IPv4Addresses, ipv4)
+	delete(curENI.IPv4Addresses, newIPv4Key(ipAddr.Address))
 
 	log.Infof("Deleted ENI(%s)'s IP %s from datastore", eniID, ipv4)
 	return nil
 }
 
+// AddIPv4PrefixToStore adds the addresses of an IPv4 prefix of an ENI to data store, e.g. "10.1.0.16/28" adds
+// 10.1.0.16 to 10.1.0.31. They are assigned to pods like secondary IPs, and can only be deleted together.
+func (ds *DataStore) AddIPv4PrefixToStore(eniID string, prefix netip.Prefix) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	curENI, ok := ds.eniIPPools[eniID]
+	if !ok {
+		return errors.New("add ENI's prefix to datastore: unknown ENI")
+	}
+	if len(curENI.prefixAddresses(prefix)) > 0 {
+		return errors.New(DuplicatePrefixError)
+	}
+	ips, err := prefixIPv4Addresses(prefix)
+	if err != nil {
+		return err
+	}
+
+	added := 0
+	for _, ipv4 := range ips {
+		key := newIPv4Key(ipv4)
+		if _, ok := curENI.IPv4Addresses[key]; ok {
+			log.Warnf("IP %s of prefix %s is already in the datastore for ENI %s", ipv4, prefix, eniID)
+			continue
+		}
+		curENI.IPv4Addresses[key] = &AddressInfo{Address: ipv4, Prefix: prefix}
+		added++
+	}
+	ds.total += added
+	// Prometheus gauge
+	totalIPs.Set(float64(ds.total))
+	log.Infof("Added ENI(%s)'s prefix %s with %d IPs to datastore", eniID, prefix, added)
+	return nil
+}
+
+// DelIPv4PrefixFromStore deletes the addresses of an IPv4 prefix of an ENI from datastore, if none of them is assigned
+// to a pod
+func (ds *DataStore) DelIPv4PrefixFromStore(eniID string, prefix netip.Prefix) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	curENI, ok := ds.eniIPPools[eniID]
+	if !ok {
+		return errors.New(UnknownENIError)
+	}
+	addrs := curENI.prefixAddresses(prefix)
+	if len(addrs) == 0 {
+		return errors.New(UnknownPrefixError)
+	}
+	for _, addr := range addrs {
+		if addr.Assigned {
+			return errors.New(PrefixInUseError)
+		}
+	}
+
+	for _, addr := range addrs {
+		delete(curENI.IPv4Addresses, newIPv4Key(addr.Address))
+	}
+	ds.total -= len(addrs)
+	// Prometheus gauge
+	totalIPs.Set(float64(ds.total))
+	log.Infof("Deleted ENI(%s)'s prefix %s from datastore", eniID, prefix)
+	return nil
+}
+
+// GetENIIPv4Prefixes returns the IPv4 prefixes of an ENI, sorted
+func (ds *DataStore) GetENIIPv4Prefixes(eniID string) ([]netip.Prefix, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	curENI, ok := ds.eniIPPools[eniID]
+	if !ok {
+		return nil, errors.New(UnknownENIError)
+	}
+	return curENI.ipv4Prefixes(func(*AddressInfo) bool { return true }), nil
+}
+
+// GetUnusedIPv4Prefixes returns the IPv4 prefixes of an ENI that can be released, the ones none of whose addresses is
+// assigned to a pod, cooling down or reserved, sorted
+func (ds *DataStore) GetUnusedIPv4Prefixes(eniID string) ([]netip.Prefix, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	curENI, ok := ds.eniIPPools[eniID]
+	if !ok {
+		return nil, errors.New(UnknownENIError)
+	}
+	return curENI.ipv4Prefixes(func(addr *AddressInfo) bool {
+		return !addr.Assigned && !addr.inCoolingPeriod() && !ds.reserved[newIPv4Key(addr.Address)]
+	}), nil
+}
+
+// prefixAddresses returns the addresses of the ENI carved out of an IPv4 prefix
+func (e *ENIIPPool) prefixAddresses(prefix netip.Prefix) []*AddressInfo {
+	var addrs []*AddressInfo
+	for _, addr := range e.IPv4Addresses {
+		if addr.Prefix == prefix {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// ipv4Prefixes returns the IPv4 prefixes of the ENI all of whose addresses pass the filter, sorted
+func (e *ENIIPPool) ipv4Prefixes(filter func(*AddressInfo) bool) []netip.Prefix {
+	passed := make(map[netip.Prefix]bool)
+	for _, addr := range e.IPv4Addresses {
+		if !addr.Prefix.IsValid() {
+			continue
+		}
+		if pass, ok := passed[addr.Prefix]; !ok || pass {
+			passed[addr.Prefix] = filter(addr)
+		}
+	}
+	var prefixes []netip.Prefix
+	for prefix, pass := range passed {
+		if pass {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return prefixes[i].Addr().Less(prefixes[j].Addr()) })
+	return prefixes
+}
+
+// prefixIPv4Addresses returns the addresses of an IPv4 prefix
+func prefixIPv4Addresses(prefix netip.Prefix) ([]netip.Addr, error) {
+	if !prefix.IsValid() || !prefix.Addr().Is4() || prefix.Masked() != prefix {
+		return nil, errors.Errorf("datastore: invalid IPv4 prefix %q", prefix)
+	}
+	size := 1 << uint(prefix.Addr().BitLen()-prefix.Bits())
+	if size > maxPrefixAddresses {
+		return nil, errors.Errorf("datastore: IPv4 prefix %s is larger than %d addresses", prefix, maxPrefixAddresses)
+	}
+
+	ips := make([]netip.Addr, 0, size)
+	for ip := prefix.Addr(); len(ips) < size; ip = ip.Next() {
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// AddIPv6AddressFromStore add an IPv6 address of an ENI to data store
+func (ds *DataStore) AddIPv6AddressFromStore(eniID string, ipv6 string) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	curENI, ok := ds.eniIPPools[eniID]
+	if !ok {
+		return errors.New("add ENI's IPv6 address to datastore: unknown ENI")
+	}
+
+	key, ok := parseIPv6Key(ipv6)
+	if !ok {
+		return errors.Errorf("add ENI's IPv6 address to datastore: invalid IPv6 address %q", ipv6)
+	}
+	_, ok = curENI.IPv6Addresses[key]
+	if ok {
+		return errors.New(DuplicateIPError)
+	}
+
+	curENI.IPv6Addresses[key] = &AddressInfo{Address: key.addr(), Assigned: false}
+	log.Infof("Added ENI(%s)'s IPv6 address %s to datastore", eniID, ipv6)
+	return nil
+}
+
+// DelIPv6AddressFromStore delete an IPv6 address of ENI from datastore
+func (ds *DataStore) DelIPv6AddressFromStore(eniID string, ipv6 string) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	curENI, ok := ds.eniIPPools[eniID]
+	if !ok {
+		return errors.New(UnknownENIError)
+	}
+
+	ipAddr := curENI.IPv6Address(ipv6)
+	if ipAddr == nil {
+		return errors.New(UnknownIPError)
+	}
+
+	if ipAddr.Assigned {
+		return errors.New(IPInUseError)
+	}
+
+	delete(curENI.IPv6Addresses, newIPv6Key(ipAddr.Address))
+	log.Infof("Deleted ENI(%s)'s IPv6 address %s from datastore", eniID, ipv6)
+	return nil
+}
+
+// AssignPodIPv6Address assigns an IPv6 address to a pod that already has an IPv4 address, or returns the one it already
+// has. If k8sPod.IPv6 is set, that address is taken out of the pool, e.g. for a running pod after an ipamd restart.
+// Otherwise the address comes from the ENI of the IPv4 address of the pod, so that both leave through the same ENI, or
+// from the primary ENI if that ENI has none left, whose IPv6 traffic is routed with the main route table.
+// It returns the assigned IPv6 address, error
+func (ds *DataStore) AssignPodIPv6Address(k8sPod *k8sapi.K8SPodInfo) (string, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	podKey := PodKey{
+		name:      k8sPod.Name,
+		namespace: k8sPod.Namespace,
+		container: k8sPod.Container,
+	}
+	podInfo, ok := ds.podsIP[podKey]
+	if !ok {
+		return "", ErrUnknownPod
+	}
+	if podInfo.IPv6 != "" {
+		if k8sPod.IPv6 != "" && k8sPod.IPv6 != podInfo.IPv6 {
+			log.Errorf("AssignPodIPv6Address: current IPv6 %s is changed to IPv6 %s for pod(name %s, namespace %s, container %s)",
+				podInfo.IPv6, k8sPod.IPv6, k8sPod.Name, k8sPod.Namespace, k8sPod.Container)
+			return "", errors.New("AssignPodIPv6Address: invalid pod with multiple IPv6 addresses")
+		}
+		return podInfo.IPv6, nil
+	}
+
+	// The zero Addr if the pod has none, which no address of the pools is
+	want, _ := netip.ParseAddr(k8sPod.IPv6)
+	for _, ownENI := range []bool{true, false} {
+		for _, eni := range ds.eniIPPools {
+			if k8sPod.IPv6 == "" && ownENI != (eni.DeviceNumber == podInfo.DeviceNumber) {
+				continue
+			}
+			if k8sPod.IPv6 == "" && !ownENI && !eni.IsPrimary {
+				continue
+			}
+			for _, addr := range eni.IPv6Addresses {
+				if want == addr.Address || (k8sPod.IPv6 == "" && !addr.Assigned && !addr.inCoolingPeriod()) {
+					addr.Assigned = true
+					log.Infof("AssignPodIPv6Address: Assign IPv6 %v to pod (name %s, namespace %s container %s)",
+						addr.Address, k8sPod.Name, k8sPod.Namespace, k8sPod.Container)
+					podInfo.IPv6 = addr.Address.String()
+					ds.setPodUnsafe(podKey, podInfo)
+					return podInfo.IPv6, nil
+				}
+			}
+		}
+	}
+	log.Errorf("DataStore has no available IPv6 addresses")
+	return "", errors.New("AssignPodIPv6Address: no available IPv6 addresses")
+}
+
 // AssignPodIPv4Address assigns an IPv4 address to pod
 // It returns the assigned IPv4 address, device number, error
 func (ds *DataStore) AssignPodIPv4Address(k8sPod *k8sapi.K8SPodInfo) (string, int, error) {
 	ds.lock.Lock()
 	defer ds.lock.Unlock()
+	return ds.assignPodUnsafe(k8sPod)
+}
+
+// AssignedIPv4Address is the IPv4 address assigned to a pod of a batch, and the device number of its ENI, or why the
+// pod got none
+type AssignedIPv4Address struct {
+	IP           string
+	DeviceNumber int
+	Err          error
+}
+
+// AssignPodIPv4Addresses assigns IPv4 addresses to a batch of pods like AssignPodIPv4Address, holding the lock once for
+// all of them. It returns the results in the order of the pods, each pod succeeds or fails on its own.
+func (ds *DataStore) AssignPodIPv4Addresses(k8sPods []*k8sapi.K8SPodInfo) []AssignedIPv4Address {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	results := make([]AssignedIPv4Address, len(k8sPods))
+	for i, k8sPod := range k8sPods {
+		results[i].IP, results[i].DeviceNumber, results[i].Err = ds.assignPodUnsafe(k8sPod)
+	}
+	return results
+}
 
+// assignPodUnsafe assigns an IPv4 address to a pod, or returns the one it already has, with ds.lock held
+func (ds *DataStore) assignPodUnsafe(k8sPod *k8sapi.K8SPodInfo) (string, int, error) {
 	log.Debugf("AssignIPv4Address: IP address pool stats: total: %d, assigned %d", ds.total, ds.assigned)
 	podKey := PodKey{
 		name:      k8sPod.Name,
@@ -267,6 +615,28 @@ func (ds *DataStore) AssignPodIPv4Address(k8sPod *k8sapi.K8SPodInfo) (string, in
 	return ds.assignPodIPv4AddressUnsafe(k8sPod)
 }
 
+// TransferPodIPv4Address hands the IPv4 address of a pod over to another pod that has none, without the address being
+// free in between
+func (ds *DataStore) TransferPodIPv4Address(from, to *k8sapi.K8SPodInfo) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	fromKey := PodKey{name: from.Name, namespace: from.Namespace, container: from.Container}
+	toKey := PodKey{name: to.Name, namespace: to.Namespace, container: to.Container}
+	podInfo, ok := ds.podsIP[fromKey]
+	if !ok {
+		return ErrUnknownPod
+	}
+	if _, ok := ds.podsIP[toKey]; ok {
+		return errors.New("TransferPodIPv4Address: the pod already has an IP address")
+	}
+	ds.deletePodUnsafe(fromKey)
+	ds.setPodUnsafe(toKey, podInfo)
+	log.Infof("TransferPodIPv4Address: IP %s of pod (name %s, namespace %s, container %s) transferred to pod (name %s, namespace %s, container %s)",
+		podInfo.IP, from.Name, from.Namespace, from.Container, to.Name, to.Namespace, to.Container)
+	return nil
+}
+
 // It returns the assigned IPv4 address, device number, error
 func (ds *DataStore) assignPodIPv4AddressUnsafe(k8sPod *k8sapi.K8SPodInfo) (string, int, error) {
 	podKey := PodKey{
@@ -274,35 +644,178 @@ func (ds *DataStore) assignPodIPv4AddressUnsafe(k8sPod *k8sapi.K8SPodInfo) (stri
 		namespace: k8sPod.Namespace,
 		container: k8sPod.Container,
 	}
+	if k8sPod.IP == "" && k8sPod.Tenant != "" {
+		// Tenant pods first fill the ENIs of their tenant, then claim a free ENI
+		if addr, deviceNumber, ok := ds.assignTenantIPv4Address(k8sPod, podKey, false); ok {
+			return addr, deviceNumber, nil
+		}
+		if addr, deviceNumber, ok := ds.assignTenantIPv4Address(k8sPod, podKey, true); ok {
+			return addr, deviceNumber, nil
+		}
+		log.Errorf("DataStore has no available IP addresses for tenant %s", k8sPod.Tenant)
+		return "", 0, errors.Errorf("assignPodIPv4AddressUnsafe: no available IP addresses for tenant %s", k8sPod.Tenant)
+	}
+	numaMiss := false
+	if k8sPod.IP == "" && k8sPod.NUMANode != nil {
+		// Pods with a NUMA node first get an IP of an ENI on the network card local to it
+		if addr, deviceNumber, ok := ds.assignNUMALocalIPv4Address(k8sPod, podKey); ok {
+			numaAssignments.With(prometheus.Labels{"local": "true"}).Inc()
+			return addr, deviceNumber, nil
+		}
+		numaMiss = true
+	}
+
+	// The zero Addr if the pod asks for none, which no address of the pools is
+	want, _ := netip.ParseAddr(k8sPod.IP)
+	want = want.Unmap()
 	for _, eni := range ds.eniIPPools {
 		if (k8sPod.IP == "") && (len(eni.IPv4Addresses) == eni.AssignedIPv4Addresses) {
 			// skip this ENI, since it has no available IP addresses
 			log.Debugf("AssignPodIPv4Address: Skip ENI %s that does not have available addresses", eni.ID)
 			continue
 		}
+		if k8sPod.IP == "" && eni.Tenant != "" {
+			log.Debugf("AssignPodIPv4Address: Skip ENI %s that is used by tenant %s", eni.ID, eni.Tenant)
+			continue
+		}
 		for _, addr := range eni.IPv4Addresses {
-			if k8sPod.IP == addr.Address {
+			if want == addr.Address {
 				// After L-IPAM restart and built IP warm-pool, it needs to take the existing running pod IP out of the pool.
 				if !addr.Assigned {
 					incrementAssignedCount(ds, eni, addr)
 				}
+				if k8sPod.Tenant != "" && !eni.IsPrimary {
+					eni.Tenant = k8sPod.Tenant
+				}
 				log.Infof("AssignPodIPv4Address: Reassign IP %v to pod (name %s, namespace %s)",
 					addr.Address, k8sPod.Name, k8sPod.Namespace)
-				ds.podsIP[podKey] = PodIPInfo{IP: addr.Address, DeviceNumber: eni.DeviceNumber}
-				return addr.Address, eni.DeviceNumber, nil
+				return ds.setPodIPv4Unsafe(podKey, eni, addr)
 			}
-			if !addr.Assigned && k8sPod.IP == "" && !addr.inCoolingPeriod() {
+			if !addr.Assigned && k8sPod.IP == "" && !addr.inCoolingPeriod() && !ds.reserved[newIPv4Key(addr.Address)] {
 				// This is triggered by a pod's Add Network command from CNI plugin
 				incrementAssignedCount(ds, eni, addr)
 				log.Infof("AssignPodIPv4Address: Assign IP %v to pod (name %s, namespace %s container %s)",
 					addr.Address, k8sPod.Name, k8sPod.Namespace, k8sPod.Container)
-				ds.podsIP[podKey] = PodIPInfo{IP: addr.Address, DeviceNumber: eni.DeviceNumber}
-				return addr.Address, eni.DeviceNumber, nil
+				if numaMiss {
+					numaAssignments.With(prometheus.Labels{"local": "false"}).Inc()
+				}
+				return ds.setPodIPv4Unsafe(podKey, eni, addr)
 			}
 		}
 	}
 	log.Errorf("DataStore has no available IP addresses")
-	return "", 0, errors.New("assignPodIPv4AddressUnsafe: no available IP addresses")
+	return "", 0, ErrNoAvailableIPv4Address
+}
+
+// assignTenantIPv4Address assigns an IP from an ENI used by the pod's tenant or, if claim is set, from a secondary ENI
+// that has no pods, which then becomes dedicated to the tenant
+func (ds *DataStore) assignTenantIPv4Address(k8sPod *k8sapi.K8SPodInfo, podKey PodKey, claim bool) (string, int, bool) {
+	for _, eni := range ds.eniIPPools {
+		if claim && !eni.isFree() {
+			continue
+		}
+		if !claim && eni.Tenant != k8sPod.Tenant {
+			continue
+		}
+		for _, addr := range eni.IPv4Addresses {
+			if addr.Assigned || addr.inCoolingPeriod() || ds.reserved[newIPv4Key(addr.Address)] {
+				continue
+			}
+			if claim {
+				log.Infof("AssignPodIPv4Address: Dedicate ENI %s to tenant %s", eni.ID, k8sPod.Tenant)
+				eni.Tenant = k8sPod.Tenant
+			}
+			incrementAssignedCount(ds, eni, addr)
+			log.Infof("AssignPodIPv4Address: Assign IP %v to pod (name %s, namespace %s container %s) of tenant %s",
+				addr.Address, k8sPod.Name, k8sPod.Namespace, k8sPod.Container, k8sPod.Tenant)
+			ip, deviceNumber, _ := ds.setPodIPv4Unsafe(podKey, eni, addr)
+			return ip, deviceNumber, true
+		}
+	}
+	return "", 0, false
+}
+
+// assignNUMALocalIPv4Address assigns an IP from an ENI without a tenant on the NUMA node of the pod
+func (ds *DataStore) assignNUMALocalIPv4Address(k8sPod *k8sapi.K8SPodInfo, podKey PodKey) (string, int, bool) {
+	for _, eni := range ds.eniIPPools {
+		if eni.NUMANode != *k8sPod.NUMANode || eni.Tenant != "" {
+			continue
+		}
+		for _, addr := range eni.IPv4Addresses {
+			if addr.Assigned || addr.inCoolingPeriod() || ds.reserved[newIPv4Key(addr.Address)] {
+				continue
+			}
+			incrementAssignedCount(ds, eni, addr)
+			log.Infof("AssignPodIPv4Address: Assign IP %v of ENI %s on NUMA node %d to pod (name %s, namespace %s container %s)",
+				addr.Address, eni.ID, eni.NUMANode, k8sPod.Name, k8sPod.Namespace, k8sPod.Container)
+			ip, deviceNumber, _ := ds.setPodIPv4Unsafe(podKey, eni, addr)
+			return ip, deviceNumber, true
+		}
+	}
+	return "", 0, false
+}
+
+// GetFreeENIs returns the number of secondary ENIs that are not used by any pod, and can be dedicated to a tenant
+func (ds *DataStore) GetFreeENIs() int {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	return ds.getFreeENIsUnsafe()
+}
+
+func (ds *DataStore) getFreeENIsUnsafe() int {
+	free := 0
+	for _, eni := range ds.eniIPPools {
+		if eni.isFree() && len(eni.IPv4Addresses) > 0 {
+			free++
+		}
+	}
+	return free
+}
+
+// GetFreeIPv4Addresses returns the IPv4 addresses that can be assigned to a pod without a tenant: the ones that are not
+// assigned, cooling down or reserved, on ENIs not used by a tenant
+func (ds *DataStore) GetFreeIPv4Addresses() []string {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	var free []string
+	for _, eni := range ds.eniIPPools {
+		if eni.Tenant != "" {
+			continue
+		}
+		for _, addr := range eni.IPv4Addresses {
+			if !addr.Assigned && !addr.inCoolingPeriod() && !ds.reserved[newIPv4Key(addr.Address)] {
+				free = append(free, addr.Address.String())
+			}
+		}
+	}
+	sort.Strings(free)
+	return free
+}
+
+// ReserveIPv4Addresses keeps the given IPv4 addresses from being assigned to new pods, in addition to the ones already
+// reserved, e.g. while they may still be used by pods that are not known yet. Pods asking for one of them by IP still
+// get it.
+func (ds *DataStore) ReserveIPv4Addresses(ips []string) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	if ds.reserved == nil {
+		ds.reserved = make(map[ipv4Key]bool)
+	}
+	for _, ip := range ips {
+		if key, ok := parseIPv4Key(ip); ok {
+			ds.reserved[key] = true
+		}
+	}
+}
+
+// ClearReservedIPv4Addresses lets the reserved IPv4 addresses be assigned to new pods again
+func (ds *DataStore) ClearReservedIPv4Addresses() {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	ds.reserved = nil
 }
 
 func incrementAssignedCount(ds *DataStore, eni *ENIIPPool, addr *AddressInfo) {
@@ -318,12 +831,28 @@ func (ds *DataStore) GetStats() (int, int) {
 	return ds.total, ds.assigned
 }
 
+// GetSharedStats returns the total number of IPv4 addresses and the number assigned to pods, of the ENIs not used by a
+// tenant. The addresses of the ENIs of a tenant can not be assigned to other pods, so they are not part of the warm pool.
+func (ds *DataStore) GetSharedStats() (int, int) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	total, assigned := ds.total, ds.assigned
+	for _, eni := range ds.eniIPPools {
+		if eni.Tenant != "" {
+			total -= len(eni.IPv4Addresses)
+			assigned -= eni.AssignedIPv4Addresses
+		}
+	}
+	return total, assigned
+}
+
 // IsRequiredForWarmIPTarget determines if this ENI has warm IPs that are required to fulfill whatever WARM_IP_TARGET is
 // set to.
 func (ds *DataStore) isRequiredForWarmIPTarget(warmIPTarget int, eni *ENIIPPool) bool {
 	otherWarmIPs := 0
 	for _, other := range ds.eniIPPools {
-		if other.ID != eni.ID {
+		if other.ID != eni.ID && other.Tenant == "" {
 			otherWarmIPs += len(other.IPv4Addresses) - other.AssignedIPv4Addresses
 		}
 	}
@@ -337,7 +866,7 @@ func (ds *DataStore) getDeletableENI(warmIPTarget int) *ENIIPPool {
 			continue
 		}
 
-		if eni.isTooYoung() {
+		if eni.isTooYoung(ds.minENILifetime) {
 			log.Debugf("ENI %s cannot be deleted because it is too young", eni.ID)
 			continue
 		}
@@ -352,6 +881,11 @@ func (ds *DataStore) getDeletableENI(warmIPTarget int) *ENIIPPool {
 			continue
 		}
 
+		if ds.keepFreeENI && eni.isFree() && ds.getFreeENIsUnsafe() <= 1 {
+			log.Debugf("ENI %s cannot be deleted because it is the last free ENI for a new tenant", eni.ID)
+			continue
+		}
+
 		if warmIPTarget != 0 && ds.isRequiredForWarmIPTarget(warmIPTarget, eni) {
 			log.Debugf("ENI %s cannot be deleted because it is required for WARM_IP_TARGET: %d", eni.ID, warmIPTarget)
 			continue
@@ -364,8 +898,8 @@ func (ds *DataStore) getDeletableENI(warmIPTarget int) *ENIIPPool {
 }
 
 // IsTooYoung returns true if the ENI hasn't been around long enough to be deleted.
-func (e *ENIIPPool) isTooYoung() bool {
-	return time.Since(e.createTime) < minLifeTime
+func (e *ENIIPPool) isTooYoung(minENILifetime time.Duration) bool {
+	return time.Since(e.createTime) < minENILifetime
 }
 
 // HasIPInCooling returns true if an IP address was unassigned recently.
@@ -378,6 +912,11 @@ func (e *ENIIPPool) hasPods() bool {
 	return e.AssignedIPv4Addresses != 0
 }
 
+// isFree returns true if the ENI is a secondary ENI without pods, which can be dedicated to a tenant.
+func (e *ENIIPPool) isFree() bool {
+	return !e.IsPrimary && e.Tenant == "" && !e.hasPods()
+}
+
 // GetENINeedsIP finds an ENI in the datastore that needs more IP addresses allocated
 func (ds *DataStore) GetENINeedsIP(maxIPperENI int, skipPrimary bool) *ENIIPPool {
 	for _, eni := range ds.eniIPPools {
@@ -394,6 +933,54 @@ func (ds *DataStore) GetENINeedsIP(maxIPperENI int, skipPrimary bool) *ENIIPPool
 	return nil
 }
 
+// GetENINeedsIPv4Prefix finds an ENI in the datastore that has room for more IPv4 prefixes, and returns it with the
+// number of prefixes it has room for. Each prefix and each secondary IP address of the ENI takes one of the
+// maxPrefixesPerENI slots. It returns "" if there is none.
+func (ds *DataStore) GetENINeedsIPv4Prefix(maxPrefixesPerENI int, skipPrimary bool) (string, int) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	for _, eni := range ds.eniIPPools {
+		if skipPrimary && eni.IsPrimary {
+			log.Debugf("Skip the primary ENI for need prefix check")
+			continue
+		}
+		secondaryIPs := 0
+		prefixes := make(map[netip.Prefix]bool)
+		for _, addr := range eni.IPv4Addresses {
+			if !addr.Prefix.IsValid() {
+				secondaryIPs++
+			} else {
+				prefixes[addr.Prefix] = true
+			}
+		}
+		if free := maxPrefixesPerENI - secondaryIPs - len(prefixes); free > 0 {
+			log.Debugf("Found ENI %s that has room for %d more prefixes: secondary IPs=%d, prefixes=%d, max=%d",
+				eni.ID, free, secondaryIPs, len(prefixes), maxPrefixesPerENI)
+			return eni.ID, free
+		}
+	}
+	return "", 0
+}
+
+// GetUnusedENI returns an ENI that can be removed from the datastore, with its device number and IPv4 addresses, without
+// removing it, or "" if there is none
+func (ds *DataStore) GetUnusedENI(warmIPTarget int) (string, int, []string) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	deletableENI := ds.getDeletableENI(warmIPTarget)
+	if deletableENI == nil {
+		return "", 0, nil
+	}
+	ips := make([]string, 0, len(deletableENI.IPv4Addresses))
+	for _, addr := range deletableENI.IPv4Addresses {
+		ips = append(ips, addr.Address.String())
+	}
+	sort.Strings(ips)
+	return deletableENI.ID, deletableENI.DeviceNumber, ips
+}
+
 // RemoveUnusedENIFromStore removes a deletable ENI from the data store.
 // It returns the name of the ENI which has been removed from the data store and needs to be deleted,
 // or empty string if no ENI could be removed.
@@ -444,6 +1031,141 @@ func (ds *DataStore) RemoveENIFromDataStore(eni string) error {
 	return nil
 }
 
+// setPodIPv4Unsafe records an IPv4 address of an ENI as the IP of a pod, with ds.lock held. It returns the address,
+// the device number of the ENI and a nil error, as the assignment functions do.
+func (ds *DataStore) setPodIPv4Unsafe(podKey PodKey, eni *ENIIPPool, addr *AddressInfo) (string, int, error) {
+	ip := addr.Address.String()
+	ds.setPodUnsafe(podKey, PodIPInfo{IP: ip, DeviceNumber: eni.DeviceNumber})
+	return ip, eni.DeviceNumber, nil
+}
+
+// setPodUnsafe records the IPs of a pod, with ds.lock held
+func (ds *DataStore) setPodUnsafe(podKey PodKey, podInfo PodIPInfo) {
+	if _, ok := ds.podsIP[podKey]; ok {
+		// The key of the pod is replaced too
+		podKey.namespace = ds.strs.get(podKey.namespace)
+	} else {
+		podKey.namespace = ds.strs.intern(podKey.namespace)
+	}
+	ds.podsIP[podKey] = podInfo
+}
+
+// deletePodUnsafe forgets a pod, with ds.lock held
+func (ds *DataStore) deletePodUnsafe(podKey PodKey) {
+	if _, ok := ds.podsIP[podKey]; ok {
+		ds.strs.release(podKey.namespace)
+		delete(ds.podsIP, podKey)
+	}
+}
+
+// WithIPsUnassigned calls fn while holding the lock of the datastore if none of the IPs is assigned to a pod, so that
+// none of them gets assigned until fn returns. Pods whose name_namespace_container key is ignored do not count. It
+// returns false without calling fn if one of the IPs is assigned.
+func (ds *DataStore) WithIPsUnassigned(ips []string, ignore func(key string) bool, fn func() error) (bool, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	for podKey, podInfo := range ds.podsIP {
+		if ignore != nil && ignore(podKey.name+"_"+podKey.namespace+"_"+podKey.container) {
+			continue
+		}
+		for _, ip := range ips {
+			if ip == podInfo.IP || (podInfo.IPv6 != "" && ip == podInfo.IPv6) {
+				return false, nil
+			}
+		}
+	}
+	return true, fn()
+}
+
+// EvictIPv4Address removes an IPv4 address of an ENI from the datastore even if a pod uses it, e.g. when it was
+// unassigned from the ENI outside of ipamd. It returns the pod that used it, nil if none did.
+func (ds *DataStore) EvictIPv4Address(eniID string, ipv4 string) (*k8sapi.K8SPodInfo, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	curENI, ok := ds.eniIPPools[eniID]
+	if !ok {
+		return nil, errors.New(UnknownENIError)
+	}
+	ipAddr := curENI.IPv4Address(ipv4)
+	if ipAddr == nil {
+		return nil, errors.New(UnknownIPError)
+	}
+
+	var pod *k8sapi.K8SPodInfo
+	if ipAddr.Assigned {
+		pod = ds.evictPodUnsafe(ipAddr.Address.String())
+		ds.assigned--
+		assignedIPs.Set(float64(ds.assigned))
+		curENI.AssignedIPv4Addresses--
+		if curENI.AssignedIPv4Addresses == 0 {
+			curENI.Tenant = ""
+		}
+	}
+	ds.total--
+	totalIPs.Set(float64(ds.total))
+	delete(curENI.IPv4Addresses, newIPv4Key(ipAddr.Address))
+	log.Infof("Evicted ENI(%s)'s IP %s from datastore", eniID, ipv4)
+	return pod, nil
+}
+
+// EvictENI removes an ENI from the datastore even if pods use its IPs, e.g. when it was detached outside of ipamd. It
+// returns the pods that used it.
+func (ds *DataStore) EvictENI(eni string) ([]*k8sapi.K8SPodInfo, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	eniIPPool, ok := ds.eniIPPools[eni]
+	if !ok {
+		return nil, errors.New(UnknownENIError)
+	}
+	var pods []*k8sapi.K8SPodInfo
+	for _, ipAddr := range eniIPPool.IPv4Addresses {
+		if !ipAddr.Assigned {
+			continue
+		}
+		if pod := ds.evictPodUnsafe(ipAddr.Address.String()); pod != nil {
+			pods = append(pods, pod)
+		}
+	}
+	ds.assigned -= eniIPPool.AssignedIPv4Addresses
+	assignedIPs.Set(float64(ds.assigned))
+	ds.total -= len(eniIPPool.IPv4Addresses)
+	totalIPs.Set(float64(ds.total))
+	delete(ds.eniIPPools, eni)
+	enis.Set(float64(len(ds.eniIPPools)))
+	log.Infof("Evicted ENI %s with %d pods from datastore: total: %d, assigned: %d", eni, len(pods), ds.total, ds.assigned)
+	return pods, nil
+}
+
+// evictPodUnsafe forgets the pod using an IPv4 address and releases its IPv6 address, if any. It returns the pod, nil if
+// no pod uses the address.
+func (ds *DataStore) evictPodUnsafe(ipv4 string) *k8sapi.K8SPodInfo {
+	for podKey, podInfo := range ds.podsIP {
+		if podInfo.IP != ipv4 {
+			continue
+		}
+		if podInfo.IPv6 != "" {
+			for _, eni := range ds.eniIPPools {
+				if ip := eni.IPv6Address(podInfo.IPv6); ip != nil {
+					ip.Assigned = false
+					ip.UnassignedTime = time.Now()
+				}
+			}
+		}
+		ds.deletePodUnsafe(podKey)
+		return &k8sapi.K8SPodInfo{
+			Name:      podKey.name,
+			Namespace: podKey.namespace,
+			Container: podKey.container,
+			IP:        podInfo.IP,
+			IPv6:      podInfo.IPv6,
+		}
+	}
+	return nil
+}
+
 // UnassignPodIPv4Address a) find out the IP address based on PodName and PodNameSpace
 // b)  mark IP address as unassigned c) returns IP address, ENI's device number, error
 func (ds *DataStore) UnassignPodIPv4Address(k8sPod *k8sapi.K8SPodInfo) (string, int, error) {
@@ -465,8 +1187,8 @@ func (ds *DataStore) UnassignPodIPv4Address(k8sPod *k8sapi.K8SPodInfo) (string,
 	}
 
 	for _, eni := range ds.eniIPPools {
-		ip, ok := eni.IPv4Addresses[ipAddr.IP]
-		if ok && ip.Assigned {
+		ip := eni.IPv4Address(ipAddr.IP)
+		if ip != nil && ip.Assigned {
 			ip.Assigned = false
 			ds.assigned--
 			assignedIPs.Set(float64(ds.assigned))
@@ -474,10 +1196,14 @@ func (ds *DataStore) UnassignPodIPv4Address(k8sPod *k8sapi.K8SPodInfo) (string,
 			curTime := time.Now()
 			ip.UnassignedTime = curTime
 			eni.lastUnassignedTime = curTime
+			if eni.AssignedIPv4Addresses == 0 && eni.Tenant != "" {
+				log.Infof("UnassignPodIPv4Address: ENI %s is no longer used by tenant %s", eni.ID, eni.Tenant)
+				eni.Tenant = ""
+			}
 			log.Infof("UnassignPodIPv4Address: pod (Name: %s, NameSpace %s Container %s)'s ipAddr %s, DeviceNumber%d",
 				k8sPod.Name, k8sPod.Namespace, k8sPod.Container, ip.Address, eni.DeviceNumber)
-			delete(ds.podsIP, podKey)
-			return ip.Address, eni.DeviceNumber, nil
+			ds.deletePodUnsafe(podKey)
+			return ip.Address.String(), eni.DeviceNumber, nil
 		}
 	}
 
@@ -486,6 +1212,57 @@ func (ds *DataStore) UnassignPodIPv4Address(k8sPod *k8sapi.K8SPodInfo) (string,
 	return "", 0, ErrUnknownPodIP
 }
 
+// UnassignPodIPv6Address releases the IPv6 address of a pod, if it has one. It must be called before
+// UnassignPodIPv4Address, which forgets the pod.
+// It returns the IPv6 address, error
+func (ds *DataStore) UnassignPodIPv6Address(k8sPod *k8sapi.K8SPodInfo) (string, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	podKey := PodKey{
+		name:      k8sPod.Name,
+		namespace: k8sPod.Namespace,
+		container: k8sPod.Container,
+	}
+	podInfo, ok := ds.podsIP[podKey]
+	if !ok {
+		return "", ErrUnknownPod
+	}
+	if podInfo.IPv6 == "" {
+		return "", nil
+	}
+
+	for _, eni := range ds.eniIPPools {
+		ip := eni.IPv6Address(podInfo.IPv6)
+		if ip != nil && ip.Assigned {
+			ip.Assigned = false
+			ip.UnassignedTime = time.Now()
+			log.Infof("UnassignPodIPv6Address: pod (Name: %s, NameSpace %s Container %s)'s IPv6 %s",
+				k8sPod.Name, k8sPod.Namespace, k8sPod.Container, ip.Address)
+			podInfo.IPv6 = ""
+			ds.setPodUnsafe(podKey, podInfo)
+			return ip.Address.String(), nil
+		}
+	}
+
+	log.Warnf("UnassignPodIPv6Address: Failed to find pod %s namespace %s container %s using IPv6 %s",
+		k8sPod.Name, k8sPod.Namespace, k8sPod.Container, podInfo.IPv6)
+	return "", ErrUnknownPodIP
+}
+
+// HasPod returns whether a container of the pod with the given namespace and name has an IP
+func (ds *DataStore) HasPod(namespace, name string) bool {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	for podKey := range ds.podsIP {
+		if podKey.name == name && podKey.namespace == namespace {
+			return true
+		}
+	}
+	return false
+}
+
 // GetPodInfos provides pod IP information to introspection endpoint
 func (ds *DataStore) GetPodInfos() *map[string]PodIPInfo {
 	ds.lock.Lock()
@@ -538,12 +1315,47 @@ func (ds *DataStore) GetENIIPPools(eni string) (map[string]*AddressInfo, error)
 	}
 
 	var ipPool = make(map[string]*AddressInfo, len(eniIPPool.IPv4Addresses))
-	for ip, ipAddr := range eniIPPool.IPv4Addresses {
-		ipPool[ip] = ipAddr
+	for _, ipAddr := range eniIPPool.IPv4Addresses {
+		ipPool[ipAddr.Address.String()] = ipAddr
 	}
 	return ipPool, nil
 }
 
+// GetENIIPv6Pools returns eni's IPv6 address list
+func (ds *DataStore) GetENIIPv6Pools(eni string) (map[string]*AddressInfo, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	eniIPPool, ok := ds.eniIPPools[eni]
+	if !ok {
+		return nil, errors.New(UnknownENIError)
+	}
+
+	var ipPool = make(map[string]*AddressInfo, len(eniIPPool.IPv6Addresses))
+	for _, ipAddr := range eniIPPool.IPv6Addresses {
+		ipPool[ipAddr.Address.String()] = ipAddr
+	}
+	return ipPool, nil
+}
+
+// IPv4Address returns the IPv4 address of the ENI given in text form, nil if the ENI does not have it
+func (e *ENIIPPool) IPv4Address(ip string) *AddressInfo {
+	key, ok := parseIPv4Key(ip)
+	if !ok {
+		return nil
+	}
+	return e.IPv4Addresses[key]
+}
+
+// IPv6Address returns the IPv6 address of the ENI given in text form, nil if the ENI does not have it
+func (e *ENIIPPool) IPv6Address(ip string) *AddressInfo {
+	key, ok := parseIPv6Key(ip)
+	if !ok {
+		return nil
+	}
+	return e.IPv6Addresses[key]
+}
+
 // InCoolingPeriod checks whether an addr is in addressCoolingPeriod
 func (addr AddressInfo) inCoolingPeriod() bool {
 	return time.Since(addr.UnassignedTime) <= addressCoolingPeriod
@@ -14,10 +14,17 @@
 package datastore
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"runtime"
 	"testing"
 	"time"
 
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -105,6 +112,48 @@ func TestAddENIIPv4Address(t *testing.T) {
 
 }
 
+func TestIPv4Prefixes(t *testing.T) {
+	ds := NewDataStore()
+	assert.NoError(t, ds.AddENI("eni-1", 1, false))
+	assert.NoError(t, ds.AddIPv4AddressFromStore("eni-1", "10.0.0.5"))
+
+	assert.NoError(t, ds.AddIPv4PrefixToStore("eni-1", netip.MustParsePrefix("10.0.0.16/28")))
+	assert.Equal(t, 17, ds.total)
+	assert.Equal(t, netip.MustParsePrefix("10.0.0.16/28"), ds.eniIPPools["eni-1"].IPv4Address("10.0.0.31").Prefix)
+	assert.Nil(t, ds.eniIPPools["eni-1"].IPv4Address("10.0.0.32"))
+	assert.EqualError(t, ds.AddIPv4PrefixToStore("eni-1", netip.MustParsePrefix("10.0.0.16/28")), DuplicatePrefixError)
+	assert.Error(t, ds.AddIPv4PrefixToStore("eni-1", netip.MustParsePrefix("10.0.0.17/28")))
+	assert.Error(t, ds.AddIPv4PrefixToStore("eni-1", netip.MustParsePrefix("10.0.0.0/16")))
+	assert.Error(t, ds.AddIPv4PrefixToStore("dummy-eni", netip.MustParsePrefix("10.0.0.32/28")))
+	assert.NoError(t, ds.AddIPv4PrefixToStore("eni-1", netip.MustParsePrefix("10.0.0.32/28")))
+	assert.Equal(t, 33, ds.total)
+
+	prefixes, err := ds.GetENIIPv4Prefixes("eni-1")
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.16/28"), netip.MustParsePrefix("10.0.0.32/28")}, prefixes)
+
+	// The secondary IP and the prefixes take 3 slots
+	eni, free := ds.GetENINeedsIPv4Prefix(4, false)
+	assert.Equal(t, "eni-1", eni)
+	assert.Equal(t, 1, free)
+	eni, _ = ds.GetENINeedsIPv4Prefix(3, false)
+	assert.Equal(t, "", eni)
+
+	// Only the prefix of the address of the pod is in use
+	ds.eniIPPools["eni-1"].IPv4Address("10.0.0.20").Assigned = true
+	unused, err := ds.GetUnusedIPv4Prefixes("eni-1")
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.32/28")}, unused)
+	assert.EqualError(t, ds.DelIPv4PrefixFromStore("eni-1", netip.MustParsePrefix("10.0.0.16/28")), PrefixInUseError)
+
+	assert.NoError(t, ds.DelIPv4PrefixFromStore("eni-1", netip.MustParsePrefix("10.0.0.32/28")))
+	assert.Equal(t, 17, ds.total)
+	assert.EqualError(t, ds.DelIPv4PrefixFromStore("eni-1", netip.MustParsePrefix("10.0.0.32/28")), UnknownPrefixError)
+	prefixes, err = ds.GetENIIPv4Prefixes("eni-1")
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.16/28")}, prefixes)
+}
+
 func TestGetENIIPPools(t *testing.T) {
 	ds := NewDataStore()
 
@@ -170,6 +219,64 @@ func TestDelENIIPv4Address(t *testing.T) {
 	assert.Equal(t, len(ds.eniIPPools["eni-1"].IPv4Addresses), 2)
 }
 
+func TestEvictIPv4Address(t *testing.T) {
+	ds := NewDataStore()
+	assert.NoError(t, ds.AddENI("eni-1", 1, true))
+	assert.NoError(t, ds.AddIPv4AddressFromStore("eni-1", "1.1.1.1"))
+	assert.NoError(t, ds.AddIPv4AddressFromStore("eni-1", "1.1.1.2"))
+	assert.NoError(t, ds.AddIPv6AddressFromStore("eni-1", "2001:db8::1"))
+	_, _, err := ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-1", Namespace: "ns-1", IP: "1.1.1.1"})
+	assert.NoError(t, err)
+	_, err = ds.AssignPodIPv6Address(&k8sapi.K8SPodInfo{Name: "pod-1", Namespace: "ns-1"})
+	assert.NoError(t, err)
+
+	// The IP is in use, it can only be evicted
+	assert.Error(t, ds.DelIPv4AddressFromStore("eni-1", "1.1.1.1"))
+	pod, err := ds.EvictIPv4Address("eni-1", "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, &k8sapi.K8SPodInfo{Name: "pod-1", Namespace: "ns-1", IP: "1.1.1.1", IPv6: "2001:db8::1"}, pod)
+	assert.Equal(t, 1, ds.total)
+	assert.Equal(t, 0, ds.assigned)
+	assert.Equal(t, 0, ds.eniIPPools["eni-1"].AssignedIPv4Addresses)
+	assert.False(t, ds.eniIPPools["eni-1"].IPv6Address("2001:db8::1").Assigned)
+	assert.Empty(t, ds.podsIP)
+
+	pod, err = ds.EvictIPv4Address("eni-1", "1.1.1.2")
+	assert.NoError(t, err)
+	assert.Nil(t, pod)
+	assert.Equal(t, 0, ds.total)
+
+	_, err = ds.EvictIPv4Address("eni-1", "1.1.1.2")
+	assert.Error(t, err)
+	_, err = ds.EvictIPv4Address("eni-2", "1.1.1.2")
+	assert.Error(t, err)
+}
+
+func TestEvictENI(t *testing.T) {
+	ds := NewDataStore()
+	assert.NoError(t, ds.AddENI("eni-1", 1, true))
+	assert.NoError(t, ds.AddENI("eni-2", 2, false))
+	assert.NoError(t, ds.AddIPv4AddressFromStore("eni-1", "1.1.1.1"))
+	assert.NoError(t, ds.AddIPv4AddressFromStore("eni-2", "1.1.2.1"))
+	assert.NoError(t, ds.AddIPv4AddressFromStore("eni-2", "1.1.2.2"))
+	_, _, err := ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-1", Namespace: "ns-1", IP: "1.1.1.1"})
+	assert.NoError(t, err)
+	_, _, err = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-2", Namespace: "ns-1", IP: "1.1.2.1"})
+	assert.NoError(t, err)
+
+	assert.Error(t, ds.RemoveENIFromDataStore("eni-2"))
+	pods, err := ds.EvictENI("eni-2")
+	assert.NoError(t, err)
+	assert.Equal(t, []*k8sapi.K8SPodInfo{{Name: "pod-2", Namespace: "ns-1", IP: "1.1.2.1"}}, pods)
+	assert.Equal(t, 1, ds.total)
+	assert.Equal(t, 1, ds.assigned)
+	assert.Equal(t, 1, ds.GetENIs())
+	assert.Len(t, ds.podsIP, 1)
+
+	_, err = ds.EvictENI("eni-2")
+	assert.Error(t, err)
+}
+
 func TestPodIPv4Address(t *testing.T) {
 	ds := NewDataStore()
 
@@ -196,6 +303,8 @@ func TestPodIPv4Address(t *testing.T) {
 	assert.Equal(t, 3, ds.total)
 	assert.Equal(t, 2, len(ds.eniIPPools["eni-1"].IPv4Addresses))
 	assert.Equal(t, 1, ds.eniIPPools["eni-1"].AssignedIPv4Addresses)
+	assert.True(t, ds.HasPod("ns-1", "pod-1"))
+	assert.False(t, ds.HasPod("ns-2", "pod-1"))
 
 	ip, _, err = ds.AssignPodIPv4Address(&podInfo)
 	assert.NoError(t, err)
@@ -295,9 +404,451 @@ func TestPodIPv4Address(t *testing.T) {
 
 	ds.eniIPPools["eni-2"].createTime = time.Time{}
 	ds.eniIPPools["eni-2"].lastUnassignedTime = time.Time{}
+	eni, deviceNumber, ips := ds.GetUnusedENI(noWarmIPTarget)
+	assert.Equal(t, eni, "eni-2")
+	assert.Equal(t, deviceNumber, 2)
+	assert.Equal(t, len(ips), 1)
+	assert.Equal(t, ds.total, 3)
+
 	eni = ds.RemoveUnusedENIFromStore(noWarmIPTarget)
 	assert.Equal(t, eni, "eni-2")
 
 	assert.Equal(t, ds.total, 2)
 	assert.Equal(t, ds.assigned, 2)
 }
+
+func TestTenantPodIPv4Address(t *testing.T) {
+	ds := NewDataStore()
+
+	ds.AddENI("eni-1", 1, true)
+	ds.AddENI("eni-2", 2, false)
+	ds.AddIPv4AddressFromStore("eni-1", "1.1.1.1")
+	ds.AddIPv4AddressFromStore("eni-2", "1.1.2.1")
+	ds.AddIPv4AddressFromStore("eni-2", "1.1.2.2")
+	assert.Equal(t, 1, ds.GetFreeENIs())
+
+	// A tenant claims a free secondary ENI, never the primary one
+	ip, deviceNumber, err := ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-1", Namespace: "ns-1", Tenant: "blue"})
+	assert.NoError(t, err)
+	assert.Contains(t, []string{"1.1.2.1", "1.1.2.2"}, ip)
+	assert.Equal(t, 2, deviceNumber)
+	assert.Equal(t, "blue", ds.eniIPPools["eni-2"].Tenant)
+	assert.Equal(t, 0, ds.GetFreeENIs())
+
+	// Pods without a tenant never use a tenant ENI
+	ip, _, err = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-2", Namespace: "ns-2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1.1.1", ip)
+	_, _, err = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-3", Namespace: "ns-2"})
+	assert.Error(t, err)
+
+	// Nor do pods of other tenants
+	_, _, err = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-4", Namespace: "ns-3", Tenant: "red"})
+	assert.Error(t, err)
+
+	_, deviceNumber, err = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-5", Namespace: "ns-1", Tenant: "blue"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, deviceNumber)
+
+	// The ENI is released once the last pod of the tenant is gone
+	_, _, err = ds.UnassignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-1", Namespace: "ns-1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "blue", ds.eniIPPools["eni-2"].Tenant)
+	_, _, err = ds.UnassignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-5", Namespace: "ns-1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "", ds.eniIPPools["eni-2"].Tenant)
+	assert.Equal(t, 1, ds.GetFreeENIs())
+
+	// The last free ENI is kept for a new tenant
+	ds.eniIPPools["eni-2"].createTime = time.Time{}
+	ds.eniIPPools["eni-2"].lastUnassignedTime = time.Time{}
+	ds.SetKeepFreeENI(true)
+	assert.Equal(t, "", ds.RemoveUnusedENIFromStore(0))
+	ds.SetKeepFreeENI(false)
+	assert.Equal(t, "eni-2", ds.RemoveUnusedENIFromStore(0))
+
+	// After a restart, the ENI of a running tenant pod is dedicated to its tenant again
+	ds = NewDataStore()
+	ds.AddENI("eni-2", 2, false)
+	ds.AddIPv4AddressFromStore("eni-2", "1.1.2.1")
+	_, _, err = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-1", Namespace: "ns-1", IP: "1.1.2.1", Tenant: "blue"})
+	assert.NoError(t, err)
+	assert.Equal(t, "blue", ds.eniIPPools["eni-2"].Tenant)
+}
+
+func TestNUMAPodIPv4Address(t *testing.T) {
+	ds := NewDataStore()
+
+	ds.AddENI("eni-1", 0, true)
+	ds.AddENI("eni-2", 1, false)
+	ds.AddENI("eni-3", 2, false)
+	ds.AddIPv4AddressFromStore("eni-1", "1.1.1.1")
+	ds.AddIPv4AddressFromStore("eni-2", "1.1.2.1")
+	ds.AddIPv4AddressFromStore("eni-3", "1.1.3.1")
+	assert.NoError(t, ds.SetENINUMANode("eni-1", 0))
+	assert.NoError(t, ds.SetENINUMANode("eni-2", 0))
+	assert.NoError(t, ds.SetENINUMANode("eni-3", 1))
+	assert.Error(t, ds.SetENINUMANode("eni-4", 1))
+
+	// A pod gets an IP of an ENI on its NUMA node
+	node := 1
+	ip, deviceNumber, err := ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-1", Namespace: "ns-1", NUMANode: &node})
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1.3.1", ip)
+	assert.Equal(t, 2, deviceNumber)
+
+	// Or any other IP once the ENIs of its NUMA node are full
+	ip, _, err = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-2", Namespace: "ns-1", NUMANode: &node})
+	assert.NoError(t, err)
+	assert.Contains(t, []string{"1.1.1.1", "1.1.2.1"}, ip)
+}
+
+func TestPodIPv6Address(t *testing.T) {
+	ds := NewDataStore()
+	ds.AddENI("eni-1", 0, true)
+	ds.AddIPv4AddressFromStore("eni-1", "1.1.1.1")
+	ds.AddIPv4AddressFromStore("eni-1", "1.1.1.2")
+	ds.AddIPv6AddressFromStore("eni-1", "2001:db8::1")
+	ds.AddIPv6AddressFromStore("eni-1", "2001:db8::2")
+
+	err := ds.AddIPv6AddressFromStore("eni-1", "2001:db8::2")
+	assert.EqualError(t, err, DuplicateIPError)
+
+	// A pod must get an IPv4 address first
+	podInfo := k8sapi.K8SPodInfo{Name: "pod-1", Namespace: "ns-1"}
+	_, err = ds.AssignPodIPv6Address(&podInfo)
+	assert.Equal(t, ErrUnknownPod, err)
+
+	_, _, err = ds.AssignPodIPv4Address(&podInfo)
+	assert.NoError(t, err)
+	ip6, err := ds.AssignPodIPv6Address(&podInfo)
+	assert.NoError(t, err)
+	assert.True(t, ds.eniIPPools["eni-1"].IPv6Address(ip6).Assigned)
+
+	// duplicate add
+	dup, err := ds.AssignPodIPv6Address(&podInfo)
+	assert.NoError(t, err)
+	assert.Equal(t, ip6, dup)
+
+	err = ds.DelIPv6AddressFromStore("eni-1", ip6)
+	assert.EqualError(t, err, IPInUseError)
+
+	// A running pod takes its address out of the pool after a restart
+	other := "2001:db8::1"
+	if ip6 == other {
+		other = "2001:db8::2"
+	}
+	podInfo2 := k8sapi.K8SPodInfo{Name: "pod-2", Namespace: "ns-1", IP: "1.1.1.2", IPv6: other}
+	_, _, err = ds.AssignPodIPv4Address(&podInfo2)
+	assert.NoError(t, err)
+	ip6, err = ds.AssignPodIPv6Address(&podInfo2)
+	assert.NoError(t, err)
+	assert.Equal(t, other, ip6)
+	assert.Equal(t, other, (*ds.GetPodInfos())["pod-2_ns-1_"].IPv6)
+
+	ip6, err = ds.UnassignPodIPv6Address(&podInfo2)
+	assert.NoError(t, err)
+	assert.Equal(t, other, ip6)
+	assert.False(t, ds.eniIPPools["eni-1"].IPv6Address(other).Assigned)
+
+	// The pod keeps its IPv4 address until it is released too
+	ip6, err = ds.UnassignPodIPv6Address(&podInfo2)
+	assert.NoError(t, err)
+	assert.Equal(t, "", ip6)
+	ip, _, err := ds.UnassignPodIPv4Address(&podInfo2)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1.1.2", ip)
+
+	err = ds.DelIPv6AddressFromStore("eni-1", other)
+	assert.NoError(t, err)
+	_, err = ds.GetENIIPv6Pools("eni-2")
+	assert.EqualError(t, err, UnknownENIError)
+}
+
+func TestPodIPv6AddressOfSecondaryENI(t *testing.T) {
+	ds := NewDataStore()
+	ds.AddENI("eni-1", 0, true)
+	ds.AddENI("eni-2", 1, false)
+	ds.AddENI("eni-3", 2, false)
+	ds.AddIPv4AddressFromStore("eni-2", "1.1.2.1")
+	ds.AddIPv4AddressFromStore("eni-3", "1.1.3.1")
+	ds.AddIPv4AddressFromStore("eni-3", "1.1.3.2")
+	ds.AddIPv6AddressFromStore("eni-1", "2001:db8::1")
+	ds.AddIPv6AddressFromStore("eni-2", "2001:db8:0:2::1")
+	ds.AddIPv6AddressFromStore("eni-3", "2001:db8:0:3::1")
+
+	// The IPv6 address comes from the ENI of the IPv4 address
+	podInfo := k8sapi.K8SPodInfo{Name: "pod-1", Namespace: "ns-1", IP: "1.1.3.1"}
+	_, _, err := ds.AssignPodIPv4Address(&podInfo)
+	assert.NoError(t, err)
+	ip6, err := ds.AssignPodIPv6Address(&podInfo)
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8:0:3::1", ip6)
+
+	// Then from the primary ENI, not from another secondary ENI
+	podInfo2 := k8sapi.K8SPodInfo{Name: "pod-2", Namespace: "ns-1", IP: "1.1.3.2"}
+	_, _, err = ds.AssignPodIPv4Address(&podInfo2)
+	assert.NoError(t, err)
+	ip6, err = ds.AssignPodIPv6Address(&podInfo2)
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", ip6)
+	assert.False(t, ds.eniIPPools["eni-2"].IPv6Address("2001:db8:0:2::1").Assigned)
+}
+
+func TestNewBackend(t *testing.T) {
+	_ = os.Unsetenv(envBackend)
+	defer os.Unsetenv(envBackend)
+
+	store, err := New()
+	assert.NoError(t, err)
+	assert.IsType(t, &DataStore{}, store)
+
+	_ = os.Setenv(envBackend, "test")
+	_, err = New()
+	assert.Error(t, err)
+
+	backend := NewDataStore()
+	RegisterBackend("test", func() (Store, error) { return backend, nil })
+	store, err = New()
+	assert.NoError(t, err)
+	assert.True(t, store == Store(backend))
+	assert.Contains(t, Backends(), MemoryBackend)
+
+	RegisterBackend("test", func() (Store, error) { return nil, errors.New("no database") })
+	_, err = New()
+	assert.Error(t, err)
+}
+
+func TestGetFreeIPv4Addresses(t *testing.T) {
+	ds := NewDataStore()
+	_ = ds.AddENI("eni-1", 1, true)
+	_ = ds.AddIPv4AddressFromStore("eni-1", "1.1.1.2")
+	_ = ds.AddIPv4AddressFromStore("eni-1", "1.1.1.1")
+	_ = ds.AddENI("eni-2", 2, false)
+	_ = ds.AddIPv4AddressFromStore("eni-2", "1.1.2.1")
+	_ = ds.AddIPv4AddressFromStore("eni-2", "1.1.2.2")
+	assert.Equal(t, []string{"1.1.1.1", "1.1.1.2", "1.1.2.1", "1.1.2.2"}, ds.GetFreeIPv4Addresses())
+
+	// Assigned IPs are not free, nor are the IPs of the ENIs of a tenant
+	_, _, err := ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-1", Namespace: "ns-1", IP: "1.1.1.1"})
+	assert.NoError(t, err)
+	ds.eniIPPools["eni-2"].Tenant = "blue"
+	assert.Equal(t, []string{"1.1.1.2"}, ds.GetFreeIPv4Addresses())
+}
+
+func TestReserveIPv4Addresses(t *testing.T) {
+	ds := NewDataStore()
+	_ = ds.AddENI("eni-1", 1, true)
+	_ = ds.AddIPv4AddressFromStore("eni-1", "1.1.1.1")
+	_ = ds.AddIPv4AddressFromStore("eni-1", "1.1.1.2")
+	ds.ReserveIPv4Addresses([]string{"1.1.1.1"})
+	assert.Equal(t, []string{"1.1.1.2"}, ds.GetFreeIPv4Addresses())
+
+	// New pods do not get the reserved IPs, but pods asking for them by IP do
+	ip, _, err := ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-1", Namespace: "ns-1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1.1.2", ip)
+	_, _, err = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-2", Namespace: "ns-1"})
+	assert.Error(t, err)
+	ip, _, err = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-3", Namespace: "ns-1", IP: "1.1.1.1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1.1.1", ip)
+	_, _, err = ds.UnassignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-3", Namespace: "ns-1"})
+	assert.NoError(t, err)
+
+	ds.ClearReservedIPv4Addresses()
+	ds.eniIPPools["eni-1"].IPv4Address("1.1.1.1").UnassignedTime = time.Time{}
+	assert.Equal(t, []string{"1.1.1.1"}, ds.GetFreeIPv4Addresses())
+}
+
+func TestAssignPodIPv4Addresses(t *testing.T) {
+	ds := NewDataStore()
+	_ = ds.AddENI("eni-1", 1, true)
+	_ = ds.AddIPv4AddressFromStore("eni-1", "1.1.1.1")
+	_ = ds.AddIPv4AddressFromStore("eni-1", "1.1.1.2")
+
+	// Each pod of the batch succeeds or fails on its own, in order
+	results := ds.AssignPodIPv4Addresses([]*k8sapi.K8SPodInfo{
+		{Name: "pod-1", Namespace: "ns-1", IP: "1.1.1.2"},
+		{Name: "pod-1", Namespace: "ns-1", IP: "1.1.1.2"},
+		{Name: "pod-2", Namespace: "ns-1"},
+		{Name: "pod-3", Namespace: "ns-1"},
+	})
+	assert.Equal(t, []AssignedIPv4Address{
+		{IP: "1.1.1.2", DeviceNumber: 1},
+		// Assigned again to the same pod
+		{IP: "1.1.1.2", DeviceNumber: 1},
+		{IP: "1.1.1.1", DeviceNumber: 1},
+		{Err: ErrNoAvailableIPv4Address},
+	}, results)
+	total, assigned := ds.GetStats()
+	assert.Equal(t, 2, total)
+	assert.Equal(t, 2, assigned)
+}
+
+func TestTransferPodIPv4Address(t *testing.T) {
+	ds := NewDataStore()
+	_ = ds.AddENI("eni-1", 1, true)
+	_ = ds.AddIPv4AddressFromStore("eni-1", "1.1.1.1")
+	placeholder := &k8sapi.K8SPodInfo{Name: "lease-1", Namespace: "leases"}
+	pod := &k8sapi.K8SPodInfo{Name: "pod-1", Namespace: "ns-1", Container: "c1"}
+	_, _, err := ds.AssignPodIPv4Address(placeholder)
+	assert.NoError(t, err)
+
+	assert.NoError(t, ds.TransferPodIPv4Address(placeholder, pod))
+	assert.Equal(t, ErrUnknownPod, ds.TransferPodIPv4Address(placeholder, pod))
+	total, assigned := ds.GetStats()
+	assert.Equal(t, 1, total)
+	assert.Equal(t, 1, assigned)
+	ip, _, err := ds.UnassignPodIPv4Address(pod)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1.1.1", ip)
+}
+
+func BenchmarkAssignUnassignPodIPv4Address(b *testing.B) {
+	current := log.Current
+	_ = log.ReplaceLogger(log.Disabled)
+	defer func() { _ = log.ReplaceLogger(current) }()
+
+	for _, pods := range []int{10, 100, 500} {
+		b.Run(fmt.Sprintf("pods=%d", pods), func(b *testing.B) {
+			// ENIs of 50 IPs, with one free IP left
+			ds := NewDataStore()
+			for i := 0; i <= pods; i++ {
+				eni := fmt.Sprintf("eni-%d", i/50)
+				if i%50 == 0 {
+					_ = ds.AddENI(eni, i/50, i == 0)
+				}
+				_ = ds.AddIPv4AddressFromStore(eni, fmt.Sprintf("10.0.%d.%d", i/200, i%200+1))
+			}
+			for i := 0; i < pods; i++ {
+				_, _, _ = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: fmt.Sprintf("pod-%d", i), Namespace: "default"})
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pod := &k8sapi.K8SPodInfo{Name: "new-pod", Namespace: "default", Container: fmt.Sprintf("c%d", i)}
+				if _, _, err := ds.AssignPodIPv4Address(pod); err != nil {
+					b.Fatal(err)
+				}
+				ip, _, err := ds.UnassignPodIPv4Address(pod)
+				if err != nil {
+					b.Fatal(err)
+				}
+				// Skip the cooling period of the released IP
+				for _, eni := range ds.eniIPPools {
+					if addr := eni.IPv4Address(ip); addr != nil {
+						addr.UnassignedTime = time.Time{}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestInternedStrings(t *testing.T) {
+	ds := NewDataStore()
+	assert.NoError(t, ds.AddENI(fmt.Sprintf("eni-%d", 1), 1, true))
+	assert.NoError(t, ds.AddIPv4PrefixToStore("eni-1", netip.MustParsePrefix("10.0.0.16/28")))
+
+	// The namespaces of the requests are kept once for all of their pods
+	for i := 0; i < 2; i++ {
+		_, _, err := ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: fmt.Sprintf("pod%d", i),
+			Namespace: fmt.Sprintf("ns-%d", 1)})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, ds.strs.strs["ns-1"].refs)
+	for i := 0; i < 2; i++ {
+		_, _, err := ds.UnassignPodIPv4Address(&k8sapi.K8SPodInfo{Name: fmt.Sprintf("pod%d", i), Namespace: "ns-1"})
+		assert.NoError(t, err)
+	}
+	assert.Empty(t, ds.strs.strs)
+}
+
+func TestAddressKeys(t *testing.T) {
+	ds := NewDataStore()
+	assert.NoError(t, ds.AddENI("eni-1", 1, true))
+	assert.NoError(t, ds.AddIPv4AddressFromStore("eni-1", "10.0.0.5"))
+	assert.NoError(t, ds.AddIPv4PrefixToStore("eni-1", netip.MustParsePrefix("10.0.0.16/30")))
+	assert.NoError(t, ds.AddIPv6AddressFromStore("eni-1", "2001:db8::1"))
+	assert.Error(t, ds.AddIPv4AddressFromStore("eni-1", "2001:db8::2"))
+	assert.Error(t, ds.AddIPv6AddressFromStore("eni-1", "10.0.0.6"))
+
+	// Any notation of an address finds it
+	assert.EqualError(t, ds.AddIPv4AddressFromStore("eni-1", "::ffff:10.0.0.5"), DuplicateIPError)
+	assert.EqualError(t, ds.AddIPv6AddressFromStore("eni-1", "2001:0db8::0001"), DuplicateIPError)
+	assert.NotNil(t, ds.eniIPPools["eni-1"].IPv4Address("10.0.0.17"))
+
+	// The keys are marshaled as addresses, and unmarshaled back
+	content, err := json.Marshal(ds.GetENIInfos())
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), `"10.0.0.5":{"Address":"10.0.0.5","Assigned":false,`)
+	assert.Contains(t, string(content), `"Prefix":"10.0.0.16/30"`)
+	assert.Contains(t, string(content), `"2001:db8::1":{"Address":"2001:db8::1"`)
+	var infos ENIInfos
+	assert.NoError(t, json.Unmarshal(content, &infos))
+	assert.Equal(t, ds.eniIPPools["eni-1"].IPv4Addresses, infos.ENIIPPools["eni-1"].IPv4Addresses)
+	assert.Equal(t, ds.eniIPPools["eni-1"].IPv6Addresses, infos.ENIIPPools["eni-1"].IPv6Addresses)
+}
+
+// BenchmarkDataStoreMemory measures the memory allocated to build the datastore of a node with many pods, in ENIs of
+// 49 IPs, and logs the part of it the datastore keeps
+func BenchmarkDataStoreMemory(b *testing.B) {
+	current := log.Current
+	_ = log.ReplaceLogger(log.Disabled)
+	defer func() { _ = log.ReplaceLogger(current) }()
+
+	// build adds the ENIs with 49 secondary IPs each, or with /28 prefixes in prefix delegation mode, and a pod on
+	// each IP. The strings of the requests are new ones, like the ones of the gRPC requests of the CNI plugin.
+	build := func(pods int, prefixDelegation bool) *DataStore {
+		ds := NewDataStore()
+		perENI := 49
+		if prefixDelegation {
+			perENI = 16 * 15
+		}
+		for i := 0; i < pods; i++ {
+			eni := fmt.Sprintf("eni-0123456789abcdef%d", i/perENI)
+			if i%perENI == 0 {
+				_ = ds.AddENI(eni, i/perENI, i == 0)
+			}
+			switch {
+			case !prefixDelegation:
+				_ = ds.AddIPv4AddressFromStore(eni, fmt.Sprintf("10.0.%d.%d", i/200, i%200+1))
+			case i%16 == 0:
+				_ = ds.AddIPv4PrefixToStore(eni, netip.MustParsePrefix(fmt.Sprintf("10.0.%d.%d/28", i/256, i%256)))
+			}
+		}
+		for i := 0; i < pods; i++ {
+			_, _, _ = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{
+				Name:      fmt.Sprintf("web-5d8f7c6b9-%05d", i),
+				Namespace: fmt.Sprintf("team-%d", i%10),
+				Container: fmt.Sprintf("%064x", i),
+			})
+		}
+		return ds
+	}
+	for _, tc := range []struct {
+		pods             int
+		prefixDelegation bool
+	}{{100, false}, {700, false}, {700, true}} {
+		b.Run(fmt.Sprintf("pods=%d/prefixes=%t", tc.pods, tc.prefixDelegation), func(b *testing.B) {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			ds := build(tc.pods, tc.prefixDelegation)
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			// Signed, the heap may have shrunk if a GC freed more than the datastore took
+			kept := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+			b.Logf("%d pods: the datastore keeps %d bytes of heap, %d per pod", tc.pods, kept, kept/int64(tc.pods))
+			runtime.KeepAlive(ds)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				build(tc.pods, tc.prefixDelegation)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datastore
+
+// stringInterner keeps a single copy of the strings the datastore holds many times, e.g. the namespaces of the pods
+// and the prefixes of the addresses, which come in as new strings with each request. A string is forgotten once all
+// of its users released it.
+type stringInterner struct {
+	strs map[string]*internedString
+}
+
+type internedString struct {
+	str  string
+	refs int
+}
+
+// intern returns the copy of the string kept by the interner, and counts one more user of it
+func (in *stringInterner) intern(str string) string {
+	if str == "" {
+		return str
+	}
+	if in.strs == nil {
+		in.strs = make(map[string]*internedString)
+	}
+	interned, ok := in.strs[str]
+	if !ok {
+		interned = &internedString{str: str}
+		in.strs[str] = interned
+	}
+	interned.refs++
+	return interned.str
+}
+
+// get returns the copy of the string kept by the interner, or the string if it has none, without counting a user
+func (in *stringInterner) get(str string) string {
+	if interned, ok := in.strs[str]; ok {
+		return interned.str
+	}
+	return str
+}
+
+// release counts one less user of the string, and forgets it when it has none left
+func (in *stringInterner) release(str string) {
+	interned, ok := in.strs[str]
+	if !ok {
+		return
+	}
+	interned.refs--
+	if interned.refs <= 0 {
+		delete(in.strs, str)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datastore
+
+import (
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+)
+
+const (
+	// envBackend is the name of the environment variable that selects the backend keeping the ENIs, IPs and pods of
+	// the node. Defaults to "memory", the DataStore.
+	envBackend = "AWS_VPC_K8S_CNI_DATASTORE_BACKEND"
+
+	// MemoryBackend is the name of the in-memory backend, which starts empty every time ipamd starts
+	MemoryBackend = "memory"
+)
+
+// Store keeps the ENIs and IPs of the node and the pods they are assigned to. DataStore is the in-memory
+// implementation, other backends are registered with RegisterBackend and selected with
+// AWS_VPC_K8S_CNI_DATASTORE_BACKEND.
+type Store interface {
+	// SetMinENILifetime sets how long an ENI must have been attached before it can be freed
+	SetMinENILifetime(minENILifetime time.Duration)
+	// SetKeepFreeENI sets whether the last free secondary ENI is kept for a new tenant
+	SetKeepFreeENI(keepFreeENI bool)
+	// AddENI adds an ENI, it returns DuplicatedENIError if the ENI is already known
+	AddENI(eniID string, deviceNumber int, isPrimary bool) error
+	// SetENINUMANode sets the NUMA node of the network card of an ENI
+	SetENINUMANode(eniID string, node int) error
+	// AddIPv4AddressFromStore adds a secondary IPv4 address of an ENI
+	AddIPv4AddressFromStore(eniID string, ipv4 string) error
+	// DelIPv4AddressFromStore removes a secondary IPv4 address of an ENI that is not assigned to a pod
+	DelIPv4AddressFromStore(eniID string, ipv4 string) error
+	// AddIPv4PrefixToStore adds the IPv4 addresses of a prefix of an ENI
+	AddIPv4PrefixToStore(eniID string, prefix netip.Prefix) error
+	// DelIPv4PrefixFromStore removes the IPv4 addresses of a prefix of an ENI, none of which is assigned to a pod
+	DelIPv4PrefixFromStore(eniID string, prefix netip.Prefix) error
+	// GetENIIPv4Prefixes returns the IPv4 prefixes of an ENI
+	GetENIIPv4Prefixes(eniID string) ([]netip.Prefix, error)
+	// GetUnusedIPv4Prefixes returns the IPv4 prefixes of an ENI none of whose addresses is in use
+	GetUnusedIPv4Prefixes(eniID string) ([]netip.Prefix, error)
+	// AddIPv6AddressFromStore adds an IPv6 address of an ENI
+	AddIPv6AddressFromStore(eniID string, ipv6 string) error
+	// DelIPv6AddressFromStore removes an IPv6 address of an ENI that is not assigned to a pod
+	DelIPv6AddressFromStore(eniID string, ipv6 string) error
+	// AssignPodIPv4Address assigns an IPv4 address to a pod, the one of the pod if set
+	AssignPodIPv4Address(k8sPod *k8sapi.K8SPodInfo) (string, int, error)
+	// AssignPodIPv4Addresses assigns IPv4 addresses to a batch of pods at once, each succeeding or failing on its own
+	AssignPodIPv4Addresses(k8sPods []*k8sapi.K8SPodInfo) []AssignedIPv4Address
+	// TransferPodIPv4Address hands the IPv4 address of a pod over to another pod that has none
+	TransferPodIPv4Address(from, to *k8sapi.K8SPodInfo) error
+	// UnassignPodIPv4Address releases the IPv4 address of a pod
+	UnassignPodIPv4Address(k8sPod *k8sapi.K8SPodInfo) (string, int, error)
+	// AssignPodIPv6Address assigns an IPv6 address to a pod, the one of the pod if set
+	AssignPodIPv6Address(k8sPod *k8sapi.K8SPodInfo) (string, error)
+	// UnassignPodIPv6Address releases the IPv6 address of a pod
+	UnassignPodIPv6Address(k8sPod *k8sapi.K8SPodInfo) (string, error)
+	// GetStats returns the total number of IPv4 addresses and the number assigned to pods
+	GetStats() (int, int)
+	// GetSharedStats is GetStats without the addresses of the ENIs used by a tenant
+	GetSharedStats() (int, int)
+	// GetFreeIPv4Addresses returns the IPv4 addresses that can be assigned to a pod without a tenant
+	GetFreeIPv4Addresses() []string
+	// ReserveIPv4Addresses keeps IPv4 addresses from being assigned to new pods, unless they ask for them by IP
+	ReserveIPv4Addresses(ips []string)
+	// ClearReservedIPv4Addresses lets the reserved IPv4 addresses be assigned to new pods again
+	ClearReservedIPv4Addresses()
+	// GetFreeENIs returns the number of ENIs without pods
+	GetFreeENIs() int
+	// GetENIs returns the number of ENIs
+	GetENIs() int
+	// GetENINeedsIP returns an ENI that has room for more IPs, if any
+	GetENINeedsIP(maxIPperENI int, skipPrimary bool) *ENIIPPool
+	// GetENINeedsIPv4Prefix returns an ENI that has room for more IPv4 prefixes, if any, and how many
+	GetENINeedsIPv4Prefix(maxPrefixesPerENI int, skipPrimary bool) (string, int)
+	// GetUnusedENI returns an ENI that can be freed, with its device number and IPs
+	GetUnusedENI(warmIPTarget int) (string, int, []string)
+	// RemoveUnusedENIFromStore removes an ENI that can be freed and returns it
+	RemoveUnusedENIFromStore(warmIPTarget int) string
+	// RemoveENIFromDataStore removes an ENI without pods
+	RemoveENIFromDataStore(eni string) error
+	// EvictIPv4Address removes an IPv4 address even if a pod uses it, and returns that pod
+	EvictIPv4Address(eniID string, ipv4 string) (*k8sapi.K8SPodInfo, error)
+	// EvictENI removes an ENI even if pods use it, and returns those pods
+	EvictENI(eni string) ([]*k8sapi.K8SPodInfo, error)
+	// GetPodInfos returns the IPs of the pods by name_namespace_container
+	GetPodInfos() *map[string]PodIPInfo
+	// HasPod returns whether a container of the pod with the given namespace and name has an IP
+	HasPod(namespace, name string) bool
+	// WithIPsUnassigned calls fn if no pod uses the IPs, none of them is assigned until fn returns
+	WithIPsUnassigned(ips []string, ignore func(key string) bool, fn func() error) (bool, error)
+	// GetENIInfos returns the ENIs and their IPs
+	GetENIInfos() *ENIInfos
+	// GetENIIPPools returns the IPv4 addresses of an ENI
+	GetENIIPPools(eni string) (map[string]*AddressInfo, error)
+	// GetENIIPv6Pools returns the IPv6 addresses of an ENI
+	GetENIIPv6Pools(eni string) (map[string]*AddressInfo, error)
+}
+
+// BackendFactory returns a new Store of a backend
+type BackendFactory func() (Store, error)
+
+var (
+	backendsLock sync.Mutex
+	backends     = map[string]BackendFactory{
+		MemoryBackend: func() (Store, error) { return NewDataStore(), nil },
+	}
+)
+
+// RegisterBackend makes a backend available under name, replacing the backend registered under the same name if any
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	backends[name] = factory
+}
+
+// Backends returns the names of the registered backends
+func Backends() []string {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getBackend() string {
+	if backend := os.Getenv(envBackend); backend != "" {
+		return backend
+	}
+	return MemoryBackend
+}
+
+// New returns a new Store of the backend selected with AWS_VPC_K8S_CNI_DATASTORE_BACKEND
+func New() (Store, error) {
+	name := getBackend()
+	backendsLock.Lock()
+	factory, ok := backends[name]
+	backendsLock.Unlock()
+	if !ok {
+		return nil, errors.Errorf("datastore: unknown backend %q, the backends are %v", name, Backends())
+	}
+	store, err := factory()
+	if err != nil {
+		return nil, errors.Wrapf(err, "datastore: failed to create backend %q", name)
+	}
+	return store, nil
+}
+
+// GetConfigForDebug returns the active configuration
+func GetConfigForDebug() map[string]interface{} {
+	return map[string]interface{}{
+		envBackend: getBackend(),
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/awsutils"
+)
+
+const (
+	// degradedReasonSubnetExhausted is reported when the subnet of the ENIs has no free IP address left
+	degradedReasonSubnetExhausted = "SubnetExhausted"
+	// degradedReasonEC2Unavailable is reported when the EC2 endpoint can not be reached or keeps failing
+	degradedReasonEC2Unavailable = "EC2Unavailable"
+	// degradedReasonRecovered is the reason of the event recorded when leaving degraded mode
+	degradedReasonRecovered = "IPPoolRecovered"
+
+	// degradedMinBackoff is how long ipamd waits before trying to grow the IP pool again after the first failure
+	degradedMinBackoff = 30 * time.Second
+	// degradedMaxBackoff caps the wait between two attempts to grow the IP pool in degraded mode
+	degradedMaxBackoff = 10 * time.Minute
+)
+
+var degradedMode = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "awscni_ipamd_degraded",
+		Help: "Set to 1 while ipamd can not grow the IP pool because of the subnet or the EC2 endpoint, by reason",
+	},
+	[]string{"reason"},
+)
+
+// degradedState tracks whether growing the IP pool keeps failing because of a problem outside of the node, like an
+// exhausted subnet or an unavailable EC2 endpoint in the node's AZ. In degraded mode, ipamd keeps serving the IPs it
+// already has and retries with an exponential backoff instead of calling EC2 on every pool check.
+type degradedState struct {
+	lock       sync.Mutex
+	reason     string
+	since      time.Time
+	failures   int
+	retryAfter time.Time
+}
+
+// DegradedInfo is the degraded mode state, as shown by the introspection endpoint
+type DegradedInfo struct {
+	Degraded   bool
+	Reason     string
+	Since      time.Time
+	Failures   int
+	RetryAfter time.Time
+}
+
+// degradedReason returns the degraded mode reason matching an error returned by EC2, or "" if the error is not caused
+// by the subnet or the EC2 endpoint
+func degradedReason(err error) string {
+	switch {
+	case awsutils.IsSubnetExhaustedError(err):
+		return degradedReasonSubnetExhausted
+	case awsutils.IsServiceUnavailableError(err):
+		return degradedReasonEC2Unavailable
+	}
+	return ""
+}
+
+// recordPoolError enters or stays in degraded mode if growing the IP pool failed because of the subnet or the EC2
+// endpoint, and returns whether it did
+func (c *IPAMContext) recordPoolError(err error) bool {
+	c.recordRecentError(err)
+	reason := degradedReason(err)
+	if reason == "" {
+		return false
+	}
+
+	c.degraded.lock.Lock()
+	now := time.Now()
+	changed := c.degraded.reason != reason
+	if c.degraded.reason == "" {
+		c.degraded.since = now
+		c.degraded.failures = 0
+	}
+	c.degraded.reason = reason
+	c.degraded.failures++
+	backoff := degradedMaxBackoff
+	if shift := uint(c.degraded.failures - 1); shift < 16 && degradedMinBackoff<<shift < degradedMaxBackoff {
+		backoff = degradedMinBackoff << shift
+	}
+	c.degraded.retryAfter = now.Add(backoff)
+	failures := c.degraded.failures
+	c.degraded.lock.Unlock()
+
+	if !changed {
+		log.Debugf("Still degraded (%s) after %d failures, next attempt to grow the IP pool in %v", reason, failures, backoff)
+		return true
+	}
+	degradedMode.Reset()
+	degradedMode.WithLabelValues(reason).Set(1)
+	message := fmt.Sprintf("Unable to grow the IP pool, new pods may not get an IP until this is resolved: %v", err)
+	log.Errorf("Entering degraded mode (%s), next attempt to grow the IP pool in %v. %s", reason, backoff, message)
+	c.emitNodeEvent(v1.EventTypeWarning, reason, message)
+	return true
+}
+
+// recordPoolSuccess leaves degraded mode once the IP pool could be grown again
+func (c *IPAMContext) recordPoolSuccess() {
+	c.degraded.lock.Lock()
+	reason := c.degraded.reason
+	since := c.degraded.since
+	c.degraded.reason = ""
+	c.degraded.failures = 0
+	c.degraded.retryAfter = time.Time{}
+	c.degraded.lock.Unlock()
+
+	if reason == "" {
+		return
+	}
+	degradedMode.Reset()
+	message := fmt.Sprintf("The IP pool can grow again after being degraded (%s) for %v", reason, time.Since(since).Round(time.Second))
+	log.Info(message)
+	c.emitNodeEvent(v1.EventTypeNormal, degradedReasonRecovered, message)
+}
+
+// inDegradedBackoff returns true if ipamd is degraded and must not try to grow the IP pool yet
+func (c *IPAMContext) inDegradedBackoff() bool {
+	c.degraded.lock.Lock()
+	defer c.degraded.lock.Unlock()
+	return c.degraded.reason != "" && time.Now().Before(c.degraded.retryAfter)
+}
+
+// getDegradedInfo returns the current degraded mode state
+func (c *IPAMContext) getDegradedInfo() DegradedInfo {
+	c.degraded.lock.Lock()
+	defer c.degraded.lock.Unlock()
+	if c.degraded.reason == "" {
+		return DegradedInfo{}
+	}
+	return DegradedInfo{
+		Degraded:   true,
+		Reason:     c.degraded.reason,
+		Since:      c.degraded.since,
+		Failures:   c.degraded.failures,
+		RetryAfter: c.degraded.retryAfter,
+	}
+}
+
+func (c *IPAMContext) emitNodeEvent(eventType, reason, message string) {
+	if err := c.k8sClient.K8SEmitNodeEvent(eventType, reason, message); err != nil {
+		log.Warnf("Failed to record node event %s: %v", reason, err)
+	}
+}
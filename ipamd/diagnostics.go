@@ -0,0 +1,212 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// envDiagnosticsAddFailures is the name of the environment variable that sets the number of consecutive failed
+	// AddNetwork calls after which ipamd saves a snapshot of the node's network configuration and of its datastore, to
+	// help understand what went wrong after the node recovers. Set it to 0 to disable. Defaults to 10.
+	envDiagnosticsAddFailures     = "AWS_VPC_K8S_CNI_DIAGNOSTICS_ADD_FAILURES"
+	defaultDiagnosticsAddFailures = 10
+
+	// envDiagnosticsDir is the name of the environment variable that sets the directory the snapshots are saved to.
+	// Defaults to the directory of the ipamd log on the host.
+	envDiagnosticsDir     = "AWS_VPC_K8S_CNI_DIAGNOSTICS_DIR"
+	defaultDiagnosticsDir = "/host/var/log/aws-routed-eni"
+
+	// hostRootPrefix is where the root of the host is mounted in the aws-node container
+	hostRootPrefix = "/host"
+
+	diagnosticsFilePrefix = "ipamd-diagnostics-"
+	// maxDiagnosticsFiles is the number of snapshots kept, the oldest ones are deleted
+	maxDiagnosticsFiles = 5
+	// maxDiagnosticsSectionBytes caps the size of each section of a snapshot
+	maxDiagnosticsSectionBytes = 256 * 1024
+	// diagnosticsCommandTimeout is how long a command is given to complete
+	diagnosticsCommandTimeout = 10 * time.Second
+	// diagnosticsCooldown is the minimum time between two snapshots
+	diagnosticsCooldown = 10 * time.Minute
+	// maxRecentErrors is the number of EC2 errors kept for the snapshots
+	maxRecentErrors = 20
+
+	// diagnosticsCapturedReason is the reason of the event recorded when a snapshot is saved
+	diagnosticsCapturedReason = "DiagnosticsCaptured"
+)
+
+// diagnosticsCommands are the commands whose output goes into a snapshot
+var diagnosticsCommands = [][]string{
+	{"ip", "rule", "show"},
+	{"ip", "route", "show", "table", "all"},
+	{"ip", "addr", "show"},
+	{"iptables-save"},
+}
+
+// diagnosticsState tracks the failed AddNetwork calls and the recent EC2 errors, for the snapshots
+type diagnosticsState struct {
+	// addFailures is the number of consecutive failed AddNetwork calls that triggers a snapshot, 0 if disabled
+	addFailures int
+	dir         string
+	runCommand  func(ctx context.Context, name string, args ...string) ([]byte, error)
+
+	lock                   sync.Mutex
+	consecutiveAddFailures int
+	lastCapture            time.Time
+	recentErrors           []recentError
+}
+
+// recentError is an error returned by EC2, as shown in a snapshot
+type recentError struct {
+	Time  time.Time
+	Error string
+}
+
+// runDiagnosticsCommand runs a command and returns its combined output
+func runDiagnosticsCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+// recordAddResult counts the consecutive failed AddNetwork calls, and returns true when a snapshot should be captured
+func (c *IPAMContext) recordAddResult(err error) bool {
+	c.diagnostics.lock.Lock()
+	defer c.diagnostics.lock.Unlock()
+	if err == nil {
+		c.diagnostics.consecutiveAddFailures = 0
+		return false
+	}
+	c.diagnostics.consecutiveAddFailures++
+	if c.diagnostics.addFailures == 0 || c.diagnostics.consecutiveAddFailures < c.diagnostics.addFailures {
+		return false
+	}
+	if time.Since(c.diagnostics.lastCapture) < diagnosticsCooldown {
+		return false
+	}
+	c.diagnostics.lastCapture = time.Now()
+	return true
+}
+
+// recordRecentError keeps an EC2 error for the snapshots
+func (c *IPAMContext) recordRecentError(err error) {
+	c.diagnostics.lock.Lock()
+	defer c.diagnostics.lock.Unlock()
+	c.diagnostics.recentErrors = append(c.diagnostics.recentErrors, recentError{Time: time.Now(), Error: err.Error()})
+	if len(c.diagnostics.recentErrors) > maxRecentErrors {
+		c.diagnostics.recentErrors = c.diagnostics.recentErrors[len(c.diagnostics.recentErrors)-maxRecentErrors:]
+	}
+}
+
+// captureDiagnostics saves a snapshot of the node's network configuration, the datastore and the recent EC2 errors,
+// and records an event pointing at it
+func (c *IPAMContext) captureDiagnostics(lastErr error) {
+	c.diagnostics.lock.Lock()
+	failures := c.diagnostics.consecutiveAddFailures
+	recentErrors := make([]recentError, len(c.diagnostics.recentErrors))
+	copy(recentErrors, c.diagnostics.recentErrors)
+	c.diagnostics.lock.Unlock()
+
+	now := time.Now().UTC()
+	var snapshot bytes.Buffer
+	fmt.Fprintf(&snapshot, "ipamd diagnostics captured at %s after %d consecutive failed AddNetwork calls\n",
+		now.Format(time.RFC3339), failures)
+	fmt.Fprintf(&snapshot, "Last error: %v\n", lastErr)
+
+	for _, command := range diagnosticsCommands {
+		ctx, cancel := context.WithTimeout(context.Background(), diagnosticsCommandTimeout)
+		output, err := c.diagnostics.runCommand(ctx, command[0], command[1:]...)
+		cancel()
+		if err != nil {
+			output = append(output, []byte(fmt.Sprintf("\nfailed: %v", err))...)
+		}
+		writeDiagnosticsSection(&snapshot, strings.Join(command, " "), output)
+	}
+	eniInfos, err := json.MarshalIndent(c.dataStore.GetENIInfos(), "", "  ")
+	if err != nil {
+		eniInfos = []byte(fmt.Sprintf("failed: %v", err))
+	}
+	writeDiagnosticsSection(&snapshot, "datastore", eniInfos)
+	var errorLines bytes.Buffer
+	for _, recentErr := range recentErrors {
+		fmt.Fprintf(&errorLines, "%s %s\n", recentErr.Time.UTC().Format(time.RFC3339), recentErr.Error)
+	}
+	writeDiagnosticsSection(&snapshot, "recent EC2 errors", errorLines.Bytes())
+
+	path := filepath.Join(c.diagnostics.dir, diagnosticsFilePrefix+now.Format("20060102T150405Z")+".txt")
+	if err := os.MkdirAll(c.diagnostics.dir, 0755); err != nil {
+		log.Errorf("Failed to create diagnostics directory %s: %v", c.diagnostics.dir, err)
+		return
+	}
+	if err := ioutil.WriteFile(path, snapshot.Bytes(), 0644); err != nil {
+		log.Errorf("Failed to save diagnostics to %s: %v", path, err)
+		return
+	}
+	pruneDiagnostics(c.diagnostics.dir)
+
+	hostPath := strings.TrimPrefix(path, hostRootPrefix)
+	message := fmt.Sprintf("%d consecutive pod network setups failed, diagnostics saved to %s on the node", failures, hostPath)
+	log.Warn(message)
+	c.emitNodeEvent(v1.EventTypeWarning, diagnosticsCapturedReason, message)
+}
+
+func writeDiagnosticsSection(snapshot *bytes.Buffer, title string, content []byte) {
+	fmt.Fprintf(snapshot, "\n===== %s =====\n", title)
+	if len(content) > maxDiagnosticsSectionBytes {
+		content = append(content[:maxDiagnosticsSectionBytes:maxDiagnosticsSectionBytes], []byte("\n[truncated]")...)
+	}
+	snapshot.Write(content)
+	snapshot.WriteString("\n")
+}
+
+// pruneDiagnostics deletes the oldest snapshots beyond maxDiagnosticsFiles
+func pruneDiagnostics(dir string) {
+	paths, err := filepath.Glob(filepath.Join(dir, diagnosticsFilePrefix+"*"))
+	if err != nil {
+		return
+	}
+	// The timestamp in the names sorts them from oldest to newest
+	sort.Strings(paths)
+	for len(paths) > maxDiagnosticsFiles {
+		if err := os.Remove(paths[0]); err != nil {
+			log.Warnf("Failed to delete old diagnostics %s: %v", paths[0], err)
+		}
+		paths = paths[1:]
+	}
+}
+
+func getDiagnosticsAddFailures() int {
+	return getNonNegativeIntEnvVar(envDiagnosticsAddFailures, defaultDiagnosticsAddFailures)
+}
+
+func getDiagnosticsDir() string {
+	if dir := os.Getenv(envDiagnosticsDir); dir != "" {
+		return dir
+	}
+	return defaultDiagnosticsDir
+}
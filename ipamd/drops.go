@@ -0,0 +1,107 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/networkutils"
+)
+
+const (
+	// dropCheckInterval is how often the counters of the packets likely to be dropped are read
+	dropCheckInterval = time.Minute
+	// dropEventInterval is the least time between two events for the same drop reason
+	dropEventInterval = 10 * time.Minute
+
+	// packetsDroppedReason is the reason of the event recorded when packets from or to pods are likely dropped
+	packetsDroppedReason = "PacketsDropped"
+)
+
+// dropHints explain the drop reasons in the events
+var dropHints = map[string]string{
+	networkutils.DropReasonRPFilter: "the source address of a pod is not routed back to its veth, " +
+		"so the reverse path filter drops them",
+	networkutils.DropReasonInvalidState: "conntrack did not see their connection start, " +
+		"usually because the request and the reply are routed through different interfaces",
+}
+
+var droppedPackets = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "awscni_dropped_packets_count",
+		Help: "The number of packets from or to pods that the node is likely to drop, by reason",
+	},
+	[]string{"reason"},
+)
+
+// dropMonitorState is the counters read by the last check, and when the last event of each reason was recorded
+type dropMonitorState struct {
+	last       map[string]uint64
+	lastEvents map[string]time.Time
+}
+
+// StartDropMonitor periodically reads the counters of the packets likely to be dropped, if drop tracing is on, and
+// reports them in metrics and rate-limited events, so that connectivity issues of pods can be explained from the node
+func (c *IPAMContext) StartDropMonitor() {
+	if !networkutils.DropTracingEnabled() {
+		return
+	}
+	log.Infof("Started counting the packets likely to be dropped every %v", dropCheckInterval)
+	state := &dropMonitorState{lastEvents: make(map[string]time.Time)}
+	for {
+		time.Sleep(dropCheckInterval)
+		counts, err := c.networkClient.GetDropCounts()
+		if err != nil {
+			log.Warnf("Failed to count the packets likely to be dropped: %v", err)
+			ipamdErrInc("getDropCountsFailed")
+			continue
+		}
+		c.reportDrops(counts, state, time.Now())
+	}
+}
+
+// reportDrops adds the packets counted since the last check to the metrics, and records an event for the reasons that
+// have new packets and had no event recently
+func (c *IPAMContext) reportDrops(counts map[string]uint64, state *dropMonitorState, now time.Time) {
+	for _, reason := range networkutils.DropReasons {
+		count, ok := counts[reason]
+		if !ok {
+			continue
+		}
+		last := state.last[reason]
+		// The counters are reset when the host network is set up again
+		if count < last {
+			last = 0
+		}
+		dropped := count - last
+		if dropped == 0 {
+			continue
+		}
+		droppedPackets.WithLabelValues(reason).Add(float64(dropped))
+		message := fmt.Sprintf("%d packets from or to pods were likely dropped (%s): %s. The kernel log has them "+
+			"with the prefix \"AWS-CNI DROP %s\"", dropped, reason, dropHints[reason], reason)
+		log.Warn(message)
+		if lastEvent, ok := state.lastEvents[reason]; ok && now.Sub(lastEvent) < dropEventInterval {
+			continue
+		}
+		state.lastEvents[reason] = now
+		c.emitNodeEvent(v1.EventTypeWarning, packetsDroppedReason, message)
+	}
+	state.last = counts
+}
@@ -0,0 +1,238 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"strings"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/fastpath"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+)
+
+const (
+	// envEarlyAdd is the name of the environment variable that lets ipamd serve ADDs as soon as its ENIs are set up
+	// when it restarts, instead of after the pods of the node are recovered from the API server, which can take a while.
+	// Until then, new pods only get IPs that no pod rule of the host uses, tenant and SR-IOV pods are refused, and the
+	// pool does not change. Not supported with IPv6. Defaults to false.
+	envEarlyAdd = "AWS_VPC_K8S_CNI_EARLY_ADD"
+)
+
+var (
+	earlyAddPending = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "awscni_early_add_pending",
+			Help: "Set to 1 while ipamd serves ADDs before the pods of the node are recovered",
+		},
+	)
+	earlyAddPods = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "awscni_early_add_pods_count",
+			Help: "The number of pods that got an IP before the pods of the node were recovered",
+		},
+	)
+	earlyAddConflicts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "awscni_early_add_conflicts_count",
+			Help: "The number of recovered pods not restored because their IP was given to a new pod while ipamd recovered them",
+		},
+	)
+)
+
+// errRecoveryPending is the error of the ADDs refused until the pods of the node are recovered
+var errRecoveryPending = errors.New("ipamd is still recovering the pods of the node")
+
+// earlyAddState tracks the pods added and deleted while the pods of the node are recovered after a restart
+type earlyAddState struct {
+	lock sync.Mutex
+	// pending is set until the pods of the node are recovered
+	pending bool
+	// done is closed once the pods of the node are recovered, nil if they were recovered before serving
+	done chan struct{}
+	// served are the IPs given to pods in the meantime, by name_namespace of the pod
+	served map[string]string
+	// deleted are the name_namespace of the pods deleted in the meantime
+	deleted map[string]bool
+}
+
+// earlyAddEnabled returns true if ipamd serves ADDs before the pods of the node are recovered
+func earlyAddEnabled() bool {
+	return getEnvBoolWithDefault(envEarlyAdd, false)
+}
+
+func earlyAddKey(name, namespace string) string {
+	return name + "_" + namespace
+}
+
+// startEarlyAdd reserves the IPs used by the pod rules of the host and starts serving ADDs before the pods of the node
+// are recovered. It returns false if no other IP is free, in which case there is no point in serving early.
+func (c *IPAMContext) startEarlyAdd(podIPsInRules []string) bool {
+	c.dataStore.ReserveIPv4Addresses(podIPsInRules)
+	if len(c.dataStore.GetFreeIPv4Addresses()) == 0 {
+		log.Infof("No IP is free besides the %d used by pod rules, recovering the pods of the node before serving ADDs",
+			len(podIPsInRules))
+		c.dataStore.ClearReservedIPv4Addresses()
+		return false
+	}
+	c.earlyAdd.lock.Lock()
+	defer c.earlyAdd.lock.Unlock()
+	c.earlyAdd.pending = true
+	c.earlyAdd.done = make(chan struct{})
+	c.earlyAdd.served = make(map[string]string)
+	c.earlyAdd.deleted = make(map[string]bool)
+	earlyAddPending.Set(1)
+	log.Infof("Serving ADDs while recovering the pods of the node, without the %d IPs used by pod rules",
+		len(podIPsInRules))
+	return true
+}
+
+// recoverInBackground recovers the pods of the node while ADDs are served, then starts managing the pool. If the pods
+// can not be recovered, ipamd restarts, as it would have exited without serving.
+func (c *IPAMContext) recoverInBackground(recoverPods func() error) {
+	if err := recoverPods(); err != nil {
+		log.Errorf("Failed to recover the pods of the node: %v", err)
+		c.Restart("failed to recover the pods of the node")
+		return
+	}
+	c.finishEarlyAdd()
+	c.startFastPath(fastpath.DefaultDir)
+}
+
+// recoveryPending returns true until the pods of the node are recovered
+func (c *IPAMContext) recoveryPending() bool {
+	c.earlyAdd.lock.Lock()
+	defer c.earlyAdd.lock.Unlock()
+	return c.earlyAdd.pending
+}
+
+// waitForRecovery blocks until the pods of the node are recovered
+func (c *IPAMContext) waitForRecovery() {
+	c.earlyAdd.lock.Lock()
+	done := c.earlyAdd.done
+	c.earlyAdd.lock.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// checkEarlyAdd returns an error if a pod can not get an IP before the pods of the node are recovered: tenant pods, since
+// the tenants of the ENIs are not known yet, and pods getting a VF, since the VFs in use are not known yet
+func (c *IPAMContext) checkEarlyAdd(tenant string, wantsVF bool) error {
+	if (tenant == "" && !wantsVF) || !c.recoveryPending() {
+		return nil
+	}
+	return errRecoveryPending
+}
+
+// recordEarlyAdd remembers the IP given to a pod before the pods of the node are recovered
+func (c *IPAMContext) recordEarlyAdd(k8sPod *k8sapi.K8SPodInfo, ip string) {
+	c.earlyAdd.lock.Lock()
+	defer c.earlyAdd.lock.Unlock()
+	if !c.earlyAdd.pending {
+		return
+	}
+	c.earlyAdd.served[earlyAddKey(k8sPod.Name, k8sPod.Namespace)] = ip
+	earlyAddPods.Inc()
+}
+
+// recordEarlyDel remembers a pod deleted before the pods of the node are recovered, so that it is not recovered
+func (c *IPAMContext) recordEarlyDel(name, namespace string) {
+	c.earlyAdd.lock.Lock()
+	defer c.earlyAdd.lock.Unlock()
+	if !c.earlyAdd.pending {
+		return
+	}
+	key := earlyAddKey(name, namespace)
+	c.earlyAdd.deleted[key] = true
+	delete(c.earlyAdd.served, key)
+}
+
+// skipRecoveredPod returns true if a recovered pod must not be restored: the pods deleted or added since ipamd serves
+// ADDs, which it already knows better than the API server, and the pods whose IP was given to another pod. The IP of
+// those had no pod rule, so they were not set up on the node anymore.
+func (c *IPAMContext) skipRecoveredPod(pod *k8sapi.K8SPodInfo) bool {
+	c.earlyAdd.lock.Lock()
+	defer c.earlyAdd.lock.Unlock()
+	if !c.earlyAdd.pending {
+		return false
+	}
+	key := earlyAddKey(pod.Name, pod.Namespace)
+	if c.earlyAdd.deleted[key] {
+		log.Infof("Not recovering pod %s, namespace %s, it was deleted since", pod.Name, pod.Namespace)
+		return true
+	}
+	if ip, ok := c.earlyAdd.served[key]; ok {
+		if ip != pod.IP {
+			log.Infof("Not recovering IP %s of pod %s, namespace %s, it was added again with IP %s since", pod.IP,
+				pod.Name, pod.Namespace, ip)
+		}
+		return true
+	}
+	for key, ip := range c.earlyAdd.served {
+		if ip == pod.IP {
+			log.Errorf("Not recovering pod %s, namespace %s, its IP %s has no pod rule and was given to pod %s since",
+				pod.Name, pod.Namespace, pod.IP, key)
+			earlyAddConflicts.Inc()
+			ipamdErrInc("earlyAddConflict")
+			return true
+		}
+	}
+	return false
+}
+
+// finishEarlyAdd checks that the pods added while the pods of the node were recovered still have the IPs they were
+// given, assigns them again if they lost them, and lets the reserved IPs be assigned again
+func (c *IPAMContext) finishEarlyAdd() {
+	c.earlyAdd.lock.Lock()
+	defer c.earlyAdd.lock.Unlock()
+	pods := *c.dataStore.GetPodInfos()
+	assigned := make(map[string]bool)
+	for _, info := range pods {
+		assigned[info.IP] = true
+	}
+	for key, ip := range c.earlyAdd.served {
+		found := false
+		for podKey, info := range pods {
+			if info.IP == ip && (podKey == key || strings.HasPrefix(podKey, key+"_")) {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		log.Warnf("Pod %s lost IP %s while the pods of the node were recovered, assigning it again", key, ip)
+		ipamdErrInc("earlyAddMismatch")
+		if assigned[ip] {
+			log.Errorf("IP %s of pod %s is assigned to another pod", ip, key)
+			continue
+		}
+		// Pod names and namespaces can not contain an underscore
+		parts := strings.SplitN(key, "_", 2)
+		if _, _, err := c.dataStore.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: parts[0], Namespace: parts[1], IP: ip}); err != nil {
+			log.Errorf("Failed to assign IP %s to pod %s again: %v", ip, key, err)
+		}
+	}
+	c.dataStore.ClearReservedIPv4Addresses()
+	c.earlyAdd.pending = false
+	c.earlyAdd.served = nil
+	c.earlyAdd.deleted = nil
+	close(c.earlyAdd.done)
+	earlyAddPending.Set(0)
+	log.Info("Recovered the pods of the node")
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/awsutils"
+)
+
+const (
+	// envEgressEIPPool is the name of the environment variable that sets the elastic IPs that give the traffic of the
+	// pods leaving the VPC a stable public IP. It is either a comma separated list of allocation IDs, e.g.
+	// "eipalloc-0a1b,eipalloc-2c3d", or a tag the elastic IPs carry, e.g. "tag:cni-egress=prod". Each IP the traffic of
+	// the pods is SNATed to, the primary IP of the node and the primary IPs of the ENIs dedicated to tenants, gets a
+	// free elastic IP of the pool. Defaults to empty, which leaves the elastic IPs alone.
+	envEgressEIPPool = "AWS_VPC_K8S_CNI_EGRESS_EIP_POOL"
+
+	// egressEIPReconcileInterval is how often the elastic IPs of the pool are matched with the SNAT IPs of the node
+	egressEIPReconcileInterval = 60 * time.Second
+)
+
+var (
+	egressEIPsAssociated = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "awscni_egress_eips_associated",
+			Help: "The number of elastic IPs of the egress pool associated with the SNAT IPs of the node",
+		},
+	)
+	egressIPsWithoutEIP = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "awscni_egress_ips_without_eip",
+			Help: "The number of SNAT IPs of the node left without an elastic IP because the egress pool has no free one",
+		},
+	)
+)
+
+// egressEIPState is the elastic IP pool of the node
+type egressEIPState struct {
+	// pool is the elastic IPs handed out to the SNAT IPs, nil if none is configured
+	pool          *awsutils.EIPPool
+	lastReconcile time.Time
+}
+
+// eipAssociation is an elastic IP to associate with a private IP of an ENI
+type eipAssociation struct {
+	AllocationID string
+	ENIID        string
+	PrivateIP    string
+}
+
+// egressEIPPlan is what a reconciliation of the elastic IPs changes
+type egressEIPPlan struct {
+	associate []eipAssociation
+	// disassociate is the association IDs to remove
+	disassociate []string
+	// associated is the number of SNAT IPs that have an elastic IP once the plan is carried out
+	associated int
+	// unassigned is the number of SNAT IPs the pool has no free elastic IP for
+	unassigned int
+}
+
+func getEgressEIPPool() *awsutils.EIPPool {
+	value := strings.TrimSpace(os.Getenv(envEgressEIPPool))
+	if value == "" {
+		return nil
+	}
+	if strings.HasPrefix(value, "tag:") {
+		tag := strings.SplitN(strings.TrimPrefix(value, "tag:"), "=", 2)
+		if len(tag) != 2 || tag[0] == "" {
+			log.Errorf("Failed to parse %s %q, expected tag:<key>=<value>, not using elastic IPs", envEgressEIPPool, value)
+			return nil
+		}
+		return &awsutils.EIPPool{TagKey: tag[0], TagValue: tag[1]}
+	}
+	pool := &awsutils.EIPPool{}
+	for _, id := range strings.Split(value, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			pool.AllocationIDs = append(pool.AllocationIDs, id)
+		}
+	}
+	if len(pool.AllocationIDs) == 0 {
+		return nil
+	}
+	return pool
+}
+
+// egressEIPTargets returns the ENI of each IP the traffic of the pods leaving the VPC is SNATed to
+func (c *IPAMContext) egressEIPTargets() map[string]string {
+	targets := make(map[string]string)
+	if c.networkClient.UseExternalSNAT() {
+		return targets
+	}
+	if c.hostPrimaryIP.IsValid() {
+		targets[c.hostPrimaryIP.String()] = c.awsClient.GetPrimaryENI()
+	}
+	if c.tenantLabel == "" {
+		return targets
+	}
+	for eniID, eni := range c.dataStore.GetENIInfos().ENIIPPools {
+		if eni.IsPrimary || eni.Tenant == "" {
+			continue
+		}
+		if ip, ok := c.primaryIP[eniID]; ok {
+			targets[ip] = eniID
+		}
+	}
+	return targets
+}
+
+// planEgressEIPs matches the elastic IPs of the pool with the SNAT IPs of the node. Elastic IPs associated with other
+// IPs of the ENIs of the node are released, and free elastic IPs go to the SNAT IPs that have none, in a stable order.
+// Elastic IPs associated with ENIs of other nodes are left alone.
+func planEgressEIPs(eips []awsutils.EIP, targets map[string]string, nodeENIs map[string]bool) egressEIPPlan {
+	var plan egressEIPPlan
+	covered := make(map[string]bool)
+	var free []awsutils.EIP
+	for _, eip := range eips {
+		if eip.AssociationID == "" {
+			free = append(free, eip)
+			continue
+		}
+		if !nodeENIs[eip.ENIID] {
+			continue
+		}
+		if targets[eip.PrivateIP] == eip.ENIID && !covered[eip.PrivateIP] {
+			covered[eip.PrivateIP] = true
+			continue
+		}
+		plan.disassociate = append(plan.disassociate, eip.AssociationID)
+	}
+	plan.associated = len(covered)
+
+	var uncovered []string
+	for ip := range targets {
+		if !covered[ip] {
+			uncovered = append(uncovered, ip)
+		}
+	}
+	sort.Strings(uncovered)
+	sort.Slice(free, func(i, j int) bool { return free[i].AllocationID < free[j].AllocationID })
+	for i, ip := range uncovered {
+		if i >= len(free) {
+			plan.unassigned = len(uncovered) - i
+			break
+		}
+		plan.associate = append(plan.associate, eipAssociation{
+			AllocationID: free[i].AllocationID,
+			ENIID:        targets[ip],
+			PrivateIP:    ip,
+		})
+	}
+	return plan
+}
+
+// reconcileEgressEIPs runs every `interval` and keeps an elastic IP of the pool associated with each SNAT IP of the
+// node, so that the traffic of the pods leaving the VPC keeps the same public IPs
+func (c *IPAMContext) reconcileEgressEIPs(interval time.Duration) {
+	if c.egressEIPs.pool == nil || time.Since(c.egressEIPs.lastReconcile) <= interval {
+		return
+	}
+	c.egressEIPs.lastReconcile = time.Now()
+
+	eips, err := c.awsClient.GetEIPs(*c.egressEIPs.pool)
+	if err != nil {
+		log.Warnf("Failed to look up the elastic IPs of the egress pool: %v", err)
+		ipamdErrInc("getEgressEIPsFailed")
+		return
+	}
+	nodeENIs := make(map[string]bool)
+	for eniID := range c.dataStore.GetENIInfos().ENIIPPools {
+		nodeENIs[eniID] = true
+	}
+	plan := planEgressEIPs(eips, c.egressEIPTargets(), nodeENIs)
+
+	for _, associationID := range plan.disassociate {
+		if err := c.awsClient.DisassociateEIP(associationID); err != nil {
+			log.Warnf("Failed to release an elastic IP of the egress pool: %v", err)
+			ipamdErrInc("disassociateEgressEIPFailed")
+		}
+	}
+	associated := plan.associated
+	for _, association := range plan.associate {
+		// Another node may have taken the same elastic IP, the next reconciliation picks another one
+		if err := c.awsClient.AssociateEIP(association.AllocationID, association.ENIID, association.PrivateIP); err != nil {
+			log.Warnf("Failed to associate an elastic IP of the egress pool: %v", err)
+			ipamdErrInc("associateEgressEIPFailed")
+			continue
+		}
+		associated++
+	}
+	if plan.unassigned > 0 {
+		log.Warnf("The egress elastic IP pool has no free elastic IP for %d SNAT IPs of the node", plan.unassigned)
+	}
+	egressEIPsAssociated.Set(float64(associated))
+	egressIPsWithoutEIP.Set(float64(plan.unassigned))
+}
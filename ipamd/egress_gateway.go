@@ -0,0 +1,60 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/cidr"
+)
+
+// EgressGatewayAnnotation is the annotation of a pod with the IPv4 address of the gateway its egress traffic goes
+// through when AWS_VPC_K8S_CNI_EGRESS_GATEWAY is set, e.g. a pod of the node or an instance in the subnet of the ENI of
+// the pod running an inspection appliance, with its source/destination check disabled
+const EgressGatewayAnnotation = "vpc.amazonaws.com/egress-gateway"
+
+var egressGatewayPods = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "awscni_egress_gateway_pods_count",
+		Help: "The number of pods set up to send their egress traffic through a gateway",
+	},
+)
+
+// getPodEgressGateway returns the egress gateway of the pod, empty if it has none. The gateway must be in the VPC.
+func (c *IPAMContext) getPodEgressGateway(meta *podMetadata) (string, error) {
+	if !c.egressGateway {
+		return "", nil
+	}
+	annotations, err := meta.getPodAnnotations()
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(annotations[EgressGatewayAnnotation])
+	if value == "" {
+		return "", nil
+	}
+	gateway, err := cidr.ParseAddr(value)
+	if err != nil || !gateway.Is4() {
+		return "", errors.Errorf("invalid %s %q, expected an IPv4 address", EgressGatewayAnnotation, value)
+	}
+	for _, vpcCIDR := range c.awsClient.GetVPCIPv4CIDRs() {
+		if vpcCIDR.Contains(gateway) {
+			return gateway.String(), nil
+		}
+	}
+	return "", errors.Errorf("%s %s is not in the VPC", EgressGatewayAnnotation, gateway)
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// ENIDetachRefusal is an ENI that was not detached during scale-down because something still references it
+type ENIDetachRefusal struct {
+	ENI string
+	// Reasons are the references to the ENI that were found
+	Reasons []string
+	Since   time.Time
+}
+
+// ENIDetachState lists the ENIs whose detach was refused, and the ENIs operators forced to be detached anyway
+type ENIDetachState struct {
+	Refused []ENIDetachRefusal
+	Forced  []string
+}
+
+// eniDetachSafety holds the state of the checks made before detaching ENIs
+type eniDetachSafety struct {
+	lock    sync.Mutex
+	refused map[string]ENIDetachRefusal
+	// forced are the ENIs that are detached on the next scale-down even if the kernel still references them
+	forced map[string]bool
+}
+
+// canDetachENI checks the kernel for rules and routes that still reference the ENI or its secondary IPs, which the
+// datastore may not know about, e.g. after a restart or a partial teardown. The detach is refused if any are found,
+// unless an operator forced it.
+func (c *IPAMContext) canDetachENI(eni string, deviceNumber int, ips []string) bool {
+	references, err := c.networkClient.GetENIReferences(deviceNumber, ips)
+	if err != nil {
+		references = []string{"failed to check the rules and routes of the node: " + err.Error()}
+	}
+
+	c.eniDetach.lock.Lock()
+	defer c.eniDetach.lock.Unlock()
+	if len(references) == 0 {
+		delete(c.eniDetach.refused, eni)
+		delete(c.eniDetach.forced, eni)
+		return true
+	}
+	if c.eniDetach.forced[eni] {
+		log.Warnf("Detaching ENI %s as forced by an operator, although it is still referenced: %v", eni, references)
+		delete(c.eniDetach.refused, eni)
+		delete(c.eniDetach.forced, eni)
+		return true
+	}
+
+	log.Warnf("Refusing to detach ENI %s, it is still referenced: %v", eni, references)
+	ipamdErrInc("freeENIRefused")
+	if c.eniDetach.refused == nil {
+		c.eniDetach.refused = make(map[string]ENIDetachRefusal)
+	}
+	refusal, ok := c.eniDetach.refused[eni]
+	if !ok {
+		refusal = ENIDetachRefusal{ENI: eni, Since: time.Now()}
+	}
+	refusal.Reasons = references
+	c.eniDetach.refused[eni] = refusal
+	return false
+}
+
+// forceENIDetach makes the next scale-down detach the ENI even if the kernel still references it
+func (c *IPAMContext) forceENIDetach(eni string) {
+	c.eniDetach.lock.Lock()
+	defer c.eniDetach.lock.Unlock()
+	if c.eniDetach.forced == nil {
+		c.eniDetach.forced = make(map[string]bool)
+	}
+	log.Infof("ENI %s is forced to be detached on the next scale-down", eni)
+	c.eniDetach.forced[eni] = true
+}
+
+// unforceENIDetach cancels forceENIDetach
+func (c *IPAMContext) unforceENIDetach(eni string) {
+	c.eniDetach.lock.Lock()
+	defer c.eniDetach.lock.Unlock()
+	delete(c.eniDetach.forced, eni)
+}
+
+func (c *IPAMContext) getENIDetachState() ENIDetachState {
+	c.eniDetach.lock.Lock()
+	defer c.eniDetach.lock.Unlock()
+
+	state := ENIDetachState{
+		Refused: make([]ENIDetachRefusal, 0, len(c.eniDetach.refused)),
+		Forced:  make([]string, 0, len(c.eniDetach.forced)),
+	}
+	for _, refusal := range c.eniDetach.refused {
+		state.Refused = append(state.Refused, refusal)
+	}
+	sort.Slice(state.Refused, func(i, j int) bool { return state.Refused[i].ENI < state.Refused[j].ENI })
+	for eni := range c.eniDetach.forced {
+		state.Forced = append(state.Forced, eni)
+	}
+	sort.Strings(state.Forced)
+	return state
+}
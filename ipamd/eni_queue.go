@@ -0,0 +1,157 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// eniOpClass is the priority of an operation of the ENI queue, the lower the sooner
+type eniOpClass int
+
+const (
+	// eniOpPodBlocking are the operations a pod waits for, e.g. growing the pool after a pod got no IP, or creating the
+	// branch ENI of a pod
+	eniOpPodBlocking eniOpClass = iota
+	// eniOpWarmPool are the operations that keep the warm pool and the ENIs of the node in shape
+	eniOpWarmPool
+	// eniOpScaleDown are the operations that give back IPs and ENIs
+	eniOpScaleDown
+	numENIOpClasses
+)
+
+var eniOpClassNames = [numENIOpClasses]string{"pod_blocking", "warm_pool", "scale_down"}
+
+func (class eniOpClass) String() string {
+	return eniOpClassNames[class]
+}
+
+var (
+	eniQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "awscni_eni_queue_depth",
+			Help: "The number of ENI operations waiting in the queue, by class",
+		},
+		[]string{"class"},
+	)
+	eniQueueWait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "awscni_eni_queue_wait_seconds",
+			Help:    "How long ENI operations waited in the queue before running, by class",
+			Buckets: []float64{0.01, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60},
+		},
+		[]string{"class"},
+	)
+)
+
+type eniOp struct {
+	class  eniOpClass
+	name   string
+	fn     func()
+	queued time.Time
+	// done is closed once the operation ran, nil if nobody waits for it
+	done chan struct{}
+}
+
+// eniQueue runs the operations that change the ENIs of the node and the pool of IPs one at a time, on a single worker,
+// so that they do not interleave. The operations a pod waits for run first, then the ones of the warm pool, then the
+// scale-downs, each class in order. An operation that is running is not interrupted. A nil queue runs the operations
+// inline.
+type eniQueue struct {
+	lock  sync.Mutex
+	ready *sync.Cond
+	ops   [numENIOpClasses][]*eniOp
+}
+
+func newENIQueue() *eniQueue {
+	q := &eniQueue{}
+	q.ready = sync.NewCond(&q.lock)
+	return q
+}
+
+// work runs the operations of the queue, forever
+func (q *eniQueue) work() {
+	for {
+		op := q.next()
+		eniQueueWait.WithLabelValues(op.class.String()).Observe(time.Since(op.queued).Seconds())
+		log.Debugf("Running ENI operation %s (%s)", op.name, op.class)
+		op.fn()
+		if op.done != nil {
+			close(op.done)
+		}
+	}
+}
+
+// next waits for an operation and removes it from the queue, the first one of the first class that has one
+func (q *eniQueue) next() *eniOp {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for {
+		for class := range q.ops {
+			if len(q.ops[class]) == 0 {
+				continue
+			}
+			op := q.ops[class][0]
+			q.ops[class] = q.ops[class][1:]
+			eniQueueDepth.WithLabelValues(op.class.String()).Set(float64(len(q.ops[class])))
+			return op
+		}
+		q.ready.Wait()
+	}
+}
+
+func (q *eniQueue) push(op *eniOp) {
+	op.queued = time.Now()
+	q.ops[op.class] = append(q.ops[op.class], op)
+	eniQueueDepth.WithLabelValues(op.class.String()).Set(float64(len(q.ops[op.class])))
+	q.ready.Signal()
+}
+
+// run queues the operation and waits until it ran. It must not be called by an operation of the queue, nor with a lock
+// an operation takes.
+func (q *eniQueue) run(class eniOpClass, name string, fn func()) {
+	if q == nil {
+		fn()
+		return
+	}
+	op := &eniOp{class: class, name: name, fn: fn, done: make(chan struct{})}
+	q.lock.Lock()
+	q.push(op)
+	q.lock.Unlock()
+	<-op.done
+}
+
+// submit queues the operation without waiting for it, unless an operation with the same name is already waiting in
+// the class or in a class that runs before. It returns whether the operation was queued.
+func (q *eniQueue) submit(class eniOpClass, name string, fn func()) bool {
+	if q == nil {
+		fn()
+		return true
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for before := eniOpClass(0); before <= class; before++ {
+		for _, op := range q.ops[before] {
+			if op.name == name {
+				return false
+			}
+		}
+	}
+	q.push(&eniOp{class: class, name: name, fn: fn})
+	return true
+}
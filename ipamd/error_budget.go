@@ -0,0 +1,188 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// envErrorBudgetMismatches is the name of the environment variable that sets how many IPs an audit may find
+	// assigned in the datastore without a host route, or routed on the host without a pod in the datastore, before
+	// ipamd heals itself. Needs AWS_VPC_K8S_CNI_AUDIT_INTERVAL. Defaults to 0, off.
+	envErrorBudgetMismatches = "AWS_VPC_K8S_CNI_ERROR_BUDGET_MISMATCHES"
+	// envErrorBudgetNetlinkFailures is the name of the environment variable that sets how many netlink operations of
+	// ipamd may fail in a row before it heals itself. Defaults to 0, off.
+	envErrorBudgetNetlinkFailures = "AWS_VPC_K8S_CNI_ERROR_BUDGET_NETLINK_FAILURES"
+
+	// errorBudgetMinUptime is how long ipamd must have run before it restarts itself, so that a node where the budget
+	// is exceeded right away does not restart in a loop
+	errorBudgetMinUptime = 10 * time.Minute
+
+	// errorBudgetRecoveryWindow is how long after a resync for netlink failures ipamd waits for a netlink operation to
+	// succeed. Past it, ipamd is back within its budget as long as too few failed again, so that a node with no netlink
+	// operation for a while does not restart on the next, unrelated, excess of its budget.
+	errorBudgetRecoveryWindow = 10 * time.Minute
+
+	// selfHealResyncReason is the reason of the event recorded when the error budget is exceeded and ipamd resyncs
+	selfHealResyncReason = "SelfHealResync"
+	// selfHealRestartReason is the reason of the event recorded when the error budget is still exceeded after the
+	// resync and ipamd restarts
+	selfHealRestartReason = "SelfHealRestart"
+	// selfHealRecoveredReason is the reason of the event recorded when the resync brought ipamd back within its budget
+	selfHealRecoveredReason = "SelfHealRecovered"
+)
+
+var selfHeals = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "awscni_self_heal_count",
+		Help: "The number of times ipamd healed itself after exceeding its error budget, by action: resync or restart",
+	},
+	[]string{"action"},
+)
+
+// errorBudgetState tracks the invariants of ipamd that, when broken too often, mean its state is corrupted. It first
+// resyncs the pool with EC2 and the host, then restarts ipamd if that did not help, rather than let it run on with a
+// state that does not match the node.
+type errorBudgetState struct {
+	lock sync.Mutex
+	// maxMismatches and maxNetlinkFailures are the budget, 0 if not checked
+	maxMismatches      int
+	maxNetlinkFailures int
+	// mismatches is the number of datastore/kernel mismatches found by the last audit
+	mismatches int
+	// netlinkFailures is the number of netlink operations that failed in a row, and netlinkSucceeded whether one
+	// succeeded, since the last resync
+	netlinkFailures  int
+	netlinkSucceeded bool
+	// resynced is when the budget was exceeded and ipamd resynced, zero if it is within its budget, and netlinkResync
+	// whether the netlink failures were beyond the budget then
+	resynced      time.Time
+	netlinkResync bool
+	started       time.Time
+}
+
+func (b *errorBudgetState) init() {
+	b.maxMismatches = getNonNegativeIntEnvVar(envErrorBudgetMismatches, 0)
+	b.maxNetlinkFailures = getNonNegativeIntEnvVar(envErrorBudgetNetlinkFailures, 0)
+	b.started = time.Now()
+}
+
+// recordMismatches records the number of datastore/kernel mismatches found by an audit
+func (c *IPAMContext) recordMismatches(count int) {
+	c.errorBudget.lock.Lock()
+	defer c.errorBudget.lock.Unlock()
+	c.errorBudget.mismatches = count
+}
+
+// recordNetlinkResult counts the netlink operations that fail in a row
+func (c *IPAMContext) recordNetlinkResult(err error) {
+	c.errorBudget.lock.Lock()
+	defer c.errorBudget.lock.Unlock()
+	if err == nil {
+		c.errorBudget.netlinkFailures = 0
+		c.errorBudget.netlinkSucceeded = true
+		return
+	}
+	c.errorBudget.netlinkFailures++
+}
+
+// errorBudgetExceeded returns why the error budget is exceeded, or an empty string if it is not
+func (c *IPAMContext) errorBudgetExceeded() string {
+	c.errorBudget.lock.Lock()
+	defer c.errorBudget.lock.Unlock()
+	b := &c.errorBudget
+	var reasons []string
+	if b.maxMismatches > 0 && b.mismatches >= b.maxMismatches {
+		reasons = append(reasons, fmt.Sprintf("%d IPs differ between the datastore and the host routes (budget %d)",
+			b.mismatches, b.maxMismatches))
+	}
+	if b.maxNetlinkFailures > 0 && b.netlinkFailures >= b.maxNetlinkFailures {
+		reasons = append(reasons, fmt.Sprintf("%d netlink operations failed in a row (budget %d)",
+			b.netlinkFailures, b.maxNetlinkFailures))
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// checkErrorBudget heals ipamd when its error budget is exceeded: it first resyncs the pool with EC2 and the host, and
+// if the budget is exceeded again after the resync, saves the checkpoint and restarts. It runs in the pool manager, so
+// that the resync does not race with the pool decisions.
+func (c *IPAMContext) checkErrorBudget() {
+	reason := c.errorBudgetExceeded()
+	c.errorBudget.lock.Lock()
+	resynced := c.errorBudget.resynced
+	started := c.errorBudget.started
+	netlinkExceeded := c.errorBudget.maxNetlinkFailures > 0 &&
+		c.errorBudget.netlinkFailures >= c.errorBudget.maxNetlinkFailures
+	// The netlink failures count from zero after a resync for them, so ipamd is only back within its budget once a
+	// netlink operation succeeded, rather than as long as too few failed again, for at most errorBudgetRecoveryWindow
+	pending := reason == "" && !resynced.IsZero() && c.errorBudget.netlinkResync && !c.errorBudget.netlinkSucceeded &&
+		time.Since(resynced) < errorBudgetRecoveryWindow
+	if reason == "" && !pending {
+		c.errorBudget.resynced = time.Time{}
+	}
+	c.errorBudget.lock.Unlock()
+
+	switch {
+	case reason == "" && resynced.IsZero(), pending:
+		return
+	case reason == "":
+		message := "ipamd is back within its error budget after resyncing"
+		log.Info(message)
+		c.emitNodeEvent(v1.EventTypeNormal, selfHealRecoveredReason, message)
+	case resynced.IsZero():
+		message := fmt.Sprintf("ipamd exceeded its error budget, resyncing the IP pool with EC2 and the host: %s", reason)
+		log.Warn(message)
+		c.emitNodeEvent(v1.EventTypeWarning, selfHealResyncReason, message)
+		selfHeals.WithLabelValues("resync").Inc()
+		c.resync()
+		c.errorBudget.lock.Lock()
+		c.errorBudget.resynced = time.Now()
+		c.errorBudget.netlinkResync = netlinkExceeded
+		c.errorBudget.lock.Unlock()
+	case time.Since(started) < errorBudgetMinUptime:
+		log.Warnf("ipamd is beyond its error budget again after resyncing, but started less than %v ago, not restarting: %s",
+			errorBudgetMinUptime, reason)
+	default:
+		message := fmt.Sprintf("ipamd is beyond its error budget again after resyncing, restarting: %s", reason)
+		log.Error(message)
+		c.emitNodeEvent(v1.EventTypeWarning, selfHealRestartReason, message)
+		selfHeals.WithLabelValues("restart").Inc()
+		c.writeCheckpoint()
+		c.Restart(message)
+	}
+}
+
+// resync reconciles the pool with the ENIs and IPs in the instance metadata and the route tables of the host right
+// away, then audits again if audits are on, so that the next check sees the result. The netlink failures before the
+// resync no longer count, the budget must be exceeded again for ipamd to restart.
+func (c *IPAMContext) resync() {
+	c.errorBudget.lock.Lock()
+	c.errorBudget.netlinkFailures = 0
+	c.errorBudget.netlinkSucceeded = false
+	c.errorBudget.lock.Unlock()
+
+	c.nodeIPPoolReconcile(0)
+	c.checkRouteTables(0)
+	if getAuditInterval() > 0 {
+		c.audit()
+	}
+}
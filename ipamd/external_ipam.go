@@ -0,0 +1,197 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"os"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/aws/amazon-vpc-cni-k8s/ipamd/datastore"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+	pb "github.com/aws/amazon-vpc-cni-k8s/rpc"
+)
+
+const (
+	// envExternalIPAMAddress is the name of the environment variable with the address, host:port, of a central IPAM
+	// service implementing the ExternalIPAM gRPC service. When set, the service picks the IP of each pod among the
+	// free IPs of the node, while ipamd keeps managing the ENIs and their secondary IPs. Defaults to empty, off.
+	envExternalIPAMAddress = "AWS_VPC_K8S_CNI_EXTERNAL_IPAM_ADDRESS"
+
+	// envExternalIPAMTimeout is the name of the environment variable with how long a call to the central IPAM service
+	// can take before the pod gets no IP. Defaults to 2s.
+	envExternalIPAMTimeout = "AWS_VPC_K8S_CNI_EXTERNAL_IPAM_TIMEOUT"
+
+	defaultExternalIPAMTimeout = 2 * time.Second
+)
+
+// externalIPAM delegates the choice of the IP of each pod to a central IPAM service
+type externalIPAM struct {
+	client     pb.ExternalIPAMClient
+	nodeName   string
+	instanceID string
+	timeout    time.Duration
+}
+
+func getExternalIPAMAddress() string {
+	return os.Getenv(envExternalIPAMAddress)
+}
+
+func getExternalIPAMTimeout() time.Duration {
+	if value := os.Getenv(envExternalIPAMTimeout); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err == nil && timeout > 0 {
+			return timeout
+		}
+		log.Errorf("Failed to parse %s %q, using default %v", envExternalIPAMTimeout, value, defaultExternalIPAMTimeout)
+	}
+	return defaultExternalIPAMTimeout
+}
+
+// newExternalIPAM connects to the central IPAM service if one is configured, it returns nil otherwise. The connection
+// is made in the background, so that ipamd starts even if the service is down.
+func newExternalIPAM(instanceID string) (*externalIPAM, error) {
+	address := getExternalIPAMAddress()
+	if address == "" {
+		return nil, nil
+	}
+	conn, err := grpc.Dial(address, grpc.WithInsecure())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to the external IPAM service %s", address)
+	}
+	log.Infof("IP assignment is delegated to the external IPAM service %s", address)
+	return &externalIPAM{
+		client:     pb.NewExternalIPAMClient(conn),
+		nodeName:   os.Getenv("MY_NODE_NAME"),
+		instanceID: instanceID,
+		timeout:    getExternalIPAMTimeout(),
+	}, nil
+}
+
+// allocate asks the central IPAM service which of the candidates the pod gets
+func (e *externalIPAM) allocate(k8sPod *k8sapi.K8SPodInfo, candidates []string) (string, error) {
+	if len(candidates) == 0 {
+		return "", errors.New("external IPAM: no available IP addresses")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	reply, err := e.client.AllocateIP(ctx, &pb.AllocateIPRequest{
+		NodeName:                   e.nodeName,
+		InstanceID:                 e.instanceID,
+		K8S_POD_NAME:               k8sPod.Name,
+		K8S_POD_NAMESPACE:          k8sPod.Namespace,
+		K8S_POD_INFRA_CONTAINER_ID: k8sPod.Container,
+		Candidates:                 candidates,
+	})
+	if err != nil {
+		ipamdErrInc("externalIPAMAllocateFailed")
+		return "", errors.Wrap(err, "external IPAM: failed to allocate an IP")
+	}
+	for _, candidate := range candidates {
+		if reply.IPv4Addr == candidate {
+			return reply.IPv4Addr, nil
+		}
+	}
+	ipamdErrInc("externalIPAMAllocateFailed")
+	return "", errors.Errorf("external IPAM: allocated IP %q is not a free IP of the node", reply.IPv4Addr)
+}
+
+// release tells the central IPAM service that the pod no longer uses its IP
+func (e *externalIPAM) release(k8sPod *k8sapi.K8SPodInfo, ip string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	_, err := e.client.ReleaseIP(ctx, &pb.ReleaseIPRequest{
+		NodeName:                   e.nodeName,
+		InstanceID:                 e.instanceID,
+		K8S_POD_NAME:               k8sPod.Name,
+		K8S_POD_NAMESPACE:          k8sPod.Namespace,
+		K8S_POD_INFRA_CONTAINER_ID: k8sPod.Container,
+		IPv4Addr:                   ip,
+	})
+	if err != nil {
+		ipamdErrInc("externalIPAMReleaseFailed")
+		return errors.Wrapf(err, "external IPAM: failed to release IP %s", ip)
+	}
+	return nil
+}
+
+// assignPodIPv4Address assigns an IPv4 address to the pod, picked by the central IPAM service if there is one. Pods of
+// tenants always get an IP of an ENI of their tenant from the datastore.
+func (c *IPAMContext) assignPodIPv4Address(k8sPod *k8sapi.K8SPodInfo) (string, int, error) {
+	if c.externalIPAM != nil && k8sPod.Tenant == "" {
+		ip, err := c.externalIPAM.allocate(k8sPod, c.dataStore.GetFreeIPv4Addresses())
+		if err != nil {
+			return "", 0, err
+		}
+		k8sPod.IP = ip
+	}
+	return c.dataStore.AssignPodIPv4Address(k8sPod)
+}
+
+// assignPodIPv4Addresses assigns IPv4 addresses to a batch of pods like assignPodIPv4Address, in a single call to the
+// datastore. The results are in the order of the pods.
+func (c *IPAMContext) assignPodIPv4Addresses(k8sPods []*k8sapi.K8SPodInfo) []datastore.AssignedIPv4Address {
+	results := make([]datastore.AssignedIPv4Address, len(k8sPods))
+	batch := make([]*k8sapi.K8SPodInfo, 0, len(k8sPods))
+	indexes := make([]int, 0, len(k8sPods))
+	var free []string
+	for i, k8sPod := range k8sPods {
+		if c.externalIPAM != nil && k8sPod.Tenant == "" {
+			if free == nil {
+				free = c.dataStore.GetFreeIPv4Addresses()
+			}
+			ip, err := c.externalIPAM.allocate(k8sPod, free)
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+			k8sPod.IP = ip
+			// The IP is not free for the next pods of the batch
+			free = removeString(free, ip)
+		}
+		batch = append(batch, k8sPod)
+		indexes = append(indexes, i)
+	}
+	for i, result := range c.dataStore.AssignPodIPv4Addresses(batch) {
+		results[indexes[i]] = result
+	}
+	return results
+}
+
+// removeString returns the strings without str
+func removeString(strs []string, str string) []string {
+	kept := make([]string, 0, len(strs))
+	for _, s := range strs {
+		if s != str {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// releaseExternalIPAM tells the central IPAM service, if there is one, that a pod released its IP. A failure does not
+// fail the delete, since the IP is already back in the pool of the node.
+func (c *IPAMContext) releaseExternalIPAM(k8sPod *k8sapi.K8SPodInfo, ip string) {
+	if c.externalIPAM == nil || ip == "" {
+		return
+	}
+	if err := c.externalIPAM.release(k8sPod, ip); err != nil {
+		log.Warnf("Failed to report the release of IP %s of pod %s, namespace %s: %v", ip, k8sPod.Name,
+			k8sPod.Namespace, err)
+	}
+}
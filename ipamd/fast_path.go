@@ -0,0 +1,277 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/aws/amazon-vpc-cni-k8s/ipamd/datastore"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/fastpath"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+)
+
+const (
+	// envFastPathLeases is the name of the environment variable that sets how many warm IPs are reserved for the fast
+	// path of the CNI plugin. When ipamd does not answer an ADD in time, e.g. during mass pod creation, the plugin sets
+	// up the pod with one of these IPs, and ipamd assigns it to the pod afterwards. The reserved IPs are not counted as
+	// warm, so that the pool grows by as many IPs. Not supported with IPv6, tenants or an external IPAM. Defaults to 0,
+	// which disables the fast path.
+	envFastPathLeases = "AWS_VPC_K8S_CNI_FAST_PATH_LEASES"
+
+	// fastPathLeaseNamespace is the namespace of the placeholder pods the reserved IPs are assigned to in the datastore,
+	// it can not be the namespace of a real pod since it has a dot
+	fastPathLeaseNamespace = "aws-node.fast-path"
+	fastPathLeaseName      = "lease"
+
+	// fastPathLeaseTTL is how long a lease is valid, so that the plugin does not use the leases of an ipamd that is gone
+	fastPathLeaseTTL = 5 * time.Minute
+	// fastPathLeaseRenewal is how long before a lease expires it is replaced by a new one
+	fastPathLeaseRenewal = 2 * time.Minute
+)
+
+var (
+	fastPathLeases = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "awscni_fast_path_leases",
+			Help: "The number of warm IPs reserved for the fast path of the CNI plugin",
+		},
+	)
+	fastPathClaims = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "awscni_fast_path_claims_count",
+			Help: "The number of pods set up by the CNI plugin with a reserved IP because ipamd did not answer in time",
+		},
+	)
+)
+
+// fastPathState is the warm IPs reserved for the fast path of the CNI plugin
+type fastPathState struct {
+	lock sync.Mutex
+	// target is the number of leases to keep, 0 if the fast path is disabled
+	target int
+	dir    string
+	key    []byte
+	// leases are the placeholder pods holding the reserved IPs and the expiry of their lease, by IP
+	leases map[string]fastPathLease
+	seq    int
+}
+
+type fastPathLease struct {
+	placeholder *k8sapi.K8SPodInfo
+	expiry      time.Time
+}
+
+func getFastPathLeases() int {
+	return getNonNegativeIntEnvVar(envFastPathLeases, 0)
+}
+
+// isFastPathPlaceholder returns whether a name_namespace_container key of the datastore is a placeholder of a lease
+func isFastPathPlaceholder(key string) bool {
+	return strings.HasPrefix(key, fastPathLeaseName+"_"+fastPathLeaseNamespace+"_")
+}
+
+// podIPInfos returns the IPs of the pods of the datastore by name_namespace_container, without the placeholders of the
+// leases, whose IPs are not used by any pod
+func (c *IPAMContext) podIPInfos() *map[string]datastore.PodIPInfo {
+	pods := make(map[string]datastore.PodIPInfo)
+	for key, info := range *c.dataStore.GetPodInfos() {
+		if !isFastPathPlaceholder(key) {
+			pods[key] = info
+		}
+	}
+	return &pods
+}
+
+// startFastPath takes over the leases the CNI plugin claimed while ipamd was not running, and starts reserving IPs
+// for the fast path if enabled. The leases of the previous ipamd are withdrawn first, since the datastore may have
+// given their IPs to other pods.
+func (c *IPAMContext) startFastPath(dir string) {
+	c.fastPath.lock.Lock()
+	defer c.fastPath.lock.Unlock()
+	c.fastPath.dir = dir
+	c.fastPath.leases = make(map[string]fastPathLease)
+	target := getFastPathLeases()
+	if target > 0 && (c.enableIPv6 || c.tenantLabel != "" || c.externalIPAM != nil || c.egressGateway || c.sriov ||
+		c.podFlagsAllowed() || c.podENI) {
+		log.Warnf("%s is not supported with IPv6, tenants, an external IPAM, egress gateways, SR-IOV, pod flags, SNAT "+
+			"exclusions or pod ENIs, disabling the fast path", envFastPathLeases)
+		target = 0
+	}
+	oldKey, err := fastpath.ReadKey(dir)
+	if err != nil && target == 0 {
+		// The fast path was never used on this node
+		return
+	}
+	key, err := fastpath.NewKey(dir)
+	if err != nil {
+		log.Errorf("Failed to set up the fast path in %s, disabling it: %v", dir, err)
+		ipamdErrInc("fastPathSetupFailed")
+		return
+	}
+	c.fastPath.key = key
+	c.fastPath.target = target
+
+	claims, err := fastpath.Claims(dir)
+	if err != nil {
+		log.Warnf("Failed to list the fast path claims: %v", err)
+	}
+	for _, claim := range claims {
+		if oldKey != nil && fastpath.Verify(oldKey, claim.Lease, claim.Expiry) == nil {
+			pod := &k8sapi.K8SPodInfo{Name: claim.PodName, Namespace: claim.PodNamespace, Container: claim.ContainerID,
+				IP: claim.IPv4}
+			if _, _, err := c.dataStore.AssignPodIPv4Address(pod); err != nil {
+				log.Warnf("Failed to restore IP %s claimed through the fast path by pod %s/%s: %v", claim.IPv4,
+					claim.PodNamespace, claim.PodName, err)
+			}
+		}
+		_ = fastpath.RemoveClaim(dir, claim)
+	}
+	if len(claims) > 0 {
+		c.writeCheckpoint()
+	}
+}
+
+// syncFastPath assigns the IPs claimed by the CNI plugin to their pods, renews the leases that are about to expire and
+// reserves more warm IPs if needed
+func (c *IPAMContext) syncFastPath() {
+	c.fastPath.lock.Lock()
+	defer c.fastPath.lock.Unlock()
+	if c.fastPath.key == nil {
+		return
+	}
+	c.adoptFastPathClaimsUnsafe()
+
+	vpcCIDRs := c.podRouteCIDRs(c.networkClient.UseExternalSNAT())
+	assigned := make(map[string]bool)
+	for key, pod := range *c.dataStore.GetPodInfos() {
+		if isFastPathPlaceholder(key) {
+			assigned[pod.IP] = true
+		}
+	}
+	for ip, lease := range c.fastPath.leases {
+		if !assigned[ip] {
+			// The IP was evicted from the datastore, e.g. unassigned from the ENI outside of ipamd
+			if fastpath.RemoveLease(c.fastPath.dir, ip) {
+				delete(c.fastPath.leases, ip)
+			}
+			continue
+		}
+		if time.Until(lease.expiry) > fastPathLeaseRenewal {
+			continue
+		}
+		// A lease that can not be withdrawn was claimed, it is taken over on the next sync
+		if fastpath.RemoveLease(c.fastPath.dir, ip) {
+			c.writeFastPathLeaseUnsafe(ip, lease.placeholder, vpcCIDRs)
+		}
+	}
+
+	for len(c.fastPath.leases) < c.fastPath.target {
+		c.fastPath.seq++
+		placeholder := &k8sapi.K8SPodInfo{Name: fastPathLeaseName, Namespace: fastPathLeaseNamespace,
+			Container: strconv.Itoa(c.fastPath.seq)}
+		ip, _, err := c.dataStore.AssignPodIPv4Address(placeholder)
+		if err != nil {
+			// Reserved once the pool has more warm IPs
+			break
+		}
+		c.writeFastPathLeaseUnsafe(ip, placeholder, vpcCIDRs)
+	}
+	fastPathLeases.Set(float64(len(c.fastPath.leases)))
+}
+
+// writeFastPathLeaseUnsafe makes a reserved IP available to the CNI plugin, or releases it if that fails
+func (c *IPAMContext) writeFastPathLeaseUnsafe(ip string, placeholder *k8sapi.K8SPodInfo, vpcCIDRs []string) {
+	deviceNumber := 0
+	for _, pod := range *c.dataStore.GetPodInfos() {
+		if pod.IP == ip {
+			deviceNumber = pod.DeviceNumber
+		}
+	}
+	expiry := time.Now().Add(fastPathLeaseTTL)
+	err := fastpath.WriteLease(c.fastPath.dir, c.fastPath.key, fastpath.Lease{
+		IPv4:            ip,
+		DeviceNumber:    int32(deviceNumber),
+		UseExternalSNAT: c.networkClient.UseExternalSNAT(),
+		VPCcidrs:        vpcCIDRs,
+		Expiry:          expiry,
+	})
+	if err != nil {
+		log.Warnf("Failed to write the fast path lease of IP %s: %v", ip, err)
+		ipamdErrInc("fastPathLeaseFailed")
+		delete(c.fastPath.leases, ip)
+		if _, _, err := c.dataStore.UnassignPodIPv4Address(placeholder); err != nil {
+			log.Warnf("Failed to release IP %s reserved for the fast path: %v", ip, err)
+		}
+		return
+	}
+	c.fastPath.leases[ip] = fastPathLease{placeholder: placeholder, expiry: expiry}
+}
+
+// adoptFastPathClaims assigns the IPs claimed by the CNI plugin to their pods, so that a DEL of such a pod finds it
+func (c *IPAMContext) adoptFastPathClaims() {
+	c.fastPath.lock.Lock()
+	defer c.fastPath.lock.Unlock()
+	if c.fastPath.key == nil {
+		return
+	}
+	c.adoptFastPathClaimsUnsafe()
+}
+
+func (c *IPAMContext) adoptFastPathClaimsUnsafe() {
+	claims, err := fastpath.Claims(c.fastPath.dir)
+	if err != nil {
+		log.Warnf("Failed to list the fast path claims: %v", err)
+		ipamdErrInc("fastPathClaimsFailed")
+		return
+	}
+	for _, claim := range claims {
+		lease, ok := c.fastPath.leases[claim.IPv4]
+		if !ok || fastpath.Verify(c.fastPath.key, claim.Lease, claim.Expiry) != nil {
+			log.Warnf("Ignoring unknown fast path claim of IP %s by pod %s/%s", claim.IPv4, claim.PodNamespace,
+				claim.PodName)
+			_ = fastpath.RemoveClaim(c.fastPath.dir, claim)
+			continue
+		}
+		pod := &k8sapi.K8SPodInfo{Name: claim.PodName, Namespace: claim.PodNamespace, Container: claim.ContainerID}
+		// ipamd may have answered the ADD after the plugin gave up on it, the pod uses the IP of the lease
+		if ip, _, err := c.dataStore.UnassignPodIPv4Address(pod); err == nil {
+			log.Infof("Released IP %s assigned to pod %s/%s after it was set up through the fast path", ip,
+				claim.PodNamespace, claim.PodName)
+		}
+		if err := c.dataStore.TransferPodIPv4Address(lease.placeholder, pod); err != nil {
+			log.Errorf("Failed to assign IP %s claimed through the fast path to pod %s/%s: %v", claim.IPv4,
+				claim.PodNamespace, claim.PodName, err)
+			ipamdErrInc("fastPathClaimsFailed")
+			if err != datastore.ErrUnknownPod {
+				continue
+			}
+		} else {
+			log.Infof("Pod %s/%s was set up with IP %s through the fast path", claim.PodNamespace, claim.PodName,
+				claim.IPv4)
+			fastPathClaims.Inc()
+		}
+		delete(c.fastPath.leases, claim.IPv4)
+		_ = fastpath.RemoveClaim(c.fastPath.dir, claim)
+	}
+	if len(claims) > 0 {
+		c.writeCheckpoint()
+	}
+	fastPathLeases.Set(float64(len(c.fastPath.leases)))
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	log "github.com/cihub/seelog"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/networkutils"
+)
+
+const (
+	// hostNetworkSetupFailedCondition is the node condition set while the last setup of the host network failed
+	hostNetworkSetupFailedCondition = "AWSHostNetworkSetupFailed"
+	// hostNetworkRolledBackReason is the reason of the condition and event when a failed setup was rolled back
+	hostNetworkRolledBackReason = "HostNetworkRolledBack"
+	// hostNetworkRollbackFailedReason is the reason of the condition and event when a failed setup could not be rolled back
+	hostNetworkRollbackFailedReason = "HostNetworkRollbackFailed"
+	// hostNetworkSetUpReason is the reason of the condition when the host network was set up and passed its self-test
+	hostNetworkSetUpReason = "HostNetworkSetUp"
+)
+
+// hostNetworkSetupState tracks the node condition reported for the setup of the host network
+type hostNetworkSetupState struct {
+	reported bool
+	failed   bool
+}
+
+// rollBackHostNetwork restores the host network saved before a setup that failed, or whose self-test failed, and
+// reports the failure with a node condition
+func (c *IPAMContext) rollBackHostNetwork(snapshot *networkutils.HostNetworkSnapshot, setupErr error) {
+	ipamdErrInc("setupHostNetworkFailed")
+	if snapshot == nil {
+		c.reportHostNetworkSetup(setupErr, false)
+		return
+	}
+	if err := c.networkClient.RestoreHostNetwork(snapshot); err != nil {
+		log.Errorf("Failed to roll back the host network: %v", err)
+		ipamdErrInc("rollBackHostNetworkFailed")
+		c.reportHostNetworkSetup(setupErr, false)
+		return
+	}
+	log.Infof("Rolled back the host network after a failed setup")
+	c.reportHostNetworkSetup(setupErr, true)
+}
+
+// reportHostNetworkSetup records the outcome of a setup of the host network, and updates the node condition if it
+// changed
+func (c *IPAMContext) reportHostNetworkSetup(setupErr error, rolledBack bool) {
+	failed := setupErr != nil
+	if c.hostNetwork.reported && !failed && !c.hostNetwork.failed {
+		return
+	}
+	c.hostNetwork.reported = true
+	c.hostNetwork.failed = failed
+
+	reason := hostNetworkSetUpReason
+	message := "The host network is set up"
+	if failed {
+		reason = hostNetworkRollbackFailedReason
+		message = "Failed to set up the host network, it may be half configured: " + setupErr.Error()
+		if rolledBack {
+			reason = hostNetworkRolledBackReason
+			message = "Failed to set up the host network, it was rolled back: " + setupErr.Error()
+		}
+		c.emitNodeEvent(v1.EventTypeWarning, reason, message)
+	}
+	if err := c.k8sClient.K8SSetNodeCondition(hostNetworkSetupFailedCondition, failed, reason, message); err != nil {
+		log.Warnf("Failed to set node condition %s: %v", hostNetworkSetupFailedCondition, err)
+	}
+}
@@ -21,7 +21,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/capabilities"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/networkutils"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/faultinjection"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/retry"
 	log "github.com/cihub/seelog"
 )
@@ -78,6 +80,18 @@ func (c *IPAMContext) setupIntrospectionServer() *http.Server {
 		"/v1/pods":                      podV1RequestHandler(c),
 		"/v1/networkutils-env-settings": networkEnvV1RequestHandler(),
 		"/v1/ipamd-env-settings":        ipamdEnvV1RequestHandler(),
+		"/v1/degraded":                  degradedV1RequestHandler(c),
+		"/v1/capabilities":              capabilitiesV1RequestHandler(),
+		"/v1/quarantined-ips":           quarantineV1RequestHandler(c),
+		"/v1/route-tables":              routeTablesV1RequestHandler(c),
+		"/v1/eni-detach":                eniDetachV1RequestHandler(c),
+		"/v1/network-state":             networkStateV1RequestHandler(c),
+		"/v1/audit":                     auditV1RequestHandler(c),
+		"/v1/mirrors":                   mirrorsV1RequestHandler(c),
+		"/v1/pod-flags":                 podFlagsV1RequestHandler(c),
+	}
+	if faultinjection.Enabled {
+		serverFunctions["/v1/faults"] = faultsV1RequestHandler()
 	}
 	paths := make([]string, 0, len(serverFunctions))
 	for path := range serverFunctions {
@@ -132,9 +146,246 @@ func eniV1RequestHandler(ipam *IPAMContext) func(http.ResponseWriter, *http.Requ
 	}
 }
 
+func degradedV1RequestHandler(ipam *IPAMContext) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		responseJSON, err := json.Marshal(ipam.getDegradedInfo())
+		if err != nil {
+			log.Errorf("Failed to marshal degraded mode data: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		logErr(w.Write(responseJSON))
+	}
+}
+
+func quarantineV1RequestHandler(ipam *IPAMContext) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		responseJSON, err := json.Marshal(ipam.getQuarantinedIPs())
+		if err != nil {
+			log.Errorf("Failed to marshal quarantined IPs: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		logErr(w.Write(responseJSON))
+	}
+}
+
+func routeTablesV1RequestHandler(ipam *IPAMContext) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		responseJSON, err := json.Marshal(ipam.getRouteTables())
+		if err != nil {
+			log.Errorf("Failed to marshal route tables: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		logErr(w.Write(responseJSON))
+	}
+}
+
+func podFlagsV1RequestHandler(ipam *IPAMContext) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		responseJSON, err := json.Marshal(ipam.getPodFlagsInfo())
+		if err != nil {
+			log.Errorf("Failed to marshal pod flags: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		logErr(w.Write(responseJSON))
+	}
+}
+
+// eniDetachV1RequestHandler lists the ENIs whose detach was refused. Operators force the detach of an ENI with a POST
+// or PUT of ?eni=<ENI ID>, and cancel it with a DELETE.
+func eniDetachV1RequestHandler(ipam *IPAMContext) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		eni := r.URL.Query().Get("eni")
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			if eni == "" {
+				http.Error(w, "missing eni parameter", http.StatusBadRequest)
+				return
+			}
+			ipam.forceENIDetach(eni)
+		case http.MethodDelete:
+			ipam.unforceENIDetach(eni)
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		responseJSON, err := json.Marshal(ipam.getENIDetachState())
+		if err != nil {
+			log.Errorf("Failed to marshal ENI detach state: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		logErr(w.Write(responseJSON))
+	}
+}
+
+// networkStateV1RequestHandler exports a snapshot of the network state owned by the plugin on GET, and applies the
+// snapshot in the request body on POST or PUT if AWS_VPC_K8S_CNI_NETWORK_STATE_IMPORT is set
+func networkStateV1RequestHandler(ipam *IPAMContext) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var response interface{}
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			response, err = ipam.exportNetworkState()
+		case http.MethodPut, http.MethodPost:
+			if !networkStateImportEnabled() {
+				http.Error(w, envNetworkStateImport+" is not set", http.StatusForbidden)
+				return
+			}
+			var state NodeNetworkState
+			if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			response, err = ipam.importNetworkState(&state)
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			log.Errorf("Failed to %s the network state: %v", r.Method, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		responseJSON, err := json.Marshal(response)
+		if err != nil {
+			log.Errorf("Failed to marshal network state: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		logErr(w.Write(responseJSON))
+	}
+}
+
+// auditV1RequestHandler returns the last audit on GET, and runs an audit and returns it on POST
+func auditV1RequestHandler(ipam *IPAMContext) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var report *AuditReport
+		switch r.Method {
+		case http.MethodGet:
+			report = ipam.getAuditReport()
+		case http.MethodPost:
+			report = ipam.audit()
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		responseJSON, err := json.Marshal(report)
+		if err != nil {
+			log.Errorf("Failed to marshal the audit report: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		logErr(w.Write(responseJSON))
+	}
+}
+
+// mirrorsV1RequestHandler lists the active mirrors. Operators mirror the traffic of a pod or an ENI to a capture
+// interface with a POST or PUT of ?pod=<namespace>/<name> or ?eni=<ENI ID>, optionally with &target=<interface> and
+// &ttl=<duration>, and stop it before it expires with a DELETE of the same pod or eni, or of ?interface=<interface>.
+func mirrorsV1RequestHandler(ipam *IPAMContext) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		pod, eni := query.Get("pod"), query.Get("eni")
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			var ttl time.Duration
+			if value := query.Get("ttl"); value != "" {
+				var err error
+				if ttl, err = time.ParseDuration(value); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if _, err := ipam.startMirror(pod, eni, query.Get("target"), ttl); err != nil {
+				log.Errorf("Failed to start mirror: %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			iface := query.Get("interface")
+			if iface == "" {
+				var err error
+				if iface, err = ipam.mirrorSource(pod, eni); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if err := ipam.stopMirror(iface); err != nil {
+				log.Errorf("Failed to stop mirror: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		responseJSON, err := json.Marshal(ipam.getMirrors())
+		if err != nil {
+			log.Errorf("Failed to marshal mirrors: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		logErr(w.Write(responseJSON))
+	}
+}
+
+func capabilitiesV1RequestHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		responseJSON, err := json.Marshal(capabilities.Get())
+		if err != nil {
+			log.Errorf("Failed to marshal capabilities: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		logErr(w.Write(responseJSON))
+	}
+}
+
+// faultsV1RequestHandler lists the injected faults on GET, sets the faults in the request body on PUT, e.g.
+// {"ec2.*": {"error": "RequestLimitExceeded", "count": 3}}, and clears the fault at the point query parameter, or all
+// of them, on DELETE
+func faultsV1RequestHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			faults := make(map[string]faultinjection.Fault)
+			if err := json.NewDecoder(r.Body).Decode(&faults); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			for point, fault := range faults {
+				if err := faultinjection.Set(point, fault); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		case http.MethodDelete:
+			faultinjection.Clear(r.URL.Query().Get("point"))
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		responseJSON, err := json.Marshal(faultinjection.List())
+		if err != nil {
+			log.Errorf("Failed to marshal faults: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		logErr(w.Write(responseJSON))
+	}
+}
+
 func podV1RequestHandler(ipam *IPAMContext) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		responseJSON, err := json.Marshal(ipam.dataStore.GetPodInfos())
+		responseJSON, err := json.Marshal(ipam.podIPInfos())
 		if err != nil {
 			log.Errorf("Failed to marshal pod data: %v", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
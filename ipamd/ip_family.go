@@ -0,0 +1,74 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"os"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// envIPFamilyPreference is the name of the environment variable that sets which address family comes first in the
+	// IPs the CNI plugin returns for dual-stack pods, "ipv4" or "ipv6". Applications honoring the order of the addresses
+	// of their interface, e.g. for their source address or for the records they register, prefer the first one. The
+	// namespaces annotated with IPFamilyPreferenceAnnotation override it. Defaults to "ipv4".
+	envIPFamilyPreference = "AWS_VPC_K8S_CNI_IP_FAMILY_PREFERENCE"
+
+	// IPFamilyPreferenceAnnotation is the annotation of a namespace with the address family that comes first in the IPs
+	// of its dual-stack pods, "ipv4" or "ipv6"
+	IPFamilyPreferenceAnnotation = "vpc.amazonaws.com/ip-family-preference"
+
+	ipFamilyIPv4 = "ipv4"
+	ipFamilyIPv6 = "ipv6"
+)
+
+// parseIPFamily returns the address family named by value, or false if it is not one
+func parseIPFamily(value string) (string, bool) {
+	switch family := strings.ToLower(strings.TrimSpace(value)); family {
+	case ipFamilyIPv4, ipFamilyIPv6:
+		return family, true
+	}
+	return "", false
+}
+
+// getIPFamilyPreference returns the address family that comes first in the IPs of dual-stack pods by default
+func getIPFamilyPreference() string {
+	if value := os.Getenv(envIPFamilyPreference); value != "" {
+		if family, ok := parseIPFamily(value); ok {
+			return family
+		}
+		log.Errorf("Failed to parse %s %q; using default: %s", envIPFamilyPreference, value, ipFamilyIPv4)
+	}
+	return ipFamilyIPv4
+}
+
+// podPrefersIPv6 returns whether the IPv6 address of a dual-stack pod comes first in its IPs. The order only affects the
+// applications of the pod, so the default of the cluster is used when the annotation of the namespace can not be read.
+func (c *IPAMContext) podPrefersIPv6(meta *podMetadata) bool {
+	family := c.ipFamilyPreference
+	namespace := meta.namespace
+	annotations, err := meta.getNamespaceAnnotations()
+	if err != nil {
+		log.Warnf("Failed to get the IP family preference of namespace %s, using %s: %v", namespace, family, err)
+	} else if value, ok := annotations[IPFamilyPreferenceAnnotation]; ok {
+		if preferred, ok := parseIPFamily(value); ok {
+			family = preferred
+		} else {
+			log.Warnf("Invalid %s %q of namespace %s, using %s", IPFamilyPreferenceAnnotation, value, namespace, family)
+		}
+	}
+	return family == ipFamilyIPv6
+}
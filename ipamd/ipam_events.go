@@ -0,0 +1,51 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"os"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/ipamevents"
+)
+
+// startIPAMEvents creates the stream of the allocations and releases of the node, and subscribes the sinks that are
+// configured
+func (c *IPAMContext) startIPAMEvents() {
+	c.events = ipamevents.NewStream(os.Getenv("MY_NODE_NAME"), c.awsClient.GetInstanceID())
+	if ipamevents.WebhookEnabled() {
+		c.events.Subscribe("webhook", ipamevents.NewWebhook())
+	}
+	if ipamevents.DNSEnabled() {
+		sink, err := ipamevents.NewDNS(c.k8sClient.K8SGetPodAnnotations)
+		if err != nil {
+			log.Errorf("Failed to start the DNS registration of pods: %v", err)
+		} else {
+			c.events.Subscribe("dns", sink)
+		}
+	}
+}
+
+// publishIPAMEvent sends an allocation or release of the IPs of a pod to the sinks, if there are any
+func (c *IPAMContext) publishIPAMEvent(eventType ipamevents.EventType, name, namespace, container, ipv4, ipv6 string) {
+	c.events.Publish(ipamevents.Event{
+		Type:         eventType,
+		PodName:      name,
+		PodNamespace: namespace,
+		ContainerID:  container,
+		IPv4:         ipv4,
+		IPv6:         ipv6,
+	})
+}
@@ -15,7 +15,7 @@ package ipamd
 
 import (
 	"fmt"
-	"net"
+	"net/netip"
 	"os"
 	"strconv"
 	"strings"
@@ -27,6 +27,7 @@ import (
 	set "github.com/deckarep/golang-set"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vishvananda/netlink"
 
 	"github.com/aws/aws-sdk-go/aws"
 
@@ -34,9 +35,19 @@ import (
 
 	"github.com/aws/amazon-vpc-cni-k8s/ipamd/datastore"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/awsutils"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/bgp"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/capabilities"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/clusterconfig"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/ec2wrapper"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/eniconfig"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/fastpath"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/ipamevents"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/networkutils"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/podipexport"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/cidr"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/logger"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/retry"
 )
 
 // The package ipamd is a long running daemon which manages a warm pool of available IP addresses.
@@ -45,12 +56,7 @@ import (
 
 const (
 	ipPoolMonitorInterval       = 5 * time.Second
-	maxRetryCheckENI            = 5
-	eniAttachTime               = 10 * time.Second
 	nodeIPPoolReconcileInterval = 60 * time.Second
-	decreaseIPPoolInterval      = 30 * time.Second
-	maxK8SRetries               = 5
-	retryK8SInterval            = 3 * time.Second
 
 	// ipReconcileCooldown is the amount of time that an IP address must wait until it can be added to the data store
 	// during reconciliation after being discovered on the EC2 instance metadata.
@@ -65,6 +71,9 @@ const (
 	//     If "WARM-IP-TARGET is not set, it will default to 30 (which the maximum number of IPs per ENI).
 	//     If there are 9 pods running on the node, ipamd will try to make the "warm pool" have 39 IPs with 9 being
 	//     assigned to pods and 30 free IPs.
+	//
+	// It can also be set as a percentage of the maximum number of pod IPs of the node, like "10%", rounded up, so that
+	// the same value works across instance sizes.
 	envWarmIPTarget = "WARM_IP_TARGET"
 	noWarmIPTarget  = 0
 
@@ -82,6 +91,8 @@ const (
 	//     If "WARM_ENI_TARGET" is not set, it defaults to 1, so if there are 9 pods running on the node,
 	//     ipamd will try to make the "warm pool" have 1 extra ENI, in other words, 60 IPs with 9 already
 	//     being assigned to pods and 51 free IPs.
+	//
+	// It can also be set as a percentage of the maximum number of ENIs of the node, like "25%", rounded up.
 	envWarmENITarget     = "WARM_ENI_TARGET"
 	defaultWarmENITarget = 1
 
@@ -95,6 +106,37 @@ const (
 	// This environment is used to specify whether Pods need to use a security group and subnet defined in an ENIConfig CRD.
 	// When it is NOT set or set to false, ipamd will use primary interface security group and subnet for Pod network.
 	envCustomNetworkCfg = "AWS_VPC_K8S_CNI_CUSTOM_NETWORK_CFG"
+
+	// This environment variable is used to specify whether pods that are scheduled on the node but still waiting for
+	// an IP should count as already using one when sizing the "warm pool". This lets ipamd start attaching ENIs and
+	// assigning IPs as soon as pods land on the node, before the CNI ADD requests arrive. Defaults to false.
+	envPrewarmPendingPods = "AWS_VPC_K8S_CNI_PREWARM_PENDING_PODS"
+
+	// This environment variable is used to specify whether ipamd should skip waiting for local pods without an IP during
+	// init when no pod has been set up on the node yet, which is determined by the absence of pod IP rules on the host.
+	// On a fresh node these pods are waiting for ipamd, so waiting for them only delays the first pods, like CoreDNS.
+	// Defaults to false.
+	envFastStart = "AWS_VPC_K8S_CNI_FAST_START"
+)
+
+var (
+	// eniAttachRetryPolicy is how ipamd waits for an attached ENI and its IPs to show up in the instance metadata
+	eniAttachRetryPolicy = retry.Policy{
+		Name:         "ENI_ATTACH",
+		InitialDelay: 10 * time.Second,
+		MaxDelay:     10 * time.Second,
+		Multiplier:   1,
+		MaxAttempts:  6,
+	}
+
+	// k8sRetryPolicy is how ipamd retries getting the local pods from the API server on start
+	k8sRetryPolicy = retry.Policy{
+		Name:         "K8S",
+		InitialDelay: 3 * time.Second,
+		MaxDelay:     3 * time.Second,
+		Multiplier:   1,
+		MaxAttempts:  5,
+	}
 )
 
 var (
@@ -149,10 +191,24 @@ var (
 
 // IPAMContext contains node level control information
 type IPAMContext struct {
-	awsClient            awsutils.APIs
-	dataStore            *datastore.DataStore
-	k8sClient            k8sapi.K8SAPIs
-	useCustomNetworking  bool
+	awsClient           awsutils.APIs
+	dataStore           datastore.Store
+	k8sClient           k8sapi.K8SAPIs
+	useCustomNetworking bool
+	prewarmPendingPods  bool
+	tenantLabel         string
+	// egressGateway is true if pods can send their egress traffic through the gateway of their annotation
+	egressGateway bool
+	// podFlags are the experimental flags of the pods
+	podFlags podFlagsState
+	// sriov is true if annotated pods get a VF of their ENI instead of a veth
+	sriov bool
+	// podENI is true if the pods annotated with security groups get a branch ENI of the trunk ENI
+	podENI bool
+	// numaAware is true if annotated pods prefer the ENIs local to their NUMA node
+	numaAware bool
+	// prefixDelegation is true if the ENIs get IPv4 prefixes instead of secondary IP addresses
+	prefixDelegation     bool
 	eniConfig            eniconfig.ENIConfig
 	networkClient        networkutils.NetworkAPIs
 	maxIPsPerENI         int
@@ -166,6 +222,48 @@ type IPAMContext struct {
 	// so that we don't reconcile and add it back too quickly if IMDS lags behind reality.
 	reconcileCooldownCache ReconcileCooldownCache
 	terminating            int32 // Flag to warn that the pod is about to shut down.
+	shutdownFenced         int32 // Set once the node shuts down, no pod is added anymore
+	degraded               degradedState
+	diagnostics            diagnosticsState
+	checkpoint             checkpointState
+	permissions            permissionsState
+	quarantine             ipQuarantine
+	auditor                auditState
+	// hostPrimaryIP is the primary IP of the node the host network was last set up with
+	hostPrimaryIP      netip.Addr
+	lastPrimaryIPCheck time.Time
+	hostNetwork        hostNetworkSetupState
+	// externalIPAM picks the IP of each pod when a central IPAM service is configured, it is nil otherwise
+	externalIPAM *externalIPAM
+	// events streams the allocations and releases of pod IPs to external systems
+	events *ipamevents.Stream
+	// enableIPv6 is set when pods also get an IPv6 address, of the ENI of their IPv4 address or of the primary ENI
+	enableIPv6 bool
+	// eniIPv6Lock protects eniSubnetIPv6CIDRs and eniIPv6s
+	eniIPv6Lock sync.Mutex
+	// eniSubnetIPv6CIDRs is the IPv6 CIDR of the subnet of each secondary ENI, the zero Prefix if it has none
+	eniSubnetIPv6CIDRs map[string]netip.Prefix
+	// eniIPv6s is the IPv6 address each secondary ENI has been set up with
+	eniIPv6s map[string]netip.Addr
+	// ipFamilyPreference is the address family that comes first in the IPs of dual-stack pods by default
+	ipFamilyPreference string
+	// allowEarlyAdd is set when ADDs are served before the pods of the node are recovered on restart
+	allowEarlyAdd bool
+	routeTables   routeTablesState
+	egressEIPs    egressEIPState
+	eniDetach     eniDetachSafety
+	fastPath      fastPathState
+	// eniQueue runs the changes of the ENIs and of the pool one at a time, the ones pods wait for first
+	eniQueue    *eniQueue
+	mirrors     mirrorState
+	vfs         sriovState
+	branchENIs  branchENIState
+	earlyAdd    earlyAddState
+	errorBudget errorBudgetState
+	pacing      scaleDownPacing
+	// configReloadPending is set when the settings of the pool must be read again
+	configReloadPending int32
+	restartRequests     chan string
 }
 
 // Keep track of recently freed IPs to avoid reading stale EC2 metadata
@@ -213,6 +311,47 @@ func prometheusRegister() {
 		prometheus.MustRegister(reconcileCnt)
 		prometheus.MustRegister(addIPCnt)
 		prometheus.MustRegister(delIPCnt)
+		prometheus.MustRegister(degradedMode)
+		prometheus.MustRegister(startupGateWait)
+		prometheus.MustRegister(apiServerUnavailable)
+		prometheus.MustRegister(snatBypassed)
+		prometheus.MustRegister(kubeProxyModeInfo)
+		prometheus.MustRegister(markConflicts)
+		prometheus.MustRegister(quarantinedIPs)
+		prometheus.MustRegister(orphanedVethsRemoved)
+		prometheus.MustRegister(leakedRouteTablesFlushed)
+		prometheus.MustRegister(egressEIPsAssociated)
+		prometheus.MustRegister(egressIPsWithoutEIP)
+		prometheus.MustRegister(fastPathLeases)
+		prometheus.MustRegister(fastPathClaims)
+		prometheus.MustRegister(egressGatewayPods)
+		prometheus.MustRegister(sriovVFsAssigned)
+		prometheus.MustRegister(branchENIsAssigned)
+		prometheus.MustRegister(branchENIsQuarantined)
+		prometheus.MustRegister(branchENIsWarm)
+		prometheus.MustRegister(branchENIsMax)
+		prometheus.MustRegister(branchENIsAvailable)
+		prometheus.MustRegister(eniQueueDepth)
+		prometheus.MustRegister(eniQueueWait)
+		prometheus.MustRegister(memoryUsage)
+		prometheus.MustRegister(memoryLimit)
+		prometheus.MustRegister(memoryWatermarkRatio)
+		prometheus.MustRegister(goroutines)
+		prometheus.MustRegister(watermarkExceededCnt)
+		prometheus.MustRegister(podIPExportsPublished)
+		prometheus.MustRegister(auditDiscrepancies)
+		prometheus.MustRegister(logger.SuppressedMessages)
+		prometheus.MustRegister(capabilities.Enabled)
+		prometheus.MustRegister(capabilities.NodeInfo)
+		prometheus.MustRegister(networkutils.IptablesQueueWait)
+		prometheus.MustRegister(networkutils.IptablesLockWait)
+		prometheus.MustRegister(networkutils.IptablesLockTimeouts)
+		prometheus.MustRegister(prefetchCacheUsed)
+		prometheus.MustRegister(earlyAddPending)
+		prometheus.MustRegister(earlyAddPods)
+		prometheus.MustRegister(earlyAddConflicts)
+		prometheus.MustRegister(selfHeals)
+		prometheus.MustRegister(droppedPackets)
 		prometheusRegistered = true
 	}
 }
@@ -225,6 +364,10 @@ func New(k8sapiClient k8sapi.K8SAPIs, eniConfig *eniconfig.ENIConfigController)
 
 	c.k8sClient = k8sapiClient
 	c.networkClient = networkutils.New()
+	// Skip the discovery baked into the AMI of the node, when it still holds
+	usePrefetchCache()
+	// Probe the features of the node before the host network is set up, so that they show up early in the logs
+	capabilities.Get()
 	c.eniConfig = eniConfig
 
 	client, err := awsutils.New()
@@ -233,21 +376,77 @@ func New(k8sapiClient k8sapi.K8SAPIs, eniConfig *eniconfig.ENIConfigController)
 		return nil, errors.Wrap(err, "ipamd: can not initialize with AWS SDK interface")
 	}
 	c.awsClient = client
+	if err = c.checkPermissions(); err != nil {
+		log.Errorf("IAM permission check failed: %v", err)
+		return nil, errors.Wrap(err, "ipamd")
+	}
 
+	c.externalIPAM, err = newExternalIPAM(client.GetInstanceID())
+	if err != nil {
+		return nil, errors.Wrap(err, "ipamd")
+	}
+	c.startIPAMEvents()
 	c.primaryIP = make(map[string]string)
+	c.restartRequests = make(chan string, 1)
 	c.reconcileCooldownCache.cache = make(map[string]time.Time)
+	c.diagnostics.addFailures = getDiagnosticsAddFailures()
+	c.diagnostics.dir = getDiagnosticsDir()
+	c.diagnostics.runCommand = runDiagnosticsCommand
+	if APIServerOptional() {
+		c.checkpoint.path = getCheckpointPath()
+	}
 	c.warmENITarget = getWarmENITarget()
 	c.warmIPTarget = getWarmIPTarget()
 	c.useCustomNetworking = UseCustomNetworkCfg()
+	c.prewarmPendingPods = prewarmPendingPodsEnabled()
+	c.tenantLabel = networkutils.TenantLabel()
+	c.egressGateway = networkutils.EgressGatewayEnabled()
+	c.podFlags.allowed = make(map[string]bool)
+	for _, flag := range networkutils.AllowedPodFlags() {
+		c.podFlags.allowed[flag] = true
+	}
+	c.podFlags.snatExclusions = networkutils.SNATExclusionAnnotationsEnabled()
+	c.enableIPv6 = networkutils.IPv6Enabled()
+	c.ipFamilyPreference = getIPFamilyPreference()
+	c.sriov = sriovEnabled()
+	c.numaAware = numaAwareEnabled()
+	c.prefixDelegation = prefixDelegationEnabled()
+	if c.sriov && c.enableIPv6 {
+		// The IPv6 addresses of pods are routed to the primary ENI, not to the ENI of the VF
+		log.Warnf("%s is not supported with IPv6, disabling it", envSRIOV)
+		c.sriov = false
+	}
+	c.podENI = networkutils.PodENIEnabled()
+	if c.podENI && c.enableIPv6 {
+		// The branch ENIs have no IPv6 address
+		log.Warnf("Pod ENIs are not supported with IPv6, disabling them")
+		c.podENI = false
+	}
+	c.allowEarlyAdd = earlyAddEnabled()
+	if c.allowEarlyAdd && c.enableIPv6 {
+		// The IPv6 addresses of the pods are only known once they are recovered
+		log.Warnf("%s is not supported with IPv6, disabling it", envEarlyAdd)
+		c.allowEarlyAdd = false
+	}
+	c.pacing.cooldown = getScaleDownCooldown()
+	c.pacing.surgeBufferPercent = getScaleDownSurgeBuffer()
+	c.egressEIPs.pool = getEgressEIPPool()
+	c.errorBudget.init()
+	c.eniQueue = newENIQueue()
+	go c.eniQueue.work()
 
 	err = c.nodeInit()
 	if err != nil {
 		return nil, err
 	}
+	// While the pods of the node are recovered in the background, the fast path starts once they are
+	if !c.recoveryPending() {
+		c.startFastPath(fastpath.DefaultDir)
+	}
 	return c, nil
 }
 
-//TODO need to break this function down(comments from CR)
+// TODO need to break this function down(comments from CR)
 func (c *IPAMContext) nodeInit() error {
 	ipamdActionsInprogress.WithLabelValues("nodeInit").Add(float64(1))
 	defer ipamdActionsInprogress.WithLabelValues("nodeInit").Sub(float64(1))
@@ -260,6 +459,16 @@ func (c *IPAMContext) nodeInit() error {
 		log.Error("Failed to get ENI limit")
 		return err
 	}
+	if c.podENI && c.setupTrunkENI() {
+		c.reserveTrunkENISlot()
+	}
+	if c.podENI {
+		c.branchENIs.lock.Lock()
+		c.branchENIs.limit = c.getMaxBranchENI()
+		c.setBranchENIGauges()
+		c.branchENIs.lock.Unlock()
+		c.advertisePodENIs()
+	}
 	enisMax.Set(float64(c.maxENI))
 
 	c.maxIPsPerENI, err = c.awsClient.GetENIipLimit()
@@ -267,36 +476,50 @@ func (c *IPAMContext) nodeInit() error {
 		log.Error("Failed to get IPs per ENI limit")
 		return err
 	}
+	if c.prefixDelegation {
+		// Each secondary IP address of the limit can be a prefix instead
+		c.maxIPsPerENI *= ipsPerPrefix
+	}
 	ipMax.Set(float64(c.maxIPsPerENI * c.maxENI))
+	c.resolveWarmTargetPercents()
 
 	enis, err := c.awsClient.GetAttachedENIs()
 	if err != nil {
 		log.Error("Failed to retrieve ENI info")
 		return errors.New("ipamd init: failed to retrieve attached ENIs info")
 	}
+	for _, eni := range enis {
+		if eni.DeviceNumber == 0 {
+			// The branch ENIs are created in the subnet of the primary ENI
+			c.branchENIs.subnet = eni.SubnetIPv4CIDR
+		}
+	}
 
-	_, vpcCIDR, err := net.ParseCIDR(c.awsClient.GetVPCIPv4CIDR())
+	c.hostPrimaryIP = c.awsClient.GetLocalIPv4()
+	err = c.setupHostNetwork(c.hostPrimaryIP)
 	if err != nil {
-		log.Error("Failed to parse VPC IPv4 CIDR", err.Error())
-		return errors.Wrap(err, "ipamd init: failed to retrieve VPC CIDR")
+		return errors.Wrap(err, "ipamd init")
+	}
+	if err = c.setupIPv6HostNetwork(); err != nil {
+		return errors.Wrap(err, "ipamd init")
 	}
+	c.lastPrimaryIPCheck = time.Now()
 
-	primaryIP := net.ParseIP(c.awsClient.GetLocalIPv4())
-	err = c.networkClient.SetupHostNetwork(vpcCIDR, c.awsClient.GetVPCIPv4CIDRs(), c.awsClient.GetPrimaryENImac(), &primaryIP)
+	c.dataStore, err = datastore.New()
 	if err != nil {
-		log.Error("Failed to set up host network", err)
-		return errors.Wrap(err, "ipamd init: failed to set up host network")
+		return errors.Wrap(err, "ipamd init")
 	}
-
-	c.dataStore = datastore.NewDataStore()
+	c.dataStore.SetMinENILifetime(getMinENILifetime())
+	c.dataStore.SetKeepFreeENI(c.tenantENIsEnabled())
+	eniAttachRetry := eniAttachRetryPolicy.WithEnvOverrides()
 	for _, eni := range enis {
 		log.Debugf("Discovered ENI %s, trying to set it up", eni.ENIID)
 		// Retry ENI sync
-		retry := 0
+		attempt := 0
 		for {
-			retry++
+			attempt++
 			err = c.setupENI(eni.ENIID, eni)
-			if retry > maxRetryCheckENI {
+			if attempt >= eniAttachRetry.MaxAttempts {
 				log.Errorf("Unable to discover attached IPs for ENI from metadata service")
 				ipamdErrInc("waitENIAttachedMaxRetryExceeded")
 				break
@@ -304,21 +527,60 @@ func (c *IPAMContext) nodeInit() error {
 
 			if err != nil {
 				log.Warnf("Error trying to set up ENI %s: %v", eni.ENIID, err)
-				if strings.Contains(err.Error(), "setupENINetwork: failed to find the link which uses MAC address") {
+				if strings.Contains(err.Error(), "setupENINetwork: failed to find the link which uses MAC address") ||
+					strings.Contains(err.Error(), networkutils.ErrUnmanagedInterface) {
 					// If we can't find the matching link for this MAC address, there is no point in retrying for this ENI.
 					log.Errorf("Unable to match link for this ENI, going to the next one.")
 					break
 				}
-				log.Debugf("Unable to discover IPs for this ENI yet (attempt %d/%d)", retry, maxRetryCheckENI)
-				time.Sleep(eniAttachTime)
+				log.Debugf("Unable to discover IPs for this ENI yet (attempt %d/%d)", attempt, eniAttachRetry.MaxAttempts)
+				time.Sleep(eniAttachRetry.Delay(attempt))
 				continue
 			}
 			log.Infof("ENI %s set up.", eni.ENIID)
 			break
 		}
 	}
-	localPods, err := c.getLocalPodsWithRetry()
+	rules, err := c.networkClient.GetRuleList()
+	if err != nil {
+		log.Errorf("During ipamd init: failed to retrieve IP rule list %v", err)
+		return nil
+	}
+
+	// The IP rules of the pods act as a record of the IPs in use. Without any, this is a fresh node and pods
+	// without an IP are waiting for us, so there is no point in waiting for the API server to report their IPs.
+	podIPsInRules := len(networkutils.GetPodIPsFromRules(rules))
+	waitForPodIPs := true
+	if fastStartEnabled() && podIPsInRules == 0 {
+		log.Info("No pod has been set up on this node yet, not waiting for local pods to get an IP")
+		waitForPodIPs = false
+	}
+
+	if c.allowEarlyAdd && podIPsInRules > 0 && c.startEarlyAdd(networkutils.GetPodIPsFromRules(rules)) {
+		go c.recoverInBackground(func() error {
+			return c.recoverLocalPods(rules, podIPsInRules, waitForPodIPs)
+		})
+		return nil
+	}
+	return c.recoverLocalPods(rules, podIPsInRules, waitForPodIPs)
+}
+
+// recoverLocalPods assigns their IPs again to the pods of the node, found by the API server or in the checkpoint, then
+// fills the pool
+func (c *IPAMContext) recoverLocalPods(rules []netlink.Rule, podIPsInRules int, waitForPodIPs bool) error {
+	localPods, err := c.getLocalPodsWithRetry(waitForPodIPs)
 	log.Debugf("getLocalPodsWithRetry() found %d local pods", len(localPods))
+	if err == nil && c.podENI {
+		// The checkpoint has no branch ENIs, only the API server tells which pods are gone
+		c.releaseOrphanedBranchENIs(localPods)
+	}
+	if err != nil && APIServerOptional() {
+		log.Warnf("During ipamd init, failed to get Pod information from Kubernetes API Server, starting without it: %v", err)
+		localPods, err = c.restoreLocalPods(podIPsInRules)
+		if err == nil {
+			go c.waitForAPIServerSync()
+		}
+	}
 	if err != nil {
 		log.Warnf("During ipamd init, failed to get Pod information from Kubernetes API Server %v", err)
 		ipamdErrInc("nodeInitK8SGetLocalPodIPsFailed")
@@ -326,13 +588,11 @@ func (c *IPAMContext) nodeInit() error {
 		// TODO  need to add node health stats here
 		return errors.Wrap(err, "failed to get running pods!")
 	}
-
-	rules, err := c.networkClient.GetRuleList()
-	if err != nil {
-		log.Errorf("During ipamd init: failed to retrieve IP rule list %v", err)
-		return nil
+	if store, ok := c.dataStore.(*checkpointStore); ok {
+		store.forgetStalePods(localPods)
 	}
 
+	podIPv6s := c.getPodIPv6s()
 	for _, ip := range localPods {
 		if ip.Container == "" {
 			log.Infof("Skipping Pod %s, Namespace %s, due to no matching container", ip.Name, ip.Namespace)
@@ -342,8 +602,39 @@ func (c *IPAMContext) nodeInit() error {
 			log.Infof("Skipping Pod %s, Namespace %s, due to no IP", ip.Name, ip.Namespace)
 			continue
 		}
+		if c.skipRecoveredPod(ip) {
+			continue
+		}
+		if c.podENI && c.recoverBranchENIPod(ip) {
+			continue
+		}
 		log.Infof("Recovered AddNetwork for Pod %s, Namespace %s, Container %s", ip.Name, ip.Namespace, ip.Container)
+		ip.IPv6 = podIPv6s[ip.IP]
+		meta := c.newPodMetadata(ip.Namespace, ip.Name)
+		// The pods restored from the checkpoint already have their tenant
+		if ip.Tenant == "" {
+			ip.Tenant, err = c.getPodTenant(meta)
+			if err != nil {
+				log.Warnf("During ipamd init, failed to get the tenant of pod %s, namespace %s: %v", ip.Name, ip.Namespace, err)
+			}
+		}
+		// The rules of the flags of the pod are kept on the host, the flags are read again for the ENI and the routes
+		// of the pod
+		var flags PodFlags
+		if flags, err = c.getPodFlags(meta, ip.Tenant, false); err != nil {
+			log.Warnf("During ipamd init, failed to get the flags of pod %s, namespace %s: %v", ip.Name, ip.Namespace, err)
+		}
+		c.recordPodFlags(ip.Namespace, ip.Name, flags)
+		if ip.Tenant == "" {
+			ip.Tenant = podENITenant("", flags, ip.Namespace, ip.Name)
+		}
 		_, _, err = c.dataStore.AssignPodIPv4Address(ip)
+		if err == nil && ip.IPv6 != "" {
+			if _, err := c.dataStore.AssignPodIPv6Address(ip); err != nil {
+				ipamdErrInc("nodeInitAssignPodIPv6AddressFailed")
+				log.Warnf("During ipamd init, failed to use pod IPv6 %s found in the host routes %v", ip.IPv6, err)
+			}
+		}
 		if err != nil {
 			ipamdErrInc("nodeInitAssignPodIPv4AddressFailed")
 			log.Warnf("During ipamd init, failed to use pod IP %s returned from Kubernetes API Server %v", ip.IP, err)
@@ -355,19 +646,22 @@ func (c *IPAMContext) nodeInit() error {
 		}
 
 		// Update ip rules in case there is a change in VPC CIDRs, AWS_VPC_K8S_CNI_EXTERNALSNAT setting
-		srcIPNet := net.IPNet{IP: net.ParseIP(ip.IP), Mask: net.IPv4Mask(255, 255, 255, 255)}
-		vpcCIDRs := c.awsClient.GetVPCIPv4CIDRs()
-
-		var pbVPCcidrs []string
-		for _, cidr := range vpcCIDRs {
-			pbVPCcidrs = append(pbVPCcidrs, *cidr)
+		srcIP, err := cidr.ParseAddr(ip.IP)
+		if err != nil {
+			log.Errorf("Invalid pod IP %s returned from Kubernetes API Server: %v", ip.IP, err)
+			continue
 		}
+		vpcCIDRs := networkutils.RemoveOverlappingCIDRs(c.awsClient.GetVPCIPv4CIDRs())
 
-		err = c.networkClient.UpdateRuleListBySrc(rules, srcIPNet, pbVPCcidrs, !c.networkClient.UseExternalSNAT())
+		// Tenant pods send all their traffic through their ENI
+		requiresSNAT := !c.networkClient.UseExternalSNAT() && ip.Tenant == "" && !flags.NoSNAT
+		err = c.networkClient.UpdateRuleListBySrc(rules, cidr.HostPrefix(srcIP), vpcCIDRs, requiresSNAT)
 		if err != nil {
 			log.Errorf("UpdateRuleListBySrc in nodeInit() failed for IP %s: %v", ip.IP, err)
 		}
 	}
+	c.writeCheckpoint()
+
 	// For a new node, attach IPs
 	increasedPool, err := c.tryAssignIPs()
 	if err == nil && increasedPool {
@@ -376,10 +670,13 @@ func (c *IPAMContext) nodeInit() error {
 	return err
 }
 
-func (c *IPAMContext) getLocalPodsWithRetry() ([]*k8sapi.K8SPodInfo, error) {
+// getLocalPodsWithRetry returns the local pods from the API server. If waitForPodIPs is set, it retries while some pods
+// have no IP, since the API server might not have caught up with the state of the node yet.
+func (c *IPAMContext) getLocalPodsWithRetry(waitForPodIPs bool) ([]*k8sapi.K8SPodInfo, error) {
 	var pods []*k8sapi.K8SPodInfo
 	var err error
-	for retry := 1; retry <= maxK8SRetries; retry++ {
+	k8sRetry := k8sRetryPolicy.WithEnvOverrides()
+	for attempt := 1; attempt <= k8sRetry.MaxAttempts; attempt++ {
 		pods, err = c.k8sClient.K8SGetLocalPodIPs()
 		if err == nil {
 			// Check for pods with no IP since the API server might not have the latest state of the node.
@@ -390,13 +687,13 @@ func (c *IPAMContext) getLocalPodsWithRetry() ([]*k8sapi.K8SPodInfo, error) {
 					allPodsHaveAnIP = false
 				}
 			}
-			if allPodsHaveAnIP {
+			if allPodsHaveAnIP || !waitForPodIPs {
 				break
 			}
-			log.Warnf("Not all pods have an IP, trying again in %v seconds.", retryK8SInterval.Seconds())
+			log.Warn("Not all pods have an IP, trying again.")
 		}
-		log.Infof("Not able to get local pods yet (attempt %d/%d): %v", retry, maxK8SRetries, err)
-		time.Sleep(retryK8SInterval)
+		log.Infof("Not able to get local pods yet (attempt %d/%d): %v", attempt, k8sRetry.MaxAttempts, err)
+		time.Sleep(k8sRetry.Delay(attempt))
 	}
 
 	if err != nil {
@@ -412,20 +709,46 @@ func (c *IPAMContext) getLocalPodsWithRetry() ([]*k8sapi.K8SPodInfo, error) {
 
 // StartNodeIPPoolManager monitors the IP pool, add or del them when it is required.
 func (c *IPAMContext) StartNodeIPPoolManager() {
+	// The pool must not shrink before the IPs of the pods are known
+	c.waitForRecovery()
 	sleepDuration := ipPoolMonitorInterval / 2
+	// Each step is an operation of the ENI queue, so that the operations pods wait for run between them
 	for {
 		time.Sleep(sleepDuration)
+		c.eniQueue.run(eniOpWarmPool, "reloadConfig", c.reloadConfigIfRequested)
 		c.updateIPPoolIfRequired()
+		c.eniQueue.run(eniOpWarmPool, "syncFastPath", c.syncFastPath)
 		time.Sleep(sleepDuration)
-		c.nodeIPPoolReconcile(nodeIPPoolReconcileInterval)
+		c.eniQueue.run(eniOpWarmPool, "nodeIPPoolReconcile", func() {
+			c.nodeIPPoolReconcile(nodeIPPoolReconcileInterval)
+		})
+		c.eniQueue.run(eniOpWarmPool, "checkPrimaryIP", func() { c.checkPrimaryIP(primaryIPCheckInterval) })
+		c.eniQueue.run(eniOpWarmPool, "checkTrunkENI", func() { c.checkTrunkENI(trunkENICheckInterval) })
+		c.eniQueue.run(eniOpWarmPool, "fillWarmBranchENIs", c.fillWarmBranchENIs)
+		c.eniQueue.run(eniOpWarmPool, "checkRouteTables", func() { c.checkRouteTables(routeTableCheckInterval) })
+		c.eniQueue.run(eniOpWarmPool, "reconcileEgressEIPs", func() {
+			c.reconcileEgressEIPs(egressEIPReconcileInterval)
+		})
+		c.eniQueue.run(eniOpWarmPool, "checkErrorBudget", c.checkErrorBudget)
 	}
 }
 
+// updateIPPoolIfRequired grows the pool as warm pool maintenance, then shrinks it as a scale-down
 func (c *IPAMContext) updateIPPoolIfRequired() {
+	c.eniQueue.run(eniOpWarmPool, "increaseIPPool", c.increaseIPPoolIfRequired)
+	c.eniQueue.run(eniOpScaleDown, "decreaseIPPool", c.decreaseIPPoolIfRequired)
+}
+
+func (c *IPAMContext) increaseIPPoolIfRequired() {
 	if c.nodeIPPoolTooLow() {
 		c.increaseIPPool()
-	} else if c.nodeIPPoolTooHigh() {
-		c.decreaseIPPool(decreaseIPPoolInterval)
+	}
+}
+
+func (c *IPAMContext) decreaseIPPoolIfRequired() {
+	// Pods may have taken IPs since the pool was grown
+	if !c.nodeIPPoolTooLow() && c.nodeIPPoolTooHigh() {
+		c.decreaseIPPool()
 	}
 
 	if c.shouldRemoveExtraENIs() {
@@ -433,21 +756,33 @@ func (c *IPAMContext) updateIPPoolIfRequired() {
 	}
 }
 
-// decreaseIPPool runs every `interval` and attempts to return unused ENIs and IPs
-func (c *IPAMContext) decreaseIPPool(interval time.Duration) {
+// requestPodBlockingGrowth grows the pool ahead of the warm pool maintenance and of the scale-downs when a pod got no
+// IP, instead of at the next pass of the pool manager. The CNI plugin adds the pod again.
+func (c *IPAMContext) requestPodBlockingGrowth() {
+	if c.eniQueue == nil || c.recoveryPending() {
+		// The pool is filled by the pool manager once the pods of the node are recovered
+		return
+	}
+	c.eniQueue.submit(eniOpPodBlocking, "increaseIPPool", c.increaseIPPoolIfRequired)
+}
+
+// decreaseIPPool attempts to return unused IPs, at most once per scale-down cooldown
+func (c *IPAMContext) decreaseIPPool() {
 	ipamdActionsInprogress.WithLabelValues("decreaseIPPool").Add(float64(1))
 	defer ipamdActionsInprogress.WithLabelValues("decreaseIPPool").Sub(float64(1))
 
 	now := time.Now()
-	timeSinceLast := now.Sub(c.lastDecreaseIPPool)
-	if timeSinceLast <= interval {
-		log.Debugf("Skipping decrease IP pool because time since last %v <= %v", timeSinceLast, interval)
+	if c.inScaleDownCooldown(now, c.lastDecreaseIPPool) {
+		log.Debugf("Skipping decrease IP pool")
 		return
 	}
 
 	log.Debugf("Starting to decrease IP pool")
 
 	c.tryUnassignIPsFromAll()
+	if c.prefixDelegation {
+		c.tryUnassignPrefixesFromAll()
+	}
 
 	c.lastDecreaseIPPool = now
 	c.lastNodeIPPoolAction = now
@@ -462,19 +797,50 @@ func (c *IPAMContext) tryFreeENI() {
 		log.Debug("AWS CNI is terminating, not detaching any ENIs")
 		return
 	}
+	if c.permissions.noENIRelease {
+		return
+	}
 
-	eni := c.dataStore.RemoveUnusedENIFromStore(c.warmIPTarget)
+	now := time.Now()
+	if c.inScaleDownCooldown(now, c.pacing.lastFreeENI) {
+		return
+	}
+
+	warmIPTarget := c.warmIPTarget
+	if warmIPTarget != noWarmIPTarget {
+		_, used := c.dataStore.GetSharedStats()
+		warmIPTarget += c.surgeBuffer(used)
+	}
+	eni, deviceNumber, ips := c.dataStore.GetUnusedENI(warmIPTarget)
 	if eni == "" {
 		return
 	}
+	if !c.canDetachENI(eni, deviceNumber, ips) {
+		return
+	}
+	prefixes, _ := c.dataStore.GetENIIPv4Prefixes(eni)
+	// A pod may have got an IP of the ENI since it was found unused
+	if err := c.dataStore.RemoveENIFromDataStore(eni); err != nil {
+		log.Warnf("Not freeing ENI %s: %v", eni, err)
+		return
+	}
+	c.deleteIPv4PrefixRoutes(eni, prefixes)
+	// The default routes of the other ENIs must not go through it once it is detached
+	err := c.networkClient.TeardownENINetwork(deviceNumber)
+	c.recordNetlinkResult(err)
+	if err != nil {
+		log.Warnf("Failed to remove the egress path of ENI %s: %v", eni, err)
+		ipamdErrInc("teardownENINetworkFailed")
+	}
 
 	log.Debugf("Start freeing ENI %s", eni)
-	err := c.awsClient.FreeENI(eni)
+	err = c.awsClient.FreeENI(eni)
 	if err != nil {
 		ipamdErrInc("decreaseIPPoolFreeENIFailed")
 		log.Errorf("Failed to free ENI %s, err: %v", eni, err)
 		return
 	}
+	c.pacing.lastFreeENI = now
 }
 
 // tryUnassignIPsFromAll determines if there are IPs to free when we have extra IPs beyond the target and warmIPTargetDefined
@@ -542,7 +908,10 @@ func (c *IPAMContext) findFreeableIPs(eni string) ([]string, error) {
 	}
 
 	for _, ip := range pool.IPv4Addresses {
-		allocatedIPs.Add(ip.Address)
+		// The addresses of a prefix are only released together, with the prefix
+		if !ip.Prefix.IsValid() {
+			allocatedIPs.Add(ip.Address.String())
+		}
 	}
 
 	availableIPs := allocatedIPs.Difference(usedIPs).ToSlice()
@@ -565,7 +934,7 @@ func (c *IPAMContext) increaseIPPool() {
 	defer ipamdActionsInprogress.WithLabelValues("increaseIPPool").Sub(float64(1))
 
 	short, _, warmIPTargetDefined := c.ipTargetState()
-	if warmIPTargetDefined && short == 0 {
+	if warmIPTargetDefined && short == 0 && !c.noFreeTenantENI() {
 		log.Debugf("Skipping increase IP pool, warm IP target reached")
 		return
 	}
@@ -575,16 +944,24 @@ func (c *IPAMContext) increaseIPPool() {
 		return
 	}
 
+	if c.inDegradedBackoff() {
+		log.Debug("Skipping increase IP pool, waiting for the next attempt in degraded mode")
+		return
+	}
+
 	// Try to add more IPs to existing ENIs first.
 	increasedPool, err := c.tryAssignIPs()
 	if err != nil {
 		log.Errorf(err.Error())
 	}
 	if increasedPool {
+		c.recordPoolSuccess()
 		c.updateLastNodeIPPoolAction()
 	} else {
 		// If we did not add an IP, try to add an ENI instead.
-		if c.dataStore.GetENIs() < c.maxENI {
+		if c.permissions.noENIAllocation {
+			log.Debug("Skipping ENI allocation as the IAM permissions to create ENIs are missing")
+		} else if c.dataStore.GetENIs() < c.maxENI {
 			c.tryAllocateENI()
 			c.updateLastNodeIPPoolAction()
 		} else {
@@ -595,6 +972,7 @@ func (c *IPAMContext) increaseIPPool() {
 
 func (c *IPAMContext) updateLastNodeIPPoolAction() {
 	c.lastNodeIPPoolAction = time.Now()
+	c.pacing.lastIncrease = c.lastNodeIPPoolAction
 	total, used := c.dataStore.GetStats()
 	log.Debugf("Successfully increased IP pool")
 	logPoolStats(total, used, c.maxIPsPerENI)
@@ -624,11 +1002,15 @@ func (c *IPAMContext) tryAllocateENI() {
 	if err != nil {
 		log.Errorf("Failed to increase pool size due to not able to allocate ENI %v", err)
 		ipamdErrInc("increaseIPPoolAllocENI")
+		c.recordPoolError(err)
 		return
 	}
 
+	var prefixes []netip.Prefix
 	short, _, warmIPTargetDefined := c.ipTargetState()
-	if warmIPTargetDefined {
+	if c.prefixDelegation {
+		prefixes, err = c.awsClient.AllocIPv4Prefixes(eni, c.prefixesToAllocate(c.maxPrefixesPerENI()))
+	} else if warmIPTargetDefined {
 		err = c.awsClient.AllocIPAddresses(eni, short)
 	} else {
 		err = c.awsClient.AllocIPAddresses(eni, c.maxIPsPerENI)
@@ -637,6 +1019,9 @@ func (c *IPAMContext) tryAllocateENI() {
 		log.Warnf("Failed to allocate all available ip addresses on an ENI %v", err)
 		// Continue to process the allocated IP addresses
 		ipamdErrInc("increaseIPPoolAllocIPAddressesFailed")
+		c.recordPoolError(err)
+	} else {
+		c.recordPoolSuccess()
 	}
 
 	eniMetadata, err := c.waitENIAttached(eni)
@@ -646,16 +1031,22 @@ func (c *IPAMContext) tryAllocateENI() {
 		return
 	}
 
-	err = c.setupENI(eni, eniMetadata)
+	err = c.setupNewENI(eni, eniMetadata)
 	if err != nil {
 		ipamdErrInc("increaseIPPoolsetupENIFailed")
 		log.Errorf("Failed to increase pool size: %v", err)
 		return
 	}
+	// The instance metadata service may not report the prefixes yet
+	c.addIPv4Prefixes(eni, prefixes)
 }
 
 // For an ENI, try to fill in missing IPs on an existing ENI
 func (c *IPAMContext) tryAssignIPs() (increasedPool bool, err error) {
+	if c.prefixDelegation {
+		return c.tryAssignPrefixes()
+	}
+
 	// If WARM_IP_TARGET is set, only proceed if we are short of target
 	short, _, warmIPTargetDefined := c.ipTargetState()
 	if warmIPTargetDefined && short == 0 {
@@ -674,6 +1065,7 @@ func (c *IPAMContext) tryAssignIPs() (increasedPool bool, err error) {
 			err = c.awsClient.AllocIPAddresses(eni.ID, 1)
 			if err != nil {
 				ipamdErrInc("increaseIPPoolAllocIPAddressesFailed")
+				c.recordPoolError(err)
 				return false, errors.Wrap(err, fmt.Sprintf("failed to allocate one IP addresses on ENI %s, err: %v", eni.ID, err))
 			}
 		}
@@ -689,6 +1081,22 @@ func (c *IPAMContext) tryAssignIPs() (increasedPool bool, err error) {
 	return false, nil
 }
 
+// setupNewENI sets up an ENI that was just attached. The route table of its device number is reclaimed first, and the
+// ENI is left out of the datastore if its network can not be set up, so that no pod gets an IP of it until a later
+// reconciliation sets it up completely.
+func (c *IPAMContext) setupNewENI(eni string, eniMetadata awsutils.ENIMetadata) error {
+	if err := c.reclaimRouteTable(eniMetadata.DeviceNumber); err != nil {
+		return errors.Wrapf(err, "failed to reclaim the route table of ENI %s", eni)
+	}
+	if err := c.setupENI(eni, eniMetadata); err != nil {
+		if delErr := c.dataStore.RemoveENIFromDataStore(eni); delErr != nil && delErr.Error() != datastore.UnknownENIError {
+			log.Warnf("Failed to remove ENI %s that could not be set up from the datastore: %v", eni, delErr)
+		}
+		return err
+	}
+	return nil
+}
+
 // setupENI does following:
 // 1) add ENI to datastore
 // 2) set up linux ENI related networking stack.
@@ -707,14 +1115,27 @@ func (c *IPAMContext) setupENI(eni string, eniMetadata awsutils.ENIMetadata) err
 
 	// For secondary ENIs, set up the network
 	if eni != c.awsClient.GetPrimaryENI() {
-		err = c.networkClient.SetupENINetwork(eniPrimaryIP, eniMetadata.MAC, eniMetadata.DeviceNumber, eniMetadata.SubnetIPv4CIDR)
+		eniIP, err := cidr.ParseAddr(eniPrimaryIP)
+		if err != nil {
+			return errors.Wrapf(err, "failed to set up ENI %s network", eni)
+		}
+		err = c.networkClient.SetupENINetwork(eniIP, eniMetadata.MAC, eniMetadata.DeviceNumber, eniMetadata.SubnetIPv4CIDR)
+		c.recordNetlinkResult(err)
 		if err != nil {
 			log.Errorf("Failed to set up networking for ENI %s", eni)
 			return errors.Wrapf(err, "failed to set up ENI %s network", eni)
 		}
 	}
 
+	c.setENISubnet(eni, eniMetadata.SubnetIPv4CIDR)
+	c.setENINUMANode(eni, eniMetadata.MAC)
 	c.primaryIP[eni] = c.addENIaddressesToDataStore(ec2Addrs, eni)
+	if c.prefixDelegation {
+		c.reconcileIPv4Prefixes(eni, eniMetadata)
+	}
+	if c.enableIPv6 {
+		c.reconcileIPv6Pool(eni, eniMetadata)
+	}
 	return nil
 }
 
@@ -726,6 +1147,9 @@ func (c *IPAMContext) addENIaddressesToDataStore(ec2Addrs []*ec2.NetworkInterfac
 			primaryIP = aws.StringValue(ec2Addr.PrivateIpAddress)
 			continue
 		}
+		if !c.validateENIAddress(eni, aws.StringValue(ec2Addr.PrivateIpAddress)) {
+			continue
+		}
 		err := c.dataStore.AddIPv4AddressFromStore(eni, aws.StringValue(ec2Addr.PrivateIpAddress))
 		if err != nil && err.Error() != datastore.DuplicateIPError {
 			log.Warnf("Failed to increase IP pool, failed to add IP %s to data store", ec2Addr.PrivateIpAddress)
@@ -755,7 +1179,8 @@ func (c *IPAMContext) getENIaddresses(eni string) ([]*ec2.NetworkInterfacePrivat
 
 func (c *IPAMContext) waitENIAttached(eni string) (awsutils.ENIMetadata, error) {
 	// Wait until the ENI shows up in the instance metadata service
-	retry := 0
+	eniAttachRetry := eniAttachRetryPolicy.WithEnvOverrides()
+	attempt := 0
 	for {
 		enis, err := c.awsClient.GetAttachedENIs()
 		if err != nil {
@@ -767,15 +1192,15 @@ func (c *IPAMContext) waitENIAttached(eni string) (awsutils.ENIMetadata, error)
 					return returnedENI, nil
 				}
 			}
-			log.Debugf("Not able to find the right ENI yet (attempt %d/%d)", retry, maxRetryCheckENI)
+			log.Debugf("Not able to find the right ENI yet (attempt %d/%d)", attempt, eniAttachRetry.MaxAttempts)
 		}
-		retry++
-		if retry > maxRetryCheckENI {
+		attempt++
+		if attempt >= eniAttachRetry.MaxAttempts {
 			ipamdErrInc("waitENIAttachedMaxRetryExceeded")
 			return awsutils.ENIMetadata{}, errors.New("waitENIAttached: giving up trying to retrieve ENIs from metadata service")
 		}
-		log.Debugf("Not able to discover attached ENIs yet (attempt %d/%d)", retry, maxRetryCheckENI)
-		time.Sleep(eniAttachTime)
+		log.Debugf("Not able to discover attached ENIs yet (attempt %d/%d)", attempt, eniAttachRetry.MaxAttempts)
+		time.Sleep(eniAttachRetry.Delay(attempt))
 	}
 }
 
@@ -819,6 +1244,38 @@ func getWarmENITarget() int {
 	return defaultWarmENITarget
 }
 
+// getWarmTargetPercent returns the percentage a warm target is set to, if it is set as a percentage like "10%"
+func getWarmTargetPercent(name string) (int, bool) {
+	inputStr := os.Getenv(name)
+	if !strings.HasSuffix(inputStr, "%") {
+		return 0, false
+	}
+	input, err := strconv.Atoi(strings.TrimSuffix(inputStr, "%"))
+	if err != nil || input < 0 || input > 100 {
+		log.Errorf("Failed to parse %s %q as a percentage between 0%% and 100%%", name, inputStr)
+		return 0, false
+	}
+	return input, true
+}
+
+// percentOf returns percent% of value, rounded up
+func percentOf(percent, value int) int {
+	return (percent*value + 99) / 100
+}
+
+// resolveWarmTargetPercents sets the warm targets that are set as a percentage of the capacity of the node, once the
+// maximum number of ENIs and of IPs per ENI are known
+func (c *IPAMContext) resolveWarmTargetPercents() {
+	if percent, ok := getWarmTargetPercent(envWarmIPTarget); ok {
+		c.warmIPTarget = percentOf(percent, c.maxENI*c.maxIPsPerENI)
+		log.Infof("Using WARM_IP_TARGET %d, %d%% of the %d IPs of the node", c.warmIPTarget, percent, c.maxENI*c.maxIPsPerENI)
+	}
+	if percent, ok := getWarmTargetPercent(envWarmENITarget); ok {
+		c.warmENITarget = percentOf(percent, c.maxENI)
+		log.Infof("Using WARM_ENI_TARGET %d, %d%% of the %d ENIs of the node", c.warmENITarget, percent, c.maxENI)
+	}
+}
+
 func logPoolStats(total, used, maxAddrsPerENI int) {
 	log.Debugf("IP pool stats: total = %d, used = %d, c.maxIPsPerENI = %d",
 		total, used, maxAddrsPerENI)
@@ -826,15 +1283,20 @@ func logPoolStats(total, used, maxAddrsPerENI int) {
 
 // nodeIPPoolTooLow returns true if IP pool is below low threshold
 func (c *IPAMContext) nodeIPPoolTooLow() bool {
+	if c.noFreeTenantENI() {
+		log.Debugf("IP pool is too low: no free ENI left for a new tenant")
+		return true
+	}
+
 	short, _, warmIPTargetDefined := c.ipTargetState()
 	if warmIPTargetDefined {
 		return short > 0
 	}
 
-	total, used := c.dataStore.GetStats()
+	total, used := c.dataStore.GetSharedStats()
 	logPoolStats(total, used, c.maxIPsPerENI)
 
-	available := total - used
+	available := total - used - c.pendingPodCount()
 	poolTooLow := available < c.maxIPsPerENI*c.warmENITarget || (c.warmENITarget == 0 && available == 0)
 	if poolTooLow {
 		log.Debugf("IP pool is too low: available (%d) < ENI target (%d) * addrsPerENI (%d)", available, c.warmENITarget, c.maxIPsPerENI)
@@ -863,16 +1325,17 @@ func (c *IPAMContext) shouldRemoveExtraENIs() bool {
 		return true
 	}
 
-	total, used := c.dataStore.GetStats()
+	total, used := c.dataStore.GetSharedStats()
 	logPoolStats(total, used, c.maxIPsPerENI)
 
 	available := total - used
+	surgeBuffer := c.surgeBuffer(used)
 	// We need the +1 to make sure we are not going below the WARM_ENI_TARGET.
-	shouldRemoveExtra := available >= (c.warmENITarget+1)*c.maxIPsPerENI
+	shouldRemoveExtra := available >= (c.warmENITarget+1)*c.maxIPsPerENI+surgeBuffer
 	if shouldRemoveExtra {
-		log.Debugf("It might be possible to remove extra ENIs because available (%d) >= (ENI target (%d) + 1) * addrsPerENI (%d): ", available, c.warmENITarget, c.maxIPsPerENI)
+		log.Debugf("It might be possible to remove extra ENIs because available (%d) >= (ENI target (%d) + 1) * addrsPerENI (%d) + surge buffer (%d): ", available, c.warmENITarget, c.maxIPsPerENI, surgeBuffer)
 	} else {
-		log.Debugf("Its NOT possible to remove extra ENIs because available (%d) < (ENI target (%d) + 1) * addrsPerENI (%d): ", available, c.warmENITarget, c.maxIPsPerENI)
+		log.Debugf("Its NOT possible to remove extra ENIs because available (%d) < (ENI target (%d) + 1) * addrsPerENI (%d) + surge buffer (%d): ", available, c.warmENITarget, c.maxIPsPerENI, surgeBuffer)
 	}
 	return shouldRemoveExtra
 }
@@ -919,7 +1382,7 @@ func (c *IPAMContext) nodeIPPoolReconcile(interval time.Duration) {
 
 		// Add new ENI
 		log.Debugf("Reconcile and add a new ENI %s", attachedENI)
-		err = c.setupENI(attachedENI.ENIID, attachedENI)
+		err = c.setupNewENI(attachedENI.ENIID, attachedENI)
 		if err != nil {
 			log.Errorf("IP pool reconcile: Failed to set up ENI %s network: %v", attachedENI.ENIID, err)
 			ipamdErrInc("eniReconcileAdd")
@@ -932,12 +1395,27 @@ func (c *IPAMContext) nodeIPPoolReconcile(interval time.Duration) {
 	// Sweep phase: since the marked ENI have been removed, the remaining ones needs to be sweeped
 	for eni := range curENIs.ENIIPPools {
 		log.Infof("Reconcile and delete detached ENI %s", eni)
+		prefixes, _ := c.dataStore.GetENIIPv4Prefixes(eni)
 		err = c.dataStore.RemoveENIFromDataStore(eni)
+		if err != nil && err.Error() == datastore.ENIInUseError && c.evictDetachedENI(eni) {
+			// Detached outside of ipamd while pods use it
+			err = nil
+		}
 		if err != nil {
 			log.Errorf("IP pool reconcile: Failed to delete ENI during reconcile: %v", err)
 			ipamdErrInc("eniReconcileDel")
 			continue
 		}
+		c.pruneQuarantine(eni, nil)
+		c.deleteIPv4PrefixRoutes(eni, prefixes)
+		if eniInfo := curENIs.ENIIPPools[eni]; !eniInfo.IsPrimary {
+			err = c.networkClient.TeardownENINetwork(eniInfo.DeviceNumber)
+			c.recordNetlinkResult(err)
+			if err != nil {
+				log.Warnf("Failed to remove the egress path of detached ENI %s: %v", eni, err)
+				ipamdErrInc("teardownENINetworkFailed")
+			}
+		}
 		reconcileCnt.With(prometheus.Labels{"fn": "eniReconcileDel"}).Inc()
 	}
 	log.Debug("Successfully Reconciled ENI/IP pool")
@@ -945,6 +1423,13 @@ func (c *IPAMContext) nodeIPPoolReconcile(interval time.Duration) {
 }
 
 func (c *IPAMContext) eniIPPoolReconcile(ipPool map[string]*datastore.AddressInfo, attachedENI awsutils.ENIMetadata, eni string) {
+	c.setENISubnet(eni, attachedENI.SubnetIPv4CIDR)
+	// The addresses of prefixes are reconciled with their prefix
+	for ip, addr := range ipPool {
+		if addr.Prefix.IsValid() {
+			delete(ipPool, ip)
+		}
+	}
 	for _, localIP := range attachedENI.LocalIPv4s {
 		if localIP == c.primaryIP[eni] {
 			log.Debugf("Reconcile and skip primary IP %s on ENI %s", localIP, eni)
@@ -984,6 +1469,11 @@ func (c *IPAMContext) eniIPPoolReconcile(ipPool map[string]*datastore.AddressInf
 			}
 		}
 
+		// IPs that are not valid for the ENI are left in ipPool, so that they are removed from the datastore below
+		if !c.validateENIAddress(eni, localIP) {
+			continue
+		}
+
 		err := c.dataStore.AddIPv4AddressFromStore(eni, localIP)
 		if err != nil && err.Error() == datastore.DuplicateIPError {
 			log.Debugf("Reconciled IP %s on ENI %s", localIP, eni)
@@ -1002,9 +1492,15 @@ func (c *IPAMContext) eniIPPoolReconcile(ipPool map[string]*datastore.AddressInf
 	}
 
 	// Sweep phase, delete remaining IPs
+	var revokedIPs []string
 	for existingIP := range ipPool {
 		log.Debugf("Reconcile and delete IP %s on ENI %s", existingIP, eni)
 		err := c.dataStore.DelIPv4AddressFromStore(eni, existingIP)
+		if err != nil && err.Error() == datastore.IPInUseError {
+			// Unassigned from the ENI outside of ipamd while a pod uses it
+			revokedIPs = append(revokedIPs, existingIP)
+			continue
+		}
 		if err != nil {
 			log.Errorf("Failed to reconcile and delete IP %s on ENI %s, %v", existingIP, eni, err)
 			ipamdErrInc("ipReconcileDel")
@@ -1013,6 +1509,16 @@ func (c *IPAMContext) eniIPPoolReconcile(ipPool map[string]*datastore.AddressInf
 		}
 		reconcileCnt.With(prometheus.Labels{"fn": "eniIPPoolReconcileDel"}).Inc()
 	}
+	if len(revokedIPs) > 0 {
+		c.evictRevokedIPs(eni, revokedIPs)
+	}
+	c.pruneQuarantine(eni, attachedENI.LocalIPv4s)
+	if c.prefixDelegation {
+		c.reconcileIPv4Prefixes(eni, attachedENI)
+	}
+	if c.enableIPv6 {
+		c.reconcileIPv6Pool(eni, attachedENI)
+	}
 }
 
 // UseCustomNetworkCfg returns whether Pods needs to use pod specific configuration or not.
@@ -1050,19 +1556,77 @@ func (c *IPAMContext) ipTargetState() (short int, over int, enabled bool) {
 		return 0, 0, false
 	}
 
-	total, assigned := c.dataStore.GetStats()
-	available := total - assigned
+	total, assigned := c.dataStore.GetSharedStats()
+	available := total - assigned - c.pendingPodCount()
 
 	// short is greater than 0 when we have fewer available IPs than the warm IP target
 	short = max(c.warmIPTarget-available, 0)
 
-	// over is the number of available IPs we have beyond the warm IP target
-	over = max(available-c.warmIPTarget, 0)
+	// over is the number of available IPs we have beyond the warm IP target and the surge buffer
+	surgeBuffer := c.surgeBuffer(assigned)
+	over = max(available-c.warmIPTarget-surgeBuffer, 0)
 
-	log.Debugf("Current warm IP stats: target: %d, total: %d, assigned: %d, available: %d, short: %d, over %d", c.warmIPTarget, total, assigned, available, short, over)
+	log.Debugf("Current warm IP stats: target: %d, surge buffer: %d, total: %d, assigned: %d, available: %d, short: %d, over %d", c.warmIPTarget, surgeBuffer, total, assigned, available, short, over)
 	return short, over, true
 }
 
+// pendingPodCount returns the number of local pods still waiting for an IP if pre-warming is enabled, otherwise 0. The
+// pods that already got an IP, but whose status does not show it yet, are counted as assigned rather than pending.
+func (c *IPAMContext) pendingPodCount() int {
+	if !c.prewarmPendingPods {
+		return 0
+	}
+	pending := 0
+	for _, pod := range c.k8sClient.K8SGetPendingPods() {
+		if !c.dataStore.HasPod(pod.Namespace, pod.Name) {
+			pending++
+		}
+	}
+	if pending > 0 {
+		log.Debugf("Reserving warm pool capacity for %d pending pods", pending)
+	}
+	return pending
+}
+
+// tenantENIsEnabled returns true in multi-tenant mode, or when pods can have an ENI of their own
+func (c *IPAMContext) tenantENIsEnabled() bool {
+	return c.tenantLabel != "" || c.podFlags.allowed[networkutils.PodFlagDedicatedENI]
+}
+
+// noFreeTenantENI returns true if ENIs can be dedicated to tenants and there is no secondary ENI left that a new tenant
+// could use. That ENI is kept when the pool shrinks, and the IPs of the ENIs of tenants are not part of the warm pool.
+func (c *IPAMContext) noFreeTenantENI() bool {
+	return c.tenantENIsEnabled() && c.dataStore.GetFreeENIs() == 0
+}
+
+// getPodTenant returns the tenant of the pods in a namespace, which is the value of its tenant label, or "" if
+// multi-tenant mode is disabled or the namespace has no tenant
+func (c *IPAMContext) getPodTenant(meta *podMetadata) (string, error) {
+	if c.tenantLabel == "" {
+		return "", nil
+	}
+	labels, err := meta.getNamespaceLabels()
+	if err != nil {
+		return "", err
+	}
+	return labels[c.tenantLabel], nil
+}
+
+func prewarmPendingPodsEnabled() bool {
+	if strValue := os.Getenv(envPrewarmPendingPods); strValue != "" {
+		parsedValue, err := strconv.ParseBool(strValue)
+		if err == nil {
+			return parsedValue
+		}
+		log.Error("Failed to parse "+envPrewarmPendingPods+"; using default: false", err.Error())
+	}
+	return false
+}
+
+func fastStartEnabled() bool {
+	return getEnvBoolWithDefault(envFastStart, false)
+}
+
 // setTerminating atomically sets the terminating flag.
 func (c *IPAMContext) setTerminating() {
 	atomic.StoreInt32(&c.terminating, 1)
@@ -1074,11 +1638,88 @@ func (c *IPAMContext) isTerminating() bool {
 
 // GetConfigForDebug returns the active values of the configuration env vars (for debugging purposes).
 func GetConfigForDebug() map[string]interface{} {
-	return map[string]interface{}{
-		envWarmIPTarget:     getWarmIPTarget(),
-		envWarmENITarget:    getWarmENITarget(),
-		envCustomNetworkCfg: UseCustomNetworkCfg(),
+	config := map[string]interface{}{
+		envWarmIPTarget:               getWarmIPTarget(),
+		envWarmENITarget:              getWarmENITarget(),
+		envCustomNetworkCfg:           UseCustomNetworkCfg(),
+		envPrewarmPendingPods:         prewarmPendingPodsEnabled(),
+		envFastStart:                  fastStartEnabled(),
+		envMinENILifetime:             getMinENILifetime().String(),
+		envScaleDownCooldown:          getScaleDownCooldown().String(),
+		envScaleDownSurgeBuffer:       getScaleDownSurgeBuffer(),
+		envMemoryWatermark:            getMemoryWatermark(),
+		envGoroutineWatermark:         getGoroutineWatermark(),
+		envDiagnosticsAddFailures:     getDiagnosticsAddFailures(),
+		envDiagnosticsDir:             getDiagnosticsDir(),
+		envNodeProfiles:               nodeProfile,
+		envNetworkStateImport:         networkStateImportEnabled(),
+		envExternalIPAMAddress:        getExternalIPAMAddress(),
+		envExternalIPAMTimeout:        getExternalIPAMTimeout().String(),
+		envGRPCReflection:             grpcReflectionEnabled(),
+		envStartupTimeout:             getStartupTimeout().String(),
+		envAPIServerOptional:          APIServerOptional(),
+		envCheckpointPath:             getCheckpointPath(),
+		envReducedPermissions:         reducedPermissionsEnabled(),
+		envEgressEIPPool:              os.Getenv(envEgressEIPPool),
+		envFastPathLeases:             getFastPathLeases(),
+		envSRIOV:                      sriovEnabled(),
+		envNUMAAware:                  numaAwareEnabled(),
+		envPrefixDelegation:           prefixDelegationEnabled(),
+		envPrefetchCache:              getPrefetchCachePath(),
+		envEarlyAdd:                   earlyAddEnabled(),
+		envErrorBudgetMismatches:      getNonNegativeIntEnvVar(envErrorBudgetMismatches, 0),
+		envErrorBudgetNetlinkFailures: getNonNegativeIntEnvVar(envErrorBudgetNetlinkFailures, 0),
+		envNodeShutdownTeardown:       nodeShutdownTeardownEnabled(),
+		envNodeShutdownTimeout:        getNodeShutdownTimeout().String(),
+		envIPFamilyPreference:         getIPFamilyPreference(),
+		envNodeInventory:              nodeInventoryEnabled(),
+		envNodeInventoryInterval:      getNodeInventoryInterval().String(),
+		envWarmBranchENITarget:        getWarmBranchENITarget(),
+		envMaxBranchENI:               getNonNegativeIntEnvVar(envMaxBranchENI, 0),
+		envVethSweeper:                vethSweeperEnabled(),
+	}
+	for _, name := range []string{envWarmIPTarget, envWarmENITarget} {
+		if _, ok := getWarmTargetPercent(name); ok {
+			config[name] = os.Getenv(name)
+		}
+	}
+	for name, value := range bgp.GetConfigForDebug() {
+		config[name] = value
+	}
+	for name, value := range ipamevents.GetConfigForDebug() {
+		config[name] = value
+	}
+	for name, value := range getResourceMetricsConfigForDebug() {
+		config[name] = value
+	}
+	for name, value := range getAuditConfigForDebug() {
+		config[name] = value
+	}
+	for name, value := range podipexport.GetConfigForDebug() {
+		config[name] = value
+	}
+	for name, value := range datastore.GetConfigForDebug() {
+		config[name] = value
+	}
+	for name, value := range clusterconfig.GetConfigForDebug() {
+		config[name] = value
+	}
+	for name, value := range awsutils.GetConfigForDebug() {
+		config[name] = value
+	}
+	for name, value := range ec2wrapper.GetConfigForDebug() {
+		config[name] = value
+	}
+	for name, value := range retry.GetConfigForDebug() {
+		config[name] = value
+	}
+	for name, value := range k8sapi.GetConfigForDebug() {
+		config[name] = value
+	}
+	for name, value := range eniconfig.GetConfigForDebug() {
+		config[name] = value
 	}
+	return config
 }
 
 func max(x, y int) int {
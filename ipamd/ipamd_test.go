@@ -14,11 +14,21 @@
 package ipamd
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/vishvananda/netlink"
 
 	"github.com/aws/amazon-vpc-cni-k8s/ipamd/datastore"
@@ -26,11 +36,15 @@ import (
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/awsutils"
 	mock_awsutils "github.com/aws/amazon-vpc-cni-k8s/pkg/awsutils/mocks"
 	mock_eniconfig "github.com/aws/amazon-vpc-cni-k8s/pkg/eniconfig/mocks"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/fastpath"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
 	mock_k8sapi "github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi/mocks"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/networkutils"
 	mock_networkutils "github.com/aws/amazon-vpc-cni-k8s/pkg/networkutils/mocks"
 
 	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -49,11 +63,19 @@ const (
 	ipaddr01         = "10.10.10.11"
 	ipaddr02         = "10.10.10.12"
 	ipaddr03         = "10.10.10.13"
+	ipv6addr01       = "2001:db8::11"
+	ipv6addr02       = "2001:db8::12"
 	ipaddr11         = "10.10.20.11"
 	ipaddr12         = "10.10.20.12"
 	vpcCIDR          = "10.10.0.0/16"
 )
 
+var (
+	primarySubnetCIDR = netip.MustParsePrefix(primarySubnet)
+	secSubnetCIDR     = netip.MustParsePrefix(secSubnet)
+	vpcCIDRPrefix     = netip.MustParsePrefix(vpcCIDR)
+)
+
 func setup(t *testing.T) (*gomock.Controller,
 	*mock_awsutils.MockAPIs,
 	*mock_k8sapi.MockK8SAPIs,
@@ -68,6 +90,17 @@ func setup(t *testing.T) (*gomock.Controller,
 }
 
 func TestNodeInit(t *testing.T) {
+	_ = os.Unsetenv(envFastStart)
+	testNodeInit(t, false)
+}
+
+func TestNodeInitFastStart(t *testing.T) {
+	_ = os.Setenv(envFastStart, "true")
+	defer os.Unsetenv(envFastStart)
+	testNodeInit(t, true)
+}
+
+func testNodeInit(t *testing.T, fastStart bool) {
 	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
 	defer ctrl.Finish()
 
@@ -86,7 +119,7 @@ func TestNodeInit(t *testing.T) {
 		ENIID:          primaryENIid,
 		MAC:            primaryMAC,
 		DeviceNumber:   primaryDevice,
-		SubnetIPv4CIDR: primarySubnet,
+		SubnetIPv4CIDR: primarySubnetCIDR,
 		LocalIPv4s:     []string{ipaddr01, ipaddr02},
 	}
 
@@ -94,20 +127,21 @@ func TestNodeInit(t *testing.T) {
 		ENIID:          secENIid,
 		MAC:            secMAC,
 		DeviceNumber:   secDevice,
-		SubnetIPv4CIDR: secSubnet,
+		SubnetIPv4CIDR: secSubnetCIDR,
 		LocalIPv4s:     []string{ipaddr11, ipaddr12},
 	}
-	var cidrs []*string
+	var cidrs []netip.Prefix
 	mockAWS.EXPECT().GetENILimit().Return(4, nil)
 	mockAWS.EXPECT().GetENIipLimit().Return(14, nil)
 	mockAWS.EXPECT().GetAttachedENIs().Return([]awsutils.ENIMetadata{eni1, eni2}, nil)
-	mockAWS.EXPECT().GetVPCIPv4CIDR().Return(vpcCIDR)
+	mockAWS.EXPECT().GetVPCIPv4CIDR().Return(vpcCIDRPrefix)
 
-	_, vpcCIDR, _ := net.ParseCIDR(vpcCIDR)
-	primaryIP := net.ParseIP(ipaddr01)
 	mockAWS.EXPECT().GetVPCIPv4CIDRs().Return(cidrs)
 	mockAWS.EXPECT().GetPrimaryENImac().Return("")
-	mockNetwork.EXPECT().SetupHostNetwork(vpcCIDR, cidrs, "", &primaryIP).Return(nil)
+	mockNetwork.EXPECT().SnapshotHostNetwork().Return(&networkutils.HostNetworkSnapshot{}, nil)
+	mockNetwork.EXPECT().SetupHostNetwork(vpcCIDRPrefix, cidrs, "", netip.MustParseAddr(ipaddr01)).Return(nil)
+	mockNetwork.EXPECT().VerifyHostNetwork().Return(nil)
+	mockK8S.EXPECT().K8SSetNodeCondition(hostNetworkSetupFailedCondition, false, hostNetworkSetUpReason, gomock.Any())
 
 	//primaryENIid
 	mockAWS.EXPECT().GetPrimaryENI().Return(primaryENIid)
@@ -136,11 +170,16 @@ func TestNodeInit(t *testing.T) {
 			PrivateIpAddress: &testAddr12, Primary: &notPrimary}}
 	mockAWS.EXPECT().GetPrimaryENI().Return(primaryENIid)
 	mockAWS.EXPECT().DescribeENI(secENIid).Return(eniResp, &attachmentID, nil)
-	mockNetwork.EXPECT().SetupENINetwork(gomock.Any(), secMAC, secDevice, secSubnet)
-
-	mockAWS.EXPECT().GetLocalIPv4().Return(ipaddr01)
-	mockK8S.EXPECT().K8SGetLocalPodIPs().Return([]*k8sapi.K8SPodInfo{{Name: "pod1",
-		Namespace: "default", UID: "pod-uid", Container: "container-uid", IP: ipaddr02}}, nil)
+	mockNetwork.EXPECT().SetupENINetwork(gomock.Any(), secMAC, secDevice, secSubnetCIDR)
+
+	mockAWS.EXPECT().GetLocalIPv4().Return(netip.MustParseAddr(ipaddr01))
+	localPods := []*k8sapi.K8SPodInfo{{Name: "pod1",
+		Namespace: "default", UID: "pod-uid", Container: "container-uid", IP: ipaddr02}}
+	if fastStart {
+		// Without any pod rule, a pod still waiting for an IP does not make ipamd retry
+		localPods = append(localPods, &k8sapi.K8SPodInfo{Name: "coredns", Namespace: "kube-system", UID: "coredns-uid"})
+	}
+	mockK8S.EXPECT().K8SGetLocalPodIPs().Return(localPods, nil).Times(1)
 
 	var rules []netlink.Rule
 	mockNetwork.EXPECT().GetRuleList().Return(rules, nil)
@@ -156,6 +195,25 @@ func TestNodeInit(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestGetLocalPodsWithRetryNoWait(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+	}
+
+	// A pod without an IP is returned right away, without retrying
+	pods := []*k8sapi.K8SPodInfo{{Name: "coredns", Namespace: "kube-system", UID: "pod-uid"}}
+	mockK8S.EXPECT().K8SGetLocalPodIPs().Return(pods, nil).Times(1)
+
+	localPods, err := mockContext.getLocalPodsWithRetry(false)
+	assert.NoError(t, err)
+	assert.Equal(t, pods, localPods)
+}
+
 func TestIncreaseIPPoolDefault(t *testing.T) {
 	_ = os.Unsetenv(envCustomNetworkCfg)
 	testIncreaseIPPool(t, false)
@@ -214,19 +272,20 @@ func testIncreaseIPPool(t *testing.T, useENIConfig bool) {
 			ENIID:          primaryENIid,
 			MAC:            primaryMAC,
 			DeviceNumber:   primaryDevice,
-			SubnetIPv4CIDR: primarySubnet,
+			SubnetIPv4CIDR: primarySubnetCIDR,
 			LocalIPv4s:     []string{ipaddr01, ipaddr02},
 		},
 		{
 			ENIID:          secENIid,
 			MAC:            secMAC,
 			DeviceNumber:   secDevice,
-			SubnetIPv4CIDR: secSubnet,
+			SubnetIPv4CIDR: secSubnetCIDR,
 			LocalIPv4s:     []string{ipaddr11, ipaddr12}},
 	}, nil)
 
+	mockNetwork.EXPECT().GetRouteTableIDs().Return(nil, nil)
 	mockAWS.EXPECT().GetPrimaryENI().Return(primaryENIid)
-	mockNetwork.EXPECT().SetupENINetwork(gomock.Any(), secMAC, secDevice, secSubnet)
+	mockNetwork.EXPECT().SetupENINetwork(gomock.Any(), secMAC, secDevice, secSubnetCIDR)
 
 	mockAWS.EXPECT().AllocIPAddresses(eni2, 14)
 	mockAWS.EXPECT().GetPrimaryENI().Return(primaryENIid)
@@ -242,6 +301,610 @@ func testIncreaseIPPool(t *testing.T, useENIConfig bool) {
 	mockContext.increaseIPPool()
 }
 
+func TestIncreaseIPPoolDegraded(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		maxIPsPerENI:  14,
+		maxENI:        4,
+		warmENITarget: 1,
+		networkClient: mockNetwork,
+		dataStore:     datastore.NewDataStore(),
+	}
+
+	// Running out of addresses in the subnet puts ipamd in degraded mode
+	subnetErr := awserr.New("InsufficientFreeAddressesInSubnet", "no free address", nil)
+	mockAWS.EXPECT().AllocENI(false, nil, "").Return("", subnetErr)
+	mockK8S.EXPECT().K8SEmitNodeEvent("Warning", degradedReasonSubnetExhausted, gomock.Any())
+	mockContext.increaseIPPool()
+	assert.True(t, mockContext.inDegradedBackoff())
+	assert.Equal(t, degradedReasonSubnetExhausted, mockContext.getDegradedInfo().Reason)
+
+	// No EC2 call is made until the backoff expires
+	mockContext.increaseIPPool()
+
+	// Further failures extend the backoff without recording another event
+	mockContext.degraded.retryAfter = time.Now()
+	mockAWS.EXPECT().AllocENI(false, nil, "").Return("", subnetErr)
+	mockContext.increaseIPPool()
+	info := mockContext.getDegradedInfo()
+	assert.Equal(t, 2, info.Failures)
+	assert.True(t, info.RetryAfter.After(time.Now().Add(degradedMinBackoff)))
+
+	// Other errors do not change the degraded mode
+	assert.False(t, mockContext.recordPoolError(errors.New("dummy error")))
+
+	mockK8S.EXPECT().K8SEmitNodeEvent("Normal", degradedReasonRecovered, gomock.Any())
+	mockContext.recordPoolSuccess()
+	assert.False(t, mockContext.inDegradedBackoff())
+	assert.False(t, mockContext.getDegradedInfo().Degraded)
+}
+
+func TestReportSNATCheck(t *testing.T) {
+	ctrl, _, mockK8S, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{k8sClient: mockK8S}
+
+	// The first check always sets the condition
+	mockK8S.EXPECT().K8SSetNodeCondition(snatBypassedCondition, false, snatInPlaceReason, gomock.Any())
+	mockContext.reportSNATCheck(networkutils.SNATRulesCheck{}, false, false)
+
+	// Only changes are reported afterwards
+	mockContext.reportSNATCheck(networkutils.SNATRulesCheck{}, true, false)
+
+	bypassed := networkutils.SNATRulesCheck{Problems: []string{"the jump to the AWS SNAT chain is missing from nat POSTROUTING"}}
+	mockK8S.EXPECT().K8SEmitNodeEvent("Warning", snatBypassedReason, gomock.Any())
+	mockK8S.EXPECT().K8SSetNodeCondition(snatBypassedCondition, true, snatBypassedReason, gomock.Any())
+	mockContext.reportSNATCheck(bypassed, true, false)
+	mockContext.reportSNATCheck(bypassed, true, true)
+
+	bypassed.Repaired = true
+	mockK8S.EXPECT().K8SEmitNodeEvent("Warning", snatRepairedReason, gomock.Any())
+	mockK8S.EXPECT().K8SSetNodeCondition(snatBypassedCondition, false, snatInPlaceReason, gomock.Any())
+	mockContext.reportSNATCheck(bypassed, true, true)
+}
+
+func TestReportKubeProxyCheck(t *testing.T) {
+	ctrl, _, mockK8S, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{k8sClient: mockK8S}
+
+	// Adjustments are only logged
+	mockContext.reportKubeProxyCheck(networkutils.KubeProxyCheck{
+		Mode:        networkutils.KubeProxyModeIPVS,
+		Reported:    true,
+		Adjustments: []string{"set net/ipv4/vs/conntrack to 1"},
+	})
+
+	mockK8S.EXPECT().K8SEmitNodeEvent("Warning", kubeProxyMismatchReason, gomock.Any())
+	mockContext.reportKubeProxyCheck(networkutils.KubeProxyCheck{
+		Mode:     networkutils.KubeProxyModeIptables,
+		Problems: []string{"kube-ipvs0 was left by the IPVS mode of kube-proxy"},
+	})
+}
+
+func TestStartKubeProxyCheck(t *testing.T) {
+	ctrl, _, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{k8sClient: mockK8S, networkClient: mockNetwork}
+	mockNetwork.EXPECT().CheckKubeProxy().Return(networkutils.KubeProxyCheck{Mode: networkutils.KubeProxyModeIPVS,
+		Reported: true}, nil)
+	mockContext.StartKubeProxyCheck()
+}
+
+func TestReportMarkCheck(t *testing.T) {
+	ctrl, _, mockK8S, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{k8sClient: mockK8S}
+	problems := []string{"mangle ztunnel-PREROUTING rule uses the marks 0x80 of the host rules"}
+
+	// An event is only recorded when the conflicts change
+	mockContext.reportMarkCheck(nil, nil)
+	mockK8S.EXPECT().K8SEmitNodeEvent("Warning", markConflictReason, gomock.Any())
+	mockContext.reportMarkCheck(problems, nil)
+	mockContext.reportMarkCheck(problems, problems)
+	mockContext.reportMarkCheck(nil, problems)
+}
+
+func TestPublishNodeInventory(t *testing.T) {
+	ctrl, _, mockK8S, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, 0, true)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr01)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr02)
+	mockContext := &IPAMContext{k8sClient: mockK8S, dataStore: ds, maxENI: 4}
+
+	inventory := map[string]string{
+		NodeENIsAnnotation:        "1",
+		NodeMaxENIsAnnotation:     "4",
+		NodeTotalIPsAnnotation:    "2",
+		NodeAssignedIPsAnnotation: "0",
+		NodeFreeIPsAnnotation:     "2",
+	}
+	// A failed update is tried again
+	mockK8S.EXPECT().K8SSetNodeAnnotations(inventory).Return(errors.New("forbidden"))
+	published := mockContext.publishNodeInventory(nil)
+	assert.Nil(t, published)
+	mockK8S.EXPECT().K8SSetNodeAnnotations(inventory).Return(nil)
+	published = mockContext.publishNodeInventory(published)
+	assert.Equal(t, inventory, published)
+
+	// The node is only patched when the inventory changed
+	published = mockContext.publishNodeInventory(published)
+	_, _, err := ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod", Namespace: "ns"})
+	assert.NoError(t, err)
+	inventory[NodeAssignedIPsAnnotation] = "1"
+	inventory[NodeFreeIPsAnnotation] = "1"
+	mockK8S.EXPECT().K8SSetNodeAnnotations(inventory).Return(nil)
+	published = mockContext.publishNodeInventory(published)
+	assert.Equal(t, inventory, published)
+}
+
+func TestReportDrops(t *testing.T) {
+	ctrl, _, mockK8S, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{k8sClient: mockK8S}
+	state := &dropMonitorState{lastEvents: make(map[string]time.Time)}
+	now := time.Now()
+
+	// Nothing was dropped
+	mockContext.reportDrops(map[string]uint64{networkutils.DropReasonRPFilter: 0, networkutils.DropReasonInvalidState: 0},
+		state, now)
+
+	mockK8S.EXPECT().K8SEmitNodeEvent("Warning", packetsDroppedReason, gomock.Any()).Do(
+		func(_, _, message string) {
+			assert.Contains(t, message, "3 packets")
+			assert.Contains(t, message, networkutils.DropReasonInvalidState)
+		})
+	mockContext.reportDrops(map[string]uint64{networkutils.DropReasonRPFilter: 0, networkutils.DropReasonInvalidState: 3},
+		state, now)
+
+	// The events of a reason are rate-limited
+	mockContext.reportDrops(map[string]uint64{networkutils.DropReasonRPFilter: 0, networkutils.DropReasonInvalidState: 5},
+		state, now.Add(time.Minute))
+
+	// Counters that went down were reset
+	mockK8S.EXPECT().K8SEmitNodeEvent("Warning", packetsDroppedReason, gomock.Any()).Do(
+		func(_, _, message string) {
+			assert.Contains(t, message, "2 packets")
+		})
+	mockContext.reportDrops(map[string]uint64{networkutils.DropReasonRPFilter: 0, networkutils.DropReasonInvalidState: 2},
+		state, now.Add(dropEventInterval+time.Minute))
+}
+
+func TestCgroupMemory(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	_, _, err = cgroupMemory(root)
+	assert.Error(t, err)
+
+	// cgroup v1
+	assert.NoError(t, os.Mkdir(filepath.Join(root, "memory"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "memory", "memory.limit_in_bytes"), []byte("9223372036854771712\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "memory", "memory.usage_in_bytes"), []byte("1000\n"), 0644))
+	usage, limit, err := cgroupMemory(root)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1000), usage)
+	assert.Equal(t, uint64(0), limit)
+	// No limit with 64KiB pages, as on some arm64 kernels
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "memory", "memory.limit_in_bytes"), []byte("9223372036854710272\n"), 0644))
+	_, limit, err = cgroupMemory(root)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), limit)
+
+	// cgroup v2 takes precedence
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "memory.max"), []byte("max\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "memory.current"), []byte("2000\n"), 0644))
+	usage, limit, err = cgroupMemory(root)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2000), usage)
+	assert.Equal(t, uint64(0), limit)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "memory.max"), []byte("4000\n"), 0644))
+	usage, limit, err = cgroupMemory(root)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2000), usage)
+	assert.Equal(t, uint64(4000), limit)
+}
+
+func TestResourceMonitorCheck(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	defer debug.SetGCPercent(defaultGCPercent)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "memory.max"), []byte("1000"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "memory.current"), []byte("700"), 0644))
+	// Off by default, the usage is only reported
+	m := &resourceMonitor{cgroupRoot: root}
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "memory.current"), []byte("900"), 0644))
+	m.check()
+	assert.False(t, m.collecting)
+
+	m.memoryWatermark = 80
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "memory.current"), []byte("700"), 0644))
+	m.check()
+	assert.False(t, m.collecting)
+
+	// Above 80% of the limit
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "memory.current"), []byte("900"), 0644))
+	m.check()
+	assert.True(t, m.collecting)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "memory.current"), []byte("700"), 0644))
+	m.check()
+	assert.False(t, m.collecting)
+
+	// Too many goroutines are only reported
+	m.goroutineWatermark = 1
+	m.check()
+	assert.False(t, m.collecting)
+}
+
+func TestRecordAddResult(t *testing.T) {
+	mockContext := &IPAMContext{diagnostics: diagnosticsState{addFailures: 2}}
+
+	assert.False(t, mockContext.recordAddResult(errors.New("no IP")))
+	// Successes reset the count
+	assert.False(t, mockContext.recordAddResult(nil))
+	assert.False(t, mockContext.recordAddResult(errors.New("no IP")))
+	assert.True(t, mockContext.recordAddResult(errors.New("no IP")))
+	// No new snapshot until the cooldown is over
+	assert.False(t, mockContext.recordAddResult(errors.New("no IP")))
+
+	mockContext.diagnostics.lastCapture = time.Now().Add(-diagnosticsCooldown)
+	assert.True(t, mockContext.recordAddResult(errors.New("no IP")))
+
+	mockContext.diagnostics.addFailures = 0
+	mockContext.diagnostics.lastCapture = time.Time{}
+	assert.False(t, mockContext.recordAddResult(errors.New("no IP")))
+}
+
+func TestCaptureDiagnostics(t *testing.T) {
+	ctrl, _, mockK8S, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	dir, err := ioutil.TempDir("", "diagnostics")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for i := 0; i < maxDiagnosticsFiles; i++ {
+		old := filepath.Join(dir, fmt.Sprintf("%s2000010%dT000000Z.txt", diagnosticsFilePrefix, i+1))
+		assert.NoError(t, ioutil.WriteFile(old, nil, 0644))
+	}
+
+	mockContext := &IPAMContext{
+		k8sClient: mockK8S,
+		dataStore: datastore.NewDataStore(),
+		diagnostics: diagnosticsState{
+			addFailures: 1,
+			dir:         dir,
+			runCommand: func(ctx context.Context, name string, args ...string) ([]byte, error) {
+				if name == "iptables-save" {
+					return nil, errors.New("not found")
+				}
+				return []byte(strings.Repeat("x", maxDiagnosticsSectionBytes+1)), nil
+			},
+		},
+	}
+	mockContext.recordRecentError(errors.New("InsufficientFreeAddressesInSubnet"))
+	assert.True(t, mockContext.recordAddResult(errors.New("no IP")))
+
+	mockK8S.EXPECT().K8SEmitNodeEvent("Warning", diagnosticsCapturedReason, gomock.Any())
+	mockContext.captureDiagnostics(errors.New("no IP"))
+
+	paths, err := filepath.Glob(filepath.Join(dir, diagnosticsFilePrefix+"*"))
+	assert.NoError(t, err)
+	assert.Equal(t, maxDiagnosticsFiles, len(paths))
+	// The oldest snapshot was deleted
+	assert.NotContains(t, paths, filepath.Join(dir, diagnosticsFilePrefix+"20000101T000000Z.txt"))
+
+	snapshot, err := ioutil.ReadFile(paths[len(paths)-1])
+	assert.NoError(t, err)
+	assert.Contains(t, string(snapshot), "Last error: no IP")
+	assert.Contains(t, string(snapshot), "===== ip rule show =====")
+	assert.Contains(t, string(snapshot), "[truncated]")
+	assert.Contains(t, string(snapshot), "failed: not found")
+	assert.Contains(t, string(snapshot), "InsufficientFreeAddressesInSubnet")
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ds := datastore.NewDataStore()
+	assert.NoError(t, ds.AddENI(primaryENIid, 0, true))
+	assert.NoError(t, ds.AddIPv4AddressFromStore(primaryENIid, ipaddr01))
+	assert.NoError(t, ds.AddENI(secENIid, 1, false))
+	assert.NoError(t, ds.AddIPv4AddressFromStore(secENIid, ipaddr11))
+	// The tenant pod claims the secondary ENI first, so that the other pod gets the IP of the primary ENI
+	_, _, err = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod2", Namespace: "team-a", Container: "c2", Tenant: "a"})
+	assert.NoError(t, err)
+	_, _, err = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod1", Namespace: "default", Container: "c1"})
+	assert.NoError(t, err)
+
+	mockContext := &IPAMContext{
+		dataStore:  ds,
+		checkpoint: checkpointState{path: filepath.Join(dir, "aws-node", "ipam.json")},
+	}
+	// Without a checkpoint, there is nothing to restore only on a fresh node
+	pods, err := mockContext.restoreLocalPods(0)
+	assert.NoError(t, err)
+	assert.Empty(t, pods)
+	_, err = mockContext.restoreLocalPods(1)
+	assert.Error(t, err)
+
+	mockContext.writeCheckpoint()
+	pods, err = mockContext.restoreLocalPods(2)
+	assert.NoError(t, err)
+	assert.Equal(t, []*k8sapi.K8SPodInfo{
+		{Name: "pod1", Namespace: "default", Container: "c1", IP: ipaddr01},
+		{Name: "pod2", Namespace: "team-a", Container: "c2", IP: ipaddr11, Tenant: "a"},
+	}, pods)
+
+	assert.NoError(t, ioutil.WriteFile(mockContext.checkpoint.path, []byte(`{"version":2}`), 0644))
+	_, err = mockContext.restoreLocalPods(2)
+	assert.Error(t, err)
+}
+
+func TestCheckpointBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ipam.json")
+
+	_ = os.Setenv("AWS_VPC_K8S_CNI_DATASTORE_BACKEND", checkpointBackend)
+	defer os.Unsetenv("AWS_VPC_K8S_CNI_DATASTORE_BACKEND")
+	_ = os.Setenv(envCheckpointPath, path)
+	defer os.Unsetenv(envCheckpointPath)
+	store, err := datastore.New()
+	assert.NoError(t, err)
+	s, ok := store.(*checkpointStore)
+	assert.True(t, ok)
+
+	// Every change of the pods is saved
+	assert.NoError(t, s.AddENI(primaryENIid, 0, true))
+	assert.NoError(t, s.AddIPv4AddressFromStore(primaryENIid, ipaddr01))
+	assert.NoError(t, s.AddIPv4AddressFromStore(primaryENIid, ipaddr02))
+	pod1 := &k8sapi.K8SPodInfo{Name: "pod1", Namespace: "default", Container: "c1"}
+	pod2 := &k8sapi.K8SPodInfo{Name: "pod2", Namespace: "default", Container: "c2"}
+	pod1.IP, _, err = s.AssignPodIPv4Address(pod1)
+	assert.NoError(t, err)
+	pod2.IP, _, err = s.AssignPodIPv4Address(pod2)
+	assert.NoError(t, err)
+	pods, err := readCheckpointFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []*k8sapi.K8SPodInfo{pod1, pod2}, pods)
+
+	// After a restart, the saved pods get their IPs back as soon as the IPs are added again, and are kept in the
+	// checkpoint until then
+	s = newCheckpointStore(path)
+	assert.NoError(t, s.AddENI(primaryENIid, 0, true))
+	assert.NoError(t, s.AddIPv4AddressFromStore(primaryENIid, pod1.IP))
+	_, _, err = s.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod3", Namespace: "default", Container: "c3"})
+	assert.Error(t, err)
+	pods, err = readCheckpointFile(path)
+	assert.NoError(t, err)
+	assert.Len(t, pods, 2)
+	assert.NoError(t, s.AddIPv4AddressFromStore(primaryENIid, pod2.IP))
+	assert.Len(t, *s.GetPodInfos(), 2)
+
+	// Once the pods of the node are known, the ones that are gone are released
+	s.forgetStalePods([]*k8sapi.K8SPodInfo{pod1})
+	_, assigned := s.GetStats()
+	assert.Equal(t, 1, assigned)
+	pods, err = readCheckpointFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []*k8sapi.K8SPodInfo{pod1}, pods)
+
+	// ipamd does not write the checkpoint itself on top of the backend
+	mockContext := &IPAMContext{dataStore: s, checkpoint: checkpointState{path: path}}
+	_, _, err = s.DataStore.UnassignPodIPv4Address(pod1)
+	assert.NoError(t, err)
+	mockContext.writeCheckpoint()
+	pods, err = readCheckpointFile(path)
+	assert.NoError(t, err)
+	assert.Len(t, pods, 1)
+}
+
+func TestCheckPermissions(t *testing.T) {
+	ctrl, mockAWS, _, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{awsClient: mockAWS}
+	mockAWS.EXPECT().CheckPermissions(awsutils.Features()).Return(map[string][]string{})
+	assert.NoError(t, mockContext.checkPermissions())
+
+	missing := map[string][]string{
+		awsutils.FeatureENIRelease: {"ec2:DetachNetworkInterface", "ec2:DeleteNetworkInterface"},
+		awsutils.FeatureENITagging: {"ec2:CreateTags"},
+	}
+	mockAWS.EXPECT().CheckPermissions(gomock.Any()).Return(missing)
+	err := mockContext.checkPermissions()
+	assert.EqualError(t, err, "missing IAM permissions: eni-release needs ec2:DetachNetworkInterface, "+
+		"ec2:DeleteNetworkInterface; eni-tagging needs ec2:CreateTags. Grant them to the IAM role of the node, or set "+
+		"AWS_VPC_K8S_CNI_REDUCED_PERMISSIONS=true to run without the features that need them")
+
+	_ = os.Setenv(envReducedPermissions, "true")
+	defer os.Unsetenv(envReducedPermissions)
+	mockAWS.EXPECT().CheckPermissions(gomock.Any()).Return(missing)
+	assert.NoError(t, mockContext.checkPermissions())
+	assert.False(t, mockContext.permissions.noENIAllocation)
+	assert.True(t, mockContext.permissions.noENIRelease)
+
+	// The core permissions are required even with reduced permissions
+	mockAWS.EXPECT().CheckPermissions(gomock.Any()).Return(map[string][]string{
+		awsutils.FeatureCore: {"ec2:DescribeNetworkInterfaces"},
+	})
+	assert.Error(t, mockContext.checkPermissions())
+}
+
+func TestCheckPrimaryIP(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     datastore.NewDataStore(),
+		primaryIP:     map[string]string{primaryENIid: ipaddr01},
+		hostPrimaryIP: netip.MustParseAddr(ipaddr01),
+	}
+	// The new primary IP was a secondary IP handed out to a pod
+	_ = mockContext.dataStore.AddENI(primaryENIid, 0, true)
+	_ = mockContext.dataStore.AddIPv4AddressFromStore(primaryENIid, ipaddr03)
+	pod := &k8sapi.K8SPodInfo{Name: "pod", Namespace: "ns"}
+	_, _, err := mockContext.dataStore.AssignPodIPv4Address(pod)
+	assert.NoError(t, err)
+
+	// Not looked up again before the interval is over
+	mockContext.lastPrimaryIPCheck = time.Now()
+	mockContext.checkPrimaryIP(time.Minute)
+
+	// Nothing to do while the IP does not change
+	mockContext.lastPrimaryIPCheck = time.Time{}
+	mockAWS.EXPECT().RefreshLocalIPv4().Return(netip.MustParseAddr(ipaddr01), nil)
+	mockContext.checkPrimaryIP(time.Minute)
+
+	// The host network is set up again for the new IP, and retried if that fails
+	newIP := netip.MustParseAddr(ipaddr03)
+	mockContext.lastPrimaryIPCheck = time.Time{}
+	mockAWS.EXPECT().RefreshLocalIPv4().Return(newIP, nil)
+	mockAWS.EXPECT().GetVPCIPv4CIDR().Return(vpcCIDRPrefix)
+	mockAWS.EXPECT().GetVPCIPv4CIDRs().Return(nil)
+	mockAWS.EXPECT().GetPrimaryENImac().Return(primaryMAC)
+	snapshot := &networkutils.HostNetworkSnapshot{}
+	mockNetwork.EXPECT().SnapshotHostNetwork().Return(snapshot, nil)
+	mockNetwork.EXPECT().SetupHostNetwork(vpcCIDRPrefix, nil, primaryMAC, newIP).Return(errors.New("iptables failed"))
+	mockNetwork.EXPECT().RestoreHostNetwork(snapshot).Return(nil)
+	mockK8S.EXPECT().K8SEmitNodeEvent("Warning", hostNetworkRolledBackReason, gomock.Any())
+	mockK8S.EXPECT().K8SSetNodeCondition(hostNetworkSetupFailedCondition, true, hostNetworkRolledBackReason, gomock.Any())
+	mockContext.checkPrimaryIP(time.Minute)
+	assert.Equal(t, netip.MustParseAddr(ipaddr01), mockContext.hostPrimaryIP)
+
+	mockContext.lastPrimaryIPCheck = time.Time{}
+	mockAWS.EXPECT().RefreshLocalIPv4().Return(newIP, nil)
+	mockAWS.EXPECT().GetVPCIPv4CIDR().Return(vpcCIDRPrefix)
+	mockAWS.EXPECT().GetVPCIPv4CIDRs().Return(nil)
+	mockAWS.EXPECT().GetPrimaryENImac().Return(primaryMAC)
+	mockNetwork.EXPECT().SnapshotHostNetwork().Return(snapshot, nil)
+	mockNetwork.EXPECT().SetupHostNetwork(vpcCIDRPrefix, nil, primaryMAC, newIP).Return(nil)
+	mockNetwork.EXPECT().VerifyHostNetwork().Return(nil)
+	mockK8S.EXPECT().K8SSetNodeCondition(hostNetworkSetupFailedCondition, false, hostNetworkSetUpReason, gomock.Any())
+	mockNetwork.EXPECT().ReplaceRouteSrc(netip.MustParseAddr(ipaddr01), newIP).Return(nil)
+	mockAWS.EXPECT().GetPrimaryENI().Return(primaryENIid)
+	mockK8S.EXPECT().K8SEmitPodEvent("ns", "pod", "Warning", podIPRevokedReason, gomock.Any())
+	mockK8S.EXPECT().K8SEmitNodeEvent("Normal", primaryIPChangedReason, gomock.Any())
+	mockContext.checkPrimaryIP(time.Minute)
+	assert.Equal(t, newIP, mockContext.hostPrimaryIP)
+	assert.Equal(t, ipaddr03, mockContext.primaryIP[primaryENIid])
+	total, assigned := mockContext.dataStore.GetStats()
+	assert.Equal(t, 0, total)
+	assert.Equal(t, 0, assigned)
+}
+
+func TestSetupHostNetworkRollback(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+	}
+	primaryIP := netip.MustParseAddr(ipaddr01)
+	expectSetup := func() {
+		mockAWS.EXPECT().GetVPCIPv4CIDR().Return(vpcCIDRPrefix)
+		mockAWS.EXPECT().GetVPCIPv4CIDRs().Return(nil)
+		mockAWS.EXPECT().GetPrimaryENImac().Return(primaryMAC)
+		mockNetwork.EXPECT().SetupHostNetwork(vpcCIDRPrefix, nil, primaryMAC, primaryIP).Return(nil)
+	}
+
+	// A failed self-test is rolled back too
+	snapshot := &networkutils.HostNetworkSnapshot{}
+	mockNetwork.EXPECT().SnapshotHostNetwork().Return(snapshot, nil)
+	expectSetup()
+	mockNetwork.EXPECT().VerifyHostNetwork().Return(errors.New("chain AWS-SNAT-CHAIN-0 is missing"))
+	mockNetwork.EXPECT().RestoreHostNetwork(snapshot).Return(nil)
+	mockK8S.EXPECT().K8SEmitNodeEvent("Warning", hostNetworkRolledBackReason, gomock.Any())
+	mockK8S.EXPECT().K8SSetNodeCondition(hostNetworkSetupFailedCondition, true, hostNetworkRolledBackReason, gomock.Any())
+	assert.Error(t, mockContext.setupHostNetwork(primaryIP))
+
+	// Without a snapshot, nothing can be rolled back
+	mockNetwork.EXPECT().SnapshotHostNetwork().Return(nil, errors.New("netlink failed"))
+	expectSetup()
+	mockNetwork.EXPECT().VerifyHostNetwork().Return(errors.New("chain AWS-SNAT-CHAIN-0 is missing"))
+	mockK8S.EXPECT().K8SEmitNodeEvent("Warning", hostNetworkRollbackFailedReason, gomock.Any())
+	mockK8S.EXPECT().K8SSetNodeCondition(hostNetworkSetupFailedCondition, true, hostNetworkRollbackFailedReason, gomock.Any())
+	assert.Error(t, mockContext.setupHostNetwork(primaryIP))
+
+	// The condition is cleared once, by the next successful setup
+	for i := 0; i < 2; i++ {
+		mockNetwork.EXPECT().SnapshotHostNetwork().Return(snapshot, nil)
+		expectSetup()
+		mockNetwork.EXPECT().VerifyHostNetwork().Return(nil)
+	}
+	mockK8S.EXPECT().K8SSetNodeCondition(hostNetworkSetupFailedCondition, false, hostNetworkSetUpReason, gomock.Any())
+	assert.NoError(t, mockContext.setupHostNetwork(primaryIP))
+	assert.NoError(t, mockContext.setupHostNetwork(primaryIP))
+}
+
+func TestImportNetworkState(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     datastore.NewDataStore(),
+	}
+	_ = mockContext.dataStore.AddENI(primaryENIid, primaryDevice, true)
+	_ = mockContext.dataStore.AddIPv4AddressFromStore(primaryENIid, ipaddr01)
+	_ = mockContext.dataStore.AddIPv4AddressFromStore(primaryENIid, ipaddr03)
+
+	network := &networkutils.NetworkState{Rules: []networkutils.StateRule{{Priority: 1536, Table: 2}}}
+	placeholder := fastPathLeaseName + "_" + fastPathLeaseNamespace + "_lease1"
+	pods := map[string]datastore.PodIPInfo{
+		"pod1_default_abc": {IP: ipaddr01},
+		"pod2_default_def": {IP: ipaddr02},
+		// The placeholders of the leases of the fast path are not imported
+		placeholder: {IP: ipaddr03},
+	}
+	mockNetwork.EXPECT().ImportNetworkState(network).Return(&networkutils.NetworkStateImport{Rules: 1}, nil)
+	result, err := mockContext.importNetworkState(&NodeNetworkState{Network: network, Pods: &pods})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Network.Rules)
+	assert.Equal(t, 1, result.Pods)
+	assert.Equal(t, []string{"pod2_default_def"}, result.Skipped)
+	_, assigned := mockContext.dataStore.GetStats()
+	assert.Equal(t, 1, assigned)
+
+	// Nor exported
+	_, _, err = mockContext.dataStore.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: fastPathLeaseName,
+		Namespace: fastPathLeaseNamespace, Container: "lease1"})
+	assert.NoError(t, err)
+	mockNetwork.EXPECT().ExportNetworkState().Return(network, nil)
+	state, err := mockContext.exportNetworkState()
+	assert.NoError(t, err)
+	assert.Equal(t, network, state.Network)
+	assert.Equal(t, map[string]datastore.PodIPInfo{"pod1_default_abc": {IP: ipaddr01, DeviceNumber: primaryDevice}},
+		*state.Pods)
+}
+
 func TestTryAddIPToENI(t *testing.T) {
 	_ = os.Unsetenv(envCustomNetworkCfg)
 	ctrl, mockAWS, mockK8S, mockNetwork, mockENIConfig := setup(t)
@@ -279,18 +942,19 @@ func TestTryAddIPToENI(t *testing.T) {
 			ENIID:          primaryENIid,
 			MAC:            primaryMAC,
 			DeviceNumber:   primaryDevice,
-			SubnetIPv4CIDR: primarySubnet,
+			SubnetIPv4CIDR: primarySubnetCIDR,
 			LocalIPv4s:     []string{ipaddr01, ipaddr02},
 		},
 		{
 			ENIID:          secENIid,
 			MAC:            secMAC,
 			DeviceNumber:   secDevice,
-			SubnetIPv4CIDR: secSubnet,
+			SubnetIPv4CIDR: secSubnetCIDR,
 			LocalIPv4s:     []string{ipaddr11, ipaddr12}},
 	}, nil)
+	mockNetwork.EXPECT().GetRouteTableIDs().Return(nil, nil)
 	mockAWS.EXPECT().GetPrimaryENI().Return(primaryENIid)
-	mockNetwork.EXPECT().SetupENINetwork(gomock.Any(), secMAC, secDevice, secSubnet)
+	mockNetwork.EXPECT().SetupENINetwork(gomock.Any(), secMAC, secDevice, secSubnetCIDR)
 	primary := true
 	notPrimary := false
 	attachmentID := testAttachmentID
@@ -327,7 +991,7 @@ func TestNodeIPPoolReconcile(t *testing.T) {
 			ENIID:          primaryENIid,
 			MAC:            primaryMAC,
 			DeviceNumber:   primaryDevice,
-			SubnetIPv4CIDR: primarySubnet,
+			SubnetIPv4CIDR: primarySubnetCIDR,
 			LocalIPv4s:     []string{ipaddr01, ipaddr02},
 		},
 	}, nil)
@@ -360,7 +1024,7 @@ func TestNodeIPPoolReconcile(t *testing.T) {
 			ENIID:          primaryENIid,
 			MAC:            primaryMAC,
 			DeviceNumber:   primaryDevice,
-			SubnetIPv4CIDR: primarySubnet,
+			SubnetIPv4CIDR: primarySubnetCIDR,
 			LocalIPv4s:     []string{ipaddr01},
 		},
 	}, nil)
@@ -379,6 +1043,117 @@ func TestNodeIPPoolReconcile(t *testing.T) {
 	assert.Equal(t, curENIs.TotalIPs, 0)
 }
 
+func TestNodeIPPoolReconcileOutOfBand(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, primaryDevice, true)
+	_ = ds.AddENI(secENIid, secDevice, false)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr01)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr02)
+	_ = ds.AddIPv4AddressFromStore(secENIid, ipaddr11)
+	for name, ip := range map[string]string{"pod1": ipaddr01, "pod2": ipaddr02, "pod3": ipaddr11} {
+		_, _, err := ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: name, Namespace: "default", IP: ip})
+		assert.NoError(t, err)
+	}
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+		primaryIP:     map[string]string{primaryENIid: "10.10.10.10"},
+	}
+	mockContext.reconcileCooldownCache.cache = make(map[string]time.Time)
+
+	// Both IPs of the primary ENI are missing from instance metadata, but only the first one is gone in EC2. The
+	// secondary ENI was detached.
+	mockAWS.EXPECT().GetAttachedENIs().Return([]awsutils.ENIMetadata{
+		{
+			ENIID:          primaryENIid,
+			MAC:            primaryMAC,
+			DeviceNumber:   primaryDevice,
+			SubnetIPv4CIDR: primarySubnetCIDR,
+			LocalIPv4s:     []string{"10.10.10.10"},
+		},
+	}, nil)
+	mockAWS.EXPECT().DescribeENI(primaryENIid).Return([]*ec2.NetworkInterfacePrivateIpAddress{
+		{PrivateIpAddress: aws.String("10.10.10.10"), Primary: aws.Bool(true)},
+		{PrivateIpAddress: aws.String(ipaddr02), Primary: aws.Bool(false)},
+	}, aws.String(testAttachmentID), nil)
+	mockAWS.EXPECT().DescribeENI(secENIid).Return([]*ec2.NetworkInterfacePrivateIpAddress{
+		{PrivateIpAddress: aws.String(ipaddr11), Primary: aws.Bool(false)},
+	}, nil, nil)
+	mockK8S.EXPECT().K8SEmitPodEvent("default", "pod1", "Warning", podIPRevokedReason, gomock.Any()).Return(nil)
+	mockK8S.EXPECT().K8SEmitPodEvent("default", "pod3", "Warning", podIPRevokedReason, gomock.Any()).Return(nil)
+	mockK8S.EXPECT().K8SEmitNodeEvent("Warning", eniDetachedReason, gomock.Any()).Return(nil)
+	mockNetwork.EXPECT().TeardownENINetwork(2).Return(nil)
+
+	mockContext.nodeIPPoolReconcile(0)
+
+	assert.Equal(t, 1, ds.GetENIs())
+	pool, err := ds.GetENIIPPools(primaryENIid)
+	assert.NoError(t, err)
+	assert.NotContains(t, pool, ipaddr01)
+	assert.Contains(t, pool, ipaddr02)
+	pods := *ds.GetPodInfos()
+	assert.Len(t, pods, 1)
+	assert.Contains(t, pods, "pod2_default_")
+}
+
+func TestNodeIPPoolReconcileQuarantine(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		primaryIP:     map[string]string{primaryENIid: ipaddr01},
+	}
+	mockContext.dataStore = datastore.NewDataStore()
+	assert.NoError(t, mockContext.dataStore.AddENI(primaryENIid, primaryDevice, true))
+
+	// The IP outside of the subnet of the ENI and the IPv6 address are not handed to pods
+	outsideIP := "10.20.0.5"
+	mockAWS.EXPECT().GetAttachedENIs().Return([]awsutils.ENIMetadata{
+		{
+			ENIID:          primaryENIid,
+			MAC:            primaryMAC,
+			DeviceNumber:   primaryDevice,
+			SubnetIPv4CIDR: primarySubnetCIDR,
+			LocalIPv4s:     []string{ipaddr01, ipaddr02, outsideIP, "2600:1f14::5"},
+		},
+	}, nil)
+	mockContext.nodeIPPoolReconcile(0)
+
+	curENIs := mockContext.dataStore.GetENIInfos()
+	assert.Equal(t, 1, curENIs.TotalIPs)
+	quarantined := mockContext.getQuarantinedIPs()
+	assert.Equal(t, 2, len(quarantined))
+	assert.Equal(t, outsideIP, quarantined[0].IP)
+	assert.Equal(t, primarySubnet, quarantined[0].SubnetCIDR)
+	assert.Equal(t, "outside of the subnet "+primarySubnet+" of the ENI", quarantined[0].Reason)
+	assert.Equal(t, "not an IPv4 address", quarantined[1].Reason)
+
+	// Quarantined IPs are forgotten once they are no longer assigned to the ENI
+	mockAWS.EXPECT().GetAttachedENIs().Return([]awsutils.ENIMetadata{
+		{
+			ENIID:          primaryENIid,
+			MAC:            primaryMAC,
+			DeviceNumber:   primaryDevice,
+			SubnetIPv4CIDR: primarySubnetCIDR,
+			LocalIPv4s:     []string{ipaddr01, ipaddr02, outsideIP},
+		},
+	}, nil)
+	mockContext.nodeIPPoolReconcile(0)
+	assert.Equal(t, 1, len(mockContext.getQuarantinedIPs()))
+
+	mockAWS.EXPECT().GetAttachedENIs().Return(nil, nil)
+	mockContext.nodeIPPoolReconcile(0)
+	assert.Empty(t, mockContext.getQuarantinedIPs())
+}
+
 func TestGetWarmENITarget(t *testing.T) {
 	ctrl, _, _, _, _ := setup(t)
 	defer ctrl.Finish()
@@ -396,6 +1171,33 @@ func TestGetWarmENITarget(t *testing.T) {
 	assert.Equal(t, warmIPTarget, noWarmIPTarget)
 }
 
+func TestResolveWarmTargetPercents(t *testing.T) {
+	mockContext := &IPAMContext{
+		maxENI:        4,
+		maxIPsPerENI:  14,
+		warmENITarget: defaultWarmENITarget,
+		warmIPTarget:  noWarmIPTarget,
+	}
+
+	_ = os.Setenv(envWarmIPTarget, "10%")
+	_ = os.Setenv(envWarmENITarget, "30%")
+	mockContext.resolveWarmTargetPercents()
+	// 10% of 56 IPs and 30% of 4 ENIs, rounded up
+	assert.Equal(t, 6, mockContext.warmIPTarget)
+	assert.Equal(t, 2, mockContext.warmENITarget)
+	assert.Equal(t, "10%", GetConfigForDebug()[envWarmIPTarget])
+
+	_ = os.Setenv(envWarmIPTarget, "150%")
+	_, ok := getWarmTargetPercent(envWarmIPTarget)
+	assert.False(t, ok)
+	_ = os.Setenv(envWarmIPTarget, "5")
+	_, ok = getWarmTargetPercent(envWarmIPTarget)
+	assert.False(t, ok)
+
+	_ = os.Unsetenv(envWarmIPTarget)
+	_ = os.Unsetenv(envWarmENITarget)
+}
+
 func TestGetWarmIPTargetState(t *testing.T) {
 	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
 	defer ctrl.Finish()
@@ -486,15 +1288,98 @@ func TestIPAMContext_nodeIPPoolTooLow(t *testing.T) {
 	}
 }
 
-func datastoreWith3FreeIPs() *datastore.DataStore {
-	datastoreWith3FreeIPs := datastore.NewDataStore()
-	_ = datastoreWith3FreeIPs.AddENI(primaryENIid, 1, true)
-	_ = datastoreWith3FreeIPs.AddIPv4AddressFromStore(primaryENIid, ipaddr01)
-	_ = datastoreWith3FreeIPs.AddIPv4AddressFromStore(primaryENIid, ipaddr02)
-	_ = datastoreWith3FreeIPs.AddIPv4AddressFromStore(primaryENIid, ipaddr03)
-	return datastoreWith3FreeIPs
-}
-
+func TestNodeIPPoolTooLowWithPendingPods(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	c := &IPAMContext{
+		awsClient:          mockAWS,
+		dataStore:          datastoreWith3FreeIPs(),
+		k8sClient:          mockK8S,
+		networkClient:      mockNetwork,
+		maxIPsPerENI:       3,
+		warmIPTarget:       1,
+		prewarmPendingPods: true,
+	}
+
+	pendingPods := func(n int) []*k8sapi.K8SPodInfo {
+		var pods []*k8sapi.K8SPodInfo
+		for i := 1; i <= n; i++ {
+			pods = append(pods, &k8sapi.K8SPodInfo{Name: fmt.Sprintf("pod-%d", i), Namespace: "ns-1"})
+		}
+		return pods
+	}
+
+	// 3 free IPs cover 2 pending pods plus the warm IP target
+	mockK8S.EXPECT().K8SGetPendingPods().Return(pendingPods(2))
+	assert.False(t, c.nodeIPPoolTooLow())
+
+	// 3 pending pods use up the free IPs, so the pool needs to grow before their CNI ADDs arrive
+	mockK8S.EXPECT().K8SGetPendingPods().Return(pendingPods(3))
+	assert.True(t, c.nodeIPPoolTooLow())
+
+	// A pod that got its IP before its status shows it is not counted twice, as assigned and as pending
+	c.dataStore = datastoreWith1Pod1()
+	mockK8S.EXPECT().K8SGetPendingPods().Return(pendingPods(2))
+	assert.False(t, c.nodeIPPoolTooLow())
+	mockK8S.EXPECT().K8SGetPendingPods().Return(pendingPods(3))
+	assert.True(t, c.nodeIPPoolTooLow())
+
+	// Pending pods are ignored unless pre-warming is enabled
+	c.prewarmPendingPods = false
+	assert.False(t, c.nodeIPPoolTooLow())
+}
+
+func TestTenantENIPoolCycle(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	// The primary ENI, an ENI of a tenant and the free ENI kept for a new tenant
+	ds := datastoreWith3FreeIPs()
+	ds.SetMinENILifetime(0)
+	ds.SetKeepFreeENI(true)
+	_ = ds.AddENI(secENIid, secDevice, false)
+	_ = ds.AddENI("eni-3", 3, false)
+	for i := 1; i <= 3; i++ {
+		_ = ds.AddIPv4AddressFromStore(secENIid, fmt.Sprintf("10.10.20.%d", i))
+		_ = ds.AddIPv4AddressFromStore("eni-3", fmt.Sprintf("10.10.30.%d", i))
+	}
+	_, _, err := ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod-1", Namespace: "blue", IP: "10.10.20.1", Tenant: "blue"})
+	assert.NoError(t, err)
+
+	c := &IPAMContext{
+		awsClient:     mockAWS,
+		dataStore:     ds,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		maxIPsPerENI:  3,
+		maxENI:        4,
+		warmENITarget: 1,
+		tenantLabel:   "tenant",
+	}
+
+	// The IPs of the tenant ENI are not in the warm pool
+	total, assigned := ds.GetSharedStats()
+	assert.Equal(t, 6, total)
+	assert.Equal(t, 0, assigned)
+
+	// The free ENI counts as the extra ENI but is not freed, so no ENI is allocated again for a new tenant either. The
+	// mocks fail the test on any EC2 call.
+	c.updateIPPoolIfRequired()
+	c.updateIPPoolIfRequired()
+	assert.Equal(t, 3, ds.GetENIs())
+	assert.Equal(t, 1, ds.GetFreeENIs())
+}
+
+func datastoreWith3FreeIPs() *datastore.DataStore {
+	datastoreWith3FreeIPs := datastore.NewDataStore()
+	_ = datastoreWith3FreeIPs.AddENI(primaryENIid, 1, true)
+	_ = datastoreWith3FreeIPs.AddIPv4AddressFromStore(primaryENIid, ipaddr01)
+	_ = datastoreWith3FreeIPs.AddIPv4AddressFromStore(primaryENIid, ipaddr02)
+	_ = datastoreWith3FreeIPs.AddIPv4AddressFromStore(primaryENIid, ipaddr03)
+	return datastoreWith3FreeIPs
+}
+
 func datastoreWith1Pod1() *datastore.DataStore {
 	datastoreWith1Pod1 := datastoreWith3FreeIPs()
 
@@ -532,3 +1417,1122 @@ func datastoreWith3Pods() *datastore.DataStore {
 	_, _, _ = datastoreWith3Pods.AssignPodIPv4Address(&podInfo3)
 	return datastoreWith3Pods
 }
+
+func TestReconcileIPv6Pool(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, primaryDevice, true)
+	_ = ds.AddIPv6AddressFromStore(primaryENIid, "2001:db8::99")
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+		maxIPsPerENI:  3,
+		enableIPv6:    true,
+	}
+
+	// Addresses are synced from IMDS, and the ENI is topped up to one per pod
+	mockAWS.EXPECT().GetENIIPv6s(primaryMAC).Return([]string{ipv6addr01, ipv6addr02}, nil)
+	mockAWS.EXPECT().AllocIPv6Addresses(primaryENIid, 1).Return(nil)
+	mockContext.reconcileIPv6Pool(primaryENIid, awsutils.ENIMetadata{ENIID: primaryENIid, MAC: primaryMAC, DeviceNumber: primaryDevice})
+
+	ipv6Pool, err := ds.GetENIIPv6Pools(primaryENIid)
+	assert.NoError(t, err)
+	assert.Len(t, ipv6Pool, 2)
+	assert.Contains(t, ipv6Pool, ipv6addr01)
+	assert.Contains(t, ipv6Pool, ipv6addr02)
+}
+
+func TestReconcileIPv6PoolOfSecondaryENI(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(secENIid, secDevice, false)
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+		maxIPsPerENI:  2,
+		enableIPv6:    true,
+	}
+	eniMetadata := awsutils.ENIMetadata{ENIID: secENIid, MAC: secMAC, DeviceNumber: secDevice}
+
+	// The first address is the one of the ENI, and is not given to pods
+	mockAWS.EXPECT().GetENISubnetIPv6CIDRs(secMAC).Return([]netip.Prefix{netip.MustParsePrefix("2001:db8:0:2::/64")}, nil)
+	mockAWS.EXPECT().GetENIIPv6s(secMAC).Return([]string{"2001:db8:0:2::10", "2001:db8:0:2::11"}, nil)
+	mockAWS.EXPECT().AllocIPv6Addresses(secENIid, 1).Return(nil)
+	mockNetwork.EXPECT().SetupENIIPv6Network(netip.MustParseAddr("2001:db8:0:2::10"), secMAC, secDevice,
+		netip.MustParsePrefix("2001:db8:0:2::/64")).Return(nil)
+	mockContext.reconcileIPv6Pool(secENIid, eniMetadata)
+	ipv6Pool, err := ds.GetENIIPv6Pools(secENIid)
+	assert.NoError(t, err)
+	assert.Len(t, ipv6Pool, 1)
+	assert.Contains(t, ipv6Pool, "2001:db8:0:2::11")
+
+	// The subnet and the network of the ENI are only set up once
+	mockAWS.EXPECT().GetENIIPv6s(secMAC).Return([]string{"2001:db8:0:2::10", "2001:db8:0:2::11", "2001:db8:0:2::12"}, nil)
+	mockContext.reconcileIPv6Pool(secENIid, eniMetadata)
+	ipv6Pool, err = ds.GetENIIPv6Pools(secENIid)
+	assert.NoError(t, err)
+	assert.Len(t, ipv6Pool, 2)
+
+	// An ENI in a subnet without IPv6 CIDR gets no IPv6 addresses
+	_ = ds.AddENI("eni-00000002", 3, false)
+	mockAWS.EXPECT().GetENISubnetIPv6CIDRs("12:ef:2a:98:e5:5c").Return(nil, nil)
+	mockContext.reconcileIPv6Pool("eni-00000002", awsutils.ENIMetadata{ENIID: "eni-00000002", MAC: "12:ef:2a:98:e5:5c", DeviceNumber: 3})
+	ipv6Pool, err = ds.GetENIIPv6Pools("eni-00000002")
+	assert.NoError(t, err)
+	assert.Empty(t, ipv6Pool)
+}
+
+func TestPrefixDelegation(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, primaryDevice, true)
+	mockContext := &IPAMContext{
+		awsClient:        mockAWS,
+		k8sClient:        mockK8S,
+		networkClient:    mockNetwork,
+		dataStore:        ds,
+		maxIPsPerENI:     3 * ipsPerPrefix,
+		maxENI:           4,
+		warmIPTarget:     20,
+		prefixDelegation: true,
+		primaryIP:        map[string]string{primaryENIid: ipaddr01},
+	}
+	mockContext.reconcileCooldownCache.cache = make(map[string]time.Time)
+	prefix1, prefix2 := netip.MustParsePrefix("10.0.0.16/28"), netip.MustParsePrefix("10.0.0.32/28")
+
+	// Two prefixes are enough for the warm IP target
+	mockAWS.EXPECT().AllocIPv4Prefixes(primaryENIid, 2).Return([]netip.Prefix{prefix1, prefix2}, nil)
+	mockNetwork.EXPECT().SetupIPv4PrefixRoute(gomock.Any()).Return(nil).Times(2)
+	increased, err := mockContext.tryAssignIPs()
+	assert.NoError(t, err)
+	assert.True(t, increased)
+	total, _ := ds.GetStats()
+	assert.Equal(t, 2*ipsPerPrefix, total)
+
+	// Only whole prefixes beyond the warm IP target are released
+	mockContext.warmIPTarget = 1
+	mockNetwork.EXPECT().DeleteIPv4PrefixRoute(prefix1).Return(nil)
+	mockAWS.EXPECT().DeallocIPv4Prefixes(primaryENIid, []netip.Prefix{prefix1}).Return(nil)
+	mockContext.decreaseIPPool()
+	total, _ = ds.GetStats()
+	assert.Equal(t, ipsPerPrefix, total)
+
+	// The released prefix is not added back while the instance metadata service still reports it, and the addresses
+	// of the other one are not secondary IPs to be removed
+	primaryENI := awsutils.ENIMetadata{
+		ENIID:          primaryENIid,
+		MAC:            primaryMAC,
+		DeviceNumber:   primaryDevice,
+		SubnetIPv4CIDR: primarySubnetCIDR,
+		LocalIPv4s:     []string{ipaddr01},
+	}
+	mockAWS.EXPECT().GetAttachedENIs().Return([]awsutils.ENIMetadata{primaryENI}, nil)
+	mockAWS.EXPECT().GetENIIPv4Prefixes(primaryMAC).Return([]netip.Prefix{prefix1, prefix2}, nil)
+	mockContext.nodeIPPoolReconcile(0)
+	prefixes, err := ds.GetENIIPv4Prefixes(primaryENIid)
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{prefix2}, prefixes)
+
+	// A prefix unassigned outside of ipamd is removed with its route
+	mockAWS.EXPECT().GetAttachedENIs().Return([]awsutils.ENIMetadata{primaryENI}, nil)
+	mockAWS.EXPECT().GetENIIPv4Prefixes(primaryMAC).Return(nil, nil)
+	mockNetwork.EXPECT().DeleteIPv4PrefixRoute(prefix2).Return(nil)
+	mockContext.nodeIPPoolReconcile(0)
+	total, _ = ds.GetStats()
+	assert.Equal(t, 0, total)
+}
+
+func TestSetupIPv6HostNetwork(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+	}
+	// Nothing to set up without IPv6
+	assert.NoError(t, mockContext.setupIPv6HostNetwork())
+
+	mockContext.enableIPv6 = true
+	vpcIPv6CIDRs := []netip.Prefix{netip.MustParsePrefix("2001:db8::/56")}
+	mockAWS.EXPECT().GetVPCIPv6CIDRs().Return(vpcIPv6CIDRs, nil)
+	mockNetwork.EXPECT().SetupIPv6HostNetwork(vpcIPv6CIDRs).Return(nil)
+	assert.NoError(t, mockContext.setupIPv6HostNetwork())
+}
+
+func TestSweepOrphanedVeths(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, primaryDevice, true)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr01)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr02)
+	_, _, err := ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod1", Namespace: "default", IP: ipaddr01})
+	assert.NoError(t, err)
+	// The IP reserved for the fast path is not used by a veth yet
+	_, _, err = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: fastPathLeaseName, Namespace: fastPathLeaseNamespace,
+		Container: "1", IP: ipaddr02})
+	assert.NoError(t, err)
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+	}
+
+	inUse := networkutils.PodVeth{Name: "eni1", IPs: []netip.Addr{netip.MustParseAddr(ipaddr01)}}
+	orphaned := networkutils.PodVeth{Name: "eni2", IPs: []netip.Addr{netip.MustParseAddr(ipaddr02)}}
+	settingUp := networkutils.PodVeth{Name: "eni3"}
+	// The pod of the node is not in the datastore, e.g. not recovered yet, but the API server still has it
+	notRecovered := networkutils.PodVeth{Name: "eni4", IPs: []netip.Addr{netip.MustParseAddr(ipaddr03)}}
+	localPods := []*k8sapi.K8SPodInfo{{Name: "pod4", Namespace: "default", IP: ipaddr03}}
+
+	// Orphaned veths are only removed on the second sweep
+	mockNetwork.EXPECT().GetPodVeths().Return([]networkutils.PodVeth{inUse, orphaned, notRecovered}, nil)
+	mockK8S.EXPECT().K8SGetLocalPodIPs().Return(localPods, nil)
+	candidates := mockContext.sweepOrphanedVeths(map[string]bool{})
+	assert.Equal(t, map[string]bool{"eni2": true}, candidates)
+
+	mockNetwork.EXPECT().GetPodVeths().Return([]networkutils.PodVeth{inUse, orphaned, settingUp, notRecovered}, nil)
+	mockK8S.EXPECT().K8SGetLocalPodIPs().Return(localPods, nil)
+	mockNetwork.EXPECT().DeletePodVeth(orphaned).Return(nil)
+	candidates = mockContext.sweepOrphanedVeths(candidates)
+	assert.Equal(t, map[string]bool{"eni3": true}, candidates)
+
+	// The veth got its route in the meantime
+	settingUp.IPs = []netip.Addr{netip.MustParseAddr(ipaddr01)}
+	mockNetwork.EXPECT().GetPodVeths().Return([]networkutils.PodVeth{inUse, settingUp}, nil)
+	mockK8S.EXPECT().K8SGetLocalPodIPs().Return(localPods, nil)
+	candidates = mockContext.sweepOrphanedVeths(candidates)
+	assert.Empty(t, candidates)
+
+	// Nothing is removed while the pods of the node are not known
+	mockNetwork.EXPECT().GetPodVeths().Return([]networkutils.PodVeth{orphaned}, nil)
+	mockK8S.EXPECT().K8SGetLocalPodIPs().Return(nil, k8sapi.ErrInformerNotSynced)
+	candidates = mockContext.sweepOrphanedVeths(map[string]bool{"eni2": true})
+	assert.Equal(t, map[string]bool{"eni2": true}, candidates)
+}
+
+func TestWithIPsUnassigned(t *testing.T) {
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, primaryDevice, true)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr01)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr02)
+	_, _, err := ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod1", Namespace: "default", IP: ipaddr01})
+	assert.NoError(t, err)
+	_, _, err = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: fastPathLeaseName, Namespace: fastPathLeaseNamespace,
+		Container: "1", IP: ipaddr02})
+	assert.NoError(t, err)
+
+	called := false
+	fn := func() error {
+		called = true
+		return nil
+	}
+	// The IP was assigned to a new pod after the sweep read the datastore
+	unassigned, err := ds.WithIPsUnassigned([]string{ipaddr01}, isFastPathPlaceholder, fn)
+	assert.NoError(t, err)
+	assert.False(t, unassigned)
+	assert.False(t, called)
+
+	unassigned, err = ds.WithIPsUnassigned([]string{ipaddr02}, isFastPathPlaceholder, fn)
+	assert.NoError(t, err)
+	assert.True(t, unassigned)
+	assert.True(t, called)
+}
+
+func TestMirror(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, primaryDevice, true)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr01)
+	_, _, err := ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod1", Namespace: "default"})
+	assert.NoError(t, err)
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+	}
+
+	_, err = mockContext.startMirror("default/pod2", "", "", 0)
+	assert.Error(t, err)
+	_, err = mockContext.startMirror("default/pod1", "", "", 2*time.Hour)
+	assert.Error(t, err)
+
+	veths := []networkutils.PodVeth{{Name: "eni1", IPs: []netip.Addr{netip.MustParseAddr(ipaddr01)}}}
+	mockNetwork.EXPECT().GetPodVeths().Return(veths, nil).Times(2)
+	mockNetwork.EXPECT().AddMirror("eni1", defaultCaptureInterface).Return(true, nil)
+	mirror, err := mockContext.startMirror("default/pod1", "", "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "eni1", mirror.Interface)
+	assert.Equal(t, defaultCaptureInterface, mirror.Target)
+
+	// Starting it again extends it
+	_, err = mockContext.startMirror("default/pod1", "", "", time.Minute)
+	assert.NoError(t, err)
+	assert.Len(t, mockContext.getMirrors(), 1)
+
+	// The capture interface is kept while another mirror uses it
+	mockAWS.EXPECT().GetAttachedENIs().Return([]awsutils.ENIMetadata{{ENIID: secENIid, MAC: secMAC}}, nil)
+	mockNetwork.EXPECT().GetInterfaceName(secMAC).Return("eth1", nil)
+	mockNetwork.EXPECT().AddMirror("eth1", defaultCaptureInterface).Return(false, nil)
+	_, err = mockContext.startMirror("", secENIid, "", 0)
+	assert.NoError(t, err)
+
+	mockNetwork.EXPECT().DelMirror("eni1", defaultCaptureInterface, false).Return(nil)
+	assert.NoError(t, mockContext.stopMirror("eni1"))
+	mockNetwork.EXPECT().DelMirror("eth1", defaultCaptureInterface, true).Return(nil)
+	assert.NoError(t, mockContext.stopMirror("eth1"))
+	assert.Empty(t, mockContext.getMirrors())
+
+	// Mirrors expire
+	mockNetwork.EXPECT().AddMirror("eth1", "capture1").Return(true, nil)
+	done := make(chan struct{})
+	mockNetwork.EXPECT().DelMirror("eth1", "capture1", true).DoAndReturn(func(string, string, bool) error {
+		close(done)
+		return nil
+	})
+	mockAWS.EXPECT().GetAttachedENIs().Return([]awsutils.ENIMetadata{{ENIID: secENIid, MAC: secMAC}}, nil)
+	mockNetwork.EXPECT().GetInterfaceName(secMAC).Return("eth1", nil)
+	_, err = mockContext.startMirror("", secENIid, "capture1", time.Millisecond)
+	assert.NoError(t, err)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the mirror did not expire")
+	}
+}
+
+func TestCheckRouteTables(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, primaryDevice, true)
+	_ = ds.AddENI(secENIid, secDevice, false)
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+		maxENI:        4,
+	}
+
+	// Table 3 was left behind by a detached ENI, table 100 is not in the range of device numbers
+	mockNetwork.EXPECT().GetRouteTableIDs().Return([]int{secDevice, 3, 100}, nil)
+	mockNetwork.EXPECT().FlushRouteTable(3).Return(nil)
+	mockContext.checkRouteTables(routeTableCheckInterval)
+	assert.Equal(t, []RouteTable{{Table: secDevice, ENI: secENIid}}, mockContext.getRouteTables())
+
+	// Not checked again before the interval
+	mockContext.checkRouteTables(routeTableCheckInterval)
+}
+
+func TestReclaimRouteTable(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		maxENI:        4,
+	}
+
+	mockNetwork.EXPECT().GetRouteTableIDs().Return([]int{3}, nil)
+	mockNetwork.EXPECT().FlushRouteTable(3).Return(nil)
+	mockNetwork.EXPECT().GetRouteTableIDs().Return(nil, nil)
+	assert.NoError(t, mockContext.reclaimRouteTable(3))
+
+	mockNetwork.EXPECT().GetRouteTableIDs().Return([]int{3}, nil)
+	assert.NoError(t, mockContext.reclaimRouteTable(2))
+
+	// A table that is not completely flushed can not be used
+	mockNetwork.EXPECT().GetRouteTableIDs().Return([]int{3}, nil)
+	mockNetwork.EXPECT().FlushRouteTable(3).Return(nil)
+	mockNetwork.EXPECT().GetRouteTableIDs().Return([]int{3}, nil)
+	assert.Error(t, mockContext.reclaimRouteTable(3))
+}
+
+func TestSetupNewENI(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+		maxENI:        4,
+		primaryIP:     make(map[string]string),
+	}
+	eniMetadata := awsutils.ENIMetadata{ENIID: secENIid, MAC: secMAC, DeviceNumber: secDevice, SubnetIPv4CIDR: secSubnetCIDR}
+
+	// The ENI is not set up if its route table can not be flushed
+	mockNetwork.EXPECT().GetRouteTableIDs().Return([]int{secDevice}, nil)
+	mockNetwork.EXPECT().FlushRouteTable(secDevice).Return(errors.New("operation not permitted"))
+	assert.Error(t, mockContext.setupNewENI(secENIid, eniMetadata))
+	assert.Empty(t, ds.GetENIInfos().ENIIPPools)
+
+	// The ENI is left out of the datastore if its network can not be set up
+	mockNetwork.EXPECT().GetRouteTableIDs().Return(nil, nil)
+	mockAWS.EXPECT().DescribeENI(secENIid).Return([]*ec2.NetworkInterfacePrivateIpAddress{
+		{PrivateIpAddress: aws.String(ipaddr11), Primary: aws.Bool(true)},
+		{PrivateIpAddress: aws.String(ipaddr12), Primary: aws.Bool(false)},
+	}, nil, nil)
+	mockAWS.EXPECT().GetPrimaryENI().Return(primaryENIid).AnyTimes()
+	mockNetwork.EXPECT().SetupENINetwork(netip.MustParseAddr(ipaddr11), secMAC, secDevice, secSubnetCIDR).Return(errors.New("link not found"))
+	assert.Error(t, mockContext.setupNewENI(secENIid, eniMetadata))
+	assert.Empty(t, ds.GetENIInfos().ENIIPPools)
+}
+
+func TestCanDetachENI(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+	}
+	ips := []string{ipaddr11, ipaddr12}
+
+	mockNetwork.EXPECT().GetENIReferences(secDevice, ips).Return(nil, nil)
+	assert.True(t, mockContext.canDetachENI(secENIid, secDevice, ips))
+
+	// A pod rule left behind refuses the detach
+	reference := "rule ip rule 0: from " + ipaddr11 + "/32 table 1"
+	mockNetwork.EXPECT().GetENIReferences(secDevice, ips).Return([]string{reference}, nil)
+	assert.False(t, mockContext.canDetachENI(secENIid, secDevice, ips))
+	state := mockContext.getENIDetachState()
+	assert.Equal(t, 1, len(state.Refused))
+	assert.Equal(t, secENIid, state.Refused[0].ENI)
+	assert.Equal(t, []string{reference}, state.Refused[0].Reasons)
+
+	mockNetwork.EXPECT().GetENIReferences(secDevice, ips).Return(nil, errors.New("netlink error"))
+	assert.False(t, mockContext.canDetachENI(secENIid, secDevice, ips))
+
+	// Forced by an operator
+	mockContext.forceENIDetach(secENIid)
+	assert.Equal(t, []string{secENIid}, mockContext.getENIDetachState().Forced)
+	mockNetwork.EXPECT().GetENIReferences(secDevice, ips).Return([]string{reference}, nil)
+	assert.True(t, mockContext.canDetachENI(secENIid, secDevice, ips))
+	assert.Equal(t, ENIDetachState{Refused: []ENIDetachRefusal{}, Forced: []string{}}, mockContext.getENIDetachState())
+}
+
+func TestScaleDownPacing(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     datastore.NewDataStore(),
+		warmIPTarget:  1,
+		pacing:        scaleDownPacing{cooldown: 30 * time.Second, surgeBufferPercent: 50},
+	}
+	_ = mockContext.dataStore.AddENI("eni-1", 1, true)
+	for _, ip := range []string{"1.1.1.1", "1.1.1.2", "1.1.1.3", "1.1.1.4", "1.1.1.5", "1.1.1.6"} {
+		_ = mockContext.dataStore.AddIPv4AddressFromStore("eni-1", ip)
+	}
+	for _, pod := range []string{"pod-1", "pod-2", "pod-3"} {
+		_, _, err := mockContext.dataStore.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: pod, Namespace: "default"})
+		assert.NoError(t, err)
+	}
+
+	// 3 available IPs, 1 for the warm IP target and 2 for the surge buffer of 50% of 3 assigned IPs
+	assert.Equal(t, 2, mockContext.surgeBuffer(3))
+	short, over, _ := mockContext.ipTargetState()
+	assert.Equal(t, 0, short)
+	assert.Equal(t, 0, over)
+	assert.False(t, mockContext.nodeIPPoolTooHigh())
+
+	mockContext.pacing.surgeBufferPercent = 0
+	assert.True(t, mockContext.nodeIPPoolTooHigh())
+
+	now := time.Now()
+	mockContext.pacing.lastIncrease = now.Add(-10 * time.Second)
+	assert.True(t, mockContext.inScaleDownCooldown(now, time.Time{}))
+	mockContext.pacing.lastIncrease = now.Add(-time.Minute)
+	assert.True(t, mockContext.inScaleDownCooldown(now, now.Add(-10*time.Second)))
+	assert.False(t, mockContext.inScaleDownCooldown(now, now.Add(-time.Minute)))
+}
+
+func TestApplyNodeProfile(t *testing.T) {
+	ctrl, _, mockK8S, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	// No profiles, the node labels are not needed
+	_ = os.Unsetenv(envNodeProfiles)
+	assert.NoError(t, ApplyNodeProfile(mockK8S))
+
+	_ = os.Setenv(envNodeProfiles, `[
+		{"name": "gpu", "nodeSelector": {"accelerator": "gpu"}, "env": {"WARM_IP_TARGET": "2"}},
+		{"name": "general", "nodeSelector": {}, "env": {"WARM_IP_TARGET": "10"}}]`)
+	mockK8S.EXPECT().K8SGetNodeLabels().Return(map[string]string{"accelerator": "gpu"}, nil)
+	assert.NoError(t, ApplyNodeProfile(mockK8S))
+	assert.Equal(t, 2, getWarmIPTarget())
+	assert.Equal(t, "gpu", GetConfigForDebug()[envNodeProfiles])
+
+	mockK8S.EXPECT().K8SGetNodeLabels().Return(map[string]string{"accelerator": "none"}, nil)
+	assert.NoError(t, ApplyNodeProfile(mockK8S))
+	assert.Equal(t, 10, getWarmIPTarget())
+
+	mockK8S.EXPECT().K8SGetNodeLabels().Return(nil, errors.New("API server error"))
+	assert.Error(t, ApplyNodeProfile(mockK8S))
+
+	_ = os.Setenv(envNodeProfiles, "not json")
+	assert.Error(t, ApplyNodeProfile(mockK8S))
+
+	_ = os.Unsetenv(envNodeProfiles)
+	_ = os.Unsetenv(envWarmIPTarget)
+	nodeProfile = ""
+}
+
+func TestReloadConfig(t *testing.T) {
+	mockContext := &IPAMContext{
+		dataStore:     datastore.NewDataStore(),
+		warmENITarget: defaultWarmENITarget,
+	}
+
+	_ = os.Setenv(envWarmIPTarget, "4")
+	mockContext.reloadConfigIfRequested()
+	assert.Equal(t, noWarmIPTarget, mockContext.warmIPTarget)
+
+	mockContext.ReloadConfig()
+	mockContext.reloadConfigIfRequested()
+	assert.Equal(t, 4, mockContext.warmIPTarget)
+	assert.Equal(t, defaultScaleDownCooldown*time.Second, mockContext.pacing.cooldown)
+
+	_ = os.Unsetenv(envWarmIPTarget)
+}
+
+func TestAudit(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, primaryDevice, true)
+	_ = ds.AddENI(secENIid, secDevice, false)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr01)
+	_, _, err := ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod1", Namespace: "default"})
+	assert.NoError(t, err)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr02)
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+		primaryIP:     map[string]string{primaryENIid: "10.10.10.10"},
+	}
+	mockContext.reconcileCooldownCache.cache = make(map[string]time.Time)
+
+	_ = os.Setenv(envAuditHeal, "true")
+	defer os.Unsetenv(envAuditHeal)
+
+	mockAWS.EXPECT().GetAttachedENIs().Return([]awsutils.ENIMetadata{
+		{ENIID: primaryENIid}, {ENIID: secENIid}, {ENIID: "eni-00000002"},
+	}, nil)
+	mockAWS.EXPECT().DescribeENI(primaryENIid).Return([]*ec2.NetworkInterfacePrivateIpAddress{
+		{PrivateIpAddress: aws.String("10.10.10.10"), Primary: aws.Bool(true)},
+		{PrivateIpAddress: aws.String(ipaddr01), Primary: aws.Bool(false)},
+		{PrivateIpAddress: aws.String(ipaddr03), Primary: aws.Bool(false)},
+	}, aws.String(testAttachmentID), nil)
+	mockAWS.EXPECT().DescribeENI(secENIid).Return(nil, nil, awsutils.ErrENINotFound)
+	mockNetwork.EXPECT().GetPodVeths().Return([]networkutils.PodVeth{
+		{Name: "eni1", IPs: []netip.Addr{netip.MustParseAddr(ipaddr02)}},
+	}, nil)
+
+	report := mockContext.audit()
+	assert.Equal(t, 2, report.ENIs)
+	assert.Empty(t, report.Errors)
+	assert.Equal(t, []AuditDiscrepancy{
+		{Kind: AuditDatastoreOnly, ENI: primaryENIid, IP: ipaddr02},
+		{Kind: AuditEC2Only, ENI: primaryENIid, IP: ipaddr03, Healed: true},
+		{Kind: AuditENINotInDatastore, ENI: "eni-00000002"},
+		{Kind: AuditENINotInEC2, ENI: secENIid},
+		{Kind: AuditKernelMissing, IP: ipaddr01, Pod: "pod1_default_"},
+		{Kind: AuditKernelOnly, IP: ipaddr02},
+	}, report.Discrepancies)
+	assert.Equal(t, report, mockContext.getAuditReport())
+
+	// The missing IP was added to the datastore
+	pool, err := ds.GetENIIPPools(primaryENIid)
+	assert.NoError(t, err)
+	assert.Contains(t, pool, ipaddr03)
+}
+
+func TestResourceMetrics(t *testing.T) {
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, primaryDevice, true)
+	_ = ds.AddENI(secENIid, secDevice, false)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr01)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr02)
+	_ = ds.AddIPv4AddressFromStore(secENIid, ipaddr11)
+	_, _, err := ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod1", Namespace: "default", IP: ipaddr01})
+	assert.NoError(t, err)
+	_, _, err = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod2", Namespace: "default", IP: ipaddr11})
+	assert.NoError(t, err)
+	_ = ds.AddIPv4AddressFromStore(secENIid, ipaddr12)
+	_, _, err = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: fastPathLeaseName, Namespace: fastPathLeaseNamespace,
+		Container: "1", IP: ipaddr12})
+	assert.NoError(t, err)
+
+	collect := func(collector prometheus.Collector) map[*prometheus.Desc][]*dto.Metric {
+		ch := make(chan prometheus.Metric, 100)
+		collector.Collect(ch)
+		close(ch)
+		metrics := make(map[*prometheus.Desc][]*dto.Metric)
+		for metric := range ch {
+			m := &dto.Metric{}
+			assert.NoError(t, metric.Write(m))
+			metrics[metric.Desc()] = append(metrics[metric.Desc()], m)
+		}
+		return metrics
+	}
+
+	// Nothing is collected by default
+	metrics := collect(&resourceMetrics{ipam: &IPAMContext{dataStore: ds}, maxSeries: defaultMetricsMaxSeries})
+	assert.Empty(t, metrics[eniIPAddressesDesc])
+	assert.Empty(t, metrics[podIPInfoDesc])
+
+	metrics = collect(&resourceMetrics{ipam: &IPAMContext{dataStore: ds}, perENI: true, perPod: true, maxSeries: 3})
+	// Each ENI has an assigned and a free series, the ones of the last ENI are over the limit
+	eniSeries := metrics[eniIPAddressesDesc]
+	assert.Len(t, eniSeries, 3)
+	assert.Equal(t, float64(1), eniSeries[0].GetGauge().GetValue())
+	assert.Equal(t, float64(1), eniSeries[1].GetGauge().GetValue())
+	// The IP reserved for the fast path has no pod
+	assert.Len(t, metrics[podIPInfoDesc], 2)
+	dropped := metrics[metricsSeriesDroppedDesc]
+	assert.Len(t, dropped, 2)
+	assert.Equal(t, float64(1), dropped[0].GetGauge().GetValue())
+	assert.Equal(t, float64(0), dropped[1].GetGauge().GetValue())
+}
+
+func TestPodPrefixes(t *testing.T) {
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, primaryDevice, true)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr01)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr02)
+	_, _, err := ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "pod1", Namespace: "default", IP: ipaddr01})
+	assert.NoError(t, err)
+	_, _, err = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: fastPathLeaseName, Namespace: fastPathLeaseNamespace,
+		Container: "1", IP: ipaddr02})
+	assert.NoError(t, err)
+
+	// The IP reserved for the fast path is not advertised
+	mockContext := &IPAMContext{dataStore: ds}
+	assert.Equal(t, []*net.IPNet{{IP: net.ParseIP(ipaddr01).To4(), Mask: net.CIDRMask(32, 32)}},
+		mockContext.podPrefixes())
+}
+
+func TestPlanEgressEIPs(t *testing.T) {
+	targets := map[string]string{ipaddr01: primaryENIid, ipaddr11: secENIid}
+	nodeENIs := map[string]bool{primaryENIid: true, secENIid: true}
+	eips := []awsutils.EIP{
+		// Associated with a target, kept
+		{AllocationID: "eipalloc-1", AssociationID: "eipassoc-1", ENIID: primaryENIid, PrivateIP: ipaddr01},
+		// Associated with an IP of the node that is no longer SNATed to, released
+		{AllocationID: "eipalloc-2", AssociationID: "eipassoc-2", ENIID: secENIid, PrivateIP: "10.10.20.12"},
+		// Used by another node, left alone
+		{AllocationID: "eipalloc-3", AssociationID: "eipassoc-3", ENIID: "eni-other", PrivateIP: "10.10.30.11"},
+		{AllocationID: "eipalloc-5"},
+		{AllocationID: "eipalloc-4"},
+	}
+	plan := planEgressEIPs(eips, targets, nodeENIs)
+	assert.Equal(t, []string{"eipassoc-2"}, plan.disassociate)
+	assert.Equal(t, []eipAssociation{{AllocationID: "eipalloc-4", ENIID: secENIid, PrivateIP: ipaddr11}}, plan.associate)
+	assert.Equal(t, 1, plan.associated)
+	assert.Equal(t, 0, plan.unassigned)
+
+	// Without free elastic IPs, the SNAT IPs are left without one
+	plan = planEgressEIPs(eips[:3], targets, nodeENIs)
+	assert.Empty(t, plan.associate)
+	assert.Equal(t, 1, plan.unassigned)
+}
+
+func TestGetEgressEIPPool(t *testing.T) {
+	defer os.Unsetenv(envEgressEIPPool)
+
+	_ = os.Unsetenv(envEgressEIPPool)
+	assert.Nil(t, getEgressEIPPool())
+	_ = os.Setenv(envEgressEIPPool, "eipalloc-1, eipalloc-2")
+	assert.Equal(t, &awsutils.EIPPool{AllocationIDs: []string{"eipalloc-1", "eipalloc-2"}}, getEgressEIPPool())
+	_ = os.Setenv(envEgressEIPPool, "tag:cni-egress=prod")
+	assert.Equal(t, &awsutils.EIPPool{TagKey: "cni-egress", TagValue: "prod"}, getEgressEIPPool())
+	_ = os.Setenv(envEgressEIPPool, "tag:cni-egress")
+	assert.Nil(t, getEgressEIPPool())
+}
+
+func TestFastPath(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	dir, err := ioutil.TempDir("", "leases")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	_ = os.Setenv(envFastPathLeases, "1")
+	defer os.Unsetenv(envFastPathLeases)
+
+	ds := datastore.NewDataStore()
+	assert.NoError(t, ds.AddENI(secENIid, secDevice, false))
+	assert.NoError(t, ds.AddIPv4AddressFromStore(secENIid, ipaddr11))
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+	}
+	mockAWS.EXPECT().GetVPCIPv4CIDRs().Return([]netip.Prefix{netip.MustParsePrefix("10.10.0.0/16")}).AnyTimes()
+	mockNetwork.EXPECT().UseExternalSNAT().Return(false).AnyTimes()
+	mockNetwork.EXPECT().GetExcludeSNATCIDRs().Return(nil).AnyTimes()
+
+	// The warm IP is reserved for the plugin
+	mockContext.startFastPath(dir)
+	mockContext.syncFastPath()
+	ips, err := fastpath.FreeLeases(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{ipaddr11}, ips)
+	_, assigned := ds.GetStats()
+	assert.Equal(t, 1, assigned)
+
+	// The plugin sets up a pod with it, which then owns the IP in the datastore
+	lease, err := fastpath.ClaimLease(dir, "pod1", "default", "c1", time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, int32(secDevice), lease.DeviceNumber)
+	assert.Equal(t, []string{"10.10.0.0/16"}, lease.VPCcidrs)
+	mockContext.adoptFastPathClaims()
+	pods := *ds.GetPodInfos()
+	assert.Len(t, pods, 1)
+	assert.Equal(t, ipaddr11, pods["pod1_default_c1"].IP)
+	claims, err := fastpath.Claims(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, claims)
+
+	// No warm IP is left to reserve
+	mockContext.syncFastPath()
+	ips, err = fastpath.FreeLeases(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, ips)
+}
+
+func TestNUMANode(t *testing.T) {
+	ctrl, _, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(secENIid, secDevice, false)
+	mockContext := &IPAMContext{
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+		numaAware:     true,
+	}
+
+	mockNetwork.EXPECT().GetNUMANode(secMAC).Return(1, nil)
+	mockContext.setENINUMANode(secENIid, secMAC)
+	assert.Equal(t, 1, ds.GetENIInfos().ENIIPPools[secENIid].NUMANode)
+
+	mockK8S.EXPECT().K8SGetPodAnnotations("default", "pod1").Return(map[string]string{NUMANodeAnnotation: "1"}, nil)
+	node := mockContext.getPodNUMANode(mockContext.newPodMetadata("default", "pod1"))
+	if assert.NotNil(t, node) {
+		assert.Equal(t, 1, *node)
+	}
+
+	// The NUMA node is only a preference, the pod still gets an IP without it
+	mockK8S.EXPECT().K8SGetPodAnnotations("default", "pod1").Return(map[string]string{NUMANodeAnnotation: "gpu0"}, nil)
+	assert.Nil(t, mockContext.getPodNUMANode(mockContext.newPodMetadata("default", "pod1")))
+	mockK8S.EXPECT().K8SGetPodAnnotations("default", "pod1").Return(nil, errors.New("API server unavailable"))
+	assert.Nil(t, mockContext.getPodNUMANode(mockContext.newPodMetadata("default", "pod1")))
+
+	mockContext.numaAware = false
+	assert.Nil(t, mockContext.getPodNUMANode(mockContext.newPodMetadata("default", "pod1")))
+}
+
+func TestErrorBudget(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{
+		awsClient:       mockAWS,
+		k8sClient:       mockK8S,
+		networkClient:   mockNetwork,
+		dataStore:       datastore.NewDataStore(),
+		restartRequests: make(chan string, 1),
+	}
+	_ = os.Setenv(envErrorBudgetNetlinkFailures, "2")
+	mockContext.errorBudget.init()
+	_ = os.Unsetenv(envErrorBudgetNetlinkFailures)
+
+	// Within the budget
+	mockContext.recordNetlinkResult(errors.New("netlink failure"))
+	mockContext.checkErrorBudget()
+	mockContext.recordNetlinkResult(nil)
+	mockContext.recordNetlinkResult(errors.New("netlink failure"))
+	mockContext.checkErrorBudget()
+
+	// Beyond the budget, ipamd resyncs, and the route tables still fail
+	mockContext.recordNetlinkResult(errors.New("netlink failure"))
+	mockK8S.EXPECT().K8SEmitNodeEvent("Warning", selfHealResyncReason, gomock.Any())
+	mockAWS.EXPECT().GetAttachedENIs().Return(nil, errors.New("imds failure"))
+	mockNetwork.EXPECT().GetRouteTableIDs().Return(nil, errors.New("netlink failure"))
+	mockContext.checkErrorBudget()
+
+	// The failures before the resync no longer count, the one of the resync is within the budget
+	mockContext.errorBudget.started = time.Now().Add(-errorBudgetMinUptime)
+	mockContext.checkErrorBudget()
+	assert.Equal(t, 0, len(mockContext.restartRequests))
+
+	// Beyond the budget again, but not restarted right after starting
+	mockContext.errorBudget.started = time.Now()
+	mockContext.recordNetlinkResult(errors.New("netlink failure"))
+	mockContext.checkErrorBudget()
+	assert.Equal(t, 0, len(mockContext.restartRequests))
+
+	mockContext.errorBudget.started = time.Now().Add(-errorBudgetMinUptime)
+	mockK8S.EXPECT().K8SEmitNodeEvent("Warning", selfHealRestartReason, gomock.Any())
+	mockContext.checkErrorBudget()
+	assert.Equal(t, 1, len(mockContext.restartRequests))
+
+	// Back within the budget after the resync
+	<-mockContext.restartRequests
+	mockContext.recordNetlinkResult(nil)
+	mockK8S.EXPECT().K8SEmitNodeEvent("Normal", selfHealRecoveredReason, gomock.Any())
+	mockContext.checkErrorBudget()
+	mockContext.checkErrorBudget()
+
+	// A resync for mismatches does not wait for a netlink operation to succeed
+	mockContext.errorBudget.maxMismatches = 1
+	mockContext.recordMismatches(1)
+	mockK8S.EXPECT().K8SEmitNodeEvent("Warning", selfHealResyncReason, gomock.Any())
+	mockAWS.EXPECT().GetAttachedENIs().Return(nil, errors.New("imds failure"))
+	mockNetwork.EXPECT().GetRouteTableIDs().Return(nil, errors.New("netlink failure"))
+	mockContext.checkErrorBudget()
+	mockContext.recordMismatches(0)
+	mockK8S.EXPECT().K8SEmitNodeEvent("Normal", selfHealRecoveredReason, gomock.Any())
+	mockContext.checkErrorBudget()
+
+	// A resync for netlink failures waits for one to succeed for a bounded time only
+	mockContext.recordNetlinkResult(errors.New("netlink failure"))
+	mockContext.recordNetlinkResult(errors.New("netlink failure"))
+	mockK8S.EXPECT().K8SEmitNodeEvent("Warning", selfHealResyncReason, gomock.Any())
+	mockAWS.EXPECT().GetAttachedENIs().Return(nil, errors.New("imds failure"))
+	mockNetwork.EXPECT().GetRouteTableIDs().Return(nil, errors.New("netlink failure"))
+	mockContext.checkErrorBudget()
+	mockContext.checkErrorBudget()
+	mockContext.errorBudget.resynced = time.Now().Add(-errorBudgetRecoveryWindow)
+	mockK8S.EXPECT().K8SEmitNodeEvent("Normal", selfHealRecoveredReason, gomock.Any())
+	mockContext.checkErrorBudget()
+	assert.True(t, mockContext.errorBudget.resynced.IsZero())
+}
+
+func TestNodeShutdownTeardown(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, primaryDevice, true)
+	_ = ds.AddENI(secENIid, secDevice, false)
+	_ = ds.AddIPv4AddressFromStore(secENIid, ipaddr11)
+	pod := &k8sapi.K8SPodInfo{Name: "pod1", Namespace: "default", Container: "c1"}
+	_, _, err := ds.AssignPodIPv4Address(pod)
+	assert.NoError(t, err)
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+	}
+
+	// Only torn down when enabled and the kubelet shuts the node down
+	assert.False(t, mockContext.nodeShuttingDown())
+	_ = os.Setenv(envNodeShutdownTeardown, "true")
+	mockK8S.EXPECT().K8SNodeShuttingDown().Return(false, errors.New("api server unreachable"))
+	assert.False(t, mockContext.nodeShuttingDown())
+	mockK8S.EXPECT().K8SNodeShuttingDown().Return(true, nil)
+	assert.True(t, mockContext.nodeShuttingDown())
+	_ = os.Unsetenv(envNodeShutdownTeardown)
+
+	// The rules of a pod that is still on the node are left in place
+	assert.NoError(t, mockContext.checkShutdownFence())
+	mockK8S.EXPECT().K8SEmitNodeEvent("Warning", nodeShutdownReason, gomock.Any())
+	mockContext.teardownNode(0)
+	assert.Equal(t, errNodeShuttingDown, mockContext.checkShutdownFence())
+
+	// The route tables of the ENIs are flushed once the pods are deleted
+	_, _, err = ds.UnassignPodIPv4Address(pod)
+	assert.NoError(t, err)
+	mockNetwork.EXPECT().FlushRouteTable(secDevice).Return(nil)
+	mockK8S.EXPECT().K8SEmitNodeEvent("Normal", nodeShutdownReason, gomock.Any())
+	mockContext.teardownNode(0)
+}
+
+func TestSetupTrunkENI(t *testing.T) {
+	ctrl, mockAWS, _, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{awsClient: mockAWS, podENI: true}
+	trunk := awsutils.TrunkENI{ENIID: "eni-trunk", MAC: "12:ef:2a:98:e5:5c"}
+	kept := awsutils.BranchENI{ENIID: "eni-branch1", IPv4Addr: "10.10.10.51", VlanID: 1, PodNamespace: "ns",
+		PodName: "pod1"}
+	orphaned := awsutils.BranchENI{ENIID: "eni-branch2", IPv4Addr: "10.10.10.52", VlanID: 2, PodNamespace: "ns",
+		PodName: "pod2"}
+	untagged := awsutils.BranchENI{ENIID: "eni-branch3", VlanID: 3}
+	gomock.InOrder(
+		mockAWS.EXPECT().GetTrunkENI().Return(awsutils.TrunkENI{}, nil),
+		mockAWS.EXPECT().AllocTrunkENI().Return(trunk, nil),
+		mockAWS.EXPECT().GetBranchENIs(trunk.ENIID).Return([]awsutils.BranchENI{kept, orphaned, untagged}, nil),
+	)
+	assert.True(t, mockContext.setupTrunkENI())
+	assert.Equal(t, trunk, mockContext.branchENIs.trunk)
+	assert.ElementsMatch(t, []string{kept.IPv4Addr, orphaned.IPv4Addr}, mockContext.branchENIIPs())
+	// The branch ENI without a pod is freed before its VLAN is used again
+	assert.Contains(t, mockContext.branchENIs.stale, 3)
+
+	// The branch ENIs of the pods that are gone are freed once the pods of the node are known, with the ones without
+	// a pod
+	mockAWS.EXPECT().FreeBranchENI(orphaned).Return(nil)
+	mockAWS.EXPECT().FreeBranchENI(untagged).Return(nil)
+	mockContext.releaseOrphanedBranchENIs([]*k8sapi.K8SPodInfo{{Name: "pod1", Namespace: "ns", Container: "cid1"}})
+	assert.Equal(t, []string{kept.IPv4Addr}, mockContext.branchENIIPs())
+	assert.Empty(t, mockContext.branchENIs.stale)
+
+	assert.True(t, mockContext.recoverBranchENIPod(&k8sapi.K8SPodInfo{Name: "pod1", Namespace: "ns", Container: "cid1"}))
+	assert.False(t, mockContext.recoverBranchENIPod(&k8sapi.K8SPodInfo{Name: "pod3", Namespace: "ns", Container: "cid3"}))
+	// The DEL of another sandbox of the pod leaves its branch ENI alone
+	_, ok := mockContext.releaseBranchENI("ns", "pod1", "cid-old")
+	assert.False(t, ok)
+
+	// Without a trunk ENI the pods with security groups are not added
+	mockAWS.EXPECT().GetTrunkENI().Return(awsutils.TrunkENI{}, errors.New("UnauthorizedOperation"))
+	assert.False(t, mockContext.setupTrunkENI())
+	_, _, err := mockContext.assignBranchENI("ns", "pod1", "cid1", []string{"sg-1"})
+	assert.Error(t, err)
+}
+
+func TestCheckTrunkENI(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	lostTrunk := awsutils.TrunkENI{ENIID: "eni-trunk1", MAC: "12:ef:2a:98:e5:5c"}
+	branch := awsutils.BranchENI{ENIID: "eni-branch1", IPv4Addr: "10.10.10.51", VlanID: 1, PodNamespace: "ns",
+		PodName: "pod1"}
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		podENI:        true,
+		maxENI:        3,
+		branchENIs: branchENIState{
+			trunk:       lostTrunk,
+			assigned:    map[string]podBranchENI{"ns/pod1": {branch: branch, container: "cid1"}},
+			quarantined: make(map[string]podBranchENI),
+			stale:       make(map[int]awsutils.BranchENI),
+			trunkSlot:   true,
+		},
+	}
+
+	// Not checked again before the interval is over
+	mockContext.branchENIs.lastCheck = time.Now()
+	mockContext.checkTrunkENI(time.Minute)
+
+	// An attached trunk ENI is left alone
+	mockAWS.EXPECT().DescribeENI(lostTrunk.ENIID).Return(nil, aws.String("eni-attach-1"), nil)
+	mockContext.branchENIs.lastCheck = time.Time{}
+	mockContext.checkTrunkENI(time.Minute)
+	assert.Equal(t, lostTrunk, mockContext.branchENIs.trunk)
+
+	// A deleted trunk ENI is replaced, and the pods of its branch ENIs are told to be recreated
+	newTrunk := awsutils.TrunkENI{ENIID: "eni-trunk2", MAC: "12:ef:2a:98:e5:5e"}
+	gomock.InOrder(
+		mockAWS.EXPECT().DescribeENI(lostTrunk.ENIID).Return(nil, nil, awsutils.ErrENINotFound),
+		mockAWS.EXPECT().GetTrunkENI().Return(awsutils.TrunkENI{}, nil),
+		mockAWS.EXPECT().AllocTrunkENI().Return(newTrunk, nil),
+	)
+	mockK8S.EXPECT().K8SEmitNodeEvent("Warning", trunkENILostReason, gomock.Any())
+	mockK8S.EXPECT().K8SEmitPodEvent("ns", "pod1", "Warning", branchENILostReason, gomock.Any())
+	mockK8S.EXPECT().K8SEmitNodeEvent("Normal", trunkENIRecreatedReason, gomock.Any())
+	mockContext.branchENIs.lastCheck = time.Time{}
+	mockContext.checkTrunkENI(time.Minute)
+	assert.Equal(t, newTrunk, mockContext.branchENIs.trunk)
+	assert.Empty(t, mockContext.branchENIs.assigned)
+	assert.Contains(t, mockContext.branchENIs.quarantined, "ns/pod1")
+	// The slot of the lost trunk ENI is used by the new one
+	assert.Equal(t, 3, mockContext.maxENI)
+	assert.Equal(t, []string{branch.IPv4Addr}, mockContext.branchENIIPs())
+
+	// The new sandbox of the pod gets a branch ENI of the new trunk ENI, without the VLAN of the quarantined one
+	newBranch := awsutils.BranchENI{ENIID: "eni-branch2", IPv4Addr: "10.10.10.52", VlanID: 2, PodNamespace: "ns",
+		PodName: "pod1"}
+	mockNetwork.EXPECT().GetInterfaceName(newTrunk.MAC).Return("eth3", nil)
+	mockAWS.EXPECT().AllocBranchENI(newTrunk.ENIID, 2, []string{"sg-1"}, "ns", "pod1").Return(newBranch, nil)
+	assigned, trunkIfName, err := mockContext.assignBranchENI("ns", "pod1", "cid2", []string{"sg-1"})
+	assert.NoError(t, err)
+	assert.Equal(t, newBranch, assigned)
+	assert.Equal(t, "eth3", trunkIfName)
+
+	// The DEL of the old sandbox frees the quarantined branch ENI
+	mockAWS.EXPECT().FreeBranchENI(branch).Return(nil)
+	released, ok := mockContext.releaseBranchENI("ns", "pod1", "cid1")
+	assert.True(t, ok)
+	assert.Equal(t, branch, released)
+	assert.Empty(t, mockContext.branchENIs.quarantined)
+	assert.Contains(t, mockContext.branchENIs.assigned, "ns/pod1")
+
+	// A trunk ENI that could not be attached is attached on a later check, in the slot left for it
+	mockContext.branchENIs.trunk = awsutils.TrunkENI{}
+	mockContext.branchENIs.trunkSlot = false
+	mockAWS.EXPECT().GetTrunkENI().Return(awsutils.TrunkENI{}, nil)
+	mockAWS.EXPECT().AllocTrunkENI().Return(awsutils.TrunkENI{}, errors.New("AttachmentLimitExceeded"))
+	mockContext.branchENIs.lastCheck = time.Time{}
+	mockContext.checkTrunkENI(time.Minute)
+	assert.Equal(t, 3, mockContext.maxENI)
+	mockAWS.EXPECT().GetTrunkENI().Return(newTrunk, nil)
+	mockK8S.EXPECT().K8SEmitNodeEvent("Normal", trunkENIRecreatedReason, gomock.Any())
+	mockContext.branchENIs.lastCheck = time.Time{}
+	mockContext.checkTrunkENI(time.Minute)
+	assert.Equal(t, newTrunk, mockContext.branchENIs.trunk)
+	assert.Equal(t, 2, mockContext.maxENI)
+}
+
+func TestWarmBranchENIs(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	trunk := awsutils.TrunkENI{ENIID: "eni-trunk", MAC: "12:ef:2a:98:e5:5c"}
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		podENI:        true,
+		branchENIs: branchENIState{
+			trunk:       trunk,
+			assigned:    make(map[string]podBranchENI),
+			quarantined: make(map[string]podBranchENI),
+			stale:       make(map[int]awsutils.BranchENI),
+		},
+	}
+
+	// MAX_BRANCH_ENI only lowers the limit of the instance type, or sets it for an unknown one
+	_ = os.Setenv(envMaxBranchENI, "2")
+	defer os.Unsetenv(envMaxBranchENI)
+	mockAWS.EXPECT().GetBranchENILimit().Return(9, nil)
+	assert.Equal(t, 2, mockContext.getMaxBranchENI())
+	mockAWS.EXPECT().GetBranchENILimit().Return(0, errors.New("unknown instance type"))
+	assert.Equal(t, 2, mockContext.getMaxBranchENI())
+	_ = os.Setenv(envMaxBranchENI, "20")
+	mockAWS.EXPECT().GetBranchENILimit().Return(9, nil)
+	assert.Equal(t, 9, mockContext.getMaxBranchENI())
+	mockContext.branchENIs.limit = 2
+
+	// The resource of the node is set once
+	mockK8S.EXPECT().K8SSetNodeExtendedResource(PodENIResourceName, int64(2)).Return(errors.New("connection refused"))
+	mockContext.advertisePodENIs()
+	mockK8S.EXPECT().K8SSetNodeExtendedResource(PodENIResourceName, int64(2)).Return(nil)
+	mockContext.advertisePodENIs()
+	mockContext.advertisePodENIs()
+
+	// The warm branch ENIs are created within the room of the trunk ENI
+	_ = os.Setenv(envWarmBranchENITarget, "3")
+	defer os.Unsetenv(envWarmBranchENITarget)
+	warm1 := awsutils.BranchENI{ENIID: "eni-branch1", VlanID: 1}
+	warm2 := awsutils.BranchENI{ENIID: "eni-branch2", VlanID: 2}
+	mockAWS.EXPECT().AllocBranchENI(trunk.ENIID, 1, nil, "", "").DoAndReturn(
+		func(string, int, []string, string, string) (awsutils.BranchENI, error) {
+			// The lock is not held through the EC2 calls, and the VLANs are reserved meanwhile
+			assert.Empty(t, mockContext.branchENIIPs())
+			assert.Equal(t, map[int]bool{1: true, 2: true}, mockContext.branchENIs.creating)
+			return warm1, nil
+		})
+	mockAWS.EXPECT().AllocBranchENI(trunk.ENIID, 2, nil, "", "").Return(warm2, nil)
+	mockContext.fillWarmBranchENIs()
+	assert.Empty(t, mockContext.branchENIs.creating)
+	assert.Equal(t, []awsutils.BranchENI{warm1, warm2}, mockContext.branchENIs.warm)
+
+	// A pod gets a warm branch ENI with its security groups, which stays warm if they can not be set
+	mockNetwork.EXPECT().GetInterfaceName(trunk.MAC).Return("eth3", nil).Times(3)
+	mockAWS.EXPECT().AssignBranchENI(warm1, []string{"sg-gone"}, "ns", "pod1").Return(awsutils.BranchENI{},
+		errors.New("InvalidGroup.NotFound"))
+	_, _, err := mockContext.assignBranchENIUnsafe("ns", "pod1", "cid1", []string{"sg-gone"})
+	assert.Error(t, err)
+	assert.Len(t, mockContext.branchENIs.warm, 2)
+	assigned := awsutils.BranchENI{ENIID: "eni-branch1", VlanID: 1, PodNamespace: "ns", PodName: "pod1"}
+	mockAWS.EXPECT().AssignBranchENI(warm1, []string{"sg-1"}, "ns", "pod1").Return(assigned, nil)
+	branch, _, err := mockContext.assignBranchENIUnsafe("ns", "pod1", "cid1", []string{"sg-1"})
+	assert.NoError(t, err)
+	assert.Equal(t, assigned, branch)
+	assert.Equal(t, []awsutils.BranchENI{warm2}, mockContext.branchENIs.warm)
+
+	// Without a warm branch ENI, no branch ENI is created once the trunk ENI is full
+	mockAWS.EXPECT().AssignBranchENI(warm2, []string{"sg-1"}, "ns", "pod2").Return(warm2, nil)
+	_, _, err = mockContext.assignBranchENIUnsafe("ns", "pod2", "cid2", []string{"sg-1"})
+	assert.NoError(t, err)
+	mockContext.fillWarmBranchENIs()
+	assert.Empty(t, mockContext.branchENIs.warm)
+	mockNetwork.EXPECT().GetInterfaceName(trunk.MAC).Return("eth3", nil)
+	_, _, err = mockContext.assignBranchENIUnsafe("ns", "pod3", "cid3", []string{"sg-1"})
+	assert.Error(t, err)
+
+	// The warm branch ENIs above the target are freed
+	mockContext.branchENIs.limit = 0
+	_ = os.Setenv(envWarmBranchENITarget, "1")
+	mockContext.branchENIs.warm = []awsutils.BranchENI{warm1, warm2}
+	mockAWS.EXPECT().FreeBranchENI(warm2).Return(nil)
+	mockContext.fillWarmBranchENIs()
+	assert.Equal(t, []awsutils.BranchENI{warm1}, mockContext.branchENIs.warm)
+	assert.Empty(t, mockContext.branchENIs.stale)
+}
+
+func TestENIQueue(t *testing.T) {
+	q := newENIQueue()
+	var ran []string
+	op := func(name string) func() {
+		return func() { ran = append(ran, name) }
+	}
+
+	// The pod blocking operations run before the warm pool and the scale-downs, each class in order
+	assert.True(t, q.submit(eniOpScaleDown, "decreaseIPPool", op("decreaseIPPool")))
+	assert.True(t, q.submit(eniOpWarmPool, "reconcile", op("reconcile")))
+	assert.True(t, q.submit(eniOpWarmPool, "increaseIPPool", op("warmIncreaseIPPool")))
+	assert.True(t, q.submit(eniOpPodBlocking, "assignBranchENI", op("assignBranchENI")))
+	// Already waiting to run as soon or sooner
+	assert.False(t, q.submit(eniOpWarmPool, "reconcile", op("reconcile")))
+	assert.False(t, q.submit(eniOpScaleDown, "increaseIPPool", op("increaseIPPool")))
+	assert.True(t, q.submit(eniOpPodBlocking, "increaseIPPool", op("podIncreaseIPPool")))
+	for range [5]struct{}{} {
+		q.next().fn()
+	}
+	assert.Equal(t, []string{"assignBranchENI", "podIncreaseIPPool", "reconcile", "warmIncreaseIPPool",
+		"decreaseIPPool"}, ran)
+
+	// run waits for the worker to run the operation
+	go q.work()
+	done := false
+	q.run(eniOpWarmPool, "reconcile", func() { done = true })
+	assert.True(t, done)
+
+	// Without a queue the operations run inline
+	var nilQueue *eniQueue
+	ran = nil
+	nilQueue.run(eniOpPodBlocking, "assignBranchENI", op("assignBranchENI"))
+	assert.True(t, nilQueue.submit(eniOpScaleDown, "freeBranchENIs", op("freeBranchENIs")))
+	assert.Equal(t, []string{"assignBranchENI", "freeBranchENIs"}, ran)
+}
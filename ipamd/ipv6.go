@@ -0,0 +1,177 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"net/netip"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/aws/amazon-vpc-cni-k8s/ipamd/datastore"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/awsutils"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/cidr"
+)
+
+// setupIPv6HostNetwork sets up the ip6tables rules of the host for the IPv6 traffic of pods, which do not depend on the
+// primary IP of the node
+func (c *IPAMContext) setupIPv6HostNetwork() error {
+	if !c.enableIPv6 {
+		return nil
+	}
+	vpcIPv6CIDRs, err := c.awsClient.GetVPCIPv6CIDRs()
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve VPC IPv6 CIDRs")
+	}
+	if err := c.networkClient.SetupIPv6HostNetwork(vpcIPv6CIDRs); err != nil {
+		log.Error("Failed to set up host IPv6 network", err)
+		return errors.Wrap(err, "failed to set up host IPv6 network")
+	}
+	return nil
+}
+
+// reconcileIPv6Pool makes the datastore hold the IPv6 addresses of an ENI, as reported by the instance metadata service,
+// and asks EC2 for more if the ENI has fewer than one per pod it can host. The IPv6 traffic of pods with an address of
+// the primary ENI is routed with the main route table. The first IPv6 address of a secondary ENI is the one of the ENI
+// itself, like its primary IPv4 address, and its other addresses are only given to pods once its IPv6 network is set
+// up. A secondary ENI in a subnet without an IPv6 CIDR gets no IPv6 addresses.
+func (c *IPAMContext) reconcileIPv6Pool(eni string, eniMetadata awsutils.ENIMetadata) {
+	mac := eniMetadata.MAC
+	primary := eniMetadata.DeviceNumber == 0
+	wantIPv6s := c.maxIPsPerENI
+	if !primary {
+		subnetIPv6CIDR, err := c.getENISubnetIPv6CIDR(eni, mac)
+		if err != nil || !subnetIPv6CIDR.IsValid() {
+			return
+		}
+		wantIPv6s++
+	}
+
+	ipv6s, err := c.awsClient.GetENIIPv6s(mac)
+	if err != nil {
+		log.Errorf("IPv6 pool reconcile: Failed to get the IPv6 addresses of ENI %s: %v", eni, err)
+		ipamdErrInc("ipv6ReconcileGetIPv6s")
+		return
+	}
+	if len(ipv6s) < wantIPv6s {
+		// The new addresses are added to the datastore once the instance metadata service reports them
+		if err := c.awsClient.AllocIPv6Addresses(eni, wantIPv6s-len(ipv6s)); err != nil {
+			log.Warnf("Failed to allocate IPv6 addresses on ENI %s: %v", eni, err)
+			ipamdErrInc("allocIPv6AddressesFailed")
+		}
+	}
+	if !primary && len(ipv6s) > 0 {
+		if !c.setupENIIPv6Network(eni, eniMetadata, ipv6s[0]) {
+			return
+		}
+		ipv6s = ipv6s[1:]
+	}
+
+	ipPool, err := c.dataStore.GetENIIPv6Pools(eni)
+	if err != nil {
+		log.Errorf("IPv6 pool reconcile: Failed to get the IPv6 pool of ENI %s: %v", eni, err)
+		return
+	}
+	for _, ipv6 := range ipv6s {
+		err := c.dataStore.AddIPv6AddressFromStore(eni, ipv6)
+		if err != nil && err.Error() == datastore.DuplicateIPError {
+			delete(ipPool, ipv6)
+			continue
+		}
+		if err != nil {
+			log.Errorf("Failed to reconcile IPv6 %s on ENI %s: %v", ipv6, eni, err)
+			ipamdErrInc("ipv6ReconcileAdd")
+			continue
+		}
+		reconcileCnt.With(prometheus.Labels{"fn": "ipv6PoolReconcileAdd"}).Inc()
+	}
+	for existingIP := range ipPool {
+		if err := c.dataStore.DelIPv6AddressFromStore(eni, existingIP); err != nil {
+			log.Errorf("Failed to reconcile and delete IPv6 %s on ENI %s, %v", existingIP, eni, err)
+			ipamdErrInc("ipv6ReconcileDel")
+			continue
+		}
+		reconcileCnt.With(prometheus.Labels{"fn": "ipv6PoolReconcileDel"}).Inc()
+	}
+}
+
+// getENISubnetIPv6CIDR returns the IPv6 CIDR of the subnet of an ENI, the zero Prefix if it has none. It is only looked
+// up once per ENI.
+func (c *IPAMContext) getENISubnetIPv6CIDR(eni string, mac string) (netip.Prefix, error) {
+	c.eniIPv6Lock.Lock()
+	defer c.eniIPv6Lock.Unlock()
+	if subnetIPv6CIDR, ok := c.eniSubnetIPv6CIDRs[eni]; ok {
+		return subnetIPv6CIDR, nil
+	}
+	cidrs, err := c.awsClient.GetENISubnetIPv6CIDRs(mac)
+	if err != nil {
+		log.Errorf("IPv6 pool reconcile: Failed to get the subnet IPv6 CIDRs of ENI %s: %v", eni, err)
+		ipamdErrInc("ipv6ReconcileGetSubnetIPv6CIDRs")
+		return netip.Prefix{}, err
+	}
+	var subnetIPv6CIDR netip.Prefix
+	if len(cidrs) > 0 {
+		subnetIPv6CIDR = cidrs[0]
+	} else {
+		log.Infof("The subnet of ENI %s has no IPv6 CIDR, the pods using its IPv4 addresses get IPv6 addresses of the primary ENI", eni)
+	}
+	if c.eniSubnetIPv6CIDRs == nil {
+		c.eniSubnetIPv6CIDRs = make(map[string]netip.Prefix)
+	}
+	c.eniSubnetIPv6CIDRs[eni] = subnetIPv6CIDR
+	return subnetIPv6CIDR, nil
+}
+
+// setupENIIPv6Network sets up the IPv6 address and routes of a secondary ENI, unless it is already set up with the same
+// address. It returns whether the ENI is set up.
+func (c *IPAMContext) setupENIIPv6Network(eni string, eniMetadata awsutils.ENIMetadata, ipv6 string) bool {
+	eniIPv6, err := cidr.ParseAddr(ipv6)
+	if err != nil {
+		log.Errorf("Failed to set up IPv6 networking for ENI %s: %v", eni, err)
+		ipamdErrInc("setupENIIPv6NetworkFailed")
+		return false
+	}
+	c.eniIPv6Lock.Lock()
+	defer c.eniIPv6Lock.Unlock()
+	if c.eniIPv6s[eni] == eniIPv6 {
+		return true
+	}
+	err = c.networkClient.SetupENIIPv6Network(eniIPv6, eniMetadata.MAC, eniMetadata.DeviceNumber, c.eniSubnetIPv6CIDRs[eni])
+	c.recordNetlinkResult(err)
+	if err != nil {
+		log.Errorf("Failed to set up IPv6 networking for ENI %s: %v", eni, err)
+		ipamdErrInc("setupENIIPv6NetworkFailed")
+		return false
+	}
+	if c.eniIPv6s == nil {
+		c.eniIPv6s = make(map[string]netip.Addr)
+	}
+	c.eniIPv6s[eni] = eniIPv6
+	return true
+}
+
+// getPodIPv6s returns the IPv6 address of each running pod, keyed by its IPv4 address. The API server only reports the
+// IPv4 address of pods, so they are found from the host routes to the pods.
+func (c *IPAMContext) getPodIPv6s() map[string]string {
+	if !c.enableIPv6 {
+		return nil
+	}
+	podIPv6s, err := c.networkClient.GetPodIPv6sFromRoutes()
+	if err != nil {
+		log.Errorf("During ipamd init: failed to find the IPv6 addresses of the pods %v", err)
+		ipamdErrInc("nodeInitGetPodIPv6sFailed")
+	}
+	return podIPv6s
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/networkutils"
+)
+
+const (
+	// kubeProxyCheckInterval is how often kube-proxy is asked for its mode until it answers
+	kubeProxyCheckInterval = 30 * time.Second
+	// kubeProxyCheckAttempts is how many times kube-proxy is asked before the mode found in the dataplane is reported
+	kubeProxyCheckAttempts = 10
+
+	// kubeProxyMismatchReason is the reason of the event recorded when kube-proxy does not fit the host network
+	kubeProxyMismatchReason = "KubeProxyMismatch"
+)
+
+var kubeProxyModeInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "awscni_kube_proxy_mode",
+		Help: "Set to 1 for the mode kube-proxy implements services with: iptables, ipvs or none",
+	},
+	[]string{"mode"},
+)
+
+// StartKubeProxyCheck finds out the mode of kube-proxy once it is running, and reports what does not work with it.
+// kube-proxy may start after ipamd, so it is asked again for a while before relying on what it left in the dataplane.
+func (c *IPAMContext) StartKubeProxyCheck() {
+	for attempt := 1; ; attempt++ {
+		result, err := c.networkClient.CheckKubeProxy()
+		if err != nil {
+			log.Warnf("Failed to check kube-proxy: %v", err)
+			ipamdErrInc("checkKubeProxyFailed")
+		} else if result.Reported || attempt >= kubeProxyCheckAttempts {
+			c.reportKubeProxyCheck(result)
+			return
+		}
+		if attempt >= kubeProxyCheckAttempts {
+			return
+		}
+		time.Sleep(kubeProxyCheckInterval)
+	}
+}
+
+// reportKubeProxyCheck logs and records the outcome of a check
+func (c *IPAMContext) reportKubeProxyCheck(result networkutils.KubeProxyCheck) {
+	source := "reported by kube-proxy"
+	if !result.Reported {
+		source = "found in the dataplane"
+	}
+	log.Infof("kube-proxy mode is %s, %s", result.Mode, source)
+	kubeProxyModeInfo.WithLabelValues(string(result.Mode)).Set(1)
+
+	for _, adjustment := range result.Adjustments {
+		log.Infof("Adjusted the host network for kube-proxy: %s", adjustment)
+	}
+	if len(result.Problems) == 0 {
+		return
+	}
+	message := "kube-proxy in " + string(result.Mode) + " mode does not fit the host network: " +
+		strings.Join(result.Problems, "; ")
+	log.Warn(message)
+	c.emitNodeEvent(v1.EventTypeWarning, kubeProxyMismatchReason, message)
+}
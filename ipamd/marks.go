@@ -0,0 +1,72 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// markCheckInterval is how often the rules of others are checked for marks used by the host rules
+	markCheckInterval = 5 * time.Minute
+
+	// markConflictReason is the reason of the event recorded when rules of others use the marks of the host rules
+	markConflictReason = "MarkConflict"
+)
+
+var markConflicts = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "awscni_mark_conflicts",
+		Help: "The number of rules written by others that use the marks of the host rules",
+	},
+)
+
+// StartMarkCheck periodically looks for rules written by others, e.g. Istio, that use the marks of the host rules.
+// Sidecar injectors and service meshes are often installed after the CNI, so they are not there at startup.
+func (c *IPAMContext) StartMarkCheck() {
+	var last []string
+	for {
+		problems, err := c.networkClient.CheckMarks()
+		if err != nil {
+			log.Warnf("Failed to check the marks of the host rules: %v", err)
+			ipamdErrInc("checkMarksFailed")
+		} else {
+			c.reportMarkCheck(problems, last)
+			last = problems
+		}
+		time.Sleep(markCheckInterval)
+	}
+}
+
+// reportMarkCheck logs and records the conflicts found, when they changed since the last check
+func (c *IPAMContext) reportMarkCheck(problems, last []string) {
+	markConflicts.Set(float64(len(problems)))
+	message := strings.Join(problems, "; ")
+	if message == strings.Join(last, "; ") {
+		return
+	}
+	if len(problems) == 0 {
+		log.Info("Nothing uses the marks of the host rules anymore")
+		return
+	}
+	message = "Rules of others use the marks of the host rules, set AWS_VPC_K8S_CNI_MARK_PRESET or " +
+		"AWS_VPC_K8S_CNI_CONNMARK: " + message
+	log.Warn(message)
+	c.emitNodeEvent(v1.EventTypeWarning, markConflictReason, message)
+}
@@ -39,6 +39,7 @@ func (c *IPAMContext) ServeMetrics() {
 		return
 	}
 
+	c.registerResourceMetrics()
 	log.Info("Serving metrics on port ", metricsPort)
 	server := c.setupMetricsServer()
 	for {
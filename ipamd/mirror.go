@@ -0,0 +1,202 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/cidr"
+)
+
+const (
+	// defaultMirrorTTL is how long the traffic of a pod or an ENI is mirrored when no TTL is given
+	defaultMirrorTTL = 10 * time.Minute
+	// maxMirrorTTL bounds the TTL of a mirror, so that a forgotten capture does not double the traffic for long
+	maxMirrorTTL = time.Hour
+
+	// defaultCaptureInterface is the dummy interface the traffic is mirrored to when no target is given, e.g. for
+	// `tcpdump -i awscapture0 -w capture.pcap`
+	defaultCaptureInterface = "awscapture0"
+)
+
+// Mirror is the traffic of a pod or an ENI mirrored to a capture interface until it expires
+type Mirror struct {
+	// Interface is the host-side veth of the pod, or the interface of the ENI
+	Interface string
+	Pod       string `json:",omitempty"`
+	ENI       string `json:",omitempty"`
+	Target    string
+	Expires   time.Time
+
+	// createdTarget is set when the capture interface was created for the mirror
+	createdTarget bool
+	timer         *time.Timer
+}
+
+// mirrorState holds the active mirrors, keyed by the mirrored interface
+type mirrorState struct {
+	lock   sync.Mutex
+	active map[string]*Mirror
+}
+
+// startMirror mirrors the traffic of the pod, given as <namespace>/<name>, or of the ENI to the target interface for
+// the TTL. Starting the mirror of an interface again with the same target extends it.
+func (c *IPAMContext) startMirror(pod, eni, target string, ttl time.Duration) (Mirror, error) {
+	if target == "" {
+		target = defaultCaptureInterface
+	}
+	if ttl <= 0 {
+		ttl = defaultMirrorTTL
+	}
+	if ttl > maxMirrorTTL {
+		return Mirror{}, errors.Errorf("TTL %s is longer than %s", ttl, maxMirrorTTL)
+	}
+	iface, err := c.mirrorSource(pod, eni)
+	if err != nil {
+		return Mirror{}, err
+	}
+
+	c.mirrors.lock.Lock()
+	defer c.mirrors.lock.Unlock()
+	if c.mirrors.active == nil {
+		c.mirrors.active = make(map[string]*Mirror)
+	}
+	mirror, ok := c.mirrors.active[iface]
+	if ok && mirror.Target != target {
+		return Mirror{}, errors.Errorf("%s is already mirrored to %s", iface, mirror.Target)
+	}
+	if !ok {
+		created, err := c.networkClient.AddMirror(iface, target)
+		if err != nil {
+			if created {
+				c.delMirror(iface, target)
+			}
+			return Mirror{}, err
+		}
+		mirror = &Mirror{Interface: iface, Pod: pod, ENI: eni, Target: target, createdTarget: created}
+		mirror.timer = time.AfterFunc(ttl, func() {
+			if err := c.stopMirror(iface); err != nil {
+				log.Warnf("Failed to stop the expired mirror of %s: %v", iface, err)
+			}
+		})
+		c.mirrors.active[iface] = mirror
+		log.Infof("Mirroring %s to %s for %s", iface, target, ttl)
+	} else {
+		mirror.timer.Reset(ttl)
+		log.Infof("Extended the mirror of %s to %s by %s", iface, target, ttl)
+	}
+	mirror.Expires = time.Now().Add(ttl)
+	return *mirror, nil
+}
+
+// stopMirror stops mirroring the interface, and deletes the capture interface once no mirror uses it if it was
+// created for them. An interface that is not known, e.g. mirrored before a restart of ipamd, is cleaned up anyway.
+func (c *IPAMContext) stopMirror(iface string) error {
+	c.mirrors.lock.Lock()
+	defer c.mirrors.lock.Unlock()
+	mirror, ok := c.mirrors.active[iface]
+	if !ok {
+		return c.networkClient.DelMirror(iface, "", false)
+	}
+	mirror.timer.Stop()
+	delete(c.mirrors.active, iface)
+	log.Infof("Stopped mirroring %s to %s", iface, mirror.Target)
+
+	deleteTarget := mirror.createdTarget
+	for _, other := range c.mirrors.active {
+		if other.Target == mirror.Target {
+			// The capture interface is handed over to the mirror still using it
+			other.createdTarget = other.createdTarget || mirror.createdTarget
+			deleteTarget = false
+		}
+	}
+	return c.networkClient.DelMirror(iface, mirror.Target, deleteTarget)
+}
+
+// delMirror cleans up after a mirror that failed to start, with mirrors.lock held
+func (c *IPAMContext) delMirror(iface, target string) {
+	for _, other := range c.mirrors.active {
+		if other.Target == target {
+			return
+		}
+	}
+	if err := c.networkClient.DelMirror(iface, target, true); err != nil {
+		log.Warnf("Failed to clean up the mirror of %s: %v", iface, err)
+	}
+}
+
+// mirrorSource returns the interface of the pod, given as <namespace>/<name>, or of the ENI
+func (c *IPAMContext) mirrorSource(pod, eni string) (string, error) {
+	switch {
+	case pod != "" && eni != "":
+		return "", errors.New("only one of pod and eni can be mirrored")
+	case pod != "":
+		parts := strings.SplitN(pod, "/", 2)
+		if len(parts) != 2 {
+			return "", errors.Errorf("pod %q is not <namespace>/<name>", pod)
+		}
+		podIP := ""
+		for key, podInfo := range *c.dataStore.GetPodInfos() {
+			if strings.HasPrefix(key, parts[1]+"_"+parts[0]+"_") && !isFastPathPlaceholder(key) {
+				podIP = podInfo.IP
+				break
+			}
+		}
+		podAddr, err := cidr.ParseAddr(podIP)
+		if err != nil {
+			return "", errors.Errorf("pod %s has no IP on this node", pod)
+		}
+		veths, err := c.networkClient.GetPodVeths()
+		if err != nil {
+			return "", errors.Wrap(err, "failed to list the veths of pods")
+		}
+		for _, veth := range veths {
+			for _, ip := range veth.IPs {
+				if ip == podAddr {
+					return veth.Name, nil
+				}
+			}
+		}
+		return "", errors.Errorf("no veth is routed to %s of pod %s", podIP, pod)
+	case eni != "":
+		enis, err := c.awsClient.GetAttachedENIs()
+		if err != nil {
+			return "", errors.Wrap(err, "failed to list the attached ENIs")
+		}
+		for _, attached := range enis {
+			if attached.ENIID == eni {
+				return c.networkClient.GetInterfaceName(attached.MAC)
+			}
+		}
+		return "", errors.Errorf("ENI %s is not attached", eni)
+	}
+	return "", errors.New("missing pod or eni")
+}
+
+func (c *IPAMContext) getMirrors() []Mirror {
+	c.mirrors.lock.Lock()
+	defer c.mirrors.lock.Unlock()
+	mirrors := make([]Mirror, 0, len(c.mirrors.active))
+	for _, mirror := range c.mirrors.active {
+		mirrors = append(mirrors, *mirror)
+	}
+	sort.Slice(mirrors, func(i, j int) bool { return mirrors[i].Interface < mirrors[j].Interface })
+	return mirrors
+}
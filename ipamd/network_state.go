@@ -0,0 +1,101 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+
+	"github.com/aws/amazon-vpc-cni-k8s/ipamd/datastore"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/networkutils"
+)
+
+// envNetworkStateImport is the name of the environment variable that allows a network state snapshot to be applied
+// through the introspection endpoint. Exporting is always allowed. Defaults to false.
+const envNetworkStateImport = "AWS_VPC_K8S_CNI_NETWORK_STATE_IMPORT"
+
+// NodeNetworkState is a snapshot of the network state owned by the plugin on a node: rules, routes and iptables chains,
+// and the ENIs, IPs and pods of the datastore
+type NodeNetworkState struct {
+	Network *networkutils.NetworkState
+	ENIs    *datastore.ENIInfos
+	Pods    *map[string]datastore.PodIPInfo
+}
+
+// NodeNetworkStateImport is the outcome of applying a NodeNetworkState
+type NodeNetworkStateImport struct {
+	Network *networkutils.NetworkStateImport
+	// Pods is the number of pods whose IP was assigned to them again in the datastore
+	Pods int
+	// Skipped are the pods whose IP is not in the datastore of the node, e.g. of ENIs it does not have
+	Skipped []string `json:",omitempty"`
+}
+
+func networkStateImportEnabled() bool {
+	return getEnvBoolWithDefault(envNetworkStateImport, false)
+}
+
+// exportNetworkState returns a snapshot of the network state owned by the plugin on the node
+func (c *IPAMContext) exportNetworkState() (*NodeNetworkState, error) {
+	network, err := c.networkClient.ExportNetworkState()
+	if err != nil {
+		return nil, err
+	}
+	// The leases of the fast path are not carried over, the plugin claims them from the ipamd that made them
+	return &NodeNetworkState{
+		Network: network,
+		ENIs:    c.dataStore.GetENIInfos(),
+		Pods:    c.podIPInfos(),
+	}, nil
+}
+
+// importNetworkState applies an exported snapshot: the rules, routes and iptables chains, then the IPs of its pods
+// that are in the datastore. ENIs and IPs are not added to the datastore, since they must exist in EC2.
+func (c *IPAMContext) importNetworkState(state *NodeNetworkState) (*NodeNetworkStateImport, error) {
+	result := &NodeNetworkStateImport{}
+	if state.Network != nil {
+		network, err := c.networkClient.ImportNetworkState(state.Network)
+		result.Network = network
+		if err != nil {
+			return result, errors.Wrap(err, "failed to import the network state")
+		}
+	}
+	if state.Pods == nil {
+		return result, nil
+	}
+	for key, pod := range *state.Pods {
+		// A placeholder would hold its IP for good, since only the leases of the fast path release them
+		if isFastPathPlaceholder(key) {
+			continue
+		}
+		// The key is name_namespace_container, names and namespaces cannot contain underscores
+		parts := strings.SplitN(key, "_", 3)
+		if len(parts) != 3 || pod.IP == "" {
+			result.Skipped = append(result.Skipped, key)
+			continue
+		}
+		k8sPod := &k8sapi.K8SPodInfo{Name: parts[0], Namespace: parts[1], Container: parts[2], IP: pod.IP}
+		if _, _, err := c.dataStore.AssignPodIPv4Address(k8sPod); err != nil {
+			log.Warnf("Failed to import the IP %s of pod %s: %v", pod.IP, key, err)
+			result.Skipped = append(result.Skipped, key)
+			continue
+		}
+		result.Pods++
+	}
+	log.Infof("Imported the IPs of %d pods into the datastore, skipped %d", result.Pods, len(result.Skipped))
+	return result, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"reflect"
+	"strconv"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// envNodeInventory is the name of the environment variable that publishes a summary of the ENIs and IPs of the node
+	// as annotations of the node, for tooling and dashboards that read the capacity of nodes without the metrics stack.
+	// Needs the permission to patch nodes. Defaults to false.
+	envNodeInventory = "AWS_VPC_K8S_CNI_NODE_INVENTORY_ANNOTATIONS"
+
+	// envNodeInventoryInterval is the name of the environment variable that sets how many seconds ipamd waits at least
+	// between two updates of the annotations. They are only updated when the summary changed. Defaults to 60, at least 10.
+	envNodeInventoryInterval     = "AWS_VPC_K8S_CNI_NODE_INVENTORY_INTERVAL"
+	defaultNodeInventoryInterval = 60
+	minNodeInventoryInterval     = 10
+
+	// NodeENIsAnnotation is the annotation of a node with the number of ENIs attached to it
+	NodeENIsAnnotation = "vpc.amazonaws.com/eni-count"
+	// NodeMaxENIsAnnotation is the annotation of a node with the number of ENIs ipamd can attach to it
+	NodeMaxENIsAnnotation = "vpc.amazonaws.com/max-eni-count"
+	// NodeTotalIPsAnnotation is the annotation of a node with the number of IPs of its ENIs that pods can get
+	NodeTotalIPsAnnotation = "vpc.amazonaws.com/total-ips"
+	// NodeAssignedIPsAnnotation is the annotation of a node with the number of IPs assigned to pods
+	NodeAssignedIPsAnnotation = "vpc.amazonaws.com/assigned-ips"
+	// NodeFreeIPsAnnotation is the annotation of a node with the number of IPs new pods can get right away
+	NodeFreeIPsAnnotation = "vpc.amazonaws.com/free-ips"
+)
+
+func nodeInventoryEnabled() bool {
+	return getEnvBoolWithDefault(envNodeInventory, false)
+}
+
+func getNodeInventoryInterval() time.Duration {
+	interval := getNonNegativeIntEnvVar(envNodeInventoryInterval, defaultNodeInventoryInterval)
+	if interval < minNodeInventoryInterval {
+		log.Warnf("%s %d is below the minimum, using %d", envNodeInventoryInterval, interval, minNodeInventoryInterval)
+		interval = minNodeInventoryInterval
+	}
+	return time.Duration(interval) * time.Second
+}
+
+// StartNodeInventory periodically publishes a summary of the ENIs and IPs of the node as annotations of the node, if
+// enabled. The node is only patched when the summary changed since the last update.
+func (c *IPAMContext) StartNodeInventory() {
+	if !nodeInventoryEnabled() {
+		return
+	}
+	interval := getNodeInventoryInterval()
+	log.Infof("Publishing the ENI and IP inventory of the node as annotations at most every %v", interval)
+	var published map[string]string
+	for {
+		published = c.publishNodeInventory(published)
+		time.Sleep(interval)
+	}
+}
+
+// nodeInventory returns the annotations summarizing the ENIs and IPs of the node
+func (c *IPAMContext) nodeInventory() map[string]string {
+	total, assigned := c.dataStore.GetStats()
+	return map[string]string{
+		NodeENIsAnnotation:        strconv.Itoa(c.dataStore.GetENIs()),
+		NodeMaxENIsAnnotation:     strconv.Itoa(c.maxENI),
+		NodeTotalIPsAnnotation:    strconv.Itoa(total),
+		NodeAssignedIPsAnnotation: strconv.Itoa(assigned),
+		NodeFreeIPsAnnotation:     strconv.Itoa(max(total-assigned, 0)),
+	}
+}
+
+// publishNodeInventory sets the inventory annotations of the node if they differ from the published ones, and returns
+// the annotations the node now has. They are published again on the next call if the update failed.
+func (c *IPAMContext) publishNodeInventory(published map[string]string) map[string]string {
+	inventory := c.nodeInventory()
+	if reflect.DeepEqual(inventory, published) {
+		return published
+	}
+	if err := c.k8sClient.K8SSetNodeAnnotations(inventory); err != nil {
+		log.Warnf("Failed to publish the ENI and IP inventory of the node: %v", err)
+		ipamdErrInc("publishNodeInventoryFailed")
+		return published
+	}
+	log.Debugf("Published the ENI and IP inventory of the node: %v", inventory)
+	return inventory
+}
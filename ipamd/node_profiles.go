@@ -0,0 +1,104 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/platform"
+)
+
+// envNodeProfiles is the name of the environment variable that holds a JSON list of configuration profiles, so that a
+// single DaemonSet configures different kinds of nodes differently. At startup, ipamd applies the environment variables
+// of the first profile whose node selector matches the labels of the node, on top of its own environment. For example:
+//
+//	[{"name": "gpu", "nodeSelector": {"k8s.amazonaws.com/accelerator": "nvidia-tesla-v100"},
+//	  "env": {"WARM_IP_TARGET": "2", "AWS_VPC_K8S_CNI_CUSTOM_NETWORK_CFG": "true"}}]
+//
+// Nodes that match no profile keep the environment of the DaemonSet.
+const envNodeProfiles = "AWS_VPC_K8S_CNI_NODE_PROFILES"
+
+// NodeProfile is a set of environment variables that applies to the nodes that have all the labels of its selector
+type NodeProfile struct {
+	Name         string            `json:"name"`
+	NodeSelector map[string]string `json:"nodeSelector"`
+	Env          map[string]string `json:"env"`
+}
+
+// nodeProfile is the name of the profile applied to the node, empty if none is
+var nodeProfile string
+
+// matches returns true if the node labels contain all the labels of the node selector of the profile
+func (p *NodeProfile) matches(nodeLabels map[string]string) bool {
+	for key, value := range p.NodeSelector {
+		if nodeLabel, ok := nodeLabels[key]; !ok || nodeLabel != value {
+			return false
+		}
+	}
+	return true
+}
+
+func getNodeProfiles() ([]NodeProfile, error) {
+	profilesStr := os.Getenv(envNodeProfiles)
+	if profilesStr == "" {
+		return nil, nil
+	}
+	var profiles []NodeProfile
+	if err := json.Unmarshal([]byte(profilesStr), &profiles); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", envNodeProfiles)
+	}
+	return profiles, nil
+}
+
+// ApplyNodeProfile sets the environment variables of the first node profile that matches the labels of the node. It
+// must be called before anything reads its configuration from the environment.
+func ApplyNodeProfile(k8sClient k8sapi.K8SAPIs) error {
+	profiles, err := getNodeProfiles()
+	if err != nil || len(profiles) == 0 {
+		return err
+	}
+	nodeLabels, err := k8sClient.K8SGetNodeLabels()
+	if err != nil {
+		return errors.Wrap(err, "failed to select the node profile")
+	}
+	for _, profile := range profiles {
+		if !profile.matches(nodeLabels) {
+			continue
+		}
+		if err := platform.Current.Validate(profile.Env); err != nil {
+			return errors.Wrapf(err, "failed to apply node profile %s", profile.Name)
+		}
+		names := make([]string, 0, len(profile.Env))
+		for name := range profile.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			log.Infof("Node profile %s sets %s=%s", profile.Name, name, profile.Env[name])
+			if err := os.Setenv(name, profile.Env[name]); err != nil {
+				return errors.Wrapf(err, "failed to apply node profile %s", profile.Name)
+			}
+		}
+		nodeProfile = profile.Name
+		return nil
+	}
+	log.Infof("No node profile matches the labels of the node, using the default configuration")
+	return nil
+}
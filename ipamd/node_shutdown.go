@@ -0,0 +1,122 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// envNodeShutdownTeardown is the name of the environment variable that makes ipamd tear the node down in order when
+	// it is terminated by a graceful node shutdown of the kubelet. Defaults to false.
+	envNodeShutdownTeardown = "AWS_VPC_K8S_CNI_NODE_SHUTDOWN_TEARDOWN"
+	// envNodeShutdownTimeout is the name of the environment variable that sets how many seconds ipamd waits for the DELs
+	// of the pods still on the node during a node shutdown. It must be shorter than the termination grace period of the
+	// aws-node pod, and than the shutdownGracePeriodCriticalPods of the kubelet.
+	envNodeShutdownTimeout     = "AWS_VPC_K8S_CNI_NODE_SHUTDOWN_TIMEOUT"
+	defaultNodeShutdownTimeout = 20
+
+	nodeShutdownPollInterval = time.Second
+
+	// nodeShutdownReason is the reason of the event recorded when ipamd tore the node down
+	nodeShutdownReason = "NodeShutdownTeardown"
+)
+
+var errNodeShuttingDown = errors.New("node is shutting down, not adding pods")
+
+func nodeShutdownTeardownEnabled() bool {
+	return getEnvBoolWithDefault(envNodeShutdownTeardown, false)
+}
+
+func getNodeShutdownTimeout() time.Duration {
+	return time.Duration(getNonNegativeIntEnvVar(envNodeShutdownTimeout, defaultNodeShutdownTimeout)) * time.Second
+}
+
+// nodeShuttingDown returns whether ipamd is terminated because the node shuts down, rather than because the aws-node
+// pod is deleted or updated, in which case the pods and their host rules must stay
+func (c *IPAMContext) nodeShuttingDown() bool {
+	if !nodeShutdownTeardownEnabled() {
+		return false
+	}
+	shuttingDown, err := c.k8sClient.K8SNodeShuttingDown()
+	if err != nil {
+		log.Warnf("Failed to get whether the node is shutting down, leaving the host network as is: %v", err)
+		return false
+	}
+	return shuttingDown
+}
+
+// checkShutdownFence returns an error once the node shuts down, so that no pod is added while it is torn down
+func (c *IPAMContext) checkShutdownFence() error {
+	if atomic.LoadInt32(&c.shutdownFenced) > 0 {
+		return errNodeShuttingDown
+	}
+	return nil
+}
+
+// teardownNode tears the node down in an order that never removes the host rules of a pod that is still terminating:
+// it fences new ADDs, waits for the DELs of the pods still on the node, writes the checkpoint, and only then flushes the
+// route tables of the ENIs and the rules that look them up. If pods are left when the timeout expires, their rules and
+// routes are left in place.
+func (c *IPAMContext) teardownNode(timeout time.Duration) {
+	atomic.StoreInt32(&c.shutdownFenced, 1)
+	log.Infof("Node is shutting down, fenced ADDs, waiting up to %v for the DELs of the pods", timeout)
+
+	deadline := time.Now().Add(timeout)
+	pods := c.localPodCount()
+	for pods > 0 && time.Now().Before(deadline) {
+		time.Sleep(nodeShutdownPollInterval)
+		pods = c.localPodCount()
+	}
+
+	c.writeCheckpoint()
+
+	if pods > 0 {
+		message := fmt.Sprintf("Node shut down with %d pods left after %v, leaving the host rules in place", pods, timeout)
+		log.Warn(message)
+		c.emitNodeEvent(v1.EventTypeWarning, nodeShutdownReason, message)
+		return
+	}
+	flushed := 0
+	for table := range c.routeTableOwners() {
+		err := c.networkClient.FlushRouteTable(table)
+		c.recordNetlinkResult(err)
+		if err != nil {
+			log.Errorf("Failed to flush route table %d on node shutdown: %v", table, err)
+			ipamdErrInc("flushRouteTableFailed")
+			continue
+		}
+		flushed++
+	}
+	message := fmt.Sprintf("Node shut down after the DELs of all pods, flushed %d ENI route tables", flushed)
+	log.Info(message)
+	c.emitNodeEvent(v1.EventTypeNormal, nodeShutdownReason, message)
+}
+
+// localPodCount returns the number of pods that still have an IP on the node
+func (c *IPAMContext) localPodCount() int {
+	count := 0
+	for key := range *c.dataStore.GetPodInfos() {
+		if !isFastPathPlaceholder(key) {
+			count++
+		}
+	}
+	return count
+}
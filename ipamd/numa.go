@@ -0,0 +1,78 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"strconv"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// envNUMAAware is the name of the environment variable that makes pods annotated with NUMANodeAnnotation prefer the
+	// IPs of the ENIs on the network card local to their NUMA node, on instances with several network cards, e.g. to
+	// keep the traffic of ML training pods off the interconnect between the NUMA nodes. Defaults to false.
+	envNUMAAware = "AWS_VPC_K8S_CNI_NUMA_AWARE"
+
+	// NUMANodeAnnotation is the annotation of a pod with the NUMA node of its CPUs and GPUs, e.g. set by the workload
+	// or a mutating webhook. The podresources API of the kubelet only knows the devices of a pod once its containers
+	// are created, which is after its network is set up.
+	NUMANodeAnnotation = "vpc.amazonaws.com/numa-node"
+)
+
+// numaAwareEnabled returns true if pods prefer the ENIs local to their NUMA node
+func numaAwareEnabled() bool {
+	return getEnvBoolWithDefault(envNUMAAware, false)
+}
+
+// getPodNUMANode returns the NUMA node of the annotation of the pod, nil if it has none. The NUMA node is only a
+// preference, so a pod whose annotation can not be read still gets an IP.
+func (c *IPAMContext) getPodNUMANode(meta *podMetadata) *int {
+	if !c.numaAware {
+		return nil
+	}
+	annotations, err := meta.getPodAnnotations()
+	if err != nil {
+		log.Warnf("Failed to get the NUMA node of pod %s, namespace %s: %v", meta.name, meta.namespace, err)
+		return nil
+	}
+	value := strings.TrimSpace(annotations[NUMANodeAnnotation])
+	if value == "" {
+		return nil
+	}
+	node, err := strconv.Atoi(value)
+	if err != nil || node < 0 {
+		log.Warnf("Ignoring invalid %s %q of pod %s, namespace %s", NUMANodeAnnotation, value, meta.name, meta.namespace)
+		return nil
+	}
+	return &node
+}
+
+// setENINUMANode records the NUMA node of the network card of the ENI, so that the pods on that node prefer its IPs
+func (c *IPAMContext) setENINUMANode(eni, mac string) {
+	if !c.numaAware {
+		return
+	}
+	node, err := c.networkClient.GetNUMANode(mac)
+	if err != nil {
+		log.Warnf("Failed to get the NUMA node of ENI %s: %v", eni, err)
+		return
+	}
+	if err := c.dataStore.SetENINUMANode(eni, node); err != nil {
+		log.Warnf("Failed to set the NUMA node of ENI %s: %v", eni, err)
+		return
+	}
+	log.Infof("ENI %s is on NUMA node %d", eni, node)
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/awsutils"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+)
+
+const (
+	// podIPRevokedReason is the reason of the events on pods whose IP was removed outside of ipamd
+	podIPRevokedReason = "PodIPRevoked"
+	// eniDetachedReason is the reason of the event on the node when an ENI used by pods was detached outside of ipamd
+	eniDetachedReason = "ENIDetachedOutOfBand"
+)
+
+// evictRevokedIPs removes the IPs that were unassigned from an ENI outside of ipamd, e.g. in the console, while pods
+// use them, so that they are not handed out again. Instance metadata can lag behind EC2, so an IP is only evicted once
+// EC2 confirms it is gone.
+func (c *IPAMContext) evictRevokedIPs(eni string, ips []string) {
+	ec2Addrs, _, err := c.awsClient.DescribeENI(eni)
+	if err != nil && err != awsutils.ErrENINotFound {
+		log.Warnf("Failed to check the IPs %v missing from ENI %s with EC2, retrying on the next reconcile: %v", ips, eni, err)
+		return
+	}
+	ec2IPs := make(map[string]bool, len(ec2Addrs))
+	for _, ec2Addr := range ec2Addrs {
+		ec2IPs[aws.StringValue(ec2Addr.PrivateIpAddress)] = true
+	}
+	for _, ip := range ips {
+		if ec2IPs[ip] {
+			log.Debugf("IP %s of ENI %s is still assigned in EC2, instance metadata is lagging", ip, eni)
+			continue
+		}
+		pod, err := c.dataStore.EvictIPv4Address(eni, ip)
+		if err != nil {
+			log.Errorf("Failed to evict IP %s of ENI %s: %v", ip, eni, err)
+			ipamdErrInc("ipReconcileEvict")
+			continue
+		}
+		log.Warnf("IP %s was unassigned from ENI %s outside of ipamd, evicted it from the datastore", ip, eni)
+		reconcileCnt.With(prometheus.Labels{"fn": "eniIPPoolReconcileEvict"}).Inc()
+		if pod != nil {
+			c.writeCheckpoint()
+			c.reportEvictedPod(pod, fmt.Sprintf("IP %s was unassigned from ENI %s outside of the CNI plugin", ip, eni))
+		}
+	}
+}
+
+// evictDetachedENI removes an ENI that was detached outside of ipamd while pods use it, so that its IPs are not handed
+// out again, once EC2 confirms it is detached. It returns whether the ENI was evicted.
+func (c *IPAMContext) evictDetachedENI(eni string) bool {
+	_, attachmentID, err := c.awsClient.DescribeENI(eni)
+	if err != nil && err != awsutils.ErrENINotFound {
+		log.Warnf("Failed to check whether ENI %s is detached with EC2, retrying on the next reconcile: %v", eni, err)
+		return false
+	}
+	if err == nil && attachmentID != nil {
+		log.Debugf("ENI %s is still attached in EC2, instance metadata is lagging", eni)
+		return false
+	}
+	pods, err := c.dataStore.EvictENI(eni)
+	if err != nil {
+		log.Errorf("Failed to evict ENI %s: %v", eni, err)
+		ipamdErrInc("eniReconcileEvict")
+		return false
+	}
+	message := fmt.Sprintf("ENI %s was detached outside of the CNI plugin while %d pods used its IPs", eni, len(pods))
+	log.Warn(message)
+	c.emitNodeEvent(v1.EventTypeWarning, eniDetachedReason, message)
+	reconcileCnt.With(prometheus.Labels{"fn": "eniReconcileEvict"}).Inc()
+	c.writeCheckpoint()
+	for _, pod := range pods {
+		c.reportEvictedPod(pod, fmt.Sprintf("ENI %s of IP %s was detached outside of the CNI plugin", eni, pod.IP))
+	}
+	return true
+}
+
+// reportEvictedPod records an event on a pod whose IP was evicted. The pod keeps the IP but has no connectivity until
+// it is recreated.
+func (c *IPAMContext) reportEvictedPod(pod *k8sapi.K8SPodInfo, cause string) {
+	message := cause + ", the pod has no connectivity until it is recreated"
+	if err := c.k8sClient.K8SEmitPodEvent(pod.Namespace, pod.Name, v1.EventTypeWarning, podIPRevokedReason, message); err != nil {
+		log.Warnf("Failed to record event %s on pod %s/%s: %v", podIPRevokedReason, pod.Namespace, pod.Name, err)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build perf
+// +build perf
+
+package ipamd
+
+import (
+	"flag"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+var (
+	perfOps         = flag.Int("perf.ops", 5000, "number of pods added and deleted at each datastore size")
+	perfMaxP99      = flag.Duration("perf.max-p99", 2*time.Millisecond, "highest p99 latency of an ADD and DEL")
+	perfMaxSlowdown = flag.Float64("perf.max-slowdown", 4,
+		"how many times slower the median ADD and DEL may be with the most pods than with the fewest")
+)
+
+// TestAddDelNetworkPerformance fails when the ADD and DEL of a pod got slower, overall or as the number of pods on
+// the node grows, e.g. because a change made the datastore scan all the pods. Run it with make perf-test.
+func TestAddDelNetworkPerformance(t *testing.T) {
+	defer disableLogging()()
+	var medians []time.Duration
+	for _, pods := range perfPodCounts {
+		ctrl := gomock.NewController(t)
+		s, err := newPerfServer(ctrl, pods)
+		if err != nil {
+			t.Fatal(err)
+		}
+		latencies := make([]time.Duration, *perfOps)
+		var elapsed time.Duration
+		for i := range latencies {
+			start := time.Now()
+			ip, err := s.addDelNetwork(i)
+			latencies[i] = time.Since(start)
+			elapsed += latencies[i]
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.recycle(ip); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ctrl.Finish()
+
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		p50 := latencies[len(latencies)/2]
+		p99 := latencies[len(latencies)*99/100]
+		medians = append(medians, p50)
+		t.Logf("%d pods: %.0f ADD and DEL per second, p50 %v, p99 %v", pods,
+			float64(len(latencies))/elapsed.Seconds(), p50, p99)
+		if p99 > *perfMaxP99 {
+			t.Errorf("%d pods: p99 latency of ADD and DEL %v is above %v", pods, p99, *perfMaxP99)
+		}
+	}
+	if slowdown := float64(medians[len(medians)-1]) / float64(medians[0]); slowdown > *perfMaxSlowdown {
+		t.Errorf("ADD and DEL are %.1f times slower with %d pods than with %d, more than %.1f", slowdown,
+			perfPodCounts[len(perfPodCounts)-1], perfPodCounts[0], *perfMaxSlowdown)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+
+	log "github.com/cihub/seelog"
+	"github.com/golang/mock/gomock"
+
+	"github.com/aws/amazon-vpc-cni-k8s/ipamd/datastore"
+	mock_awsutils "github.com/aws/amazon-vpc-cni-k8s/pkg/awsutils/mocks"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+	mock_networkutils "github.com/aws/amazon-vpc-cni-k8s/pkg/networkutils/mocks"
+	pb "github.com/aws/amazon-vpc-cni-k8s/rpc"
+)
+
+const (
+	// perfIPsPerENI is the number of IPs of an ENI on the largest instance types
+	perfIPsPerENI = 50
+	// perfSpareIPs is the number of free IPs left in the datastore next to the running pods
+	perfSpareIPs = 10
+)
+
+// perfPodCounts are the numbers of running pods the ADD path is measured with
+var perfPodCounts = []int{10, 100, 500}
+
+// perfServer is a gRPC server of ipamd with the calls to AWS and to the network mocked
+type perfServer struct {
+	server
+	dataStore *datastore.DataStore
+	// enis are the ENIs of the IPs
+	enis map[string]string
+}
+
+// newPerfServer returns a server whose datastore holds the given number of running pods
+func newPerfServer(ctrl *gomock.Controller, pods int) (*perfServer, error) {
+	mockAWS := mock_awsutils.NewMockAPIs(ctrl)
+	mockNetwork := mock_networkutils.NewMockNetworkAPIs(ctrl)
+	mockAWS.EXPECT().GetVPCIPv4CIDRs().Return([]netip.Prefix{netip.MustParsePrefix(vpcCIDR)}).AnyTimes()
+	mockNetwork.EXPECT().UseExternalSNAT().Return(false).AnyTimes()
+	mockNetwork.EXPECT().GetExcludeSNATCIDRs().Return([]netip.Prefix{netip.MustParsePrefix("10.12.0.0/16")}).AnyTimes()
+
+	ds := datastore.NewDataStore()
+	enis := make(map[string]string)
+	for i := 0; i < pods+perfSpareIPs; i++ {
+		eni := fmt.Sprintf("eni-%d", i/perfIPsPerENI)
+		if i%perfIPsPerENI == 0 {
+			if err := ds.AddENI(eni, i/perfIPsPerENI, i == 0); err != nil {
+				return nil, err
+			}
+		}
+		ip := fmt.Sprintf("10.0.%d.%d", i/200, i%200+1)
+		if err := ds.AddIPv4AddressFromStore(eni, ip); err != nil {
+			return nil, err
+		}
+		enis[ip] = eni
+	}
+	for i := 0; i < pods; i++ {
+		pod := &k8sapi.K8SPodInfo{Name: fmt.Sprintf("pod-%d", i), Namespace: "default", Container: fmt.Sprintf("c%d", i)}
+		if _, _, err := ds.AssignPodIPv4Address(pod); err != nil {
+			return nil, err
+		}
+	}
+	return &perfServer{
+		server:    server{ipamContext: &IPAMContext{awsClient: mockAWS, networkClient: mockNetwork, dataStore: ds}},
+		dataStore: ds,
+		enis:      enis,
+	}, nil
+}
+
+// addDelNetwork adds then deletes a pod, as the CNI plugin does when a pod starts and stops, and returns its IP
+func (s *perfServer) addDelNetwork(i int) (string, error) {
+	name := fmt.Sprintf("new-pod-%d", i)
+	container := fmt.Sprintf("new-c%d", i)
+	addReply, err := s.AddNetwork(context.Background(), &pb.AddNetworkRequest{
+		K8S_POD_NAME: name, K8S_POD_NAMESPACE: "default", K8S_POD_INFRA_CONTAINER_ID: container, IfName: "eth0"})
+	if err != nil {
+		return "", err
+	}
+	if !addReply.Success {
+		return "", fmt.Errorf("AddNetwork of pod %s failed", name)
+	}
+	delReply, err := s.DelNetwork(context.Background(), &pb.DelNetworkRequest{
+		K8S_POD_NAME: name, K8S_POD_NAMESPACE: "default", K8S_POD_INFRA_CONTAINER_ID: container,
+		IPv4Addr: addReply.IPv4Addr, Reason: "PodDeleted"})
+	if err != nil {
+		return "", err
+	}
+	if !delReply.Success {
+		return "", fmt.Errorf("DelNetwork of pod %s failed", name)
+	}
+	return addReply.IPv4Addr, nil
+}
+
+// recycle makes a released IP available again right away, instead of after its cooling period
+func (s *perfServer) recycle(ip string) error {
+	if err := s.dataStore.DelIPv4AddressFromStore(s.enis[ip], ip); err != nil {
+		return err
+	}
+	return s.dataStore.AddIPv4AddressFromStore(s.enis[ip], ip)
+}
+
+// disableLogging silences the logs, so that the ADD path is measured without the cost of writing them out
+func disableLogging() (restore func()) {
+	current := log.Current
+	_ = log.ReplaceLogger(log.Disabled)
+	return func() { _ = log.ReplaceLogger(current) }
+}
+
+func BenchmarkAddDelNetwork(b *testing.B) {
+	defer disableLogging()()
+	for _, pods := range perfPodCounts {
+		b.Run(fmt.Sprintf("pods=%d", pods), func(b *testing.B) {
+			ctrl := gomock.NewController(b)
+			defer ctrl.Finish()
+			s, err := newPerfServer(ctrl, pods)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ip, err := s.addDelNetwork(i)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				if err := s.recycle(ip); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/awsutils"
+)
+
+// envReducedPermissions is the name of the environment variable that makes ipamd disable the features whose IAM
+// permissions are denied, instead of exiting. Defaults to false.
+const envReducedPermissions = "AWS_VPC_K8S_CNI_REDUCED_PERMISSIONS"
+
+// permissionsState is the features disabled because their IAM permissions are denied
+type permissionsState struct {
+	noENIAllocation bool
+	noENIRelease    bool
+}
+
+func reducedPermissionsEnabled() bool {
+	return getEnvBoolWithDefault(envReducedPermissions, false)
+}
+
+// checkPermissions probes the IAM permissions of the features of ipamd. If some are denied, it returns an error listing
+// all of them, unless reduced permissions are allowed, in which case the features that need them are disabled. The core
+// permissions are always required.
+func (c *IPAMContext) checkPermissions() error {
+	missing := c.awsClient.CheckPermissions(awsutils.Features())
+	if len(missing) == 0 {
+		log.Info("The IAM permissions of all the features are granted")
+		return nil
+	}
+	description := describeMissingPermissions(missing)
+	if _, ok := missing[awsutils.FeatureCore]; ok || !reducedPermissionsEnabled() {
+		return errors.Errorf("missing IAM permissions: %s. Grant them to the IAM role of the node, or set %s=true to "+
+			"run without the features that need them", description, envReducedPermissions)
+	}
+
+	log.Warnf("Missing IAM permissions, running without the features that need them: %s", description)
+	_, c.permissions.noENIAllocation = missing[awsutils.FeatureENIAllocation]
+	_, c.permissions.noENIRelease = missing[awsutils.FeatureENIRelease]
+	return nil
+}
+
+// describeMissingPermissions lists the denied IAM actions by feature, e.g. "eni-tagging needs ec2:CreateTags"
+func describeMissingPermissions(missing map[string][]string) string {
+	features := make([]string, 0, len(missing))
+	for feature := range missing {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	parts := make([]string, 0, len(features))
+	for _, feature := range features {
+		parts = append(parts, fmt.Sprintf("%s needs %s", feature, strings.Join(missing[feature], ", ")))
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,270 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/networkutils"
+)
+
+// PodFlagsAnnotation is the annotation of a namespace or of a pod with the comma separated experimental flags of its
+// pods, e.g. "no-snat,mtu=1400,metadata-block". Boolean flags are on when named alone, or set with "=true" or "=false",
+// so that a pod can turn off a flag of its namespace. The flags of the pod override the ones of its namespace. Only the
+// flags listed in AWS_VPC_K8S_CNI_POD_FLAGS apply.
+const PodFlagsAnnotation = "vpc.amazonaws.com/experimental-flags"
+
+// SNATExcludeAnnotation is the annotation of a namespace or of a pod that keeps the traffic of its pods leaving the VPC
+// from being SNATed on the node when "true". The annotation of the pod overrides the one of its namespace, so that a pod
+// can be SNATed in a namespace that is not. It only applies when AWS_VPC_K8S_CNI_SNAT_EXCLUSION_ANNOTATIONS is enabled.
+const SNATExcludeAnnotation = "vpc.amazonaws.com/snat-exclude"
+
+// PodFlags are the experimental flags that apply to a pod
+type PodFlags struct {
+	NoSNAT        bool
+	MTU           int
+	DedicatedENI  bool
+	MetadataBlock bool
+	// Applied are the flags that apply to the pod, in the syntax of the annotation
+	Applied []string
+	// Ignored are the flags of the annotations that do not apply to the pod, with the reason
+	Ignored []string
+}
+
+// PodFlagsInfo is the introspection view of the experimental pod flags
+type PodFlagsInfo struct {
+	// Allowed are the flags the node applies
+	Allowed []string
+	// SNATExclusions is whether the node applies the SNAT exclusion annotations
+	SNATExclusions bool
+	// Pods are the flags of the pods whose annotations have any, by namespace/name
+	Pods map[string]PodFlags
+}
+
+type podFlagsState struct {
+	// allowed are the flags the node applies
+	allowed map[string]bool
+	// snatExclusions is whether the node applies the SNAT exclusion annotations
+	snatExclusions bool
+
+	lock sync.Mutex
+	// pods are the flags of the pods whose annotations have any, by namespace/name
+	pods map[string]PodFlags
+}
+
+func podFlagsKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// dedicatedENITenant is the tenant of the ENI of a pod with the dedicated-eni flag. Label values can not hold a "/", so
+// it never is the tenant of a namespace.
+func dedicatedENITenant(namespace, name string) string {
+	return "pod/" + namespace + "/" + name
+}
+
+// resolvePodFlags parses the annotations of a namespace and of one of its pods into the flags of the pod. The flags that
+// are unknown, not allowed, invalid or that do not work with the other settings of the pod are ignored.
+func resolvePodFlags(allowed map[string]bool, namespaceValue, podValue string, tenant string, wantsVF bool) PodFlags {
+	var flags PodFlags
+	values := make(map[string]string)
+	for _, annotation := range []string{namespaceValue, podValue} {
+		for _, item := range strings.Split(annotation, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			name, value := item, ""
+			if i := strings.Index(item, "="); i >= 0 {
+				name, value = item[:i], item[i+1:]
+			}
+			name = strings.ToLower(strings.TrimSpace(name))
+			if !isPodFlag(name) {
+				flags.Ignored = append(flags.Ignored, fmt.Sprintf("%s: unknown flag", item))
+				continue
+			}
+			values[name] = strings.TrimSpace(value)
+		}
+	}
+
+	for _, name := range networkutils.PodFlags {
+		value, ok := values[name]
+		if !ok {
+			continue
+		}
+		if !allowed[name] {
+			flags.Ignored = append(flags.Ignored, fmt.Sprintf("%s: not allowed on the node", name))
+			continue
+		}
+		if name == networkutils.PodFlagMTU {
+			mtu, err := strconv.Atoi(value)
+			if err != nil || !networkutils.ValidPodMTU(mtu) {
+				flags.Ignored = append(flags.Ignored, fmt.Sprintf("%s=%s: invalid MTU", name, value))
+				continue
+			}
+			if wantsVF {
+				flags.Ignored = append(flags.Ignored, fmt.Sprintf("%s=%d: the pod gets a VF", name, mtu))
+				continue
+			}
+			flags.MTU = mtu
+			flags.Applied = append(flags.Applied, fmt.Sprintf("%s=%d", name, mtu))
+			continue
+		}
+
+		on := true
+		if value != "" {
+			var err error
+			if on, err = strconv.ParseBool(value); err != nil {
+				flags.Ignored = append(flags.Ignored, fmt.Sprintf("%s=%s: invalid value", name, value))
+				continue
+			}
+		}
+		if !on {
+			continue
+		}
+		switch name {
+		case networkutils.PodFlagNoSNAT, networkutils.PodFlagMetadataBlock:
+			// The traffic of a VF does not go through the host, where the rules of the flags are
+			if wantsVF {
+				flags.Ignored = append(flags.Ignored, fmt.Sprintf("%s: the pod gets a VF", name))
+				continue
+			}
+			flags.NoSNAT = flags.NoSNAT || name == networkutils.PodFlagNoSNAT
+			flags.MetadataBlock = flags.MetadataBlock || name == networkutils.PodFlagMetadataBlock
+		case networkutils.PodFlagDedicatedENI:
+			if tenant != "" {
+				flags.Ignored = append(flags.Ignored, fmt.Sprintf("%s: the pod shares the ENIs of tenant %s", name, tenant))
+				continue
+			}
+			flags.DedicatedENI = true
+		}
+		flags.Applied = append(flags.Applied, name)
+	}
+	return flags
+}
+
+// resolveSNATExclusion applies the SNAT exclusion annotations of a namespace and of one of its pods to the flags of the
+// pod. An exclusion has the effect of the no-snat flag.
+func resolveSNATExclusion(flags *PodFlags, namespaceValue, podValue string, wantsVF bool) {
+	excluded := false
+	for _, value := range []string{namespaceValue, podValue} {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		on, err := strconv.ParseBool(value)
+		if err != nil {
+			flags.Ignored = append(flags.Ignored, fmt.Sprintf("%s=%s: invalid value", SNATExcludeAnnotation, value))
+			continue
+		}
+		excluded = on
+	}
+	if !excluded {
+		return
+	}
+	// The traffic of a VF does not go through the host, where the rule of the exclusion is
+	if wantsVF {
+		flags.Ignored = append(flags.Ignored, fmt.Sprintf("%s: the pod gets a VF", SNATExcludeAnnotation))
+		return
+	}
+	flags.NoSNAT = true
+	flags.Applied = append(flags.Applied, SNATExcludeAnnotation+"=true")
+}
+
+func isPodFlag(name string) bool {
+	for _, flag := range networkutils.PodFlags {
+		if flag == name {
+			return true
+		}
+	}
+	return false
+}
+
+// podFlagsAllowed returns whether the node applies any experimental pod flag, or the SNAT exclusion annotations
+func (c *IPAMContext) podFlagsAllowed() bool {
+	return len(c.podFlags.allowed) > 0 || c.podFlags.snatExclusions
+}
+
+// getPodFlags returns the experimental flags of a pod, from the annotations of its namespace and of the pod, including
+// its SNAT exclusion. The annotations are only read when the node applies some flags or the SNAT exclusions.
+func (c *IPAMContext) getPodFlags(meta *podMetadata, tenant string, wantsVF bool) (PodFlags, error) {
+	if !c.podFlagsAllowed() {
+		return PodFlags{}, nil
+	}
+	namespaceAnnotations, err := meta.getNamespaceAnnotations()
+	if err != nil {
+		return PodFlags{}, err
+	}
+	podAnnotations, err := meta.getPodAnnotations()
+	if err != nil {
+		return PodFlags{}, err
+	}
+	flags := resolvePodFlags(c.podFlags.allowed, namespaceAnnotations[PodFlagsAnnotation], podAnnotations[PodFlagsAnnotation],
+		tenant, wantsVF)
+	if c.podFlags.snatExclusions {
+		resolveSNATExclusion(&flags, namespaceAnnotations[SNATExcludeAnnotation], podAnnotations[SNATExcludeAnnotation],
+			wantsVF)
+	}
+	if len(flags.Ignored) > 0 {
+		log.Warnf("Ignoring annotations of pod %s, namespace %s: %s", meta.name, meta.namespace, strings.Join(flags.Ignored, "; "))
+	}
+	return flags, nil
+}
+
+// recordPodFlags keeps the flags of a pod for introspection, if its annotations have any
+func (c *IPAMContext) recordPodFlags(namespace, name string, flags PodFlags) {
+	if len(flags.Applied) == 0 && len(flags.Ignored) == 0 {
+		return
+	}
+	c.podFlags.lock.Lock()
+	defer c.podFlags.lock.Unlock()
+	if c.podFlags.pods == nil {
+		c.podFlags.pods = make(map[string]PodFlags)
+	}
+	c.podFlags.pods[podFlagsKey(namespace, name)] = flags
+}
+
+// forgetPodFlags drops the flags of a deleted pod
+func (c *IPAMContext) forgetPodFlags(namespace, name string) {
+	c.podFlags.lock.Lock()
+	defer c.podFlags.lock.Unlock()
+	delete(c.podFlags.pods, podFlagsKey(namespace, name))
+}
+
+// getPodFlagsInfo returns the flags the node applies and the flags of the pods
+func (c *IPAMContext) getPodFlagsInfo() PodFlagsInfo {
+	info := PodFlagsInfo{SNATExclusions: c.podFlags.snatExclusions, Pods: make(map[string]PodFlags)}
+	for _, flag := range networkutils.PodFlags {
+		if c.podFlags.allowed[flag] {
+			info.Allowed = append(info.Allowed, flag)
+		}
+	}
+	c.podFlags.lock.Lock()
+	defer c.podFlags.lock.Unlock()
+	for key, flags := range c.podFlags.pods {
+		info.Pods[key] = flags
+	}
+	return info
+}
+
+// podENITenant returns the tenant of the ENIs a pod gets its IPs from, which is a tenant of its own with the
+// dedicated-eni flag
+func podENITenant(tenant string, flags PodFlags, namespace, name string) string {
+	if flags.DedicatedENI {
+		return dedicatedENITenant(namespace, name)
+	}
+	return tenant
+}
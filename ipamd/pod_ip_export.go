@@ -0,0 +1,71 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/podipexport"
+)
+
+var podIPExportsPublished = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "awscni_pod_ip_exports_published",
+		Help: "The number of exports of the pod to IP mappings of the node that were published",
+	},
+)
+
+// StartPodIPExport periodically publishes the pod to IP mappings of the node, if a destination is configured
+func (c *IPAMContext) StartPodIPExport() {
+	if !podipexport.Enabled() {
+		return
+	}
+	publisher, err := podipexport.NewPublisher(c.k8sClient)
+	if err != nil {
+		log.Errorf("Failed to start exporting the pod IPs: %v", err)
+		ipamdErrInc("podIPExportStartFailed")
+		return
+	}
+	log.Info("Started exporting the pod IPs")
+	for {
+		c.publishPodIPExport(publisher)
+		time.Sleep(podipexport.GetInterval())
+	}
+}
+
+// publishPodIPExport publishes the pods of the datastore and their IPs
+func (c *IPAMContext) publishPodIPExport(publisher *podipexport.Publisher) {
+	var pods []podipexport.Mapping
+	for key, pod := range *c.dataStore.GetPodInfos() {
+		// The key is name_namespace_container, names and namespaces cannot contain underscores
+		parts := strings.SplitN(key, "_", 3)
+		if len(parts) != 3 || isFastPathPlaceholder(key) {
+			continue
+		}
+		pods = append(pods, podipexport.Mapping{Namespace: parts[1], Name: parts[0], IPv4: pod.IP, IPv6: pod.IPv6})
+	}
+	export := podipexport.NewExport(os.Getenv("MY_NODE_NAME"), c.awsClient.GetInstanceID(), pods)
+	if err := publisher.Publish(export); err != nil {
+		log.Warnf("Failed to publish the pod IPs: %v", err)
+		ipamdErrInc("podIPExportFailed")
+		return
+	}
+	podIPExportsPublished.Inc()
+	log.Debugf("Published the IPs of %d pods", len(pods))
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+)
+
+// podMetadata is the annotations of a pod, and the labels and annotations of its namespace, as needed by the features
+// of the node when the pod is added. Each of them is read at most once per pod, on first use, so that the features
+// share the same read.
+type podMetadata struct {
+	namespace, name string
+	k8sClient       k8sapi.K8SAPIs
+
+	podAnnotations       *metadataRead
+	namespaceLabels      *metadataRead
+	namespaceAnnotations *metadataRead
+}
+
+// metadataRead is the outcome of reading labels or annotations
+type metadataRead struct {
+	values map[string]string
+	err    error
+}
+
+func (c *IPAMContext) newPodMetadata(namespace, name string) *podMetadata {
+	return &podMetadata{namespace: namespace, name: name, k8sClient: c.k8sClient}
+}
+
+// getPodAnnotations returns the annotations of the pod
+func (m *podMetadata) getPodAnnotations() (map[string]string, error) {
+	if m.podAnnotations == nil {
+		values, err := m.k8sClient.K8SGetPodAnnotations(m.namespace, m.name)
+		m.podAnnotations = &metadataRead{values: values, err: err}
+	}
+	return m.podAnnotations.values, m.podAnnotations.err
+}
+
+// getNamespaceLabels returns the labels of the namespace of the pod
+func (m *podMetadata) getNamespaceLabels() (map[string]string, error) {
+	if m.namespaceLabels == nil {
+		values, err := m.k8sClient.K8SGetNamespaceLabels(m.namespace)
+		m.namespaceLabels = &metadataRead{values: values, err: err}
+	}
+	return m.namespaceLabels.values, m.namespaceLabels.err
+}
+
+// getNamespaceAnnotations returns the annotations of the namespace of the pod
+func (m *podMetadata) getNamespaceAnnotations() (map[string]string, error) {
+	if m.namespaceAnnotations == nil {
+		values, err := m.k8sClient.K8SGetNamespaceAnnotations(m.namespace)
+		m.namespaceAnnotations = &metadataRead{values: values, err: err}
+	}
+	return m.namespaceAnnotations.values, m.namespaceAnnotations.err
+}
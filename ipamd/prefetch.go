@@ -0,0 +1,89 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"os"
+
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/awsutils"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/capabilities"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/prefetch"
+)
+
+const (
+	// envPrefetchCache is the name of the environment variable that sets the prefetch cache file written by
+	// node-prefetch when the AMI of the node was built. The parts of it that still hold on the node are used instead of
+	// discovering them. Set it to "none" to always discover them.
+	envPrefetchCache = "AWS_VPC_K8S_CNI_PREFETCH_CACHE"
+)
+
+var prefetchCacheUsed = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "awscni_prefetch_cache_used",
+		Help: "Set to 1 for each part of the prefetch cache used instead of discovering it: capabilities, instance_limits or cluster",
+	},
+	[]string{"part"},
+)
+
+func getPrefetchCachePath() string {
+	if path := os.Getenv(envPrefetchCache); path != "" {
+		return path
+	}
+	return prefetch.DefaultPath
+}
+
+// usePrefetchCache applies the prefetch cache, if there is one. The capabilities are only used if they were probed with
+// the kernel and the iptables of this node. The instance limits only add instance types ipamd does not know. The
+// identity of the cluster is only a default for CLUSTER_NAME and CLUSTER_ID.
+func usePrefetchCache() {
+	path := getPrefetchCachePath()
+	if path == "none" {
+		return
+	}
+	cache, err := prefetch.Read(path)
+	if os.IsNotExist(err) {
+		log.Debugf("No prefetch cache %s", path)
+		return
+	}
+	if err != nil {
+		log.Warnf("Not using the prefetch cache: %v", err)
+		return
+	}
+	log.Infof("Using the prefetch cache %s written at %s", path, cache.CreatedAt)
+
+	if probed, err := cache.ValidCapabilities(); err != nil {
+		log.Infof("Probing the capabilities of the node, the cached ones are stale: %v", err)
+	} else if capabilities.Set(*probed) {
+		prefetchCacheUsed.WithLabelValues("capabilities").Set(1)
+	}
+
+	added := 0
+	for instanceType, limits := range cache.InstanceLimits {
+		if awsutils.AddInstanceLimits(instanceType, limits.ENIs, limits.IPsPerENI) {
+			log.Infof("Using the cached limits of instance type %s: %d ENIs of %d IPs", instanceType, limits.ENIs, limits.IPsPerENI)
+			added++
+		}
+	}
+	if added > 0 {
+		prefetchCacheUsed.WithLabelValues("instance_limits").Set(1)
+	}
+
+	if cache.ClusterName != "" {
+		awsutils.SetPrefetchedCluster(cache.ClusterName, cache.ClusterID)
+		prefetchCacheUsed.WithLabelValues("cluster").Set(1)
+	}
+}
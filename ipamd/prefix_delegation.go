@@ -0,0 +1,209 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"net/netip"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/aws/amazon-vpc-cni-k8s/ipamd/datastore"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/awsutils"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/cidr"
+)
+
+const (
+	// envPrefixDelegation is the name of the environment variable that makes ipamd assign /28 IPv4 prefixes to the
+	// ENIs instead of secondary IP addresses, and give pods the addresses of the prefixes. Each prefix takes the place
+	// of a secondary IP address in the limit of the ENI, so a node can have 16 times as many pod IPs, which only works
+	// on Nitro instances. Defaults to false.
+	envPrefixDelegation = "AWS_VPC_K8S_CNI_PREFIX_DELEGATION"
+
+	// ipsPerPrefix is the number of IPv4 addresses of the /28 prefixes EC2 assigns
+	ipsPerPrefix = 16
+)
+
+// prefixDelegationEnabled returns true if the ENIs get IPv4 prefixes instead of secondary IP addresses
+func prefixDelegationEnabled() bool {
+	return getEnvBoolWithDefault(envPrefixDelegation, false)
+}
+
+// maxPrefixesPerENI returns the number of prefixes an ENI can have, one per secondary IP address it could have
+func (c *IPAMContext) maxPrefixesPerENI() int {
+	return c.maxIPsPerENI / ipsPerPrefix
+}
+
+// prefixesToAllocate returns the number of prefixes to ask for on an ENI that has room for free more, only as many as
+// WARM_IP_TARGET needs if it is set
+func (c *IPAMContext) prefixesToAllocate(free int) int {
+	short, _, warmIPTargetDefined := c.ipTargetState()
+	if warmIPTargetDefined {
+		return min(free, (short+ipsPerPrefix-1)/ipsPerPrefix)
+	}
+	return free
+}
+
+// tryAssignPrefixes assigns more prefixes to an existing ENI that has room for them
+func (c *IPAMContext) tryAssignPrefixes() (increasedPool bool, err error) {
+	// If WARM_IP_TARGET is set, only proceed if we are short of target
+	short, _, warmIPTargetDefined := c.ipTargetState()
+	if warmIPTargetDefined && short == 0 {
+		return false, nil
+	}
+
+	eni, free := c.dataStore.GetENINeedsIPv4Prefix(c.maxPrefixesPerENI(), c.useCustomNetworking)
+	if eni == "" {
+		return false, nil
+	}
+	prefixes, err := c.awsClient.AllocIPv4Prefixes(eni, c.prefixesToAllocate(free))
+	if err != nil {
+		ipamdErrInc("increaseIPPoolAllocIPv4PrefixesFailed")
+		c.recordPoolError(err)
+		return false, errors.Wrapf(err, "failed to allocate IPv4 prefixes on ENI %s", eni)
+	}
+	if len(prefixes) == 0 {
+		// EC2 has no room for more prefixes on the ENI, e.g. because of secondary IP addresses ipamd does not know
+		return false, nil
+	}
+	c.addIPv4Prefixes(eni, prefixes)
+	return true, nil
+}
+
+// addIPv4Prefixes sets up the routes of prefixes assigned to an ENI and adds their addresses to the datastore
+func (c *IPAMContext) addIPv4Prefixes(eni string, prefixes []netip.Prefix) {
+	for _, prefix := range prefixes {
+		if !prefix.Addr().Is4() {
+			log.Errorf("Ignoring invalid prefix %q of ENI %s", prefix, eni)
+			ipamdErrInc("addIPv4PrefixInvalid")
+			continue
+		}
+		// The pods can use the addresses of the prefix without its route, so a failure is not fatal
+		err := c.networkClient.SetupIPv4PrefixRoute(prefix)
+		c.recordNetlinkResult(err)
+		if err != nil {
+			log.Errorf("Failed to set up the route of prefix %s of ENI %s: %v", prefix, eni, err)
+			ipamdErrInc("setupIPv4PrefixRouteFailed")
+		}
+		err = c.dataStore.AddIPv4PrefixToStore(eni, prefix)
+		if err != nil && err.Error() != datastore.DuplicatePrefixError {
+			log.Warnf("Failed to add prefix %s of ENI %s to the datastore: %v", prefix, eni, err)
+			ipamdErrInc("addIPv4PrefixFailed")
+		}
+	}
+}
+
+// deleteIPv4PrefixRoutes deletes the routes of prefixes that are no longer in the datastore
+func (c *IPAMContext) deleteIPv4PrefixRoutes(eni string, prefixes []netip.Prefix) {
+	for _, prefix := range prefixes {
+		err := c.networkClient.DeleteIPv4PrefixRoute(prefix)
+		c.recordNetlinkResult(err)
+		if err != nil {
+			log.Errorf("Failed to delete the route of prefix %s of ENI %s: %v", prefix, eni, err)
+			ipamdErrInc("deleteIPv4PrefixRouteFailed")
+		}
+	}
+}
+
+// reconcileIPv4Prefixes makes the datastore hold the addresses of the prefixes of an ENI, as reported by the instance
+// metadata service. Prefixes that were just released are left out until the instance metadata service catches up.
+func (c *IPAMContext) reconcileIPv4Prefixes(eni string, eniMetadata awsutils.ENIMetadata) {
+	prefixes, err := c.awsClient.GetENIIPv4Prefixes(eniMetadata.MAC)
+	if err != nil {
+		log.Errorf("Prefix reconcile: Failed to get the prefixes of ENI %s: %v", eni, err)
+		ipamdErrInc("prefixReconcileGetPrefixes")
+		return
+	}
+	existing, err := c.dataStore.GetENIIPv4Prefixes(eni)
+	if err != nil {
+		log.Errorf("Prefix reconcile: Failed to get the prefixes of ENI %s from the datastore: %v", eni, err)
+		return
+	}
+	inStore := make(map[netip.Prefix]bool, len(existing))
+	for _, prefix := range existing {
+		inStore[prefix] = true
+	}
+
+	var added []netip.Prefix
+	for _, prefix := range prefixes {
+		if inStore[prefix] {
+			delete(inStore, prefix)
+			continue
+		}
+		if found, recentlyFreed := c.reconcileCooldownCache.RecentlyFreed(prefix.String()); found && recentlyFreed {
+			log.Debugf("Reconcile skipping prefix %s on ENI %s because it was recently unassigned from the ENI.", prefix, eni)
+			continue
+		}
+		added = append(added, prefix)
+		reconcileCnt.With(prometheus.Labels{"fn": "prefixReconcileAdd"}).Inc()
+	}
+	c.addIPv4Prefixes(eni, added)
+
+	var deleted []netip.Prefix
+	for prefix := range inStore {
+		if err := c.dataStore.DelIPv4PrefixFromStore(eni, prefix); err != nil {
+			// Pods keep the addresses of a prefix that was unassigned outside of ipamd until they are deleted
+			log.Errorf("Failed to reconcile and delete prefix %s on ENI %s, %v", prefix, eni, err)
+			ipamdErrInc("prefixReconcileDel")
+			continue
+		}
+		deleted = append(deleted, prefix)
+		reconcileCnt.With(prometheus.Labels{"fn": "prefixReconcileDel"}).Inc()
+	}
+	c.deleteIPv4PrefixRoutes(eni, deleted)
+}
+
+// tryUnassignPrefixesFromAll releases the prefixes none of whose addresses are in use, as long as WARM_IP_TARGET is
+// set and enough addresses are left beyond it
+func (c *IPAMContext) tryUnassignPrefixesFromAll() {
+	_, over, warmIPTargetDefined := c.ipTargetState()
+	if !warmIPTargetDefined || over < ipsPerPrefix {
+		return
+	}
+	eniInfos := c.dataStore.GetENIInfos()
+	for eniID := range eniInfos.ENIIPPools {
+		prefixes, err := c.dataStore.GetUnusedIPv4Prefixes(eniID)
+		if err != nil {
+			log.Errorf("Error finding unused prefixes: %s", err)
+			return
+		}
+
+		var deleted []netip.Prefix
+		for _, prefix := range prefixes {
+			if over < ipsPerPrefix {
+				break
+			}
+			if err := c.dataStore.DelIPv4PrefixFromStore(eniID, prefix); err != nil {
+				log.Warnf("Failed to delete prefix %s on ENI %s from datastore: %s", prefix, eniID, err)
+				ipamdErrInc("decreaseIPPool")
+				continue
+			}
+			deleted = append(deleted, prefix)
+			over -= ipsPerPrefix
+		}
+		if len(deleted) == 0 {
+			continue
+		}
+		c.deleteIPv4PrefixRoutes(eniID, deleted)
+
+		if err := c.awsClient.DeallocIPv4Prefixes(eniID, deleted); err != nil {
+			log.Warnf("Failed to decrease IP pool by removing prefixes %v from ENI %s: %s", deleted, eniID, err)
+		} else {
+			log.Debugf("Successfully decreased IP pool by removing prefixes %v from ENI %s", deleted, eniID)
+		}
+		// Keep the reconciliation from adding the prefixes back while the instance metadata service lags behind
+		c.reconcileCooldownCache.Add(cidr.Strings(deleted))
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/aws/amazon-vpc-cni-k8s/ipamd/datastore"
+)
+
+const (
+	// primaryIPCheckInterval is how often the primary IP of the node is looked up again to find out if it changed
+	primaryIPCheckInterval = 60 * time.Second
+
+	// primaryIPChangedReason is the reason of the event recorded when the host network was updated for a new primary IP
+	primaryIPChangedReason = "PrimaryIPChanged"
+)
+
+// setupHostNetwork sets up the iptables rules and routing of the host for the given primary IP of the node
+func (c *IPAMContext) setupHostNetwork(primaryIP netip.Addr) error {
+	vpcCIDR := c.awsClient.GetVPCIPv4CIDR()
+	if !vpcCIDR.IsValid() {
+		log.Error("Unknown VPC IPv4 CIDR")
+		return errors.New("failed to retrieve VPC CIDR")
+	}
+
+	// Save what is about to change, so that a failed setup does not leave the node half configured
+	snapshot, err := c.networkClient.SnapshotHostNetwork()
+	if err != nil {
+		log.Warnf("Failed to save the host network before setting it up, it cannot be rolled back: %v", err)
+	}
+
+	err = c.networkClient.SetupHostNetwork(vpcCIDR, c.awsClient.GetVPCIPv4CIDRs(), c.awsClient.GetPrimaryENImac(), primaryIP)
+	if err == nil {
+		err = c.networkClient.VerifyHostNetwork()
+	}
+	if err != nil {
+		log.Error("Failed to set up host network", err)
+		c.rollBackHostNetwork(snapshot, err)
+		return errors.Wrap(err, "failed to set up host network")
+	}
+	c.reportHostNetworkSetup(nil, false)
+	return nil
+}
+
+// checkPrimaryIP runs every `interval` and looks up the primary IP of the node. If it changed, e.g. with some BYO-IP
+// workflows, the SNAT rule and the routes using the old IP are rewritten, so that aws-node does not need a restart.
+func (c *IPAMContext) checkPrimaryIP(interval time.Duration) {
+	if time.Since(c.lastPrimaryIPCheck) <= interval {
+		return
+	}
+	c.lastPrimaryIPCheck = time.Now()
+
+	primaryIP, err := c.awsClient.RefreshLocalIPv4()
+	if err != nil {
+		log.Warnf("Failed to look up the primary IP of the node: %v", err)
+		ipamdErrInc("refreshPrimaryIPFailed")
+		return
+	}
+	if primaryIP == c.hostPrimaryIP {
+		return
+	}
+
+	oldIP := c.hostPrimaryIP
+	log.Infof("The primary IP of the node changed from %s to %s, updating the host network", oldIP, primaryIP)
+	if err := c.setupHostNetwork(primaryIP); err != nil {
+		// Retried on the next check, since hostPrimaryIP still holds the old IP
+		log.Errorf("Failed to update the host network for primary IP %s: %v", primaryIP, err)
+		ipamdErrInc("primaryIPChangeFailed")
+		return
+	}
+	if err := c.networkClient.ReplaceRouteSrc(oldIP, primaryIP); err != nil {
+		log.Errorf("Failed to update the routes using primary IP %s: %v", oldIP, err)
+		ipamdErrInc("primaryIPChangeFailed")
+		return
+	}
+	// The new primary IP must not be handed out to pods by the reconciliation of the primary ENI
+	primaryENI := c.awsClient.GetPrimaryENI()
+	c.evictNewPrimaryIP(primaryENI, primaryIP.String())
+	c.primaryIP[primaryENI] = primaryIP.String()
+	c.hostPrimaryIP = primaryIP
+	reconcileCnt.With(prometheus.Labels{"fn": "primaryIPChanged"}).Inc()
+	c.emitNodeEvent(v1.EventTypeNormal, primaryIPChangedReason,
+		fmt.Sprintf("Updated the host network for primary IP %s, which replaced %s", primaryIP, oldIP))
+}
+
+// evictNewPrimaryIP removes the new primary IP of the node from the datastore when it was a secondary IP of the primary
+// ENI, and reports the pod it was handed out to, which now shares its IP with the host
+func (c *IPAMContext) evictNewPrimaryIP(eni string, primaryIP string) {
+	pod, err := c.dataStore.EvictIPv4Address(eni, primaryIP)
+	if err != nil {
+		if err.Error() != datastore.UnknownIPError {
+			log.Errorf("Failed to evict new primary IP %s of ENI %s: %v", primaryIP, eni, err)
+			ipamdErrInc("primaryIPEvictFailed")
+		}
+		return
+	}
+	log.Warnf("New primary IP %s was a secondary IP of ENI %s, evicted it from the datastore", primaryIP, eni)
+	reconcileCnt.With(prometheus.Labels{"fn": "primaryIPEvict"}).Inc()
+	if pod != nil {
+		c.writeCheckpoint()
+		c.reportEvictedPod(pod, fmt.Sprintf("IP %s became the primary IP of the node", primaryIP))
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var quarantinedIPs = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "awscni_quarantined_ip_count",
+		Help: "The number of secondary IPs returned by EC2 that are not handed to pods because they are not valid for their ENI",
+	},
+)
+
+// ipQuarantine keeps the secondary IPs of ENIs that are not IPv4 addresses of the subnet of their ENI, e.g. when EC2
+// returned addresses of a subnet whose CIDR was being edited. They are never added to the datastore, so that pods do not
+// get an IP that can not be routed.
+type ipQuarantine struct {
+	lock sync.Mutex
+	// subnets maps each ENI to the CIDR of its subnet
+	subnets map[string]eniSubnet
+	// ips maps each quarantined IP to why it was rejected
+	ips map[string]QuarantinedIP
+}
+
+// eniSubnet is the subnet of an ENI, with the strings the quarantined IPs of the ENI share
+type eniSubnet struct {
+	eni    string
+	subnet netip.Prefix
+	cidr   string
+}
+
+// QuarantinedIP is a rejected secondary IP, as shown by the introspection endpoint
+type QuarantinedIP struct {
+	IP         string
+	ENI        string
+	SubnetCIDR string
+	Reason     string
+	Since      time.Time
+}
+
+// setENISubnet records the subnet CIDR of an ENI, against which its secondary IPs are validated
+func (c *IPAMContext) setENISubnet(eni string, subnet netip.Prefix) {
+	if !subnet.IsValid() {
+		log.Warnf("Unknown subnet CIDR of ENI %s, its IPs are only checked to be IPv4", eni)
+	}
+
+	c.quarantine.lock.Lock()
+	defer c.quarantine.lock.Unlock()
+	if c.quarantine.subnets == nil {
+		c.quarantine.subnets = make(map[string]eniSubnet)
+	}
+	cidr := ""
+	if subnet.IsValid() {
+		cidr = subnet.String()
+	}
+	c.quarantine.subnets[eni] = eniSubnet{eni: eni, subnet: subnet, cidr: cidr}
+}
+
+// validateENIAddress returns whether a secondary IP of an ENI can be added to the datastore. An IP that is not an IPv4
+// address in the subnet of the ENI is quarantined instead.
+func (c *IPAMContext) validateENIAddress(eni string, ipv4 string) bool {
+	c.quarantine.lock.Lock()
+	defer c.quarantine.lock.Unlock()
+
+	eniSubnet, known := c.quarantine.subnets[eni]
+	subnet := eniSubnet.subnet
+	ip, err := netip.ParseAddr(ipv4)
+	reason := ""
+	switch {
+	case err != nil:
+		reason = "not an IP address"
+	case !ip.Unmap().Is4():
+		reason = "not an IPv4 address"
+	case subnet.IsValid() && !subnet.Contains(ip.Unmap()):
+		reason = fmt.Sprintf("outside of the subnet %s of the ENI", subnet)
+	}
+	if reason == "" {
+		if _, ok := c.quarantine.ips[ipv4]; ok {
+			log.Infof("Releasing IP %s of ENI %s from quarantine", ipv4, eni)
+			delete(c.quarantine.ips, ipv4)
+			quarantinedIPs.Set(float64(len(c.quarantine.ips)))
+		}
+		return true
+	}
+
+	if _, ok := c.quarantine.ips[ipv4]; ok {
+		return false
+	}
+	log.Warnf("Quarantining IP %s of ENI %s: %s", ipv4, eni, reason)
+	ipamdErrInc("ipQuarantined")
+	if c.quarantine.ips == nil {
+		c.quarantine.ips = make(map[string]QuarantinedIP)
+	}
+	if known {
+		// The IPs of an ENI share the strings of its subnet
+		eni = eniSubnet.eni
+	}
+	c.quarantine.ips[ipv4] = QuarantinedIP{IP: ipv4, ENI: eni, SubnetCIDR: eniSubnet.cidr, Reason: reason,
+		Since: time.Now()}
+	quarantinedIPs.Set(float64(len(c.quarantine.ips)))
+	return false
+}
+
+// pruneQuarantine forgets the quarantined IPs of an ENI that are no longer assigned to it. A nil list removes all of
+// them, for an ENI that is gone.
+func (c *IPAMContext) pruneQuarantine(eni string, assignedIPs []string) {
+	c.quarantine.lock.Lock()
+	defer c.quarantine.lock.Unlock()
+
+	assigned := make(map[string]bool, len(assignedIPs))
+	for _, ip := range assignedIPs {
+		assigned[ip] = true
+	}
+	for ip, entry := range c.quarantine.ips {
+		if entry.ENI == eni && !assigned[ip] {
+			log.Infof("Forgetting quarantined IP %s, which is no longer assigned to ENI %s", ip, eni)
+			delete(c.quarantine.ips, ip)
+		}
+	}
+	if assignedIPs == nil {
+		delete(c.quarantine.subnets, eni)
+	}
+	quarantinedIPs.Set(float64(len(c.quarantine.ips)))
+}
+
+// getQuarantinedIPs returns the quarantined IPs, sorted by IP
+func (c *IPAMContext) getQuarantinedIPs() []QuarantinedIP {
+	c.quarantine.lock.Lock()
+	defer c.quarantine.lock.Unlock()
+
+	ips := make([]QuarantinedIP, 0, len(c.quarantine.ips))
+	for _, entry := range c.quarantine.ips {
+		ips = append(ips, entry)
+	}
+	sort.Slice(ips, func(i, j int) bool { return ips[i].IP < ips[j].IP })
+	return ips
+}
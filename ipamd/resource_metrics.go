@@ -0,0 +1,170 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// envMetricsPerENI is the name of the environment variable that adds metrics with a series per ENI. Defaults to
+	// false.
+	envMetricsPerENI = "AWS_VPC_K8S_CNI_METRICS_PER_ENI"
+
+	// envMetricsPerPod is the name of the environment variable that adds metrics with a series per pod. Defaults to
+	// false.
+	envMetricsPerPod = "AWS_VPC_K8S_CNI_METRICS_PER_POD"
+
+	// envMetricsMaxSeries is the name of the environment variable with the maximum number of series of each per-ENI
+	// and per-pod metric, the others are dropped. Defaults to 500.
+	envMetricsMaxSeries     = "AWS_VPC_K8S_CNI_METRICS_MAX_SERIES"
+	defaultMetricsMaxSeries = 500
+)
+
+var (
+	eniIPAddressesDesc = prometheus.NewDesc(
+		"awscni_eni_ip_addresses",
+		"The number of IPv4 addresses of each ENI, by state",
+		[]string{"eni", "device", "state"}, nil,
+	)
+	podIPInfoDesc = prometheus.NewDesc(
+		"awscni_pod_ip_info",
+		"The IPs of each pod, the value is always 1",
+		[]string{"namespace", "pod", "ipv4", "ipv6", "device"}, nil,
+	)
+	metricsSeriesDroppedDesc = prometheus.NewDesc(
+		"awscni_metrics_series_dropped",
+		"The number of series left out of the last scrape of a metric because of AWS_VPC_K8S_CNI_METRICS_MAX_SERIES",
+		[]string{"metric"}, nil,
+	)
+)
+
+func metricsPerENIEnabled() bool {
+	return getEnvBoolWithDefault(envMetricsPerENI, false)
+}
+
+func metricsPerPodEnabled() bool {
+	return getEnvBoolWithDefault(envMetricsPerPod, false)
+}
+
+func getMetricsMaxSeries() int {
+	return getNonNegativeIntEnvVar(envMetricsMaxSeries, defaultMetricsMaxSeries)
+}
+
+// resourceMetrics is a collector of the metrics with a series per ENI or per pod. They are computed from the datastore
+// on each scrape, so that the series of ENIs and pods that are gone disappear, and are capped so that large nodes do not
+// overwhelm Prometheus.
+type resourceMetrics struct {
+	ipam      *IPAMContext
+	perENI    bool
+	perPod    bool
+	maxSeries int
+}
+
+// registerResourceMetrics registers the per-ENI and per-pod metrics that are enabled, none by default
+func (c *IPAMContext) registerResourceMetrics() {
+	collector := &resourceMetrics{
+		ipam:      c,
+		perENI:    metricsPerENIEnabled(),
+		perPod:    metricsPerPodEnabled(),
+		maxSeries: getMetricsMaxSeries(),
+	}
+	if !collector.perENI && !collector.perPod {
+		return
+	}
+	if err := prometheus.Register(collector); err != nil {
+		log.Errorf("Failed to register the per-ENI and per-pod metrics: %v", err)
+	}
+}
+
+// Describe sends the descriptors of the enabled metrics
+func (m *resourceMetrics) Describe(ch chan<- *prometheus.Desc) {
+	if m.perENI {
+		ch <- eniIPAddressesDesc
+	}
+	if m.perPod {
+		ch <- podIPInfoDesc
+	}
+	ch <- metricsSeriesDroppedDesc
+}
+
+// Collect sends the series of the enabled metrics, sorted so that the same ones are kept on each scrape
+func (m *resourceMetrics) Collect(ch chan<- prometheus.Metric) {
+	if m.perENI {
+		var series []prometheus.Metric
+		eniInfos := m.ipam.dataStore.GetENIInfos()
+		enis := make([]string, 0, len(eniInfos.ENIIPPools))
+		for eni := range eniInfos.ENIIPPools {
+			enis = append(enis, eni)
+		}
+		sort.Strings(enis)
+		for _, eni := range enis {
+			pool := eniInfos.ENIIPPools[eni]
+			device := strconv.Itoa(pool.DeviceNumber)
+			assigned := float64(pool.AssignedIPv4Addresses)
+			free := float64(len(pool.IPv4Addresses)) - assigned
+			series = append(series,
+				prometheus.MustNewConstMetric(eniIPAddressesDesc, prometheus.GaugeValue, assigned, eni, device, "assigned"),
+				prometheus.MustNewConstMetric(eniIPAddressesDesc, prometheus.GaugeValue, free, eni, device, "free"))
+		}
+		m.send(ch, "awscni_eni_ip_addresses", series)
+	}
+	if m.perPod {
+		var series []prometheus.Metric
+		pods := *m.ipam.dataStore.GetPodInfos()
+		keys := make([]string, 0, len(pods))
+		for key := range pods {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			// The key is name_namespace_container, names and namespaces cannot contain underscores
+			parts := strings.SplitN(key, "_", 3)
+			if len(parts) != 3 || isFastPathPlaceholder(key) {
+				continue
+			}
+			pod := pods[key]
+			series = append(series, prometheus.MustNewConstMetric(podIPInfoDesc, prometheus.GaugeValue, 1,
+				parts[1], parts[0], pod.IP, pod.IPv6, strconv.Itoa(pod.DeviceNumber)))
+		}
+		m.send(ch, "awscni_pod_ip_info", series)
+	}
+}
+
+// send sends at most maxSeries series of a metric, and the number of the others
+func (m *resourceMetrics) send(ch chan<- prometheus.Metric, name string, series []prometheus.Metric) {
+	dropped := 0
+	if len(series) > m.maxSeries {
+		dropped = len(series) - m.maxSeries
+		series = series[:m.maxSeries]
+	}
+	for _, metric := range series {
+		ch <- metric
+	}
+	ch <- prometheus.MustNewConstMetric(metricsSeriesDroppedDesc, prometheus.GaugeValue, float64(dropped), name)
+}
+
+// getResourceMetricsConfigForDebug returns the configuration of the per-ENI and per-pod metrics
+func getResourceMetricsConfigForDebug() map[string]interface{} {
+	return map[string]interface{}{
+		envMetricsPerENI:    metricsPerENIEnabled(),
+		envMetricsPerPod:    metricsPerPodEnabled(),
+		envMetricsMaxSeries: getMetricsMaxSeries(),
+	}
+}
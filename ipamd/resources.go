@@ -0,0 +1,217 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// envMemoryWatermark is the name of the environment variable that sets the percentage of the memory limit of the
+	// aws-node container above which ipamd collects garbage more aggressively and returns the freed memory to the OS,
+	// to stay clear of the OOM killer. The limit is read from cgroup v2, or v1. Defaults to 0, off.
+	envMemoryWatermark = "AWS_VPC_K8S_CNI_MEMORY_WATERMARK"
+
+	// envGoroutineWatermark is the name of the environment variable that sets the number of goroutines above which
+	// ipamd reports that it is leaking them. Defaults to 0, off.
+	envGoroutineWatermark = "AWS_VPC_K8S_CNI_GOROUTINE_WATERMARK"
+
+	// resourceCheckInterval is how often the memory usage and number of goroutines are checked
+	resourceCheckInterval = 10 * time.Second
+
+	// aggressiveGCPercent is the GOGC value used while the memory usage is above the watermark
+	aggressiveGCPercent = 25
+	defaultGCPercent    = 100
+
+	// cgroupRoot is where the cgroup of the aws-node container is mounted
+	cgroupRoot = "/sys/fs/cgroup"
+
+	// cgroupV1Unlimited is the lowest cgroup v1 memory limit that means no limit. The actual value is the largest
+	// multiple of the page size, which depends on the architecture and kernel, e.g. 4KiB on x86_64 and up to 64KiB on
+	// arm64.
+	cgroupV1Unlimited = 1 << 62
+)
+
+var (
+	memoryUsage = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "awscni_ipamd_memory_usage_bytes",
+			Help: "The memory usage of the aws-node container, as accounted by its cgroup",
+		},
+	)
+	memoryLimit = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "awscni_ipamd_memory_limit_bytes",
+			Help: "The memory limit of the aws-node container, 0 if there is none",
+		},
+	)
+	memoryWatermarkRatio = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "awscni_ipamd_memory_watermark_ratio",
+			Help: "The memory usage of the aws-node container relative to the watermark, shedding starts at 1",
+		},
+	)
+	goroutines = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "awscni_ipamd_goroutines",
+			Help: "The number of goroutines in ipamd",
+		},
+	)
+	watermarkExceededCnt = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "awscni_ipamd_watermark_exceeded_count",
+			Help: "The number of resource checks that found a watermark exceeded, by watermark: memory or goroutines",
+		},
+		[]string{"watermark"},
+	)
+)
+
+// resourceMonitor reports how close ipamd is to its memory limit, and keeps it below its memory watermark. There is
+// no cache in ipamd worth dropping, so going above the watermark only makes the garbage collector work harder.
+type resourceMonitor struct {
+	cgroupRoot         string
+	memoryWatermark    int
+	goroutineWatermark int
+	// collecting is true while the memory usage is above the watermark
+	collecting bool
+}
+
+// StartResourceMonitor periodically reports the memory usage and number of goroutines of ipamd, and collects garbage
+// more aggressively when the memory usage goes above its watermark
+func (c *IPAMContext) StartResourceMonitor() {
+	m := &resourceMonitor{
+		cgroupRoot:         cgroupRoot,
+		memoryWatermark:    getMemoryWatermark(),
+		goroutineWatermark: getGoroutineWatermark(),
+	}
+	for {
+		m.check()
+		time.Sleep(resourceCheckInterval)
+	}
+}
+
+// check reports the resource usage and compares it with the watermarks
+func (m *resourceMonitor) check() {
+	numGoroutines := runtime.NumGoroutine()
+	goroutines.Set(float64(numGoroutines))
+	if m.goroutineWatermark > 0 && numGoroutines > m.goroutineWatermark {
+		log.Warnf("ipamd is running %d goroutines, above the watermark of %d", numGoroutines, m.goroutineWatermark)
+		watermarkExceededCnt.WithLabelValues("goroutines").Inc()
+	}
+
+	memoryExceeded := false
+	usage, limit, err := cgroupMemory(m.cgroupRoot)
+	if err != nil {
+		log.Debugf("Unable to read the memory usage of the container: %v", err)
+	} else {
+		memoryUsage.Set(float64(usage))
+		memoryLimit.Set(float64(limit))
+		if m.memoryWatermark > 0 && limit > 0 {
+			watermark := limit / 100 * uint64(m.memoryWatermark)
+			memoryWatermarkRatio.Set(float64(usage) / float64(watermark))
+			memoryExceeded = usage > watermark
+		}
+	}
+	if memoryExceeded {
+		if !m.collecting {
+			log.Warnf("Memory usage of %d bytes is above the watermark of %d%% of the %d bytes limit, collecting garbage more often",
+				usage, m.memoryWatermark, limit)
+			debug.SetGCPercent(aggressiveGCPercent)
+			m.collecting = true
+		}
+		watermarkExceededCnt.WithLabelValues("memory").Inc()
+		// Return the freed memory to the OS, so that it no longer counts against the limit
+		debug.FreeOSMemory()
+	} else if m.collecting {
+		log.Infof("Memory usage of %d bytes is back below the watermark", usage)
+		debug.SetGCPercent(defaultGCPercent)
+		m.collecting = false
+	}
+}
+
+// cgroupMemory returns the memory usage and limit of the cgroup mounted at root, from cgroup v2 or else v1. The limit
+// is 0 if there is none.
+func cgroupMemory(root string) (usage, limit uint64, err error) {
+	// cgroup v2 has a single hierarchy with the memory controller files at its root
+	if limitStr, err := readCgroupFile(filepath.Join(root, "memory.max")); err == nil {
+		if limitStr != "max" {
+			if limit, err = strconv.ParseUint(limitStr, 10, 64); err != nil {
+				return 0, 0, errors.Wrap(err, "failed to parse cgroup v2 memory limit")
+			}
+		}
+		usage, err = readCgroupUint(filepath.Join(root, "memory.current"))
+		return usage, limit, errors.Wrap(err, "failed to read cgroup v2 memory usage")
+	}
+
+	limit, err = readCgroupUint(filepath.Join(root, "memory", "memory.limit_in_bytes"))
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to read cgroup memory limit")
+	}
+	if limit >= cgroupV1Unlimited {
+		limit = 0
+	}
+	usage, err = readCgroupUint(filepath.Join(root, "memory", "memory.usage_in_bytes"))
+	return usage, limit, errors.Wrap(err, "failed to read cgroup v1 memory usage")
+}
+
+func readCgroupFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func readCgroupUint(path string) (uint64, error) {
+	content, err := readCgroupFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(content, 10, 64)
+}
+
+func getMemoryWatermark() int {
+	watermark := getNonNegativeIntEnvVar(envMemoryWatermark, 0)
+	if watermark > 100 {
+		log.Errorf("%s must be at most 100; using default: 0", envMemoryWatermark)
+		return 0
+	}
+	return watermark
+}
+
+func getGoroutineWatermark() int {
+	return getNonNegativeIntEnvVar(envGoroutineWatermark, 0)
+}
+
+func getNonNegativeIntEnvVar(name string, defaultValue int) int {
+	if strValue := os.Getenv(name); strValue != "" {
+		parsedValue, err := strconv.Atoi(strValue)
+		if err == nil && parsedValue >= 0 {
+			return parsedValue
+		}
+		log.Errorf("Failed to parse %s %q; using default: %d", name, strValue, defaultValue)
+	}
+	return defaultValue
+}
@@ -0,0 +1,158 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// routeTableCheckInterval is how often the route tables are checked for ones left behind by ENIs that are detached
+const routeTableCheckInterval = 60 * time.Second
+
+var leakedRouteTablesFlushed = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "awscni_leaked_route_tables_flushed_count",
+		Help: "The number of route tables flushed because no attached ENI uses them",
+	},
+)
+
+// RouteTable is a route table of an ENI, which uses its device number as the table ID
+type RouteTable struct {
+	Table int
+	// ENI is the ENI that owns the table, empty when the table is leaked
+	ENI string
+}
+
+// routeTablesState is the route tables found by the last check
+type routeTablesState struct {
+	lock      sync.Mutex
+	tables    []RouteTable
+	lastCheck time.Time
+}
+
+// routeTableOwners returns the route table of each secondary ENI in the datastore, the primary ENI uses the main table
+func (c *IPAMContext) routeTableOwners() map[int]string {
+	owners := make(map[int]string)
+	for eniID, eni := range c.dataStore.GetENIInfos().ENIIPPools {
+		if !eni.IsPrimary {
+			owners[eni.DeviceNumber] = eniID
+		}
+	}
+	return owners
+}
+
+// isENIRouteTable returns whether the table ID is in the range of the device numbers of ENIs. Tables outside of it
+// belong to others and are never flushed.
+func (c *IPAMContext) isENIRouteTable(table int) bool {
+	return table > 0 && table < c.maxENI
+}
+
+// checkRouteTables runs every `interval` and flushes the route tables of ENIs that are no longer attached. Their routes
+// and rules would otherwise blackhole the traffic of a new ENI that gets the same device number.
+func (c *IPAMContext) checkRouteTables(interval time.Duration) {
+	c.routeTables.lock.Lock()
+	defer c.routeTables.lock.Unlock()
+	if time.Since(c.routeTables.lastCheck) <= interval {
+		return
+	}
+	c.routeTables.lastCheck = time.Now()
+
+	tableIDs, err := c.networkClient.GetRouteTableIDs()
+	c.recordNetlinkResult(err)
+	if err != nil {
+		log.Warnf("Failed to list the route tables: %v", err)
+		ipamdErrInc("checkRouteTablesFailed")
+		return
+	}
+	owners := c.routeTableOwners()
+	var tables []RouteTable
+	for table, eni := range owners {
+		tables = append(tables, RouteTable{Table: table, ENI: eni})
+	}
+	for _, table := range tableIDs {
+		if _, ok := owners[table]; ok || !c.isENIRouteTable(table) {
+			continue
+		}
+		log.Warnf("Route table %d is not used by any attached ENI, flushing it", table)
+		err := c.networkClient.FlushRouteTable(table)
+		c.recordNetlinkResult(err)
+		if err != nil {
+			log.Errorf("Failed to flush leaked route table %d: %v", table, err)
+			ipamdErrInc("flushRouteTableFailed")
+			tables = append(tables, RouteTable{Table: table})
+			continue
+		}
+		leakedRouteTablesFlushed.Inc()
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Table < tables[j].Table })
+	c.routeTables.tables = tables
+}
+
+// reclaimRouteTable flushes the route table of a newly attached ENI, in case the previous ENI with the same device
+// number left routes or rules behind, and checks that nothing is left of them. The ENI must not be used until it
+// succeeds, since leftovers of an ENI in another subnet would blackhole the traffic of its pods.
+func (c *IPAMContext) reclaimRouteTable(table int) error {
+	if !c.isENIRouteTable(table) {
+		return nil
+	}
+	inUse, err := c.routeTableInUse(table)
+	if err != nil || !inUse {
+		return err
+	}
+	log.Warnf("Route table %d of a new ENI is already in use, flushing it", table)
+	if err := c.networkClient.FlushRouteTable(table); err != nil {
+		ipamdErrInc("flushRouteTableFailed")
+		return errors.Wrapf(err, "failed to flush route table %d", table)
+	}
+	leakedRouteTablesFlushed.Inc()
+	// Routes or rules added while flushing, or that could not be listed, would be left behind
+	if inUse, err = c.routeTableInUse(table); err != nil {
+		return err
+	}
+	if inUse {
+		ipamdErrInc("flushRouteTableFailed")
+		return errors.Errorf("route table %d still has routes or rules after being flushed", table)
+	}
+	return nil
+}
+
+// routeTableInUse returns whether the route table has routes or rules that look it up
+func (c *IPAMContext) routeTableInUse(table int) (bool, error) {
+	tableIDs, err := c.networkClient.GetRouteTableIDs()
+	if err != nil {
+		ipamdErrInc("checkRouteTablesFailed")
+		return false, errors.Wrap(err, "failed to list the route tables")
+	}
+	for _, tableID := range tableIDs {
+		if tableID == table {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// getRouteTables returns the route tables found by the last check, with the ENI that owns each of them
+func (c *IPAMContext) getRouteTables() []RouteTable {
+	c.routeTables.lock.Lock()
+	defer c.routeTables.lock.Unlock()
+	tables := make([]RouteTable, len(c.routeTables.tables))
+	copy(tables, c.routeTables.tables)
+	return tables
+}
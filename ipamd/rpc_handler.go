@@ -32,13 +32,32 @@ import (
 	log "github.com/cihub/seelog"
 
 	"github.com/aws/amazon-vpc-cni-k8s/ipamd/datastore"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/awsutils"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/ipamevents"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/networkutils"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/cidr"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/faultinjection"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/tracing"
 )
 
 const (
 	ipamdgRPCaddress = "127.0.0.1:50051"
+
+	// maxBulkAddNetworkRequests is the number of sandboxes a BulkAddNetwork call can add, so that a single call does
+	// not hold the IP pool for long
+	maxBulkAddNetworkRequests = 256
+
+	// envGRPCReflection enables the gRPC reflection service, so that ipamd-cli and tools like grpcurl can list and
+	// call the ipamd API without its protobuf definitions
+	envGRPCReflection = "AWS_VPC_K8S_CNI_GRPC_REFLECTION"
 )
 
+// grpcReflectionEnabled returns true if the gRPC reflection service should be registered
+func grpcReflectionEnabled() bool {
+	return getEnvBoolWithDefault(envGRPCReflection, false)
+}
+
 // server controls RPC service responses.
 type server struct {
 	ipamContext *IPAMContext
@@ -46,46 +65,304 @@ type server struct {
 
 // AddNetwork processes CNI add network request and return an IP address for container
 func (s *server) AddNetwork(ctx context.Context, in *pb.AddNetworkRequest) (*pb.AddNetworkReply, error) {
-	log.Infof("Received AddNetwork for NS %s, Pod %s, NameSpace %s, Container %s, ifname %s",
+	trace := tracing.FromIncomingContext(ctx)
+	resp := s.addNetwork(trace, in, make(map[bool][]string))
+	if resp.Success {
+		s.ipamContext.writeCheckpoint()
+	}
+	if err := faultinjection.Inject(faultinjection.GRPCPrefix + "AddNetwork"); err != nil {
+		// Drop the reply after the IP is assigned, as if it was lost on the way to the CNI plugin
+		return nil, trace.Wrap(err)
+	}
+	return resp, nil
+}
+
+// BulkAddNetwork assigns IPs to the sandboxes a runtime creates ahead of time for a batch job, in one call. The replies
+// are in the order of the requests, and each sandbox succeeds or fails on its own. The IPv4 addresses are assigned
+// holding the lock of the datastore once, and the routes of the pods are computed and the checkpoint is written once,
+// for the whole batch.
+func (s *server) BulkAddNetwork(ctx context.Context, in *pb.BulkAddNetworkRequest) (*pb.BulkAddNetworkReply, error) {
+	trace := tracing.FromIncomingContext(ctx)
+	if len(in.Requests) > maxBulkAddNetworkRequests {
+		return nil, errors.Errorf("BulkAddNetwork: %d sandboxes requested, at most %d can be added at once",
+			len(in.Requests), maxBulkAddNetworkRequests)
+	}
+	trace.Infof("Received BulkAddNetwork for %d sandboxes", len(in.Requests))
+
+	adds := make([]*podAdd, len(in.Requests))
+	var k8sPods []*k8sapi.K8SPodInfo
+	for i, req := range in.Requests {
+		adds[i] = s.prepareAddNetwork(trace, req)
+		if adds[i].k8sPod != nil {
+			k8sPods = append(k8sPods, adds[i].k8sPod)
+		}
+	}
+	results := s.ipamContext.assignPodIPv4Addresses(k8sPods)
+
+	routeCIDRs := make(map[bool][]string)
+	resp := &pb.BulkAddNetworkReply{}
+	assigned := 0
+	for i, req := range in.Requests {
+		add := adds[i]
+		if add.k8sPod != nil {
+			add.addr, add.deviceNumber, add.err = results[0].IP, results[0].DeviceNumber, results[0].Err
+			results = results[1:]
+			s.setUpPodIPs(trace, req, add)
+		}
+		reply := s.addNetworkReply(trace, req, add, routeCIDRs)
+		if reply.Success {
+			assigned++
+		}
+		resp.Replies = append(resp.Replies, reply)
+	}
+	if assigned > 0 {
+		s.ipamContext.writeCheckpoint()
+	}
+	trace.Infof("Send BulkAddNetworkReply: %d of %d sandboxes got an IP", assigned, len(in.Requests))
+	if err := faultinjection.Inject(faultinjection.GRPCPrefix + "BulkAddNetwork"); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return resp, nil
+}
+
+// podAdd is the ADD of a sandbox, from its checks to its reply
+type podAdd struct {
+	addr, addr6, gateway, vf, subnet, branchMAC, trunkIfName string
+	deviceNumber, vlanID                                     int
+	securityGroups                                           []string
+	wantsVF, ipv6First                                       bool
+	tenant                                                   string
+	flags                                                    PodFlags
+	// meta is the annotations and labels of the pod and its namespace, read once for all the checks
+	meta *podMetadata
+	// k8sPod is the pod that gets its IPv4 address from the datastore, nil if it gets a branch ENI or failed a check
+	k8sPod *k8sapi.K8SPodInfo
+	err    error
+}
+
+// addNetwork assigns the IPs of a sandbox, routeCIDRs caches the routes of the pods by whether SNAT is external
+func (s *server) addNetwork(trace tracing.Trace, in *pb.AddNetworkRequest, routeCIDRs map[bool][]string) *pb.AddNetworkReply {
+	add := s.prepareAddNetwork(trace, in)
+	if add.k8sPod != nil {
+		add.addr, add.deviceNumber, add.err = s.ipamContext.assignPodIPv4Address(add.k8sPod)
+		s.setUpPodIPs(trace, in, add)
+	}
+	return s.addNetworkReply(trace, in, add, routeCIDRs)
+}
+
+// prepareAddNetwork runs the checks of the ADD of a sandbox, and assigns a branch ENI to the pod if it has security
+// groups. Otherwise the pod to assign an IPv4 address to is returned, unless a check failed.
+func (s *server) prepareAddNetwork(trace tracing.Trace, in *pb.AddNetworkRequest) *podAdd {
+	trace.Infof("Received AddNetwork for NS %s, Pod %s, NameSpace %s, Container %s, ifname %s",
 		in.Netns, in.K8S_POD_NAME, in.K8S_POD_NAMESPACE, in.K8S_POD_INFRA_CONTAINER_ID, in.IfName)
 
-	addr, deviceNumber, err := s.ipamContext.dataStore.AssignPodIPv4Address(&k8sapi.K8SPodInfo{
-		Name:      in.K8S_POD_NAME,
-		Namespace: in.K8S_POD_NAMESPACE,
-		Container: in.K8S_POD_INFRA_CONTAINER_ID})
+	add := &podAdd{meta: s.ipamContext.newPodMetadata(in.K8S_POD_NAMESPACE, in.K8S_POD_NAME)}
+	add.err = s.ipamContext.checkShutdownFence()
+	if add.err != nil {
+		trace.Warnf("Not adding pod %s, namespace %s: %v", in.K8S_POD_NAME, in.K8S_POD_NAMESPACE, add.err)
+	} else if add.tenant, add.err = s.ipamContext.getPodTenant(add.meta); add.err != nil {
+		// Do not let a tenant pod get an IP from the shared pool
+		trace.Errorf("Failed to get the tenant of namespace %s: %v", in.K8S_POD_NAMESPACE, add.err)
+	} else if add.gateway, add.err = s.ipamContext.getPodEgressGateway(add.meta); add.err != nil {
+		// Do not let the egress traffic of the pod bypass its gateway
+		trace.Errorf("Failed to get the egress gateway of pod %s, namespace %s: %v", in.K8S_POD_NAME, in.K8S_POD_NAMESPACE, add.err)
+	} else if add.wantsVF, add.err = s.ipamContext.podWantsVF(add.meta); add.err != nil {
+		trace.Errorf("Failed to get whether pod %s, namespace %s gets a VF: %v", in.K8S_POD_NAME, in.K8S_POD_NAMESPACE, add.err)
+	} else if add.wantsVF && add.gateway != "" {
+		// The traffic of a VF does not go through the host, where it would be routed to the gateway
+		add.err = errors.Errorf("pod can not have both %s and %s", SRIOVAnnotation, EgressGatewayAnnotation)
+		trace.Errorf("Failed to add pod %s, namespace %s: %v", in.K8S_POD_NAME, in.K8S_POD_NAMESPACE, add.err)
+	} else if add.securityGroups, add.err = s.ipamContext.podSecurityGroups(add.meta); add.err != nil {
+		// Do not let the pod miss its security groups
+		trace.Errorf("Failed to get the security groups of pod %s, namespace %s: %v", in.K8S_POD_NAME, in.K8S_POD_NAMESPACE, add.err)
+	} else if len(add.securityGroups) > 0 && (add.wantsVF || add.gateway != "" || add.tenant != "") {
+		// The traffic of a branch ENI goes through the trunk ENI, not through the ENI of the VF or of the tenant, nor
+		// through the gateway
+		add.err = errors.Errorf("pod with %s can not have a VF, an egress gateway or a tenant", PodSecurityGroupsAnnotation)
+		trace.Errorf("Failed to add pod %s, namespace %s: %v", in.K8S_POD_NAME, in.K8S_POD_NAMESPACE, add.err)
+	} else if add.flags, add.err = s.ipamContext.getPodFlags(add.meta, add.tenant, add.wantsVF); add.err != nil {
+		// Do not let a pod miss its flags, e.g. the block of the instance metadata service
+		trace.Errorf("Failed to get the flags of pod %s, namespace %s: %v", in.K8S_POD_NAME, in.K8S_POD_NAMESPACE, add.err)
+	} else if add.err = s.ipamContext.checkEarlyAdd(podENITenant(add.tenant, add.flags, in.K8S_POD_NAMESPACE, in.K8S_POD_NAME), add.wantsVF); add.err != nil {
+		trace.Warnf("Not adding pod %s, namespace %s yet: %v", in.K8S_POD_NAME, in.K8S_POD_NAMESPACE, add.err)
+	} else if len(add.securityGroups) > 0 {
+		// The flags do not apply to the pods with a branch ENI, whose traffic does not go through the host rules
+		add.flags = PodFlags{}
+		var branch awsutils.BranchENI
+		if branch, add.trunkIfName, add.err = s.ipamContext.assignBranchENI(in.K8S_POD_NAMESPACE, in.K8S_POD_NAME,
+			in.K8S_POD_INFRA_CONTAINER_ID, add.securityGroups); add.err != nil {
+			trace.Errorf("Failed to assign a branch ENI to pod %s, namespace %s: %v", in.K8S_POD_NAME, in.K8S_POD_NAMESPACE, add.err)
+		} else {
+			add.addr, add.vlanID, add.branchMAC, add.subnet = branch.IPv4Addr, branch.VlanID, branch.MAC, s.ipamContext.branchENIs.subnet.String()
+		}
+	} else {
+		add.k8sPod = &k8sapi.K8SPodInfo{
+			Name:      in.K8S_POD_NAME,
+			Namespace: in.K8S_POD_NAMESPACE,
+			Container: in.K8S_POD_INFRA_CONTAINER_ID,
+			Tenant:    podENITenant(add.tenant, add.flags, in.K8S_POD_NAMESPACE, in.K8S_POD_NAME),
+			NUMANode:  s.ipamContext.getPodNUMANode(add.meta)}
+	}
+	return add
+}
 
-	var pbVPCcidrs []string
-	for _, cidr := range s.ipamContext.awsClient.GetVPCIPv4CIDRs() {
-		log.Debugf("VPC CIDR %s", *cidr)
-		pbVPCcidrs = append(pbVPCcidrs, *cidr)
+// setUpPodIPs sets up the pod once the datastore assigned its IPv4 address, or asks for the pool to grow if it had
+// none left
+func (s *server) setUpPodIPs(trace tracing.Trace, in *pb.AddNetworkRequest, add *podAdd) {
+	k8sPod := add.k8sPod
+	if add.err == datastore.ErrNoAvailableIPv4Address {
+		s.ipamContext.requestPodBlockingGrowth()
+	}
+	if add.err == nil && s.ipamContext.enableIPv6 {
+		add.addr6, add.err = s.ipamContext.dataStore.AssignPodIPv6Address(k8sPod)
+		if add.err != nil {
+			// The CNI plugin does not release the IPv4 address of a pod it failed to add
+			trace.Errorf("Failed to assign an IPv6 address to pod %s, namespace %s: %v", in.K8S_POD_NAME, in.K8S_POD_NAMESPACE, add.err)
+			if _, _, unassignErr := s.ipamContext.dataStore.UnassignPodIPv4Address(k8sPod); unassignErr != nil {
+				trace.Errorf("Failed to release IP %s of pod %s, namespace %s: %v", add.addr, in.K8S_POD_NAME, in.K8S_POD_NAMESPACE, unassignErr)
+			} else {
+				s.ipamContext.releaseExternalIPAM(k8sPod, add.addr)
+			}
+			add.addr, add.deviceNumber = "", 0
+		}
+	}
+	if add.err == nil && add.gateway != "" {
+		if add.err = s.ipamContext.networkClient.AddEgressGatewayExemption(add.addr); add.err != nil {
+			trace.Errorf("Failed to exempt pod %s, namespace %s from SNAT for its egress gateway: %v", in.K8S_POD_NAME, in.K8S_POD_NAMESPACE, add.err)
+			s.ipamContext.unassignPodIPs(trace, k8sPod, add.addr, add.addr6)
+			add.addr, add.addr6, add.deviceNumber = "", "", 0
+		} else {
+			egressGatewayPods.Inc()
+		}
+	}
+	if add.err == nil && (add.flags.NoSNAT || add.flags.MetadataBlock) {
+		if add.err = s.ipamContext.networkClient.AddPodFlagRules(add.addr, add.flags.NoSNAT, add.flags.MetadataBlock); add.err != nil {
+			trace.Errorf("Failed to add the rules of the flags of pod %s, namespace %s: %v", in.K8S_POD_NAME, in.K8S_POD_NAMESPACE, add.err)
+			s.ipamContext.unassignPodIPs(trace, k8sPod, add.addr, add.addr6)
+			add.addr, add.addr6, add.deviceNumber = "", "", 0
+		}
+	}
+	if add.err == nil && add.wantsVF {
+		if add.vf, add.subnet, add.err = s.ipamContext.assignVF(k8sPod, add.deviceNumber); add.err != nil {
+			trace.Errorf("Failed to assign a VF to pod %s, namespace %s: %v", in.K8S_POD_NAME, in.K8S_POD_NAMESPACE, add.err)
+			s.ipamContext.unassignPodIPs(trace, k8sPod, add.addr, add.addr6)
+			add.addr, add.addr6, add.deviceNumber = "", "", 0
+		}
 	}
+	if add.err == nil && add.addr6 != "" {
+		add.ipv6First = s.ipamContext.podPrefersIPv6(add.meta)
+	}
+	if add.err == nil {
+		s.ipamContext.recordEarlyAdd(k8sPod, add.addr)
+		s.ipamContext.recordPodFlags(in.K8S_POD_NAMESPACE, in.K8S_POD_NAME, add.flags)
+	}
+}
 
-	useExternalSNAT := s.ipamContext.networkClient.UseExternalSNAT()
-	if !useExternalSNAT {
-		for _, cidr := range s.ipamContext.networkClient.GetExcludeSNATCIDRs() {
-			log.Debugf("CIDR SNAT Exclusion %s", cidr)
-			pbVPCcidrs = append(pbVPCcidrs, cidr)
+// addNetworkReply records the result of the ADD of a sandbox and returns its reply
+func (s *server) addNetworkReply(trace tracing.Trace, in *pb.AddNetworkRequest, add *podAdd, routeCIDRs map[bool][]string) *pb.AddNetworkReply {
+	err := add.err
+	if err != nil {
+		if degraded := s.ipamContext.getDegradedInfo(); degraded.Degraded {
+			trace.Warnf("AddNetwork: the IP pool can not grow while ipamd is degraded (%s) since %v",
+				degraded.Reason, degraded.Since)
 		}
 	}
+	if s.ipamContext.recordAddResult(err) {
+		go s.ipamContext.captureDiagnostics(err)
+	}
+
+	// Tenant pods send all their traffic through their ENI, where it is SNATed to the IP of the ENI if needed. So do the
+	// pods with the no-snat flag, whose traffic is not SNATed on the node.
+	useExternalSNAT := s.ipamContext.networkClient.UseExternalSNAT() || add.tenant != "" || add.flags.NoSNAT
+	// Pods with an egress gateway send the traffic to the VPC and to the excluded CIDRs through their ENI, and the rest
+	// through their gateway
+	withoutExclusions := useExternalSNAT && add.gateway == ""
+	pbVPCcidrs, ok := routeCIDRs[withoutExclusions]
+	if !ok {
+		pbVPCcidrs = s.ipamContext.podRouteCIDRs(withoutExclusions)
+		routeCIDRs[withoutExclusions] = pbVPCcidrs
+	}
+	trace.Debugf("VPC CIDRs and CIDR SNAT exclusions %v", pbVPCcidrs)
 
 	resp := pb.AddNetworkReply{
 		Success:         err == nil,
-		IPv4Addr:        addr,
-		IPv4Subnet:      "",
-		DeviceNumber:    int32(deviceNumber),
+		IPv4Addr:        add.addr,
+		IPv6Addr:        add.addr6,
+		IPv4Subnet:      add.subnet,
+		DeviceNumber:    int32(add.deviceNumber),
 		UseExternalSNAT: useExternalSNAT,
 		VPCcidrs:        pbVPCcidrs,
+		EgressGateway:   add.gateway,
+		VF:              add.vf,
+		IPv6First:       add.ipv6First,
+		MTU:             int32(add.flags.MTU),
+		VlanID:          int32(add.vlanID),
+		BranchENIMAC:    add.branchMAC,
+		TrunkIfName:     add.trunkIfName,
 	}
 
-	log.Infof("Send AddNetworkReply: IPv4Addr %s, DeviceNumber: %d, err: %v", addr, deviceNumber, err)
+	trace.Infof("Send AddNetworkReply: IPv4Addr %s, IPv6Addr %s, IPv6First: %v, DeviceNumber: %d, EgressGateway: %s, VF: %s, VLAN: %d, flags: %v, err: %v", add.addr, add.addr6, add.ipv6First, add.deviceNumber, add.gateway, add.vf, add.vlanID, add.flags.Applied, err)
+	if err == nil {
+		s.ipamContext.publishIPAMEvent(ipamevents.Allocated, in.K8S_POD_NAME, in.K8S_POD_NAMESPACE,
+			in.K8S_POD_INFRA_CONTAINER_ID, add.addr, add.addr6)
+	}
 	addIPCnt.Inc()
-	return &resp, nil
+	return &resp
+}
+
+// unassignPodIPs releases the IPs of a pod that could not be set up, since the CNI plugin does not release the IPs of a
+// pod it failed to add
+func (c *IPAMContext) unassignPodIPs(trace tracing.Trace, k8sPod *k8sapi.K8SPodInfo, addr, addr6 string) {
+	// The IPv6 address is released first, since releasing the IPv4 address forgets the pod
+	if addr6 != "" {
+		if _, err := c.dataStore.UnassignPodIPv6Address(k8sPod); err != nil {
+			trace.Errorf("Failed to release IPv6 address %s of pod %s, namespace %s: %v", addr6, k8sPod.Name, k8sPod.Namespace, err)
+		}
+	}
+	if _, _, err := c.dataStore.UnassignPodIPv4Address(k8sPod); err != nil {
+		trace.Errorf("Failed to release IP %s of pod %s, namespace %s: %v", addr, k8sPod.Name, k8sPod.Namespace, err)
+	} else {
+		c.releaseExternalIPAM(k8sPod, addr)
+	}
+}
+
+// podRouteCIDRs returns the CIDRs the traffic of pods is routed to through the ENI of the pod, without SNAT, as the CNI
+// plugin takes them
+func (c *IPAMContext) podRouteCIDRs(useExternalSNAT bool) []string {
+	// Traffic to the CIDRs that overlap with the other side of a hybrid network is SNATed and leaves through the
+	// primary ENI
+	cidrs := networkutils.RemoveOverlappingCIDRs(c.awsClient.GetVPCIPv4CIDRs())
+	if !useExternalSNAT {
+		cidrs = append(cidrs, c.networkClient.GetExcludeSNATCIDRs()...)
+	}
+	return cidr.Strings(cidrs)
 }
 
 func (s *server) DelNetwork(ctx context.Context, in *pb.DelNetworkRequest) (*pb.DelNetworkReply, error) {
-	log.Infof("Received DelNetwork for IP %s, Pod %s, Namespace %s, Container %s",
+	trace := tracing.FromIncomingContext(ctx)
+	trace.Infof("Received DelNetwork for IP %s, Pod %s, Namespace %s, Container %s",
 		in.IPv4Addr, in.K8S_POD_NAME, in.K8S_POD_NAMESPACE, in.K8S_POD_INFRA_CONTAINER_ID)
 	delIPCnt.With(prometheus.Labels{"reason": in.Reason}).Inc()
+	// The pod may have been set up through the fast path, with an IP that is not assigned to it yet
+	s.ipamContext.adoptFastPathClaims()
+	// The pod must not be recovered if it is deleted while the pods of the node are
+	s.ipamContext.recordEarlyDel(in.K8S_POD_NAME, in.K8S_POD_NAMESPACE)
+
+	k8sPod := &k8sapi.K8SPodInfo{
+		Name:      in.K8S_POD_NAME,
+		Namespace: in.K8S_POD_NAMESPACE,
+		Container: in.K8S_POD_INFRA_CONTAINER_ID}
+	// The IPv6 address is released first, since releasing the IPv4 address forgets the pod
+	ip6, err := s.ipamContext.dataStore.UnassignPodIPv6Address(k8sPod)
+	if err != nil && err == datastore.ErrUnknownPod {
+		k8sPod = &k8sapi.K8SPodInfo{
+			Name:      in.K8S_POD_NAME,
+			Namespace: in.K8S_POD_NAMESPACE}
+		ip6, err = s.ipamContext.dataStore.UnassignPodIPv6Address(k8sPod)
+	}
+	if err != nil && err != datastore.ErrUnknownPod {
+		trace.Warnf("Failed to release the IPv6 address of pod %s, namespace %s: %v", in.K8S_POD_NAME, in.K8S_POD_NAMESPACE, err)
+	}
 
 	ip, deviceNumber, err := s.ipamContext.dataStore.UnassignPodIPv4Address(&k8sapi.K8SPodInfo{
 		Name:      in.K8S_POD_NAME,
@@ -98,7 +375,42 @@ func (s *server) DelNetwork(ctx context.Context, in *pb.DelNetworkRequest) (*pb.
 			Name:      in.K8S_POD_NAME,
 			Namespace: in.K8S_POD_NAMESPACE})
 	}
-	log.Infof("Send DelNetworkReply: IPv4Addr %s, DeviceNumber: %d, err: %v", ip, deviceNumber, err)
+	var vlanID int
+	if err == datastore.ErrUnknownPod && s.ipamContext.podENI {
+		// The IPs of the pods with a branch ENI are not in the datastore
+		if branch, ok := s.ipamContext.releaseBranchENI(in.K8S_POD_NAMESPACE, in.K8S_POD_NAME, in.K8S_POD_INFRA_CONTAINER_ID); ok {
+			ip, vlanID, err = branch.IPv4Addr, branch.VlanID, nil
+		}
+	}
+	var hadGateway bool
+	if err == nil && vlanID == 0 && s.ipamContext.egressGateway {
+		var gatewayErr error
+		if hadGateway, gatewayErr = s.ipamContext.networkClient.DelEgressGatewayExemption(ip); gatewayErr != nil {
+			trace.Errorf("Failed to remove the SNAT exemption of IP %s: %v", ip, gatewayErr)
+		}
+	}
+	if err == nil && vlanID == 0 && s.ipamContext.podFlagsAllowed() {
+		if flagsErr := s.ipamContext.networkClient.DelPodFlagRules(ip); flagsErr != nil {
+			trace.Errorf("Failed to remove the rules of the flags of IP %s: %v", ip, flagsErr)
+		}
+		s.ipamContext.forgetPodFlags(in.K8S_POD_NAMESPACE, in.K8S_POD_NAME)
+	}
+	var vf string
+	if err == nil && vlanID == 0 && s.ipamContext.sriov {
+		vf = s.ipamContext.releaseVF(&k8sapi.K8SPodInfo{
+			Name:      in.K8S_POD_NAME,
+			Namespace: in.K8S_POD_NAMESPACE,
+			Container: in.K8S_POD_INFRA_CONTAINER_ID})
+	}
+	trace.Infof("Send DelNetworkReply: IPv4Addr %s, IPv6Addr %s, DeviceNumber: %d, EgressGateway: %v, VF: %s, VLAN: %d, err: %v", ip, ip6, deviceNumber, hadGateway, vf, vlanID, err)
+	if err == nil {
+		s.ipamContext.writeCheckpoint()
+		if vlanID == 0 {
+			s.ipamContext.releaseExternalIPAM(k8sPod, ip)
+		}
+		s.ipamContext.publishIPAMEvent(ipamevents.Released, in.K8S_POD_NAME, in.K8S_POD_NAMESPACE,
+			in.K8S_POD_INFRA_CONTAINER_ID, ip, ip6)
+	}
 
 	// Plugins should generally complete a DEL action without error even if some resources are missing. For example,
 	// an IPAM plugin should generally release an IP allocation and return success even if the container network
@@ -107,7 +419,11 @@ func (s *server) DelNetwork(ctx context.Context, in *pb.DelNetworkRequest) (*pb.
 	if err != nil && err != datastore.ErrUnknownPod {
 		success = false
 	}
-	return &pb.DelNetworkReply{Success: success, IPv4Addr: ip, DeviceNumber: int32(deviceNumber)}, nil
+	if err := faultinjection.Inject(faultinjection.GRPCPrefix + "DelNetwork"); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &pb.DelNetworkReply{Success: success, IPv4Addr: ip, IPv6Addr: ip6, DeviceNumber: int32(deviceNumber),
+		EgressGateway: hadGateway, VF: vf, VlanID: int32(vlanID)}, nil
 }
 
 // RunRPCHandler handles request from gRPC
@@ -125,8 +441,11 @@ func (c *IPAMContext) RunRPCHandler() error {
 	// TODO: Implement watch once the status is check is handled correctly.
 	hs.SetServingStatus("grpc.health.v1.aws-node", healthpb.HealthCheckResponse_SERVING)
 	healthpb.RegisterHealthServer(s, hs)
-	// Register reflection service on gRPC server.
-	reflection.Register(s)
+	// Register reflection service on gRPC server, only on demand as it describes the whole API to any local client
+	if grpcReflectionEnabled() {
+		log.Info("Registering the gRPC reflection service")
+		reflection.Register(s)
+	}
 	// Add shutdown hook
 	go c.shutdownListener(s)
 	if err := s.Serve(lis); err != nil {
@@ -136,7 +455,8 @@ func (c *IPAMContext) RunRPCHandler() error {
 	return nil
 }
 
-// shutdownListener - Listen to signals and set ipamd to be in status "terminating"
+// shutdownListener - Listen to signals and set ipamd to be in status "terminating". A restart request also stops the
+// gRPC server, so that ipamd exits and Kubernetes starts it again. On a node shutdown, the node is torn down first.
 func (c *IPAMContext) shutdownListener(s *grpc.Server) {
 	log.Info("Setting up shutdown hook.")
 	sig := make(chan os.Signal, 1)
@@ -146,8 +466,18 @@ func (c *IPAMContext) shutdownListener(s *grpc.Server) {
 	// Terminate signal sent from Kubernetes
 	signal.Notify(sig, syscall.SIGTERM)
 
-	<-sig
-	log.Info("Received shutdown signal, setting 'terminating' to true")
-	// We received an interrupt signal, shut down.
-	c.setTerminating()
+	select {
+	case <-sig:
+		log.Info("Received shutdown signal, setting 'terminating' to true")
+		// We received an interrupt signal, shut down.
+		c.setTerminating()
+		if c.nodeShuttingDown() {
+			c.teardownNode(getNodeShutdownTimeout())
+			s.GracefulStop()
+		}
+	case reason := <-c.restartRequests:
+		log.Infof("Restarting: %s", reason)
+		c.setTerminating()
+		s.GracefulStop()
+	}
 }
@@ -15,12 +15,20 @@ package ipamd
 
 import (
 	"context"
+	"errors"
+	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/aws/amazon-vpc-cni-k8s/ipamd/datastore"
-	"github.com/aws/aws-sdk-go/aws"
+	"github.com/golang/mock/gomock"
 
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/awsutils"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/ipamevents"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/networkutils"
 	pb "github.com/aws/amazon-vpc-cni-k8s/rpc"
+	mock_rpc "github.com/aws/amazon-vpc-cni-k8s/rpc/mocks"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -50,12 +58,12 @@ func TestServer_AddNetwork(t *testing.T) {
 		IfName:                     "eni",
 	}
 
-	vpcCIDRs := []*string{aws.String(vpcCIDR)}
+	vpcCIDRs := []netip.Prefix{netip.MustParsePrefix(vpcCIDR)}
 	testCases := []struct {
 		name               string
 		useExternalSNAT    bool
-		vpcCIDRs           []*string
-		snatExclusionCIDRs []string
+		vpcCIDRs           []netip.Prefix
+		snatExclusionCIDRs []netip.Prefix
 	}{
 		{
 			"VPC CIDRs",
@@ -67,7 +75,7 @@ func TestServer_AddNetwork(t *testing.T) {
 			"SNAT Exclusion CIDRs",
 			false,
 			vpcCIDRs,
-			[]string{"10.12.0.0/16", "10.13.0.0/16"},
+			[]netip.Prefix{netip.MustParsePrefix("10.12.0.0/16"), netip.MustParsePrefix("10.13.0.0/16")},
 		},
 	}
 	for _, tc := range testCases {
@@ -84,9 +92,776 @@ func TestServer_AddNetwork(t *testing.T) {
 
 		var expectedCIDRs []string
 		for _, cidr := range tc.vpcCIDRs {
-			expectedCIDRs = append(expectedCIDRs, *cidr)
+			expectedCIDRs = append(expectedCIDRs, cidr.String())
+		}
+		for _, cidr := range tc.snatExclusionCIDRs {
+			expectedCIDRs = append(expectedCIDRs, cidr.String())
 		}
-		expectedCIDRs = append([]string{vpcCIDR}, tc.snatExclusionCIDRs...)
 		assert.Equal(t, expectedCIDRs, addNetworkReply.VPCcidrs, tc.name)
 	}
 }
+
+func TestServer_BulkAddNetwork(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, 0, true)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr01)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr02)
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+	}
+	rpcServer := server{ipamContext: mockContext}
+
+	// The routes are computed once for the batch, and each sandbox gets its own reply
+	mockAWS.EXPECT().GetVPCIPv4CIDRs().Return([]netip.Prefix{netip.MustParsePrefix(vpcCIDR)}).Times(1)
+	mockNetwork.EXPECT().UseExternalSNAT().Return(true).Times(3)
+	bulkReply, err := rpcServer.BulkAddNetwork(context.TODO(), &pb.BulkAddNetworkRequest{Requests: []*pb.AddNetworkRequest{
+		{K8S_POD_NAME: "pod1", K8S_POD_NAMESPACE: "ns", K8S_POD_INFRA_CONTAINER_ID: "cid1"},
+		{K8S_POD_NAME: "pod2", K8S_POD_NAMESPACE: "ns", K8S_POD_INFRA_CONTAINER_ID: "cid2"},
+		{K8S_POD_NAME: "pod3", K8S_POD_NAMESPACE: "ns", K8S_POD_INFRA_CONTAINER_ID: "cid3"},
+	}})
+	assert.NoError(t, err)
+	assert.Len(t, bulkReply.Replies, 3)
+	assert.True(t, bulkReply.Replies[0].Success)
+	assert.True(t, bulkReply.Replies[1].Success)
+	assert.NotEqual(t, bulkReply.Replies[0].IPv4Addr, bulkReply.Replies[1].IPv4Addr)
+	assert.Equal(t, []string{vpcCIDR}, bulkReply.Replies[1].VPCcidrs)
+	// The pool has no IP left for the last one
+	assert.False(t, bulkReply.Replies[2].Success)
+
+	// Too large batches are refused
+	_, err = rpcServer.BulkAddNetwork(context.TODO(), &pb.BulkAddNetworkRequest{
+		Requests: make([]*pb.AddNetworkRequest, maxBulkAddNetworkRequests+1)})
+	assert.Error(t, err)
+}
+
+func TestServer_AddNetworkTenant(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, 1, true)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr01)
+	_ = ds.AddENI(secENIid, 2, false)
+	_ = ds.AddIPv4AddressFromStore(secENIid, ipaddr11)
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+		tenantLabel:   "tenant",
+	}
+	rpcServer := server{ipamContext: mockContext}
+
+	addNetworkRequest := &pb.AddNetworkRequest{
+		Netns:                      "netns",
+		K8S_POD_NAME:               "pod",
+		K8S_POD_NAMESPACE:          "ns",
+		K8S_POD_INFRA_CONTAINER_ID: "cid",
+		IfName:                     "eni",
+	}
+
+	// Without the namespace labels, the pod does not get an IP from the shared pool
+	mockK8S.EXPECT().K8SGetNamespaceLabels("ns").Return(nil, errors.New("API server unavailable"))
+	mockAWS.EXPECT().GetVPCIPv4CIDRs().Return([]netip.Prefix{netip.MustParsePrefix(vpcCIDR)})
+	mockNetwork.EXPECT().UseExternalSNAT().Return(false)
+	mockNetwork.EXPECT().GetExcludeSNATCIDRs().Return(nil)
+	addNetworkReply, err := rpcServer.AddNetwork(context.TODO(), addNetworkRequest)
+	assert.NoError(t, err)
+	assert.False(t, addNetworkReply.Success)
+
+	// Tenant pods get an IP from a dedicated secondary ENI, and send all their traffic through it
+	mockK8S.EXPECT().K8SGetNamespaceLabels("ns").Return(map[string]string{"tenant": "blue"}, nil)
+	mockAWS.EXPECT().GetVPCIPv4CIDRs().Return([]netip.Prefix{netip.MustParsePrefix(vpcCIDR)})
+	mockNetwork.EXPECT().UseExternalSNAT().Return(false)
+	addNetworkReply, err = rpcServer.AddNetwork(context.TODO(), addNetworkRequest)
+	assert.NoError(t, err)
+	assert.True(t, addNetworkReply.Success)
+	assert.Equal(t, ipaddr11, addNetworkReply.IPv4Addr)
+	assert.Equal(t, int32(2), addNetworkReply.DeviceNumber)
+	assert.True(t, addNetworkReply.UseExternalSNAT)
+	assert.Equal(t, []string{vpcCIDR}, addNetworkReply.VPCcidrs)
+
+	// A new tenant can not get an IP until another ENI is attached
+	assert.True(t, mockContext.nodeIPPoolTooLow())
+}
+
+func TestServer_AddDelNetworkEgressGateway(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, 1, true)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr01)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr02)
+	// Released IPs cool down before they are reused
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, "10.10.10.13")
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+		egressGateway: true,
+	}
+	rpcServer := server{ipamContext: mockContext}
+
+	addNetworkRequest := &pb.AddNetworkRequest{
+		Netns:                      "netns",
+		K8S_POD_NAME:               "pod",
+		K8S_POD_NAMESPACE:          "ns",
+		K8S_POD_INFRA_CONTAINER_ID: "cid",
+		IfName:                     "eni",
+	}
+	mockAWS.EXPECT().GetVPCIPv4CIDRs().Return([]netip.Prefix{netip.MustParsePrefix(vpcCIDR)}).AnyTimes()
+	mockNetwork.EXPECT().UseExternalSNAT().Return(true).AnyTimes()
+	mockNetwork.EXPECT().GetExcludeSNATCIDRs().Return([]netip.Prefix{netip.MustParsePrefix("10.12.0.0/16")}).AnyTimes()
+
+	// A gateway outside of the VPC is rejected, rather than letting the traffic of the pod leave without it
+	mockK8S.EXPECT().K8SGetPodAnnotations("ns", "pod").Return(map[string]string{EgressGatewayAnnotation: "8.8.8.8"}, nil)
+	addNetworkReply, err := rpcServer.AddNetwork(context.TODO(), addNetworkRequest)
+	assert.NoError(t, err)
+	assert.False(t, addNetworkReply.Success)
+
+	// The IP is released if the traffic of the pod can not be exempted from SNAT
+	mockK8S.EXPECT().K8SGetPodAnnotations("ns", "pod").Return(map[string]string{EgressGatewayAnnotation: "10.10.10.5"}, nil)
+	mockNetwork.EXPECT().AddEgressGatewayExemption(gomock.Any()).Return(errors.New("iptables failed"))
+	addNetworkReply, err = rpcServer.AddNetwork(context.TODO(), addNetworkRequest)
+	assert.NoError(t, err)
+	assert.False(t, addNetworkReply.Success)
+	_, assigned := ds.GetStats()
+	assert.Equal(t, 0, assigned)
+
+	// The traffic to the VPC and to the excluded CIDRs is routed through the ENI even with external SNAT
+	mockK8S.EXPECT().K8SGetPodAnnotations("ns", "pod").Return(map[string]string{EgressGatewayAnnotation: "10.10.10.5"}, nil)
+	mockNetwork.EXPECT().AddEgressGatewayExemption(gomock.Any()).Return(nil)
+	addNetworkReply, err = rpcServer.AddNetwork(context.TODO(), addNetworkRequest)
+	assert.NoError(t, err)
+	assert.True(t, addNetworkReply.Success)
+	assert.Equal(t, "10.10.10.5", addNetworkReply.EgressGateway)
+	assert.Equal(t, []string{vpcCIDR, "10.12.0.0/16"}, addNetworkReply.VPCcidrs)
+
+	mockNetwork.EXPECT().DelEgressGatewayExemption(addNetworkReply.IPv4Addr).Return(true, nil)
+	delNetworkReply, err := rpcServer.DelNetwork(context.TODO(), &pb.DelNetworkRequest{
+		K8S_POD_NAME:               "pod",
+		K8S_POD_NAMESPACE:          "ns",
+		K8S_POD_INFRA_CONTAINER_ID: "cid",
+	})
+	assert.NoError(t, err)
+	assert.True(t, delNetworkReply.Success)
+	assert.True(t, delNetworkReply.EgressGateway)
+
+	// Pods without the annotation keep their usual routes
+	mockK8S.EXPECT().K8SGetPodAnnotations("ns", "pod").Return(nil, nil)
+	addNetworkReply, err = rpcServer.AddNetwork(context.TODO(), addNetworkRequest)
+	assert.NoError(t, err)
+	assert.True(t, addNetworkReply.Success)
+	assert.Empty(t, addNetworkReply.EgressGateway)
+	assert.Equal(t, []string{vpcCIDR}, addNetworkReply.VPCcidrs)
+}
+
+func TestServer_AddDelNetworkSRIOV(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(secENIid, secDevice, false)
+	_ = ds.AddIPv4AddressFromStore(secENIid, ipaddr11)
+	_ = ds.AddIPv4AddressFromStore(secENIid, ipaddr12)
+	// Released IPs cool down before they are reused
+	_ = ds.AddIPv4AddressFromStore(secENIid, "10.10.20.13")
+	_ = ds.AddIPv4AddressFromStore(secENIid, "10.10.20.14")
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+		sriov:         true,
+	}
+	rpcServer := server{ipamContext: mockContext}
+
+	mockAWS.EXPECT().GetVPCIPv4CIDRs().Return([]netip.Prefix{netip.MustParsePrefix(vpcCIDR)}).AnyTimes()
+	mockNetwork.EXPECT().UseExternalSNAT().Return(true).AnyTimes()
+	mockK8S.EXPECT().K8SGetPodAnnotations("ns", gomock.Any()).Return(map[string]string{SRIOVAnnotation: "true"}, nil).AnyTimes()
+	mockAWS.EXPECT().GetAttachedENIs().Return([]awsutils.ENIMetadata{
+		{ENIID: primaryENIid, MAC: primaryMAC, DeviceNumber: primaryDevice, SubnetIPv4CIDR: primarySubnetCIDR},
+		{ENIID: secENIid, MAC: secMAC, DeviceNumber: secDevice, SubnetIPv4CIDR: secSubnetCIDR},
+	}, nil).AnyTimes()
+	mockNetwork.EXPECT().GetInterfaceName(secMAC).Return("eth2", nil).AnyTimes()
+	// The VFs reserved for pods are still in the host netns until the CNI plugin moves them
+	mockNetwork.EXPECT().GetVFs("eth2").Return([]string{"eth2v0", "eth2v1"}, nil).AnyTimes()
+
+	addNetwork := func(pod string) *pb.AddNetworkReply {
+		reply, err := rpcServer.AddNetwork(context.TODO(), &pb.AddNetworkRequest{
+			K8S_POD_NAME:               pod,
+			K8S_POD_NAMESPACE:          "ns",
+			K8S_POD_INFRA_CONTAINER_ID: "cid-" + pod,
+		})
+		assert.NoError(t, err)
+		return reply
+	}
+	reply := addNetwork("pod1")
+	assert.True(t, reply.Success)
+	assert.Equal(t, "eth2v0", reply.VF)
+	assert.Equal(t, secSubnet, reply.IPv4Subnet)
+	reply = addNetwork("pod2")
+	assert.True(t, reply.Success)
+	assert.Equal(t, "eth2v1", reply.VF)
+
+	// The IP is released when there is no free VF
+	reply = addNetwork("pod3")
+	assert.False(t, reply.Success)
+	_, assigned := ds.GetStats()
+	assert.Equal(t, 2, assigned)
+
+	// The VF of a deleted pod is handed to the next one
+	delNetworkReply, err := rpcServer.DelNetwork(context.TODO(), &pb.DelNetworkRequest{
+		K8S_POD_NAME:               "pod1",
+		K8S_POD_NAMESPACE:          "ns",
+		K8S_POD_INFRA_CONTAINER_ID: "cid-pod1",
+	})
+	assert.NoError(t, err)
+	assert.True(t, delNetworkReply.Success)
+	assert.Equal(t, "eth2v0", delNetworkReply.VF)
+
+	reply = addNetwork("pod3")
+	assert.True(t, reply.Success)
+	assert.Equal(t, "eth2v0", reply.VF)
+}
+
+func TestServer_AddDelNetworkBranchENI(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(secENIid, secDevice, false)
+	_ = ds.AddIPv4AddressFromStore(secENIid, ipaddr11)
+	trunk := awsutils.TrunkENI{ENIID: "eni-trunk", MAC: "12:ef:2a:98:e5:5c"}
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+		podENI:        true,
+		branchENIs: branchENIState{
+			trunk:    trunk,
+			subnet:   primarySubnetCIDR,
+			assigned: make(map[string]podBranchENI),
+			stale:    make(map[int]awsutils.BranchENI),
+		},
+	}
+	rpcServer := server{ipamContext: mockContext}
+
+	mockAWS.EXPECT().GetVPCIPv4CIDRs().Return([]netip.Prefix{netip.MustParsePrefix(vpcCIDR)}).AnyTimes()
+	mockNetwork.EXPECT().UseExternalSNAT().Return(true).AnyTimes()
+	mockNetwork.EXPECT().GetExcludeSNATCIDRs().Return(nil).AnyTimes()
+	annotations := map[string]string{PodSecurityGroupsAnnotation: "sg-1, sg-2"}
+	mockK8S.EXPECT().K8SGetPodAnnotations("ns", "pod1").Return(annotations, nil).AnyTimes()
+	mockK8S.EXPECT().K8SGetPodAnnotations("ns", "pod2").Return(map[string]string{}, nil).AnyTimes()
+	mockK8S.EXPECT().K8SGetPodAnnotations("ns", "pod3").Return(annotations, nil).AnyTimes()
+	mockK8S.EXPECT().K8SGetPodAnnotations("ns", "pod4").Return(
+		map[string]string{PodSecurityGroupsAnnotation: "web"}, nil).AnyTimes()
+	mockNetwork.EXPECT().GetInterfaceName(trunk.MAC).Return("eth3", nil).AnyTimes()
+
+	addNetwork := func(pod string) *pb.AddNetworkReply {
+		reply, err := rpcServer.AddNetwork(context.TODO(), &pb.AddNetworkRequest{
+			K8S_POD_NAME:               pod,
+			K8S_POD_NAMESPACE:          "ns",
+			K8S_POD_INFRA_CONTAINER_ID: "cid-" + pod,
+		})
+		assert.NoError(t, err)
+		return reply
+	}
+	branch := awsutils.BranchENI{ENIID: "eni-branch1", MAC: "12:ef:2a:98:e5:5d", IPv4Addr: "10.10.10.50", VlanID: 1,
+		AssociationID: "trunk-assoc-1", PodNamespace: "ns", PodName: "pod1"}
+	mockAWS.EXPECT().AllocBranchENI(trunk.ENIID, 1, []string{"sg-1", "sg-2"}, "ns", "pod1").Return(branch, nil)
+	reply := addNetwork("pod1")
+	assert.True(t, reply.Success)
+	assert.Equal(t, branch.IPv4Addr, reply.IPv4Addr)
+	assert.Equal(t, primarySubnet, reply.IPv4Subnet)
+	assert.Equal(t, int32(1), reply.VlanID)
+	assert.Equal(t, branch.MAC, reply.BranchENIMAC)
+	assert.Equal(t, "eth3", reply.TrunkIfName)
+	_, assigned := ds.GetStats()
+	assert.Equal(t, 0, assigned)
+
+	// A pod without security groups gets an IP of the datastore
+	reply = addNetwork("pod2")
+	assert.True(t, reply.Success)
+	assert.Equal(t, ipaddr11, reply.IPv4Addr)
+	assert.Equal(t, int32(0), reply.VlanID)
+
+	reply = addNetwork("pod4")
+	assert.False(t, reply.Success)
+
+	// The VLAN of a branch ENI that could not be freed is not used until it is
+	mockAWS.EXPECT().FreeBranchENI(branch).Return(errors.New("throttled"))
+	delNetworkReply, err := rpcServer.DelNetwork(context.TODO(), &pb.DelNetworkRequest{
+		K8S_POD_NAME:               "pod1",
+		K8S_POD_NAMESPACE:          "ns",
+		K8S_POD_INFRA_CONTAINER_ID: "cid-pod1",
+	})
+	assert.NoError(t, err)
+	assert.True(t, delNetworkReply.Success)
+	assert.Equal(t, branch.IPv4Addr, delNetworkReply.IPv4Addr)
+	assert.Equal(t, int32(1), delNetworkReply.VlanID)
+	assert.Contains(t, mockContext.branchENIs.stale, 1)
+
+	branch3 := awsutils.BranchENI{ENIID: "eni-branch3", IPv4Addr: "10.10.10.53", VlanID: 1, PodNamespace: "ns",
+		PodName: "pod3"}
+	gomock.InOrder(
+		mockAWS.EXPECT().FreeBranchENI(branch).Return(nil),
+		mockAWS.EXPECT().AllocBranchENI(trunk.ENIID, 1, []string{"sg-1", "sg-2"}, "ns", "pod3").Return(branch3, nil),
+	)
+	reply = addNetwork("pod3")
+	assert.True(t, reply.Success)
+	assert.Equal(t, int32(1), reply.VlanID)
+	assert.Empty(t, mockContext.branchENIs.stale)
+}
+
+func TestServer_AddDelNetworkDualStack(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, 0, true)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr01)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr02)
+	_ = ds.AddIPv6AddressFromStore(primaryENIid, ipv6addr01)
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+		enableIPv6:    true,
+		events:        ipamevents.NewStream("node", "i-0123456789"),
+	}
+	events := make(eventSink, 2)
+	mockContext.events.Subscribe("test", events)
+	rpcServer := server{ipamContext: mockContext}
+
+	addNetworkRequest := &pb.AddNetworkRequest{
+		Netns:                      "netns",
+		K8S_POD_NAME:               "pod",
+		K8S_POD_NAMESPACE:          "ns",
+		K8S_POD_INFRA_CONTAINER_ID: "cid",
+		IfName:                     "eni",
+	}
+	mockAWS.EXPECT().GetVPCIPv4CIDRs().Return([]netip.Prefix{netip.MustParsePrefix(vpcCIDR)}).Times(2)
+	mockNetwork.EXPECT().UseExternalSNAT().Return(true).Times(2)
+	mockK8S.EXPECT().K8SGetNamespaceAnnotations("ns").Return(map[string]string{IPFamilyPreferenceAnnotation: "ipv6"}, nil)
+
+	addNetworkReply, err := rpcServer.AddNetwork(context.TODO(), addNetworkRequest)
+	assert.NoError(t, err)
+	assert.True(t, addNetworkReply.Success)
+	assert.Equal(t, ipv6addr01, addNetworkReply.IPv6Addr)
+	assert.True(t, addNetworkReply.IPv6First)
+	podIP := addNetworkReply.IPv4Addr
+
+	// Without a free IPv6 address, the IPv4 address is given back to the pool
+	addNetworkRequest.K8S_POD_NAME = "pod2"
+	addNetworkReply, err = rpcServer.AddNetwork(context.TODO(), addNetworkRequest)
+	assert.NoError(t, err)
+	assert.False(t, addNetworkReply.Success)
+	_, assigned := ds.GetStats()
+	assert.Equal(t, 1, assigned)
+
+	delNetworkReply, err := rpcServer.DelNetwork(context.TODO(), &pb.DelNetworkRequest{
+		K8S_POD_NAME:               "pod",
+		K8S_POD_NAMESPACE:          "ns",
+		K8S_POD_INFRA_CONTAINER_ID: "cid",
+	})
+	assert.NoError(t, err)
+	assert.True(t, delNetworkReply.Success)
+	assert.Equal(t, ipv6addr01, delNetworkReply.IPv6Addr)
+	ipv6Pool, err := ds.GetENIIPv6Pools(primaryENIid)
+	assert.NoError(t, err)
+	assert.False(t, ipv6Pool[ipv6addr01].Assigned)
+
+	// Only the IPs that pods got and released are sent to the sinks
+	for _, eventType := range []ipamevents.EventType{ipamevents.Allocated, ipamevents.Released} {
+		event := <-events
+		assert.Equal(t, eventType, event.Type)
+		assert.Equal(t, "pod", event.PodName)
+		assert.Equal(t, podIP, event.IPv4)
+		assert.Equal(t, ipv6addr01, event.IPv6)
+	}
+	assert.Empty(t, events)
+}
+
+func TestPodPrefersIPv6(t *testing.T) {
+	ctrl, _, mockK8S, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{k8sClient: mockK8S, ipFamilyPreference: ipFamilyIPv6}
+
+	// The default of the cluster is used when the namespace has no valid preference
+	mockK8S.EXPECT().K8SGetNamespaceAnnotations("ns").Return(nil, nil)
+	assert.True(t, mockContext.podPrefersIPv6(mockContext.newPodMetadata("ns", "pod")))
+	mockK8S.EXPECT().K8SGetNamespaceAnnotations("ns").Return(nil, errors.New("API server unavailable"))
+	assert.True(t, mockContext.podPrefersIPv6(mockContext.newPodMetadata("ns", "pod")))
+	mockK8S.EXPECT().K8SGetNamespaceAnnotations("ns").Return(map[string]string{IPFamilyPreferenceAnnotation: "ipv5"}, nil)
+	assert.True(t, mockContext.podPrefersIPv6(mockContext.newPodMetadata("ns", "pod")))
+
+	mockK8S.EXPECT().K8SGetNamespaceAnnotations("ns").Return(map[string]string{IPFamilyPreferenceAnnotation: " IPv4"}, nil)
+	assert.False(t, mockContext.podPrefersIPv6(mockContext.newPodMetadata("ns", "pod")))
+}
+
+func TestServer_AddDelNetworkPodFlags(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, 1, true)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr01)
+	_ = ds.AddENI(secENIid, 2, false)
+	_ = ds.AddIPv4AddressFromStore(secENIid, ipaddr11)
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+		podFlags: podFlagsState{allowed: map[string]bool{
+			networkutils.PodFlagNoSNAT:        true,
+			networkutils.PodFlagMTU:           true,
+			networkutils.PodFlagDedicatedENI:  true,
+			networkutils.PodFlagMetadataBlock: true,
+		}},
+	}
+	rpcServer := server{ipamContext: mockContext}
+
+	addNetworkRequest := &pb.AddNetworkRequest{
+		Netns:                      "netns",
+		K8S_POD_NAME:               "pod",
+		K8S_POD_NAMESPACE:          "ns",
+		K8S_POD_INFRA_CONTAINER_ID: "cid",
+		IfName:                     "eni",
+	}
+	mockAWS.EXPECT().GetVPCIPv4CIDRs().Return([]netip.Prefix{netip.MustParsePrefix(vpcCIDR)}).AnyTimes()
+	mockNetwork.EXPECT().UseExternalSNAT().Return(false).AnyTimes()
+	mockNetwork.EXPECT().GetExcludeSNATCIDRs().Return(nil).AnyTimes()
+
+	// A pod whose flags can not be read does not start without them
+	mockK8S.EXPECT().K8SGetNamespaceAnnotations("ns").Return(nil, errors.New("API server unavailable"))
+	addNetworkReply, err := rpcServer.AddNetwork(context.TODO(), addNetworkRequest)
+	assert.NoError(t, err)
+	assert.False(t, addNetworkReply.Success)
+
+	// The pod turns off a flag of its namespace, and gets an ENI of its own whose traffic is not SNATed
+	mockK8S.EXPECT().K8SGetNamespaceAnnotations("ns").Return(
+		map[string]string{PodFlagsAnnotation: "no-snat,mtu=1400,metadata-block"}, nil)
+	mockK8S.EXPECT().K8SGetPodAnnotations("ns", "pod").Return(
+		map[string]string{PodFlagsAnnotation: "metadata-block=false, dedicated-eni"}, nil)
+	mockNetwork.EXPECT().AddPodFlagRules(ipaddr11, true, false).Return(nil)
+	addNetworkReply, err = rpcServer.AddNetwork(context.TODO(), addNetworkRequest)
+	assert.NoError(t, err)
+	assert.True(t, addNetworkReply.Success)
+	assert.Equal(t, ipaddr11, addNetworkReply.IPv4Addr)
+	assert.Equal(t, int32(2), addNetworkReply.DeviceNumber)
+	assert.True(t, addNetworkReply.UseExternalSNAT)
+	assert.Equal(t, int32(1400), addNetworkReply.MTU)
+	assert.Equal(t, []string{"no-snat", "mtu=1400", "dedicated-eni"},
+		mockContext.getPodFlagsInfo().Pods["ns/pod"].Applied)
+
+	// No other pod gets an IP of the ENI of the pod
+	assert.True(t, mockContext.nodeIPPoolTooLow())
+
+	mockNetwork.EXPECT().DelPodFlagRules(ipaddr11).Return(nil)
+	delNetworkReply, err := rpcServer.DelNetwork(context.TODO(), &pb.DelNetworkRequest{
+		K8S_POD_NAME:               "pod",
+		K8S_POD_NAMESPACE:          "ns",
+		K8S_POD_INFRA_CONTAINER_ID: "cid",
+	})
+	assert.NoError(t, err)
+	assert.True(t, delNetworkReply.Success)
+	assert.Empty(t, mockContext.getPodFlagsInfo().Pods)
+}
+
+func TestPodMetadataReadOnce(t *testing.T) {
+	ctrl, _, mockK8S, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{
+		k8sClient:          mockK8S,
+		tenantLabel:        "tenant",
+		egressGateway:      true,
+		sriov:              true,
+		podENI:             true,
+		numaAware:          true,
+		ipFamilyPreference: ipFamilyIPv4,
+		podFlags:           podFlagsState{allowed: map[string]bool{networkutils.PodFlagMTU: true}},
+	}
+
+	// Every feature of the ADD of the pod shares one read of the pod and of its namespace
+	mockK8S.EXPECT().K8SGetPodAnnotations("ns", "pod").Return(map[string]string{
+		PodFlagsAnnotation: "mtu=1400", SRIOVAnnotation: "false", NUMANodeAnnotation: "1"}, nil)
+	mockK8S.EXPECT().K8SGetNamespaceLabels("ns").Return(map[string]string{"tenant": "blue"}, nil)
+	mockK8S.EXPECT().K8SGetNamespaceAnnotations("ns").Return(map[string]string{IPFamilyPreferenceAnnotation: "ipv6"}, nil)
+
+	meta := mockContext.newPodMetadata("ns", "pod")
+	tenant, err := mockContext.getPodTenant(meta)
+	assert.NoError(t, err)
+	assert.Equal(t, "blue", tenant)
+	gateway, err := mockContext.getPodEgressGateway(meta)
+	assert.NoError(t, err)
+	assert.Empty(t, gateway)
+	wantsVF, err := mockContext.podWantsVF(meta)
+	assert.NoError(t, err)
+	assert.False(t, wantsVF)
+	securityGroups, err := mockContext.podSecurityGroups(meta)
+	assert.NoError(t, err)
+	assert.Empty(t, securityGroups)
+	flags, err := mockContext.getPodFlags(meta, tenant, wantsVF)
+	assert.NoError(t, err)
+	assert.Equal(t, 1400, flags.MTU)
+	if node := mockContext.getPodNUMANode(meta); assert.NotNil(t, node) {
+		assert.Equal(t, 1, *node)
+	}
+	assert.True(t, mockContext.podPrefersIPv6(meta))
+
+	// A failed read is not retried within the same ADD either
+	mockK8S.EXPECT().K8SGetPodAnnotations("ns", "pod2").Return(nil, errors.New("API server unavailable"))
+	meta = mockContext.newPodMetadata("ns", "pod2")
+	_, err = mockContext.getPodEgressGateway(meta)
+	assert.Error(t, err)
+	_, err = mockContext.podWantsVF(meta)
+	assert.Error(t, err)
+}
+
+func TestResolvePodFlags(t *testing.T) {
+	allowed := map[string]bool{networkutils.PodFlagNoSNAT: true, networkutils.PodFlagMTU: true,
+		networkutils.PodFlagDedicatedENI: true}
+
+	flags := resolvePodFlags(allowed, "no-snat,mtu=100000,metadata-block", "fast,dedicated-eni=maybe", "", false)
+	assert.Equal(t, PodFlags{NoSNAT: true, Applied: []string{"no-snat"}, Ignored: []string{
+		"fast: unknown flag",
+		"mtu=100000: invalid MTU",
+		"dedicated-eni=maybe: invalid value",
+		"metadata-block: not allowed on the node",
+	}}, flags)
+
+	// The pod overrides the flags of its namespace
+	flags = resolvePodFlags(allowed, "no-snat,mtu=1400", "no-snat=false,MTU=1500", "", false)
+	assert.Equal(t, PodFlags{MTU: 1500, Applied: []string{"mtu=1500"}}, flags)
+
+	// Tenant pods share the ENIs of their tenant, and the traffic of a VF does not go through the host
+	flags = resolvePodFlags(allowed, "", "dedicated-eni,no-snat,mtu=1400", "blue", true)
+	assert.Equal(t, PodFlags{Ignored: []string{
+		"no-snat: the pod gets a VF",
+		"mtu=1400: the pod gets a VF",
+		"dedicated-eni: the pod shares the ENIs of tenant blue",
+	}}, flags)
+}
+
+func TestResolveSNATExclusion(t *testing.T) {
+	var flags PodFlags
+	resolveSNATExclusion(&flags, "true", "", false)
+	assert.Equal(t, PodFlags{NoSNAT: true, Applied: []string{"vpc.amazonaws.com/snat-exclude=true"}}, flags)
+
+	// The pod overrides its namespace, and invalid values are ignored
+	flags = PodFlags{}
+	resolveSNATExclusion(&flags, "true", "false", false)
+	assert.Equal(t, PodFlags{}, flags)
+	flags = PodFlags{}
+	resolveSNATExclusion(&flags, "true", "maybe", false)
+	assert.Equal(t, PodFlags{NoSNAT: true, Applied: []string{"vpc.amazonaws.com/snat-exclude=true"},
+		Ignored: []string{"vpc.amazonaws.com/snat-exclude=maybe: invalid value"}}, flags)
+
+	flags = PodFlags{}
+	resolveSNATExclusion(&flags, "", "true", true)
+	assert.Equal(t, PodFlags{Ignored: []string{"vpc.amazonaws.com/snat-exclude: the pod gets a VF"}}, flags)
+}
+
+func TestGetPodFlagsSNATExclusion(t *testing.T) {
+	ctrl, _, mockK8S, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockContext := &IPAMContext{k8sClient: mockK8S, podFlags: podFlagsState{snatExclusions: true}}
+	assert.True(t, mockContext.podFlagsAllowed())
+
+	// Only the SNAT exclusion applies, the experimental flags are not allowed on the node
+	mockK8S.EXPECT().K8SGetNamespaceAnnotations("ns").Return(map[string]string{SNATExcludeAnnotation: "true"}, nil)
+	mockK8S.EXPECT().K8SGetPodAnnotations("ns", "pod").Return(map[string]string{PodFlagsAnnotation: "no-snat"}, nil)
+	flags, err := mockContext.getPodFlags(mockContext.newPodMetadata("ns", "pod"), "", false)
+	assert.NoError(t, err)
+	assert.Equal(t, PodFlags{NoSNAT: true, Applied: []string{"vpc.amazonaws.com/snat-exclude=true"},
+		Ignored: []string{"no-snat: not allowed on the node"}}, flags)
+}
+
+func TestAssignPodIPv4AddressesExternalIPAM(t *testing.T) {
+	ctrl, _, _, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, 0, true)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr01)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr02)
+	mockIPAM := mock_rpc.NewMockExternalIPAMClient(ctrl)
+	mockContext := &IPAMContext{
+		dataStore:    ds,
+		externalIPAM: &externalIPAM{client: mockIPAM, timeout: time.Second},
+	}
+
+	// The IP picked for a pod of the batch is not a candidate for the next ones
+	gomock.InOrder(
+		mockIPAM.EXPECT().AllocateIP(gomock.Any(), gomock.Any()).Return(&pb.AllocateIPReply{IPv4Addr: ipaddr02}, nil),
+		mockIPAM.EXPECT().AllocateIP(gomock.Any(), gomock.Any()).Return(nil, errors.New("unavailable")),
+		mockIPAM.EXPECT().AllocateIP(gomock.Any(), &pb.AllocateIPRequest{K8S_POD_NAME: "pod3", K8S_POD_NAMESPACE: "ns",
+			Candidates: []string{ipaddr01}}).Return(&pb.AllocateIPReply{IPv4Addr: ipaddr01}, nil),
+	)
+	results := mockContext.assignPodIPv4Addresses([]*k8sapi.K8SPodInfo{
+		{Name: "pod1", Namespace: "ns"},
+		{Name: "pod2", Namespace: "ns"},
+		{Name: "pod3", Namespace: "ns"},
+	})
+	assert.Len(t, results, 3)
+	assert.Equal(t, datastore.AssignedIPv4Address{IP: ipaddr02}, results[0])
+	assert.Error(t, results[1].Err)
+	assert.Equal(t, datastore.AssignedIPv4Address{IP: ipaddr01}, results[2])
+}
+
+type eventSink chan ipamevents.Event
+
+func (s eventSink) Handle(event ipamevents.Event) error {
+	s <- event
+	return nil
+}
+
+func TestServer_AddDelNetworkExternalIPAM(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(primaryENIid, 0, true)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr01)
+	_ = ds.AddIPv4AddressFromStore(primaryENIid, ipaddr02)
+	mockIPAM := mock_rpc.NewMockExternalIPAMClient(ctrl)
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+		externalIPAM: &externalIPAM{
+			client:     mockIPAM,
+			nodeName:   "node",
+			instanceID: "i-0123456789",
+			timeout:    time.Second,
+		},
+	}
+	rpcServer := server{ipamContext: mockContext}
+
+	addNetworkRequest := &pb.AddNetworkRequest{
+		Netns:                      "netns",
+		K8S_POD_NAME:               "pod",
+		K8S_POD_NAMESPACE:          "ns",
+		K8S_POD_INFRA_CONTAINER_ID: "cid",
+		IfName:                     "eni",
+	}
+	mockAWS.EXPECT().GetVPCIPv4CIDRs().Return([]netip.Prefix{netip.MustParsePrefix(vpcCIDR)}).Times(3)
+	mockNetwork.EXPECT().UseExternalSNAT().Return(true).Times(3)
+
+	// The central IPAM service picks the IP among the free IPs of the node
+	mockIPAM.EXPECT().AllocateIP(gomock.Any(), &pb.AllocateIPRequest{
+		NodeName:                   "node",
+		InstanceID:                 "i-0123456789",
+		K8S_POD_NAME:               "pod",
+		K8S_POD_NAMESPACE:          "ns",
+		K8S_POD_INFRA_CONTAINER_ID: "cid",
+		Candidates:                 []string{ipaddr01, ipaddr02},
+	}).Return(&pb.AllocateIPReply{IPv4Addr: ipaddr02}, nil)
+	addNetworkReply, err := rpcServer.AddNetwork(context.TODO(), addNetworkRequest)
+	assert.NoError(t, err)
+	assert.True(t, addNetworkReply.Success)
+	assert.Equal(t, ipaddr02, addNetworkReply.IPv4Addr)
+
+	// An IP that is not free on the node is refused, and so are failed calls
+	otherRequest := &pb.AddNetworkRequest{K8S_POD_NAME: "other", K8S_POD_NAMESPACE: "ns", K8S_POD_INFRA_CONTAINER_ID: "cid2"}
+	mockIPAM.EXPECT().AllocateIP(gomock.Any(), gomock.Any()).Return(&pb.AllocateIPReply{IPv4Addr: ipaddr02}, nil)
+	addNetworkReply, err = rpcServer.AddNetwork(context.TODO(), otherRequest)
+	assert.NoError(t, err)
+	assert.False(t, addNetworkReply.Success)
+	mockIPAM.EXPECT().AllocateIP(gomock.Any(), gomock.Any()).Return(nil, errors.New("unavailable"))
+	addNetworkReply, err = rpcServer.AddNetwork(context.TODO(), otherRequest)
+	assert.NoError(t, err)
+	assert.False(t, addNetworkReply.Success)
+
+	// The release is reported, and a failure to report it does not fail the delete
+	delNetworkRequest := &pb.DelNetworkRequest{
+		K8S_POD_NAME:               "pod",
+		K8S_POD_NAMESPACE:          "ns",
+		K8S_POD_INFRA_CONTAINER_ID: "cid",
+	}
+	mockIPAM.EXPECT().ReleaseIP(gomock.Any(), &pb.ReleaseIPRequest{
+		NodeName:                   "node",
+		InstanceID:                 "i-0123456789",
+		K8S_POD_NAME:               "pod",
+		K8S_POD_NAMESPACE:          "ns",
+		K8S_POD_INFRA_CONTAINER_ID: "cid",
+		IPv4Addr:                   ipaddr02,
+	}).Return(nil, errors.New("unavailable"))
+	delNetworkReply, err := rpcServer.DelNetwork(context.TODO(), delNetworkRequest)
+	assert.NoError(t, err)
+	assert.True(t, delNetworkReply.Success)
+	assert.Equal(t, ipaddr02, delNetworkReply.IPv4Addr)
+}
+
+func TestServer_AddDelNetworkEarly(t *testing.T) {
+	ctrl, mockAWS, mockK8S, mockNetwork, _ := setup(t)
+	defer ctrl.Finish()
+
+	ds := datastore.NewDataStore()
+	_ = ds.AddENI(secENIid, secDevice, false)
+	_ = ds.AddIPv4AddressFromStore(secENIid, ipaddr11)
+	_ = ds.AddIPv4AddressFromStore(secENIid, ipaddr12)
+	mockContext := &IPAMContext{
+		awsClient:     mockAWS,
+		k8sClient:     mockK8S,
+		networkClient: mockNetwork,
+		dataStore:     ds,
+		allowEarlyAdd: true,
+	}
+	rpcServer := server{ipamContext: mockContext}
+	mockAWS.EXPECT().GetVPCIPv4CIDRs().Return([]netip.Prefix{netip.MustParsePrefix(vpcCIDR)}).AnyTimes()
+	mockNetwork.EXPECT().UseExternalSNAT().Return(true).AnyTimes()
+	mockNetwork.EXPECT().GetExcludeSNATCIDRs().Return(nil).AnyTimes()
+
+	// The IP of a pod rule may be used by a pod that is not recovered yet
+	assert.True(t, mockContext.startEarlyAdd([]string{ipaddr11}))
+	reply, err := rpcServer.AddNetwork(context.TODO(), &pb.AddNetworkRequest{
+		K8S_POD_NAME:               "new",
+		K8S_POD_NAMESPACE:          "ns",
+		K8S_POD_INFRA_CONTAINER_ID: "cid-new",
+	})
+	assert.NoError(t, err)
+	assert.True(t, reply.Success)
+	assert.Equal(t, ipaddr12, reply.IPv4Addr)
+	_, err = rpcServer.DelNetwork(context.TODO(), &pb.DelNetworkRequest{
+		K8S_POD_NAME:               "deleted",
+		K8S_POD_NAMESPACE:          "ns",
+		K8S_POD_INFRA_CONTAINER_ID: "cid-deleted",
+	})
+	assert.NoError(t, err)
+
+	// The pods added or deleted since are not recovered, nor the ones whose IP was given to another pod
+	assert.False(t, mockContext.skipRecoveredPod(&k8sapi.K8SPodInfo{Name: "running", Namespace: "ns", IP: ipaddr11}))
+	assert.True(t, mockContext.skipRecoveredPod(&k8sapi.K8SPodInfo{Name: "deleted", Namespace: "ns", IP: ipaddr11}))
+	assert.True(t, mockContext.skipRecoveredPod(&k8sapi.K8SPodInfo{Name: "new", Namespace: "ns", IP: ipaddr12}))
+	assert.True(t, mockContext.skipRecoveredPod(&k8sapi.K8SPodInfo{Name: "stale", Namespace: "ns", IP: ipaddr12}))
+	_, _, err = ds.AssignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "running", Namespace: "ns", Container: "cid-running", IP: ipaddr11})
+	assert.NoError(t, err)
+
+	// A pod that lost its IP in the meantime gets it again
+	_, _, err = ds.UnassignPodIPv4Address(&k8sapi.K8SPodInfo{Name: "new", Namespace: "ns", Container: "cid-new"})
+	assert.NoError(t, err)
+	mockContext.finishEarlyAdd()
+	mockContext.waitForRecovery()
+	assert.False(t, mockContext.recoveryPending())
+	pods := *ds.GetPodInfos()
+	assert.Equal(t, ipaddr12, pods["new_ns_"].IP)
+	assert.Equal(t, ipaddr11, pods["running_ns_cid-running"].IP)
+	assert.False(t, mockContext.skipRecoveredPod(&k8sapi.K8SPodInfo{Name: "deleted", Namespace: "ns", IP: ipaddr11}))
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// envMinENILifetime is the name of the environment variable that sets how long, in seconds, an ENI must have been
+	// attached before it can be freed, so that an ENI attached for a burst of pods is not detached right after.
+	// Defaults to 60.
+	envMinENILifetime     = "AWS_VPC_K8S_CNI_MIN_ENI_LIFETIME"
+	defaultMinENILifetime = 60
+
+	// envScaleDownCooldown is the name of the environment variable that sets how long, in seconds, ipamd waits after the
+	// pool was increased, or after IPs or an ENI were freed, before it frees more IPs or ENIs. Defaults to 30.
+	envScaleDownCooldown     = "AWS_VPC_K8S_CNI_SCALE_DOWN_COOLDOWN"
+	defaultScaleDownCooldown = 30
+
+	// envScaleDownSurgeBuffer is the name of the environment variable that sets a number of IPs, as a percentage of the
+	// IPs assigned to pods, that ipamd keeps on top of the warm target when it frees IPs or ENIs. The pool is still
+	// increased only up to the warm target, so that a pool that grew during a burst of pods is not shrunk as soon as a
+	// few of them are deleted. Defaults to 0.
+	envScaleDownSurgeBuffer     = "AWS_VPC_K8S_CNI_SCALE_DOWN_SURGE_BUFFER"
+	defaultScaleDownSurgeBuffer = 0
+)
+
+// scaleDownPacing holds the settings and the state that keep the pool from oscillating
+type scaleDownPacing struct {
+	cooldown           time.Duration
+	surgeBufferPercent int
+	lastIncrease       time.Time
+	lastFreeENI        time.Time
+}
+
+func getMinENILifetime() time.Duration {
+	return time.Duration(getNonNegativeIntEnvVar(envMinENILifetime, defaultMinENILifetime)) * time.Second
+}
+
+func getScaleDownCooldown() time.Duration {
+	return time.Duration(getNonNegativeIntEnvVar(envScaleDownCooldown, defaultScaleDownCooldown)) * time.Second
+}
+
+func getScaleDownSurgeBuffer() int {
+	return getNonNegativeIntEnvVar(envScaleDownSurgeBuffer, defaultScaleDownSurgeBuffer)
+}
+
+// surgeBuffer returns the number of IPs kept on top of the warm target when scaling down, for the given number of IPs
+// assigned to pods
+func (c *IPAMContext) surgeBuffer(assigned int) int {
+	return percentOf(c.pacing.surgeBufferPercent, assigned)
+}
+
+// inScaleDownCooldown returns true if the pool was increased, or was decreased at last, within the cooldown
+func (c *IPAMContext) inScaleDownCooldown(now time.Time, last time.Time) bool {
+	if sinceIncrease := now.Sub(c.pacing.lastIncrease); sinceIncrease <= c.pacing.cooldown {
+		log.Debugf("Not scaling down because the pool was increased %v ago, cooldown is %v", sinceIncrease, c.pacing.cooldown)
+		return true
+	}
+	if sinceLast := now.Sub(last); sinceLast <= c.pacing.cooldown {
+		log.Debugf("Not scaling down because the pool was decreased %v ago, cooldown is %v", sinceLast, c.pacing.cooldown)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/networkutils"
+)
+
+const (
+	// snatCheckInterval is how often the nat POSTROUTING chain is checked for rules that bypass the AWS SNAT chain
+	snatCheckInterval = 60 * time.Second
+
+	// snatBypassedCondition is the node condition set while pod traffic may not be SNATed because of other rules
+	snatBypassedCondition = "AWSSNATBypassed"
+	// snatBypassedReason is the reason of the condition and event when rules bypassing the AWS SNAT chain are found
+	snatBypassedReason = "SNATRulesBypassed"
+	// snatRepairedReason is the reason of the event recorded when the jump to the AWS SNAT chain was put back
+	snatRepairedReason = "SNATRulesRepaired"
+	// snatInPlaceReason is the reason of the condition when nothing bypasses the AWS SNAT chain
+	snatInPlaceReason = "SNATRulesInPlace"
+)
+
+var snatBypassed = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "awscni_snat_rules_bypassed",
+		Help: "Set to 1 while rules written by others keep pod traffic from reaching the AWS SNAT chain",
+	},
+)
+
+// StartSNATCheck periodically looks for rules written into the nat POSTROUTING chain by others that bypass the AWS SNAT
+// chain, if enabled, and reports them with a node condition
+func (c *IPAMContext) StartSNATCheck() {
+	if !networkutils.IptablesCheckEnabled() {
+		return
+	}
+	log.Info("Started checking for rules bypassing the AWS SNAT chain")
+
+	// The condition is always set on the first check, to clear one left behind by a previous run
+	reported := false
+	bypassed := false
+	for {
+		time.Sleep(snatCheckInterval)
+		result, err := c.networkClient.CheckSNATRules()
+		if err != nil {
+			log.Warnf("Failed to check for rules bypassing the AWS SNAT chain: %v", err)
+			ipamdErrInc("checkSNATRulesFailed")
+			continue
+		}
+		c.reportSNATCheck(result, reported, bypassed)
+		reported = true
+		bypassed = len(result.Problems) > 0 && !result.Repaired
+	}
+}
+
+// reportSNATCheck logs and records the outcome of a check, and updates the node condition if it changed
+func (c *IPAMContext) reportSNATCheck(result networkutils.SNATRulesCheck, reported, wasBypassed bool) {
+	message := strings.Join(result.Problems, "; ")
+	bypassed := len(result.Problems) > 0 && !result.Repaired
+	switch {
+	case result.Repaired:
+		message = "Moved the jump to the AWS SNAT chain back: " + message
+		log.Warn(message)
+		c.emitNodeEvent(v1.EventTypeWarning, snatRepairedReason, message)
+	case bypassed:
+		message = "Pod traffic leaving the VPC may not be SNATed: " + message
+		log.Warn(message)
+	}
+	if bypassed {
+		snatBypassed.Set(1)
+	} else {
+		snatBypassed.Set(0)
+	}
+	if reported && bypassed == wasBypassed {
+		return
+	}
+
+	reason := snatInPlaceReason
+	if bypassed {
+		reason = snatBypassedReason
+		c.emitNodeEvent(v1.EventTypeWarning, reason, message)
+	} else {
+		message = "Nothing bypasses the AWS SNAT chain"
+	}
+	if err := c.k8sClient.K8SSetNodeCondition(snatBypassedCondition, bypassed, reason, message); err != nil {
+		log.Warnf("Failed to set node condition %s: %v", snatBypassedCondition, err)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+)
+
+const (
+	// envSRIOV is the name of the environment variable that hands an SR-IOV virtual function of the ENI of a pod to the
+	// pods annotated with SRIOVAnnotation, on instances that expose VFs, e.g. bare-metal instances. The VF is moved to
+	// the network namespace of the pod in place of the veth, for DPDK and low-latency workloads. ipamd still manages the
+	// IP of the pod. Defaults to false.
+	envSRIOV = "AWS_VPC_K8S_CNI_SRIOV"
+
+	// SRIOVAnnotation is the annotation of the pods that get a VF instead of a veth, when set to "true"
+	SRIOVAnnotation = "vpc.amazonaws.com/sriov"
+)
+
+var sriovVFsAssigned = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "awscni_sriov_vfs_assigned",
+		Help: "The number of SR-IOV virtual functions assigned to pods",
+	},
+)
+
+// sriovState holds the VFs assigned to pods, keyed by the name_namespace_container of the pod. It is not persisted: a
+// VF in the network namespace of a pod is not listed in the host network namespace, so it is not handed out again after
+// a restart of ipamd, and the kernel moves it back to the host network namespace when the namespace of the pod is gone.
+type sriovState struct {
+	lock     sync.Mutex
+	assigned map[string]string
+}
+
+// sriovEnabled returns true if annotated pods can get a VF
+func sriovEnabled() bool {
+	return getEnvBoolWithDefault(envSRIOV, false)
+}
+
+// podWantsVF returns whether the pod is annotated to get a VF
+func (c *IPAMContext) podWantsVF(meta *podMetadata) (bool, error) {
+	if !c.sriov {
+		return false, nil
+	}
+	annotations, err := meta.getPodAnnotations()
+	if err != nil {
+		return false, err
+	}
+	value := strings.TrimSpace(annotations[SRIOVAnnotation])
+	if value == "" {
+		return false, nil
+	}
+	wantsVF, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.Errorf("invalid %s %q, expected true or false", SRIOVAnnotation, value)
+	}
+	return wantsVF, nil
+}
+
+// assignVF assigns a free VF of the ENI with the device number to the pod, and returns it with the subnet of the ENI
+func (c *IPAMContext) assignVF(k8sPod *k8sapi.K8SPodInfo, deviceNumber int) (string, string, error) {
+	enis, err := c.awsClient.GetAttachedENIs()
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to list the attached ENIs")
+	}
+	for _, eni := range enis {
+		if eni.DeviceNumber != deviceNumber {
+			continue
+		}
+		pf, err := c.networkClient.GetInterfaceName(eni.MAC)
+		if err != nil {
+			return "", "", err
+		}
+		vfs, err := c.networkClient.GetVFs(pf)
+		if err != nil {
+			return "", "", err
+		}
+
+		c.vfs.lock.Lock()
+		defer c.vfs.lock.Unlock()
+		if c.vfs.assigned == nil {
+			c.vfs.assigned = make(map[string]string)
+		}
+		for _, vf := range vfs {
+			if c.vfAssigned(vf) {
+				continue
+			}
+			c.vfs.assigned[vfPodKey(k8sPod)] = vf
+			sriovVFsAssigned.Set(float64(len(c.vfs.assigned)))
+			log.Infof("Assigned VF %s of %s (%s) to pod %s, namespace %s", vf, pf, eni.ENIID, k8sPod.Name, k8sPod.Namespace)
+			return vf, eni.SubnetIPv4CIDR.String(), nil
+		}
+		return "", "", errors.Errorf("no free VF on %s (%s), %d in use", pf, eni.ENIID, len(c.vfs.assigned))
+	}
+	return "", "", errors.Errorf("no ENI with device number %d", deviceNumber)
+}
+
+// vfAssigned returns whether the VF is assigned to a pod, with vfs.lock held. The VFs reserved for pods the CNI plugin
+// has not moved them to yet are still listed in the host network namespace.
+func (c *IPAMContext) vfAssigned(vf string) bool {
+	for _, assigned := range c.vfs.assigned {
+		if assigned == vf {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseVF releases the VF of the pod, and returns it or empty if the pod has none. Like for its IP, the VF of a
+// container that is not known is looked up by the name and namespace of the pod.
+func (c *IPAMContext) releaseVF(k8sPod *k8sapi.K8SPodInfo) string {
+	c.vfs.lock.Lock()
+	defer c.vfs.lock.Unlock()
+	key := vfPodKey(k8sPod)
+	vf, ok := c.vfs.assigned[key]
+	if !ok {
+		prefix := vfPodKey(&k8sapi.K8SPodInfo{Name: k8sPod.Name, Namespace: k8sPod.Namespace})
+		for podKey, podVF := range c.vfs.assigned {
+			if strings.HasPrefix(podKey, prefix) {
+				key, vf, ok = podKey, podVF, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return ""
+	}
+	delete(c.vfs.assigned, key)
+	sriovVFsAssigned.Set(float64(len(c.vfs.assigned)))
+	log.Infof("Released VF %s of pod %s, namespace %s", vf, k8sPod.Name, k8sPod.Namespace)
+	return vf
+}
+
+func vfPodKey(k8sPod *k8sapi.K8SPodInfo) string {
+	return fmt.Sprintf("%s_%s_%s", k8sPod.Name, k8sPod.Namespace, k8sPod.Container)
+}
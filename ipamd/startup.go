@@ -0,0 +1,180 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	clientset "k8s.io/client-go/kubernetes"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/ec2metadata"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/retry"
+)
+
+const (
+	// envStartupTimeout is the name of the environment variable that sets how long ipamd waits at startup for each of
+	// IMDS, the primary ENI and the API server to be ready before giving up, e.g. "10m". Defaults to 5 minutes.
+	envStartupTimeout     = "AWS_VPC_K8S_CNI_STARTUP_TIMEOUT"
+	defaultStartupTimeout = 5 * time.Minute
+
+	startupGateIMDS       = "imds"
+	startupGatePrimaryENI = "primary-eni"
+	startupGateAPIServer  = "api-server"
+
+	// optionalAPIServerTimeout is how long ipamd waits for the API server at startup when it can run without it
+	optionalAPIServerTimeout = 30 * time.Second
+)
+
+// startupGatePolicy is how often the dependencies of ipamd are checked while waiting for them at startup
+var startupGatePolicy = retry.Policy{
+	Name:         "STARTUP",
+	InitialDelay: time.Second,
+	MaxDelay:     30 * time.Second,
+	Multiplier:   2,
+	Jitter:       0.2,
+}
+
+var (
+	startupGateWait = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "awscni_startup_gate_wait_seconds",
+			Help: "How long ipamd waited at startup for each of its dependencies to be ready",
+		},
+		[]string{"gate"},
+	)
+
+	// startupSleep is replaced in tests
+	startupSleep = time.Sleep
+)
+
+// WaitForIMDS waits for the instance metadata service to answer
+func WaitForIMDS() error {
+	metadata := ec2metadata.NewNoRetry()
+	return waitForStartupGate(startupGateIMDS, getStartupTimeout(), func() error {
+		_, err := metadata.Region()
+		return err
+	})
+}
+
+// WaitForPrimaryENI waits for the interface of the primary ENI to be up with the primary IP of the instance, so that
+// the host network is not set up on an interface the OS is still configuring
+func WaitForPrimaryENI() error {
+	metadata := ec2metadata.NewNoRetry()
+	return waitForStartupGate(startupGatePrimaryENI, getStartupTimeout(), func() error {
+		return checkPrimaryENI(metadata, net.Interfaces, func(intf net.Interface) ([]net.Addr, error) {
+			return intf.Addrs()
+		})
+	})
+}
+
+// WaitForAPIServer waits for the API server to answer and returns a client for it. If ipamd can run without the API
+// server, it only waits for a short while and then returns a client that catches up once the API server answers.
+func WaitForAPIServer() (clientset.Interface, error) {
+	timeout := getStartupTimeout()
+	if APIServerOptional() && timeout > optionalAPIServerTimeout {
+		timeout = optionalAPIServerTimeout
+	}
+	var kubeClient clientset.Interface
+	err := waitForStartupGate(startupGateAPIServer, timeout, func() error {
+		var err error
+		kubeClient, err = k8sapi.CreateKubeClient()
+		return err
+	})
+	if err != nil && APIServerOptional() {
+		log.Warnf("Starting without the API server, the IPs of the pods are restored from the checkpoint: %v", err)
+		return k8sapi.GetKubeClient()
+	}
+	return kubeClient, err
+}
+
+// waitForStartupGate calls check until it succeeds, logging why ipamd is still waiting, or returns its last error once
+// timeout is over
+func waitForStartupGate(gate string, timeout time.Duration, check func() error) error {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := check()
+		waited := time.Since(start)
+		if err == nil {
+			log.Infof("Startup gate %s passed after %v (%d attempts)", gate, waited.Round(time.Millisecond), attempt)
+			startupGateWait.WithLabelValues(gate).Set(waited.Seconds())
+			return nil
+		}
+		if waited >= timeout {
+			log.Errorf("Startup gate %s not passed after %v, giving up: %v", gate, timeout, err)
+			return errors.Wrapf(err, "startup gate %s not passed after %v", gate, timeout)
+		}
+		delay := startupGatePolicy.Delay(attempt)
+		if remaining := timeout - waited; delay > remaining {
+			delay = remaining
+		}
+		log.Warnf("Waiting for startup gate %s (attempt %d, waited %v of %v), next check in %v: %v",
+			gate, attempt, waited.Round(time.Second), timeout, delay.Round(time.Millisecond), err)
+		startupSleep(delay)
+	}
+}
+
+// checkPrimaryENI returns an error until the interface with the MAC of the primary ENI is up and has its primary IP
+func checkPrimaryENI(metadata ec2metadata.EC2Metadata, interfaces func() ([]net.Interface, error),
+	addrs func(net.Interface) ([]net.Addr, error)) error {
+	mac, err := metadata.GetMetadata("mac")
+	if err != nil {
+		return errors.Wrap(err, "failed to get the MAC of the primary ENI")
+	}
+	primaryIP, err := metadata.GetMetadata("local-ipv4")
+	if err != nil {
+		return errors.Wrap(err, "failed to get the primary IP")
+	}
+
+	intfs, err := interfaces()
+	if err != nil {
+		return errors.Wrap(err, "failed to list the interfaces")
+	}
+	for _, intf := range intfs {
+		if !strings.EqualFold(mac, intf.HardwareAddr.String()) {
+			continue
+		}
+		if intf.Flags&net.FlagUp == 0 {
+			return errors.Errorf("interface %s of the primary ENI is down", intf.Name)
+		}
+		intfAddrs, err := addrs(intf)
+		if err != nil {
+			return errors.Wrapf(err, "failed to list the addresses of interface %s", intf.Name)
+		}
+		for _, addr := range intfAddrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.String() == primaryIP {
+				return nil
+			}
+		}
+		return errors.Errorf("interface %s of the primary ENI does not have the primary IP %s yet", intf.Name, primaryIP)
+	}
+	return errors.Errorf("no interface with the MAC %s of the primary ENI", mac)
+}
+
+func getStartupTimeout() time.Duration {
+	if strValue := os.Getenv(envStartupTimeout); strValue != "" {
+		timeout, err := time.ParseDuration(strValue)
+		if err == nil && timeout > 0 {
+			return timeout
+		}
+		log.Errorf("Failed to parse %s %q, using default: %v", envStartupTimeout, strValue, defaultStartupTimeout)
+	}
+	return defaultStartupTimeout
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	mock_ec2metadata "github.com/aws/amazon-vpc-cni-k8s/pkg/ec2metadata/mocks"
+)
+
+func TestWaitForStartupGate(t *testing.T) {
+	var slept []time.Duration
+	startupSleep = func(d time.Duration) { slept = append(slept, d) }
+	defer func() { startupSleep = time.Sleep }()
+
+	calls := 0
+	err := waitForStartupGate(startupGateIMDS, time.Hour, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	// The delay keeps growing across attempts instead of starting over
+	assert.Len(t, slept, 2)
+	assert.True(t, slept[1] > slept[0])
+
+	err = waitForStartupGate(startupGateAPIServer, time.Nanosecond, func() error {
+		time.Sleep(time.Millisecond)
+		return errors.New("connection refused")
+	})
+	assert.EqualError(t, err, "startup gate api-server not passed after 1ns: connection refused")
+}
+
+func TestCheckPrimaryENI(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	metadata := mock_ec2metadata.NewMockEC2Metadata(ctrl)
+	metadata.EXPECT().GetMetadata("mac").Return("0a:1b:2c:3d:4e:5f", nil).AnyTimes()
+	metadata.EXPECT().GetMetadata("local-ipv4").Return(ipaddr01, nil).AnyTimes()
+
+	mac, _ := net.ParseMAC("0a:1b:2c:3d:4e:5f")
+	primary := net.Interface{Name: "eth0", HardwareAddr: mac, Flags: net.FlagUp}
+	var addrs []net.Addr
+	check := func(intfs ...net.Interface) error {
+		return checkPrimaryENI(metadata,
+			func() ([]net.Interface, error) { return intfs, nil },
+			func(net.Interface) ([]net.Addr, error) { return addrs, nil })
+	}
+
+	assert.EqualError(t, check(), "no interface with the MAC 0a:1b:2c:3d:4e:5f of the primary ENI")
+	assert.EqualError(t, check(primary), "interface eth0 of the primary ENI does not have the primary IP 10.10.10.11 yet")
+
+	addrs = []net.Addr{&net.IPNet{IP: net.ParseIP(ipaddr01), Mask: net.CIDRMask(24, 32)}}
+	assert.NoError(t, check(primary))
+
+	primary.Flags = 0
+	assert.EqualError(t, check(primary), "interface eth0 of the primary ENI is down")
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamd
+
+import (
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// envVethSweeper is the name of the environment variable that turns on the removal of the host-side veth devices left
+// behind by pods that are gone. Defaults to false.
+const envVethSweeper = "AWS_VPC_K8S_CNI_VETH_SWEEPER"
+
+// vethSweepInterval is how often the host-side veth devices are checked for ones left behind by pods that are gone
+const vethSweepInterval = 5 * time.Minute
+
+var orphanedVethsRemoved = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "awscni_orphaned_veths_removed_count",
+		Help: "The number of host-side veth devices removed because no pod in the datastore uses them",
+	},
+)
+
+func vethSweeperEnabled() bool {
+	return getEnvBoolWithDefault(envVethSweeper, false)
+}
+
+// StartVethSweeper periodically removes the host-side veth devices, and their routes and rules, that no pod uses, if
+// enabled. Container runtimes that crash before calling DEL leave them behind, and they accumulate. The first sweep
+// waits for the pods of the node to be recovered, the veths of the pods not recovered yet would look orphaned.
+func (c *IPAMContext) StartVethSweeper() {
+	if !vethSweeperEnabled() {
+		return
+	}
+	c.waitForRecovery()
+	log.Info("Started sweeping orphaned veth devices")
+	candidates := make(map[string]bool)
+	for {
+		time.Sleep(vethSweepInterval)
+		candidates = c.sweepOrphanedVeths(candidates)
+	}
+}
+
+// sweepOrphanedVeths removes the veths that were already orphaned on the previous sweep, and returns the ones that are
+// orphaned now. A veth is only removed when it is orphaned on two sweeps in a row, so that the veth of a pod being set
+// up, which has no host route yet, or being torn down, whose namespace is about to be deleted, is left alone. A veth is
+// orphaned when no pod in the datastore has its IPs, and no pod of the node has them according to the API server either.
+func (c *IPAMContext) sweepOrphanedVeths(candidates map[string]bool) map[string]bool {
+	veths, err := c.networkClient.GetPodVeths()
+	if err != nil {
+		log.Warnf("Failed to list the veth devices of pods: %v", err)
+		ipamdErrInc("sweepOrphanedVethsFailed")
+		return candidates
+	}
+	// The pods that have not been deleted still run their containers, whatever the datastore says
+	localPods, err := c.k8sClient.K8SGetLocalPodIPs()
+	if err != nil {
+		log.Warnf("Not sweeping veth devices, failed to get the pods of the node: %v", err)
+		return candidates
+	}
+
+	// The IPs reserved for the fast path have no veth, a claimed one is assigned to its pod long before a second sweep
+	assignedIPs := make(map[string]bool)
+	for key, podInfo := range *c.dataStore.GetPodInfos() {
+		if isFastPathPlaceholder(key) {
+			continue
+		}
+		assignedIPs[podInfo.IP] = true
+		if podInfo.IPv6 != "" {
+			assignedIPs[podInfo.IPv6] = true
+		}
+	}
+	for _, pod := range localPods {
+		if pod.IP != "" {
+			assignedIPs[pod.IP] = true
+		}
+	}
+	if c.podENI {
+		for _, ip := range c.branchENIIPs() {
+			assignedIPs[ip] = true
+		}
+	}
+
+	orphaned := make(map[string]bool)
+	for _, veth := range veths {
+		inUse := false
+		var ips []string
+		for _, ip := range veth.IPs {
+			if assignedIPs[ip.String()] {
+				inUse = true
+				break
+			}
+			ips = append(ips, ip.String())
+		}
+		if inUse {
+			continue
+		}
+		if !candidates[veth.Name] {
+			log.Debugf("Veth %s with IPs %v is not used by any pod, removing it on the next sweep", veth.Name, veth.IPs)
+			orphaned[veth.Name] = true
+			continue
+		}
+		// One of its IPs may have been assigned to a new pod since the datastore was read
+		veth := veth
+		unassigned, err := c.dataStore.WithIPsUnassigned(ips, isFastPathPlaceholder, func() error {
+			return c.networkClient.DeletePodVeth(veth)
+		})
+		if !unassigned {
+			log.Debugf("Veth %s has an IP that was just assigned to a pod, leaving it alone", veth.Name)
+			continue
+		}
+		if err != nil {
+			log.Warnf("Failed to remove orphaned veth %s: %v", veth.Name, err)
+			ipamdErrInc("sweepOrphanedVethsFailed")
+			orphaned[veth.Name] = true
+			continue
+		}
+		log.Infof("Removed orphaned veth %s with IPs %v", veth.Name, veth.IPs)
+		orphanedVethsRemoved.Inc()
+	}
+	return orphaned
+}
@@ -22,8 +22,10 @@ import (
 	"github.com/aws/amazon-vpc-cni-k8s/ipamd"
 	log "github.com/cihub/seelog"
 
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/clusterconfig"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/eniconfig"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/platform"
 )
 
 const (
@@ -42,16 +44,48 @@ func _main() int {
 	defer log.Flush()
 	logger.SetupLogger(logger.GetLogFileLocation(defaultLogFilePath))
 
-	log.Infof("Starting L-IPAMD %s  ...", version)
+	log.Infof("Starting L-IPAMD %s on %s with the %s dataplane ...", version, platform.Current.OS,
+		platform.Current.Dataplane)
 
-	kubeClient, err := k8sapi.CreateKubeClient()
+	// Wait for the dependencies of ipamd in process, rather than crash looping until they are ready, so that the
+	// logs show what ipamd is waiting for
+	if err := ipamd.WaitForIMDS(); err != nil {
+		return 1
+	}
+	if err := ipamd.WaitForPrimaryENI(); err != nil {
+		return 1
+	}
+	kubeClient, err := ipamd.WaitForAPIServer()
 	if err != nil {
-		log.Errorf("Failed to create client: %v", err)
 		return 1
 	}
 
 	discoverController := k8sapi.NewController(kubeClient)
 	go discoverController.DiscoverK8SPods()
+	go discoverController.DiscoverK8SNamespaces()
+
+	// Node profiles override the environment, which the rest of the configuration is read from
+	if err := ipamd.ApplyNodeProfile(discoverController); err != nil {
+		if !ipamd.APIServerOptional() {
+			log.Errorf("Failed to apply node profile: %v", err)
+			return 1
+		}
+		log.Warnf("Failed to apply node profile, starting with the default configuration: %v", err)
+	}
+
+	// The ClusterCNIConfig overrides the node profile, and is applied again whenever it changes
+	clusterConfigController := clusterconfig.New(discoverController)
+	if clusterconfig.Enabled() {
+		if _, _, err := clusterConfigController.Sync(); err != nil {
+			log.Errorf("Failed to apply ClusterCNIConfig, starting with the current configuration: %v", err)
+		}
+	}
+
+	// The same settings configure every platform, the ones the dataplane of this one does not implement are rejected
+	if err := platform.Current.ValidateEnv(); err != nil {
+		log.Errorf("Invalid configuration: %v", err)
+		return 1
+	}
 
 	eniConfigController := eniconfig.NewENIConfigController()
 	if ipamd.UseCustomNetworkCfg() {
@@ -68,12 +102,46 @@ func _main() int {
 	// Pool manager
 	go ipamContext.StartNodeIPPoolManager()
 
+	if clusterconfig.Enabled() {
+		go clusterConfigController.Start(ipamContext.ReloadConfig, ipamContext.Restart)
+	}
+
 	// Prometheus metrics
 	go ipamContext.ServeMetrics()
 
 	// CNI introspection endpoints
 	go ipamContext.ServeIntrospection()
 
+	// Optional BGP advertisement of pod IPs
+	go ipamContext.StartBGPSpeaker()
+
+	// Optional check for iptables rules bypassing the AWS SNAT chain
+	go ipamContext.StartSNATCheck()
+
+	// Check of the mode of kube-proxy against the host network
+	go ipamContext.StartKubeProxyCheck()
+
+	// Check of the marks of the host rules against the rules of others, e.g. Istio
+	go ipamContext.StartMarkCheck()
+
+	// Removal of host-side veth devices left behind by pods that are gone
+	go ipamContext.StartVethSweeper()
+
+	// Optional export of the pod IPs for firewalls
+	go ipamContext.StartPodIPExport()
+
+	// Optional audit of the IPs in EC2, the datastore and the kernel
+	go ipamContext.StartAuditor()
+
+	// Optional counting of the packets of pods likely to be dropped
+	go ipamContext.StartDropMonitor()
+
+	// Optional publishing of the ENI and IP inventory of the node as annotations
+	go ipamContext.StartNodeInventory()
+
+	// Memory and goroutine watermarks
+	go ipamContext.StartResourceMonitor()
+
 	/*
 	// Copy the CNI plugin and config. This will mark the node as Ready.
 	log.Info("Copying /app/aws-cni to /host/opt/cni/bin/aws-cni")
@@ -28,3 +28,73 @@ type ENIConfigSpec struct {
 type ENIConfigStatus struct {
 	// Fill me
 }
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ClusterCNIConfigList is a list of ClusterCNIConfigs
+type ClusterCNIConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []ClusterCNIConfig `json:"items"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ClusterCNIConfig holds the configuration of the CNI of every node of the cluster, which aws-node applies without
+// being restarted
+type ClusterCNIConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              ClusterCNIConfigSpec   `json:"spec"`
+	Status            ClusterCNIConfigStatus `json:"status,omitempty"`
+}
+
+// ClusterCNIConfigSpec is the configuration, as the environment variables of aws-node
+type ClusterCNIConfigSpec struct {
+	Env map[string]string `json:"env,omitempty"`
+	// Overrides are applied on top of Env on the nodes that match their node selector. Only the first one that matches
+	// is applied.
+	Overrides []ClusterCNIConfigOverride `json:"overrides,omitempty"`
+	// Rollout stages the changes of the settings of the dataplane, like SNAT, the connmark or the MTU. The other settings
+	// apply to all nodes at once. When it is not set, the dataplane settings also apply to all nodes at once.
+	Rollout *ClusterCNIConfigRollout `json:"rollout,omitempty"`
+}
+
+// ClusterCNIConfigRollout selects the nodes that apply a change of the dataplane settings
+type ClusterCNIConfigRollout struct {
+	// Percent is the percentage of nodes that apply the change. The same nodes stay selected when it is increased.
+	Percent int `json:"percent"`
+	// CanarySelector selects nodes that apply the change first, whatever the percentage
+	CanarySelector map[string]string `json:"canarySelector,omitempty"`
+	// MaxFailedNodes is the number of nodes that must fail with the change to halt the rollout. Defaults to 1.
+	MaxFailedNodes int `json:"maxFailedNodes,omitempty"`
+	// MaxErrors is the number of ipamd errors after which a node that applied the change fails with it. Defaults to 10.
+	MaxErrors int `json:"maxErrors,omitempty"`
+}
+
+// ClusterCNIConfigOverride is the configuration of a group of nodes
+type ClusterCNIConfigOverride struct {
+	Name         string            `json:"name"`
+	NodeSelector map[string]string `json:"nodeSelector"`
+	Env          map[string]string `json:"env,omitempty"`
+}
+
+// ClusterCNIConfigStatus counts the nodes that failed with the dataplane settings of the configuration. Each node reports
+// the configuration it applied in an annotation of the node instead, so that the status does not grow with the cluster.
+type ClusterCNIConfigStatus struct {
+	// FailedNodes is the number of nodes that failed with the dataplane settings, by their identifier. Only the latest
+	// dataplane settings are counted.
+	FailedNodes map[string]int `json:"failedNodes,omitempty"`
+}
+
+// ClusterCNIConfigNodeStatus is the configuration applied by a node, reported in an annotation of the node
+type ClusterCNIConfigNodeStatus struct {
+	Generation int64 `json:"generation"`
+	// Override is the name of the override applied by the node, empty if none is
+	Override string `json:"override,omitempty"`
+	// Dataplane identifies the dataplane settings applied by the node
+	Dataplane string `json:"dataplane,omitempty"`
+	// Failed is set when the errors of ipamd rose after the node applied the dataplane settings
+	Failed      bool        `json:"failed,omitempty"`
+	LastApplied metav1.Time `json:"lastApplied"`
+}
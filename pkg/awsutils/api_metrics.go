@@ -0,0 +1,113 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package awsutils
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	awsretry "github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The metrics of the calls to the EC2 API, by operation. They are recorded by middlewares of the AWS SDK clients, so
+// that every operation is covered, including the attempts the SDK retries.
+var (
+	ec2APIRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "awscni_ec2_api_requests_total",
+			Help: "The number of calls to the EC2 API, retries included in a single call",
+		},
+		[]string{"api"},
+	)
+	ec2APIErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "awscni_ec2_api_errors_total",
+			Help: "The number of calls to the EC2 API that failed after their retries, by error code",
+		},
+		[]string{"api", "error"},
+	)
+	ec2APIThrottles = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "awscni_ec2_api_throttles_total",
+			Help: "The number of attempts of calls to the EC2 API that were throttled",
+		},
+		[]string{"api"},
+	)
+	ec2APILatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "awscni_ec2_api_latency_seconds",
+			Help:    "The latency of the calls to the EC2 API in seconds, retries included",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+		},
+		[]string{"api"},
+	)
+)
+
+// isErrorThrottle tells the errors of the attempts that were throttled
+var isErrorThrottle = awsretry.IsErrorThrottles(awsretry.DefaultThrottles)
+
+// instrumentConfig records the metrics of every call made with the clients of cfg
+func instrumentConfig(cfg *awsv2.Config) {
+	cfg.APIOptions = append(cfg.APIOptions, addEC2APIMetrics)
+}
+
+// addEC2APIMetrics adds the middlewares that record the metrics of a call, and of each of its attempts after the
+// retryer
+func addEC2APIMetrics(stack *middleware.Stack) error {
+	err := stack.Initialize.Add(middleware.InitializeMiddlewareFunc("awscni.ec2APIMetrics", recordEC2APICall),
+		middleware.Before)
+	if err != nil {
+		return err
+	}
+	return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("awscni.ec2APIAttemptMetrics", recordEC2APIAttempt),
+		middleware.After)
+}
+
+// recordEC2APIAttempt counts an attempt that was throttled
+func recordEC2APIAttempt(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (
+	middleware.FinalizeOutput, middleware.Metadata, error) {
+	out, metadata, err := next.HandleFinalize(ctx, in)
+	if err != nil && isErrorThrottle.IsErrorThrottle(err).Bool() {
+		ec2APIThrottles.WithLabelValues(middleware.GetOperationName(ctx)).Inc()
+	}
+	return out, metadata, err
+}
+
+// recordEC2APICall records a call, once its retries are done
+func recordEC2APICall(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (
+	middleware.InitializeOutput, middleware.Metadata, error) {
+	start := time.Now()
+	out, metadata, err := next.HandleInitialize(ctx, in)
+	api := middleware.GetOperationName(ctx)
+	ec2APIRequests.WithLabelValues(api).Inc()
+	ec2APILatency.WithLabelValues(api).Observe(time.Since(start).Seconds())
+	if err != nil {
+		code := "Unknown"
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			code = apiErr.ErrorCode()
+		}
+		// The dry runs of the permission check fail when they would have succeeded
+		if code != dryRunOperationCode {
+			ec2APIErrors.WithLabelValues(api, code).Inc()
+		}
+		recordUnauthorized(api, code)
+	}
+	return out, metadata, err
+}
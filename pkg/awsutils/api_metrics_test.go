@@ -0,0 +1,88 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package awsutils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func metricValue(t *testing.T, metric prometheus.Metric) float64 {
+	m := &dto.Metric{}
+	assert.NoError(t, metric.Write(m))
+	if m.Histogram != nil {
+		return float64(m.Histogram.GetSampleCount())
+	}
+	return m.Counter.GetValue()
+}
+
+func TestEC2APIMetrics(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`<Response><Errors><Error><Code>RequestLimitExceeded</Code>` +
+				`<Message>Request limit exceeded.</Message></Error></Errors><RequestID>1</RequestID></Response>`))
+			return
+		}
+		_, _ = w.Write([]byte(`<DescribeInstancesResponse><reservationSet/></DescribeInstancesResponse>`))
+	}))
+	defer server.Close()
+
+	cfg := aws.Config{
+		Region:       "us-west-2",
+		BaseEndpoint: aws.String(server.URL),
+		Credentials:  credentials.NewStaticCredentialsProvider("id", "secret", ""),
+		Retryer: func() aws.Retryer {
+			return retry.AddWithMaxAttempts(retry.NewStandard(func(o *retry.StandardOptions) {
+				o.Backoff = retry.BackoffDelayerFunc(func(int, error) (time.Duration, error) { return 0, nil })
+			}), 2)
+		},
+	}
+	instrumentConfig(&cfg)
+	client := ec2.NewFromConfig(cfg)
+
+	requests := ec2APIRequests.WithLabelValues("DescribeInstances")
+	errs := ec2APIErrors.WithLabelValues("DescribeInstances", "RequestLimitExceeded")
+	throttles := ec2APIThrottles.WithLabelValues("DescribeInstances")
+	latency := ec2APILatency.WithLabelValues("DescribeInstances").(prometheus.Metric)
+
+	// Both attempts are throttled
+	_, err := client.DescribeInstances(context.Background(), &ec2.DescribeInstancesInput{})
+	assert.Error(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, float64(1), metricValue(t, requests))
+	assert.Equal(t, float64(1), metricValue(t, errs))
+	assert.Equal(t, float64(2), metricValue(t, throttles))
+	assert.Equal(t, float64(1), metricValue(t, latency))
+
+	_, err = client.DescribeInstances(context.Background(), &ec2.DescribeInstancesInput{})
+	assert.NoError(t, err)
+	assert.Equal(t, float64(2), metricValue(t, requests))
+	assert.Equal(t, float64(1), metricValue(t, errs))
+	assert.Equal(t, float64(2), metricValue(t, throttles))
+	assert.Equal(t, float64(2), metricValue(t, latency))
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package awsutils
+
+import (
+	"os"
+	"regexp"
+	"time"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// envRoleARN is the name of the environment variable that sets the IAM role ipamd assumes to manage ENIs and IPs,
+	// e.g. a role of the networking account that owns the subnets of a shared VPC. Defaults to the role of the node.
+	envRoleARN = "AWS_VPC_K8S_CNI_ROLE_ARN"
+	// envRoleExternalID is the name of the environment variable that sets the external ID the trust policy of the role
+	// may require
+	envRoleExternalID = "AWS_VPC_K8S_CNI_ROLE_EXTERNAL_ID"
+	// envRoleSessionName is the name of the environment variable that sets the session name of the role, which shows
+	// up in CloudTrail. Defaults to the name of the node.
+	envRoleSessionName     = "AWS_VPC_K8S_CNI_ROLE_SESSION_NAME"
+	defaultRoleSessionName = "aws-node"
+
+	// assumeRoleDuration is how long the credentials of the role are valid
+	assumeRoleDuration = time.Hour
+	// assumeRoleExpiryWindow is how long before they expire the credentials of the role are refreshed, so that no call
+	// is made with credentials that expire on the way
+	assumeRoleExpiryWindow = 5 * time.Minute
+	// maxRoleSessionNameLength is the maximum length of a session name allowed by STS
+	maxRoleSessionNameLength = 64
+)
+
+// invalidRoleSessionNameChars are the characters STS does not allow in a session name
+var invalidRoleSessionNameChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// assumeRole returns a copy of cfg with the credentials of the role set by AWS_VPC_K8S_CNI_ROLE_ARN, or cfg if no role is
+// set. The credentials are cached and refreshed before they expire.
+func assumeRole(cfg awsv2.Config) (awsv2.Config, error) {
+	roleARN := os.Getenv(envRoleARN)
+	if roleARN == "" {
+		return cfg, nil
+	}
+	if _, err := arn.Parse(roleARN); err != nil {
+		return cfg, errors.Wrapf(err, "invalid %s %q", envRoleARN, roleARN)
+	}
+	sessionName := getRoleSessionName()
+	log.Infof("Assuming role %s with session name %s to manage ENIs and IPs", roleARN, sessionName)
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), roleARN, func(o *stscreds.AssumeRoleOptions) {
+		configureAssumeRole(o, sessionName, os.Getenv(envRoleExternalID))
+	})
+	assumed := cfg.Copy()
+	assumed.Credentials = awsv2.NewCredentialsCache(provider, func(o *awsv2.CredentialsCacheOptions) {
+		o.ExpiryWindow = assumeRoleExpiryWindow
+	})
+	return assumed, nil
+}
+
+// configureAssumeRole sets the session name, external ID and duration of the credentials of the role
+func configureAssumeRole(o *stscreds.AssumeRoleOptions, sessionName, externalID string) {
+	o.RoleSessionName = sessionName
+	if externalID != "" {
+		o.ExternalID = awsv2.String(externalID)
+	}
+	o.Duration = assumeRoleDuration
+}
+
+// getRoleSessionName returns the session name of the role, made of the characters STS allows
+func getRoleSessionName() string {
+	name := os.Getenv(envRoleSessionName)
+	if name == "" {
+		name = os.Getenv("MY_NODE_NAME")
+	}
+	name = invalidRoleSessionNameChars.ReplaceAllString(name, "-")
+	if len(name) > maxRoleSessionNameLength {
+		name = name[:maxRoleSessionNameLength]
+	}
+	if len(name) < 2 {
+		return defaultRoleSessionName
+	}
+	return name
+}
+
+// GetConfigForDebug returns the active values of the configuration env vars (for debugging purposes).
+func GetConfigForDebug() map[string]interface{} {
+	return map[string]interface{}{
+		envRoleARN:         os.Getenv(envRoleARN),
+		envRoleSessionName: getRoleSessionName(),
+		clusterNameEnvVar:  os.Getenv(clusterNameEnvVar),
+		clusterIDEnvVar:    os.Getenv(clusterIDEnvVar),
+	}
+}
@@ -17,9 +17,11 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
-	"os"
+	"net/http"
+	"net/netip"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -29,33 +31,40 @@ import (
 
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/ec2metadata"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/ec2wrapper"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/cidr"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/retry"
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/eks"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 const (
-	metadataMACPath      = "network/interfaces/macs/"
-	metadataAZ           = "placement/availability-zone/"
-	metadataLocalIP      = "local-ipv4"
-	metadataInstanceID   = "instance-id"
-	metadataInstanceType = "instance-type"
-	metadataMAC          = "mac"
-	metadataSGs          = "/security-group-ids/"
-	metadataSubnetID     = "/subnet-id/"
-	metadataVPCcidrs     = "/vpc-ipv4-cidr-blocks/"
-	metadataVPCcidr      = "/vpc-ipv4-cidr-block/"
-	metadataDeviceNum    = "/device-number/"
-	metadataInterface    = "/interface-id/"
-	metadataSubnetCIDR   = "/subnet-ipv4-cidr-block"
-	metadataIPv4s        = "/local-ipv4s"
-	maxENIDeleteRetries  = 12
-	maxENIBackoffDelay   = time.Minute
-	eniDescriptionPrefix = "aws-K8S-"
-	metadataOwnerID      = "/owner-id"
+	metadataMACPath         = "network/interfaces/macs/"
+	metadataAZ              = "placement/availability-zone/"
+	metadataLocalIP         = "local-ipv4"
+	metadataInstanceID      = "instance-id"
+	metadataInstanceType    = "instance-type"
+	metadataMAC             = "mac"
+	metadataSGs             = "/security-group-ids/"
+	metadataSubnetID        = "/subnet-id/"
+	metadataVPCcidrs        = "/vpc-ipv4-cidr-blocks/"
+	metadataVPCcidr         = "/vpc-ipv4-cidr-block/"
+	metadataDeviceNum       = "/device-number/"
+	metadataInterface       = "/interface-id/"
+	metadataSubnetCIDR      = "/subnet-ipv4-cidr-block"
+	metadataIPv4s           = "/local-ipv4s"
+	metadataIPv6s           = "/ipv6s"
+	metadataIPv4Prefixes    = "/ipv4-prefix"
+	metadataVPCIPv6CIDRs    = "/vpc-ipv6-cidr-blocks"
+	metadataSubnetIPv6CIDRs = "/subnet-ipv6-cidr-blocks"
+	maxENIDeleteRetries     = 12
+	maxENIBackoffDelay      = time.Minute
+	eniDescriptionPrefix    = "aws-K8S-"
+	metadataOwnerID         = "/owner-id"
 
 	// AllocENI need to choose a first free device number between 0 and maxENI
 	maxENIs           = 128
@@ -73,18 +82,40 @@ const (
 // ErrENINotFound is an error when ENI is not found.
 var ErrENINotFound = errors.New("ENI is not found")
 
+var (
+	// ec2RetryPolicy is how EC2 API calls are retried by the AWS SDK, close to the SDK's defaults
+	ec2RetryPolicy = retry.Policy{
+		Name:         "EC2",
+		InitialDelay: 30 * time.Millisecond,
+		MaxDelay:     5 * time.Minute,
+		Multiplier:   2,
+		Jitter:       1,
+		MaxAttempts:  16,
+	}
+
+	// tagENIRetryPolicy is how tagging a new ENI is retried
+	tagENIRetryPolicy = retry.Policy{
+		Name:         "ENI_TAG",
+		InitialDelay: time.Second,
+		MaxDelay:     time.Minute,
+		Multiplier:   2,
+		Jitter:       0.3,
+		MaxAttempts:  5,
+	}
+)
+
 var (
 	awsAPILatency = prometheus.NewSummaryVec(
 		prometheus.SummaryOpts{
 			Name: "awscni_aws_api_latency_ms",
-			Help: "AWS API call latency in ms",
+			Help: "Instance metadata call latency in ms, see awscni_ec2_api_latency_seconds for EC2",
 		},
 		[]string{"api", "error"},
 	)
 	awsAPIErr = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "awscni_aws_api_error_count",
-			Help: "The number of times AWS API returns an error",
+			Help: "The number of times instance metadata returns an error, see awscni_ec2_api_errors_total for EC2",
 		},
 		[]string{"api", "error"},
 	)
@@ -121,14 +152,38 @@ type APIs interface {
 	// DeallocIPAddresses deallocates the list of IP addresses from a ENI
 	DeallocIPAddresses(eniID string, ips []string) error
 
+	// AllocIPv4Prefixes allocates numPrefixes /28 IPv4 prefixes on a ENI, and returns them
+	AllocIPv4Prefixes(eniID string, numPrefixes int) ([]netip.Prefix, error)
+
+	// DeallocIPv4Prefixes deallocates the list of IPv4 prefixes from a ENI
+	DeallocIPv4Prefixes(eniID string, prefixes []netip.Prefix) error
+
+	// GetENIIPv4Prefixes returns the IPv4 prefixes of the ENI with the given MAC address
+	GetENIIPv4Prefixes(eniMAC string) ([]netip.Prefix, error)
+
+	// AllocIPv6Addresses allocates numIPs IPv6 addresses on a ENI
+	AllocIPv6Addresses(eniID string, numIPs int) error
+
+	// GetENIIPv6s returns the IPv6 addresses of the ENI with the given MAC address
+	GetENIIPv6s(eniMAC string) ([]string, error)
+
+	// GetVPCIPv6CIDRs returns the IPv6 CIDRs of the VPC
+	GetVPCIPv6CIDRs() ([]netip.Prefix, error)
+
+	// GetENISubnetIPv6CIDRs returns the IPv6 CIDRs of the subnet of the ENI with the given MAC address
+	GetENISubnetIPv6CIDRs(eniMAC string) ([]netip.Prefix, error)
+
 	// GetVPCIPv4CIDR returns VPC's 1st CIDR
-	GetVPCIPv4CIDR() string
+	GetVPCIPv4CIDR() netip.Prefix
 
 	// GetVPCIPv4CIDRs returns VPC's CIDRs
-	GetVPCIPv4CIDRs() []*string
+	GetVPCIPv4CIDRs() []netip.Prefix
 
 	// GetLocalIPv4 returns the primary IP address on the primary ENI interface
-	GetLocalIPv4() string
+	GetLocalIPv4() netip.Addr
+
+	// RefreshLocalIPv4 looks up the primary IP address on the primary ENI interface again and returns it
+	RefreshLocalIPv4() (netip.Addr, error)
 
 	// GetPrimaryENI returns the primary ENI
 	GetPrimaryENI() string
@@ -141,6 +196,48 @@ type APIs interface {
 
 	// GetPrimaryENImac returns the mac address of the primary ENI
 	GetPrimaryENImac() string
+
+	// GetInstanceID returns the ID of the instance
+	GetInstanceID() string
+
+	// GetClusterName returns the name of the cluster of the node, or an empty string if it is unknown
+	GetClusterName() string
+
+	// GetClusterID returns the ID of the cluster of the node, or an empty string if it is unknown
+	GetClusterID() string
+
+	// CheckPermissions returns the IAM actions of the given features that are denied, by feature
+	CheckPermissions(features []string) map[string][]string
+
+	// GetEIPs returns the elastic IPs of a pool
+	GetEIPs(pool EIPPool) ([]EIP, error)
+
+	// AssociateEIP associates an elastic IP with a private IP of an ENI
+	AssociateEIP(allocationID, eniID, privateIP string) error
+
+	// DisassociateEIP removes the association of an elastic IP
+	DisassociateEIP(associationID string) error
+
+	// GetTrunkENI returns the trunk ENI attached to the instance, with an empty ID if there is none
+	GetTrunkENI() (TrunkENI, error)
+
+	// AllocTrunkENI creates a trunk ENI and attaches it to the instance
+	AllocTrunkENI() (TrunkENI, error)
+
+	// AllocBranchENI creates a branch ENI for a pod, or a warm one without a pod, and associates it with the trunk ENI
+	AllocBranchENI(trunkENI string, vlanID int, securityGroups []string, podNamespace, podName string) (BranchENI, error)
+
+	// AssignBranchENI gives a warm branch ENI the security groups of a pod and tags it with the pod
+	AssignBranchENI(branch BranchENI, securityGroups []string, podNamespace, podName string) (BranchENI, error)
+
+	// GetBranchENILimit returns the number of branch ENIs that can be associated with the trunk ENI of the instance
+	GetBranchENILimit() (int, error)
+
+	// FreeBranchENI removes the association of a branch ENI and deletes it
+	FreeBranchENI(branch BranchENI) error
+
+	// GetBranchENIs returns the branch ENIs associated with the trunk ENI
+	GetBranchENIs(trunkENI string) ([]BranchENI, error)
 }
 
 // EC2InstanceMetadataCache caches instance metadata
@@ -149,22 +246,37 @@ type EC2InstanceMetadataCache struct {
 	securityGroups   []*string
 	subnetID         string
 	cidrBlock        string
-	localIPv4        string
+	localIPv4        netip.Addr
 	instanceID       string
 	instanceType     string
-	vpcIPv4CIDR      string
-	vpcIPv4CIDRs     []*string
+	vpcIPv4CIDR      netip.Prefix
+	vpcIPv4CIDRs     []netip.Prefix
 	primaryENI       string
 	primaryENImac    string
 	availabilityZone string
 	region           string
 	accountID        string
+	clusterName      string
+	clusterID        string
 
 	// dynamic
 	currentENIs int
 
+	// trunkENI is the trunk ENI of the instance, left out of the attached ENIs, empty if there is none
+	trunkENI     string
+	trunkENILock sync.RWMutex
+
 	ec2Metadata ec2metadata.EC2Metadata
 	ec2SVC      ec2wrapper.EC2
+	eksSVC      eksAPI
+
+	// deniedActions are the IAM actions found denied by CheckPermissions
+	deniedActions   map[string]bool
+	permissionsLock sync.RWMutex
+
+	// subnetOwners are the accounts that own the subnets of the ENIs, empty if unknown
+	subnetOwners     map[string]string
+	subnetOwnersLock sync.Mutex
 }
 
 // ENIMetadata contains ENI information retrieved from EC2 meta data service
@@ -179,7 +291,7 @@ type ENIMetadata struct {
 	DeviceNumber int // 0 means it is primary interface
 
 	// SubnetIPv4CIDR is the ipv4 cider of network interface
-	SubnetIPv4CIDR string
+	SubnetIPv4CIDR netip.Prefix
 
 	// The ip addresses allocated for the network interface
 	LocalIPv4s []string
@@ -195,6 +307,13 @@ func prometheusRegister() {
 		prometheus.MustRegister(awsAPILatency)
 		prometheus.MustRegister(awsAPIErr)
 		prometheus.MustRegister(awsUtilsErr)
+		prometheus.MustRegister(ec2APIRequests)
+		prometheus.MustRegister(ec2APIErrors)
+		prometheus.MustRegister(ec2APIThrottles)
+		prometheus.MustRegister(ec2APILatency)
+		prometheus.MustRegister(missingPermission)
+		prometheus.MustRegister(sharedSubnet)
+		prometheus.MustRegister(clusterInfo)
 		prometheusRegistered = true
 	}
 }
@@ -215,20 +334,32 @@ func New() (*EC2InstanceMetadataCache, error) {
 	cache.region = region
 	log.Debugf("Discovered region: %s", cache.region)
 
-	sess, err := session.NewSession(
-		&aws.Config{Region: aws.String(cache.region),
-			MaxRetries: aws.Int(15)})
+	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(cache.region),
+		config.WithRetryer(func() awsv2.Retryer {
+			return retry.NewSDKV2Retryer(ec2RetryPolicy.WithEnvOverrides())
+		}))
+	if err != nil {
+		log.Errorf("Failed to load the AWS SDK configuration %v", err)
+		return nil, errors.Wrap(err, "instance metadata: failed to load the AWS SDK configuration")
+	}
+	instrumentConfig(&cfg)
+	// The cluster belongs to the account of the node, even if the ENIs are managed with the role of another account
+	cache.eksSVC = eks.NewFromConfig(cfg)
+	cfg, err = assumeRole(cfg)
 	if err != nil {
-		log.Errorf("Failed to initialize AWS SDK session %v", err)
-		return nil, errors.Wrap(err, "instance metadata: failed to initialize AWS SDK session")
+		log.Errorf("Failed to assume the role to manage ENIs and IPs: %v", err)
+		return nil, errors.Wrap(err, "awsutils: failed to assume role")
 	}
 
-	ec2SVC := ec2wrapper.New(sess)
+	ec2SVC := ec2wrapper.New(cfg)
 	cache.ec2SVC = ec2SVC
 	err = cache.initWithEC2Metadata()
 	if err != nil {
 		return nil, err
 	}
+	cache.discoverCluster()
+	// Report early whether the subnet of the node is shared, since it limits what ipamd can do in it
+	cache.subnetOwner(cache.subnetID)
 
 	// Clean up leaked ENIs in the background
 	go wait.Forever(cache.cleanUpLeakedENIs, time.Hour)
@@ -249,12 +380,16 @@ func (cache *EC2InstanceMetadataCache) initWithEC2Metadata() error {
 	log.Debugf("Found availability zone: %s ", cache.availabilityZone)
 
 	// retrieve eth0 local-ipv4
-	cache.localIPv4, err = cache.ec2Metadata.GetMetadata(metadataLocalIP)
+	localIPv4, err := cache.ec2Metadata.GetMetadata(metadataLocalIP)
 	if err != nil {
 		awsAPIErrInc("GetMetadata", err)
 		log.Errorf("Failed to retrieve instance's primary ip address data from instance metadata service %v", err)
 		return errors.Wrap(err, "get instance metadata: failed to retrieve the instance primary ip address data")
 	}
+	cache.localIPv4, err = cidr.ParseAddr(localIPv4)
+	if err != nil {
+		return errors.Wrap(err, "get instance metadata: invalid instance primary ip address")
+	}
 	log.Debugf("Discovered the instance primary ip address: %s", cache.localIPv4)
 
 	// retrieve instance-id
@@ -314,12 +449,16 @@ func (cache *EC2InstanceMetadataCache) initWithEC2Metadata() error {
 	log.Debugf("Found subnet-id: %s ", cache.subnetID)
 
 	// retrieve vpc-ipv4-cidr-block
-	cache.vpcIPv4CIDR, err = cache.ec2Metadata.GetMetadata(metadataMACPath + mac + metadataVPCcidr)
+	vpcIPv4CIDR, err := cache.ec2Metadata.GetMetadata(metadataMACPath + mac + metadataVPCcidr)
 	if err != nil {
 		awsAPIErrInc("GetMetadata", err)
 		log.Errorf("Failed to retrieve vpc-ipv4-cidr-block from instance metadata service")
 		return errors.Wrap(err, "get instance metadata: failed to retrieve vpc-ipv4-cidr-block data")
 	}
+	cache.vpcIPv4CIDR, err = cidr.Parse(vpcIPv4CIDR)
+	if err != nil {
+		return errors.Wrap(err, "get instance metadata: invalid vpc-ipv4-cidr-block")
+	}
 	log.Debugf("Found vpc-ipv4-cidr-block: %s ", cache.vpcIPv4CIDR)
 
 	// retrieve vpc-ipv4-cidr-blocks
@@ -330,12 +469,11 @@ func (cache *EC2InstanceMetadataCache) initWithEC2Metadata() error {
 		return errors.Wrap(err, "get instance metadata: failed to retrieve vpc-ipv4-cidr-block data")
 	}
 
-	vpcIPv4CIDRs := strings.Fields(metadataVPCIPv4CIDRs)
-
-	for _, vpcCIDR := range vpcIPv4CIDRs {
-		log.Debugf("Found VPC CIDR: %s", vpcCIDR)
-		cache.vpcIPv4CIDRs = append(cache.vpcIPv4CIDRs, aws.String(vpcCIDR))
+	cache.vpcIPv4CIDRs, err = cidr.ParseAll(strings.Fields(metadataVPCIPv4CIDRs))
+	if err != nil {
+		return errors.Wrap(err, "get instance metadata: invalid vpc-ipv4-cidr-blocks")
 	}
+	log.Debugf("Found VPC CIDRs: %v", cache.vpcIPv4CIDRs)
 	return nil
 }
 
@@ -415,12 +553,17 @@ func (cache *EC2InstanceMetadataCache) GetAttachedENIs() (eniList []ENIMetadata,
 	cache.currentENIs = len(macsStrs)
 
 	var enis []ENIMetadata
+	trunkENI := cache.getTrunkENIID()
 	// retrieve the attached ENIs
 	for _, macStr := range macsStrs {
 		eniMetadata, err := cache.getENIMetadata(macStr)
 		if err != nil {
 			return nil, errors.Wrapf(err, "get attached ENIs: failed to retrieve ENI metadata for ENI: %s", macStr)
 		}
+		// The trunk ENI carries the traffic of the branch ENIs, its IPs are not for the pool
+		if trunkENI != "" && eniMetadata.ENIID == trunkENI {
+			continue
+		}
 		enis = append(enis, eniMetadata)
 	}
 	return enis, nil
@@ -437,7 +580,7 @@ func (cache *EC2InstanceMetadataCache) getENIMetadata(macStr string) (ENIMetadat
 	}
 	log.Debugf("Found ENI: %s, MAC %s, device %d", eni, eniMAC, deviceNum)
 
-	localIPv4s, cidr, err := cache.getIPsAndCIDR(eniMAC)
+	localIPv4s, subnetCIDR, err := cache.getIPsAndCIDR(eniMAC)
 	if err != nil {
 		return ENIMetadata{}, errors.Wrapf(err, "get ENI metadata: failed to retrieve IPs and CIDR for ENI: %s", eniMAC)
 	}
@@ -445,22 +588,26 @@ func (cache *EC2InstanceMetadataCache) getENIMetadata(macStr string) (ENIMetadat
 		ENIID:          eni,
 		MAC:            eniMAC,
 		DeviceNumber:   deviceNum,
-		SubnetIPv4CIDR: cidr,
+		SubnetIPv4CIDR: subnetCIDR,
 		LocalIPv4s:     localIPv4s}, nil
 }
 
 // getIPsAndCIDR return list of IPs, CIDR, error
-func (cache *EC2InstanceMetadataCache) getIPsAndCIDR(eniMAC string) ([]string, string, error) {
+func (cache *EC2InstanceMetadataCache) getIPsAndCIDR(eniMAC string) ([]string, netip.Prefix, error) {
 	start := time.Now()
-	cidr, err := cache.ec2Metadata.GetMetadata(metadataMACPath + eniMAC + metadataSubnetCIDR)
+	subnetCIDR, err := cache.ec2Metadata.GetMetadata(metadataMACPath + eniMAC + metadataSubnetCIDR)
 	awsAPILatency.WithLabelValues("GetMetadata", fmt.Sprint(err != nil)).Observe(msSince(start))
 
 	if err != nil {
 		awsAPIErrInc("GetMetadata", err)
 		log.Errorf("Failed to retrieve subnet-ipv4-cidr-block data from instance metadata %v", err)
-		return nil, "", errors.Wrapf(err, "failed to retrieve subnet-ipv4-cidr-block for ENI %s", eniMAC)
+		return nil, netip.Prefix{}, errors.Wrapf(err, "failed to retrieve subnet-ipv4-cidr-block for ENI %s", eniMAC)
+	}
+	subnetPrefix, err := cidr.Parse(subnetCIDR)
+	if err != nil {
+		return nil, netip.Prefix{}, errors.Wrapf(err, "invalid subnet-ipv4-cidr-block for ENI %s", eniMAC)
 	}
-	log.Debugf("Found CIDR %s for ENI %s", cidr, eniMAC)
+	log.Debugf("Found CIDR %s for ENI %s", subnetPrefix, eniMAC)
 
 	start = time.Now()
 	ipv4s, err := cache.ec2Metadata.GetMetadata(metadataMACPath + eniMAC + metadataIPv4s)
@@ -468,12 +615,12 @@ func (cache *EC2InstanceMetadataCache) getIPsAndCIDR(eniMAC string) ([]string, s
 	if err != nil {
 		awsAPIErrInc("GetMetadata", err)
 		log.Errorf("Failed to retrieve ENI %s local-ipv4s from instance metadata service, %v", eniMAC, err)
-		return nil, "", errors.Wrapf(err, "failed to retrieve ENI %s local-ipv4s", eniMAC)
+		return nil, netip.Prefix{}, errors.Wrapf(err, "failed to retrieve ENI %s local-ipv4s", eniMAC)
 	}
 
 	ipv4Strs := strings.Fields(ipv4s)
 	log.Debugf("Found IP addresses %v on ENI %s", ipv4Strs, eniMAC)
-	return ipv4Strs, cidr, nil
+	return ipv4Strs, subnetPrefix, nil
 }
 
 // getENIDeviceNumber returns ENI ID, device number, error
@@ -516,11 +663,8 @@ func (cache *EC2InstanceMetadataCache) awsGetFreeDeviceNumber() (int, error) {
 		InstanceIds: []*string{aws.String(cache.instanceID)},
 	}
 
-	start := time.Now()
 	result, err := cache.ec2SVC.DescribeInstances(input)
-	awsAPILatency.WithLabelValues("DescribeInstances", fmt.Sprint(err != nil)).Observe(msSince(start))
 	if err != nil {
-		awsAPIErrInc("DescribeInstances", err)
 		log.Errorf("awsGetFreeDeviceNumber: Unable to retrieve instance data from EC2 control plane %v", err)
 		return 0, errors.Wrap(err,
 			"find a free device number for ENI: not able to retrieve instance data from EC2 control plane")
@@ -570,19 +714,8 @@ func (cache *EC2InstanceMetadataCache) AllocENI(useCustomCfg bool, sg []*string,
 	cache.tagENI(eniID)
 
 	// Also change the ENI's attribute so that the ENI will be deleted when the instance is deleted.
-	attributeInput := &ec2.ModifyNetworkInterfaceAttributeInput{
-		Attachment: &ec2.NetworkInterfaceAttachmentChanges{
-			AttachmentId:        aws.String(attachmentID),
-			DeleteOnTermination: aws.Bool(true),
-		},
-		NetworkInterfaceId: aws.String(eniID),
-	}
-
-	start := time.Now()
-	_, err = cache.ec2SVC.ModifyNetworkInterfaceAttribute(attributeInput)
-	awsAPILatency.WithLabelValues("ModifyNetworkInterfaceAttribute", fmt.Sprint(err != nil)).Observe(msSince(start))
+	err = cache.setDeleteOnTermination(eniID, attachmentID)
 	if err != nil {
-		awsAPIErrInc("ModifyNetworkInterfaceAttribute", err)
 		err := cache.FreeENI(eniID)
 		if err != nil {
 			awsUtilsErrInc("ENICleanupUponModifyNetworkErr", err)
@@ -594,6 +727,19 @@ func (cache *EC2InstanceMetadataCache) AllocENI(useCustomCfg bool, sg []*string,
 	return eniID, nil
 }
 
+// setDeleteOnTermination changes the attachment of the ENI so that the ENI is deleted when the instance is
+func (cache *EC2InstanceMetadataCache) setDeleteOnTermination(eniID, attachmentID string) error {
+	attributeInput := &ec2.ModifyNetworkInterfaceAttributeInput{
+		Attachment: &ec2.NetworkInterfaceAttachmentChanges{
+			AttachmentId:        aws.String(attachmentID),
+			DeleteOnTermination: aws.Bool(true),
+		},
+		NetworkInterfaceId: aws.String(eniID),
+	}
+	_, err := cache.ec2SVC.ModifyNetworkInterfaceAttribute(attributeInput)
+	return err
+}
+
 // return attachment id, error
 func (cache *EC2InstanceMetadataCache) attachENI(eniID string) (string, error) {
 	// attach to instance
@@ -607,11 +753,8 @@ func (cache *EC2InstanceMetadataCache) attachENI(eniID string) (string, error) {
 		InstanceId:         aws.String(cache.instanceID),
 		NetworkInterfaceId: aws.String(eniID),
 	}
-	start := time.Now()
 	attachOutput, err := cache.ec2SVC.AttachNetworkInterface(attachInput)
-	awsAPILatency.WithLabelValues("AttachNetworkInterface", fmt.Sprint(err != nil)).Observe(msSince(start))
 	if err != nil {
-		awsAPIErrInc("AttachNetworkInterface", err)
 		if containsAttachmentLimitExceededError(err) {
 			// TODO once reached limit, should stop retrying increasePool
 			log.Infof("Exceeded instance ENI attachment limit: %d ", cache.currentENIs)
@@ -643,19 +786,23 @@ func (cache *EC2InstanceMetadataCache) createENI(useCustomCfg bool, sg []*string
 		sgs = append(sgs, *input.Groups[i])
 	}
 	log.Infof("Creating ENI with security groups: %v in subnet: %s", sgs, *input.SubnetId)
-	start := time.Now()
 	result, err := cache.ec2SVC.CreateNetworkInterface(input)
-	awsAPILatency.WithLabelValues("CreateNetworkInterface", fmt.Sprint(err != nil)).Observe(msSince(start))
 	if err != nil {
-		awsAPIErrInc("CreateNetworkInterface", err)
 		log.Errorf("Failed to CreateNetworkInterface %v", err)
+		if owner := cache.sharedSubnetOwner(*input.SubnetId); owner != "" {
+			err = cache.explainSharedSubnetError(err, *input.SubnetId, owner)
+		}
 		return "", errors.Wrap(err, "failed to create network interface")
 	}
 	log.Infof("Created a new ENI: %s", aws.StringValue(result.NetworkInterface.NetworkInterfaceId))
 	return aws.StringValue(result.NetworkInterface.NetworkInterfaceId), nil
 }
 
-func (cache *EC2InstanceMetadataCache) tagENI(eniID string) {
+func (cache *EC2InstanceMetadataCache) tagENI(eniID string, extraTags ...*ec2.Tag) {
+	if cache.denied("ec2:CreateTags") {
+		log.Infof("Not tagging ENI %s, ec2:CreateTags is denied", eniID)
+		return
+	}
 	// Tag the ENI with "node.k8s.amazonaws.com/instance_id=<instance_id>"
 	tags := []*ec2.Tag{
 		{
@@ -664,15 +811,15 @@ func (cache *EC2InstanceMetadataCache) tagENI(eniID string) {
 		},
 	}
 
-	// If the CLUSTER_NAME env var is present,
+	// If the cluster is known, from CLUSTER_NAME or the tags of the instance,
 	// tag the ENI with "cluster.k8s.amazonaws.com/name=<cluster_name>"
-	clusterName := os.Getenv(clusterNameEnvVar)
-	if clusterName != "" {
+	if cache.clusterName != "" {
 		tags = append(tags, &ec2.Tag{
 			Key:   aws.String(eniClusterTagKey),
-			Value: aws.String(clusterName),
+			Value: aws.String(cache.clusterName),
 		})
 	}
+	tags = append(tags, extraTags...)
 
 	for _, tag := range tags {
 		log.Debugf("Trying to tag newly created ENI: key=%s, value=%s", aws.StringValue(tag.Key), aws.StringValue(tag.Value))
@@ -685,12 +832,9 @@ func (cache *EC2InstanceMetadataCache) tagENI(eniID string) {
 		Tags: tags,
 	}
 
-	_ = retry.RetryNWithBackoff(retry.NewSimpleBackoff(time.Second, time.Minute, 0.3, 2), 5, func() error {
-		start := time.Now()
+	_ = tagENIRetryPolicy.WithEnvOverrides().Do(func() error {
 		_, err := cache.ec2SVC.CreateTags(input)
-		awsAPILatency.WithLabelValues("CreateTags", fmt.Sprint(err != nil)).Observe(msSince(start))
 		if err != nil {
-			awsAPIErrInc("CreateTags", err)
 			return log.Warnf("Failed to tag the newly created ENI %s: %v", eniID, err)
 		}
 		log.Debugf("Successfully tagged ENI: %s", eniID)
@@ -714,6 +858,26 @@ func containsPrivateIPAddressLimitExceededError(err error) bool {
 	return false
 }
 
+// IsSubnetExhaustedError returns whether an EC2 call failed because the subnet has no free IP address left
+func IsSubnetExhaustedError(err error) bool {
+	if aerr, ok := errors.Cause(err).(awserr.Error); ok {
+		return aerr.Code() == "InsufficientFreeAddressesInSubnet"
+	}
+	return false
+}
+
+// IsServiceUnavailableError returns whether an EC2 call failed because the EC2 endpoint could not be reached or could
+// not serve the request, as opposed to the request being invalid
+func IsServiceUnavailableError(err error) bool {
+	if aerr, ok := errors.Cause(err).(awserr.Error); ok {
+		switch aerr.Code() {
+		case "RequestError", "Unavailable", "ServiceUnavailable", "InternalError", "InternalFailure":
+			return true
+		}
+	}
+	return false
+}
+
 func awsAPIErrInc(api string, err error) {
 	if aerr, ok := err.(awserr.Error); ok {
 		awsAPIErr.With(prometheus.Labels{"api": api, "error": aerr.Code()}).Inc()
@@ -751,12 +915,17 @@ func (cache *EC2InstanceMetadataCache) freeENI(eniName string, maxBackoffDelay t
 	}
 
 	// Retry detaching the ENI from the instance
-	err = retry.RetryNWithBackoff(retry.NewSimpleBackoff(time.Millisecond*200, maxBackoffDelay, 0.15, 2.0), maxENIDeleteRetries, func() error {
-		start := time.Now()
+	detachRetryPolicy := retry.Policy{
+		Name:         "ENI_DETACH",
+		InitialDelay: 200 * time.Millisecond,
+		MaxDelay:     maxBackoffDelay,
+		Multiplier:   2,
+		Jitter:       0.15,
+		MaxAttempts:  maxENIDeleteRetries,
+	}
+	err = detachRetryPolicy.WithEnvOverrides().Do(func() error {
 		_, ec2Err := cache.ec2SVC.DetachNetworkInterface(detachInput)
-		awsAPILatency.WithLabelValues("DetachNetworkInterface", fmt.Sprint(ec2Err != nil)).Observe(msSince(start))
 		if ec2Err != nil {
-			awsAPIErrInc("DetachNetworkInterface", ec2Err)
 			log.Errorf("Failed to detach ENI %s %v", eniName, ec2Err)
 			return errors.New("unable to detach ENI from EC2 instance, giving up")
 		}
@@ -786,10 +955,16 @@ func (cache *EC2InstanceMetadataCache) deleteENI(eniName string, maxBackoffDelay
 	deleteInput := &ec2.DeleteNetworkInterfaceInput{
 		NetworkInterfaceId: aws.String(eniName),
 	}
-	err := retry.RetryNWithBackoff(retry.NewSimpleBackoff(time.Millisecond*500, maxBackoffDelay, 0.15, 2.0), maxENIDeleteRetries, func() error {
-		start := time.Now()
+	deleteRetryPolicy := retry.Policy{
+		Name:         "ENI_DELETE",
+		InitialDelay: 500 * time.Millisecond,
+		MaxDelay:     maxBackoffDelay,
+		Multiplier:   2,
+		Jitter:       0.15,
+		MaxAttempts:  maxENIDeleteRetries,
+	}
+	err := deleteRetryPolicy.WithEnvOverrides().Do(func() error {
 		_, ec2Err := cache.ec2SVC.DeleteNetworkInterface(deleteInput)
-		awsAPILatency.WithLabelValues("DeleteNetworkInterface", fmt.Sprint(ec2Err != nil)).Observe(msSince(start))
 		if ec2Err != nil {
 			if aerr, ok := ec2Err.(awserr.Error); ok {
 				// If already deleted, we are good
@@ -798,7 +973,6 @@ func (cache *EC2InstanceMetadataCache) deleteENI(eniName string, maxBackoffDelay
 					return nil
 				}
 			}
-			awsAPIErrInc("DeleteNetworkInterface", ec2Err)
 			log.Debugf("Not able to delete ENI: %v ", ec2Err)
 			return errors.Wrapf(ec2Err, "unable to delete ENI")
 		}
@@ -808,27 +982,29 @@ func (cache *EC2InstanceMetadataCache) deleteENI(eniName string, maxBackoffDelay
 	return err
 }
 
-// DescribeENI returns the IPv4 addresses of interface and the attachment id
+// DescribeENI returns the IPv4 addresses of interface and the attachment id, which is nil if the ENI is not attached
 // return: private IP address, attachment id, error
 func (cache *EC2InstanceMetadataCache) DescribeENI(eniID string) ([]*ec2.NetworkInterfacePrivateIpAddress, *string, error) {
 	eniIds := make([]*string, 0)
 	eniIds = append(eniIds, aws.String(eniID))
 	input := &ec2.DescribeNetworkInterfacesInput{NetworkInterfaceIds: eniIds}
 
-	start := time.Now()
 	result, err := cache.ec2SVC.DescribeNetworkInterfaces(input)
-	awsAPILatency.WithLabelValues("DescribeNetworkInterfaces", fmt.Sprint(err != nil)).Observe(msSince(start))
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			if aerr.Code() == "InvalidNetworkInterfaceID.NotFound" {
 				return nil, nil, ErrENINotFound
 			}
 		}
-		awsAPIErrInc("DescribeNetworkInterfaces", err)
 		log.Errorf("Failed to get ENI %s information from EC2 control plane %v", eniID, err)
 		return nil, nil, errors.Wrap(err, "failed to describe network interface")
 	}
-	return result.NetworkInterfaces[0].PrivateIpAddresses, result.NetworkInterfaces[0].Attachment.AttachmentId, nil
+	eni := result.NetworkInterfaces[0]
+	if eni.Attachment == nil {
+		// The ENI was detached, e.g. by an operator in the console
+		return eni.PrivateIpAddresses, nil, nil
+	}
+	return eni.PrivateIpAddresses, eni.Attachment.AttachmentId, nil
 }
 
 // AllocIPAddress allocates an IP address for an ENI
@@ -840,11 +1016,8 @@ func (cache *EC2InstanceMetadataCache) AllocIPAddress(eniID string) error {
 		SecondaryPrivateIpAddressCount: aws.Int64(1),
 	}
 
-	start := time.Now()
 	output, err := cache.ec2SVC.AssignPrivateIpAddresses(input)
-	awsAPILatency.WithLabelValues("AssignPrivateIpAddresses", fmt.Sprint(err != nil)).Observe(msSince(start))
 	if err != nil {
-		awsAPIErrInc("AssignPrivateIpAddresses", err)
 		log.Errorf("Failed to allocate a private IP address  %v", err)
 		return errors.Wrap(err, "failed to assign private IP addresses")
 	}
@@ -873,6 +1046,15 @@ func (cache *EC2InstanceMetadataCache) GetENILimit() (int, error) {
 	return eniLimit, nil
 }
 
+// GetBranchENILimit returns the number of branch ENIs that can be associated with the trunk ENI of the instance
+func (cache *EC2InstanceMetadataCache) GetBranchENILimit() (int, error) {
+	branchLimit, ok := InstanceBranchENIsAvailable[cache.instanceType]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("%s: %s", UnknownInstanceType, cache.instanceType))
+	}
+	return branchLimit, nil
+}
+
 // AllocIPAddresses allocates numIPs of IP address on an ENI
 func (cache *EC2InstanceMetadataCache) AllocIPAddresses(eniID string, numIPs int) error {
 	var needIPs = numIPs
@@ -898,11 +1080,8 @@ func (cache *EC2InstanceMetadataCache) AllocIPAddresses(eniID string, numIPs int
 		SecondaryPrivateIpAddressCount: aws.Int64(int64(needIPs)),
 	}
 
-	start := time.Now()
 	_, err = cache.ec2SVC.AssignPrivateIpAddresses(input)
-	awsAPILatency.WithLabelValues("AssignPrivateIpAddresses", fmt.Sprint(err != nil)).Observe(msSince(start))
 	if err != nil {
-		awsAPIErrInc("AssignPrivateIpAddresses", err)
 		if containsPrivateIPAddressLimitExceededError(err) {
 			return nil
 		}
@@ -912,6 +1091,182 @@ func (cache *EC2InstanceMetadataCache) AllocIPAddresses(eniID string, numIPs int
 	return nil
 }
 
+// AllocIPv4Prefixes allocates numPrefixes /28 IPv4 prefixes on an ENI, and returns the prefixes EC2 assigned. Each
+// prefix takes the place of a secondary IP address in the limit of the ENI.
+func (cache *EC2InstanceMetadataCache) AllocIPv4Prefixes(eniID string, numPrefixes int) ([]netip.Prefix, error) {
+	prefixLimit, err := cache.GetENIipLimit()
+	if err != nil {
+		awsUtilsErrInc("UnknownInstanceType", err)
+		return nil, err
+	}
+	needPrefixes := numPrefixes
+	if prefixLimit < needPrefixes {
+		needPrefixes = prefixLimit
+	}
+	if needPrefixes < 1 {
+		return nil, nil
+	}
+
+	log.Infof("Trying to allocate %d IPv4 prefixes on ENI %s", needPrefixes, eniID)
+	input := &ec2wrapper.AssignIpv4PrefixesInput{
+		NetworkInterfaceId: aws.String(eniID),
+		Ipv4PrefixCount:    aws.Int64(int64(needPrefixes)),
+	}
+
+	output, err := cache.ec2SVC.AssignIpv4Prefixes(input)
+	if err != nil {
+		if containsPrivateIPAddressLimitExceededError(err) {
+			return nil, nil
+		}
+		log.Errorf("Failed to allocate IPv4 prefixes %v", err)
+		return nil, errors.Wrap(err, "allocate IPv4 prefixes: failed to allocate IPv4 prefixes")
+	}
+	var prefixes []netip.Prefix
+	for _, assigned := range output.AssignedIpv4Prefixes {
+		prefix, err := cidr.Parse(aws.StringValue(assigned.Ipv4Prefix))
+		if err != nil {
+			return nil, errors.Wrap(err, "allocate IPv4 prefixes: invalid prefix assigned by EC2")
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	log.Infof("Allocated IPv4 prefixes %v on ENI %s", prefixes, eniID)
+	return prefixes, nil
+}
+
+// DeallocIPv4Prefixes unassigns IPv4 prefixes from an ENI
+func (cache *EC2InstanceMetadataCache) DeallocIPv4Prefixes(eniID string, prefixes []netip.Prefix) error {
+	log.Infof("Trying to unassign the following IPv4 prefixes %s from ENI %s", prefixes, eniID)
+	input := &ec2wrapper.UnassignIpv4PrefixesInput{
+		NetworkInterfaceId: aws.String(eniID),
+		Ipv4Prefixes:       aws.StringSlice(cidr.Strings(prefixes)),
+	}
+
+	_, err := cache.ec2SVC.UnassignIpv4Prefixes(input)
+	if err != nil {
+		log.Errorf("Failed to deallocate IPv4 prefixes %v", err)
+		return errors.Wrapf(err, "deallocate IPv4 prefixes: failed to deallocate IPv4 prefixes: %s", prefixes)
+	}
+	return nil
+}
+
+// GetENIIPv4Prefixes returns the IPv4 prefixes of an ENI from the instance metadata service. An ENI without any has no
+// ipv4-prefix key, which is not an error.
+func (cache *EC2InstanceMetadataCache) GetENIIPv4Prefixes(eniMAC string) ([]netip.Prefix, error) {
+	start := time.Now()
+	prefixes, err := cache.ec2Metadata.GetMetadata(metadataMACPath + eniMAC + metadataIPv4Prefixes)
+	awsAPILatency.WithLabelValues("GetMetadata", fmt.Sprint(err != nil)).Observe(msSince(start))
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+			return nil, nil
+		}
+		awsAPIErrInc("GetMetadata", err)
+		log.Errorf("Failed to retrieve ENI %s ipv4-prefix from instance metadata service, %v", eniMAC, err)
+		return nil, errors.Wrapf(err, "failed to retrieve ENI %s ipv4-prefix", eniMAC)
+	}
+
+	prefixList, err := cidr.ParseAll(strings.Fields(prefixes))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid ENI %s ipv4-prefix", eniMAC)
+	}
+	log.Debugf("Found IPv4 prefixes %v on ENI %s", prefixList, eniMAC)
+	return prefixList, nil
+}
+
+// AllocIPv6Addresses allocates numIPs IPv6 addresses on an ENI. The subnet of the ENI must have an IPv6 CIDR.
+func (cache *EC2InstanceMetadataCache) AllocIPv6Addresses(eniID string, numIPs int) error {
+	ipLimit, err := cache.GetENIipLimit()
+	if err != nil {
+		awsUtilsErrInc("UnknownInstanceType", err)
+		return err
+	}
+	needIPs := numIPs
+	if ipLimit < needIPs {
+		needIPs = ipLimit
+	}
+	if needIPs < 1 {
+		return nil
+	}
+
+	log.Infof("Trying to allocate %d IPv6 addresses on ENI %s", needIPs, eniID)
+	input := &ec2.AssignIpv6AddressesInput{
+		NetworkInterfaceId: aws.String(eniID),
+		Ipv6AddressCount:   aws.Int64(int64(needIPs)),
+	}
+
+	_, err = cache.ec2SVC.AssignIpv6Addresses(input)
+	if err != nil {
+		log.Errorf("Failed to allocate IPv6 addresses %v", err)
+		return errors.Wrap(err, "allocate IPv6 addresses: failed to allocate IPv6 addresses")
+	}
+	return nil
+}
+
+// GetENIIPv6s returns the IPv6 addresses of an ENI from the instance metadata service. An ENI without any has no ipv6s
+// key, which is not an error.
+func (cache *EC2InstanceMetadataCache) GetENIIPv6s(eniMAC string) ([]string, error) {
+	start := time.Now()
+	ipv6s, err := cache.ec2Metadata.GetMetadata(metadataMACPath + eniMAC + metadataIPv6s)
+	awsAPILatency.WithLabelValues("GetMetadata", fmt.Sprint(err != nil)).Observe(msSince(start))
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+			return nil, nil
+		}
+		awsAPIErrInc("GetMetadata", err)
+		log.Errorf("Failed to retrieve ENI %s ipv6s from instance metadata service, %v", eniMAC, err)
+		return nil, errors.Wrapf(err, "failed to retrieve ENI %s ipv6s", eniMAC)
+	}
+
+	ipv6Strs := strings.Fields(ipv6s)
+	log.Debugf("Found IPv6 addresses %v on ENI %s", ipv6Strs, eniMAC)
+	return ipv6Strs, nil
+}
+
+// GetVPCIPv6CIDRs returns the IPv6 CIDRs of the VPC from the instance metadata service. A VPC without any has no
+// vpc-ipv6-cidr-blocks key, which is not an error.
+func (cache *EC2InstanceMetadataCache) GetVPCIPv6CIDRs() ([]netip.Prefix, error) {
+	start := time.Now()
+	cidrs, err := cache.ec2Metadata.GetMetadata(metadataMACPath + cache.primaryENImac + metadataVPCIPv6CIDRs)
+	awsAPILatency.WithLabelValues("GetMetadata", fmt.Sprint(err != nil)).Observe(msSince(start))
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+			return nil, nil
+		}
+		awsAPIErrInc("GetMetadata", err)
+		log.Errorf("Failed to retrieve vpc-ipv6-cidr-blocks from instance metadata service, %v", err)
+		return nil, errors.Wrap(err, "failed to retrieve vpc-ipv6-cidr-blocks")
+	}
+
+	cidrList, err := cidr.ParseAll(strings.Fields(cidrs))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid vpc-ipv6-cidr-blocks")
+	}
+	log.Debugf("Found VPC IPv6 CIDRs %v", cidrList)
+	return cidrList, nil
+}
+
+// GetENISubnetIPv6CIDRs returns the IPv6 CIDRs of the subnet of an ENI from the instance metadata service. A subnet
+// without any has no subnet-ipv6-cidr-blocks key, which is not an error.
+func (cache *EC2InstanceMetadataCache) GetENISubnetIPv6CIDRs(eniMAC string) ([]netip.Prefix, error) {
+	start := time.Now()
+	cidrs, err := cache.ec2Metadata.GetMetadata(metadataMACPath + eniMAC + metadataSubnetIPv6CIDRs)
+	awsAPILatency.WithLabelValues("GetMetadata", fmt.Sprint(err != nil)).Observe(msSince(start))
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+			return nil, nil
+		}
+		awsAPIErrInc("GetMetadata", err)
+		log.Errorf("Failed to retrieve ENI %s subnet-ipv6-cidr-blocks from instance metadata service, %v", eniMAC, err)
+		return nil, errors.Wrapf(err, "failed to retrieve ENI %s subnet-ipv6-cidr-blocks", eniMAC)
+	}
+
+	cidrList, err := cidr.ParseAll(strings.Fields(cidrs))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid ENI %s subnet-ipv6-cidr-blocks", eniMAC)
+	}
+	log.Debugf("Found subnet IPv6 CIDRs %v of ENI %s", cidrList, eniMAC)
+	return cidrList, nil
+}
+
 // DeallocIPAddresses allocates numIPs of IP address on an ENI
 func (cache *EC2InstanceMetadataCache) DeallocIPAddresses(eniID string, ips []string) error {
 	ctx := context.Background()
@@ -926,11 +1281,8 @@ func (cache *EC2InstanceMetadataCache) DeallocIPAddresses(eniID string, ips []st
 		PrivateIpAddresses: ipsInput,
 	}
 
-	start := time.Now()
 	_, err := cache.ec2SVC.UnassignPrivateIpAddressesWithContext(ctx, input)
-	awsAPILatency.WithLabelValues("UnassignPrivateIpAddressesWithContext", fmt.Sprint(err != nil)).Observe(msSince(start))
 	if err != nil {
-		awsAPIErrInc("UnassignPrivateIpAddressesWithContext", err)
 		log.Errorf("Failed to deallocate a private IP address %v", err)
 		return errors.Wrap(err, fmt.Sprintf("deallocate IP addresses: failed to deallocate private IP addresses: %s", ips))
 	}
@@ -943,14 +1295,26 @@ func (cache *EC2InstanceMetadataCache) cleanUpLeakedENIs() {
 	log.Infof("Will attempt to clean up AWS CNI leaked ENIs after waiting %s.", startupDelay)
 	time.Sleep(startupDelay)
 
+	if cache.denied("ec2:DeleteNetworkInterface") {
+		log.Info("Not cleaning up leaked ENIs, ec2:DeleteNetworkInterface is denied")
+		return
+	}
 	log.Debug("Checking for leaked AWS CNI ENIs.")
 	networkInterfaces, err := cache.getFilteredListOfNetworkInterfaces()
 	if err != nil {
 		log.Warnf("Unable to get leaked ENIs: %v", err)
 	} else {
+		branchENIs, branchErr := cache.associatedBranchENIIDs()
+		if branchErr != nil {
+			log.Warnf("Not cleaning up leaked branch ENIs: %v", branchErr)
+		}
 		// Clean up all the leaked ones we found
 		for _, networkInterface := range networkInterfaces {
 			eniID := aws.StringValue(networkInterface.NetworkInterfaceId)
+			if strings.HasPrefix(aws.StringValue(networkInterface.Description), branchDescriptionPrefix) &&
+				(branchErr != nil || branchENIs[eniID]) {
+				continue
+			}
 			err = cache.deleteENI(eniID, maxENIBackoffDelay)
 			if err != nil {
 				log.Warnf("Failed to clean up leaked ENI %s: %v", eniID, err)
@@ -980,17 +1344,23 @@ func (cache *EC2InstanceMetadataCache) getFilteredListOfNetworkInterfaces() ([]*
 	input := &ec2.DescribeNetworkInterfacesInput{
 		Filters: []*ec2.Filter{tagFilter, statusFilter},
 	}
-	result, err := cache.ec2SVC.DescribeNetworkInterfaces(input)
-	if err != nil {
-		return nil, errors.Wrap(err, "awsutils: unable to obtain filtered list of network interfaces")
-	}
-
 	networkInterfaces := make([]*ec2.NetworkInterface, 0)
-	for _, networkInterface := range result.NetworkInterfaces {
-		// Verify the description starts with "aws-K8S-"
-		if strings.HasPrefix(aws.StringValue(networkInterface.Description), eniDescriptionPrefix) {
-			networkInterfaces = append(networkInterfaces, networkInterface)
+	// The ENIs may come in several pages
+	for {
+		result, err := cache.ec2SVC.DescribeNetworkInterfaces(input)
+		if err != nil {
+			return nil, errors.Wrap(err, "awsutils: unable to obtain filtered list of network interfaces")
+		}
+		for _, networkInterface := range result.NetworkInterfaces {
+			// Verify the description starts with "aws-K8S-"
+			if strings.HasPrefix(aws.StringValue(networkInterface.Description), eniDescriptionPrefix) {
+				networkInterfaces = append(networkInterfaces, networkInterface)
+			}
+		}
+		if aws.StringValue(result.NextToken) == "" {
+			break
 		}
+		input.NextToken = result.NextToken
 	}
 
 	if len(networkInterfaces) < 1 {
@@ -1003,20 +1373,39 @@ func (cache *EC2InstanceMetadataCache) getFilteredListOfNetworkInterfaces() ([]*
 }
 
 // GetVPCIPv4CIDR returns VPC CIDR
-func (cache *EC2InstanceMetadataCache) GetVPCIPv4CIDR() string {
+func (cache *EC2InstanceMetadataCache) GetVPCIPv4CIDR() netip.Prefix {
 	return cache.vpcIPv4CIDR
 }
 
 // GetVPCIPv4CIDRs returns VPC CIDRs
-func (cache *EC2InstanceMetadataCache) GetVPCIPv4CIDRs() []*string {
+func (cache *EC2InstanceMetadataCache) GetVPCIPv4CIDRs() []netip.Prefix {
 	return cache.vpcIPv4CIDRs
 }
 
 // GetLocalIPv4 returns the primary IP address on the primary interface
-func (cache *EC2InstanceMetadataCache) GetLocalIPv4() string {
+func (cache *EC2InstanceMetadataCache) GetLocalIPv4() netip.Addr {
 	return cache.localIPv4
 }
 
+// RefreshLocalIPv4 retrieves the primary IP address on the primary interface from the instance metadata service, so
+// that a change of the address is seen without restarting
+func (cache *EC2InstanceMetadataCache) RefreshLocalIPv4() (netip.Addr, error) {
+	metadataIPv4, err := cache.ec2Metadata.GetMetadata(metadataLocalIP)
+	if err != nil {
+		awsAPIErrInc("GetMetadata", err)
+		return netip.Addr{}, errors.Wrap(err, "refresh instance metadata: failed to retrieve the instance primary ip address data")
+	}
+	localIPv4, err := cidr.ParseAddr(metadataIPv4)
+	if err != nil {
+		return netip.Addr{}, errors.Wrap(err, "refresh instance metadata: invalid instance primary ip address")
+	}
+	if localIPv4 != cache.localIPv4 {
+		log.Infof("The instance primary ip address changed from %s to %s", cache.localIPv4, localIPv4)
+		cache.localIPv4 = localIPv4
+	}
+	return localIPv4, nil
+}
+
 // GetPrimaryENI returns the primary ENI
 func (cache *EC2InstanceMetadataCache) GetPrimaryENI() string {
 	return cache.primaryENI
@@ -1026,3 +1415,8 @@ func (cache *EC2InstanceMetadataCache) GetPrimaryENI() string {
 func (cache *EC2InstanceMetadataCache) GetPrimaryENImac() string {
 	return cache.primaryENImac
 }
+
+// GetInstanceID returns the ID of the instance
+func (cache *EC2InstanceMetadataCache) GetInstanceID() string {
+	return cache.instanceID
+}
@@ -14,7 +14,11 @@
 package awsutils
 
 import (
+	"context"
 	"errors"
+	"net/netip"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -22,10 +26,15 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/eks"
+	ekstypes "github.com/aws/aws-sdk-go-v2/service/eks/types"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 
 	mock_ec2metadata "github.com/aws/amazon-vpc-cni-k8s/pkg/ec2metadata/mocks"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/ec2wrapper"
 	mock_ec2wrapper "github.com/aws/amazon-vpc-cni-k8s/pkg/ec2wrapper/mocks"
 )
 
@@ -82,12 +91,13 @@ func TestInitWithEC2metadata(t *testing.T) {
 	err := ins.initWithEC2Metadata()
 	assert.NoError(t, err)
 	assert.Equal(t, az, ins.availabilityZone)
-	assert.Equal(t, localIP, ins.localIPv4)
+	assert.Equal(t, netip.MustParseAddr(localIP), ins.localIPv4)
 	assert.Equal(t, ins.instanceID, instanceID)
 	assert.Equal(t, ins.primaryENImac, primaryMAC)
 	assert.Equal(t, len(ins.securityGroups), 2)
 	assert.Equal(t, subnetID, ins.subnetID)
-	assert.Equal(t, vpcCIDR, ins.vpcIPv4CIDR)
+	assert.Equal(t, netip.MustParsePrefix(vpcCIDR), ins.vpcIPv4CIDR)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix(vpcCIDR)}, ins.vpcIPv4CIDRs)
 }
 
 func TestInitWithEC2metadataVPCcidrErr(t *testing.T) {
@@ -220,6 +230,99 @@ func TestInitWithEC2metadataAZErr(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestRefreshLocalIPv4(t *testing.T) {
+	ctrl, mockMetadata, _ := setup(t)
+	defer ctrl.Finish()
+
+	ins := &EC2InstanceMetadataCache{ec2Metadata: mockMetadata, localIPv4: netip.MustParseAddr(localIP)}
+	mockMetadata.EXPECT().GetMetadata(metadataLocalIP).Return("10.0.0.20", nil)
+	newIP, err := ins.RefreshLocalIPv4()
+	assert.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddr("10.0.0.20"), newIP)
+	assert.Equal(t, netip.MustParseAddr("10.0.0.20"), ins.GetLocalIPv4())
+
+	mockMetadata.EXPECT().GetMetadata(metadataLocalIP).Return("", errors.New("Error on localIP"))
+	_, err = ins.RefreshLocalIPv4()
+	assert.Error(t, err)
+	assert.Equal(t, netip.MustParseAddr("10.0.0.20"), ins.GetLocalIPv4())
+}
+
+func TestGetENIIPv6s(t *testing.T) {
+	ctrl, mockMetadata, _ := setup(t)
+	defer ctrl.Finish()
+
+	ins := &EC2InstanceMetadataCache{ec2Metadata: mockMetadata}
+	mockMetadata.EXPECT().GetMetadata(metadataMACPath+primaryMAC+metadataIPv6s).Return("2001:db8::1 2001:db8::2", nil)
+	ipv6s, err := ins.GetENIIPv6s(primaryMAC)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2001:db8::1", "2001:db8::2"}, ipv6s)
+
+	// An ENI without IPv6 addresses has no ipv6s key
+	notFound := awserr.NewRequestFailure(awserr.New("EC2MetadataError", "failed to make EC2Metadata request", nil), 404, "")
+	mockMetadata.EXPECT().GetMetadata(metadataMACPath+primaryMAC+metadataIPv6s).Return("", notFound)
+	ipv6s, err = ins.GetENIIPv6s(primaryMAC)
+	assert.NoError(t, err)
+	assert.Empty(t, ipv6s)
+
+	mockMetadata.EXPECT().GetMetadata(metadataMACPath+primaryMAC+metadataIPv6s).Return("", errors.New("Error on ipv6s"))
+	_, err = ins.GetENIIPv6s(primaryMAC)
+	assert.Error(t, err)
+}
+
+func TestGetENIIPv4Prefixes(t *testing.T) {
+	ctrl, mockMetadata, _ := setup(t)
+	defer ctrl.Finish()
+
+	ins := &EC2InstanceMetadataCache{ec2Metadata: mockMetadata}
+	mockMetadata.EXPECT().GetMetadata(metadataMACPath+primaryMAC+metadataIPv4Prefixes).Return("10.0.0.16/28 10.0.0.32/28", nil)
+	prefixes, err := ins.GetENIIPv4Prefixes(primaryMAC)
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.16/28"), netip.MustParsePrefix("10.0.0.32/28")}, prefixes)
+
+	// An ENI without prefixes has no ipv4-prefix key
+	notFound := awserr.NewRequestFailure(awserr.New("EC2MetadataError", "failed to make EC2Metadata request", nil), 404, "")
+	mockMetadata.EXPECT().GetMetadata(metadataMACPath+primaryMAC+metadataIPv4Prefixes).Return("", notFound)
+	prefixes, err = ins.GetENIIPv4Prefixes(primaryMAC)
+	assert.NoError(t, err)
+	assert.Empty(t, prefixes)
+}
+
+func TestGetVPCIPv6CIDRs(t *testing.T) {
+	ctrl, mockMetadata, _ := setup(t)
+	defer ctrl.Finish()
+
+	ins := &EC2InstanceMetadataCache{ec2Metadata: mockMetadata, primaryENImac: primaryMAC}
+	mockMetadata.EXPECT().GetMetadata(metadataMACPath+primaryMAC+metadataVPCIPv6CIDRs).Return("2001:db8::/56", nil)
+	cidrs, err := ins.GetVPCIPv6CIDRs()
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8::/56")}, cidrs)
+
+	// A VPC without IPv6 CIDRs has no vpc-ipv6-cidr-blocks key
+	notFound := awserr.NewRequestFailure(awserr.New("EC2MetadataError", "failed to make EC2Metadata request", nil), 404, "")
+	mockMetadata.EXPECT().GetMetadata(metadataMACPath+primaryMAC+metadataVPCIPv6CIDRs).Return("", notFound)
+	cidrs, err = ins.GetVPCIPv6CIDRs()
+	assert.NoError(t, err)
+	assert.Empty(t, cidrs)
+}
+
+func TestGetENISubnetIPv6CIDRs(t *testing.T) {
+	ctrl, mockMetadata, _ := setup(t)
+	defer ctrl.Finish()
+
+	ins := &EC2InstanceMetadataCache{ec2Metadata: mockMetadata}
+	mockMetadata.EXPECT().GetMetadata(metadataMACPath+eni2MAC+metadataSubnetIPv6CIDRs).Return("2001:db8:0:1::/64", nil)
+	cidrs, err := ins.GetENISubnetIPv6CIDRs(eni2MAC)
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8:0:1::/64")}, cidrs)
+
+	// A subnet without IPv6 CIDRs has no subnet-ipv6-cidr-blocks key
+	notFound := awserr.NewRequestFailure(awserr.New("EC2MetadataError", "failed to make EC2Metadata request", nil), 404, "")
+	mockMetadata.EXPECT().GetMetadata(metadataMACPath+eni2MAC+metadataSubnetIPv6CIDRs).Return("", notFound)
+	cidrs, err = ins.GetENISubnetIPv6CIDRs(eni2MAC)
+	assert.NoError(t, err)
+	assert.Empty(t, cidrs)
+}
+
 func TestSetPrimaryENs(t *testing.T) {
 	ctrl, mockMetadata, _ := setup(t)
 	defer ctrl.Finish()
@@ -549,6 +652,55 @@ func TestAllocIPAddressOnErr(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestAllocIPv6Addresses(t *testing.T) {
+	ctrl, _, mockEC2 := setup(t)
+	defer ctrl.Finish()
+
+	input := &ec2.AssignIpv6AddressesInput{
+		NetworkInterfaceId: aws.String("eni-id"),
+		Ipv6AddressCount:   aws.Int64(49),
+	}
+	mockEC2.EXPECT().AssignIpv6Addresses(input).Return(nil, nil)
+
+	ins := &EC2InstanceMetadataCache{ec2SVC: mockEC2, instanceType: "c5n.18xlarge"}
+	err := ins.AllocIPv6Addresses("eni-id", 50)
+	assert.NoError(t, err)
+
+	mockEC2.EXPECT().AssignIpv6Addresses(gomock.Any()).Return(nil, errors.New("Error on AssignIpv6Addresses"))
+	err = ins.AllocIPv6Addresses("eni-id", 1)
+	assert.Error(t, err)
+}
+
+func TestAllocIPv4Prefixes(t *testing.T) {
+	ctrl, _, mockEC2 := setup(t)
+	defer ctrl.Finish()
+
+	// At most one prefix per secondary IP address of the ENI
+	input := &ec2wrapper.AssignIpv4PrefixesInput{
+		NetworkInterfaceId: aws.String("eni-id"),
+		Ipv4PrefixCount:    aws.Int64(49),
+	}
+	output := &ec2wrapper.AssignIpv4PrefixesOutput{
+		AssignedIpv4Prefixes: []*ec2wrapper.Ipv4PrefixSpecification{{Ipv4Prefix: aws.String("10.0.0.16/28")}},
+	}
+	mockEC2.EXPECT().AssignIpv4Prefixes(input).Return(output, nil)
+
+	ins := &EC2InstanceMetadataCache{ec2SVC: mockEC2, instanceType: "c5n.18xlarge"}
+	prefixes, err := ins.AllocIPv4Prefixes("eni-id", 50)
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.16/28")}, prefixes)
+
+	mockEC2.EXPECT().AssignIpv4Prefixes(gomock.Any()).Return(nil, errors.New("Error on AssignIpv4Prefixes"))
+	_, err = ins.AllocIPv4Prefixes("eni-id", 1)
+	assert.Error(t, err)
+
+	mockEC2.EXPECT().UnassignIpv4Prefixes(&ec2wrapper.UnassignIpv4PrefixesInput{
+		NetworkInterfaceId: aws.String("eni-id"),
+		Ipv4Prefixes:       aws.StringSlice([]string{"10.0.0.16/28"}),
+	}).Return(nil, nil)
+	assert.NoError(t, ins.DeallocIPv4Prefixes("eni-id", []netip.Prefix{netip.MustParsePrefix("10.0.0.16/28")}))
+}
+
 func TestAllocIPAddresses(t *testing.T) {
 	ctrl, _, mockEC2 := setup(t)
 	defer ctrl.Finish()
@@ -625,3 +777,370 @@ func TestEC2InstanceMetadataCache_getFilteredListOfNetworkInterfaces_Error(t *te
 	assert.Nil(t, got)
 	assert.Error(t, err)
 }
+
+func TestDegradedErrors(t *testing.T) {
+	ctrl, mockMetadata, mockEC2 := setup(t)
+	defer ctrl.Finish()
+
+	ins := &EC2InstanceMetadataCache{ec2Metadata: mockMetadata, ec2SVC: mockEC2}
+	mockEC2.EXPECT().CreateNetworkInterface(gomock.Any()).Return(nil,
+		awserr.New("InsufficientFreeAddressesInSubnet", "no free address", nil))
+	_, err := ins.AllocENI(false, nil, "")
+	assert.True(t, IsSubnetExhaustedError(err))
+	assert.False(t, IsServiceUnavailableError(err))
+
+	err = awserr.New("RequestError", "send request failed", errors.New("dial tcp: i/o timeout"))
+	assert.True(t, IsServiceUnavailableError(err))
+	assert.False(t, IsSubnetExhaustedError(err))
+
+	err = awserr.New("InvalidParameterValue", "invalid subnet", nil)
+	assert.False(t, IsServiceUnavailableError(err))
+	assert.False(t, IsSubnetExhaustedError(err))
+	assert.False(t, IsServiceUnavailableError(errors.New("dummy error")))
+}
+
+func TestCheckPermissions(t *testing.T) {
+	ctrl, _, mockEC2 := setup(t)
+	defer ctrl.Finish()
+
+	granted := awserr.New("DryRunOperation", "Request would have succeeded", nil)
+	denied := awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation", nil)
+	mockEC2.EXPECT().DescribeNetworkInterfaces(gomock.Any()).DoAndReturn(
+		func(input *ec2.DescribeNetworkInterfacesInput) (*ec2.DescribeNetworkInterfacesOutput, error) {
+			assert.True(t, aws.BoolValue(input.DryRun))
+			assert.Equal(t, primaryeniID, aws.StringValue(input.NetworkInterfaceIds[0]))
+			return nil, granted
+		})
+	mockEC2.EXPECT().CreateNetworkInterface(gomock.Any()).Return(nil, denied)
+	mockEC2.EXPECT().AttachNetworkInterface(gomock.Any()).Return(nil, granted)
+	mockEC2.EXPECT().ModifyNetworkInterfaceAttribute(gomock.Any()).Return(nil, granted)
+	mockEC2.EXPECT().DescribeInstances(gomock.Any()).Return(nil, denied)
+	// Failures other than a denial do not count as missing permissions
+	mockEC2.EXPECT().DetachNetworkInterface(gomock.Any()).Return(nil, awserr.New("InvalidAttachmentID.NotFound", "", nil))
+	mockEC2.EXPECT().DeleteNetworkInterface(gomock.Any()).Return(nil, granted)
+	mockEC2.EXPECT().CreateTags(gomock.Any()).Return(nil, denied)
+
+	ins := &EC2InstanceMetadataCache{ec2SVC: mockEC2, primaryENI: primaryeniID, instanceID: instanceID}
+	missing := ins.CheckPermissions(Features())
+	assert.Equal(t, map[string][]string{
+		FeatureENIAllocation: {"ec2:CreateNetworkInterface", "ec2:DescribeInstances"},
+		FeatureENITagging:    {"ec2:CreateTags"},
+	}, missing)
+	assert.True(t, ins.denied("ec2:CreateTags"))
+	assert.False(t, ins.denied("ec2:DetachNetworkInterface"))
+
+	// New ENIs are not tagged once tagging is denied
+	ins.tagENI(eniID)
+}
+
+func TestAssumeRole(t *testing.T) {
+	cfg := awsv2.Config{Region: "us-west-2"}
+
+	got, err := assumeRole(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, cfg, got)
+
+	_ = os.Setenv(envRoleARN, "networking-role")
+	defer os.Unsetenv(envRoleARN)
+	_, err = assumeRole(cfg)
+	assert.Error(t, err)
+
+	_ = os.Setenv(envRoleARN, "arn:aws:iam::123456789012:role/aws-node")
+	got, err = assumeRole(cfg)
+	assert.NoError(t, err)
+	assert.NotEqual(t, cfg.Credentials, got.Credentials)
+	assert.Nil(t, cfg.Credentials)
+
+	o := &stscreds.AssumeRoleOptions{}
+	configureAssumeRole(o, "node-1", "secret")
+	assert.Equal(t, "node-1", o.RoleSessionName)
+	assert.Equal(t, "secret", awsv2.ToString(o.ExternalID))
+	assert.Equal(t, assumeRoleDuration, o.Duration)
+}
+
+func TestGetRoleSessionName(t *testing.T) {
+	defer os.Unsetenv("MY_NODE_NAME")
+	defer os.Unsetenv(envRoleSessionName)
+
+	_ = os.Unsetenv("MY_NODE_NAME")
+	assert.Equal(t, defaultRoleSessionName, getRoleSessionName())
+
+	_ = os.Setenv("MY_NODE_NAME", "ip-10-0-0-1.us-west-2.compute.internal")
+	assert.Equal(t, "ip-10-0-0-1.us-west-2.compute.internal", getRoleSessionName())
+
+	_ = os.Setenv(envRoleSessionName, "node 1/"+strings.Repeat("x", 70))
+	assert.Equal(t, "node-1-"+strings.Repeat("x", 57), getRoleSessionName())
+}
+
+func TestSharedSubnet(t *testing.T) {
+	ctrl, _, mockEC2 := setup(t)
+	defer ctrl.Finish()
+
+	ins := &EC2InstanceMetadataCache{ec2SVC: mockEC2, accountID: accountID, subnetID: subnetID}
+	mockEC2.EXPECT().DescribeSubnets(gomock.Any()).Return(&ec2.DescribeSubnetsOutput{
+		Subnets: []*ec2.Subnet{{SubnetId: aws.String(subnetID), OwnerId: aws.String("111122223333")}},
+	}, nil)
+	mockEC2.EXPECT().CreateNetworkInterface(gomock.Any()).Return(nil,
+		awserr.New("InvalidGroup.NotFound", "The security group 'sg-2e080f50' does not exist", nil))
+	_, err := ins.createENI(false, nil, "")
+	assert.EqualError(t, err, "failed to create network interface: subnet subnet-6b245523 is shared by account "+
+		"111122223333, the security groups of the ENIs must be owned by account 694065802095: "+
+		"InvalidGroup.NotFound: The security group 'sg-2e080f50' does not exist")
+
+	// The owner is cached, and the subnets that can not be described are assumed not to be shared
+	assert.Equal(t, "111122223333", ins.sharedSubnetOwner(subnetID))
+	mockEC2.EXPECT().DescribeSubnets(gomock.Any()).Return(nil,
+		awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation", nil))
+	assert.Equal(t, "", ins.sharedSubnetOwner("subnet-00000000"))
+	assert.Equal(t, "", ins.sharedSubnetOwner("subnet-00000000"))
+}
+
+func TestEIPs(t *testing.T) {
+	ctrl, _, mockEC2 := setup(t)
+	defer ctrl.Finish()
+
+	ins := &EC2InstanceMetadataCache{ec2SVC: mockEC2}
+	mockEC2.EXPECT().DescribeAddresses(gomock.Any()).DoAndReturn(func(input *ec2.DescribeAddressesInput) (*ec2.DescribeAddressesOutput, error) {
+		assert.Len(t, input.Filters, 2)
+		assert.Equal(t, "tag:cni-egress", aws.StringValue(input.Filters[1].Name))
+		return &ec2.DescribeAddressesOutput{Addresses: []*ec2.Address{
+			{AllocationId: aws.String("eipalloc-1"), PublicIp: aws.String("198.51.100.1"), AssociationId: aws.String("eipassoc-1"),
+				NetworkInterfaceId: aws.String(eniID), PrivateIpAddress: aws.String("10.0.0.1")},
+			{AllocationId: aws.String("eipalloc-2"), PublicIp: aws.String("198.51.100.2")},
+		}}, nil
+	})
+	eips, err := ins.GetEIPs(EIPPool{TagKey: "cni-egress", TagValue: "prod"})
+	assert.NoError(t, err)
+	assert.Equal(t, []EIP{
+		{AllocationID: "eipalloc-1", PublicIP: "198.51.100.1", AssociationID: "eipassoc-1", ENIID: eniID, PrivateIP: "10.0.0.1"},
+		{AllocationID: "eipalloc-2", PublicIP: "198.51.100.2"},
+	}, eips)
+
+	mockEC2.EXPECT().AssociateAddress(gomock.Any()).DoAndReturn(func(input *ec2.AssociateAddressInput) (*ec2.AssociateAddressOutput, error) {
+		assert.False(t, aws.BoolValue(input.AllowReassociation))
+		return nil, awserr.New("Resource.AlreadyAssociated", "resource eipalloc-2 is already associated", nil)
+	})
+	assert.Error(t, ins.AssociateEIP("eipalloc-2", eniID, "10.0.0.2"))
+	mockEC2.EXPECT().DisassociateAddress(gomock.Any()).Return(&ec2.DisassociateAddressOutput{}, nil)
+	assert.NoError(t, ins.DisassociateEIP("eipassoc-1"))
+}
+
+func TestTrunkENI(t *testing.T) {
+	ctrl, mockMetadata, mockEC2 := setup(t)
+	defer ctrl.Finish()
+
+	ins := &EC2InstanceMetadataCache{ec2Metadata: mockMetadata, ec2SVC: mockEC2, instanceID: instanceID}
+	mockEC2.EXPECT().DescribeNetworkInterfaces(gomock.Any()).DoAndReturn(func(input *ec2.DescribeNetworkInterfacesInput) (*ec2.DescribeNetworkInterfacesOutput, error) {
+		assert.Equal(t, "interface-type", aws.StringValue(input.Filters[1].Name))
+		return &ec2.DescribeNetworkInterfacesOutput{NetworkInterfaces: []*ec2.NetworkInterface{
+			{NetworkInterfaceId: aws.String(eni2MAC), MacAddress: aws.String(eni2MAC)},
+		}}, nil
+	})
+	trunk, err := ins.GetTrunkENI()
+	assert.NoError(t, err)
+	assert.Equal(t, TrunkENI{ENIID: eni2MAC, MAC: eni2MAC}, trunk)
+
+	// The trunk ENI is not one of the attached ENIs of the pool
+	mockMetadata.EXPECT().GetMetadata(metadataMACPath).Return(primaryMAC+" "+eni2MAC, nil)
+	gomock.InOrder(
+		mockMetadata.EXPECT().GetMetadata(metadataMACPath+primaryMAC+metadataDeviceNum).Return(eni1Device, nil),
+		mockMetadata.EXPECT().GetMetadata(metadataMACPath+primaryMAC+metadataInterface).Return(primaryMAC, nil),
+		mockMetadata.EXPECT().GetMetadata(metadataMACPath+primaryMAC+metadataSubnetCIDR).Return(subnetCIDR, nil),
+		mockMetadata.EXPECT().GetMetadata(metadataMACPath+primaryMAC+metadataIPv4s).Return("", nil),
+		mockMetadata.EXPECT().GetMetadata(metadataMACPath+eni2MAC+metadataDeviceNum).Return(eni2Device, nil),
+		mockMetadata.EXPECT().GetMetadata(metadataMACPath+eni2MAC+metadataInterface).Return(eni2MAC, nil),
+		mockMetadata.EXPECT().GetMetadata(metadataMACPath+eni2MAC+metadataSubnetCIDR).Return(subnetCIDR, nil),
+		mockMetadata.EXPECT().GetMetadata(metadataMACPath+eni2MAC+metadataIPv4s).Return("", nil),
+	)
+	enis, err := ins.GetAttachedENIs()
+	assert.NoError(t, err)
+	assert.Len(t, enis, 1)
+	assert.Equal(t, primaryMAC, enis[0].ENIID)
+}
+
+func TestBranchENIs(t *testing.T) {
+	ctrl, _, mockEC2 := setup(t)
+	defer ctrl.Finish()
+
+	ins := &EC2InstanceMetadataCache{ec2SVC: mockEC2, instanceID: instanceID, subnetID: subnetID}
+	mockEC2.EXPECT().CreateNetworkInterface(gomock.Any()).DoAndReturn(func(input *ec2.CreateNetworkInterfaceInput) (*ec2.CreateNetworkInterfaceOutput, error) {
+		assert.Equal(t, []string{sg1}, aws.StringValueSlice(input.Groups))
+		return &ec2.CreateNetworkInterfaceOutput{NetworkInterface: &ec2.NetworkInterface{NetworkInterfaceId: aws.String("eni-branch"),
+			MacAddress: aws.String("12:ef:2a:98:e5:5c"), PrivateIpAddress: aws.String("10.0.1.7")}}, nil
+	})
+	mockEC2.EXPECT().AssociateTrunkInterface(gomock.Any()).DoAndReturn(func(input *ec2wrapper.AssociateTrunkInterfaceInput) (*ec2wrapper.AssociateTrunkInterfaceOutput, error) {
+		assert.Equal(t, int64(3), aws.Int64Value(input.VlanId))
+		return &ec2wrapper.AssociateTrunkInterfaceOutput{InterfaceAssociation: &ec2wrapper.TrunkInterfaceAssociation{
+			AssociationId: aws.String("trunk-assoc-1")}}, nil
+	})
+	mockEC2.EXPECT().CreateTags(gomock.Any()).DoAndReturn(func(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+		assert.Equal(t, eniBranchPodTagKey, aws.StringValue(input.Tags[1].Key))
+		assert.Equal(t, "default/web", aws.StringValue(input.Tags[1].Value))
+		return &ec2.CreateTagsOutput{}, nil
+	})
+	branch, err := ins.AllocBranchENI(eniID, 3, []string{sg1}, "default", "web")
+	assert.NoError(t, err)
+	expected := BranchENI{ENIID: "eni-branch", MAC: "12:ef:2a:98:e5:5c", IPv4Addr: "10.0.1.7", VlanID: 3,
+		AssociationID: "trunk-assoc-1", PodNamespace: "default", PodName: "web"}
+	assert.Equal(t, expected, branch)
+
+	// The branch ENI and its pod are found again
+	mockEC2.EXPECT().DescribeTrunkInterfaceAssociations(gomock.Any()).Return(&ec2wrapper.DescribeTrunkInterfaceAssociationsOutput{
+		InterfaceAssociations: []*ec2wrapper.TrunkInterfaceAssociation{{AssociationId: aws.String("trunk-assoc-1"),
+			BranchInterfaceId: aws.String("eni-branch"), VlanId: aws.Int64(3)}}}, nil)
+	mockEC2.EXPECT().DescribeNetworkInterfaces(gomock.Any()).Return(&ec2.DescribeNetworkInterfacesOutput{
+		NetworkInterfaces: []*ec2.NetworkInterface{{NetworkInterfaceId: aws.String("eni-branch"), MacAddress: aws.String("12:ef:2a:98:e5:5c"),
+			PrivateIpAddress: aws.String("10.0.1.7"), TagSet: []*ec2.Tag{{Key: aws.String(eniBranchPodTagKey), Value: aws.String("default/web")}}}}}, nil)
+	branches, err := ins.GetBranchENIs(eniID)
+	assert.NoError(t, err)
+	assert.Equal(t, []BranchENI{expected}, branches)
+
+	// A branch ENI whose association is already gone is still deleted
+	mockEC2.EXPECT().DisassociateTrunkInterface(gomock.Any()).Return(nil, awserr.New("InvalidAssociationID.NotFound", "", nil))
+	mockEC2.EXPECT().DeleteNetworkInterface(gomock.Any()).Return(&ec2.DeleteNetworkInterfaceOutput{}, nil)
+	assert.NoError(t, ins.FreeBranchENI(branch))
+
+	// The branch ENI is deleted if it can not be associated
+	mockEC2.EXPECT().CreateNetworkInterface(gomock.Any()).Return(&ec2.CreateNetworkInterfaceOutput{
+		NetworkInterface: &ec2.NetworkInterface{NetworkInterfaceId: aws.String("eni-branch2")}}, nil)
+	mockEC2.EXPECT().AssociateTrunkInterface(gomock.Any()).Return(nil, awserr.New("InvalidParameterValue", "VLAN in use", nil))
+	mockEC2.EXPECT().DeleteNetworkInterface(gomock.Any()).Return(&ec2.DeleteNetworkInterfaceOutput{}, nil)
+	_, err = ins.AllocBranchENI(eniID, 3, []string{sg1}, "default", "api")
+	assert.Error(t, err)
+
+	// A warm branch ENI gets the security groups of the primary ENI and no pod tag, until it is assigned to a pod
+	ins.securityGroups = aws.StringSlice([]string{sg2})
+	mockEC2.EXPECT().CreateNetworkInterface(gomock.Any()).DoAndReturn(func(input *ec2.CreateNetworkInterfaceInput) (*ec2.CreateNetworkInterfaceOutput, error) {
+		assert.Equal(t, []string{sg2}, aws.StringValueSlice(input.Groups))
+		return &ec2.CreateNetworkInterfaceOutput{NetworkInterface: &ec2.NetworkInterface{NetworkInterfaceId: aws.String("eni-warm")}}, nil
+	})
+	mockEC2.EXPECT().AssociateTrunkInterface(gomock.Any()).Return(&ec2wrapper.AssociateTrunkInterfaceOutput{}, nil)
+	mockEC2.EXPECT().CreateTags(gomock.Any()).DoAndReturn(func(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+		for _, tag := range input.Tags {
+			assert.NotEqual(t, eniBranchPodTagKey, aws.StringValue(tag.Key))
+		}
+		return &ec2.CreateTagsOutput{}, nil
+	})
+	warm, err := ins.AllocBranchENI(eniID, 4, nil, "", "")
+	assert.NoError(t, err)
+	mockEC2.EXPECT().ModifyNetworkInterfaceAttribute(gomock.Any()).DoAndReturn(func(input *ec2.ModifyNetworkInterfaceAttributeInput) (*ec2.ModifyNetworkInterfaceAttributeOutput, error) {
+		assert.Equal(t, "eni-warm", aws.StringValue(input.NetworkInterfaceId))
+		assert.Equal(t, []string{sg1}, aws.StringValueSlice(input.Groups))
+		return &ec2.ModifyNetworkInterfaceAttributeOutput{}, nil
+	})
+	mockEC2.EXPECT().CreateTags(gomock.Any()).DoAndReturn(func(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+		assert.Equal(t, "default/db", aws.StringValue(input.Tags[1].Value))
+		return &ec2.CreateTagsOutput{}, nil
+	})
+	branch, err = ins.AssignBranchENI(warm, []string{sg1}, "default", "db")
+	assert.NoError(t, err)
+	assert.Equal(t, BranchENI{ENIID: "eni-warm", VlanID: 4, PodNamespace: "default", PodName: "db"}, branch)
+
+	// The branch ENI is not assigned if its security groups can not be changed
+	mockEC2.EXPECT().ModifyNetworkInterfaceAttribute(gomock.Any()).Return(nil, errors.New("InvalidGroup.NotFound"))
+	_, err = ins.AssignBranchENI(warm, []string{"sg-gone"}, "default", "db")
+	assert.Error(t, err)
+}
+
+func TestGetBranchENILimit(t *testing.T) {
+	ins := &EC2InstanceMetadataCache{instanceType: "m5.large"}
+	limit, err := ins.GetBranchENILimit()
+	assert.NoError(t, err)
+	assert.Equal(t, 9, limit)
+
+	// Instance types without trunk ENIs have no branch ENIs
+	ins.instanceType = "t2.micro"
+	_, err = ins.GetBranchENILimit()
+	assert.Error(t, err)
+}
+
+// fakeEKS describes a single cluster
+type fakeEKS struct {
+	name, arn string
+}
+
+func (f *fakeEKS) DescribeCluster(_ context.Context, input *eks.DescribeClusterInput, _ ...func(*eks.Options)) (
+	*eks.DescribeClusterOutput, error) {
+	if awsv2.ToString(input.Name) != f.name {
+		return nil, &ekstypes.ResourceNotFoundException{Message: awsv2.String("No cluster found")}
+	}
+	return &eks.DescribeClusterOutput{Cluster: &ekstypes.Cluster{Name: input.Name, Arn: awsv2.String(f.arn)}}, nil
+}
+
+func TestDiscoverCluster(t *testing.T) {
+	ctrl, mockMetadata, mockEC2 := setup(t)
+	defer ctrl.Finish()
+	arn := "arn:aws:eks:us-east-1:" + accountID + ":cluster/prod"
+	fake := &fakeEKS{name: "prod", arn: arn}
+
+	// The env vars override the discovery
+	_ = os.Setenv(clusterNameEnvVar, "staging")
+	_ = os.Setenv(clusterIDEnvVar, "staging-id")
+	ins := &EC2InstanceMetadataCache{ec2Metadata: mockMetadata, ec2SVC: mockEC2, eksSVC: fake, instanceID: instanceID}
+	ins.discoverCluster()
+	assert.Equal(t, "staging", ins.GetClusterName())
+	assert.Equal(t, "staging-id", ins.GetClusterID())
+	_ = os.Unsetenv(clusterNameEnvVar)
+	_ = os.Unsetenv(clusterIDEnvVar)
+
+	// The cluster is in the prefetch cache
+	SetPrefetchedCluster("baked", "baked-id")
+	ins = &EC2InstanceMetadataCache{ec2Metadata: mockMetadata, ec2SVC: mockEC2, eksSVC: fake, instanceID: instanceID}
+	ins.discoverCluster()
+	assert.Equal(t, "baked", ins.GetClusterName())
+	assert.Equal(t, "baked-id", ins.GetClusterID())
+	SetPrefetchedCluster("", "")
+
+	// The instance metadata tags are enabled
+	mockMetadata.EXPECT().GetMetadata(metadataClusterNameTag).Return("prod", nil)
+	ins = &EC2InstanceMetadataCache{ec2Metadata: mockMetadata, ec2SVC: mockEC2, eksSVC: fake, instanceID: instanceID}
+	ins.discoverCluster()
+	assert.Equal(t, "prod", ins.GetClusterName())
+	assert.Equal(t, arn, ins.GetClusterID())
+
+	// The tags are only available from EC2, and the cluster is not an EKS cluster
+	mockMetadata.EXPECT().GetMetadata(metadataClusterNameTag).Return("", errors.New("404"))
+	mockEC2.EXPECT().DescribeInstances(gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{{Tags: []*ec2.Tag{
+			{Key: aws.String("Name"), Value: aws.String("node")},
+			{Key: aws.String(kubernetesClusterTagPrefix + "kops"), Value: aws.String("owned")},
+		}}}}},
+	}, nil)
+	ins = &EC2InstanceMetadataCache{ec2Metadata: mockMetadata, ec2SVC: mockEC2, eksSVC: fake, instanceID: instanceID}
+	ins.discoverCluster()
+	assert.Equal(t, "kops", ins.GetClusterName())
+	assert.Equal(t, "", ins.GetClusterID())
+
+	// The cluster is unknown
+	mockMetadata.EXPECT().GetMetadata(metadataClusterNameTag).Return("", errors.New("404"))
+	mockEC2.EXPECT().DescribeInstances(gomock.Any()).Return(nil, errors.New("UnauthorizedOperation"))
+	ins = &EC2InstanceMetadataCache{ec2Metadata: mockMetadata, ec2SVC: mockEC2, eksSVC: fake, instanceID: instanceID}
+	ins.discoverCluster()
+	assert.Equal(t, "", ins.GetClusterName())
+	assert.Equal(t, "", ins.GetClusterID())
+}
+
+func TestClusterNameInTags(t *testing.T) {
+	tag := func(key, value string) *ec2.Tag { return &ec2.Tag{Key: aws.String(key), Value: aws.String(value)} }
+	assert.Equal(t, "", clusterNameInTags(nil))
+	assert.Equal(t, "a", clusterNameInTags([]*ec2.Tag{tag(kubernetesClusterTagPrefix+"b", "owned"), tag(eksClusterNameTagKey, "a")}))
+	assert.Equal(t, "c", clusterNameInTags([]*ec2.Tag{tag(kubernetesClusterTagPrefix+"b", "owned"), tag(eksctlClusterNameTagKey, "c")}))
+	assert.Equal(t, "b", clusterNameInTags([]*ec2.Tag{tag("Name", "node"), tag(kubernetesClusterTagPrefix+"b", "shared")}))
+}
+
+func TestAddInstanceLimits(t *testing.T) {
+	defer delete(InstanceENIsAvailable, "x9.large")
+	defer delete(InstanceIPsAvailable, "x9.large")
+	assert.True(t, AddInstanceLimits("x9.large", 3, 10))
+	assert.False(t, AddInstanceLimits("x9.large", 4, 15))
+	assert.False(t, AddInstanceLimits("c1.medium", 4, 15))
+
+	ins := &EC2InstanceMetadataCache{instanceType: "x9.large"}
+	enis, err := ins.GetENILimit()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, enis)
+	ips, err := ins.GetENIipLimit()
+	assert.NoError(t, err)
+	assert.Equal(t, 9, ips)
+	assert.Equal(t, 2, InstanceENIsAvailable["c1.medium"])
+}
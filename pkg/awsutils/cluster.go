@@ -0,0 +1,166 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package awsutils
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eks"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// clusterIDEnvVar is the name of the environment variable that overrides the discovered ID of the cluster
+	clusterIDEnvVar = "CLUSTER_ID"
+
+	// metadataClusterNameTag is the instance metadata path of the tag EKS sets on its nodes, only available when the
+	// instance metadata tags are enabled on the instance
+	metadataClusterNameTag = "tags/instance/" + eksClusterNameTagKey
+	// eksClusterNameTagKey is the tag EKS managed node groups set on their instances
+	eksClusterNameTagKey = "eks:cluster-name"
+	// eksctlClusterNameTagKey is the tag eksctl sets on the instances of its node groups
+	eksctlClusterNameTagKey = "alpha.eksctl.io/cluster-name"
+	// kubernetesClusterTagPrefix is the prefix of the "kubernetes.io/cluster/<name>" tag of self-managed nodes
+	kubernetesClusterTagPrefix = "kubernetes.io/cluster/"
+
+	// The sources of the cluster name
+	clusterSourceEnv  = "env"
+	clusterSourceIMDS = "imds"
+	clusterSourceEC2  = "ec2"
+	// clusterSourcePrefetch is the prefetch cache baked into the AMI of the node
+	clusterSourcePrefetch = "prefetch"
+)
+
+// prefetchedClusterName and prefetchedClusterID are the identity of the cluster set by SetPrefetchedCluster
+var prefetchedClusterName, prefetchedClusterID string
+
+var clusterInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "awscni_cluster_info",
+		Help: "Set to 1 for the name and ID of the cluster of the node, and where the name comes from",
+	},
+	[]string{"name", "id", "source"},
+)
+
+// eksAPI is the part of the EKS API the cache uses
+type eksAPI interface {
+	DescribeCluster(ctx context.Context, input *eks.DescribeClusterInput, optFns ...func(*eks.Options)) (
+		*eks.DescribeClusterOutput, error)
+}
+
+// discoverCluster finds the name and the ID of the cluster of the node, unless CLUSTER_NAME and CLUSTER_ID set them.
+// The name comes from the tags of the instance, read from the instance metadata if its tags are enabled there, or else
+// from EC2. The ID is the ARN of the EKS cluster, which needs eks:DescribeCluster. Either stays empty if it can't be
+// found, which only means the ENIs are not tagged with the cluster.
+func (cache *EC2InstanceMetadataCache) discoverCluster() {
+	source := clusterSourceEnv
+	cache.clusterName = os.Getenv(clusterNameEnvVar)
+	if cache.clusterName == "" && prefetchedClusterName != "" {
+		cache.clusterName, source = prefetchedClusterName, clusterSourcePrefetch
+	}
+	if cache.clusterName == "" {
+		cache.clusterName, source = cache.clusterNameFromTags()
+	}
+	cache.clusterID = os.Getenv(clusterIDEnvVar)
+	if cache.clusterID == "" && cache.clusterName == prefetchedClusterName {
+		cache.clusterID = prefetchedClusterID
+	}
+	if cache.clusterID == "" && cache.clusterName != "" && cache.eksSVC != nil {
+		cache.clusterID = cache.clusterARN(cache.clusterName)
+	}
+	if cache.clusterName == "" {
+		log.Infof("Unable to discover the cluster of the node, set %s to tag the ENIs with it", clusterNameEnvVar)
+		return
+	}
+	log.Infof("Using cluster %s (ID %q) from %s", cache.clusterName, cache.clusterID, source)
+	clusterInfo.WithLabelValues(cache.clusterName, cache.clusterID, source).Set(1)
+}
+
+// SetPrefetchedCluster sets the identity of the cluster used instead of discovering it, when CLUSTER_NAME and CLUSTER_ID
+// are not set. It must be called before New.
+func SetPrefetchedCluster(name, id string) {
+	prefetchedClusterName, prefetchedClusterID = name, id
+}
+
+// clusterNameFromTags returns the name of the cluster found in the tags of the instance, and where they were read
+func (cache *EC2InstanceMetadataCache) clusterNameFromTags() (string, string) {
+	name, err := cache.ec2Metadata.GetMetadata(metadataClusterNameTag)
+	if err == nil && name != "" {
+		return name, clusterSourceIMDS
+	}
+	log.Debugf("Cluster name tag not found in instance metadata: %v", err)
+
+	output, err := cache.ec2SVC.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(cache.instanceID)},
+	})
+	if err != nil {
+		log.Warnf("Unable to describe instance %s to find its cluster: %v", cache.instanceID, err)
+		return "", ""
+	}
+	for _, reservation := range output.Reservations {
+		for _, instance := range reservation.Instances {
+			if name := clusterNameInTags(instance.Tags); name != "" {
+				return name, clusterSourceEC2
+			}
+		}
+	}
+	return "", ""
+}
+
+// clusterNameInTags returns the name of the cluster in the tags set by EKS, eksctl or the "kubernetes.io/cluster/"
+// convention, in this order
+func clusterNameInTags(tags []*ec2.Tag) string {
+	var eksctlName, kubernetesName string
+	for _, tag := range tags {
+		key := aws.StringValue(tag.Key)
+		switch {
+		case key == eksClusterNameTagKey:
+			return aws.StringValue(tag.Value)
+		case key == eksctlClusterNameTagKey:
+			eksctlName = aws.StringValue(tag.Value)
+		case strings.HasPrefix(key, kubernetesClusterTagPrefix):
+			kubernetesName = strings.TrimPrefix(key, kubernetesClusterTagPrefix)
+		}
+	}
+	if eksctlName != "" {
+		return eksctlName
+	}
+	return kubernetesName
+}
+
+// clusterARN returns the ARN of the EKS cluster with the given name, or an empty string if it can't be described
+func (cache *EC2InstanceMetadataCache) clusterARN(name string) string {
+	output, err := cache.eksSVC.DescribeCluster(context.Background(), &eks.DescribeClusterInput{Name: awsv2.String(name)})
+	if err != nil {
+		log.Infof("Unable to describe EKS cluster %s, its ID stays unknown: %v", name, err)
+		return ""
+	}
+	return awsv2.ToString(output.Cluster.Arn)
+}
+
+// GetClusterName returns the name of the cluster of the node, or an empty string if it is unknown
+func (cache *EC2InstanceMetadataCache) GetClusterName() string {
+	return cache.clusterName
+}
+
+// GetClusterID returns the ID of the cluster of the node, or an empty string if it is unknown
+func (cache *EC2InstanceMetadataCache) GetClusterID() string {
+	return cache.clusterID
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package awsutils
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// EIPPool selects elastic IPs, either by allocation ID or by tag
+type EIPPool struct {
+	AllocationIDs []string
+	TagKey        string
+	TagValue      string
+}
+
+// EIP is an elastic IP and the private IP it is associated with, if any
+type EIP struct {
+	AllocationID  string
+	PublicIP      string
+	AssociationID string
+	ENIID         string
+	PrivateIP     string
+}
+
+// GetEIPs returns the elastic IPs of a pool
+func (cache *EC2InstanceMetadataCache) GetEIPs(pool EIPPool) ([]EIP, error) {
+	input := &ec2.DescribeAddressesInput{
+		Filters: []*ec2.Filter{{Name: aws.String("domain"), Values: []*string{aws.String("vpc")}}},
+	}
+	if len(pool.AllocationIDs) > 0 {
+		input.AllocationIds = aws.StringSlice(pool.AllocationIDs)
+	} else {
+		input.Filters = append(input.Filters, &ec2.Filter{
+			Name:   aws.String("tag:" + pool.TagKey),
+			Values: []*string{aws.String(pool.TagValue)},
+		})
+	}
+	output, err := cache.ec2SVC.DescribeAddresses(input)
+	if err != nil {
+		awsAPIErrInc("DescribeAddresses", err)
+		return nil, errors.Wrap(err, "failed to describe the elastic IPs")
+	}
+	eips := make([]EIP, 0, len(output.Addresses))
+	for _, address := range output.Addresses {
+		eips = append(eips, EIP{
+			AllocationID:  aws.StringValue(address.AllocationId),
+			PublicIP:      aws.StringValue(address.PublicIp),
+			AssociationID: aws.StringValue(address.AssociationId),
+			ENIID:         aws.StringValue(address.NetworkInterfaceId),
+			PrivateIP:     aws.StringValue(address.PrivateIpAddress),
+		})
+	}
+	return eips, nil
+}
+
+// AssociateEIP associates an elastic IP with a private IP of an ENI. It fails if the elastic IP is already associated,
+// e.g. by another node that picked it at the same time.
+func (cache *EC2InstanceMetadataCache) AssociateEIP(allocationID, eniID, privateIP string) error {
+	_, err := cache.ec2SVC.AssociateAddress(&ec2.AssociateAddressInput{
+		AllocationId:       aws.String(allocationID),
+		NetworkInterfaceId: aws.String(eniID),
+		PrivateIpAddress:   aws.String(privateIP),
+		AllowReassociation: aws.Bool(false),
+	})
+	if err != nil {
+		awsAPIErrInc("AssociateAddress", err)
+		return errors.Wrapf(err, "failed to associate elastic IP %s with IP %s of ENI %s", allocationID, privateIP, eniID)
+	}
+	log.Infof("Associated elastic IP %s with IP %s of ENI %s", allocationID, privateIP, eniID)
+	return nil
+}
+
+// DisassociateEIP removes the association of an elastic IP
+func (cache *EC2InstanceMetadataCache) DisassociateEIP(associationID string) error {
+	_, err := cache.ec2SVC.DisassociateAddress(&ec2.DisassociateAddressInput{AssociationId: aws.String(associationID)})
+	if err != nil {
+		awsAPIErrInc("DisassociateAddress", err)
+		return errors.Wrapf(err, "failed to remove elastic IP association %s", associationID)
+	}
+	log.Infof("Removed elastic IP association %s", associationID)
+	return nil
+}
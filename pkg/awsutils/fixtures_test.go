@@ -0,0 +1,526 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package awsutils
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/ec2metadata"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/ec2wrapper"
+)
+
+// Run `go test ./pkg/awsutils -run TestFixture<name> -record` on an EC2 instance with the credentials of ipamd to record
+// the IMDS and EC2 interactions of a scenario again. The scenario really runs, e.g. it creates and attaches ENIs, and
+// its assertions describe the recorded instance, so they may need updating.
+var recordFixtures = flag.Bool("record", false, "record the IMDS and EC2 fixtures from the real services")
+
+// fixturesDir holds the sanitized IMDS and EC2 interactions the scenarios replay
+const fixturesDir = "testdata/fixtures"
+
+// accountIDPattern matches the AWS account IDs, e.g. in owner IDs and ARNs, which are replaced when recording
+var accountIDPattern = regexp.MustCompile(`\b[0-9]{12}\b`)
+
+// sanitizedAccountID replaces the account IDs in the recorded fixtures
+const sanitizedAccountID = "123456789012"
+
+// fixture is the recorded IMDS and EC2 interactions of a scenario
+type fixture struct {
+	// Region is the region IMDS returned
+	Region string `json:"region,omitempty"`
+	// Metadata maps the IMDS paths to their response. They can be read in any order and any number of times.
+	Metadata map[string]metadataResponse `json:"metadata,omitempty"`
+	// EC2 is the EC2 calls in the order they were made, including the failed calls and their retries
+	EC2 []ec2Interaction `json:"ec2,omitempty"`
+}
+
+type metadataResponse struct {
+	Value string        `json:"value,omitempty"`
+	Error *fixtureError `json:"error,omitempty"`
+}
+
+type ec2Interaction struct {
+	Operation string          `json:"operation"`
+	Input     json.RawMessage `json:"input"`
+	Output    json.RawMessage `json:"output,omitempty"`
+	Error     *fixtureError   `json:"error,omitempty"`
+}
+
+// fixtureError is an error of IMDS or EC2. The status code is kept for the callers that check it, e.g. a 404 of IMDS.
+type fixtureError struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	StatusCode int    `json:"statusCode,omitempty"`
+}
+
+func newFixtureError(err error) *fixtureError {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return &fixtureError{Code: "RequestError", Message: err.Error()}
+	}
+	fixtureErr := &fixtureError{Code: aerr.Code(), Message: aerr.Message()}
+	if failure, ok := err.(awserr.RequestFailure); ok {
+		fixtureErr.StatusCode = failure.StatusCode()
+	}
+	return fixtureErr
+}
+
+func (e *fixtureError) err() error {
+	err := awserr.New(e.Code, e.Message, nil)
+	if e.StatusCode != 0 {
+		return awserr.NewRequestFailure(err, e.StatusCode, "fixture")
+	}
+	return err
+}
+
+// fixtureClients replays the IMDS and EC2 interactions of a fixture, or records them from the real services with
+// -record
+type fixtureClients struct {
+	t       *testing.T
+	name    string
+	fixture fixture
+	// next is the index of the next EC2 interaction to replay
+	next     int
+	metadata ec2metadata.EC2Metadata
+	ec2      ec2wrapper.EC2
+}
+
+// loadFixture returns the clients replaying the fixture of a scenario. Call done at the end of the scenario to check
+// that all the EC2 calls were made, or to write the recorded fixture.
+func loadFixture(t *testing.T, name string) (*fixtureClients, func()) {
+	f := &fixtureClients{t: t, name: name}
+	path := filepath.Join(fixturesDir, name+".json")
+	if *recordFixtures {
+		f.fixture.Metadata = make(map[string]metadataResponse)
+		f.metadata = ec2metadata.New()
+		region, err := f.metadata.Region()
+		if err != nil {
+			t.Fatalf("Failed to get the region from IMDS: %v", err)
+		}
+		cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(region))
+		if err != nil {
+			t.Fatalf("Failed to load the AWS SDK configuration: %v", err)
+		}
+		f.ec2 = ec2wrapper.New(cfg)
+		return f, func() {
+			data, err := json.MarshalIndent(f.fixture, "", "  ")
+			if err != nil {
+				t.Fatalf("Failed to encode fixture %s: %v", name, err)
+			}
+			data = accountIDPattern.ReplaceAll(data, []byte(sanitizedAccountID))
+			if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+				t.Fatalf("Failed to write fixture %s: %v", name, err)
+			}
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read fixture %s: %v", name, err)
+	}
+	if err := json.Unmarshal(data, &f.fixture); err != nil {
+		t.Fatalf("Failed to decode fixture %s: %v", name, err)
+	}
+	return f, func() {
+		if f.next < len(f.fixture.EC2) {
+			t.Errorf("Fixture %s: %d EC2 calls were not made, the next one is %s", name, len(f.fixture.EC2)-f.next,
+				f.fixture.EC2[f.next].Operation)
+		}
+	}
+}
+
+// cache returns the EC2 instance metadata cache using the clients of the fixture
+func (f *fixtureClients) cache() *EC2InstanceMetadataCache {
+	return &EC2InstanceMetadataCache{ec2Metadata: f, ec2SVC: f}
+}
+
+func (f *fixtureClients) GetMetadata(path string) (string, error) {
+	if *recordFixtures {
+		value, err := f.metadata.GetMetadata(path)
+		response := metadataResponse{Value: value}
+		if err != nil {
+			response = metadataResponse{Error: newFixtureError(err)}
+		}
+		f.fixture.Metadata[path] = response
+		return value, err
+	}
+	response, ok := f.fixture.Metadata[path]
+	if !ok {
+		f.t.Errorf("Fixture %s: unexpected IMDS path %s", f.name, path)
+		return "", awserr.NewRequestFailure(awserr.New("NotFound", "not in the fixture", nil), 404, "fixture")
+	}
+	if response.Error != nil {
+		return "", response.Error.err()
+	}
+	return response.Value, nil
+}
+
+func (f *fixtureClients) Region() (string, error) {
+	if *recordFixtures {
+		region, err := f.metadata.Region()
+		f.fixture.Region = region
+		return region, err
+	}
+	return f.fixture.Region, nil
+}
+
+// call replays the next EC2 interaction into output, which must be a call of the operation with the same input, or
+// records the real call with -record
+func (f *fixtureClients) call(operation string, input, output interface{}, real func() (interface{}, error)) error {
+	inputJSON, err := marshalWithoutNulls(input)
+	if err != nil {
+		f.t.Fatalf("Fixture %s: failed to encode the input of %s: %v", f.name, operation, err)
+	}
+	if *recordFixtures {
+		interaction := ec2Interaction{Operation: operation, Input: inputJSON}
+		realOutput, err := real()
+		if err != nil {
+			interaction.Error = newFixtureError(err)
+		} else if interaction.Output, err = marshalWithoutNulls(realOutput); err != nil {
+			f.t.Fatalf("Fixture %s: failed to encode the output of %s: %v", f.name, operation, err)
+		}
+		f.fixture.EC2 = append(f.fixture.EC2, interaction)
+		if interaction.Error != nil {
+			return interaction.Error.err()
+		}
+		return json.Unmarshal(interaction.Output, output)
+	}
+	if f.next >= len(f.fixture.EC2) {
+		f.t.Errorf("Fixture %s: unexpected call of %s after the last recorded call", f.name, operation)
+		return awserr.New("UnexpectedCall", "not in the fixture", nil)
+	}
+	interaction := f.fixture.EC2[f.next]
+	f.next++
+	if interaction.Operation != operation {
+		f.t.Errorf("Fixture %s: call %d is %s, expected %s", f.name, f.next, operation, interaction.Operation)
+		return awserr.New("UnexpectedCall", "not in the fixture", nil)
+	}
+	if !sameJSON(inputJSON, interaction.Input) {
+		f.t.Errorf("Fixture %s: call %d of %s has input %s, expected %s", f.name, f.next, operation, inputJSON,
+			interaction.Input)
+	}
+	if interaction.Error != nil {
+		return interaction.Error.err()
+	}
+	if len(interaction.Output) == 0 {
+		return nil
+	}
+	return json.Unmarshal(interaction.Output, output)
+}
+
+// marshalWithoutNulls encodes an input or output of EC2 without its unset fields, which keeps the fixtures readable
+func marshalWithoutNulls(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(withoutNulls(value))
+}
+
+// withoutNulls removes the null fields of the objects in a decoded JSON document
+func withoutNulls(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			if field == nil {
+				delete(value, key)
+			} else {
+				value[key] = withoutNulls(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = withoutNulls(item)
+		}
+	}
+	return value
+}
+
+// sameJSON returns whether both documents have the same content, whatever the order of their keys
+func sameJSON(a, b []byte) bool {
+	var valueA, valueB interface{}
+	if json.Unmarshal(a, &valueA) != nil || json.Unmarshal(b, &valueB) != nil {
+		return false
+	}
+	return reflect.DeepEqual(withoutNulls(valueA), withoutNulls(valueB))
+}
+
+func (f *fixtureClients) CreateNetworkInterface(input *ec2.CreateNetworkInterfaceInput) (*ec2.CreateNetworkInterfaceOutput, error) {
+	output := &ec2.CreateNetworkInterfaceOutput{}
+	if err := f.call("CreateNetworkInterface", input, output, func() (interface{}, error) {
+		return f.ec2.CreateNetworkInterface(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	output := &ec2.DescribeInstancesOutput{}
+	if err := f.call("DescribeInstances", input, output, func() (interface{}, error) {
+		return f.ec2.DescribeInstances(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) AttachNetworkInterface(input *ec2.AttachNetworkInterfaceInput) (*ec2.AttachNetworkInterfaceOutput, error) {
+	output := &ec2.AttachNetworkInterfaceOutput{}
+	if err := f.call("AttachNetworkInterface", input, output, func() (interface{}, error) {
+		return f.ec2.AttachNetworkInterface(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) DeleteNetworkInterface(input *ec2.DeleteNetworkInterfaceInput) (*ec2.DeleteNetworkInterfaceOutput, error) {
+	output := &ec2.DeleteNetworkInterfaceOutput{}
+	if err := f.call("DeleteNetworkInterface", input, output, func() (interface{}, error) {
+		return f.ec2.DeleteNetworkInterface(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) DetachNetworkInterface(input *ec2.DetachNetworkInterfaceInput) (*ec2.DetachNetworkInterfaceOutput, error) {
+	output := &ec2.DetachNetworkInterfaceOutput{}
+	if err := f.call("DetachNetworkInterface", input, output, func() (interface{}, error) {
+		return f.ec2.DetachNetworkInterface(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) AssignPrivateIpAddresses(input *ec2.AssignPrivateIpAddressesInput) (*ec2.AssignPrivateIpAddressesOutput, error) {
+	output := &ec2.AssignPrivateIpAddressesOutput{}
+	if err := f.call("AssignPrivateIpAddresses", input, output, func() (interface{}, error) {
+		return f.ec2.AssignPrivateIpAddresses(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) AssignIpv6Addresses(input *ec2.AssignIpv6AddressesInput) (*ec2.AssignIpv6AddressesOutput, error) {
+	output := &ec2.AssignIpv6AddressesOutput{}
+	if err := f.call("AssignIpv6Addresses", input, output, func() (interface{}, error) {
+		return f.ec2.AssignIpv6Addresses(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) UnassignPrivateIpAddressesWithContext(ctx aws.Context, input *ec2.UnassignPrivateIpAddressesInput, opts ...request.Option) (*ec2.UnassignPrivateIpAddressesOutput, error) {
+	output := &ec2.UnassignPrivateIpAddressesOutput{}
+	if err := f.call("UnassignPrivateIpAddresses", input, output, func() (interface{}, error) {
+		return f.ec2.UnassignPrivateIpAddressesWithContext(ctx, input, opts...)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) AssignIpv4Prefixes(input *ec2wrapper.AssignIpv4PrefixesInput) (*ec2wrapper.AssignIpv4PrefixesOutput, error) {
+	output := &ec2wrapper.AssignIpv4PrefixesOutput{}
+	if err := f.call("AssignIpv4Prefixes", input, output, func() (interface{}, error) {
+		return f.ec2.AssignIpv4Prefixes(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) UnassignIpv4Prefixes(input *ec2wrapper.UnassignIpv4PrefixesInput) (*ec2wrapper.UnassignIpv4PrefixesOutput, error) {
+	output := &ec2wrapper.UnassignIpv4PrefixesOutput{}
+	if err := f.call("UnassignIpv4Prefixes", input, output, func() (interface{}, error) {
+		return f.ec2.UnassignIpv4Prefixes(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) AssociateTrunkInterface(input *ec2wrapper.AssociateTrunkInterfaceInput) (*ec2wrapper.AssociateTrunkInterfaceOutput, error) {
+	output := &ec2wrapper.AssociateTrunkInterfaceOutput{}
+	if err := f.call("AssociateTrunkInterface", input, output, func() (interface{}, error) {
+		return f.ec2.AssociateTrunkInterface(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) DescribeTrunkInterfaceAssociations(input *ec2wrapper.DescribeTrunkInterfaceAssociationsInput) (*ec2wrapper.DescribeTrunkInterfaceAssociationsOutput, error) {
+	output := &ec2wrapper.DescribeTrunkInterfaceAssociationsOutput{}
+	if err := f.call("DescribeTrunkInterfaceAssociations", input, output, func() (interface{}, error) {
+		return f.ec2.DescribeTrunkInterfaceAssociations(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) DisassociateTrunkInterface(input *ec2wrapper.DisassociateTrunkInterfaceInput) (*ec2wrapper.DisassociateTrunkInterfaceOutput, error) {
+	output := &ec2wrapper.DisassociateTrunkInterfaceOutput{}
+	if err := f.call("DisassociateTrunkInterface", input, output, func() (interface{}, error) {
+		return f.ec2.DisassociateTrunkInterface(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) DescribeNetworkInterfaces(input *ec2.DescribeNetworkInterfacesInput) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	output := &ec2.DescribeNetworkInterfacesOutput{}
+	if err := f.call("DescribeNetworkInterfaces", input, output, func() (interface{}, error) {
+		return f.ec2.DescribeNetworkInterfaces(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) DescribeSubnets(input *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+	output := &ec2.DescribeSubnetsOutput{}
+	if err := f.call("DescribeSubnets", input, output, func() (interface{}, error) {
+		return f.ec2.DescribeSubnets(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) DescribeAddresses(input *ec2.DescribeAddressesInput) (*ec2.DescribeAddressesOutput, error) {
+	output := &ec2.DescribeAddressesOutput{}
+	if err := f.call("DescribeAddresses", input, output, func() (interface{}, error) {
+		return f.ec2.DescribeAddresses(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) AssociateAddress(input *ec2.AssociateAddressInput) (*ec2.AssociateAddressOutput, error) {
+	output := &ec2.AssociateAddressOutput{}
+	if err := f.call("AssociateAddress", input, output, func() (interface{}, error) {
+		return f.ec2.AssociateAddress(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) DisassociateAddress(input *ec2.DisassociateAddressInput) (*ec2.DisassociateAddressOutput, error) {
+	output := &ec2.DisassociateAddressOutput{}
+	if err := f.call("DisassociateAddress", input, output, func() (interface{}, error) {
+		return f.ec2.DisassociateAddress(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) ModifyNetworkInterfaceAttribute(input *ec2.ModifyNetworkInterfaceAttributeInput) (*ec2.ModifyNetworkInterfaceAttributeOutput, error) {
+	output := &ec2.ModifyNetworkInterfaceAttributeOutput{}
+	if err := f.call("ModifyNetworkInterfaceAttribute", input, output, func() (interface{}, error) {
+		return f.ec2.ModifyNetworkInterfaceAttribute(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (f *fixtureClients) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	output := &ec2.CreateTagsOutput{}
+	if err := f.call("CreateTags", input, output, func() (interface{}, error) {
+		return f.ec2.CreateTags(input)
+	}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func TestFixtureGetAttachedENIs(t *testing.T) {
+	f, done := loadFixture(t, "attached_enis")
+	defer done()
+
+	ins := f.cache()
+	err := ins.initWithEC2Metadata()
+	assert.NoError(t, err)
+	assert.Equal(t, "eni-0a1b2c3d4e5f60001", ins.GetPrimaryENI())
+
+	enis, err := ins.GetAttachedENIs()
+	assert.NoError(t, err)
+	if assert.Len(t, enis, 2) {
+		assert.Equal(t, "eni-0a1b2c3d4e5f60001", enis[0].ENIID)
+		assert.Equal(t, 0, enis[0].DeviceNumber)
+		assert.Equal(t, "eni-0a1b2c3d4e5f60002", enis[1].ENIID)
+		// The device number of a secondary ENI is shifted by one
+		assert.Equal(t, 2, enis[1].DeviceNumber)
+		assert.Equal(t, []string{"10.0.1.20", "10.0.1.21"}, enis[1].LocalIPv4s)
+	}
+}
+
+func TestFixtureLeakedENIsPaginated(t *testing.T) {
+	f, done := loadFixture(t, "leaked_enis_paginated")
+	defer done()
+
+	enis, err := f.cache().getFilteredListOfNetworkInterfaces()
+	assert.NoError(t, err)
+	var ids []string
+	for _, eni := range enis {
+		ids = append(ids, aws.StringValue(eni.NetworkInterfaceId))
+	}
+	// The ENI not created by the CNI is skipped, the one on the second page is kept
+	assert.Equal(t, []string{"eni-0a1b2c3d4e5f60101", "eni-0a1b2c3d4e5f60103"}, ids)
+}
+
+func TestFixtureAllocENITagNotFound(t *testing.T) {
+	// Right after it is created, the ENI may not be visible to CreateTags yet
+	_ = os.Setenv("AWS_VPC_K8S_CNI_RETRY_INITIAL_DELAY", "1ms")
+	defer os.Unsetenv("AWS_VPC_K8S_CNI_RETRY_INITIAL_DELAY")
+
+	f, done := loadFixture(t, "alloc_eni_tag_not_found")
+	defer done()
+
+	ins := f.cache()
+	err := ins.initWithEC2Metadata()
+	assert.NoError(t, err)
+
+	eni, err := ins.AllocENI(false, nil, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "eni-0a1b2c3d4e5f60003", eni)
+}
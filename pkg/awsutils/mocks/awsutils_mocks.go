@@ -18,6 +18,7 @@
 package mock_awsutils
 
 import (
+	netip "net/netip"
 	reflect "reflect"
 
 	awsutils "github.com/aws/amazon-vpc-cni-k8s/pkg/awsutils"
@@ -48,6 +49,19 @@ func (m *MockAPIs) EXPECT() *MockAPIsMockRecorder {
 	return m.recorder
 }
 
+// AllocBranchENI mocks base method
+func (m *MockAPIs) AllocBranchENI(arg0 string, arg1 int, arg2 []string, arg3, arg4 string) (awsutils.BranchENI, error) {
+	ret := m.ctrl.Call(m, "AllocBranchENI", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].(awsutils.BranchENI)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AllocBranchENI indicates an expected call of AllocBranchENI
+func (mr *MockAPIsMockRecorder) AllocBranchENI(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AllocBranchENI", reflect.TypeOf((*MockAPIs)(nil).AllocBranchENI), arg0, arg1, arg2, arg3, arg4)
+}
+
 // AllocENI mocks base method
 func (m *MockAPIs) AllocENI(arg0 bool, arg1 []*string, arg2 string) (string, error) {
 	ret := m.ctrl.Call(m, "AllocENI", arg0, arg1, arg2)
@@ -85,6 +99,81 @@ func (mr *MockAPIsMockRecorder) AllocIPAddresses(arg0, arg1 interface{}) *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AllocIPAddresses", reflect.TypeOf((*MockAPIs)(nil).AllocIPAddresses), arg0, arg1)
 }
 
+// AllocIPv4Prefixes mocks base method
+func (m *MockAPIs) AllocIPv4Prefixes(arg0 string, arg1 int) ([]netip.Prefix, error) {
+	ret := m.ctrl.Call(m, "AllocIPv4Prefixes", arg0, arg1)
+	ret0, _ := ret[0].([]netip.Prefix)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AllocIPv4Prefixes indicates an expected call of AllocIPv4Prefixes
+func (mr *MockAPIsMockRecorder) AllocIPv4Prefixes(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AllocIPv4Prefixes", reflect.TypeOf((*MockAPIs)(nil).AllocIPv4Prefixes), arg0, arg1)
+}
+
+// AllocIPv6Addresses mocks base method
+func (m *MockAPIs) AllocIPv6Addresses(arg0 string, arg1 int) error {
+	ret := m.ctrl.Call(m, "AllocIPv6Addresses", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AllocIPv6Addresses indicates an expected call of AllocIPv6Addresses
+func (mr *MockAPIsMockRecorder) AllocIPv6Addresses(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AllocIPv6Addresses", reflect.TypeOf((*MockAPIs)(nil).AllocIPv6Addresses), arg0, arg1)
+}
+
+// AllocTrunkENI mocks base method
+func (m *MockAPIs) AllocTrunkENI() (awsutils.TrunkENI, error) {
+	ret := m.ctrl.Call(m, "AllocTrunkENI")
+	ret0, _ := ret[0].(awsutils.TrunkENI)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AllocTrunkENI indicates an expected call of AllocTrunkENI
+func (mr *MockAPIsMockRecorder) AllocTrunkENI() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AllocTrunkENI", reflect.TypeOf((*MockAPIs)(nil).AllocTrunkENI))
+}
+
+// AssignBranchENI mocks base method
+func (m *MockAPIs) AssignBranchENI(arg0 awsutils.BranchENI, arg1 []string, arg2, arg3 string) (awsutils.BranchENI, error) {
+	ret := m.ctrl.Call(m, "AssignBranchENI", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(awsutils.BranchENI)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AssignBranchENI indicates an expected call of AssignBranchENI
+func (mr *MockAPIsMockRecorder) AssignBranchENI(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AssignBranchENI", reflect.TypeOf((*MockAPIs)(nil).AssignBranchENI), arg0, arg1, arg2, arg3)
+}
+
+// AssociateEIP mocks base method
+func (m *MockAPIs) AssociateEIP(arg0, arg1, arg2 string) error {
+	ret := m.ctrl.Call(m, "AssociateEIP", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AssociateEIP indicates an expected call of AssociateEIP
+func (mr *MockAPIsMockRecorder) AssociateEIP(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AssociateEIP", reflect.TypeOf((*MockAPIs)(nil).AssociateEIP), arg0, arg1, arg2)
+}
+
+// CheckPermissions mocks base method
+func (m *MockAPIs) CheckPermissions(arg0 []string) map[string][]string {
+	ret := m.ctrl.Call(m, "CheckPermissions", arg0)
+	ret0, _ := ret[0].(map[string][]string)
+	return ret0
+}
+
+// CheckPermissions indicates an expected call of CheckPermissions
+func (mr *MockAPIsMockRecorder) CheckPermissions(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CheckPermissions", reflect.TypeOf((*MockAPIs)(nil).CheckPermissions), arg0)
+}
+
 // DeallocIPAddresses mocks base method
 func (m *MockAPIs) DeallocIPAddresses(arg0 string, arg1 []string) error {
 	ret := m.ctrl.Call(m, "DeallocIPAddresses", arg0, arg1)
@@ -97,6 +186,18 @@ func (mr *MockAPIsMockRecorder) DeallocIPAddresses(arg0, arg1 interface{}) *gomo
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeallocIPAddresses", reflect.TypeOf((*MockAPIs)(nil).DeallocIPAddresses), arg0, arg1)
 }
 
+// DeallocIPv4Prefixes mocks base method
+func (m *MockAPIs) DeallocIPv4Prefixes(arg0 string, arg1 []netip.Prefix) error {
+	ret := m.ctrl.Call(m, "DeallocIPv4Prefixes", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeallocIPv4Prefixes indicates an expected call of DeallocIPv4Prefixes
+func (mr *MockAPIsMockRecorder) DeallocIPv4Prefixes(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeallocIPv4Prefixes", reflect.TypeOf((*MockAPIs)(nil).DeallocIPv4Prefixes), arg0, arg1)
+}
+
 // DescribeENI mocks base method
 func (m *MockAPIs) DescribeENI(arg0 string) ([]*ec2.NetworkInterfacePrivateIpAddress, *string, error) {
 	ret := m.ctrl.Call(m, "DescribeENI", arg0)
@@ -111,6 +212,30 @@ func (mr *MockAPIsMockRecorder) DescribeENI(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DescribeENI", reflect.TypeOf((*MockAPIs)(nil).DescribeENI), arg0)
 }
 
+// DisassociateEIP mocks base method
+func (m *MockAPIs) DisassociateEIP(arg0 string) error {
+	ret := m.ctrl.Call(m, "DisassociateEIP", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DisassociateEIP indicates an expected call of DisassociateEIP
+func (mr *MockAPIsMockRecorder) DisassociateEIP(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DisassociateEIP", reflect.TypeOf((*MockAPIs)(nil).DisassociateEIP), arg0)
+}
+
+// FreeBranchENI mocks base method
+func (m *MockAPIs) FreeBranchENI(arg0 awsutils.BranchENI) error {
+	ret := m.ctrl.Call(m, "FreeBranchENI", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FreeBranchENI indicates an expected call of FreeBranchENI
+func (mr *MockAPIsMockRecorder) FreeBranchENI(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FreeBranchENI", reflect.TypeOf((*MockAPIs)(nil).FreeBranchENI), arg0)
+}
+
 // FreeENI mocks base method
 func (m *MockAPIs) FreeENI(arg0 string) error {
 	ret := m.ctrl.Call(m, "FreeENI", arg0)
@@ -136,6 +261,95 @@ func (mr *MockAPIsMockRecorder) GetAttachedENIs() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAttachedENIs", reflect.TypeOf((*MockAPIs)(nil).GetAttachedENIs))
 }
 
+// GetBranchENILimit mocks base method
+func (m *MockAPIs) GetBranchENILimit() (int, error) {
+	ret := m.ctrl.Call(m, "GetBranchENILimit")
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetBranchENILimit indicates an expected call of GetBranchENILimit
+func (mr *MockAPIsMockRecorder) GetBranchENILimit() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBranchENILimit", reflect.TypeOf((*MockAPIs)(nil).GetBranchENILimit))
+}
+
+// GetBranchENIs mocks base method
+func (m *MockAPIs) GetBranchENIs(arg0 string) ([]awsutils.BranchENI, error) {
+	ret := m.ctrl.Call(m, "GetBranchENIs", arg0)
+	ret0, _ := ret[0].([]awsutils.BranchENI)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetBranchENIs indicates an expected call of GetBranchENIs
+func (mr *MockAPIsMockRecorder) GetBranchENIs(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBranchENIs", reflect.TypeOf((*MockAPIs)(nil).GetBranchENIs), arg0)
+}
+
+// GetClusterID mocks base method
+func (m *MockAPIs) GetClusterID() string {
+	ret := m.ctrl.Call(m, "GetClusterID")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// GetClusterID indicates an expected call of GetClusterID
+func (mr *MockAPIsMockRecorder) GetClusterID() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetClusterID", reflect.TypeOf((*MockAPIs)(nil).GetClusterID))
+}
+
+// GetClusterName mocks base method
+func (m *MockAPIs) GetClusterName() string {
+	ret := m.ctrl.Call(m, "GetClusterName")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// GetClusterName indicates an expected call of GetClusterName
+func (mr *MockAPIsMockRecorder) GetClusterName() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetClusterName", reflect.TypeOf((*MockAPIs)(nil).GetClusterName))
+}
+
+// GetEIPs mocks base method
+func (m *MockAPIs) GetEIPs(arg0 awsutils.EIPPool) ([]awsutils.EIP, error) {
+	ret := m.ctrl.Call(m, "GetEIPs", arg0)
+	ret0, _ := ret[0].([]awsutils.EIP)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetEIPs indicates an expected call of GetEIPs
+func (mr *MockAPIsMockRecorder) GetEIPs(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetEIPs", reflect.TypeOf((*MockAPIs)(nil).GetEIPs), arg0)
+}
+
+// GetENIIPv4Prefixes mocks base method
+func (m *MockAPIs) GetENIIPv4Prefixes(arg0 string) ([]netip.Prefix, error) {
+	ret := m.ctrl.Call(m, "GetENIIPv4Prefixes", arg0)
+	ret0, _ := ret[0].([]netip.Prefix)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetENIIPv4Prefixes indicates an expected call of GetENIIPv4Prefixes
+func (mr *MockAPIsMockRecorder) GetENIIPv4Prefixes(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetENIIPv4Prefixes", reflect.TypeOf((*MockAPIs)(nil).GetENIIPv4Prefixes), arg0)
+}
+
+// GetENIIPv6s mocks base method
+func (m *MockAPIs) GetENIIPv6s(arg0 string) ([]string, error) {
+	ret := m.ctrl.Call(m, "GetENIIPv6s", arg0)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetENIIPv6s indicates an expected call of GetENIIPv6s
+func (mr *MockAPIsMockRecorder) GetENIIPv6s(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetENIIPv6s", reflect.TypeOf((*MockAPIs)(nil).GetENIIPv6s), arg0)
+}
+
 // GetENILimit mocks base method
 func (m *MockAPIs) GetENILimit() (int, error) {
 	ret := m.ctrl.Call(m, "GetENILimit")
@@ -149,6 +363,19 @@ func (mr *MockAPIsMockRecorder) GetENILimit() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetENILimit", reflect.TypeOf((*MockAPIs)(nil).GetENILimit))
 }
 
+// GetENISubnetIPv6CIDRs mocks base method
+func (m *MockAPIs) GetENISubnetIPv6CIDRs(arg0 string) ([]netip.Prefix, error) {
+	ret := m.ctrl.Call(m, "GetENISubnetIPv6CIDRs", arg0)
+	ret0, _ := ret[0].([]netip.Prefix)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetENISubnetIPv6CIDRs indicates an expected call of GetENISubnetIPv6CIDRs
+func (mr *MockAPIsMockRecorder) GetENISubnetIPv6CIDRs(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetENISubnetIPv6CIDRs", reflect.TypeOf((*MockAPIs)(nil).GetENISubnetIPv6CIDRs), arg0)
+}
+
 // GetENIipLimit mocks base method
 func (m *MockAPIs) GetENIipLimit() (int, error) {
 	ret := m.ctrl.Call(m, "GetENIipLimit")
@@ -162,10 +389,22 @@ func (mr *MockAPIsMockRecorder) GetENIipLimit() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetENIipLimit", reflect.TypeOf((*MockAPIs)(nil).GetENIipLimit))
 }
 
+// GetInstanceID mocks base method
+func (m *MockAPIs) GetInstanceID() string {
+	ret := m.ctrl.Call(m, "GetInstanceID")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// GetInstanceID indicates an expected call of GetInstanceID
+func (mr *MockAPIsMockRecorder) GetInstanceID() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetInstanceID", reflect.TypeOf((*MockAPIs)(nil).GetInstanceID))
+}
+
 // GetLocalIPv4 mocks base method
-func (m *MockAPIs) GetLocalIPv4() string {
+func (m *MockAPIs) GetLocalIPv4() netip.Addr {
 	ret := m.ctrl.Call(m, "GetLocalIPv4")
-	ret0, _ := ret[0].(string)
+	ret0, _ := ret[0].(netip.Addr)
 	return ret0
 }
 
@@ -198,10 +437,23 @@ func (mr *MockAPIsMockRecorder) GetPrimaryENImac() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPrimaryENImac", reflect.TypeOf((*MockAPIs)(nil).GetPrimaryENImac))
 }
 
+// GetTrunkENI mocks base method
+func (m *MockAPIs) GetTrunkENI() (awsutils.TrunkENI, error) {
+	ret := m.ctrl.Call(m, "GetTrunkENI")
+	ret0, _ := ret[0].(awsutils.TrunkENI)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetTrunkENI indicates an expected call of GetTrunkENI
+func (mr *MockAPIsMockRecorder) GetTrunkENI() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTrunkENI", reflect.TypeOf((*MockAPIs)(nil).GetTrunkENI))
+}
+
 // GetVPCIPv4CIDR mocks base method
-func (m *MockAPIs) GetVPCIPv4CIDR() string {
+func (m *MockAPIs) GetVPCIPv4CIDR() netip.Prefix {
 	ret := m.ctrl.Call(m, "GetVPCIPv4CIDR")
-	ret0, _ := ret[0].(string)
+	ret0, _ := ret[0].(netip.Prefix)
 	return ret0
 }
 
@@ -211,9 +463,9 @@ func (mr *MockAPIsMockRecorder) GetVPCIPv4CIDR() *gomock.Call {
 }
 
 // GetVPCIPv4CIDRs mocks base method
-func (m *MockAPIs) GetVPCIPv4CIDRs() []*string {
+func (m *MockAPIs) GetVPCIPv4CIDRs() []netip.Prefix {
 	ret := m.ctrl.Call(m, "GetVPCIPv4CIDRs")
-	ret0, _ := ret[0].([]*string)
+	ret0, _ := ret[0].([]netip.Prefix)
 	return ret0
 }
 
@@ -221,3 +473,29 @@ func (m *MockAPIs) GetVPCIPv4CIDRs() []*string {
 func (mr *MockAPIsMockRecorder) GetVPCIPv4CIDRs() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetVPCIPv4CIDRs", reflect.TypeOf((*MockAPIs)(nil).GetVPCIPv4CIDRs))
 }
+
+// GetVPCIPv6CIDRs mocks base method
+func (m *MockAPIs) GetVPCIPv6CIDRs() ([]netip.Prefix, error) {
+	ret := m.ctrl.Call(m, "GetVPCIPv6CIDRs")
+	ret0, _ := ret[0].([]netip.Prefix)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetVPCIPv6CIDRs indicates an expected call of GetVPCIPv6CIDRs
+func (mr *MockAPIsMockRecorder) GetVPCIPv6CIDRs() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetVPCIPv6CIDRs", reflect.TypeOf((*MockAPIs)(nil).GetVPCIPv6CIDRs))
+}
+
+// RefreshLocalIPv4 mocks base method
+func (m *MockAPIs) RefreshLocalIPv4() (netip.Addr, error) {
+	ret := m.ctrl.Call(m, "RefreshLocalIPv4")
+	ret0, _ := ret[0].(netip.Addr)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RefreshLocalIPv4 indicates an expected call of RefreshLocalIPv4
+func (mr *MockAPIsMockRecorder) RefreshLocalIPv4() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RefreshLocalIPv4", reflect.TypeOf((*MockAPIs)(nil).RefreshLocalIPv4))
+}
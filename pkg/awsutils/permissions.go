@@ -0,0 +1,184 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package awsutils
+
+import (
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The features of ipamd that need IAM permissions, beyond assigning IPs to the ENIs that are attached
+const (
+	// FeatureCore is what ipamd can not run without
+	FeatureCore = "core"
+	// FeatureENIAllocation is the creation of ENIs when the attached ones are full
+	FeatureENIAllocation = "eni-allocation"
+	// FeatureENIRelease is the deletion of unused ENIs, including the ones leaked by earlier runs
+	FeatureENIRelease = "eni-release"
+	// FeatureENITagging is the tagging of new ENIs with the instance and cluster they belong to
+	FeatureENITagging = "eni-tagging"
+
+	// dryRunOperationCode is the error code of a dry run that would have succeeded
+	dryRunOperationCode = "DryRunOperation"
+	// unauthorizedOperationCode is the error code of a call that the IAM policy denies
+	unauthorizedOperationCode = "UnauthorizedOperation"
+
+	// dryRunAttachmentID is the attachment detached by the dry run, the attachment ID of the primary ENI is unknown
+	dryRunAttachmentID = "eni-attach-00000000000000000"
+)
+
+// featurePermissions are the IAM actions each feature needs. AssignPrivateIpAddresses, UnassignPrivateIpAddresses and
+// AssignIpv6Addresses are needed too, but EC2 has no dry run for them, so that they are only reported once denied.
+var featurePermissions = map[string][]string{
+	FeatureCore:          {"ec2:DescribeNetworkInterfaces"},
+	FeatureENIAllocation: {"ec2:CreateNetworkInterface", "ec2:AttachNetworkInterface", "ec2:ModifyNetworkInterfaceAttribute", "ec2:DescribeInstances"},
+	FeatureENIRelease:    {"ec2:DetachNetworkInterface", "ec2:DeleteNetworkInterface"},
+	FeatureENITagging:    {"ec2:CreateTags"},
+}
+
+var missingPermission = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "awscni_missing_iam_permission",
+		Help: "Set to 1 for each IAM action that ipamd needs but is denied",
+	},
+	[]string{"action"},
+)
+
+// Features returns the features of ipamd that need IAM permissions
+func Features() []string {
+	features := make([]string, 0, len(featurePermissions))
+	for feature := range featurePermissions {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	return features
+}
+
+// CheckPermissions probes the IAM actions of the given features with dry-run calls, and returns the denied ones by
+// feature. Actions whose dry run fails for another reason are logged and not reported as denied.
+func (cache *EC2InstanceMetadataCache) CheckPermissions(features []string) map[string][]string {
+	missing := make(map[string][]string)
+	denied := make(map[string]bool)
+	for _, feature := range features {
+		for _, action := range featurePermissions[feature] {
+			if _, checked := denied[action]; !checked {
+				denied[action] = cache.isDenied(action)
+			}
+			if denied[action] {
+				missing[feature] = append(missing[feature], action)
+			}
+		}
+	}
+
+	cache.permissionsLock.Lock()
+	defer cache.permissionsLock.Unlock()
+	cache.deniedActions = denied
+	return missing
+}
+
+// isDenied returns true if the dry run of action is denied
+func (cache *EC2InstanceMetadataCache) isDenied(action string) bool {
+	err := cache.dryRun(action)
+	aerr, ok := err.(awserr.Error)
+	switch {
+	case ok && aerr.Code() == dryRunOperationCode:
+		log.Debugf("IAM permission %s is granted", action)
+		return false
+	case ok && aerr.Code() == unauthorizedOperationCode:
+		log.Errorf("IAM permission %s is denied", action)
+		missingPermission.WithLabelValues(action).Set(1)
+		return true
+	}
+	// In a shared subnet, ENIs can not be created with the security groups of another account, whatever the policy
+	if owner := cache.sharedSubnetOwner(cache.subnetID); owner != "" && action == "ec2:CreateNetworkInterface" {
+		if explained := cache.explainSharedSubnetError(err, cache.subnetID, owner); explained != err {
+			log.Errorf("IAM permission %s can not be used: %v", action, explained)
+			return true
+		}
+	}
+	log.Warnf("Unable to check IAM permission %s: %v", action, err)
+	return false
+}
+
+// dryRun calls action with the dry run flag, on the resources of the instance
+func (cache *EC2InstanceMetadataCache) dryRun(action string) error {
+	var err error
+	switch action {
+	case "ec2:DescribeNetworkInterfaces":
+		_, err = cache.ec2SVC.DescribeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{
+			DryRun:              aws.Bool(true),
+			NetworkInterfaceIds: []*string{aws.String(cache.primaryENI)},
+		})
+	case "ec2:DescribeInstances":
+		_, err = cache.ec2SVC.DescribeInstances(&ec2.DescribeInstancesInput{
+			DryRun:      aws.Bool(true),
+			InstanceIds: []*string{aws.String(cache.instanceID)},
+		})
+	case "ec2:CreateNetworkInterface":
+		_, err = cache.ec2SVC.CreateNetworkInterface(&ec2.CreateNetworkInterfaceInput{
+			DryRun:   aws.Bool(true),
+			Groups:   cache.securityGroups,
+			SubnetId: aws.String(cache.subnetID),
+		})
+	case "ec2:AttachNetworkInterface":
+		_, err = cache.ec2SVC.AttachNetworkInterface(&ec2.AttachNetworkInterfaceInput{
+			DryRun:             aws.Bool(true),
+			DeviceIndex:        aws.Int64(maxENIs - 1),
+			InstanceId:         aws.String(cache.instanceID),
+			NetworkInterfaceId: aws.String(cache.primaryENI),
+		})
+	case "ec2:ModifyNetworkInterfaceAttribute":
+		_, err = cache.ec2SVC.ModifyNetworkInterfaceAttribute(&ec2.ModifyNetworkInterfaceAttributeInput{
+			DryRun:             aws.Bool(true),
+			Description:        &ec2.AttributeValue{Value: aws.String(eniDescriptionPrefix + cache.instanceID)},
+			NetworkInterfaceId: aws.String(cache.primaryENI),
+		})
+	case "ec2:DetachNetworkInterface":
+		_, err = cache.ec2SVC.DetachNetworkInterface(&ec2.DetachNetworkInterfaceInput{
+			DryRun:       aws.Bool(true),
+			AttachmentId: aws.String(dryRunAttachmentID),
+		})
+	case "ec2:DeleteNetworkInterface":
+		_, err = cache.ec2SVC.DeleteNetworkInterface(&ec2.DeleteNetworkInterfaceInput{
+			DryRun:             aws.Bool(true),
+			NetworkInterfaceId: aws.String(cache.primaryENI),
+		})
+	case "ec2:CreateTags":
+		_, err = cache.ec2SVC.CreateTags(&ec2.CreateTagsInput{
+			DryRun:    aws.Bool(true),
+			Resources: []*string{aws.String(cache.primaryENI)},
+			Tags:      []*ec2.Tag{{Key: aws.String(eniNodeTagKey), Value: aws.String(cache.instanceID)}},
+		})
+	}
+	return err
+}
+
+// denied returns true if action was denied when the permissions were checked
+func (cache *EC2InstanceMetadataCache) denied(action string) bool {
+	cache.permissionsLock.RLock()
+	defer cache.permissionsLock.RUnlock()
+	return cache.deniedActions[action]
+}
+
+// recordUnauthorized reports an action denied outside of the permission check, e.g. one that has no dry run
+func recordUnauthorized(operation, code string) {
+	if code == unauthorizedOperationCode {
+		missingPermission.WithLabelValues("ec2:" + operation).Set(1)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package awsutils
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var sharedSubnet = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "awscni_shared_subnet",
+		Help: "Set to 1 for each subnet of the ENIs that is shared with the account of the node by another account via AWS RAM",
+	},
+	[]string{"subnet", "owner"},
+)
+
+// subnetOwner returns the account that owns a subnet, or an empty string if it is unknown. Participants of a shared
+// VPC can describe the subnets shared with them, but the IAM policy of the node may not allow it, in which case the
+// subnet is assumed not to be shared.
+func (cache *EC2InstanceMetadataCache) subnetOwner(subnetID string) string {
+	cache.subnetOwnersLock.Lock()
+	defer cache.subnetOwnersLock.Unlock()
+	if owner, ok := cache.subnetOwners[subnetID]; ok {
+		return owner
+	}
+	if cache.subnetOwners == nil {
+		cache.subnetOwners = make(map[string]string)
+	}
+
+	var owner string
+	output, err := cache.ec2SVC.DescribeSubnets(&ec2.DescribeSubnetsInput{SubnetIds: []*string{aws.String(subnetID)}})
+	if err != nil {
+		log.Warnf("Unable to find the account that owns subnet %s, assuming it is not shared: %v", subnetID, err)
+	} else if len(output.Subnets) == 1 {
+		owner = aws.StringValue(output.Subnets[0].OwnerId)
+	}
+	cache.subnetOwners[subnetID] = owner
+	if owner != "" && cache.accountID != "" && owner != cache.accountID {
+		log.Infof("Subnet %s is shared with account %s by account %s", subnetID, cache.accountID, owner)
+		sharedSubnet.WithLabelValues(subnetID, owner).Set(1)
+	}
+	return owner
+}
+
+// sharedSubnetOwner returns the account that shares a subnet with the account of the node, or an empty string if the
+// subnet is not shared
+func (cache *EC2InstanceMetadataCache) sharedSubnetOwner(subnetID string) string {
+	if cache.accountID == "" {
+		return ""
+	}
+	owner := cache.subnetOwner(subnetID)
+	if owner == "" || owner == cache.accountID {
+		return ""
+	}
+	return owner
+}
+
+// explainSharedSubnetError adds to the error of a call that failed in a subnet shared by owner the limitations of the
+// shared subnets that likely caused it, since EC2 reports them as if the resources did not exist
+func (cache *EC2InstanceMetadataCache) explainSharedSubnetError(err error, subnetID, owner string) error {
+	aerr, ok := errors.Cause(err).(awserr.Error)
+	if !ok {
+		return err
+	}
+	switch aerr.Code() {
+	case "InvalidGroup.NotFound", "InvalidSecurityGroupID.NotFound":
+		return errors.Wrapf(err, "subnet %s is shared by account %s, the security groups of the ENIs must be owned by "+
+			"account %s", subnetID, owner, cache.accountID)
+	case "InvalidSubnetID.NotFound":
+		return errors.Wrapf(err, "subnet %s of account %s is no longer shared with account %s", subnetID, owner,
+			cache.accountID)
+	case unauthorizedOperationCode:
+		return errors.Wrapf(err, "subnet %s is shared by account %s, only the resources of account %s can be changed",
+			subnetID, owner, cache.accountID)
+	}
+	return err
+}
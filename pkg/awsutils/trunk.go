@@ -0,0 +1,309 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package awsutils
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/ec2wrapper"
+)
+
+const (
+	// trunkInterfaceType is the type of the ENIs whose traffic is tagged with the VLAN of their branch ENIs
+	trunkInterfaceType = "trunk"
+	// branchDescriptionPrefix starts the description of the branch ENIs, so that leaked ones are cleaned up too
+	branchDescriptionPrefix = eniDescriptionPrefix + "branch-"
+	// eniBranchPodTagKey tags the branch ENIs with the namespace/name of their pod
+	eniBranchPodTagKey = "k8s.amazonaws.com/pod"
+	// eniBranchVlanTagKey tags the branch ENIs with their VLAN
+	eniBranchVlanTagKey = "k8s.amazonaws.com/vlan_id"
+)
+
+// TrunkENI is the ENI that carries the traffic of the branch ENIs of the instance
+type TrunkENI struct {
+	ENIID string
+	MAC   string
+}
+
+// BranchENI is an ENI of a pod, with its own security groups, whose traffic goes through the trunk ENI tagged with
+// its VLAN
+type BranchENI struct {
+	ENIID         string
+	MAC           string
+	IPv4Addr      string
+	VlanID        int
+	AssociationID string
+	PodNamespace  string
+	PodName       string
+}
+
+// getTrunkENIID returns the ID of the trunk ENI, empty if there is none
+func (cache *EC2InstanceMetadataCache) getTrunkENIID() string {
+	cache.trunkENILock.RLock()
+	defer cache.trunkENILock.RUnlock()
+	return cache.trunkENI
+}
+
+func (cache *EC2InstanceMetadataCache) setTrunkENIID(eniID string) {
+	cache.trunkENILock.Lock()
+	defer cache.trunkENILock.Unlock()
+	cache.trunkENI = eniID
+}
+
+// GetTrunkENI returns the trunk ENI attached to the instance, with an empty ID if there is none. From then on, the
+// trunk ENI is left out of the attached ENIs.
+func (cache *EC2InstanceMetadataCache) GetTrunkENI() (TrunkENI, error) {
+	input := &ec2.DescribeNetworkInterfacesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("attachment.instance-id"), Values: []*string{aws.String(cache.instanceID)}},
+			{Name: aws.String("interface-type"), Values: []*string{aws.String(trunkInterfaceType)}},
+		},
+	}
+	output, err := cache.ec2SVC.DescribeNetworkInterfaces(input)
+	if err != nil {
+		awsAPIErrInc("DescribeNetworkInterfaces", err)
+		return TrunkENI{}, errors.Wrap(err, "failed to describe the trunk ENI of the instance")
+	}
+	if len(output.NetworkInterfaces) == 0 {
+		cache.setTrunkENIID("")
+		return TrunkENI{}, nil
+	}
+	eni := output.NetworkInterfaces[0]
+	trunk := TrunkENI{ENIID: aws.StringValue(eni.NetworkInterfaceId), MAC: aws.StringValue(eni.MacAddress)}
+	cache.setTrunkENIID(trunk.ENIID)
+	return trunk, nil
+}
+
+// AllocTrunkENI creates a trunk ENI in the subnet of the primary ENI, with its security groups, and attaches it to the
+// instance. From then on, the trunk ENI is left out of the attached ENIs.
+func (cache *EC2InstanceMetadataCache) AllocTrunkENI() (TrunkENI, error) {
+	input := &ec2.CreateNetworkInterfaceInput{
+		Description:   aws.String(eniDescriptionPrefix + "trunk-" + cache.instanceID),
+		Groups:        cache.securityGroups,
+		SubnetId:      aws.String(cache.subnetID),
+		InterfaceType: aws.String(trunkInterfaceType),
+	}
+	result, err := cache.ec2SVC.CreateNetworkInterface(input)
+	if err != nil {
+		awsAPIErrInc("CreateNetworkInterface", err)
+		return TrunkENI{}, errors.Wrap(err, "AllocTrunkENI: failed to create the trunk ENI")
+	}
+	trunk := TrunkENI{
+		ENIID: aws.StringValue(result.NetworkInterface.NetworkInterfaceId),
+		MAC:   aws.StringValue(result.NetworkInterface.MacAddress),
+	}
+	// Leave the trunk ENI out of the attached ENIs before it shows up in the instance metadata
+	cache.setTrunkENIID(trunk.ENIID)
+
+	attachmentID, err := cache.attachENI(trunk.ENIID)
+	if err != nil {
+		cache.setTrunkENIID("")
+		_ = cache.deleteENI(trunk.ENIID, maxENIBackoffDelay)
+		return TrunkENI{}, errors.Wrap(err, "AllocTrunkENI: error attaching the trunk ENI")
+	}
+	cache.tagENI(trunk.ENIID)
+	if err = cache.setDeleteOnTermination(trunk.ENIID, attachmentID); err != nil {
+		// The trunk ENI works, it is only left behind if the instance is terminated
+		log.Warnf("Failed to set the trunk ENI %s to be deleted with the instance: %v", trunk.ENIID, err)
+	}
+	log.Infof("Created and attached trunk ENI %s", trunk.ENIID)
+	return trunk, nil
+}
+
+// AllocBranchENI creates a branch ENI for a pod, with the security groups, in the subnet of the primary ENI, and
+// associates it with the trunk ENI with the VLAN. The branch ENI is tagged with the pod and the VLAN, so that it is
+// found again after a restart. A warm branch ENI, without a pod, gets the security groups of the primary ENI until it is
+// assigned to a pod.
+func (cache *EC2InstanceMetadataCache) AllocBranchENI(trunkENI string, vlanID int, securityGroups []string,
+	podNamespace, podName string) (BranchENI, error) {
+	input := &ec2.CreateNetworkInterfaceInput{
+		Description: aws.String(branchDescriptionPrefix + cache.instanceID),
+		Groups:      aws.StringSlice(securityGroups),
+		SubnetId:    aws.String(cache.subnetID),
+	}
+	if len(securityGroups) == 0 {
+		input.Groups = cache.securityGroups
+	}
+	log.Infof("Creating branch ENI with security groups: %v in subnet: %s for pod %s/%s", securityGroups,
+		cache.subnetID, podNamespace, podName)
+	result, err := cache.ec2SVC.CreateNetworkInterface(input)
+	if err != nil {
+		awsAPIErrInc("CreateNetworkInterface", err)
+		if owner := cache.sharedSubnetOwner(cache.subnetID); owner != "" {
+			err = cache.explainSharedSubnetError(err, cache.subnetID, owner)
+		}
+		return BranchENI{}, errors.Wrap(err, "AllocBranchENI: failed to create the branch ENI")
+	}
+	branch := BranchENI{
+		ENIID:        aws.StringValue(result.NetworkInterface.NetworkInterfaceId),
+		MAC:          aws.StringValue(result.NetworkInterface.MacAddress),
+		IPv4Addr:     aws.StringValue(result.NetworkInterface.PrivateIpAddress),
+		VlanID:       vlanID,
+		PodNamespace: podNamespace,
+		PodName:      podName,
+	}
+
+	association, err := cache.ec2SVC.AssociateTrunkInterface(&ec2wrapper.AssociateTrunkInterfaceInput{
+		BranchInterfaceId: aws.String(branch.ENIID),
+		TrunkInterfaceId:  aws.String(trunkENI),
+		VlanId:            aws.Int64(int64(vlanID)),
+	})
+	if err != nil {
+		awsAPIErrInc("AssociateTrunkInterface", err)
+		_ = cache.deleteENI(branch.ENIID, maxENIBackoffDelay)
+		return BranchENI{}, errors.Wrapf(err, "AllocBranchENI: failed to associate branch ENI %s with trunk ENI %s",
+			branch.ENIID, trunkENI)
+	}
+	if association.InterfaceAssociation != nil {
+		branch.AssociationID = aws.StringValue(association.InterfaceAssociation.AssociationId)
+	}
+	var tags []*ec2.Tag
+	if podName != "" {
+		tags = append(tags, &ec2.Tag{Key: aws.String(eniBranchPodTagKey), Value: aws.String(podNamespace + "/" + podName)})
+	}
+	tags = append(tags, &ec2.Tag{Key: aws.String(eniBranchVlanTagKey), Value: aws.String(strconv.Itoa(vlanID))})
+	cache.tagENI(branch.ENIID, tags...)
+	log.Infof("Associated branch ENI %s with trunk ENI %s, VLAN %d", branch.ENIID, trunkENI, vlanID)
+	return branch, nil
+}
+
+// AssignBranchENI replaces the security groups of a warm branch ENI with the ones of the pod, and tags it with the pod
+func (cache *EC2InstanceMetadataCache) AssignBranchENI(branch BranchENI, securityGroups []string, podNamespace,
+	podName string) (BranchENI, error) {
+	log.Infof("Assigning branch ENI %s with security groups: %v to pod %s/%s", branch.ENIID, securityGroups,
+		podNamespace, podName)
+	_, err := cache.ec2SVC.ModifyNetworkInterfaceAttribute(&ec2.ModifyNetworkInterfaceAttributeInput{
+		Groups:             aws.StringSlice(securityGroups),
+		NetworkInterfaceId: aws.String(branch.ENIID),
+	})
+	if err != nil {
+		awsAPIErrInc("ModifyNetworkInterfaceAttribute", err)
+		return BranchENI{}, errors.Wrapf(err, "AssignBranchENI: failed to set the security groups of branch ENI %s",
+			branch.ENIID)
+	}
+	branch.PodNamespace = podNamespace
+	branch.PodName = podName
+	cache.tagENI(branch.ENIID,
+		&ec2.Tag{Key: aws.String(eniBranchPodTagKey), Value: aws.String(podNamespace + "/" + podName)})
+	return branch, nil
+}
+
+// FreeBranchENI removes the association of a branch ENI with the trunk ENI, and deletes it
+func (cache *EC2InstanceMetadataCache) FreeBranchENI(branch BranchENI) error {
+	if branch.AssociationID != "" {
+		_, err := cache.ec2SVC.DisassociateTrunkInterface(&ec2wrapper.DisassociateTrunkInterfaceInput{
+			AssociationId: aws.String(branch.AssociationID),
+		})
+		if err != nil && !containsAssociationNotFoundError(err) {
+			awsAPIErrInc("DisassociateTrunkInterface", err)
+			return errors.Wrapf(err, "FreeBranchENI: failed to remove association %s of branch ENI %s",
+				branch.AssociationID, branch.ENIID)
+		}
+	}
+	if err := cache.deleteENI(branch.ENIID, maxENIBackoffDelay); err != nil {
+		return errors.Wrapf(err, "FreeBranchENI: failed to delete branch ENI %s", branch.ENIID)
+	}
+	return nil
+}
+
+// GetBranchENIs returns the branch ENIs associated with the trunk ENI, with the pod and VLAN of their tags
+func (cache *EC2InstanceMetadataCache) GetBranchENIs(trunkENI string) ([]BranchENI, error) {
+	input := &ec2wrapper.DescribeTrunkInterfaceAssociationsInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("trunk-interface-association.trunk-interface-id"),
+			Values: []*string{aws.String(trunkENI)},
+		}},
+	}
+	associations := make(map[string]*ec2wrapper.TrunkInterfaceAssociation)
+	var branchIDs []*string
+	// The associations may come in several pages
+	for {
+		output, err := cache.ec2SVC.DescribeTrunkInterfaceAssociations(input)
+		if err != nil {
+			awsAPIErrInc("DescribeTrunkInterfaceAssociations", err)
+			return nil, errors.Wrapf(err, "failed to describe the associations of trunk ENI %s", trunkENI)
+		}
+		for _, association := range output.InterfaceAssociations {
+			associations[aws.StringValue(association.BranchInterfaceId)] = association
+			branchIDs = append(branchIDs, association.BranchInterfaceId)
+		}
+		if aws.StringValue(output.NextToken) == "" {
+			break
+		}
+		input.NextToken = output.NextToken
+	}
+	if len(branchIDs) == 0 {
+		return nil, nil
+	}
+
+	output, err := cache.ec2SVC.DescribeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{NetworkInterfaceIds: branchIDs})
+	if err != nil {
+		awsAPIErrInc("DescribeNetworkInterfaces", err)
+		return nil, errors.Wrapf(err, "failed to describe the branch ENIs of trunk ENI %s", trunkENI)
+	}
+	branches := make([]BranchENI, 0, len(output.NetworkInterfaces))
+	for _, eni := range output.NetworkInterfaces {
+		association := associations[aws.StringValue(eni.NetworkInterfaceId)]
+		branch := BranchENI{
+			ENIID:         aws.StringValue(eni.NetworkInterfaceId),
+			MAC:           aws.StringValue(eni.MacAddress),
+			IPv4Addr:      aws.StringValue(eni.PrivateIpAddress),
+			VlanID:        int(aws.Int64Value(association.VlanId)),
+			AssociationID: aws.StringValue(association.AssociationId),
+		}
+		for _, tag := range eni.TagSet {
+			if aws.StringValue(tag.Key) == eniBranchPodTagKey {
+				parts := strings.SplitN(aws.StringValue(tag.Value), "/", 2)
+				if len(parts) == 2 {
+					branch.PodNamespace, branch.PodName = parts[0], parts[1]
+				}
+			}
+		}
+		branches = append(branches, branch)
+	}
+	return branches, nil
+}
+
+// associatedBranchENIIDs returns the IDs of the branch ENIs associated with the trunk ENI of the instance, which are in
+// use although they are not attached to it
+func (cache *EC2InstanceMetadataCache) associatedBranchENIIDs() (map[string]bool, error) {
+	ids := make(map[string]bool)
+	trunkENI := cache.getTrunkENIID()
+	if trunkENI == "" {
+		return ids, nil
+	}
+	branches, err := cache.GetBranchENIs(trunkENI)
+	if err != nil {
+		return nil, err
+	}
+	for _, branch := range branches {
+		ids[branch.ENIID] = true
+	}
+	return ids, nil
+}
+
+// containsAssociationNotFoundError returns whether the trunk interface association is already gone
+func containsAssociationNotFoundError(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == "InvalidAssociationID.NotFound"
+	}
+	return false
+}
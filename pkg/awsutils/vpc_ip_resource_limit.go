@@ -530,3 +530,68 @@ var InstanceIPsAvailable = map[string]int{
 	"z1d.12xlarge":  50,
 	"z1d.metal":     50,
 }
+
+// InstanceBranchENIsAvailable contains a mapping of the instance types that support trunk ENIs to the number of branch
+// ENIs that can be associated with their trunk ENI
+var InstanceBranchENIsAvailable = map[string]int{
+	"c5.large":     9,
+	"c5.xlarge":    18,
+	"c5.2xlarge":   38,
+	"c5.4xlarge":   54,
+	"c5.9xlarge":   54,
+	"c5.12xlarge":  54,
+	"c5.18xlarge":  107,
+	"c5.24xlarge":  107,
+	"c5.metal":     107,
+	"c5d.large":    9,
+	"c5d.xlarge":   18,
+	"c5d.2xlarge":  38,
+	"c5d.4xlarge":  54,
+	"c5d.9xlarge":  54,
+	"c5d.18xlarge": 107,
+	"m5.large":     9,
+	"m5.xlarge":    18,
+	"m5.2xlarge":   38,
+	"m5.4xlarge":   54,
+	"m5.8xlarge":   54,
+	"m5.12xlarge":  54,
+	"m5.16xlarge":  107,
+	"m5.24xlarge":  107,
+	"m5.metal":     107,
+	"m5d.large":    9,
+	"m5d.xlarge":   18,
+	"m5d.2xlarge":  38,
+	"m5d.4xlarge":  54,
+	"m5d.12xlarge": 54,
+	"m5d.24xlarge": 107,
+	"r5.large":     9,
+	"r5.xlarge":    18,
+	"r5.2xlarge":   38,
+	"r5.4xlarge":   54,
+	"r5.8xlarge":   54,
+	"r5.12xlarge":  54,
+	"r5.16xlarge":  107,
+	"r5.24xlarge":  107,
+	"r5.metal":     107,
+	"r5d.large":    9,
+	"r5d.xlarge":   18,
+	"r5d.2xlarge":  38,
+	"r5d.4xlarge":  54,
+	"r5d.12xlarge": 54,
+	"r5d.24xlarge": 107,
+}
+
+// AddInstanceLimits adds the limits of an instance type missing from InstanceENIsAvailable and InstanceIPsAvailable,
+// e.g. one released after this version. The known instance types are not changed. It returns whether the limits were
+// added, and must be called before New.
+func AddInstanceLimits(instanceType string, enis, ipsPerENI int) bool {
+	if _, ok := InstanceENIsAvailable[instanceType]; ok {
+		return false
+	}
+	if _, ok := InstanceIPsAvailable[instanceType]; ok {
+		return false
+	}
+	InstanceENIsAvailable[instanceType] = enis
+	InstanceIPsAvailable[instanceType] = ipsPerENI
+	return true
+}
@@ -0,0 +1,481 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package bgp implements a minimal, advertise-only BGP speaker used to announce the pod IPs of a node to
+// external routers, e.g. on-premises routers reachable over Direct Connect when SNAT is disabled.
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/retry"
+)
+
+const (
+	// envBGPEnabled is used to turn on the BGP speaker. Defaults to false.
+	envBGPEnabled = "AWS_VPC_K8S_CNI_BGP_ENABLED"
+
+	// envBGPLocalASN is the autonomous system number the node uses when peering.
+	envBGPLocalASN = "AWS_VPC_K8S_CNI_BGP_LOCAL_ASN"
+
+	// envBGPPeers is a comma separated list of <ipv4>:<asn> peers, e.g. "10.0.0.1:65000,10.0.0.2:65000".
+	envBGPPeers = "AWS_VPC_K8S_CNI_BGP_PEERS"
+
+	// envBGPCommunities is a comma separated list of <asn>:<value> communities attached to every announcement.
+	envBGPCommunities = "AWS_VPC_K8S_CNI_BGP_COMMUNITIES"
+
+	// envBGPAdvertiseCIDRs is a comma separated list of IPv4 CIDRs. When set, only pod IPs inside one of these
+	// CIDRs are announced. Defaults to announcing every pod IP.
+	envBGPAdvertiseCIDRs = "AWS_VPC_K8S_CNI_BGP_ADVERTISE_CIDRS"
+
+	bgpPort         = 179
+	defaultHoldTime = 90
+	dialTimeout     = 10 * time.Second
+)
+
+// Speaker advertises a set of prefixes to the configured BGP peers
+type Speaker interface {
+	// Start connects to every peer and keeps the sessions up until Stop is called
+	Start()
+	// Stop closes every session
+	Stop()
+	// SetPrefixes replaces the set of advertised prefixes
+	SetPrefixes(prefixes []*net.IPNet)
+}
+
+// Peer is a BGP neighbor
+type Peer struct {
+	Address net.IP
+	ASN     uint32
+}
+
+func (p Peer) String() string {
+	return fmt.Sprintf("%s(AS%d)", p.Address, p.ASN)
+}
+
+type speaker struct {
+	localASN       uint32
+	routerID       net.IP
+	nextHop        net.IP
+	holdTime       uint16
+	peers          []Peer
+	communities    []uint32
+	advertiseCIDRs []*net.IPNet
+	dial           func(address string) (net.Conn, error)
+
+	lock     sync.Mutex
+	prefixes map[string]*net.IPNet
+	sessions []*session
+	stop     chan struct{}
+}
+
+// Enabled returns whether the BGP speaker has been turned on
+func Enabled() bool {
+	return getBoolEnvVar(envBGPEnabled, false)
+}
+
+// New creates a BGP speaker from the environment, using nodeIP as both router ID and next hop
+func New(nodeIP net.IP) (Speaker, error) {
+	localASN, err := parseASN(os.Getenv(envBGPLocalASN))
+	if err != nil {
+		return nil, errors.Wrapf(err, "bgp: invalid %s", envBGPLocalASN)
+	}
+	peers, err := parsePeers(os.Getenv(envBGPPeers))
+	if err != nil {
+		return nil, errors.Wrapf(err, "bgp: invalid %s", envBGPPeers)
+	}
+	if len(peers) == 0 {
+		return nil, errors.Errorf("bgp: %s must list at least one peer", envBGPPeers)
+	}
+	communities, err := parseCommunities(os.Getenv(envBGPCommunities))
+	if err != nil {
+		return nil, errors.Wrapf(err, "bgp: invalid %s", envBGPCommunities)
+	}
+	if nodeIP.To4() == nil {
+		return nil, errors.Errorf("bgp: node IP %s is not an IPv4 address", nodeIP)
+	}
+	return &speaker{
+		localASN:       localASN,
+		routerID:       nodeIP.To4(),
+		nextHop:        nodeIP.To4(),
+		holdTime:       defaultHoldTime,
+		peers:          peers,
+		communities:    communities,
+		advertiseCIDRs: getAdvertiseCIDRs(),
+		dial: func(address string) (net.Conn, error) {
+			return net.DialTimeout("tcp", address, dialTimeout)
+		},
+		prefixes: make(map[string]*net.IPNet),
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+// Start connects to every configured peer. Sessions are re-established with a backoff if they fail.
+func (s *speaker) Start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, peer := range s.peers {
+		sess := &session{
+			speaker: s,
+			peer:    peer,
+			address: net.JoinHostPort(peer.Address.String(), strconv.Itoa(bgpPort)),
+			changed: make(chan struct{}, 1),
+		}
+		s.sessions = append(s.sessions, sess)
+		log.Infof("bgp: starting session with peer %s", peer)
+		go sess.run()
+	}
+}
+
+// Stop closes every session
+func (s *speaker) Stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+}
+
+// SetPrefixes replaces the advertised prefixes, filtered through AWS_VPC_K8S_CNI_BGP_ADVERTISE_CIDRS
+func (s *speaker) SetPrefixes(prefixes []*net.IPNet) {
+	desired := make(map[string]*net.IPNet, len(prefixes))
+	for _, prefix := range prefixes {
+		if prefix == nil || prefix.IP.To4() == nil {
+			continue
+		}
+		if !s.shouldAdvertise(prefix) {
+			continue
+		}
+		desired[prefix.String()] = prefix
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.prefixes = desired
+	for _, sess := range s.sessions {
+		sess.notify()
+	}
+}
+
+func (s *speaker) shouldAdvertise(prefix *net.IPNet) bool {
+	if len(s.advertiseCIDRs) == 0 {
+		return true
+	}
+	for _, cidr := range s.advertiseCIDRs {
+		if cidr.Contains(prefix.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *speaker) desiredPrefixes() map[string]*net.IPNet {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	copied := make(map[string]*net.IPNet, len(s.prefixes))
+	for k, v := range s.prefixes {
+		copied[k] = v
+	}
+	return copied
+}
+
+// session is the state of the connection to a single peer
+type session struct {
+	speaker *speaker
+	peer    Peer
+	address string
+	changed chan struct{}
+}
+
+func (sess *session) notify() {
+	select {
+	case sess.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (sess *session) run() {
+	backoff := retry.NewSimpleBackoff(time.Second, 2*time.Minute, 0.2, 2)
+	for {
+		select {
+		case <-sess.speaker.stop:
+			return
+		default:
+		}
+		established, err := sess.connect()
+		if err != nil {
+			log.Warnf("bgp: session with peer %s failed: %v", sess.peer, err)
+		}
+		if established {
+			backoff.Reset()
+		}
+		select {
+		case <-sess.speaker.stop:
+			return
+		case <-time.After(backoff.Duration()):
+		}
+	}
+}
+
+// connect runs a single session until it fails. It returns whether the session reached the established state.
+func (sess *session) connect() (bool, error) {
+	conn, err := sess.speaker.dial(sess.address)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to connect")
+	}
+	defer conn.Close()
+
+	holdTime, fourByteASN, err := sess.handshake(conn)
+	if err != nil {
+		return false, err
+	}
+	log.Infof("bgp: session with peer %s established, hold time %ds", sess.peer, holdTime)
+
+	attrs := pathAttributes{
+		localASN:    sess.speaker.localASN,
+		ibgp:        sess.peer.ASN == sess.speaker.localASN,
+		fourByteASN: fourByteASN,
+		nextHop:     sess.speaker.nextHop,
+		communities: sess.speaker.communities,
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if holdTime > 0 {
+				_ = conn.SetReadDeadline(time.Now().Add(time.Duration(holdTime) * time.Second))
+			}
+			msg, err := readMessage(conn)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if msg.msgType == msgTypeNotification {
+				readErr <- errors.Errorf("received notification %v", msg.body)
+				return
+			}
+			// Updates from the peer are ignored, this speaker does not import any routes
+		}
+	}()
+
+	var keepalive <-chan time.Time
+	if holdTime > 0 {
+		ticker := time.NewTicker(time.Duration(holdTime) * time.Second / 3)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	advertised := make(map[string]*net.IPNet)
+	sess.notify()
+	for {
+		select {
+		case <-sess.speaker.stop:
+			_, _ = conn.Write(encodeNotification(errCodeCease, 0))
+			return true, nil
+		case err := <-readErr:
+			return true, err
+		case <-keepalive:
+			if _, err := conn.Write(encodeKeepalive()); err != nil {
+				return true, errors.Wrap(err, "failed to send keepalive")
+			}
+		case <-sess.changed:
+			desired := sess.speaker.desiredPrefixes()
+			withdrawn, announced := diffPrefixes(advertised, desired)
+			if len(withdrawn) == 0 && len(announced) == 0 {
+				continue
+			}
+			for _, msg := range encodeUpdates(withdrawn, announced, attrs) {
+				if _, err := conn.Write(msg); err != nil {
+					return true, errors.Wrap(err, "failed to send update")
+				}
+			}
+			log.Debugf("bgp: peer %s: announced %d prefixes, withdrew %d", sess.peer, len(announced), len(withdrawn))
+			advertised = desired
+		}
+	}
+}
+
+// handshake exchanges OPEN and KEEPALIVE messages, returning the negotiated hold time and 4-octet ASN support
+func (sess *session) handshake(conn net.Conn) (uint16, bool, error) {
+	_ = conn.SetDeadline(time.Now().Add(time.Duration(defaultHoldTime) * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(encodeOpen(sess.speaker.localASN, sess.speaker.holdTime, sess.speaker.routerID)); err != nil {
+		return 0, false, errors.Wrap(err, "failed to send OPEN")
+	}
+	msg, err := readMessage(conn)
+	if err != nil {
+		return 0, false, errors.Wrap(err, "failed to read OPEN")
+	}
+	if msg.msgType != msgTypeOpen {
+		return 0, false, errors.Errorf("expected OPEN, got message type %d", msg.msgType)
+	}
+	open, err := decodeOpen(msg.body)
+	if err != nil {
+		return 0, false, err
+	}
+	if open.asn != sess.peer.ASN {
+		_, _ = conn.Write(encodeNotification(errCodeOpen, errSubBadPeer))
+		return 0, false, errors.Errorf("peer announced AS%d, expected AS%d", open.asn, sess.peer.ASN)
+	}
+	if _, err := conn.Write(encodeKeepalive()); err != nil {
+		return 0, false, errors.Wrap(err, "failed to send KEEPALIVE")
+	}
+	msg, err = readMessage(conn)
+	if err != nil {
+		return 0, false, errors.Wrap(err, "failed to read KEEPALIVE")
+	}
+	if msg.msgType != msgTypeKeepalive {
+		return 0, false, errors.Errorf("expected KEEPALIVE, got message type %d", msg.msgType)
+	}
+
+	holdTime := sess.speaker.holdTime
+	if open.holdTime < holdTime {
+		holdTime = open.holdTime
+	}
+	return holdTime, open.fourByteASN, nil
+}
+
+// diffPrefixes returns the prefixes to withdraw and to announce to go from current to desired
+func diffPrefixes(current, desired map[string]*net.IPNet) (withdrawn, announced []*net.IPNet) {
+	for key, prefix := range current {
+		if _, ok := desired[key]; !ok {
+			withdrawn = append(withdrawn, prefix)
+		}
+	}
+	for key, prefix := range desired {
+		if _, ok := current[key]; !ok {
+			announced = append(announced, prefix)
+		}
+	}
+	sortPrefixes(withdrawn)
+	sortPrefixes(announced)
+	return withdrawn, announced
+}
+
+func sortPrefixes(prefixes []*net.IPNet) {
+	sort.Slice(prefixes, func(i, j int) bool {
+		return prefixes[i].String() < prefixes[j].String()
+	})
+}
+
+func parseASN(value string) (uint32, error) {
+	asn, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if asn == 0 {
+		return 0, errors.New("ASN must be greater than 0")
+	}
+	return uint32(asn), nil
+}
+
+func parsePeers(value string) ([]Peer, error) {
+	var peers []Peer
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		sep := strings.LastIndex(item, ":")
+		if sep < 0 {
+			return nil, errors.Errorf("peer %q is not of the form <ipv4>:<asn>", item)
+		}
+		ip := net.ParseIP(item[:sep])
+		if ip == nil || ip.To4() == nil {
+			return nil, errors.Errorf("peer %q does not have a valid IPv4 address", item)
+		}
+		asn, err := parseASN(item[sep+1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "peer %q does not have a valid ASN", item)
+		}
+		peers = append(peers, Peer{Address: ip.To4(), ASN: asn})
+	}
+	return peers, nil
+}
+
+func parseCommunities(value string) ([]uint32, error) {
+	var communities []uint32
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		if len(parts) != 2 {
+			return nil, errors.Errorf("community %q is not of the form <asn>:<value>", item)
+		}
+		high, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil {
+			return nil, errors.Wrapf(err, "community %q", item)
+		}
+		low, err := strconv.ParseUint(parts[1], 10, 16)
+		if err != nil {
+			return nil, errors.Wrapf(err, "community %q", item)
+		}
+		communities = append(communities, uint32(high)<<16|uint32(low))
+	}
+	return communities, nil
+}
+
+func getAdvertiseCIDRs() []*net.IPNet {
+	var cidrs []*net.IPNet
+	for _, item := range strings.Split(os.Getenv(envBGPAdvertiseCIDRs), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(item)
+		if err != nil || cidr.IP.To4() == nil {
+			log.Errorf("getAdvertiseCIDRs : ignoring %v is not a valid IPv4 CIDR", item)
+			continue
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs
+}
+
+func getBoolEnvVar(name string, defaultValue bool) bool {
+	if strValue := os.Getenv(name); strValue != "" {
+		parsedValue, err := strconv.ParseBool(strValue)
+		if err != nil {
+			log.Error("Failed to parse "+name+"; using default: "+fmt.Sprint(defaultValue), err.Error())
+			return defaultValue
+		}
+		return parsedValue
+	}
+	return defaultValue
+}
+
+// GetConfigForDebug returns the active values of the configuration env vars (for debugging purposes).
+func GetConfigForDebug() map[string]interface{} {
+	return map[string]interface{}{
+		envBGPEnabled:        Enabled(),
+		envBGPLocalASN:       os.Getenv(envBGPLocalASN),
+		envBGPPeers:          os.Getenv(envBGPPeers),
+		envBGPCommunities:    os.Getenv(envBGPCommunities),
+		envBGPAdvertiseCIDRs: getAdvertiseCIDRs(),
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	_, cidr, err := net.ParseCIDR(s)
+	assert.NoError(t, err)
+	return cidr
+}
+
+func TestOpenRoundTrip(t *testing.T) {
+	msg, err := readMessage(bytes.NewReader(encodeOpen(4200000000, 90, net.ParseIP("10.0.0.1"))))
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(msgTypeOpen), msg.msgType)
+	// 2 octet AS field carries AS_TRANS for a 4 octet ASN
+	assert.Equal(t, uint16(asTrans), binary.BigEndian.Uint16(msg.body[1:3]))
+
+	open, err := decodeOpen(msg.body)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(4200000000), open.asn)
+	assert.Equal(t, uint16(90), open.holdTime)
+	assert.True(t, open.fourByteASN)
+	assert.Equal(t, "10.0.0.1", open.routerID.String())
+}
+
+func TestReadMessageInvalid(t *testing.T) {
+	buf := encodeKeepalive()
+	buf[0] = 0
+	_, err := readMessage(bytes.NewReader(buf))
+	assert.Error(t, err)
+
+	buf = encodeKeepalive()
+	binary.BigEndian.PutUint16(buf[16:18], maxMsgLen+1)
+	_, err = readMessage(bytes.NewReader(buf))
+	assert.Error(t, err)
+}
+
+func TestEncodeUpdatesChunking(t *testing.T) {
+	var announced []*net.IPNet
+	for i := 0; i < 2000; i++ {
+		announced = append(announced, &net.IPNet{
+			IP:   net.IPv4(10, 1, byte(i>>8), byte(i)).To4(),
+			Mask: net.CIDRMask(32, 32),
+		})
+	}
+	attrs := pathAttributes{localASN: 65001, nextHop: net.ParseIP("10.0.0.1")}
+	msgs := encodeUpdates(nil, announced, attrs)
+	assert.True(t, len(msgs) > 1)
+	for _, m := range msgs {
+		assert.True(t, len(m) <= maxMsgLen)
+	}
+
+	msgs = encodeUpdates([]*net.IPNet{mustCIDR(t, "10.2.0.0/16")}, nil, attrs)
+	assert.Equal(t, 1, len(msgs))
+	// header, withdrawn length 3, /16 prefix, empty attributes
+	assert.Equal(t, []byte{0, 3, 16, 10, 2, 0, 0}, msgs[0][headerLen:])
+}
+
+func TestPathAttributesIBGP(t *testing.T) {
+	attrs := pathAttributes{localASN: 65001, ibgp: true, nextHop: net.ParseIP("10.0.0.1"), communities: []uint32{65001<<16 | 100}}
+	encoded := attrs.encode()
+	// AS_PATH is empty for iBGP
+	assert.True(t, bytes.Contains(encoded, []byte{attrFlagTransitive, attrTypeASPath, 0}))
+	assert.True(t, bytes.Contains(encoded, []byte{attrFlagTransitive, attrTypeLocalPref, 4, 0, 0, 0, defaultLocalPref}))
+	assert.True(t, bytes.Contains(encoded, []byte{attrFlagOptional | attrFlagTransitive, attrTypeCommunities, 4, 0xfd, 0xe9, 0, 100}))
+}
+
+func TestParsePeers(t *testing.T) {
+	peers, err := parsePeers("10.0.0.1:65000, 10.0.0.2:4200000000")
+	assert.NoError(t, err)
+	assert.Equal(t, []Peer{
+		{Address: net.ParseIP("10.0.0.1").To4(), ASN: 65000},
+		{Address: net.ParseIP("10.0.0.2").To4(), ASN: 4200000000},
+	}, peers)
+
+	_, err = parsePeers("10.0.0.1")
+	assert.Error(t, err)
+	_, err = parsePeers("fd00::1:65000")
+	assert.Error(t, err)
+	_, err = parsePeers("10.0.0.1:0")
+	assert.Error(t, err)
+}
+
+func TestParseCommunities(t *testing.T) {
+	communities, err := parseCommunities("65000:100,1:2")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{65000<<16 | 100, 1<<16 | 2}, communities)
+
+	_, err = parseCommunities("65000")
+	assert.Error(t, err)
+	_, err = parseCommunities("70000:1")
+	assert.Error(t, err)
+}
+
+func TestNew(t *testing.T) {
+	_ = os.Setenv(envBGPLocalASN, "65001")
+	_ = os.Setenv(envBGPPeers, "10.0.0.1:65000")
+	_ = os.Setenv(envBGPAdvertiseCIDRs, "10.1.0.0/16,bogus")
+	defer os.Unsetenv(envBGPLocalASN)
+	defer os.Unsetenv(envBGPPeers)
+	defer os.Unsetenv(envBGPAdvertiseCIDRs)
+
+	s, err := New(net.ParseIP("10.0.0.10"))
+	assert.NoError(t, err)
+	sp := s.(*speaker)
+	assert.Equal(t, uint32(65001), sp.localASN)
+	assert.Equal(t, 1, len(sp.advertiseCIDRs))
+
+	sp.SetPrefixes([]*net.IPNet{mustCIDR(t, "10.1.2.3/32"), mustCIDR(t, "10.2.2.3/32")})
+	assert.Equal(t, 1, len(sp.desiredPrefixes()))
+
+	_ = os.Unsetenv(envBGPPeers)
+	_, err = New(net.ParseIP("10.0.0.10"))
+	assert.Error(t, err)
+}
+
+func TestDiffPrefixes(t *testing.T) {
+	a, b, c := mustCIDR(t, "10.0.0.1/32"), mustCIDR(t, "10.0.0.2/32"), mustCIDR(t, "10.0.0.3/32")
+	current := map[string]*net.IPNet{a.String(): a, b.String(): b}
+	desired := map[string]*net.IPNet{b.String(): b, c.String(): c}
+	withdrawn, announced := diffPrefixes(current, desired)
+	assert.Equal(t, []*net.IPNet{a}, withdrawn)
+	assert.Equal(t, []*net.IPNet{c}, announced)
+}
+
+func TestSession(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	s := &speaker{
+		localASN: 65001,
+		routerID: net.ParseIP("10.0.0.10").To4(),
+		nextHop:  net.ParseIP("10.0.0.10").To4(),
+		holdTime: defaultHoldTime,
+		peers:    []Peer{{Address: net.ParseIP("10.0.0.1").To4(), ASN: 65000}},
+		dial: func(address string) (net.Conn, error) {
+			return local, nil
+		},
+		prefixes: make(map[string]*net.IPNet),
+		stop:     make(chan struct{}),
+	}
+	s.SetPrefixes([]*net.IPNet{mustCIDR(t, "10.1.0.5/32")})
+	s.Start()
+	defer s.Stop()
+
+	_ = remote.SetDeadline(time.Now().Add(5 * time.Second))
+	msg, err := readMessage(remote)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(msgTypeOpen), msg.msgType)
+	open, err := decodeOpen(msg.body)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(65001), open.asn)
+
+	_, err = remote.Write(encodeOpen(65000, 30, net.ParseIP("10.0.0.1")))
+	assert.NoError(t, err)
+	msg, err = readMessage(remote)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(msgTypeKeepalive), msg.msgType)
+	_, err = remote.Write(encodeKeepalive())
+	assert.NoError(t, err)
+
+	msg, err = readMessage(remote)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(msgTypeUpdate), msg.msgType)
+	assert.True(t, bytes.HasSuffix(msg.body, []byte{32, 10, 1, 0, 5}))
+
+	s.SetPrefixes(nil)
+	msg, err = readMessage(remote)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(msgTypeUpdate), msg.msgType)
+	assert.Equal(t, []byte{0, 5, 32, 10, 1, 0, 5, 0, 0}, msg.body)
+}
@@ -0,0 +1,290 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// Wire format of the subset of BGP-4 (RFC 4271) needed to advertise IPv4 unicast prefixes.
+const (
+	headerLen  = 19
+	maxMsgLen  = 4096
+	bgpVersion = 4
+
+	msgTypeOpen         = 1
+	msgTypeUpdate       = 2
+	msgTypeNotification = 3
+	msgTypeKeepalive    = 4
+
+	optParamCapabilities = 2
+	capMultiprotocol     = 1
+	capFourOctetASN      = 65
+
+	afiIPv4          = 1
+	safiUnicast      = 1
+	asTrans          = 23456
+	maxTwoOctetASN   = 0xffff
+	defaultLocalPref = 100
+
+	attrFlagOptional   = 0x80
+	attrFlagTransitive = 0x40
+
+	attrTypeOrigin      = 1
+	attrTypeASPath      = 2
+	attrTypeNextHop     = 3
+	attrTypeLocalPref   = 5
+	attrTypeCommunities = 8
+
+	originIGP     = 0
+	asPathSegSeq  = 2
+	errCodeOpen   = 2
+	errSubBadPeer = 2
+	errCodeCease  = 6
+)
+
+type message struct {
+	msgType uint8
+	body    []byte
+}
+
+// openMessage is the decoded content of a BGP OPEN message
+type openMessage struct {
+	asn         uint32
+	holdTime    uint16
+	routerID    net.IP
+	fourByteASN bool
+}
+
+func encodeMessage(msgType uint8, body []byte) []byte {
+	buf := make([]byte, headerLen, headerLen+len(body))
+	for i := 0; i < 16; i++ {
+		buf[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(buf[16:18], uint16(headerLen+len(body)))
+	buf[18] = msgType
+	return append(buf, body...)
+}
+
+func readMessage(r io.Reader) (*message, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	for i := 0; i < 16; i++ {
+		if header[i] != 0xff {
+			return nil, errors.New("bgp: invalid message marker")
+		}
+	}
+	length := int(binary.BigEndian.Uint16(header[16:18]))
+	if length < headerLen || length > maxMsgLen {
+		return nil, errors.Errorf("bgp: invalid message length %d", length)
+	}
+	body := make([]byte, length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &message{msgType: header[18], body: body}, nil
+}
+
+func encodeOpen(asn uint32, holdTime uint16, routerID net.IP) []byte {
+	var body bytes.Buffer
+	body.WriteByte(bgpVersion)
+	myAS := uint16(asTrans)
+	if asn <= maxTwoOctetASN {
+		myAS = uint16(asn)
+	}
+	_ = binary.Write(&body, binary.BigEndian, myAS)
+	_ = binary.Write(&body, binary.BigEndian, holdTime)
+	body.Write(routerID.To4())
+
+	caps := []byte{
+		capMultiprotocol, 4, 0, afiIPv4, 0, safiUnicast,
+		capFourOctetASN, 4, 0, 0, 0, 0,
+	}
+	binary.BigEndian.PutUint32(caps[8:12], asn)
+	body.WriteByte(byte(len(caps) + 2))
+	body.WriteByte(optParamCapabilities)
+	body.WriteByte(byte(len(caps)))
+	body.Write(caps)
+	return encodeMessage(msgTypeOpen, body.Bytes())
+}
+
+func decodeOpen(body []byte) (*openMessage, error) {
+	if len(body) < 10 {
+		return nil, errors.New("bgp: OPEN message too short")
+	}
+	if body[0] != bgpVersion {
+		return nil, errors.Errorf("bgp: unsupported version %d", body[0])
+	}
+	open := &openMessage{
+		asn:      uint32(binary.BigEndian.Uint16(body[1:3])),
+		holdTime: binary.BigEndian.Uint16(body[3:5]),
+		routerID: net.IP(body[5:9]).To4(),
+	}
+	optLen := int(body[9])
+	params := body[10:]
+	if len(params) < optLen {
+		return nil, errors.New("bgp: OPEN optional parameters truncated")
+	}
+	params = params[:optLen]
+	for len(params) >= 2 {
+		paramType, paramLen := params[0], int(params[1])
+		if len(params) < 2+paramLen {
+			return nil, errors.New("bgp: OPEN optional parameter truncated")
+		}
+		value := params[2 : 2+paramLen]
+		params = params[2+paramLen:]
+		if paramType != optParamCapabilities {
+			continue
+		}
+		for len(value) >= 2 {
+			capCode, capLen := value[0], int(value[1])
+			if len(value) < 2+capLen {
+				return nil, errors.New("bgp: OPEN capability truncated")
+			}
+			if capCode == capFourOctetASN && capLen == 4 {
+				open.fourByteASN = true
+				open.asn = binary.BigEndian.Uint32(value[2:6])
+			}
+			value = value[2+capLen:]
+		}
+	}
+	return open, nil
+}
+
+func encodeKeepalive() []byte {
+	return encodeMessage(msgTypeKeepalive, nil)
+}
+
+func encodeNotification(code, subcode uint8) []byte {
+	return encodeMessage(msgTypeNotification, []byte{code, subcode})
+}
+
+// pathAttributes describes the attributes attached to every prefix we announce
+type pathAttributes struct {
+	localASN    uint32
+	ibgp        bool
+	fourByteASN bool
+	nextHop     net.IP
+	communities []uint32
+}
+
+func (p pathAttributes) encode() []byte {
+	var buf bytes.Buffer
+	writeAttr := func(flags, attrType uint8, value []byte) {
+		buf.WriteByte(flags)
+		buf.WriteByte(attrType)
+		buf.WriteByte(byte(len(value)))
+		buf.Write(value)
+	}
+
+	writeAttr(attrFlagTransitive, attrTypeOrigin, []byte{originIGP})
+
+	var asPath []byte
+	if !p.ibgp {
+		// eBGP peers expect our ASN prepended to the path
+		asPath = []byte{asPathSegSeq, 1}
+		if p.fourByteASN {
+			asn := make([]byte, 4)
+			binary.BigEndian.PutUint32(asn, p.localASN)
+			asPath = append(asPath, asn...)
+		} else {
+			asn := make([]byte, 2)
+			localASN := uint16(asTrans)
+			if p.localASN <= maxTwoOctetASN {
+				localASN = uint16(p.localASN)
+			}
+			binary.BigEndian.PutUint16(asn, localASN)
+			asPath = append(asPath, asn...)
+		}
+	}
+	writeAttr(attrFlagTransitive, attrTypeASPath, asPath)
+	writeAttr(attrFlagTransitive, attrTypeNextHop, p.nextHop.To4())
+
+	if p.ibgp {
+		localPref := make([]byte, 4)
+		binary.BigEndian.PutUint32(localPref, defaultLocalPref)
+		writeAttr(attrFlagTransitive, attrTypeLocalPref, localPref)
+	}
+
+	if len(p.communities) > 0 {
+		communities := make([]byte, 4*len(p.communities))
+		for i, c := range p.communities {
+			binary.BigEndian.PutUint32(communities[4*i:], c)
+		}
+		writeAttr(attrFlagOptional|attrFlagTransitive, attrTypeCommunities, communities)
+	}
+	return buf.Bytes()
+}
+
+func encodePrefix(prefix *net.IPNet) []byte {
+	ones, _ := prefix.Mask.Size()
+	octets := (ones + 7) / 8
+	return append([]byte{byte(ones)}, prefix.IP.To4()[:octets]...)
+}
+
+// encodeUpdates packs the withdrawn and announced prefixes into as few UPDATE messages as fit within the
+// maximum BGP message size.
+func encodeUpdates(withdrawn, announced []*net.IPNet, attrs pathAttributes) [][]byte {
+	var msgs [][]byte
+	// 2 bytes withdrawn length + 2 bytes attribute length
+	const fixedLen = headerLen + 4
+
+	var wBuf bytes.Buffer
+	for _, prefix := range withdrawn {
+		encoded := encodePrefix(prefix)
+		if fixedLen+wBuf.Len()+len(encoded) > maxMsgLen {
+			msgs = append(msgs, encodeUpdate(wBuf.Bytes(), nil, nil))
+			wBuf.Reset()
+		}
+		wBuf.Write(encoded)
+	}
+	if wBuf.Len() > 0 {
+		msgs = append(msgs, encodeUpdate(wBuf.Bytes(), nil, nil))
+	}
+
+	encodedAttrs := attrs.encode()
+	var nBuf bytes.Buffer
+	for _, prefix := range announced {
+		encoded := encodePrefix(prefix)
+		if fixedLen+len(encodedAttrs)+nBuf.Len()+len(encoded) > maxMsgLen {
+			msgs = append(msgs, encodeUpdate(nil, encodedAttrs, nBuf.Bytes()))
+			nBuf.Reset()
+		}
+		nBuf.Write(encoded)
+	}
+	if nBuf.Len() > 0 {
+		msgs = append(msgs, encodeUpdate(nil, encodedAttrs, nBuf.Bytes()))
+	}
+	return msgs
+}
+
+func encodeUpdate(withdrawn, attrs, nlri []byte) []byte {
+	body := make([]byte, 0, 4+len(withdrawn)+len(attrs)+len(nlri))
+	lenBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(lenBuf, uint16(len(withdrawn)))
+	body = append(body, lenBuf...)
+	body = append(body, withdrawn...)
+	binary.BigEndian.PutUint16(lenBuf, uint16(len(attrs)))
+	body = append(body, lenBuf...)
+	body = append(body, attrs...)
+	body = append(body, nlri...)
+	return encodeMessage(msgTypeUpdate, body)
+}
@@ -0,0 +1,258 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package capabilities probes the features of the kernel and of the networking tools of the node, so that the rules
+// ipamd sets up only use what is available
+package capabilities
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// procRoot is where the proc filesystem of the host is mounted in the aws-node container, which runs in the network
+	// namespace of the host
+	procRoot = "/proc"
+
+	// IptablesModeNFTables is the iptables mode that writes nf_tables rules
+	IptablesModeNFTables = "nf_tables"
+	// IptablesModeLegacy is the iptables mode that writes x_tables rules
+	IptablesModeLegacy = "legacy"
+)
+
+// conntrackModulePrefixes are the prefixes of the names of the modules reported in ConntrackModules
+var conntrackModulePrefixes = []string{"nf_conntrack", "nf_nat", "xt_conntrack", "xt_connmark", "xt_CONNMARK"}
+
+// iptablesVersionRegexp matches the output of iptables --version, e.g. "iptables v1.8.4 (nf_tables)"
+var iptablesVersionRegexp = regexp.MustCompile(`v([0-9.]+)(?: \(([a-z_]+)\))?`)
+
+var (
+	// Enabled reports which capabilities the node has, by capability
+	Enabled = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "awscni_capability_enabled",
+			Help: "Whether the node has a capability, 1 if it does",
+		},
+		[]string{"capability"},
+	)
+	// NodeInfo reports the versions of the kernel and of iptables
+	NodeInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "awscni_node_info",
+			Help: "The versions of the kernel and of iptables of the node, always 1",
+		},
+		[]string{"kernel_version", "iptables_version", "iptables_mode"},
+	)
+)
+
+// Capabilities are the features of the node
+type Capabilities struct {
+	// KernelVersion is the release of the kernel, e.g. "4.14.146-119.123.amzn2.x86_64"
+	KernelVersion string
+	// IptablesVersion is the version of iptables, e.g. "1.8.4", empty if iptables could not be run
+	IptablesVersion string
+	// IptablesMode is IptablesModeNFTables or IptablesModeLegacy
+	IptablesMode string
+	// IptablesRandomFully is whether iptables supports the --random-fully option of the SNAT target
+	IptablesRandomFully bool
+	// NftPresent is whether the nft command is installed
+	NftPresent bool
+	// IPv6Enabled is whether IPv6 is enabled on the node
+	IPv6Enabled bool
+	// ConntrackModules are the loaded connection tracking and NAT modules. Modules built into the kernel are not listed.
+	ConntrackModules []string
+}
+
+// prober probes the capabilities, its fields are replaced in tests
+type prober struct {
+	procRoot       string
+	uname          func() (string, error)
+	iptablesPath   func() (string, error)
+	runCommand     func(name string, args ...string) ([]byte, error)
+	hasRandomFully func() (bool, error)
+	lookPath       func(file string) (string, error)
+}
+
+var (
+	once   sync.Once
+	probed Capabilities
+)
+
+// Get probes the capabilities of the node the first time it is called, then logs them and sets the metrics. The
+// following calls return the same capabilities.
+func Get() Capabilities {
+	once.Do(func() {
+		probed = newProber().probe()
+		log.Infof("Node capabilities: %+v", probed)
+		setMetrics(probed)
+	})
+	return probed
+}
+
+// Set makes Get return the given capabilities instead of probing them, e.g. the ones probed when the AMI of the node
+// was built. It returns false if Get was already called.
+func Set(c Capabilities) bool {
+	set := false
+	once.Do(func() {
+		probed = c
+		set = true
+		log.Infof("Node capabilities, not probed: %+v", probed)
+		setMetrics(probed)
+	})
+	return set
+}
+
+// KernelVersion returns the release of the kernel
+func KernelVersion() (string, error) {
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return "", err
+	}
+	return string(bytes.TrimRight(uname.Release[:], "\x00")), nil
+}
+
+// IptablesFingerprint identifies the iptables binary by its resolved path, size and modification time, which change
+// whenever iptables is replaced, so that it tells whether capabilities probed earlier still hold
+func IptablesFingerprint() (string, error) {
+	path, err := exec.LookPath("iptables")
+	if err != nil {
+		return "", err
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d:%d", path, info.Size(), info.ModTime().Unix()), nil
+}
+
+func newProber() *prober {
+	return &prober{
+		procRoot: procRoot,
+		uname:    KernelVersion,
+		iptablesPath: func() (string, error) {
+			return exec.LookPath("iptables")
+		},
+		runCommand: func(name string, args ...string) ([]byte, error) {
+			return exec.Command(name, args...).CombinedOutput()
+		},
+		hasRandomFully: func() (bool, error) {
+			ipt, err := iptables.New()
+			if err != nil {
+				return false, err
+			}
+			return ipt.HasRandomFully(), nil
+		},
+		lookPath: exec.LookPath,
+	}
+}
+
+func (p *prober) probe() Capabilities {
+	var c Capabilities
+	var err error
+	if c.KernelVersion, err = p.uname(); err != nil {
+		log.Warnf("Failed to get the kernel version: %v", err)
+	}
+
+	if path, err := p.iptablesPath(); err != nil {
+		log.Warnf("Failed to find iptables: %v", err)
+	} else if output, err := p.runCommand(path, "--version"); err != nil {
+		log.Warnf("Failed to get the iptables version: %v", err)
+	} else {
+		c.IptablesVersion, c.IptablesMode = parseIptablesVersion(string(output))
+	}
+	if c.IptablesRandomFully, err = p.hasRandomFully(); err != nil {
+		log.Warnf("Failed to check whether iptables supports --random-fully: %v", err)
+	}
+	_, err = p.lookPath("nft")
+	c.NftPresent = err == nil
+
+	disableIPv6, err := ioutil.ReadFile(filepath.Join(p.procRoot, "sys", "net", "ipv6", "conf", "all", "disable_ipv6"))
+	c.IPv6Enabled = err == nil && strings.TrimSpace(string(disableIPv6)) == "0"
+
+	if modules, err := ioutil.ReadFile(filepath.Join(p.procRoot, "modules")); err != nil {
+		log.Warnf("Failed to list the kernel modules: %v", err)
+	} else {
+		c.ConntrackModules = parseConntrackModules(string(modules))
+	}
+	return c
+}
+
+// parseIptablesVersion returns the version and mode of iptables from the output of iptables --version. Versions before
+// 1.8 only have the legacy mode and do not print it.
+func parseIptablesVersion(output string) (version, mode string) {
+	match := iptablesVersionRegexp.FindStringSubmatch(output)
+	if match == nil {
+		return "", ""
+	}
+	mode = match[2]
+	if mode == "" {
+		mode = IptablesModeLegacy
+	}
+	return match[1], mode
+}
+
+// parseConntrackModules returns the sorted names of the connection tracking modules listed in /proc/modules
+func parseConntrackModules(modules string) []string {
+	var names []string
+	scanner := bufio.NewScanner(strings.NewReader(modules))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		for _, prefix := range conntrackModulePrefixes {
+			if strings.HasPrefix(fields[0], prefix) {
+				names = append(names, fields[0])
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func setMetrics(c Capabilities) {
+	Enabled.WithLabelValues("iptables_random_fully").Set(boolToFloat(c.IptablesRandomFully))
+	Enabled.WithLabelValues("iptables_nf_tables").Set(boolToFloat(c.IptablesMode == IptablesModeNFTables))
+	Enabled.WithLabelValues("nft").Set(boolToFloat(c.NftPresent))
+	Enabled.WithLabelValues("ipv6").Set(boolToFloat(c.IPv6Enabled))
+	for _, module := range c.ConntrackModules {
+		Enabled.WithLabelValues("module_" + module).Set(1)
+	}
+	NodeInfo.WithLabelValues(c.KernelVersion, c.IptablesVersion, c.IptablesMode).Set(1)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
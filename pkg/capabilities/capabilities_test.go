@@ -0,0 +1,90 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package capabilities
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIptablesVersion(t *testing.T) {
+	version, mode := parseIptablesVersion("iptables v1.8.4 (nf_tables)\n")
+	assert.Equal(t, "1.8.4", version)
+	assert.Equal(t, IptablesModeNFTables, mode)
+
+	version, mode = parseIptablesVersion("iptables v1.8.2 (legacy)\n")
+	assert.Equal(t, "1.8.2", version)
+	assert.Equal(t, IptablesModeLegacy, mode)
+
+	// Before 1.8
+	version, mode = parseIptablesVersion("iptables v1.6.2\n")
+	assert.Equal(t, "1.6.2", version)
+	assert.Equal(t, IptablesModeLegacy, mode)
+
+	version, mode = parseIptablesVersion("command not found")
+	assert.Equal(t, "", version)
+	assert.Equal(t, "", mode)
+}
+
+func TestProbe(t *testing.T) {
+	root, err := ioutil.TempDir("", "proc")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	ipv6Dir := filepath.Join(root, "sys", "net", "ipv6", "conf", "all")
+	assert.NoError(t, os.MkdirAll(ipv6Dir, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(ipv6Dir, "disable_ipv6"), []byte("0\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "modules"), []byte(
+		"xt_nat 16384 2 - Live 0x0000000000000000\n"+
+			"nf_nat_ipv4 16384 1 iptable_nat, Live 0x0000000000000000\n"+
+			"nf_conntrack 135168 5 xt_nat,nf_nat_ipv4, Live 0x0000000000000000\n"+
+			"ena 94208 0 - Live 0x0000000000000000\n"), 0644))
+
+	p := &prober{
+		procRoot: root,
+		uname:    func() (string, error) { return "4.14.146-119.123.amzn2.x86_64", nil },
+		iptablesPath: func() (string, error) {
+			return "/usr/sbin/iptables", nil
+		},
+		runCommand: func(name string, args ...string) ([]byte, error) {
+			return []byte("iptables v1.8.4 (nf_tables)\n"), nil
+		},
+		hasRandomFully: func() (bool, error) { return true, nil },
+		lookPath:       func(file string) (string, error) { return "", errors.New("not found") },
+	}
+	assert.Equal(t, Capabilities{
+		KernelVersion:       "4.14.146-119.123.amzn2.x86_64",
+		IptablesVersion:     "1.8.4",
+		IptablesMode:        IptablesModeNFTables,
+		IptablesRandomFully: true,
+		IPv6Enabled:         true,
+		ConntrackModules:    []string{"nf_conntrack", "nf_nat_ipv4"},
+	}, p.probe())
+
+	// Nothing is available
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(ipv6Dir, "disable_ipv6"), []byte("1\n"), 0644))
+	assert.NoError(t, os.Remove(filepath.Join(root, "modules")))
+	p.iptablesPath = func() (string, error) { return "", errors.New("not found") }
+	p.hasRandomFully = func() (bool, error) { return false, errors.New("not found") }
+	p.lookPath = func(file string) (string, error) { return "/usr/sbin/nft", nil }
+	assert.Equal(t, Capabilities{
+		KernelVersion: "4.14.146-119.123.amzn2.x86_64",
+		NftPresent:    true,
+	}, p.probe())
+}
@@ -0,0 +1,471 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package clusterconfig applies the configuration held by a ClusterCNIConfig to aws-node
+package clusterconfig
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/operator-framework/operator-sdk/pkg/k8sclient"
+	"github.com/operator-framework/operator-sdk/pkg/sdk"
+	sdkK8sutil "github.com/operator-framework/operator-sdk/pkg/util/k8sutil"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/apis/crd/v1alpha1"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/networkutils"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/platform"
+)
+
+const (
+	// envClusterConfig is the name of the environment variable that sets the name of the ClusterCNIConfig that aws-node
+	// applies. Its environment variables override the ones of the DaemonSet, and the node profiles. When it is not set,
+	// no ClusterCNIConfig is used.
+	envClusterConfig = "AWS_VPC_K8S_CNI_CLUSTER_CONFIG"
+
+	// NodeStatusAnnotation is the annotation of a node that reports the configuration it applied from the
+	// ClusterCNIConfig, as a ClusterCNIConfigNodeStatus
+	NodeStatusAnnotation = "vpc.amazonaws.com/cluster-cni-config"
+
+	// resyncPeriod is how often the ClusterCNIConfig is applied again while it does not change, which picks up the
+	// changes of the labels of the node
+	resyncPeriod = 5 * time.Minute
+
+	// retryInterval is how long it takes to apply the ClusterCNIConfig again after it failed to
+	retryInterval = 30 * time.Second
+
+	// observationInterval is how often the errors of ipamd are checked after the node applied dataplane settings
+	observationInterval = 30 * time.Second
+
+	// maxConflicts is how many times a failed node is counted again in the status of the ClusterCNIConfig when other
+	// nodes updated it at the same time
+	maxConflicts = 5
+)
+
+// client gets ClusterCNIConfigs from the API server and patches their status
+type client interface {
+	get(name string) (*v1alpha1.ClusterCNIConfig, error)
+	patch(name string, patch []byte) error
+}
+
+type sdkClient struct{}
+
+func newClusterCNIConfig(name string) *v1alpha1.ClusterCNIConfig {
+	return &v1alpha1.ClusterCNIConfig{
+		TypeMeta:   metav1.TypeMeta{Kind: "ClusterCNIConfig", APIVersion: v1alpha1.SchemeGroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+	}
+}
+
+func (sdkClient) get(name string) (*v1alpha1.ClusterCNIConfig, error) {
+	config := newClusterCNIConfig(name)
+	if err := sdk.Get(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (sdkClient) patch(name string, patch []byte) error {
+	return sdk.Patch(newClusterCNIConfig(name), types.MergePatchType, patch)
+}
+
+// newInformer returns an informer of the ClusterCNIConfig with the given name only
+func newInformer(name string, handler cache.ResourceEventHandler) (cache.Store, cache.Controller, error) {
+	resourceClient, _, err := k8sclient.GetResourceClient(v1alpha1.SchemeGroupVersion.String(), "ClusterCNIConfig", "")
+	if err != nil {
+		return nil, nil, err
+	}
+	selector := fields.OneTermEqualSelector("metadata.name", name).String()
+	listWatch := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return resourceClient.List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return resourceClient.Watch(options)
+		},
+	}
+	store, informer := cache.NewInformer(listWatch, &unstructured.Unstructured{}, resyncPeriod, handler)
+	return store, informer, nil
+}
+
+// Controller applies a ClusterCNIConfig to the environment of aws-node and reports it in an annotation of the node
+type Controller struct {
+	name       string
+	myNodeName string
+	k8sClient  k8sapi.K8SAPIs
+	client     client
+	// store caches the ClusterCNIConfig once it is watched
+	store cache.Store
+
+	lock sync.Mutex
+	// env is the environment applied from the ClusterCNIConfig
+	env map[string]string
+	// defaults are the values the applied environment variables had before, nil when they were not set
+	defaults map[string]*string
+	// configured is set while the ClusterCNIConfig exists, and status is the status of the node to report then
+	configured bool
+	status     v1alpha1.ClusterCNIConfigNodeStatus
+	// reported is the status of the node last reported in its annotation, read from it once after a restart
+	reported       v1alpha1.ClusterCNIConfigNodeStatus
+	reportedLoaded bool
+	// counted is the dataplane settings the node is counted as failed with in the status of the ClusterCNIConfig
+	counted string
+	// observation watches the errors of ipamd after dataplane settings were applied
+	observation *dataplaneObservation
+	maxErrors   int
+	errorCount  func() float64
+}
+
+// Enabled returns whether a ClusterCNIConfig is configured
+func Enabled() bool {
+	return os.Getenv(envClusterConfig) != ""
+}
+
+// New creates a controller of the ClusterCNIConfig configured for aws-node
+func New(k8sClient k8sapi.K8SAPIs) *Controller {
+	return &Controller{
+		name:       os.Getenv(envClusterConfig),
+		myNodeName: os.Getenv("MY_NODE_NAME"),
+		k8sClient:  k8sClient,
+		client:     sdkClient{},
+		defaults:   make(map[string]*string),
+		errorCount: ipamdErrorCount,
+	}
+}
+
+// nodeEnv returns the environment a ClusterCNIConfig sets on a node with the given labels, and the name of the override
+// that applies to it
+func nodeEnv(spec *v1alpha1.ClusterCNIConfigSpec, nodeLabels map[string]string) (map[string]string, string) {
+	env := make(map[string]string)
+	for name, value := range spec.Env {
+		env[name] = value
+	}
+	for _, override := range spec.Overrides {
+		if !matches(override.NodeSelector, nodeLabels) {
+			continue
+		}
+		for name, value := range override.Env {
+			env[name] = value
+		}
+		return env, override.Name
+	}
+	return env, ""
+}
+
+func matches(nodeSelector, nodeLabels map[string]string) bool {
+	for key, value := range nodeSelector {
+		if nodeLabel, ok := nodeLabels[key]; !ok || nodeLabel != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Sync applies the current ClusterCNIConfig to the environment, and returns whether the environment changed, and
+// whether dataplane settings changed, which only take effect when ipamd restarts. A ClusterCNIConfig that does not exist
+// sets no environment variable, and one that sets settings the platform does not implement is not applied.
+func (c *Controller) Sync() (bool, bool, error) {
+	config, err := c.getConfig()
+	if err != nil {
+		return false, false, errors.Wrapf(err, "failed to get ClusterCNIConfig %s", c.name)
+	}
+	var spec v1alpha1.ClusterCNIConfigSpec
+	if config != nil {
+		spec = config.Spec
+	}
+	nodeLabels, err := c.k8sClient.K8SGetNodeLabels()
+	if err != nil {
+		return false, false, errors.Wrapf(err, "failed to apply ClusterCNIConfig %s", c.name)
+	}
+	env, override := nodeEnv(&spec, nodeLabels)
+	if err := platform.Current.Validate(env); err != nil {
+		return false, false, errors.Wrapf(err, "failed to apply ClusterCNIConfig %s", c.name)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Changes of the dataplane settings only apply to the nodes selected by the rollout, until it is halted
+	dataplane := dataplaneEnv(env)
+	dataplaneChanged := !reflect.DeepEqual(dataplane, dataplaneEnv(c.env))
+	if dataplaneChanged && config != nil &&
+		(!inRollout(spec.Rollout, c.myNodeName, nodeLabels) || rolloutHalted(config, dataplaneID(dataplane))) {
+		for _, name := range networkutils.DataplaneSettings {
+			if value, ok := c.env[name]; ok {
+				env[name] = value
+			} else {
+				delete(env, name)
+			}
+		}
+		dataplane = dataplaneEnv(env)
+		dataplaneChanged = false
+	}
+
+	changed := !reflect.DeepEqual(env, c.env)
+	if changed {
+		if err := c.setEnv(env); err != nil {
+			return false, false, errors.Wrapf(err, "failed to apply ClusterCNIConfig %s", c.name)
+		}
+	}
+	if dataplaneChanged {
+		c.observation = &dataplaneObservation{
+			dataplane: dataplaneID(dataplane),
+			since:     time.Now(),
+			baseline:  c.errorCount(),
+		}
+		// A node that restarts after it failed with the dataplane settings stays failed, and is not counted again
+		if reported := c.lastReported(); reported.Failed && reported.Dataplane == c.observation.dataplane {
+			c.observation.failed = true
+			c.counted = reported.Dataplane
+		}
+	}
+	c.maxErrors = defaultMaxErrors
+	if spec.Rollout != nil && spec.Rollout.MaxErrors > 0 {
+		c.maxErrors = spec.Rollout.MaxErrors
+	}
+	c.observation.observe(c.errorCount(), c.maxErrors)
+
+	c.configured = config != nil
+	if c.configured {
+		c.status = v1alpha1.ClusterCNIConfigNodeStatus{
+			Generation: config.Generation,
+			Override:   override,
+			Dataplane:  dataplaneID(dataplane),
+			Failed:     c.observation != nil && c.observation.failed,
+		}
+		c.report()
+	}
+	return changed, dataplaneChanged, nil
+}
+
+// getConfig returns the ClusterCNIConfig from the cache of the watch once it runs, and from the API server before. It
+// returns nil if the ClusterCNIConfig does not exist.
+func (c *Controller) getConfig() (*v1alpha1.ClusterCNIConfig, error) {
+	if c.store == nil {
+		config, err := c.client.get(c.name)
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return config, err
+	}
+	obj, exists, err := c.store.GetByKey(c.name)
+	if err != nil || !exists {
+		return nil, err
+	}
+	config := newClusterCNIConfig(c.name)
+	if err := sdkK8sutil.UnstructuredIntoRuntimeObject(obj.(*unstructured.Unstructured), config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// setEnv sets the environment variables of env, and restores the previous values of the ones that are no longer in it
+func (c *Controller) setEnv(env map[string]string) error {
+	for name := range c.env {
+		if _, ok := env[name]; ok {
+			continue
+		}
+		log.Infof("ClusterCNIConfig %s no longer sets %s", c.name, name)
+		var err error
+		if value := c.defaults[name]; value != nil {
+			err = os.Setenv(name, *value)
+		} else {
+			err = os.Unsetenv(name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, saved := c.defaults[name]; !saved {
+			if value, ok := os.LookupEnv(name); ok {
+				c.defaults[name] = &value
+			} else {
+				c.defaults[name] = nil
+			}
+		}
+		if value, ok := os.LookupEnv(name); ok && value == env[name] {
+			continue
+		}
+		log.Infof("ClusterCNIConfig %s sets %s=%s", c.name, name, env[name])
+		if err := os.Setenv(name, env[name]); err != nil {
+			return err
+		}
+	}
+	c.env = env
+	return nil
+}
+
+// lastReported returns the status last reported by the node, which is read from the annotation of the node the first
+// time after a restart
+func (c *Controller) lastReported() v1alpha1.ClusterCNIConfigNodeStatus {
+	if c.reportedLoaded {
+		return c.reported
+	}
+	annotations, err := c.k8sClient.K8SGetNodeAnnotations()
+	if err != nil {
+		log.Warnf("Failed to read the status of ClusterCNIConfig %s reported by the node: %v", c.name, err)
+		return c.reported
+	}
+	c.reportedLoaded = true
+	if value, ok := annotations[NodeStatusAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &c.reported); err != nil {
+			log.Warnf("Ignoring the invalid status of ClusterCNIConfig %s reported by the node: %v", c.name, err)
+		}
+	}
+	return c.reported
+}
+
+// report records the configuration applied by the node in its annotation when it changed, and counts the node in the
+// status of the ClusterCNIConfig when it failed with the dataplane settings. Whatever fails to be reported is reported
+// again on the next sync.
+func (c *Controller) report() {
+	if c.status.Failed && c.counted != c.status.Dataplane {
+		if err := c.reportFailure(c.status.Dataplane); err != nil {
+			log.Warnf("Failed to report the failure of the node in ClusterCNIConfig %s: %v", c.name, err)
+			return
+		}
+		c.counted = c.status.Dataplane
+	}
+	if c.status == c.reported {
+		return
+	}
+	status := c.status
+	status.LastApplied = metav1.Now()
+	value, err := json.Marshal(status)
+	if err != nil {
+		log.Warnf("Failed to report the status of ClusterCNIConfig %s: %v", c.name, err)
+		return
+	}
+	if err := c.k8sClient.K8SSetNodeAnnotations(map[string]string{NodeStatusAnnotation: string(value)}); err != nil {
+		log.Warnf("Failed to report the status of ClusterCNIConfig %s: %v", c.name, err)
+		return
+	}
+	c.reported = c.status
+}
+
+// reportFailure adds the node to the count of nodes that failed with the dataplane settings in the status of the
+// ClusterCNIConfig, and drops the counts of other dataplane settings. The count is patched with the resource version it
+// was read at, so that nodes that fail at the same time don't overwrite each other's.
+func (c *Controller) reportFailure(dataplane string) error {
+	for conflicts := 0; ; conflicts++ {
+		config, err := c.client.get(c.name)
+		if err != nil {
+			return err
+		}
+		failedNodes := map[string]interface{}{dataplane: config.Status.FailedNodes[dataplane] + 1}
+		for other := range config.Status.FailedNodes {
+			if other != dataplane {
+				failedNodes[other] = nil
+			}
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{"resourceVersion": config.ResourceVersion},
+			"status":   map[string]interface{}{"failedNodes": failedNodes},
+		})
+		if err != nil {
+			return err
+		}
+		err = c.client.patch(c.name, patch)
+		if !apierrors.IsConflict(err) || conflicts == maxConflicts {
+			return err
+		}
+	}
+}
+
+// observe checks the errors of ipamd after the node applied dataplane settings, and reports it when it fails with them
+func (c *Controller) observe() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.observation.observe(c.errorCount(), c.maxErrors) && c.configured {
+		c.status.Failed = true
+		c.report()
+	}
+}
+
+// Start watches the ClusterCNIConfig and applies it whenever it changes, and every resyncPeriod otherwise. It calls
+// onChange when the environment changed, and restart when dataplane settings changed.
+func (c *Controller) Start(onChange func(), restart func(reason string)) {
+	changes := make(chan struct{}, 1)
+	notify := func(interface{}) {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+	store, informer, err := newInformer(c.name, cache.ResourceEventHandlerFuncs{
+		AddFunc:    notify,
+		UpdateFunc: func(_, obj interface{}) { notify(obj) },
+		DeleteFunc: notify,
+	})
+	if err != nil {
+		log.Errorf("Failed to watch ClusterCNIConfig %s: %v", c.name, err)
+		return
+	}
+	log.Infof("Watching ClusterCNIConfig %s", c.name)
+	go informer.Run(wait.NeverStop)
+	cache.WaitForCacheSync(wait.NeverStop, informer.HasSynced)
+	c.store = store
+
+	ticker := time.NewTicker(observationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-changes:
+			changed, dataplaneChanged, err := c.Sync()
+			if err != nil {
+				log.Errorf("Failed to sync ClusterCNIConfig: %v", err)
+				time.AfterFunc(retryInterval, func() { notify(nil) })
+				continue
+			}
+			if dataplaneChanged {
+				restart("ClusterCNIConfig " + c.name + " changed the dataplane settings")
+			} else if changed {
+				onChange()
+			}
+		case <-ticker.C:
+			c.observe()
+		}
+	}
+}
+
+// GetConfigForDebug returns the active values of the configuration env vars (for debugging purposes).
+func GetConfigForDebug() map[string]interface{} {
+	return map[string]interface{}{
+		envClusterConfig: os.Getenv(envClusterConfig),
+	}
+}
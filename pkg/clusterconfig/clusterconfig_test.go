@@ -0,0 +1,276 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package clusterconfig
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/apis/crd/v1alpha1"
+	mock_k8sapi "github.com/aws/amazon-vpc-cni-k8s/pkg/k8sapi/mocks"
+)
+
+type fakeClient struct {
+	config    *v1alpha1.ClusterCNIConfig
+	err       error
+	conflicts int
+	patches   []map[string]interface{}
+}
+
+func (f *fakeClient) get(name string) (*v1alpha1.ClusterCNIConfig, error) {
+	return f.config, f.err
+}
+
+func (f *fakeClient) patch(name string, patch []byte) error {
+	if f.conflicts > 0 {
+		f.conflicts--
+		return apierrors.NewConflict(schema.GroupResource{Group: "crd.k8s.amazonaws.com", Resource: "clustercniconfigs"},
+			name, errors.New("the object has been modified"))
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(patch, &decoded); err != nil {
+		return err
+	}
+	f.patches = append(f.patches, decoded)
+	return nil
+}
+
+func (f *fakeClient) lastFailedNodes() map[string]interface{} {
+	status := f.patches[len(f.patches)-1]["status"].(map[string]interface{})
+	return status["failedNodes"].(map[string]interface{})
+}
+
+// nodeStatuses records the statuses reported in the annotation of the node
+type nodeStatuses []v1alpha1.ClusterCNIConfigNodeStatus
+
+func (n *nodeStatuses) record(annotations map[string]string) {
+	var status v1alpha1.ClusterCNIConfigNodeStatus
+	_ = json.Unmarshal([]byte(annotations[NodeStatusAnnotation]), &status)
+	*n = append(*n, status)
+}
+
+func (n nodeStatuses) last() v1alpha1.ClusterCNIConfigNodeStatus {
+	return n[len(n)-1]
+}
+
+func TestSync(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockK8S := mock_k8sapi.NewMockK8SAPIs(ctrl)
+
+	_ = os.Setenv("WARM_ENI_TARGET", "1")
+	_ = os.Unsetenv("WARM_IP_TARGET")
+	config := newClusterCNIConfig("default")
+	config.Generation = 1
+	config.Spec = v1alpha1.ClusterCNIConfigSpec{
+		Env: map[string]string{"WARM_ENI_TARGET": "2"},
+		Overrides: []v1alpha1.ClusterCNIConfigOverride{
+			{Name: "gpu", NodeSelector: map[string]string{"accelerator": "gpu"}, Env: map[string]string{"WARM_IP_TARGET": "3"}},
+		},
+	}
+	client := &fakeClient{config: config}
+	c := &Controller{
+		name:       "default",
+		myNodeName: "node-1",
+		k8sClient:  mockK8S,
+		client:     client,
+		defaults:   make(map[string]*string),
+		errorCount: func() float64 { return 0 },
+	}
+	var statuses nodeStatuses
+	mockK8S.EXPECT().K8SSetNodeAnnotations(gomock.Any()).Do(statuses.record).Return(nil).AnyTimes()
+
+	mockK8S.EXPECT().K8SGetNodeLabels().Return(map[string]string{"accelerator": "gpu"}, nil).Times(2)
+	changed, _, err := c.Sync()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "2", os.Getenv("WARM_ENI_TARGET"))
+	assert.Equal(t, "3", os.Getenv("WARM_IP_TARGET"))
+	assert.Equal(t, int64(1), statuses.last().Generation)
+	assert.Equal(t, "gpu", statuses.last().Override)
+
+	// Nothing changed, nothing is reported again, and the ClusterCNIConfig is not written to
+	changed, _, err = c.Sync()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, 1, len(statuses))
+	assert.Empty(t, client.patches)
+
+	// The override no longer matches, WARM_IP_TARGET goes back to unset
+	config.Generation = 2
+	mockK8S.EXPECT().K8SGetNodeLabels().Return(map[string]string{}, nil)
+	changed, _, err = c.Sync()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	_, found := os.LookupEnv("WARM_IP_TARGET")
+	assert.False(t, found)
+	assert.Equal(t, int64(2), statuses.last().Generation)
+
+	// The ClusterCNIConfig is deleted, WARM_ENI_TARGET goes back to the value of the DaemonSet
+	client.config = nil
+	client.err = apierrors.NewNotFound(schema.GroupResource{Group: "crd.k8s.amazonaws.com", Resource: "clustercniconfigs"}, "default")
+	mockK8S.EXPECT().K8SGetNodeLabels().Return(map[string]string{}, nil)
+	changed, _, err = c.Sync()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "1", os.Getenv("WARM_ENI_TARGET"))
+
+	client.err = errors.New("API server error")
+	_, _, err = c.Sync()
+	assert.Error(t, err)
+
+	_ = os.Unsetenv("WARM_ENI_TARGET")
+}
+
+func TestSyncRollout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockK8S := mock_k8sapi.NewMockK8SAPIs(ctrl)
+
+	_ = os.Unsetenv("AWS_VPC_K8S_CNI_CONNMARK")
+	_ = os.Unsetenv("WARM_IP_TARGET")
+	config := newClusterCNIConfig("default")
+	config.Generation = 1
+	config.Spec = v1alpha1.ClusterCNIConfigSpec{
+		Env: map[string]string{"AWS_VPC_K8S_CNI_CONNMARK": "0x100", "WARM_IP_TARGET": "3"},
+		Rollout: &v1alpha1.ClusterCNIConfigRollout{
+			CanarySelector: map[string]string{"canary": "true"},
+			MaxErrors:      5,
+		},
+	}
+	client := &fakeClient{config: config}
+	errorCount := 0.0
+	c := &Controller{
+		name:       "default",
+		myNodeName: "node-1",
+		k8sClient:  mockK8S,
+		client:     client,
+		defaults:   make(map[string]*string),
+		errorCount: func() float64 { return errorCount },
+	}
+	var statuses nodeStatuses
+	mockK8S.EXPECT().K8SSetNodeAnnotations(gomock.Any()).Do(statuses.record).Return(nil).AnyTimes()
+
+	// Not a canary, only the other settings apply
+	mockK8S.EXPECT().K8SGetNodeLabels().Return(map[string]string{}, nil)
+	changed, dataplaneChanged, err := c.Sync()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.False(t, dataplaneChanged)
+	assert.Equal(t, "3", os.Getenv("WARM_IP_TARGET"))
+	_, found := os.LookupEnv("AWS_VPC_K8S_CNI_CONNMARK")
+	assert.False(t, found)
+
+	// Labeled as a canary, the connmark applies and its errors are watched
+	mockK8S.EXPECT().K8SGetNodeLabels().Return(map[string]string{"canary": "true"}, nil)
+	mockK8S.EXPECT().K8SGetNodeAnnotations().Return(map[string]string{}, nil)
+	changed, dataplaneChanged, err = c.Sync()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.True(t, dataplaneChanged)
+	assert.Equal(t, "0x100", os.Getenv("AWS_VPC_K8S_CNI_CONNMARK"))
+	dataplane := dataplaneID(map[string]string{"AWS_VPC_K8S_CNI_CONNMARK": "0x100"})
+	assert.Equal(t, dataplane, statuses.last().Dataplane)
+
+	// The errors are checked between syncs, the node fails and is counted in place of the previous dataplane settings
+	errorCount = 6
+	config.ResourceVersion = "10"
+	config.Status.FailedNodes = map[string]int{"previous": 2}
+	client.conflicts = 1
+	c.observe()
+	assert.True(t, statuses.last().Failed)
+	assert.Equal(t, 1, len(client.patches))
+	assert.Equal(t, map[string]interface{}{dataplane: float64(1), "previous": nil}, client.lastFailedNodes())
+	assert.Equal(t, "10", client.patches[0]["metadata"].(map[string]interface{})["resourceVersion"])
+
+	// The node is only counted once
+	mockK8S.EXPECT().K8SGetNodeLabels().Return(map[string]string{"canary": "true"}, nil)
+	_, dataplaneChanged, err = c.Sync()
+	assert.NoError(t, err)
+	assert.False(t, dataplaneChanged)
+	assert.Equal(t, 1, len(client.patches))
+
+	// The canary failed, the rollout is halted for the other nodes
+	config.Status.FailedNodes = map[string]int{dataplane: 1}
+	config.Spec.Rollout.Percent = 100
+	assert.True(t, rolloutHalted(config, dataplane))
+	assert.True(t, inRollout(config.Spec.Rollout, "node-2", map[string]string{}))
+
+	_ = os.Unsetenv("AWS_VPC_K8S_CNI_CONNMARK")
+	_ = os.Unsetenv("WARM_IP_TARGET")
+}
+
+func TestSyncRolloutRestart(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockK8S := mock_k8sapi.NewMockK8SAPIs(ctrl)
+
+	_ = os.Unsetenv("AWS_VPC_K8S_CNI_CONNMARK")
+	config := newClusterCNIConfig("default")
+	config.Generation = 1
+	config.Spec = v1alpha1.ClusterCNIConfigSpec{Env: map[string]string{"AWS_VPC_K8S_CNI_CONNMARK": "0x100"}}
+	config.Status.FailedNodes = map[string]int{}
+	client := &fakeClient{config: config}
+	c := &Controller{
+		name:       "default",
+		myNodeName: "node-1",
+		k8sClient:  mockK8S,
+		client:     client,
+		defaults:   make(map[string]*string),
+		errorCount: func() float64 { return 0 },
+	}
+
+	// The node failed with the dataplane settings before it restarted
+	dataplane := dataplaneID(map[string]string{"AWS_VPC_K8S_CNI_CONNMARK": "0x100"})
+	reported, _ := json.Marshal(v1alpha1.ClusterCNIConfigNodeStatus{Generation: 1, Dataplane: dataplane, Failed: true})
+	mockK8S.EXPECT().K8SGetNodeLabels().Return(map[string]string{}, nil)
+	mockK8S.EXPECT().K8SGetNodeAnnotations().Return(map[string]string{NodeStatusAnnotation: string(reported)}, nil)
+
+	// It stays failed, which it already reported, and is not counted again
+	_, dataplaneChanged, err := c.Sync()
+	assert.NoError(t, err)
+	assert.True(t, dataplaneChanged)
+	assert.True(t, c.status.Failed)
+	assert.Empty(t, client.patches)
+
+	_ = os.Unsetenv("AWS_VPC_K8S_CNI_CONNMARK")
+}
+
+func TestInRollout(t *testing.T) {
+	assert.True(t, inRollout(nil, "node-1", nil))
+
+	rollout := &v1alpha1.ClusterCNIConfigRollout{Percent: 0}
+	assert.False(t, inRollout(rollout, "node-1", nil))
+
+	// A node selected by a percentage stays selected by a higher one
+	selected := 0
+	for i := 0; i < 1000; i++ {
+		node := "node-" + strconv.Itoa(i)
+		rollout.Percent = 20
+		if inRollout(rollout, node, nil) {
+			selected++
+			rollout.Percent = 50
+			assert.True(t, inRollout(rollout, node, nil))
+		}
+	}
+	assert.InDelta(t, 200, selected, 60)
+}
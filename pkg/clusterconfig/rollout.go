@@ -0,0 +1,136 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package clusterconfig
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/apis/crd/v1alpha1"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/networkutils"
+)
+
+const (
+	defaultMaxFailedNodes = 1
+	defaultMaxErrors      = 10
+
+	// observationPeriod is how long the errors of ipamd are watched after the node applied dataplane settings
+	observationPeriod = 10 * time.Minute
+
+	// ipamdErrorMetric is the metric of the errors of ipamd that tells whether a node fails with dataplane settings
+	ipamdErrorMetric = "awscni_ipamd_error_count"
+)
+
+// dataplaneObservation watches the errors of ipamd after the node applied dataplane settings
+type dataplaneObservation struct {
+	dataplane string
+	since     time.Time
+	baseline  float64
+	failed    bool
+}
+
+// dataplaneEnv returns the dataplane settings of env
+func dataplaneEnv(env map[string]string) map[string]string {
+	dataplane := make(map[string]string)
+	for _, name := range networkutils.DataplaneSettings {
+		if value, ok := env[name]; ok {
+			dataplane[name] = value
+		}
+	}
+	return dataplane
+}
+
+// dataplaneID identifies dataplane settings in the status of a ClusterCNIConfig, empty if there are none
+func dataplaneID(dataplane map[string]string) string {
+	if len(dataplane) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(dataplane))
+	for name := range dataplane {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hash := fnv.New32a()
+	for _, name := range names {
+		_, _ = fmt.Fprintf(hash, "%s=%s\n", name, dataplane[name])
+	}
+	return fmt.Sprintf("%08x", hash.Sum32())
+}
+
+// inRollout returns true if the node is selected to apply a change of the dataplane settings. The percentage of nodes is
+// selected by a hash of the node name, so that a node stays selected when the percentage is increased.
+func inRollout(rollout *v1alpha1.ClusterCNIConfigRollout, nodeName string, nodeLabels map[string]string) bool {
+	if rollout == nil {
+		return true
+	}
+	if len(rollout.CanarySelector) > 0 && matches(rollout.CanarySelector, nodeLabels) {
+		return true
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(nodeName))
+	return int(hash.Sum32()%100) < rollout.Percent
+}
+
+// rolloutHalted returns true if enough nodes failed with the dataplane settings to stop applying them to more nodes
+func rolloutHalted(config *v1alpha1.ClusterCNIConfig, dataplane string) bool {
+	maxFailedNodes := defaultMaxFailedNodes
+	if config.Spec.Rollout != nil && config.Spec.Rollout.MaxFailedNodes > 0 {
+		maxFailedNodes = config.Spec.Rollout.MaxFailedNodes
+	}
+	failed := config.Status.FailedNodes[dataplane]
+	if failed < maxFailedNodes {
+		return false
+	}
+	log.Warnf("Rollout of the dataplane settings %s of ClusterCNIConfig %s is halted, %d nodes failed with them",
+		dataplane, config.Name, failed)
+	return true
+}
+
+// ipamdErrorCount returns the number of errors of ipamd so far
+func ipamdErrorCount() float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		log.Warnf("Failed to gather the metrics of ipamd: %v", err)
+		return 0
+	}
+	count := 0.0
+	for _, family := range families {
+		if family.GetName() != ipamdErrorMetric {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			count += metric.GetCounter().GetValue()
+		}
+	}
+	return count
+}
+
+// observe fails the node with the dataplane settings it applied if the errors of ipamd rose by more than maxErrors
+// within the observation period. It returns true if the node just failed.
+func (o *dataplaneObservation) observe(errorCount float64, maxErrors int) bool {
+	if o == nil || o.failed || time.Since(o.since) > observationPeriod {
+		return false
+	}
+	if errors := errorCount - o.baseline; errors > float64(maxErrors) {
+		log.Errorf("Dataplane settings %s failed, ipamd had %v errors since they were applied", o.dataplane, errors)
+		o.failed = true
+		return true
+	}
+	return false
+}
@@ -14,11 +14,32 @@
 package ec2metadata
 
 import (
-	"github.com/aws/aws-sdk-go/aws"
-	ec2metadatasvc "github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"context"
+	"errors"
+	"io/ioutil"
+	"time"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/retry"
 )
 
+// imdsRetryPolicy is how calls to the instance metadata service are retried, close to the AWS SDK's defaults
+var imdsRetryPolicy = retry.Policy{
+	Name:         "IMDS",
+	InitialDelay: 30 * time.Millisecond,
+	MaxDelay:     30 * time.Second,
+	Multiplier:   2,
+	Jitter:       1,
+	MaxAttempts:  11,
+}
+
+// errCodeEC2Metadata is the code of the errors of the instance metadata service, as the v1 SDK reports them
+const errCodeEC2Metadata = "EC2MetadataError"
+
 // EC2Metadata wraps the methods from the amazon-sdk-go's ec2metadata package
 type EC2Metadata interface {
 	GetMetadata(path string) (string, error)
@@ -27,5 +48,53 @@ type EC2Metadata interface {
 
 // NewEC2Metadata creates a new EC2Metadata object
 func New() EC2Metadata {
-	return ec2metadatasvc.New(session.New(), aws.NewConfig().WithMaxRetries(10))
+	return newClient(retry.NewSDKV2Retryer(imdsRetryPolicy.WithEnvOverrides()))
+}
+
+// NewNoRetry creates an EC2Metadata object that gives up on the first error, for callers that retry on their own
+func NewNoRetry() EC2Metadata {
+	return newClient(awsv2.NopRetryer{})
+}
+
+// client implements EC2Metadata with the instance metadata client of the v2 SDK
+type client struct {
+	imds *imds.Client
+}
+
+func newClient(retryer awsv2.Retryer) *client {
+	return &client{imds: imds.New(imds.Options{Retryer: retryer})}
+}
+
+// GetMetadata returns the value of the metadata at path, e.g. "mac"
+func (c *client) GetMetadata(path string) (string, error) {
+	output, err := c.imds.GetMetadata(context.Background(), &imds.GetMetadataInput{Path: path})
+	if err != nil {
+		return "", toAWSError(err)
+	}
+	defer output.Content.Close()
+	content, err := ioutil.ReadAll(output.Content)
+	if err != nil {
+		return "", awserr.New(errCodeEC2Metadata, "failed to read the metadata", err)
+	}
+	return string(content), nil
+}
+
+// Region returns the region of the instance
+func (c *client) Region() (string, error) {
+	output, err := c.imds.GetRegion(context.Background(), &imds.GetRegionInput{})
+	if err != nil {
+		return "", toAWSError(err)
+	}
+	return output.Region, nil
+}
+
+// toAWSError returns an error of the instance metadata service as the v1 SDK reports it, so that the callers can tell a
+// missing key by the awserr.RequestFailure with the 404 status code
+func toAWSError(err error) error {
+	aerr := awserr.New(errCodeEC2Metadata, "failed to make EC2Metadata request", err)
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) {
+		return awserr.NewRequestFailure(aerr, respErr.HTTPStatusCode(), "")
+	}
+	return aerr
 }
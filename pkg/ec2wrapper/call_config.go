@@ -0,0 +1,97 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ec2wrapper
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// envEndpoint is the name of the environment variable that sets the endpoint of the EC2 API, e.g. a VPC endpoint
+	// or a FIPS endpoint. Only the EC2 client uses it, STS keeps its own endpoint. Defaults to the regional endpoint.
+	envEndpoint = "AWS_VPC_K8S_CNI_EC2_ENDPOINT"
+
+	// envTimeouts is the name of the environment variable that sets the timeout of each EC2 call, retries included,
+	// per operation, e.g. "DescribeInstances=10s,AssignPrivateIpAddresses=5s,*=30s". "*" applies to the operations
+	// not listed. Defaults to no timeout.
+	envTimeouts = "AWS_VPC_K8S_CNI_EC2_TIMEOUTS"
+
+	// anyOperation is the key of the timeout of the operations that are not listed
+	anyOperation = "*"
+)
+
+// callTimeouts maps the name of an EC2 operation to the timeout of its calls
+type callTimeouts map[string]time.Duration
+
+// forOperation returns the timeout of the calls of the operation, 0 if there is none
+func (t callTimeouts) forOperation(name string) time.Duration {
+	if timeout, ok := t[name]; ok {
+		return timeout
+	}
+	return t[anyOperation]
+}
+
+// String formats the timeouts the way AWS_VPC_K8S_CNI_EC2_TIMEOUTS sets them
+func (t callTimeouts) String() string {
+	entries := make([]string, 0, len(t))
+	for name, timeout := range t {
+		entries = append(entries, name+"="+timeout.String())
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+func getEndpoint() string {
+	return strings.TrimSpace(os.Getenv(envEndpoint))
+}
+
+// getTimeouts parses AWS_VPC_K8S_CNI_EC2_TIMEOUTS, skipping the entries that are not valid
+func getTimeouts() callTimeouts {
+	timeouts := callTimeouts{}
+	strValue := os.Getenv(envTimeouts)
+	if strValue == "" {
+		return timeouts
+	}
+	for _, entry := range strings.Split(strValue, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			log.Errorf("Failed to parse %s entry %q, expected <operation>=<timeout>", envTimeouts, entry)
+			continue
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil || timeout <= 0 {
+			log.Errorf("Failed to parse %s entry %q, ignoring the timeout of %s", envTimeouts, entry, parts[0])
+			continue
+		}
+		timeouts[strings.TrimSpace(parts[0])] = timeout
+	}
+	return timeouts
+}
+
+// GetConfigForDebug returns the active values of the configuration env vars (for debugging purposes).
+func GetConfigForDebug() map[string]interface{} {
+	return map[string]interface{}{
+		envEndpoint: getEndpoint(),
+		envTimeouts: getTimeouts().String(),
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ec2wrapper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	ec2svc "github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetTimeouts(t *testing.T) {
+	defer os.Unsetenv(envTimeouts)
+
+	assert.Empty(t, getTimeouts())
+
+	_ = os.Setenv(envTimeouts, "DescribeInstances=10s, AssignPrivateIpAddresses=5s,*=30s,bogus,CreateTags=-1s,=1s,")
+	timeouts := getTimeouts()
+	assert.Equal(t, callTimeouts{
+		"DescribeInstances":        10 * time.Second,
+		"AssignPrivateIpAddresses": 5 * time.Second,
+		anyOperation:               30 * time.Second,
+	}, timeouts)
+	assert.Equal(t, 10*time.Second, timeouts.forOperation("DescribeInstances"))
+	assert.Equal(t, 30*time.Second, timeouts.forOperation("CreateTags"))
+	assert.Equal(t, "*=30s,AssignPrivateIpAddresses=5s,DescribeInstances=10s", timeouts.String())
+	assert.Equal(t, time.Duration(0), callTimeouts{}.forOperation("CreateTags"))
+}
+
+func TestNewWithEndpointAndTimeouts(t *testing.T) {
+	defer os.Unsetenv(envEndpoint)
+	defer os.Unsetenv(envTimeouts)
+
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.FormValue("Action") == "DescribeInstances" {
+			time.Sleep(time.Second)
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		_, _ = w.Write([]byte(`<DescribeNetworkInterfacesResponse></DescribeNetworkInterfacesResponse>`))
+	}))
+	defer server.Close()
+
+	_ = os.Setenv(envEndpoint, server.URL)
+	_ = os.Setenv(envTimeouts, "DescribeInstances=50ms")
+	// The configuration points elsewhere, only the EC2 client uses the endpoint
+	client := New(testConfig("http://127.0.0.1:1", 1))
+
+	_, err := client.DescribeNetworkInterfaces(&ec2svc.DescribeNetworkInterfacesInput{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+
+	start := time.Now()
+	_, err = client.DescribeInstances(&ec2svc.DescribeInstancesInput{})
+	awsErr, ok := err.(awserr.Error)
+	assert.True(t, ok)
+	assert.Equal(t, request.CanceledErrorCode, awsErr.Code())
+	assert.True(t, time.Since(start) < time.Second)
+}
@@ -14,10 +14,18 @@
 package ec2wrapper
 
 import (
+	"context"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	ec2v2 "github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/request"
-	"github.com/aws/aws-sdk-go/aws/session"
 	ec2svc "github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	log "github.com/cihub/seelog"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/faultinjection"
 )
 
 type EC2 interface {
@@ -27,12 +35,169 @@ type EC2 interface {
 	DeleteNetworkInterface(input *ec2svc.DeleteNetworkInterfaceInput) (*ec2svc.DeleteNetworkInterfaceOutput, error)
 	DetachNetworkInterface(input *ec2svc.DetachNetworkInterfaceInput) (*ec2svc.DetachNetworkInterfaceOutput, error)
 	AssignPrivateIpAddresses(input *ec2svc.AssignPrivateIpAddressesInput) (*ec2svc.AssignPrivateIpAddressesOutput, error)
+	AssignIpv6Addresses(input *ec2svc.AssignIpv6AddressesInput) (*ec2svc.AssignIpv6AddressesOutput, error)
 	UnassignPrivateIpAddressesWithContext(ctx aws.Context, input *ec2svc.UnassignPrivateIpAddressesInput, opts ...request.Option) (*ec2svc.UnassignPrivateIpAddressesOutput, error)
+	AssignIpv4Prefixes(input *AssignIpv4PrefixesInput) (*AssignIpv4PrefixesOutput, error)
+	UnassignIpv4Prefixes(input *UnassignIpv4PrefixesInput) (*UnassignIpv4PrefixesOutput, error)
+	AssociateTrunkInterface(input *AssociateTrunkInterfaceInput) (*AssociateTrunkInterfaceOutput, error)
+	DescribeTrunkInterfaceAssociations(input *DescribeTrunkInterfaceAssociationsInput) (*DescribeTrunkInterfaceAssociationsOutput, error)
+	DisassociateTrunkInterface(input *DisassociateTrunkInterfaceInput) (*DisassociateTrunkInterfaceOutput, error)
 	DescribeNetworkInterfaces(input *ec2svc.DescribeNetworkInterfacesInput) (*ec2svc.DescribeNetworkInterfacesOutput, error)
+	DescribeSubnets(input *ec2svc.DescribeSubnetsInput) (*ec2svc.DescribeSubnetsOutput, error)
+	DescribeAddresses(input *ec2svc.DescribeAddressesInput) (*ec2svc.DescribeAddressesOutput, error)
+	AssociateAddress(input *ec2svc.AssociateAddressInput) (*ec2svc.AssociateAddressOutput, error)
+	DisassociateAddress(input *ec2svc.DisassociateAddressInput) (*ec2svc.DisassociateAddressOutput, error)
 	ModifyNetworkInterfaceAttribute(input *ec2svc.ModifyNetworkInterfaceAttributeInput) (*ec2svc.ModifyNetworkInterfaceAttributeOutput, error)
 	CreateTags(input *ec2svc.CreateTagsInput) (*ec2svc.CreateTagsOutput, error)
 }
 
-func New(sess *session.Session) EC2 {
-	return ec2svc.New(sess)
+// ec2Client implements EC2 with the EC2 client of the v2 SDK
+type ec2Client struct {
+	client   *ec2v2.Client
+	timeouts callTimeouts
+}
+
+// New returns an EC2 client made with cfg, with the endpoint and call timeouts set by AWS_VPC_K8S_CNI_EC2_ENDPOINT and
+// AWS_VPC_K8S_CNI_EC2_TIMEOUTS
+func New(cfg awsv2.Config) EC2 {
+	client := ec2v2.NewFromConfig(cfg, func(o *ec2v2.Options) {
+		if endpoint := getEndpoint(); endpoint != "" {
+			log.Infof("Using EC2 endpoint %s", endpoint)
+			o.BaseEndpoint = awsv2.String(endpoint)
+		}
+		if faultinjection.Enabled {
+			o.APIOptions = append(o.APIOptions, addInjectFault)
+		}
+	})
+	timeouts := getTimeouts()
+	if len(timeouts) > 0 {
+		log.Infof("Using EC2 call timeouts %s", timeouts)
+	}
+	return &ec2Client{client: client, timeouts: timeouts}
+}
+
+// addInjectFault fails every attempt of a call with the fault set on the "ec2.<operation>" point, after the retryer so
+// that the faults are retried like the errors of EC2. The error code of the fault is used as the EC2 error code.
+func addInjectFault(stack *middleware.Stack) error {
+	return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("awscni.faultinjection",
+		func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (
+			middleware.FinalizeOutput, middleware.Metadata, error) {
+			if err := faultinjection.Inject(faultinjection.EC2Prefix + middleware.GetOperationName(ctx)); err != nil {
+				if injected, ok := err.(*faultinjection.InjectedError); ok {
+					err = &smithy.GenericAPIError{Code: injected.Message, Message: injected.Error()}
+				}
+				return middleware.FinalizeOutput{}, middleware.Metadata{}, err
+			}
+			return next.HandleFinalize(ctx, in)
+		}), middleware.After)
+}
+
+// invoke makes a call with the v2 SDK for the input and output shapes of the v1 SDK. The timeout of the operation, if
+// any, bounds the call, retries included.
+func invoke[Out, In, V2In, V2Out any](ctx context.Context, c *ec2Client, operation string, input *In,
+	call func(context.Context, *V2In, ...func(*ec2v2.Options)) (*V2Out, error)) (*Out, error) {
+	if timeout := c.timeouts.forOperation(operation); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	v2Input := new(V2In)
+	convertShape(v2Input, input)
+	v2Output, err := call(ctx, v2Input)
+	if err != nil {
+		return nil, toAWSError(err)
+	}
+	output := new(Out)
+	convertShape(output, v2Output)
+	return output, nil
+}
+
+// CreateNetworkInterface calls CreateNetworkInterface
+func (c *ec2Client) CreateNetworkInterface(input *ec2svc.CreateNetworkInterfaceInput) (*ec2svc.CreateNetworkInterfaceOutput, error) {
+	return invoke[ec2svc.CreateNetworkInterfaceOutput](context.Background(), c, "CreateNetworkInterface", input,
+		c.client.CreateNetworkInterface)
+}
+
+// DescribeInstances calls DescribeInstances
+func (c *ec2Client) DescribeInstances(input *ec2svc.DescribeInstancesInput) (*ec2svc.DescribeInstancesOutput, error) {
+	return invoke[ec2svc.DescribeInstancesOutput](context.Background(), c, "DescribeInstances", input,
+		c.client.DescribeInstances)
+}
+
+// AttachNetworkInterface calls AttachNetworkInterface
+func (c *ec2Client) AttachNetworkInterface(input *ec2svc.AttachNetworkInterfaceInput) (*ec2svc.AttachNetworkInterfaceOutput, error) {
+	return invoke[ec2svc.AttachNetworkInterfaceOutput](context.Background(), c, "AttachNetworkInterface", input,
+		c.client.AttachNetworkInterface)
+}
+
+// DeleteNetworkInterface calls DeleteNetworkInterface
+func (c *ec2Client) DeleteNetworkInterface(input *ec2svc.DeleteNetworkInterfaceInput) (*ec2svc.DeleteNetworkInterfaceOutput, error) {
+	return invoke[ec2svc.DeleteNetworkInterfaceOutput](context.Background(), c, "DeleteNetworkInterface", input,
+		c.client.DeleteNetworkInterface)
+}
+
+// DetachNetworkInterface calls DetachNetworkInterface
+func (c *ec2Client) DetachNetworkInterface(input *ec2svc.DetachNetworkInterfaceInput) (*ec2svc.DetachNetworkInterfaceOutput, error) {
+	return invoke[ec2svc.DetachNetworkInterfaceOutput](context.Background(), c, "DetachNetworkInterface", input,
+		c.client.DetachNetworkInterface)
+}
+
+// AssignPrivateIpAddresses calls AssignPrivateIpAddresses
+func (c *ec2Client) AssignPrivateIpAddresses(input *ec2svc.AssignPrivateIpAddressesInput) (*ec2svc.AssignPrivateIpAddressesOutput, error) {
+	return invoke[ec2svc.AssignPrivateIpAddressesOutput](context.Background(), c, "AssignPrivateIpAddresses", input,
+		c.client.AssignPrivateIpAddresses)
+}
+
+// AssignIpv6Addresses calls AssignIpv6Addresses
+func (c *ec2Client) AssignIpv6Addresses(input *ec2svc.AssignIpv6AddressesInput) (*ec2svc.AssignIpv6AddressesOutput, error) {
+	return invoke[ec2svc.AssignIpv6AddressesOutput](context.Background(), c, "AssignIpv6Addresses", input,
+		c.client.AssignIpv6Addresses)
+}
+
+// UnassignPrivateIpAddressesWithContext calls UnassignPrivateIpAddresses with ctx. The request options of the v1 SDK
+// do not apply to the v2 SDK and are ignored.
+func (c *ec2Client) UnassignPrivateIpAddressesWithContext(ctx aws.Context, input *ec2svc.UnassignPrivateIpAddressesInput, opts ...request.Option) (*ec2svc.UnassignPrivateIpAddressesOutput, error) {
+	return invoke[ec2svc.UnassignPrivateIpAddressesOutput](ctx, c, "UnassignPrivateIpAddresses", input,
+		c.client.UnassignPrivateIpAddresses)
+}
+
+// DescribeNetworkInterfaces calls DescribeNetworkInterfaces
+func (c *ec2Client) DescribeNetworkInterfaces(input *ec2svc.DescribeNetworkInterfacesInput) (*ec2svc.DescribeNetworkInterfacesOutput, error) {
+	return invoke[ec2svc.DescribeNetworkInterfacesOutput](context.Background(), c, "DescribeNetworkInterfaces", input,
+		c.client.DescribeNetworkInterfaces)
+}
+
+// DescribeSubnets calls DescribeSubnets
+func (c *ec2Client) DescribeSubnets(input *ec2svc.DescribeSubnetsInput) (*ec2svc.DescribeSubnetsOutput, error) {
+	return invoke[ec2svc.DescribeSubnetsOutput](context.Background(), c, "DescribeSubnets", input,
+		c.client.DescribeSubnets)
+}
+
+// DescribeAddresses calls DescribeAddresses
+func (c *ec2Client) DescribeAddresses(input *ec2svc.DescribeAddressesInput) (*ec2svc.DescribeAddressesOutput, error) {
+	return invoke[ec2svc.DescribeAddressesOutput](context.Background(), c, "DescribeAddresses", input,
+		c.client.DescribeAddresses)
+}
+
+// AssociateAddress calls AssociateAddress
+func (c *ec2Client) AssociateAddress(input *ec2svc.AssociateAddressInput) (*ec2svc.AssociateAddressOutput, error) {
+	return invoke[ec2svc.AssociateAddressOutput](context.Background(), c, "AssociateAddress", input,
+		c.client.AssociateAddress)
+}
+
+// DisassociateAddress calls DisassociateAddress
+func (c *ec2Client) DisassociateAddress(input *ec2svc.DisassociateAddressInput) (*ec2svc.DisassociateAddressOutput, error) {
+	return invoke[ec2svc.DisassociateAddressOutput](context.Background(), c, "DisassociateAddress", input,
+		c.client.DisassociateAddress)
+}
+
+// ModifyNetworkInterfaceAttribute calls ModifyNetworkInterfaceAttribute
+func (c *ec2Client) ModifyNetworkInterfaceAttribute(input *ec2svc.ModifyNetworkInterfaceAttributeInput) (*ec2svc.ModifyNetworkInterfaceAttributeOutput, error) {
+	return invoke[ec2svc.ModifyNetworkInterfaceAttributeOutput](context.Background(), c,
+		"ModifyNetworkInterfaceAttribute", input, c.client.ModifyNetworkInterfaceAttribute)
+}
+
+// CreateTags calls CreateTags
+func (c *ec2Client) CreateTags(input *ec2svc.CreateTagsInput) (*ec2svc.CreateTagsOutput, error) {
+	return invoke[ec2svc.CreateTagsOutput](context.Background(), c, "CreateTags", input, c.client.CreateTags)
 }
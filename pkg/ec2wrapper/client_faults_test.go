@@ -0,0 +1,41 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build faultinjection
+// +build faultinjection
+
+package ec2wrapper
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	ec2svc "github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/faultinjection"
+)
+
+func TestInjectFault(t *testing.T) {
+	defer faultinjection.Clear("")
+
+	client := New(testConfig("http://127.0.0.1:1", 3))
+
+	assert.NoError(t, faultinjection.Set("ec2.*", faultinjection.Fault{Error: "RequestLimitExceeded", Count: 3}))
+	_, err := client.DescribeInstances(&ec2svc.DescribeInstancesInput{})
+	awsErr, ok := err.(awserr.Error)
+	assert.True(t, ok)
+	assert.Equal(t, "RequestLimitExceeded", awsErr.Code())
+	// The throttled request was retried
+	assert.Empty(t, faultinjection.List())
+}
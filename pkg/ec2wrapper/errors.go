@@ -0,0 +1,43 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ec2wrapper
+
+import (
+	"context"
+	"errors"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/smithy-go"
+)
+
+// toAWSError returns the error of a call made with the v2 SDK as the callers of EC2 expect it from the v1 SDK: an
+// awserr.RequestFailure with the EC2 error code, or an awserr.Error with request.CanceledErrorCode if the context of
+// the call is done
+func toAWSError(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		aerr := awserr.New(apiErr.ErrorCode(), apiErr.ErrorMessage(), err)
+		var respErr *awshttp.ResponseError
+		if errors.As(err, &respErr) {
+			return awserr.NewRequestFailure(aerr, respErr.HTTPStatusCode(), respErr.ServiceRequestID())
+		}
+		return aerr
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+	return err
+}
@@ -20,6 +20,7 @@ package mock_ec2wrapper
 import (
 	reflect "reflect"
 
+	ec2wrapper "github.com/aws/amazon-vpc-cni-k8s/pkg/ec2wrapper"
 	aws "github.com/aws/aws-sdk-go/aws"
 	request "github.com/aws/aws-sdk-go/aws/request"
 	ec2 "github.com/aws/aws-sdk-go/service/ec2"
@@ -49,6 +50,32 @@ func (m *MockEC2) EXPECT() *MockEC2MockRecorder {
 	return m.recorder
 }
 
+// AssignIpv4Prefixes mocks base method
+func (m *MockEC2) AssignIpv4Prefixes(arg0 *ec2wrapper.AssignIpv4PrefixesInput) (*ec2wrapper.AssignIpv4PrefixesOutput, error) {
+	ret := m.ctrl.Call(m, "AssignIpv4Prefixes", arg0)
+	ret0, _ := ret[0].(*ec2wrapper.AssignIpv4PrefixesOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AssignIpv4Prefixes indicates an expected call of AssignIpv4Prefixes
+func (mr *MockEC2MockRecorder) AssignIpv4Prefixes(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AssignIpv4Prefixes", reflect.TypeOf((*MockEC2)(nil).AssignIpv4Prefixes), arg0)
+}
+
+// AssignIpv6Addresses mocks base method
+func (m *MockEC2) AssignIpv6Addresses(arg0 *ec2.AssignIpv6AddressesInput) (*ec2.AssignIpv6AddressesOutput, error) {
+	ret := m.ctrl.Call(m, "AssignIpv6Addresses", arg0)
+	ret0, _ := ret[0].(*ec2.AssignIpv6AddressesOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AssignIpv6Addresses indicates an expected call of AssignIpv6Addresses
+func (mr *MockEC2MockRecorder) AssignIpv6Addresses(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AssignIpv6Addresses", reflect.TypeOf((*MockEC2)(nil).AssignIpv6Addresses), arg0)
+}
+
 // AssignPrivateIpAddresses mocks base method
 func (m *MockEC2) AssignPrivateIpAddresses(arg0 *ec2.AssignPrivateIpAddressesInput) (*ec2.AssignPrivateIpAddressesOutput, error) {
 	ret := m.ctrl.Call(m, "AssignPrivateIpAddresses", arg0)
@@ -62,6 +89,32 @@ func (mr *MockEC2MockRecorder) AssignPrivateIpAddresses(arg0 interface{}) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AssignPrivateIpAddresses", reflect.TypeOf((*MockEC2)(nil).AssignPrivateIpAddresses), arg0)
 }
 
+// AssociateAddress mocks base method
+func (m *MockEC2) AssociateAddress(arg0 *ec2.AssociateAddressInput) (*ec2.AssociateAddressOutput, error) {
+	ret := m.ctrl.Call(m, "AssociateAddress", arg0)
+	ret0, _ := ret[0].(*ec2.AssociateAddressOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AssociateAddress indicates an expected call of AssociateAddress
+func (mr *MockEC2MockRecorder) AssociateAddress(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AssociateAddress", reflect.TypeOf((*MockEC2)(nil).AssociateAddress), arg0)
+}
+
+// AssociateTrunkInterface mocks base method
+func (m *MockEC2) AssociateTrunkInterface(arg0 *ec2wrapper.AssociateTrunkInterfaceInput) (*ec2wrapper.AssociateTrunkInterfaceOutput, error) {
+	ret := m.ctrl.Call(m, "AssociateTrunkInterface", arg0)
+	ret0, _ := ret[0].(*ec2wrapper.AssociateTrunkInterfaceOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AssociateTrunkInterface indicates an expected call of AssociateTrunkInterface
+func (mr *MockEC2MockRecorder) AssociateTrunkInterface(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AssociateTrunkInterface", reflect.TypeOf((*MockEC2)(nil).AssociateTrunkInterface), arg0)
+}
+
 // AttachNetworkInterface mocks base method
 func (m *MockEC2) AttachNetworkInterface(arg0 *ec2.AttachNetworkInterfaceInput) (*ec2.AttachNetworkInterfaceOutput, error) {
 	ret := m.ctrl.Call(m, "AttachNetworkInterface", arg0)
@@ -114,6 +167,19 @@ func (mr *MockEC2MockRecorder) DeleteNetworkInterface(arg0 interface{}) *gomock.
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteNetworkInterface", reflect.TypeOf((*MockEC2)(nil).DeleteNetworkInterface), arg0)
 }
 
+// DescribeAddresses mocks base method
+func (m *MockEC2) DescribeAddresses(arg0 *ec2.DescribeAddressesInput) (*ec2.DescribeAddressesOutput, error) {
+	ret := m.ctrl.Call(m, "DescribeAddresses", arg0)
+	ret0, _ := ret[0].(*ec2.DescribeAddressesOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DescribeAddresses indicates an expected call of DescribeAddresses
+func (mr *MockEC2MockRecorder) DescribeAddresses(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DescribeAddresses", reflect.TypeOf((*MockEC2)(nil).DescribeAddresses), arg0)
+}
+
 // DescribeInstances mocks base method
 func (m *MockEC2) DescribeInstances(arg0 *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
 	ret := m.ctrl.Call(m, "DescribeInstances", arg0)
@@ -140,6 +206,32 @@ func (mr *MockEC2MockRecorder) DescribeNetworkInterfaces(arg0 interface{}) *gomo
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DescribeNetworkInterfaces", reflect.TypeOf((*MockEC2)(nil).DescribeNetworkInterfaces), arg0)
 }
 
+// DescribeSubnets mocks base method
+func (m *MockEC2) DescribeSubnets(arg0 *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+	ret := m.ctrl.Call(m, "DescribeSubnets", arg0)
+	ret0, _ := ret[0].(*ec2.DescribeSubnetsOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DescribeSubnets indicates an expected call of DescribeSubnets
+func (mr *MockEC2MockRecorder) DescribeSubnets(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DescribeSubnets", reflect.TypeOf((*MockEC2)(nil).DescribeSubnets), arg0)
+}
+
+// DescribeTrunkInterfaceAssociations mocks base method
+func (m *MockEC2) DescribeTrunkInterfaceAssociations(arg0 *ec2wrapper.DescribeTrunkInterfaceAssociationsInput) (*ec2wrapper.DescribeTrunkInterfaceAssociationsOutput, error) {
+	ret := m.ctrl.Call(m, "DescribeTrunkInterfaceAssociations", arg0)
+	ret0, _ := ret[0].(*ec2wrapper.DescribeTrunkInterfaceAssociationsOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DescribeTrunkInterfaceAssociations indicates an expected call of DescribeTrunkInterfaceAssociations
+func (mr *MockEC2MockRecorder) DescribeTrunkInterfaceAssociations(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DescribeTrunkInterfaceAssociations", reflect.TypeOf((*MockEC2)(nil).DescribeTrunkInterfaceAssociations), arg0)
+}
+
 // DetachNetworkInterface mocks base method
 func (m *MockEC2) DetachNetworkInterface(arg0 *ec2.DetachNetworkInterfaceInput) (*ec2.DetachNetworkInterfaceOutput, error) {
 	ret := m.ctrl.Call(m, "DetachNetworkInterface", arg0)
@@ -153,6 +245,32 @@ func (mr *MockEC2MockRecorder) DetachNetworkInterface(arg0 interface{}) *gomock.
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DetachNetworkInterface", reflect.TypeOf((*MockEC2)(nil).DetachNetworkInterface), arg0)
 }
 
+// DisassociateAddress mocks base method
+func (m *MockEC2) DisassociateAddress(arg0 *ec2.DisassociateAddressInput) (*ec2.DisassociateAddressOutput, error) {
+	ret := m.ctrl.Call(m, "DisassociateAddress", arg0)
+	ret0, _ := ret[0].(*ec2.DisassociateAddressOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DisassociateAddress indicates an expected call of DisassociateAddress
+func (mr *MockEC2MockRecorder) DisassociateAddress(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DisassociateAddress", reflect.TypeOf((*MockEC2)(nil).DisassociateAddress), arg0)
+}
+
+// DisassociateTrunkInterface mocks base method
+func (m *MockEC2) DisassociateTrunkInterface(arg0 *ec2wrapper.DisassociateTrunkInterfaceInput) (*ec2wrapper.DisassociateTrunkInterfaceOutput, error) {
+	ret := m.ctrl.Call(m, "DisassociateTrunkInterface", arg0)
+	ret0, _ := ret[0].(*ec2wrapper.DisassociateTrunkInterfaceOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DisassociateTrunkInterface indicates an expected call of DisassociateTrunkInterface
+func (mr *MockEC2MockRecorder) DisassociateTrunkInterface(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DisassociateTrunkInterface", reflect.TypeOf((*MockEC2)(nil).DisassociateTrunkInterface), arg0)
+}
+
 // ModifyNetworkInterfaceAttribute mocks base method
 func (m *MockEC2) ModifyNetworkInterfaceAttribute(arg0 *ec2.ModifyNetworkInterfaceAttributeInput) (*ec2.ModifyNetworkInterfaceAttributeOutput, error) {
 	ret := m.ctrl.Call(m, "ModifyNetworkInterfaceAttribute", arg0)
@@ -166,6 +284,19 @@ func (mr *MockEC2MockRecorder) ModifyNetworkInterfaceAttribute(arg0 interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ModifyNetworkInterfaceAttribute", reflect.TypeOf((*MockEC2)(nil).ModifyNetworkInterfaceAttribute), arg0)
 }
 
+// UnassignIpv4Prefixes mocks base method
+func (m *MockEC2) UnassignIpv4Prefixes(arg0 *ec2wrapper.UnassignIpv4PrefixesInput) (*ec2wrapper.UnassignIpv4PrefixesOutput, error) {
+	ret := m.ctrl.Call(m, "UnassignIpv4Prefixes", arg0)
+	ret0, _ := ret[0].(*ec2wrapper.UnassignIpv4PrefixesOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UnassignIpv4Prefixes indicates an expected call of UnassignIpv4Prefixes
+func (mr *MockEC2MockRecorder) UnassignIpv4Prefixes(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UnassignIpv4Prefixes", reflect.TypeOf((*MockEC2)(nil).UnassignIpv4Prefixes), arg0)
+}
+
 // UnassignPrivateIpAddressesWithContext mocks base method
 func (m *MockEC2) UnassignPrivateIpAddressesWithContext(arg0 aws.Context, arg1 *ec2.UnassignPrivateIpAddressesInput, arg2 ...request.Option) (*ec2.UnassignPrivateIpAddressesOutput, error) {
 	varargs := []interface{}{arg0, arg1}
@@ -0,0 +1,79 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ec2wrapper
+
+import (
+	"context"
+)
+
+// The v1 SDK predates prefix delegation, so the prefix parameters of AssignPrivateIpAddresses and
+// UnassignPrivateIpAddresses have the shapes below, like the ones of the SDK.
+
+// AssignIpv4PrefixesInput assigns /28 IPv4 prefixes to a network interface
+type AssignIpv4PrefixesInput struct {
+	_ struct{} `type:"structure"`
+
+	// Ipv4PrefixCount is the number of prefixes EC2 picks in the subnet of the network interface
+	Ipv4PrefixCount *int64 `type:"integer"`
+
+	// NetworkInterfaceId is the ID of the network interface
+	NetworkInterfaceId *string `locationName:"networkInterfaceId" type:"string" required:"true"`
+}
+
+// AssignIpv4PrefixesOutput contains the prefixes assigned to the network interface
+type AssignIpv4PrefixesOutput struct {
+	_ struct{} `type:"structure"`
+
+	// AssignedIpv4Prefixes are the prefixes assigned by the call
+	AssignedIpv4Prefixes []*Ipv4PrefixSpecification `locationName:"assignedIpv4PrefixSet" locationNameList:"item" type:"list"`
+
+	// NetworkInterfaceId is the ID of the network interface
+	NetworkInterfaceId *string `locationName:"networkInterfaceId" type:"string"`
+}
+
+// Ipv4PrefixSpecification is an IPv4 prefix of a network interface
+type Ipv4PrefixSpecification struct {
+	_ struct{} `type:"structure"`
+
+	// Ipv4Prefix is the prefix in CIDR notation, like "10.0.0.16/28"
+	Ipv4Prefix *string `locationName:"ipv4Prefix" type:"string"`
+}
+
+// UnassignIpv4PrefixesInput unassigns IPv4 prefixes from a network interface
+type UnassignIpv4PrefixesInput struct {
+	_ struct{} `type:"structure"`
+
+	// Ipv4Prefixes are the prefixes to unassign
+	Ipv4Prefixes []*string `locationName:"Ipv4Prefix" locationNameList:"item" type:"list"`
+
+	// NetworkInterfaceId is the ID of the network interface
+	NetworkInterfaceId *string `locationName:"networkInterfaceId" type:"string" required:"true"`
+}
+
+// UnassignIpv4PrefixesOutput is the empty result of UnassignIpv4Prefixes
+type UnassignIpv4PrefixesOutput struct {
+	_ struct{} `type:"structure"`
+}
+
+// AssignIpv4Prefixes calls AssignPrivateIpAddresses with a number of prefixes
+func (c *ec2Client) AssignIpv4Prefixes(input *AssignIpv4PrefixesInput) (*AssignIpv4PrefixesOutput, error) {
+	return invoke[AssignIpv4PrefixesOutput](context.Background(), c, "AssignPrivateIpAddresses", input,
+		c.client.AssignPrivateIpAddresses)
+}
+
+// UnassignIpv4Prefixes calls UnassignPrivateIpAddresses with prefixes
+func (c *ec2Client) UnassignIpv4Prefixes(input *UnassignIpv4PrefixesInput) (*UnassignIpv4PrefixesOutput, error) {
+	return invoke[UnassignIpv4PrefixesOutput](context.Background(), c, "UnassignPrivateIpAddresses", input,
+		c.client.UnassignPrivateIpAddresses)
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ec2wrapper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIpv4Prefixes(t *testing.T) {
+	var forms []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		forms = append(forms, r.PostForm)
+		w.Header().Set("Content-Type", "text/xml")
+		if r.PostForm.Get("Action") == "AssignPrivateIpAddresses" {
+			_, _ = w.Write([]byte(`<AssignPrivateIpAddressesResponse>
+  <networkInterfaceId>eni-1</networkInterfaceId>
+  <assignedIpv4PrefixSet>
+    <item><ipv4Prefix>10.0.0.16/28</ipv4Prefix></item>
+    <item><ipv4Prefix>10.0.0.32/28</ipv4Prefix></item>
+  </assignedIpv4PrefixSet>
+</AssignPrivateIpAddressesResponse>`))
+			return
+		}
+		_, _ = w.Write([]byte(`<UnassignPrivateIpAddressesResponse></UnassignPrivateIpAddressesResponse>`))
+	}))
+	defer server.Close()
+
+	client := New(testConfig(server.URL, 1))
+
+	output, err := client.AssignIpv4Prefixes(&AssignIpv4PrefixesInput{
+		NetworkInterfaceId: aws.String("eni-1"),
+		Ipv4PrefixCount:    aws.Int64(2),
+	})
+	assert.NoError(t, err)
+	assert.Len(t, output.AssignedIpv4Prefixes, 2)
+	assert.Equal(t, "10.0.0.32/28", aws.StringValue(output.AssignedIpv4Prefixes[1].Ipv4Prefix))
+
+	_, err = client.UnassignIpv4Prefixes(&UnassignIpv4PrefixesInput{
+		NetworkInterfaceId: aws.String("eni-1"),
+		Ipv4Prefixes:       aws.StringSlice([]string{"10.0.0.16/28", "10.0.0.32/28"}),
+	})
+	assert.NoError(t, err)
+
+	assert.Len(t, forms, 2)
+	assert.Equal(t, "eni-1", forms[0].Get("NetworkInterfaceId"))
+	assert.Equal(t, "2", forms[0].Get("Ipv4PrefixCount"))
+	assert.Equal(t, "UnassignPrivateIpAddresses", forms[1].Get("Action"))
+	assert.Equal(t, "10.0.0.16/28", forms[1].Get("Ipv4Prefix.1"))
+	assert.Equal(t, "10.0.0.32/28", forms[1].Get("Ipv4Prefix.2"))
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ec2wrapper
+
+import (
+	"reflect"
+)
+
+// The EC2 interface keeps the shapes of the v1 SDK, which its callers, mocks and fixtures are written with, while the
+// calls are made with the v2 SDK. Both SDKs are generated from the same API model, so a shape has the same field names
+// in both, only their Go types differ: pointers or values, int64 or int32, strings or enum types. convertShape copies
+// the fields of a shape by name between the two.
+
+// convertShape copies the fields of the struct src points to into the struct dst points to. The fields of dst that src
+// does not have are left alone.
+func convertShape(dst, src interface{}) {
+	s := reflect.ValueOf(src)
+	if s.Kind() != reflect.Ptr || s.IsNil() {
+		return
+	}
+	convertValue(reflect.ValueOf(dst).Elem(), s.Elem())
+}
+
+// convertValue copies s into d, allocating the pointers, slices and maps of d as needed
+func convertValue(d, s reflect.Value) {
+	if s.Kind() == reflect.Ptr || s.Kind() == reflect.Interface {
+		if s.IsNil() {
+			return
+		}
+		s = s.Elem()
+	}
+	if d.Kind() == reflect.Ptr {
+		elem := reflect.New(d.Type().Elem())
+		convertValue(elem.Elem(), s)
+		d.Set(elem)
+		return
+	}
+	if s.Type().AssignableTo(d.Type()) {
+		d.Set(s)
+		return
+	}
+	switch d.Kind() {
+	case reflect.String:
+		if s.Kind() == reflect.String {
+			d.SetString(s.String())
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if isInt(s.Kind()) {
+			d.SetInt(s.Int())
+		}
+	case reflect.Float32, reflect.Float64:
+		if s.Kind() == reflect.Float32 || s.Kind() == reflect.Float64 {
+			d.SetFloat(s.Float())
+		}
+	case reflect.Bool:
+		if s.Kind() == reflect.Bool {
+			d.SetBool(s.Bool())
+		}
+	case reflect.Slice:
+		if s.Kind() != reflect.Slice || s.IsNil() {
+			return
+		}
+		slice := reflect.MakeSlice(d.Type(), s.Len(), s.Len())
+		for i := 0; i < s.Len(); i++ {
+			convertValue(slice.Index(i), s.Index(i))
+		}
+		d.Set(slice)
+	case reflect.Map:
+		if s.Kind() != reflect.Map || s.IsNil() {
+			return
+		}
+		m := reflect.MakeMapWithSize(d.Type(), s.Len())
+		iter := s.MapRange()
+		for iter.Next() {
+			key := reflect.New(d.Type().Key()).Elem()
+			convertValue(key, iter.Key())
+			value := reflect.New(d.Type().Elem()).Elem()
+			convertValue(value, iter.Value())
+			m.SetMapIndex(key, value)
+		}
+		d.Set(m)
+	case reflect.Struct:
+		if s.Kind() != reflect.Struct {
+			return
+		}
+		for i := 0; i < d.NumField(); i++ {
+			field := d.Type().Field(i)
+			if field.PkgPath != "" {
+				// Unexported, like the "_" of the v1 shapes
+				continue
+			}
+			if sField := s.FieldByName(field.Name); sField.IsValid() {
+				convertValue(d.Field(i), sField)
+			}
+		}
+	}
+}
+
+func isInt(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
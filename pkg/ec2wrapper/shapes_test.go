@@ -0,0 +1,88 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ec2wrapper
+
+import (
+	"testing"
+	"time"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	awsretry "github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	ec2v2 "github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go/aws"
+	ec2svc "github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+// testConfig returns the configuration of a client of the EC2 API at endpoint, that makes maxAttempts attempts of
+// each call without waiting in between
+func testConfig(endpoint string, maxAttempts int) awsv2.Config {
+	return awsv2.Config{
+		Region:       "us-west-2",
+		BaseEndpoint: awsv2.String(endpoint),
+		Credentials:  credentials.NewStaticCredentialsProvider("id", "secret", ""),
+		Retryer: func() awsv2.Retryer {
+			return awsretry.NewStandard(func(o *awsretry.StandardOptions) {
+				o.MaxAttempts = maxAttempts
+				o.Backoff = awsretry.BackoffDelayerFunc(func(int, error) (time.Duration, error) { return 0, nil })
+			})
+		},
+	}
+}
+
+func TestConvertShape(t *testing.T) {
+	input := &ec2svc.CreateNetworkInterfaceInput{
+		SubnetId:                       aws.String("subnet-1"),
+		Groups:                         aws.StringSlice([]string{"sg-1", "sg-2"}),
+		SecondaryPrivateIpAddressCount: aws.Int64(3),
+	}
+	v2Input := &ec2v2.CreateNetworkInterfaceInput{}
+	convertShape(v2Input, input)
+	assert.Equal(t, "subnet-1", awsv2.ToString(v2Input.SubnetId))
+	assert.Equal(t, []string{"sg-1", "sg-2"}, v2Input.Groups)
+	assert.Equal(t, int32(3), awsv2.ToInt32(v2Input.SecondaryPrivateIpAddressCount))
+	assert.Nil(t, v2Input.Description)
+
+	attachTime := time.Now()
+	v2Output := &ec2v2.DescribeNetworkInterfacesOutput{
+		NetworkInterfaces: []types.NetworkInterface{{
+			NetworkInterfaceId: awsv2.String("eni-1"),
+			Status:             types.NetworkInterfaceStatusInUse,
+			Attachment: &types.NetworkInterfaceAttachment{
+				AttachTime:  &attachTime,
+				DeviceIndex: awsv2.Int32(1),
+			},
+			PrivateIpAddresses: []types.NetworkInterfacePrivateIpAddress{{
+				PrivateIpAddress: awsv2.String("10.0.0.5"),
+				Primary:          awsv2.Bool(true),
+			}},
+			TagSet: []types.Tag{{Key: awsv2.String("cluster"), Value: awsv2.String("prod")}},
+		}},
+	}
+	output := &ec2svc.DescribeNetworkInterfacesOutput{}
+	convertShape(output, v2Output)
+	assert.Len(t, output.NetworkInterfaces, 1)
+	eni := output.NetworkInterfaces[0]
+	assert.Equal(t, "eni-1", aws.StringValue(eni.NetworkInterfaceId))
+	assert.Equal(t, ec2svc.NetworkInterfaceStatusInUse, aws.StringValue(eni.Status))
+	assert.Equal(t, attachTime, aws.TimeValue(eni.Attachment.AttachTime))
+	assert.Equal(t, int64(1), aws.Int64Value(eni.Attachment.DeviceIndex))
+	assert.Equal(t, "10.0.0.5", aws.StringValue(eni.PrivateIpAddresses[0].PrivateIpAddress))
+	assert.True(t, aws.BoolValue(eni.PrivateIpAddresses[0].Primary))
+	assert.Equal(t, "prod", aws.StringValue(eni.TagSet[0].Value))
+	assert.Nil(t, eni.Association)
+	assert.Nil(t, output.NextToken)
+}
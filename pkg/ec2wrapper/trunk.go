@@ -0,0 +1,119 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ec2wrapper
+
+import (
+	"context"
+
+	ec2svc "github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// The v1 SDK predates ENI trunking too, so the trunk interface association calls have the shapes below, like the ones
+// of the SDK.
+
+// AssociateTrunkInterfaceInput associates a branch network interface with a trunk network interface
+type AssociateTrunkInterfaceInput struct {
+	_ struct{} `type:"structure"`
+
+	// BranchInterfaceId is the ID of the branch network interface
+	BranchInterfaceId *string `type:"string" required:"true"`
+
+	// TrunkInterfaceId is the ID of the trunk network interface
+	TrunkInterfaceId *string `type:"string" required:"true"`
+
+	// VlanId is the VLAN the traffic of the branch network interface is tagged with on the trunk network interface
+	VlanId *int64 `type:"integer"`
+}
+
+// AssociateTrunkInterfaceOutput contains the association of the branch network interface
+type AssociateTrunkInterfaceOutput struct {
+	_ struct{} `type:"structure"`
+
+	// InterfaceAssociation is the new association
+	InterfaceAssociation *TrunkInterfaceAssociation `locationName:"interfaceAssociation" type:"structure"`
+}
+
+// TrunkInterfaceAssociation is the association of a branch network interface with a trunk network interface
+type TrunkInterfaceAssociation struct {
+	_ struct{} `type:"structure"`
+
+	// AssociationId is the ID of the association
+	AssociationId *string `locationName:"associationId" type:"string"`
+
+	// BranchInterfaceId is the ID of the branch network interface
+	BranchInterfaceId *string `locationName:"branchInterfaceId" type:"string"`
+
+	// TrunkInterfaceId is the ID of the trunk network interface
+	TrunkInterfaceId *string `locationName:"trunkInterfaceId" type:"string"`
+
+	// VlanId is the VLAN of the branch network interface
+	VlanId *int64 `locationName:"vlanId" type:"integer"`
+}
+
+// DescribeTrunkInterfaceAssociationsInput lists the associations of trunk network interfaces, e.g. with the
+// "trunk-interface-association.trunk-interface-id" filter
+type DescribeTrunkInterfaceAssociationsInput struct {
+	_ struct{} `type:"structure"`
+
+	// Filters are the filters of the associations
+	Filters []*ec2svc.Filter `locationName:"Filter" locationNameList:"Filter" type:"list"`
+
+	// NextToken is the token of the next page
+	NextToken *string `type:"string"`
+}
+
+// DescribeTrunkInterfaceAssociationsOutput contains a page of associations
+type DescribeTrunkInterfaceAssociationsOutput struct {
+	_ struct{} `type:"structure"`
+
+	// InterfaceAssociations are the associations of the page
+	InterfaceAssociations []*TrunkInterfaceAssociation `locationName:"interfaceAssociationSet" locationNameList:"item" type:"list"`
+
+	// NextToken is the token of the next page, empty on the last one
+	NextToken *string `locationName:"nextToken" type:"string"`
+}
+
+// DisassociateTrunkInterfaceInput removes the association of a branch network interface
+type DisassociateTrunkInterfaceInput struct {
+	_ struct{} `type:"structure"`
+
+	// AssociationId is the ID of the association
+	AssociationId *string `type:"string" required:"true"`
+}
+
+// DisassociateTrunkInterfaceOutput contains whether the association is removed
+type DisassociateTrunkInterfaceOutput struct {
+	_ struct{} `type:"structure"`
+
+	// Return is true if the association is removed
+	Return *bool `locationName:"return" type:"boolean"`
+}
+
+// AssociateTrunkInterface calls AssociateTrunkInterface
+func (c *ec2Client) AssociateTrunkInterface(input *AssociateTrunkInterfaceInput) (*AssociateTrunkInterfaceOutput, error) {
+	return invoke[AssociateTrunkInterfaceOutput](context.Background(), c, "AssociateTrunkInterface", input,
+		c.client.AssociateTrunkInterface)
+}
+
+// DescribeTrunkInterfaceAssociations calls DescribeTrunkInterfaceAssociations
+func (c *ec2Client) DescribeTrunkInterfaceAssociations(input *DescribeTrunkInterfaceAssociationsInput) (*DescribeTrunkInterfaceAssociationsOutput, error) {
+	return invoke[DescribeTrunkInterfaceAssociationsOutput](context.Background(), c,
+		"DescribeTrunkInterfaceAssociations", input, c.client.DescribeTrunkInterfaceAssociations)
+}
+
+// DisassociateTrunkInterface calls DisassociateTrunkInterface
+func (c *ec2Client) DisassociateTrunkInterface(input *DisassociateTrunkInterfaceInput) (*DisassociateTrunkInterfaceOutput, error) {
+	return invoke[DisassociateTrunkInterfaceOutput](context.Background(), c, "DisassociateTrunkInterface", input,
+		c.client.DisassociateTrunkInterface)
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ec2wrapper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	ec2svc "github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrunkInterfaceAssociations(t *testing.T) {
+	var forms []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		forms = append(forms, r.PostForm)
+		w.Header().Set("Content-Type", "text/xml")
+		switch r.PostForm.Get("Action") {
+		case "AssociateTrunkInterface":
+			_, _ = w.Write([]byte(`<AssociateTrunkInterfaceResponse>
+  <interfaceAssociation>
+    <associationId>trunk-assoc-1</associationId>
+    <branchInterfaceId>eni-branch</branchInterfaceId>
+    <trunkInterfaceId>eni-trunk</trunkInterfaceId>
+    <vlanId>3</vlanId>
+  </interfaceAssociation>
+</AssociateTrunkInterfaceResponse>`))
+		case "DescribeTrunkInterfaceAssociations":
+			_, _ = w.Write([]byte(`<DescribeTrunkInterfaceAssociationsResponse>
+  <interfaceAssociationSet>
+    <item><associationId>trunk-assoc-1</associationId><branchInterfaceId>eni-branch</branchInterfaceId><vlanId>3</vlanId></item>
+  </interfaceAssociationSet>
+</DescribeTrunkInterfaceAssociationsResponse>`))
+		default:
+			_, _ = w.Write([]byte(`<DisassociateTrunkInterfaceResponse><return>true</return></DisassociateTrunkInterfaceResponse>`))
+		}
+	}))
+	defer server.Close()
+
+	client := New(testConfig(server.URL, 1))
+
+	output, err := client.AssociateTrunkInterface(&AssociateTrunkInterfaceInput{
+		BranchInterfaceId: aws.String("eni-branch"),
+		TrunkInterfaceId:  aws.String("eni-trunk"),
+		VlanId:            aws.Int64(3),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "trunk-assoc-1", aws.StringValue(output.InterfaceAssociation.AssociationId))
+	assert.Equal(t, int64(3), aws.Int64Value(output.InterfaceAssociation.VlanId))
+
+	associations, err := client.DescribeTrunkInterfaceAssociations(&DescribeTrunkInterfaceAssociationsInput{
+		Filters: []*ec2svc.Filter{{
+			Name:   aws.String("trunk-interface-association.trunk-interface-id"),
+			Values: aws.StringSlice([]string{"eni-trunk"}),
+		}},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, associations.InterfaceAssociations, 1)
+	assert.Equal(t, "eni-branch", aws.StringValue(associations.InterfaceAssociations[0].BranchInterfaceId))
+
+	disassociated, err := client.DisassociateTrunkInterface(&DisassociateTrunkInterfaceInput{
+		AssociationId: aws.String("trunk-assoc-1"),
+	})
+	assert.NoError(t, err)
+	assert.True(t, aws.BoolValue(disassociated.Return))
+
+	assert.Len(t, forms, 3)
+	assert.Equal(t, "eni-branch", forms[0].Get("BranchInterfaceId"))
+	assert.Equal(t, "eni-trunk", forms[0].Get("TrunkInterfaceId"))
+	assert.Equal(t, "3", forms[0].Get("VlanId"))
+	assert.Equal(t, "trunk-interface-association.trunk-interface-id", forms[1].Get("Filter.1.Name"))
+	assert.Equal(t, "eni-trunk", forms[1].Get("Filter.1.Value.1"))
+	assert.Equal(t, "trunk-assoc-1", forms[2].Get("AssociationId"))
+}
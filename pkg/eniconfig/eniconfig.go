@@ -45,6 +45,12 @@ const (
 	//   This will set eniConfigLabelDef to eniConfigOverride
 	envEniConfigAnnotationDef = "ENI_CONFIG_ANNOTATION_DEF"
 	envEniConfigLabelDef      = "ENI_CONFIG_LABEL_DEF"
+
+	// envResyncPeriod is the name of the environment variable that sets how often the ENIConfigs and the nodes in the
+	// cache of the controller are handled again, e.g. "1m". Lower values pick up a missed change of the ENIConfig of the
+	// node sooner, without a call to the API server. Defaults to 5 seconds.
+	envResyncPeriod     = "AWS_VPC_K8S_CNI_ENICONFIG_RESYNC_PERIOD"
+	defaultResyncPeriod = 5 * time.Second
 )
 
 type ENIConfig interface {
@@ -151,7 +157,7 @@ func (eniCfg *ENIConfigController) Start() {
 
 	resource := "crd.k8s.amazonaws.com/v1alpha1"
 	kind := "ENIConfig"
-	resyncPeriod := time.Second * 5
+	resyncPeriod := getResyncPeriod()
 	log.Infof("Watching %s, %s, every %v s", resource, kind, resyncPeriod.Seconds())
 	sdk.Watch(resource, kind, "", resyncPeriod)
 	sdk.Watch("/v1", "Node", corev1.NamespaceAll, resyncPeriod)
@@ -206,6 +212,18 @@ func getEniConfigAnnotationDef() string {
 	return defaultEniConfigAnnotationDef
 }
 
+// getResyncPeriod returns how often the cached ENIConfigs and nodes are handled again
+func getResyncPeriod() time.Duration {
+	if strValue := os.Getenv(envResyncPeriod); strValue != "" {
+		parsedValue, err := time.ParseDuration(strValue)
+		if err == nil && parsedValue > 0 {
+			return parsedValue
+		}
+		log.Errorf("Failed to parse %s %q; using default: %v", envResyncPeriod, strValue, defaultResyncPeriod)
+	}
+	return defaultResyncPeriod
+}
+
 // getEniConfigLabelDef returns eniConfigLabel name
 func getEniConfigLabelDef() string {
 	inputStr, found := os.LookupEnv(envEniConfigLabelDef)
@@ -219,3 +237,12 @@ func getEniConfigLabelDef() string {
 	}
 	return defaultEniConfigLabelDef
 }
+
+// GetConfigForDebug returns the active values of the configuration env vars (for debugging purposes).
+func GetConfigForDebug() map[string]interface{} {
+	return map[string]interface{}{
+		envEniConfigAnnotationDef: getEniConfigAnnotationDef(),
+		envEniConfigLabelDef:      getEniConfigLabelDef(),
+		envResyncPeriod:           getResyncPeriod().String(),
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -238,3 +239,19 @@ func TestGetEniConfigLabelDefCustom(t *testing.T) {
 	eniConfigLabelDef := getEniConfigLabelDef()
 	assert.Equal(t, eniConfigLabelDef, "k8s.amazonaws.com/eniConfigCustom")
 }
+
+func TestGetResyncPeriod(t *testing.T) {
+	defer os.Unsetenv(envResyncPeriod)
+
+	os.Unsetenv(envResyncPeriod)
+	assert.Equal(t, defaultResyncPeriod, getResyncPeriod())
+
+	os.Setenv(envResyncPeriod, "1m")
+	assert.Equal(t, time.Minute, getResyncPeriod())
+
+	// Invalid and zero periods fall back to the default
+	for _, value := range []string{"soon", "0s", "-1s"} {
+		os.Setenv(envResyncPeriod, value)
+		assert.Equal(t, defaultResyncPeriod, getResyncPeriod(), value)
+	}
+}
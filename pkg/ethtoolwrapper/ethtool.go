@@ -0,0 +1,138 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package ethtoolwrapper is a wrapper of the ethtool ioctls used to turn offloads of network interfaces on or off
+package ethtoolwrapper
+
+import (
+	"sort"
+	"strings"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Offloads that can be turned on or off, named like in `ethtool -K`
+const (
+	// OffloadTxChecksum is the checksumming of transmitted packets
+	OffloadTxChecksum = "tx-checksum"
+	// OffloadTSO is the TCP segmentation offload
+	OffloadTSO = "tso"
+	// OffloadGSO is the generic segmentation offload
+	OffloadGSO = "gso"
+	// OffloadGRO is the generic receive offload
+	OffloadGRO = "gro"
+)
+
+// ethtool commands of the legacy offload interface, from linux/ethtool.h
+var offloadCmds = map[string]uint32{
+	OffloadTxChecksum: 0x00000017, // ETHTOOL_STXCSUM
+	OffloadTSO:        0x0000001f, // ETHTOOL_STSO
+	OffloadGSO:        0x00000024, // ETHTOOL_SGSO
+	OffloadGRO:        0x0000002c, // ETHTOOL_SGRO
+}
+
+// Ethtool wraps the ethtool calls on network interfaces
+type Ethtool interface {
+	// SetOffload turns the offload on or off on the interface, in the network namespace of the calling thread
+	SetOffload(ifName string, offload string, on bool) error
+}
+
+type ethtool struct {
+}
+
+// NewEthtool creates an Ethtool object
+func NewEthtool() Ethtool {
+	return &ethtool{}
+}
+
+// ethtoolValue is struct ethtool_value of linux/ethtool.h
+type ethtoolValue struct {
+	cmd  uint32
+	data uint32
+}
+
+// ifreq is struct ifreq of linux/if.h, with ifr_data as the union member. It is a pointer rather than a uintptr, so that
+// the value it points to stays alive while the kernel reads it.
+type ifreq struct {
+	name [unix.IFNAMSIZ]byte
+	data unsafe.Pointer
+	_    [16]byte
+}
+
+func (*ethtool) SetOffload(ifName string, offload string, on bool) error {
+	cmd, ok := offloadCmds[offload]
+	if !ok {
+		return errors.Errorf("unknown offload %q", offload)
+	}
+	if len(ifName) >= unix.IFNAMSIZ {
+		return errors.Errorf("interface name %q is too long", ifName)
+	}
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return errors.Wrap(err, "failed to open the ethtool socket")
+	}
+	defer unix.Close(fd)
+
+	value := ethtoolValue{cmd: cmd}
+	if on {
+		value.data = 1
+	}
+	var req ifreq
+	copy(req.name[:], ifName)
+	req.data = unsafe.Pointer(&value)
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCETHTOOL, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		return errors.Wrapf(errno, "failed to set %s of %q to %v", offload, ifName, on)
+	}
+	return nil
+}
+
+// ParseOffloads parses a comma separated list of offloads to turn on or off, e.g. "tx-checksum=off,gro=on"
+func ParseOffloads(offloads string) (map[string]bool, error) {
+	result := make(map[string]bool)
+	for _, setting := range strings.Split(offloads, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		parts := strings.Split(setting, "=")
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid offload setting %q, expected <offload>=on|off", setting)
+		}
+		name := strings.TrimSpace(parts[0])
+		if _, ok := offloadCmds[name]; !ok {
+			return nil, errors.Errorf("unknown offload %q, supported offloads are %s", name, supportedOffloads())
+		}
+		switch strings.TrimSpace(parts[1]) {
+		case "on":
+			result[name] = true
+		case "off":
+			result[name] = false
+		default:
+			return nil, errors.Errorf("invalid offload setting %q, expected <offload>=on|off", setting)
+		}
+	}
+	return result, nil
+}
+
+func supportedOffloads() string {
+	var names []string
+	for name := range offloadCmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
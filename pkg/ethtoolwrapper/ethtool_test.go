@@ -0,0 +1,37 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ethtoolwrapper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOffloads(t *testing.T) {
+	offloads, err := ParseOffloads("")
+	assert.NoError(t, err)
+	assert.Empty(t, offloads)
+
+	offloads, err = ParseOffloads("tx-checksum=off, tso=off,gro=on")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{OffloadTxChecksum: false, OffloadTSO: false, OffloadGRO: true}, offloads)
+
+	_, err = ParseOffloads("lro=off")
+	assert.Error(t, err)
+	_, err = ParseOffloads("gro")
+	assert.Error(t, err)
+	_, err = ParseOffloads("gro=false")
+	assert.Error(t, err)
+}
@@ -0,0 +1,247 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package fastpath lets the CNI plugin set up a pod with a warm IP that ipamd reserved in advance, when ipamd is too
+// busy to answer in time. ipamd writes a lease file for each reserved IP, signed with a key only root can read, and
+// the plugin claims a lease by moving its file, which only one plugin can do. ipamd then assigns the IP to the pod.
+package fastpath
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultDir is where ipamd writes the leases, on the host
+	DefaultDir = "/var/run/aws-node/leases"
+
+	keyFile     = "key"
+	freeDir     = "free"
+	claimedDir  = "claimed"
+	leaseSuffix = ".json"
+	// claimSeparator separates the fields of the name of a claimed lease, it is in neither IPs nor Kubernetes names
+	claimSeparator = "_"
+)
+
+// Lease is a warm IP reserved by ipamd, with everything the plugin needs to set up a pod with it
+type Lease struct {
+	IPv4            string    `json:"ipv4"`
+	DeviceNumber    int32     `json:"deviceNumber"`
+	UseExternalSNAT bool      `json:"useExternalSNAT"`
+	VPCcidrs        []string  `json:"vpcCIDRs"`
+	Expiry          time.Time `json:"expiry"`
+	Signature       string    `json:"signature,omitempty"`
+}
+
+// Claim is a lease a plugin claimed for a pod
+type Claim struct {
+	Lease
+	PodName      string
+	PodNamespace string
+	ContainerID  string
+}
+
+// NewKey writes a new signing key to dir and removes the leases signed with the previous one
+func NewKey(dir string) ([]byte, error) {
+	for _, sub := range []string{freeDir, claimedDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, errors.Wrapf(err, "failed to create lease directory %s", sub)
+		}
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, "failed to generate lease key")
+	}
+	// Leases signed with the previous key can no longer be verified, remove them before any new one is written
+	free, err := ioutil.ReadDir(filepath.Join(dir, freeDir))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list leases")
+	}
+	for _, file := range free {
+		_ = os.Remove(filepath.Join(dir, freeDir, file.Name()))
+	}
+	if err := writeFileAtomic(filepath.Join(dir, keyFile), []byte(hex.EncodeToString(key)), 0600); err != nil {
+		return nil, errors.Wrap(err, "failed to write lease key")
+	}
+	return key, nil
+}
+
+// ReadKey returns the signing key in dir
+func ReadKey(dir string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, keyFile))
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(data)))
+}
+
+func sign(key []byte, lease Lease) (string, error) {
+	lease.Signature = ""
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Verify returns an error if the lease was not signed with key or has expired
+func Verify(key []byte, lease Lease, now time.Time) error {
+	signature, err := sign(key, lease)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(signature), []byte(lease.Signature)) {
+		return errors.Errorf("lease of IP %s has an invalid signature", lease.IPv4)
+	}
+	if now.After(lease.Expiry) {
+		return errors.Errorf("lease of IP %s expired at %v", lease.IPv4, lease.Expiry)
+	}
+	return nil
+}
+
+// WriteLease signs a lease and makes it available to the plugins, replacing the previous lease of the same IP
+func WriteLease(dir string, key []byte, lease Lease) error {
+	signature, err := sign(key, lease)
+	if err != nil {
+		return err
+	}
+	lease.Signature = signature
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, freeDir, lease.IPv4+leaseSuffix), data, 0600)
+}
+
+// RemoveLease withdraws the lease of an IP, it returns false if the lease was already claimed or removed
+func RemoveLease(dir string, ipv4 string) bool {
+	return os.Remove(filepath.Join(dir, freeDir, ipv4+leaseSuffix)) == nil
+}
+
+// FreeLeases returns the IPs of the leases that have not been claimed
+func FreeLeases(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(dir, freeDir))
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), leaseSuffix) {
+			ips = append(ips, strings.TrimSuffix(file.Name(), leaseSuffix))
+		}
+	}
+	return ips, nil
+}
+
+// ClaimLease claims a free lease for a pod, verifies it and returns it. Expired or invalid leases that are claimed on
+// the way are given up, ipamd releases their IPs.
+func ClaimLease(dir string, podName, podNamespace, containerID string, now time.Time) (*Lease, error) {
+	key, err := ReadKey(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read lease key")
+	}
+	ips, err := FreeLeases(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list leases")
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		claimed := filepath.Join(dir, claimedDir,
+			strings.Join([]string{ip, podNamespace, podName, containerID}, claimSeparator)+leaseSuffix)
+		// Only one plugin can move the file, the others move on to the next lease
+		if err := os.Rename(filepath.Join(dir, freeDir, ip+leaseSuffix), claimed); err != nil {
+			continue
+		}
+		lease, err := readLease(claimed)
+		if err == nil {
+			err = Verify(key, *lease, now)
+		}
+		if err != nil {
+			_ = os.Remove(claimed)
+			continue
+		}
+		return lease, nil
+	}
+	return nil, errors.New("no lease available")
+}
+
+// Claims returns the leases claimed by plugins, and removes the claims that can not be read
+func Claims(dir string) ([]Claim, error) {
+	files, err := ioutil.ReadDir(filepath.Join(dir, claimedDir))
+	if err != nil {
+		return nil, err
+	}
+	var claims []Claim
+	for _, file := range files {
+		path := filepath.Join(dir, claimedDir, file.Name())
+		fields := strings.Split(strings.TrimSuffix(file.Name(), leaseSuffix), claimSeparator)
+		lease, err := readLease(path)
+		if err != nil || len(fields) != 4 || !strings.HasSuffix(file.Name(), leaseSuffix) {
+			_ = os.Remove(path)
+			continue
+		}
+		claims = append(claims, Claim{Lease: *lease, PodNamespace: fields[1], PodName: fields[2], ContainerID: fields[3]})
+	}
+	return claims, nil
+}
+
+// RemoveClaim removes a claim once ipamd took it into account
+func RemoveClaim(dir string, claim Claim) error {
+	name := strings.Join([]string{claim.IPv4, claim.PodNamespace, claim.PodName, claim.ContainerID}, claimSeparator)
+	return os.Remove(filepath.Join(dir, claimedDir, name+leaseSuffix))
+}
+
+func readLease(path string) (*Lease, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lease Lease
+	if err := json.Unmarshal(data, &lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// writeFileAtomic writes the file through a temporary one, so that readers never see it partially written
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package fastpath
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leases")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	key, err := NewKey(dir)
+	assert.NoError(t, err)
+	lease := Lease{IPv4: "10.0.0.11", DeviceNumber: 1, VPCcidrs: []string{"10.0.0.0/16"}, Expiry: now.Add(time.Minute)}
+	assert.NoError(t, WriteLease(dir, key, lease))
+	assert.NoError(t, WriteLease(dir, key, Lease{IPv4: "10.0.0.12", Expiry: now.Add(-time.Minute)}))
+	ips, err := FreeLeases(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.11", "10.0.0.12"}, ips)
+
+	// The first lease is claimed, the expired one is given up
+	claimed, err := ClaimLease(dir, "pod1", "default", "c1", now)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.11", claimed.IPv4)
+	assert.Equal(t, int32(1), claimed.DeviceNumber)
+	_, err = ClaimLease(dir, "pod2", "default", "c2", now)
+	assert.Error(t, err)
+	ips, err = FreeLeases(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, ips)
+
+	claims, err := Claims(dir)
+	assert.NoError(t, err)
+	assert.Len(t, claims, 1)
+	assert.Equal(t, "pod1", claims[0].PodName)
+	assert.Equal(t, "default", claims[0].PodNamespace)
+	assert.Equal(t, "c1", claims[0].ContainerID)
+	assert.NoError(t, Verify(key, claims[0].Lease, now))
+	assert.NoError(t, RemoveClaim(dir, claims[0]))
+
+	// A new key invalidates the leases signed with the previous one
+	assert.NoError(t, WriteLease(dir, key, lease))
+	newKey, err := NewKey(dir)
+	assert.NoError(t, err)
+	assert.Error(t, Verify(newKey, claims[0].Lease, now))
+	ips, err = FreeLeases(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, ips)
+	assert.False(t, RemoveLease(dir, "10.0.0.11"))
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamevents
+
+import (
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// envDNSProvider is the name of the environment variable that selects the provider pods with a hostname
+	// annotation are registered with, e.g. "route53". Defaults to empty, off.
+	envDNSProvider = "AWS_VPC_K8S_CNI_DNS_PROVIDER"
+
+	// HostnameAnnotation is the annotation of a pod with the fully qualified name its IPv4 address is registered under
+	HostnameAnnotation = "vpc.amazonaws.com/hostname"
+)
+
+// DNSProvider registers the forward and reverse records of pods
+type DNSProvider interface {
+	// Register creates or updates the A record of hostname and the PTR record of ip
+	Register(hostname string, ip net.IP) error
+	// Unregister deletes the A record of hostname and the PTR record of ip, records that are already gone are not
+	// errors
+	Unregister(hostname string, ip net.IP) error
+}
+
+// DNSProviderFactory returns a new DNSProvider
+type DNSProviderFactory func() (DNSProvider, error)
+
+var (
+	dnsProvidersLock sync.Mutex
+	dnsProviders     = map[string]DNSProviderFactory{
+		route53Provider: newRoute53,
+	}
+)
+
+// RegisterDNSProvider makes a provider available under name, replacing the provider registered under the same name if
+// any
+func RegisterDNSProvider(name string, factory DNSProviderFactory) {
+	dnsProvidersLock.Lock()
+	defer dnsProvidersLock.Unlock()
+	dnsProviders[name] = factory
+}
+
+func dnsProviderNames() []string {
+	names := make([]string, 0, len(dnsProviders))
+	for name := range dnsProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DNSEnabled returns whether a DNS provider is selected
+func DNSEnabled() bool {
+	return os.Getenv(envDNSProvider) != ""
+}
+
+// dnsRecord is what was registered for a pod
+type dnsRecord struct {
+	hostname string
+	ip       net.IP
+}
+
+// dns is a Sink that registers the pods with a hostname annotation when they get their IP, and unregisters them when
+// they release it
+type dns struct {
+	provider    DNSProvider
+	annotations func(namespace, name string) (map[string]string, error)
+
+	// records are the registered records by namespace/name, so that they can be unregistered once the pod is gone
+	records map[string]dnsRecord
+}
+
+// NewDNS returns a Sink that registers pods with the selected DNS provider, looking up their annotations with the
+// given function
+func NewDNS(annotations func(namespace, name string) (map[string]string, error)) (Sink, error) {
+	name := os.Getenv(envDNSProvider)
+	dnsProvidersLock.Lock()
+	factory, ok := dnsProviders[name]
+	names := dnsProviderNames()
+	dnsProvidersLock.Unlock()
+	if !ok {
+		return nil, errors.Errorf("dns: unknown provider %q, the providers are %v", name, names)
+	}
+	provider, err := factory()
+	if err != nil {
+		return nil, errors.Wrapf(err, "dns: failed to create provider %q", name)
+	}
+	return &dns{provider: provider, annotations: annotations, records: make(map[string]dnsRecord)}, nil
+}
+
+// Handle registers or unregisters the pod of the event if it has a hostname annotation
+func (d *dns) Handle(event Event) error {
+	key := event.PodNamespace + "/" + event.PodName
+	ip := net.ParseIP(event.IPv4)
+	if ip == nil {
+		return nil
+	}
+	switch event.Type {
+	case Allocated:
+		annotations, err := d.annotations(event.PodNamespace, event.PodName)
+		if err != nil {
+			return errors.Wrap(err, "dns: failed to get the hostname of the pod")
+		}
+		hostname := strings.TrimSuffix(annotations[HostnameAnnotation], ".")
+		if hostname == "" {
+			return nil
+		}
+		if err := d.provider.Register(hostname, ip); err != nil {
+			return errors.Wrapf(err, "dns: failed to register %s", hostname)
+		}
+		log.Infof("Registered %s for IP %s of pod %s", hostname, ip, key)
+		d.records[key] = dnsRecord{hostname: hostname, ip: ip}
+	case Released:
+		record, ok := d.records[key]
+		if !ok || !record.ip.Equal(ip) {
+			// Registered before ipamd restarted, the pod is usually still there while its sandbox is torn down
+			annotations, err := d.annotations(event.PodNamespace, event.PodName)
+			if err != nil {
+				return errors.Wrap(err, "dns: failed to get the hostname of the pod")
+			}
+			record = dnsRecord{hostname: strings.TrimSuffix(annotations[HostnameAnnotation], "."), ip: ip}
+		}
+		delete(d.records, key)
+		if record.hostname == "" {
+			return nil
+		}
+		if err := d.provider.Unregister(record.hostname, ip); err != nil {
+			return errors.Wrapf(err, "dns: failed to unregister %s", record.hostname)
+		}
+		log.Infof("Unregistered %s for IP %s of pod %s", record.hostname, ip, key)
+	}
+	return nil
+}
+
+// reverseName returns the name of the PTR record of an IPv4 address, e.g. 5.0.0.10.in-addr.arpa for 10.0.0.5
+func reverseName(ip net.IP) string {
+	ip4 := ip.To4()
+	labels := make([]string, 0, 4)
+	for i := len(ip4) - 1; i >= 0; i-- {
+		labels = append(labels, strconv.Itoa(int(ip4[i])))
+	}
+	return strings.Join(labels, ".") + ".in-addr.arpa"
+}
+
+// getDNSConfigForDebug returns the DNS registration configuration
+func getDNSConfigForDebug() map[string]interface{} {
+	config := map[string]interface{}{
+		envDNSProvider: os.Getenv(envDNSProvider),
+	}
+	if os.Getenv(envDNSProvider) == route53Provider {
+		for k, v := range getRoute53ConfigForDebug() {
+			config[k] = v
+		}
+	}
+	return config
+}
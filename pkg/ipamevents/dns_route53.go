@@ -0,0 +1,165 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamevents
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/route53"
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/ec2metadata"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/retry"
+)
+
+const (
+	route53Provider = "route53"
+
+	// envDNSZoneID is the name of the environment variable with the ID of the Route53 private hosted zone the A
+	// records of pods are registered in
+	envDNSZoneID = "AWS_VPC_K8S_CNI_DNS_ZONE_ID"
+
+	// envDNSReverseZoneID is the name of the environment variable with the ID of the Route53 private hosted zone the
+	// PTR records of pods are registered in, e.g. the zone of 10.in-addr.arpa. Defaults to empty, no PTR records.
+	envDNSReverseZoneID = "AWS_VPC_K8S_CNI_DNS_REVERSE_ZONE_ID"
+
+	// envDNSTTL is the name of the environment variable with the TTL of the records in seconds. Defaults to 60.
+	envDNSTTL     = "AWS_VPC_K8S_CNI_DNS_TTL"
+	defaultDNSTTL = 60
+)
+
+// route53RetryPolicy is how the calls to Route53 are retried, the API is throttled to a few requests per second per
+// account
+var route53RetryPolicy = retry.Policy{
+	Name:         "ROUTE53",
+	InitialDelay: 200 * time.Millisecond,
+	MaxDelay:     30 * time.Second,
+	Multiplier:   2,
+	Jitter:       0.5,
+	MaxAttempts:  8,
+}
+
+// route53API is the part of the Route53 API the provider uses
+type route53API interface {
+	ChangeResourceRecordSets(input *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error)
+}
+
+// route53DNS registers the records of pods in Route53 private hosted zones
+type route53DNS struct {
+	client        route53API
+	zoneID        string
+	reverseZoneID string
+	ttl           int64
+}
+
+func getDNSTTL() int64 {
+	if value := os.Getenv(envDNSTTL); value != "" {
+		ttl, err := strconv.ParseInt(value, 10, 64)
+		if err == nil && ttl > 0 {
+			return ttl
+		}
+		log.Errorf("Failed to parse %s %q, using default %d", envDNSTTL, value, defaultDNSTTL)
+	}
+	return defaultDNSTTL
+}
+
+func newRoute53() (DNSProvider, error) {
+	zoneID := os.Getenv(envDNSZoneID)
+	if zoneID == "" {
+		return nil, errors.Errorf("route53: %s is not set", envDNSZoneID)
+	}
+	region, err := ec2metadata.New().Region()
+	if err != nil {
+		return nil, errors.Wrap(err, "route53: failed to retrieve region data from instance metadata")
+	}
+	sess, err := session.NewSession(
+		request.WithRetryer(&aws.Config{Region: aws.String(region)},
+			retry.NewSDKRetryer(route53RetryPolicy.WithEnvOverrides())))
+	if err != nil {
+		return nil, errors.Wrap(err, "route53: failed to initialize AWS SDK session")
+	}
+	return &route53DNS{
+		client:        route53.New(sess),
+		zoneID:        zoneID,
+		reverseZoneID: os.Getenv(envDNSReverseZoneID),
+		ttl:           getDNSTTL(),
+	}, nil
+}
+
+// Register upserts the A record of hostname, then the PTR record of ip
+func (r *route53DNS) Register(hostname string, ip net.IP) error {
+	if err := r.change(route53.ChangeActionUpsert, r.zoneID, hostname, route53.RRTypeA, ip.String()); err != nil {
+		return err
+	}
+	if r.reverseZoneID == "" {
+		return nil
+	}
+	return r.change(route53.ChangeActionUpsert, r.reverseZoneID, reverseName(ip), route53.RRTypePtr, hostname)
+}
+
+// Unregister deletes the PTR record of ip, then the A record of hostname
+func (r *route53DNS) Unregister(hostname string, ip net.IP) error {
+	if r.reverseZoneID != "" {
+		err := r.change(route53.ChangeActionDelete, r.reverseZoneID, reverseName(ip), route53.RRTypePtr, hostname)
+		if err != nil {
+			return err
+		}
+	}
+	return r.change(route53.ChangeActionDelete, r.zoneID, hostname, route53.RRTypeA, ip.String())
+}
+
+// change applies a single change to a record set. Deleting a record that does not exist, or no longer has the same
+// value, is not an error: another pod took the name over.
+func (r *route53DNS) change(action, zoneID, name, recordType, value string) error {
+	_, err := r.client.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(zoneID),
+		ChangeBatch: &route53.ChangeBatch{
+			Comment: aws.String("amazon-vpc-cni-k8s"),
+			Changes: []*route53.Change{{
+				Action: aws.String(action),
+				ResourceRecordSet: &route53.ResourceRecordSet{
+					Name:            aws.String(name),
+					Type:            aws.String(recordType),
+					TTL:             aws.Int64(r.ttl),
+					ResourceRecords: []*route53.ResourceRecord{{Value: aws.String(value)}},
+				},
+			}},
+		},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && action == route53.ChangeActionDelete &&
+			aerr.Code() == route53.ErrCodeInvalidChangeBatch {
+			log.Debugf("Record %s %s %s is already gone: %v", recordType, name, value, aerr)
+			return nil
+		}
+		return errors.Wrapf(err, "route53: failed to %s %s record %s in zone %s", action, recordType, name, zoneID)
+	}
+	return nil
+}
+
+func getRoute53ConfigForDebug() map[string]interface{} {
+	return map[string]interface{}{
+		envDNSZoneID:        os.Getenv(envDNSZoneID),
+		envDNSReverseZoneID: os.Getenv(envDNSReverseZoneID),
+		envDNSTTL:           getDNSTTL(),
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamevents
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDNS records the calls to a DNSProvider
+type fakeDNS struct {
+	calls []string
+}
+
+func (f *fakeDNS) Register(hostname string, ip net.IP) error {
+	f.calls = append(f.calls, fmt.Sprintf("register %s %s", hostname, ip))
+	return nil
+}
+
+func (f *fakeDNS) Unregister(hostname string, ip net.IP) error {
+	f.calls = append(f.calls, fmt.Sprintf("unregister %s %s", hostname, ip))
+	return nil
+}
+
+func TestDNS(t *testing.T) {
+	provider := &fakeDNS{}
+	RegisterDNSProvider("fake", func() (DNSProvider, error) { return provider, nil })
+	_ = os.Setenv(envDNSProvider, "fake")
+	defer os.Unsetenv(envDNSProvider)
+	assert.True(t, DNSEnabled())
+
+	annotations := map[string]map[string]string{
+		"ns/web": {HostnameAnnotation: "web.example.internal."},
+		"ns/db":  {HostnameAnnotation: "db.example.internal"},
+	}
+	sink, err := NewDNS(func(namespace, name string) (map[string]string, error) {
+		return annotations[namespace+"/"+name], nil
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, sink.Handle(Event{Type: Allocated, PodName: "web", PodNamespace: "ns", IPv4: "10.0.0.5"}))
+	assert.NoError(t, sink.Handle(Event{Type: Allocated, PodName: "other", PodNamespace: "ns", IPv4: "10.0.0.6"}))
+	// The pod is gone by the time its IP is released, the registered name is used
+	delete(annotations, "ns/web")
+	assert.NoError(t, sink.Handle(Event{Type: Released, PodName: "web", PodNamespace: "ns", IPv4: "10.0.0.5"}))
+	// Registered before a restart, the annotation is looked up
+	assert.NoError(t, sink.Handle(Event{Type: Released, PodName: "db", PodNamespace: "ns", IPv4: "10.0.0.7"}))
+	assert.NoError(t, sink.Handle(Event{Type: Released, PodName: "other", PodNamespace: "ns", IPv4: "10.0.0.6"}))
+
+	assert.Equal(t, []string{
+		"register web.example.internal 10.0.0.5",
+		"unregister web.example.internal 10.0.0.5",
+		"unregister db.example.internal 10.0.0.7",
+	}, provider.calls)
+
+	_ = os.Setenv(envDNSProvider, "unknown")
+	_, err = NewDNS(nil)
+	assert.Error(t, err)
+}
+
+// fakeRoute53 records the changes made to the record sets
+type fakeRoute53 struct {
+	changes []string
+	err     error
+}
+
+func (f *fakeRoute53) ChangeResourceRecordSets(input *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error) {
+	for _, change := range input.ChangeBatch.Changes {
+		f.changes = append(f.changes, fmt.Sprintf("%s %s %s %s %s", aws.StringValue(input.HostedZoneId),
+			aws.StringValue(change.Action), aws.StringValue(change.ResourceRecordSet.Type),
+			aws.StringValue(change.ResourceRecordSet.Name),
+			aws.StringValue(change.ResourceRecordSet.ResourceRecords[0].Value)))
+	}
+	return &route53.ChangeResourceRecordSetsOutput{}, f.err
+}
+
+func TestRoute53(t *testing.T) {
+	client := &fakeRoute53{}
+	provider := &route53DNS{client: client, zoneID: "Z1", reverseZoneID: "Z2", ttl: 60}
+	ip := net.ParseIP("10.0.1.5")
+
+	assert.NoError(t, provider.Register("web.example.internal", ip))
+	assert.NoError(t, provider.Unregister("web.example.internal", ip))
+	assert.Equal(t, []string{
+		"Z1 UPSERT A web.example.internal 10.0.1.5",
+		"Z2 UPSERT PTR 5.1.0.10.in-addr.arpa web.example.internal",
+		"Z2 DELETE PTR 5.1.0.10.in-addr.arpa web.example.internal",
+		"Z1 DELETE A web.example.internal 10.0.1.5",
+	}, client.changes)
+
+	// Deleting records that are already gone succeeds, upserting fails
+	client.err = awserr.New(route53.ErrCodeInvalidChangeBatch, "not found", nil)
+	assert.NoError(t, provider.Unregister("web.example.internal", ip))
+	assert.Error(t, provider.Register("web.example.internal", ip))
+}
@@ -0,0 +1,147 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package ipamevents streams the IP allocations and releases of ipamd to external systems, e.g. a webhook that keeps a
+// CMDB or firewall automation in sync without scraping the nodes.
+package ipamevents
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// queueSize is the number of events each sink can lag behind before new events are dropped
+const queueSize = 1024
+
+// EventType is what happened to the IP of a pod
+type EventType string
+
+const (
+	// Allocated is sent when a pod got its IPs
+	Allocated EventType = "allocated"
+	// Released is sent when a pod released its IPs
+	Released EventType = "released"
+)
+
+// Event is an allocation or release of the IPs of a pod
+type Event struct {
+	Type         EventType `json:"type"`
+	Time         time.Time `json:"time"`
+	Node         string    `json:"node"`
+	InstanceID   string    `json:"instanceID"`
+	PodName      string    `json:"podName"`
+	PodNamespace string    `json:"podNamespace"`
+	ContainerID  string    `json:"containerID,omitempty"`
+	IPv4         string    `json:"ipv4,omitempty"`
+	IPv6         string    `json:"ipv6,omitempty"`
+}
+
+// Sink receives the events of a Stream, one at a time and in order. Sinks retry as they see fit, an error is only
+// counted and logged.
+type Sink interface {
+	Handle(event Event) error
+}
+
+var (
+	eventsDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "awscni_ipam_events_dropped",
+			Help: "The number of IPAM events dropped because a sink fell too far behind",
+		},
+		[]string{"sink"},
+	)
+	eventsFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "awscni_ipam_events_failed",
+			Help: "The number of IPAM events a sink failed to handle",
+		},
+		[]string{"sink"},
+	)
+	prometheusRegistered = false
+)
+
+func prometheusRegister() {
+	if !prometheusRegistered {
+		prometheus.MustRegister(eventsDropped)
+		prometheus.MustRegister(eventsFailed)
+		prometheusRegistered = true
+	}
+}
+
+type subscriber struct {
+	name   string
+	sink   Sink
+	events chan Event
+}
+
+// Stream sends the events published by ipamd to every subscribed sink, without ever blocking ipamd
+type Stream struct {
+	node       string
+	instanceID string
+
+	lock        sync.Mutex
+	subscribers []*subscriber
+}
+
+// NewStream returns a Stream of the events of a node
+func NewStream(node, instanceID string) *Stream {
+	prometheusRegister()
+	return &Stream{node: node, instanceID: instanceID}
+}
+
+// Subscribe starts sending the events published from now on to the sink
+func (s *Stream) Subscribe(name string, sink Sink) {
+	sub := &subscriber{name: name, sink: sink, events: make(chan Event, queueSize)}
+	s.lock.Lock()
+	s.subscribers = append(s.subscribers, sub)
+	s.lock.Unlock()
+	log.Infof("Sending IPAM events to %s", name)
+	go sub.run()
+}
+
+// Publish queues the event for every sink, with the node, instance and time filled in. Events are dropped for the
+// sinks whose queue is full. Publishing to a nil Stream does nothing.
+func (s *Stream) Publish(event Event) {
+	if s == nil {
+		return
+	}
+	event.Node = s.node
+	event.InstanceID = s.instanceID
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, sub := range s.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			log.Warnf("Dropped the %s event of pod %s/%s for %s, which is too far behind", event.Type,
+				event.PodNamespace, event.PodName, sub.name)
+			eventsDropped.WithLabelValues(sub.name).Inc()
+		}
+	}
+}
+
+func (sub *subscriber) run() {
+	for event := range sub.events {
+		if err := sub.sink.Handle(event); err != nil {
+			log.Errorf("Failed to send the %s event of pod %s/%s to %s: %v", event.Type, event.PodNamespace,
+				event.PodName, sub.name, err)
+			eventsFailed.WithLabelValues(sub.name).Inc()
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamevents
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/retry"
+)
+
+type channelSink chan Event
+
+func (s channelSink) Handle(event Event) error {
+	s <- event
+	return nil
+}
+
+func TestStream(t *testing.T) {
+	var stream *Stream
+	stream.Publish(Event{Type: Allocated})
+
+	stream = NewStream("node", "i-0123456789")
+	sink := make(channelSink, 1)
+	stream.Subscribe("test", sink)
+	stream.Publish(Event{Type: Allocated, PodName: "pod", PodNamespace: "ns", IPv4: "10.0.0.5"})
+
+	select {
+	case event := <-sink:
+		assert.Equal(t, Allocated, event.Type)
+		assert.Equal(t, "node", event.Node)
+		assert.Equal(t, "i-0123456789", event.InstanceID)
+		assert.Equal(t, "10.0.0.5", event.IPv4)
+		assert.False(t, event.Time.IsZero())
+	case <-time.After(5 * time.Second):
+		t.Fatal("the event was not sent to the sink")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var statuses []int
+	var events []Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		events = append(events, event)
+		w.WriteHeader(statuses[0])
+		statuses = statuses[1:]
+	}))
+	defer server.Close()
+
+	_ = os.Setenv(envWebhookURL, server.URL+"?token=secret")
+	defer os.Unsetenv(envWebhookURL)
+	assert.True(t, WebhookEnabled())
+	assert.Equal(t, server.URL, GetConfigForDebug()[envWebhookURL])
+	hook := NewWebhook().(*webhook)
+	hook.policy = retry.Policy{InitialDelay: time.Millisecond, MaxDelay: time.Millisecond, Multiplier: 1, MaxAttempts: 3}
+	event := Event{Type: Released, PodName: "pod", PodNamespace: "ns", IPv4: "10.0.0.5"}
+
+	// Server errors are retried
+	statuses = []int{http.StatusServiceUnavailable, http.StatusOK}
+	assert.NoError(t, hook.Handle(event))
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, "10.0.0.5", events[1].IPv4)
+
+	// Client errors are not
+	events = nil
+	statuses = []int{http.StatusBadRequest}
+	assert.Error(t, hook.Handle(event))
+	assert.Equal(t, 1, len(events))
+
+	// Up to the maximum number of attempts
+	events = nil
+	statuses = []int{http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway}
+	assert.Error(t, hook.Handle(event))
+	assert.Equal(t, 3, len(events))
+}
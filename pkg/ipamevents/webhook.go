@@ -0,0 +1,132 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ipamevents
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/retry"
+)
+
+const (
+	// envWebhookURL is the name of the environment variable with the URL every allocation and release is POSTed to,
+	// as a JSON Event. Defaults to empty, off.
+	envWebhookURL = "AWS_VPC_K8S_CNI_IPAM_WEBHOOK_URL"
+
+	// envWebhookTimeout is the name of the environment variable with how long each POST to the webhook can take.
+	// Defaults to 5s.
+	envWebhookTimeout = "AWS_VPC_K8S_CNI_IPAM_WEBHOOK_TIMEOUT"
+
+	defaultWebhookTimeout = 5 * time.Second
+)
+
+// webhookRetryPolicy is how a POST to the webhook is retried when it fails or the webhook answers with a 5xx or 429
+var webhookRetryPolicy = retry.Policy{
+	Name:         "WEBHOOK",
+	InitialDelay: time.Second,
+	MaxDelay:     30 * time.Second,
+	Multiplier:   2,
+	Jitter:       0.2,
+	MaxAttempts:  5,
+}
+
+type webhook struct {
+	url    string
+	client *http.Client
+	policy retry.Policy
+}
+
+// WebhookEnabled returns whether a webhook URL is set
+func WebhookEnabled() bool {
+	return os.Getenv(envWebhookURL) != ""
+}
+
+func getWebhookTimeout() time.Duration {
+	if value := os.Getenv(envWebhookTimeout); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err == nil && timeout > 0 {
+			return timeout
+		}
+		log.Errorf("Failed to parse %s %q, using default %v", envWebhookTimeout, value, defaultWebhookTimeout)
+	}
+	return defaultWebhookTimeout
+}
+
+// NewWebhook returns a Sink that POSTs every event to the webhook URL
+func NewWebhook() Sink {
+	return &webhook{
+		url:    os.Getenv(envWebhookURL),
+		client: &http.Client{Timeout: getWebhookTimeout()},
+		policy: webhookRetryPolicy.WithEnvOverrides(),
+	}
+}
+
+// Handle POSTs the event, retrying while the webhook is unreachable or answers with a 5xx or 429
+func (w *webhook) Handle(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "webhook: failed to marshal event")
+	}
+	return w.policy.Do(func() error {
+		resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return errors.Wrap(err, "webhook: failed to POST event")
+		}
+		// Drain the body so that the connection can be reused
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		err = errors.Errorf("webhook: POST returned %s", resp.Status)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return err
+		}
+		return retry.NewRetriableError(retry.NewRetriable(false), err)
+	})
+}
+
+// redactedWebhookURL returns the webhook URL without its credentials and query, which may hold tokens
+func redactedWebhookURL() string {
+	value := os.Getenv(envWebhookURL)
+	u, err := url.Parse(value)
+	if err != nil || value == "" {
+		return ""
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
+
+// GetConfigForDebug returns the active values of the configuration env vars (for debugging purposes)
+func GetConfigForDebug() map[string]interface{} {
+	config := map[string]interface{}{
+		envWebhookURL:     redactedWebhookURL(),
+		envWebhookTimeout: getWebhookTimeout().String(),
+	}
+	for k, v := range getDNSConfigForDebug() {
+		config[k] = v
+	}
+	return config
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package k8sapi
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/operator-framework/operator-sdk/pkg/k8sclient"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// envKubeAPIQPS is the name of the environment variable that sets how many requests per second the Kubernetes client
+	// of ipamd and of the metrics helper sends to the API server on average. Defaults to the client-go default, 5.
+	envKubeAPIQPS = "AWS_VPC_K8S_CNI_KUBE_API_QPS"
+
+	// envKubeAPIBurst is the name of the environment variable that sets how many requests the Kubernetes client can send
+	// at once above its QPS. Defaults to the client-go default, 10.
+	envKubeAPIBurst = "AWS_VPC_K8S_CNI_KUBE_API_BURST"
+
+	// envPodResyncPeriod is the name of the environment variable that sets how often every pod in the cache of the pod
+	// informer is handled again, e.g. "10m", which repairs the local pod state after a missed update without a call to
+	// the API server. Defaults to 0, never.
+	envPodResyncPeriod = "AWS_VPC_K8S_CNI_POD_RESYNC_PERIOD"
+
+	// envPodWatchTimeout is the name of the environment variable that sets how long the pod informer keeps a watch open
+	// before it opens a new one from the last resource version it saw, e.g. "30m". Longer watches send fewer requests to
+	// the API server. Pods are only listed again when the resource version expired. Defaults to a random duration between
+	// 5 and 10 minutes, as chosen by client-go.
+	envPodWatchTimeout = "AWS_VPC_K8S_CNI_POD_WATCH_TIMEOUT"
+)
+
+// GetKubeClient returns a client of the API server with the QPS and burst set by AWS_VPC_K8S_CNI_KUBE_API_QPS and
+// AWS_VPC_K8S_CNI_KUBE_API_BURST
+func GetKubeClient() (clientset.Interface, error) {
+	cfg := rest.CopyConfig(k8sclient.GetKubeConfig())
+	cfg.QPS = getKubeAPIQPS()
+	cfg.Burst = getKubeAPIBurst()
+	log.Infof("Using Kubernetes client QPS %v, burst %d", cfg.QPS, cfg.Burst)
+	return clientset.NewForConfig(cfg)
+}
+
+// withPodWatchTimeout returns the list options modifier of the pod informer, which sets the timeout of its watches
+func withPodWatchTimeout(timeout time.Duration) func(*metav1.ListOptions) {
+	return func(options *metav1.ListOptions) {
+		// Only the watches have a timeout, the lists are served from the cache of the API server
+		if timeout > 0 && options.Watch {
+			seconds := int64(timeout.Seconds())
+			options.TimeoutSeconds = &seconds
+		}
+	}
+}
+
+func getKubeAPIQPS() float32 {
+	if strValue := os.Getenv(envKubeAPIQPS); strValue != "" {
+		parsedValue, err := strconv.ParseFloat(strValue, 32)
+		if err == nil && parsedValue > 0 {
+			return float32(parsedValue)
+		}
+		log.Errorf("Failed to parse %s %q; using default: %v", envKubeAPIQPS, strValue, rest.DefaultQPS)
+	}
+	return rest.DefaultQPS
+}
+
+func getKubeAPIBurst() int {
+	if strValue := os.Getenv(envKubeAPIBurst); strValue != "" {
+		parsedValue, err := strconv.Atoi(strValue)
+		if err == nil && parsedValue > 0 {
+			return parsedValue
+		}
+		log.Errorf("Failed to parse %s %q; using default: %d", envKubeAPIBurst, strValue, rest.DefaultBurst)
+	}
+	return rest.DefaultBurst
+}
+
+// getDurationEnvVar returns the non-negative duration set by the environment variable, or 0 if it is not set or not valid
+func getDurationEnvVar(name string) time.Duration {
+	if strValue := os.Getenv(name); strValue != "" {
+		parsedValue, err := time.ParseDuration(strValue)
+		if err == nil && parsedValue >= 0 {
+			return parsedValue
+		}
+		log.Errorf("Failed to parse %s %q; using default: 0", name, strValue)
+	}
+	return 0
+}
+
+// GetConfigForDebug returns the active values of the configuration env vars (for debugging purposes).
+func GetConfigForDebug() map[string]interface{} {
+	return map[string]interface{}{
+		envKubeAPIQPS:      getKubeAPIQPS(),
+		envKubeAPIBurst:    getKubeAPIBurst(),
+		envPodResyncPeriod: getDurationEnvVar(envPodResyncPeriod).String(),
+		envPodWatchTimeout: getDurationEnvVar(envPodWatchTimeout).String(),
+	}
+}
@@ -2,6 +2,7 @@
 package k8sapi
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
@@ -14,9 +15,10 @@ import (
 
 	clientset "k8s.io/client-go/kubernetes"
 
-	"github.com/operator-framework/operator-sdk/pkg/k8sclient"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
@@ -39,6 +41,36 @@ const (
 // K8SAPIs defines interface to use kubelet introspection API
 type K8SAPIs interface {
 	K8SGetLocalPodIPs() ([]*K8SPodInfo, error)
+	// K8SGetPendingPods returns the pods scheduled on the local node that do not have an IP in their status yet
+	K8SGetPendingPods() []*K8SPodInfo
+	// K8SGetNamespaceLabels returns the labels of the given namespace
+	K8SGetNamespaceLabels(namespace string) (map[string]string, error)
+	// K8SGetNamespaceAnnotations returns the annotations of the given namespace
+	K8SGetNamespaceAnnotations(namespace string) (map[string]string, error)
+	// K8SGetNodeLabels returns the labels of the local node
+	K8SGetNodeLabels() (map[string]string, error)
+	// K8SGetNodeAnnotations returns the annotations of the local node
+	K8SGetNodeAnnotations() (map[string]string, error)
+	// K8SNodeShuttingDown returns whether the kubelet of the local node reports that the node is shutting down
+	K8SNodeShuttingDown() (bool, error)
+	// K8SGetPodAnnotations returns the annotations of the given pod
+	K8SGetPodAnnotations(namespace, name string) (map[string]string, error)
+	// K8SEmitNodeEvent records an event on the local node
+	K8SEmitNodeEvent(eventType, reason, message string) error
+	// K8SEmitPodEvent records an event on the given pod
+	K8SEmitPodEvent(namespace, name, eventType, reason, message string) error
+	// K8SSetNodeCondition sets a condition in the status of the local node
+	K8SSetNodeCondition(conditionType string, status bool, reason, message string) error
+	// K8SSetNodeAnnotations sets annotations on the local node
+	K8SSetNodeAnnotations(annotations map[string]string) error
+	// K8SSetNodeExtendedResource sets the capacity of an extended resource of the local node
+	K8SSetNodeExtendedResource(name string, quantity int64) error
+	// K8SGetConfigMapData returns the data of a config map
+	K8SGetConfigMapData(namespace, name string) (map[string]string, error)
+	// K8SPatchConfigMapData sets keys in the data of an existing config map, and deletes the keys set to nil
+	K8SPatchConfigMapData(namespace, name string, data map[string]*string) error
+	// K8SListNodeNames returns the names of the nodes of the cluster
+	K8SListNodeNames() ([]string, error)
 }
 
 // K8SPodInfo provides pod info
@@ -52,6 +84,12 @@ type K8SPodInfo struct {
 	// IP is pod's ipv4 address
 	IP  string
 	UID string
+	// Tenant is the tenant the pod belongs to in multi-tenant mode, empty otherwise
+	Tenant string
+	// IPv6 is pod's ipv6 address in dual-stack clusters, which ipamd recovers from the host routes
+	IPv6 string
+	// NUMANode is the NUMA node of the CPUs and devices of the pod, whose local ENIs are preferred, nil if unknown
+	NUMANode *int
 }
 
 // ErrInformerNotSynced indicates that it has not synced with API server yet
@@ -62,6 +100,9 @@ type Controller struct {
 	workerPods     map[string]*K8SPodInfo
 	workerPodsLock sync.RWMutex
 
+	// pendingPods is the set of local pods that are waiting for an IP
+	pendingPods map[string]struct{}
+
 	cniPods     map[string]string
 	cniPodsLock sync.RWMutex
 
@@ -69,19 +110,27 @@ type Controller struct {
 	kubeClient kubernetes.Interface
 	myNodeName string
 	synced     bool
+
+	// namespaces is the cache of the namespaces of the cluster, nil until it is synced
+	namespaces     cache.Indexer
+	namespacesLock sync.RWMutex
 }
 
 // NewController creates a new DiscoveryController
 func NewController(clientset kubernetes.Interface) *Controller {
 	return &Controller{kubeClient: clientset,
-		myNodeName: os.Getenv("MY_NODE_NAME"),
-		cniPods:    make(map[string]string),
-		workerPods: make(map[string]*K8SPodInfo)}
+		myNodeName:  os.Getenv("MY_NODE_NAME"),
+		cniPods:     make(map[string]string),
+		workerPods:  make(map[string]*K8SPodInfo),
+		pendingPods: make(map[string]struct{})}
 }
 
 // CreateKubeClient creates a k8s client
 func CreateKubeClient() (clientset.Interface, error) {
-	kubeClient := k8sclient.GetKubeClient()
+	kubeClient, err := GetKubeClient()
+	if err != nil {
+		return nil, fmt.Errorf("error creating the kubernetes client: %v", err)
+	}
 	// Informers don't seem to do a good job logging error messages when it
 	// can't reach the server, making debugging hard. This makes it easier to
 	// figure out if apiserver is configured incorrectly.
@@ -90,7 +139,7 @@ func CreateKubeClient() (clientset.Interface, error) {
 	if err != nil {
 		errMsg := "Failed to communicate with K8S Server. Please check instance security groups or http proxy setting"
 		log.Infof(errMsg)
-		fmt.Printf(errMsg)
+		fmt.Print(errMsg)
 		return nil, fmt.Errorf("error communicating with apiserver: %v", err)
 	}
 	log.Infof("Running with Kubernetes cluster version: v%s.%s. git version: %s. git tree state: %s. commit: %s. platform: %s",
@@ -120,7 +169,8 @@ func (d *Controller) GetCNIPods() []string {
 // DiscoverK8SPods discovers Pods running in the cluster
 func (d *Controller) DiscoverK8SPods() {
 	// create the pod watcher
-	podListWatcher := cache.NewListWatchFromClient(d.kubeClient.CoreV1().RESTClient(), "pods", metav1.NamespaceAll, fields.Everything())
+	podListWatcher := cache.NewFilteredListWatchFromClient(d.kubeClient.CoreV1().RESTClient(), "pods", metav1.NamespaceAll,
+		withPodWatchTimeout(getDurationEnvVar(envPodWatchTimeout)))
 
 	// create the workqueue
 	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
@@ -129,7 +179,8 @@ func (d *Controller) DiscoverK8SPods() {
 	// whenever the cache is updated, the pod key is added to the workqueue.
 	// Note that when we finally process the item from the workqueue, we might see a newer version
 	// of the Pod than the version which was responsible for triggering the update.
-	indexer, informer := cache.NewIndexerInformer(podListWatcher, &v1.Pod{}, 0, cache.ResourceEventHandlerFuncs{
+	resyncPeriod := getDurationEnvVar(envPodResyncPeriod)
+	indexer, informer := cache.NewIndexerInformer(podListWatcher, &v1.Pod{}, resyncPeriod, cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			key, err := cache.MetaNamespaceKeyFunc(obj)
 			if err == nil {
@@ -185,6 +236,295 @@ func (d *Controller) K8SGetLocalPodIPs() ([]*K8SPodInfo, error) {
 	return localPods, nil
 }
 
+// K8SGetPendingPods returns the pods scheduled on the local node that are still pending without an IP in their status.
+// The status lags behind the CNI, so some of them may already have an IP in the datastore.
+func (d *Controller) K8SGetPendingPods() []*K8SPodInfo {
+	if !d.synced {
+		return nil
+	}
+
+	d.workerPodsLock.RLock()
+	defer d.workerPodsLock.RUnlock()
+	pods := make([]*K8SPodInfo, 0, len(d.pendingPods))
+	for key := range d.pendingPods {
+		if pod, ok := d.workerPods[key]; ok {
+			podCopy := *pod
+			pods = append(pods, &podCopy)
+		}
+	}
+	return pods
+}
+
+// DiscoverK8SNamespaces caches the namespaces of the cluster, so that their labels and annotations are read without a
+// request to the API server on every ADD
+func (d *Controller) DiscoverK8SNamespaces() {
+	namespaceListWatcher := cache.NewListWatchFromClient(d.kubeClient.CoreV1().RESTClient(), "namespaces",
+		metav1.NamespaceAll, fields.Everything())
+	indexer, informer := cache.NewIndexerInformer(namespaceListWatcher, &v1.Namespace{},
+		getDurationEnvVar(envPodResyncPeriod), cache.ResourceEventHandlerFuncs{}, cache.Indexers{})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go informer.Run(stop)
+	if !cache.WaitForCacheSync(stop, informer.HasSynced) {
+		log.Error("Timed out waiting for the namespace cache to sync")
+		return
+	}
+	log.Info("Synced the namespaces with APIServer")
+	d.namespacesLock.Lock()
+	d.namespaces = indexer
+	d.namespacesLock.Unlock()
+
+	// Wait forever
+	select {}
+}
+
+// getNamespace returns a namespace from the cache, or from the API server when the cache is not synced yet or does not
+// have it yet
+func (d *Controller) getNamespace(namespace string) (*v1.Namespace, error) {
+	d.namespacesLock.RLock()
+	namespaces := d.namespaces
+	d.namespacesLock.RUnlock()
+	if namespaces != nil {
+		obj, exists, err := namespaces.GetByKey(namespace)
+		if err == nil && exists {
+			if ns, ok := obj.(*v1.Namespace); ok {
+				return ns, nil
+			}
+		}
+	}
+	ns, err := d.kubeClient.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get namespace %s", namespace)
+	}
+	return ns, nil
+}
+
+// K8SGetNamespaceLabels returns the labels set on a namespace
+func (d *Controller) K8SGetNamespaceLabels(namespace string) (map[string]string, error) {
+	ns, err := d.getNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return ns.Labels, nil
+}
+
+// K8SGetNamespaceAnnotations returns the annotations set on a namespace
+func (d *Controller) K8SGetNamespaceAnnotations(namespace string) (map[string]string, error) {
+	ns, err := d.getNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return ns.Annotations, nil
+}
+
+// K8SGetPodAnnotations returns the annotations of the given pod, from the cache of the pod informer, or from the API
+// server when the cache is not synced yet or does not have the pod yet
+func (d *Controller) K8SGetPodAnnotations(namespace, name string) (map[string]string, error) {
+	if d.synced {
+		obj, exists, err := d.controller.indexer.GetByKey(namespace + "/" + name)
+		if err == nil && exists {
+			if pod, ok := obj.(*v1.Pod); ok {
+				return pod.Annotations, nil
+			}
+		}
+	}
+	pod, err := d.kubeClient.CoreV1().Pods(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get pod %s/%s", namespace, name)
+	}
+	return pod.Annotations, nil
+}
+
+// K8SGetNodeLabels returns the labels set on the local node
+func (d *Controller) K8SGetNodeLabels() (map[string]string, error) {
+	node, err := d.kubeClient.CoreV1().Nodes().Get(d.myNodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get node %s", d.myNodeName)
+	}
+	return node.Labels, nil
+}
+
+// K8SGetNodeAnnotations returns the annotations set on the local node
+func (d *Controller) K8SGetNodeAnnotations() (map[string]string, error) {
+	node, err := d.kubeClient.CoreV1().Nodes().Get(d.myNodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get node %s", d.myNodeName)
+	}
+	return node.Annotations, nil
+}
+
+// nodeShuttingDownMessage is the message of the Ready condition of a node while its kubelet terminates the pods on a
+// graceful node shutdown
+const nodeShuttingDownMessage = "node is shutting down"
+
+// K8SNodeShuttingDown returns whether the local node is not ready because of a graceful node shutdown of its kubelet
+func (d *Controller) K8SNodeShuttingDown() (bool, error) {
+	node, err := d.kubeClient.CoreV1().Nodes().Get(d.myNodeName, metav1.GetOptions{})
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get node %s", d.myNodeName)
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status != v1.ConditionTrue && strings.Contains(condition.Message, nodeShuttingDownMessage), nil
+		}
+	}
+	return false, nil
+}
+
+// K8SEmitNodeEvent records an event of the given type (Normal or Warning) on the local node, so that it shows up in
+// "kubectl describe node"
+func (d *Controller) K8SEmitNodeEvent(eventType, reason, message string) error {
+	node := v1.ObjectReference{
+		Kind: "Node",
+		Name: d.myNodeName,
+		UID:  types.UID(d.myNodeName),
+	}
+	if err := d.emitEvent(metav1.NamespaceDefault, node, eventType, reason, message); err != nil {
+		return errors.Wrapf(err, "failed to record event %s on node %s", reason, d.myNodeName)
+	}
+	return nil
+}
+
+// K8SEmitPodEvent records an event of the given type (Normal or Warning) on a pod, so that it shows up in
+// "kubectl describe pod"
+func (d *Controller) K8SEmitPodEvent(namespace, name, eventType, reason, message string) error {
+	pod, err := d.kubeClient.CoreV1().Pods(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to get pod %s/%s", namespace, name)
+	}
+	podRef := v1.ObjectReference{
+		Kind:      "Pod",
+		Namespace: namespace,
+		Name:      name,
+		UID:       pod.UID,
+	}
+	if err := d.emitEvent(namespace, podRef, eventType, reason, message); err != nil {
+		return errors.Wrapf(err, "failed to record event %s on pod %s/%s", reason, namespace, name)
+	}
+	return nil
+}
+
+func (d *Controller) emitEvent(namespace string, object v1.ObjectReference, eventType, reason, message string) error {
+	now := metav1.Now()
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: object.Name + ".",
+		},
+		InvolvedObject: object,
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         v1.EventSource{Component: "aws-node", Host: d.myNodeName},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	_, err := d.kubeClient.CoreV1().Events(namespace).Create(event)
+	return err
+}
+
+// K8SSetNodeCondition sets a condition in the status of the local node, leaving the other conditions alone
+func (d *Controller) K8SSetNodeCondition(conditionType string, status bool, reason, message string) error {
+	now := metav1.Now()
+	condition := v1.NodeCondition{
+		Type:               v1.NodeConditionType(conditionType),
+		Status:             v1.ConditionFalse,
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+		Reason:             reason,
+		Message:            message,
+	}
+	if status {
+		condition.Status = v1.ConditionTrue
+	}
+	// Conditions are merged by type, so the patch only replaces ours
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []v1.NodeCondition{condition},
+		},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode condition %s", conditionType)
+	}
+	if _, err := d.kubeClient.CoreV1().Nodes().PatchStatus(d.myNodeName, patch); err != nil {
+		return errors.Wrapf(err, "failed to set condition %s on node %s", conditionType, d.myNodeName)
+	}
+	return nil
+}
+
+// K8SSetNodeAnnotations sets annotations on the local node, leaving its other annotations as they are
+func (d *Controller) K8SSetNodeAnnotations(annotations map[string]string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to encode the node annotations")
+	}
+	if _, err := d.kubeClient.CoreV1().Nodes().Patch(d.myNodeName, types.MergePatchType, patch); err != nil {
+		return errors.Wrapf(err, "failed to set annotations on node %s", d.myNodeName)
+	}
+	return nil
+}
+
+// K8SSetNodeExtendedResource sets the capacity of an extended resource of the local node, leaving its other resources
+// alone. The kubelet keeps the resource and makes it allocatable, so that the scheduler places no more pods requesting
+// it on the node.
+func (d *Controller) K8SSetNodeExtendedResource(name string, quantity int64) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"capacity": v1.ResourceList{
+				v1.ResourceName(name): *resource.NewQuantity(quantity, resource.DecimalSI),
+			},
+		},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode extended resource %s", name)
+	}
+	if _, err := d.kubeClient.CoreV1().Nodes().PatchStatus(d.myNodeName, patch); err != nil {
+		return errors.Wrapf(err, "failed to set extended resource %s on node %s", name, d.myNodeName)
+	}
+	return nil
+}
+
+// K8SGetConfigMapData returns the data of a config map
+func (d *Controller) K8SGetConfigMapData(namespace, name string) (map[string]string, error) {
+	configMap, err := d.kubeClient.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get config map %s/%s", namespace, name)
+	}
+	return configMap.Data, nil
+}
+
+// K8SPatchConfigMapData sets keys in the data of a config map, leaving the other keys alone, so that several nodes can
+// share it. The keys set to nil are deleted. The config map is not created, so that aws-node only needs to patch it, see
+// config/v1.5/pod-ip-export.yaml.
+func (d *Controller) K8SPatchConfigMapData(namespace, name string, data map[string]*string) error {
+	patch, err := json.Marshal(map[string]interface{}{"data": data})
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode the data of config map %s/%s", namespace, name)
+	}
+	if _, err := d.kubeClient.CoreV1().ConfigMaps(namespace).Patch(name, types.MergePatchType, patch); err != nil {
+		return errors.Wrapf(err, "failed to update config map %s/%s", namespace, name)
+	}
+	return nil
+}
+
+// K8SListNodeNames returns the names of the nodes of the cluster, as cached by the API server
+func (d *Controller) K8SListNodeNames() ([]string, error) {
+	nodes, err := d.kubeClient.CoreV1().Nodes().List(metav1.ListOptions{ResourceVersion: "0"})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list the nodes")
+	}
+	names := make([]string, 0, len(nodes.Items))
+	for _, node := range nodes.Items {
+		names = append(names, node.Name)
+	}
+	return names, nil
+}
+
 // The rest of logic/code are taken from kubernetes/client-go/examples/workqueue
 func newController(queue workqueue.RateLimitingInterface, indexer cache.Indexer, informer cache.Controller) *controller {
 	return &controller{
@@ -224,6 +564,7 @@ func (d *Controller) handlePodUpdate(key string) error {
 		d.workerPodsLock.Lock()
 		defer d.workerPodsLock.Unlock()
 		delete(d.workerPods, key)
+		delete(d.pendingPods, key)
 		if strings.HasPrefix(key, metav1.NamespaceSystem+"/"+cniPodName) {
 			d.cniPodsLock.Lock()
 			defer d.cniPodsLock.Unlock()
@@ -261,6 +602,12 @@ func (d *Controller) handlePodUpdate(key string) error {
 			IP:        pod.Status.PodIP,
 		}
 
+		if pod.Status.Phase == v1.PodPending && pod.Status.PodIP == "" {
+			d.pendingPods[key] = struct{}{}
+		} else {
+			delete(d.pendingPods, key)
+		}
+
 		log.Infof("Add/Update for Pod %s on my node, namespace = %s, IP = %s", podName, d.workerPods[key].Namespace, d.workerPods[key].IP)
 	} else if strings.HasPrefix(key, metav1.NamespaceSystem+"/"+cniPodName) {
 		d.cniPodsLock.Lock()
@@ -47,6 +47,43 @@ func (m *MockK8SAPIs) EXPECT() *MockK8SAPIsMockRecorder {
 	return m.recorder
 }
 
+// K8SEmitNodeEvent mocks base method
+func (m *MockK8SAPIs) K8SEmitNodeEvent(arg0, arg1, arg2 string) error {
+	ret := m.ctrl.Call(m, "K8SEmitNodeEvent", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// K8SEmitNodeEvent indicates an expected call of K8SEmitNodeEvent
+func (mr *MockK8SAPIsMockRecorder) K8SEmitNodeEvent(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "K8SEmitNodeEvent", reflect.TypeOf((*MockK8SAPIs)(nil).K8SEmitNodeEvent), arg0, arg1, arg2)
+}
+
+// K8SEmitPodEvent mocks base method
+func (m *MockK8SAPIs) K8SEmitPodEvent(arg0, arg1, arg2, arg3, arg4 string) error {
+	ret := m.ctrl.Call(m, "K8SEmitPodEvent", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// K8SEmitPodEvent indicates an expected call of K8SEmitPodEvent
+func (mr *MockK8SAPIsMockRecorder) K8SEmitPodEvent(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "K8SEmitPodEvent", reflect.TypeOf((*MockK8SAPIs)(nil).K8SEmitPodEvent), arg0, arg1, arg2, arg3, arg4)
+}
+
+// K8SGetConfigMapData mocks base method
+func (m *MockK8SAPIs) K8SGetConfigMapData(arg0, arg1 string) (map[string]string, error) {
+	ret := m.ctrl.Call(m, "K8SGetConfigMapData", arg0, arg1)
+	ret0, _ := ret[0].(map[string]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// K8SGetConfigMapData indicates an expected call of K8SGetConfigMapData
+func (mr *MockK8SAPIsMockRecorder) K8SGetConfigMapData(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "K8SGetConfigMapData", reflect.TypeOf((*MockK8SAPIs)(nil).K8SGetConfigMapData), arg0, arg1)
+}
+
 // K8SGetLocalPodIPs mocks base method
 func (m *MockK8SAPIs) K8SGetLocalPodIPs() ([]*k8sapi.K8SPodInfo, error) {
 	ret := m.ctrl.Call(m, "K8SGetLocalPodIPs")
@@ -59,3 +96,154 @@ func (m *MockK8SAPIs) K8SGetLocalPodIPs() ([]*k8sapi.K8SPodInfo, error) {
 func (mr *MockK8SAPIsMockRecorder) K8SGetLocalPodIPs() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "K8SGetLocalPodIPs", reflect.TypeOf((*MockK8SAPIs)(nil).K8SGetLocalPodIPs))
 }
+
+// K8SGetNamespaceAnnotations mocks base method
+func (m *MockK8SAPIs) K8SGetNamespaceAnnotations(arg0 string) (map[string]string, error) {
+	ret := m.ctrl.Call(m, "K8SGetNamespaceAnnotations", arg0)
+	ret0, _ := ret[0].(map[string]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// K8SGetNamespaceAnnotations indicates an expected call of K8SGetNamespaceAnnotations
+func (mr *MockK8SAPIsMockRecorder) K8SGetNamespaceAnnotations(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "K8SGetNamespaceAnnotations", reflect.TypeOf((*MockK8SAPIs)(nil).K8SGetNamespaceAnnotations), arg0)
+}
+
+// K8SGetNamespaceLabels mocks base method
+func (m *MockK8SAPIs) K8SGetNamespaceLabels(arg0 string) (map[string]string, error) {
+	ret := m.ctrl.Call(m, "K8SGetNamespaceLabels", arg0)
+	ret0, _ := ret[0].(map[string]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// K8SGetNamespaceLabels indicates an expected call of K8SGetNamespaceLabels
+func (mr *MockK8SAPIsMockRecorder) K8SGetNamespaceLabels(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "K8SGetNamespaceLabels", reflect.TypeOf((*MockK8SAPIs)(nil).K8SGetNamespaceLabels), arg0)
+}
+
+// K8SGetNodeAnnotations mocks base method
+func (m *MockK8SAPIs) K8SGetNodeAnnotations() (map[string]string, error) {
+	ret := m.ctrl.Call(m, "K8SGetNodeAnnotations")
+	ret0, _ := ret[0].(map[string]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// K8SGetNodeAnnotations indicates an expected call of K8SGetNodeAnnotations
+func (mr *MockK8SAPIsMockRecorder) K8SGetNodeAnnotations() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "K8SGetNodeAnnotations", reflect.TypeOf((*MockK8SAPIs)(nil).K8SGetNodeAnnotations))
+}
+
+// K8SGetNodeLabels mocks base method
+func (m *MockK8SAPIs) K8SGetNodeLabels() (map[string]string, error) {
+	ret := m.ctrl.Call(m, "K8SGetNodeLabels")
+	ret0, _ := ret[0].(map[string]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// K8SGetNodeLabels indicates an expected call of K8SGetNodeLabels
+func (mr *MockK8SAPIsMockRecorder) K8SGetNodeLabels() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "K8SGetNodeLabels", reflect.TypeOf((*MockK8SAPIs)(nil).K8SGetNodeLabels))
+}
+
+// K8SGetPendingPods mocks base method
+func (m *MockK8SAPIs) K8SGetPendingPods() []*k8sapi.K8SPodInfo {
+	ret := m.ctrl.Call(m, "K8SGetPendingPods")
+	ret0, _ := ret[0].([]*k8sapi.K8SPodInfo)
+	return ret0
+}
+
+// K8SGetPendingPods indicates an expected call of K8SGetPendingPods
+func (mr *MockK8SAPIsMockRecorder) K8SGetPendingPods() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "K8SGetPendingPods", reflect.TypeOf((*MockK8SAPIs)(nil).K8SGetPendingPods))
+}
+
+// K8SGetPodAnnotations mocks base method
+func (m *MockK8SAPIs) K8SGetPodAnnotations(arg0, arg1 string) (map[string]string, error) {
+	ret := m.ctrl.Call(m, "K8SGetPodAnnotations", arg0, arg1)
+	ret0, _ := ret[0].(map[string]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// K8SGetPodAnnotations indicates an expected call of K8SGetPodAnnotations
+func (mr *MockK8SAPIsMockRecorder) K8SGetPodAnnotations(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "K8SGetPodAnnotations", reflect.TypeOf((*MockK8SAPIs)(nil).K8SGetPodAnnotations), arg0, arg1)
+}
+
+// K8SListNodeNames mocks base method
+func (m *MockK8SAPIs) K8SListNodeNames() ([]string, error) {
+	ret := m.ctrl.Call(m, "K8SListNodeNames")
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// K8SListNodeNames indicates an expected call of K8SListNodeNames
+func (mr *MockK8SAPIsMockRecorder) K8SListNodeNames() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "K8SListNodeNames", reflect.TypeOf((*MockK8SAPIs)(nil).K8SListNodeNames))
+}
+
+// K8SNodeShuttingDown mocks base method
+func (m *MockK8SAPIs) K8SNodeShuttingDown() (bool, error) {
+	ret := m.ctrl.Call(m, "K8SNodeShuttingDown")
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// K8SNodeShuttingDown indicates an expected call of K8SNodeShuttingDown
+func (mr *MockK8SAPIsMockRecorder) K8SNodeShuttingDown() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "K8SNodeShuttingDown", reflect.TypeOf((*MockK8SAPIs)(nil).K8SNodeShuttingDown))
+}
+
+// K8SPatchConfigMapData mocks base method
+func (m *MockK8SAPIs) K8SPatchConfigMapData(arg0, arg1 string, arg2 map[string]*string) error {
+	ret := m.ctrl.Call(m, "K8SPatchConfigMapData", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// K8SPatchConfigMapData indicates an expected call of K8SPatchConfigMapData
+func (mr *MockK8SAPIsMockRecorder) K8SPatchConfigMapData(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "K8SPatchConfigMapData", reflect.TypeOf((*MockK8SAPIs)(nil).K8SPatchConfigMapData), arg0, arg1, arg2)
+}
+
+// K8SSetNodeAnnotations mocks base method
+func (m *MockK8SAPIs) K8SSetNodeAnnotations(arg0 map[string]string) error {
+	ret := m.ctrl.Call(m, "K8SSetNodeAnnotations", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// K8SSetNodeAnnotations indicates an expected call of K8SSetNodeAnnotations
+func (mr *MockK8SAPIsMockRecorder) K8SSetNodeAnnotations(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "K8SSetNodeAnnotations", reflect.TypeOf((*MockK8SAPIs)(nil).K8SSetNodeAnnotations), arg0)
+}
+
+// K8SSetNodeCondition mocks base method
+func (m *MockK8SAPIs) K8SSetNodeCondition(arg0 string, arg1 bool, arg2, arg3 string) error {
+	ret := m.ctrl.Call(m, "K8SSetNodeCondition", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// K8SSetNodeCondition indicates an expected call of K8SSetNodeCondition
+func (mr *MockK8SAPIsMockRecorder) K8SSetNodeCondition(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "K8SSetNodeCondition", reflect.TypeOf((*MockK8SAPIs)(nil).K8SSetNodeCondition), arg0, arg1, arg2, arg3)
+}
+
+// K8SSetNodeExtendedResource mocks base method
+func (m *MockK8SAPIs) K8SSetNodeExtendedResource(arg0 string, arg1 int64) error {
+	ret := m.ctrl.Call(m, "K8SSetNodeExtendedResource", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// K8SSetNodeExtendedResource indicates an expected call of K8SSetNodeExtendedResource
+func (mr *MockK8SAPIsMockRecorder) K8SSetNodeExtendedResource(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "K8SSetNodeExtendedResource", reflect.TypeOf((*MockK8SAPIs)(nil).K8SSetNodeExtendedResource), arg0, arg1)
+}
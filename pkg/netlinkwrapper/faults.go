@@ -0,0 +1,132 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package netlinkwrapper
+
+import (
+	"github.com/vishvananda/netlink"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/faultinjection"
+)
+
+// faultyNetLink injects the faults set on the "netlink.<method>" points into the changes made through a NetLink
+type faultyNetLink struct {
+	NetLink
+}
+
+// NewFaultyNetLink wraps a NetLink so that faults can be injected into its link, address, route and rule changes. It
+// returns nl unchanged in binaries built without the faultinjection build tag.
+func NewFaultyNetLink(nl NetLink) NetLink {
+	if !faultinjection.Enabled {
+		return nl
+	}
+	return &faultyNetLink{NetLink: nl}
+}
+
+func (f *faultyNetLink) LinkAdd(link netlink.Link) error {
+	if err := faultinjection.Inject(faultinjection.NetlinkPrefix + "LinkAdd"); err != nil {
+		return err
+	}
+	return f.NetLink.LinkAdd(link)
+}
+
+func (f *faultyNetLink) LinkSetNsFd(link netlink.Link, fd int) error {
+	if err := faultinjection.Inject(faultinjection.NetlinkPrefix + "LinkSetNsFd"); err != nil {
+		return err
+	}
+	return f.NetLink.LinkSetNsFd(link, fd)
+}
+
+func (f *faultyNetLink) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	if err := faultinjection.Inject(faultinjection.NetlinkPrefix + "AddrAdd"); err != nil {
+		return err
+	}
+	return f.NetLink.AddrAdd(link, addr)
+}
+
+func (f *faultyNetLink) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	if err := faultinjection.Inject(faultinjection.NetlinkPrefix + "AddrDel"); err != nil {
+		return err
+	}
+	return f.NetLink.AddrDel(link, addr)
+}
+
+func (f *faultyNetLink) LinkSetUp(link netlink.Link) error {
+	if err := faultinjection.Inject(faultinjection.NetlinkPrefix + "LinkSetUp"); err != nil {
+		return err
+	}
+	return f.NetLink.LinkSetUp(link)
+}
+
+func (f *faultyNetLink) LinkSetDown(link netlink.Link) error {
+	if err := faultinjection.Inject(faultinjection.NetlinkPrefix + "LinkSetDown"); err != nil {
+		return err
+	}
+	return f.NetLink.LinkSetDown(link)
+}
+
+func (f *faultyNetLink) RouteAdd(route *netlink.Route) error {
+	if err := faultinjection.Inject(faultinjection.NetlinkPrefix + "RouteAdd"); err != nil {
+		return err
+	}
+	return f.NetLink.RouteAdd(route)
+}
+
+func (f *faultyNetLink) RouteReplace(route *netlink.Route) error {
+	if err := faultinjection.Inject(faultinjection.NetlinkPrefix + "RouteReplace"); err != nil {
+		return err
+	}
+	return f.NetLink.RouteReplace(route)
+}
+
+func (f *faultyNetLink) RouteDel(route *netlink.Route) error {
+	if err := faultinjection.Inject(faultinjection.NetlinkPrefix + "RouteDel"); err != nil {
+		return err
+	}
+	return f.NetLink.RouteDel(route)
+}
+
+func (f *faultyNetLink) NeighAdd(neigh *netlink.Neigh) error {
+	if err := faultinjection.Inject(faultinjection.NetlinkPrefix + "NeighAdd"); err != nil {
+		return err
+	}
+	return f.NetLink.NeighAdd(neigh)
+}
+
+func (f *faultyNetLink) LinkDel(link netlink.Link) error {
+	if err := faultinjection.Inject(faultinjection.NetlinkPrefix + "LinkDel"); err != nil {
+		return err
+	}
+	return f.NetLink.LinkDel(link)
+}
+
+func (f *faultyNetLink) RuleAdd(rule *netlink.Rule) error {
+	if err := faultinjection.Inject(faultinjection.NetlinkPrefix + "RuleAdd"); err != nil {
+		return err
+	}
+	return f.NetLink.RuleAdd(rule)
+}
+
+func (f *faultyNetLink) RuleDel(rule *netlink.Rule) error {
+	if err := faultinjection.Inject(faultinjection.NetlinkPrefix + "RuleDel"); err != nil {
+		return err
+	}
+	return f.NetLink.RuleDel(rule)
+}
+
+func (f *faultyNetLink) LinkSetMTU(link netlink.Link, mtu int) error {
+	if err := faultinjection.Inject(faultinjection.NetlinkPrefix + "LinkSetMTU"); err != nil {
+		return err
+	}
+	return f.NetLink.LinkSetMTU(link, mtu)
+}
@@ -0,0 +1,45 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build faultinjection
+// +build faultinjection
+
+package netlinkwrapper
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+
+	mock_netlinkwrapper "github.com/aws/amazon-vpc-cni-k8s/pkg/netlinkwrapper/mocks"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/faultinjection"
+)
+
+func TestFaultyNetLink(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	defer faultinjection.Clear("")
+
+	mockNetLink := mock_netlinkwrapper.NewMockNetLink(ctrl)
+	nl := NewFaultyNetLink(mockNetLink)
+	route := &netlink.Route{}
+
+	assert.NoError(t, faultinjection.Set("netlink.RouteAdd", faultinjection.Fault{Error: "network is unreachable", Count: 1}))
+	// The fault is returned without calling netlink
+	assert.Error(t, nl.RouteAdd(route))
+
+	mockNetLink.EXPECT().RouteAdd(route).Return(nil)
+	assert.NoError(t, nl.RouteAdd(route))
+}
@@ -84,6 +84,30 @@ func (mr *MockNetLinkMockRecorder) AddrList(arg0, arg1 interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddrList", reflect.TypeOf((*MockNetLink)(nil).AddrList), arg0, arg1)
 }
 
+// FilterAdd mocks base method
+func (m *MockNetLink) FilterAdd(arg0 netlink.Filter) error {
+	ret := m.ctrl.Call(m, "FilterAdd", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FilterAdd indicates an expected call of FilterAdd
+func (mr *MockNetLinkMockRecorder) FilterAdd(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FilterAdd", reflect.TypeOf((*MockNetLink)(nil).FilterAdd), arg0)
+}
+
+// FilterDel mocks base method
+func (m *MockNetLink) FilterDel(arg0 netlink.Filter) error {
+	ret := m.ctrl.Call(m, "FilterDel", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FilterDel indicates an expected call of FilterDel
+func (mr *MockNetLinkMockRecorder) FilterDel(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FilterDel", reflect.TypeOf((*MockNetLink)(nil).FilterDel), arg0)
+}
+
 // LinkAdd mocks base method
 func (m *MockNetLink) LinkAdd(arg0 netlink.Link) error {
 	ret := m.ctrl.Call(m, "LinkAdd", arg0)
@@ -158,6 +182,18 @@ func (mr *MockNetLinkMockRecorder) LinkSetMTU(arg0, arg1 interface{}) *gomock.Ca
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LinkSetMTU", reflect.TypeOf((*MockNetLink)(nil).LinkSetMTU), arg0, arg1)
 }
 
+// LinkSetName mocks base method
+func (m *MockNetLink) LinkSetName(arg0 netlink.Link, arg1 string) error {
+	ret := m.ctrl.Call(m, "LinkSetName", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// LinkSetName indicates an expected call of LinkSetName
+func (mr *MockNetLinkMockRecorder) LinkSetName(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LinkSetName", reflect.TypeOf((*MockNetLink)(nil).LinkSetName), arg0, arg1)
+}
+
 // LinkSetNsFd mocks base method
 func (m *MockNetLink) LinkSetNsFd(arg0 netlink.Link, arg1 int) error {
 	ret := m.ctrl.Call(m, "LinkSetNsFd", arg0, arg1)
@@ -194,6 +230,19 @@ func (mr *MockNetLinkMockRecorder) NeighAdd(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NeighAdd", reflect.TypeOf((*MockNetLink)(nil).NeighAdd), arg0)
 }
 
+// NeighList mocks base method
+func (m *MockNetLink) NeighList(arg0, arg1 int) ([]netlink.Neigh, error) {
+	ret := m.ctrl.Call(m, "NeighList", arg0, arg1)
+	ret0, _ := ret[0].([]netlink.Neigh)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// NeighList indicates an expected call of NeighList
+func (mr *MockNetLinkMockRecorder) NeighList(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NeighList", reflect.TypeOf((*MockNetLink)(nil).NeighList), arg0, arg1)
+}
+
 // NewRule mocks base method
 func (m *MockNetLink) NewRule() *netlink.Rule {
 	ret := m.ctrl.Call(m, "NewRule")
@@ -219,28 +268,28 @@ func (mr *MockNetLinkMockRecorder) ParseAddr(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ParseAddr", reflect.TypeOf((*MockNetLink)(nil).ParseAddr), arg0)
 }
 
-// RouteAdd mocks base method
-func (m *MockNetLink) RouteAdd(arg0 *netlink.Route) error {
-	ret := m.ctrl.Call(m, "RouteAdd", arg0)
+// QdiscAdd mocks base method
+func (m *MockNetLink) QdiscAdd(arg0 netlink.Qdisc) error {
+	ret := m.ctrl.Call(m, "QdiscAdd", arg0)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// RouteAdd indicates an expected call of RouteAdd
-func (mr *MockNetLinkMockRecorder) RouteAdd(arg0 interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RouteAdd", reflect.TypeOf((*MockNetLink)(nil).RouteAdd), arg0)
+// QdiscAdd indicates an expected call of QdiscAdd
+func (mr *MockNetLinkMockRecorder) QdiscAdd(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "QdiscAdd", reflect.TypeOf((*MockNetLink)(nil).QdiscAdd), arg0)
 }
 
-// RouteReplace mocks base method
-func (m *MockNetLink) RouteReplace(arg0 *netlink.Route) error {
-	ret := m.ctrl.Call(m, "RouteReplace", arg0)
+// RouteAdd mocks base method
+func (m *MockNetLink) RouteAdd(arg0 *netlink.Route) error {
+	ret := m.ctrl.Call(m, "RouteAdd", arg0)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// RouteReplace indicates an expected call of RouteReplace
-func (mr *MockNetLinkMockRecorder) RouteReplace(arg0 interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RouteReplace", reflect.TypeOf((*MockNetLink)(nil).RouteReplace), arg0)
+// RouteAdd indicates an expected call of RouteAdd
+func (mr *MockNetLinkMockRecorder) RouteAdd(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RouteAdd", reflect.TypeOf((*MockNetLink)(nil).RouteAdd), arg0)
 }
 
 // RouteDel mocks base method
@@ -268,6 +317,31 @@ func (mr *MockNetLinkMockRecorder) RouteList(arg0, arg1 interface{}) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RouteList", reflect.TypeOf((*MockNetLink)(nil).RouteList), arg0, arg1)
 }
 
+// RouteListFiltered mocks base method
+func (m *MockNetLink) RouteListFiltered(arg0 int, arg1 *netlink.Route, arg2 uint64) ([]netlink.Route, error) {
+	ret := m.ctrl.Call(m, "RouteListFiltered", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]netlink.Route)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RouteListFiltered indicates an expected call of RouteListFiltered
+func (mr *MockNetLinkMockRecorder) RouteListFiltered(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RouteListFiltered", reflect.TypeOf((*MockNetLink)(nil).RouteListFiltered), arg0, arg1, arg2)
+}
+
+// RouteReplace mocks base method
+func (m *MockNetLink) RouteReplace(arg0 *netlink.Route) error {
+	ret := m.ctrl.Call(m, "RouteReplace", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RouteReplace indicates an expected call of RouteReplace
+func (mr *MockNetLinkMockRecorder) RouteReplace(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RouteReplace", reflect.TypeOf((*MockNetLink)(nil).RouteReplace), arg0)
+}
+
 // RuleAdd mocks base method
 func (m *MockNetLink) RuleAdd(arg0 *netlink.Rule) error {
 	ret := m.ctrl.Call(m, "RuleAdd", arg0)
@@ -25,6 +25,8 @@ type NetLink interface {
 	LinkByName(name string) (netlink.Link, error)
 	// LinkSetNsFd is equivalent to `ip link set $link netns $ns`
 	LinkSetNsFd(link netlink.Link, fd int) error
+	// LinkSetName is equivalent to `ip link set $link name $name`
+	LinkSetName(link netlink.Link, name string) error
 	// ParseAddr parses an address string
 	ParseAddr(s string) (*netlink.Addr, error)
 	// AddrAdd is equivalent to `ip addr add $addr dev $link`
@@ -43,6 +45,8 @@ type NetLink interface {
 	LinkSetDown(link netlink.Link) error
 	// RouteList gets a list of routes in the system.
 	RouteList(link netlink.Link, family int) ([]netlink.Route, error)
+	// RouteListFiltered gets a list of routes in the system matching the filter, e.g. of all route tables
+	RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error)
 	// RouteAdd will add a route to the route table
 	RouteAdd(route *netlink.Route) error
 	// RouteReplace will replace the route in the route table
@@ -51,6 +55,8 @@ type NetLink interface {
 	RouteDel(route *netlink.Route) error
 	// NeighAdd equivalent to: `ip neigh add ....`
 	NeighAdd(neigh *netlink.Neigh) error
+	// NeighList is equivalent to: `ip neigh show dev $link`
+	NeighList(linkIndex, family int) ([]netlink.Neigh, error)
 	// LinkDel equivalent to: `ip link del $link`
 	LinkDel(link netlink.Link) error
 	// NewRule creates a new empty rule
@@ -63,6 +69,12 @@ type NetLink interface {
 	RuleList(family int) ([]netlink.Rule, error)
 	// LinkSetMTU is equivalent to `ip link set dev $link mtu $mtu`
 	LinkSetMTU(link netlink.Link, mtu int) error
+	// QdiscAdd is equivalent to `tc qdisc add`
+	QdiscAdd(qdisc netlink.Qdisc) error
+	// FilterAdd is equivalent to `tc filter add`
+	FilterAdd(filter netlink.Filter) error
+	// FilterDel is equivalent to `tc filter del`
+	FilterDel(filter netlink.Filter) error
 }
 
 type netLink struct {
@@ -85,6 +97,10 @@ func (*netLink) LinkSetNsFd(link netlink.Link, fd int) error {
 	return netlink.LinkSetNsFd(link, fd)
 }
 
+func (*netLink) LinkSetName(link netlink.Link, name string) error {
+	return netlink.LinkSetName(link, name)
+}
+
 func (*netLink) ParseAddr(s string) (*netlink.Addr, error) {
 	return netlink.ParseAddr(s)
 }
@@ -113,6 +129,10 @@ func (*netLink) RouteList(link netlink.Link, family int) ([]netlink.Route, error
 	return netlink.RouteList(link, family)
 }
 
+func (*netLink) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	return netlink.RouteListFiltered(family, filter, filterMask)
+}
+
 func (*netLink) RouteAdd(route *netlink.Route) error {
 	return netlink.RouteAdd(route)
 }
@@ -133,6 +153,10 @@ func (*netLink) NeighAdd(neigh *netlink.Neigh) error {
 	return netlink.NeighAdd(neigh)
 }
 
+func (*netLink) NeighList(linkIndex, family int) ([]netlink.Neigh, error) {
+	return netlink.NeighList(linkIndex, family)
+}
+
 func (*netLink) LinkDel(link netlink.Link) error {
 	return netlink.LinkDel(link)
 }
@@ -157,6 +181,18 @@ func (*netLink) LinkSetMTU(link netlink.Link, mtu int) error {
 	return netlink.LinkSetMTU(link, mtu)
 }
 
+func (*netLink) QdiscAdd(qdisc netlink.Qdisc) error {
+	return netlink.QdiscAdd(qdisc)
+}
+
+func (*netLink) FilterAdd(filter netlink.Filter) error {
+	return netlink.FilterAdd(filter)
+}
+
+func (*netLink) FilterDel(filter netlink.Filter) error {
+	return netlink.FilterDel(filter)
+}
+
 // IsNotExistsError returns true if the error type is syscall.ESRCH
 // This helps us determine if we should ignore this error as the route
 // that we want to cleanup has been deleted already routing table
@@ -0,0 +1,288 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package netlinkwrapper
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+// DefaultThrottlePath is the file holding the token bucket of the route and rule changes. ipamd and every run of the
+// CNI plugin take their tokens from it, so that the changes made when pods are added count against the same limit as
+// the changes of ipamd.
+const DefaultThrottlePath = "/var/run/aws-node/netlink-throttle.json"
+
+// priorityGrace is how long after its retry a waiter in the priority lane keeps the regular lane waiting, so that the
+// regular lane does not take the token the priority lane has waited for
+const priorityGrace = 10 * time.Millisecond
+
+// Lane is the lane a route or rule change waits in for its token
+type Lane int
+
+const (
+	// PriorityLane is for the changes a pod waits for while it is added, it is served first
+	PriorityLane Lane = iota
+	// RegularLane is for the changes made when pods are deleted and by clean-ups and reconciliation, it is only served
+	// when no one waits in the priority lane
+	RegularLane
+)
+
+// bucketState is the token bucket as it is stored in the throttle file
+type bucketState struct {
+	// Rate is the number of changes per second, changes are not throttled when it is not positive
+	Rate   float64   `json:"rate"`
+	Burst  float64   `json:"burst"`
+	Tokens float64   `json:"tokens"`
+	Last   time.Time `json:"last"`
+	// PriorityUntil is when the regular lane may take tokens again, it is pushed back by the waiters in the priority lane
+	PriorityUntil time.Time `json:"priorityUntil"`
+}
+
+// tokenBucket limits the rate of route and rule changes. Its state is kept in a file locked with flock, so that the
+// processes that use the same file share the limit.
+type tokenBucket struct {
+	// lock serializes the goroutines of the process, flock only serializes processes
+	lock sync.Mutex
+	path string
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newTokenBucket(path string) *tokenBucket {
+	return &tokenBucket{
+		path:  path,
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+}
+
+// withState calls fn with the state of the bucket locked, and saves the state fn leaves. When the file does not exist
+// and create is false, fn gets a zero state, which does not throttle, and nothing is saved.
+func (tb *tokenBucket) withState(create bool, fn func(state *bucketState)) error {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+	}
+	f, err := os.OpenFile(tb.path, flags, 0644)
+	if os.IsNotExist(err) && !create {
+		fn(&bucketState{})
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to open netlink throttle %s", tb.path)
+	}
+	// Closing the file releases the flock
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return errors.Wrapf(err, "failed to lock netlink throttle %s", tb.path)
+	}
+
+	var state bucketState
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read netlink throttle %s", tb.path)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return errors.Wrapf(err, "failed to parse netlink throttle %s", tb.path)
+		}
+	}
+	fn(&state)
+	if data, err = json.Marshal(state); err != nil {
+		return errors.Wrapf(err, "failed to encode netlink throttle %s", tb.path)
+	}
+	if err := f.Truncate(0); err != nil {
+		return errors.Wrapf(err, "failed to truncate netlink throttle %s", tb.path)
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return errors.Wrapf(err, "failed to write netlink throttle %s", tb.path)
+	}
+	return nil
+}
+
+// take takes n tokens, up to the burst, for the lane if they are available and returns how many it took, which is 0
+// when changes are not throttled. Otherwise it returns how long to wait before retrying.
+func (tb *tokenBucket) take(lane Lane, n int) (taken int, delay time.Duration, err error) {
+	err = tb.withState(false, func(state *bucketState) {
+		if state.Rate <= 0 {
+			return
+		}
+		now := tb.now()
+		state.Tokens += now.Sub(state.Last).Seconds() * state.Rate
+		if state.Tokens > state.Burst {
+			state.Tokens = state.Burst
+		}
+		state.Last = now
+
+		want := float64(n)
+		if want > state.Burst {
+			want = state.Burst
+		}
+		// The priority lane gets the next tokens as long as anyone is waiting in it
+		if state.Tokens >= want && (lane == PriorityLane || !now.Before(state.PriorityUntil)) {
+			state.Tokens -= want
+			taken = int(want)
+			return
+		}
+		delay = time.Duration((want - state.Tokens) / state.Rate * float64(time.Second))
+		if lane == PriorityLane {
+			if until := now.Add(delay + priorityGrace); until.After(state.PriorityUntil) {
+				state.PriorityUntil = until
+			}
+		} else if wait := state.PriorityUntil.Sub(now); wait > delay {
+			delay = wait
+		}
+		if delay < time.Millisecond {
+			delay = time.Millisecond
+		}
+	})
+	return taken, delay, err
+}
+
+// wait blocks until n tokens, up to the burst, are taken for the lane and returns how many were taken. A change is not
+// held back by a throttle file that cannot be used.
+func (tb *tokenBucket) wait(lane Lane, n int) int {
+	for {
+		taken, delay, err := tb.take(lane, n)
+		if err != nil || delay == 0 {
+			return taken
+		}
+		tb.sleep(delay)
+	}
+}
+
+// refund gives back the tokens a batch did not use
+func (tb *tokenBucket) refund(n int) {
+	if n <= 0 {
+		return
+	}
+	_ = tb.withState(false, func(state *bucketState) {
+		if state.Rate <= 0 {
+			return
+		}
+		state.Tokens += float64(n)
+		if state.Tokens > state.Burst {
+			state.Tokens = state.Burst
+		}
+	})
+}
+
+// ShareThrottle sets up the throttle file at path, so that the route and rule changes of all the NetLinks throttled
+// with it are limited to opsPerSec, allowing bursts of up to burst changes. A non-positive opsPerSec removes the file,
+// which turns throttling off.
+func ShareThrottle(path string, opsPerSec int, burst int) error {
+	if opsPerSec <= 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to remove netlink throttle %s", path)
+		}
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	tb := newTokenBucket(path)
+	return tb.withState(true, func(state *bucketState) {
+		*state = bucketState{
+			Rate:   float64(opsPerSec),
+			Burst:  float64(burst),
+			Tokens: float64(burst),
+			Last:   tb.now(),
+		}
+	})
+}
+
+// throttledNetLink makes the route and rule changes of a NetLink wait for tokens in one lane of a token bucket
+type throttledNetLink struct {
+	NetLink
+	bucket *tokenBucket
+	lane   Lane
+	// prepaid is the number of tokens a batch has left for its changes, it is nil outside of batches
+	prepaid *int
+}
+
+// NewThrottledNetLink wraps a NetLink so that its route and rule changes take tokens from the throttle file at path, in
+// the priority lane. Changes are not throttled as long as the file does not exist, see ShareThrottle.
+func NewThrottledNetLink(nl NetLink, path string) NetLink {
+	return &throttledNetLink{NetLink: nl, bucket: newTokenBucket(path), lane: PriorityLane}
+}
+
+// WithLane returns a NetLink whose route and rule changes wait in the given lane of the throttle of nl. It returns nl
+// when nl is not throttled.
+func WithLane(nl NetLink, lane Lane) NetLink {
+	t, ok := nl.(*throttledNetLink)
+	if !ok {
+		return nl
+	}
+	return &throttledNetLink{NetLink: t.NetLink, bucket: t.bucket, lane: lane}
+}
+
+// Batch makes the route and rule changes of fn as one batch of up to n changes: the tokens of the batch, up to the
+// burst, are taken at once before fn runs, so that the changes follow each other rather than each waiting for a token
+// among the changes of other callers. The tokens fn does not use are given back.
+func Batch(nl NetLink, n int, fn func(NetLink) error) error {
+	t, ok := nl.(*throttledNetLink)
+	if !ok || n <= 0 {
+		return fn(nl)
+	}
+	prepaid := t.bucket.wait(t.lane, n)
+	defer func() {
+		t.bucket.refund(prepaid)
+	}()
+	return fn(&throttledNetLink{NetLink: t.NetLink, bucket: t.bucket, lane: t.lane, prepaid: &prepaid})
+}
+
+// wait takes a token for one change, from the tokens of the batch if there are any left
+func (t *throttledNetLink) wait() {
+	if t.prepaid != nil && *t.prepaid > 0 {
+		*t.prepaid--
+		return
+	}
+	t.bucket.wait(t.lane, 1)
+}
+
+func (t *throttledNetLink) RouteAdd(route *netlink.Route) error {
+	t.wait()
+	return t.NetLink.RouteAdd(route)
+}
+
+func (t *throttledNetLink) RouteReplace(route *netlink.Route) error {
+	t.wait()
+	return t.NetLink.RouteReplace(route)
+}
+
+func (t *throttledNetLink) RouteDel(route *netlink.Route) error {
+	t.wait()
+	return t.NetLink.RouteDel(route)
+}
+
+func (t *throttledNetLink) RuleAdd(rule *netlink.Rule) error {
+	t.wait()
+	return t.NetLink.RuleAdd(rule)
+}
+
+func (t *throttledNetLink) RuleDel(rule *netlink.Rule) error {
+	t.wait()
+	return t.NetLink.RuleDel(rule)
+}
@@ -0,0 +1,171 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package netlinkwrapper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+
+	mock_netlinkwrapper "github.com/aws/amazon-vpc-cni-k8s/pkg/netlinkwrapper/mocks"
+)
+
+// newTestBucket shares a throttle in a temporary file and returns a bucket using it with a fake clock
+func newTestBucket(t *testing.T, opsPerSec, burst int) (*tokenBucket, *time.Time, func()) {
+	dir, err := ioutil.TempDir("", "netlink-throttle")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "throttle.json")
+
+	clock := time.Unix(0, 0)
+	tb := newTokenBucket(path)
+	tb.now = func() time.Time { return clock }
+	tb.sleep = func(d time.Duration) { clock = clock.Add(d) }
+	require.NoError(t, tb.withState(true, func(state *bucketState) {
+		*state = bucketState{Rate: float64(opsPerSec), Burst: float64(burst), Tokens: float64(burst), Last: clock}
+	}))
+	return tb, &clock, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestTokenBucketRate(t *testing.T) {
+	tb, clock, cleanup := newTestBucket(t, 10, 2)
+	defer cleanup()
+
+	// The burst is served immediately
+	assert.Equal(t, 1, tb.wait(RegularLane, 1))
+	assert.Equal(t, 1, tb.wait(RegularLane, 1))
+	assert.Equal(t, time.Unix(0, 0), *clock)
+
+	// Then one change every 100ms
+	tb.wait(RegularLane, 1)
+	assert.Equal(t, 100*time.Millisecond, clock.Sub(time.Unix(0, 0)))
+	tb.wait(PriorityLane, 1)
+	assert.Equal(t, 200*time.Millisecond, clock.Sub(time.Unix(0, 0)))
+}
+
+func TestTokenBucketPriority(t *testing.T) {
+	tb, _, cleanup := newTestBucket(t, 10, 1)
+	defer cleanup()
+
+	assert.Equal(t, 1, tb.wait(PriorityLane, 1))
+
+	// A waiter in the priority lane keeps the regular lane waiting past its own retry
+	taken, delay, err := tb.take(PriorityLane, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, taken)
+	assert.Equal(t, 100*time.Millisecond, delay)
+	_, delay, err = tb.take(RegularLane, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 100*time.Millisecond+priorityGrace, delay)
+
+	// The priority lane gets the token when it retries, the regular lane only gets the next one
+	tb.sleep(100 * time.Millisecond)
+	_, delay, _ = tb.take(RegularLane, 1)
+	assert.Equal(t, priorityGrace, delay)
+	taken, _, _ = tb.take(PriorityLane, 1)
+	assert.Equal(t, 1, taken)
+	tb.sleep(100 * time.Millisecond)
+	taken, _, _ = tb.take(RegularLane, 1)
+	assert.Equal(t, 1, taken)
+}
+
+func TestTokenBucketNotShared(t *testing.T) {
+	tb := newTokenBucket(filepath.Join(os.TempDir(), "netlink-throttle-missing.json"))
+	tb.sleep = func(time.Duration) { t.Fatal("changes are throttled without a throttle file") }
+
+	assert.Equal(t, 0, tb.wait(PriorityLane, 5))
+	tb.refund(5)
+}
+
+func TestShareThrottle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netlink-throttle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "throttle.json")
+
+	assert.NoError(t, ShareThrottle(path, 10, 0))
+	tb := newTokenBucket(path)
+	assert.Equal(t, 1, tb.wait(PriorityLane, 5))
+
+	// Turning throttling off removes the file
+	assert.NoError(t, ShareThrottle(path, 0, 10))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, ShareThrottle(path, 0, 10))
+}
+
+func TestThrottledNetLinkBatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockNetLink := mock_netlinkwrapper.NewMockNetLink(ctrl)
+
+	tb, clock, cleanup := newTestBucket(t, 10, 4)
+	defer cleanup()
+	throttled := &throttledNetLink{NetLink: mockNetLink, bucket: tb, lane: PriorityLane}
+
+	// The tokens of a batch are taken at once, the unused ones are given back
+	route := &netlink.Route{Table: 10}
+	mockNetLink.EXPECT().RouteDel(route).Return(nil)
+	mockNetLink.EXPECT().RouteAdd(route).Return(nil)
+	err := Batch(throttled, 3, func(nl NetLink) error {
+		assert.NoError(t, nl.RouteDel(route))
+		return nl.RouteAdd(route)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Unix(0, 0), *clock)
+	_ = tb.withState(false, func(state *bucketState) {
+		assert.Equal(t, float64(2), state.Tokens)
+	})
+
+	// A batch larger than the burst takes the whole burst, its other changes wait for their own token
+	mockNetLink.EXPECT().RuleDel(gomock.Any()).Return(nil).Times(6)
+	err = Batch(WithLane(throttled, RegularLane), 6, func(nl NetLink) error {
+		for i := 0; i < 6; i++ {
+			assert.NoError(t, nl.RuleDel(&netlink.Rule{Table: 10}))
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 400*time.Millisecond, clock.Sub(time.Unix(0, 0)))
+}
+
+func TestNewThrottledNetLink(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockNetLink := mock_netlinkwrapper.NewMockNetLink(ctrl)
+
+	// Lanes and batches are ignored when the NetLink is not throttled
+	assert.Equal(t, NetLink(mockNetLink), WithLane(mockNetLink, RegularLane))
+	assert.NoError(t, Batch(mockNetLink, 2, func(nl NetLink) error {
+		assert.Equal(t, NetLink(mockNetLink), nl)
+		return nil
+	}))
+
+	// Changes are not throttled as long as there is no throttle file
+	throttled := NewThrottledNetLink(mockNetLink, filepath.Join(os.TempDir(), "netlink-throttle-missing.json"))
+	route := &netlink.Route{Table: 10}
+	mockNetLink.EXPECT().RouteAdd(route).Return(nil)
+	mockNetLink.EXPECT().RouteDel(route).Return(nil)
+	mockNetLink.EXPECT().RouteList(nil, 0).Return(nil, nil)
+	assert.NoError(t, throttled.RouteAdd(route))
+	assert.NoError(t, WithLane(throttled, RegularLane).RouteDel(route))
+	_, err := throttled.RouteList(nil, 0)
+	assert.NoError(t, err)
+}
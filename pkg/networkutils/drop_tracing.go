@@ -0,0 +1,196 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"encoding/csv"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// envDropTracing is the name of the environment variable that counts and logs the packets from or to pods that the
+	// node is likely to drop, in the dropTracingChain mangle chain. Defaults to false.
+	envDropTracing = "AWS_VPC_K8S_CNI_DROP_TRACING"
+
+	// envDropLogRate is the name of the environment variable with the rate the traced packets are logged at, in the
+	// syntax of the iptables limit match. Defaults to defaultDropLogRate.
+	envDropLogRate     = "AWS_VPC_K8S_CNI_DROP_LOG_RATE"
+	defaultDropLogRate = "10/minute"
+
+	// dropTracingChain is the mangle chain that counts and logs the packets likely to be dropped
+	dropTracingChain = "AWS-CNI-DROPS"
+
+	dropTracingComment = "AWS, DROP TRACING"
+	// dropCommentPrefix is followed by the reason in the comment of the rules that count the packets
+	dropCommentPrefix = "AWS, DROP "
+	// dropLogPrefix is followed by the reason in the kernel log, it is at most 29 characters long with the reason
+	dropLogPrefix = "AWS-CNI DROP "
+)
+
+// The reasons the packets traced in dropTracingChain are likely to be dropped
+const (
+	// DropReasonRPFilter is a packet from a pod whose source address is not routed back to the veth it came from, which
+	// the reverse path filter drops. The host route of the pod is missing or points to another veth.
+	DropReasonRPFilter = "rp-filter"
+	// DropReasonInvalidState is a packet from or to a pod of a connection conntrack did not see start, which kube-proxy
+	// drops. It is usually caused by the request and the reply being routed through different interfaces.
+	DropReasonInvalidState = "invalid-state"
+)
+
+// DropReasons are the reasons the traced packets are counted by
+var DropReasons = []string{DropReasonRPFilter, DropReasonInvalidState}
+
+var dropLogRatePattern = regexp.MustCompile(`^[0-9]+/(second|minute|hour|day)$`)
+
+// DropTracingEnabled returns whether the packets likely to be dropped are counted and logged
+func DropTracingEnabled() bool {
+	return getBoolEnvVar(envDropTracing, false)
+}
+
+func getDropLogRate() string {
+	value := os.Getenv(envDropLogRate)
+	if value == "" {
+		return defaultDropLogRate
+	}
+	if !dropLogRatePattern.MatchString(value) {
+		log.Errorf("Failed to parse %s %q, using %s", envDropLogRate, value, defaultDropLogRate)
+		return defaultDropLogRate
+	}
+	return value
+}
+
+// dropTracingRules returns the rules of dropTracingChain. Each match has a rule that counts the packets and one that
+// logs them at a limited rate, both of which let the packets go on.
+func dropTracingRules(vethPattern string, rate string) [][]string {
+	matches := []struct {
+		reason string
+		match  []string
+	}{
+		{DropReasonRPFilter, []string{"-i", vethPattern, "-m", "rpfilter", "--invert"}},
+		{DropReasonInvalidState, []string{"-i", vethPattern, "-m", "conntrack", "--ctstate", "INVALID"}},
+		// The node only forwards the traffic of pods, so this is the traffic to pods coming in through the ENIs
+		{DropReasonInvalidState, []string{"!", "-i", vethPattern, "-m", "addrtype", "!", "--dst-type", "LOCAL",
+			"-m", "conntrack", "--ctstate", "INVALID"}},
+	}
+	var rules [][]string
+	for _, m := range matches {
+		rules = append(rules,
+			append(append([]string{}, m.match...), "-m", "comment", "--comment", dropCommentPrefix+m.reason),
+			append(append([]string{}, m.match...), "-m", "limit", "--limit", rate,
+				"-j", "LOG", "--log-prefix", dropLogPrefix+m.reason+": "))
+	}
+	return rules
+}
+
+// setupDropTracing (re)creates dropTracingChain and the jump to it from mangle PREROUTING, or removes them when drop
+// tracing is off. Recreating the chain resets its counters.
+func (n *linuxNetwork) setupDropTracing(ipt iptablesIface) error {
+	jumpRule := []string{"-m", "comment", "--comment", dropTracingComment, "-j", dropTracingChain}
+	if !n.dropTracing {
+		// Checking the rule fails if the chain was never created, in which case there is nothing to clean up
+		if exists, err := ipt.Exists("mangle", "PREROUTING", jumpRule...); err == nil && exists {
+			if err := ipt.Delete("mangle", "PREROUTING", jumpRule...); err != nil {
+				return errors.Wrap(err, "host network setup: failed to delete drop tracing rule")
+			}
+			if err := ipt.ClearChain("mangle", dropTracingChain); err != nil {
+				return errors.Wrapf(err, "host network setup: failed to clear chain %s", dropTracingChain)
+			}
+			if err := ipt.DeleteChain("mangle", dropTracingChain); err != nil {
+				return errors.Wrapf(err, "host network setup: failed to delete chain %s", dropTracingChain)
+			}
+		}
+		return nil
+	}
+
+	if err := ipt.NewChain("mangle", dropTracingChain); err != nil && !containChainExistErr(err) {
+		return errors.Wrapf(err, "host network setup: failed to add chain %s", dropTracingChain)
+	}
+	if err := ipt.ClearChain("mangle", dropTracingChain); err != nil {
+		return errors.Wrapf(err, "host network setup: failed to clear chain %s", dropTracingChain)
+	}
+	for _, rule := range dropTracingRules(n.vethPattern(), n.dropLogRate) {
+		if err := ipt.Append("mangle", dropTracingChain, rule...); err != nil {
+			return errors.Wrapf(err, "host network setup: failed to add rule to chain %s", dropTracingChain)
+		}
+	}
+	exists, err := ipt.Exists("mangle", "PREROUTING", jumpRule...)
+	if err != nil {
+		return errors.Wrap(err, "host network setup: failed to check existence of drop tracing rule")
+	}
+	if !exists {
+		log.Debugf("Setup Host Network: iptables -I PREROUTING 1 -t mangle %s", strings.Join(jumpRule, " "))
+		if err := ipt.Insert("mangle", "PREROUTING", 1, jumpRule...); err != nil {
+			return errors.Wrap(err, "host network setup: failed to add drop tracing rule")
+		}
+	}
+	return nil
+}
+
+// GetDropCounts returns the number of packets counted for each reason since dropTracingChain was last set up, or nil
+// when drop tracing is off
+func (n *linuxNetwork) GetDropCounts() (map[string]uint64, error) {
+	if !n.dropTracing {
+		return nil, nil
+	}
+	ipt, err := n.newIptables()
+	if err != nil {
+		return nil, errors.Wrap(err, "get drop counts: failed to create iptables")
+	}
+	rules, err := ipt.ListWithCounters("mangle", dropTracingChain)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get drop counts: failed to list chain %s", dropTracingChain)
+	}
+	return parseDropCounts(rules)
+}
+
+// parseDropCounts sums the packet counters of the counting rules of dropTracingChain, listed with `iptables -S -v`,
+// by reason
+func parseDropCounts(rules []string) (map[string]uint64, error) {
+	counts := make(map[string]uint64, len(DropReasons))
+	for _, reason := range DropReasons {
+		counts[reason] = 0
+	}
+	for _, rule := range rules {
+		r := csv.NewReader(strings.NewReader(rule))
+		r.Comma = ' '
+		ruleSpec, err := r.Read()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse rule %s", rule)
+		}
+		reason := ""
+		var packets uint64
+		for i := 0; i+1 < len(ruleSpec); i++ {
+			switch ruleSpec[i] {
+			case "--comment":
+				if strings.HasPrefix(ruleSpec[i+1], dropCommentPrefix) {
+					reason = strings.TrimPrefix(ruleSpec[i+1], dropCommentPrefix)
+				}
+			case "-c":
+				if packets, err = strconv.ParseUint(ruleSpec[i+1], 10, 64); err != nil {
+					return nil, errors.Wrapf(err, "failed to parse the counters of rule %s", rule)
+				}
+			}
+		}
+		if _, ok := counts[reason]; ok {
+			counts[reason] += packets
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"encoding/csv"
+	"net/netip"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// envEgressGateway is the name of the environment variable that lets pods send their egress traffic through the
+	// gateway set by their vpc.amazonaws.com/egress-gateway annotation, e.g. an inspection appliance, instead of having
+	// it SNATed on the node. Defaults to false, since it costs a read of the pod from the API server on every ADD.
+	envEgressGateway = "AWS_VPC_K8S_CNI_EGRESS_GATEWAY"
+
+	// egressGatewayChain is the nat chain that keeps the egress traffic of the pods with a gateway from being SNATed
+	egressGatewayChain = "AWS-EGRESS-GATEWAY"
+
+	egressGatewayComment    = "AWS, EGRESS GATEWAY"
+	egressGatewayVPCComment = "AWS, EGRESS GATEWAY VPC"
+)
+
+// EgressGatewayEnabled returns whether pods can send their egress traffic through a gateway
+func EgressGatewayEnabled() bool {
+	return getBoolEnvVar(envEgressGateway, false)
+}
+
+// egressGatewayRule is the rule of egressGatewayChain that stops the nat table for the traffic of the pod
+func egressGatewayRule(podIP string) []string {
+	return []string{"-s", podIP + "/32", "-m", "comment", "--comment", egressGatewayComment, "-j", "ACCEPT"}
+}
+
+// setupEgressGatewayChain (re)creates the chain that keeps the egress traffic of the pods with a gateway from being
+// SNATed. Their traffic to the VPC goes on to the other rules, e.g. the masquerading of kube-proxy. The rules of the
+// pods are kept, since the pods keep their gateway across restarts of ipamd.
+func (n *linuxNetwork) setupEgressGatewayChain(ipt iptablesIface, vpcCIDRs []netip.Prefix) error {
+	jumpRule := []string{"-m", "comment", "--comment", "AWS EGRESS GATEWAY", "-j", egressGatewayChain}
+	if !n.egressGateway {
+		// Checking the rule fails if the chain was never created, in which case there is nothing to clean up
+		if exists, err := ipt.Exists("nat", "POSTROUTING", jumpRule...); err == nil && exists {
+			if err := ipt.Delete("nat", "POSTROUTING", jumpRule...); err != nil {
+				return errors.Wrap(err, "host network setup: failed to delete egress gateway rule")
+			}
+		}
+		return nil
+	}
+
+	if err := ipt.NewChain("nat", egressGatewayChain); err != nil && !containChainExistErr(err) {
+		return errors.Wrapf(err, "host network setup: failed to add chain %s", egressGatewayChain)
+	}
+	exists, err := ipt.Exists("nat", "POSTROUTING", jumpRule...)
+	if err != nil {
+		return errors.Wrap(err, "host network setup: failed to check existence of egress gateway rule")
+	}
+	podRules, err := listEgressGatewayPodRules(ipt)
+	if err != nil {
+		return err
+	}
+	if err := ipt.ClearChain("nat", egressGatewayChain); err != nil {
+		return errors.Wrapf(err, "host network setup: failed to clear chain %s", egressGatewayChain)
+	}
+	rules := make([][]string, 0, len(vpcCIDRs)+len(podRules))
+	for _, cidr := range vpcCIDRs {
+		rules = append(rules, []string{"-d", cidr.String(), "-m", "comment", "--comment", egressGatewayVPCComment, "-j", "RETURN"})
+	}
+	for _, rule := range append(rules, podRules...) {
+		if err := ipt.Append("nat", egressGatewayChain, rule...); err != nil {
+			return errors.Wrapf(err, "host network setup: failed to add %s rule to chain %s", rule, egressGatewayChain)
+		}
+	}
+	if !exists {
+		// The traffic of the pods must leave the nat table before it reaches the tenant SNAT and the AWS SNAT chain
+		log.Debugf("Setup Host Network: iptables -I POSTROUTING 1 -t nat %s", strings.Join(jumpRule, " "))
+		if err := ipt.Insert("nat", "POSTROUTING", 1, jumpRule...); err != nil {
+			return errors.Wrap(err, "host network setup: failed to add egress gateway rule")
+		}
+	}
+	return nil
+}
+
+// listEgressGatewayPodRules returns the rules of the pods in egressGatewayChain
+func listEgressGatewayPodRules(ipt iptablesIface) ([][]string, error) {
+	rules, err := ipt.List("nat", egressGatewayChain)
+	if err != nil {
+		return nil, errors.Wrapf(err, "host network setup: failed to list chain %s", egressGatewayChain)
+	}
+	var podRules [][]string
+	for _, rule := range rules {
+		r := csv.NewReader(strings.NewReader(rule))
+		r.Comma = ' '
+		ruleSpec, err := r.Read()
+		if err != nil || len(ruleSpec) < 4 || ruleSpec[2] != "-s" {
+			continue
+		}
+		podRules = append(podRules, ruleSpec[2:])
+	}
+	return podRules, nil
+}
+
+// AddEgressGatewayExemption keeps the egress traffic of the pod from being SNATed on the node, so that it reaches its
+// gateway with the IP of the pod
+func (n *linuxNetwork) AddEgressGatewayExemption(podIP string) error {
+	ipt, err := n.newIptables()
+	if err != nil {
+		return errors.Wrap(err, "AddEgressGatewayExemption: failed to create iptables")
+	}
+	rule := egressGatewayRule(podIP)
+	exists, err := ipt.Exists("nat", egressGatewayChain, rule...)
+	if err != nil {
+		return errors.Wrapf(err, "AddEgressGatewayExemption: failed to check the rule of %s", podIP)
+	}
+	if exists {
+		return nil
+	}
+	log.Infof("Adding egress gateway rule for %s", podIP)
+	if err := ipt.Append("nat", egressGatewayChain, rule...); err != nil {
+		return errors.Wrapf(err, "AddEgressGatewayExemption: failed to add the rule of %s", podIP)
+	}
+	return nil
+}
+
+// DelEgressGatewayExemption removes the exemption of the pod from SNAT, and returns whether it had one
+func (n *linuxNetwork) DelEgressGatewayExemption(podIP string) (bool, error) {
+	ipt, err := n.newIptables()
+	if err != nil {
+		return false, errors.Wrap(err, "DelEgressGatewayExemption: failed to create iptables")
+	}
+	rule := egressGatewayRule(podIP)
+	exists, err := ipt.Exists("nat", egressGatewayChain, rule...)
+	if err != nil {
+		return false, errors.Wrapf(err, "DelEgressGatewayExemption: failed to check the rule of %s", podIP)
+	}
+	if !exists {
+		return false, nil
+	}
+	log.Infof("Deleting egress gateway rule for %s", podIP)
+	if err := ipt.Delete("nat", egressGatewayChain, rule...); err != nil {
+		return true, errors.Wrapf(err, "DelEgressGatewayExemption: failed to delete the rule of %s", podIP)
+	}
+	return true, nil
+}
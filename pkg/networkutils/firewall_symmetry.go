@@ -0,0 +1,237 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/cidr"
+)
+
+const (
+	// envFirewallSubnetCIDRs is the name of the environment variable that lists the IPv4 CIDRs of the subnets of the
+	// AWS Network Firewall endpoints. When set, the replies of the pods leave through the ENI their connection came in
+	// through, so that they go back through the firewall endpoint that inspected the request, and the traffic of the
+	// pods to the firewall subnets is not SNATed. Defaults to empty.
+	envFirewallSubnetCIDRs = "AWS_VPC_K8S_CNI_FIREWALL_SUBNET_CIDRS"
+
+	// firewallSymmetryChain is the mangle chain that marks new connections with the ENI they came in through
+	firewallSymmetryChain = "AWS-FIREWALL-SYMMETRY"
+
+	// firewallMarkMask holds the route table of the ENI a connection came in through. It stays clear of the marks of
+	// kube-proxy (0x0000c000), the connmark of the primary ENI and the upper bits used by Calico.
+	firewallMarkMask  = 0x3f000000
+	firewallMarkShift = 24
+	// maxFirewallTable is the last route table that fits in firewallMarkMask, the mask itself stands for the primary ENI
+	maxFirewallTable = firewallMarkMask>>firewallMarkShift - 1
+
+	// firewallRulePriority comes before the rules of the pods, so that their replies follow the mark of the connection
+	firewallRulePriority = 1025
+
+	firewallComment = "AWS, FIREWALL SYMMETRY"
+)
+
+// getFirewallSubnetCIDRs returns the CIDRs of the subnets of the firewall endpoints, empty if symmetric routing is off
+func getFirewallSubnetCIDRs() []netip.Prefix {
+	var cidrs []netip.Prefix
+	for _, item := range strings.Split(os.Getenv(envFirewallSubnetCIDRs), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, err := cidr.Parse(item)
+		if err != nil || !prefix.Addr().Is4() {
+			log.Errorf("getFirewallSubnetCIDRs : ignoring %v is not a valid IPv4 CIDR", item)
+			continue
+		}
+		cidrs = append(cidrs, prefix)
+	}
+	return cidrs
+}
+
+// getSNATExclusions returns the CIDRs the traffic of the pods is not SNATed for, on top of the VPC CIDRs. The firewall
+// subnets must see the IPs of the pods, like the excluded CIDRs.
+func getSNATExclusions() []netip.Prefix {
+	if useExternalSNAT() {
+		return nil
+	}
+	return RemoveOverlappingCIDRs(append(getExcludeSNATCIDRs(), getFirewallSubnetCIDRs()...))
+}
+
+func (n *linuxNetwork) firewallSymmetryEnabled() bool {
+	return len(n.firewallSubnetCIDRs) > 0
+}
+
+// firewallMark returns the connection mark of the ENI with the given route table, 0 for the primary ENI
+func firewallMark(eniTable int) uint32 {
+	if eniTable == 0 {
+		return firewallMarkMask
+	}
+	return uint32(eniTable) << firewallMarkShift
+}
+
+// firewallRule returns the rule that routes the marked replies of the pods with the route table of their ENI
+func (n *linuxNetwork) firewallRule(eniTable int) *netlink.Rule {
+	rule := n.netLink.NewRule()
+	rule.Mark = int(firewallMark(eniTable))
+	rule.Mask = firewallMarkMask
+	rule.Table = eniTable
+	if eniTable == 0 {
+		rule.Table = mainRoutingTable
+	}
+	rule.Priority = firewallRulePriority
+	return rule
+}
+
+// isFirewallRule returns whether the rule was added for symmetric routing. It looks up the route table of an ENI, but
+// does not keep the ENI in use, since any ENI with that route table is marked the same way.
+func isFirewallRule(rule netlink.Rule) bool {
+	return rule.Priority == firewallRulePriority && rule.Mask == firewallMarkMask
+}
+
+// firewallMarkRule is the rule of firewallSymmetryChain that marks the new connections coming in through the interface
+func firewallMarkRule(ifName string, eniTable int) []string {
+	return []string{"-i", ifName, "-m", "comment", "--comment", firewallComment,
+		"-j", "CONNMARK", "--set-mark", fmt.Sprintf("%#x/%#x", firewallMark(eniTable), firewallMarkMask)}
+}
+
+// setupFirewallSymmetry (re)creates the chain that marks the connections coming in through the primary ENI, and the rule
+// that routes their replies with the main route table. The rules of the secondary ENIs are added by SetupENINetwork.
+func (n *linuxNetwork) setupFirewallSymmetry(ipt iptablesIface, primaryIntf string) error {
+	jumpRule := []string{"-m", "conntrack", "--ctstate", "NEW",
+		"-m", "comment", "--comment", "AWS FIREWALL SYMMETRY", "-j", firewallSymmetryChain}
+	if !n.firewallSymmetryEnabled() {
+		// Checking the rule fails if the chain was never created, in which case there is nothing to clean up
+		if exists, err := ipt.Exists("mangle", "PREROUTING", jumpRule...); err == nil && exists {
+			if err := ipt.Delete("mangle", "PREROUTING", jumpRule...); err != nil {
+				return errors.Wrap(err, "host network setup: failed to delete firewall symmetry rule")
+			}
+			return n.deleteFirewallRules()
+		}
+		return nil
+	}
+
+	if err := n.addFirewallRule(0); err != nil {
+		return err
+	}
+	if err := ipt.NewChain("mangle", firewallSymmetryChain); err != nil && !containChainExistErr(err) {
+		return errors.Wrapf(err, "host network setup: failed to add chain %s", firewallSymmetryChain)
+	}
+	exists, err := ipt.Exists("mangle", "PREROUTING", jumpRule...)
+	if err != nil {
+		return errors.Wrap(err, "host network setup: failed to check existence of firewall symmetry rule")
+	}
+	if err := ipt.ClearChain("mangle", firewallSymmetryChain); err != nil {
+		return errors.Wrapf(err, "host network setup: failed to clear chain %s", firewallSymmetryChain)
+	}
+	if err := ipt.Append("mangle", firewallSymmetryChain, firewallMarkRule(primaryIntf, 0)...); err != nil {
+		return errors.Wrapf(err, "host network setup: failed to add rule to chain %s", firewallSymmetryChain)
+	}
+	if !exists {
+		log.Debugf("Setup Host Network: iptables -I PREROUTING 1 -t mangle %s", strings.Join(jumpRule, " "))
+		if err := ipt.Insert("mangle", "PREROUTING", 1, jumpRule...); err != nil {
+			return errors.Wrap(err, "host network setup: failed to add firewall symmetry rule")
+		}
+	}
+	return nil
+}
+
+// addFirewallRule (re)adds the rule that routes the replies to the connections of the ENI with its route table
+func (n *linuxNetwork) addFirewallRule(eniTable int) error {
+	rule := n.firewallRule(eniTable)
+	if err := n.netLink.RuleDel(rule); err != nil && !containsNoSuchRule(err) {
+		return errors.Wrapf(err, "failed to delete old firewall symmetry rule for table %d", eniTable)
+	}
+	if err := n.netLink.RuleAdd(rule); err != nil {
+		return errors.Wrapf(err, "failed to add firewall symmetry rule for table %d", eniTable)
+	}
+	return nil
+}
+
+// deleteFirewallRules removes the rules of every ENI once symmetric routing is turned off
+func (n *linuxNetwork) deleteFirewallRules() error {
+	rules, err := n.netLink.RuleList(unix.AF_INET)
+	if err != nil {
+		return errors.Wrap(err, "host network setup: failed to list rules")
+	}
+	for _, rule := range rules {
+		if !isFirewallRule(rule) {
+			continue
+		}
+		rule := rule
+		log.Infof("Deleting firewall symmetry rule %s", rule.String())
+		if err := n.regularNetLink().RuleDel(&rule); err != nil && !containsNoSuchRule(err) {
+			return errors.Wrapf(err, "host network setup: failed to delete firewall symmetry rule %s", rule.String())
+		}
+	}
+	return nil
+}
+
+// updateFirewallSymmetry makes sure that the connections coming in through the ENI interface are marked with its route
+// table, and that their replies are routed with it
+func (n *linuxNetwork) updateFirewallSymmetry(ifName string, eniTable int) error {
+	if eniTable > maxFirewallTable {
+		log.Warnf("Replies to the connections of %s are not routed symmetrically, route table %d does not fit in "+
+			"the connection mark", ifName, eniTable)
+		return nil
+	}
+	if err := n.addFirewallRule(eniTable); err != nil {
+		return errors.Wrap(err, "updateFirewallSymmetry")
+	}
+
+	ipt, err := n.newIptables()
+	if err != nil {
+		return errors.Wrap(err, "updateFirewallSymmetry: failed to create iptables")
+	}
+	markRule := firewallMarkRule(ifName, eniTable)
+	rules, err := ipt.List("mangle", firewallSymmetryChain)
+	if err != nil {
+		return errors.Wrapf(err, "updateFirewallSymmetry: failed to list chain %s", firewallSymmetryChain)
+	}
+	exists := false
+	for _, rule := range rules {
+		r := csv.NewReader(strings.NewReader(rule))
+		r.Comma = ' '
+		ruleSpec, err := r.Read()
+		if err != nil || len(ruleSpec) < 4 || ruleSpec[2] != "-i" || ruleSpec[3] != ifName {
+			continue
+		}
+		if sameRuleSpec(ruleSpec[2:], markRule) {
+			exists = true
+			continue
+		}
+		// The interface now belongs to another ENI
+		log.Infof("Deleting stale firewall symmetry rule %v", ruleSpec[2:])
+		if err := ipt.Delete("mangle", firewallSymmetryChain, ruleSpec[2:]...); err != nil {
+			return errors.Wrapf(err, "updateFirewallSymmetry: failed to delete stale rule for %s", ifName)
+		}
+	}
+	if exists {
+		return nil
+	}
+	log.Infof("Marking the connections coming in through %s with route table %d", ifName, eniTable)
+	if err := ipt.Append("mangle", firewallSymmetryChain, markRule...); err != nil {
+		return errors.Wrapf(err, "updateFirewallSymmetry: failed to add rule for %s", ifName)
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// hostSetupChains are the built-in chains that SetupHostNetwork adds rules to, besides the chains of its own
+var hostSetupChains = map[string][]string{
+	"nat":    {"POSTROUTING"},
+	"mangle": {"PREROUTING"},
+}
+
+// HostNetworkSnapshot is the state of what SetupHostNetwork changes: the IPv4 rules at the priorities it uses, the
+// chains of its own and its rules in the built-in chains
+type HostNetworkSnapshot struct {
+	rules []netlink.Rule
+	// chains are the rule specs of each chain, by table
+	chains map[string]map[string][][]string
+}
+
+// isHostSetupRule returns whether an IPv4 rule is at a priority SetupHostNetwork manages
+func isHostSetupRule(rule netlink.Rule) bool {
+	return rule.Priority == hostRulePriority || rule.Priority == unmanagedCIDRRulePriority
+}
+
+// isAWSChain returns whether a chain is one of ours
+func isAWSChain(chain string) bool {
+	return strings.HasPrefix(chain, "AWS-")
+}
+
+// ruleKey identifies an IPv4 rule by the fields SetupHostNetwork sets
+func ruleKey(rule netlink.Rule) string {
+	return fmt.Sprintf("%d %v %v %d/%d %d %v", rule.Priority, rule.Src, rule.Dst, rule.Mark, rule.Mask, rule.Table, rule.Invert)
+}
+
+// SnapshotHostNetwork saves what SetupHostNetwork changes, so that it can be restored if the setup fails
+func (n *linuxNetwork) SnapshotHostNetwork() (*HostNetworkSnapshot, error) {
+	rules, err := n.netLink.RuleList(unix.AF_INET)
+	if err != nil {
+		return nil, errors.Wrap(err, "host network snapshot: failed to list IP rules")
+	}
+	snapshot := &HostNetworkSnapshot{}
+	for _, rule := range rules {
+		if isHostSetupRule(rule) {
+			snapshot.rules = append(snapshot.rules, rule)
+		}
+	}
+
+	ipt, err := n.newIptables()
+	if err != nil {
+		return nil, errors.Wrap(err, "host network snapshot: failed to create iptables")
+	}
+	if snapshot.chains, err = listHostChains(ipt); err != nil {
+		return nil, errors.Wrap(err, "host network snapshot")
+	}
+	return snapshot, nil
+}
+
+// listHostChains returns the rule specs of the chains of ours and of the built-in chains SetupHostNetwork adds rules
+// to, by table
+func listHostChains(ipt iptablesIface) (map[string]map[string][][]string, error) {
+	tables := make(map[string]map[string][][]string)
+	for table, builtins := range hostSetupChains {
+		chains, err := ipt.ListChains(table)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list iptables %s chains", table)
+		}
+		tables[table] = make(map[string][][]string)
+		for _, chain := range append(builtins, chains...) {
+			if !isAWSChain(chain) && !containsString(builtins, chain) {
+				continue
+			}
+			ruleSpecs, err := listRuleSpecs(ipt, table, chain)
+			if err != nil {
+				return nil, err
+			}
+			tables[table][chain] = ruleSpecs
+		}
+	}
+	return tables, nil
+}
+
+// RestoreHostNetwork puts back the state saved by SnapshotHostNetwork. The rules of others in the built-in chains are
+// left alone.
+func (n *linuxNetwork) RestoreHostNetwork(snapshot *HostNetworkSnapshot) error {
+	log.Infof("Restoring the host network to its state before the setup")
+	if err := n.restoreHostRules(snapshot.rules); err != nil {
+		return err
+	}
+	ipt, err := n.newIptables()
+	if err != nil {
+		return errors.Wrap(err, "host network restore: failed to create iptables")
+	}
+	for table, saved := range snapshot.chains {
+		if err := restoreChains(ipt, table, saved); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *linuxNetwork) restoreHostRules(saved []netlink.Rule) error {
+	rules, err := n.netLink.RuleList(unix.AF_INET)
+	if err != nil {
+		return errors.Wrap(err, "host network restore: failed to list IP rules")
+	}
+	savedKeys := make(map[string]bool)
+	for _, rule := range saved {
+		savedKeys[ruleKey(rule)] = true
+	}
+	currentKeys := make(map[string]bool)
+	for _, rule := range rules {
+		if !isHostSetupRule(rule) {
+			continue
+		}
+		currentKeys[ruleKey(rule)] = true
+		if savedKeys[ruleKey(rule)] {
+			continue
+		}
+		rule := rule
+		if err := n.netLink.RuleDel(&rule); err != nil && !containsNoSuchRule(err) {
+			return errors.Wrapf(err, "host network restore: failed to delete rule %s", ruleKey(rule))
+		}
+	}
+	for _, rule := range saved {
+		if currentKeys[ruleKey(rule)] {
+			continue
+		}
+		rule := rule
+		if err := n.netLink.RuleAdd(&rule); err != nil {
+			return errors.Wrapf(err, "host network restore: failed to add rule %s", ruleKey(rule))
+		}
+	}
+	return nil
+}
+
+// restoreChains puts back the chains of ours in a table as they were saved, and our rules in its built-in chains
+func restoreChains(ipt iptablesIface, table string, saved map[string][][]string) error {
+	chains, err := ipt.ListChains(table)
+	if err != nil {
+		return errors.Wrapf(err, "host network restore: failed to list iptables %s chains", table)
+	}
+	for chain, ruleSpecs := range saved {
+		if !isAWSChain(chain) {
+			continue
+		}
+		if err := ipt.NewChain(table, chain); err != nil && !containChainExistErr(err) {
+			return errors.Wrapf(err, "host network restore: failed to add chain %s", chain)
+		}
+		if err := ipt.ClearChain(table, chain); err != nil {
+			return errors.Wrapf(err, "host network restore: failed to flush chain %s", chain)
+		}
+		for _, ruleSpec := range ruleSpecs {
+			if err := ipt.Append(table, chain, ruleSpec...); err != nil {
+				return errors.Wrapf(err, "host network restore: failed to add rule to chain %s", chain)
+			}
+		}
+	}
+
+	for _, chain := range hostSetupChains[table] {
+		if err := restoreAWSRules(ipt, table, chain, saved[chain]); err != nil {
+			return err
+		}
+	}
+
+	// The chains added by the failed setup go once nothing jumps to them anymore
+	for _, chain := range chains {
+		if _, ok := saved[chain]; ok || !isAWSChain(chain) {
+			continue
+		}
+		if err := ipt.ClearChain(table, chain); err != nil {
+			return errors.Wrapf(err, "host network restore: failed to flush chain %s", chain)
+		}
+		if err := ipt.DeleteChain(table, chain); err != nil {
+			return errors.Wrapf(err, "host network restore: failed to delete chain %s", chain)
+		}
+	}
+	return nil
+}
+
+// restoreAWSRules makes the rules of ours in a built-in chain match the saved ones, at the same positions
+func restoreAWSRules(ipt iptablesIface, table, chain string, saved [][]string) error {
+	current, err := listRuleSpecs(ipt, table, chain)
+	if err != nil {
+		return errors.Wrap(err, "host network restore")
+	}
+	for _, ruleSpec := range current {
+		if isAWSRule(ruleSpec) && !containsRuleSpec(saved, ruleSpec) {
+			if err := ipt.Delete(table, chain, ruleSpec...); err != nil {
+				return errors.Wrapf(err, "host network restore: failed to delete rule from chain %s", chain)
+			}
+		}
+	}
+	for i, ruleSpec := range saved {
+		if !isAWSRule(ruleSpec) || containsRuleSpec(current, ruleSpec) {
+			continue
+		}
+		position := i + 1
+		if count, err := listRuleSpecs(ipt, table, chain); err == nil && position > len(count)+1 {
+			position = len(count) + 1
+		}
+		if err := ipt.Insert(table, chain, position, ruleSpec...); err != nil {
+			return errors.Wrapf(err, "host network restore: failed to add rule to chain %s", chain)
+		}
+	}
+	return nil
+}
+
+func containsRuleSpec(ruleSpecs [][]string, ruleSpec []string) bool {
+	for _, other := range ruleSpecs {
+		if sameRuleSpec(other, ruleSpec) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, other := range values {
+		if other == value {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyHostNetwork checks that the rules of the last SetupHostNetwork are in place
+func (n *linuxNetwork) VerifyHostNetwork() error {
+	if n.lastHostRules == nil {
+		return nil
+	}
+	ipt, err := n.newIptables()
+	if err != nil {
+		return errors.Wrap(err, "host network self-test: failed to create iptables")
+	}
+	chains, err := ipt.ListChains("nat")
+	if err != nil {
+		return errors.Wrap(err, "host network self-test: failed to list iptables nat chains")
+	}
+	if !containsString(chains, snatChain) {
+		return errors.Errorf("host network self-test: chain %s is missing", snatChain)
+	}
+	for _, rule := range append(n.lastHostRules.snatRules, n.lastHostRules.otherRules...) {
+		exists, err := ipt.Exists(rule.table, rule.chain, rule.rule...)
+		if err != nil {
+			return errors.Wrapf(err, "host network self-test: failed to check %v", rule)
+		}
+		if exists != rule.shouldExist {
+			return errors.Errorf("host network self-test: %v exists: %v, should exist: %v", rule, exists, rule.shouldExist)
+		}
+	}
+
+	if !n.nodePortSupportEnabled {
+		return nil
+	}
+	rules, err := n.netLink.RuleList(unix.AF_INET)
+	if err != nil {
+		return errors.Wrap(err, "host network self-test: failed to list IP rules")
+	}
+	for _, rule := range rules {
+		if rule.Priority == hostRulePriority && rule.Mark == int(n.mainENIMark) && rule.Table == mainRoutingTable {
+			return nil
+		}
+	}
+	return errors.New("host network self-test: the rule of the main ENI is missing")
+}
@@ -0,0 +1,152 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build integration
+// +build integration
+
+package networkutils
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+	"golang.org/x/sys/unix"
+)
+
+// The kernel backends run the iptables suite against the iptables of the machine, and against the nftables backend
+// with its nft, in a network namespace of their own. They need root and the binaries: `make integration-test-iptables`.
+func init() {
+	iptablesBackends = append(iptablesBackends,
+		iptablesBackend{name: "kernel", new: func(t *testing.T) (iptablesIface, func()) {
+			return newNetNSIptables(t, "iptables", func() (iptablesIface, error) { return iptables.New() })
+		}},
+		iptablesBackend{name: "kernel-nftables", new: func(t *testing.T) (iptablesIface, func()) {
+			if err := exec.Command("nft", "-j", "list", "tables").Run(); err != nil {
+				t.Skipf("nft does not support JSON, it needs 0.9.1 or later: %v", err)
+			}
+			return newNetNSIptables(t, "nft", func() (iptablesIface, error) {
+				return newNFTables(iptables.ProtocolIPv4), nil
+			})
+		}})
+}
+
+// netNSIptables runs iptables, or nft, in a new network namespace. The namespace belongs to a single OS thread, so every call
+// is made from the goroutine locked to it.
+type netNSIptables struct {
+	ipt   iptablesIface
+	calls chan func()
+}
+
+func newNetNSIptables(t *testing.T, binary string, newIptables func() (iptablesIface, error)) (iptablesIface, func()) {
+	if os.Geteuid() != 0 {
+		t.Skipf("running %s in a network namespace needs root", binary)
+	}
+	if _, err := exec.LookPath(binary); err != nil {
+		t.Skipf("%s is not installed", binary)
+	}
+
+	n := &netNSIptables{calls: make(chan func())}
+	ready := make(chan error)
+	go func() {
+		// The thread is never unlocked, so that it exits with the goroutine instead of going back to the pool while
+		// still in the namespace
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			ready <- err
+			return
+		}
+		ready <- nil
+		for call := range n.calls {
+			call()
+		}
+	}()
+	if err := <-ready; err != nil {
+		t.Fatalf("Failed to create a network namespace: %v", err)
+	}
+
+	var err error
+	n.do(func() { n.ipt, err = newIptables() })
+	if err != nil {
+		close(n.calls)
+		t.Fatalf("Failed to run %s: %v", binary, err)
+	}
+	return n, func() { close(n.calls) }
+}
+
+// do runs fn in the network namespace
+func (n *netNSIptables) do(fn func()) {
+	done := make(chan struct{})
+	n.calls <- func() {
+		defer close(done)
+		fn()
+	}
+	<-done
+}
+
+func (n *netNSIptables) Exists(table, chain string, rulespec ...string) (exists bool, err error) {
+	n.do(func() { exists, err = n.ipt.Exists(table, chain, rulespec...) })
+	return exists, err
+}
+
+func (n *netNSIptables) Insert(table, chain string, pos int, rulespec ...string) (err error) {
+	n.do(func() { err = n.ipt.Insert(table, chain, pos, rulespec...) })
+	return err
+}
+
+func (n *netNSIptables) Append(table, chain string, rulespec ...string) (err error) {
+	n.do(func() { err = n.ipt.Append(table, chain, rulespec...) })
+	return err
+}
+
+func (n *netNSIptables) Delete(table, chain string, rulespec ...string) (err error) {
+	n.do(func() { err = n.ipt.Delete(table, chain, rulespec...) })
+	return err
+}
+
+func (n *netNSIptables) List(table, chain string) (rules []string, err error) {
+	n.do(func() { rules, err = n.ipt.List(table, chain) })
+	return rules, err
+}
+
+func (n *netNSIptables) ListWithCounters(table, chain string) (rules []string, err error) {
+	n.do(func() { rules, err = n.ipt.ListWithCounters(table, chain) })
+	return rules, err
+}
+
+func (n *netNSIptables) NewChain(table, chain string) (err error) {
+	n.do(func() { err = n.ipt.NewChain(table, chain) })
+	return err
+}
+
+func (n *netNSIptables) ClearChain(table, chain string) (err error) {
+	n.do(func() { err = n.ipt.ClearChain(table, chain) })
+	return err
+}
+
+func (n *netNSIptables) DeleteChain(table, chain string) (err error) {
+	n.do(func() { err = n.ipt.DeleteChain(table, chain) })
+	return err
+}
+
+func (n *netNSIptables) ListChains(table string) (chains []string, err error) {
+	n.do(func() { chains, err = n.ipt.ListChains(table) })
+	return chains, err
+}
+
+func (n *netNSIptables) HasRandomFully() (hasRandomFully bool) {
+	n.do(func() { hasRandomFully = n.ipt.HasRandomFully() })
+	return hasRandomFully
+}
@@ -0,0 +1,193 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// envIptablesLockTimeout is the name of the environment variable that sets for how many seconds an iptables command
+	// of ipamd is retried while another process, e.g. kube-proxy or a security agent, holds the xtables lock or changes
+	// the nf_tables rules at the same time. Defaults to 30, 0 does not retry.
+	envIptablesLockTimeout     = "AWS_VPC_K8S_CNI_IPTABLES_LOCK_TIMEOUT"
+	defaultIptablesLockTimeout = 30
+
+	iptablesLockRetryInterval = 200 * time.Millisecond
+)
+
+// iptablesLockMessages are in the errors of iptables when it could not take the xtables lock, or when nf_tables
+// rejected a concurrent change
+var iptablesLockMessages = []string{"xtables lock", "Resource temporarily unavailable"}
+
+// iptablesQueue makes the iptables commands of ipamd run one at a time, so that its own goroutines do not contend for
+// the xtables lock with each other on top of the other processes of the node
+var iptablesQueue sync.Mutex
+
+var (
+	// IptablesQueueWait is the time the iptables commands of ipamd waited for its previous ones to finish
+	IptablesQueueWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "awscni_iptables_queue_wait_seconds",
+			Help:    "The time the iptables commands of ipamd waited for its previous ones to finish",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		},
+	)
+	// IptablesLockWait is the time the iptables commands of ipamd were retried because another process held the lock
+	IptablesLockWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "awscni_iptables_lock_wait_seconds",
+			Help:    "The time the iptables commands of ipamd were retried because another process held the xtables lock",
+			Buckets: prometheus.ExponentialBuckets(0.2, 2, 10),
+		},
+	)
+	// IptablesLockTimeouts is the number of iptables commands of ipamd that failed because the lock was held too long
+	IptablesLockTimeouts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "awscni_iptables_lock_timeouts_count",
+			Help: "The number of iptables commands of ipamd that failed because another process held the xtables lock for too long",
+		},
+	)
+)
+
+func getIptablesLockTimeout() time.Duration {
+	timeout := getIntEnvVar(envIptablesLockTimeout, defaultIptablesLockTimeout)
+	if timeout < 0 {
+		log.Errorf("%s must not be negative; will use %d", envIptablesLockTimeout, defaultIptablesLockTimeout)
+		timeout = defaultIptablesLockTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// isIptablesLockError returns whether an iptables command failed because of another process, and can be retried
+func isIptablesLockError(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, message := range iptablesLockMessages {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
+
+// queuedIptables runs the commands of an iptables one at a time with the other ones of ipamd, and retries them while
+// another process holds the xtables lock. go-iptables already waits for the lock with --wait when iptables supports it.
+type queuedIptables struct {
+	ipt     iptablesIface
+	timeout time.Duration
+	sleep   func(time.Duration)
+}
+
+func newQueuedIptables(ipt iptablesIface, timeout time.Duration) iptablesIface {
+	return &queuedIptables{ipt: ipt, timeout: timeout, sleep: time.Sleep}
+}
+
+func (q *queuedIptables) run(command func() error) error {
+	queued := time.Now()
+	iptablesQueue.Lock()
+	defer iptablesQueue.Unlock()
+	IptablesQueueWait.Observe(time.Since(queued).Seconds())
+
+	start := time.Now()
+	err := command()
+	if !isIptablesLockError(err) {
+		return err
+	}
+	for isIptablesLockError(err) && time.Since(start) < q.timeout {
+		log.Debugf("iptables lock is held by another process, retrying: %v", err)
+		q.sleep(iptablesLockRetryInterval)
+		err = command()
+	}
+	IptablesLockWait.Observe(time.Since(start).Seconds())
+	if isIptablesLockError(err) {
+		log.Errorf("iptables lock was held by another process for more than %v: %v", q.timeout, err)
+		IptablesLockTimeouts.Inc()
+	}
+	return err
+}
+
+func (q *queuedIptables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	var exists bool
+	err := q.run(func() error {
+		var err error
+		exists, err = q.ipt.Exists(table, chain, rulespec...)
+		return err
+	})
+	return exists, err
+}
+
+func (q *queuedIptables) Insert(table, chain string, pos int, rulespec ...string) error {
+	return q.run(func() error { return q.ipt.Insert(table, chain, pos, rulespec...) })
+}
+
+func (q *queuedIptables) Append(table, chain string, rulespec ...string) error {
+	return q.run(func() error { return q.ipt.Append(table, chain, rulespec...) })
+}
+
+func (q *queuedIptables) Delete(table, chain string, rulespec ...string) error {
+	return q.run(func() error { return q.ipt.Delete(table, chain, rulespec...) })
+}
+
+func (q *queuedIptables) List(table, chain string) ([]string, error) {
+	var rules []string
+	err := q.run(func() error {
+		var err error
+		rules, err = q.ipt.List(table, chain)
+		return err
+	})
+	return rules, err
+}
+
+func (q *queuedIptables) ListWithCounters(table, chain string) ([]string, error) {
+	var rules []string
+	err := q.run(func() error {
+		var err error
+		rules, err = q.ipt.ListWithCounters(table, chain)
+		return err
+	})
+	return rules, err
+}
+
+func (q *queuedIptables) NewChain(table, chain string) error {
+	return q.run(func() error { return q.ipt.NewChain(table, chain) })
+}
+
+func (q *queuedIptables) ClearChain(table, chain string) error {
+	return q.run(func() error { return q.ipt.ClearChain(table, chain) })
+}
+
+func (q *queuedIptables) DeleteChain(table, chain string) error {
+	return q.run(func() error { return q.ipt.DeleteChain(table, chain) })
+}
+
+func (q *queuedIptables) ListChains(table string) ([]string, error) {
+	var chains []string
+	err := q.run(func() error {
+		var err error
+		chains, err = q.ipt.ListChains(table)
+		return err
+	})
+	return chains, err
+}
+
+func (q *queuedIptables) HasRandomFully() bool {
+	return q.ipt.HasRandomFully()
+}
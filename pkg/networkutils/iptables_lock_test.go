@@ -0,0 +1,70 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// contendedIptables fails its next appends as if another process held the xtables lock
+type contendedIptables struct {
+	*mockIptables
+	failures int
+	appends  int
+}
+
+func (ipt *contendedIptables) Append(table, chain string, rulespec ...string) error {
+	ipt.appends++
+	if ipt.failures > 0 {
+		ipt.failures--
+		return errors.New("running [iptables -t nat -A POSTROUTING --wait]: exit status 4: " +
+			"Another app is currently holding the xtables lock. Perhaps you want to use the -w option?")
+	}
+	return ipt.mockIptables.Append(table, chain, rulespec...)
+}
+
+func TestQueuedIptables(t *testing.T) {
+	ipt := &contendedIptables{mockIptables: newMockIptables(), failures: 2}
+	q := newQueuedIptables(ipt, time.Minute).(*queuedIptables)
+	var slept time.Duration
+	q.sleep = func(d time.Duration) { slept += d }
+	assert.NoError(t, ipt.NewChain("nat", "AWS-SNAT-CHAIN-0"))
+	assert.NoError(t, ipt.NewChain("nat", "AWS-SNAT-CHAIN-1"))
+
+	// Retried until the lock is released
+	assert.NoError(t, q.Append("nat", "POSTROUTING", "-j", "AWS-SNAT-CHAIN-0"))
+	assert.Equal(t, 3, ipt.appends)
+	assert.Equal(t, 2*iptablesLockRetryInterval, slept)
+	exists, err := q.Exists("nat", "POSTROUTING", "-j", "AWS-SNAT-CHAIN-0")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// Not retried after the timeout
+	ipt.failures, ipt.appends = 2, 0
+	q.timeout = 0
+	assert.True(t, isIptablesLockError(q.Append("nat", "POSTROUTING", "-j", "AWS-SNAT-CHAIN-1")))
+	assert.Equal(t, 1, ipt.appends)
+}
+
+func TestIsIptablesLockError(t *testing.T) {
+	assert.False(t, isIptablesLockError(nil))
+	assert.False(t, isIptablesLockError(errors.New("running [iptables -t nat -N AWS-SNAT-CHAIN-0 --wait]: exit status 4: "+
+		"iptables: Chain already exists.")))
+	assert.True(t, isIptablesLockError(errors.New("running [iptables -t nat -A POSTROUTING --wait]: exit status 4: "+
+		"iptables: Resource temporarily unavailable.")))
+}
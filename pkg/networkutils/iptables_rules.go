@@ -0,0 +1,230 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// hostRulesConfig is everything the iptables rules of the host network depend on
+type hostRulesConfig struct {
+	vpcCIDR             netip.Prefix
+	vpcCIDRs            []netip.Prefix
+	excludeSNATCIDRs    []netip.Prefix
+	unmanagedCIDRs      []netip.Prefix
+	unmanagedInterfaces []string
+	primaryAddr         netip.Addr
+	primaryIntf         string
+	nodePortInterfaces  []string
+	vethPattern         string
+	mainENIMark         uint32
+
+	useExternalSNAT bool
+	// snatStrategy is nil for a SNAT without randomization
+	snatStrategy           SNATStrategy
+	snatTarget             snatTarget
+	hasRandomFully         bool
+	nodePortSupportEnabled bool
+	ipvs                   bool
+	tenantSNAT             bool
+	firewallSymmetry       bool
+	// podENI is set when pods can have a branch ENI, whose traffic leaves through a VLAN interface with their own IP
+	podENI bool
+
+	// ipv6 is set to build the ip6tables rules. IPv6 traffic of pods is always routed with the main route table, so
+	// there are no connmark rules, and it is SNATed with MASQUERADE since it does not depend on the node's address.
+	ipv6 bool
+}
+
+// hostRules is the desired state of the iptables rules of the host network
+type hostRules struct {
+	// snatCIDRs are the destinations whose traffic is not SNATed to the primary IP
+	snatCIDRs []snatCIDR
+	// snatRules are the rules of the SNAT chain and the jump to it from nat POSTROUTING
+	snatRules []iptablesRule
+	// otherRules are the connmark rules for node ports and the rules of previous versions to delete
+	otherRules []iptablesRule
+	// tenantSNATRules are the rules of the AWS-TENANT-SNAT chain, nil if tenant SNAT is disabled
+	tenantSNATRules [][]string
+}
+
+// buildHostRules returns the iptables rules for the configuration, without touching iptables so that the chain layout
+// can be tested on its own
+func buildHostRules(cfg hostRulesConfig) hostRules {
+	var rules hostRules
+	for _, cidr := range cfg.vpcCIDRs {
+		rules.snatCIDRs = append(rules.snatCIDRs, snatCIDR{cidr: cidr, isExclusion: false})
+	}
+	for _, cidr := range cfg.excludeSNATCIDRs {
+		rules.snatCIDRs = append(rules.snatCIDRs, snatCIDR{cidr: cidr, isExclusion: true})
+	}
+	for _, cidr := range cfg.unmanagedCIDRs {
+		rules.snatCIDRs = append(rules.snatCIDRs, snatCIDR{cidr: cidr, isExclusion: true})
+	}
+	for _, iface := range cfg.unmanagedInterfaces {
+		rules.snatCIDRs = append(rules.snatCIDRs, snatCIDR{iface: iface, isExclusion: true})
+	}
+	if cfg.podENI {
+		rules.snatCIDRs = append(rules.snatCIDRs, snatCIDR{iface: vlanInterfacePattern, isExclusion: true})
+	}
+
+	// build SNAT rules for outbound non-VPC traffic
+	rules.snatRules = append(rules.snatRules, iptablesRule{
+		name:        "first SNAT rules for non-VPC outbound traffic",
+		shouldExist: !cfg.useExternalSNAT,
+		table:       "nat",
+		chain:       "POSTROUTING",
+		rule:        snatChainJumpRule,
+		positioned:  true,
+	})
+
+	// The traffic to each CIDR returns from the SNAT chain before its last rule. These rules are added at the top of
+	// the chain, so that a CIDR added later is not matched by the SNAT rule first.
+	for i, cidr := range rules.snatCIDRs {
+		comment := "AWS SNAT CHAIN"
+		if cidr.isExclusion {
+			comment += " EXCLUSION"
+		}
+		match := []string{"-d", cidr.cidr.String()}
+		if cidr.iface != "" {
+			match = []string{"-o", cidr.iface}
+			comment = "AWS SNAT CHAIN UNMANAGED"
+		}
+		rules.snatRules = append(rules.snatRules, iptablesRule{
+			name:        fmt.Sprintf("[%d] %s", i, snatChain),
+			shouldExist: !cfg.useExternalSNAT,
+			table:       "nat",
+			chain:       snatChain,
+			rule:        append(match, "-m", "comment", "--comment", comment, "-j", "RETURN"),
+			prepend:     true,
+		})
+	}
+
+	snatRule := []string{"-m", "comment", "--comment", "AWS, SNAT",
+		"-m", "addrtype", "!", "--dst-type", "LOCAL"}
+	if cfg.snatTarget == snatTargetMasquerade || cfg.ipv6 {
+		// MASQUERADE does not depend on the primary IP, so the rule stays the same when the IP changes
+		snatRule = append(snatRule, "-j", "MASQUERADE")
+	} else {
+		snatRule = append(snatRule, "-j", "SNAT", "--to-source", cfg.primaryAddr.String())
+	}
+	if cfg.snatStrategy != nil {
+		snatRule = append(snatRule, cfg.snatStrategy.TargetOptions(cfg.hasRandomFully)...)
+	}
+	rules.snatRules = append(rules.snatRules, iptablesRule{
+		name:        "last SNAT rule for non-VPC outbound traffic",
+		shouldExist: !cfg.useExternalSNAT,
+		table:       "nat",
+		chain:       snatChain,
+		rule:        snatRule,
+	})
+
+	if cfg.ipv6 {
+		return rules
+	}
+
+	nodePortInterfaces := cfg.nodePortInterfaces
+	if len(nodePortInterfaces) == 0 {
+		nodePortInterfaces = []string{cfg.primaryIntf}
+	}
+	for _, iface := range nodePortInterfaces {
+		rules.otherRules = append(rules.otherRules, iptablesRule{
+			name:        fmt.Sprintf("connmark for %s", iface),
+			shouldExist: cfg.nodePortSupportEnabled,
+			table:       "mangle",
+			chain:       "PREROUTING",
+			rule: []string{
+				"-m", "comment", "--comment", nodePortComment,
+				"-i", iface,
+				"-m", "addrtype", "--dst-type", "LOCAL", "--limit-iface-in",
+				"-j", "CONNMARK", "--set-mark", fmt.Sprintf("%#x/%#x", cfg.mainENIMark, cfg.mainENIMark),
+			},
+			positioned: true,
+		})
+	}
+
+	// The external and load balancer IPs of IPVS are local to the node but not on the interface, so the rules above do
+	// not match them
+	for _, iface := range nodePortInterfaces {
+		rules.otherRules = append(rules.otherRules, iptablesRule{
+			name:        ipvsConnmarkRuleName,
+			shouldExist: cfg.nodePortSupportEnabled && cfg.ipvs,
+			table:       "mangle",
+			chain:       "PREROUTING",
+			rule: []string{
+				"-m", "comment", "--comment", nodePortIPVSComment,
+				"-i", iface,
+				"-m", "addrtype", "--dst-type", "LOCAL",
+				"-j", "CONNMARK", "--set-mark", fmt.Sprintf("%#x/%#x", cfg.mainENIMark, cfg.mainENIMark),
+			},
+			positioned: true,
+		})
+	}
+
+	rules.otherRules = append(rules.otherRules, iptablesRule{
+		name:        "connmark restore for primary ENI",
+		shouldExist: cfg.nodePortSupportEnabled,
+		table:       "mangle",
+		chain:       "PREROUTING",
+		rule: []string{
+			"-m", "comment", "--comment", "AWS, primary ENI",
+			"-i", cfg.vethPattern, "-j", "CONNMARK", "--restore-mark", "--mask", fmt.Sprintf("%#x", cfg.mainENIMark),
+		},
+		positioned: true,
+	})
+
+	rules.otherRules = append(rules.otherRules, iptablesRule{
+		name:        "connmark restore for firewall symmetry",
+		shouldExist: cfg.firewallSymmetry,
+		table:       "mangle",
+		chain:       "PREROUTING",
+		rule: []string{
+			"-m", "comment", "--comment", firewallComment,
+			"-i", cfg.vethPattern, "-j", "CONNMARK", "--restore-mark", "--mask", fmt.Sprintf("%#x", firewallMarkMask),
+		},
+		positioned: true,
+	})
+
+	// remove pre-1.3 AWS SNAT rules
+	rules.otherRules = append(rules.otherRules, iptablesRule{
+		name:        fmt.Sprintf("rule for primary address %s", cfg.primaryAddr),
+		shouldExist: false,
+		table:       "nat",
+		chain:       "POSTROUTING",
+		rule: []string{
+			"!", "-d", cfg.vpcCIDR.String(),
+			"-m", "comment", "--comment", "AWS, SNAT",
+			"-m", "addrtype", "!", "--dst-type", "LOCAL",
+			"-j", "SNAT", "--to-source", cfg.primaryAddr.String()}})
+
+	if cfg.tenantSNAT {
+		rules.tenantSNATRules = buildTenantSNATRules(rules.snatCIDRs)
+	}
+	return rules
+}
+
+// buildTenantSNATRules returns the rules of the AWS-TENANT-SNAT chain, which leave the traffic to the VPC and to the
+// excluded CIDRs alone
+func buildTenantSNATRules(snatCIDRs []snatCIDR) [][]string {
+	var rules [][]string
+	for _, cidr := range snatCIDRs {
+		match := []string{"-d", cidr.cidr.String()}
+		if cidr.iface != "" {
+			match = []string{"-o", cidr.iface}
+		}
+		rules = append(rules, append(match, "-j", "RETURN"))
+	}
+	return rules
+}
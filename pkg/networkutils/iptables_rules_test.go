@@ -0,0 +1,211 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Run `go test ./pkg/networkutils -run TestBuildHostRules -update` to rewrite the golden files after changing the rules
+var updateGolden = flag.Bool("update", false, "update the golden files of the iptables rules")
+
+func TestBuildHostRules(t *testing.T) {
+	vpcCIDR := netip.MustParsePrefix("10.10.0.0/16")
+	vpcCIDRv6 := netip.MustParsePrefix("2600:1f14::/56")
+	base := hostRulesConfig{
+		vpcCIDR:      vpcCIDR,
+		vpcCIDRs:     testPrefixes("10.10.0.0/16"),
+		primaryAddr:  netip.MustParseAddr("10.10.10.20"),
+		primaryIntf:  "eth0",
+		vethPattern:  "eni+",
+		mainENIMark:  defaultConnmark,
+		snatStrategy: randomHashSNAT{},
+		snatTarget:   snatTargetSNAT,
+	}
+
+	testCases := []struct {
+		name   string
+		modify func(cfg *hostRulesConfig)
+	}{
+		{"default", func(cfg *hostRulesConfig) {}},
+		{"external_snat", func(cfg *hostRulesConfig) {
+			cfg.useExternalSNAT = true
+		}},
+		{"multiple_vpc_cidrs", func(cfg *hostRulesConfig) {
+			cfg.vpcCIDRs = testPrefixes("10.10.0.0/16", "10.11.0.0/16", "100.64.0.0/10")
+		}},
+		{"exclusions", func(cfg *hostRulesConfig) {
+			cfg.excludeSNATCIDRs = testPrefixes("10.12.0.0/16", "10.13.0.0/16")
+		}},
+		{"unmanaged", func(cfg *hostRulesConfig) {
+			cfg.excludeSNATCIDRs = testPrefixes("10.12.0.0/16")
+			cfg.unmanagedCIDRs = testPrefixes("192.168.0.0/24")
+			cfg.unmanagedInterfaces = []string{"eth3", "wg0"}
+		}},
+		{"external_snat_exclusions", func(cfg *hostRulesConfig) {
+			cfg.useExternalSNAT = true
+			cfg.excludeSNATCIDRs = testPrefixes("10.12.0.0/16")
+		}},
+		{"sequential_snat", func(cfg *hostRulesConfig) {
+			cfg.snatStrategy = sequentialSNAT{}
+		}},
+		{"random_fully", func(cfg *hostRulesConfig) {
+			cfg.snatStrategy = randomPRNGSNAT{}
+			cfg.hasRandomFully = true
+		}},
+		{"random_fully_unsupported", func(cfg *hostRulesConfig) {
+			cfg.snatStrategy = randomPRNGSNAT{}
+		}},
+		{"masquerade", func(cfg *hostRulesConfig) {
+			cfg.snatTarget = snatTargetMasquerade
+			cfg.excludeSNATCIDRs = testPrefixes("10.12.0.0/16")
+		}},
+		{"masquerade_random_fully", func(cfg *hostRulesConfig) {
+			cfg.snatTarget = snatTargetMasquerade
+			cfg.snatStrategy = randomPRNGSNAT{}
+			cfg.hasRandomFully = true
+		}},
+		{"node_port", func(cfg *hostRulesConfig) {
+			cfg.nodePortSupportEnabled = true
+			cfg.primaryIntf = "ens5"
+			cfg.vethPattern = "cali+"
+			cfg.mainENIMark = 0x100
+		}},
+		{"node_port_ipvs", func(cfg *hostRulesConfig) {
+			cfg.nodePortSupportEnabled = true
+			cfg.ipvs = true
+		}},
+		{"node_port_interfaces", func(cfg *hostRulesConfig) {
+			cfg.nodePortSupportEnabled = true
+			cfg.nodePortInterfaces = []string{"eth0", "bond0"}
+			cfg.ipvs = true
+		}},
+		{"istio_preset", func(cfg *hostRulesConfig) {
+			cfg.nodePortSupportEnabled = true
+			cfg.firewallSymmetry = true
+			cfg.mainENIMark = istioConnmark
+		}},
+		{"tenant_snat", func(cfg *hostRulesConfig) {
+			cfg.tenantSNAT = true
+			cfg.excludeSNATCIDRs = testPrefixes("10.12.0.0/16")
+			cfg.unmanagedInterfaces = []string{"eth3"}
+		}},
+		{"pod_eni", func(cfg *hostRulesConfig) {
+			cfg.podENI = true
+			cfg.excludeSNATCIDRs = testPrefixes("10.12.0.0/16")
+		}},
+		{"firewall_symmetry", func(cfg *hostRulesConfig) {
+			cfg.firewallSymmetry = true
+			cfg.excludeSNATCIDRs = testPrefixes("10.20.0.0/24")
+		}},
+		{"ipv6_cidrs", func(cfg *hostRulesConfig) {
+			cfg.vpcCIDR = vpcCIDRv6
+			cfg.vpcCIDRs = testPrefixes("2600:1f14::/56")
+			cfg.excludeSNATCIDRs = testPrefixes("fd00::/8")
+			cfg.primaryAddr = netip.MustParseAddr("2600:1f14::10")
+		}},
+		{"ipv6_snat", func(cfg *hostRulesConfig) {
+			cfg.ipv6 = true
+			cfg.vpcCIDRs = testPrefixes("2600:1f14::/56")
+			cfg.excludeSNATCIDRs = testPrefixes("fd00::/8")
+		}},
+		{"ipv6_no_snat", func(cfg *hostRulesConfig) {
+			cfg.ipv6 = true
+			cfg.vpcCIDRs = testPrefixes("2600:1f14::/56")
+			cfg.useExternalSNAT = true
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := base
+			tc.modify(&cfg)
+			got := renderHostRules(buildHostRules(cfg))
+
+			golden := filepath.Join("testdata", "iptables_rules", tc.name+".golden")
+			if *updateGolden {
+				assert.NoError(t, ioutil.WriteFile(golden, got, 0644))
+			}
+			want, err := ioutil.ReadFile(golden)
+			assert.NoError(t, err)
+			assert.Equal(t, string(want), string(got))
+		})
+	}
+}
+
+func TestBuildHostRulesIstioMarks(t *testing.T) {
+	vpcCIDR := netip.MustParsePrefix("10.10.0.0/16")
+	rules := buildHostRules(hostRulesConfig{
+		vpcCIDR:                vpcCIDR,
+		vpcCIDRs:               testPrefixes("10.10.0.0/16"),
+		primaryAddr:            netip.MustParseAddr("10.10.10.20"),
+		primaryIntf:            "eth0",
+		vethPattern:            "eni+",
+		mainENIMark:            presetConnmark(markPresetIstio),
+		snatStrategy:           randomHashSNAT{},
+		snatTarget:             snatTargetSNAT,
+		nodePortSupportEnabled: true,
+		ipvs:                   true,
+		firewallSymmetry:       true,
+	})
+
+	// Every rule only matches on and changes the marks it owns, which stay clear of the marks of Istio
+	for _, rule := range append(rules.snatRules, rules.otherRules...) {
+		bits := ruleMarkBits(rule.rule)
+		assert.Zero(t, bits&^(istioConnmark|firewallMarkMask), "%v", rule)
+		assert.Zero(t, bits&istioMarkMask, "%v", rule)
+	}
+}
+
+// renderHostRules prints the rules the way iptables-save does, with the rules that must not exist prefixed with "!"
+func renderHostRules(rules hostRules) []byte {
+	var out bytes.Buffer
+	fmt.Fprintln(&out, "# chains")
+	fmt.Fprintf(&out, "-t nat -N %s\n", snatChain)
+	fmt.Fprintln(&out, "# rules")
+	for _, rule := range append(rules.snatRules, rules.otherRules...) {
+		prefix := ""
+		if !rule.shouldExist {
+			prefix = "! "
+		}
+		fmt.Fprintf(&out, "%s-t %s -A %s %s\n", prefix, rule.table, rule.chain, quoteRuleSpec(rule.rule))
+	}
+	if rules.tenantSNATRules != nil {
+		fmt.Fprintln(&out, "# tenant SNAT")
+		for _, rule := range rules.tenantSNATRules {
+			fmt.Fprintf(&out, "-t nat -A %s %s\n", tenantSNATChain, quoteRuleSpec(rule))
+		}
+	}
+	return out.Bytes()
+}
+
+func quoteRuleSpec(ruleSpec []string) string {
+	quoted := make([]string, len(ruleSpec))
+	for i, arg := range ruleSpec {
+		if strings.Contains(arg, " ") {
+			arg = fmt.Sprintf("%q", arg)
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
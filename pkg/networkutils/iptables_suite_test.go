@@ -0,0 +1,280 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/capabilities"
+	mock_netlinkwrapper "github.com/aws/amazon-vpc-cni-k8s/pkg/netlinkwrapper/mocks"
+	mock_procsyswrapper "github.com/aws/amazon-vpc-cni-k8s/pkg/procsyswrapper/mocks"
+)
+
+// iptablesBackend creates the iptables that the suite runs against, and the function that releases it
+type iptablesBackend struct {
+	name string
+	new  func(t *testing.T) (iptablesIface, func())
+}
+
+// iptablesBackends are the iptables the suite runs against. The kernel one is added by the integration build tag, see
+// iptables_kernel_test.go.
+var iptablesBackends = []iptablesBackend{
+	{name: "mock", new: func(t *testing.T) (iptablesIface, func()) {
+		return newMockIptables(), func() {}
+	}},
+}
+
+// iptablesSuite holds the tests that must pass the same way against every backend. They only go through iptablesIface,
+// so that differences between the mock and the kernel in how rules are listed, quoted or matched make them fail.
+var iptablesSuite = []struct {
+	name string
+	test func(t *testing.T, ipt iptablesIface)
+}{
+	{"SetupHostNetworkIsIdempotent", testSetupHostNetworkIsIdempotent},
+	{"SetupHostNetworkRemovesStaleExclusions", testSetupHostNetworkRemovesStaleExclusions},
+	{"SetupHostNetworkExternalSNAT", testSetupHostNetworkExternalSNAT},
+	{"SetupHostNetworkRandomFully", testSetupHostNetworkRandomFully},
+	{"SetupHostNetworkSwitchesSNATTarget", testSetupHostNetworkSwitchesSNATTarget},
+	{"SetupHostNetworkInsertsJump", testSetupHostNetworkInsertsJump},
+	{"CheckSNATRulesRepairsBypass", testCheckSNATRulesRepairsBypass},
+}
+
+func TestIptablesSuite(t *testing.T) {
+	for _, backend := range iptablesBackends {
+		for _, tc := range iptablesSuite {
+			t.Run(backend.name+"/"+tc.name, func(t *testing.T) {
+				ipt, release := backend.new(t)
+				defer release()
+				tc.test(t, ipt)
+			})
+		}
+	}
+}
+
+// newSuiteNetwork returns a linuxNetwork that changes the iptables of the backend, and nothing else
+func newSuiteNetwork(t *testing.T, ctrl *gomock.Controller, ipt iptablesIface) *linuxNetwork {
+	mockNetLink := mock_netlinkwrapper.NewMockNetLink(ctrl)
+	mockNetLink.EXPECT().NewRule().Return(&netlink.Rule{}).AnyTimes()
+	mockNetLink.EXPECT().RuleDel(gomock.Any()).AnyTimes()
+	mockNetLink.EXPECT().RuleAdd(gomock.Any()).AnyTimes()
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil).AnyTimes()
+	mockNetLink.EXPECT().LinkByName(kubeIPVSInterface).Return(nil, errors.New("link not found")).AnyTimes()
+	procSys := mock_procsyswrapper.NewMockProcSys(ctrl)
+	procSys.EXPECT().Set(gomock.Any(), gomock.Any()).AnyTimes()
+	return &linuxNetwork{
+		primaryInterface:       "eth0",
+		excludeSNATCIDRs:       testPrefixes("10.12.0.0/16", "10.13.0.0/16"),
+		nodePortSupportEnabled: true,
+		snatStrategy:           randomHashSNAT{},
+		snatTarget:             snatTargetSNAT,
+		mainENIMark:            defaultConnmark,
+		iptablesCheck:          iptablesCheckWarn,
+
+		netLink: mockNetLink,
+		newIptables: func() (iptablesIface, error) {
+			return ipt, nil
+		},
+		procSys: procSys,
+		capabilities: func() capabilities.Capabilities {
+			return capabilities.Capabilities{IptablesRandomFully: ipt.HasRandomFully()}
+		},
+	}
+}
+
+func setupSuiteHostNetwork(t *testing.T, ln *linuxNetwork) {
+	vpcCIDRs := testPrefixes("10.10.0.0/16", "10.11.0.0/16")
+	require.NoError(t, ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr))
+}
+
+// expectedHostRules returns the rules SetupHostNetwork should have left in place
+func expectedHostRules(ln *linuxNetwork, ipt iptablesIface) []iptablesRule {
+	rules := buildHostRules(hostRulesConfig{
+		vpcCIDR:                testENIPrefix,
+		vpcCIDRs:               testPrefixes("10.10.0.0/16", "10.11.0.0/16"),
+		excludeSNATCIDRs:       ln.excludeSNATCIDRs,
+		primaryAddr:            testENIAddr,
+		primaryIntf:            ln.primaryInterface,
+		vethPattern:            ln.vethPattern(),
+		mainENIMark:            ln.mainENIMark,
+		useExternalSNAT:        ln.useExternalSNAT,
+		snatStrategy:           ln.snatStrategy,
+		snatTarget:             ln.snatTarget,
+		hasRandomFully:         ipt.HasRandomFully(),
+		nodePortSupportEnabled: ln.nodePortSupportEnabled,
+	})
+	return append(rules.snatRules, rules.otherRules...)
+}
+
+// assertHostRules checks, with the matching of the backend, that the rules that should exist do and the others don't
+func assertHostRules(t *testing.T, ln *linuxNetwork, ipt iptablesIface) {
+	for _, rule := range expectedHostRules(ln, ipt) {
+		exists, err := ipt.Exists(rule.table, rule.chain, rule.rule...)
+		if err != nil {
+			// The chain does not exist
+			exists = false
+		}
+		assert.Equal(t, rule.shouldExist, exists, "%s: %s %s %v", rule.name, rule.table, rule.chain, rule.rule)
+	}
+}
+
+// dumpRules lists the chains SetupHostNetwork changes, as listed by the backend
+func dumpRules(t *testing.T, ipt iptablesIface) map[string][]string {
+	dump := make(map[string][]string)
+	chains, err := ipt.ListChains("nat")
+	require.NoError(t, err)
+	for _, chain := range chains {
+		if chain != "POSTROUTING" && !strings.HasPrefix(chain, "AWS-") {
+			continue
+		}
+		rules, err := ipt.List("nat", chain)
+		require.NoError(t, err)
+		dump["nat "+chain] = rules
+	}
+	rules, err := ipt.List("mangle", "PREROUTING")
+	require.NoError(t, err)
+	dump["mangle PREROUTING"] = rules
+	return dump
+}
+
+func testSetupHostNetworkIsIdempotent(t *testing.T, ipt iptablesIface) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ln := newSuiteNetwork(t, ctrl, ipt)
+
+	setupSuiteHostNetwork(t, ln)
+	assertHostRules(t, ln, ipt)
+	first := dumpRules(t, ipt)
+
+	// ipamd restarts
+	setupSuiteHostNetwork(t, ln)
+	assertHostRules(t, ln, ipt)
+	assert.Equal(t, first, dumpRules(t, ipt))
+}
+
+func testSetupHostNetworkRemovesStaleExclusions(t *testing.T, ipt iptablesIface) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ln := newSuiteNetwork(t, ctrl, ipt)
+
+	setupSuiteHostNetwork(t, ln)
+	ln.excludeSNATCIDRs = testPrefixes("10.12.0.0/16")
+	setupSuiteHostNetwork(t, ln)
+	assertHostRules(t, ln, ipt)
+	for chain, rules := range dumpRules(t, ipt) {
+		for _, rule := range rules {
+			assert.NotContains(t, rule, "10.13.0.0/16", "stale rule in %s", chain)
+		}
+	}
+}
+
+func testSetupHostNetworkExternalSNAT(t *testing.T, ipt iptablesIface) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ln := newSuiteNetwork(t, ctrl, ipt)
+
+	setupSuiteHostNetwork(t, ln)
+	ln.useExternalSNAT = true
+	setupSuiteHostNetwork(t, ln)
+	assertHostRules(t, ln, ipt)
+	exists, err := ipt.Exists("nat", "POSTROUTING", snatChainJumpRule...)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func testSetupHostNetworkRandomFully(t *testing.T, ipt iptablesIface) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ln := newSuiteNetwork(t, ctrl, ipt)
+	ln.snatStrategy = randomPRNGSNAT{}
+
+	// Falls back to --random if the iptables of the backend does not support --random-fully
+	setupSuiteHostNetwork(t, ln)
+	assertHostRules(t, ln, ipt)
+}
+
+func testSetupHostNetworkSwitchesSNATTarget(t *testing.T, ipt iptablesIface) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ln := newSuiteNetwork(t, ctrl, ipt)
+
+	setupSuiteHostNetwork(t, ln)
+	ln.snatTarget = snatTargetMasquerade
+	setupSuiteHostNetwork(t, ln)
+	assertHostRules(t, ln, ipt)
+	for chain, rules := range dumpRules(t, ipt) {
+		for _, rule := range rules {
+			assert.NotContains(t, rule, "--to-source", "stale SNAT rule in %s", chain)
+		}
+	}
+
+	ln.snatTarget = snatTargetSNAT
+	setupSuiteHostNetwork(t, ln)
+	assertHostRules(t, ln, ipt)
+	for chain, rules := range dumpRules(t, ipt) {
+		for _, rule := range rules {
+			assert.NotContains(t, rule, "MASQUERADE", "stale MASQUERADE rule in %s", chain)
+		}
+	}
+}
+
+func testSetupHostNetworkInsertsJump(t *testing.T, ipt iptablesIface) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ln := newSuiteNetwork(t, ctrl, ipt)
+	ln.nodePortSupportEnabled = false
+	ln.iptablesRulePosition = iptablesRuleInsert
+
+	masqueradeRule := []string{"!", "-o", "lo", "-j", "MASQUERADE"}
+	require.NoError(t, ipt.Append("nat", "POSTROUTING", masqueradeRule...))
+	setupSuiteHostNetwork(t, ln)
+	setupSuiteHostNetwork(t, ln)
+	assertHostRules(t, ln, ipt)
+
+	ruleSpecs, err := listRuleSpecs(ipt, "nat", "POSTROUTING")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{snatChainJumpRule, masqueradeRule}, ruleSpecs)
+}
+
+func testCheckSNATRulesRepairsBypass(t *testing.T, ipt iptablesIface) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ln := newSuiteNetwork(t, ctrl, ipt)
+
+	setupSuiteHostNetwork(t, ln)
+	result, err := ln.CheckSNATRules()
+	require.NoError(t, err)
+	assert.Empty(t, result.Problems)
+
+	require.NoError(t, ipt.Insert("nat", "POSTROUTING", 1, "!", "-o", "lo", "-j", "MASQUERADE"))
+	result, err = ln.CheckSNATRules()
+	require.NoError(t, err)
+	assert.Equal(t, []string{`nat POSTROUTING rule 1 "! -o lo -j MASQUERADE" comes before the AWS SNAT chain`},
+		result.Problems)
+
+	ln.iptablesCheck = iptablesCheckRepair
+	result, err = ln.CheckSNATRules()
+	require.NoError(t, err)
+	assert.True(t, result.Repaired)
+	result, err = ln.CheckSNATRules()
+	require.NoError(t, err)
+	assert.Empty(t, result.Problems)
+}
@@ -0,0 +1,289 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package iptablestest is an iptables in memory for the tests of the iptables rules, e.g. of networkutils or of
+// plugins chained after the AWS CNI. It has the methods of go-iptables and behaves like iptables where tests can tell
+// the difference: chains must exist before rules are added to them or jumped to, positions must be in the chain, and
+// the errors carry the messages of iptables.
+package iptablestest
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// The messages of the errors of iptables, which callers look for
+const (
+	ErrChainExists   = "iptables: Chain already exists."
+	ErrNoChain       = "iptables: No chain/target/match by that name."
+	ErrBadRule       = "iptables: Bad rule (does a matching rule exist in that chain?)."
+	ErrIndexTooBig   = "iptables: Index of insertion too big."
+	ErrChainInUse    = "iptables: Too many links."
+	ErrChainNotEmpty = "iptables: Directory not empty."
+	ErrBuiltin       = "iptables: Invalid argument. Run `dmesg' for more information."
+)
+
+// builtinChains are the built-in chains of each table, in the order iptables lists them
+var builtinChains = map[string][]string{
+	"filter": {"INPUT", "FORWARD", "OUTPUT"},
+	"nat":    {"PREROUTING", "INPUT", "OUTPUT", "POSTROUTING"},
+	"mangle": {"PREROUTING", "INPUT", "FORWARD", "OUTPUT", "POSTROUTING"},
+	"raw":    {"PREROUTING", "OUTPUT"},
+}
+
+// targets are the targets that are not chains
+var targets = map[string]bool{
+	"ACCEPT": true, "DROP": true, "RETURN": true, "REJECT": true, "LOG": true, "SNAT": true, "DNAT": true,
+	"MASQUERADE": true, "REDIRECT": true, "MARK": true, "CONNMARK": true, "TPROXY": true, "NOTRACK": true,
+}
+
+// Error is an error of Iptables, with the message iptables would print
+type Error struct {
+	msg string
+}
+
+func (e *Error) Error() string {
+	return e.msg
+}
+
+func errorf(format string, args ...interface{}) error {
+	return &Error{msg: fmt.Sprintf(format, args...)}
+}
+
+// Iptables keeps the rules of its chains in memory
+type Iptables struct {
+	// Tables are the rule specs of each chain, by table. The built-in chains exist even when they are not in it, the
+	// other chains exist when they are.
+	Tables map[string]map[string][][]string
+	// RandomFully is what HasRandomFully returns
+	RandomFully bool
+}
+
+// New returns an Iptables without rules, whose SNAT supports --random-fully
+func New() *Iptables {
+	return &Iptables{Tables: make(map[string]map[string][][]string), RandomFully: true}
+}
+
+func isBuiltin(table, chain string) bool {
+	for _, builtin := range builtinChains[table] {
+		if builtin == chain {
+			return true
+		}
+	}
+	return false
+}
+
+// chain returns the rules of the chain, and fails if it does not exist
+func (ipt *Iptables) chain(table, chain string) ([][]string, error) {
+	if _, ok := builtinChains[table]; !ok {
+		return nil, errorf("iptables v1.8.4 (legacy): can't initialize iptables table `%s': Table does not exist", table)
+	}
+	rules, ok := ipt.Tables[table][chain]
+	if !ok && !isBuiltin(table, chain) {
+		return nil, errorf(ErrNoChain)
+	}
+	return rules, nil
+}
+
+func (ipt *Iptables) setChain(table, chain string, rules [][]string) {
+	if ipt.Tables[table] == nil {
+		ipt.Tables[table] = make(map[string][][]string)
+	}
+	ipt.Tables[table][chain] = rules
+}
+
+// checkRule fails if the rule jumps to a chain that does not exist
+func (ipt *Iptables) checkRule(table string, rulespec []string) error {
+	for i := 0; i+1 < len(rulespec); i++ {
+		if rulespec[i] != "-j" && rulespec[i] != "--jump" {
+			continue
+		}
+		target := rulespec[i+1]
+		if targets[target] {
+			return nil
+		}
+		if _, ok := ipt.Tables[table][target]; !ok || isBuiltin(table, target) {
+			return errorf("iptables v1.8.4 (legacy): Couldn't load target `%s':No such file or directory", target)
+		}
+	}
+	return nil
+}
+
+func (ipt *Iptables) find(rules [][]string, rulespec []string) int {
+	for i, rule := range rules {
+		if reflect.DeepEqual(rule, rulespec) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Exists returns whether the chain has the rule, false if the chain does not exist like iptables -C
+func (ipt *Iptables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	rules, err := ipt.chain(table, chain)
+	if err != nil {
+		return false, nil
+	}
+	return ipt.find(rules, rulespec) >= 0, nil
+}
+
+// Insert adds the rule at the position, starting at 1, which can be right after the last rule
+func (ipt *Iptables) Insert(table, chain string, pos int, rulespec ...string) error {
+	rules, err := ipt.chain(table, chain)
+	if err != nil {
+		return err
+	}
+	if err := ipt.checkRule(table, rulespec); err != nil {
+		return err
+	}
+	if pos < 1 || pos > len(rules)+1 {
+		return errorf(ErrIndexTooBig)
+	}
+	inserted := append([][]string{}, rules[:pos-1]...)
+	inserted = append(inserted, append([]string{}, rulespec...))
+	ipt.setChain(table, chain, append(inserted, rules[pos-1:]...))
+	return nil
+}
+
+// Append adds the rule at the end of the chain
+func (ipt *Iptables) Append(table, chain string, rulespec ...string) error {
+	rules, err := ipt.chain(table, chain)
+	if err != nil {
+		return err
+	}
+	if err := ipt.checkRule(table, rulespec); err != nil {
+		return err
+	}
+	ipt.setChain(table, chain, append(append([][]string{}, rules...), append([]string{}, rulespec...)))
+	return nil
+}
+
+// Delete removes the first rule of the chain with the rule spec
+func (ipt *Iptables) Delete(table, chain string, rulespec ...string) error {
+	rules, err := ipt.chain(table, chain)
+	if err != nil {
+		return err
+	}
+	i := ipt.find(rules, rulespec)
+	if i < 0 {
+		return errorf(ErrBadRule)
+	}
+	ipt.setChain(table, chain, append(append([][]string{}, rules[:i]...), rules[i+1:]...))
+	return nil
+}
+
+// List returns the chain and its rules like iptables -S, quoting the words with spaces
+func (ipt *Iptables) List(table, chain string) ([]string, error) {
+	rules, err := ipt.chain(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	lines := []string{"-N " + chain}
+	if isBuiltin(table, chain) {
+		lines = []string{"-P " + chain + " ACCEPT"}
+	}
+	for _, rule := range rules {
+		words := []string{"-A", chain}
+		for _, word := range rule {
+			if strings.Contains(word, " ") {
+				word = fmt.Sprintf("%q", word)
+			}
+			words = append(words, word)
+		}
+		lines = append(lines, strings.Join(words, " "))
+	}
+	return lines, nil
+}
+
+// ListWithCounters lists the rules like List, every counter is 0
+func (ipt *Iptables) ListWithCounters(table, chain string) ([]string, error) {
+	lines, err := ipt.List(table, chain)
+	for i := range lines {
+		if strings.HasPrefix(lines[i], "-A ") {
+			lines[i] += " -c 0 0"
+		}
+	}
+	return lines, err
+}
+
+// NewChain creates the chain, it fails if it exists
+func (ipt *Iptables) NewChain(table, chain string) error {
+	if _, err := ipt.chain(table, chain); err == nil {
+		return errorf(ErrChainExists)
+	} else if _, ok := builtinChains[table]; !ok {
+		return err
+	}
+	ipt.setChain(table, chain, [][]string{})
+	return nil
+}
+
+// ClearChain removes the rules of the chain, which is created if it does not exist
+func (ipt *Iptables) ClearChain(table, chain string) error {
+	if _, err := ipt.chain(table, chain); err != nil {
+		if _, ok := builtinChains[table]; !ok {
+			return err
+		}
+	}
+	ipt.setChain(table, chain, [][]string{})
+	return nil
+}
+
+// DeleteChain deletes the chain, which must be empty and not jumped to
+func (ipt *Iptables) DeleteChain(table, chain string) error {
+	rules, err := ipt.chain(table, chain)
+	if err != nil {
+		return err
+	}
+	if isBuiltin(table, chain) {
+		return errorf(ErrBuiltin)
+	}
+	if len(rules) > 0 {
+		return errorf(ErrChainNotEmpty)
+	}
+	for other, otherRules := range ipt.Tables[table] {
+		for _, rule := range otherRules {
+			for i := 0; i+1 < len(rule); i++ {
+				if (rule[i] == "-j" || rule[i] == "--jump") && rule[i+1] == chain {
+					return errorf("%s (%s chain %s jumps to it)", ErrChainInUse, table, other)
+				}
+			}
+		}
+	}
+	delete(ipt.Tables[table], chain)
+	return nil
+}
+
+// ListChains returns the built-in chains of the table, then the others in alphabetical order
+func (ipt *Iptables) ListChains(table string) ([]string, error) {
+	chains, ok := builtinChains[table]
+	if !ok {
+		_, err := ipt.chain(table, "")
+		return nil, err
+	}
+	chains = append([]string{}, chains...)
+	var others []string
+	for chain := range ipt.Tables[table] {
+		if !isBuiltin(table, chain) {
+			others = append(others, chain)
+		}
+	}
+	sort.Strings(others)
+	return append(chains, others...), nil
+}
+
+// HasRandomFully returns RandomFully
+func (ipt *Iptables) HasRandomFully() bool {
+	return ipt.RandomFully
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package iptablestest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChains(t *testing.T) {
+	ipt := New()
+
+	// The built-in chains exist
+	assert.EqualError(t, ipt.NewChain("nat", "POSTROUTING"), ErrChainExists)
+	assert.EqualError(t, ipt.DeleteChain("nat", "POSTROUTING"), ErrBuiltin)
+	assert.Error(t, ipt.NewChain("nonexistent", "CHAIN"))
+
+	assert.EqualError(t, ipt.Append("nat", "AWS-SNAT-CHAIN-0", "-j", "RETURN"), ErrNoChain)
+	assert.Error(t, ipt.Append("nat", "POSTROUTING", "-j", "AWS-SNAT-CHAIN-0"))
+	assert.NoError(t, ipt.NewChain("nat", "AWS-SNAT-CHAIN-0"))
+	assert.EqualError(t, ipt.NewChain("nat", "AWS-SNAT-CHAIN-0"), ErrChainExists)
+	assert.NoError(t, ipt.Append("nat", "AWS-SNAT-CHAIN-0", "-j", "RETURN"))
+	assert.NoError(t, ipt.Append("nat", "POSTROUTING", "-j", "AWS-SNAT-CHAIN-0"))
+
+	chains, err := ipt.ListChains("nat")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"PREROUTING", "INPUT", "OUTPUT", "POSTROUTING", "AWS-SNAT-CHAIN-0"}, chains)
+
+	// A chain is deleted once it is empty and nothing jumps to it
+	assert.EqualError(t, ipt.DeleteChain("nat", "AWS-SNAT-CHAIN-0"), ErrChainNotEmpty)
+	assert.NoError(t, ipt.ClearChain("nat", "AWS-SNAT-CHAIN-0"))
+	assert.Error(t, ipt.DeleteChain("nat", "AWS-SNAT-CHAIN-0"))
+	assert.NoError(t, ipt.Delete("nat", "POSTROUTING", "-j", "AWS-SNAT-CHAIN-0"))
+	assert.NoError(t, ipt.DeleteChain("nat", "AWS-SNAT-CHAIN-0"))
+	assert.EqualError(t, ipt.DeleteChain("nat", "AWS-SNAT-CHAIN-0"), ErrNoChain)
+
+	// ClearChain creates the chain
+	assert.NoError(t, ipt.ClearChain("nat", "AWS-SNAT-CHAIN-1"))
+	_, err = ipt.List("nat", "AWS-SNAT-CHAIN-1")
+	assert.NoError(t, err)
+}
+
+func TestRules(t *testing.T) {
+	ipt := New()
+
+	assert.EqualError(t, ipt.Insert("nat", "POSTROUTING", 2, "-j", "ACCEPT"), ErrIndexTooBig)
+	assert.EqualError(t, ipt.Insert("nat", "POSTROUTING", 0, "-j", "ACCEPT"), ErrIndexTooBig)
+	assert.NoError(t, ipt.Insert("nat", "POSTROUTING", 1, "-j", "ACCEPT"))
+	assert.NoError(t, ipt.Insert("nat", "POSTROUTING", 1, "-m", "comment", "--comment", "first rule", "-j", "RETURN"))
+	assert.NoError(t, ipt.Insert("nat", "POSTROUTING", 3, "-j", "MASQUERADE"))
+	assert.Equal(t, [][]string{
+		{"-m", "comment", "--comment", "first rule", "-j", "RETURN"},
+		{"-j", "ACCEPT"},
+		{"-j", "MASQUERADE"},
+	}, ipt.Tables["nat"]["POSTROUTING"])
+
+	exists, err := ipt.Exists("nat", "POSTROUTING", "-j", "ACCEPT")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	// Like iptables -C, a missing chain has no rule
+	exists, err = ipt.Exists("nat", "AWS-SNAT-CHAIN-0", "-j", "ACCEPT")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	rules, err := ipt.List("nat", "POSTROUTING")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"-P POSTROUTING ACCEPT",
+		`-A POSTROUTING -m comment --comment "first rule" -j RETURN`,
+		"-A POSTROUTING -j ACCEPT",
+		"-A POSTROUTING -j MASQUERADE",
+	}, rules)
+	rules, err = ipt.ListWithCounters("nat", "POSTROUTING")
+	assert.NoError(t, err)
+	assert.Equal(t, "-A POSTROUTING -j ACCEPT -c 0 0", rules[2])
+	_, err = ipt.List("nat", "AWS-SNAT-CHAIN-0")
+	assert.EqualError(t, err, ErrNoChain)
+
+	assert.NoError(t, ipt.Delete("nat", "POSTROUTING", "-j", "ACCEPT"))
+	assert.EqualError(t, ipt.Delete("nat", "POSTROUTING", "-j", "ACCEPT"), ErrBadRule)
+	assert.Len(t, ipt.Tables["nat"]["POSTROUTING"], 2)
+}
@@ -0,0 +1,256 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// envKubeProxyMode is the name of the environment variable that sets the mode of kube-proxy, "iptables", "ipvs" or
+	// "none", instead of finding it out. The NodePort rules for IPVS are only added when it is set to "ipvs", or when
+	// it is not set and kube-ipvs0 exists when ipamd starts. Defaults to empty.
+	envKubeProxyMode = "AWS_VPC_K8S_CNI_KUBE_PROXY_MODE"
+
+	// envKubeProxyMetricsAddr is the name of the environment variable that sets the address of the metrics server of
+	// kube-proxy, which reports its mode on /proxyMode. Defaults to the address kube-proxy listens on by default.
+	envKubeProxyMetricsAddr     = "AWS_VPC_K8S_CNI_KUBE_PROXY_METRICS_ADDR"
+	defaultKubeProxyMetricsAddr = "127.0.0.1:10249"
+
+	kubeProxyTimeout = 2 * time.Second
+
+	// kubeIPVSInterface is the dummy interface the IPVS mode of kube-proxy binds the service IPs to
+	kubeIPVSInterface = "kube-ipvs0"
+	// kubeServiceChainPrefix is the prefix of the nat chains of the services in the iptables mode of kube-proxy
+	kubeServiceChainPrefix = "KUBE-SVC-"
+	kubeServicesChain      = "KUBE-SERVICES"
+
+	// kubeProxyMarks are the packet marks kube-proxy uses by default for masquerading (0x4000) and dropping (0x8000)
+	kubeProxyMarks = 0xc000
+
+	// ipvsConntrack makes IPVS keep conntrack entries for the connections it balances, without which the connmark of
+	// the NodePort traffic is not restored on the replies of the pods
+	ipvsConntrack = "net/ipv4/vs/conntrack"
+)
+
+// KubeProxyMode is the way kube-proxy implements services
+type KubeProxyMode string
+
+const (
+	// KubeProxyModeIptables implements services with nat rules
+	KubeProxyModeIptables KubeProxyMode = "iptables"
+	// KubeProxyModeIPVS implements services with IPVS virtual servers bound to kube-ipvs0
+	KubeProxyModeIPVS KubeProxyMode = "ipvs"
+	// KubeProxyModeNone is used when kube-proxy does not answer and no service rules are found, e.g. when services are
+	// implemented by an eBPF dataplane
+	KubeProxyModeNone KubeProxyMode = "none"
+)
+
+// ipvsConnmarkRuleName is the name of the host rule that marks the connections to the services of IPVS
+const ipvsConnmarkRuleName = "connmark for IPVS services on primary ENI"
+
+// KubeProxyCheck is the outcome of looking at how kube-proxy implements services and whether it fits the host rules
+type KubeProxyCheck struct {
+	Mode KubeProxyMode
+	// Reported is true if kube-proxy answered with its mode, rather than the mode being guessed from the dataplane
+	Reported bool
+	// Problems describes the mismatches between kube-proxy and the host network that could not be fixed
+	Problems []string
+	// Adjustments describes the changes made to the host so that it works with kube-proxy
+	Adjustments []string
+}
+
+// CheckKubeProxy finds out the mode of kube-proxy, from kube-proxy itself or from what it left in the dataplane, and
+// looks for leftovers of another mode and for settings that do not work with it. Under IPVS, the conntrack entries
+// the NodePort connmark depends on are turned on.
+func (n *linuxNetwork) CheckKubeProxy() (KubeProxyCheck, error) {
+	var result KubeProxyCheck
+	reported, err := n.kubeProxyMode()
+	if err != nil {
+		log.Debugf("kube-proxy did not report its mode: %v", err)
+	}
+	_, err = n.netLink.LinkByName(kubeIPVSInterface)
+	hasIPVSInterface := err == nil
+
+	ipt, err := n.systemIptables()
+	if err != nil {
+		return result, errors.Wrap(err, "check kube-proxy: failed to create iptables")
+	}
+	chains, err := ipt.ListChains("nat")
+	if err != nil {
+		return result, errors.Wrap(err, "check kube-proxy: failed to list nat chains")
+	}
+	hasServicesChain, hasServiceChains := false, false
+	for _, chain := range chains {
+		hasServicesChain = hasServicesChain || chain == kubeServicesChain
+		hasServiceChains = hasServiceChains || strings.HasPrefix(chain, kubeServiceChainPrefix)
+	}
+
+	switch {
+	case n.kubeProxyModeSetting != "" && reported == "":
+		result.Mode = n.kubeProxyModeSetting
+	case reported != "":
+		result.Mode = KubeProxyMode(reported)
+		result.Reported = true
+	case hasIPVSInterface:
+		result.Mode = KubeProxyModeIPVS
+	case hasServicesChain:
+		result.Mode = KubeProxyModeIptables
+	default:
+		result.Mode = KubeProxyModeNone
+	}
+
+	if n.kubeProxyModeSetting != "" && result.Reported && n.kubeProxyModeSetting != result.Mode {
+		result.Problems = append(result.Problems, fmt.Sprintf("%s is %s but kube-proxy runs in %s mode",
+			envKubeProxyMode, n.kubeProxyModeSetting, result.Mode))
+	}
+
+	switch result.Mode {
+	case KubeProxyModeIPVS:
+		if result.Reported && !hasIPVSInterface {
+			result.Problems = append(result.Problems, fmt.Sprintf(
+				"kube-proxy runs in IPVS mode but %s is missing, services are not reachable", kubeIPVSInterface))
+		}
+		if hasServiceChains {
+			result.Problems = append(result.Problems, fmt.Sprintf(
+				"the nat table still has %s* chains of the iptables mode of kube-proxy, which are matched before IPVS, "+
+					"run kube-proxy --cleanup", kubeServiceChainPrefix))
+		}
+		if n.nodePortSupportEnabled {
+			n.checkIPVSConntrack(&result)
+			if err := n.checkIPVSConnmarkRule(&result); err != nil {
+				return result, err
+			}
+		}
+	case KubeProxyModeIptables:
+		if hasIPVSInterface {
+			result.Problems = append(result.Problems, fmt.Sprintf(
+				"%s was left by the IPVS mode of kube-proxy, the service IPs bound to it are local to the node and "+
+					"bypass the iptables rules of kube-proxy, delete it", kubeIPVSInterface))
+		}
+	}
+	if result.Mode != KubeProxyModeNone && n.nodePortSupportEnabled && n.mainENIMark&kubeProxyMarks != 0 {
+		result.Problems = append(result.Problems, fmt.Sprintf(
+			"the connmark %#x of %s overlaps the marks %#x of kube-proxy, NodePort replies may leave through the wrong ENI",
+			n.mainENIMark, envConnmark, kubeProxyMarks))
+	}
+	return result, nil
+}
+
+// checkIPVSConntrack turns on the conntrack entries of IPVS, which kube-proxy turns on as well, in case it did not
+func (n *linuxNetwork) checkIPVSConntrack(result *KubeProxyCheck) {
+	value, err := n.procSys.Get(ipvsConntrack)
+	if err == nil && value == "1" {
+		return
+	}
+	if err = n.procSys.Set(ipvsConntrack, "1"); err != nil {
+		result.Problems = append(result.Problems, fmt.Sprintf(
+			"IPVS does not keep conntrack entries and %s can not be set, NodePort replies from pods on secondary ENIs "+
+				"leave through the wrong ENI: %v", ipvsConntrack, err))
+		return
+	}
+	result.Adjustments = append(result.Adjustments, fmt.Sprintf(
+		"set %s to 1 so that the connmark of NodePort traffic is restored on IPVS connections", ipvsConntrack))
+}
+
+// checkIPVSConnmarkRule adds the connmark rule of the services of IPVS if kube-proxy switched to IPVS after the host
+// network was set up
+func (n *linuxNetwork) checkIPVSConnmarkRule(result *KubeProxyCheck) error {
+	if n.lastHostRules == nil {
+		return nil
+	}
+	ipt, err := n.newIptables()
+	if err != nil {
+		return errors.Wrap(err, "check kube-proxy: failed to create iptables")
+	}
+	for i, rule := range n.lastHostRules.otherRules {
+		if rule.name != ipvsConnmarkRuleName || rule.shouldExist {
+			continue
+		}
+		exists, err := ipt.Exists(rule.table, rule.chain, rule.rule...)
+		if err != nil {
+			return errors.Wrapf(err, "check kube-proxy: failed to check existence of %v", rule)
+		}
+		if !exists {
+			if err := ipt.Append(rule.table, rule.chain, rule.rule...); err != nil {
+				return errors.Wrapf(err, "check kube-proxy: failed to add %v", rule)
+			}
+		}
+		n.lastHostRules.otherRules[i].shouldExist = true
+		result.Adjustments = append(result.Adjustments,
+			"added the connmark rule of the external and load balancer IPs of the services of IPVS")
+	}
+	return nil
+}
+
+// ipvsEnabled returns whether kube-proxy implements services with IPVS, from the setting or from kube-ipvs0
+func (n *linuxNetwork) ipvsEnabled() bool {
+	if n.kubeProxyModeSetting != "" {
+		return n.kubeProxyModeSetting == KubeProxyModeIPVS
+	}
+	_, err := n.netLink.LinkByName(kubeIPVSInterface)
+	return err == nil
+}
+
+// setIPVSConntrack makes IPVS keep conntrack entries, so that the connmark of NodePort traffic is restored on the
+// replies of the pods. Setting it fails if the ip_vs module is not loaded yet, which kube-proxy does.
+func (n *linuxNetwork) setIPVSConntrack() {
+	if err := n.procSys.Set(ipvsConntrack, "1"); err != nil {
+		log.Warnf("Failed to set %s, NodePort replies from pods on secondary ENIs may leave through the wrong ENI "+
+			"until kube-proxy sets it: %v", ipvsConntrack, err)
+	}
+}
+
+func getKubeProxyModeSetting() KubeProxyMode {
+	value := KubeProxyMode(os.Getenv(envKubeProxyMode))
+	switch value {
+	case "", KubeProxyModeIptables, KubeProxyModeIPVS, KubeProxyModeNone:
+		return value
+	}
+	log.Errorf("Failed to parse %s %q, finding out the mode of kube-proxy instead", envKubeProxyMode, value)
+	return ""
+}
+
+// getKubeProxyMode asks kube-proxy for its mode on its metrics server
+func getKubeProxyMode(addr string) (string, error) {
+	client := http.Client{Timeout: kubeProxyTimeout}
+	resp, err := client.Get("http://" + addr + "/proxyMode")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+func getKubeProxyMetricsAddr() string {
+	if addr := os.Getenv(envKubeProxyMetricsAddr); addr != "" {
+		return addr
+	}
+	return defaultKubeProxyMetricsAddr
+}
@@ -0,0 +1,148 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// envMarkPreset is the name of the environment variable that selects a preset of the marks used by the host rules,
+	// so that they stay clear of the marks of another component of the node. "istio" moves the default connmark of
+	// the primary ENI out of the marks of Istio. Defaults to empty.
+	envMarkPreset = "AWS_VPC_K8S_CNI_MARK_PRESET"
+
+	markPresetIstio = "istio"
+
+	// istioMarkMask holds the marks Istio intercepts traffic with: 0x539 (1337) for TPROXY and REDIRECT, and the bits
+	// matched with the 0xfff mask by the host rules of its ambient mode
+	istioMarkMask = 0xfff
+	// istioConnmark is the default connmark of the istio preset. It stays clear of the marks of Istio, kube-proxy
+	// (0x0000c000), Calico (0xffff0000) and firewall symmetry.
+	istioConnmark = 0x2000
+)
+
+// markChainPrefixes are the prefixes of the chains whose marks are checked against the marks of the host rules
+var markChainPrefixes = []string{"ISTIO", "ztunnel"}
+
+func getMarkPreset() string {
+	value := os.Getenv(envMarkPreset)
+	switch value {
+	case "", markPresetIstio:
+		return value
+	}
+	log.Errorf("Failed to parse %s %q, using the default marks", envMarkPreset, value)
+	return ""
+}
+
+// presetConnmark returns the default connmark of the given preset
+func presetConnmark(preset string) uint32 {
+	if preset == markPresetIstio {
+		return istioConnmark
+	}
+	return defaultConnmark
+}
+
+// ownedMarks returns the bits of the packet and connection marks the host rules use
+func (n *linuxNetwork) ownedMarks() uint32 {
+	var marks uint32
+	if n.nodePortSupportEnabled {
+		marks |= n.mainENIMark
+	}
+	if n.firewallSymmetryEnabled() {
+		marks |= firewallMarkMask
+	}
+	return marks
+}
+
+// ruleMarkBits returns the bits of the marks a rule matches on or changes. A mark without a mask stands for all bits.
+func ruleMarkBits(ruleSpec []string) uint32 {
+	var bits uint32
+	for i := 0; i+1 < len(ruleSpec); i++ {
+		value := ruleSpec[i+1]
+		switch ruleSpec[i] {
+		case "--mask", "--nfmask", "--ctmask", "--or-mark", "--xor-mark":
+			if mask, err := strconv.ParseUint(value, 0, 32); err == nil {
+				bits |= uint32(mask)
+			}
+		case "--and-mark":
+			if mask, err := strconv.ParseUint(value, 0, 32); err == nil {
+				bits |= ^uint32(mask)
+			}
+		case "--set-xmark", "--set-mark", "--mark", "--tproxy-mark":
+			parts := strings.SplitN(value, "/", 2)
+			if len(parts) == 1 {
+				bits |= 0xffffffff
+			} else if mask, err := strconv.ParseUint(parts[1], 0, 32); err == nil {
+				bits |= uint32(mask)
+			}
+		}
+	}
+	return bits
+}
+
+// CheckMarks looks for rules of Istio that match on or change the marks the host rules use, which breaks the routing
+// of either the replies of NodePort traffic or the interception of the sidecars
+func (n *linuxNetwork) CheckMarks() ([]string, error) {
+	owned := n.ownedMarks()
+	if owned == 0 {
+		return nil, nil
+	}
+	var problems []string
+	if getMarkPreset() == markPresetIstio && n.mainENIMark&istioMarkMask != 0 && n.nodePortSupportEnabled {
+		problems = append(problems, fmt.Sprintf("%s %#x overlaps the marks %#x of Istio", envConnmark,
+			n.mainENIMark, istioMarkMask))
+	}
+	ipt, err := n.systemIptables()
+	if err != nil {
+		return nil, errors.Wrap(err, "check marks: failed to create iptables")
+	}
+	for _, table := range []string{"mangle", "nat"} {
+		chains, err := ipt.ListChains(table)
+		if err != nil {
+			return nil, errors.Wrapf(err, "check marks: failed to list %s chains", table)
+		}
+		for _, chain := range chains {
+			if !hasMarkChainPrefix(chain) {
+				continue
+			}
+			ruleSpecs, err := listRuleSpecs(ipt, table, chain)
+			if err != nil {
+				return nil, errors.Wrap(err, "check marks")
+			}
+			for _, ruleSpec := range ruleSpecs {
+				if bits := ruleMarkBits(ruleSpec); bits&owned != 0 {
+					problems = append(problems, fmt.Sprintf("%s %s rule %q uses the marks %#x of the host rules",
+						table, chain, strings.Join(ruleSpec, " "), bits&owned))
+				}
+			}
+		}
+	}
+	return problems, nil
+}
+
+func hasMarkChainPrefix(chain string) bool {
+	for _, prefix := range markChainPrefixes {
+		if strings.HasPrefix(chain, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// mirrorFilterPriority identifies the tc filters that mirror the traffic of an interface, so that they are deleted
+// without touching the other filters of the interface
+const mirrorFilterPriority = 0xa3c0
+
+// mirrorFilters returns the filters that mirror the traffic received and sent by the source interface to the target
+func mirrorFilters(sourceIndex, targetIndex int) []netlink.Filter {
+	var filters []netlink.Filter
+	for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+		filters = append(filters, &netlink.MatchAll{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: sourceIndex,
+				Parent:    parent,
+				Priority:  mirrorFilterPriority,
+				Protocol:  unix.ETH_P_ALL,
+			},
+			Actions: []netlink.Action{&netlink.MirredAction{
+				ActionAttrs:  netlink.ActionAttrs{Action: netlink.TC_ACT_PIPE},
+				MirredAction: netlink.TCA_EGRESS_MIRROR,
+				Ifindex:      targetIndex,
+			}},
+		})
+	}
+	return filters
+}
+
+// AddMirror mirrors the traffic of the source interface to the target interface with tc, like
+// `tc filter add dev $source ingress matchall action mirred egress mirror dev $target`. The target is created as a
+// dummy interface if it does not exist, and the returned bool tells whether it was.
+func (n *linuxNetwork) AddMirror(source, target string) (bool, error) {
+	sourceLink, err := n.netLink.LinkByName(source)
+	if err != nil {
+		return false, errors.Wrapf(err, "add mirror: failed to find interface %s", source)
+	}
+	created := false
+	targetLink, err := n.netLink.LinkByName(target)
+	if err != nil {
+		if err := n.netLink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: target}}); err != nil {
+			return false, errors.Wrapf(err, "add mirror: failed to create capture interface %s", target)
+		}
+		created = true
+		if targetLink, err = n.netLink.LinkByName(target); err != nil {
+			return created, errors.Wrapf(err, "add mirror: failed to find capture interface %s", target)
+		}
+		if err := n.netLink.LinkSetUp(targetLink); err != nil {
+			return created, errors.Wrapf(err, "add mirror: failed to set capture interface %s up", target)
+		}
+	}
+
+	// The clsact qdisc is left in place on teardown, others may have attached filters to it
+	qdisc := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: sourceLink.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	if err := n.netLink.QdiscAdd(qdisc); err != nil && !isExistsError(err) {
+		return created, errors.Wrapf(err, "add mirror: failed to add clsact qdisc to %s", source)
+	}
+	for _, filter := range mirrorFilters(sourceLink.Attrs().Index, targetLink.Attrs().Index) {
+		if err := n.netLink.FilterAdd(filter); err != nil {
+			return created, errors.Wrapf(err, "add mirror: failed to mirror %s to %s", source, target)
+		}
+	}
+	return created, nil
+}
+
+// DelMirror stops mirroring the traffic of the source interface, which may be gone already with its pod, and deletes
+// the target interface if asked to
+func (n *linuxNetwork) DelMirror(source, target string, deleteTarget bool) error {
+	if sourceLink, err := n.netLink.LinkByName(source); err == nil {
+		for _, filter := range mirrorFilters(sourceLink.Attrs().Index, 0) {
+			if err := n.netLink.FilterDel(filter); err != nil && !containsNoSuchRule(err) {
+				return errors.Wrapf(err, "delete mirror: failed to stop mirroring %s", source)
+			}
+		}
+	}
+	if !deleteTarget {
+		return nil
+	}
+	targetLink, err := n.netLink.LinkByName(target)
+	if err != nil {
+		return nil
+	}
+	if err := n.netLink.LinkDel(targetLink); err != nil {
+		return errors.Wrapf(err, "delete mirror: failed to delete capture interface %s", target)
+	}
+	return nil
+}
+
+// GetInterfaceName returns the name of the interface with the given MAC address
+func (n *linuxNetwork) GetInterfaceName(mac string) (string, error) {
+	links, err := n.netLink.LinkList()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to list interfaces")
+	}
+	for _, link := range links {
+		if link.Attrs().HardwareAddr.String() == mac {
+			return link.Attrs().Name, nil
+		}
+	}
+	return "", errors.Errorf("no interface found which uses mac address %s", mac)
+}
+
+func isExistsError(err error) bool {
+	if errno, ok := err.(syscall.Errno); ok {
+		return errno == syscall.EEXIST
+	}
+	return false
+}
@@ -1,4 +1,4 @@
-// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
 //
 // Licensed under the Apache License, Version 2.0 (the "License"). You may
 // not use this file except in compliance with the License. A copy of the
@@ -18,9 +18,10 @@
 package mock_networkutils
 
 import (
-	net "net"
+	netip "net/netip"
 	reflect "reflect"
 
+	networkutils "github.com/aws/amazon-vpc-cni-k8s/pkg/networkutils"
 	gomock "github.com/golang/mock/gomock"
 	netlink "github.com/vishvananda/netlink"
 )
@@ -48,8 +49,145 @@ func (m *MockNetworkAPIs) EXPECT() *MockNetworkAPIsMockRecorder {
 	return m.recorder
 }
 
+// AddEgressGatewayExemption mocks base method
+func (m *MockNetworkAPIs) AddEgressGatewayExemption(arg0 string) error {
+	ret := m.ctrl.Call(m, "AddEgressGatewayExemption", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddEgressGatewayExemption indicates an expected call of AddEgressGatewayExemption
+func (mr *MockNetworkAPIsMockRecorder) AddEgressGatewayExemption(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddEgressGatewayExemption", reflect.TypeOf((*MockNetworkAPIs)(nil).AddEgressGatewayExemption), arg0)
+}
+
+// AddMirror mocks base method
+func (m *MockNetworkAPIs) AddMirror(arg0, arg1 string) (bool, error) {
+	ret := m.ctrl.Call(m, "AddMirror", arg0, arg1)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AddMirror indicates an expected call of AddMirror
+func (mr *MockNetworkAPIsMockRecorder) AddMirror(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddMirror", reflect.TypeOf((*MockNetworkAPIs)(nil).AddMirror), arg0, arg1)
+}
+
+// AddPodFlagRules mocks base method
+func (m *MockNetworkAPIs) AddPodFlagRules(arg0 string, arg1, arg2 bool) error {
+	ret := m.ctrl.Call(m, "AddPodFlagRules", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddPodFlagRules indicates an expected call of AddPodFlagRules
+func (mr *MockNetworkAPIsMockRecorder) AddPodFlagRules(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddPodFlagRules", reflect.TypeOf((*MockNetworkAPIs)(nil).AddPodFlagRules), arg0, arg1, arg2)
+}
+
+// CheckKubeProxy mocks base method
+func (m *MockNetworkAPIs) CheckKubeProxy() (networkutils.KubeProxyCheck, error) {
+	ret := m.ctrl.Call(m, "CheckKubeProxy")
+	ret0, _ := ret[0].(networkutils.KubeProxyCheck)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CheckKubeProxy indicates an expected call of CheckKubeProxy
+func (mr *MockNetworkAPIsMockRecorder) CheckKubeProxy() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CheckKubeProxy", reflect.TypeOf((*MockNetworkAPIs)(nil).CheckKubeProxy))
+}
+
+// CheckMarks mocks base method
+func (m *MockNetworkAPIs) CheckMarks() ([]string, error) {
+	ret := m.ctrl.Call(m, "CheckMarks")
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CheckMarks indicates an expected call of CheckMarks
+func (mr *MockNetworkAPIsMockRecorder) CheckMarks() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CheckMarks", reflect.TypeOf((*MockNetworkAPIs)(nil).CheckMarks))
+}
+
+// CheckSNATRules mocks base method
+func (m *MockNetworkAPIs) CheckSNATRules() (networkutils.SNATRulesCheck, error) {
+	ret := m.ctrl.Call(m, "CheckSNATRules")
+	ret0, _ := ret[0].(networkutils.SNATRulesCheck)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CheckSNATRules indicates an expected call of CheckSNATRules
+func (mr *MockNetworkAPIsMockRecorder) CheckSNATRules() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CheckSNATRules", reflect.TypeOf((*MockNetworkAPIs)(nil).CheckSNATRules))
+}
+
+// DelEgressGatewayExemption mocks base method
+func (m *MockNetworkAPIs) DelEgressGatewayExemption(arg0 string) (bool, error) {
+	ret := m.ctrl.Call(m, "DelEgressGatewayExemption", arg0)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DelEgressGatewayExemption indicates an expected call of DelEgressGatewayExemption
+func (mr *MockNetworkAPIsMockRecorder) DelEgressGatewayExemption(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DelEgressGatewayExemption", reflect.TypeOf((*MockNetworkAPIs)(nil).DelEgressGatewayExemption), arg0)
+}
+
+// DelMirror mocks base method
+func (m *MockNetworkAPIs) DelMirror(arg0, arg1 string, arg2 bool) error {
+	ret := m.ctrl.Call(m, "DelMirror", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DelMirror indicates an expected call of DelMirror
+func (mr *MockNetworkAPIsMockRecorder) DelMirror(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DelMirror", reflect.TypeOf((*MockNetworkAPIs)(nil).DelMirror), arg0, arg1, arg2)
+}
+
+// DelPodFlagRules mocks base method
+func (m *MockNetworkAPIs) DelPodFlagRules(arg0 string) error {
+	ret := m.ctrl.Call(m, "DelPodFlagRules", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DelPodFlagRules indicates an expected call of DelPodFlagRules
+func (mr *MockNetworkAPIsMockRecorder) DelPodFlagRules(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DelPodFlagRules", reflect.TypeOf((*MockNetworkAPIs)(nil).DelPodFlagRules), arg0)
+}
+
+// DeleteIPv4PrefixRoute mocks base method
+func (m *MockNetworkAPIs) DeleteIPv4PrefixRoute(arg0 netip.Prefix) error {
+	ret := m.ctrl.Call(m, "DeleteIPv4PrefixRoute", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteIPv4PrefixRoute indicates an expected call of DeleteIPv4PrefixRoute
+func (mr *MockNetworkAPIsMockRecorder) DeleteIPv4PrefixRoute(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteIPv4PrefixRoute", reflect.TypeOf((*MockNetworkAPIs)(nil).DeleteIPv4PrefixRoute), arg0)
+}
+
+// DeletePodVeth mocks base method
+func (m *MockNetworkAPIs) DeletePodVeth(arg0 networkutils.PodVeth) error {
+	ret := m.ctrl.Call(m, "DeletePodVeth", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeletePodVeth indicates an expected call of DeletePodVeth
+func (mr *MockNetworkAPIsMockRecorder) DeletePodVeth(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeletePodVeth", reflect.TypeOf((*MockNetworkAPIs)(nil).DeletePodVeth), arg0)
+}
+
 // DeleteRuleListBySrc mocks base method
-func (m *MockNetworkAPIs) DeleteRuleListBySrc(arg0 net.IPNet) error {
+func (m *MockNetworkAPIs) DeleteRuleListBySrc(arg0 netip.Prefix) error {
 	ret := m.ctrl.Call(m, "DeleteRuleListBySrc", arg0)
 	ret0, _ := ret[0].(error)
 	return ret0
@@ -60,6 +198,147 @@ func (mr *MockNetworkAPIsMockRecorder) DeleteRuleListBySrc(arg0 interface{}) *go
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteRuleListBySrc", reflect.TypeOf((*MockNetworkAPIs)(nil).DeleteRuleListBySrc), arg0)
 }
 
+// ExportNetworkState mocks base method
+func (m *MockNetworkAPIs) ExportNetworkState() (*networkutils.NetworkState, error) {
+	ret := m.ctrl.Call(m, "ExportNetworkState")
+	ret0, _ := ret[0].(*networkutils.NetworkState)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ExportNetworkState indicates an expected call of ExportNetworkState
+func (mr *MockNetworkAPIsMockRecorder) ExportNetworkState() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExportNetworkState", reflect.TypeOf((*MockNetworkAPIs)(nil).ExportNetworkState))
+}
+
+// FlushRouteTable mocks base method
+func (m *MockNetworkAPIs) FlushRouteTable(arg0 int) error {
+	ret := m.ctrl.Call(m, "FlushRouteTable", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FlushRouteTable indicates an expected call of FlushRouteTable
+func (mr *MockNetworkAPIsMockRecorder) FlushRouteTable(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FlushRouteTable", reflect.TypeOf((*MockNetworkAPIs)(nil).FlushRouteTable), arg0)
+}
+
+// GetDropCounts mocks base method
+func (m *MockNetworkAPIs) GetDropCounts() (map[string]uint64, error) {
+	ret := m.ctrl.Call(m, "GetDropCounts")
+	ret0, _ := ret[0].(map[string]uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDropCounts indicates an expected call of GetDropCounts
+func (mr *MockNetworkAPIsMockRecorder) GetDropCounts() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDropCounts", reflect.TypeOf((*MockNetworkAPIs)(nil).GetDropCounts))
+}
+
+// GetENIReferences mocks base method
+func (m *MockNetworkAPIs) GetENIReferences(arg0 int, arg1 []string) ([]string, error) {
+	ret := m.ctrl.Call(m, "GetENIReferences", arg0, arg1)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetENIReferences indicates an expected call of GetENIReferences
+func (mr *MockNetworkAPIsMockRecorder) GetENIReferences(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetENIReferences", reflect.TypeOf((*MockNetworkAPIs)(nil).GetENIReferences), arg0, arg1)
+}
+
+// GetExcludeSNATCIDRs mocks base method
+func (m *MockNetworkAPIs) GetExcludeSNATCIDRs() []netip.Prefix {
+	ret := m.ctrl.Call(m, "GetExcludeSNATCIDRs")
+	ret0, _ := ret[0].([]netip.Prefix)
+	return ret0
+}
+
+// GetExcludeSNATCIDRs indicates an expected call of GetExcludeSNATCIDRs
+func (mr *MockNetworkAPIsMockRecorder) GetExcludeSNATCIDRs() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExcludeSNATCIDRs", reflect.TypeOf((*MockNetworkAPIs)(nil).GetExcludeSNATCIDRs))
+}
+
+// GetIPv6RuleList mocks base method
+func (m *MockNetworkAPIs) GetIPv6RuleList() ([]netlink.Rule, error) {
+	ret := m.ctrl.Call(m, "GetIPv6RuleList")
+	ret0, _ := ret[0].([]netlink.Rule)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetIPv6RuleList indicates an expected call of GetIPv6RuleList
+func (mr *MockNetworkAPIsMockRecorder) GetIPv6RuleList() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetIPv6RuleList", reflect.TypeOf((*MockNetworkAPIs)(nil).GetIPv6RuleList))
+}
+
+// GetInterfaceName mocks base method
+func (m *MockNetworkAPIs) GetInterfaceName(arg0 string) (string, error) {
+	ret := m.ctrl.Call(m, "GetInterfaceName", arg0)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetInterfaceName indicates an expected call of GetInterfaceName
+func (mr *MockNetworkAPIsMockRecorder) GetInterfaceName(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetInterfaceName", reflect.TypeOf((*MockNetworkAPIs)(nil).GetInterfaceName), arg0)
+}
+
+// GetNUMANode mocks base method
+func (m *MockNetworkAPIs) GetNUMANode(arg0 string) (int, error) {
+	ret := m.ctrl.Call(m, "GetNUMANode", arg0)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetNUMANode indicates an expected call of GetNUMANode
+func (mr *MockNetworkAPIsMockRecorder) GetNUMANode(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetNUMANode", reflect.TypeOf((*MockNetworkAPIs)(nil).GetNUMANode), arg0)
+}
+
+// GetPodIPv6sFromRoutes mocks base method
+func (m *MockNetworkAPIs) GetPodIPv6sFromRoutes() (map[string]string, error) {
+	ret := m.ctrl.Call(m, "GetPodIPv6sFromRoutes")
+	ret0, _ := ret[0].(map[string]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetPodIPv6sFromRoutes indicates an expected call of GetPodIPv6sFromRoutes
+func (mr *MockNetworkAPIsMockRecorder) GetPodIPv6sFromRoutes() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPodIPv6sFromRoutes", reflect.TypeOf((*MockNetworkAPIs)(nil).GetPodIPv6sFromRoutes))
+}
+
+// GetPodVeths mocks base method
+func (m *MockNetworkAPIs) GetPodVeths() ([]networkutils.PodVeth, error) {
+	ret := m.ctrl.Call(m, "GetPodVeths")
+	ret0, _ := ret[0].([]networkutils.PodVeth)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetPodVeths indicates an expected call of GetPodVeths
+func (mr *MockNetworkAPIsMockRecorder) GetPodVeths() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPodVeths", reflect.TypeOf((*MockNetworkAPIs)(nil).GetPodVeths))
+}
+
+// GetRouteTableIDs mocks base method
+func (m *MockNetworkAPIs) GetRouteTableIDs() ([]int, error) {
+	ret := m.ctrl.Call(m, "GetRouteTableIDs")
+	ret0, _ := ret[0].([]int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRouteTableIDs indicates an expected call of GetRouteTableIDs
+func (mr *MockNetworkAPIsMockRecorder) GetRouteTableIDs() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRouteTableIDs", reflect.TypeOf((*MockNetworkAPIs)(nil).GetRouteTableIDs))
+}
+
 // GetRuleList mocks base method
 func (m *MockNetworkAPIs) GetRuleList() ([]netlink.Rule, error) {
 	ret := m.ctrl.Call(m, "GetRuleList")
@@ -74,7 +353,7 @@ func (mr *MockNetworkAPIsMockRecorder) GetRuleList() *gomock.Call {
 }
 
 // GetRuleListBySrc mocks base method
-func (m *MockNetworkAPIs) GetRuleListBySrc(arg0 []netlink.Rule, arg1 net.IPNet) ([]netlink.Rule, error) {
+func (m *MockNetworkAPIs) GetRuleListBySrc(arg0 []netlink.Rule, arg1 netip.Prefix) ([]netlink.Rule, error) {
 	ret := m.ctrl.Call(m, "GetRuleListBySrc", arg0, arg1)
 	ret0, _ := ret[0].([]netlink.Rule)
 	ret1, _ := ret[1].(error)
@@ -86,8 +365,70 @@ func (mr *MockNetworkAPIsMockRecorder) GetRuleListBySrc(arg0, arg1 interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRuleListBySrc", reflect.TypeOf((*MockNetworkAPIs)(nil).GetRuleListBySrc), arg0, arg1)
 }
 
+// GetVFs mocks base method
+func (m *MockNetworkAPIs) GetVFs(arg0 string) ([]string, error) {
+	ret := m.ctrl.Call(m, "GetVFs", arg0)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetVFs indicates an expected call of GetVFs
+func (mr *MockNetworkAPIsMockRecorder) GetVFs(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetVFs", reflect.TypeOf((*MockNetworkAPIs)(nil).GetVFs), arg0)
+}
+
+// ImportNetworkState mocks base method
+func (m *MockNetworkAPIs) ImportNetworkState(arg0 *networkutils.NetworkState) (*networkutils.NetworkStateImport, error) {
+	ret := m.ctrl.Call(m, "ImportNetworkState", arg0)
+	ret0, _ := ret[0].(*networkutils.NetworkStateImport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ImportNetworkState indicates an expected call of ImportNetworkState
+func (mr *MockNetworkAPIsMockRecorder) ImportNetworkState(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ImportNetworkState", reflect.TypeOf((*MockNetworkAPIs)(nil).ImportNetworkState), arg0)
+}
+
+// ReplaceRouteSrc mocks base method
+func (m *MockNetworkAPIs) ReplaceRouteSrc(arg0, arg1 netip.Addr) error {
+	ret := m.ctrl.Call(m, "ReplaceRouteSrc", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReplaceRouteSrc indicates an expected call of ReplaceRouteSrc
+func (mr *MockNetworkAPIsMockRecorder) ReplaceRouteSrc(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReplaceRouteSrc", reflect.TypeOf((*MockNetworkAPIs)(nil).ReplaceRouteSrc), arg0, arg1)
+}
+
+// RestoreHostNetwork mocks base method
+func (m *MockNetworkAPIs) RestoreHostNetwork(arg0 *networkutils.HostNetworkSnapshot) error {
+	ret := m.ctrl.Call(m, "RestoreHostNetwork", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RestoreHostNetwork indicates an expected call of RestoreHostNetwork
+func (mr *MockNetworkAPIsMockRecorder) RestoreHostNetwork(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RestoreHostNetwork", reflect.TypeOf((*MockNetworkAPIs)(nil).RestoreHostNetwork), arg0)
+}
+
+// SetupENIIPv6Network mocks base method
+func (m *MockNetworkAPIs) SetupENIIPv6Network(arg0 netip.Addr, arg1 string, arg2 int, arg3 netip.Prefix) error {
+	ret := m.ctrl.Call(m, "SetupENIIPv6Network", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetupENIIPv6Network indicates an expected call of SetupENIIPv6Network
+func (mr *MockNetworkAPIsMockRecorder) SetupENIIPv6Network(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetupENIIPv6Network", reflect.TypeOf((*MockNetworkAPIs)(nil).SetupENIIPv6Network), arg0, arg1, arg2, arg3)
+}
+
 // SetupENINetwork mocks base method
-func (m *MockNetworkAPIs) SetupENINetwork(arg0, arg1 string, arg2 int, arg3 string) error {
+func (m *MockNetworkAPIs) SetupENINetwork(arg0 netip.Addr, arg1 string, arg2 int, arg3 netip.Prefix) error {
 	ret := m.ctrl.Call(m, "SetupENINetwork", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].(error)
 	return ret0
@@ -99,7 +440,7 @@ func (mr *MockNetworkAPIsMockRecorder) SetupENINetwork(arg0, arg1, arg2, arg3 in
 }
 
 // SetupHostNetwork mocks base method
-func (m *MockNetworkAPIs) SetupHostNetwork(arg0 *net.IPNet, arg1 []*string, arg2 string, arg3 *net.IP) error {
+func (m *MockNetworkAPIs) SetupHostNetwork(arg0 netip.Prefix, arg1 []netip.Prefix, arg2 string, arg3 netip.Addr) error {
 	ret := m.ctrl.Call(m, "SetupHostNetwork", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].(error)
 	return ret0
@@ -110,8 +451,57 @@ func (mr *MockNetworkAPIsMockRecorder) SetupHostNetwork(arg0, arg1, arg2, arg3 i
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetupHostNetwork", reflect.TypeOf((*MockNetworkAPIs)(nil).SetupHostNetwork), arg0, arg1, arg2, arg3)
 }
 
+// SetupIPv4PrefixRoute mocks base method
+func (m *MockNetworkAPIs) SetupIPv4PrefixRoute(arg0 netip.Prefix) error {
+	ret := m.ctrl.Call(m, "SetupIPv4PrefixRoute", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetupIPv4PrefixRoute indicates an expected call of SetupIPv4PrefixRoute
+func (mr *MockNetworkAPIsMockRecorder) SetupIPv4PrefixRoute(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetupIPv4PrefixRoute", reflect.TypeOf((*MockNetworkAPIs)(nil).SetupIPv4PrefixRoute), arg0)
+}
+
+// SetupIPv6HostNetwork mocks base method
+func (m *MockNetworkAPIs) SetupIPv6HostNetwork(arg0 []netip.Prefix) error {
+	ret := m.ctrl.Call(m, "SetupIPv6HostNetwork", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetupIPv6HostNetwork indicates an expected call of SetupIPv6HostNetwork
+func (mr *MockNetworkAPIsMockRecorder) SetupIPv6HostNetwork(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetupIPv6HostNetwork", reflect.TypeOf((*MockNetworkAPIs)(nil).SetupIPv6HostNetwork), arg0)
+}
+
+// SnapshotHostNetwork mocks base method
+func (m *MockNetworkAPIs) SnapshotHostNetwork() (*networkutils.HostNetworkSnapshot, error) {
+	ret := m.ctrl.Call(m, "SnapshotHostNetwork")
+	ret0, _ := ret[0].(*networkutils.HostNetworkSnapshot)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SnapshotHostNetwork indicates an expected call of SnapshotHostNetwork
+func (mr *MockNetworkAPIsMockRecorder) SnapshotHostNetwork() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SnapshotHostNetwork", reflect.TypeOf((*MockNetworkAPIs)(nil).SnapshotHostNetwork))
+}
+
+// TeardownENINetwork mocks base method
+func (m *MockNetworkAPIs) TeardownENINetwork(arg0 int) error {
+	ret := m.ctrl.Call(m, "TeardownENINetwork", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// TeardownENINetwork indicates an expected call of TeardownENINetwork
+func (mr *MockNetworkAPIsMockRecorder) TeardownENINetwork(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TeardownENINetwork", reflect.TypeOf((*MockNetworkAPIs)(nil).TeardownENINetwork), arg0)
+}
+
 // UpdateRuleListBySrc mocks base method
-func (m *MockNetworkAPIs) UpdateRuleListBySrc(arg0 []netlink.Rule, arg1 net.IPNet, arg2 []string, arg3 bool) error {
+func (m *MockNetworkAPIs) UpdateRuleListBySrc(arg0 []netlink.Rule, arg1 netip.Prefix, arg2 []netip.Prefix, arg3 bool) error {
 	ret := m.ctrl.Call(m, "UpdateRuleListBySrc", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].(error)
 	return ret0
@@ -134,14 +524,14 @@ func (mr *MockNetworkAPIsMockRecorder) UseExternalSNAT() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UseExternalSNAT", reflect.TypeOf((*MockNetworkAPIs)(nil).UseExternalSNAT))
 }
 
-// GetExcludeSNATCIDRs mocks base method
-func (m *MockNetworkAPIs) GetExcludeSNATCIDRs() []string {
-	ret := m.ctrl.Call(m, "GetExcludeSNATCIDRs")
-	ret0, _ := ret[0].([]string)
+// VerifyHostNetwork mocks base method
+func (m *MockNetworkAPIs) VerifyHostNetwork() error {
+	ret := m.ctrl.Call(m, "VerifyHostNetwork")
+	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// GetExcludeSNATCIDRs indicates an expected call of GetExcludeSNATCIDRs
-func (mr *MockNetworkAPIsMockRecorder) GetExcludeSNATCIDRs() *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExcludeSNATCIDRs", reflect.TypeOf((*MockNetworkAPIs)(nil).GetExcludeSNATCIDRs))
+// VerifyHostNetwork indicates an expected call of VerifyHostNetwork
+func (mr *MockNetworkAPIsMockRecorder) VerifyHostNetwork() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "VerifyHostNetwork", reflect.TypeOf((*MockNetworkAPIs)(nil).VerifyHostNetwork))
 }
@@ -0,0 +1,137 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"net/netip"
+	"os"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/cidr"
+)
+
+const (
+	// envNAT64 is the name of the environment variable that routes the IPv6 traffic of pods to the NAT64 prefix, so that
+	// pods resolving IPv4-only destinations through DNS64 can reach them over IPv6. With "vpc", the prefix is routed
+	// through the primary interface to the VPC router, whose route table sends it to a NAT gateway. With "node", it is
+	// routed to the tun device of a NAT64 running on the node, e.g. TAYGA. Requires AWS_VPC_K8S_CNI_ENABLE_IPV6.
+	// Defaults to empty, which leaves the prefix to the default route.
+	envNAT64 = "AWS_VPC_K8S_CNI_NAT64"
+
+	// envNAT64Prefix is the name of the environment variable that sets the prefix DNS64 synthesizes the IPv6 addresses
+	// of IPv4-only destinations in. Defaults to the well-known prefix 64:ff9b::/96.
+	envNAT64Prefix = "AWS_VPC_K8S_CNI_NAT64_PREFIX"
+
+	// envNAT64Device is the name of the environment variable that sets the device of the NAT64 of the node, when
+	// AWS_VPC_K8S_CNI_NAT64 is "node". Defaults to "nat64".
+	envNAT64Device     = "AWS_VPC_K8S_CNI_NAT64_DEVICE"
+	defaultNAT64Device = "nat64"
+)
+
+var defaultNAT64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+type nat64Mode string
+
+const (
+	nat64Off nat64Mode = "off"
+	// nat64VPC routes the NAT64 prefix to the VPC, where a NAT gateway translates it
+	nat64VPC nat64Mode = "vpc"
+	// nat64Node routes the NAT64 prefix to a NAT64 running on the node
+	nat64Node nat64Mode = "node"
+)
+
+func getNAT64Mode() nat64Mode {
+	strValue := os.Getenv(envNAT64)
+	switch mode := nat64Mode(strValue); mode {
+	case "":
+		return nat64Off
+	case nat64Off, nat64VPC, nat64Node:
+		return mode
+	default:
+		log.Errorf("Failed to parse %s; using default: %s. Provided string was %q", envNAT64, nat64Off, strValue)
+		return nat64Off
+	}
+}
+
+func getNAT64Prefix() netip.Prefix {
+	strValue := os.Getenv(envNAT64Prefix)
+	if strValue == "" {
+		return defaultNAT64Prefix
+	}
+	prefix, err := cidr.Parse(strValue)
+	if err != nil || !prefix.Addr().Is6() {
+		log.Errorf("Failed to parse %s; using default: %s. Provided string was %q", envNAT64Prefix, defaultNAT64Prefix,
+			strValue)
+		return defaultNAT64Prefix
+	}
+	return prefix
+}
+
+func getNAT64Device() string {
+	if device := os.Getenv(envNAT64Device); device != "" {
+		return device
+	}
+	return defaultNAT64Device
+}
+
+func (n *linuxNetwork) nat64Enabled() bool {
+	return n.nat64 == nat64VPC || n.nat64 == nat64Node
+}
+
+// setupNAT64Route routes the NAT64 prefix in the main route table, which the IPv6 traffic of pods uses
+func (n *linuxNetwork) setupNAT64Route() error {
+	if !n.nat64Enabled() {
+		return nil
+	}
+	route := netlink.Route{Dst: cidr.IPNet(n.nat64Prefix), Table: mainRoutingTable}
+	if n.nat64 == nat64Node {
+		link, err := n.netLink.LinkByName(n.nat64Device)
+		if err != nil {
+			return errors.Wrapf(err, "failed to find NAT64 device %s", n.nat64Device)
+		}
+		route.LinkIndex = link.Attrs().Index
+		route.Scope = netlink.SCOPE_LINK
+	} else {
+		gw, err := n.ipv6DefaultGateway()
+		if err != nil {
+			return err
+		}
+		route.LinkIndex = gw.LinkIndex
+		route.Gw = gw.Gw
+	}
+	log.Infof("Routing NAT64 prefix %s through %s", n.nat64Prefix, n.nat64)
+	if err := n.netLink.RouteReplace(&route); err != nil {
+		return errors.Wrapf(err, "failed to route NAT64 prefix %s", n.nat64Prefix)
+	}
+	return nil
+}
+
+// ipv6DefaultGateway returns the IPv6 default route of the main route table, learnt from the router advertisements of
+// the VPC
+func (n *linuxNetwork) ipv6DefaultGateway() (netlink.Route, error) {
+	routes, err := n.netLink.RouteList(nil, unix.AF_INET6)
+	if err != nil {
+		return netlink.Route{}, errors.Wrap(err, "failed to list IPv6 routes")
+	}
+	for _, route := range routes {
+		if route.Dst == nil && route.Gw != nil {
+			return route, nil
+		}
+	}
+	return netlink.Route{}, errors.New("no IPv6 default route to send the NAT64 prefix to")
+}
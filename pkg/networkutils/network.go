@@ -14,16 +14,17 @@
 package networkutils
 
 import (
-	"encoding/binary"
 	"encoding/csv"
 	"fmt"
-	"io"
 	"math"
 	"net"
+	"net/netip"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -35,8 +36,12 @@ import (
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/vishvananda/netlink"
 
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/capabilities"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/netlinkwrapper"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/nswrapper"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/procsyswrapper"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/cidr"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/retry"
 )
 
 const (
@@ -48,6 +53,9 @@ const (
 	// 1024 is reserved for (ip rule not to <vpc's subnet> table main)
 	hostRulePriority = 1024
 
+	// unmanagedCIDRRulePriority is used for the rules that send traffic to unmanaged CIDRs through the main route table
+	unmanagedCIDRRulePriority = 1000
+
 	// 1025 - 1535 can be used priority lower than fromPodRulePriority but higher than default nonVPC CIDR rule
 	fromPodRulePriority = 1536
 
@@ -64,11 +72,18 @@ const (
 	envExcludeSNATCIDRs = "AWS_VPC_K8S_CNI_EXCLUDE_SNAT_CIDRS"
 
 	// This environment is used to specify weather the SNAT rule added to iptables should randomize port
-	// allocation for outgoing connections. If set to "hashrandom" the SNAT iptables rule will have the "--random" flag
-	// added to it. Set it to "prng" if you want to use a pseudo random numbers, i.e. "--random-fully".
-	// Defaults to hashrandom.
+	// allocation for outgoing connections, it names the SNATStrategy of the rule. If set to "hashrandom" the SNAT
+	// iptables rule will have the "--random" flag added to it. Set it to "prng" or "random-fully" if you want to use a
+	// pseudo random numbers, i.e. "--random-fully", or to "none" to disable randomization. Defaults to hashrandom,
+	// which "default" also selects.
 	envRandomizeSNAT = "AWS_VPC_K8S_CNI_RANDOMIZESNAT"
 
+	// envSNATTarget is the name of the environment variable that selects the target of the SNAT rule for traffic
+	// leaving the VPC. Set it to "masquerade" to use MASQUERADE, which takes the address of the outgoing interface for
+	// each new connection, so that egress keeps working when the primary IP changes without the rule being rewritten.
+	// Defaults to "snat", which uses SNAT --to-source with the primary IP.
+	envSNATTarget = "AWS_VPC_K8S_CNI_SNAT_TARGET"
+
 	// envNodePortSupport is the name of environment variable that configures whether we implement support for
 	// NodePorts on the primary ENI.  This requires that we add additional iptables rules and loosen the kernel's
 	// RPF check as described below.  Defaults to true.
@@ -87,51 +102,300 @@ const (
 	// - Calico uses 0xffff0000.
 	defaultConnmark = 0x80
 
+	// envEgressMultipath is the name of the environment variable that enables spreading pod egress flows across all
+	// secondary ENIs in the same subnet when external SNAT is used. The default route of each ENI route table is
+	// replaced by an ECMP route over every ENI in the subnet, so flows are hashed across ENIs instead of all leaving
+	// through the ENI the pod IP belongs to. This requires source/destination checking to be disabled on the ENIs.
+	// Defaults to false.
+	envEgressMultipath = "AWS_VPC_K8S_CNI_EGRESS_MULTIPATH"
+
+	// envNetlinkOpsPerSec is the name of the environment variable that limits the rate of route and rule changes
+	// made by ipamd and the CNI plugin, so that a flood of changes on nodes with heavy pod churn does not starve other
+	// netlink users. The changes of pods being added are served before the changes of deletes and clean-ups. Defaults
+	// to 0, which disables the limit.
+	envNetlinkOpsPerSec = "AWS_VPC_K8S_CNI_NETLINK_OPS_PER_SEC"
+
+	// envNetlinkOpsBurst is the name of the environment variable that sets how many route and rule changes can be
+	// made back to back before AWS_VPC_K8S_CNI_NETLINK_OPS_PER_SEC applies. Defaults to 10.
+	envNetlinkOpsBurst = "AWS_VPC_K8S_CNI_NETLINK_OPS_BURST"
+
+	defaultNetlinkOpsBurst = 10
+
+	// envUnmanagedInterfaces is the name of the environment variable that lists network interfaces the CNI must never
+	// modify, e.g. a VPN tunnel or NICs bound to DPDK. A trailing "+" matches every interface with that prefix, as in
+	// iptables. Traffic leaving through these interfaces is not SNATed. Defaults to empty.
+	envUnmanagedInterfaces = "AWS_VPC_K8S_CNI_UNMANAGED_INTERFACES"
+
+	// envUnmanagedCIDRs is the name of the environment variable that lists IPv4 CIDRs whose traffic the CNI must leave
+	// alone. Traffic to these CIDRs is not SNATed and is always routed using the main route table, so that it keeps
+	// following the routes of the interfaces that serve them. Defaults to empty.
+	envUnmanagedCIDRs = "AWS_VPC_K8S_CNI_UNMANAGED_CIDRS"
+
+	// envVethPrefix is the name of the environment variable that holds the prefix of the host-side veth devices of the
+	// pods, which is also used to configure the CNI plugin. Defaults to "eni".
+	envVethPrefix     = "AWS_VPC_K8S_CNI_VETHPREFIX"
+	defaultVethPrefix = "eni"
+
+	// envPrimaryInterface is the name of the environment variable that overrides the name of the primary interface, which
+	// is otherwise found from its MAC address. It is used for the NodePort connmark rule and RPF setting.
+	envPrimaryInterface = "AWS_VPC_K8S_CNI_PRIMARY_INTERFACE"
+
+	// envPodInterfacePattern is the name of the environment variable that overrides the iptables interface pattern used
+	// to match traffic coming from pods in the connmark restore rule, e.g. for a bridged setup. Defaults to the veth
+	// prefix followed by "+".
+	envPodInterfacePattern = "AWS_VPC_K8S_CNI_POD_INTERFACE_PATTERN"
+
+	// envTenantLabel is the name of the environment variable that holds the key of the namespace label used to group
+	// pods into tenants. Pods of a tenant only get IPs from secondary ENIs dedicated to that tenant, and their traffic
+	// leaving the VPC is SNATed to the primary IP of their ENI, so that each tenant's egress can be told apart by source
+	// IP. Defaults to empty, which disables multi-tenant mode.
+	envTenantLabel = "AWS_VPC_K8S_CNI_TENANT_LABEL"
+
+	// envEnableIPv6 is the name of the environment variable that enables dual-stack pods. Each pod then also gets an
+	// IPv6 address of the ENI of its IPv4 address, or of the primary ENI, whose subnet must have an IPv6 CIDR. IPv6
+	// traffic of pods is routed with the route table of their ENI, the main one for the primary ENI, and is not SNATed.
+	// Defaults to false.
+	envEnableIPv6 = "AWS_VPC_K8S_CNI_ENABLE_IPV6"
+
+	// envIPv6SNAT is the name of the environment variable that enables SNAT of the IPv6 traffic of pods leaving the VPC,
+	// independently of AWS_VPC_K8S_CNI_EXTERNALSNAT. The traffic is masqueraded to the IPv6 address of the interface it
+	// leaves through. Defaults to false, since pod IPv6 addresses are globally routable, e.g. through an egress-only
+	// internet gateway.
+	envIPv6SNAT = "AWS_VPC_K8S_CNI_IPV6_SNAT"
+
+	// envIPv6ExcludeSNATCIDRs is the name of the environment variable that holds a comma separated list of IPv6 CIDRs
+	// to exclude from SNAT when AWS_VPC_K8S_CNI_IPV6_SNAT is enabled. Defaults to empty.
+	envIPv6ExcludeSNATCIDRs = "AWS_VPC_K8S_CNI_IPV6_EXCLUDE_SNAT_CIDRS"
+
+	// tenantSNATChain is the nat chain holding the SNAT rules of the ENIs dedicated to tenants
+	tenantSNATChain = "AWS-TENANT-SNAT"
+
+	// envIptablesCheck is the name of the environment variable that controls the periodic check for rules written into
+	// the nat POSTROUTING chain by others (e.g. firewalld or security agents) that keep pod traffic from reaching the AWS
+	// SNAT chain, or for the jump to that chain having been removed. Set it to "warn" to report these rules with a node
+	// condition and events, or to "repair" to also move the jump back before them. Defaults to "off".
+	envIptablesCheck = "AWS_VPC_K8S_CNI_IPTABLES_CHECK"
+
+	// envIptablesRulePosition is the name of the environment variable that controls where the jump to the AWS SNAT chain
+	// in nat POSTROUTING and the connmark rules in mangle PREROUTING go relative to the rules of others, like the
+	// kube-proxy MASQUERADE rules. Set it to "insert" to keep them before these rules, or to "append" to keep them after
+	// them. When set, rules found in the wrong place are moved. Defaults to appending new rules and leaving existing ones
+	// where they are.
+	envIptablesRulePosition = "AWS_VPC_K8S_CNI_IPTABLES_RULE_POSITION"
+
+	// maxInterfaceNameLen is the maximum length of an interface name, IFNAMSIZ minus the terminating null byte
+	maxInterfaceNameLen = 15
+
+	// defaultPrimaryInterface is the name assumed for the primary interface if it can not be found by MAC address
+	defaultPrimaryInterface = "eth0"
+
 	// envMTU gives a way to configure the MTU size for new ENIs attached. Range is from 576 to 9001.
 	envMTU = "AWS_VPC_ENI_MTU"
 
 	// Range of MTU for each ENI and veth pair. Defaults to maximumMTU
 	minimumMTU = 576
 	maximumMTU = 9001
+)
 
-	// number of retries to add a route
-	maxRetryRouteAdd = 5
-
-	retryRouteAddInterval = 5 * time.Second
-
-	// number of attempts to find an ENI by MAC address after it is attached
-	maxAttemptsLinkByMac = 5
+var (
+	// routeAddRetryPolicy is how a route to an ENI's gateway is retried while the gateway is not reachable yet
+	routeAddRetryPolicy = retry.Policy{
+		Name:         "ROUTE_ADD",
+		InitialDelay: 5 * time.Second,
+		MaxDelay:     5 * time.Second,
+		Multiplier:   1,
+		MaxAttempts:  6,
+	}
 
-	retryLinkByMacInterval = 3 * time.Second
+	// linkByMacRetryPolicy is how an ENI is looked up by MAC address while it is being attached
+	linkByMacRetryPolicy = retry.Policy{
+		Name:         "LINK_BY_MAC",
+		InitialDelay: 3 * time.Second,
+		MaxDelay:     3 * time.Second,
+		Multiplier:   1,
+		MaxAttempts:  5,
+	}
 )
 
+// ErrUnmanagedInterface is the prefix of the error returned when asked to set up an interface listed in
+// AWS_VPC_K8S_CNI_UNMANAGED_INTERFACES
+const ErrUnmanagedInterface = "setupENINetwork: refusing to modify unmanaged interface"
+
+// DataplaneSettings are the environment variables that change the rules, routes and iptables of the host, which ipamd
+// only reads when it starts
+var DataplaneSettings = []string{
+	envExternalSNAT,
+	envExcludeSNATCIDRs,
+	envRandomizeSNAT,
+	envSNATTarget,
+	envNodePortSupport,
+	envNodePortInterfaces,
+	envConnmark,
+	envEgressMultipath,
+	envMTU,
+	envIPv6SNAT,
+	envIPv6ExcludeSNATCIDRs,
+	envOverlappingCIDRs,
+	envNAT64,
+	envNAT64Prefix,
+	envNAT64Device,
+	envEgressGateway,
+	envFirewallSubnetCIDRs,
+	envKubeProxyMode,
+	envMarkPreset,
+	envPodFlags,
+	envPodSNATExclusions,
+	envPodENI,
+}
+
 // NetworkAPIs defines the host level and the eni level network related operations
 type NetworkAPIs interface {
 	// SetupNodeNetwork performs node level network configuration
-	SetupHostNetwork(vpcCIDR *net.IPNet, vpcCIDRs []*string, primaryMAC string, primaryAddr *net.IP) error
+	SetupHostNetwork(vpcCIDR netip.Prefix, vpcCIDRs []netip.Prefix, primaryMAC string, primaryAddr netip.Addr) error
 	// SetupENINetwork performs eni level network configuration
-	SetupENINetwork(eniIP string, mac string, table int, subnetCIDR string) error
+	SetupENINetwork(eniIP netip.Addr, mac string, table int, subnetCIDR netip.Prefix) error
+	// SetupENIIPv6Network performs eni level network configuration of the IPv6 traffic of pods
+	SetupENIIPv6Network(eniIPv6 netip.Addr, mac string, table int, subnetIPv6CIDR netip.Prefix) error
 	UseExternalSNAT() bool
-	GetExcludeSNATCIDRs() []string
+	GetExcludeSNATCIDRs() []netip.Prefix
 	GetRuleList() ([]netlink.Rule, error)
-	GetRuleListBySrc(ruleList []netlink.Rule, src net.IPNet) ([]netlink.Rule, error)
-	UpdateRuleListBySrc(ruleList []netlink.Rule, src net.IPNet, toCIDRs []string, toFlag bool) error
-	DeleteRuleListBySrc(src net.IPNet) error
+	GetIPv6RuleList() ([]netlink.Rule, error)
+	GetRuleListBySrc(ruleList []netlink.Rule, src netip.Prefix) ([]netlink.Rule, error)
+	UpdateRuleListBySrc(ruleList []netlink.Rule, src netip.Prefix, toCIDRs []netip.Prefix, toFlag bool) error
+	DeleteRuleListBySrc(src netip.Prefix) error
+	// CheckSNATRules looks for rules written by others that bypass the AWS SNAT chain, and repairs them if configured
+	CheckSNATRules() (SNATRulesCheck, error)
+	// ReplaceRouteSrc changes the preferred source of the routes that use oldSrc to newSrc
+	ReplaceRouteSrc(oldSrc, newSrc netip.Addr) error
+	// GetPodIPv6sFromRoutes returns the IPv6 address of each pod, keyed by its IPv4 address
+	GetPodIPv6sFromRoutes() (map[string]string, error)
+	// SetupIPv6HostNetwork performs node level network configuration of the IPv6 traffic of pods
+	SetupIPv6HostNetwork(vpcIPv6CIDRs []netip.Prefix) error
+	// GetPodVeths returns the host-side veth devices of the pods, with the addresses routed to them
+	GetPodVeths() ([]PodVeth, error)
+	// DeletePodVeth deletes the host-side veth device of a pod, its routes, and the rules of its addresses
+	DeletePodVeth(veth PodVeth) error
+	// GetRouteTableIDs returns the route tables other than the main, local and default ones that are in use
+	GetRouteTableIDs() ([]int, error)
+	// FlushRouteTable deletes the routes of a route table and the rules that look it up
+	FlushRouteTable(table int) error
+	// TeardownENINetwork removes the ENI of a route table from the egress paths of the other ENIs
+	TeardownENINetwork(table int) error
+	// GetENIReferences returns the rules and routes that still reference an ENI or its secondary IPs
+	GetENIReferences(eniTable int, ips []string) ([]string, error)
+	// SnapshotHostNetwork saves what SetupHostNetwork changes, so that it can be restored if the setup fails
+	SnapshotHostNetwork() (*HostNetworkSnapshot, error)
+	// RestoreHostNetwork puts back the state saved by SnapshotHostNetwork
+	RestoreHostNetwork(snapshot *HostNetworkSnapshot) error
+	// VerifyHostNetwork checks that the rules of the last SetupHostNetwork are in place
+	VerifyHostNetwork() error
+	// ExportNetworkState returns the rules, routes and iptables chains the plugin owns on the node
+	ExportNetworkState() (*NetworkState, error)
+	// ImportNetworkState applies the rules, routes and iptables chains of an exported NetworkState
+	ImportNetworkState(state *NetworkState) (*NetworkStateImport, error)
+	// AddEgressGatewayExemption keeps the egress traffic of a pod with a gateway from being SNATed on the node
+	AddEgressGatewayExemption(podIP string) error
+	// DelEgressGatewayExemption removes the exemption of a pod from SNAT, and returns whether it had one
+	DelEgressGatewayExemption(podIP string) (bool, error)
+	// AddPodFlagRules adds the rules of a pod for its no-snat and metadata-block flags
+	AddPodFlagRules(podIP string, noSNAT, blockMetadata bool) error
+	// DelPodFlagRules removes the rules of a pod for its flags, if it has any
+	DelPodFlagRules(podIP string) error
+	// SetupIPv4PrefixRoute drops the traffic to the addresses of an IPv4 prefix of an ENI that no pod uses
+	SetupIPv4PrefixRoute(prefix netip.Prefix) error
+	// DeleteIPv4PrefixRoute removes the route of an IPv4 prefix that is no longer assigned to an ENI
+	DeleteIPv4PrefixRoute(prefix netip.Prefix) error
+	// CheckKubeProxy finds out the mode of kube-proxy and looks for mismatches with the host network
+	CheckKubeProxy() (KubeProxyCheck, error)
+	// CheckMarks looks for rules of others that use the marks of the host rules
+	CheckMarks() ([]string, error)
+	// AddMirror mirrors the traffic of an interface to a capture interface, and returns whether it created the latter
+	AddMirror(source, target string) (bool, error)
+	// DelMirror stops mirroring the traffic of an interface, and deletes the capture interface if asked to
+	DelMirror(source, target string, deleteTarget bool) error
+	// GetInterfaceName returns the name of the interface with the given MAC address
+	GetInterfaceName(mac string) (string, error)
+	// GetVFs returns the SR-IOV virtual functions of an interface that are in the host network namespace
+	GetVFs(pf string) ([]string, error)
+	// GetNUMANode returns the NUMA node of the network card of the interface with the given MAC address, -1 if unknown
+	GetNUMANode(mac string) (int, error)
+	// GetDropCounts returns the number of packets from or to pods likely to be dropped, by reason, nil if drop
+	// tracing is off
+	GetDropCounts() (map[string]uint64, error)
+}
+
+// PodVeth is the host-side veth device of a pod
+type PodVeth struct {
+	Name string
+	// IPs are the addresses with a host route to the veth
+	IPs []netip.Addr
 }
 
 type linuxNetwork struct {
 	useExternalSNAT        bool
-	excludeSNATCIDRs       []string
-	typeOfSNAT             snatType
+	excludeSNATCIDRs       []netip.Prefix
+	overlappingCIDRs       []netip.Prefix
+	snatStrategy           SNATStrategy
+	snatTarget             snatTarget
 	nodePortSupportEnabled bool
+	nodePortInterfaces     []string
 	connmark               uint32
 	mtu                    int
+	egressMultipath        bool
+	unmanagedInterfaces    []string
+	unmanagedCIDRs         []netip.Prefix
+	vethPrefix             string
+	primaryInterface       string
+	podInterfacePattern    string
+	tenantLabel            string
+	iptablesCheck          iptablesCheckMode
+	iptablesRulePosition   iptablesRulePosition
+	ipv6Enabled            bool
+	ipv6SNAT               bool
+	ipv6ExcludeSNATCIDRs   []netip.Prefix
+	nat64                  nat64Mode
+	nat64Prefix            netip.Prefix
+	nat64Device            string
+	egressGateway          bool
+	podFlags               []string
+	podSNATExclusions      bool
+	podENI                 bool
+	firewallSubnetCIDRs    []netip.Prefix
+	kubeProxyModeSetting   KubeProxyMode
+	dropTracing            bool
+	dropLogRate            string
+	nftMode                nftMode
+
+	// egressPathsLock protects egressPaths
+	egressPathsLock sync.Mutex
+	// egressPaths maps the route table of each secondary ENI to its default gateway
+	egressPaths map[int]egressPath
+
+	// throttlePath is the file of the netlink throttle that ipamd shares with the CNI plugin, set up with
+	// netlinkOpsPerSec and netlinkOpsBurst by SetupHostNetwork. It is left alone when empty.
+	throttlePath     string
+	netlinkOpsPerSec int
+	netlinkOpsBurst  int
 
 	netLink     netlinkwrapper.NetLink
 	ns          nswrapper.NS
 	newIptables func() (iptablesIface, error)
-	mainENIMark uint32
-	openFile    func(name string, flag int, perm os.FileMode) (stringWriteCloser, error)
+	// newIp6tables returns the ip6tables for the rules of the IPv6 traffic of pods
+	newIp6tables func() (iptablesIface, error)
+	// newSystemIptables returns the iptables of the node whatever the backend of the host rules, to look at the rules
+	// of others such as kube-proxy. newIptables is used when it is not set.
+	newSystemIptables func() (iptablesIface, error)
+	// newOtherBackend returns the backend the host rules are not programmed with, for IPv4 or IPv6, to delete the rules
+	// left there in another mode. It returns nil if that backend is not on the node.
+	newOtherBackend func(ipv6 bool) (iptablesIface, error)
+	mainENIMark     uint32
+	procSys         procsyswrapper.ProcSys
+	// capabilities returns the features of the node, which are only probed when first needed
+	capabilities func() capabilities.Capabilities
+	// kubeProxyMode asks kube-proxy for its mode
+	kubeProxyMode func() (string, error)
+	// lastHostRules are the iptables rules of the last SetupHostNetwork, for VerifyHostNetwork
+	lastHostRules *hostRules
 }
 
 type iptablesIface interface {
@@ -140,6 +404,7 @@ type iptablesIface interface {
 	Append(table, chain string, rulespec ...string) error
 	Delete(table, chain string, rulespec ...string) error
 	List(table, chain string) ([]string, error)
+	ListWithCounters(table, chain string) ([]string, error)
 	NewChain(table, chain string) error
 	ClearChain(table, chain string) error
 	DeleteChain(table, chain string) error
@@ -147,42 +412,123 @@ type iptablesIface interface {
 	HasRandomFully() bool
 }
 
-type snatType uint32
+// snatCIDR is a destination whose traffic is not SNATed to the primary IP
+type snatCIDR struct {
+	cidr        netip.Prefix
+	isExclusion bool
+	// iface is set instead of cidr for traffic leaving through an unmanaged interface
+	iface string
+}
+
+type snatTarget string
+
+const (
+	snatTargetSNAT       snatTarget = "snat"
+	snatTargetMasquerade snatTarget = "masquerade"
+)
+
+type iptablesCheckMode string
+
+const (
+	iptablesCheckOff    iptablesCheckMode = "off"
+	iptablesCheckWarn   iptablesCheckMode = "warn"
+	iptablesCheckRepair iptablesCheckMode = "repair"
+)
+
+type iptablesRulePosition string
 
 const (
-	sequentialSNAT snatType = iota
-	randomHashSNAT
-	randomPRNGSNAT
+	// iptablesRuleAppendNew appends missing rules and leaves existing ones alone
+	iptablesRuleAppendNew iptablesRulePosition = ""
+	iptablesRuleAppend    iptablesRulePosition = "append"
+	iptablesRuleInsert    iptablesRulePosition = "insert"
 )
 
+// snatChain returns the traffic to the VPC and to the excluded CIDRs, and SNATs the rest. Before, there was one
+// AWS-SNAT-CHAIN-<n> chain per CIDR, each jumping to the next one, so the chain keeps the name of the first of them.
+const snatChain = "AWS-SNAT-CHAIN-0"
+
+// snatChainJumpRule sends the traffic leaving the node to the AWS SNAT chain
+var snatChainJumpRule = []string{"-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", snatChain}
+
+// SNATRulesCheck is the outcome of looking for nat POSTROUTING rules that keep traffic from reaching the AWS SNAT chain
+type SNATRulesCheck struct {
+	// Problems describes what was found, it is empty if the jump to the AWS SNAT chain is in place and not bypassed
+	Problems []string
+	// Repaired is true if the jump to the AWS SNAT chain was moved or added back to fix the problems
+	Repaired bool
+}
+
 // New creates a linuxNetwork object
 func New() NetworkAPIs {
+	nftMode := getNFTMode()
 	return &linuxNetwork{
 		useExternalSNAT:        useExternalSNAT(),
-		excludeSNATCIDRs:       getExcludeSNATCIDRs(),
-		typeOfSNAT:             typeOfSNAT(),
+		excludeSNATCIDRs:       getSNATExclusions(),
+		overlappingCIDRs:       getOverlappingCIDRs(),
+		snatStrategy:           getSNATStrategy(),
+		snatTarget:             getSNATTarget(),
 		nodePortSupportEnabled: nodePortSupportEnabled(),
+		nodePortInterfaces:     getNodePortInterfaces(),
 		mainENIMark:            getConnmark(),
 		mtu:                    GetEthernetMTU(),
-
-		netLink: netlinkwrapper.NewNetLink(),
-		ns:      nswrapper.NewNS(),
+		egressMultipath:        egressMultipathEnabled(),
+		egressPaths:            make(map[int]egressPath),
+		unmanagedInterfaces:    getUnmanagedInterfaces(),
+		unmanagedCIDRs:         getUnmanagedCIDRs(),
+		vethPrefix:             getVethPrefix(),
+		primaryInterface:       getInterfaceEnvVar(envPrimaryInterface),
+		podInterfacePattern:    getInterfaceEnvVar(envPodInterfacePattern),
+		tenantLabel:            TenantLabel(),
+		iptablesCheck:          getIptablesCheckMode(),
+		iptablesRulePosition:   getIptablesRulePosition(),
+		ipv6Enabled:            IPv6Enabled(),
+		ipv6SNAT:               ipv6SNATEnabled(),
+		ipv6ExcludeSNATCIDRs:   getIPv6ExcludeSNATCIDRs(),
+		nat64:                  getNAT64Mode(),
+		nat64Prefix:            getNAT64Prefix(),
+		nat64Device:            getNAT64Device(),
+		egressGateway:          EgressGatewayEnabled(),
+		podFlags:               AllowedPodFlags(),
+		podSNATExclusions:      SNATExclusionAnnotationsEnabled(),
+		podENI:                 PodENIEnabled(),
+		firewallSubnetCIDRs:    getFirewallSubnetCIDRs(),
+		kubeProxyModeSetting:   getKubeProxyModeSetting(),
+		dropTracing:            DropTracingEnabled(),
+		dropLogRate:            getDropLogRate(),
+		nftMode:                nftMode,
+
+		netLink: netlinkwrapper.NewThrottledNetLink(netlinkwrapper.NewFaultyNetLink(netlinkwrapper.NewNetLink()),
+			netlinkwrapper.DefaultThrottlePath),
+		throttlePath:     netlinkwrapper.DefaultThrottlePath,
+		netlinkOpsPerSec: getNetlinkOpsPerSec(),
+		netlinkOpsBurst:  getNetlinkOpsBurst(),
+		ns:               nswrapper.NewNS(),
 		newIptables: func() (iptablesIface, error) {
-			ipt, err := iptables.New()
-			return ipt, err
+			return newHostIptables(iptables.ProtocolIPv4, nftMode)
+		},
+		newIp6tables: func() (iptablesIface, error) {
+			return newHostIptables(iptables.ProtocolIPv6, nftMode)
 		},
-		openFile: func(name string, flag int, perm os.FileMode) (stringWriteCloser, error) {
-			return os.OpenFile(name, flag, perm)
+		newSystemIptables: func() (iptablesIface, error) {
+			return newHostIptables(iptables.ProtocolIPv4, nftModeOff)
+		},
+		newOtherBackend: func(ipv6 bool) (iptablesIface, error) {
+			if ipv6 {
+				return newOtherHostIptables(iptables.ProtocolIPv6, nftMode)
+			}
+			return newOtherHostIptables(iptables.ProtocolIPv4, nftMode)
+		},
+		procSys:      procsyswrapper.NewProcSys(),
+		capabilities: capabilities.Get,
+		kubeProxyMode: func() (string, error) {
+			return getKubeProxyMode(getKubeProxyMetricsAddr())
 		},
 	}
 }
 
-type stringWriteCloser interface {
-	io.Closer
-	WriteString(s string) (int, error)
-}
-
-// find out the primary interface name
+// findPrimaryInterfaceName finds the name of the primary interface from its MAC address, as reported by IMDS, so that
+// it works regardless of the naming scheme of the distro (eth0, ens5, enX0...)
 func findPrimaryInterfaceName(primaryMAC string) (string, error) {
 	log.Debugf("Trying to find primary interface that has mac : %s", primaryMAC)
 
@@ -195,7 +541,7 @@ func findPrimaryInterfaceName(primaryMAC string) (string, error) {
 	for _, intf := range interfaces {
 		log.Debugf("Discovered interface: %v, mac: %v", intf.Name, intf.HardwareAddr)
 
-		if strings.Compare(primaryMAC, intf.HardwareAddr.String()) == 0 {
+		if strings.EqualFold(primaryMAC, intf.HardwareAddr.String()) {
 			log.Infof("Discovered primary interface: %s", intf.Name)
 			return intf.Name, nil
 		}
@@ -206,11 +552,18 @@ func findPrimaryInterfaceName(primaryMAC string) (string, error) {
 }
 
 // SetupHostNetwork performs node level network configuration
-func (n *linuxNetwork) SetupHostNetwork(vpcCIDR *net.IPNet, vpcCIDRs []*string, primaryMAC string, primaryAddr *net.IP) error {
+func (n *linuxNetwork) SetupHostNetwork(vpcCIDR netip.Prefix, vpcCIDRs []netip.Prefix, primaryMAC string, primaryAddr netip.Addr) error {
 	log.Info("Setting up host network... ")
 
+	// The CNI plugin takes the tokens of its route and rule changes from the same throttle
+	if n.throttlePath != "" {
+		if err := netlinkwrapper.ShareThrottle(n.throttlePath, n.netlinkOpsPerSec, n.netlinkOpsBurst); err != nil {
+			return errors.Wrap(err, "host network setup: failed to set up the netlink throttle")
+		}
+	}
+
 	hostRule := n.netLink.NewRule()
-	hostRule.Dst = vpcCIDR
+	hostRule.Dst = cidr.IPNet(vpcCIDR)
 	hostRule.Table = mainRoutingTable
 	hostRule.Priority = hostRulePriority
 	hostRule.Invert = true
@@ -222,14 +575,26 @@ func (n *linuxNetwork) SetupHostNetwork(vpcCIDR *net.IPNet, vpcCIDRs []*string,
 		return errors.Wrapf(err, "host network setup: failed to delete old host rule")
 	}
 
-	primaryIntf := "eth0"
-	if n.nodePortSupportEnabled {
+	// The primary interface name is also needed when node port support is disabled, to clean up the rules that match it
+	primaryIntf := n.primaryInterface
+	if primaryIntf == "" {
 		primaryIntf, err = findPrimaryInterfaceName(primaryMAC)
 		if err != nil {
-			return errors.Wrapf(err, "failed to SetupHostNetwork")
+			if n.nodePortSupportEnabled {
+				return errors.Wrapf(err, "failed to SetupHostNetwork")
+			}
+			log.Warnf("Failed to find primary interface, assuming %s: %v", defaultPrimaryInterface, err)
+			primaryIntf = defaultPrimaryInterface
 		}
-		// If node port support is enabled, configure the kernel's reverse path filter check on eth0 for "loose"
-		// filtering.  This is required because
+	}
+	if isUnmanagedInterface(primaryIntf, n.unmanagedInterfaces) {
+		return errors.Errorf("host network setup: primary interface %s is listed in %s", primaryIntf, envUnmanagedInterfaces)
+	}
+
+	nodePortInterfaces := n.resolveNodePortInterfaces(primaryIntf)
+	if n.nodePortSupportEnabled {
+		// If node port support is enabled, configure the kernel's reverse path filter check on eth0, and the other
+		// node port interfaces, for "loose" filtering.  This is required because
 		// - NodePorts are exposed on eth0
 		// - The kernel's RPF check happens after incoming packets to NodePorts are DNATted to the pod IP.
 		// - For pods assigned to secondary ENIs, the routing table includes source-based routing.  When the kernel does
@@ -237,13 +602,30 @@ func (n *linuxNetwork) SetupHostNetwork(vpcCIDR *net.IPNet, vpcCIDRs []*string,
 		// - Thus, it finds the source-based route that leaves via the secondary ENI.
 		// - In "strict" mode, the RPF check fails because the return path uses a different interface to the incoming
 		//   packet.  In "loose" mode, the check passes because some route was found.
-		primaryIntfRPFilter := "/proc/sys/net/ipv4/conf/" + primaryIntf + "/rp_filter"
 		const rpFilterLoose = "2"
+		for _, iface := range nodePortInterfaces {
+			rpFilter := "net/ipv4/conf/" + iface + "/rp_filter"
+			log.Debugf("Setting RPF for node port interface: %s", rpFilter)
+			err = n.procSys.Set(rpFilter, rpFilterLoose)
+			if err != nil {
+				return errors.Wrapf(err, "failed to configure %s RPF check", iface)
+			}
+		}
+	}
+	ipvs := n.nodePortSupportEnabled && n.ipvsEnabled()
+	if ipvs {
+		n.setIPVSConntrack()
+	}
 
-		log.Debugf("Setting RPF for primary interface: %s", primaryIntfRPFilter)
-		err = n.setProcSys(primaryIntfRPFilter, rpFilterLoose)
-		if err != nil {
-			return errors.Wrapf(err, "failed to configure %s RPF check", primaryIntf)
+	if n.ipv6Enabled {
+		// Forwarding stops the primary interface from accepting router advertisements, and with them its IPv6 default
+		// route, unless accept_ra is set to 2
+		acceptRA := "net/ipv6/conf/" + primaryIntf + "/accept_ra"
+		if err = n.procSys.Set(acceptRA, "2"); err != nil {
+			return errors.Wrapf(err, "failed to configure %s to accept router advertisements", primaryIntf)
+		}
+		if err = n.procSys.Set("net/ipv6/conf/all/forwarding", "1"); err != nil {
+			return errors.Wrap(err, "failed to enable IPv6 forwarding")
 		}
 	}
 
@@ -272,105 +654,140 @@ func (n *linuxNetwork) SetupHostNetwork(vpcCIDR *net.IPNet, vpcCIDRs []*string,
 		}
 	}
 
+	err = n.updateUnmanagedCIDRRules()
+	if err != nil {
+		return err
+	}
+
 	ipt, err := n.newIptables()
 	if err != nil {
 		return errors.Wrap(err, "host network setup: failed to create iptables")
 	}
 
-	type snatCIDR struct {
-		cidr        string
-		isExclusion bool
+	if len(n.overlappingCIDRs) > 0 {
+		vpcCIDRs = cidr.SubtractAll(vpcCIDRs, n.overlappingCIDRs)
+		log.Infof("Traffic to %v is SNATed since it overlaps with the other side of the network, VPC CIDRs routed "+
+			"directly: %v", n.overlappingCIDRs, vpcCIDRs)
+	}
+	hasRandomFully := false
+	if n.snatStrategy != nil && n.snatStrategy.RandomFully() {
+		hasRandomFully = n.nftEnabled() || n.capabilities().IptablesRandomFully
+		if !hasRandomFully {
+			log.Warn("prng (--random-fully) requested, but iptables version does not support it. " +
+				"Falling back to hashrandom (--random)")
+		}
+	}
+	hostRules := buildHostRules(hostRulesConfig{
+		vpcCIDR:                vpcCIDR,
+		vpcCIDRs:               vpcCIDRs,
+		excludeSNATCIDRs:       n.excludeSNATCIDRs,
+		unmanagedCIDRs:         n.unmanagedCIDRs,
+		unmanagedInterfaces:    n.unmanagedInterfaces,
+		primaryAddr:            primaryAddr,
+		primaryIntf:            primaryIntf,
+		nodePortInterfaces:     nodePortInterfaces,
+		vethPattern:            n.vethPattern(),
+		mainENIMark:            n.mainENIMark,
+		useExternalSNAT:        n.useExternalSNAT,
+		snatStrategy:           n.snatStrategy,
+		snatTarget:             n.snatTarget,
+		hasRandomFully:         hasRandomFully,
+		nodePortSupportEnabled: n.nodePortSupportEnabled,
+		ipvs:                   ipvs,
+		tenantSNAT:             n.tenantSNATEnabled(),
+		firewallSymmetry:       n.firewallSymmetryEnabled(),
+		podENI:                 n.podENI,
+	})
+	n.lastHostRules = &hostRules
+	n.warnNFTIgnoredSettings()
+	if err := n.applyHostRules(ipt, hostRules); err != nil {
+		return err
+	}
+	if err := n.deleteOtherBackendRules(false); err != nil {
+		// The rules of the backend in use work all the same
+		log.Warnf("Failed to delete the host rules left in the other backend: %v", err)
+	}
+	if err := deleteStaleConnmarkRules(ipt, hostRules); err != nil {
+		return err
+	}
+	if err := n.setupTenantSNATChain(ipt, hostRules.tenantSNATRules); err != nil {
+		return err
+	}
+	if err := n.setupFirewallSymmetry(ipt, primaryIntf); err != nil {
+		return err
+	}
+	if err := n.setupDropTracing(ipt); err != nil {
+		return err
+	}
+	if err := n.setupEgressGatewayChain(ipt, vpcCIDRs); err != nil {
+		return err
+	}
+	return n.setupPodFlagChains(ipt, vpcCIDRs)
+}
+
+// SetupIPv6HostNetwork sets up the ip6tables rules of the host for the IPv6 traffic of pods. Its SNAT policy and
+// exclusions are configured apart from the IPv4 ones, and by default IPv6 traffic keeps the address of the pod.
+func (n *linuxNetwork) SetupIPv6HostNetwork(vpcIPv6CIDRs []netip.Prefix) error {
+	if !n.ipv6Enabled {
+		return nil
+	}
+	log.Infof("Setting up host IPv6 network, SNAT: %v, VPC IPv6 CIDRs: %v", n.ipv6SNAT, vpcIPv6CIDRs)
+
+	ipt, err := n.newIp6tables()
+	if err != nil {
+		return errors.Wrap(err, "host IPv6 network setup: failed to create ip6tables")
+	}
+	hasRandomFully := false
+	if n.snatStrategy != nil && n.snatStrategy.RandomFully() {
+		hasRandomFully = n.nftEnabled() || n.capabilities().IptablesRandomFully
+	}
+	excludeSNATCIDRs := n.ipv6ExcludeSNATCIDRs
+	if n.nat64Enabled() {
+		// The NAT64 translates the source itself, and keeps the address of the pod visible to it
+		excludeSNATCIDRs = append(append([]netip.Prefix{}, excludeSNATCIDRs...), n.nat64Prefix)
 	}
-	var allCIDRs []snatCIDR
-	for _, cidr := range vpcCIDRs {
-		allCIDRs = append(allCIDRs, snatCIDR{cidr: *cidr, isExclusion: false})
+	if err := n.setupNAT64Route(); err != nil {
+		return errors.Wrap(err, "host IPv6 network setup")
 	}
-	for _, cidr := range n.excludeSNATCIDRs {
-		allCIDRs = append(allCIDRs, snatCIDR{cidr: cidr, isExclusion: true})
+	err = n.applyHostRules(ipt, buildHostRules(hostRulesConfig{
+		vpcCIDRs:         vpcIPv6CIDRs,
+		excludeSNATCIDRs: excludeSNATCIDRs,
+		useExternalSNAT:  !n.ipv6SNAT,
+		snatStrategy:     n.snatStrategy,
+		hasRandomFully:   hasRandomFully,
+		ipv6:             true,
+	}))
+	if err != nil {
+		return err
 	}
+	if err := n.deleteOtherBackendRules(true); err != nil {
+		log.Warnf("Failed to delete the host IPv6 rules left in the other backend: %v", err)
+	}
+	return nil
+}
 
+// applyHostRules makes the iptables rules match the desired state, and removes the SNAT rules that are not part of it
+func (n *linuxNetwork) applyHostRules(ipt iptablesIface, hostRules hostRules) error {
 	// if excludeSNATCIDRs or vpcCIDRs have changed they need to be cleared
-	snatStaleRulesToCheck, err := listCurrentSNATRules(ipt)
+	snatStaleRulesToCheck, snatChains, err := listCurrentSNATRules(ipt)
 	if err != nil {
 		return errors.Wrapf(err, "host network setup: failed to get SNAT chain rules to clear")
 	}
 
 	// build IPTABLES chain for SNAT of non-VPC outbound traffic and excluded CIDRs
-	var chains []string
-	for i := 0; i <= len(allCIDRs); i++ {
-		chain := fmt.Sprintf("AWS-SNAT-CHAIN-%d", i)
-		log.Debugf("Setup Host Network: iptables -N %s -t nat", chain)
-		if err := ipt.NewChain("nat", chain); err != nil && !containChainExistErr(err) {
-			log.Errorf("ipt.NewChain error for chain [%s]: %v", chain, err)
-			return errors.Wrapf(err, "host network setup: failed to add chain")
-		}
-		chains = append(chains, chain)
-	}
-
-	// build SNAT rules for outbound non-VPC traffic
-	var iptableRules []iptablesRule
-	log.Debugf("Setup Host Network: iptables -A POSTROUTING -m comment --comment \"AWS SNAT CHAIN\" -j AWS-SNAT-CHAIN-0")
-	iptableRules = append(iptableRules, iptablesRule{
-		name:        "first SNAT rules for non-VPC outbound traffic",
-		shouldExist: !n.useExternalSNAT,
-		table:       "nat",
-		chain:       "POSTROUTING",
-		rule: []string{
-			"-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-0",
-		}})
-
-	for i, cidr := range allCIDRs {
-		curChain := chains[i]
-		curName := fmt.Sprintf("[%d] AWS-SNAT-CHAIN", i)
-		nextChain := chains[i+1]
-		comment := "AWS SNAT CHAIN"
-		if cidr.isExclusion {
-			comment += " EXCLUSION"
-		}
-		log.Debugf("Setup Host Network: iptables -A %s ! -d %s -t nat -j %s", curChain, cidr, nextChain)
-
-		iptableRules = append(iptableRules, iptablesRule{
-			name:        curName,
-			shouldExist: !n.useExternalSNAT,
-			table:       "nat",
-			chain:       curChain,
-			rule: []string{
-				"!", "-d", cidr.cidr, "-m", "comment", "--comment", comment, "-j", nextChain,
-			}})
-	}
-
-	// Prepare the Desired Rule for SNAT Rule
-	snatRule := []string{"-m", "comment", "--comment", "AWS, SNAT",
-		"-m", "addrtype", "!", "--dst-type", "LOCAL",
-		"-j", "SNAT", "--to-source", primaryAddr.String()}
-	if n.typeOfSNAT == randomHashSNAT {
-		snatRule = append(snatRule, "--random")
-	}
-	if n.typeOfSNAT == randomPRNGSNAT {
-		if ipt.HasRandomFully() {
-			snatRule = append(snatRule, "--random-fully")
-		} else {
-			log.Warn("prng (--random-fully) requested, but iptables version does not support it. " +
-				"Falling back to hashrandom (--random)")
-			snatRule = append(snatRule, "--random")
-		}
+	log.Debugf("Setup Host Network: iptables -N %s -t nat", snatChain)
+	if err := ipt.NewChain("nat", snatChain); err != nil && !containChainExistErr(err) {
+		log.Errorf("ipt.NewChain error for chain [%s]: %v", snatChain, err)
+		return errors.Wrapf(err, "host network setup: failed to add chain")
 	}
 
-	lastChain := chains[len(chains)-1]
-	iptableRules = append(iptableRules, iptablesRule{
-		name:        "last SNAT rule for non-VPC outbound traffic",
-		shouldExist: !n.useExternalSNAT,
-		table:       "nat",
-		chain:       lastChain,
-		rule:        snatRule,
-	})
-
+	iptableRules := hostRules.snatRules
 	var snatStaleRulesToClear []iptablesRule
 	log.Debugf("Setup Host Network: synchronising SNAT stale rules")
 	for _, staleRule := range snatStaleRulesToCheck {
 		keepRule := false
 		for _, newRule := range iptableRules {
-			if staleRule.chain == newRule.chain && reflect.DeepEqual(newRule.rule, staleRule.rule) {
+			if staleRule.chain == newRule.chain && sameRuleSpec(newRule.rule, staleRule.rule) {
 				log.Debugf("Setup Host Network: active rule found: %s", staleRule)
 				keepRule = true
 				break
@@ -384,43 +801,9 @@ func (n *linuxNetwork) SetupHostNetwork(vpcCIDR *net.IPNet, vpcCIDRs []*string,
 
 	iptableRules = append(iptableRules, snatStaleRulesToClear...)
 	log.Debugf("iptableRules: %v", iptableRules)
+	iptableRules = append(iptableRules, hostRules.otherRules...)
 
-	iptableRules = append(iptableRules, iptablesRule{
-		name:        "connmark for primary ENI",
-		shouldExist: n.nodePortSupportEnabled,
-		table:       "mangle",
-		chain:       "PREROUTING",
-		rule: []string{
-			"-m", "comment", "--comment", "AWS, primary ENI",
-			"-i", primaryIntf,
-			"-m", "addrtype", "--dst-type", "LOCAL", "--limit-iface-in",
-			"-j", "CONNMARK", "--set-mark", fmt.Sprintf("%#x/%#x", n.mainENIMark, n.mainENIMark),
-		},
-	})
-
-	iptableRules = append(iptableRules, iptablesRule{
-		name:        "connmark restore for primary ENI",
-		shouldExist: n.nodePortSupportEnabled,
-		table:       "mangle",
-		chain:       "PREROUTING",
-		rule: []string{
-			"-m", "comment", "--comment", "AWS, primary ENI",
-			"-i", "eni+", "-j", "CONNMARK", "--restore-mark", "--mask", fmt.Sprintf("%#x", n.mainENIMark),
-		},
-	})
-
-	// remove pre-1.3 AWS SNAT rules
-	iptableRules = append(iptableRules, iptablesRule{
-		name:        fmt.Sprintf("rule for primary address %s", primaryAddr),
-		shouldExist: false,
-		table:       "nat",
-		chain:       "POSTROUTING",
-		rule: []string{
-			"!", "-d", vpcCIDR.String(),
-			"-m", "comment", "--comment", "AWS, SNAT",
-			"-m", "addrtype", "!", "--dst-type", "LOCAL",
-			"-j", "SNAT", "--to-source", primaryAddr.String()}})
-
+	prepended := make(map[string]int)
 	for _, rule := range iptableRules {
 		log.Debugf("execute iptable rule : %s", rule.name)
 
@@ -430,7 +813,19 @@ func (n *linuxNetwork) SetupHostNetwork(vpcCIDR *net.IPNet, vpcCIDRs []*string,
 			return errors.Wrapf(err, "host network setup: failed to check existence of %v", rule)
 		}
 
-		if !exists && rule.shouldExist {
+		if rule.shouldExist && rule.positioned && n.rulePosition() != iptablesRuleAppendNew {
+			err = n.placeRule(ipt, rule)
+			if err != nil {
+				log.Errorf("host network setup: failed to place %v, %v", rule, err)
+				return errors.Wrapf(err, "host network setup: failed to place %v", rule)
+			}
+		} else if !exists && rule.shouldExist && rule.prepend {
+			err = ipt.Insert(rule.table, rule.chain, prepended[rule.table+"/"+rule.chain]+1, rule.rule...)
+			if err != nil {
+				log.Errorf("host network setup: failed to add %v, %v", rule, err)
+				return errors.Wrapf(err, "host network setup: failed to add %v", rule)
+			}
+		} else if !exists && rule.shouldExist {
 			err = ipt.Append(rule.table, rule.chain, rule.rule...)
 			if err != nil {
 				log.Errorf("host network setup: failed to add %v, %v", rule, err)
@@ -443,62 +838,377 @@ func (n *linuxNetwork) SetupHostNetwork(vpcCIDR *net.IPNet, vpcCIDRs []*string,
 				return errors.Wrapf(err, "host network setup: failed to delete %v", rule)
 			}
 		}
+		if rule.shouldExist && rule.prepend {
+			prepended[rule.table+"/"+rule.chain]++
+		}
+	}
+
+	// The chains of the previous layout are empty once their stale rules and the jumps to them are deleted
+	for _, chain := range snatChains {
+		if chain == snatChain {
+			continue
+		}
+		log.Infof("Setup Host Network: deleting stale SNAT chain %s", chain)
+		if err := ipt.ClearChain("nat", chain); err != nil {
+			return errors.Wrapf(err, "host network setup: failed to clear stale chain %s", chain)
+		}
+		if err := ipt.DeleteChain("nat", chain); err != nil {
+			return errors.Wrapf(err, "host network setup: failed to delete stale chain %s", chain)
+		}
+	}
+	return nil
+}
+
+// placeRule adds the rule before or after the rules of others in its chain, as configured, or moves it there if it is
+// somewhere else. When inserted, the rule goes after the rules of ours at the top of the chain, to keep their order.
+func (n *linuxNetwork) placeRule(ipt iptablesIface, rule iptablesRule) error {
+	ruleSpecs, err := listRuleSpecs(ipt, rule.table, rule.chain)
+	if err != nil {
+		return err
+	}
+	for i, ruleSpec := range ruleSpecs {
+		if !sameRuleSpec(ruleSpec, rule.rule) {
+			continue
+		}
+		others := ruleSpecs[i+1:]
+		if n.iptablesRulePosition == iptablesRuleInsert {
+			others = ruleSpecs[:i]
+		}
+		foreign := false
+		for _, other := range others {
+			if !isAWSRule(other) {
+				foreign = true
+				break
+			}
+		}
+		if !foreign {
+			return nil
+		}
+		log.Infof("Moving %v to %s the rules of others", rule, n.iptablesRulePosition)
+		if err := ipt.Delete(rule.table, rule.chain, rule.rule...); err != nil {
+			return err
+		}
+		ruleSpecs = append(ruleSpecs[:i:i], ruleSpecs[i+1:]...)
+		break
+	}
+
+	if n.iptablesRulePosition != iptablesRuleInsert {
+		return ipt.Append(rule.table, rule.chain, rule.rule...)
+	}
+	pos := 1
+	for _, ruleSpec := range ruleSpecs {
+		if !isAWSRule(ruleSpec) {
+			break
+		}
+		pos++
+	}
+	return ipt.Insert(rule.table, rule.chain, pos, rule.rule...)
+}
+
+// listRuleSpecs returns the rules of a chain, without the action and chain name
+func listRuleSpecs(ipt iptablesIface, table, chain string) ([][]string, error) {
+	rules, err := ipt.List(table, chain)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list iptables %s chain %s", table, chain)
+	}
+	var ruleSpecs [][]string
+	for _, rule := range rules {
+		r := csv.NewReader(strings.NewReader(rule))
+		r.Comma = ' '
+		ruleSpec, err := r.Read()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse iptables %s chain %s rule %s", table, chain, rule)
+		}
+		if len(ruleSpec) < 2 || ruleSpec[0] != "-A" {
+			// the chain policy
+			continue
+		}
+		ruleSpecs = append(ruleSpecs, ruleSpec[2:]) //drop action and chain name
+	}
+	return ruleSpecs, nil
+}
+
+// sameRuleSpec returns whether two rule specs are the same rule. The nftables backend lists the comment of a rule first,
+// wherever it was in the rule spec the rule was added with.
+func sameRuleSpec(a, b []string) bool {
+	return reflect.DeepEqual(commentFirst(a), commentFirst(b))
+}
+
+func commentFirst(ruleSpec []string) []string {
+	for i := 0; i+3 < len(ruleSpec); i++ {
+		if ruleSpec[i] == "-m" && ruleSpec[i+1] == "comment" && ruleSpec[i+2] == "--comment" {
+			moved := append([]string{}, ruleSpec[i:i+4]...)
+			moved = append(moved, ruleSpec[:i]...)
+			return append(moved, ruleSpec[i+4:]...)
+		}
+	}
+	return append([]string{}, ruleSpec...)
+}
+
+// systemIptables returns the iptables of the node, whose rules are the ones of others when the host rules are
+// programmed with nftables
+func (n *linuxNetwork) systemIptables() (iptablesIface, error) {
+	if n.newSystemIptables == nil {
+		return n.newIptables()
+	}
+	return n.newSystemIptables()
+}
+
+// isAWSRule returns whether a rule was added by us, which is told by its comment
+func isAWSRule(ruleSpec []string) bool {
+	for i := 0; i+1 < len(ruleSpec); i++ {
+		if ruleSpec[i] == "--comment" && strings.HasPrefix(ruleSpec[i+1], "AWS") {
+			return true
+		}
+	}
+	return false
+}
+
+// setupTenantSNATChain (re)creates the chain that SNATs traffic leaving through tenant ENIs. Traffic to the VPC and to
+// excluded CIDRs is left alone, the per-ENI SNAT rules are added by SetupENINetwork.
+func (n *linuxNetwork) setupTenantSNATChain(ipt iptablesIface, rules [][]string) error {
+	jumpRule := []string{"-m", "comment", "--comment", "AWS TENANT SNAT", "-j", tenantSNATChain}
+	if !n.tenantSNATEnabled() {
+		// Checking the rule fails if the chain was never created, in which case there is nothing to clean up
+		if exists, err := ipt.Exists("nat", "POSTROUTING", jumpRule...); err == nil && exists {
+			if err := ipt.Delete("nat", "POSTROUTING", jumpRule...); err != nil {
+				return errors.Wrap(err, "host network setup: failed to delete tenant SNAT rule")
+			}
+		}
+		return nil
+	}
+
+	if err := ipt.NewChain("nat", tenantSNATChain); err != nil && !containChainExistErr(err) {
+		return errors.Wrapf(err, "host network setup: failed to add chain %s", tenantSNATChain)
+	}
+	exists, err := ipt.Exists("nat", "POSTROUTING", jumpRule...)
+	if err != nil {
+		return errors.Wrap(err, "host network setup: failed to check existence of tenant SNAT rule")
+	}
+	if err := ipt.ClearChain("nat", tenantSNATChain); err != nil {
+		return errors.Wrapf(err, "host network setup: failed to clear chain %s", tenantSNATChain)
+	}
+	for _, rule := range rules {
+		if err := ipt.Append("nat", tenantSNATChain, rule...); err != nil {
+			return errors.Wrapf(err, "host network setup: failed to add %s rule to chain %s", rule, tenantSNATChain)
+		}
+	}
+	if !exists {
+		// Tenant traffic must be SNATed before it reaches the SNAT to the primary IP
+		log.Debugf("Setup Host Network: iptables -I POSTROUTING 1 -t nat %s", strings.Join(jumpRule, " "))
+		if err := ipt.Insert("nat", "POSTROUTING", 1, jumpRule...); err != nil {
+			return errors.Wrap(err, "host network setup: failed to add tenant SNAT rule")
+		}
+	}
+	return nil
+}
+
+// updateTenantSNATRule makes sure that traffic leaving through the given ENI interface is SNATed to the ENI's IP
+func (n *linuxNetwork) updateTenantSNATRule(ifName string, eniIP netip.Addr) error {
+	ipt, err := n.newIptables()
+	if err != nil {
+		return errors.Wrap(err, "updateTenantSNATRule: failed to create iptables")
+	}
+	snatRule := []string{"-o", ifName, "-m", "comment", "--comment", "AWS, TENANT SNAT",
+		"-m", "addrtype", "!", "--dst-type", "LOCAL",
+		"-j", "SNAT", "--to-source", eniIP.String()}
+
+	rules, err := ipt.List("nat", tenantSNATChain)
+	if err != nil {
+		return errors.Wrapf(err, "updateTenantSNATRule: failed to list chain %s", tenantSNATChain)
+	}
+	exists := false
+	for _, rule := range rules {
+		r := csv.NewReader(strings.NewReader(rule))
+		r.Comma = ' '
+		ruleSpec, err := r.Read()
+		if err != nil || len(ruleSpec) < 4 || ruleSpec[2] != "-o" || ruleSpec[3] != ifName {
+			continue
+		}
+		if sameRuleSpec(ruleSpec[2:], snatRule) {
+			exists = true
+			continue
+		}
+		// The interface now belongs to another ENI
+		log.Infof("Deleting stale tenant SNAT rule %v", ruleSpec[2:])
+		if err := ipt.Delete("nat", tenantSNATChain, ruleSpec[2:]...); err != nil {
+			return errors.Wrapf(err, "updateTenantSNATRule: failed to delete stale rule for %s", ifName)
+		}
+	}
+	if exists {
+		return nil
+	}
+	log.Infof("Adding tenant SNAT rule for traffic leaving through %s to %s", ifName, eniIP)
+	if err := ipt.Append("nat", tenantSNATChain, snatRule...); err != nil {
+		return errors.Wrapf(err, "updateTenantSNATRule: failed to add rule for %s", ifName)
+	}
+	return nil
+}
+
+// updateUnmanagedCIDRRules makes sure that traffic to every unmanaged CIDR, and only to those, is routed using the main
+// route table
+func (n *linuxNetwork) updateUnmanagedCIDRRules() error {
+	ruleList, err := n.netLink.RuleList(unix.AF_INET)
+	if err != nil {
+		return errors.Wrap(err, "host network setup: failed to list IP rules")
+	}
+
+	desired := make(map[netip.Prefix]bool)
+	for _, prefix := range n.unmanagedCIDRs {
+		desired[prefix] = true
+	}
+	for _, rule := range ruleList {
+		if rule.Priority != unmanagedCIDRRulePriority || rule.Dst == nil {
+			continue
+		}
+		if dst := cidr.FromIPNet(rule.Dst); desired[dst] {
+			delete(desired, dst)
+			continue
+		}
+		log.Infof("Removing rule for CIDR %s, which is no longer unmanaged", rule.Dst.String())
+		if err := n.netLink.RuleDel(&rule); err != nil && !containsNoSuchRule(err) {
+			return errors.Wrapf(err, "host network setup: failed to delete rule for unmanaged CIDR %s", rule.Dst.String())
+		}
+	}
+
+	for _, prefix := range n.unmanagedCIDRs {
+		if !desired[prefix] {
+			continue
+		}
+		unmanagedRule := n.netLink.NewRule()
+		unmanagedRule.Dst = cidr.IPNet(prefix)
+		unmanagedRule.Table = mainRoutingTable
+		unmanagedRule.Priority = unmanagedCIDRRulePriority
+		if err := n.netLink.RuleAdd(unmanagedRule); err != nil {
+			return errors.Wrapf(err, "host network setup: failed to add rule for unmanaged CIDR %s", prefix)
+		}
+		log.Infof("Added rule to route traffic to unmanaged CIDR %s through the main route table", prefix)
 	}
 	return nil
 }
 
-func listCurrentSNATRules(ipt iptablesIface) ([]iptablesRule, error) {
+// listCurrentSNATRules returns the rules of the AWS SNAT chains, which are stale unless they are still desired, and the
+// chains themselves
+func listCurrentSNATRules(ipt iptablesIface) ([]iptablesRule, []string, error) {
 	var toClear []iptablesRule
+	var chains []string
 	log.Debug("Setup Host Network: loading existing iptables nat SNAT exclusion rules")
 
 	existingChains, err := ipt.ListChains("nat")
 	if err != nil {
-		return nil, errors.Wrap(err, "host network setup: failed to list iptables nat chains")
+		return nil, nil, errors.Wrap(err, "host network setup: failed to list iptables nat chains")
 	}
+	// The stale rules are deleted in the order of their chains, starting with the one nat POSTROUTING jumps to
+	sort.Strings(existingChains)
 	for _, chain := range existingChains {
 		if !strings.HasPrefix(chain, "AWS-SNAT-CHAIN") {
 			continue
 		}
-		rules, err := ipt.List("nat", chain)
+		chains = append(chains, chain)
+		// The -N line of the chain is not a rule
+		ruleSpecs, err := listRuleSpecs(ipt, "nat", chain)
 		if err != nil {
-			return nil, errors.Wrap(err, fmt.Sprintf("host network setup: failed to list iptables nat chain %s", chain))
+			return nil, nil, errors.Wrap(err, "host network setup")
 		}
-		for i, rule := range rules {
-			r := csv.NewReader(strings.NewReader(rule))
-			r.Comma = ' '
-			ruleSpec, err := r.Read()
-			if err != nil {
-				return nil, errors.Wrap(err, fmt.Sprintf("host network setup: failed to parse iptables nat chain %s rule %s", chain, rule))
-			}
+		for i, ruleSpec := range ruleSpecs {
 			log.Debugf("host network setup: found potentially stale SNAT rule for chain %s: %v", chain, ruleSpec)
 			toClear = append(toClear, iptablesRule{
 				name:        fmt.Sprintf("[%d] %s", i, chain),
 				shouldExist: false, // To trigger ipt.Delete for stale rules
 				table:       "nat",
 				chain:       chain,
-				rule:        ruleSpec[2:], //drop action and chain name
+				rule:        ruleSpec,
 			})
 		}
 	}
-	return toClear, nil
-}
-
-func containChainExistErr(err error) bool {
-	return strings.Contains(err.Error(), "Chain already exists")
+	return toClear, chains, nil
 }
 
-func (n *linuxNetwork) setProcSys(key, value string) error {
-	f, err := n.openFile(key, os.O_WRONLY, 0644)
+// CheckSNATRules looks for rules in the nat POSTROUTING chain that come before the jump to the AWS SNAT chain and
+// terminate the traffic of pods, e.g. an unrestricted MASQUERADE or ACCEPT, and for the jump having been removed. In
+// repair mode, the jump is moved back right before the first of these rules, or appended if it is missing. With
+// AWS_VPC_K8S_CNI_IPTABLES_RULE_POSITION=append the rules of others come before the jump on purpose, so only a missing
+// jump is reported and repaired.
+func (n *linuxNetwork) CheckSNATRules() (SNATRulesCheck, error) {
+	var result SNATRulesCheck
+	if n.iptablesCheck == iptablesCheckOff || n.useExternalSNAT || n.nftEnabled() {
+		return result, nil
+	}
+	ipt, err := n.newIptables()
 	if err != nil {
-		return err
+		return result, errors.Wrap(err, "check SNAT rules: failed to create iptables")
 	}
-	_, err = f.WriteString(value)
+	ruleSpecs, err := listRuleSpecs(ipt, "nat", "POSTROUTING")
 	if err != nil {
-		// If the write failed, just close
-		_ = f.Close()
-		return err
+		return result, errors.Wrap(err, "check SNAT rules")
+	}
+
+	jumpPos, firstBypassPos := 0, 0
+	for i, ruleSpec := range ruleSpecs {
+		pos := i + 1
+		if sameRuleSpec(ruleSpec, snatChainJumpRule) {
+			jumpPos = pos
+			break
+		}
+		if n.rulePosition() != iptablesRuleAppend && bypassesSNATChain(ruleSpec) {
+			if firstBypassPos == 0 {
+				firstBypassPos = pos
+			}
+			result.Problems = append(result.Problems,
+				fmt.Sprintf("nat POSTROUTING rule %d %q comes before the AWS SNAT chain", pos, strings.Join(ruleSpec, " ")))
+		}
+	}
+	if jumpPos == 0 {
+		result.Problems = append(result.Problems, "the jump to the AWS SNAT chain is missing from nat POSTROUTING")
+	}
+	if len(result.Problems) == 0 || n.iptablesCheck != iptablesCheckRepair {
+		return result, nil
+	}
+
+	if jumpPos != 0 {
+		if err := ipt.Delete("nat", "POSTROUTING", snatChainJumpRule...); err != nil {
+			return result, errors.Wrap(err, "check SNAT rules: failed to delete the jump to the AWS SNAT chain")
+		}
+	}
+	if firstBypassPos != 0 {
+		// The jump came after the first bypassing rule, so deleting it did not move that rule
+		err = ipt.Insert("nat", "POSTROUTING", firstBypassPos, snatChainJumpRule...)
+	} else {
+		err = ipt.Append("nat", "POSTROUTING", snatChainJumpRule...)
+	}
+	if err != nil {
+		return result, errors.Wrap(err, "check SNAT rules: failed to add the jump to the AWS SNAT chain")
 	}
-	return f.Close()
+	result.Repaired = true
+	return result, nil
+}
+
+// bypassesSNATChain returns whether a nat POSTROUTING rule can stop the traffic of pods before it reaches the AWS SNAT
+// chain. Jumps to other chains are not followed, and rules restricted to a source CIDR are assumed to be for others.
+func bypassesSNATChain(ruleSpec []string) bool {
+	if isAWSRule(ruleSpec) {
+		return false
+	}
+	var target string
+	for i := 0; i+1 < len(ruleSpec); i++ {
+		switch ruleSpec[i] {
+		case "-s", "--source":
+			if i == 0 || ruleSpec[i-1] != "!" {
+				return false
+			}
+		case "-j", "--jump":
+			target = ruleSpec[i+1]
+		}
+	}
+	switch target {
+	case "SNAT", "MASQUERADE", "ACCEPT", "RETURN", "DROP":
+		return true
+	}
+	return false
+}
+
+func containChainExistErr(err error) bool {
+	return strings.Contains(err.Error(), "Chain already exists")
 }
 
 type iptablesRule struct {
@@ -506,6 +1216,10 @@ type iptablesRule struct {
 	shouldExist  bool
 	table, chain string
 	rule         []string
+	// positioned rules are placed relative to the rules of others as set by AWS_VPC_K8S_CNI_IPTABLES_RULE_POSITION
+	positioned bool
+	// prepend rules are added at the top of their chain, after the prepend rules before them, instead of at its end
+	prepend bool
 }
 
 func (r iptablesRule) String() string {
@@ -522,11 +1236,43 @@ func containsNoSuchRule(err error) bool {
 // GetConfigForDebug returns the active values of the configuration env vars (for debugging purposes).
 func GetConfigForDebug() map[string]interface{} {
 	return map[string]interface{}{
-		envExternalSNAT:     useExternalSNAT(),
-		envExcludeSNATCIDRs: getExcludeSNATCIDRs(),
-		envNodePortSupport:  nodePortSupportEnabled(),
-		envConnmark:         getConnmark(),
-		envRandomizeSNAT:    typeOfSNAT(),
+		envExternalSNAT:         useExternalSNAT(),
+		envExcludeSNATCIDRs:     getExcludeSNATCIDRs(),
+		envNodePortSupport:      nodePortSupportEnabled(),
+		envNodePortInterfaces:   getNodePortInterfaces(),
+		envConnmark:             getConnmark(),
+		envRandomizeSNAT:        getSNATStrategy().Name(),
+		envSNATTarget:           getSNATTarget(),
+		envEgressMultipath:      egressMultipathEnabled(),
+		envNetlinkOpsPerSec:     getNetlinkOpsPerSec(),
+		envNetlinkOpsBurst:      getNetlinkOpsBurst(),
+		envUnmanagedInterfaces:  getUnmanagedInterfaces(),
+		envUnmanagedCIDRs:       getUnmanagedCIDRs(),
+		envVethPrefix:           getVethPrefix(),
+		envPrimaryInterface:     getInterfaceEnvVar(envPrimaryInterface),
+		envPodInterfacePattern:  getInterfaceEnvVar(envPodInterfacePattern),
+		envTenantLabel:          TenantLabel(),
+		envIptablesCheck:        getIptablesCheckMode(),
+		envIptablesRulePosition: getIptablesRulePosition(),
+		envIptablesLockTimeout:  getIptablesLockTimeout().String(),
+		envEnableIPv6:           IPv6Enabled(),
+		envIPv6SNAT:             ipv6SNATEnabled(),
+		envIPv6ExcludeSNATCIDRs: getIPv6ExcludeSNATCIDRs(),
+		envOverlappingCIDRs:     getOverlappingCIDRs(),
+		envNAT64:                getNAT64Mode(),
+		envNAT64Prefix:          getNAT64Prefix(),
+		envNAT64Device:          getNAT64Device(),
+		envEgressGateway:        EgressGatewayEnabled(),
+		envPodFlags:             AllowedPodFlags(),
+		envPodSNATExclusions:    SNATExclusionAnnotationsEnabled(),
+		envPodENI:               PodENIEnabled(),
+		envFirewallSubnetCIDRs:  getFirewallSubnetCIDRs(),
+		envKubeProxyMetricsAddr: getKubeProxyMetricsAddr(),
+		envKubeProxyMode:        getKubeProxyModeSetting(),
+		envMarkPreset:           getMarkPreset(),
+		envDropTracing:          DropTracingEnabled(),
+		envDropLogRate:          getDropLogRate(),
+		envNFTMode:              getNFTMode(),
 	}
 }
 
@@ -543,11 +1289,11 @@ func useExternalSNAT() bool {
 
 // GetExcludeSNATCIDRs returns a list of cidrs that should be excluded from SNAT if UseExternalSNAT is false,
 // otherwise it returns an empty list.
-func (n *linuxNetwork) GetExcludeSNATCIDRs() []string {
-	return getExcludeSNATCIDRs()
+func (n *linuxNetwork) GetExcludeSNATCIDRs() []netip.Prefix {
+	return getSNATExclusions()
 }
 
-func getExcludeSNATCIDRs() []string {
+func getExcludeSNATCIDRs() []netip.Prefix {
 	if useExternalSNAT() {
 		return nil
 	}
@@ -556,47 +1302,184 @@ func getExcludeSNATCIDRs() []string {
 	if excludeCIDRs == "" {
 		return nil
 	}
-	var cidrs []string
+	var cidrs []netip.Prefix
 	for _, excludeCIDR := range strings.Split(excludeCIDRs, ",") {
-		_, parseCIDR, err := net.ParseCIDR(excludeCIDR)
+		prefix, err := cidr.Parse(excludeCIDR)
 		if err != nil {
 			log.Errorf("getExcludeSNATCIDRs : ignoring %v is not a valid IPv4 CIDR", excludeCIDR)
 		} else {
-			cidrs = append(cidrs, parseCIDR.String())
+			cidrs = append(cidrs, prefix)
 		}
 	}
 	return cidrs
 }
 
-func typeOfSNAT() snatType {
-	defaultValue := randomHashSNAT
-	defaultString := "hashrandom"
-	strValue := os.Getenv(envRandomizeSNAT)
-	switch strValue {
+func getIptablesCheckMode() iptablesCheckMode {
+	strValue := os.Getenv(envIptablesCheck)
+	switch mode := iptablesCheckMode(strValue); mode {
 	case "":
-		// empty means default
-		return defaultValue
-	case "prng":
-		// prng means to use --random-fully
-		// note: for old versions of iptables, this will fall back to --random
-		return randomPRNGSNAT
-	case "none":
-		// none means to disable randomisation (no flag)
-		return sequentialSNAT
-
-	case defaultString:
-		// hashrandom means to use --random
-		return randomHashSNAT
+		return iptablesCheckOff
+	case iptablesCheckOff, iptablesCheckWarn, iptablesCheckRepair:
+		return mode
 	default:
-		// if we get to this point, the environment variable has an invalid value
-		log.Errorf("Failed to parse %s; using default: %s. Provided string was %q", envRandomizeSNAT, defaultString,
+		log.Errorf("Failed to parse %s; using default: %s. Provided string was %q", envIptablesCheck, iptablesCheckOff,
 			strValue)
-		return defaultValue
+		return iptablesCheckOff
 	}
 }
 
-func nodePortSupportEnabled() bool {
-	return getBoolEnvVar(envNodePortSupport, true)
+func getIptablesRulePosition() iptablesRulePosition {
+	strValue := os.Getenv(envIptablesRulePosition)
+	switch position := iptablesRulePosition(strValue); position {
+	case iptablesRuleAppendNew, iptablesRuleAppend, iptablesRuleInsert:
+		return position
+	default:
+		log.Errorf("Failed to parse %s; appending new rules. Provided string was %q", envIptablesRulePosition, strValue)
+		return iptablesRuleAppendNew
+	}
+}
+
+func getSNATTarget() snatTarget {
+	strValue := os.Getenv(envSNATTarget)
+	switch target := snatTarget(strValue); target {
+	case "":
+		return snatTargetSNAT
+	case snatTargetSNAT, snatTargetMasquerade:
+		return target
+	default:
+		log.Errorf("Failed to parse %s; using default: %s. Provided string was %q", envSNATTarget, snatTargetSNAT,
+			strValue)
+		return snatTargetSNAT
+	}
+}
+
+// IptablesCheckEnabled returns whether ipamd should periodically look for rules that bypass the AWS SNAT chain
+func IptablesCheckEnabled() bool {
+	return getIptablesCheckMode() != iptablesCheckOff && !useExternalSNAT()
+}
+
+// IPv6Enabled returns whether pods also get an IPv6 address of the primary ENI
+func IPv6Enabled() bool {
+	return getBoolEnvVar(envEnableIPv6, false)
+}
+
+func ipv6SNATEnabled() bool {
+	return getBoolEnvVar(envIPv6SNAT, false)
+}
+
+func getIPv6ExcludeSNATCIDRs() []netip.Prefix {
+	if !ipv6SNATEnabled() {
+		return nil
+	}
+
+	excludeCIDRs := os.Getenv(envIPv6ExcludeSNATCIDRs)
+	if excludeCIDRs == "" {
+		return nil
+	}
+	var cidrs []netip.Prefix
+	for _, excludeCIDR := range strings.Split(excludeCIDRs, ",") {
+		prefix, err := cidr.Parse(excludeCIDR)
+		if err != nil || !prefix.Addr().Is6() {
+			log.Errorf("getIPv6ExcludeSNATCIDRs : ignoring %v is not a valid IPv6 CIDR", excludeCIDR)
+		} else {
+			cidrs = append(cidrs, prefix)
+		}
+	}
+	return cidrs
+}
+
+func nodePortSupportEnabled() bool {
+	return getBoolEnvVar(envNodePortSupport, true)
+}
+
+func getUnmanagedInterfaces() []string {
+	var ifaces []string
+	for _, iface := range strings.Split(os.Getenv(envUnmanagedInterfaces), ",") {
+		iface = strings.TrimSpace(iface)
+		if iface != "" {
+			ifaces = append(ifaces, iface)
+		}
+	}
+	return ifaces
+}
+
+func getUnmanagedCIDRs() []netip.Prefix {
+	var cidrs []netip.Prefix
+	for _, item := range strings.Split(os.Getenv(envUnmanagedCIDRs), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, err := cidr.Parse(item)
+		if err != nil || !prefix.Addr().Is4() {
+			log.Errorf("getUnmanagedCIDRs : ignoring %v is not a valid IPv4 CIDR", item)
+			continue
+		}
+		cidrs = append(cidrs, prefix)
+	}
+	return cidrs
+}
+
+// isUnmanagedInterface returns whether name matches one of the unmanaged interfaces, where a trailing "+" matches
+// any interface with that prefix
+func isUnmanagedInterface(name string, unmanagedInterfaces []string) bool {
+	for _, iface := range unmanagedInterfaces {
+		if strings.HasSuffix(iface, "+") {
+			if strings.HasPrefix(name, strings.TrimSuffix(iface, "+")) {
+				return true
+			}
+		} else if name == iface {
+			return true
+		}
+	}
+	return false
+}
+
+func getVethPrefix() string {
+	if vethPrefix := os.Getenv(envVethPrefix); vethPrefix != "" {
+		return vethPrefix
+	}
+	return defaultVethPrefix
+}
+
+// vethPattern returns the iptables interface pattern matching the host-side veth devices of the pods
+func (n *linuxNetwork) vethPattern() string {
+	if n.podInterfacePattern != "" {
+		return n.podInterfacePattern
+	}
+	if n.vethPrefix == "" {
+		return defaultVethPrefix + "+"
+	}
+	return n.vethPrefix + "+"
+}
+
+// getInterfaceEnvVar returns the interface name or pattern set in the given environment variable, or "" if it is unset
+// or invalid
+func getInterfaceEnvVar(name string) string {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return ""
+	}
+	if len(value) > maxInterfaceNameLen || strings.ContainsAny(value, " /:") {
+		log.Errorf("Ignoring %s, %q is not a valid interface name", name, value)
+		return ""
+	}
+	return value
+}
+
+// TenantLabel returns the key of the namespace label that assigns pods to tenants, or "" if multi-tenant mode is
+// disabled
+func TenantLabel() string {
+	return strings.TrimSpace(os.Getenv(envTenantLabel))
+}
+
+// tenantSNATEnabled returns whether the node SNATs the traffic of tenant pods to the IP of their ENI
+func (n *linuxNetwork) tenantSNATEnabled() bool {
+	return n.tenantLabel != "" && !n.useExternalSNAT
+}
+
+func egressMultipathEnabled() bool {
+	return getBoolEnvVar(envEgressMultipath, false)
 }
 
 func getBoolEnvVar(name string, defaultValue bool) bool {
@@ -612,38 +1495,68 @@ func getBoolEnvVar(name string, defaultValue bool) bool {
 }
 
 func getConnmark() uint32 {
+	preset := getMarkPreset()
+	defaultMark := presetConnmark(preset)
 	if connmark := os.Getenv(envConnmark); connmark != "" {
 		mark, err := strconv.ParseInt(connmark, 0, 64)
 		if err != nil {
-			log.Error("Failed to parse "+envConnmark+"; will use ", defaultConnmark, err.Error())
-			return defaultConnmark
+			log.Error("Failed to parse "+envConnmark+"; will use ", defaultMark, err.Error())
+			return defaultMark
 		}
 		if mark > math.MaxUint32 || mark <= 0 {
-			log.Error(""+envConnmark+" out of range; will use ", defaultConnmark)
-			return defaultConnmark
+			log.Error(""+envConnmark+" out of range; will use ", defaultMark)
+			return defaultMark
+		}
+		if preset == markPresetIstio && mark&istioMarkMask != 0 {
+			log.Warnf("%s %#x overlaps the marks %#x of Istio", envConnmark, mark, istioMarkMask)
 		}
 		return uint32(mark)
 	}
-	return defaultConnmark
+	return defaultMark
+}
+
+func getNetlinkOpsPerSec() int {
+	return getIntEnvVar(envNetlinkOpsPerSec, 0)
+}
+
+func getNetlinkOpsBurst() int {
+	burst := getIntEnvVar(envNetlinkOpsBurst, defaultNetlinkOpsBurst)
+	if burst < 1 {
+		log.Errorf("%s must be at least 1; will use %d", envNetlinkOpsBurst, defaultNetlinkOpsBurst)
+		return defaultNetlinkOpsBurst
+	}
+	return burst
+}
+
+func getIntEnvVar(name string, defaultValue int) int {
+	if strValue := os.Getenv(name); strValue != "" {
+		parsedValue, err := strconv.Atoi(strValue)
+		if err != nil {
+			log.Error("Failed to parse "+name+"; using default: "+fmt.Sprint(defaultValue), err.Error())
+			return defaultValue
+		}
+		return parsedValue
+	}
+	return defaultValue
 }
 
 // LinkByMac returns linux netlink based on interface MAC
-func LinkByMac(mac string, netLink netlinkwrapper.NetLink, retryInterval time.Duration) (netlink.Link, error) {
+func LinkByMac(mac string, netLink netlinkwrapper.NetLink, retryPolicy retry.Policy) (netlink.Link, error) {
 	// The adapter might not be immediately available, so we perform retries
 	var lastErr error
 	attempt := 0
 	for {
 		attempt++
-		if attempt > maxAttemptsLinkByMac {
+		if attempt > retryPolicy.MaxAttempts {
 			return nil, lastErr
 		} else if attempt > 1 {
-			time.Sleep(retryInterval)
+			time.Sleep(retryPolicy.Delay(attempt - 1))
 		}
 
 		links, err := netLink.LinkList()
 
 		if err != nil {
-			lastErr = errors.Errorf("%s (attempt %d/%d)", err, attempt, maxAttemptsLinkByMac)
+			lastErr = errors.Errorf("%s (attempt %d/%d)", err, attempt, retryPolicy.MaxAttempts)
 			log.Debugf(lastErr.Error())
 			continue
 		}
@@ -651,23 +1564,177 @@ func LinkByMac(mac string, netLink netlinkwrapper.NetLink, retryInterval time.Du
 		for _, link := range links {
 			if mac == link.Attrs().HardwareAddr.String() {
 				log.Debugf("Found the Link that uses mac address %s and its index is %d (attempt %d/%d)",
-					mac, link.Attrs().Index, attempt, maxAttemptsLinkByMac)
+					mac, link.Attrs().Index, attempt, retryPolicy.MaxAttempts)
 				return link, nil
 			}
 		}
 
-		lastErr = errors.Errorf("no interface found which uses mac address %s (attempt %d/%d)", mac, attempt, maxAttemptsLinkByMac)
+		lastErr = errors.Errorf("no interface found which uses mac address %s (attempt %d/%d)", mac, attempt, retryPolicy.MaxAttempts)
 		log.Debugf(lastErr.Error())
 	}
 }
 
 // SetupENINetwork adds default route to route table (eni-<eni_table>)
-func (n *linuxNetwork) SetupENINetwork(eniIP string, eniMAC string, eniTable int, eniSubnetCIDR string) error {
-	return setupENINetwork(eniIP, eniMAC, eniTable, eniSubnetCIDR, n.netLink, retryLinkByMacInterval, retryRouteAddInterval, n.mtu)
+func (n *linuxNetwork) SetupENINetwork(eniIP netip.Addr, eniMAC string, eniTable int, eniSubnetCIDR netip.Prefix) error {
+	err := setupENINetwork(eniIP, eniMAC, eniTable, eniSubnetCIDR, n.netLink, linkByMacRetryPolicy.WithEnvOverrides(),
+		routeAddRetryPolicy.WithEnvOverrides(), n.mtu, n.unmanagedInterfaces)
+	if err != nil || eniTable == 0 {
+		return err
+	}
+	multipath := n.egressMultipath
+	if multipath && !n.useExternalSNAT {
+		log.Warnf("Ignoring %s, it requires %s to be set", envEgressMultipath, envExternalSNAT)
+		multipath = false
+	}
+	if !multipath && !n.tenantSNATEnabled() && !n.firewallSymmetryEnabled() {
+		return nil
+	}
+	link, err := LinkByMac(eniMAC, n.netLink, linkByMacRetryPolicy.WithEnvOverrides())
+	if err != nil {
+		return errors.Wrapf(err, "SetupENINetwork: failed to find the link which uses MAC address %s", eniMAC)
+	}
+	if n.tenantSNATEnabled() {
+		if err := n.updateTenantSNATRule(link.Attrs().Name, eniIP); err != nil {
+			return err
+		}
+	}
+	if n.firewallSymmetryEnabled() {
+		if err := n.updateFirewallSymmetry(link.Attrs().Name, eniTable); err != nil {
+			return err
+		}
+	}
+	if !multipath {
+		return nil
+	}
+	return n.updateEgressMultipath(eniTable, link.Attrs().Index, eniSubnetCIDR)
 }
 
-func setupENINetwork(eniIP string, eniMAC string, eniTable int, eniSubnetCIDR string, netLink netlinkwrapper.NetLink,
-	retryLinkByMacInterval time.Duration, retryRouteAddInterval time.Duration, mtu int) error {
+// egressPath is the default gateway of a secondary ENI
+type egressPath struct {
+	linkIndex int
+	gw        netip.Addr
+	subnet    netip.Prefix
+}
+
+// updateEgressMultipath records the default gateway of an ENI and replaces the default route of every ENI route
+// table in the same subnet with an ECMP route across all of them
+func (n *linuxNetwork) updateEgressMultipath(eniTable int, linkIndex int, eniSubnetCIDR netip.Prefix) error {
+	subnet := eniSubnetCIDR.Masked()
+	gw, err := cidr.Gateway(subnet)
+	if err != nil {
+		return errors.Wrap(err, "updateEgressMultipath")
+	}
+
+	n.egressPathsLock.Lock()
+	defer n.egressPathsLock.Unlock()
+	subnets, err := n.pruneEgressPaths()
+	if err != nil {
+		return errors.Wrap(err, "updateEgressMultipath")
+	}
+	n.egressPaths[eniTable] = egressPath{linkIndex: linkIndex, gw: gw, subnet: subnet}
+	subnets[subnet] = true
+	return n.replaceEgressRoutes(subnets)
+}
+
+// TeardownENINetwork removes the default gateway of the ENI of the route table from the ECMP default routes of the
+// other ENIs in its subnet. It must be called before the ENI is detached, the kernel deletes a multipath route with
+// all of its paths when the link of one of them goes away.
+func (n *linuxNetwork) TeardownENINetwork(eniTable int) error {
+	n.egressPathsLock.Lock()
+	defer n.egressPathsLock.Unlock()
+	path, ok := n.egressPaths[eniTable]
+	if !ok {
+		return nil
+	}
+	delete(n.egressPaths, eniTable)
+	subnets, err := n.pruneEgressPaths()
+	if err != nil {
+		return errors.Wrap(err, "TeardownENINetwork")
+	}
+	subnets[path.subnet] = true
+	log.Infof("Removing the egress path of route table %d from subnet %s", eniTable, path.subnet)
+	return n.replaceEgressRoutes(subnets)
+}
+
+// pruneEgressPaths drops the paths through links that no longer exist, like the ones of ENIs detached out-of-band or
+// while ipamd was not running, and returns the subnets they were in. egressPathsLock must be held.
+func (n *linuxNetwork) pruneEgressPaths() (map[netip.Prefix]bool, error) {
+	subnets := make(map[netip.Prefix]bool)
+	links, err := n.netLink.LinkList()
+	if err != nil {
+		return subnets, errors.Wrap(err, "failed to list links")
+	}
+	linkIndexes := make(map[int]bool, len(links))
+	for _, link := range links {
+		linkIndexes[link.Attrs().Index] = true
+	}
+	for table, path := range n.egressPaths {
+		if !linkIndexes[path.linkIndex] {
+			log.Infof("Link %d of route table %d is gone, removing its egress path", path.linkIndex, table)
+			delete(n.egressPaths, table)
+			subnets[path.subnet] = true
+		}
+	}
+	return subnets, nil
+}
+
+// replaceEgressRoutes replaces the default route of every ENI route table in the subnets with an ECMP route across the
+// default gateways of all of them, or with a single path route when only one ENI is left in a subnet.
+// egressPathsLock must be held.
+func (n *linuxNetwork) replaceEgressRoutes(subnets map[netip.Prefix]bool) error {
+	for subnet := range subnets {
+		var tables []int
+		for table, path := range n.egressPaths {
+			if path.subnet == subnet {
+				tables = append(tables, table)
+			}
+		}
+		sort.Ints(tables)
+
+		if len(tables) == 1 {
+			path := n.egressPaths[tables[0]]
+			route := netlink.Route{
+				LinkIndex: path.linkIndex,
+				Dst:       &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+				Scope:     netlink.SCOPE_UNIVERSE,
+				Gw:        cidr.IP(path.gw),
+				Table:     tables[0],
+			}
+			if err := n.netLink.RouteReplace(&route); err != nil {
+				return errors.Wrapf(err, "replaceEgressRoutes: unable to replace default route in table %d", tables[0])
+			}
+			log.Debugf("Only one ENI in subnet %s, using a single path default route in table %d", subnet, tables[0])
+			continue
+		}
+
+		var nexthops []*netlink.NexthopInfo
+		for _, table := range tables {
+			path := n.egressPaths[table]
+			nexthops = append(nexthops, &netlink.NexthopInfo{
+				LinkIndex: path.linkIndex,
+				Gw:        cidr.IP(path.gw),
+				// The gateway is only known as on-link in the route table of its own ENI
+				Flags: int(netlink.FLAG_ONLINK),
+			})
+		}
+		for _, table := range tables {
+			route := netlink.Route{
+				Dst:       &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+				Scope:     netlink.SCOPE_UNIVERSE,
+				MultiPath: nexthops,
+				Table:     table,
+			}
+			if err := n.netLink.RouteReplace(&route); err != nil {
+				return errors.Wrapf(err, "replaceEgressRoutes: unable to replace default route in table %d", table)
+			}
+			log.Infof("Replaced default route in table %d with %d paths through subnet %s", table, len(nexthops), subnet)
+		}
+	}
+	return nil
+}
+
+func setupENINetwork(eniIP netip.Addr, eniMAC string, eniTable int, eniSubnetCIDR netip.Prefix, netLink netlinkwrapper.NetLink,
+	linkByMacRetry retry.Policy, routeAddRetry retry.Policy, mtu int, unmanagedInterfaces []string) error {
 
 	if eniTable == 0 {
 		log.Debugf("Skipping set up ENI network for primary interface")
@@ -676,11 +1743,15 @@ func setupENINetwork(eniIP string, eniMAC string, eniTable int, eniSubnetCIDR st
 
 	log.Infof("Setting up network for an ENI with IP address %s, MAC address %s, CIDR %s and route table %d",
 		eniIP, eniMAC, eniSubnetCIDR, eniTable)
-	link, err := LinkByMac(eniMAC, netLink, retryLinkByMacInterval)
+	link, err := LinkByMac(eniMAC, netLink, linkByMacRetry)
 	if err != nil {
 		return errors.Wrapf(err, "setupENINetwork: failed to find the link which uses MAC address %s", eniMAC)
 	}
 
+	if len(unmanagedInterfaces) > 0 && isUnmanagedInterface(link.Attrs().Name, unmanagedInterfaces) {
+		return errors.Errorf("%s %s, which uses MAC address %s", ErrUnmanagedInterface, link.Attrs().Name, eniMAC)
+	}
+
 	if err = netLink.LinkSetMTU(link, mtu); err != nil {
 		return errors.Wrapf(err, "setupENINetwork: failed to set MTU to %d for %s", mtu, eniIP)
 	}
@@ -691,14 +1762,12 @@ func setupENINetwork(eniIP string, eniMAC string, eniTable int, eniSubnetCIDR st
 
 	deviceNumber := link.Attrs().Index
 
-	_, ipnet, err := net.ParseCIDR(eniSubnetCIDR)
+	gw, err := cidr.Gateway(eniSubnetCIDR)
 	if err != nil {
-		return errors.Wrapf(err, "setupENINetwork: invalid IPv4 CIDR block %s", eniSubnetCIDR)
+		return errors.Wrap(err, "setupENINetwork")
 	}
-
-	gw, err := incrementIPv4Addr(ipnet.IP)
-	if err != nil {
-		return errors.Wrapf(err, "setupENINetwork: failed to define gateway address from %v", ipnet.IP)
+	if !eniIP.Is4() || !eniSubnetCIDR.Addr().Is4() {
+		return errors.Errorf("setupENINetwork: invalid IPv4 address %s or CIDR block %s", eniIP, eniSubnetCIDR)
 	}
 
 	// Explicitly set the IP on the device if not already set.
@@ -718,10 +1787,7 @@ func setupENINetwork(eniIP string, eniMAC string, eniTable int, eniSubnetCIDR st
 			return errors.Wrap(err, "setupENINetwork: failed to delete IP addr from ENI")
 		}
 	}
-	eniAddr := &net.IPNet{
-		IP:   net.ParseIP(eniIP),
-		Mask: ipnet.Mask,
-	}
+	eniAddr := cidr.IPNet(netip.PrefixFrom(eniIP, eniSubnetCIDR.Bits()))
 	log.Debugf("Adding IP address %s", eniAddr.String())
 	if err = netLink.AddrAdd(link, &netlink.Addr{IPNet: eniAddr}); err != nil {
 		return errors.Wrap(err, "setupENINetwork: failed to add IP addr to ENI")
@@ -732,7 +1798,7 @@ func setupENINetwork(eniIP string, eniMAC string, eniTable int, eniSubnetCIDR st
 		// Add a direct link route for the host's ENI IP only
 		{
 			LinkIndex: deviceNumber,
-			Dst:       &net.IPNet{IP: gw, Mask: net.CIDRMask(32, 32)},
+			Dst:       cidr.IPNet(cidr.HostPrefix(gw)),
 			Scope:     netlink.SCOPE_LINK,
 			Table:     eniTable,
 		},
@@ -741,10 +1807,129 @@ func setupENINetwork(eniIP string, eniMAC string, eniTable int, eniSubnetCIDR st
 			LinkIndex: deviceNumber,
 			Dst:       &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
 			Scope:     netlink.SCOPE_UNIVERSE,
-			Gw:        gw,
+			Gw:        cidr.IP(gw),
+			Table:     eniTable,
+		},
+	}
+	if err := addENIRoutes(netLink, routes, gw, eniTable, routeAddRetry); err != nil {
+		return err
+	}
+
+	// Remove the route that default out to ENI-x out of main route table
+	subnet := eniSubnetCIDR.Masked()
+	defaultRoute := netlink.Route{
+		Dst:   cidr.IPNet(subnet),
+		Src:   cidr.IP(eniIP),
+		Table: mainRoutingTable,
+		Scope: netlink.SCOPE_LINK,
+	}
+
+	if err := netLink.RouteDel(&defaultRoute); err != nil {
+		if !netlinkwrapper.IsNotExistsError(err) {
+			return errors.Wrapf(err, "setupENINetwork: unable to delete default route %s for source IP %s", subnet, eniIP)
+		}
+	}
+	return nil
+}
+
+// SetupENIIPv6Network adds the IPv6 address of a secondary ENI and the IPv6 routes of its route table, so that the IPv6
+// traffic of the pods using the addresses of the ENI leaves through it
+func (n *linuxNetwork) SetupENIIPv6Network(eniIPv6 netip.Addr, eniMAC string, eniTable int, eniSubnetIPv6CIDR netip.Prefix) error {
+	if !n.ipv6Enabled {
+		return nil
+	}
+	return setupENIIPv6Network(eniIPv6, eniMAC, eniTable, eniSubnetIPv6CIDR, n.netLink,
+		linkByMacRetryPolicy.WithEnvOverrides(), routeAddRetryPolicy.WithEnvOverrides())
+}
+
+// setupENIIPv6Network is the IPv6 counterpart of setupENINetwork. The link-local address of the ENI is kept, and the
+// VPC router is reached through the first address of the subnet like for IPv4.
+func setupENIIPv6Network(eniIPv6 netip.Addr, eniMAC string, eniTable int, eniSubnetIPv6CIDR netip.Prefix, netLink netlinkwrapper.NetLink,
+	linkByMacRetry retry.Policy, routeAddRetry retry.Policy) error {
+	if eniTable == 0 {
+		log.Debugf("Skipping set up ENI IPv6 network for primary interface")
+		return nil
+	}
+
+	log.Infof("Setting up IPv6 network for an ENI with IPv6 address %s, MAC address %s, CIDR %s and route table %d",
+		eniIPv6, eniMAC, eniSubnetIPv6CIDR, eniTable)
+	link, err := LinkByMac(eniMAC, netLink, linkByMacRetry)
+	if err != nil {
+		return errors.Wrapf(err, "setupENIIPv6Network: failed to find the link which uses MAC address %s", eniMAC)
+	}
+	deviceNumber := link.Attrs().Index
+
+	gw, err := cidr.Gateway(eniSubnetIPv6CIDR)
+	if err != nil {
+		return errors.Wrap(err, "setupENIIPv6Network")
+	}
+	if !eniIPv6.Is6() || eniIPv6.Is4In6() || !eniSubnetIPv6CIDR.Addr().Is6() {
+		return errors.Errorf("setupENIIPv6Network: invalid IPv6 address %s or CIDR block %s", eniIPv6, eniSubnetIPv6CIDR)
+	}
+	ip := cidr.IP(eniIPv6)
+	subnet := eniSubnetIPv6CIDR.Masked()
+
+	addrs, err := netLink.AddrList(link, unix.AF_INET6)
+	if err != nil {
+		return errors.Wrap(err, "setupENIIPv6Network: failed to list IPv6 addresses for ENI")
+	}
+	found := false
+	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if addr.IP.Equal(ip) {
+			found = true
+			continue
+		}
+		log.Debugf("Deleting existing IPv6 address %s", addr.String())
+		if err = netLink.AddrDel(link, &addr); err != nil {
+			return errors.Wrap(err, "setupENIIPv6Network: failed to delete IPv6 addr from ENI")
+		}
+	}
+	if !found {
+		eniAddr := cidr.IPNet(netip.PrefixFrom(eniIPv6, subnet.Bits()))
+		log.Debugf("Adding IPv6 address %s", eniAddr.String())
+		// The address is assigned by EC2, there is no need to wait for duplicate address detection
+		if err = netLink.AddrAdd(link, &netlink.Addr{IPNet: eniAddr, Flags: unix.IFA_F_NODAD}); err != nil {
+			return errors.Wrap(err, "setupENIIPv6Network: failed to add IPv6 addr to ENI")
+		}
+	}
+
+	log.Debugf("Setting up ENI's IPv6 default gateway %v", gw)
+	routes := []netlink.Route{
+		{
+			LinkIndex: deviceNumber,
+			Dst:       cidr.IPNet(cidr.HostPrefix(gw)),
+			Scope:     netlink.SCOPE_LINK,
+			Table:     eniTable,
+		},
+		{
+			LinkIndex: deviceNumber,
+			Dst:       &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+			Scope:     netlink.SCOPE_UNIVERSE,
+			Gw:        cidr.IP(gw),
 			Table:     eniTable,
 		},
 	}
+	if err := addENIRoutes(netLink, routes, gw, eniTable, routeAddRetry); err != nil {
+		return err
+	}
+
+	// The host reaches the subnet through the primary interface, as for IPv4
+	subnetRoute := netlink.Route{
+		LinkIndex: deviceNumber,
+		Dst:       cidr.IPNet(subnet),
+		Table:     mainRoutingTable,
+	}
+	if err := netLink.RouteDel(&subnetRoute); err != nil && !netlinkwrapper.IsNotExistsError(err) {
+		return errors.Wrapf(err, "setupENIIPv6Network: unable to delete route %s of the main route table", subnet)
+	}
+	return nil
+}
+
+// addENIRoutes replaces the routes of an ENI route table, retrying while the routes they depend on are not there yet
+func addENIRoutes(netLink netlinkwrapper.NetLink, routes []netlink.Route, gw netip.Addr, eniTable int, routeAddRetry retry.Policy) error {
 	for _, r := range routes {
 		err := netLink.RouteDel(&r)
 		if err != nil && !netlinkwrapper.IsNotExistsError(err) {
@@ -752,20 +1937,20 @@ func setupENINetwork(eniIP string, eniMAC string, eniTable int, eniSubnetCIDR st
 		}
 
 		// In case of route dependency, retry few times
-		retry := 0
+		attempt := 0
 		for {
 			if err := netLink.RouteAdd(&r); err != nil {
 				if netlinkwrapper.IsNetworkUnreachableError(err) {
-					retry++
-					if retry > maxRetryRouteAdd {
+					attempt++
+					if attempt >= routeAddRetry.MaxAttempts {
 						log.Errorf("Failed to add route %s/0 via %s table %d",
 							r.Dst.IP.String(), gw.String(), eniTable)
 						return errors.Wrapf(err, "setupENINetwork: failed to add route %s/0 via %s table %d",
 							r.Dst.IP.String(), gw.String(), eniTable)
 					}
 					log.Debugf("Not able to add route route %s/0 via %s table %d (attempt %d/%d)",
-						r.Dst.IP.String(), gw.String(), eniTable, retry, maxRetryRouteAdd)
-					time.Sleep(retryRouteAddInterval)
+						r.Dst.IP.String(), gw.String(), eniTable, attempt, routeAddRetry.MaxAttempts)
+					time.Sleep(routeAddRetry.Delay(attempt))
 				} else if netlinkwrapper.IsRouteExistsError(err) {
 					if err := netLink.RouteReplace(&r); err != nil {
 						return errors.Wrapf(err, "setupENINetwork: unable to replace route entry %s", r.Dst.IP.String())
@@ -782,53 +1967,306 @@ func setupENINetwork(eniIP string, eniMAC string, eniTable int, eniSubnetCIDR st
 			}
 		}
 	}
+	return nil
+}
 
-	// Remove the route that default out to ENI-x out of main route table
-	_, cidr, err := net.ParseCIDR(eniSubnetCIDR)
+// GetRuleList returns IP rules
+func (n *linuxNetwork) GetRuleList() ([]netlink.Rule, error) {
+	return n.netLink.RuleList(unix.AF_INET)
+}
+
+// GetIPv6RuleList returns IPv6 rules
+func (n *linuxNetwork) GetIPv6RuleList() ([]netlink.Rule, error) {
+	return n.netLink.RuleList(unix.AF_INET6)
+}
+
+// GetPodIPsFromRules returns the IPs of the pods that have a to-pod rule in the given rule list, i.e. the pods that
+// have already been set up on this host by the CNI plugin
+func GetPodIPsFromRules(ruleList []netlink.Rule) []string {
+	var podIPs []string
+	for _, rule := range ruleList {
+		if rule.Priority != toPodRulePriority || rule.Dst == nil {
+			continue
+		}
+		if ones, bits := rule.Dst.Mask.Size(); ones == bits {
+			podIPs = append(podIPs, rule.Dst.IP.String())
+		}
+	}
+	return podIPs
+}
+
+// ReplaceRouteSrc changes the preferred source of the routes of the main route table that use oldSrc, e.g. after the
+// primary IP of the node changed, so that traffic from the host is not sent from an address that is gone
+func (n *linuxNetwork) ReplaceRouteSrc(oldSrc, newSrc netip.Addr) error {
+	if !oldSrc.IsValid() || !newSrc.IsValid() {
+		return errors.Errorf("ReplaceRouteSrc: invalid source %s or %s", oldSrc, newSrc)
+	}
+	routes, err := n.netLink.RouteList(nil, unix.AF_INET)
 	if err != nil {
-		return errors.Wrapf(err, "setupENINetwork: invalid IPv4 CIDR block %s", eniSubnetCIDR)
+		return errors.Wrap(err, "ReplaceRouteSrc: failed to list routes")
 	}
-	defaultRoute := netlink.Route{
-		Dst:   cidr,
-		Src:   net.ParseIP(eniIP),
-		Table: mainRoutingTable,
-		Scope: netlink.SCOPE_LINK,
+	for _, route := range routes {
+		if cidr.FromIP(route.Src) != oldSrc {
+			continue
+		}
+		route.Src = cidr.IP(newSrc)
+		if err := n.netLink.RouteReplace(&route); err != nil {
+			return errors.Wrapf(err, "ReplaceRouteSrc: failed to replace route %s", route)
+		}
+		log.Infof("ReplaceRouteSrc: changed the source of route %s from %s to %s", route, oldSrc, newSrc)
 	}
+	return nil
+}
 
-	if err := netLink.RouteDel(&defaultRoute); err != nil {
-		if !netlinkwrapper.IsNotExistsError(err) {
-			return errors.Wrapf(err, "setupENINetwork: unable to delete default route %s for source IP %s", cidr.String(), eniIP)
+// GetPodIPv6sFromRoutes returns the IPv6 address of each pod, keyed by its IPv4 address. The addresses of a pod are
+// the destinations of the host routes to its veth.
+func (n *linuxNetwork) GetPodIPv6sFromRoutes() (map[string]string, error) {
+	routes, err := n.netLink.RouteList(nil, unix.AF_INET)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetPodIPv6sFromRoutes: failed to list IPv4 routes")
+	}
+	ipv4ByLink := make(map[int]string)
+	for _, route := range routes {
+		if isHostRoute(route, 32) && route.Scope == netlink.SCOPE_LINK {
+			ipv4ByLink[route.LinkIndex] = route.Dst.IP.String()
+		}
+	}
+
+	routes, err = n.netLink.RouteList(nil, unix.AF_INET6)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetPodIPv6sFromRoutes: failed to list IPv6 routes")
+	}
+	podIPv6s := make(map[string]string)
+	for _, route := range routes {
+		if !isHostRoute(route, 128) {
+			continue
+		}
+		if ipv4, ok := ipv4ByLink[route.LinkIndex]; ok {
+			podIPv6s[ipv4] = route.Dst.IP.String()
+		}
+	}
+	return podIPv6s, nil
+}
+
+// GetPodVeths returns the veth devices that match the veth prefix, with the addresses of their host routes
+func (n *linuxNetwork) GetPodVeths() ([]PodVeth, error) {
+	links, err := n.netLink.LinkList()
+	if err != nil {
+		return nil, errors.Wrap(err, "GetPodVeths: failed to list links")
+	}
+	prefix := n.vethPrefix
+	if prefix == "" {
+		prefix = defaultVethPrefix
+	}
+	vethByIndex := make(map[int]*PodVeth)
+	var indexes []int
+	for _, link := range links {
+		if link.Type() != "veth" || !strings.HasPrefix(link.Attrs().Name, prefix) {
+			continue
+		}
+		vethByIndex[link.Attrs().Index] = &PodVeth{Name: link.Attrs().Name}
+		indexes = append(indexes, link.Attrs().Index)
+	}
+
+	for _, family := range []int{unix.AF_INET, unix.AF_INET6} {
+		var routes []netlink.Route
+		if family == unix.AF_INET && n.podENI {
+			// The host routes of the pods with a branch ENI are in the route table of their VLAN
+			routes, err = n.netLink.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_UNSPEC},
+				netlink.RT_FILTER_TABLE)
+		} else {
+			routes, err = n.netLink.RouteList(nil, family)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "GetPodVeths: failed to list routes")
+		}
+		bits := 32
+		if family == unix.AF_INET6 {
+			bits = 128
+		}
+		for _, route := range routes {
+			if veth, ok := vethByIndex[route.LinkIndex]; ok && isHostRoute(route, bits) {
+				veth.IPs = append(veth.IPs, cidr.FromIP(route.Dst.IP))
+			}
+		}
+	}
+
+	veths := make([]PodVeth, 0, len(indexes))
+	for _, index := range indexes {
+		veths = append(veths, *vethByIndex[index])
+	}
+	return veths, nil
+}
+
+// DeletePodVeth deletes the veth, which also deletes its routes, and the to-pod and from-pod rules of its addresses.
+// Devices and rules that are already gone are not errors.
+func (n *linuxNetwork) DeletePodVeth(veth PodVeth) error {
+	link, err := n.netLink.LinkByName(veth.Name)
+	if err == nil {
+		err = n.netLink.LinkDel(link)
+	}
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return errors.Wrapf(err, "DeletePodVeth: failed to delete %s", veth.Name)
+		}
+	}
+
+	for _, ip := range veth.IPs {
+		addr := cidr.HostPrefix(ip)
+		toPodRule := n.netLink.NewRule()
+		toPodRule.Dst = cidr.IPNet(addr)
+		toPodRule.Priority = toPodRulePriority
+		if err := n.regularNetLink().RuleDel(toPodRule); err != nil && !containsNoSuchRule(err) {
+			return errors.Wrapf(err, "DeletePodVeth: failed to delete to-pod rule of %s", ip)
+		}
+		if ip.Is4() {
+			if err := n.DeleteRuleListBySrc(addr); err != nil {
+				return errors.Wrapf(err, "DeletePodVeth: failed to delete from-pod rules of %s", ip)
+			}
+		}
+	}
+	log.Infof("Deleted veth %s of IPs %v", veth.Name, veth.IPs)
+	return nil
+}
+
+// isReservedRouteTable returns whether the route table is one of the tables of the kernel rather than of an ENI
+func isReservedRouteTable(table int) bool {
+	return table == unix.RT_TABLE_UNSPEC || table == unix.RT_TABLE_MAIN || table == unix.RT_TABLE_LOCAL ||
+		table == unix.RT_TABLE_DEFAULT
+}
+
+// GetRouteTableIDs returns the IDs of the route tables, other than the main, local and default ones, that have IPv4
+// routes or that IPv4 rules look up
+func (n *linuxNetwork) GetRouteTableIDs() ([]int, error) {
+	routes, err := n.netLink.RouteListFiltered(unix.AF_INET, &netlink.Route{Table: unix.RT_TABLE_UNSPEC},
+		netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetRouteTableIDs: failed to list routes")
+	}
+	rules, err := n.netLink.RuleList(unix.AF_INET)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetRouteTableIDs: failed to list rules")
+	}
+
+	inUse := make(map[int]bool)
+	for _, route := range routes {
+		inUse[route.Table] = true
+	}
+	for _, rule := range rules {
+		if !isFirewallRule(rule) {
+			inUse[rule.Table] = true
 		}
 	}
+	var tables []int
+	for table := range inUse {
+		if !isReservedRouteTable(table) {
+			tables = append(tables, table)
+		}
+	}
+	sort.Ints(tables)
+	return tables, nil
+}
+
+// FlushRouteTable deletes the IPv4 routes of the route table, and the IPv4 rules that look it up, so that the table can
+// be used again by an ENI with the same device number
+func (n *linuxNetwork) FlushRouteTable(table int) error {
+	if isReservedRouteTable(table) {
+		return errors.Errorf("FlushRouteTable: refusing to flush reserved route table %d", table)
+	}
+	if err := n.TeardownENINetwork(table); err != nil {
+		return err
+	}
+	routes, err := n.netLink.RouteListFiltered(unix.AF_INET, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return errors.Wrapf(err, "FlushRouteTable: failed to list routes of table %d", table)
+	}
+	allRules, err := n.netLink.RuleList(unix.AF_INET)
+	if err != nil {
+		return errors.Wrap(err, "FlushRouteTable: failed to list rules")
+	}
+	var rules []netlink.Rule
+	for _, rule := range allRules {
+		if rule.Table == table {
+			rules = append(rules, rule)
+		}
+	}
+
+	err = netlinkwrapper.Batch(n.regularNetLink(), len(routes)+len(rules), func(netLink netlinkwrapper.NetLink) error {
+		for _, route := range routes {
+			route := route
+			if err := netLink.RouteDel(&route); err != nil && !netlinkwrapper.IsNotExistsError(err) {
+				return errors.Wrapf(err, "FlushRouteTable: failed to delete route %v", route)
+			}
+		}
+		for _, rule := range rules {
+			rule := rule
+			if err := netLink.RuleDel(&rule); err != nil && !containsNoSuchRule(err) {
+				return errors.Wrapf(err, "FlushRouteTable: failed to delete rule %v", rule)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("Flushed %d routes and the rules of route table %d", len(routes), table)
 	return nil
 }
 
-// incrementIPv4Addr returns incremented IPv4 address
-func incrementIPv4Addr(ip net.IP) (net.IP, error) {
-	ip4 := ip.To4()
-	if ip4 == nil {
-		return nil, fmt.Errorf("%q is not a valid IPv4 Address", ip)
+// GetENIReferences returns a description of each IPv4 rule that looks up the route table of the ENI or matches one of
+// its secondary IPs, and of each host route to one of its secondary IPs. Pods still use the ENI if there are any.
+func (n *linuxNetwork) GetENIReferences(eniTable int, ips []string) ([]string, error) {
+	isENIIP := make(map[string]bool)
+	for _, ip := range ips {
+		isENIIP[ip] = true
 	}
-	intIP := binary.BigEndian.Uint32([]byte(ip4))
-	if intIP == (1<<32 - 1) {
-		return nil, fmt.Errorf("%q will be overflowed", ip)
+	matches := func(ipNet *net.IPNet) bool {
+		return ipNet != nil && isENIIP[ipNet.IP.String()]
 	}
-	intIP++
-	bytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(bytes, intIP)
-	return net.IP(bytes), nil
+
+	rules, err := n.netLink.RuleList(unix.AF_INET)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetENIReferences: failed to list rules")
+	}
+	var references []string
+	for _, rule := range rules {
+		if (eniTable > 0 && rule.Table == eniTable && !isFirewallRule(rule)) || matches(rule.Src) || matches(rule.Dst) {
+			references = append(references, "rule "+rule.String())
+		}
+	}
+
+	routes, err := n.netLink.RouteList(nil, unix.AF_INET)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetENIReferences: failed to list routes")
+	}
+	for _, route := range routes {
+		if isHostRoute(route, 32) && matches(route.Dst) {
+			references = append(references, "route "+route.String())
+		}
+	}
+	return references, nil
 }
 
-// GetRuleList returns IP rules
-func (n *linuxNetwork) GetRuleList() ([]netlink.Rule, error) {
-	return n.netLink.RuleList(unix.AF_INET)
+// isHostRoute returns whether a route is a direct route to a single address
+func isHostRoute(route netlink.Route, bits int) bool {
+	if route.Dst == nil || route.Gw != nil {
+		return false
+	}
+	ones, maskBits := route.Dst.Mask.Size()
+	return ones == bits && maskBits == bits
+}
+
+// regularNetLink returns the NetLink of the changes no pod being added waits for, they give way to the changes of the
+// ADD path in the netlink throttle
+func (n *linuxNetwork) regularNetLink() netlinkwrapper.NetLink {
+	return netlinkwrapper.WithLane(n.netLink, netlinkwrapper.RegularLane)
 }
 
 // GetRuleListBySrc returns IP rules with matching source IP
-func (n *linuxNetwork) GetRuleListBySrc(ruleList []netlink.Rule, src net.IPNet) ([]netlink.Rule, error) {
+func (n *linuxNetwork) GetRuleListBySrc(ruleList []netlink.Rule, src netip.Prefix) ([]netlink.Rule, error) {
 	var srcRuleList []netlink.Rule
 	for _, rule := range ruleList {
-		if rule.Src != nil && rule.Src.IP.Equal(src.IP) {
+		if rule.Src != nil && cidr.FromIP(rule.Src.IP) == src.Addr() {
 			srcRuleList = append(srcRuleList, rule)
 		}
 	}
@@ -836,10 +2274,14 @@ func (n *linuxNetwork) GetRuleListBySrc(ruleList []netlink.Rule, src net.IPNet)
 }
 
 // DeleteRuleListBySrc deletes IP rules that have a matching source IP
-func (n *linuxNetwork) DeleteRuleListBySrc(src net.IPNet) error {
+func (n *linuxNetwork) DeleteRuleListBySrc(src netip.Prefix) error {
 	log.Infof("Delete Rule List By Src [%v]", src)
 
-	ruleList, err := n.GetRuleList()
+	getRuleList := n.GetRuleList
+	if src.Addr().Is6() {
+		getRuleList = n.GetIPv6RuleList
+	}
+	ruleList, err := getRuleList()
 	if err != nil {
 		log.Errorf("DeleteRuleListBySrc: failed to get rule list %v", err)
 		return err
@@ -852,25 +2294,32 @@ func (n *linuxNetwork) DeleteRuleListBySrc(src net.IPNet) error {
 	}
 
 	log.Infof("Remove current list [%v]", srcRuleList)
-	for _, rule := range srcRuleList {
-		if err := n.netLink.RuleDel(&rule); err != nil && !containsNoSuchRule(err) {
-			log.Errorf("Failed to cleanup old IP rule: %v", err)
-			return errors.Wrapf(err, "DeleteRuleListBySrc: failed to delete old rule")
-		}
+	return netlinkwrapper.Batch(n.regularNetLink(), len(srcRuleList), func(netLink netlinkwrapper.NetLink) error {
+		for _, rule := range srcRuleList {
+			if err := netLink.RuleDel(&rule); err != nil && !containsNoSuchRule(err) {
+				log.Errorf("Failed to cleanup old IP rule: %v", err)
+				return errors.Wrapf(err, "DeleteRuleListBySrc: failed to delete old rule")
+			}
 
-		var toDst string
-		if rule.Dst != nil {
-			toDst = rule.Dst.String()
+			var toDst string
+			if rule.Dst != nil {
+				toDst = rule.Dst.String()
+			}
+			log.Debugf("DeleteRuleListBySrc: Successfully removed current rule [%v] to %s", rule, toDst)
 		}
-		log.Debugf("DeleteRuleListBySrc: Successfully removed current rule [%v] to %s", rule, toDst)
-	}
-	return nil
+		return nil
+	})
 }
 
-// UpdateRuleListBySrc modify IP rules that have a matching source IP
-func (n *linuxNetwork) UpdateRuleListBySrc(ruleList []netlink.Rule, src net.IPNet, toCIDRs []string, requiresSNAT bool) error {
+// UpdateRuleListBySrc modify IP rules that have a matching source IP. For an IPv6 source, ruleList holds the IPv6
+// rules, the CIDRs of the other family are skipped and the IPv6 CIDRs excluded from SNAT are used.
+func (n *linuxNetwork) UpdateRuleListBySrc(ruleList []netlink.Rule, src netip.Prefix, toCIDRs []netip.Prefix, requiresSNAT bool) error {
+	excludeSNATCIDRs := n.excludeSNATCIDRs
+	if src.Addr().Is6() {
+		excludeSNATCIDRs = n.ipv6ExcludeSNATCIDRs
+	}
 	log.Infof("Update Rule List[%v] for source[%v] with toCIDRs[%v], excludeSNATCIDRs[%v], requiresSNAT[%v]",
-		ruleList, src, toCIDRs, n.excludeSNATCIDRs, requiresSNAT)
+		ruleList, src, toCIDRs, excludeSNATCIDRs, requiresSNAT)
 
 	srcRuleList, err := n.GetRuleListBySrc(ruleList, src)
 	if err != nil {
@@ -878,62 +2327,75 @@ func (n *linuxNetwork) UpdateRuleListBySrc(ruleList []netlink.Rule, src net.IPNe
 		return err
 	}
 
-	log.Infof("Remove current list [%v]", srcRuleList)
-	var srcRuleTable int
-	for _, rule := range srcRuleList {
-		srcRuleTable = rule.Table
-		if err := n.netLink.RuleDel(&rule); err != nil && !containsNoSuchRule(err) {
-			log.Errorf("Failed to cleanup old IP rule: %v", err)
-			return errors.Wrapf(err, "UpdateRuleListBySrc: failed to delete old rule")
+	// The old rules are deleted and the new ones added as one batch
+	changes := 0
+	if len(srcRuleList) > 0 {
+		changes = len(srcRuleList) + 1
+		if requiresSNAT {
+			changes = len(srcRuleList) + len(toCIDRs) + len(excludeSNATCIDRs)
 		}
-		var toDst string
-		if rule.Dst != nil {
-			toDst = rule.Dst.String()
-		}
-		log.Debugf("UpdateRuleListBySrc: Successfully removed current rule [%v] to %s", rule, toDst)
 	}
+	return netlinkwrapper.Batch(n.regularNetLink(), changes, func(netLink netlinkwrapper.NetLink) error {
+		log.Infof("Remove current list [%v]", srcRuleList)
+		var srcRuleTable int
+		for _, rule := range srcRuleList {
+			srcRuleTable = rule.Table
+			if err := netLink.RuleDel(&rule); err != nil && !containsNoSuchRule(err) {
+				log.Errorf("Failed to cleanup old IP rule: %v", err)
+				return errors.Wrapf(err, "UpdateRuleListBySrc: failed to delete old rule")
+			}
+			var toDst string
+			if rule.Dst != nil {
+				toDst = rule.Dst.String()
+			}
+			log.Debugf("UpdateRuleListBySrc: Successfully removed current rule [%v] to %s", rule, toDst)
+		}
 
-	if len(srcRuleList) == 0 {
-		log.Debug("UpdateRuleListBySrc: empty list, no need to update")
-		return nil
-	}
+		if len(srcRuleList) == 0 {
+			log.Debug("UpdateRuleListBySrc: empty list, no need to update")
+			return nil
+		}
+
+		if requiresSNAT {
+			allCIDRs := append(append([]netip.Prefix{}, toCIDRs...), excludeSNATCIDRs...)
+			for _, dst := range allCIDRs {
+				if dst.Addr().Is6() != src.Addr().Is6() {
+					continue
+				}
+				podRule := netLink.NewRule()
+				podRule.Dst = cidr.IPNet(dst)
+				podRule.Src = cidr.IPNet(src)
+				podRule.Table = srcRuleTable
+				podRule.Priority = fromPodRulePriority
+
+				err = netLink.RuleAdd(podRule)
+				if err != nil {
+					log.Errorf("Failed to add pod IP rule for external SNAT: %v", err)
+					return errors.Wrapf(err, "UpdateRuleListBySrc: failed to add pod rule for CIDR %s", dst)
+				}
+				var toDst string
 
-	if requiresSNAT {
-		allCIDRs := append(toCIDRs, n.excludeSNATCIDRs...)
-		for _, cidr := range allCIDRs {
-			podRule := n.netLink.NewRule()
-			_, podRule.Dst, _ = net.ParseCIDR(cidr)
-			podRule.Src = &src
+				if podRule.Dst != nil {
+					toDst = podRule.Dst.String()
+				}
+				log.Infof("UpdateRuleListBySrc: Successfully added pod rule[%v] to %s", podRule, toDst)
+			}
+		} else {
+			podRule := netLink.NewRule()
+
+			podRule.Src = cidr.IPNet(src)
 			podRule.Table = srcRuleTable
 			podRule.Priority = fromPodRulePriority
 
-			err = n.netLink.RuleAdd(podRule)
+			err = netLink.RuleAdd(podRule)
 			if err != nil {
-				log.Errorf("Failed to add pod IP rule for external SNAT: %v", err)
-				return errors.Wrapf(err, "UpdateRuleListBySrc: failed to add pod rule for CIDR %s", cidr)
-			}
-			var toDst string
-
-			if podRule.Dst != nil {
-				toDst = podRule.Dst.String()
+				log.Errorf("Failed to add pod IP rule: %v", err)
+				return errors.Wrapf(err, "UpdateRuleListBySrc: failed to add pod rule")
 			}
-			log.Infof("UpdateRuleListBySrc: Successfully added pod rule[%v] to %s", podRule, toDst)
+			log.Infof("UpdateRuleListBySrc: Successfully added pod rule[%v]", podRule)
 		}
-	} else {
-		podRule := n.netLink.NewRule()
-
-		podRule.Src = &src
-		podRule.Table = srcRuleTable
-		podRule.Priority = fromPodRulePriority
-
-		err = n.netLink.RuleAdd(podRule)
-		if err != nil {
-			log.Errorf("Failed to add pod IP rule: %v", err)
-			return errors.Wrapf(err, "UpdateRuleListBySrc: failed to add pod rule")
-		}
-		log.Infof("UpdateRuleListBySrc: Successfully added pod rule[%v]", podRule)
-	}
-	return nil
+		return nil
+	})
 }
 
 // GetEthernetMTU gets the MTU setting from AWS_VPC_ENI_MTU, or defaults to 9001 if not set.
@@ -0,0 +1,260 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/netlinkwrapper"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/cidr"
+)
+
+// NetworkState is the network state owned by the plugin on a node, in a form that can be exported and applied again,
+// possibly on another node
+type NetworkState struct {
+	// Rules are the IPv4 rules at the priorities the plugin uses
+	Rules []StateRule
+	// Routes are the IPv4 routes of the route tables of the ENIs, and the host routes to the pods
+	Routes []StateRoute
+	// Iptables are the rule specs of the chains of the plugin, and of its rules in the built-in chains, by table and
+	// chain
+	Iptables map[string]map[string][][]string
+}
+
+// StateRule is an IPv4 rule of a NetworkState
+type StateRule struct {
+	Priority int
+	Table    int
+	Src      string `json:",omitempty"`
+	Dst      string `json:",omitempty"`
+	Mark     int
+	Mask     int
+	Invert   bool `json:",omitempty"`
+}
+
+// StateRoute is an IPv4 route of a NetworkState. The link is kept by name, since indexes differ between nodes.
+type StateRoute struct {
+	Table int
+	Dst   string `json:",omitempty"`
+	Gw    string `json:",omitempty"`
+	Src   string `json:",omitempty"`
+	Link  string
+	Scope int
+}
+
+// NetworkStateImport is the outcome of applying a NetworkState
+type NetworkStateImport struct {
+	// Rules and Routes are the number of rules and routes added or replaced
+	Rules  int
+	Routes int
+	// Skipped describes what could not be applied, e.g. routes through links the node does not have
+	Skipped []string `json:",omitempty"`
+}
+
+// isPluginRulePriority returns whether IPv4 rules at this priority are written by the plugin
+func isPluginRulePriority(priority int) bool {
+	return priority == toPodRulePriority || priority == fromPodRulePriority || priority == hostRulePriority ||
+		priority == unmanagedCIDRRulePriority
+}
+
+func ipNetString(ipNet *net.IPNet) string {
+	if ipNet == nil {
+		return ""
+	}
+	return ipNet.String()
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func parseStateIPNet(s string) (*net.IPNet, error) {
+	if s == "" {
+		return nil, nil
+	}
+	prefix, err := cidr.Parse(s)
+	return cidr.IPNet(prefix), err
+}
+
+func (r StateRule) String() string {
+	return fmt.Sprintf("rule priority %d from %s to %s mark %d/%d table %d invert %v", r.Priority, r.Src, r.Dst, r.Mark,
+		r.Mask, r.Table, r.Invert)
+}
+
+func (r StateRoute) String() string {
+	return fmt.Sprintf("route to %s via %s dev %s src %s table %d", r.Dst, r.Gw, r.Link, r.Src, r.Table)
+}
+
+// ExportNetworkState returns the rules, routes and iptables chains the plugin owns on the node
+func (n *linuxNetwork) ExportNetworkState() (*NetworkState, error) {
+	state := &NetworkState{}
+	rules, err := n.netLink.RuleList(unix.AF_INET)
+	if err != nil {
+		return nil, errors.Wrap(err, "ExportNetworkState: failed to list rules")
+	}
+	for _, rule := range rules {
+		if !isPluginRulePriority(rule.Priority) {
+			continue
+		}
+		state.Rules = append(state.Rules, StateRule{
+			Priority: rule.Priority,
+			Table:    rule.Table,
+			Src:      ipNetString(rule.Src),
+			Dst:      ipNetString(rule.Dst),
+			Mark:     rule.Mark,
+			Mask:     rule.Mask,
+			Invert:   rule.Invert,
+		})
+	}
+
+	links, err := n.netLink.LinkList()
+	if err != nil {
+		return nil, errors.Wrap(err, "ExportNetworkState: failed to list links")
+	}
+	linkNames := make(map[int]string)
+	for _, link := range links {
+		linkNames[link.Attrs().Index] = link.Attrs().Name
+	}
+	routes, err := n.netLink.RouteListFiltered(unix.AF_INET, &netlink.Route{Table: unix.RT_TABLE_UNSPEC},
+		netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, errors.Wrap(err, "ExportNetworkState: failed to list routes")
+	}
+	vethPrefix := n.vethPrefix
+	if vethPrefix == "" {
+		vethPrefix = defaultVethPrefix
+	}
+	for _, route := range routes {
+		link := linkNames[route.LinkIndex]
+		podRoute := route.Table == mainRoutingTable && strings.HasPrefix(link, vethPrefix)
+		if (isReservedRouteTable(route.Table) && !podRoute) || link == "" {
+			continue
+		}
+		state.Routes = append(state.Routes, StateRoute{
+			Table: route.Table,
+			Dst:   ipNetString(route.Dst),
+			Gw:    ipString(route.Gw),
+			Src:   ipString(route.Src),
+			Link:  link,
+			Scope: int(route.Scope),
+		})
+	}
+
+	ipt, err := n.newIptables()
+	if err != nil {
+		return nil, errors.Wrap(err, "ExportNetworkState: failed to create iptables")
+	}
+	if state.Iptables, err = listHostChains(ipt); err != nil {
+		return nil, errors.Wrap(err, "ExportNetworkState")
+	}
+	// Only the rules of the plugin are kept from the built-in chains
+	for table, builtins := range hostSetupChains {
+		for _, chain := range builtins {
+			var ruleSpecs [][]string
+			for _, ruleSpec := range state.Iptables[table][chain] {
+				if isAWSRule(ruleSpec) {
+					ruleSpecs = append(ruleSpecs, ruleSpec)
+				}
+			}
+			state.Iptables[table][chain] = ruleSpecs
+		}
+	}
+	return state, nil
+}
+
+// ImportNetworkState applies the rules, routes and iptables chains of an exported NetworkState. Rules and routes
+// missing from the state are left alone, the chains of the plugin are made to match it.
+func (n *linuxNetwork) ImportNetworkState(state *NetworkState) (*NetworkStateImport, error) {
+	result := &NetworkStateImport{}
+	rules, err := n.netLink.RuleList(unix.AF_INET)
+	if err != nil {
+		return nil, errors.Wrap(err, "ImportNetworkState: failed to list rules")
+	}
+	existing := make(map[string]bool)
+	for _, rule := range rules {
+		existing[ruleKey(rule)] = true
+	}
+	for _, stateRule := range state.Rules {
+		rule := n.netLink.NewRule()
+		rule.Priority = stateRule.Priority
+		rule.Table = stateRule.Table
+		rule.Mark = stateRule.Mark
+		rule.Mask = stateRule.Mask
+		rule.Invert = stateRule.Invert
+		src, err := parseStateIPNet(stateRule.Src)
+		if err == nil {
+			rule.Src = src
+			rule.Dst, err = parseStateIPNet(stateRule.Dst)
+		}
+		if err != nil {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("%s: %v", stateRule, err))
+			continue
+		}
+		if existing[ruleKey(*rule)] {
+			continue
+		}
+		if err := n.netLink.RuleAdd(rule); err != nil {
+			return result, errors.Wrapf(err, "ImportNetworkState: failed to add %s", stateRule)
+		}
+		result.Rules++
+	}
+
+	for _, stateRoute := range state.Routes {
+		link, err := n.netLink.LinkByName(stateRoute.Link)
+		if err != nil {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("%s: %v", stateRoute, err))
+			continue
+		}
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Table:     stateRoute.Table,
+			Gw:        net.ParseIP(stateRoute.Gw),
+			Src:       net.ParseIP(stateRoute.Src),
+			Scope:     netlink.Scope(stateRoute.Scope),
+		}
+		if route.Dst, err = parseStateIPNet(stateRoute.Dst); err != nil {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("%s: %v", stateRoute, err))
+			continue
+		}
+		if err := n.netLink.RouteReplace(route); err != nil && !netlinkwrapper.IsRouteExistsError(err) {
+			return result, errors.Wrapf(err, "ImportNetworkState: failed to replace %s", stateRoute)
+		}
+		result.Routes++
+	}
+
+	if len(state.Iptables) > 0 {
+		ipt, err := n.newIptables()
+		if err != nil {
+			return result, errors.Wrap(err, "ImportNetworkState: failed to create iptables")
+		}
+		for table, chains := range state.Iptables {
+			if err := restoreChains(ipt, table, chains); err != nil {
+				return result, errors.Wrap(err, "ImportNetworkState")
+			}
+		}
+	}
+	log.Infof("Imported the network state: %d rules and %d routes added or replaced, %d skipped", result.Rules,
+		result.Routes, len(result.Skipped))
+	return result, nil
+}
@@ -14,16 +14,19 @@
 package networkutils
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"os"
-	"reflect"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
-	"time"
-
-	"github.com/aws/aws-sdk-go/aws"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
@@ -31,10 +34,15 @@ import (
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/capabilities"
 	mocks_ip "github.com/aws/amazon-vpc-cni-k8s/pkg/ipwrapper/mocks"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/netlinkwrapper/mock_netlink"
 	mock_netlinkwrapper "github.com/aws/amazon-vpc-cni-k8s/pkg/netlinkwrapper/mocks"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/networkutils/iptablestest"
 	mock_nswrapper "github.com/aws/amazon-vpc-cni-k8s/pkg/nswrapper/mocks"
+	mock_procsyswrapper "github.com/aws/amazon-vpc-cni-k8s/pkg/procsyswrapper/mocks"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/cidr"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/retry"
 )
 
 const (
@@ -51,8 +59,21 @@ const (
 var (
 	_, testENINetIPNet, _ = net.ParseCIDR(testeniSubnet)
 	testENINetIP          = net.ParseIP(testeniIP)
+	testENIPrefix         = netip.MustParsePrefix(testeniSubnet)
+	testENIAddr           = netip.MustParseAddr(testeniIP)
+	// testRetryPolicy retries without waiting
+	testRetryPolicy = retry.Policy{MaxAttempts: 5}
 )
 
+// testPrefixes parses the CIDRs of a test
+func testPrefixes(cidrs ...string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, s := range cidrs {
+		prefixes = append(prefixes, netip.MustParsePrefix(s))
+	}
+	return prefixes
+}
+
 func setup(t *testing.T) (*gomock.Controller,
 	*mock_netlinkwrapper.MockNetLink,
 	*mocks_ip.MockIP,
@@ -104,7 +125,7 @@ func TestSetupENINetwork(t *testing.T) {
 
 	// eth1's IP address
 	testeniAddr := &net.IPNet{
-		IP:   net.ParseIP(testeniIP),
+		IP:   net.ParseIP(testeniIP).To4(),
 		Mask: testENINetIPNet.Mask,
 	}
 	mockNetLink.EXPECT().AddrList(gomock.Any(), unix.AF_INET).Return([]netlink.Addr{}, nil)
@@ -118,21 +139,184 @@ func TestSetupENINetwork(t *testing.T) {
 
 	mockNetLink.EXPECT().RouteDel(gomock.Any()).Return(nil)
 
-	err = setupENINetwork(testeniIP, testMAC2, testTable, testeniSubnet, mockNetLink, 0*time.Second, 0*time.Second, testMTU)
+	err = setupENINetwork(testENIAddr, testMAC2, testTable, testENIPrefix, mockNetLink, testRetryPolicy, testRetryPolicy, testMTU, nil)
+	assert.NoError(t, err)
+}
+
+func TestSetupENIIPv6Network(t *testing.T) {
+	ctrl, mockNetLink, _, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	hwAddr, err := net.ParseMAC(testMAC2)
+	assert.NoError(t, err)
+	eth1 := mock_netlink.NewMockLink(ctrl)
+	eth1.EXPECT().Attrs().Return(&netlink.LinkAttrs{HardwareAddr: hwAddr, Index: 3}).AnyTimes()
+	mockNetLink.EXPECT().LinkList().Return([]netlink.Link{eth1}, nil)
+
+	// The link-local address is kept and a stale address is deleted
+	linkLocal := netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)}}
+	stale := netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP("2001:db8:0:2::99"), Mask: net.CIDRMask(64, 128)}}
+	mockNetLink.EXPECT().AddrList(eth1, unix.AF_INET6).Return([]netlink.Addr{linkLocal, stale}, nil)
+	mockNetLink.EXPECT().AddrDel(eth1, &stale).Return(nil)
+	eniAddr := &net.IPNet{IP: net.ParseIP("2001:db8:0:2::10"), Mask: net.CIDRMask(64, 128)}
+	mockNetLink.EXPECT().AddrAdd(eth1, &netlink.Addr{IPNet: eniAddr, Flags: unix.IFA_F_NODAD}).Return(nil)
+
+	gw := net.ParseIP("2001:db8:0:2::1")
+	routes := []netlink.Route{
+		{LinkIndex: 3, Dst: &net.IPNet{IP: gw, Mask: net.CIDRMask(128, 128)}, Scope: netlink.SCOPE_LINK, Table: testTable},
+		{LinkIndex: 3, Dst: &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}, Scope: netlink.SCOPE_UNIVERSE, Gw: gw, Table: testTable},
+	}
+	for i := range routes {
+		mockNetLink.EXPECT().RouteDel(&routes[i]).Return(nil)
+		mockNetLink.EXPECT().RouteAdd(&routes[i]).Return(nil)
+	}
+	_, subnet, _ := net.ParseCIDR("2001:db8:0:2::/64")
+	mockNetLink.EXPECT().RouteDel(&netlink.Route{LinkIndex: 3, Dst: subnet, Table: mainRoutingTable}).Return(nil)
+
+	err = setupENIIPv6Network(netip.MustParseAddr("2001:db8:0:2::10"), testMAC2, testTable, netip.MustParsePrefix("2001:db8:0:2::/64"), mockNetLink, testRetryPolicy, testRetryPolicy)
+	assert.NoError(t, err)
+
+	// The primary ENI is not set up, and the address must be in the family of the CIDR
+	assert.NoError(t, setupENIIPv6Network(netip.MustParseAddr("2001:db8::10"), testMAC1, 0, netip.MustParsePrefix("2001:db8::/64"), mockNetLink, testRetryPolicy, testRetryPolicy))
+	mockNetLink.EXPECT().LinkList().Return([]netlink.Link{eth1}, nil)
+	assert.Error(t, setupENIIPv6Network(netip.MustParseAddr("10.10.0.10"), testMAC2, testTable, netip.MustParsePrefix("2001:db8:0:2::/64"), mockNetLink, testRetryPolicy, testRetryPolicy))
+}
+
+func egressLinks(indexes ...int) []netlink.Link {
+	var links []netlink.Link
+	for _, index := range indexes {
+		links = append(links, &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Index: index}})
+	}
+	return links
+}
+
+func TestUpdateEgressMultipath(t *testing.T) {
+	ctrl, mockNetLink, _, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{netLink: mockNetLink, egressPaths: make(map[int]egressPath)}
+	gw := net.ParseIP("10.10.0.1").To4()
+	defaultDst := &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+
+	// A single ENI in the subnet keeps its regular default route
+	mockNetLink.EXPECT().LinkList().Return(egressLinks(3), nil)
+	mockNetLink.EXPECT().RouteReplace(&netlink.Route{
+		LinkIndex: 3, Dst: defaultDst, Scope: netlink.SCOPE_UNIVERSE, Gw: gw, Table: testTable}).Return(nil)
+	err := ln.updateEgressMultipath(testTable, 3, testENIPrefix)
+	assert.NoError(t, err)
+
+	nexthops := []*netlink.NexthopInfo{
+		{LinkIndex: 3, Gw: gw, Flags: int(netlink.FLAG_ONLINK)},
+		{LinkIndex: 4, Gw: gw, Flags: int(netlink.FLAG_ONLINK)},
+	}
+	for _, table := range []int{testTable, testTable + 1} {
+		mockNetLink.EXPECT().RouteReplace(&netlink.Route{
+			Dst:       defaultDst,
+			Scope:     netlink.SCOPE_UNIVERSE,
+			MultiPath: nexthops,
+			Table:     table,
+		}).Return(nil)
+	}
+	mockNetLink.EXPECT().LinkList().Return(egressLinks(3, 4), nil)
+	err = ln.updateEgressMultipath(testTable+1, 4, testENIPrefix)
+	assert.NoError(t, err)
+
+	// ENIs in other subnets are not mixed in
+	mockNetLink.EXPECT().LinkList().Return(egressLinks(3, 4, 5), nil)
+	mockNetLink.EXPECT().RouteReplace(&netlink.Route{
+		LinkIndex: 5, Dst: defaultDst, Scope: netlink.SCOPE_UNIVERSE, Gw: net.ParseIP("10.11.0.1").To4(), Table: testTable + 2}).Return(nil)
+	err = ln.updateEgressMultipath(testTable+2, 5, netip.MustParsePrefix("10.11.0.0/16"))
 	assert.NoError(t, err)
 }
 
+func TestTeardownENINetwork(t *testing.T) {
+	ctrl, mockNetLink, _, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	gw := net.ParseIP("10.10.0.1").To4()
+	defaultDst := &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+	gwAddr := netip.MustParseAddr("10.10.0.1")
+	ln := &linuxNetwork{netLink: mockNetLink, egressPaths: map[int]egressPath{
+		testTable:     {linkIndex: 3, gw: gwAddr, subnet: testENIPrefix},
+		testTable + 1: {linkIndex: 4, gw: gwAddr, subnet: testENIPrefix},
+		testTable + 2: {linkIndex: 5, gw: gwAddr, subnet: testENIPrefix},
+	}}
+
+	// Detaching one of three ENIs leaves the other two in the ECMP route
+	nexthops := []*netlink.NexthopInfo{
+		{LinkIndex: 3, Gw: gw, Flags: int(netlink.FLAG_ONLINK)},
+		{LinkIndex: 5, Gw: gw, Flags: int(netlink.FLAG_ONLINK)},
+	}
+	mockNetLink.EXPECT().LinkList().Return(egressLinks(3, 4, 5), nil)
+	for _, table := range []int{testTable, testTable + 2} {
+		mockNetLink.EXPECT().RouteReplace(&netlink.Route{
+			Dst:       defaultDst,
+			Scope:     netlink.SCOPE_UNIVERSE,
+			MultiPath: nexthops,
+			Table:     table,
+		}).Return(nil)
+	}
+	assert.NoError(t, ln.TeardownENINetwork(testTable+1))
+	assert.NotContains(t, ln.egressPaths, testTable+1)
+
+	// The link of a second ENI went away out-of-band, the last one gets its single path route back
+	mockNetLink.EXPECT().LinkList().Return(egressLinks(3), nil)
+	mockNetLink.EXPECT().RouteReplace(&netlink.Route{
+		LinkIndex: 3, Dst: defaultDst, Scope: netlink.SCOPE_UNIVERSE, Gw: gw, Table: testTable}).Return(nil)
+	assert.NoError(t, ln.TeardownENINetwork(testTable+2))
+	assert.Len(t, ln.egressPaths, 1)
+	assert.Contains(t, ln.egressPaths, testTable)
+
+	// Unknown tables are left alone
+	assert.NoError(t, ln.TeardownENINetwork(testTable+5))
+}
+
+func TestReplaceRouteSrc(t *testing.T) {
+	ctrl, mockNetLink, _, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{netLink: mockNetLink}
+	oldIP := net.ParseIP("10.10.10.20").To4()
+	newIP := net.ParseIP("10.10.10.30").To4()
+	subnetRoute := netlink.Route{LinkIndex: 2, Dst: testENINetIPNet, Src: oldIP, Scope: netlink.SCOPE_LINK, Table: 254}
+	defaultRoute := netlink.Route{LinkIndex: 2, Gw: net.ParseIP("10.10.0.1"), Table: 254}
+	mockNetLink.EXPECT().RouteList(nil, unix.AF_INET).Return([]netlink.Route{subnetRoute, defaultRoute}, nil)
+
+	replaced := subnetRoute
+	replaced.Src = newIP
+	mockNetLink.EXPECT().RouteReplace(&replaced).Return(nil)
+	assert.NoError(t, ln.ReplaceRouteSrc(netip.MustParseAddr("10.10.10.20"), netip.MustParseAddr("10.10.10.30")))
+}
+
+func TestIPv4PrefixRoute(t *testing.T) {
+	ctrl, mockNetLink, _, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{netLink: mockNetLink}
+	prefix := netip.MustParsePrefix("10.10.10.16/28")
+	_, dst, _ := net.ParseCIDR("10.10.10.16/28")
+	route := &netlink.Route{Dst: dst, Table: unix.RT_TABLE_MAIN, Type: unix.RTN_BLACKHOLE}
+	mockNetLink.EXPECT().RouteReplace(route).Return(nil)
+	assert.NoError(t, ln.SetupIPv4PrefixRoute(prefix))
+
+	// The route is already gone
+	mockNetLink.EXPECT().RouteDel(route).Return(syscall.ESRCH)
+	assert.NoError(t, ln.DeleteIPv4PrefixRoute(prefix))
+	mockNetLink.EXPECT().RouteDel(route).Return(syscall.EPERM)
+	assert.Error(t, ln.DeleteIPv4PrefixRoute(prefix))
+}
+
 func TestSetupENINetworkMACFail(t *testing.T) {
 	ctrl, mockNetLink, _, _, _ := setup(t)
 	defer ctrl.Finish()
 
 	// Emulate a delay attaching the ENI so a retry is necessary
 	// First attempt gets one links
-	for i := 0; i < maxAttemptsLinkByMac; i++ {
+	for i := 0; i < testRetryPolicy.MaxAttempts; i++ {
 		mockNetLink.EXPECT().LinkList().Return(nil, fmt.Errorf("simulated failure"))
 	}
 
-	err := setupENINetwork(testeniIP, testMAC2, testTable, testeniSubnet, mockNetLink, 0*time.Second, 0*time.Second, testMTU)
+	err := setupENINetwork(testENIAddr, testMAC2, testTable, testENIPrefix, mockNetLink, testRetryPolicy, testRetryPolicy, testMTU, nil)
 	assert.Errorf(t, err, "simulated failure")
 }
 
@@ -140,7 +324,7 @@ func TestSetupENINetworkPrimary(t *testing.T) {
 	ctrl, mockNetLink, _, _, _ := setup(t)
 	defer ctrl.Finish()
 
-	err := setupENINetwork(testeniIP, testMAC2, 0, testeniSubnet, mockNetLink, 0*time.Second, 0*time.Second, testMTU)
+	err := setupENINetwork(testENIAddr, testMAC2, 0, testENIPrefix, mockNetLink, testRetryPolicy, testRetryPolicy, testMTU, nil)
 	assert.NoError(t, err)
 }
 
@@ -164,9 +348,10 @@ func TestSetupHostNetworkNodePortDisabled(t *testing.T) {
 	var mainENIRule netlink.Rule
 	mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
 	mockNetLink.EXPECT().RuleDel(&mainENIRule)
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
 
-	var vpcCIDRs []*string
-	err := ln.SetupHostNetwork(testENINetIPNet, vpcCIDRs, "", &testENINetIP)
+	var vpcCIDRs []netip.Prefix
+	err := ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
 	assert.NoError(t, err)
 }
 
@@ -184,8 +369,8 @@ func TestUpdateRuleListBySrc(t *testing.T) {
 		name               string
 		oldRule            netlink.Rule
 		requiresSNAT       bool
-		toCIDRs            []string
-		snatExclusionCIDRs []string
+		toCIDRs            []netip.Prefix
+		snatExclusionCIDRs []netip.Prefix
 		ruleList           []netlink.Rule
 		newRules           []netlink.Rule
 		expDst             []*net.IPNet
@@ -195,7 +380,7 @@ func TestUpdateRuleListBySrc(t *testing.T) {
 			"multiple destinations",
 			origRule,
 			true,
-			[]string{"10.10.0.0/16", "10.11.0.0/16"},
+			testPrefixes("10.10.0.0/16", "10.11.0.0/16"),
 			nil,
 			[]netlink.Rule{origRule},
 			make([]netlink.Rule, 2),
@@ -206,7 +391,7 @@ func TestUpdateRuleListBySrc(t *testing.T) {
 			"single destination",
 			origRule,
 			false,
-			[]string{""},
+			[]netip.Prefix{{}},
 			nil,
 			[]netlink.Rule{origRule},
 			make([]netlink.Rule, 1),
@@ -217,8 +402,8 @@ func TestUpdateRuleListBySrc(t *testing.T) {
 			"SNAT exclusions",
 			origRule,
 			true,
-			[]string{"10.10.0.0/16", "10.11.0.0/16"},
-			[]string{"10.12.0.0/16", "10.13.0.0/16"},
+			testPrefixes("10.10.0.0/16", "10.11.0.0/16"),
+			testPrefixes("10.12.0.0/16", "10.13.0.0/16"),
 			[]netlink.Rule{origRule},
 			make([]netlink.Rule, 4),
 			make([]*net.IPNet, 4),
@@ -237,7 +422,7 @@ func TestUpdateRuleListBySrc(t *testing.T) {
 
 		allCIDRs := append(tc.toCIDRs, tc.snatExclusionCIDRs...)
 		for i := 0; i < newRuleSize; i++ {
-			_, tc.expDst[i], _ = net.ParseCIDR(allCIDRs[i])
+			tc.expDst[i] = cidr.IPNet(allCIDRs[i])
 		}
 
 		mockNetLink.EXPECT().RuleDel(&tc.oldRule)
@@ -247,7 +432,7 @@ func TestUpdateRuleListBySrc(t *testing.T) {
 			mockNetLink.EXPECT().RuleAdd(&tc.newRules[i])
 		}
 
-		err := ln.UpdateRuleListBySrc(tc.ruleList, *testENINetIPNet, tc.toCIDRs, tc.requiresSNAT)
+		err := ln.UpdateRuleListBySrc(tc.ruleList, testENIPrefix, tc.toCIDRs, tc.requiresSNAT)
 		assert.NoError(t, err)
 
 		for i := 0; i < newRuleSize; i++ {
@@ -258,11 +443,45 @@ func TestUpdateRuleListBySrc(t *testing.T) {
 	}
 }
 
+func TestUpdateRuleListBySrcIPv6(t *testing.T) {
+	ctrl, mockNetLink, _, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{
+		netLink:              mockNetLink,
+		excludeSNATCIDRs:     testPrefixes("10.12.0.0/16"),
+		ipv6ExcludeSNATCIDRs: testPrefixes("2001:db8:1::/48"),
+	}
+	src := netip.MustParsePrefix("2001:db8::11/128")
+	origRule := netlink.Rule{Src: cidr.IPNet(src), Table: testTable}
+
+	// The IPv4 CIDRs are skipped, and the IPv6 CIDRs excluded from SNAT are used
+	mockNetLink.EXPECT().RuleDel(&origRule)
+	newRules := make([]netlink.Rule, 2)
+	for i := range newRules {
+		mockNetLink.EXPECT().NewRule().Return(&newRules[i])
+		mockNetLink.EXPECT().RuleAdd(&newRules[i])
+	}
+	err := ln.UpdateRuleListBySrc([]netlink.Rule{origRule}, src, testPrefixes("10.10.0.0/16", "2001:db8::/56"), true)
+	assert.NoError(t, err)
+	for i, dstCIDR := range []string{"2001:db8::/56", "2001:db8:1::/48"} {
+		_, dst, _ := net.ParseCIDR(dstCIDR)
+		assert.Equal(t, dst, newRules[i].Dst)
+		assert.Equal(t, cidr.IPNet(src), newRules[i].Src)
+		assert.Equal(t, testTable, newRules[i].Table)
+	}
+
+	// The IPv6 rules are listed to delete the rules of an IPv6 source
+	mockNetLink.EXPECT().RuleList(unix.AF_INET6).Return([]netlink.Rule{origRule}, nil)
+	mockNetLink.EXPECT().RuleDel(&origRule)
+	assert.NoError(t, ln.DeleteRuleListBySrc(src))
+}
+
 func TestSetupHostNetworkNodePortEnabled(t *testing.T) {
 	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
 	defer ctrl.Finish()
 
-	var mockRPFilter mockFile
+	mockProcSys := mock_procsyswrapper.NewMockProcSys(ctrl)
 	ln := &linuxNetwork{
 		useExternalSNAT:        true,
 		nodePortSupportEnabled: true,
@@ -273,11 +492,12 @@ func TestSetupHostNetworkNodePortEnabled(t *testing.T) {
 		newIptables: func() (iptablesIface, error) {
 			return mockIptables, nil
 		},
-		openFile: func(name string, flag int, perm os.FileMode) (stringWriteCloser, error) {
-			return &mockRPFilter, nil
-		},
+		procSys: mockProcSys,
 	}
 
+	mockProcSys.EXPECT().Set("net/ipv4/conf/lo/rp_filter", "2")
+
+	mockNetLink.EXPECT().LinkByName(kubeIPVSInterface).Return(nil, errors.New("link not found"))
 	var hostRule netlink.Rule
 	mockNetLink.EXPECT().NewRule().Return(&hostRule)
 	mockNetLink.EXPECT().RuleDel(&hostRule)
@@ -285,14 +505,15 @@ func TestSetupHostNetworkNodePortEnabled(t *testing.T) {
 	mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
 	mockNetLink.EXPECT().RuleDel(&mainENIRule)
 	mockNetLink.EXPECT().RuleAdd(&mainENIRule)
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
 
-	var vpcCIDRs []*string
+	var vpcCIDRs []netip.Prefix
 
 	// loopback for primary device is a little bit hacky. But the test is stable and it should be
 	// OK for test purpose.
 	LoopBackMac := ""
 
-	err := ln.SetupHostNetwork(testENINetIPNet, vpcCIDRs, LoopBackMac, &testENINetIP)
+	err := ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, LoopBackMac, testENIAddr)
 	assert.NoError(t, err)
 
 	assert.Equal(t, map[string]map[string][][]string{
@@ -310,102 +531,110 @@ func TestSetupHostNetworkNodePortEnabled(t *testing.T) {
 				},
 			},
 		},
-	}, mockIptables.dataplaneState)
-	assert.Equal(t, mockFile{closed: true, data: "2"}, mockRPFilter)
+		// The SNAT chain is created empty with external SNAT
+		"nat": {"AWS-SNAT-CHAIN-0": [][]string{}},
+	}, mockIptables.Tables)
 }
 
-func TestLoadMTUFromEnvTooLow(t *testing.T) {
-	_ = os.Setenv(envMTU, "1")
-	assert.Equal(t, GetEthernetMTU(), minimumMTU)
-}
-
-func TestLoadMTUFromEnv1500(t *testing.T) {
-	_ = os.Setenv(envMTU, "1500")
-	assert.Equal(t, GetEthernetMTU(), 1500)
-}
-
-func TestLoadMTUFromEnvTooHigh(t *testing.T) {
-	_ = os.Setenv(envMTU, "65536")
-	assert.Equal(t, GetEthernetMTU(), maximumMTU)
-}
-
-func TestLoadExcludeSNATCIDRsFromEnv(t *testing.T) {
-	_ = os.Setenv(envExternalSNAT, "false")
-	_ = os.Setenv(envExcludeSNATCIDRs, "10.12.0.0/16,10.13.0.0/16")
-
-	expected := []string{"10.12.0.0/16", "10.13.0.0/16"}
-	assert.Equal(t, getExcludeSNATCIDRs(), expected)
-}
-
-func TestSetupHostNetworkWithExcludeSNATCIDRs(t *testing.T) {
+func TestSetupHostNetworkRulePosition(t *testing.T) {
 	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
 	defer ctrl.Finish()
 
-	var mockRPFilter mockFile
+	mockProcSys := mock_procsyswrapper.NewMockProcSys(ctrl)
 	ln := &linuxNetwork{
-		useExternalSNAT:        false,
-		excludeSNATCIDRs:       []string{"10.12.0.0/16", "10.13.0.0/16"},
 		nodePortSupportEnabled: true,
 		mainENIMark:            defaultConnmark,
+		iptablesRulePosition:   iptablesRuleInsert,
 
 		netLink: mockNetLink,
 		ns:      mockNS,
 		newIptables: func() (iptablesIface, error) {
 			return mockIptables, nil
 		},
-		openFile: func(name string, flag int, perm os.FileMode) (stringWriteCloser, error) {
-			return &mockRPFilter, nil
+		procSys: mockProcSys,
+	}
+	mockProcSys.EXPECT().Set("net/ipv4/conf/lo/rp_filter", "2").AnyTimes()
+
+	setMarkRule := []string{
+		"-m", "comment", "--comment", "AWS, primary ENI",
+		"-i", "lo",
+		"-m", "addrtype", "--dst-type", "LOCAL", "--limit-iface-in",
+		"-j", "CONNMARK", "--set-mark", "0x80/0x80",
+	}
+	restoreMarkRule := []string{
+		"-m", "comment", "--comment", "AWS, primary ENI",
+		"-i", "eni+", "-j", "CONNMARK", "--restore-mark", "--mask", "0x80",
+	}
+	masqueradeRule := []string{"-m", "comment", "--comment", "kubernetes postrouting rules", "-j", "KUBE-POSTROUTING"}
+	markRule := []string{"-j", "MARK", "--set-mark", "0x1"}
+
+	// The jump to the SNAT chain was appended before the rule position was set
+	mockIptables.Tables = map[string]map[string][][]string{
+		"nat": {
+			"POSTROUTING": {masqueradeRule, snatChainJumpRule},
+		},
+		"mangle": {
+			"PREROUTING": {markRule},
 		},
 	}
 
 	var hostRule netlink.Rule
-	mockNetLink.EXPECT().NewRule().Return(&hostRule)
-	mockNetLink.EXPECT().RuleDel(&hostRule)
 	var mainENIRule netlink.Rule
-	mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
-	mockNetLink.EXPECT().RuleDel(&mainENIRule)
-	mockNetLink.EXPECT().RuleAdd(&mainENIRule)
+	expectRules := func() {
+		mockNetLink.EXPECT().LinkByName(kubeIPVSInterface).Return(nil, errors.New("link not found"))
+		mockNetLink.EXPECT().NewRule().Return(&hostRule)
+		mockNetLink.EXPECT().RuleDel(&hostRule)
+		mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
+		mockNetLink.EXPECT().RuleDel(&mainENIRule)
+		mockNetLink.EXPECT().RuleAdd(&mainENIRule)
+		mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+	}
+	expectRules()
+	err := ln.SetupHostNetwork(testENIPrefix, nil, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{snatChainJumpRule, masqueradeRule}, mockIptables.Tables["nat"]["POSTROUTING"])
+	assert.Equal(t, [][]string{setMarkRule, restoreMarkRule, markRule}, mockIptables.Tables["mangle"]["PREROUTING"])
 
-	var vpcCIDRs []*string
-	vpcCIDRs = []*string{aws.String("10.10.0.0/16"), aws.String("10.11.0.0/16")}
-	err := ln.SetupHostNetwork(testENINetIPNet, vpcCIDRs, "", &testENINetIP)
+	// Back to appending, the rules are moved after the rules of others
+	ln.iptablesRulePosition = iptablesRuleAppend
+	expectRules()
+	err = ln.SetupHostNetwork(testENIPrefix, nil, "", testENIAddr)
 	assert.NoError(t, err)
-	assert.Equal(t,
-		map[string]map[string][][]string{
-			"nat": {
-				"AWS-SNAT-CHAIN-0": [][]string{{"!", "-d", "10.10.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-1"}},
-				"AWS-SNAT-CHAIN-1": [][]string{{"!", "-d", "10.11.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-2"}},
-				"AWS-SNAT-CHAIN-2": [][]string{{"!", "-d", "10.12.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "AWS-SNAT-CHAIN-3"}},
-				"AWS-SNAT-CHAIN-3": [][]string{{"!", "-d", "10.13.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "AWS-SNAT-CHAIN-4"}},
-				"AWS-SNAT-CHAIN-4": [][]string{{"-m", "comment", "--comment", "AWS, SNAT", "-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "SNAT", "--to-source", "10.10.10.20"}},
-				"POSTROUTING":      [][]string{{"-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-0"}}},
-			"mangle": {
-				"PREROUTING": [][]string{
-					{"-m", "comment", "--comment", "AWS, primary ENI", "-i", "lo", "-m", "addrtype", "--dst-type", "LOCAL", "--limit-iface-in", "-j", "CONNMARK", "--set-mark", "0x80/0x80"},
-					{"-m", "comment", "--comment", "AWS, primary ENI", "-i", "eni+", "-j", "CONNMARK", "--restore-mark", "--mask", "0x80"},
-				},
-			},
-		}, mockIptables.dataplaneState)
+	assert.Equal(t, [][]string{masqueradeRule, snatChainJumpRule}, mockIptables.Tables["nat"]["POSTROUTING"])
+	assert.Equal(t, [][]string{markRule, setMarkRule, restoreMarkRule}, mockIptables.Tables["mangle"]["PREROUTING"])
 }
 
-func TestSetupHostNetworkCleansUpStaleSNATRules(t *testing.T) {
+func TestSetupHostNetworkNodePortDisabledCleansUpRules(t *testing.T) {
 	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
 	defer ctrl.Finish()
 
-	var mockRPFilter mockFile
 	ln := &linuxNetwork{
-		useExternalSNAT:        false,
-		excludeSNATCIDRs:       nil,
-		nodePortSupportEnabled: true,
-		mainENIMark:            defaultConnmark,
+		useExternalSNAT: true,
+		mainENIMark:     defaultConnmark,
+		vethPrefix:      "veth",
 
 		netLink: mockNetLink,
 		ns:      mockNS,
 		newIptables: func() (iptablesIface, error) {
 			return mockIptables, nil
 		},
-		openFile: func(name string, flag int, perm os.FileMode) (stringWriteCloser, error) {
-			return &mockRPFilter, nil
+	}
+
+	// Rules left behind while node port support was enabled
+	mockIptables.Tables = map[string]map[string][][]string{
+		"mangle": {
+			"PREROUTING": [][]string{
+				{
+					"-m", "comment", "--comment", "AWS, primary ENI",
+					"-i", "eth0",
+					"-m", "addrtype", "--dst-type", "LOCAL", "--limit-iface-in",
+					"-j", "CONNMARK", "--set-mark", "0x80/0x80",
+				},
+				{
+					"-m", "comment", "--comment", "AWS, primary ENI",
+					"-i", "veth+", "-j", "CONNMARK", "--restore-mark", "--mask", "0x80",
+				},
+			},
 		},
 	}
 
@@ -415,59 +644,38 @@ func TestSetupHostNetworkCleansUpStaleSNATRules(t *testing.T) {
 	var mainENIRule netlink.Rule
 	mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
 	mockNetLink.EXPECT().RuleDel(&mainENIRule)
-	mockNetLink.EXPECT().RuleAdd(&mainENIRule)
-
-	vpcCIDRs := []*string{aws.String("10.10.0.0/16"), aws.String("10.11.0.0/16")}
-	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-0", "!", "-d", "10.10.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAN", "-j", "AWS-SNAT-CHAIN-1") //AWS SNAT CHAN proves backwards compatibility
-	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-1", "!", "-d", "10.11.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-2")
-	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-2", "!", "-d", "10.12.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "AWS-SNAT-CHAIN-3")
-	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-3", "!", "-d", "10.13.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "AWS-SNAT-CHAIN-4")
-	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-4", "-m", "comment", "--comment", "AWS, SNAT", "-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "SNAT", "--to-source", "10.10.10.20")
-	_ = mockIptables.NewChain("nat", "AWS-SNAT-CHAIN-5")
-	_ = mockIptables.Append("nat", "POSTROUTING", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-0")
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
 
-	err := ln.SetupHostNetwork(testENINetIPNet, vpcCIDRs, "", &testENINetIP)
+	// No interface has this MAC, so the primary interface is assumed to be eth0
+	var vpcCIDRs []netip.Prefix
+	err := ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "02:00:00:00:00:00", testENIAddr)
 	assert.NoError(t, err)
-
-	assert.Equal(t,
-		map[string]map[string][][]string{
-			"nat": {
-				"AWS-SNAT-CHAIN-0": [][]string{{"!", "-d", "10.10.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-1"}},
-				"AWS-SNAT-CHAIN-1": [][]string{{"!", "-d", "10.11.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-2"}},
-				"AWS-SNAT-CHAIN-2": [][]string{{"-m", "comment", "--comment", "AWS, SNAT", "-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "SNAT", "--to-source", "10.10.10.20"}},
-				"AWS-SNAT-CHAIN-3": [][]string{},
-				"AWS-SNAT-CHAIN-4": [][]string{},
-				"POSTROUTING":      [][]string{{"-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-0"}}},
-			"mangle": {
-				"PREROUTING": [][]string{
-					{"-m", "comment", "--comment", "AWS, primary ENI", "-i", "lo", "-m", "addrtype", "--dst-type", "LOCAL", "--limit-iface-in", "-j", "CONNMARK", "--set-mark", "0x80/0x80"},
-					{"-m", "comment", "--comment", "AWS, primary ENI", "-i", "eni+", "-j", "CONNMARK", "--restore-mark", "--mask", "0x80"},
-				},
-			},
-		}, mockIptables.dataplaneState)
+	assert.Empty(t, mockIptables.Tables["mangle"]["PREROUTING"])
 }
 
-func TestSetupHostNetworkExcludedSNATCIDRsIdempotent(t *testing.T) {
+func TestSetupHostNetworkInterfaceOverrides(t *testing.T) {
 	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
 	defer ctrl.Finish()
 
-	var mockRPFilter mockFile
+	mockProcSys := mock_procsyswrapper.NewMockProcSys(ctrl)
 	ln := &linuxNetwork{
-		useExternalSNAT:        false,
-		excludeSNATCIDRs:       []string{"10.12.0.0/16", "10.13.0.0/16"},
+		useExternalSNAT:        true,
 		nodePortSupportEnabled: true,
 		mainENIMark:            defaultConnmark,
+		primaryInterface:       "ens5",
+		podInterfacePattern:    "cni0",
 
 		netLink: mockNetLink,
 		ns:      mockNS,
 		newIptables: func() (iptablesIface, error) {
 			return mockIptables, nil
 		},
-		openFile: func(name string, flag int, perm os.FileMode) (stringWriteCloser, error) {
-			return &mockRPFilter, nil
-		},
+		procSys: mockProcSys,
 	}
 
+	mockProcSys.EXPECT().Set("net/ipv4/conf/ens5/rp_filter", "2")
+
+	mockNetLink.EXPECT().LinkByName(kubeIPVSInterface).Return(nil, errors.New("link not found"))
 	var hostRule netlink.Rule
 	mockNetLink.EXPECT().NewRule().Return(&hostRule)
 	mockNetLink.EXPECT().RuleDel(&hostRule)
@@ -475,205 +683,1867 @@ func TestSetupHostNetworkExcludedSNATCIDRsIdempotent(t *testing.T) {
 	mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
 	mockNetLink.EXPECT().RuleDel(&mainENIRule)
 	mockNetLink.EXPECT().RuleAdd(&mainENIRule)
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
 
-	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-0", "!", "-d", "10.10.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-1")
-	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-1", "!", "-d", "10.11.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-2")
-	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-2", "!", "-d", "10.12.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "AWS-SNAT-CHAIN-3")
-	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-3", "!", "-d", "10.13.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "AWS-SNAT-CHAIN-4")
-	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-4", "-m", "comment", "--comment", "AWS, SNAT", "-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "SNAT", "--to-source", "10.10.10.20")
-	_ = mockIptables.Append("nat", "POSTROUTING", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-0")
-
-	// remove exclusions
-	vpcCIDRs := []*string{aws.String("10.10.0.0/16"), aws.String("10.11.0.0/16")}
-	err := ln.SetupHostNetwork(testENINetIPNet, vpcCIDRs, "", &testENINetIP)
+	// The MAC is ignored since the primary interface is configured
+	var vpcCIDRs []netip.Prefix
+	err := ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "02:00:00:00:00:00", testENIAddr)
 	assert.NoError(t, err)
-
-	assert.Equal(t,
-		map[string]map[string][][]string{
-			"nat": {
-				"AWS-SNAT-CHAIN-0": [][]string{{"!", "-d", "10.10.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-1"}},
-				"AWS-SNAT-CHAIN-1": [][]string{{"!", "-d", "10.11.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-2"}},
-				"AWS-SNAT-CHAIN-2": [][]string{{"!", "-d", "10.12.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "AWS-SNAT-CHAIN-3"}},
-				"AWS-SNAT-CHAIN-3": [][]string{{"!", "-d", "10.13.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "AWS-SNAT-CHAIN-4"}},
-				"AWS-SNAT-CHAIN-4": [][]string{{"-m", "comment", "--comment", "AWS, SNAT", "-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "SNAT", "--to-source", "10.10.10.20"}},
-				"POSTROUTING":      [][]string{{"-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-0"}}},
-			"mangle": {
-				"PREROUTING": [][]string{
-					{"-m", "comment", "--comment", "AWS, primary ENI", "-i", "lo", "-m", "addrtype", "--dst-type", "LOCAL", "--limit-iface-in", "-j", "CONNMARK", "--set-mark", "0x80/0x80"},
-					{"-m", "comment", "--comment", "AWS, primary ENI", "-i", "eni+", "-j", "CONNMARK", "--restore-mark", "--mask", "0x80"},
-				},
-			},
-		}, mockIptables.dataplaneState)
+	assert.Equal(t, [][]string{
+		{
+			"-m", "comment", "--comment", "AWS, primary ENI",
+			"-i", "ens5",
+			"-m", "addrtype", "--dst-type", "LOCAL", "--limit-iface-in",
+			"-j", "CONNMARK", "--set-mark", "0x80/0x80",
+		},
+		{
+			"-m", "comment", "--comment", "AWS, primary ENI",
+			"-i", "cni0", "-j", "CONNMARK", "--restore-mark", "--mask", "0x80",
+		},
+	}, mockIptables.Tables["mangle"]["PREROUTING"])
 }
 
-func TestSetupHostNetworkMultipleCIDRs(t *testing.T) {
+func TestSetupHostNetworkIPv6(t *testing.T) {
 	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
 	defer ctrl.Finish()
 
-	var mockRPFilter mockFile
+	mockProcSys := mock_procsyswrapper.NewMockProcSys(ctrl)
 	ln := &linuxNetwork{
-		useExternalSNAT:        true,
-		nodePortSupportEnabled: true,
-		mainENIMark:            defaultConnmark,
+		useExternalSNAT:  true,
+		mainENIMark:      defaultConnmark,
+		primaryInterface: "ens5",
+		ipv6Enabled:      true,
 
 		netLink: mockNetLink,
 		ns:      mockNS,
 		newIptables: func() (iptablesIface, error) {
 			return mockIptables, nil
 		},
-		openFile: func(name string, flag int, perm os.FileMode) (stringWriteCloser, error) {
-			return &mockRPFilter, nil
-		},
+		procSys: mockProcSys,
 	}
 
+	mockProcSys.EXPECT().Set("net/ipv6/conf/ens5/accept_ra", "2")
+	mockProcSys.EXPECT().Set("net/ipv6/conf/all/forwarding", "1")
+
 	var hostRule netlink.Rule
 	mockNetLink.EXPECT().NewRule().Return(&hostRule)
 	mockNetLink.EXPECT().RuleDel(&hostRule)
 	var mainENIRule netlink.Rule
 	mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
 	mockNetLink.EXPECT().RuleDel(&mainENIRule)
-	mockNetLink.EXPECT().RuleAdd(&mainENIRule)
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
 
-	var vpcCIDRs []*string
-	vpcCIDRs = []*string{aws.String("10.10.0.0/16"), aws.String("10.11.0.0/16")}
-	err := ln.SetupHostNetwork(testENINetIPNet, vpcCIDRs, "", &testENINetIP)
+	var vpcCIDRs []netip.Prefix
+	err := ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
 	assert.NoError(t, err)
 }
 
-func TestIncrementIPv4Addr(t *testing.T) {
-	testCases := []struct {
-		name     string
-		ip       net.IP
-		expected net.IP
-		err      bool
-	}{
-		{"increment", net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2).To4(), false},
-		{"carry up 1", net.IPv4(10, 0, 0, 255), net.IPv4(10, 0, 1, 0).To4(), false},
-		{"carry up 2", net.IPv4(10, 0, 255, 255), net.IPv4(10, 1, 0, 0).To4(), false},
-		{"overflow", net.IPv4(255, 255, 255, 255), nil, true},
-	}
+func TestSetupIPv6HostNetwork(t *testing.T) {
+	ctrl, _, _, _, mockIptables := setup(t)
+	defer ctrl.Finish()
 
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			result, err := incrementIPv4Addr(tc.ip)
-			if tc.err {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
-			}
-			assert.Equal(t, tc.expected, result, tc.name)
-		})
+	ln := &linuxNetwork{
+		ipv6Enabled:          true,
+		ipv6SNAT:             true,
+		ipv6ExcludeSNATCIDRs: testPrefixes("fd00::/8"),
+		newIptables: func() (iptablesIface, error) {
+			t.Fatal("IPv4 iptables must not be used for the IPv6 rules")
+			return nil, nil
+		},
+		newIp6tables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
 	}
-}
 
-type mockIptables struct {
-	// dataplaneState is a map from table name to chain name to slice of rulespecs
-	dataplaneState map[string]map[string][][]string
-}
+	err := ln.SetupIPv6HostNetwork(testPrefixes("2600:1f14::/56"))
+	assert.NoError(t, err)
+	assert.Equal(t,
+		map[string]map[string][][]string{
+			"nat": {
+				"AWS-SNAT-CHAIN-0": [][]string{
+					{"-d", "2600:1f14::/56", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "RETURN"},
+					{"-d", "fd00::/8", "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "RETURN"},
+					{"-m", "comment", "--comment", "AWS, SNAT", "-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "MASQUERADE"},
+				},
+				"POSTROUTING": [][]string{{"-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-0"}}},
+		}, mockIptables.Tables)
 
-func newMockIptables() *mockIptables {
-	return &mockIptables{dataplaneState: map[string]map[string][][]string{}}
+	// Disabling IPv6 SNAT removes the rules, whatever the IPv4 SNAT policy is
+	ln.ipv6SNAT = false
+	ln.ipv6ExcludeSNATCIDRs = nil
+	err = ln.SetupIPv6HostNetwork(testPrefixes("2600:1f14::/56"))
+	assert.NoError(t, err)
+	assert.Empty(t, mockIptables.Tables["nat"]["POSTROUTING"])
+	assert.Empty(t, mockIptables.Tables["nat"]["AWS-SNAT-CHAIN-0"])
 }
 
-func (ipt *mockIptables) Exists(table, chainName string, rulespec ...string) (bool, error) {
-	chain := ipt.dataplaneState[table][chainName]
-	for _, r := range chain {
-		if reflect.DeepEqual(rulespec, r) {
-			return true, nil
-		}
+func TestSetupIPv6HostNetworkNAT64(t *testing.T) {
+	ctrl, mockNetLink, _, _, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{
+		ipv6Enabled: true,
+		ipv6SNAT:    true,
+		nat64:       nat64VPC,
+		nat64Prefix: defaultNAT64Prefix,
+		nat64Device: defaultNAT64Device,
+		netLink:     mockNetLink,
+		newIp6tables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
 	}
-	return false, nil
-}
+	prefix := cidr.IPNet(defaultNAT64Prefix)
+
+	// The prefix is routed to the VPC router, and excluded from SNAT
+	subnetRoute6 := netlink.Route{LinkIndex: 2, Dst: &net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(64, 128)}}
+	defaultRoute6 := netlink.Route{LinkIndex: 2, Gw: net.ParseIP("fe80::1")}
+	mockNetLink.EXPECT().RouteList(nil, unix.AF_INET6).Return([]netlink.Route{subnetRoute6, defaultRoute6}, nil)
+	mockNetLink.EXPECT().RouteReplace(&netlink.Route{Dst: prefix, Table: mainRoutingTable, LinkIndex: 2,
+		Gw: net.ParseIP("fe80::1")}).Return(nil)
+	err := ln.SetupIPv6HostNetwork(testPrefixes("2600:1f14::/56"))
+	assert.NoError(t, err)
+	assert.Contains(t, mockIptables.Tables["nat"]["AWS-SNAT-CHAIN-0"],
+		[]string{"-d", defaultNAT64Prefix.String(), "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "RETURN"})
+
+	// With a NAT64 on the node, the prefix is routed to its device, which must exist
+	ln.nat64 = nat64Node
+	nat64 := &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: defaultNAT64Device, Index: 7}}
+	mockNetLink.EXPECT().LinkByName(defaultNAT64Device).Return(nat64, nil)
+	mockNetLink.EXPECT().RouteReplace(&netlink.Route{Dst: prefix, Table: mainRoutingTable, LinkIndex: 7,
+		Scope: netlink.SCOPE_LINK}).Return(nil)
+	err = ln.SetupIPv6HostNetwork(testPrefixes("2600:1f14::/56"))
+	assert.NoError(t, err)
 
-func (ipt *mockIptables) Insert(table, chain string, pos int, rulespec ...string) error {
-	return nil
+	mockNetLink.EXPECT().LinkByName(defaultNAT64Device).Return(nil, errors.New("Link not found"))
+	err = ln.SetupIPv6HostNetwork(testPrefixes("2600:1f14::/56"))
+	assert.Error(t, err)
 }
 
-func (ipt *mockIptables) Append(table, chain string, rulespec ...string) error {
-	if ipt.dataplaneState[table] == nil {
-		ipt.dataplaneState[table] = map[string][][]string{}
-	}
-	ipt.dataplaneState[table][chain] = append(ipt.dataplaneState[table][chain], rulespec)
-	return nil
-}
+func TestGetNAT64Prefix(t *testing.T) {
+	defer os.Unsetenv(envNAT64Prefix)
 
-func (ipt *mockIptables) Delete(table, chainName string, rulespec ...string) error {
-	chain := ipt.dataplaneState[table][chainName]
-	updatedChain := chain[:0]
-	found := false
-	for _, r := range chain {
-		if !found && reflect.DeepEqual(rulespec, r) {
-			found = true
-			continue
-		}
-		updatedChain = append(updatedChain, r)
-	}
-	if !found {
-		return errors.New("not found")
-	}
-	ipt.dataplaneState[table][chainName] = updatedChain
-	return nil
+	_ = os.Unsetenv(envNAT64Prefix)
+	assert.Equal(t, defaultNAT64Prefix, getNAT64Prefix())
+	_ = os.Setenv(envNAT64Prefix, "2001:db8:64::1/96")
+	assert.Equal(t, netip.MustParsePrefix("2001:db8:64::/96"), getNAT64Prefix())
+	_ = os.Setenv(envNAT64Prefix, "10.0.0.0/8")
+	assert.Equal(t, defaultNAT64Prefix, getNAT64Prefix())
 }
 
-func (ipt *mockIptables) List(table, chain string) ([]string, error) {
-	var chains []string
-	chainContents := ipt.dataplaneState[table][chain]
-	for _, ruleSpec := range chainContents {
-		sanitizedRuleSpec := []string{"-A", chain}
-		for _, item := range ruleSpec {
-			if strings.Contains(item, " ") {
-				item = fmt.Sprintf("%q", item)
-			}
-			sanitizedRuleSpec = append(sanitizedRuleSpec, item)
-		}
-		chains = append(chains, strings.Join(sanitizedRuleSpec, " "))
-	}
-	return chains, nil
+func TestGetPodIPv6sFromRoutes(t *testing.T) {
+	ctrl, mockNetLink, _, _, _ := setup(t)
+	defer ctrl.Finish()
 
+	ln := &linuxNetwork{netLink: mockNetLink}
+	podRoute := netlink.Route{LinkIndex: 5, Dst: &net.IPNet{IP: net.ParseIP("10.10.10.5"), Mask: net.CIDRMask(32, 32)},
+		Scope: netlink.SCOPE_LINK}
+	v4OnlyPodRoute := netlink.Route{LinkIndex: 6, Dst: &net.IPNet{IP: net.ParseIP("10.10.10.6"), Mask: net.CIDRMask(32, 32)},
+		Scope: netlink.SCOPE_LINK}
+	defaultRoute := netlink.Route{LinkIndex: 2, Gw: net.ParseIP("10.10.0.1")}
+	mockNetLink.EXPECT().RouteList(nil, unix.AF_INET).Return([]netlink.Route{podRoute, v4OnlyPodRoute, defaultRoute}, nil)
+
+	podRoute6 := netlink.Route{LinkIndex: 5, Dst: &net.IPNet{IP: net.ParseIP("2001:db8::5"), Mask: net.CIDRMask(128, 128)}}
+	subnetRoute6 := netlink.Route{LinkIndex: 2, Dst: &net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(64, 128)}}
+	linkLocalRoute6 := netlink.Route{LinkIndex: 5, Dst: &net.IPNet{IP: net.ParseIP("fe80::"), Mask: net.CIDRMask(64, 128)}}
+	mockNetLink.EXPECT().RouteList(nil, unix.AF_INET6).Return([]netlink.Route{podRoute6, subnetRoute6, linkLocalRoute6}, nil)
+
+	podIPv6s, err := ln.GetPodIPv6sFromRoutes()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"10.10.10.5": "2001:db8::5"}, podIPv6s)
 }
 
-func (ipt *mockIptables) NewChain(table, chain string) error {
-	return nil
-}
+func TestGetPodVeths(t *testing.T) {
+	ctrl, mockNetLink, _, _, _ := setup(t)
+	defer ctrl.Finish()
 
-func (ipt *mockIptables) ClearChain(table, chain string) error {
-	return nil
+	ln := &linuxNetwork{netLink: mockNetLink, vethPrefix: "eni"}
+	podVeth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eni123", Index: 5}}
+	otherVeth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "cali123", Index: 6}}
+	eth0 := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Index: 2}}
+	mockNetLink.EXPECT().LinkList().Return([]netlink.Link{eth0, podVeth, otherVeth}, nil)
+
+	podRoute := netlink.Route{LinkIndex: 5, Dst: &net.IPNet{IP: net.ParseIP("10.10.10.5"), Mask: net.CIDRMask(32, 32)},
+		Scope: netlink.SCOPE_LINK}
+	otherRoute := netlink.Route{LinkIndex: 6, Dst: &net.IPNet{IP: net.ParseIP("10.10.10.6"), Mask: net.CIDRMask(32, 32)},
+		Scope: netlink.SCOPE_LINK}
+	mockNetLink.EXPECT().RouteList(nil, unix.AF_INET).Return([]netlink.Route{podRoute, otherRoute}, nil)
+	podRoute6 := netlink.Route{LinkIndex: 5, Dst: &net.IPNet{IP: net.ParseIP("2001:db8::5"), Mask: net.CIDRMask(128, 128)}}
+	linkLocalRoute6 := netlink.Route{LinkIndex: 5, Dst: &net.IPNet{IP: net.ParseIP("fe80::"), Mask: net.CIDRMask(64, 128)}}
+	mockNetLink.EXPECT().RouteList(nil, unix.AF_INET6).Return([]netlink.Route{podRoute6, linkLocalRoute6}, nil)
+
+	veths, err := ln.GetPodVeths()
+	assert.NoError(t, err)
+	assert.Equal(t, []PodVeth{{Name: "eni123", IPs: []netip.Addr{netip.MustParseAddr("10.10.10.5"),
+		netip.MustParseAddr("2001:db8::5")}}}, veths)
 }
 
-func (ipt *mockIptables) DeleteChain(table, chain string) error {
-	return nil
+func TestGetPodVethsPodENI(t *testing.T) {
+	ctrl, mockNetLink, _, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{netLink: mockNetLink, vethPrefix: "eni", podENI: true}
+	podVeth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eni123", Index: 5}}
+	branchVeth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eni456", Index: 7}}
+	mockNetLink.EXPECT().LinkList().Return([]netlink.Link{podVeth, branchVeth}, nil)
+
+	podRoute := netlink.Route{LinkIndex: 5, Dst: &net.IPNet{IP: net.ParseIP("10.10.10.5"), Mask: net.CIDRMask(32, 32)},
+		Scope: netlink.SCOPE_LINK, Table: unix.RT_TABLE_MAIN}
+	// The host route of a pod with a branch ENI is in the route table of its VLAN
+	branchRoute := netlink.Route{LinkIndex: 7, Dst: &net.IPNet{IP: net.ParseIP("10.10.20.7"), Mask: net.CIDRMask(32, 32)},
+		Scope: netlink.SCOPE_LINK, Table: 103}
+	mockNetLink.EXPECT().RouteListFiltered(unix.AF_INET, &netlink.Route{Table: unix.RT_TABLE_UNSPEC},
+		netlink.RT_FILTER_TABLE).Return([]netlink.Route{podRoute, branchRoute}, nil)
+	mockNetLink.EXPECT().RouteList(nil, unix.AF_INET6).Return(nil, nil)
+
+	veths, err := ln.GetPodVeths()
+	assert.NoError(t, err)
+	assert.Equal(t, []PodVeth{{Name: "eni123", IPs: []netip.Addr{netip.MustParseAddr("10.10.10.5")}},
+		{Name: "eni456", IPs: []netip.Addr{netip.MustParseAddr("10.10.20.7")}}}, veths)
 }
 
-func (ipt *mockIptables) ListChains(table string) ([]string, error) {
-	var chains []string
-	for chain := range ipt.dataplaneState[table] {
-		chains = append(chains, chain)
-	}
-	return chains, nil
+func TestDeletePodVeth(t *testing.T) {
+	ctrl, mockNetLink, _, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{netLink: mockNetLink}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eni123", Index: 5}}
+	podIP := net.ParseIP("10.10.10.5").To4()
+	fromPodRule := netlink.Rule{Src: &net.IPNet{IP: podIP, Mask: net.CIDRMask(32, 32)}, Table: 2}
+
+	mockNetLink.EXPECT().LinkByName("eni123").Return(veth, nil)
+	mockNetLink.EXPECT().LinkDel(veth).Return(nil)
+	mockNetLink.EXPECT().NewRule().DoAndReturn(func() *netlink.Rule { return netlink.NewRule() }).Times(2)
+	gomock.InOrder(
+		mockNetLink.EXPECT().RuleDel(gomock.Any()).Do(func(rule *netlink.Rule) {
+			assert.Equal(t, &net.IPNet{IP: podIP, Mask: net.CIDRMask(32, 32)}, rule.Dst)
+			assert.Equal(t, toPodRulePriority, rule.Priority)
+		}).Return(nil),
+		mockNetLink.EXPECT().RuleList(unix.AF_INET).Return([]netlink.Rule{fromPodRule}, nil),
+		mockNetLink.EXPECT().RuleDel(&fromPodRule).Return(nil),
+		// The IPv6 to-pod rule is already gone
+		mockNetLink.EXPECT().RuleDel(gomock.Any()).Return(unix.ENOENT),
+	)
+
+	err := ln.DeletePodVeth(PodVeth{Name: "eni123", IPs: []netip.Addr{netip.MustParseAddr("10.10.10.5"),
+		netip.MustParseAddr("2001:db8::5")}})
+	assert.NoError(t, err)
 }
 
-func (ipt *mockIptables) HasRandomFully() bool {
-	// TODO: Work out how to write a test case for this
-	return true
+func TestGetRouteTableIDs(t *testing.T) {
+	ctrl, mockNetLink, _, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{netLink: mockNetLink}
+	mockNetLink.EXPECT().RouteListFiltered(unix.AF_INET, &netlink.Route{}, netlink.RT_FILTER_TABLE).Return([]netlink.Route{
+		{Table: unix.RT_TABLE_MAIN}, {Table: unix.RT_TABLE_LOCAL}, {Table: 2}, {Table: 2}}, nil)
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return([]netlink.Rule{
+		{Table: unix.RT_TABLE_MAIN}, {Table: unix.RT_TABLE_LOCAL}, {Table: 3},
+		// The firewall symmetry rule of a table is left for the next ENI with the same device number
+		{Table: 4, Priority: firewallRulePriority, Mark: 4 << firewallMarkShift, Mask: firewallMarkMask}}, nil)
+
+	tables, err := ln.GetRouteTableIDs()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 3}, tables)
 }
 
-type mockFile struct {
-	closed bool
-	data   string
+func TestFlushRouteTable(t *testing.T) {
+	ctrl, mockNetLink, _, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{netLink: mockNetLink}
+	route := netlink.Route{Dst: &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}, Table: 3}
+	fromPodRule := netlink.Rule{Src: &net.IPNet{IP: net.ParseIP("10.10.10.5"), Mask: net.CIDRMask(32, 32)}, Table: 3}
+	otherRule := netlink.Rule{Table: 2}
+	mockNetLink.EXPECT().RouteListFiltered(unix.AF_INET, &netlink.Route{Table: 3}, netlink.RT_FILTER_TABLE).Return(
+		[]netlink.Route{route}, nil)
+	mockNetLink.EXPECT().RouteDel(&route).Return(nil)
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return([]netlink.Rule{fromPodRule, otherRule}, nil)
+	mockNetLink.EXPECT().RuleDel(&fromPodRule).Return(nil)
+
+	err := ln.FlushRouteTable(3)
+	assert.NoError(t, err)
+
+	assert.Error(t, ln.FlushRouteTable(unix.RT_TABLE_MAIN))
 }
 
-func (f *mockFile) WriteString(s string) (int, error) {
-	if f.closed {
-		panic("write call on closed file")
-	}
-	f.data += s
-	return len(s), nil
+func TestGetENIReferences(t *testing.T) {
+	ctrl, mockNetLink, _, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{netLink: mockNetLink}
+	podIP := net.IPNet{IP: net.ParseIP("10.10.10.5"), Mask: net.CIDRMask(32, 32)}
+	otherIP := net.IPNet{IP: net.ParseIP("10.10.10.6"), Mask: net.CIDRMask(32, 32)}
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return([]netlink.Rule{
+		{Src: &podIP, Table: 3}, {Dst: &otherIP, Table: unix.RT_TABLE_MAIN}, {Table: 2},
+		{Table: 2, Priority: firewallRulePriority, Mark: 2 << firewallMarkShift, Mask: firewallMarkMask}}, nil)
+	mockNetLink.EXPECT().RouteList(nil, unix.AF_INET).Return([]netlink.Route{
+		{Dst: &podIP, LinkIndex: 5}, {Dst: &otherIP, LinkIndex: 6}}, nil)
+
+	references, err := ln.GetENIReferences(2, []string{"10.10.10.5"})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(references))
+
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return([]netlink.Rule{{Table: 2}}, nil)
+	mockNetLink.EXPECT().RouteList(nil, unix.AF_INET).Return([]netlink.Route{{Dst: &otherIP, LinkIndex: 6}}, nil)
+	references, err = ln.GetENIReferences(3, []string{"10.10.10.5"})
+	assert.NoError(t, err)
+	assert.Empty(t, references)
 }
 
-func (f *mockFile) Close() error {
-	if f.closed {
-		panic("close call on closed file")
+func TestSnapshotAndRestoreHostNetwork(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{
+		mainENIMark: 0x80,
+
+		netLink: mockNetLink,
+		ns:      mockNS,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+	}
+
+	kubeRule := []string{"-m", "comment", "--comment", "kubernetes postrouting rules", "-j", "KUBE-POSTROUTING"}
+	mockIptables.Tables = map[string]map[string][][]string{
+		"nat": {"POSTROUTING": {kubeRule}},
+	}
+	_, unmanagedCIDR, _ := net.ParseCIDR("10.20.0.0/16")
+	savedRule := netlink.Rule{Dst: unmanagedCIDR, Table: mainRoutingTable, Priority: unmanagedCIDRRulePriority}
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return([]netlink.Rule{savedRule, {Table: 3, Priority: 1536}}, nil)
+	snapshot, err := ln.SnapshotHostNetwork()
+	assert.NoError(t, err)
+	assert.Equal(t, []netlink.Rule{savedRule}, snapshot.rules)
+
+	var hostRule netlink.Rule
+	mockNetLink.EXPECT().NewRule().Return(&hostRule)
+	mockNetLink.EXPECT().RuleDel(&hostRule)
+	var mainENIRule netlink.Rule
+	mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
+	mockNetLink.EXPECT().RuleDel(&mainENIRule)
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+	assert.NoError(t, ln.SetupHostNetwork(testENIPrefix, nil, "", testENIAddr))
+	assert.NoError(t, ln.VerifyHostNetwork())
+	assert.Contains(t, mockIptables.Tables["nat"]["POSTROUTING"], snatChainJumpRule)
+
+	// The rules added by the setup go and the saved ones come back, the rules of others are left alone
+	addedRule := netlink.Rule{Mark: 0x80, Mask: 0x80, Table: mainRoutingTable, Priority: hostRulePriority}
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return([]netlink.Rule{addedRule}, nil)
+	mockNetLink.EXPECT().RuleDel(&addedRule).Return(nil)
+	mockNetLink.EXPECT().RuleAdd(&savedRule).Return(nil)
+	assert.NoError(t, ln.RestoreHostNetwork(snapshot))
+	assert.Equal(t, [][]string{kubeRule}, mockIptables.Tables["nat"]["POSTROUTING"])
+	for chain := range mockIptables.Tables["nat"] {
+		assert.False(t, isAWSChain(chain), chain)
+	}
+	assert.Error(t, ln.VerifyHostNetwork())
+}
+
+func TestExportAndImportNetworkState(t *testing.T) {
+	ctrl, mockNetLink, _, _, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{
+		netLink:    mockNetLink,
+		vethPrefix: "eni",
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+	}
+	podIP := &net.IPNet{IP: net.ParseIP("10.10.10.5").To4(), Mask: net.CIDRMask(32, 32)}
+	fromPodRule := netlink.NewRule()
+	fromPodRule.Src = podIP
+	fromPodRule.Table = 2
+	fromPodRule.Priority = fromPodRulePriority
+	mainRule := netlink.NewRule()
+	mainRule.Table = mainRoutingTable
+	mainRule.Priority = 32766
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return([]netlink.Rule{*fromPodRule, *mainRule}, nil)
+	eth0 := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Index: 2}}
+	eth1 := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1", Index: 3}}
+	podVeth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eni123", Index: 5}}
+	mockNetLink.EXPECT().LinkList().Return([]netlink.Link{eth0, eth1, podVeth}, nil)
+	_, defaultDst, _ := net.ParseCIDR("0.0.0.0/0")
+	eniRoute := netlink.Route{Table: 2, LinkIndex: 3, Dst: defaultDst, Gw: net.ParseIP("10.10.10.1")}
+	podRoute := netlink.Route{Table: mainRoutingTable, LinkIndex: 5, Dst: podIP, Scope: netlink.SCOPE_LINK}
+	hostRoute := netlink.Route{Table: mainRoutingTable, LinkIndex: 2, Dst: defaultDst, Gw: net.ParseIP("10.10.0.1")}
+	mockNetLink.EXPECT().RouteListFiltered(unix.AF_INET, &netlink.Route{Table: unix.RT_TABLE_UNSPEC},
+		netlink.RT_FILTER_TABLE).Return([]netlink.Route{eniRoute, podRoute, hostRoute}, nil)
+	kubeRule := []string{"-m", "comment", "--comment", "kubernetes postrouting rules", "-j", "KUBE-POSTROUTING"}
+	snatRule := []string{"-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "SNAT", "--to-source", "10.10.0.5"}
+	mockIptables.Tables = map[string]map[string][][]string{
+		"nat": {"POSTROUTING": {kubeRule, snatChainJumpRule}, "AWS-SNAT-CHAIN-0": {snatRule}},
+	}
+
+	state, err := ln.ExportNetworkState()
+	assert.NoError(t, err)
+	assert.Equal(t, []StateRule{{Priority: fromPodRulePriority, Table: 2, Src: "10.10.10.5/32", Mark: -1, Mask: -1}},
+		state.Rules)
+	assert.Equal(t, []StateRoute{
+		{Table: 2, Dst: "0.0.0.0/0", Gw: "10.10.10.1", Link: "eth1"},
+		{Table: mainRoutingTable, Dst: "10.10.10.5/32", Link: "eni123", Scope: int(netlink.SCOPE_LINK)},
+	}, state.Routes)
+	assert.Equal(t, [][]string{snatChainJumpRule}, state.Iptables["nat"]["POSTROUTING"])
+
+	// Applied on a node without the pod, its route is skipped
+	data, err := json.Marshal(state)
+	assert.NoError(t, err)
+	var imported NetworkState
+	assert.NoError(t, json.Unmarshal(data, &imported))
+	mockIptables.Tables = map[string]map[string][][]string{"nat": {"POSTROUTING": {kubeRule}}}
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+	mockNetLink.EXPECT().NewRule().Return(netlink.NewRule())
+	mockNetLink.EXPECT().RuleAdd(fromPodRule).Return(nil)
+	mockNetLink.EXPECT().LinkByName("eth1").Return(eth1, nil)
+	mockNetLink.EXPECT().LinkByName("eni123").Return(nil, errors.New("Link not found"))
+	mockNetLink.EXPECT().RouteReplace(&netlink.Route{Table: 2, LinkIndex: 3, Dst: defaultDst,
+		Gw: net.ParseIP("10.10.10.1")}).Return(nil)
+
+	result, err := ln.ImportNetworkState(&imported)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Rules)
+	assert.Equal(t, 1, result.Routes)
+	assert.Equal(t, 1, len(result.Skipped))
+	// Only our rules of the built-in chains are exported, so they go first
+	assert.Equal(t, [][]string{snatChainJumpRule, kubeRule}, mockIptables.Tables["nat"]["POSTROUTING"])
+	assert.Equal(t, [][]string{snatRule}, mockIptables.Tables["nat"]["AWS-SNAT-CHAIN-0"])
+}
+
+func TestCheckSNATRules(t *testing.T) {
+	ctrl, _, _, _, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{
+		iptablesCheck: iptablesCheckWarn,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+	}
+
+	kubeRule := []string{"-m", "comment", "--comment", "kubernetes postrouting rules", "-j", "KUBE-POSTROUTING"}
+	dockerRule := []string{"-s", "172.17.0.0/16", "!", "-o", "docker0", "-j", "MASQUERADE"}
+	bypassRule := []string{"!", "-o", "lo", "-j", "MASQUERADE"}
+	mockIptables.Tables = map[string]map[string][][]string{
+		"nat": {
+			"POSTROUTING":      {kubeRule, dockerRule, snatChainJumpRule},
+			"KUBE-POSTROUTING": {},
+			"AWS-SNAT-CHAIN-0": {},
+		},
+	}
+	result, err := ln.CheckSNATRules()
+	assert.NoError(t, err)
+	assert.Equal(t, SNATRulesCheck{}, result)
+
+	// A third party inserts a rule masquerading everything
+	_ = mockIptables.Insert("nat", "POSTROUTING", 2, bypassRule...)
+	result, err = ln.CheckSNATRules()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`nat POSTROUTING rule 2 "! -o lo -j MASQUERADE" comes before the AWS SNAT chain`}, result.Problems)
+	assert.False(t, result.Repaired)
+	assert.Equal(t, [][]string{kubeRule, bypassRule, dockerRule, snatChainJumpRule}, mockIptables.Tables["nat"]["POSTROUTING"])
+
+	ln.iptablesCheck = iptablesCheckRepair
+	result, err = ln.CheckSNATRules()
+	assert.NoError(t, err)
+	assert.True(t, result.Repaired)
+	assert.Equal(t, [][]string{kubeRule, snatChainJumpRule, bypassRule, dockerRule}, mockIptables.Tables["nat"]["POSTROUTING"])
+
+	result, err = ln.CheckSNATRules()
+	assert.NoError(t, err)
+	assert.Equal(t, SNATRulesCheck{}, result)
+
+	// The jump is removed
+	_ = mockIptables.Delete("nat", "POSTROUTING", snatChainJumpRule...)
+	ln.iptablesCheck = iptablesCheckWarn
+	result, err = ln.CheckSNATRules()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(result.Problems))
+	assert.Equal(t, "the jump to the AWS SNAT chain is missing from nat POSTROUTING", result.Problems[1])
+
+	ln.iptablesCheck = iptablesCheckRepair
+	result, err = ln.CheckSNATRules()
+	assert.NoError(t, err)
+	assert.True(t, result.Repaired)
+	assert.Equal(t, [][]string{kubeRule, snatChainJumpRule, bypassRule, dockerRule}, mockIptables.Tables["nat"]["POSTROUTING"])
+
+	// The rules of others are meant to come first when appending, only the missing jump is repaired, after them
+	ln.iptablesRulePosition = iptablesRuleAppend
+	mockIptables.Tables["nat"]["POSTROUTING"] = [][]string{kubeRule, bypassRule, dockerRule, snatChainJumpRule}
+	result, err = ln.CheckSNATRules()
+	assert.NoError(t, err)
+	assert.Equal(t, SNATRulesCheck{}, result)
+	_ = mockIptables.Delete("nat", "POSTROUTING", snatChainJumpRule...)
+	result, err = ln.CheckSNATRules()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"the jump to the AWS SNAT chain is missing from nat POSTROUTING"}, result.Problems)
+	assert.True(t, result.Repaired)
+	assert.Equal(t, [][]string{kubeRule, bypassRule, dockerRule, snatChainJumpRule}, mockIptables.Tables["nat"]["POSTROUTING"])
+	ln.iptablesRulePosition = iptablesRuleAppendNew
+
+	// Nothing is checked when SNAT is done outside of the node
+	ln.useExternalSNAT = true
+	_ = mockIptables.Delete("nat", "POSTROUTING", snatChainJumpRule...)
+	result, err = ln.CheckSNATRules()
+	assert.NoError(t, err)
+	assert.Equal(t, SNATRulesCheck{}, result)
+}
+
+func TestSameRuleSpec(t *testing.T) {
+	ruleSpec := []string{"-d", "10.10.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "RETURN"}
+	assert.True(t, sameRuleSpec(ruleSpec, ruleSpec))
+	assert.True(t, sameRuleSpec(ruleSpec,
+		[]string{"-m", "comment", "--comment", "AWS SNAT CHAIN", "-d", "10.10.0.0/16", "-j", "RETURN"}))
+	assert.False(t, sameRuleSpec(ruleSpec,
+		[]string{"-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "RETURN", "-d", "10.10.0.0/16"}))
+	assert.False(t, sameRuleSpec(ruleSpec, []string{"-d", "10.10.0.0/16", "-j", "RETURN"}))
+	// The rule spec is left alone
+	assert.Equal(t, "-d", ruleSpec[0])
+}
+
+func TestGetIptablesRulePosition(t *testing.T) {
+	defer os.Unsetenv(envIptablesRulePosition)
+
+	assert.Equal(t, iptablesRuleAppendNew, getIptablesRulePosition())
+	_ = os.Setenv(envIptablesRulePosition, "insert")
+	assert.Equal(t, iptablesRuleInsert, getIptablesRulePosition())
+	_ = os.Setenv(envIptablesRulePosition, "first")
+	assert.Equal(t, iptablesRuleAppendNew, getIptablesRulePosition())
+}
+
+func TestGetSNATTarget(t *testing.T) {
+	defer os.Unsetenv(envSNATTarget)
+
+	assert.Equal(t, snatTargetSNAT, getSNATTarget())
+	_ = os.Setenv(envSNATTarget, "masquerade")
+	assert.Equal(t, snatTargetMasquerade, getSNATTarget())
+	_ = os.Setenv(envSNATTarget, "MASQUERADE")
+	assert.Equal(t, snatTargetSNAT, getSNATTarget())
+}
+
+func TestGetSNATStrategy(t *testing.T) {
+	defer os.Unsetenv(envRandomizeSNAT)
+
+	assert.Equal(t, randomHashSNAT{}, getSNATStrategy())
+	_ = os.Setenv(envRandomizeSNAT, "random-fully")
+	assert.Equal(t, randomPRNGSNAT{}, getSNATStrategy())
+	assert.Equal(t, []string{"--random"}, getSNATStrategy().TargetOptions(false))
+	_ = os.Setenv(envRandomizeSNAT, "none")
+	assert.Equal(t, sequentialSNAT{}, getSNATStrategy())
+	assert.Empty(t, getSNATStrategy().TargetOptions(true))
+	_ = os.Setenv(envRandomizeSNAT, "default")
+	assert.Equal(t, randomHashSNAT{}, getSNATStrategy())
+	_ = os.Setenv(envRandomizeSNAT, "sequential")
+	assert.Equal(t, randomHashSNAT{}, getSNATStrategy())
+}
+
+func TestGetIptablesCheckMode(t *testing.T) {
+	defer os.Unsetenv(envIptablesCheck)
+
+	assert.Equal(t, iptablesCheckOff, getIptablesCheckMode())
+	_ = os.Setenv(envIptablesCheck, "repair")
+	assert.Equal(t, iptablesCheckRepair, getIptablesCheckMode())
+	_ = os.Setenv(envIptablesCheck, "fix")
+	assert.Equal(t, iptablesCheckOff, getIptablesCheckMode())
+}
+
+func TestGetInterfaceEnvVar(t *testing.T) {
+	defer os.Unsetenv(envPodInterfacePattern)
+
+	_ = os.Setenv(envPodInterfacePattern, "veth+")
+	assert.Equal(t, "veth+", getInterfaceEnvVar(envPodInterfacePattern))
+	_ = os.Setenv(envPodInterfacePattern, "averyveryverylongname")
+	assert.Equal(t, "", getInterfaceEnvVar(envPodInterfacePattern))
+	_ = os.Setenv(envPodInterfacePattern, "eth0 eth1")
+	assert.Equal(t, "", getInterfaceEnvVar(envPodInterfacePattern))
+}
+
+func TestLoadMTUFromEnvTooLow(t *testing.T) {
+	_ = os.Setenv(envMTU, "1")
+	assert.Equal(t, GetEthernetMTU(), minimumMTU)
+}
+
+func TestLoadMTUFromEnv1500(t *testing.T) {
+	_ = os.Setenv(envMTU, "1500")
+	assert.Equal(t, GetEthernetMTU(), 1500)
+}
+
+func TestLoadMTUFromEnvTooHigh(t *testing.T) {
+	_ = os.Setenv(envMTU, "65536")
+	assert.Equal(t, GetEthernetMTU(), maximumMTU)
+}
+
+func TestLoadNetlinkOpsBurstFromEnv(t *testing.T) {
+	_ = os.Setenv(envNetlinkOpsBurst, "0")
+	assert.Equal(t, defaultNetlinkOpsBurst, getNetlinkOpsBurst())
+	_ = os.Setenv(envNetlinkOpsBurst, "50")
+	assert.Equal(t, 50, getNetlinkOpsBurst())
+	_ = os.Unsetenv(envNetlinkOpsBurst)
+}
+
+func TestLoadExcludeSNATCIDRsFromEnv(t *testing.T) {
+	_ = os.Setenv(envExternalSNAT, "false")
+	_ = os.Setenv(envExcludeSNATCIDRs, "10.12.0.0/16,10.13.0.0/16")
+
+	expected := testPrefixes("10.12.0.0/16", "10.13.0.0/16")
+	assert.Equal(t, getExcludeSNATCIDRs(), expected)
+}
+
+func TestLoadIPv6ExcludeSNATCIDRsFromEnv(t *testing.T) {
+	_ = os.Setenv(envIPv6ExcludeSNATCIDRs, "fd00::/8,10.12.0.0/16,2600:1f14:1::/48")
+	defer os.Unsetenv(envIPv6ExcludeSNATCIDRs)
+	assert.Empty(t, getIPv6ExcludeSNATCIDRs())
+
+	_ = os.Setenv(envIPv6SNAT, "true")
+	defer os.Unsetenv(envIPv6SNAT)
+	assert.Equal(t, testPrefixes("fd00::/8", "2600:1f14:1::/48"), getIPv6ExcludeSNATCIDRs())
+}
+
+func TestSetupHostNetworkWithExcludeSNATCIDRs(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	mockProcSys := mock_procsyswrapper.NewMockProcSys(ctrl)
+	ln := &linuxNetwork{
+		useExternalSNAT:        false,
+		excludeSNATCIDRs:       testPrefixes("10.12.0.0/16", "10.13.0.0/16"),
+		nodePortSupportEnabled: true,
+		mainENIMark:            defaultConnmark,
+
+		netLink: mockNetLink,
+		ns:      mockNS,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+		procSys: mockProcSys,
+	}
+
+	mockProcSys.EXPECT().Set("net/ipv4/conf/lo/rp_filter", "2")
+
+	mockNetLink.EXPECT().LinkByName(kubeIPVSInterface).Return(nil, errors.New("link not found"))
+	var hostRule netlink.Rule
+	mockNetLink.EXPECT().NewRule().Return(&hostRule)
+	mockNetLink.EXPECT().RuleDel(&hostRule)
+	var mainENIRule netlink.Rule
+	mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
+	mockNetLink.EXPECT().RuleDel(&mainENIRule)
+	mockNetLink.EXPECT().RuleAdd(&mainENIRule)
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+
+	var vpcCIDRs []netip.Prefix
+	vpcCIDRs = testPrefixes("10.10.0.0/16", "10.11.0.0/16")
+	err := ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Equal(t,
+		map[string]map[string][][]string{
+			"nat": {
+				"AWS-SNAT-CHAIN-0": [][]string{
+					{"-d", "10.10.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "RETURN"},
+					{"-d", "10.11.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "RETURN"},
+					{"-d", "10.12.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "RETURN"},
+					{"-d", "10.13.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "RETURN"},
+					{"-m", "comment", "--comment", "AWS, SNAT", "-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "SNAT", "--to-source", "10.10.10.20"},
+				},
+				"POSTROUTING": [][]string{{"-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-0"}}},
+			"mangle": {
+				"PREROUTING": [][]string{
+					{"-m", "comment", "--comment", "AWS, primary ENI", "-i", "lo", "-m", "addrtype", "--dst-type", "LOCAL", "--limit-iface-in", "-j", "CONNMARK", "--set-mark", "0x80/0x80"},
+					{"-m", "comment", "--comment", "AWS, primary ENI", "-i", "eni+", "-j", "CONNMARK", "--restore-mark", "--mask", "0x80"},
+				},
+			},
+		}, mockIptables.Tables)
+}
+
+func TestSetupHostNetworkOverlappingCIDRs(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	mockProcSys := mock_procsyswrapper.NewMockProcSys(ctrl)
+	ln := &linuxNetwork{
+		overlappingCIDRs: testPrefixes("10.10.128.0/17", "10.11.0.0/16"),
+		mainENIMark:      defaultConnmark,
+
+		netLink: mockNetLink,
+		ns:      mockNS,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+		procSys: mockProcSys,
+	}
+
+	var hostRule netlink.Rule
+	mockNetLink.EXPECT().NewRule().Return(&hostRule)
+	mockNetLink.EXPECT().RuleDel(&hostRule)
+	var mainENIRule netlink.Rule
+	mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
+	mockNetLink.EXPECT().RuleDel(&mainENIRule)
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+
+	// Only the part of the VPC that does not overlap is left out of SNAT
+	vpcCIDRs := testPrefixes("10.10.0.0/16", "10.11.0.0/16")
+	err := ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Equal(t,
+		map[string][][]string{
+			"AWS-SNAT-CHAIN-0": {
+				{"-d", "10.10.0.0/17", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "RETURN"},
+				{"-m", "comment", "--comment", "AWS, SNAT", "-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "SNAT", "--to-source", "10.10.10.20"},
+			},
+			"POSTROUTING": {{"-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-0"}}},
+		mockIptables.Tables["nat"])
+}
+
+func TestSetupHostNetworkWithUnmanagedInterfacesAndCIDRs(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{
+		useExternalSNAT:        false,
+		nodePortSupportEnabled: false,
+		mainENIMark:            defaultConnmark,
+		unmanagedInterfaces:    []string{"tun0"},
+		unmanagedCIDRs:         testPrefixes("172.16.0.0/12"),
+
+		netLink: mockNetLink,
+		ns:      mockNS,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+	}
+
+	var hostRule netlink.Rule
+	mockNetLink.EXPECT().NewRule().Return(&hostRule)
+	mockNetLink.EXPECT().RuleDel(&hostRule)
+	var mainENIRule netlink.Rule
+	mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
+	mockNetLink.EXPECT().RuleDel(&mainENIRule)
+
+	// The rule for a CIDR that is no longer unmanaged is removed, the one for the new CIDR is added
+	_, staleCIDR, _ := net.ParseCIDR("192.168.0.0/16")
+	staleRule := netlink.Rule{Priority: unmanagedCIDRRulePriority, Dst: staleCIDR, Table: mainRoutingTable}
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return([]netlink.Rule{staleRule}, nil)
+	mockNetLink.EXPECT().RuleDel(&staleRule)
+	var unmanagedRule netlink.Rule
+	mockNetLink.EXPECT().NewRule().Return(&unmanagedRule)
+	mockNetLink.EXPECT().RuleAdd(&unmanagedRule)
+
+	var vpcCIDRs []netip.Prefix
+	vpcCIDRs = testPrefixes("10.10.0.0/16")
+	err := ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, "172.16.0.0/12", unmanagedRule.Dst.String())
+	assert.Equal(t, unmanagedCIDRRulePriority, unmanagedRule.Priority)
+	assert.Equal(t,
+		map[string][][]string{
+			"AWS-SNAT-CHAIN-0": {
+				{"-d", "10.10.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "RETURN"},
+				{"-d", "172.16.0.0/12", "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "RETURN"},
+				{"-o", "tun0", "-m", "comment", "--comment", "AWS SNAT CHAIN UNMANAGED", "-j", "RETURN"},
+				{"-m", "comment", "--comment", "AWS, SNAT", "-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "SNAT", "--to-source", "10.10.10.20"},
+			},
+			"POSTROUTING": {{"-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-0"}},
+		}, mockIptables.Tables["nat"])
+}
+
+func TestSetupHostNetworkTenantSNAT(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{
+		useExternalSNAT:        false,
+		nodePortSupportEnabled: false,
+		mainENIMark:            defaultConnmark,
+		tenantLabel:            "tenant",
+
+		netLink: mockNetLink,
+		ns:      mockNS,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+	}
+
+	var hostRule netlink.Rule
+	mockNetLink.EXPECT().NewRule().Return(&hostRule)
+	mockNetLink.EXPECT().RuleDel(&hostRule)
+	var mainENIRule netlink.Rule
+	mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
+	mockNetLink.EXPECT().RuleDel(&mainENIRule)
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+
+	vpcCIDRs := testPrefixes("10.10.0.0/16")
+	err := ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Equal(t,
+		map[string][][]string{
+			"AWS-SNAT-CHAIN-0": {
+				{"-d", "10.10.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "RETURN"},
+				{"-m", "comment", "--comment", "AWS, SNAT", "-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "SNAT", "--to-source", "10.10.10.20"},
+			},
+			"AWS-TENANT-SNAT": {{"-d", "10.10.0.0/16", "-j", "RETURN"}},
+			"POSTROUTING": {
+				{"-m", "comment", "--comment", "AWS TENANT SNAT", "-j", "AWS-TENANT-SNAT"},
+				{"-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-0"},
+			},
+		}, mockIptables.Tables["nat"])
+
+	// The interface is now used by another ENI
+	tenantRule := func(ip string) []string {
+		return []string{"-o", "eth1", "-m", "comment", "--comment", "AWS, TENANT SNAT",
+			"-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "SNAT", "--to-source", ip}
+	}
+	err = ln.updateTenantSNATRule("eth1", netip.MustParseAddr("10.10.10.30"))
+	assert.NoError(t, err)
+	err = ln.updateTenantSNATRule("eth1", testENIAddr)
+	assert.NoError(t, err)
+	err = ln.updateTenantSNATRule("eth1", testENIAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"-d", "10.10.0.0/16", "-j", "RETURN"}, tenantRule(testeniIP)},
+		mockIptables.Tables["nat"]["AWS-TENANT-SNAT"])
+
+	// Disabling multi-tenant mode removes the jump to the tenant chain
+	ln.tenantLabel = ""
+	mockNetLink.EXPECT().NewRule().Return(&hostRule)
+	mockNetLink.EXPECT().RuleDel(&hostRule)
+	mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
+	mockNetLink.EXPECT().RuleDel(&mainENIRule)
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+	err = ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-0"}},
+		mockIptables.Tables["nat"]["POSTROUTING"])
+}
+
+func TestSetupHostNetworkEgressGateway(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{
+		useExternalSNAT:        false,
+		nodePortSupportEnabled: false,
+		mainENIMark:            defaultConnmark,
+		egressGateway:          true,
+
+		netLink: mockNetLink,
+		ns:      mockNS,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+	}
+
+	var hostRule netlink.Rule
+	var mainENIRule netlink.Rule
+	expectRules := func() {
+		mockNetLink.EXPECT().NewRule().Return(&hostRule)
+		mockNetLink.EXPECT().RuleDel(&hostRule)
+		mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
+		mockNetLink.EXPECT().RuleDel(&mainENIRule)
+		mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+	}
+	gatewayJumpRule := []string{"-m", "comment", "--comment", "AWS EGRESS GATEWAY", "-j", "AWS-EGRESS-GATEWAY"}
+	vpcRule := []string{"-d", "10.10.0.0/16", "-m", "comment", "--comment", "AWS, EGRESS GATEWAY VPC", "-j", "RETURN"}
+	podRule := []string{"-s", "10.10.10.21/32", "-m", "comment", "--comment", "AWS, EGRESS GATEWAY", "-j", "ACCEPT"}
+
+	vpcCIDRs := testPrefixes("10.10.0.0/16")
+	expectRules()
+	err := ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{vpcRule}, mockIptables.Tables["nat"]["AWS-EGRESS-GATEWAY"])
+	assert.Equal(t, gatewayJumpRule, mockIptables.Tables["nat"]["POSTROUTING"][0])
+
+	// The pod is exempted from SNAT once
+	err = ln.AddEgressGatewayExemption("10.10.10.21")
+	assert.NoError(t, err)
+	err = ln.AddEgressGatewayExemption("10.10.10.21")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{vpcRule, podRule}, mockIptables.Tables["nat"]["AWS-EGRESS-GATEWAY"])
+
+	// The rules of the pods survive a restart of ipamd
+	expectRules()
+	err = ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{vpcRule, podRule}, mockIptables.Tables["nat"]["AWS-EGRESS-GATEWAY"])
+	assert.Len(t, mockIptables.Tables["nat"]["POSTROUTING"], 2)
+
+	hadGateway, err := ln.DelEgressGatewayExemption("10.10.10.21")
+	assert.NoError(t, err)
+	assert.True(t, hadGateway)
+	hadGateway, err = ln.DelEgressGatewayExemption("10.10.10.21")
+	assert.NoError(t, err)
+	assert.False(t, hadGateway)
+	assert.Equal(t, [][]string{vpcRule}, mockIptables.Tables["nat"]["AWS-EGRESS-GATEWAY"])
+
+	// Disabling the egress gateways removes the jump to the chain
+	ln.egressGateway = false
+	expectRules()
+	err = ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-0"}},
+		mockIptables.Tables["nat"]["POSTROUTING"])
+}
+
+func TestSetupHostNetworkPodFlags(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{
+		useExternalSNAT:        false,
+		nodePortSupportEnabled: false,
+		mainENIMark:            defaultConnmark,
+		podFlags:               []string{PodFlagNoSNAT, PodFlagMetadataBlock},
+
+		netLink: mockNetLink,
+		ns:      mockNS,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+	}
+
+	var hostRule netlink.Rule
+	var mainENIRule netlink.Rule
+	expectRules := func() {
+		mockNetLink.EXPECT().NewRule().Return(&hostRule)
+		mockNetLink.EXPECT().RuleDel(&hostRule)
+		mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
+		mockNetLink.EXPECT().RuleDel(&mainENIRule)
+		mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+	}
+	jumpRule := []string{"-m", "comment", "--comment", "AWS POD FLAGS", "-j", "AWS-POD-FLAGS"}
+	vpcRule := []string{"-d", "10.10.0.0/16", "-m", "comment", "--comment", "AWS, POD NO SNAT VPC", "-j", "RETURN"}
+	noSNATRule := []string{"-s", "10.10.10.21/32", "-m", "comment", "--comment", "AWS, POD NO SNAT", "-j", "ACCEPT"}
+	metadataRule := []string{"-s", "10.10.10.21/32", "-d", "169.254.169.254/32", "-m", "comment", "--comment",
+		"AWS, POD METADATA BLOCK", "-j", "DROP"}
+
+	vpcCIDRs := testPrefixes("10.10.0.0/16")
+	expectRules()
+	err := ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{vpcRule}, mockIptables.Tables["nat"]["AWS-POD-FLAGS"])
+	assert.Equal(t, jumpRule, mockIptables.Tables["nat"]["POSTROUTING"][0])
+	assert.Empty(t, mockIptables.Tables["filter"]["AWS-POD-FLAGS"])
+	assert.Equal(t, [][]string{jumpRule}, mockIptables.Tables["filter"]["FORWARD"])
+
+	err = ln.AddPodFlagRules("10.10.10.21", true, true)
+	assert.NoError(t, err)
+	err = ln.AddPodFlagRules("10.10.10.21", true, true)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{vpcRule, noSNATRule}, mockIptables.Tables["nat"]["AWS-POD-FLAGS"])
+	assert.Equal(t, [][]string{metadataRule}, mockIptables.Tables["filter"]["AWS-POD-FLAGS"])
+
+	// The rules of the pods survive a restart of ipamd
+	expectRules()
+	err = ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{vpcRule, noSNATRule}, mockIptables.Tables["nat"]["AWS-POD-FLAGS"])
+	assert.Equal(t, [][]string{metadataRule}, mockIptables.Tables["filter"]["AWS-POD-FLAGS"])
+	assert.Len(t, mockIptables.Tables["filter"]["FORWARD"], 1)
+
+	err = ln.DelPodFlagRules("10.10.10.21")
+	assert.NoError(t, err)
+	err = ln.DelPodFlagRules("10.10.10.21")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{vpcRule}, mockIptables.Tables["nat"]["AWS-POD-FLAGS"])
+	assert.Empty(t, mockIptables.Tables["filter"]["AWS-POD-FLAGS"])
+
+	// The SNAT exclusions keep the nat chain without the flags
+	ln.podFlags = nil
+	ln.podSNATExclusions = true
+	expectRules()
+	err = ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, jumpRule, mockIptables.Tables["nat"]["POSTROUTING"][0])
+	assert.Empty(t, mockIptables.Tables["filter"]["FORWARD"])
+	err = ln.AddPodFlagRules("10.10.10.21", true, false)
+	assert.NoError(t, err)
+	err = ln.DelPodFlagRules("10.10.10.21")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{vpcRule}, mockIptables.Tables["nat"]["AWS-POD-FLAGS"])
+
+	// Taking the flags and the exclusions off the node removes the jumps to the chains
+	ln.podSNATExclusions = false
+	expectRules()
+	err = ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Empty(t, mockIptables.Tables["filter"]["FORWARD"])
+	assert.Equal(t, [][]string{{"-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-0"}},
+		mockIptables.Tables["nat"]["POSTROUTING"])
+}
+
+func TestAllowedPodFlags(t *testing.T) {
+	_ = os.Setenv(envPodFlags, " metadata-block,NO-SNAT,,bogus")
+	defer os.Unsetenv(envPodFlags)
+	assert.Equal(t, []string{PodFlagNoSNAT, PodFlagMetadataBlock}, AllowedPodFlags())
+}
+
+func TestSetupHostNetworkFirewallSymmetry(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{
+		useExternalSNAT:        false,
+		nodePortSupportEnabled: false,
+		mainENIMark:            defaultConnmark,
+		primaryInterface:       "eth0",
+		firewallSubnetCIDRs:    testPrefixes("10.10.255.0/24"),
+
+		netLink: mockNetLink,
+		ns:      mockNS,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+	}
+
+	var hostRule netlink.Rule
+	var mainENIRule netlink.Rule
+	expectRules := func() {
+		mockNetLink.EXPECT().NewRule().Return(&hostRule)
+		mockNetLink.EXPECT().RuleDel(&hostRule)
+		mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
+		mockNetLink.EXPECT().RuleDel(&mainENIRule)
+		mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+	}
+	// The replies to the connections of an ENI are routed with its route table
+	expectFirewallRule := func(mark int, table int) {
+		firewallRule := netlink.NewRule()
+		mockNetLink.EXPECT().NewRule().Return(firewallRule)
+		mockNetLink.EXPECT().RuleDel(firewallRule).Return(unix.ENOENT)
+		mockNetLink.EXPECT().RuleAdd(firewallRule).Do(func(rule *netlink.Rule) {
+			assert.Equal(t, mark, rule.Mark)
+			assert.Equal(t, firewallMarkMask, rule.Mask)
+			assert.Equal(t, table, rule.Table)
+			assert.Equal(t, firewallRulePriority, rule.Priority)
+		}).Return(nil)
+	}
+	jumpRule := []string{"-m", "conntrack", "--ctstate", "NEW",
+		"-m", "comment", "--comment", "AWS FIREWALL SYMMETRY", "-j", "AWS-FIREWALL-SYMMETRY"}
+	markRule := func(ifName string, mark string) []string {
+		return []string{"-i", ifName, "-m", "comment", "--comment", "AWS, FIREWALL SYMMETRY",
+			"-j", "CONNMARK", "--set-mark", mark + "/0x3f000000"}
+	}
+
+	vpcCIDRs := testPrefixes("10.10.0.0/16")
+	expectRules()
+	expectFirewallRule(0x3f000000, unix.RT_TABLE_MAIN)
+	err := ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{markRule("eth0", "0x3f000000")}, mockIptables.Tables["mangle"]["AWS-FIREWALL-SYMMETRY"])
+	assert.Equal(t, jumpRule, mockIptables.Tables["mangle"]["PREROUTING"][0])
+	assert.Contains(t, mockIptables.Tables["mangle"]["PREROUTING"], []string{
+		"-m", "comment", "--comment", "AWS, FIREWALL SYMMETRY",
+		"-i", "eni+", "-j", "CONNMARK", "--restore-mark", "--mask", "0x3f000000"})
+
+	// The interface now belongs to another ENI
+	expectFirewallRule(0x2000000, 2)
+	err = ln.updateFirewallSymmetry("eth1", 2)
+	assert.NoError(t, err)
+	expectFirewallRule(0x3000000, 3)
+	err = ln.updateFirewallSymmetry("eth1", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{markRule("eth0", "0x3f000000"), markRule("eth1", "0x3000000")},
+		mockIptables.Tables["mangle"]["AWS-FIREWALL-SYMMETRY"])
+
+	// A route table that does not fit in the mark is left alone
+	err = ln.updateFirewallSymmetry("eth2", maxFirewallTable+1)
+	assert.NoError(t, err)
+	assert.Len(t, mockIptables.Tables["mangle"]["AWS-FIREWALL-SYMMETRY"], 2)
+
+	// Turning it off removes the jump to the chain and the rules of all ENIs
+	ln.firewallSubnetCIDRs = nil
+	firewallRule := netlink.Rule{Table: 3, Priority: firewallRulePriority, Mark: 0x3000000, Mask: firewallMarkMask}
+	mockNetLink.EXPECT().NewRule().Return(&hostRule)
+	mockNetLink.EXPECT().RuleDel(&hostRule)
+	mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
+	mockNetLink.EXPECT().RuleDel(&mainENIRule)
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return([]netlink.Rule{{Table: 3, Priority: fromPodRulePriority}, firewallRule}, nil)
+	mockNetLink.EXPECT().RuleDel(&firewallRule).Return(nil)
+	err = ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.NotContains(t, mockIptables.Tables["mangle"]["PREROUTING"], jumpRule)
+}
+
+func TestSetupHostNetworkDropTracing(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{
+		useExternalSNAT:        false,
+		nodePortSupportEnabled: false,
+		mainENIMark:            defaultConnmark,
+		primaryInterface:       "eth0",
+		dropTracing:            true,
+		dropLogRate:            "5/minute",
+
+		netLink: mockNetLink,
+		ns:      mockNS,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+	}
+	var hostRule netlink.Rule
+	var mainENIRule netlink.Rule
+	expectRules := func() {
+		mockNetLink.EXPECT().NewRule().Return(&hostRule)
+		mockNetLink.EXPECT().RuleDel(&hostRule)
+		mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
+		mockNetLink.EXPECT().RuleDel(&mainENIRule)
+		mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+	}
+	jumpRule := []string{"-m", "comment", "--comment", "AWS, DROP TRACING", "-j", "AWS-CNI-DROPS"}
+
+	vpcCIDRs := testPrefixes("10.10.0.0/16")
+	expectRules()
+	err := ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, jumpRule, mockIptables.Tables["mangle"]["PREROUTING"][0])
+	chain := mockIptables.Tables["mangle"]["AWS-CNI-DROPS"]
+	assert.Len(t, chain, 6)
+	assert.Equal(t, []string{"-i", "eni+", "-m", "rpfilter", "--invert",
+		"-m", "comment", "--comment", "AWS, DROP rp-filter"}, chain[0])
+	assert.Equal(t, []string{"-i", "eni+", "-m", "rpfilter", "--invert",
+		"-m", "limit", "--limit", "5/minute", "-j", "LOG", "--log-prefix", "AWS-CNI DROP rp-filter: "}, chain[1])
+
+	counts, err := ln.GetDropCounts()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint64{DropReasonRPFilter: 0, DropReasonInvalidState: 0}, counts)
+
+	// Setting up the host network again does not add the rules twice
+	expectRules()
+	err = ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Len(t, mockIptables.Tables["mangle"]["AWS-CNI-DROPS"], 6)
+	assert.Equal(t, [][]string{jumpRule}, mockIptables.Tables["mangle"]["PREROUTING"])
+
+	// Turning it off removes the jump to the chain and its rules
+	ln.dropTracing = false
+	expectRules()
+	err = ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.NotContains(t, mockIptables.Tables["mangle"]["PREROUTING"], jumpRule)
+	assert.Empty(t, mockIptables.Tables["mangle"]["AWS-CNI-DROPS"])
+	counts, err = ln.GetDropCounts()
+	assert.NoError(t, err)
+	assert.Nil(t, counts)
+}
+
+func TestParseDropCounts(t *testing.T) {
+	counts, err := parseDropCounts([]string{
+		"-N AWS-CNI-DROPS",
+		`-A AWS-CNI-DROPS -i eni+ -m rpfilter --invert -m comment --comment "AWS, DROP rp-filter" -c 3 180`,
+		`-A AWS-CNI-DROPS -i eni+ -m rpfilter --invert -m limit --limit 10/min -j LOG --log-prefix "AWS-CNI DROP rp-filter: " -c 3 180`,
+		`-A AWS-CNI-DROPS -i eni+ -m conntrack --ctstate INVALID -m comment --comment "AWS, DROP invalid-state" -c 7 420`,
+		`-A AWS-CNI-DROPS ! -i eni+ -m addrtype ! --dst-type LOCAL -m conntrack --ctstate INVALID -m comment --comment "AWS, DROP invalid-state" -c 5 300`,
+		`-A AWS-CNI-DROPS -m comment --comment "AWS, DROP unknown" -c 9 540`,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint64{DropReasonRPFilter: 3, DropReasonInvalidState: 12}, counts)
+
+	_, err = parseDropCounts([]string{`-A AWS-CNI-DROPS -m comment --comment "AWS, DROP rp-filter" -c x 0`})
+	assert.Error(t, err)
+}
+
+func TestCheckKubeProxy(t *testing.T) {
+	ctrl, mockNetLink, _, _, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	mockProcSys := mock_procsyswrapper.NewMockProcSys(ctrl)
+	reported := ""
+	ln := &linuxNetwork{
+		nodePortSupportEnabled: true,
+		mainENIMark:            defaultConnmark,
+
+		netLink: mockNetLink,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+		procSys: mockProcSys,
+		kubeProxyMode: func() (string, error) {
+			if reported == "" {
+				return "", errors.New("connection refused")
+			}
+			return reported, nil
+		},
+	}
+	ipvsLink := mock_netlink.NewMockLink(ctrl)
+
+	// Without kube-proxy nor its rules, services are implemented by something else
+	mockNetLink.EXPECT().LinkByName("kube-ipvs0").Return(nil, errors.New("not found"))
+	result, err := ln.CheckKubeProxy()
+	assert.NoError(t, err)
+	assert.Equal(t, KubeProxyCheck{Mode: KubeProxyModeNone}, result)
+
+	// The mode is guessed from the rules of kube-proxy until it answers
+	mockIptables.Tables = map[string]map[string][][]string{
+		"nat": {"KUBE-SERVICES": nil, "KUBE-SVC-ABCDEF": nil},
+	}
+	mockNetLink.EXPECT().LinkByName("kube-ipvs0").Return(nil, errors.New("not found"))
+	result, err = ln.CheckKubeProxy()
+	assert.NoError(t, err)
+	assert.Equal(t, KubeProxyCheck{Mode: KubeProxyModeIptables}, result)
+
+	// IPVS keeps the conntrack entries the NodePort connmark needs, and the chains of the iptables mode are leftovers
+	reported = "ipvs"
+	mockNetLink.EXPECT().LinkByName("kube-ipvs0").Return(ipvsLink, nil)
+	mockProcSys.EXPECT().Get("net/ipv4/vs/conntrack").Return("0", nil)
+	mockProcSys.EXPECT().Set("net/ipv4/vs/conntrack", "1").Return(nil)
+	result, err = ln.CheckKubeProxy()
+	assert.NoError(t, err)
+	assert.Equal(t, KubeProxyModeIPVS, result.Mode)
+	assert.True(t, result.Reported)
+	assert.Len(t, result.Problems, 1)
+	assert.Contains(t, result.Problems[0], "KUBE-SVC-")
+	assert.Len(t, result.Adjustments, 1)
+
+	// kube-ipvs0 is a leftover in iptables mode, and the connmark must stay clear of the marks of kube-proxy
+	reported = "iptables"
+	ln.mainENIMark = 0x4000
+	mockNetLink.EXPECT().LinkByName("kube-ipvs0").Return(ipvsLink, nil)
+	result, err = ln.CheckKubeProxy()
+	assert.NoError(t, err)
+	assert.Equal(t, KubeProxyModeIptables, result.Mode)
+	assert.Len(t, result.Problems, 2)
+	assert.Empty(t, result.Adjustments)
+}
+
+func TestSetupHostNetworkIPVS(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	mockProcSys := mock_procsyswrapper.NewMockProcSys(ctrl)
+	reported := ""
+	ln := &linuxNetwork{
+		useExternalSNAT:        true,
+		nodePortSupportEnabled: true,
+		mainENIMark:            defaultConnmark,
+
+		netLink: mockNetLink,
+		ns:      mockNS,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+		procSys: mockProcSys,
+		kubeProxyMode: func() (string, error) {
+			return reported, nil
+		},
+	}
+	ipvsRule := []string{
+		"-m", "comment", "--comment", "AWS, primary ENI IPVS",
+		"-i", "lo",
+		"-m", "addrtype", "--dst-type", "LOCAL",
+		"-j", "CONNMARK", "--set-mark", "0x80/0x80",
+	}
+	expectSetup := func() {
+		mockProcSys.EXPECT().Set("net/ipv4/conf/lo/rp_filter", "2")
+		var hostRule netlink.Rule
+		mockNetLink.EXPECT().NewRule().Return(&hostRule)
+		mockNetLink.EXPECT().RuleDel(&hostRule)
+		var mainENIRule netlink.Rule
+		mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
+		mockNetLink.EXPECT().RuleDel(&mainENIRule)
+		mockNetLink.EXPECT().RuleAdd(&mainENIRule)
+		mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+	}
+
+	// kube-ipvs0 does not exist until kube-proxy starts, so the rule is added once kube-proxy reports IPVS
+	mockNetLink.EXPECT().LinkByName(kubeIPVSInterface).Return(nil, errors.New("link not found"))
+	expectSetup()
+	err := ln.SetupHostNetwork(testENIPrefix, nil, "", testENIAddr)
+	assert.NoError(t, err)
+	exists, _ := mockIptables.Exists("mangle", "PREROUTING", ipvsRule...)
+	assert.False(t, exists)
+
+	reported = "ipvs"
+	mockNetLink.EXPECT().LinkByName(kubeIPVSInterface).Return(mock_netlink.NewMockLink(ctrl), nil)
+	mockProcSys.EXPECT().Get("net/ipv4/vs/conntrack").Return("1", nil)
+	result, err := ln.CheckKubeProxy()
+	assert.NoError(t, err)
+	assert.Empty(t, result.Problems)
+	assert.Len(t, result.Adjustments, 1)
+	exists, _ = mockIptables.Exists("mangle", "PREROUTING", ipvsRule...)
+	assert.True(t, exists)
+
+	// The configured mode skips the detection, and the ip_vs module may not be loaded yet
+	ln.kubeProxyModeSetting = KubeProxyModeIPVS
+	mockProcSys.EXPECT().Set("net/ipv4/vs/conntrack", "1").Return(errors.New("no such file or directory"))
+	expectSetup()
+	err = ln.SetupHostNetwork(testENIPrefix, nil, "", testENIAddr)
+	assert.NoError(t, err)
+	exists, _ = mockIptables.Exists("mangle", "PREROUTING", ipvsRule...)
+	assert.True(t, exists)
+
+	// A configured mode that kube-proxy does not run in is reported
+	ln.kubeProxyModeSetting = KubeProxyModeIptables
+	reported = "ipvs"
+	mockNetLink.EXPECT().LinkByName(kubeIPVSInterface).Return(mock_netlink.NewMockLink(ctrl), nil)
+	mockProcSys.EXPECT().Get("net/ipv4/vs/conntrack").Return("1", nil)
+	result, err = ln.CheckKubeProxy()
+	assert.NoError(t, err)
+	assert.Len(t, result.Problems, 1)
+	assert.Contains(t, result.Problems[0], envKubeProxyMode)
+}
+
+func TestGetKubeProxyModeSetting(t *testing.T) {
+	defer os.Unsetenv(envKubeProxyMode)
+
+	_ = os.Setenv(envKubeProxyMode, "ipvs")
+	assert.Equal(t, KubeProxyModeIPVS, getKubeProxyModeSetting())
+
+	_ = os.Setenv(envKubeProxyMode, "userspace")
+	assert.Equal(t, KubeProxyMode(""), getKubeProxyModeSetting())
+}
+
+func TestRuleMarkBits(t *testing.T) {
+	testCases := []struct {
+		ruleSpec string
+		bits     uint32
+	}{
+		{"-p tcp -j TPROXY --on-port 15006 --tproxy-mark 0x539/0xffffffff", 0xffffffff},
+		{"-m mark --mark 0x100/0xfff -j RETURN", 0xfff},
+		{"-m mark --mark 0x539 -j ACCEPT", 0xffffffff},
+		{"-j CONNMARK --restore-mark --nfmask 0xffffffff --ctmask 0xffffffff", 0xffffffff},
+		{"-j CONNMARK --restore-mark --mask 0x80", 0x80},
+		{"-j MARK --set-xmark 0x200/0x200", 0x200},
+		{"-j MARK --and-mark 0xffffff00", 0xff},
+		{"-p tcp -j REDIRECT --to-ports 15001", 0},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.bits, ruleMarkBits(strings.Fields(tc.ruleSpec)), tc.ruleSpec)
+	}
+}
+
+func TestCheckMarks(t *testing.T) {
+	ctrl, _, _, _, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{
+		nodePortSupportEnabled: true,
+		mainENIMark:            defaultConnmark,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+	}
+	mockIptables.Tables = map[string]map[string][][]string{
+		"mangle": {
+			"ztunnel-PREROUTING": {
+				{"-m", "mark", "--mark", "0x200/0x200", "-j", "RETURN"},
+				{"-j", "CONNMARK", "--restore-mark", "--nfmask", "0xffffffff", "--ctmask", "0xffffffff"},
+			},
+			"KUBE-KUBELET-CANARY": {
+				{"-j", "MARK", "--set-xmark", "0x80/0x80"},
+			},
+		},
+	}
+
+	// Only the rules of Istio that use the connmark of the primary ENI are reported
+	problems, err := ln.CheckMarks()
+	assert.NoError(t, err)
+	assert.Len(t, problems, 1)
+	assert.Contains(t, problems[0], "--restore-mark")
+
+	// Restoring the whole mark overwrites any connmark
+	ln.mainENIMark = istioConnmark
+	problems, err = ln.CheckMarks()
+	assert.NoError(t, err)
+	assert.Len(t, problems, 1)
+
+	// Without the marks of NodePort support, nothing can conflict
+	ln.nodePortSupportEnabled = false
+	problems, err = ln.CheckMarks()
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+}
+
+func TestGetConnmarkMarkPreset(t *testing.T) {
+	defer os.Unsetenv(envMarkPreset)
+	defer os.Unsetenv(envConnmark)
+
+	_ = os.Setenv(envMarkPreset, "istio")
+	assert.Equal(t, uint32(istioConnmark), getConnmark())
+
+	// An explicit connmark wins over the preset
+	_ = os.Setenv(envConnmark, "0x4000000")
+	assert.Equal(t, uint32(0x4000000), getConnmark())
+
+	_ = os.Setenv(envMarkPreset, "linkerd")
+	_ = os.Unsetenv(envConnmark)
+	assert.Equal(t, uint32(defaultConnmark), getConnmark())
+}
+
+func TestMirror(t *testing.T) {
+	ctrl, mockNetLink, _, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	ln := &linuxNetwork{netLink: mockNetLink}
+	source := mock_netlink.NewMockLink(ctrl)
+	source.EXPECT().Attrs().Return(&netlink.LinkAttrs{Name: "eni1", Index: 5}).AnyTimes()
+	target := mock_netlink.NewMockLink(ctrl)
+	target.EXPECT().Attrs().Return(&netlink.LinkAttrs{Name: "awscapture0", Index: 9}).AnyTimes()
+
+	// The capture interface is created, and the clsact qdisc of the veth may exist already
+	mockNetLink.EXPECT().LinkByName("eni1").Return(source, nil)
+	mockNetLink.EXPECT().LinkByName("awscapture0").Return(nil, errors.New("link not found"))
+	mockNetLink.EXPECT().LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "awscapture0"}}).Return(nil)
+	mockNetLink.EXPECT().LinkByName("awscapture0").Return(target, nil)
+	mockNetLink.EXPECT().LinkSetUp(target).Return(nil)
+	mockNetLink.EXPECT().QdiscAdd(gomock.Any()).Return(unix.EEXIST)
+	for _, filter := range mirrorFilters(5, 9) {
+		mockNetLink.EXPECT().FilterAdd(filter).Return(nil)
+	}
+	created, err := ln.AddMirror("eni1", "awscapture0")
+	assert.NoError(t, err)
+	assert.True(t, created)
+
+	mockNetLink.EXPECT().LinkByName("eni1").Return(source, nil)
+	mockNetLink.EXPECT().FilterDel(gomock.Any()).Return(nil)
+	mockNetLink.EXPECT().FilterDel(gomock.Any()).Return(unix.ENOENT)
+	mockNetLink.EXPECT().LinkByName("awscapture0").Return(target, nil)
+	mockNetLink.EXPECT().LinkDel(target).Return(nil)
+	assert.NoError(t, ln.DelMirror("eni1", "awscapture0", true))
+
+	// The veth is gone with its pod
+	mockNetLink.EXPECT().LinkByName("eni1").Return(nil, errors.New("link not found"))
+	assert.NoError(t, ln.DelMirror("eni1", "awscapture0", false))
+}
+
+func TestGetKubeProxyMode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/proxyMode" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "ipvs")
+	}))
+	defer server.Close()
+
+	mode, err := getKubeProxyMode(strings.TrimPrefix(server.URL, "http://"))
+	assert.NoError(t, err)
+	assert.Equal(t, "ipvs", mode)
+
+	server.Close()
+	_, err = getKubeProxyMode(strings.TrimPrefix(server.URL, "http://"))
+	assert.Error(t, err)
+}
+
+func TestGetSNATExclusions(t *testing.T) {
+	_ = os.Setenv(envExcludeSNATCIDRs, "10.12.0.0/16")
+	_ = os.Setenv(envFirewallSubnetCIDRs, "10.10.255.0/24, bad,2600:1f14::/64")
+	defer os.Unsetenv(envExcludeSNATCIDRs)
+	defer os.Unsetenv(envFirewallSubnetCIDRs)
+
+	assert.Equal(t, testPrefixes("10.10.255.0/24"), getFirewallSubnetCIDRs())
+	assert.Equal(t, testPrefixes("10.12.0.0/16", "10.10.255.0/24"), getSNATExclusions())
+
+	_ = os.Setenv(envExternalSNAT, "true")
+	defer os.Unsetenv(envExternalSNAT)
+	assert.Empty(t, getSNATExclusions())
+}
+
+func TestSetupENINetworkUnmanagedInterface(t *testing.T) {
+	ctrl, mockNetLink, _, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	hwAddr, err := net.ParseMAC(testMAC2)
+	assert.NoError(t, err)
+	eth1 := mock_netlink.NewMockLink(ctrl)
+	eth1.EXPECT().Attrs().Return(&netlink.LinkAttrs{Name: "eth1", HardwareAddr: hwAddr}).AnyTimes()
+	mockNetLink.EXPECT().LinkList().Return([]netlink.Link{eth1}, nil)
+
+	// Nothing is changed on the interface
+	err = setupENINetwork(testENIAddr, testMAC2, testTable, testENIPrefix, mockNetLink, testRetryPolicy, testRetryPolicy, testMTU, []string{"eth+"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), ErrUnmanagedInterface)
+}
+
+func TestIsUnmanagedInterface(t *testing.T) {
+	unmanaged := []string{"tun0", "dpdk+"}
+	assert.True(t, isUnmanagedInterface("tun0", unmanaged))
+	assert.False(t, isUnmanagedInterface("tun1", unmanaged))
+	assert.True(t, isUnmanagedInterface("dpdk3", unmanaged))
+	assert.False(t, isUnmanagedInterface("eth0", unmanaged))
+	assert.False(t, isUnmanagedInterface("eth0", nil))
+}
+
+func TestSetupHostNetworkCleansUpStaleSNATRules(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	mockProcSys := mock_procsyswrapper.NewMockProcSys(ctrl)
+	ln := &linuxNetwork{
+		useExternalSNAT:        false,
+		excludeSNATCIDRs:       nil,
+		nodePortSupportEnabled: true,
+		mainENIMark:            defaultConnmark,
+
+		netLink: mockNetLink,
+		ns:      mockNS,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+		procSys: mockProcSys,
+	}
+
+	mockProcSys.EXPECT().Set("net/ipv4/conf/lo/rp_filter", "2")
+
+	mockNetLink.EXPECT().LinkByName(kubeIPVSInterface).Return(nil, errors.New("link not found"))
+	var hostRule netlink.Rule
+	mockNetLink.EXPECT().NewRule().Return(&hostRule)
+	mockNetLink.EXPECT().RuleDel(&hostRule)
+	var mainENIRule netlink.Rule
+	mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
+	mockNetLink.EXPECT().RuleDel(&mainENIRule)
+	mockNetLink.EXPECT().RuleAdd(&mainENIRule)
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+
+	vpcCIDRs := testPrefixes("10.10.0.0/16", "10.11.0.0/16")
+	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-0", "!", "-d", "10.10.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAN", "-j", "AWS-SNAT-CHAIN-1") //AWS SNAT CHAN proves backwards compatibility
+	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-1", "!", "-d", "10.11.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-2")
+	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-2", "!", "-d", "10.12.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "AWS-SNAT-CHAIN-3")
+	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-3", "!", "-d", "10.13.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "AWS-SNAT-CHAIN-4")
+	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-4", "-m", "comment", "--comment", "AWS, SNAT", "-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "SNAT", "--to-source", "10.10.10.20")
+	_ = mockIptables.NewChain("nat", "AWS-SNAT-CHAIN-5")
+	_ = mockIptables.Append("nat", "POSTROUTING", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-0")
+
+	err := ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+
+	assert.Equal(t,
+		map[string]map[string][][]string{
+			"nat": {
+				"AWS-SNAT-CHAIN-0": [][]string{
+					{"-d", "10.10.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "RETURN"},
+					{"-d", "10.11.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "RETURN"},
+					{"-m", "comment", "--comment", "AWS, SNAT", "-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "SNAT", "--to-source", "10.10.10.20"},
+				},
+				"POSTROUTING": [][]string{{"-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-0"}}},
+			"mangle": {
+				"PREROUTING": [][]string{
+					{"-m", "comment", "--comment", "AWS, primary ENI", "-i", "lo", "-m", "addrtype", "--dst-type", "LOCAL", "--limit-iface-in", "-j", "CONNMARK", "--set-mark", "0x80/0x80"},
+					{"-m", "comment", "--comment", "AWS, primary ENI", "-i", "eni+", "-j", "CONNMARK", "--restore-mark", "--mask", "0x80"},
+				},
+			},
+		}, mockIptables.Tables)
+}
+
+func TestSetupHostNetworkNodePortInterfaces(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	mockProcSys := mock_procsyswrapper.NewMockProcSys(ctrl)
+	ln := &linuxNetwork{
+		nodePortSupportEnabled: true,
+		nodePortInterfaces:     []string{"primary", "bond0", "eth3"},
+		unmanagedInterfaces:    []string{"eth3"},
+		mainENIMark:            defaultConnmark,
+		primaryInterface:       "eth0",
+
+		netLink: mockNetLink,
+		ns:      mockNS,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+		procSys: mockProcSys,
+	}
+	var hostRule netlink.Rule
+	var mainENIRule netlink.Rule
+	expectRules := func() {
+		mockNetLink.EXPECT().LinkByName(kubeIPVSInterface).Return(nil, errors.New("link not found"))
+		mockNetLink.EXPECT().NewRule().Return(&hostRule)
+		mockNetLink.EXPECT().RuleDel(&hostRule)
+		mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
+		mockNetLink.EXPECT().RuleDel(&mainENIRule)
+		mockNetLink.EXPECT().RuleAdd(&mainENIRule)
+		mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+	}
+	markRule := func(iface string) []string {
+		return []string{"-m", "comment", "--comment", "AWS, primary ENI", "-i", iface,
+			"-m", "addrtype", "--dst-type", "LOCAL", "--limit-iface-in", "-j", "CONNMARK", "--set-mark", "0x80/0x80"}
+	}
+
+	// The unmanaged interface is left alone
+	expectRules()
+	mockProcSys.EXPECT().Set("net/ipv4/conf/eth0/rp_filter", "2")
+	mockProcSys.EXPECT().Set("net/ipv4/conf/bond0/rp_filter", "2")
+	vpcCIDRs := testPrefixes("10.10.0.0/16")
+	err := ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	prerouting := mockIptables.Tables["mangle"]["PREROUTING"]
+	assert.Contains(t, prerouting, markRule("eth0"))
+	assert.Contains(t, prerouting, markRule("bond0"))
+	assert.NotContains(t, prerouting, markRule("eth3"))
+
+	// The rules of the interfaces that are no longer selected are deleted
+	ln.nodePortInterfaces = []string{"bond0"}
+	expectRules()
+	mockProcSys.EXPECT().Set("net/ipv4/conf/bond0/rp_filter", "2")
+	err = ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	prerouting = mockIptables.Tables["mangle"]["PREROUTING"]
+	assert.NotContains(t, prerouting, markRule("eth0"))
+	assert.Contains(t, prerouting, markRule("bond0"))
+	assert.Contains(t, prerouting, []string{"-m", "comment", "--comment", "AWS, primary ENI",
+		"-i", "eni+", "-j", "CONNMARK", "--restore-mark", "--mask", "0x80"})
+}
+
+func TestSetupHostNetworkPodInterfacePatternChange(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	mockProcSys := mock_procsyswrapper.NewMockProcSys(ctrl)
+	ln := &linuxNetwork{
+		nodePortSupportEnabled: true,
+		mainENIMark:            defaultConnmark,
+		primaryInterface:       "eth0",
+
+		netLink: mockNetLink,
+		ns:      mockNS,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+		procSys: mockProcSys,
+	}
+	var hostRule netlink.Rule
+	var mainENIRule netlink.Rule
+	expectRules := func() {
+		mockNetLink.EXPECT().LinkByName(kubeIPVSInterface).Return(nil, errors.New("link not found"))
+		mockNetLink.EXPECT().NewRule().Return(&hostRule)
+		mockNetLink.EXPECT().RuleDel(&hostRule)
+		mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
+		mockNetLink.EXPECT().RuleDel(&mainENIRule)
+		mockNetLink.EXPECT().RuleAdd(&mainENIRule)
+		mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+		mockProcSys.EXPECT().Set("net/ipv4/conf/eth0/rp_filter", "2")
+	}
+	restoreRule := func(comment, iface, mask string) []string {
+		return []string{"-m", "comment", "--comment", comment, "-i", iface,
+			"-j", "CONNMARK", "--restore-mark", "--mask", mask}
+	}
+
+	expectRules()
+	vpcCIDRs := testPrefixes("10.10.0.0/16")
+	err := ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Contains(t, mockIptables.Tables["mangle"]["PREROUTING"], restoreRule(nodePortComment, "eni+", "0x80"))
+	// Left by a former setup with firewall symmetry on
+	mockIptables.Tables["mangle"]["PREROUTING"] = append(mockIptables.Tables["mangle"]["PREROUTING"],
+		restoreRule(firewallComment, "eni+", "0x3f000000"))
+
+	// The restore rules of the former pattern are deleted, whether their feature is still on or not
+	ln.podInterfacePattern = "cni0"
+	expectRules()
+	err = ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+	prerouting := mockIptables.Tables["mangle"]["PREROUTING"]
+	assert.Contains(t, prerouting, restoreRule(nodePortComment, "cni0", "0x80"))
+	assert.NotContains(t, prerouting, restoreRule(nodePortComment, "eni+", "0x80"))
+	assert.NotContains(t, prerouting, restoreRule(firewallComment, "eni+", "0x3f000000"))
+}
+
+func TestSetupHostNetworkExcludedSNATCIDRsIdempotent(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	mockProcSys := mock_procsyswrapper.NewMockProcSys(ctrl)
+	ln := &linuxNetwork{
+		useExternalSNAT:        false,
+		excludeSNATCIDRs:       testPrefixes("10.12.0.0/16", "10.13.0.0/16"),
+		nodePortSupportEnabled: true,
+		mainENIMark:            defaultConnmark,
+
+		netLink: mockNetLink,
+		ns:      mockNS,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+		procSys: mockProcSys,
+	}
+
+	mockProcSys.EXPECT().Set("net/ipv4/conf/lo/rp_filter", "2")
+
+	mockNetLink.EXPECT().LinkByName(kubeIPVSInterface).Return(nil, errors.New("link not found"))
+	var hostRule netlink.Rule
+	mockNetLink.EXPECT().NewRule().Return(&hostRule)
+	mockNetLink.EXPECT().RuleDel(&hostRule)
+	var mainENIRule netlink.Rule
+	mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
+	mockNetLink.EXPECT().RuleDel(&mainENIRule)
+	mockNetLink.EXPECT().RuleAdd(&mainENIRule)
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+
+	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-0", "!", "-d", "10.10.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-1")
+	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-1", "!", "-d", "10.11.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-2")
+	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-2", "!", "-d", "10.12.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "AWS-SNAT-CHAIN-3")
+	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-3", "!", "-d", "10.13.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "AWS-SNAT-CHAIN-4")
+	_ = mockIptables.Append("nat", "AWS-SNAT-CHAIN-4", "-m", "comment", "--comment", "AWS, SNAT", "-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "SNAT", "--to-source", "10.10.10.20")
+	_ = mockIptables.Append("nat", "POSTROUTING", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-0")
+
+	// remove exclusions
+	vpcCIDRs := testPrefixes("10.10.0.0/16", "10.11.0.0/16")
+	err := ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+
+	assert.Equal(t,
+		map[string]map[string][][]string{
+			"nat": {
+				"AWS-SNAT-CHAIN-0": [][]string{
+					{"-d", "10.10.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "RETURN"},
+					{"-d", "10.11.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "RETURN"},
+					{"-d", "10.12.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "RETURN"},
+					{"-d", "10.13.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN EXCLUSION", "-j", "RETURN"},
+					{"-m", "comment", "--comment", "AWS, SNAT", "-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "SNAT", "--to-source", "10.10.10.20"},
+				},
+				"POSTROUTING": [][]string{{"-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "AWS-SNAT-CHAIN-0"}}},
+			"mangle": {
+				"PREROUTING": [][]string{
+					{"-m", "comment", "--comment", "AWS, primary ENI", "-i", "lo", "-m", "addrtype", "--dst-type", "LOCAL", "--limit-iface-in", "-j", "CONNMARK", "--set-mark", "0x80/0x80"},
+					{"-m", "comment", "--comment", "AWS, primary ENI", "-i", "eni+", "-j", "CONNMARK", "--restore-mark", "--mask", "0x80"},
+				},
+			},
+		}, mockIptables.Tables)
+}
+
+func TestApplyHostRulesAddsCIDRBeforeSNATRule(t *testing.T) {
+	mockIptables := newMockIptables()
+	ln := &linuxNetwork{}
+	cfg := hostRulesConfig{vpcCIDRs: testPrefixes("10.11.0.0/16"), primaryAddr: testENIAddr, vpcCIDR: testENIPrefix}
+	assert.NoError(t, ln.applyHostRules(mockIptables, buildHostRules(cfg)))
+
+	// A CIDR added later, before or after the others, is returned from the chain before the SNAT rule
+	cfg.vpcCIDRs = testPrefixes("10.10.0.0/16", "10.11.0.0/16", "10.12.0.0/16")
+	assert.NoError(t, ln.applyHostRules(mockIptables, buildHostRules(cfg)))
+	assert.Equal(t, [][]string{
+		{"-d", "10.10.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "RETURN"},
+		{"-d", "10.11.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "RETURN"},
+		{"-d", "10.12.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "RETURN"},
+		{"-m", "comment", "--comment", "AWS, SNAT", "-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "SNAT", "--to-source", "10.10.10.20"},
+	}, mockIptables.Tables["nat"]["AWS-SNAT-CHAIN-0"])
+}
+
+func TestSetupHostNetworkMultipleCIDRs(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	mockProcSys := mock_procsyswrapper.NewMockProcSys(ctrl)
+	ln := &linuxNetwork{
+		useExternalSNAT:        true,
+		nodePortSupportEnabled: true,
+		mainENIMark:            defaultConnmark,
+
+		netLink: mockNetLink,
+		ns:      mockNS,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+		procSys: mockProcSys,
+	}
+
+	mockProcSys.EXPECT().Set("net/ipv4/conf/lo/rp_filter", "2")
+
+	mockNetLink.EXPECT().LinkByName(kubeIPVSInterface).Return(nil, errors.New("link not found"))
+	var hostRule netlink.Rule
+	mockNetLink.EXPECT().NewRule().Return(&hostRule)
+	mockNetLink.EXPECT().RuleDel(&hostRule)
+	var mainENIRule netlink.Rule
+	mockNetLink.EXPECT().NewRule().Return(&mainENIRule)
+	mockNetLink.EXPECT().RuleDel(&mainENIRule)
+	mockNetLink.EXPECT().RuleAdd(&mainENIRule)
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+
+	var vpcCIDRs []netip.Prefix
+	vpcCIDRs = testPrefixes("10.10.0.0/16", "10.11.0.0/16")
+	err := ln.SetupHostNetwork(testENIPrefix, vpcCIDRs, "", testENIAddr)
+	assert.NoError(t, err)
+}
+
+func TestSetupHostNetworkRandomFully(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS, mockIptables := setup(t)
+	defer ctrl.Finish()
+
+	hasRandomFully := false
+	ln := &linuxNetwork{
+		snatStrategy:     randomPRNGSNAT{},
+		primaryInterface: "eth0",
+		mainENIMark:      defaultConnmark,
+
+		netLink: mockNetLink,
+		ns:      mockNS,
+		newIptables: func() (iptablesIface, error) {
+			return mockIptables, nil
+		},
+		capabilities: func() capabilities.Capabilities {
+			return capabilities.Capabilities{IptablesRandomFully: hasRandomFully}
+		},
+	}
+	mockNetLink.EXPECT().NewRule().Return(&netlink.Rule{}).Times(4)
+	mockNetLink.EXPECT().RuleDel(gomock.Any()).Times(4)
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil).Times(2)
+	snatRule := []string{"-m", "comment", "--comment", "AWS, SNAT", "-m", "addrtype", "!", "--dst-type", "LOCAL",
+		"-j", "SNAT", "--to-source", "10.10.10.20"}
+	returnRule := []string{"-d", "10.10.0.0/16", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j", "RETURN"}
+
+	// Falls back to --random when iptables does not support --random-fully
+	err := ln.SetupHostNetwork(testENIPrefix, testPrefixes("10.10.0.0/16"), "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{returnRule, append(snatRule, "--random")}, mockIptables.Tables["nat"]["AWS-SNAT-CHAIN-0"])
+
+	hasRandomFully = true
+	err = ln.SetupHostNetwork(testENIPrefix, testPrefixes("10.10.0.0/16"), "", testENIAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{returnRule, append(snatRule, "--random-fully")}, mockIptables.Tables["nat"]["AWS-SNAT-CHAIN-0"])
+}
+
+func TestGetPodIPsFromRules(t *testing.T) {
+	_, podNet, _ := net.ParseCIDR("10.10.10.21/32")
+	_, vpcNet, _ := net.ParseCIDR("10.10.0.0/16")
+	rules := []netlink.Rule{
+		{Priority: toPodRulePriority, Dst: podNet, Table: mainRoutingTable},
+		{Priority: fromPodRulePriority, Src: podNet, Table: testTable},
+		{Priority: hostRulePriority, Dst: vpcNet, Table: mainRoutingTable},
+	}
+	assert.Equal(t, []string{"10.10.10.21"}, GetPodIPsFromRules(rules))
+	assert.Empty(t, GetPodIPsFromRules(nil))
+}
+
+// mockIptables is the iptables in memory that the tests give to linuxNetwork
+type mockIptables = iptablestest.Iptables
+
+func newMockIptables() *mockIptables {
+	return iptablestest.New()
+}
+
+func TestListVFs(t *testing.T) {
+	root, err := ioutil.TempDir("", "sysclassnet")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	// virtfn1 was moved to the netns of a pod, virtfn0 and virtfn2 are in the host netns
+	for _, dir := range []string{"eth1/device/virtfn0/net/eth1v0", "eth1/device/virtfn1", "eth1/device/virtfn2/net/eth1v2", "eth2"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
 	}
-	f.closed = true
-	return nil
+	vfs, err := listVFs(root, "eth1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"eth1v0", "eth1v2"}, vfs)
+
+	// An interface without SR-IOV has no VFs
+	vfs, err = listVFs(root, "eth2")
+	assert.NoError(t, err)
+	assert.Empty(t, vfs)
+
+	_, err = listVFs(root, "eth3")
+	assert.Error(t, err)
+}
+
+func TestReadNUMANode(t *testing.T) {
+	root, err := ioutil.TempDir("", "sysclassnet")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "eth1", "device"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "eth1", "device", "numa_node"), []byte("1\n"), 0644))
+	node, err := readNUMANode(root, "eth1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, node)
+
+	// A virtual interface has no NUMA node
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "dummy0"), 0755))
+	node, err = readNUMANode(root, "dummy0")
+	assert.NoError(t, err)
+	assert.Equal(t, -1, node)
 }
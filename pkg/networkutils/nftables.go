@@ -0,0 +1,1050 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/pkg/errors"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/capabilities"
+)
+
+const (
+	// envNFTMode is the name of the environment variable that selects how the host rules, e.g. SNAT and connmark, are
+	// programmed. With "on", they are written with nft to tables of their own, aws-cni-nat and aws-cni-mangle, instead
+	// of with iptables. With "off", iptables is always used. With "auto", the default, nft is used when it is installed
+	// and iptables is not, as on nftables-only distros.
+	envNFTMode = "AWS_VPC_K8S_CNI_NFT_MODE"
+
+	// nftTablePrefix is the prefix of the nftables tables of the host rules, which are named after the iptables table
+	// whose rules they hold
+	nftTablePrefix = "aws-cni-"
+)
+
+type nftMode string
+
+const (
+	nftModeAuto nftMode = "auto"
+	nftModeOn   nftMode = "on"
+	nftModeOff  nftMode = "off"
+)
+
+func getNFTMode() nftMode {
+	strValue := os.Getenv(envNFTMode)
+	switch mode := nftMode(strValue); mode {
+	case "":
+		return nftModeAuto
+	case nftModeAuto, nftModeOn, nftModeOff:
+		return mode
+	default:
+		log.Errorf("Failed to parse %s; using default: %s. Provided string was %q", envNFTMode, nftModeAuto, strValue)
+		return nftModeAuto
+	}
+}
+
+// useNFTables returns whether the host rules are programmed with nft in the mode. The capabilities of the node are
+// only probed in auto mode.
+func useNFTables(mode nftMode, caps func() capabilities.Capabilities) bool {
+	switch mode {
+	case nftModeOn:
+		return true
+	case nftModeAuto:
+		c := caps()
+		return c.NftPresent && c.IptablesVersion == ""
+	default:
+		return false
+	}
+}
+
+// newHostIptables returns what the host rules of the protocol are programmed with in the mode: the nftables backend or
+// iptables. Either runs its commands one at a time with the other ones of ipamd.
+func newHostIptables(proto iptables.Protocol, mode nftMode) (iptablesIface, error) {
+	if useNFTables(mode, capabilities.Get) {
+		return newQueuedIptables(newNFTables(proto), getIptablesLockTimeout()), nil
+	}
+	ipt, err := iptables.NewWithProtocol(proto)
+	if err != nil {
+		return nil, err
+	}
+	return newQueuedIptables(ipt, getIptablesLockTimeout()), nil
+}
+
+// newOtherHostIptables returns the backend the host rules of the protocol are not programmed with in the mode, nil if
+// it is not on the node
+func newOtherHostIptables(proto iptables.Protocol, mode nftMode) (iptablesIface, error) {
+	if useNFTables(mode, capabilities.Get) {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			log.Debugf("Not looking for iptables rules to delete, iptables is not available: %v", err)
+			return nil, nil
+		}
+		return newQueuedIptables(ipt, getIptablesLockTimeout()), nil
+	}
+	if !capabilities.Get().NftPresent {
+		return nil, nil
+	}
+	return newQueuedIptables(newNFTables(proto), getIptablesLockTimeout()), nil
+}
+
+// nftEnabled returns whether the host rules are programmed with nft
+func (n *linuxNetwork) nftEnabled() bool {
+	return useNFTables(n.nftMode, n.capabilities)
+}
+
+// rulePosition returns where the positioned rules go relative to the rules of others. The tables of the nftables
+// backend only hold rules of ours, and their base chains are ordered with the ones of others by priority, so new rules
+// are appended.
+func (n *linuxNetwork) rulePosition() iptablesRulePosition {
+	if n.iptablesRulePosition != iptablesRuleAppendNew && n.nftEnabled() {
+		return iptablesRuleAppendNew
+	}
+	return n.iptablesRulePosition
+}
+
+// warnNFTIgnoredSettings warns about the iptables settings that have no effect with the nftables backend
+func (n *linuxNetwork) warnNFTIgnoredSettings() {
+	if !n.nftEnabled() {
+		return
+	}
+	if n.iptablesRulePosition != iptablesRuleAppendNew {
+		log.Warnf("%s=%s is ignored with %s: the nftables tables of the host rules hold no rules of others to "+
+			"position them against", envIptablesRulePosition, n.iptablesRulePosition, envNFTMode)
+	}
+	if n.iptablesCheck != iptablesCheckOff {
+		log.Warnf("%s=%s is ignored with %s: the rules of others are not in the nftables tables of the host rules",
+			envIptablesCheck, n.iptablesCheck, envNFTMode)
+	}
+}
+
+// deleteOtherBackendRules deletes the SNAT chains of ours, the jump to them and our CONNMARK rules from the backend the
+// host rules are not programmed with, e.g. the iptables rules left from before AWS_VPC_K8S_CNI_NFT_MODE was turned on.
+// Both backends would SNAT and mark the same traffic otherwise.
+func (n *linuxNetwork) deleteOtherBackendRules(ipv6 bool) error {
+	if n.newOtherBackend == nil {
+		return nil
+	}
+	ipt, err := n.newOtherBackend(ipv6)
+	if err != nil {
+		return errors.Wrap(err, "host network setup: failed to open the other backend of the host rules")
+	}
+	if ipt == nil {
+		return nil
+	}
+	for _, chain := range []struct{ table, chain, target string }{
+		{"nat", "POSTROUTING", "AWS-SNAT-CHAIN"},
+		{"mangle", "PREROUTING", "CONNMARK"},
+	} {
+		ruleSpecs, err := listRuleSpecs(ipt, chain.table, chain.chain)
+		if err != nil {
+			return errors.Wrap(err, "host network setup: failed to list the rules of the other backend")
+		}
+		for _, ruleSpec := range ruleSpecs {
+			if !isAWSRule(ruleSpec) || !strings.HasPrefix(ruleTarget(ruleSpec), chain.target) {
+				continue
+			}
+			log.Infof("Deleting %s %s rule %q left in the backend the host rules are not programmed with",
+				chain.table, chain.chain, strings.Join(ruleSpec, " "))
+			if err := ipt.Delete(chain.table, chain.chain, ruleSpec...); err != nil {
+				return errors.Wrapf(err, "host network setup: failed to delete %s %s rule %q", chain.table,
+					chain.chain, strings.Join(ruleSpec, " "))
+			}
+		}
+	}
+
+	chains, err := ipt.ListChains("nat")
+	if err != nil {
+		return errors.Wrap(err, "host network setup: failed to list the nat chains of the other backend")
+	}
+	var snatChains []string
+	for _, chain := range chains {
+		if strings.HasPrefix(chain, "AWS-SNAT-CHAIN") {
+			snatChains = append(snatChains, chain)
+		}
+	}
+	// The chains of the previous layout jump to each other, so all of them are cleared before any is deleted
+	for _, chain := range snatChains {
+		if err := ipt.ClearChain("nat", chain); err != nil {
+			return errors.Wrapf(err, "host network setup: failed to clear %s of the other backend", chain)
+		}
+	}
+	for _, chain := range snatChains {
+		log.Infof("Deleting nat chain %s left in the backend the host rules are not programmed with", chain)
+		if err := ipt.DeleteChain("nat", chain); err != nil {
+			return errors.Wrapf(err, "host network setup: failed to delete %s of the other backend", chain)
+		}
+	}
+	return nil
+}
+
+// ruleTarget returns the target of a rule spec, "" if it has none
+func ruleTarget(ruleSpec []string) string {
+	for i := 0; i+1 < len(ruleSpec); i++ {
+		if ruleSpec[i] == "-j" || ruleSpec[i] == "--jump" {
+			return ruleSpec[i+1]
+		}
+	}
+	return ""
+}
+
+// nftBaseChain is the base chain of an nftables table standing for a built-in chain of iptables
+type nftBaseChain struct {
+	name     string
+	typ      string
+	hook     string
+	priority int
+}
+
+// nftBaseChains are the built-in chains of each iptables table, in the order iptables lists them, with the type, hook
+// and priority of the equivalent base chains
+var nftBaseChains = map[string][]nftBaseChain{
+	"nat": {
+		{"PREROUTING", "nat", "prerouting", -100},
+		{"INPUT", "nat", "input", 100},
+		{"OUTPUT", "nat", "output", -100},
+		{"POSTROUTING", "nat", "postrouting", 100},
+	},
+	"mangle": {
+		{"PREROUTING", "filter", "prerouting", -150},
+		{"INPUT", "filter", "input", -150},
+		{"FORWARD", "filter", "forward", -150},
+		{"OUTPUT", "route", "output", -150},
+		{"POSTROUTING", "filter", "postrouting", -150},
+	},
+	"filter": {
+		{"INPUT", "filter", "input", 0},
+		{"FORWARD", "filter", "forward", 0},
+		{"OUTPUT", "filter", "output", 0},
+	},
+}
+
+// nftables programs the rules of iptablesIface with nft, in an nftables table of its own for each iptables table. The
+// rule specs are translated to nft expressions and back, so that the rules are handled the same way as with iptables.
+// Only the matches and targets of the host rules are supported.
+type nftables struct {
+	// family is the nftables family of the tables, ip or ip6
+	family string
+	// run runs nft with the arguments, and the input if any
+	run func(input []byte, args ...string) ([]byte, error)
+}
+
+func newNFTables(proto iptables.Protocol) *nftables {
+	family := "ip"
+	if proto == iptables.ProtocolIPv6 {
+		family = "ip6"
+	}
+	return &nftables{family: family, run: runNFT}
+}
+
+func runNFT(input []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("nft", args...)
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Errorf("running nft %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// isNFTNotFound returns whether nft failed because the table or chain does not exist
+func isNFTNotFound(err error) bool {
+	return strings.Contains(err.Error(), "No such file or directory")
+}
+
+func baseChain(table, chain string) (nftBaseChain, bool) {
+	for _, base := range nftBaseChains[table] {
+		if base.name == chain {
+			return base, true
+		}
+	}
+	return nftBaseChain{}, false
+}
+
+func (n *nftables) tableName(table string) string {
+	return nftTablePrefix + table
+}
+
+func (n *nftables) chainObject(table, chain string) map[string]interface{} {
+	return map[string]interface{}{"family": n.family, "table": n.tableName(table), "name": chain}
+}
+
+// setup returns the commands creating the table, and the chain if it is a built-in one, which exist in iptables from
+// the start
+func (n *nftables) setup(table, chain string) []interface{} {
+	commands := []interface{}{
+		map[string]interface{}{"add": map[string]interface{}{
+			"table": map[string]interface{}{"family": n.family, "name": n.tableName(table)}}},
+	}
+	if base, ok := baseChain(table, chain); ok {
+		object := n.chainObject(table, chain)
+		object["type"] = base.typ
+		object["hook"] = base.hook
+		object["prio"] = base.priority
+		object["policy"] = "accept"
+		commands = append(commands, map[string]interface{}{"add": map[string]interface{}{"chain": object}})
+	}
+	return commands
+}
+
+// apply runs the commands as one transaction
+func (n *nftables) apply(commands ...interface{}) error {
+	input, err := json.Marshal(map[string]interface{}{"nftables": commands})
+	if err != nil {
+		return errors.Wrap(err, "nftables: failed to encode commands")
+	}
+	_, err = n.run(input, "-j", "-f", "-")
+	return err
+}
+
+// nftListing is the output of nft -j list
+type nftListing struct {
+	Nftables []struct {
+		Chain *struct {
+			Name string `json:"name"`
+		} `json:"chain"`
+		Rule *struct {
+			Handle  int           `json:"handle"`
+			Comment string        `json:"comment"`
+			Expr    []interface{} `json:"expr"`
+		} `json:"rule"`
+	} `json:"nftables"`
+}
+
+func (n *nftables) list(args ...string) (nftListing, error) {
+	var listing nftListing
+	output, err := n.run(nil, append([]string{"-j", "list"}, args...)...)
+	if err != nil {
+		return listing, err
+	}
+	if err := json.Unmarshal(output, &listing); err != nil {
+		return listing, errors.Wrapf(err, "nftables: failed to decode the output of nft list %s", strings.Join(args, " "))
+	}
+	return listing, nil
+}
+
+// nftListedRule is a rule of a chain, translated back to an iptables rule spec
+type nftListedRule struct {
+	handle         int
+	ruleSpec       []string
+	packets, bytes uint64
+}
+
+// listRules returns the rules of the chain, and whether the chain exists. The built-in chains always exist.
+func (n *nftables) listRules(table, chain string) ([]nftListedRule, bool, error) {
+	listing, err := n.list("chain", n.family, n.tableName(table), chain)
+	if err != nil {
+		if isNFTNotFound(err) {
+			_, builtin := baseChain(table, chain)
+			return nil, builtin, nil
+		}
+		return nil, false, err
+	}
+	var rules []nftListedRule
+	for _, object := range listing.Nftables {
+		if object.Rule == nil {
+			continue
+		}
+		rule := nftListedRule{handle: object.Rule.Handle}
+		rule.ruleSpec, rule.packets, rule.bytes, err = n.ruleSpec(object.Rule.Comment, object.Rule.Expr)
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "nftables: failed to translate rule %d of %s chain %s",
+				object.Rule.Handle, table, chain)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, true, nil
+}
+
+// canonical returns the rule spec as it is listed once added
+func (n *nftables) canonical(ruleSpec []string) ([]string, error) {
+	exprs, comment, err := n.ruleExprs(ruleSpec)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(exprs)
+	if err != nil {
+		return nil, err
+	}
+	var decoded []interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+	canonical, _, _, err := n.ruleSpec(comment, decoded)
+	return canonical, err
+}
+
+// find returns the handle of the first rule of the chain with the rule spec, 0 if there is none
+func (n *nftables) find(table, chain string, ruleSpec []string) (int, error) {
+	want, err := n.canonical(ruleSpec)
+	if err != nil {
+		return 0, err
+	}
+	rules, _, err := n.listRules(table, chain)
+	if err != nil {
+		return 0, err
+	}
+	for _, rule := range rules {
+		if reflect.DeepEqual(rule.ruleSpec, want) {
+			return rule.handle, nil
+		}
+	}
+	return 0, nil
+}
+
+func (n *nftables) ruleObject(table, chain string, ruleSpec []string) (map[string]interface{}, error) {
+	exprs, comment, err := n.ruleExprs(ruleSpec)
+	if err != nil {
+		return nil, err
+	}
+	object := map[string]interface{}{"family": n.family, "table": n.tableName(table), "chain": chain, "expr": exprs}
+	if comment != "" {
+		object["comment"] = comment
+	}
+	return object, nil
+}
+
+// Exists returns whether the chain has the rule
+func (n *nftables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	handle, err := n.find(table, chain, rulespec)
+	return handle != 0, err
+}
+
+// Insert adds the rule at the position, starting at 1
+func (n *nftables) Insert(table, chain string, pos int, rulespec ...string) error {
+	rule, err := n.ruleObject(table, chain, rulespec)
+	if err != nil {
+		return err
+	}
+	rules, exists, err := n.listRules(table, chain)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.Errorf("nftables: %s chain %s does not exist", table, chain)
+	}
+	if pos < 1 || pos > len(rules)+1 {
+		return errors.Errorf("nftables: index of insertion %d too big for %s chain %s", pos, table, chain)
+	}
+	command := "add"
+	if pos <= len(rules) {
+		// The rule is inserted before the one at the position
+		command = "insert"
+		rule["handle"] = rules[pos-1].handle
+	}
+	commands := append(n.setup(table, chain), map[string]interface{}{command: map[string]interface{}{"rule": rule}})
+	return n.apply(commands...)
+}
+
+// Append adds the rule at the end of the chain
+func (n *nftables) Append(table, chain string, rulespec ...string) error {
+	rule, err := n.ruleObject(table, chain, rulespec)
+	if err != nil {
+		return err
+	}
+	commands := append(n.setup(table, chain), map[string]interface{}{"add": map[string]interface{}{"rule": rule}})
+	return n.apply(commands...)
+}
+
+// Delete removes the first rule of the chain with the rule spec
+func (n *nftables) Delete(table, chain string, rulespec ...string) error {
+	handle, err := n.find(table, chain, rulespec)
+	if err != nil {
+		return err
+	}
+	if handle == 0 {
+		return errors.Errorf("nftables: no rule %q in %s chain %s", strings.Join(rulespec, " "), table, chain)
+	}
+	return n.apply(map[string]interface{}{"delete": map[string]interface{}{"rule": map[string]interface{}{
+		"family": n.family, "table": n.tableName(table), "chain": chain, "handle": handle}}})
+}
+
+// List returns the rules of the chain like iptables -S
+func (n *nftables) List(table, chain string) ([]string, error) {
+	return n.listChain(table, chain, false)
+}
+
+// ListWithCounters returns the rules of the chain like iptables -S -v
+func (n *nftables) ListWithCounters(table, chain string) ([]string, error) {
+	return n.listChain(table, chain, true)
+}
+
+func (n *nftables) listChain(table, chain string, counters bool) ([]string, error) {
+	rules, exists, err := n.listRules(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.Errorf("nftables: %s chain %s does not exist", table, chain)
+	}
+	lines := []string{"-N " + chain}
+	if _, builtin := baseChain(table, chain); builtin {
+		lines = []string{"-P " + chain + " ACCEPT"}
+	}
+	for _, rule := range rules {
+		ruleSpec := rule.ruleSpec
+		if counters {
+			ruleSpec = withCounters(ruleSpec, rule.packets, rule.bytes)
+		}
+		words := []string{"-A", chain}
+		for _, word := range ruleSpec {
+			if word == "" || strings.ContainsAny(word, " \"") {
+				word = strconv.Quote(word)
+			}
+			words = append(words, word)
+		}
+		lines = append(lines, strings.Join(words, " "))
+	}
+	return lines, nil
+}
+
+// withCounters adds the counters of a rule before its target, where iptables -S -v lists them
+func withCounters(ruleSpec []string, packets, bytes uint64) []string {
+	counters := []string{"-c", strconv.FormatUint(packets, 10), strconv.FormatUint(bytes, 10)}
+	for i, word := range ruleSpec {
+		if word == "-j" {
+			return append(append(append([]string{}, ruleSpec[:i]...), counters...), ruleSpec[i:]...)
+		}
+	}
+	return append(append([]string{}, ruleSpec...), counters...)
+}
+
+// NewChain creates the chain, it fails if it already exists like with iptables
+func (n *nftables) NewChain(table, chain string) error {
+	chains, err := n.ListChains(table)
+	if err != nil {
+		return err
+	}
+	for _, existing := range chains {
+		if existing == chain {
+			return errors.Errorf("nftables: %s chain %s: Chain already exists.", table, chain)
+		}
+	}
+	commands := append(n.setup(table, chain),
+		map[string]interface{}{"add": map[string]interface{}{"chain": n.chainObject(table, chain)}})
+	return n.apply(commands...)
+}
+
+// ClearChain removes the rules of the chain, which is created if it does not exist
+func (n *nftables) ClearChain(table, chain string) error {
+	commands := n.setup(table, chain)
+	if _, builtin := baseChain(table, chain); !builtin {
+		commands = append(commands, map[string]interface{}{"add": map[string]interface{}{
+			"chain": n.chainObject(table, chain)}})
+	}
+	commands = append(commands, map[string]interface{}{"flush": map[string]interface{}{
+		"chain": n.chainObject(table, chain)}})
+	return n.apply(commands...)
+}
+
+// DeleteChain deletes the chain, which must be empty and not jumped to
+func (n *nftables) DeleteChain(table, chain string) error {
+	return n.apply(map[string]interface{}{"delete": map[string]interface{}{"chain": n.chainObject(table, chain)}})
+}
+
+// ListChains returns the built-in chains of the table followed by the chains of ours
+func (n *nftables) ListChains(table string) ([]string, error) {
+	var chains []string
+	for _, base := range nftBaseChains[table] {
+		chains = append(chains, base.name)
+	}
+	listing, err := n.list("table", n.family, n.tableName(table))
+	if err != nil {
+		if isNFTNotFound(err) {
+			return chains, nil
+		}
+		return nil, err
+	}
+	for _, object := range listing.Nftables {
+		if object.Chain == nil {
+			continue
+		}
+		if _, builtin := baseChain(table, object.Chain.Name); !builtin {
+			chains = append(chains, object.Chain.Name)
+		}
+	}
+	return chains, nil
+}
+
+// HasRandomFully returns true, the fully-random flag of nft is what --random-fully of iptables uses
+func (n *nftables) HasRandomFully() bool {
+	return true
+}
+
+// nftMatches are the iptables match modules that can be translated
+var nftMatches = map[string]bool{"comment": true, "addrtype": true, "conntrack": true, "limit": true, "rpfilter": true}
+
+func (n *nftables) addressBits() int {
+	if n.family == "ip6" {
+		return 128
+	}
+	return 32
+}
+
+func nftMatch(op string, left, right interface{}) map[string]interface{} {
+	return map[string]interface{}{"match": map[string]interface{}{"op": op, "left": left, "right": right}}
+}
+
+func nftKey(expression, key string) map[string]interface{} {
+	return map[string]interface{}{expression: map[string]interface{}{"key": key}}
+}
+
+// ruleExprs translates an iptables rule spec to the expressions of an nft rule, and its comment. Every rule counts its
+// packets before its target, since drop tracing reads them.
+func (n *nftables) ruleExprs(ruleSpec []string) ([]interface{}, string, error) {
+	var exprs []interface{}
+	var comment string
+	var fib, rpfilter map[string]interface{}
+	counter := map[string]interface{}{"counter": nil}
+	invert := false
+	for i := 0; i < len(ruleSpec); i++ {
+		option := ruleSpec[i]
+		if option == "!" {
+			invert = true
+			continue
+		}
+		op := "=="
+		if invert {
+			op = "!="
+		}
+		invert = false
+		switch {
+		case option == "--limit-iface-in" && fib != nil:
+			fib["flags"] = append(fib["flags"].([]string), "iif")
+			continue
+		case option == "--invert" && rpfilter != nil:
+			// The packets without a route back through their interface
+			rpfilter["right"] = false
+			continue
+		}
+		if i+1 == len(ruleSpec) {
+			return nil, "", errors.Errorf("nftables: missing value of %s in %q", option, strings.Join(ruleSpec, " "))
+		}
+		i++
+		value := ruleSpec[i]
+		switch option {
+		case "-m", "--match":
+			if !nftMatches[value] {
+				return nil, "", errors.Errorf("nftables: unsupported match %s", value)
+			}
+			if value == "rpfilter" {
+				match := nftMatch("==", map[string]interface{}{"fib": map[string]interface{}{
+					"result": "oif", "flags": []string{"saddr", "iif"}}}, true)
+				rpfilter = match["match"].(map[string]interface{})
+				exprs = append(exprs, match)
+			}
+		case "--comment":
+			comment = value
+		case "-s", "--source", "-d", "--destination":
+			field := "saddr"
+			if option == "-d" || option == "--destination" {
+				field = "daddr"
+			}
+			right, err := n.address(value)
+			if err != nil {
+				return nil, "", err
+			}
+			exprs = append(exprs, nftMatch(op, map[string]interface{}{"payload": map[string]interface{}{
+				"protocol": n.family, "field": field}}, right))
+		case "-i", "--in-interface", "-o", "--out-interface":
+			key := "iifname"
+			if option == "-o" || option == "--out-interface" {
+				key = "oifname"
+			}
+			if strings.HasSuffix(value, "+") {
+				value = strings.TrimSuffix(value, "+") + "*"
+			}
+			exprs = append(exprs, nftMatch(op, nftKey("meta", key), value))
+		case "--dst-type":
+			fib = map[string]interface{}{"result": "type", "flags": []string{"daddr"}}
+			exprs = append(exprs, nftMatch(op, map[string]interface{}{"fib": fib}, strings.ToLower(value)))
+		case "--ctstate":
+			var states []interface{}
+			for _, state := range strings.Split(value, ",") {
+				states = append(states, strings.ToLower(state))
+			}
+			var right interface{} = states
+			if len(states) == 1 {
+				right = states[0]
+			}
+			if op == "==" {
+				op = "in"
+			}
+			exprs = append(exprs, nftMatch(op, nftKey("ct", "state"), right))
+		case "--limit":
+			parts := strings.SplitN(value, "/", 2)
+			rate, err := strconv.ParseUint(parts[0], 10, 32)
+			if err != nil || len(parts) != 2 {
+				return nil, "", errors.Errorf("nftables: invalid limit %s", value)
+			}
+			exprs = append(exprs, map[string]interface{}{"limit": map[string]interface{}{"rate": rate, "per": parts[1]}})
+		case "-j", "--jump":
+			target, err := n.targetExprs(value, ruleSpec[i+1:])
+			if err != nil {
+				return nil, "", err
+			}
+			return append(append(exprs, counter), target...), comment, nil
+		default:
+			return nil, "", errors.Errorf("nftables: unsupported option %s", option)
+		}
+	}
+	return append(exprs, counter), comment, nil
+}
+
+func (n *nftables) address(value string) (interface{}, error) {
+	if !strings.Contains(value, "/") {
+		value += fmt.Sprintf("/%d", n.addressBits())
+	}
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "nftables: invalid address %s", value)
+	}
+	if prefix.Bits() == n.addressBits() {
+		return prefix.Addr().String(), nil
+	}
+	network := prefix.Masked()
+	return map[string]interface{}{"prefix": map[string]interface{}{"addr": network.Addr().String(), "len": network.Bits()}}, nil
+}
+
+// parseMark parses the value and mask of a mark, the mask is all ones if there is none
+func parseMark(value string) (uint32, uint32, error) {
+	parts := strings.SplitN(value, "/", 2)
+	mark, err := strconv.ParseUint(parts[0], 0, 32)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "nftables: invalid mark %s", value)
+	}
+	mask := uint64(0xffffffff)
+	if len(parts) == 2 {
+		if mask, err = strconv.ParseUint(parts[1], 0, 32); err != nil {
+			return 0, 0, errors.Wrapf(err, "nftables: invalid mark %s", value)
+		}
+	}
+	return uint32(mark), uint32(mask), nil
+}
+
+// targetExprs translates the target of an iptables rule and its options to nft statements
+func (n *nftables) targetExprs(target string, options []string) ([]interface{}, error) {
+	values := make(map[string]string)
+	for i := 0; i < len(options); i++ {
+		switch options[i] {
+		case "--random", "--random-fully", "--restore-mark":
+			values[options[i]] = ""
+		case "--to-source", "--set-mark", "--set-xmark", "--mask", "--nfmask", "--ctmask", "--log-prefix":
+			if i+1 == len(options) {
+				return nil, errors.Errorf("nftables: missing value of %s", options[i])
+			}
+			values[options[i]] = options[i+1]
+			i++
+		default:
+			return nil, errors.Errorf("nftables: unsupported option %s of target %s", options[i], target)
+		}
+	}
+	_, random := values["--random"]
+	_, randomFully := values["--random-fully"]
+	var flags interface{}
+	if random {
+		flags = "random"
+	} else if randomFully {
+		flags = "fully-random"
+	}
+
+	switch target {
+	case "RETURN", "ACCEPT", "DROP":
+		return []interface{}{map[string]interface{}{strings.ToLower(target): nil}}, nil
+	case "SNAT":
+		snat := map[string]interface{}{"addr": values["--to-source"]}
+		if flags != nil {
+			snat["flags"] = flags
+		}
+		return []interface{}{map[string]interface{}{"snat": snat}}, nil
+	case "MASQUERADE":
+		var masquerade interface{}
+		if flags != nil {
+			masquerade = map[string]interface{}{"flags": flags}
+		}
+		return []interface{}{map[string]interface{}{"masquerade": masquerade}}, nil
+	case "LOG":
+		return []interface{}{map[string]interface{}{"log": map[string]interface{}{"prefix": values["--log-prefix"]}}},
+			nil
+	case "CONNMARK":
+		if _, ok := values["--restore-mark"]; ok {
+			// Like iptables, the bits of the packet mark outside of nfmask are kept:
+			// meta mark set meta mark & ~nfmask | ct mark & ctmask
+			masks := map[string]uint32{"--nfmask": 0xffffffff, "--ctmask": 0xffffffff}
+			for _, option := range []string{"--mask", "--nfmask", "--ctmask"} {
+				maskStr, ok := values[option]
+				if !ok {
+					continue
+				}
+				mask, err := strconv.ParseUint(maskStr, 0, 32)
+				if err != nil {
+					return nil, errors.Wrapf(err, "nftables: invalid mask %s", maskStr)
+				}
+				if option == "--mask" {
+					masks["--nfmask"], masks["--ctmask"] = uint32(mask), uint32(mask)
+				} else {
+					masks[option] = uint32(mask)
+				}
+			}
+			var value interface{} = nftKey("ct", "mark")
+			if masks["--ctmask"] != 0xffffffff {
+				value = map[string]interface{}{"&": []interface{}{value, masks["--ctmask"]}}
+			}
+			if masks["--nfmask"] != 0xffffffff {
+				value = map[string]interface{}{"|": []interface{}{
+					map[string]interface{}{"&": []interface{}{nftKey("meta", "mark"), ^masks["--nfmask"]}}, value}}
+			}
+			return []interface{}{map[string]interface{}{"mangle": map[string]interface{}{
+				"key": nftKey("meta", "mark"), "value": value}}}, nil
+		}
+		operator, markStr := "|", values["--set-mark"]
+		if xmark, ok := values["--set-xmark"]; ok {
+			operator, markStr = "^", xmark
+		}
+		mark, mask, err := parseMark(markStr)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{} = mark
+		if mask != 0xffffffff {
+			value = map[string]interface{}{operator: []interface{}{
+				map[string]interface{}{"&": []interface{}{nftKey("ct", "mark"), ^mask}}, mark}}
+		}
+		return []interface{}{map[string]interface{}{"mangle": map[string]interface{}{
+			"key": nftKey("ct", "mark"), "value": value}}}, nil
+	case "MARK", "TPROXY", "REJECT", "DNAT", "REDIRECT", "NOTRACK":
+		return nil, errors.Errorf("nftables: unsupported target %s", target)
+	default:
+		if len(options) > 0 {
+			return nil, errors.Errorf("nftables: unexpected options of the jump to %s", target)
+		}
+		return []interface{}{map[string]interface{}{"jump": map[string]interface{}{"target": target}}}, nil
+	}
+}
+
+// ruleSpec translates the comment and expressions of an nft rule back to an iptables rule spec, with the comment
+// first, and returns its counters
+func (n *nftables) ruleSpec(comment string, exprs []interface{}) ([]string, uint64, uint64, error) {
+	var ruleSpec []string
+	if comment != "" {
+		ruleSpec = append(ruleSpec, "-m", "comment", "--comment", comment)
+	}
+	var packets, bytes uint64
+	for _, expr := range exprs {
+		object, ok := expr.(map[string]interface{})
+		if !ok || len(object) != 1 {
+			return nil, 0, 0, errors.Errorf("nftables: unexpected expression %v", expr)
+		}
+		for kind, value := range object {
+			fields, _ := value.(map[string]interface{})
+			var words []string
+			var err error
+			switch kind {
+			case "match":
+				words, err = n.matchSpec(fields)
+			case "counter":
+				packets, bytes = nftNumber(fields["packets"]), nftNumber(fields["bytes"])
+			case "return", "accept", "drop":
+				words = []string{"-j", strings.ToUpper(kind)}
+			case "jump":
+				words = []string{"-j", fmt.Sprint(fields["target"])}
+			case "snat":
+				words = append([]string{"-j", "SNAT", "--to-source", fmt.Sprint(fields["addr"])},
+					nftFlagsSpec(fields["flags"])...)
+			case "masquerade":
+				words = append([]string{"-j", "MASQUERADE"}, nftFlagsSpec(fields["flags"])...)
+			case "log":
+				words = []string{"-j", "LOG", "--log-prefix", fmt.Sprint(fields["prefix"])}
+			case "limit":
+				words = []string{"-m", "limit", "--limit", fmt.Sprintf("%d/%s", nftNumber(fields["rate"]), fields["per"])}
+				if burst := nftNumber(fields["burst"]); burst != 0 && burst != 5 {
+					words = append(words, "--limit-burst", fmt.Sprint(burst))
+				}
+			case "mangle":
+				words, err = mangleSpec(fields)
+			default:
+				err = errors.Errorf("nftables: unsupported expression %s", kind)
+			}
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			ruleSpec = append(ruleSpec, words...)
+		}
+	}
+	return ruleSpec, packets, bytes, nil
+}
+
+func (n *nftables) matchSpec(match map[string]interface{}) ([]string, error) {
+	left := nftObject(match["left"])
+	right := match["right"]
+	var not []string
+	if match["op"] == "!=" {
+		not = []string{"!"}
+	}
+	if payload, ok := left["payload"].(map[string]interface{}); ok {
+		option := "-s"
+		if payload["field"] == "daddr" {
+			option = "-d"
+		}
+		address := fmt.Sprintf("%v/%d", right, n.addressBits())
+		if prefix := nftObject(nftObject(right)["prefix"]); prefix != nil {
+			address = fmt.Sprintf("%v/%d", prefix["addr"], nftNumber(prefix["len"]))
+		}
+		return append(not, option, address), nil
+	}
+	if meta, ok := left["meta"].(map[string]interface{}); ok {
+		option := "-i"
+		if meta["key"] == "oifname" {
+			option = "-o"
+		}
+		iface := fmt.Sprint(right)
+		if strings.HasSuffix(iface, "*") {
+			iface = strings.TrimSuffix(iface, "*") + "+"
+		}
+		return append(not, option, iface), nil
+	}
+	if fib, ok := left["fib"].(map[string]interface{}); ok {
+		if fib["result"] == "oif" {
+			if right == false {
+				return []string{"-m", "rpfilter", "--invert"}, nil
+			}
+			return []string{"-m", "rpfilter"}, nil
+		}
+		words := append(append([]string{"-m", "addrtype"}, not...), "--dst-type", strings.ToUpper(fmt.Sprint(right)))
+		for _, flag := range nftStrings(fib["flags"]) {
+			if flag == "iif" {
+				words = append(words, "--limit-iface-in")
+			}
+		}
+		return words, nil
+	}
+	if ct, ok := left["ct"].(map[string]interface{}); ok && ct["key"] == "state" {
+		if set := nftObject(right); set != nil {
+			right = set["set"]
+		}
+		var states []string
+		for _, state := range nftStrings(right) {
+			states = append(states, strings.ToUpper(state))
+		}
+		return append(append([]string{"-m", "conntrack"}, not...), "--ctstate", strings.Join(states, ",")), nil
+	}
+	return nil, errors.Errorf("nftables: unsupported match %v", match)
+}
+
+// mangleSpec translates the statements setting the connection mark, or the packet mark from it, to CONNMARK
+func mangleSpec(mangle map[string]interface{}) ([]string, error) {
+	key := nftObject(mangle["key"])
+	value := mangle["value"]
+	if _, ok := key["meta"]; ok {
+		return restoreMarkSpec(value)
+	}
+	if mark, ok := value.(float64); ok {
+		return []string{"-j", "CONNMARK", "--set-mark", fmt.Sprintf("%#x", uint32(mark))}, nil
+	}
+	for operator, option := range map[string]string{"|": "--set-mark", "^": "--set-xmark"} {
+		operands, ok := nftObject(value)[operator].([]interface{})
+		if !ok || len(operands) != 2 {
+			continue
+		}
+		and, ok := nftObject(operands[0])["&"].([]interface{})
+		if !ok || len(and) != 2 {
+			continue
+		}
+		return []string{"-j", "CONNMARK", option,
+			fmt.Sprintf("%#x/%#x", nftNumber(operands[1]), ^uint32(nftNumber(and[1])))}, nil
+	}
+	return nil, errors.Errorf("nftables: unsupported connection mark %v", value)
+}
+
+// restoreMarkSpec translates the packet mark restored from the connection mark to CONNMARK --restore-mark, the value
+// being meta mark & ~nfmask | ct mark & ctmask, without the masks that are all ones
+func restoreMarkSpec(value interface{}) ([]string, error) {
+	nfmask, ctmask := uint32(0xffffffff), uint32(0xffffffff)
+	if or, ok := nftObject(value)["|"].([]interface{}); ok && len(or) == 2 {
+		and, ok := nftObject(or[0])["&"].([]interface{})
+		if !ok || len(and) != 2 || nftObject(and[0])["meta"] == nil {
+			return nil, errors.Errorf("nftables: unsupported packet mark %v", value)
+		}
+		nfmask, value = ^uint32(nftNumber(and[1])), or[1]
+	}
+	if and, ok := nftObject(value)["&"].([]interface{}); ok && len(and) == 2 {
+		ctmask, value = uint32(nftNumber(and[1])), and[0]
+	}
+	if _, ok := nftObject(value)["ct"]; !ok {
+		return nil, errors.Errorf("nftables: unsupported packet mark %v", value)
+	}
+	switch {
+	case nfmask == 0xffffffff && ctmask == 0xffffffff:
+		return []string{"-j", "CONNMARK", "--restore-mark"}, nil
+	case nfmask == ctmask:
+		return []string{"-j", "CONNMARK", "--restore-mark", "--mask", fmt.Sprintf("%#x", nfmask)}, nil
+	default:
+		return []string{"-j", "CONNMARK", "--restore-mark", "--nfmask", fmt.Sprintf("%#x", nfmask), "--ctmask",
+			fmt.Sprintf("%#x", ctmask)}, nil
+	}
+}
+
+// nftFlagsSpec translates the flags of SNAT and MASQUERADE
+func nftFlagsSpec(flags interface{}) []string {
+	var words []string
+	for _, flag := range nftStrings(flags) {
+		switch flag {
+		case "random":
+			words = append(words, "--random")
+		case "fully-random":
+			words = append(words, "--random-fully")
+		}
+	}
+	return words
+}
+
+// nftStrings returns the strings of a value nft lists as a string when there is one, and as an array otherwise
+func nftStrings(value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var strs []string
+		for _, item := range value {
+			strs = append(strs, fmt.Sprint(item))
+		}
+		return strs
+	}
+	return nil
+}
+
+// nftNumber returns the number of a decoded JSON value, 0 if it is not one
+func nftNumber(value interface{}) uint64 {
+	number, _ := value.(float64)
+	return uint64(number)
+}
+
+// nftObject returns the fields of a decoded JSON object, nil if it is not one
+func nftObject(value interface{}) map[string]interface{} {
+	object, _ := value.(map[string]interface{})
+	return object
+}
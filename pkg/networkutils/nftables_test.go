@@ -0,0 +1,497 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/capabilities"
+)
+
+// The nftables backend runs the iptables suite against fakeNFT
+func init() {
+	iptablesBackends = append(iptablesBackends, iptablesBackend{name: "nftables", new: func(t *testing.T) (iptablesIface, func()) {
+		n := newNFTables(iptables.ProtocolIPv4)
+		n.run = newFakeNFT().run
+		return n, func() {}
+	}})
+}
+
+// fakeNFT runs the nft commands of the nftables backend against tables in memory. Like nft, it lists single flags as a
+// string, reports the counters of the rules, and fails on missing tables, chains and jump targets.
+type fakeNFT struct {
+	tables map[string]*fakeNFTTable
+	// counters are the counters listed for the rules with the comment
+	counters map[string]uint64
+}
+
+type fakeNFTTable struct {
+	chains     []string
+	rules      map[string][]map[string]interface{}
+	nextHandle int
+}
+
+func newFakeNFT() *fakeNFT {
+	return &fakeNFT{tables: make(map[string]*fakeNFTTable), counters: make(map[string]uint64)}
+}
+
+var errFakeNFTNotFound = errors.New("Error: No such file or directory")
+
+func (f *fakeNFT) table(object map[string]interface{}) (*fakeNFTTable, error) {
+	name, ok := object["table"]
+	if !ok {
+		name = object["name"]
+	}
+	table, ok := f.tables[fmt.Sprintf("%v %v", object["family"], name)]
+	if !ok {
+		return nil, errFakeNFTNotFound
+	}
+	return table, nil
+}
+
+func (f *fakeNFT) chain(object map[string]interface{}, field string) (*fakeNFTTable, string, error) {
+	table, err := f.table(object)
+	if err != nil {
+		return nil, "", err
+	}
+	chain := fmt.Sprint(object[field])
+	if _, ok := table.rules[chain]; !ok {
+		return nil, "", errFakeNFTNotFound
+	}
+	return table, chain, nil
+}
+
+func (f *fakeNFT) run(input []byte, args ...string) ([]byte, error) {
+	if len(args) == 3 && args[1] == "-f" {
+		var batch struct {
+			Nftables []map[string]map[string]map[string]interface{} `json:"nftables"`
+		}
+		if err := json.Unmarshal(input, &batch); err != nil {
+			return nil, err
+		}
+		// nft applies a batch as one transaction, the fake checks every command would succeed but does not roll back
+		for _, command := range batch.Nftables {
+			for verb, objects := range command {
+				for kind, object := range objects {
+					if err := f.apply(verb, kind, object); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		return nil, nil
+	}
+	var objects []interface{}
+	switch {
+	case len(args) == 6 && args[2] == "chain":
+		table, chain, err := f.chain(map[string]interface{}{"family": args[3], "table": args[4], "name": args[5]}, "name")
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, map[string]interface{}{"chain": map[string]interface{}{"name": chain}})
+		for _, rule := range table.rules[chain] {
+			objects = append(objects, map[string]interface{}{"rule": f.listed(rule)})
+		}
+	case len(args) == 5 && args[2] == "table":
+		table, err := f.table(map[string]interface{}{"family": args[3], "name": args[4]})
+		if err != nil {
+			return nil, err
+		}
+		for _, chain := range table.chains {
+			objects = append(objects, map[string]interface{}{"chain": map[string]interface{}{"name": chain}})
+		}
+	default:
+		return nil, fmt.Errorf("unexpected nft %s", strings.Join(args, " "))
+	}
+	return json.Marshal(map[string]interface{}{"nftables": objects})
+}
+
+// listed returns the rule as nft lists it
+func (f *fakeNFT) listed(rule map[string]interface{}) map[string]interface{} {
+	data, _ := json.Marshal(rule)
+	data = []byte(strings.Replace(string(data), `"flags":["daddr"]`, `"flags":"daddr"`, -1))
+	packets := f.counters[fmt.Sprint(rule["comment"])]
+	data = []byte(strings.Replace(string(data), `"counter":null`,
+		fmt.Sprintf(`"counter":{"packets":%d,"bytes":%d}`, packets, packets*100), -1))
+	var listed map[string]interface{}
+	_ = json.Unmarshal(data, &listed)
+	return listed
+}
+
+func (f *fakeNFT) apply(verb, kind string, object map[string]interface{}) error {
+	switch verb + " " + kind {
+	case "add table":
+		key := fmt.Sprintf("%v %v", object["family"], object["name"])
+		if _, ok := f.tables[key]; !ok {
+			f.tables[key] = &fakeNFTTable{rules: make(map[string][]map[string]interface{}), nextHandle: 1}
+		}
+	case "add chain":
+		table, err := f.table(object)
+		if err != nil {
+			return err
+		}
+		name := fmt.Sprint(object["name"])
+		if _, ok := table.rules[name]; !ok {
+			table.chains = append(table.chains, name)
+			table.rules[name] = nil
+		}
+	case "flush chain":
+		table, chain, err := f.chain(object, "name")
+		if err != nil {
+			return err
+		}
+		table.rules[chain] = nil
+	case "delete chain":
+		table, chain, err := f.chain(object, "name")
+		if err != nil {
+			return err
+		}
+		if len(table.rules[chain]) > 0 {
+			return errors.New("Error: Device or resource busy")
+		}
+		delete(table.rules, chain)
+		for i, name := range table.chains {
+			if name == chain {
+				table.chains = append(table.chains[:i], table.chains[i+1:]...)
+				break
+			}
+		}
+	case "add rule", "insert rule":
+		table, chain, err := f.chain(object, "chain")
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(object["expr"])
+		for _, target := range strings.Split(string(data), `"jump":{"target":"`)[1:] {
+			if _, ok := table.rules[strings.SplitN(target, `"`, 2)[0]]; !ok {
+				return errFakeNFTNotFound
+			}
+		}
+		rule := map[string]interface{}{"handle": table.nextHandle, "expr": object["expr"]}
+		if comment, ok := object["comment"]; ok {
+			rule["comment"] = comment
+		}
+		table.nextHandle++
+		rules := table.rules[chain]
+		pos := len(rules)
+		if verb == "insert" {
+			pos = 0
+		}
+		if handle, ok := object["handle"]; ok {
+			pos = -1
+			for i, existing := range rules {
+				if fmt.Sprint(existing["handle"]) == fmt.Sprint(handle) {
+					pos = i
+				}
+			}
+			if pos < 0 {
+				return errFakeNFTNotFound
+			}
+		}
+		table.rules[chain] = append(rules[:pos:pos], append([]map[string]interface{}{rule}, rules[pos:]...)...)
+	case "delete rule":
+		table, chain, err := f.chain(object, "chain")
+		if err != nil {
+			return err
+		}
+		for i, rule := range table.rules[chain] {
+			if fmt.Sprint(rule["handle"]) == fmt.Sprint(object["handle"]) {
+				table.rules[chain] = append(table.rules[chain][:i], table.rules[chain][i+1:]...)
+				return nil
+			}
+		}
+		return errFakeNFTNotFound
+	default:
+		return fmt.Errorf("unexpected nft command %s %s", verb, kind)
+	}
+	return nil
+}
+
+func newTestNFTables() (*nftables, *fakeNFT) {
+	fake := newFakeNFT()
+	n := newNFTables(iptables.ProtocolIPv4)
+	n.run = fake.run
+	return n, fake
+}
+
+func TestNFTablesRuleRoundTrip(t *testing.T) {
+	n, _ := newTestNFTables()
+	rules := buildHostRules(hostRulesConfig{
+		vpcCIDR:                testENIPrefix,
+		vpcCIDRs:               testPrefixes("10.10.0.0/16"),
+		excludeSNATCIDRs:       testPrefixes("10.12.0.0/16"),
+		unmanagedInterfaces:    []string{"eth9"},
+		primaryAddr:            testENIAddr,
+		primaryIntf:            "eth0",
+		vethPattern:            "eni+",
+		mainENIMark:            defaultConnmark,
+		snatStrategy:           randomPRNGSNAT{},
+		hasRandomFully:         true,
+		nodePortSupportEnabled: true,
+		ipvs:                   true,
+		firewallSymmetry:       true,
+	})
+	var ruleSpecs [][]string
+	for _, rule := range append(rules.snatRules, rules.otherRules...) {
+		ruleSpecs = append(ruleSpecs, rule.rule)
+	}
+	ruleSpecs = append(ruleSpecs, dropTracingRules("eni+", defaultDropLogRate)...)
+	ruleSpecs = append(ruleSpecs, firewallMarkRule("eth1", 2), egressGatewayRule("10.10.1.5"),
+		[]string{"-j", "CONNMARK", "--set-xmark", "0x80/0x80"}, []string{"-j", "CONNMARK", "--restore-mark"})
+
+	for _, ruleSpec := range ruleSpecs {
+		canonical, err := n.canonical(ruleSpec)
+		if assert.NoError(t, err, "%v", ruleSpec) {
+			assert.True(t, sameRuleSpec(ruleSpec, canonical), "%v is listed as %v", ruleSpec, canonical)
+		}
+	}
+}
+
+func TestNFTablesRuleExprs(t *testing.T) {
+	n, _ := newTestNFTables()
+	exprs, comment, err := n.ruleExprs([]string{"-m", "comment", "--comment", "AWS, primary ENI", "-i", "eni+",
+		"-j", "CONNMARK", "--set-mark", "0x80/0x80"})
+	require.NoError(t, err)
+	assert.Equal(t, "AWS, primary ENI", comment)
+	data, err := json.Marshal(exprs)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"match": {"op": "==", "left": {"meta": {"key": "iifname"}}, "right": "eni*"}},
+		{"counter": null},
+		{"mangle": {"key": {"ct": {"key": "mark"}}, "value": {"|": [{"&": [{"ct": {"key": "mark"}}, 4294967167]}, 128]}}}
+	]`, string(data))
+
+	for _, ruleSpec := range [][]string{
+		{"-p", "tcp", "-j", "ACCEPT"},
+		{"-m", "mark", "--mark", "0x80", "-j", "ACCEPT"},
+		{"-j", "TPROXY", "--tproxy-mark", "0x1/0x1"},
+		{"-j", "SNAT", "--to-source"},
+	} {
+		_, _, err := n.ruleExprs(ruleSpec)
+		assert.Error(t, err, "%v", ruleSpec)
+	}
+}
+
+// evalNFTMark evaluates the value of a statement setting a mark, from the packet and connection marks
+func evalNFTMark(t *testing.T, value interface{}, packetMark, connMark uint32) uint32 {
+	switch value := value.(type) {
+	case float64:
+		return uint32(value)
+	case map[string]interface{}:
+		if key, ok := value["meta"]; ok {
+			assert.Equal(t, "mark", nftObject(key)["key"])
+			return packetMark
+		}
+		if key, ok := value["ct"]; ok {
+			assert.Equal(t, "mark", nftObject(key)["key"])
+			return connMark
+		}
+		if operands, ok := value["&"].([]interface{}); ok {
+			return evalNFTMark(t, operands[0], packetMark, connMark) & evalNFTMark(t, operands[1], packetMark, connMark)
+		}
+		if operands, ok := value["|"].([]interface{}); ok {
+			return evalNFTMark(t, operands[0], packetMark, connMark) | evalNFTMark(t, operands[1], packetMark, connMark)
+		}
+	}
+	t.Fatalf("unexpected mark expression %v", value)
+	return 0
+}
+
+func TestNFTablesRestoreMark(t *testing.T) {
+	n, _ := newTestNFTables()
+	const kubeProxyMark = 0x4000
+	for _, tc := range []struct {
+		ruleSpec   []string
+		packetMark uint32
+		connMark   uint32
+		want       uint32
+	}{
+		// The bits of the packet mark outside of the mask are kept, like with iptables
+		{[]string{"-j", "CONNMARK", "--restore-mark", "--mask", "0x80"}, kubeProxyMark, 0x80, kubeProxyMark | 0x80},
+		{[]string{"-j", "CONNMARK", "--restore-mark", "--mask", "0x80"}, kubeProxyMark | 0x80, 0x1, kubeProxyMark},
+		{[]string{"-j", "CONNMARK", "--restore-mark", "--nfmask", "0xff", "--ctmask", "0xf"}, kubeProxyMark | 0xf0,
+			0x3f, kubeProxyMark | 0xf},
+		{[]string{"-j", "CONNMARK", "--restore-mark"}, kubeProxyMark, 0x80, 0x80},
+	} {
+		exprs, _, err := n.ruleExprs(tc.ruleSpec)
+		require.NoError(t, err, "%v", tc.ruleSpec)
+		data, err := json.Marshal(exprs[len(exprs)-1])
+		require.NoError(t, err)
+		var statement map[string]interface{}
+		require.NoError(t, json.Unmarshal(data, &statement))
+		mangle := nftObject(statement["mangle"])
+		assert.Equal(t, "mark", nftObject(nftObject(mangle["key"])["meta"])["key"])
+		assert.Equal(t, tc.want, evalNFTMark(t, mangle["value"], tc.packetMark, tc.connMark), "%v", tc.ruleSpec)
+
+		canonical, err := n.canonical(tc.ruleSpec)
+		if assert.NoError(t, err, "%v", tc.ruleSpec) {
+			assert.Equal(t, tc.ruleSpec, canonical)
+		}
+	}
+}
+
+func TestNFTablesChains(t *testing.T) {
+	n, _ := newTestNFTables()
+
+	chains, err := n.ListChains("nat")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"PREROUTING", "INPUT", "OUTPUT", "POSTROUTING"}, chains)
+	exists, err := n.Exists("nat", snatChain, "-j", "RETURN")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, n.NewChain("nat", snatChain))
+	err = n.NewChain("nat", snatChain)
+	assert.True(t, containChainExistErr(err))
+	// The jump target must exist
+	assert.Error(t, n.Append("nat", "POSTROUTING", "-j", "AWS-MISSING"))
+	require.NoError(t, n.Append("nat", "POSTROUTING", snatChainJumpRule...))
+	require.NoError(t, n.Append("nat", snatChain, "-d", "10.10.0.0/16", "-j", "RETURN"))
+	require.NoError(t, n.Insert("nat", snatChain, 1, "-d", "10.12.0.1", "-j", "RETURN"))
+	require.NoError(t, n.Insert("nat", snatChain, 3, "-j", "MASQUERADE"))
+	assert.Error(t, n.Insert("nat", snatChain, 5, "-j", "MASQUERADE"))
+
+	rules, err := n.List("nat", snatChain)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"-N AWS-SNAT-CHAIN-0",
+		"-A AWS-SNAT-CHAIN-0 -d 10.12.0.1/32 -j RETURN",
+		"-A AWS-SNAT-CHAIN-0 -d 10.10.0.0/16 -j RETURN",
+		"-A AWS-SNAT-CHAIN-0 -j MASQUERADE",
+	}, rules)
+	rules, err = n.List("nat", "POSTROUTING")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"-P POSTROUTING ACCEPT",
+		`-A POSTROUTING -m comment --comment "AWS SNAT CHAIN" -j AWS-SNAT-CHAIN-0`,
+	}, rules)
+
+	chains, err = n.ListChains("nat")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"PREROUTING", "INPUT", "OUTPUT", "POSTROUTING", snatChain}, chains)
+
+	require.NoError(t, n.Delete("nat", snatChain, "-d", "10.12.0.1/32", "-j", "RETURN"))
+	assert.Error(t, n.Delete("nat", snatChain, "-d", "10.12.0.1/32", "-j", "RETURN"))
+	// The chain is still jumped to
+	require.NoError(t, n.Delete("nat", "POSTROUTING", snatChainJumpRule...))
+	require.NoError(t, n.ClearChain("nat", snatChain))
+	require.NoError(t, n.DeleteChain("nat", snatChain))
+	chains, err = n.ListChains("nat")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"PREROUTING", "INPUT", "OUTPUT", "POSTROUTING"}, chains)
+}
+
+func TestNFTablesDropCounts(t *testing.T) {
+	n, fake := newTestNFTables()
+	require.NoError(t, n.NewChain("mangle", dropTracingChain))
+	for _, rule := range dropTracingRules("eni+", defaultDropLogRate) {
+		require.NoError(t, n.Append("mangle", dropTracingChain, rule...))
+	}
+	fake.counters[dropCommentPrefix+DropReasonRPFilter] = 3
+	fake.counters[dropCommentPrefix+DropReasonInvalidState] = 2
+
+	rules, err := n.ListWithCounters("mangle", dropTracingChain)
+	require.NoError(t, err)
+	counts, err := parseDropCounts(rules)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), counts[DropReasonRPFilter])
+	// Both rules counting invalid packets
+	assert.Equal(t, uint64(4), counts[DropReasonInvalidState])
+}
+
+func TestUseNFTables(t *testing.T) {
+	probed := false
+	caps := func(c capabilities.Capabilities) func() capabilities.Capabilities {
+		return func() capabilities.Capabilities {
+			probed = true
+			return c
+		}
+	}
+	nftOnly := capabilities.Capabilities{NftPresent: true}
+	both := capabilities.Capabilities{NftPresent: true, IptablesVersion: "1.8.4"}
+
+	assert.True(t, useNFTables(nftModeOn, caps(both)))
+	assert.False(t, useNFTables(nftModeOff, caps(nftOnly)))
+	assert.False(t, useNFTables("", caps(nftOnly)))
+	assert.False(t, probed)
+	assert.True(t, useNFTables(nftModeAuto, caps(nftOnly)))
+	assert.False(t, useNFTables(nftModeAuto, caps(both)))
+	assert.False(t, useNFTables(nftModeAuto, caps(capabilities.Capabilities{})))
+}
+
+func TestDeleteOtherBackendRules(t *testing.T) {
+	other := newMockIptables()
+	require.NoError(t, other.NewChain("nat", "AWS-SNAT-CHAIN-0"))
+	require.NoError(t, other.NewChain("nat", "AWS-SNAT-CHAIN-1"))
+	require.NoError(t, other.Append("nat", "AWS-SNAT-CHAIN-0", "-m", "comment", "--comment", "AWS SNAT CHAIN", "-j",
+		"AWS-SNAT-CHAIN-1"))
+	require.NoError(t, other.Append("nat", "AWS-SNAT-CHAIN-1", "-m", "comment", "--comment", "AWS, SNAT", "-j",
+		"MASQUERADE"))
+	kubeProxyRule := []string{"-m", "comment", "--comment", "kubernetes postrouting rules", "-j", "MASQUERADE"}
+	require.NoError(t, other.Append("nat", "POSTROUTING", kubeProxyRule...))
+	require.NoError(t, other.Append("nat", "POSTROUTING", snatChainJumpRule...))
+	istioRule := []string{"-i", "eni+", "-j", "CONNMARK", "--restore-mark", "--mask", "0xf00"}
+	require.NoError(t, other.Append("mangle", "PREROUTING", istioRule...))
+	require.NoError(t, other.Append("mangle", "PREROUTING", "-m", "comment", "--comment", "AWS, primary ENI", "-i",
+		"eni+", "-j", "CONNMARK", "--restore-mark", "--mask", "0x80"))
+
+	var ipv6 []bool
+	ln := &linuxNetwork{newOtherBackend: func(v6 bool) (iptablesIface, error) {
+		ipv6 = append(ipv6, v6)
+		return other, nil
+	}}
+	require.NoError(t, ln.deleteOtherBackendRules(false))
+	assert.Equal(t, []bool{false}, ipv6)
+	assert.Equal(t, [][]string{kubeProxyRule}, other.Tables["nat"]["POSTROUTING"])
+	assert.Equal(t, [][]string{istioRule}, other.Tables["mangle"]["PREROUTING"])
+	assert.NotContains(t, other.Tables["nat"], "AWS-SNAT-CHAIN-0")
+	assert.NotContains(t, other.Tables["nat"], "AWS-SNAT-CHAIN-1")
+
+	// Nothing to do when the other backend is not on the node
+	ln.newOtherBackend = func(bool) (iptablesIface, error) { return nil, nil }
+	assert.NoError(t, ln.deleteOtherBackendRules(true))
+}
+
+func TestNFTIgnoresRulePositionAndCheck(t *testing.T) {
+	ipt := newMockIptables()
+	require.NoError(t, ipt.NewChain("nat", snatChain))
+	require.NoError(t, ipt.Append("nat", "POSTROUTING", "-j", "MASQUERADE"))
+	ln := &linuxNetwork{
+		iptablesRulePosition: iptablesRuleInsert,
+		iptablesCheck:        iptablesCheckRepair,
+		nftMode:              nftModeOn,
+		newIptables: func() (iptablesIface, error) {
+			return ipt, nil
+		},
+	}
+	assert.Equal(t, iptablesRuleAppendNew, ln.rulePosition())
+	result, err := ln.CheckSNATRules()
+	assert.NoError(t, err)
+	assert.Empty(t, result.Problems)
+	assert.Equal(t, [][]string{{"-j", "MASQUERADE"}}, ipt.Tables["nat"]["POSTROUTING"])
+
+	ln.nftMode = nftModeOff
+	assert.Equal(t, iptablesRuleInsert, ln.rulePosition())
+	result, err = ln.CheckSNATRules()
+	assert.NoError(t, err)
+	assert.True(t, result.Repaired)
+}
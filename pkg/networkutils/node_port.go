@@ -0,0 +1,126 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"os"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// envNodePortInterfaces is the name of the environment variable that lists the interfaces whose incoming connections
+	// to the node are marked for node port support, so that their replies are routed with the main route table.
+	// nodePortPrimaryInterface stands for the primary interface, whatever its name. Defaults to
+	// nodePortPrimaryInterface.
+	envNodePortInterfaces = "AWS_VPC_K8S_CNI_NODE_PORT_INTERFACES"
+
+	nodePortPrimaryInterface = "primary"
+
+	// nodePortComment and nodePortIPVSComment are the comments of the rules that mark the connections of node ports
+	nodePortComment     = "AWS, primary ENI"
+	nodePortIPVSComment = "AWS, primary ENI IPVS"
+)
+
+func getNodePortInterfaces() []string {
+	var ifaces []string
+	for _, iface := range strings.Split(os.Getenv(envNodePortInterfaces), ",") {
+		iface = strings.TrimSpace(iface)
+		if iface != "" && !containsString(ifaces, iface) {
+			ifaces = append(ifaces, iface)
+		}
+	}
+	if len(ifaces) == 0 {
+		return []string{nodePortPrimaryInterface}
+	}
+	return ifaces
+}
+
+// resolveNodePortInterfaces returns the names of the interfaces whose connections are marked for node port support.
+// Unmanaged interfaces are left alone, since the CNI does not own their traffic.
+func (n *linuxNetwork) resolveNodePortInterfaces(primaryIntf string) []string {
+	selected := n.nodePortInterfaces
+	if len(selected) == 0 {
+		selected = []string{nodePortPrimaryInterface}
+	}
+	var ifaces []string
+	for _, iface := range selected {
+		if iface == nodePortPrimaryInterface {
+			iface = primaryIntf
+		}
+		if isUnmanagedInterface(iface, n.unmanagedInterfaces) {
+			log.Warnf("Ignoring %s in %s, it is listed in %s", iface, envNodePortInterfaces, envUnmanagedInterfaces)
+			continue
+		}
+		if !containsString(ifaces, iface) {
+			ifaces = append(ifaces, iface)
+		}
+	}
+	return ifaces
+}
+
+// isConnmarkRule returns whether the mangle PREROUTING rule is one of the host rules that set or restore a connection
+// mark on an interface: the marks of node ports, and the restores of that mark and of the firewall symmetry mark on
+// the interfaces of the pods
+func isConnmarkRule(ruleSpec []string) bool {
+	comment, connmark := "", false
+	for i, item := range ruleSpec {
+		switch item {
+		case "--comment":
+			if i+1 < len(ruleSpec) {
+				comment = ruleSpec[i+1]
+			}
+		case "--set-mark", "--restore-mark":
+			connmark = true
+		}
+	}
+	if !connmark {
+		return false
+	}
+	switch comment {
+	case nodePortComment, nodePortIPVSComment, firewallComment:
+		return true
+	}
+	return false
+}
+
+// deleteStaleConnmarkRules deletes the connection mark rules of interfaces that are no longer selected, or of an older
+// pod interface pattern, which the host rules do not know about anymore
+func deleteStaleConnmarkRules(ipt iptablesIface, hostRules hostRules) error {
+	ruleSpecs, err := listRuleSpecs(ipt, "mangle", "PREROUTING")
+	if err != nil {
+		return errors.Wrap(err, "host network setup")
+	}
+	for _, ruleSpec := range ruleSpecs {
+		if !isConnmarkRule(ruleSpec) || isDesiredRule(hostRules.otherRules, ruleSpec) {
+			continue
+		}
+		log.Infof("Deleting stale connmark rule %v", ruleSpec)
+		if err := ipt.Delete("mangle", "PREROUTING", ruleSpec...); err != nil {
+			return errors.Wrapf(err, "host network setup: failed to delete stale connmark rule %v", ruleSpec)
+		}
+	}
+	return nil
+}
+
+func isDesiredRule(rules []iptablesRule, ruleSpec []string) bool {
+	for _, rule := range rules {
+		if rule.shouldExist && sameRuleSpec(rule.rule, ruleSpec) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GetNUMANode returns the NUMA node of the network card of the interface with the given MAC address, -1 if the kernel
+// does not know it, e.g. on instances with a single NUMA node
+func (n *linuxNetwork) GetNUMANode(mac string) (int, error) {
+	name, err := n.GetInterfaceName(mac)
+	if err != nil {
+		return -1, err
+	}
+	return readNUMANode(sysClassNet, name)
+}
+
+// readNUMANode reads the NUMA node of the device of the interface in the sysfs root
+func readNUMANode(root, iface string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(root, iface, "device", "numa_node"))
+	if os.IsNotExist(err) {
+		// A virtual interface has no device
+		return -1, nil
+	}
+	if err != nil {
+		return -1, errors.Wrapf(err, "failed to read the NUMA node of %s", iface)
+	}
+	node, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1, errors.Wrapf(err, "invalid NUMA node of %s", iface)
+	}
+	return node, nil
+}
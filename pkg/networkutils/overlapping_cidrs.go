@@ -0,0 +1,53 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"net/netip"
+	"os"
+	"strings"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/cidr"
+)
+
+// envOverlappingCIDRs is the name of the environment variable that holds a comma separated list of IPv4 CIDRs of the
+// VPC, or excluded from SNAT, that also exist on the other side of a hybrid network, e.g. on premises. Traffic of pods
+// to them is always SNATed to the primary IP of the node and leaves through the primary ENI, like traffic leaving the
+// VPC, instead of being routed through the ENI of the pod with the address of the pod. Defaults to empty.
+const envOverlappingCIDRs = "AWS_VPC_K8S_CNI_OVERLAPPING_CIDRS"
+
+func getOverlappingCIDRs() []netip.Prefix {
+	var cidrs []netip.Prefix
+	for _, item := range strings.Split(os.Getenv(envOverlappingCIDRs), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, err := cidr.Parse(item)
+		if err != nil || !prefix.Addr().Is4() {
+			log.Errorf("getOverlappingCIDRs : ignoring %v is not a valid IPv4 CIDR", item)
+			continue
+		}
+		cidrs = append(cidrs, prefix)
+	}
+	return cidrs
+}
+
+// RemoveOverlappingCIDRs returns the parts of the CIDRs that are not in AWS_VPC_K8S_CNI_OVERLAPPING_CIDRS, which the
+// traffic of pods is routed to directly and not SNATed for
+func RemoveOverlappingCIDRs(cidrs []netip.Prefix) []netip.Prefix {
+	return cidr.SubtractAll(cidrs, getOverlappingCIDRs())
+}
@@ -0,0 +1,32 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+const (
+	// envPodENI is the name of the environment variable that gives the pods annotated with
+	// vpc.amazonaws.com/pod-security-groups a branch ENI of the trunk ENI of the node, with their own security groups.
+	// The traffic of these pods goes through a VLAN interface of the trunk ENI instead of the ENIs of the other pods, and
+	// is not SNATed on the node. Defaults to false, since the trunk ENI takes the slot of an ENI and reading the
+	// annotation costs a read of the pod from the API server on every ADD.
+	envPodENI = "AWS_VPC_K8S_CNI_POD_ENI"
+
+	// vlanInterfacePattern matches the VLAN interfaces the CNI plugin creates on the trunk ENI for the pods with a
+	// branch ENI
+	vlanInterfacePattern = "vlan+"
+)
+
+// PodENIEnabled returns whether pods can get a branch ENI with their own security groups
+func PodENIEnabled() bool {
+	return getBoolEnvVar(envPodENI, false)
+}
@@ -0,0 +1,286 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"encoding/csv"
+	"net/netip"
+	"os"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// envPodFlags is the name of the environment variable that holds the comma separated list of the experimental pod
+	// flags the node applies, out of PodFlags. Namespaces and pods turn them on with the
+	// vpc.amazonaws.com/experimental-flags annotation, the other flags of the annotation are ignored. Defaults to none,
+	// since reading the annotations costs a read of the namespace and of the pod from the API server on every ADD.
+	envPodFlags = "AWS_VPC_K8S_CNI_POD_FLAGS"
+
+	// envPodSNATExclusions is the name of the environment variable that makes the node read the
+	// vpc.amazonaws.com/snat-exclude annotation of namespaces and pods, which keeps the traffic of their pods leaving
+	// the VPC from being SNATed on the node, like the no-snat pod flag. Unlike AWS_VPC_K8S_CNI_EXTERNALSNAT, the other
+	// pods are still SNATed. Defaults to false, since reading the annotations costs a read of the namespace and of the
+	// pod from the API server on every ADD.
+	envPodSNATExclusions = "AWS_VPC_K8S_CNI_SNAT_EXCLUSION_ANNOTATIONS"
+
+	// podFlagsChain is the chain holding the rules of the pods with flags, in the nat table for PodFlagNoSNAT and in the
+	// filter table for PodFlagMetadataBlock
+	podFlagsChain = "AWS-POD-FLAGS"
+
+	podNoSNATComment        = "AWS, POD NO SNAT"
+	podNoSNATVPCComment     = "AWS, POD NO SNAT VPC"
+	podMetadataBlockComment = "AWS, POD METADATA BLOCK"
+
+	// instanceMetadataIP is the IPv4 address of the instance metadata service
+	instanceMetadataIP = "169.254.169.254/32"
+)
+
+// The experimental pod flags
+const (
+	// PodFlagNoSNAT keeps the traffic of the pod leaving the VPC from being SNATed on the node
+	PodFlagNoSNAT = "no-snat"
+	// PodFlagMTU sets the MTU of the interface of the pod, at most the MTU of the node
+	PodFlagMTU = "mtu"
+	// PodFlagDedicatedENI gives the pod a secondary ENI no other pod uses
+	PodFlagDedicatedENI = "dedicated-eni"
+	// PodFlagMetadataBlock drops the traffic of the pod to the instance metadata service
+	PodFlagMetadataBlock = "metadata-block"
+)
+
+// PodFlags are the experimental pod flags, in the order they are applied and reported
+var PodFlags = []string{PodFlagNoSNAT, PodFlagMTU, PodFlagDedicatedENI, PodFlagMetadataBlock}
+
+// AllowedPodFlags returns the experimental pod flags the node applies, in the order of PodFlags
+func AllowedPodFlags() []string {
+	listed := make(map[string]bool)
+	for _, item := range strings.Split(os.Getenv(envPodFlags), ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		if !isPodFlag(item) {
+			log.Errorf("Ignoring unknown pod flag %q of %s, valid flags: %s", item, envPodFlags, strings.Join(PodFlags, ","))
+			continue
+		}
+		listed[item] = true
+	}
+	var flags []string
+	for _, flag := range PodFlags {
+		if listed[flag] {
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
+
+// SNATExclusionAnnotationsEnabled returns whether the SNAT exclusion annotations of namespaces and pods apply
+func SNATExclusionAnnotationsEnabled() bool {
+	return getBoolEnvVar(envPodSNATExclusions, false)
+}
+
+func isPodFlag(name string) bool {
+	for _, flag := range PodFlags {
+		if flag == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidPodMTU returns whether the MTU of the interface of a pod can be set to mtu, which must not exceed the MTU of the
+// interfaces of the other pods
+func ValidPodMTU(mtu int) bool {
+	return mtu >= minimumMTU && mtu <= GetEthernetMTU()
+}
+
+func (n *linuxNetwork) podFlagAllowed(flag string) bool {
+	for _, allowed := range n.podFlags {
+		if allowed == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// podNoSNATEnabled returns whether pods can be kept from being SNATed, by the no-snat flag or by an annotation
+func (n *linuxNetwork) podNoSNATEnabled() bool {
+	return n.podFlagAllowed(PodFlagNoSNAT) || n.podSNATExclusions
+}
+
+// podNoSNATRule is the rule of the nat podFlagsChain that stops the nat table for the traffic of the pod
+func podNoSNATRule(podIP string) []string {
+	return []string{"-s", podIP + "/32", "-m", "comment", "--comment", podNoSNATComment, "-j", "ACCEPT"}
+}
+
+// podMetadataBlockRule is the rule of the filter podFlagsChain that drops the traffic of the pod to the instance
+// metadata service
+func podMetadataBlockRule(podIP string) []string {
+	return []string{"-s", podIP + "/32", "-d", instanceMetadataIP, "-m", "comment", "--comment", podMetadataBlockComment,
+		"-j", "DROP"}
+}
+
+// setupPodFlagChains (re)creates the chains holding the rules of the pods with flags, for the flags the node applies.
+// Like the rules of the pods with an egress gateway, the rules of the pods are kept across restarts of ipamd.
+func (n *linuxNetwork) setupPodFlagChains(ipt iptablesIface, vpcCIDRs []netip.Prefix) error {
+	// The traffic of the pods to the VPC goes on to the other rules, e.g. the masquerading of kube-proxy
+	var vpcRules [][]string
+	for _, cidr := range vpcCIDRs {
+		vpcRules = append(vpcRules, []string{"-d", cidr.String(), "-m", "comment", "--comment", podNoSNATVPCComment, "-j", "RETURN"})
+	}
+	// The traffic of the pods must leave the nat table before it reaches the tenant SNAT and the AWS SNAT chain
+	if err := setupPodFlagChain(ipt, "nat", "POSTROUTING", n.podNoSNATEnabled(), vpcRules); err != nil {
+		return err
+	}
+	return setupPodFlagChain(ipt, "filter", "FORWARD", n.podFlagAllowed(PodFlagMetadataBlock), nil)
+}
+
+// setupPodFlagChain (re)creates podFlagsChain in table with the given rules followed by the rules of the pods, and jumps
+// to it first from hook. It only removes the jump when the flags of the chain are not applied.
+func setupPodFlagChain(ipt iptablesIface, table, hook string, enabled bool, rules [][]string) error {
+	jumpRule := []string{"-m", "comment", "--comment", "AWS POD FLAGS", "-j", podFlagsChain}
+	if !enabled {
+		// Checking the rule fails if the chain was never created, in which case there is nothing to clean up
+		if exists, err := ipt.Exists(table, hook, jumpRule...); err == nil && exists {
+			if err := ipt.Delete(table, hook, jumpRule...); err != nil {
+				return errors.Wrapf(err, "host network setup: failed to delete %s pod flags rule", table)
+			}
+		}
+		return nil
+	}
+
+	if err := ipt.NewChain(table, podFlagsChain); err != nil && !containChainExistErr(err) {
+		return errors.Wrapf(err, "host network setup: failed to add %s chain %s", table, podFlagsChain)
+	}
+	exists, err := ipt.Exists(table, hook, jumpRule...)
+	if err != nil {
+		return errors.Wrapf(err, "host network setup: failed to check existence of %s pod flags rule", table)
+	}
+	podRules, err := listPodFlagRules(ipt, table)
+	if err != nil {
+		return err
+	}
+	if err := ipt.ClearChain(table, podFlagsChain); err != nil {
+		return errors.Wrapf(err, "host network setup: failed to clear %s chain %s", table, podFlagsChain)
+	}
+	for _, rule := range append(append([][]string{}, rules...), podRules...) {
+		if err := ipt.Append(table, podFlagsChain, rule...); err != nil {
+			return errors.Wrapf(err, "host network setup: failed to add %s rule to %s chain %s", rule, table, podFlagsChain)
+		}
+	}
+	if !exists {
+		log.Debugf("Setup Host Network: iptables -I %s 1 -t %s %s", hook, table, strings.Join(jumpRule, " "))
+		if err := ipt.Insert(table, hook, 1, jumpRule...); err != nil {
+			return errors.Wrapf(err, "host network setup: failed to add %s pod flags rule", table)
+		}
+	}
+	return nil
+}
+
+// listPodFlagRules returns the rules of the pods in the podFlagsChain of table
+func listPodFlagRules(ipt iptablesIface, table string) ([][]string, error) {
+	rules, err := ipt.List(table, podFlagsChain)
+	if err != nil {
+		return nil, errors.Wrapf(err, "host network setup: failed to list %s chain %s", table, podFlagsChain)
+	}
+	var podRules [][]string
+	for _, rule := range rules {
+		r := csv.NewReader(strings.NewReader(rule))
+		r.Comma = ' '
+		ruleSpec, err := r.Read()
+		if err != nil || len(ruleSpec) < 4 || ruleSpec[2] != "-s" {
+			continue
+		}
+		podRules = append(podRules, ruleSpec[2:])
+	}
+	return podRules, nil
+}
+
+// AddPodFlagRules adds the rules of the pod for its no-snat and metadata-block flags
+func (n *linuxNetwork) AddPodFlagRules(podIP string, noSNAT, blockMetadata bool) error {
+	if !noSNAT && !blockMetadata {
+		return nil
+	}
+	ipt, err := n.newIptables()
+	if err != nil {
+		return errors.Wrap(err, "AddPodFlagRules: failed to create iptables")
+	}
+	if noSNAT {
+		if err := addPodFlagRule(ipt, "nat", podNoSNATRule(podIP)); err != nil {
+			return err
+		}
+	}
+	if blockMetadata {
+		if err := addPodFlagRule(ipt, "filter", podMetadataBlockRule(podIP)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addPodFlagRule(ipt iptablesIface, table string, rule []string) error {
+	exists, err := ipt.Exists(table, podFlagsChain, rule...)
+	if err != nil {
+		return errors.Wrapf(err, "AddPodFlagRules: failed to check %s rule %s", table, rule)
+	}
+	if exists {
+		return nil
+	}
+	log.Infof("Adding %s pod flag rule %s", table, rule)
+	if err := ipt.Append(table, podFlagsChain, rule...); err != nil {
+		return errors.Wrapf(err, "AddPodFlagRules: failed to add %s rule %s", table, rule)
+	}
+	return nil
+}
+
+// DelPodFlagRules removes the rules of the pod for its flags, if it has any
+func (n *linuxNetwork) DelPodFlagRules(podIP string) error {
+	noSNAT := n.podNoSNATEnabled()
+	blockMetadata := n.podFlagAllowed(PodFlagMetadataBlock)
+	if !noSNAT && !blockMetadata {
+		return nil
+	}
+	ipt, err := n.newIptables()
+	if err != nil {
+		return errors.Wrap(err, "DelPodFlagRules: failed to create iptables")
+	}
+	if noSNAT {
+		if err := delPodFlagRule(ipt, "nat", podNoSNATRule(podIP)); err != nil {
+			return err
+		}
+	}
+	if blockMetadata {
+		if err := delPodFlagRule(ipt, "filter", podMetadataBlockRule(podIP)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func delPodFlagRule(ipt iptablesIface, table string, rule []string) error {
+	exists, err := ipt.Exists(table, podFlagsChain, rule...)
+	if err != nil {
+		return errors.Wrapf(err, "DelPodFlagRules: failed to check %s rule %s", table, rule)
+	}
+	if !exists {
+		return nil
+	}
+	log.Infof("Deleting %s pod flag rule %s", table, rule)
+	if err := ipt.Delete(table, podFlagsChain, rule...); err != nil {
+		return errors.Wrapf(err, "DelPodFlagRules: failed to delete %s rule %s", table, rule)
+	}
+	return nil
+}
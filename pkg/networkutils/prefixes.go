@@ -0,0 +1,56 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"net/netip"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/netlinkwrapper"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/cidr"
+)
+
+// ipv4PrefixRoute is the route of the main route table that drops the traffic to the addresses of a prefix that no pod
+// uses. Without it, this traffic would be sent back to the VPC, which routes it to the ENI of the prefix again, until its
+// TTL runs out. The host routes to the veths of the pods are more specific, so the traffic of pods is not affected.
+func ipv4PrefixRoute(prefix netip.Prefix) *netlink.Route {
+	return &netlink.Route{
+		Dst:   cidr.IPNet(prefix),
+		Table: unix.RT_TABLE_MAIN,
+		Type:  unix.RTN_BLACKHOLE,
+	}
+}
+
+// SetupIPv4PrefixRoute adds the route that drops the traffic to the unused addresses of an IPv4 prefix of an ENI
+func (n *linuxNetwork) SetupIPv4PrefixRoute(prefix netip.Prefix) error {
+	if err := n.netLink.RouteReplace(ipv4PrefixRoute(prefix)); err != nil {
+		return errors.Wrapf(err, "SetupIPv4PrefixRoute: failed to add the route of prefix %s", prefix)
+	}
+	log.Debugf("Added the blackhole route of prefix %s", prefix)
+	return nil
+}
+
+// DeleteIPv4PrefixRoute deletes the route of an IPv4 prefix that was unassigned from its ENI. A route that is already
+// gone is not an error.
+func (n *linuxNetwork) DeleteIPv4PrefixRoute(prefix netip.Prefix) error {
+	if err := n.regularNetLink().RouteDel(ipv4PrefixRoute(prefix)); err != nil && !netlinkwrapper.IsNotExistsError(err) {
+		return errors.Wrapf(err, "DeleteIPv4PrefixRoute: failed to delete the route of prefix %s", prefix)
+	}
+	log.Debugf("Deleted the blackhole route of prefix %s", prefix)
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+// SNATStrategy chooses the source ports of the connections translated by the rule that SNATs the traffic leaving the
+// VPC. The strategies are selected by name with AWS_VPC_K8S_CNI_RANDOMIZESNAT.
+type SNATStrategy interface {
+	// Name is the value of AWS_VPC_K8S_CNI_RANDOMIZESNAT that selects the strategy
+	Name() string
+	// RandomFully returns whether the strategy uses --random-fully, which iptables supports since 1.6.2
+	RandomFully() bool
+	// TargetOptions returns the options of the SNAT or MASQUERADE target of the rule
+	TargetOptions(hasRandomFully bool) []string
+}
+
+// sequentialSNAT keeps the source port when it is free, and takes the next free one otherwise
+type sequentialSNAT struct{}
+
+func (sequentialSNAT) Name() string { return "none" }
+
+func (sequentialSNAT) RandomFully() bool { return false }
+
+func (sequentialSNAT) TargetOptions(hasRandomFully bool) []string { return nil }
+
+// randomHashSNAT picks the source port with a hash of the connection, so that the ports of concurrent connections of
+// different pods to the same destination are less likely to collide
+type randomHashSNAT struct{}
+
+func (randomHashSNAT) Name() string { return "hashrandom" }
+
+func (randomHashSNAT) RandomFully() bool { return false }
+
+func (randomHashSNAT) TargetOptions(hasRandomFully bool) []string { return []string{"--random"} }
+
+// randomPRNGSNAT picks the source port with a pseudo random number, and falls back to randomHashSNAT with older
+// versions of iptables
+type randomPRNGSNAT struct{}
+
+func (randomPRNGSNAT) Name() string { return "prng" }
+
+func (randomPRNGSNAT) RandomFully() bool { return true }
+
+func (randomPRNGSNAT) TargetOptions(hasRandomFully bool) []string {
+	if !hasRandomFully {
+		return []string{"--random"}
+	}
+	return []string{"--random-fully"}
+}
+
+// defaultSNATStrategy is the strategy used when AWS_VPC_K8S_CNI_RANDOMIZESNAT is not set
+var defaultSNATStrategy SNATStrategy = randomHashSNAT{}
+
+// snatStrategies are the strategies by the values of AWS_VPC_K8S_CNI_RANDOMIZESNAT, including aliases
+var snatStrategies = map[string]SNATStrategy{
+	"default":      defaultSNATStrategy,
+	"hashrandom":   randomHashSNAT{},
+	"prng":         randomPRNGSNAT{},
+	"random-fully": randomPRNGSNAT{},
+	"none":         sequentialSNAT{},
+}
+
+func getSNATStrategy() SNATStrategy {
+	strValue := strings.ToLower(strings.TrimSpace(os.Getenv(envRandomizeSNAT)))
+	if strValue == "" {
+		return defaultSNATStrategy
+	}
+	if strategy, ok := snatStrategies[strValue]; ok {
+		return strategy
+	}
+	names := make([]string, 0, len(snatStrategies))
+	for name := range snatStrategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.Errorf("Failed to parse %s; using default: %s. Provided string was %q, valid values: %s", envRandomizeSNAT,
+		defaultSNATStrategy.Name(), strValue, strings.Join(names, ","))
+	return defaultSNATStrategy
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package networkutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// sysClassNet is where the kernel lists the network interfaces of the host network namespace
+const sysClassNet = "/sys/class/net"
+
+// GetVFs returns the SR-IOV virtual functions of the physical interface that are in the host network namespace, sorted
+// by name. A VF that was moved to the network namespace of a pod is not listed, since sysfs only shows the interfaces
+// of the network namespace it was mounted from.
+func (n *linuxNetwork) GetVFs(pf string) ([]string, error) {
+	return listVFs(sysClassNet, pf)
+}
+
+// listVFs lists the interfaces of the virtfn<N> devices of the physical interface in the sysfs root
+func listVFs(root, pf string) ([]string, error) {
+	devices, err := filepath.Glob(filepath.Join(root, pf, "device", "virtfn*"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list the VFs of %s", pf)
+	}
+	if len(devices) == 0 {
+		if _, err := os.Stat(filepath.Join(root, pf)); err != nil {
+			return nil, errors.Wrapf(err, "failed to find interface %s", pf)
+		}
+		return nil, nil
+	}
+	var vfs []string
+	for _, device := range devices {
+		netdevs, err := ioutil.ReadDir(filepath.Join(device, "net"))
+		if err != nil {
+			// The VF has no netdev in this network namespace
+			continue
+		}
+		for _, netdev := range netdevs {
+			vfs = append(vfs, netdev.Name())
+		}
+	}
+	sort.Strings(vfs)
+	return vfs, nil
+}
@@ -47,6 +47,19 @@ func (m *MockNS) EXPECT() *MockNSMockRecorder {
 	return m.recorder
 }
 
+// GetNS mocks base method
+func (m *MockNS) GetNS(arg0 string) (ns.NetNS, error) {
+	ret := m.ctrl.Call(m, "GetNS", arg0)
+	ret0, _ := ret[0].(ns.NetNS)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetNS indicates an expected call of GetNS
+func (mr *MockNSMockRecorder) GetNS(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetNS", reflect.TypeOf((*MockNS)(nil).GetNS), arg0)
+}
+
 // WithNetNSPath mocks base method
 func (m *MockNS) WithNetNSPath(arg0 string, arg1 func(ns.NetNS) error) error {
 	ret := m.ctrl.Call(m, "WithNetNSPath", arg0, arg1)
@@ -0,0 +1,109 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package platform describes the operating systems aws-node runs on. Every platform is configured by the same
+// environment variables, and rejects the settings its dataplane does not implement, rather than ignoring them.
+package platform
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Platform is an operating system and the dataplane aws-node programs on it
+type Platform struct {
+	// OS is the GOOS of the platform
+	OS string
+	// Dataplane is the name of the dataplane that wires the pods to the ENIs
+	Dataplane string
+	// Unsupported maps the settings the dataplane does not implement to the reason why
+	Unsupported map[string]string
+}
+
+// Linux is programmed with netlink and iptables, and implements every setting
+var Linux = &Platform{
+	OS:        "linux",
+	Dataplane: "netlink",
+}
+
+// Windows is programmed with the Host Networking Service, which has no equivalent of the iptables chains, marks, rules
+// and veth devices of Linux
+var Windows = &Platform{
+	OS:        "windows",
+	Dataplane: "hns",
+	Unsupported: map[string]string{
+		"AWS_VPC_K8S_CNI_RANDOMIZESNAT":                 "HNS does not randomize the source ports of SNAT",
+		"AWS_VPC_K8S_CNI_SNAT_TARGET":                   "HNS always SNATs to the primary IP of the node",
+		"AWS_VPC_K8S_CNI_IPTABLES_CHECK":                "there are no iptables rules to check",
+		"AWS_VPC_K8S_CNI_IPTABLES_RULE_POSITION":        "there are no iptables rules to position",
+		"AWS_VPC_K8S_CNI_IPTABLES_LOCK_TIMEOUT":         "there is no xtables lock",
+		"AWS_VPC_K8S_CNI_NFT_MODE":                      "there are no nftables",
+		"AWS_VPC_CNI_NODE_PORT_SUPPORT":                 "HNS routes the replies of node ports itself",
+		"AWS_VPC_K8S_CNI_NODE_PORT_INTERFACES":          "HNS routes the replies of node ports itself",
+		"AWS_VPC_K8S_CNI_CONNMARK":                      "HNS does not mark connections",
+		"AWS_VPC_K8S_CNI_MARK_PRESET":                   "HNS does not mark connections",
+		"AWS_VPC_K8S_CNI_EGRESS_MULTIPATH":              "HNS has no multipath routes",
+		"AWS_VPC_K8S_CNI_NAT64":                         "HNS does not translate IPv6 to IPv4",
+		"AWS_VPC_K8S_CNI_NAT64_PREFIX":                  "HNS does not translate IPv6 to IPv4",
+		"AWS_VPC_K8S_CNI_NAT64_DEVICE":                  "HNS does not translate IPv6 to IPv4",
+		"AWS_VPC_K8S_CNI_VETHPREFIX":                    "pods are attached to HNS endpoints, not veth devices",
+		"AWS_VPC_K8S_CNI_POD_INTERFACE_PATTERN":         "pods are attached to HNS endpoints, not veth devices",
+		"AWS_VPC_K8S_CNI_UNMANAGED_INTERFACES":          "HNS owns every interface of the node",
+		"AWS_VPC_K8S_CNI_KUBE_PROXY_MODE":               "kube-proxy only runs in kernelspace mode",
+		"AWS_VPC_K8S_CNI_KUBE_PROXY_METRICS_ADDR":       "kube-proxy only runs in kernelspace mode",
+		"AWS_VPC_K8S_CNI_DROP_TRACING":                  "there are no iptables rules to count drops",
+		"AWS_VPC_K8S_CNI_POD_FLAGS":                     "HNS has no per-pod sysctls",
+		"AWS_VPC_K8S_CNI_SNAT_EXCLUSION_ANNOTATIONS":    "HNS endpoints have no per-pod SNAT exceptions",
+		"AWS_VPC_K8S_CNI_NETLINK_OPS_PER_SEC":           "there is no netlink",
+		"AWS_VPC_K8S_CNI_NETLINK_OPS_BURST":             "there is no netlink",
+		"AWS_VPC_K8S_CNI_ERROR_BUDGET_NETLINK_FAILURES": "there is no netlink",
+		"AWS_VPC_K8S_CNI_PREFIX_DELEGATION":             "HNS does not route the unused addresses of prefixes",
+		"AWS_VPC_K8S_CNI_SRIOV":                         "HNS cannot attach virtual functions to pods",
+		"AWS_VPC_K8S_CNI_POD_ENI":                       "HNS cannot attach VLAN interfaces to pods",
+		"AWS_VPC_K8S_CNI_NUMA_AWARE":                    "the NUMA topology is not read on Windows",
+	},
+}
+
+// Validate returns an error that lists the settings of env the platform does not implement
+func (p *Platform) Validate(env map[string]string) error {
+	return p.validate(func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	})
+}
+
+// ValidateEnv returns an error that lists the settings of the environment of the process the platform does not
+// implement
+func (p *Platform) ValidateEnv() error {
+	return p.validate(os.LookupEnv)
+}
+
+// validate returns an error that lists the unsupported settings lookup returns a value for. Empty values are the
+// defaults of the DaemonSet, which are shared by every platform.
+func (p *Platform) validate(lookup func(string) (string, bool)) error {
+	var unsupported []string
+	for name, reason := range p.Unsupported {
+		if value, ok := lookup(name); ok && value != "" {
+			unsupported = append(unsupported, name+" ("+reason+")")
+		}
+	}
+	if len(unsupported) == 0 {
+		return nil
+	}
+	sort.Strings(unsupported)
+	return errors.Errorf("settings not supported by the %s dataplane of %s: %s",
+		p.Dataplane, p.OS, strings.Join(unsupported, ", "))
+}
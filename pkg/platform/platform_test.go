@@ -0,0 +1,45 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package platform
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCurrent(t *testing.T) {
+	assert.Equal(t, runtime.GOOS, Current.OS)
+}
+
+func TestValidate(t *testing.T) {
+	env := map[string]string{"WARM_IP_TARGET": "2", "AWS_VPC_K8S_CNI_CONNMARK": "0x100"}
+	assert.NoError(t, Linux.Validate(env))
+	assert.EqualError(t, Windows.Validate(env), "settings not supported by the hns dataplane of windows: "+
+		"AWS_VPC_K8S_CNI_CONNMARK (HNS does not mark connections)")
+
+	// Empty values are the defaults
+	assert.NoError(t, Windows.Validate(map[string]string{"AWS_VPC_K8S_CNI_CONNMARK": ""}))
+
+	_ = os.Setenv("AWS_VPC_K8S_CNI_VETHPREFIX", "veth")
+	_ = os.Setenv("AWS_VPC_K8S_CNI_NAT64", "true")
+	assert.EqualError(t, Windows.ValidateEnv(), "settings not supported by the hns dataplane of windows: "+
+		"AWS_VPC_K8S_CNI_NAT64 (HNS does not translate IPv6 to IPv4), "+
+		"AWS_VPC_K8S_CNI_VETHPREFIX (pods are attached to HNS endpoints, not veth devices)")
+	assert.NoError(t, Linux.ValidateEnv())
+	_ = os.Unsetenv("AWS_VPC_K8S_CNI_VETHPREFIX")
+	_ = os.Unsetenv("AWS_VPC_K8S_CNI_NAT64")
+}
@@ -0,0 +1,210 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package podipexport
+
+import (
+	"bytes"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/ec2metadata"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/retry"
+)
+
+// s3RetryPolicy is how uploads to S3 are retried
+var s3RetryPolicy = retry.Policy{
+	Name:         "S3",
+	InitialDelay: 100 * time.Millisecond,
+	MaxDelay:     30 * time.Second,
+	Multiplier:   2,
+	Jitter:       0.5,
+	MaxAttempts:  5,
+}
+
+// configMapPruneInterval is how often a node deletes the exports of the nodes that are gone from a shared config map
+const configMapPruneInterval = time.Hour
+
+// Destination stores the signed exports
+type Destination interface {
+	// Put stores body under name, replacing the previous export of the same name
+	Put(name string, body []byte, signature string) error
+}
+
+// ConfigMapClient is the part of the Kubernetes API the config map destination uses
+type ConfigMapClient interface {
+	K8SGetConfigMapData(namespace, name string) (map[string]string, error)
+	K8SPatchConfigMapData(namespace, name string, data map[string]*string) error
+	K8SListNodeNames() ([]string, error)
+}
+
+// newDestination returns the destination of a s3://bucket/prefix or configmap://namespace/name URL
+func newDestination(value string, configMaps ConfigMapClient) (Destination, error) {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return nil, errors.Errorf("podipexport: invalid destination %q", value)
+	}
+	switch u.Scheme {
+	case "s3":
+		return newS3Destination(u.Host, strings.Trim(u.Path, "/"))
+	case "configmap":
+		name := strings.Trim(u.Path, "/")
+		if name == "" || strings.Contains(name, "/") {
+			return nil, errors.Errorf("podipexport: invalid config map in destination %q", value)
+		}
+		return &configMapDestination{namespace: u.Host, name: name, client: configMaps}, nil
+	default:
+		return nil, errors.Errorf("podipexport: unknown scheme %q of destination %q, use s3 or configmap", u.Scheme, value)
+	}
+}
+
+// s3API is the part of the S3 API the destination uses
+type s3API interface {
+	PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
+}
+
+// s3Destination stores each export as an object, with its signature and schema version in the object metadata so that
+// both are updated atomically
+type s3Destination struct {
+	client s3API
+	bucket string
+	prefix string
+}
+
+func newS3Destination(bucket, prefix string) (*s3Destination, error) {
+	region, err := ec2metadata.New().Region()
+	if err != nil {
+		return nil, errors.Wrap(err, "podipexport: failed to retrieve region data from instance metadata")
+	}
+	sess, err := session.NewSession(
+		request.WithRetryer(&aws.Config{Region: aws.String(region)},
+			retry.NewSDKRetryer(s3RetryPolicy.WithEnvOverrides())))
+	if err != nil {
+		return nil, errors.Wrap(err, "podipexport: failed to initialize AWS SDK session")
+	}
+	return &s3Destination{client: s3.New(sess), bucket: bucket, prefix: prefix}, nil
+}
+
+// Put uploads the export to <prefix>/<name>
+func (d *s3Destination) Put(name string, body []byte, signature string) error {
+	key := path.Join(d.prefix, name)
+	contentType := "application/json"
+	if strings.HasSuffix(name, "."+FormatCSV) {
+		contentType = "text/csv"
+	}
+	_, err := d.client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(d.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+		Metadata: map[string]*string{
+			"signature":      aws.String(signature),
+			"schema-version": aws.String(SchemaVersion),
+		},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "podipexport: failed to upload s3://%s/%s", d.bucket, key)
+	}
+	return nil
+}
+
+// configMapDestination stores each export as a key of a config map shared by the nodes, with its signature under the
+// same key suffixed with .sig
+type configMapDestination struct {
+	namespace string
+	name      string
+	client    ConfigMapClient
+	// lastPrune is when the exports of the nodes that are gone were last deleted
+	lastPrune time.Time
+}
+
+// Put sets the export and its signature in the config map in a single patch. Every configMapPruneInterval, the same
+// patch deletes the exports of the nodes that are no longer in the cluster, which would otherwise stay there forever.
+func (d *configMapDestination) Put(name string, body []byte, signature string) error {
+	bodyStr := string(body)
+	data := map[string]*string{
+		name:          &bodyStr,
+		name + ".sig": &signature,
+	}
+	if time.Since(d.lastPrune) >= configMapPruneInterval {
+		staleKeys, err := d.staleKeys()
+		if err != nil {
+			// The export is still published, the stale ones are deleted next time
+			log.Warnf("Failed to find the exports of the nodes that are gone from config map %s/%s: %v",
+				d.namespace, d.name, err)
+		} else {
+			for _, key := range staleKeys {
+				log.Infof("Deleting %s from config map %s/%s, its node is gone", key, d.namespace, d.name)
+				data[key] = nil
+			}
+			d.lastPrune = time.Now()
+		}
+	}
+	err := d.client.K8SPatchConfigMapData(d.namespace, d.name, data)
+	return errors.Wrap(err, "podipexport: failed to update the config map")
+}
+
+// staleKeys returns the keys of the config map holding the exports of nodes that are not in the cluster
+func (d *configMapDestination) staleKeys() ([]string, error) {
+	data, err := d.client.K8SGetConfigMapData(d.namespace, d.name)
+	if err != nil {
+		return nil, err
+	}
+	nodeNames, err := d.client.K8SListNodeNames()
+	if err != nil {
+		return nil, err
+	}
+	nodes := make(map[string]bool, len(nodeNames))
+	for _, node := range nodeNames {
+		nodes[node] = true
+	}
+	var staleKeys []string
+	for key := range data {
+		if node, ok := exportNode(key); ok && !nodes[node] {
+			staleKeys = append(staleKeys, key)
+		}
+	}
+	return staleKeys, nil
+}
+
+// exportNode returns the node of the export or signature stored under the given name, <node>.v<N>.<format>[.sig],
+// false if the name is not one of an export
+func exportNode(name string) (string, bool) {
+	name = strings.TrimSuffix(name, ".sig")
+	switch {
+	case strings.HasSuffix(name, "."+FormatJSON):
+		name = strings.TrimSuffix(name, "."+FormatJSON)
+	case strings.HasSuffix(name, "."+FormatCSV):
+		name = strings.TrimSuffix(name, "."+FormatCSV)
+	default:
+		return "", false
+	}
+	i := strings.LastIndex(name, ".v")
+	if i <= 0 {
+		return "", false
+	}
+	if _, err := strconv.Atoi(name[i+2:]); err != nil {
+		return "", false
+	}
+	return name[:i], true
+}
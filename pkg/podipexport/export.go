@@ -0,0 +1,207 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package podipexport periodically publishes the pod to IP mappings of a node, for firewalls that enforce IP-based
+// policies and cannot query the Kubernetes API.
+package podipexport
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SchemaVersion is the version of the format of the exports. It is part of their name and content, and changes
+	// whenever a field is removed or changes meaning.
+	SchemaVersion = "v1"
+
+	// envDestination is the name of the environment variable with where the exports are published, either
+	// s3://bucket/prefix or configmap://namespace/name. Defaults to empty, off.
+	envDestination = "AWS_VPC_K8S_CNI_POD_IP_EXPORT_DESTINATION"
+
+	// envFormat is the name of the environment variable with the format of the exports, json or csv. Defaults to json.
+	envFormat = "AWS_VPC_K8S_CNI_POD_IP_EXPORT_FORMAT"
+
+	// envInterval is the name of the environment variable with how often the exports are published. Defaults to 5m.
+	envInterval = "AWS_VPC_K8S_CNI_POD_IP_EXPORT_INTERVAL"
+
+	// envSigningKeyFile is the name of the environment variable with the path of the file holding the key the exports
+	// are signed with, e.g. a mounted secret
+	envSigningKeyFile = "AWS_VPC_K8S_CNI_POD_IP_EXPORT_SIGNING_KEY_FILE"
+
+	// FormatJSON is a JSON document with the node and its pods
+	FormatJSON = "json"
+	// FormatCSV is a CSV file with a header and a line per pod
+	FormatCSV = "csv"
+
+	defaultInterval = 5 * time.Minute
+)
+
+// csvHeader are the columns of a CSV export
+var csvHeader = []string{"schema_version", "node", "instance_id", "generated_at", "namespace", "name", "ipv4", "ipv6"}
+
+// Mapping is a pod and its IPs
+type Mapping struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	IPv4      string `json:"ipv4,omitempty"`
+	IPv6      string `json:"ipv6,omitempty"`
+}
+
+// Export is the pod to IP mappings of a node at a point in time
+type Export struct {
+	SchemaVersion string    `json:"schemaVersion"`
+	Node          string    `json:"node"`
+	InstanceID    string    `json:"instanceID"`
+	GeneratedAt   time.Time `json:"generatedAt"`
+	Pods          []Mapping `json:"pods"`
+}
+
+// Enabled returns whether the exports are published
+func Enabled() bool {
+	return os.Getenv(envDestination) != ""
+}
+
+// GetInterval returns how often the exports are published
+func GetInterval() time.Duration {
+	if value := os.Getenv(envInterval); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err == nil && interval > 0 {
+			return interval
+		}
+		log.Errorf("Failed to parse %s %q, using default %v", envInterval, value, defaultInterval)
+	}
+	return defaultInterval
+}
+
+func getFormat() string {
+	switch value := strings.ToLower(os.Getenv(envFormat)); value {
+	case "", FormatJSON:
+		return FormatJSON
+	case FormatCSV:
+		return FormatCSV
+	default:
+		log.Errorf("Unknown %s %q, using default %s", envFormat, value, FormatJSON)
+		return FormatJSON
+	}
+}
+
+// NewExport returns the export of the given pods, sorted by namespace and name
+func NewExport(node, instanceID string, pods []Mapping) *Export {
+	sort.Slice(pods, func(i, j int) bool {
+		if pods[i].Namespace != pods[j].Namespace {
+			return pods[i].Namespace < pods[j].Namespace
+		}
+		return pods[i].Name < pods[j].Name
+	})
+	return &Export{
+		SchemaVersion: SchemaVersion,
+		Node:          node,
+		InstanceID:    instanceID,
+		GeneratedAt:   time.Now().UTC(),
+		Pods:          pods,
+	}
+}
+
+// Name returns the name the export is published under, e.g. ip-10-0-0-1.ec2.internal.v1.json
+func (e *Export) Name(format string) string {
+	return e.Node + "." + SchemaVersion + "." + format
+}
+
+// Encode returns the export in the given format
+func (e *Export) Encode(format string) ([]byte, error) {
+	if format == FormatJSON {
+		return json.Marshal(e)
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(csvHeader); err != nil {
+		return nil, err
+	}
+	generatedAt := e.GeneratedAt.Format(time.RFC3339)
+	for _, pod := range e.Pods {
+		err := w.Write([]string{e.SchemaVersion, e.Node, e.InstanceID, generatedAt, pod.Namespace, pod.Name, pod.IPv4,
+			pod.IPv6})
+		if err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of body with key
+func Sign(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Publisher publishes the exports of a node
+type Publisher struct {
+	destination Destination
+	format      string
+	key         []byte
+}
+
+// NewPublisher returns a Publisher to the configured destination, updating config maps with the given client
+func NewPublisher(configMaps ConfigMapClient) (*Publisher, error) {
+	path := os.Getenv(envSigningKeyFile)
+	if path == "" {
+		return nil, errors.Errorf("podipexport: %s is not set, exports must be signed", envSigningKeyFile)
+	}
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "podipexport: failed to read the signing key")
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, errors.Errorf("podipexport: the signing key in %s is empty", path)
+	}
+	destination, err := newDestination(os.Getenv(envDestination), configMaps)
+	if err != nil {
+		return nil, err
+	}
+	return &Publisher{destination: destination, format: getFormat(), key: key}, nil
+}
+
+// Publish encodes, signs and publishes an export
+func (p *Publisher) Publish(export *Export) error {
+	body, err := export.Encode(p.format)
+	if err != nil {
+		return errors.Wrap(err, "podipexport: failed to encode the export")
+	}
+	return p.destination.Put(export.Name(p.format), body, Sign(p.key, body))
+}
+
+// GetConfigForDebug returns the active values of the configuration env vars (for debugging purposes)
+func GetConfigForDebug() map[string]interface{} {
+	return map[string]interface{}{
+		envDestination:    os.Getenv(envDestination),
+		envFormat:         getFormat(),
+		envInterval:       GetInterval().String(),
+		envSigningKeyFile: os.Getenv(envSigningKeyFile),
+	}
+}
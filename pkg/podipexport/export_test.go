@@ -0,0 +1,183 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package podipexport
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func testExport() *Export {
+	return NewExport("ip-10-0-0-1.ec2.internal", "i-0123456789", []Mapping{
+		{Namespace: "prod", Name: "web", IPv4: "10.0.0.5"},
+		{Namespace: "default", Name: "db", IPv4: "10.0.0.6", IPv6: "2001:db8::6"},
+	})
+}
+
+func TestEncode(t *testing.T) {
+	export := testExport()
+	assert.Equal(t, "db", export.Pods[0].Name)
+	assert.Equal(t, "ip-10-0-0-1.ec2.internal.v1.json", export.Name(FormatJSON))
+
+	body, err := export.Encode(FormatJSON)
+	assert.NoError(t, err)
+	var decoded map[string]interface{}
+	assert.NoError(t, json.Unmarshal(body, &decoded))
+	assert.Equal(t, "v1", decoded["schemaVersion"])
+	assert.Equal(t, "i-0123456789", decoded["instanceID"])
+	assert.Len(t, decoded["pods"], 2)
+
+	body, err = export.Encode(FormatCSV)
+	assert.NoError(t, err)
+	generatedAt := export.GeneratedAt.Format(time.RFC3339)
+	assert.Equal(t, "schema_version,node,instance_id,generated_at,namespace,name,ipv4,ipv6\n"+
+		"v1,ip-10-0-0-1.ec2.internal,i-0123456789,"+generatedAt+",default,db,10.0.0.6,2001:db8::6\n"+
+		"v1,ip-10-0-0-1.ec2.internal,i-0123456789,"+generatedAt+",prod,web,10.0.0.5,\n", string(body))
+}
+
+func TestSign(t *testing.T) {
+	// RFC 4231 test case 2
+	assert.Equal(t, "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843",
+		Sign([]byte("Jefe"), []byte("what do ya want for nothing?")))
+}
+
+func TestPublishConfigMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "podipexport")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	assert.NoError(t, ioutil.WriteFile(keyFile, []byte("secret\n"), 0600))
+
+	configMaps := &fakeConfigMaps{
+		data: map[string]string{
+			"ip-10-0-0-1.ec2.internal.v1.csv": "old",
+			"ip-10-0-0-2.ec2.internal.v1.csv": "gone",
+			// Left alone, not an export
+			"README": "pod IPs",
+		},
+		nodes: []string{"ip-10-0-0-1.ec2.internal"},
+	}
+
+	_ = os.Setenv(envDestination, "configmap://kube-system/pod-ips")
+	_ = os.Setenv(envFormat, FormatCSV)
+	defer os.Unsetenv(envDestination)
+	defer os.Unsetenv(envFormat)
+	assert.True(t, Enabled())
+
+	// Exports are only published signed
+	_, err = NewPublisher(configMaps)
+	assert.Error(t, err)
+
+	_ = os.Setenv(envSigningKeyFile, keyFile)
+	defer os.Unsetenv(envSigningKeyFile)
+	publisher, err := NewPublisher(configMaps)
+	assert.NoError(t, err)
+
+	// The first export also deletes the exports of the nodes that are gone
+	export := testExport()
+	assert.NoError(t, publisher.Publish(export))
+	body, _ := export.Encode(FormatCSV)
+	assert.Equal(t, map[string]string{
+		"ip-10-0-0-1.ec2.internal.v1.csv":     string(body),
+		"ip-10-0-0-1.ec2.internal.v1.csv.sig": Sign([]byte("secret"), body),
+		"README":                              "pod IPs",
+	}, configMaps.data)
+	assert.Equal(t, 1, configMaps.lists)
+
+	// They are only looked for again after configMapPruneInterval
+	assert.NoError(t, publisher.Publish(export))
+	assert.Equal(t, 1, configMaps.lists)
+
+	for _, destination := range []string{"configmap://kube-system", "ftp://host/path", "s3:///prefix"} {
+		_ = os.Setenv(envDestination, destination)
+		_, err = NewPublisher(configMaps)
+		assert.Error(t, err, destination)
+	}
+}
+
+func TestExportNode(t *testing.T) {
+	for name, node := range map[string]string{
+		"ip-10-0-0-1.ec2.internal.v1.json":    "ip-10-0-0-1.ec2.internal",
+		"ip-10-0-0-1.ec2.internal.v1.csv.sig": "ip-10-0-0-1.ec2.internal",
+		"node.v2.internal.v12.json":           "node.v2.internal",
+		"ip-10-0-0-1.ec2.internal.v1.yaml":    "",
+		"ip-10-0-0-1.ec2.internal.vnext.json": "",
+		".v1.json":                            "",
+		"ip-10-0-0-1.ec2.internal.json":       "",
+	} {
+		exportedNode, ok := exportNode(name)
+		assert.Equal(t, node != "", ok, name)
+		assert.Equal(t, node, exportedNode, name)
+	}
+}
+
+type fakeConfigMaps struct {
+	data  map[string]string
+	nodes []string
+	lists int
+}
+
+func (f *fakeConfigMaps) K8SGetConfigMapData(namespace, name string) (map[string]string, error) {
+	return f.data, nil
+}
+
+func (f *fakeConfigMaps) K8SPatchConfigMapData(namespace, name string, data map[string]*string) error {
+	if namespace != "kube-system" || name != "pod-ips" {
+		return errors.Errorf("unexpected config map %s/%s", namespace, name)
+	}
+	for key, value := range data {
+		if value == nil {
+			delete(f.data, key)
+		} else {
+			f.data[key] = *value
+		}
+	}
+	return nil
+}
+
+func (f *fakeConfigMaps) K8SListNodeNames() ([]string, error) {
+	f.lists++
+	return f.nodes, nil
+}
+
+type fakeS3 struct {
+	inputs []*s3.PutObjectInput
+}
+
+func (f *fakeS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	f.inputs = append(f.inputs, input)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestS3Destination(t *testing.T) {
+	client := &fakeS3{}
+	destination := &s3Destination{client: client, bucket: "bucket", prefix: "exports/cluster"}
+	assert.NoError(t, destination.Put("node.v1.csv", []byte("body"), "abc"))
+
+	assert.Len(t, client.inputs, 1)
+	input := client.inputs[0]
+	assert.Equal(t, "exports/cluster/node.v1.csv", aws.StringValue(input.Key))
+	assert.Equal(t, "text/csv", aws.StringValue(input.ContentType))
+	assert.Equal(t, "abc", aws.StringValue(input.Metadata["signature"]))
+	assert.Equal(t, SchemaVersion, aws.StringValue(input.Metadata["schema-version"]))
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package prefetch reads and writes the results of the discovery aws-node does on a node, cached in a file baked into
+// the AMI of the node, so that its first start on a new node can skip them
+package prefetch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/capabilities"
+)
+
+const (
+	// DefaultPath is where the cache is in the aws-node container, /var/lib/aws-node/prefetch.json on the host
+	DefaultPath = "/host/var/lib/aws-node/prefetch.json"
+
+	cacheVersion = 1
+)
+
+// Cache is the content of the cache file
+type Cache struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	// KernelVersion and IptablesFingerprint identify the kernel and iptables the capabilities were probed with
+	KernelVersion       string                     `json:"kernelVersion"`
+	IptablesFingerprint string                     `json:"iptablesFingerprint"`
+	Capabilities        *capabilities.Capabilities `json:"capabilities,omitempty"`
+	// InstanceLimits are the limits of instance types aws-node may not know, by instance type
+	InstanceLimits map[string]InstanceLimits `json:"instanceLimits,omitempty"`
+	// ClusterName and ClusterID are the identity of the cluster, only set when the AMI is built for a single cluster
+	ClusterName string `json:"clusterName,omitempty"`
+	ClusterID   string `json:"clusterID,omitempty"`
+}
+
+// InstanceLimits are the number of ENIs of an instance type, and of IPv4 addresses per ENI including the primary one
+type InstanceLimits struct {
+	ENIs      int `json:"enis"`
+	IPsPerENI int `json:"ipsPerENI"`
+}
+
+// fingerprints return the kernel version and the iptables fingerprint of the node, replaced in tests
+var fingerprints = func() (string, string, error) {
+	kernelVersion, err := capabilities.KernelVersion()
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to get the kernel version")
+	}
+	iptables, err := capabilities.IptablesFingerprint()
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to fingerprint iptables")
+	}
+	return kernelVersion, iptables, nil
+}
+
+// New probes the capabilities of the node into a new cache
+func New() (*Cache, error) {
+	kernelVersion, iptables, err := fingerprints()
+	if err != nil {
+		return nil, err
+	}
+	probed := capabilities.Get()
+	return &Cache{
+		Version:             cacheVersion,
+		CreatedAt:           time.Now().UTC(),
+		KernelVersion:       kernelVersion,
+		IptablesFingerprint: iptables,
+		Capabilities:        &probed,
+	}, nil
+}
+
+// Read returns the cache in a file
+func Read(path string) (*Cache, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cache Cache
+	if err := json.Unmarshal(content, &cache); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the prefetch cache %s", path)
+	}
+	if cache.Version != cacheVersion {
+		return nil, errors.Errorf("unsupported version %d of the prefetch cache %s", cache.Version, path)
+	}
+	return &cache, nil
+}
+
+// Write replaces the cache in a file at once, so that it is never read half written
+func Write(path string, cache *Cache) error {
+	content, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode the prefetch cache")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrap(err, "failed to create the directory of the prefetch cache")
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return errors.Wrap(err, "failed to write the prefetch cache")
+	}
+	return errors.Wrap(os.Rename(tmpPath, path), "failed to replace the prefetch cache")
+}
+
+// ValidCapabilities returns the cached capabilities if they were probed with the kernel and the iptables of this node,
+// or else an error telling why they can't be used
+func (c *Cache) ValidCapabilities() (*capabilities.Capabilities, error) {
+	if c.Capabilities == nil {
+		return nil, errors.New("no capabilities cached")
+	}
+	kernelVersion, iptables, err := fingerprints()
+	if err != nil {
+		return nil, err
+	}
+	if kernelVersion != c.KernelVersion {
+		return nil, errors.Errorf("probed on kernel %s, not %s", c.KernelVersion, kernelVersion)
+	}
+	if iptables != c.IptablesFingerprint {
+		return nil, errors.Errorf("probed with iptables %s, not %s", c.IptablesFingerprint, iptables)
+	}
+	return c.Capabilities, nil
+}
+
+// ParseInstanceLimits parses instance limits written as a comma separated list of
+// "<instance type>=<ENIs>:<IPs per ENI>", e.g. "m6i.large=3:10,m6i.xlarge=4:15"
+func ParseInstanceLimits(value string) (map[string]InstanceLimits, error) {
+	limits := make(map[string]InstanceLimits)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, "=")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("invalid instance limits %q, must be <instance type>=<ENIs>:<IPs per ENI>", entry)
+		}
+		numbers := strings.Split(parts[1], ":")
+		if len(numbers) != 2 {
+			return nil, errors.Errorf("invalid instance limits %q, must be <instance type>=<ENIs>:<IPs per ENI>", entry)
+		}
+		enis, err := strconv.Atoi(numbers[0])
+		if err != nil || enis < 1 {
+			return nil, errors.Errorf("invalid number of ENIs in %q", entry)
+		}
+		ips, err := strconv.Atoi(numbers[1])
+		if err != nil || ips < 2 {
+			return nil, errors.Errorf("invalid number of IPs per ENI in %q, must be at least 2", entry)
+		}
+		limits[parts[0]] = InstanceLimits{ENIs: enis, IPsPerENI: ips}
+	}
+	return limits, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package prefetch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/capabilities"
+)
+
+func TestReadWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prefetch")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "aws-node", "prefetch.json")
+
+	_, err = Read(path)
+	assert.True(t, os.IsNotExist(err))
+
+	cache := &Cache{
+		Version:        cacheVersion,
+		KernelVersion:  "4.14.146-119.123.amzn2.x86_64",
+		Capabilities:   &capabilities.Capabilities{IptablesVersion: "1.8.4", IptablesRandomFully: true},
+		InstanceLimits: map[string]InstanceLimits{"m6i.large": {ENIs: 3, IPsPerENI: 10}},
+		ClusterName:    "prod",
+	}
+	assert.NoError(t, Write(path, cache))
+	read, err := Read(path)
+	assert.NoError(t, err)
+	assert.Equal(t, cache, read)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"version": 2}`), 0644))
+	_, err = Read(path)
+	assert.Error(t, err)
+}
+
+func TestValidCapabilities(t *testing.T) {
+	defer func(f func() (string, string, error)) { fingerprints = f }(fingerprints)
+	fingerprints = func() (string, string, error) {
+		return "4.14.146-119.123.amzn2.x86_64", "/sbin/xtables-multi:1024:1570000000", nil
+	}
+	probed := &capabilities.Capabilities{IptablesRandomFully: true}
+	cache := &Cache{
+		KernelVersion:       "4.14.146-119.123.amzn2.x86_64",
+		IptablesFingerprint: "/sbin/xtables-multi:1024:1570000000",
+		Capabilities:        probed,
+	}
+	valid, err := cache.ValidCapabilities()
+	assert.NoError(t, err)
+	assert.Equal(t, probed, valid)
+
+	// The node runs a newer kernel than the one the AMI was built with
+	cache.KernelVersion = "4.14.138-114.102.amzn2.x86_64"
+	_, err = cache.ValidCapabilities()
+	assert.Error(t, err)
+
+	// The aws-node image was updated since
+	cache.KernelVersion = "4.14.146-119.123.amzn2.x86_64"
+	cache.IptablesFingerprint = "/sbin/xtables-multi:1024:1560000000"
+	_, err = cache.ValidCapabilities()
+	assert.Error(t, err)
+
+	_, err = (&Cache{}).ValidCapabilities()
+	assert.Error(t, err)
+}
+
+func TestParseInstanceLimits(t *testing.T) {
+	limits, err := ParseInstanceLimits("")
+	assert.NoError(t, err)
+	assert.Empty(t, limits)
+
+	limits, err = ParseInstanceLimits("m6i.large=3:10, m6i.xlarge=4:15")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]InstanceLimits{
+		"m6i.large":  {ENIs: 3, IPsPerENI: 10},
+		"m6i.xlarge": {ENIs: 4, IPsPerENI: 15},
+	}, limits)
+
+	for _, value := range []string{"m6i.large", "m6i.large=3", "=3:10", "m6i.large=0:10", "m6i.large=3:1", "m6i.large=x:10"} {
+		_, err = ParseInstanceLimits(value)
+		assert.Error(t, err, value)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package procsyswrapper is a wrapper of the kernel parameters under /proc/sys, so that the host tuning done by the
+// CNI can be tested with mocks
+package procsyswrapper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const procSysRoot = "/proc/sys"
+
+// ProcSys reads and writes the kernel parameters of the network namespace of the calling thread, named by their path
+// under /proc/sys, e.g. "net/ipv4/conf/eth0/rp_filter"
+type ProcSys interface {
+	// Get returns the value of the parameter, without the trailing newline
+	Get(key string) (string, error)
+	// Set writes the value of the parameter
+	Set(key, value string) error
+}
+
+type procSys struct {
+	root string
+}
+
+// NewProcSys creates a ProcSys object
+func NewProcSys() ProcSys {
+	return &procSys{root: procSysRoot}
+}
+
+func (p *procSys) path(key string) string {
+	return filepath.Join(p.root, filepath.Clean("/"+key))
+}
+
+func (p *procSys) Get(key string) (string, error) {
+	value, err := ioutil.ReadFile(p.path(key))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %s", key)
+	}
+	return strings.TrimRight(string(value), "\n"), nil
+}
+
+func (p *procSys) Set(key, value string) error {
+	f, err := os.OpenFile(p.path(key), os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", key)
+	}
+	if _, err = f.WriteString(value); err != nil {
+		// If the write failed, just close
+		_ = f.Close()
+		return errors.Wrapf(err, "failed to write %s", key)
+	}
+	return f.Close()
+}
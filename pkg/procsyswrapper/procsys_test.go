@@ -0,0 +1,50 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package procsyswrapper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcSys(t *testing.T) {
+	root, err := ioutil.TempDir("", "procsys")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "net", "ipv4", "conf", "eth0")
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "rp_filter"), []byte("1\n"), 0644))
+
+	p := &procSys{root: root}
+	value, err := p.Get("net/ipv4/conf/eth0/rp_filter")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", value)
+
+	assert.NoError(t, p.Set("net/ipv4/conf/eth0/rp_filter", "2"))
+	value, err = p.Get("net/ipv4/conf/eth0/rp_filter")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", value)
+
+	// Keys stay under the root
+	assert.Equal(t, filepath.Join(root, "etc", "passwd"), p.path("../../etc/passwd"))
+
+	// The kernel parameters are never created
+	assert.Error(t, p.Set("net/ipv4/conf/eth1/rp_filter", "2"))
+	_, err = p.Get("net/ipv4/conf/eth1/rp_filter")
+	assert.Error(t, err)
+}
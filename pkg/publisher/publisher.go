@@ -16,6 +16,7 @@ package publisher
 
 import (
 	"context"
+	"os"
 	"sync"
 	"time"
 
@@ -40,6 +41,9 @@ const (
 	// Metric dimension constants
 	clusterIDDimension = "CLUSTER_ID"
 
+	// eksClusterNameTagKey is the tag EKS managed node groups set on their instances
+	eksClusterNameTagKey = "eks:cluster-name"
+
 	// localMetricData is the default size for the local queue(slice)
 	localMetricDataSize = 100
 
@@ -84,15 +88,7 @@ func New(ctx context.Context) (Publisher, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "publisher: unable to obtain EC2 service client")
 	}
-	clusterID, err := ec2Client.GetClusterTag("CLUSTER_ID")
-	if err != nil || clusterID == "" {
-		glog.Errorf("Failed to obtain cluster-id, fetching name.  %v", err)
-		clusterID, err = ec2Client.GetClusterTag("Name")
-		if err != nil || clusterID == "" {
-			glog.Errorf("Failed to obtain cluster-id or name, defaulting to 'k8s-cluster'.  %v", err)
-			clusterID = "k8s-cluster"
-		}
-	}
+	clusterID := getClusterID(ec2Client)
 	glog.Info("Using cluster ID ", clusterID)
 
 	// Get CloudWatch client
@@ -116,6 +112,23 @@ func New(ctx context.Context) (Publisher, error) {
 	}, nil
 }
 
+// getClusterID returns the ID of the cluster the metrics are published for: the CLUSTER_ID env var if set, or else the
+// CLUSTER_ID tag of the instance, the cluster name tag EKS sets on its nodes, or the Name tag, in this order
+func getClusterID(ec2Client *ec2wrapper.EC2Wrapper) string {
+	if clusterID := os.Getenv(clusterIDDimension); clusterID != "" {
+		return clusterID
+	}
+	for _, tagKey := range []string{clusterIDDimension, eksClusterNameTagKey, "Name"} {
+		clusterID, err := ec2Client.GetClusterTag(tagKey)
+		if err == nil && clusterID != "" {
+			return clusterID
+		}
+		glog.Errorf("Failed to obtain cluster-id from tag %s.  %v", tagKey, err)
+	}
+	glog.Error("Failed to obtain cluster-id or name, defaulting to 'k8s-cluster'")
+	return "k8s-cluster"
+}
+
 // Start is used to setup the monitor loop
 func (p *cloudWatchPublisher) Start() {
 	glog.Info("Starting monitor loop for CloudWatch publisher")
@@ -138,9 +151,9 @@ func (p *cloudWatchPublisher) Publish(metricDataPoints ...*cloudwatch.MetricDatu
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	// NOTE: Iteration is used to override the metric dimensions
+	// NOTE: Iteration is used to add the cluster dimensions ahead of the ones of the data point, e.g. its nodegroup
 	for _, metricDatum := range metricDataPoints {
-		metricDatum.Dimensions = dimensions
+		metricDatum.Dimensions = append(append([]*cloudwatch.Dimension{}, dimensions...), metricDatum.Dimensions...)
 		p.localMetricData = append(p.localMetricData, metricDatum)
 	}
 }
@@ -181,6 +181,23 @@ func TestGetCloudWatchMetricDatumDimensionsWithMissingClusterID(t *testing.T) {
 	assert.Equal(t, testCloudwatchDimensions, expectedCloudwatchDimensions)
 }
 
+func TestCloudWatchPublisherKeepsDatumDimensions(t *testing.T) {
+	cloudwatchPublisher := getCloudWatchPublisher(t)
+
+	nodegroupDimension := &cloudwatch.Dimension{Name: aws.String("NODEGROUP"), Value: aws.String("ng-1")}
+	cloudwatchPublisher.Publish(&cloudwatch.MetricDatum{
+		MetricName: aws.String(testMetricOne),
+		Value:      aws.Float64(1.0),
+		Dimensions: []*cloudwatch.Dimension{nodegroupDimension},
+	})
+
+	assert.Len(t, cloudwatchPublisher.localMetricData, 1)
+	assert.Equal(t, []*cloudwatch.Dimension{
+		{Name: aws.String(clusterIDDimension), Value: aws.String(testClusterID)},
+		nodegroupDimension,
+	}, cloudwatchPublisher.localMetricData[0].Dimensions)
+}
+
 func TestPublishWithNoData(t *testing.T) {
 	cloudwatchPublisher := &cloudWatchPublisher{}
 
@@ -0,0 +1,181 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package cidr has the IP and CIDR arithmetic shared by ipamd and the CNI plugin, for IPv4 and IPv6. Addresses and
+// CIDRs are netip values, converted to the net types only where netlink needs them.
+package cidr
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/pkg/errors"
+)
+
+// Parse parses a CIDR and returns its network, with the host bits cleared like net.ParseCIDR does
+func Parse(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, errors.Wrapf(err, "invalid CIDR block %s", s)
+	}
+	return prefix.Masked(), nil
+}
+
+// ParseAll parses a list of CIDRs, failing on the first invalid one
+func ParseAll(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, s := range cidrs {
+		prefix, err := Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// ParseAddr parses an IP address, returning IPv4-mapped IPv6 addresses as IPv4 ones
+func ParseAddr(s string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, errors.Wrapf(err, "invalid IP address %s", s)
+	}
+	return addr.Unmap(), nil
+}
+
+// Strings returns the CIDRs in their canonical text form, as iptables and the EC2 API take them
+func Strings(prefixes []netip.Prefix) []string {
+	if prefixes == nil {
+		return nil
+	}
+	strs := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		strs = append(strs, prefix.String())
+	}
+	return strs
+}
+
+// HostPrefix returns the CIDR that only holds addr: a /32 for IPv4 and a /128 for IPv6
+func HostPrefix(addr netip.Addr) netip.Prefix {
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
+
+// IPNet returns prefix as the net type netlink takes, with a 4 byte address for IPv4. It returns nil for the zero
+// Prefix.
+func IPNet(prefix netip.Prefix) *net.IPNet {
+	if !prefix.IsValid() {
+		return nil
+	}
+	return &net.IPNet{
+		IP:   prefix.Addr().AsSlice(),
+		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	}
+}
+
+// FromIPNet returns the CIDR of an IPNet read from netlink, or the zero Prefix if it is nil or invalid
+func FromIPNet(ipNet *net.IPNet) netip.Prefix {
+	if ipNet == nil {
+		return netip.Prefix{}
+	}
+	addr := FromIP(ipNet.IP)
+	ones, bits := ipNet.Mask.Size()
+	if addr.Is4() && bits == net.IPv6len*8 && ones >= 96 {
+		// An IPv4 CIDR with the 16 byte form of its mask
+		ones, bits = ones-96, net.IPv4len*8
+	}
+	if !addr.IsValid() || bits != addr.BitLen() {
+		return netip.Prefix{}
+	}
+	return netip.PrefixFrom(addr, ones)
+}
+
+// IP returns addr as the net type netlink takes, or nil for the zero Addr
+func IP(addr netip.Addr) net.IP {
+	if !addr.IsValid() {
+		return nil
+	}
+	return addr.AsSlice()
+}
+
+// FromIP returns the address of a net.IP, as an IPv4 address for both of its IPv4 forms, or the zero Addr
+func FromIP(ip net.IP) netip.Addr {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// Next returns the address after addr
+func Next(addr netip.Addr) (netip.Addr, error) {
+	if !addr.IsValid() {
+		return netip.Addr{}, errors.New("invalid IP address")
+	}
+	next := addr.Next()
+	if !next.IsValid() {
+		return netip.Addr{}, errors.Errorf("%q will be overflowed", addr)
+	}
+	return next, nil
+}
+
+// Gateway returns the address of the router of a subnet, the first one after the network address
+func Gateway(subnet netip.Prefix) (netip.Addr, error) {
+	if !subnet.IsValid() {
+		return netip.Addr{}, errors.Errorf("invalid CIDR block %s", subnet)
+	}
+	network := subnet.Masked().Addr()
+	gw, err := Next(network)
+	if err != nil {
+		return netip.Addr{}, errors.Wrapf(err, "failed to define gateway address from %s", network)
+	}
+	return gw, nil
+}
+
+// Subtract returns the parts of a that are not in r, by splitting a in halves until each half is either in r or
+// outside of it. CIDRs of different families do not overlap.
+func Subtract(a, r netip.Prefix) []netip.Prefix {
+	a, r = a.Masked(), r.Masked()
+	if !a.Overlaps(r) {
+		return []netip.Prefix{a}
+	}
+	if r.Bits() <= a.Bits() {
+		// r contains a
+		return nil
+	}
+	bits := a.Bits()
+	high := a.Addr().AsSlice()
+	high[bits/8] |= 0x80 >> uint(bits%8)
+	highAddr, _ := netip.AddrFromSlice(high)
+	low := netip.PrefixFrom(a.Addr(), bits+1)
+	return append(Subtract(low, r), Subtract(netip.PrefixFrom(highAddr, bits+1), r)...)
+}
+
+// SubtractAll returns the smallest list of CIDRs that covers the addresses of prefixes that are in none of remove
+func SubtractAll(prefixes []netip.Prefix, remove []netip.Prefix) []netip.Prefix {
+	if len(remove) == 0 {
+		return prefixes
+	}
+	var result []netip.Prefix
+	for _, prefix := range prefixes {
+		pieces := []netip.Prefix{prefix}
+		for _, r := range remove {
+			var remaining []netip.Prefix
+			for _, piece := range pieces {
+				remaining = append(remaining, Subtract(piece, r)...)
+			}
+			pieces = remaining
+		}
+		result = append(result, pieces...)
+	}
+	return result
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cidr
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// incrementIPv4Addr and subtractCIDRs keep the signatures of the helpers the tests below were written for in
+// networkutils, before the arithmetic moved here
+func incrementIPv4Addr(ip net.IP) (net.IP, error) {
+	next, err := Next(FromIP(ip))
+	if err != nil {
+		return nil, err
+	}
+	return IP(next), nil
+}
+
+func subtractCIDRs(cidrs []string, remove []string) []string {
+	prefixes, err := ParseAll(cidrs)
+	if err != nil {
+		return nil
+	}
+	removePrefixes, err := ParseAll(remove)
+	if err != nil {
+		return nil
+	}
+	return Strings(SubtractAll(prefixes, removePrefixes))
+}
+
+func TestSubtractCIDRs(t *testing.T) {
+	assert.Equal(t, []string{"10.0.0.0/16"}, subtractCIDRs([]string{"10.0.0.0/16"}, nil))
+	assert.Equal(t, []string{"10.0.0.0/16"}, subtractCIDRs([]string{"10.0.0.0/16"}, []string{"192.168.0.0/16"}))
+	assert.Empty(t, subtractCIDRs([]string{"10.0.0.0/16"}, []string{"10.0.0.0/8"}))
+	assert.Equal(t, []string{"10.0.0.0/17", "10.0.192.0/18"},
+		subtractCIDRs([]string{"10.0.0.0/16"}, []string{"10.0.128.0/18"}))
+	assert.Equal(t, []string{"10.0.0.0/18", "10.0.96.0/19", "10.0.160.0/19", "10.0.192.0/18", "2600:1f14::/56"},
+		subtractCIDRs([]string{"10.0.0.0/16", "2600:1f14::/56"}, []string{"10.0.64.0/19", "10.0.128.0/19"}))
+}
+
+func TestIncrementIPv4Addr(t *testing.T) {
+	testCases := []struct {
+		name     string
+		ip       net.IP
+		expected net.IP
+		err      bool
+	}{
+		{"increment", net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2).To4(), false},
+		{"carry up 1", net.IPv4(10, 0, 0, 255), net.IPv4(10, 0, 1, 0).To4(), false},
+		{"carry up 2", net.IPv4(10, 0, 255, 255), net.IPv4(10, 1, 0, 0).To4(), false},
+		{"overflow", net.IPv4(255, 255, 255, 255), nil, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := incrementIPv4Addr(tc.ip)
+			if tc.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.expected, result, tc.name)
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	testCases := []struct {
+		name     string
+		addr     netip.Addr
+		expected netip.Addr
+		err      bool
+	}{
+		{"IPv6", netip.MustParseAddr("2600:1f14::ffff"), netip.MustParseAddr("2600:1f14::1:0"), false},
+		{"IPv6 overflow", netip.MustParseAddr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), netip.Addr{}, true},
+		{"invalid", netip.Addr{}, netip.Addr{}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := Next(tc.addr)
+			if tc.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.expected, result, tc.name)
+		})
+	}
+}
+
+func TestGateway(t *testing.T) {
+	gw, err := Gateway(netip.MustParsePrefix("10.0.16.0/20"))
+	assert.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddr("10.0.16.1"), gw)
+
+	// The host bits of the subnet do not move its gateway
+	gw, err = Gateway(netip.MustParsePrefix("10.0.16.9/20"))
+	assert.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddr("10.0.16.1"), gw)
+
+	gw, err = Gateway(netip.MustParsePrefix("2600:1f14:aaa:bb00::/64"))
+	assert.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddr("2600:1f14:aaa:bb00::1"), gw)
+
+	_, err = Gateway(netip.Prefix{})
+	assert.Error(t, err)
+}
+
+func TestSubtractAll(t *testing.T) {
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2600:1f14::/57"), netip.MustParsePrefix("2600:1f14:0:c0::/58")},
+		SubtractAll([]netip.Prefix{netip.MustParsePrefix("2600:1f14::/56")},
+			[]netip.Prefix{netip.MustParsePrefix("2600:1f14:0:80::/58")}))
+}
+
+func TestParse(t *testing.T) {
+	prefix, err := Parse("10.0.16.9/20")
+	assert.NoError(t, err)
+	assert.Equal(t, netip.MustParsePrefix("10.0.16.0/20"), prefix)
+
+	_, err = Parse("10.0.16.0")
+	assert.Error(t, err)
+
+	_, err = ParseAll([]string{"10.0.0.0/16", "invalid"})
+	assert.Error(t, err)
+}
+
+func TestIPNet(t *testing.T) {
+	ipNet := IPNet(netip.MustParsePrefix("10.0.16.0/20"))
+	assert.Equal(t, "10.0.16.0/20", ipNet.String())
+	assert.Len(t, ipNet.IP, net.IPv4len)
+	assert.Equal(t, netip.MustParsePrefix("10.0.16.0/20"), FromIPNet(ipNet))
+
+	_, ipNet, _ = net.ParseCIDR("2600:1f14::/56")
+	assert.Equal(t, netip.MustParsePrefix("2600:1f14::/56"), FromIPNet(ipNet))
+	assert.Nil(t, IPNet(netip.Prefix{}))
+	assert.False(t, FromIPNet(nil).IsValid())
+
+	assert.Equal(t, netip.MustParseAddr("10.0.0.1"), FromIP(net.IPv4(10, 0, 0, 1)))
+	assert.Nil(t, IP(netip.Addr{}))
+}
@@ -0,0 +1,38 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build !faultinjection
+// +build !faultinjection
+
+package faultinjection
+
+// Enabled is true in binaries built with the faultinjection build tag
+const Enabled = false
+
+// Set returns ErrDisabled
+func Set(point string, fault Fault) error {
+	return ErrDisabled
+}
+
+// Clear does nothing
+func Clear(point string) {}
+
+// List returns no faults
+func List() map[string]Fault {
+	return nil
+}
+
+// Inject does nothing
+func Inject(point string) error {
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build faultinjection
+// +build faultinjection
+
+package faultinjection
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// Enabled is true in binaries built with the faultinjection build tag
+const Enabled = true
+
+var (
+	lock   sync.Mutex
+	faults = make(map[string]*Fault)
+)
+
+// Set injects the fault at the point, replacing the fault already set there
+func Set(point string, fault Fault) error {
+	lock.Lock()
+	defer lock.Unlock()
+	log.Warnf("Injecting fault at %s: %+v", point, fault)
+	faults[point] = &fault
+	return nil
+}
+
+// Clear removes the fault at the point, or all the faults if the point is empty
+func Clear(point string) {
+	lock.Lock()
+	defer lock.Unlock()
+	if point == "" {
+		faults = make(map[string]*Fault)
+		return
+	}
+	delete(faults, point)
+}
+
+// List returns the faults currently set, by point
+func List() map[string]Fault {
+	lock.Lock()
+	defer lock.Unlock()
+	list := make(map[string]Fault, len(faults))
+	for point, fault := range faults {
+		list[point] = *fault
+	}
+	return list
+}
+
+// Inject applies the fault set at the point, if any: it sleeps for its delay, then returns its error
+func Inject(point string) error {
+	fault, ok := take(point)
+	if !ok {
+		return nil
+	}
+	if fault.DelayMs > 0 {
+		time.Sleep(time.Duration(fault.DelayMs) * time.Millisecond)
+	}
+	if fault.Error != "" {
+		return &InjectedError{Point: point, Message: fault.Error}
+	}
+	return nil
+}
+
+// take returns the fault that applies to the point, and counts it
+func take(point string) (Fault, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+	key := point
+	fault, ok := faults[key]
+	if !ok {
+		// The longest matching prefix wins
+		for pattern, f := range faults {
+			prefix := strings.TrimSuffix(pattern, "*")
+			if prefix != pattern && strings.HasPrefix(point, prefix) && (!ok || len(pattern) > len(key)) {
+				key, fault, ok = pattern, f, true
+			}
+		}
+	}
+	if !ok {
+		return Fault{}, false
+	}
+	if fault.Count > 0 {
+		fault.Count--
+		if fault.Count == 0 {
+			delete(faults, key)
+		}
+	}
+	return *fault, true
+}
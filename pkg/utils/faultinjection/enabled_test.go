@@ -0,0 +1,49 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build faultinjection
+// +build faultinjection
+
+package faultinjection
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInject(t *testing.T) {
+	defer Clear("")
+
+	assert.NoError(t, Inject("netlink.RouteAdd"))
+
+	assert.NoError(t, Set("netlink.RouteAdd", Fault{Error: "file exists", Count: 2}))
+	assert.EqualError(t, Inject("netlink.RouteAdd"), "injected fault at netlink.RouteAdd: file exists")
+	assert.Error(t, Inject("netlink.RouteAdd"))
+	// The fault is cleared once its count is reached
+	assert.NoError(t, Inject("netlink.RouteAdd"))
+	assert.Empty(t, List())
+
+	// The longest prefix wins
+	assert.NoError(t, Set("ec2.*", Fault{Error: "RequestLimitExceeded"}))
+	assert.NoError(t, Set("ec2.Describe*", Fault{DelayMs: 10}))
+	start := time.Now()
+	assert.NoError(t, Inject("ec2.DescribeInstances"))
+	assert.True(t, time.Since(start) >= 10*time.Millisecond)
+	assert.Error(t, Inject("ec2.AttachNetworkInterface"))
+	assert.NoError(t, Inject("netlink.RouteAdd"))
+
+	Clear("ec2.*")
+	assert.Equal(t, map[string]Fault{"ec2.Describe*": {DelayMs: 10}}, List())
+}
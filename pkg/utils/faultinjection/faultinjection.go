@@ -0,0 +1,58 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package faultinjection lets integration tests delay or fail calls to netlink, EC2 and the gRPC replies of ipamd, to
+// exercise their retry and rollback paths. Faults can only be injected in binaries built with the faultinjection build
+// tag, Inject is a no-op otherwise.
+package faultinjection
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Injection points are named after the call they are in, e.g. "netlink.RouteAdd", "ec2.AssignPrivateIpAddresses" or
+// "grpc.AddNetwork". A fault set on a prefix ending with "*", e.g. "ec2.*", applies to all the calls it matches.
+const (
+	// NetlinkPrefix is the prefix of the netlink injection points
+	NetlinkPrefix = "netlink."
+	// EC2Prefix is the prefix of the EC2 injection points
+	EC2Prefix = "ec2."
+	// GRPCPrefix is the prefix of the injection points in the gRPC replies of ipamd
+	GRPCPrefix = "grpc."
+)
+
+// ErrDisabled is returned when setting a fault in a binary built without the faultinjection build tag
+var ErrDisabled = errors.New("fault injection is not enabled in this build")
+
+// Fault describes what happens when an injection point is reached
+type Fault struct {
+	// DelayMs is how long the call is delayed, in milliseconds
+	DelayMs int64 `json:"delayMs,omitempty"`
+	// Error makes the call fail with this error. For EC2 calls it is used as the error code, e.g.
+	// "RequestLimitExceeded" throttles them.
+	Error string `json:"error,omitempty"`
+	// Count is the number of times the fault is injected before it is cleared, 0 for no limit
+	Count int `json:"count,omitempty"`
+}
+
+// InjectedError is the error returned by a call with a fault
+type InjectedError struct {
+	Point   string
+	Message string
+}
+
+func (e *InjectedError) Error() string {
+	return fmt.Sprintf("injected fault at %s: %s", e.Point, e.Message)
+}
@@ -0,0 +1,284 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package logger
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// envLogCloudWatchGroup is the name of the environment variable with the CloudWatch Logs group the cloudwatch
+	// sink writes to. The group has to exist.
+	envLogCloudWatchGroup = "AWS_VPC_K8S_CNI_LOG_CLOUDWATCH_GROUP"
+
+	// envLogCloudWatchStream is the name of the environment variable with the log stream of the node in the group,
+	// it is created if needed. Defaults to the host name.
+	envLogCloudWatchStream = "AWS_VPC_K8S_CNI_LOG_CLOUDWATCH_STREAM"
+
+	// envLogCloudWatchFlushInterval is the name of the environment variable that sets how often the buffered
+	// messages are sent to CloudWatch Logs. Defaults to 5 seconds.
+	envLogCloudWatchFlushInterval     = "AWS_VPC_K8S_CNI_LOG_CLOUDWATCH_FLUSH_INTERVAL"
+	defaultLogCloudWatchFlushInterval = 5 * time.Second
+
+	// Limits of a PutLogEvents call
+	maxBatchEvents   = 10000
+	maxBatchBytes    = 1048576
+	maxEventBytes    = 262144
+	eventOverhead    = 26
+	maxBufferedBytes = 4 * maxBatchBytes
+)
+
+// cloudWatchReceiver is a seelog custom receiver that buffers the messages and sends them to a CloudWatch Logs stream
+// in batches. Messages are dropped when CloudWatch Logs can not keep up, rather than slowing ipamd down.
+type cloudWatchReceiver struct {
+	client        cloudwatchlogsiface.CloudWatchLogsAPI
+	group         string
+	stream        string
+	flushInterval time.Duration
+
+	lock          sync.Mutex
+	events        []*cloudwatchlogs.InputLogEvent
+	bufferedBytes int
+	dropped       int
+
+	// sendLock serializes the calls to CloudWatch Logs, which need the sequence token of the previous call
+	sendLock      sync.Mutex
+	streamCreated bool
+	token         *string
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newCloudWatchReceiverFromEnv() (log.CustomReceiver, error) {
+	group := os.Getenv(envLogCloudWatchGroup)
+	if group == "" {
+		return nil, errors.Errorf("%s is not set", envLogCloudWatchGroup)
+	}
+	stream := os.Getenv(envLogCloudWatchStream)
+	if stream == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get the host name for the log stream")
+		}
+		stream = hostname
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		region, err := ec2metadata.New(sess).Region()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get the region")
+		}
+		sess.Config.Region = aws.String(region)
+	}
+
+	r := newCloudWatchReceiver(cloudwatchlogs.New(sess), group, stream, getLogCloudWatchFlushInterval())
+	r.start()
+	return r, nil
+}
+
+func newCloudWatchReceiver(client cloudwatchlogsiface.CloudWatchLogsAPI, group, stream string,
+	flushInterval time.Duration) *cloudWatchReceiver {
+	return &cloudWatchReceiver{
+		client:        client,
+		group:         group,
+		stream:        stream,
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+	}
+}
+
+// ReceiveMessage buffers the message until the next flush
+func (r *cloudWatchReceiver) ReceiveMessage(message string, level log.LogLevel, context log.LogContextInterface) error {
+	message = strings.TrimSuffix(message, "\n")
+	if len(message) > maxEventBytes-eventOverhead {
+		message = message[:maxEventBytes-eventOverhead]
+	}
+	size := len(message) + eventOverhead
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.bufferedBytes+size > maxBufferedBytes {
+		r.dropped++
+		return nil
+	}
+	r.events = append(r.events, &cloudwatchlogs.InputLogEvent{
+		Message:   aws.String(message),
+		Timestamp: aws.Int64(time.Now().UnixNano() / int64(time.Millisecond)),
+	})
+	r.bufferedBytes += size
+	return nil
+}
+
+// start periodically sends the buffered messages
+func (r *cloudWatchReceiver) start() {
+	r.wg.Add(1)
+	ticker := time.NewTicker(r.flushInterval)
+	go func() {
+		defer r.wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.Flush()
+			case <-r.done:
+				return
+			}
+		}
+	}()
+}
+
+// next takes the next batch of buffered messages
+func (r *cloudWatchReceiver) next() ([]*cloudwatchlogs.InputLogEvent, int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	size, n := 0, 0
+	for n < len(r.events) && n < maxBatchEvents {
+		eventSize := len(aws.StringValue(r.events[n].Message)) + eventOverhead
+		if size+eventSize > maxBatchBytes {
+			break
+		}
+		size += eventSize
+		n++
+	}
+	batch := r.events[:n]
+	r.events = r.events[n:]
+	r.bufferedBytes -= size
+	dropped := r.dropped
+	r.dropped = 0
+	return batch, dropped
+}
+
+// Flush sends all the buffered messages. The messages of a batch that fails are dropped, the error is printed as it
+// can not be logged.
+func (r *cloudWatchReceiver) Flush() {
+	r.sendLock.Lock()
+	defer r.sendLock.Unlock()
+	for {
+		batch, dropped := r.next()
+		if dropped > 0 {
+			fmt.Printf("Dropped %d log messages, CloudWatch Logs is not keeping up\n", dropped)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := r.put(batch); err != nil {
+			fmt.Printf("Failed to send %d log messages to CloudWatch Logs: %v\n", len(batch), err)
+			return
+		}
+	}
+}
+
+// put sends a batch, creating the log stream first if needed
+func (r *cloudWatchReceiver) put(batch []*cloudwatchlogs.InputLogEvent) error {
+	if !r.streamCreated {
+		_, err := r.client.CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
+			LogGroupName:  aws.String(r.group),
+			LogStreamName: aws.String(r.stream),
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != cloudwatchlogs.ErrCodeResourceAlreadyExistsException {
+				return errors.Wrapf(err, "failed to create log stream %s", r.stream)
+			}
+			// The stream was created before, e.g. by a previous run of ipamd, continue after its last message
+			if err := r.refreshToken(); err != nil {
+				return err
+			}
+		}
+		r.streamCreated = true
+	}
+
+	input := &cloudwatchlogs.PutLogEventsInput{
+		LogGroupName:  aws.String(r.group),
+		LogStreamName: aws.String(r.stream),
+		LogEvents:     batch,
+	}
+	for attempt := 0; ; attempt++ {
+		input.SequenceToken = r.token
+		output, err := r.client.PutLogEvents(input)
+		if err == nil {
+			r.token = output.NextSequenceToken
+			return nil
+		}
+		aerr, ok := err.(awserr.Error)
+		if attempt > 0 || !ok || (aerr.Code() != cloudwatchlogs.ErrCodeInvalidSequenceTokenException &&
+			aerr.Code() != cloudwatchlogs.ErrCodeDataAlreadyAcceptedException) {
+			return err
+		}
+		// Another writer used the stream, retry once with its current token
+		if err := r.refreshToken(); err != nil {
+			return err
+		}
+	}
+}
+
+// refreshToken gets the sequence token of the next message of the log stream
+func (r *cloudWatchReceiver) refreshToken() error {
+	output, err := r.client.DescribeLogStreams(&cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName:        aws.String(r.group),
+		LogStreamNamePrefix: aws.String(r.stream),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to describe log stream %s", r.stream)
+	}
+	r.token = nil
+	for _, stream := range output.LogStreams {
+		if aws.StringValue(stream.LogStreamName) == r.stream {
+			r.token = stream.UploadSequenceToken
+		}
+	}
+	return nil
+}
+
+// AfterParse is not used, the receiver is created by newCloudWatchReceiver
+func (r *cloudWatchReceiver) AfterParse(initArgs log.CustomReceiverInitArgs) error {
+	return nil
+}
+
+// Close stops the periodic flush and sends the remaining messages
+func (r *cloudWatchReceiver) Close() error {
+	close(r.done)
+	r.wg.Wait()
+	r.Flush()
+	return nil
+}
+
+func getLogCloudWatchFlushInterval() time.Duration {
+	if strValue := os.Getenv(envLogCloudWatchFlushInterval); strValue != "" {
+		interval, err := time.ParseDuration(strValue)
+		if err == nil && interval > 0 {
+			return interval
+		}
+		fmt.Printf("Failed to parse %s %q, using default: %v\n", envLogCloudWatchFlushInterval,
+			strValue, defaultLogCloudWatchFlushInterval)
+	}
+	return defaultLogCloudWatchFlushInterval
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package logger
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// dedupReceiverName is the name of the seelog custom receiver that suppresses repeated messages
+	dedupReceiverName = "dedup"
+
+	// maxDedupMessages caps the number of distinct messages tracked, messages beyond it are always logged
+	maxDedupMessages = 1000
+)
+
+// SuppressedMessages counts the warning and error messages that were not logged because they were repeated
+var SuppressedMessages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "awscni_log_suppressed_count",
+		Help: "The number of repeated log messages that were suppressed, by level",
+	},
+	[]string{"level"},
+)
+
+// occurrences tracks a message logged during the current interval
+type occurrences struct {
+	level      log.LogLevel
+	message    string
+	firstSeen  time.Time
+	suppressed int
+}
+
+// dedupReceiver is a seelog custom receiver that forwards messages to the configured output, except for warnings
+// and errors already logged during the interval. A summary with the number of suppressed occurrences of a message is
+// logged once its interval is over.
+type dedupReceiver struct {
+	output   log.LoggerInterface
+	interval time.Duration
+	now      func() time.Time
+
+	lock sync.Mutex
+	seen map[string]*occurrences
+	done chan struct{}
+}
+
+func newDedupReceiver(output log.LoggerInterface, interval time.Duration) *dedupReceiver {
+	return &dedupReceiver{
+		output:   output,
+		interval: interval,
+		now:      time.Now,
+		seen:     make(map[string]*occurrences),
+		done:     make(chan struct{}),
+	}
+}
+
+// ReceiveMessage forwards the message to the output, unless it is suppressed
+func (r *dedupReceiver) ReceiveMessage(message string, level log.LogLevel, context log.LogContextInterface) error {
+	switch level {
+	case log.TraceLvl:
+		r.output.Trace(message)
+	case log.DebugLvl:
+		r.output.Debug(message)
+	case log.InfoLvl:
+		r.output.Info(message)
+	case log.WarnLvl, log.ErrorLvl:
+		if r.suppress(level, message) {
+			return nil
+		}
+		r.write(level, message)
+	case log.CriticalLvl:
+		r.output.Critical(message)
+	}
+	return nil
+}
+
+// suppress returns whether the message was already logged during its interval, and counts it if so
+func (r *dedupReceiver) suppress(level log.LogLevel, message string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := level.String() + message
+	now := r.now()
+	if o, ok := r.seen[key]; ok {
+		if now.Sub(o.firstSeen) < r.interval {
+			o.suppressed++
+			SuppressedMessages.WithLabelValues(level.String()).Inc()
+			return true
+		}
+		r.summarize(o)
+		delete(r.seen, key)
+	}
+	if len(r.seen) < maxDedupMessages {
+		r.seen[key] = &occurrences{level: level, message: message, firstSeen: now}
+	}
+	return false
+}
+
+// summarize logs how many occurrences of a message were suppressed, if any
+func (r *dedupReceiver) summarize(o *occurrences) {
+	if o.suppressed == 0 {
+		return
+	}
+	r.write(o.level, fmt.Sprintf("%s (repeated %d more times in %v)", o.message, o.suppressed, r.interval))
+}
+
+// flushExpired summarizes and forgets the messages whose interval is over
+func (r *dedupReceiver) flushExpired(all bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := r.now()
+	for key, o := range r.seen {
+		if all || now.Sub(o.firstSeen) >= r.interval {
+			r.summarize(o)
+			delete(r.seen, key)
+		}
+	}
+}
+
+func (r *dedupReceiver) write(level log.LogLevel, message string) {
+	if level == log.ErrorLvl {
+		_ = r.output.Error(message)
+	} else {
+		_ = r.output.Warn(message)
+	}
+}
+
+// start periodically logs the summaries of the messages whose interval is over, so that they show up even if the
+// message is not logged again
+func (r *dedupReceiver) start() {
+	ticker := time.NewTicker(r.interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.flushExpired(false)
+			case <-r.done:
+				return
+			}
+		}
+	}()
+}
+
+// AfterParse is not used, the receiver is created by newDedupReceiver
+func (r *dedupReceiver) AfterParse(initArgs log.CustomReceiverInitArgs) error {
+	return nil
+}
+
+// Flush flushes the output
+func (r *dedupReceiver) Flush() {
+	r.output.Flush()
+}
+
+// Close logs the pending summaries and closes the output
+func (r *dedupReceiver) Close() error {
+	close(r.done)
+	r.flushExpired(true)
+	r.output.Close()
+	return nil
+}
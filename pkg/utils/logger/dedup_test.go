@@ -0,0 +1,84 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package logger
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupReceiver(t *testing.T) {
+	var buf bytes.Buffer
+	output, err := log.LoggerFromWriterWithMinLevelAndFormat(&buf, log.TraceLvl, "[%LEVEL] %Msg%n")
+	assert.NoError(t, err)
+
+	now := time.Now()
+	receiver := newDedupReceiver(output, time.Minute)
+	receiver.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		_ = receiver.ReceiveMessage("throttled", log.ErrorLvl, nil)
+		_ = receiver.ReceiveMessage("throttled", log.WarnLvl, nil)
+		_ = receiver.ReceiveMessage("retrying", log.InfoLvl, nil)
+	}
+	receiver.Flush()
+	assert.Equal(t, "[ERROR] throttled\n[WARN] throttled\n[INFO] retrying\n[INFO] retrying\n[INFO] retrying\n", buf.String())
+
+	// The summary is logged once the interval is over
+	buf.Reset()
+	now = now.Add(30 * time.Second)
+	receiver.flushExpired(false)
+	receiver.Flush()
+	assert.Equal(t, "", buf.String())
+	now = now.Add(30 * time.Second)
+	receiver.flushExpired(false)
+	receiver.Flush()
+	assert.Equal(t, "[ERROR] throttled (repeated 2 more times in 1m0s)\n[WARN] throttled (repeated 2 more times in 1m0s)\n",
+		sortedLines(buf.String()))
+
+	// or when the message is logged again after it
+	buf.Reset()
+	_ = receiver.ReceiveMessage("throttled", log.ErrorLvl, nil)
+	_ = receiver.ReceiveMessage("throttled", log.ErrorLvl, nil)
+	now = now.Add(time.Minute)
+	_ = receiver.ReceiveMessage("throttled", log.ErrorLvl, nil)
+	receiver.Flush()
+	assert.Equal(t, "[ERROR] throttled\n[ERROR] throttled (repeated 1 more times in 1m0s)\n[ERROR] throttled\n", buf.String())
+}
+
+func TestGetLogDedupInterval(t *testing.T) {
+	defer os.Unsetenv(envLogDedupInterval)
+
+	assert.Equal(t, defaultLogDedupInterval, getLogDedupInterval())
+	_ = os.Setenv(envLogDedupInterval, "0")
+	assert.Equal(t, time.Duration(0), getLogDedupInterval())
+	_ = os.Setenv(envLogDedupInterval, "10s")
+	assert.Equal(t, 10*time.Second, getLogDedupInterval())
+	_ = os.Setenv(envLogDedupInterval, "-1s")
+	assert.Equal(t, defaultLogDedupInterval, getLogDedupInterval())
+}
+
+// sortedLines sorts the lines of messages logged in no particular order
+func sortedLines(s string) string {
+	lines := strings.SplitAfter(s, "\n")
+	sort.Strings(lines)
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// journaldSocket is the socket of the native protocol of journald, it has to be mounted into the aws-node pod
+	journaldSocket = "/run/systemd/journal/socket"
+
+	// journaldIdentifier is the SYSLOG_IDENTIFIER of the messages, to filter them with journalctl -t aws-node
+	journaldIdentifier = "aws-node"
+)
+
+// journaldPriorities maps the seelog levels to the syslog priorities journald uses
+var journaldPriorities = map[log.LogLevel]string{
+	log.TraceLvl:    "7",
+	log.DebugLvl:    "7",
+	log.InfoLvl:     "6",
+	log.WarnLvl:     "4",
+	log.ErrorLvl:    "3",
+	log.CriticalLvl: "2",
+}
+
+// journaldReceiver is a seelog custom receiver that sends each message to journald with its priority
+type journaldReceiver struct {
+	conn *net.UnixConn
+}
+
+func newJournaldReceiverFromEnv() (log.CustomReceiver, error) {
+	return newJournaldReceiver(journaldSocket)
+}
+
+func newJournaldReceiver(socket string) (*journaldReceiver, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldReceiver{conn: conn}, nil
+}
+
+// ReceiveMessage sends the message as a datagram of the journald native protocol
+func (r *journaldReceiver) ReceiveMessage(message string, level log.LogLevel, context log.LogContextInterface) error {
+	var b bytes.Buffer
+	writeJournaldField(&b, "PRIORITY", journaldPriorities[level])
+	writeJournaldField(&b, "SYSLOG_IDENTIFIER", journaldIdentifier)
+	writeJournaldField(&b, "MESSAGE", strings.TrimSuffix(message, "\n"))
+	_, err := r.conn.Write(b.Bytes())
+	return err
+}
+
+// writeJournaldField writes a field, values spanning several lines are written with their length instead of a "="
+func writeJournaldField(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		b.WriteString("=")
+		b.WriteString(value)
+		b.WriteString("\n")
+		return
+	}
+	b.WriteString("\n")
+	_ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteString("\n")
+}
+
+// AfterParse is not used, the receiver is created by newJournaldReceiver
+func (r *journaldReceiver) AfterParse(initArgs log.CustomReceiverInitArgs) error {
+	return nil
+}
+
+// Flush does nothing, the messages are sent as they are received
+func (r *journaldReceiver) Flush() {}
+
+// Close closes the connection to journald
+func (r *journaldReceiver) Close() error {
+	return r.conn.Close()
+}
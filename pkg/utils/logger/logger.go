@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	log "github.com/cihub/seelog"
 )
@@ -24,17 +25,37 @@ import (
 const (
 	envLogLevel    = "AWS_VPC_K8S_CNI_LOGLEVEL"
 	envLogFilePath = "AWS_VPC_K8S_CNI_LOG_FILE"
+
+	// envLogDedupInterval is the name of the environment variable that sets for how long a warning or error message
+	// that was logged is not logged again, e.g. "1m". The number of suppressed occurrences is logged once the interval
+	// is over. Set it to "0" to log every message. Defaults to 1 minute.
+	envLogDedupInterval     = "AWS_VPC_K8S_CNI_LOG_DEDUP_INTERVAL"
+	defaultLogDedupInterval = time.Minute
+
 	// logConfigFormat defines the seelog format, with a rolling file
 	// writer. We cannot do this in code and have to resort to using
 	// LoggerFromConfigAsString as seelog doesn't have a usable public
 	// implementation of NewRollingFileWriterTime
 	logConfigFormat = `
-<seelog type="asyncloop" minlevel="%s">
+<seelog type="%s" minlevel="%s">
  <outputs formatid="main">
   %s
  </outputs>
  <formats>
   <format id="main" format="%%UTCDate(2006-01-02T15:04:05.000Z07:00) [%%LEVEL]%%t%%Msg%%n" />
+  <format id="msg" format="%%Msg" />
+ </formats>
+</seelog>
+`
+	// dedupLogConfigFormat defines the seelog format used when repeated messages are suppressed, the messages are
+	// formatted by the logger defined by logConfigFormat that the dedup receiver forwards them to
+	dedupLogConfigFormat = `
+<seelog type="asyncloop" minlevel="%s">
+ <outputs formatid="msg">
+  <custom name="%s" />
+ </outputs>
+ <formats>
+  <format id="msg" format="%%Msg" />
  </formats>
 </seelog>
 `
@@ -51,7 +72,7 @@ func GetLogFileLocation(defaultLogFilePath string) string {
 
 // SetupLogger sets up a file logger
 func SetupLogger(logFilePath string) {
-	logger, err := log.LoggerFromConfigAsString(fmt.Sprintf(logConfigFormat, getLogLevel(), getLogOutput(logFilePath)))
+	logger, err := newLogger(logFilePath, getLogDedupInterval())
 	if err != nil {
 		fmt.Println("Error setting up logger: ", err)
 		return
@@ -63,6 +84,55 @@ func SetupLogger(logFilePath string) {
 	}
 }
 
+func newLogger(logFilePath string, dedupInterval time.Duration) (log.LoggerInterface, error) {
+	sinks := newSinks()
+	outputs := getLogOutput(logFilePath)
+	if len(sinks) > 0 {
+		outputs += "\n  " + sinks.outputs()
+	}
+	if dedupInterval == 0 {
+		logger, err := log.LoggerFromParamConfigAsString(fmt.Sprintf(logConfigFormat, "asyncloop", getLogLevel(), outputs),
+			sinks.params())
+		if err != nil {
+			sinks.close()
+		}
+		return logger, err
+	}
+	// The messages are already queued by the dedup logger
+	output, err := log.LoggerFromParamConfigAsString(fmt.Sprintf(logConfigFormat, "sync", getLogLevel(), outputs),
+		sinks.params())
+	if err != nil {
+		sinks.close()
+		return nil, err
+	}
+	receiver := newDedupReceiver(output, dedupInterval)
+	logger, err := log.LoggerFromParamConfigAsString(fmt.Sprintf(dedupLogConfigFormat, getLogLevel(), dedupReceiverName),
+		&log.CfgParseParams{
+			CustomReceiverProducers: map[string]log.CustomReceiverProducer{
+				dedupReceiverName: func(log.CustomReceiverInitArgs) (log.CustomReceiver, error) {
+					return receiver, nil
+				},
+			},
+		})
+	if err != nil {
+		output.Close()
+		return nil, err
+	}
+	receiver.start()
+	return logger, nil
+}
+
+func getLogDedupInterval() time.Duration {
+	if strValue := os.Getenv(envLogDedupInterval); strValue != "" {
+		interval, err := time.ParseDuration(strValue)
+		if err == nil && interval >= 0 {
+			return interval
+		}
+		fmt.Printf("Failed to parse %s %q, using default: %v\n", envLogDedupInterval, strValue, defaultLogDedupInterval)
+	}
+	return defaultLogDedupInterval
+}
+
 func getLogLevel() string {
 	seelogLevel, ok := log.LogLevelFromString(strings.ToLower(os.Getenv(envLogLevel)))
 	if !ok {
@@ -0,0 +1,103 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package logger
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// envLogSinks is the name of the environment variable with the comma separated list of the sinks ipamd also
+	// writes its logs to, besides the log file: "journald" and "cloudwatch"
+	envLogSinks = "AWS_VPC_K8S_CNI_LOG_SINKS"
+
+	journaldSinkName   = "journald"
+	cloudWatchSinkName = "cloudwatch"
+)
+
+// sinkProducers create the receivers of the sinks by name
+var sinkProducers = map[string]func() (log.CustomReceiver, error){
+	journaldSinkName:   newJournaldReceiverFromEnv,
+	cloudWatchSinkName: newCloudWatchReceiverFromEnv,
+}
+
+// sinks are the receivers of the log sinks that could be set up
+type sinks map[string]log.CustomReceiver
+
+// newSinks sets up the sinks listed in envLogSinks. A sink that can not be set up is skipped, so that a broken sink
+// never prevents logging to the file.
+func newSinks() sinks {
+	s := make(sinks)
+	for _, name := range getLogSinks() {
+		produce, ok := sinkProducers[name]
+		if !ok {
+			fmt.Printf("Unknown log sink %q in %s, skipping it\n", name, envLogSinks)
+			continue
+		}
+		receiver, err := produce()
+		if err != nil {
+			fmt.Printf("Failed to set up log sink %s, skipping it: %v\n", name, err)
+			continue
+		}
+		s[name] = receiver
+	}
+	return s
+}
+
+// outputs returns the seelog outputs of the sinks
+func (s sinks) outputs() string {
+	var outputs []string
+	for name := range s {
+		// journald records the time and level of each message, only the message itself is sent
+		formatID := "main"
+		if name == journaldSinkName {
+			formatID = "msg"
+		}
+		outputs = append(outputs, fmt.Sprintf(`<custom name="%s" formatid="%s" />`, name, formatID))
+	}
+	return strings.Join(outputs, "\n  ")
+}
+
+// params returns the seelog parameters that make the receivers of the sinks available to the config
+func (s sinks) params() *log.CfgParseParams {
+	producers := make(map[string]log.CustomReceiverProducer)
+	for name, receiver := range s {
+		receiver := receiver
+		producers[name] = func(log.CustomReceiverInitArgs) (log.CustomReceiver, error) {
+			return receiver, nil
+		}
+	}
+	return &log.CfgParseParams{CustomReceiverProducers: producers}
+}
+
+// close closes the receivers of the sinks, for when the logger using them could not be created
+func (s sinks) close() {
+	for _, receiver := range s {
+		_ = receiver.Close()
+	}
+}
+
+func getLogSinks() []string {
+	var names []string
+	for _, name := range strings.Split(os.Getenv(envLogSinks), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
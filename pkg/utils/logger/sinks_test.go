@@ -0,0 +1,152 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package logger
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	log "github.com/cihub/seelog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetLogSinks(t *testing.T) {
+	defer os.Unsetenv(envLogSinks)
+
+	assert.Empty(t, getLogSinks())
+	_ = os.Setenv(envLogSinks, " journald, CloudWatch,")
+	assert.Equal(t, []string{"journald", "cloudwatch"}, getLogSinks())
+
+	// Sinks that are unknown or can not be set up are skipped
+	_ = os.Setenv(envLogSinks, "syslog,cloudwatch")
+	assert.Empty(t, newSinks())
+}
+
+func TestJournaldReceiver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journald")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "socket")
+	journal, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	assert.NoError(t, err)
+	defer journal.Close()
+
+	receiver, err := newJournaldReceiver(socket)
+	assert.NoError(t, err)
+	defer receiver.Close()
+
+	buf := make([]byte, 1024)
+	assert.NoError(t, receiver.ReceiveMessage("Failed to allocate ENI\n", log.ErrorLvl, nil))
+	n, err := journal.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "PRIORITY=3\nSYSLOG_IDENTIFIER=aws-node\nMESSAGE=Failed to allocate ENI\n", string(buf[:n]))
+
+	// Messages spanning several lines are sent with their length
+	assert.NoError(t, receiver.ReceiveMessage("line 1\nline 2", log.InfoLvl, nil))
+	n, err = journal.Read(buf)
+	assert.NoError(t, err)
+	message := string(buf[:n])
+	assert.True(t, strings.HasPrefix(message, "PRIORITY=6\nSYSLOG_IDENTIFIER=aws-node\nMESSAGE\n"))
+	length := buf[len("PRIORITY=6\nSYSLOG_IDENTIFIER=aws-node\nMESSAGE\n"):]
+	assert.Equal(t, uint64(len("line 1\nline 2")), binary.LittleEndian.Uint64(length[:8]))
+	assert.True(t, strings.HasSuffix(message, "line 1\nline 2\n"))
+}
+
+type mockCloudWatchLogs struct {
+	cloudwatchlogsiface.CloudWatchLogsAPI
+	streamExists bool
+	token        int
+	// staleToken makes the next PutLogEvents fail as if another writer used the stream
+	staleToken bool
+	batches    [][]string
+}
+
+func (m *mockCloudWatchLogs) CreateLogStream(*cloudwatchlogs.CreateLogStreamInput) (*cloudwatchlogs.CreateLogStreamOutput, error) {
+	if m.streamExists {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeResourceAlreadyExistsException, "exists", nil)
+	}
+	m.streamExists = true
+	return &cloudwatchlogs.CreateLogStreamOutput{}, nil
+}
+
+func (m *mockCloudWatchLogs) DescribeLogStreams(*cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	return &cloudwatchlogs.DescribeLogStreamsOutput{LogStreams: []*cloudwatchlogs.LogStream{
+		{LogStreamName: aws.String("node-1-other")},
+		{LogStreamName: aws.String("node-1"), UploadSequenceToken: aws.String(m.currentToken())},
+	}}, nil
+}
+
+func (m *mockCloudWatchLogs) currentToken() string {
+	return string(rune('a' + m.token))
+}
+
+func (m *mockCloudWatchLogs) PutLogEvents(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	if m.staleToken {
+		m.staleToken = false
+		m.token++
+	}
+	if (m.token == 0 && input.SequenceToken != nil) || (m.token > 0 && aws.StringValue(input.SequenceToken) != m.currentToken()) {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeInvalidSequenceTokenException, "invalid token", nil)
+	}
+	var batch []string
+	for _, event := range input.LogEvents {
+		batch = append(batch, aws.StringValue(event.Message))
+	}
+	m.batches = append(m.batches, batch)
+	m.token++
+	return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String(m.currentToken())}, nil
+}
+
+func TestCloudWatchReceiver(t *testing.T) {
+	client := &mockCloudWatchLogs{}
+	receiver := newCloudWatchReceiver(client, "/aws/eks/cni", "node-1", time.Minute)
+
+	_ = receiver.ReceiveMessage("2019-06-20T18:04:31.000Z [INFO]\tStarting L-IPAMD\n", log.InfoLvl, nil)
+	_ = receiver.ReceiveMessage("2019-06-20T18:04:32.000Z [INFO]\tServing RPC Handler\n", log.InfoLvl, nil)
+	receiver.Flush()
+	assert.Equal(t, [][]string{{"2019-06-20T18:04:31.000Z [INFO]\tStarting L-IPAMD",
+		"2019-06-20T18:04:32.000Z [INFO]\tServing RPC Handler"}}, client.batches)
+
+	// A stale sequence token is refreshed once
+	client.staleToken = true
+	_ = receiver.ReceiveMessage("retried", log.InfoLvl, nil)
+	receiver.Flush()
+	assert.Equal(t, []string{"retried"}, client.batches[1])
+
+	// A restarted ipamd continues the existing stream
+	restarted := newCloudWatchReceiver(client, "/aws/eks/cni", "node-1", time.Minute)
+	_ = restarted.ReceiveMessage("restarted", log.InfoLvl, nil)
+	assert.NoError(t, restarted.Close())
+	assert.Equal(t, []string{"restarted"}, client.batches[2])
+
+	// Messages beyond the buffer are dropped until the next flush
+	full := newCloudWatchReceiver(client, "/aws/eks/cni", "node-1", time.Minute)
+	large := strings.Repeat("x", maxEventBytes)
+	for i := 0; i < maxBufferedBytes/maxEventBytes+1; i++ {
+		_ = full.ReceiveMessage(large, log.InfoLvl, nil)
+	}
+	assert.Equal(t, 1, full.dropped)
+	assert.Len(t, full.events, maxBufferedBytes/maxEventBytes)
+	assert.Len(t, aws.StringValue(full.events[0].Message), maxEventBytes-eventOverhead)
+}
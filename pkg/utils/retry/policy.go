@@ -0,0 +1,178 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package retry
+
+import (
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// envPrefix is the prefix of the environment variables that override the retry policies. The variables of a single
+	// dependency insert its name after it, e.g. AWS_VPC_K8S_CNI_RETRY_EC2_MAX_ATTEMPTS.
+	envPrefix = "AWS_VPC_K8S_CNI_RETRY_"
+
+	// envInitialDelay is the name of the environment variable that overrides the delay before the first retry of every
+	// call to IMDS, EC2, the Kubernetes API server and netlink, e.g. "500ms"
+	envInitialDelay = "AWS_VPC_K8S_CNI_RETRY_INITIAL_DELAY"
+
+	// envMaxDelay is the name of the environment variable that overrides the maximum delay between two retries
+	envMaxDelay = "AWS_VPC_K8S_CNI_RETRY_MAX_DELAY"
+
+	// envMultiplier is the name of the environment variable that overrides the factor the delay grows by after each
+	// retry
+	envMultiplier = "AWS_VPC_K8S_CNI_RETRY_MULTIPLIER"
+
+	// envJitter is the name of the environment variable that overrides the fraction of the delay that is randomly added
+	// to it, e.g. 0.2 adds up to 20%
+	envJitter = "AWS_VPC_K8S_CNI_RETRY_JITTER"
+
+	// envMaxAttempts is the name of the environment variable that overrides the number of attempts made before giving up,
+	// including the first one
+	envMaxAttempts = "AWS_VPC_K8S_CNI_RETRY_MAX_ATTEMPTS"
+)
+
+// Policy describes how a call to an external dependency is retried
+type Policy struct {
+	// Name is the name of the dependency in the environment variables that override its policy only, e.g. "EC2"
+	Name string
+	// InitialDelay is the delay before the first retry
+	InitialDelay time.Duration
+	// MaxDelay caps the delay between two retries, before jitter
+	MaxDelay time.Duration
+	// Multiplier is the factor the delay grows by after each retry
+	Multiplier float64
+	// Jitter is the fraction of the delay that is randomly added to it
+	Jitter float64
+	// MaxAttempts is the number of attempts made before giving up, including the first one
+	MaxAttempts int
+}
+
+// WithEnvOverrides returns the policy with the fields set in the AWS_VPC_K8S_CNI_RETRY_* environment variables
+// replaced, so that every dependency keeps its own defaults but can be tuned from a single place. The fields set in the
+// AWS_VPC_K8S_CNI_RETRY_<Name>_* variables of the dependency of the policy take precedence.
+func (p Policy) WithEnvOverrides() Policy {
+	p = p.withEnvOverrides(envInitialDelay, envMaxDelay, envMultiplier, envJitter, envMaxAttempts)
+	if p.Name != "" {
+		p = p.withEnvOverrides(p.envName(envInitialDelay), p.envName(envMaxDelay), p.envName(envMultiplier),
+			p.envName(envJitter), p.envName(envMaxAttempts))
+	}
+	if p.MaxDelay < p.InitialDelay {
+		p.MaxDelay = p.InitialDelay
+	}
+	return p
+}
+
+func (p Policy) withEnvOverrides(initialDelay, maxDelay, multiplier, jitter, maxAttempts string) Policy {
+	if value, ok := getDurationEnvVar(initialDelay); ok {
+		p.InitialDelay = value
+	}
+	if value, ok := getDurationEnvVar(maxDelay); ok {
+		p.MaxDelay = value
+	}
+	if value, ok := getFloatEnvVar(multiplier, 1); ok {
+		p.Multiplier = value
+	}
+	if value, ok := getFloatEnvVar(jitter, 0); ok {
+		p.Jitter = value
+	}
+	if value, ok := getIntEnvVar(maxAttempts); ok {
+		p.MaxAttempts = value
+	}
+	return p
+}
+
+// envName returns the name of the variable that overrides a field of the policy of the dependency only
+func (p Policy) envName(name string) string {
+	return envPrefix + p.Name + "_" + strings.TrimPrefix(name, envPrefix)
+}
+
+// Backoff returns a Backoff that follows the policy
+func (p Policy) Backoff() Backoff {
+	return NewSimpleBackoff(p.InitialDelay, p.MaxDelay, p.Jitter, p.Multiplier)
+}
+
+// Delay returns the delay before the given retry, starting at 1, including jitter
+func (p Policy) Delay(retry int) time.Duration {
+	if retry < 1 {
+		return 0
+	}
+	delay := time.Duration(math.Min(
+		float64(p.InitialDelay)*math.Pow(math.Max(p.Multiplier, 1), float64(retry-1)),
+		float64(p.MaxDelay)))
+	return AddJitter(delay, time.Duration(float64(delay)*p.Jitter))
+}
+
+// Do calls fn until it succeeds, returns an error that must not be retried, or MaxAttempts is reached
+func (p Policy) Do(fn func() error) error {
+	return RetryNWithBackoff(p.Backoff(), p.MaxAttempts, fn)
+}
+
+// GetConfigForDebug returns the active values of the configuration env vars (for debugging purposes).
+func GetConfigForDebug() map[string]interface{} {
+	overrides := Policy{}.WithEnvOverrides()
+	config := map[string]interface{}{
+		envInitialDelay: overrides.InitialDelay.String(),
+		envMaxDelay:     overrides.MaxDelay.String(),
+		envMultiplier:   overrides.Multiplier,
+		envJitter:       overrides.Jitter,
+		envMaxAttempts:  overrides.MaxAttempts,
+	}
+	// The per-dependency variables that are set, as they are
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if _, ok := config[name]; !ok && strings.HasPrefix(name, envPrefix) {
+			config[name] = value
+		}
+	}
+	return config
+}
+
+func getDurationEnvVar(name string) (time.Duration, bool) {
+	if strValue := os.Getenv(name); strValue != "" {
+		parsedValue, err := time.ParseDuration(strValue)
+		if err == nil && parsedValue >= 0 {
+			return parsedValue, true
+		}
+		log.Errorf("Failed to parse %s %q, using the default delay", name, strValue)
+	}
+	return 0, false
+}
+
+func getFloatEnvVar(name string, minValue float64) (float64, bool) {
+	if strValue := os.Getenv(name); strValue != "" {
+		parsedValue, err := strconv.ParseFloat(strValue, 64)
+		if err == nil && parsedValue >= minValue {
+			return parsedValue, true
+		}
+		log.Errorf("Failed to parse %s %q, using the default value", name, strValue)
+	}
+	return 0, false
+}
+
+func getIntEnvVar(name string) (int, bool) {
+	if strValue := os.Getenv(name); strValue != "" {
+		parsedValue, err := strconv.Atoi(strValue)
+		if err == nil && parsedValue > 0 {
+			return parsedValue, true
+		}
+		log.Errorf("Failed to parse %s %q, using the default number of attempts", name, strValue)
+	}
+	return 0, false
+}
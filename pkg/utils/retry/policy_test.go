@@ -0,0 +1,125 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package retry
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/ttime"
+	mock_ttime "github.com/aws/amazon-vpc-cni-k8s/pkg/utils/ttime/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+var testPolicy = Policy{
+	InitialDelay: 100 * time.Millisecond,
+	MaxDelay:     time.Second,
+	Multiplier:   2,
+	MaxAttempts:  3,
+}
+
+func TestPolicyWithEnvOverrides(t *testing.T) {
+	defer os.Unsetenv(envInitialDelay)
+	defer os.Unsetenv(envMaxDelay)
+	defer os.Unsetenv(envMultiplier)
+	defer os.Unsetenv(envJitter)
+	defer os.Unsetenv(envMaxAttempts)
+
+	assert.Equal(t, testPolicy, testPolicy.WithEnvOverrides())
+
+	_ = os.Setenv(envInitialDelay, "2s")
+	_ = os.Setenv(envMultiplier, "3")
+	_ = os.Setenv(envMaxAttempts, "7")
+	assert.Equal(t, Policy{
+		InitialDelay: 2 * time.Second,
+		MaxDelay:     2 * time.Second,
+		Multiplier:   3,
+		MaxAttempts:  7,
+	}, testPolicy.WithEnvOverrides())
+
+	// Invalid values are ignored
+	_ = os.Setenv(envInitialDelay, "-1s")
+	_ = os.Setenv(envMaxDelay, "soon")
+	_ = os.Setenv(envMultiplier, "0.5")
+	_ = os.Setenv(envJitter, "-1")
+	_ = os.Setenv(envMaxAttempts, "0")
+	assert.Equal(t, testPolicy, testPolicy.WithEnvOverrides())
+}
+
+func TestPolicyWithDependencyEnvOverrides(t *testing.T) {
+	defer os.Unsetenv(envMaxAttempts)
+	defer os.Unsetenv("AWS_VPC_K8S_CNI_RETRY_EC2_MAX_ATTEMPTS")
+	defer os.Unsetenv("AWS_VPC_K8S_CNI_RETRY_EC2_INITIAL_DELAY")
+
+	ec2 := testPolicy
+	ec2.Name = "EC2"
+	imds := testPolicy
+	imds.Name = "IMDS"
+
+	// The variables of a dependency take precedence over the global ones, and only apply to it
+	_ = os.Setenv(envMaxAttempts, "7")
+	_ = os.Setenv("AWS_VPC_K8S_CNI_RETRY_EC2_MAX_ATTEMPTS", "12")
+	_ = os.Setenv("AWS_VPC_K8S_CNI_RETRY_EC2_INITIAL_DELAY", "2s")
+	assert.Equal(t, Policy{
+		Name:         "EC2",
+		InitialDelay: 2 * time.Second,
+		MaxDelay:     2 * time.Second,
+		Multiplier:   2,
+		MaxAttempts:  12,
+	}, ec2.WithEnvOverrides())
+	assert.Equal(t, 7, imds.WithEnvOverrides().MaxAttempts)
+	assert.Equal(t, 100*time.Millisecond, imds.WithEnvOverrides().InitialDelay)
+
+	config := GetConfigForDebug()
+	assert.Equal(t, 7, config[envMaxAttempts])
+	assert.Equal(t, "12", config["AWS_VPC_K8S_CNI_RETRY_EC2_MAX_ATTEMPTS"])
+}
+
+func TestPolicyDelay(t *testing.T) {
+	assert.Equal(t, time.Duration(0), testPolicy.Delay(0))
+	assert.Equal(t, 100*time.Millisecond, testPolicy.Delay(1))
+	assert.Equal(t, 200*time.Millisecond, testPolicy.Delay(2))
+	assert.Equal(t, 800*time.Millisecond, testPolicy.Delay(4))
+	assert.Equal(t, time.Second, testPolicy.Delay(10))
+
+	jittered := testPolicy
+	jittered.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		delay := jittered.Delay(2)
+		assert.True(t, delay >= 200*time.Millisecond && delay <= 300*time.Millisecond, "delay %v out of range", delay)
+	}
+}
+
+func TestPolicyDo(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mocktime := mock_ttime.NewMockTime(ctrl)
+	_time = mocktime
+	defer func() { _time = &ttime.DefaultTime{} }()
+
+	gomock.InOrder(
+		mocktime.EXPECT().Sleep(100*time.Millisecond),
+		mocktime.EXPECT().Sleep(200*time.Millisecond),
+	)
+	attempts := 0
+	err := testPolicy.Do(func() error {
+		attempts++
+		return errors.New("err")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, testPolicy.MaxAttempts, attempts)
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package retry
+
+import (
+	"time"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	awsretry "github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// sdkRetryer retries AWS SDK requests following a Policy. Throttled requests keep the SDK's own delays, which back off
+// further than regular errors.
+type sdkRetryer struct {
+	client.DefaultRetryer
+	policy Policy
+}
+
+// NewSDKRetryer returns an AWS SDK retryer that follows the policy
+func NewSDKRetryer(policy Policy) request.Retryer {
+	maxRetries := policy.MaxAttempts - 1
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	return sdkRetryer{DefaultRetryer: client.DefaultRetryer{NumMaxRetries: maxRetries}, policy: policy}
+}
+
+// RetryRules returns the delay before retrying the request
+func (r sdkRetryer) RetryRules(req *request.Request) time.Duration {
+	if req.IsErrorThrottle() {
+		return r.DefaultRetryer.RetryRules(req)
+	}
+	return r.policy.Delay(req.RetryCount + 1)
+}
+
+// NewSDKV2Retryer returns an AWS SDK v2 retryer that follows the policy. As with NewSDKRetryer, throttled calls keep the
+// SDK's own delays, and the SDK does not limit the rate of the retries on top of the policy.
+func NewSDKV2Retryer(policy Policy) awsv2.Retryer {
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return awsretry.NewStandard(func(o *awsretry.StandardOptions) {
+		o.MaxAttempts = maxAttempts
+		o.Backoff = sdkV2Backoff{
+			policy:    policy,
+			throttles: awsretry.IsErrorThrottles(awsretry.DefaultThrottles),
+			throttled: awsretry.NewExponentialJitterBackoff(awsretry.DefaultMaxBackoff),
+		}
+		o.RateLimiter = ratelimit.None
+	})
+}
+
+// sdkV2Backoff is the delay between the attempts of a call made with the AWS SDK v2
+type sdkV2Backoff struct {
+	policy    Policy
+	throttles awsretry.IsErrorThrottle
+	throttled awsretry.BackoffDelayer
+}
+
+// BackoffDelay returns the delay after the given attempt failed with err
+func (b sdkV2Backoff) BackoffDelay(attempt int, err error) (time.Duration, error) {
+	if b.throttles.IsErrorThrottle(err).Bool() {
+		return b.throttled.BackoffDelay(attempt, err)
+	}
+	return b.policy.Delay(attempt), nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package retry
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSDKV2Retryer(t *testing.T) {
+	retryer := NewSDKV2Retryer(testPolicy)
+	assert.Equal(t, 3, retryer.MaxAttempts())
+	assert.Equal(t, 1, NewSDKV2Retryer(Policy{}).MaxAttempts())
+
+	// Regular errors follow the policy
+	delay, err := retryer.RetryDelay(2, errors.New("connection reset"))
+	assert.NoError(t, err)
+	assert.Equal(t, 200*time.Millisecond, delay)
+
+	// Throttled calls back off further, with the SDK's own delays
+	throttled := &smithy.GenericAPIError{Code: "RequestLimitExceeded"}
+	assert.True(t, retryer.IsErrorRetryable(throttled))
+	delay, err = retryer.RetryDelay(1, throttled)
+	assert.NoError(t, err)
+	assert.True(t, delay <= 2*time.Second)
+}
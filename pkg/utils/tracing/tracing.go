@@ -0,0 +1,125 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package tracing carries the identifiers of a CNI operation across the CNI plugin and ipamd, so that their log lines
+// and errors for the same pod can be stitched together
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// PodUIDKey is the gRPC metadata key of the UID of the pod
+	PodUIDKey = "k8s-pod-uid"
+	// TraceIDKey is the gRPC metadata key of the identifier of the CNI operation
+	TraceIDKey = "cni-trace-id"
+)
+
+// Trace identifies one CNI operation on a pod. The pod UID stays the same across the sandbox restarts of the pod,
+// while the trace ID is different for every ADD and DEL.
+type Trace struct {
+	PodUID string
+	ID     string
+}
+
+// New returns the trace of an operation on the pod with the given UID, with a random trace ID if id is empty
+func New(podUID, id string) Trace {
+	if id == "" {
+		id = newID()
+	}
+	return Trace{PodUID: podUID, ID: id}
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// String returns the identifiers of the trace, as they appear in log lines and errors
+func (t Trace) String() string {
+	var fields []string
+	if t.ID != "" {
+		fields = append(fields, "trace="+t.ID)
+	}
+	if t.PodUID != "" {
+		fields = append(fields, "pod-uid="+t.PodUID)
+	}
+	return strings.Join(fields, " ")
+}
+
+// NewOutgoingContext returns ctx with the trace attached to the gRPC calls made with it
+func (t Trace) NewOutgoingContext(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, TraceIDKey, t.ID, PodUIDKey, t.PodUID)
+}
+
+// FromIncomingContext returns the trace of the gRPC call ctx belongs to, it is empty if the caller sent none
+func FromIncomingContext(ctx context.Context) Trace {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return Trace{}
+	}
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	return Trace{PodUID: first(PodUIDKey), ID: first(TraceIDKey)}
+}
+
+// Wrap prefixes the error message of err with the trace
+func (t Trace) Wrap(err error) error {
+	if err == nil || t.String() == "" {
+		return err
+	}
+	return errors.Wrap(err, t.String())
+}
+
+func (t Trace) format(format string) string {
+	if s := t.String(); s != "" {
+		return fmt.Sprintf("[%s] %s", strings.Replace(s, "%", "%%", -1), format)
+	}
+	return format
+}
+
+// Debugf logs a debug message prefixed with the trace
+func (t Trace) Debugf(format string, params ...interface{}) {
+	log.Debugf(t.format(format), params...)
+}
+
+// Infof logs an info message prefixed with the trace
+func (t Trace) Infof(format string, params ...interface{}) {
+	log.Infof(t.format(format), params...)
+}
+
+// Warnf logs a warning prefixed with the trace
+func (t Trace) Warnf(format string, params ...interface{}) error {
+	return log.Warnf(t.format(format), params...)
+}
+
+// Errorf logs an error prefixed with the trace
+func (t Trace) Errorf(format string, params ...interface{}) error {
+	return log.Errorf(t.format(format), params...)
+}
@@ -0,0 +1,53 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package tracing
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestNew(t *testing.T) {
+	trace := New("pod-uid-1", "")
+	assert.Len(t, trace.ID, 16)
+	assert.NotEqual(t, trace.ID, New("pod-uid-1", "").ID)
+
+	trace = New("pod-uid-1", "trace-1")
+	assert.Equal(t, "trace=trace-1 pod-uid=pod-uid-1", trace.String())
+	assert.Equal(t, "trace=trace-1", New("", "trace-1").String())
+}
+
+func TestContext(t *testing.T) {
+	trace := New("pod-uid-1", "trace-1")
+
+	// Pass the outgoing metadata on as incoming, like the gRPC server does
+	md, _ := metadata.FromOutgoingContext(trace.NewOutgoingContext(context.Background()))
+	assert.Equal(t, trace, FromIncomingContext(metadata.NewIncomingContext(context.Background(), md)))
+
+	assert.Equal(t, Trace{}, FromIncomingContext(context.Background()))
+}
+
+func TestWrap(t *testing.T) {
+	err := errors.New("failed to assign an IP address")
+
+	assert.EqualError(t, New("pod-uid-1", "trace-1").Wrap(err),
+		"trace=trace-1 pod-uid=pod-uid-1: failed to assign an IP address")
+	assert.Equal(t, err, Trace{}.Wrap(err))
+	assert.NoError(t, New("pod-uid-1", "trace-1").Wrap(nil))
+	assert.Equal(t, "[trace=100%% pod-uid=pod-uid-1] %s", New("pod-uid-1", "100%").format("%s"))
+}
@@ -21,21 +21,28 @@ import (
 	"net"
 	"os"
 	"runtime"
+	"strconv"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	log "github.com/cihub/seelog"
 
 	"github.com/pkg/errors"
 
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/logger"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/tracing"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
 	cniSpecVersion "github.com/containernetworking/cni/pkg/version"
 
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/ethtoolwrapper"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/fastpath"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/grpcwrapper"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/rpcwrapper"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/typeswrapper"
@@ -50,6 +57,11 @@ const (
 
 var (
 	version string
+
+	// fastPathDir is where ipamd writes the leases of the warm IPs reserved for the fast path
+	fastPathDir = fastpath.DefaultDir
+	// fastPathTimeout is how long AddNetwork may take before a lease is used, when there is one
+	fastPathTimeout = 2 * time.Second
 )
 
 // NetConf stores the common network config for the CNI plugin
@@ -67,6 +79,20 @@ type NetConf struct {
 	// veth device name. It should be no more than four characters, and
 	// defaults to 'eni'.
 	VethPrefix string `json:"vethPrefix"`
+
+	// VethOffloads is a comma separated list of offloads to turn on or
+	// off on both ends of the veth pair, e.g. "tx-checksum=off,tso=off".
+	// Offloads that are not listed keep the kernel defaults.
+	VethOffloads string `json:"vethOffloads"`
+
+	// RouteConvergenceTimeout is how long to wait for the host route and
+	// the rules of the pod to be in the kernel before the ADD succeeds,
+	// e.g. "2s". Empty does not wait.
+	RouteConvergenceTimeout string `json:"routeConvergenceTimeout"`
+
+	// RouteConvergenceGateway also waits for the pod to resolve its
+	// gateway to the host veth, when RouteConvergenceTimeout is set.
+	RouteConvergenceGateway string `json:"routeConvergenceGateway"`
 }
 
 // K8sArgs is the valid CNI_ARGS used for Kubernetes
@@ -84,6 +110,12 @@ type K8sArgs struct {
 
 	// K8S_POD_INFRA_CONTAINER_ID is pod's container id
 	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
+
+	// K8S_POD_UID is pod's uid, it is the same across the restarts of the pod sandbox
+	K8S_POD_UID types.UnmarshallableString
+
+	// CNI_TRACE_ID identifies the CNI operation in the logs of the plugin and ipamd, a random one is used if it is not set
+	CNI_TRACE_ID types.UnmarshallableString
 }
 
 func init() {
@@ -97,7 +129,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 }
 
 func add(args *skel.CmdArgs, cniTypes typeswrapper.CNITYPES, grpcClient grpcwrapper.GRPC,
-	rpcClient rpcwrapper.RPC, driverClient driver.NetworkAPIs) error {
+	rpcClient rpcwrapper.RPC, driverClient driver.NetworkAPIs) (err error) {
 	log.Infof("Received CNI add request: ContainerID(%s) Netns(%s) IfName(%s) Args(%s) Path(%s) argsStdinData(%s)",
 		args.ContainerID, args.Netns, args.IfName, args.Args, args.Path, args.StdinData)
 
@@ -113,6 +145,12 @@ func add(args *skel.CmdArgs, cniTypes typeswrapper.CNITYPES, grpcClient grpcwrap
 		return errors.Wrap(err, "add cmd: failed to load k8s config from arg")
 	}
 
+	trace := tracing.New(string(k8sArgs.K8S_POD_UID), string(k8sArgs.CNI_TRACE_ID))
+	defer func() {
+		err = trace.Wrap(err)
+	}()
+	ctx := trace.NewOutgoingContext(context.Background())
+
 	// Default the host-side veth prefix to 'eni'.
 	if conf.VethPrefix == "" {
 		conf.VethPrefix = "eni"
@@ -120,13 +158,21 @@ func add(args *skel.CmdArgs, cniTypes typeswrapper.CNITYPES, grpcClient grpcwrap
 	if len(conf.VethPrefix) > 4 {
 		return errors.New("conf.VethPrefix can be at most 4 characters long")
 	}
+	vethOffloads, err := ethtoolwrapper.ParseOffloads(conf.VethOffloads)
+	if err != nil {
+		return errors.Wrap(err, "add cmd: invalid conf.VethOffloads")
+	}
+	convergenceTimeout, convergenceGateway, err := parseRouteConvergence(conf)
+	if err != nil {
+		return err
+	}
 
 	cniVersion := conf.CNIVersion
 
 	// Set up a connection to the ipamD server.
 	conn, err := grpcClient.Dial(ipamDAddress, grpc.WithInsecure())
 	if err != nil {
-		log.Errorf("Failed to connect to backend server for pod %s namespace %s container %s: %v",
+		trace.Errorf("Failed to connect to backend server for pod %s namespace %s container %s: %v",
 			string(k8sArgs.K8S_POD_NAME),
 			string(k8sArgs.K8S_POD_NAMESPACE),
 			string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID),
@@ -137,7 +183,15 @@ func add(args *skel.CmdArgs, cniTypes typeswrapper.CNITYPES, grpcClient grpcwrap
 
 	c := rpcClient.NewCNIBackendClient(conn)
 
-	r, err := c.AddNetwork(context.Background(),
+	// When ipamd reserved warm IPs for the fast path, it has little time to answer before one of them is used
+	addCtx := ctx
+	leases, _ := fastpath.FreeLeases(fastPathDir)
+	if len(leases) > 0 {
+		var cancel context.CancelFunc
+		addCtx, cancel = context.WithTimeout(ctx, fastPathTimeout)
+		defer cancel()
+	}
+	r, err := c.AddNetwork(addCtx,
 		&pb.AddNetworkRequest{
 			Netns:                      args.Netns,
 			K8S_POD_NAME:               string(k8sArgs.K8S_POD_NAME),
@@ -145,8 +199,29 @@ func add(args *skel.CmdArgs, cniTypes typeswrapper.CNITYPES, grpcClient grpcwrap
 			K8S_POD_INFRA_CONTAINER_ID: string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID),
 			IfName:                     args.IfName})
 
+	if err != nil && len(leases) > 0 && ipamdBusy(err) {
+		trace.Warnf("AddNetwork did not answer in time for pod %s namespace %s container %s, using a lease: %v",
+			string(k8sArgs.K8S_POD_NAME),
+			string(k8sArgs.K8S_POD_NAMESPACE),
+			string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID),
+			err)
+		lease, leaseErr := fastpath.ClaimLease(fastPathDir, string(k8sArgs.K8S_POD_NAME),
+			string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID), time.Now())
+		if leaseErr == nil {
+			r, err = &pb.AddNetworkReply{
+				Success:         true,
+				IPv4Addr:        lease.IPv4,
+				DeviceNumber:    lease.DeviceNumber,
+				UseExternalSNAT: lease.UseExternalSNAT,
+				VPCcidrs:        lease.VPCcidrs,
+			}, nil
+		} else {
+			trace.Warnf("Failed to claim a lease: %v", leaseErr)
+		}
+	}
+
 	if err != nil {
-		log.Errorf("Error received from AddNetwork grpc call for pod %s namespace %s container %s: %v",
+		trace.Errorf("Error received from AddNetwork grpc call for pod %s namespace %s container %s: %v",
 			string(k8sArgs.K8S_POD_NAME),
 			string(k8sArgs.K8S_POD_NAMESPACE),
 			string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID),
@@ -155,34 +230,57 @@ func add(args *skel.CmdArgs, cniTypes typeswrapper.CNITYPES, grpcClient grpcwrap
 	}
 
 	if !r.Success {
-		log.Errorf("Failed to assign an IP address to pod %s, namespace %s container %s",
+		trace.Errorf("Failed to assign an IP address to pod %s, namespace %s container %s",
 			string(k8sArgs.K8S_POD_NAME),
 			string(k8sArgs.K8S_POD_NAMESPACE),
 			string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID))
 		return fmt.Errorf("add cmd: failed to assign an IP address to container")
 	}
 
-	log.Infof("Received add network response for pod %s namespace %s container %s: %s, table %d, external-SNAT: %v, vpcCIDR: %v",
+	trace.Infof("Received add network response for pod %s namespace %s container %s: %s %s, table %d, external-SNAT: %v, vpcCIDR: %v, egress gateway: %s, VF: %s, MTU: %d, VLAN: %d",
 		string(k8sArgs.K8S_POD_NAME), string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID),
-		r.IPv4Addr, r.DeviceNumber, r.UseExternalSNAT, r.VPCcidrs)
+		r.IPv4Addr, r.IPv6Addr, r.DeviceNumber, r.UseExternalSNAT, r.VPCcidrs, r.EgressGateway, r.VF, r.MTU, r.VlanID)
 
 	addr := &net.IPNet{
 		IP:   net.ParseIP(r.IPv4Addr),
 		Mask: net.IPv4Mask(255, 255, 255, 255),
 	}
+	addr6 := ipv6HostNet(r.IPv6Addr)
+	// The gateway is nil when the pod has none
+	egressGateway := net.ParseIP(r.EgressGateway)
 
 	// build hostVethName
 	// Note: the maximum length for linux interface name is 15
 	hostVethName := generateHostVethName(conf.VethPrefix, string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME))
 
-	err = driverClient.SetupNS(hostVethName, args.IfName, args.Netns, addr, int(r.DeviceNumber), r.VPCcidrs, r.UseExternalSNAT)
+	if r.VF != "" {
+		// The pod gets the VF instead of a veth
+		var subnet *net.IPNet
+		if _, subnet, err = net.ParseCIDR(r.IPv4Subnet); err == nil {
+			addr.Mask = subnet.Mask
+			err = driverClient.SetupVF(r.VF, args.IfName, args.Netns, addr, subnet)
+		}
+	} else if r.VlanID != 0 {
+		// The pod gets a branch ENI, reached through a VLAN of the trunk ENI
+		var subnet *net.IPNet
+		if _, subnet, err = net.ParseCIDR(r.IPv4Subnet); err == nil {
+			err = driverClient.SetupBranchENI(hostVethName, args.IfName, args.Netns, addr, int(r.VlanID), r.BranchENIMAC,
+				r.TrunkIfName, subnet, int(r.MTU))
+		}
+	} else {
+		err = driverClient.SetupNS(hostVethName, args.IfName, args.Netns, addr, addr6, int(r.DeviceNumber), r.VPCcidrs, r.UseExternalSNAT, vethOffloads, egressGateway, int(r.MTU))
+		if err == nil && convergenceTimeout > 0 {
+			err = driverClient.WaitForConvergence(hostVethName, args.IfName, args.Netns, addr, int(r.DeviceNumber),
+				convergenceGateway, convergenceTimeout)
+		}
+	}
 
 	if err != nil {
-		log.Errorf("Failed SetupPodNetwork for pod %s namespace %s container %s: %v",
+		trace.Errorf("Failed SetupPodNetwork for pod %s namespace %s container %s: %v",
 			string(k8sArgs.K8S_POD_NAME), string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID), err)
 
 		// return allocated IP back to IP pool
-		r, delErr := c.DelNetwork(context.Background(),
+		r, delErr := c.DelNetwork(ctx,
 			&pb.DelNetworkRequest{
 				K8S_POD_NAME:               string(k8sArgs.K8S_POD_NAME),
 				K8S_POD_NAMESPACE:          string(k8sArgs.K8S_POD_NAMESPACE),
@@ -191,12 +289,12 @@ func add(args *skel.CmdArgs, cniTypes typeswrapper.CNITYPES, grpcClient grpcwrap
 				Reason:                     "SetupNSFailed"})
 
 		if delErr != nil {
-			log.Errorf("Error received from DelNetwork grpc call for pod %s namespace %s container %s: %v",
+			trace.Errorf("Error received from DelNetwork grpc call for pod %s namespace %s container %s: %v",
 				string(k8sArgs.K8S_POD_NAME), string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID), delErr)
 		}
 
 		if !r.Success {
-			log.Errorf("Failed to release IP of pod %s namespace %s container %s: %v",
+			trace.Errorf("Failed to release IP of pod %s namespace %s container %s: %v",
 				string(k8sArgs.K8S_POD_NAME), string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID), delErr)
 		}
 		return errors.Wrap(err, "add command: failed to setup network")
@@ -208,6 +306,18 @@ func add(args *skel.CmdArgs, cniTypes typeswrapper.CNITYPES, grpcClient grpcwrap
 			Address: *addr,
 		},
 	}
+	if addr6 != nil {
+		ip6 := &current.IPConfig{
+			Version: "6",
+			Address: *addr6,
+		}
+		if r.IPv6First {
+			// Applications honoring the order of the addresses of the pod prefer the first one
+			ips = append([]*current.IPConfig{ip6}, ips...)
+		} else {
+			ips = append(ips, ip6)
+		}
+	}
 
 	result := &current.Result{
 		IPs: ips,
@@ -216,6 +326,42 @@ func add(args *skel.CmdArgs, cniTypes typeswrapper.CNITYPES, grpcClient grpcwrap
 	return cniTypes.PrintResult(result, cniVersion)
 }
 
+// parseRouteConvergence returns how long to wait for the routes of a pod to converge, 0 to not wait, and whether to
+// also wait for its gateway to resolve
+func parseRouteConvergence(conf NetConf) (time.Duration, bool, error) {
+	if conf.RouteConvergenceTimeout == "" {
+		return 0, false, nil
+	}
+	timeout, err := time.ParseDuration(conf.RouteConvergenceTimeout)
+	if err != nil || timeout < 0 {
+		return 0, false, errors.Errorf("add cmd: invalid conf.RouteConvergenceTimeout %q", conf.RouteConvergenceTimeout)
+	}
+	gateway := false
+	if conf.RouteConvergenceGateway != "" {
+		if gateway, err = strconv.ParseBool(conf.RouteConvergenceGateway); err != nil {
+			return 0, false, errors.Wrap(err, "add cmd: invalid conf.RouteConvergenceGateway")
+		}
+	}
+	return timeout, gateway, nil
+}
+
+// ipamdBusy returns whether an AddNetwork error means ipamd did not answer, rather than refused to assign an IP
+func ipamdBusy(err error) bool {
+	code := status.Code(err)
+	return code == codes.DeadlineExceeded || code == codes.Unavailable
+}
+
+// ipv6HostNet returns the /128 of the IPv6 address of a pod, or nil if the pod has no IPv6 address
+func ipv6HostNet(ipv6 string) *net.IPNet {
+	if ipv6 == "" {
+		return nil
+	}
+	return &net.IPNet{
+		IP:   net.ParseIP(ipv6),
+		Mask: net.CIDRMask(128, 128),
+	}
+}
+
 // generateHostVethName returns a name to be used on the host-side veth device.
 func generateHostVethName(prefix, namespace, podname string) string {
 	h := sha1.New()
@@ -228,7 +374,7 @@ func cmdDel(args *skel.CmdArgs) error {
 }
 
 func del(args *skel.CmdArgs, cniTypes typeswrapper.CNITYPES, grpcClient grpcwrapper.GRPC, rpcClient rpcwrapper.RPC,
-	driverClient driver.NetworkAPIs) error {
+	driverClient driver.NetworkAPIs) (err error) {
 
 	log.Infof("Received CNI del request: ContainerID(%s) Netns(%s) IfName(%s) Args(%s) Path(%s) argsStdinData(%s)",
 		args.ContainerID, args.Netns, args.IfName, args.Args, args.Path, args.StdinData)
@@ -245,11 +391,17 @@ func del(args *skel.CmdArgs, cniTypes typeswrapper.CNITYPES, grpcClient grpcwrap
 		return errors.Wrap(err, "del cmd: failed to load k8s config from args")
 	}
 
+	trace := tracing.New(string(k8sArgs.K8S_POD_UID), string(k8sArgs.CNI_TRACE_ID))
+	defer func() {
+		err = trace.Wrap(err)
+	}()
+	ctx := trace.NewOutgoingContext(context.Background())
+
 	// notify local IP address manager to free secondary IP
 	// Set up a connection to the server.
 	conn, err := grpcClient.Dial(ipamDAddress, grpc.WithInsecure())
 	if err != nil {
-		log.Errorf("Failed to connect to backend server for pod %s namespace %s container %s: %v",
+		trace.Errorf("Failed to connect to backend server for pod %s namespace %s container %s: %v",
 			string(k8sArgs.K8S_POD_NAME),
 			string(k8sArgs.K8S_POD_NAMESPACE),
 			string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID),
@@ -261,7 +413,7 @@ func del(args *skel.CmdArgs, cniTypes typeswrapper.CNITYPES, grpcClient grpcwrap
 
 	c := rpcClient.NewCNIBackendClient(conn)
 
-	r, err := c.DelNetwork(context.Background(),
+	r, err := c.DelNetwork(ctx,
 		&pb.DelNetworkRequest{
 			K8S_POD_NAME:               string(k8sArgs.K8S_POD_NAME),
 			K8S_POD_NAMESPACE:          string(k8sArgs.K8S_POD_NAMESPACE),
@@ -270,26 +422,40 @@ func del(args *skel.CmdArgs, cniTypes typeswrapper.CNITYPES, grpcClient grpcwrap
 			Reason:                     "PodDeleted"})
 
 	if err != nil {
-		log.Errorf("Error received from DelNetwork grpc call for pod %s namespace %s container %s: %v",
+		trace.Errorf("Error received from DelNetwork grpc call for pod %s namespace %s container %s: %v",
 			string(k8sArgs.K8S_POD_NAME), string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID), err)
 		return err
 	}
 
 	if !r.Success {
-		log.Errorf("Failed to process delete request for pod %s namespace %s container %s: Success == false",
+		trace.Errorf("Failed to process delete request for pod %s namespace %s container %s: Success == false",
 			string(k8sArgs.K8S_POD_NAME), string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID))
 		return errors.New("del cmd: failed to process delete request")
 	}
 
+	if r.IPv4Addr == "" {
+		// ipamd does not know the pod, because its IP was already released by a previous DEL, or it never got one.
+		// There is no IP to tear down the host routes and rules of, so there is nothing left to do.
+		trace.Infof("No IP to tear down for pod %s namespace %s container %s, it is already released",
+			string(k8sArgs.K8S_POD_NAME), string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID))
+		return nil
+	}
+
 	addr := &net.IPNet{
 		IP:   net.ParseIP(r.IPv4Addr),
 		Mask: net.IPv4Mask(255, 255, 255, 255),
 	}
 
-	err = driverClient.TeardownNS(addr, int(r.DeviceNumber))
+	if r.VF != "" {
+		err = driverClient.TeardownVF(r.VF, args.IfName, args.Netns)
+	} else if r.VlanID != 0 {
+		err = driverClient.TeardownBranchENI(addr, int(r.VlanID))
+	} else {
+		err = driverClient.TeardownNS(addr, ipv6HostNet(r.IPv6Addr), int(r.DeviceNumber), r.EgressGateway)
+	}
 
 	if err != nil {
-		log.Errorf("Failed on TeardownPodNetwork for pod %s namespace %s container %s: %v",
+		trace.Errorf("Failed on TeardownPodNetwork for pod %s namespace %s container %s: %v",
 			string(k8sArgs.K8S_POD_NAME), string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID), err)
 		return err
 	}
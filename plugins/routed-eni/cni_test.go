@@ -16,20 +16,31 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"net"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/fastpath"
 	mock_grpcwrapper "github.com/aws/amazon-vpc-cni-k8s/pkg/grpcwrapper/mocks"
 	mock_rpcwrapper "github.com/aws/amazon-vpc-cni-k8s/pkg/rpcwrapper/mocks"
 	mock_typeswrapper "github.com/aws/amazon-vpc-cni-k8s/pkg/typeswrapper/mocks"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/tracing"
 	mock_driver "github.com/aws/amazon-vpc-cni-k8s/plugins/routed-eni/driver/mocks"
 	"github.com/aws/amazon-vpc-cni-k8s/rpc"
 	mock_rpc "github.com/aws/amazon-vpc-cni-k8s/rpc/mocks"
+	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -40,6 +51,7 @@ const (
 	cniName     = "aws-cni"
 	cniType     = "aws-cni"
 	ipAddr      = "10.0.1.15"
+	ipv6Addr    = "2001:db8::15"
 	devNum      = 4
 )
 
@@ -75,8 +87,9 @@ func TestCmdAdd(t *testing.T) {
 	defer ctrl.Finish()
 
 	netconf := &NetConf{CNIVersion: cniVersion,
-		Name: cniName,
-		Type: cniType}
+		Name:         cniName,
+		Type:         cniType,
+		VethOffloads: "tx-checksum=off"}
 	stdinData, _ := json.Marshal(netconf)
 
 	cmdArgs := &skel.CmdArgs{ContainerID: containerID,
@@ -101,13 +114,199 @@ func TestCmdAdd(t *testing.T) {
 	}
 
 	mocksNetwork.EXPECT().SetupNS(gomock.Any(), cmdArgs.IfName, cmdArgs.Netns,
-		addr, int(addNetworkReply.DeviceNumber), gomock.Any(), gomock.Any()).Return(nil)
+		addr, gomock.Nil(), int(addNetworkReply.DeviceNumber), gomock.Any(), gomock.Any(),
+		map[string]bool{"tx-checksum": false}, gomock.Nil(), 0).Return(nil)
 
 	mocksTypes.EXPECT().PrintResult(gomock.Any(), gomock.Any()).Return(nil)
 
 	add(cmdArgs, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork)
 }
 
+func TestCmdAddMTU(t *testing.T) {
+	ctrl, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork := setup(t)
+	defer ctrl.Finish()
+
+	netconf := &NetConf{CNIVersion: cniVersion,
+		Name: cniName,
+		Type: cniType}
+	stdinData, _ := json.Marshal(netconf)
+
+	cmdArgs := &skel.CmdArgs{ContainerID: containerID,
+		Netns:     netNS,
+		IfName:    ifName,
+		StdinData: stdinData}
+
+	mocksTypes.EXPECT().LoadArgs(gomock.Any(), gomock.Any()).Return(nil)
+
+	conn, _ := grpc.Dial(ipamDAddress, grpc.WithInsecure())
+
+	mocksGRPC.EXPECT().Dial(gomock.Any(), gomock.Any()).Return(conn, nil)
+	mockC := mock_rpc.NewMockCNIBackendClient(ctrl)
+	mocksRPC.EXPECT().NewCNIBackendClient(conn).Return(mockC)
+
+	// The MTU of the flags of the pod is the one of its interface
+	addNetworkReply := &rpc.AddNetworkReply{Success: true, IPv4Addr: ipAddr, DeviceNumber: devNum, MTU: 1400}
+	mockC.EXPECT().AddNetwork(gomock.Any(), gomock.Any()).Return(addNetworkReply, nil)
+
+	mocksNetwork.EXPECT().SetupNS(gomock.Any(), cmdArgs.IfName, cmdArgs.Netns,
+		gomock.Any(), gomock.Nil(), int(addNetworkReply.DeviceNumber), gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Nil(), 1400).Return(nil)
+	mocksTypes.EXPECT().PrintResult(gomock.Any(), gomock.Any()).Return(nil)
+
+	err := add(cmdArgs, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork)
+	assert.NoError(t, err)
+}
+
+func TestCmdAddDualStack(t *testing.T) {
+	ctrl, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork := setup(t)
+	defer ctrl.Finish()
+
+	netconf := &NetConf{CNIVersion: cniVersion,
+		Name: cniName,
+		Type: cniType}
+	stdinData, _ := json.Marshal(netconf)
+
+	cmdArgs := &skel.CmdArgs{ContainerID: containerID,
+		Netns:     netNS,
+		IfName:    ifName,
+		StdinData: stdinData}
+
+	mocksTypes.EXPECT().LoadArgs(gomock.Any(), gomock.Any()).Return(nil)
+
+	conn, _ := grpc.Dial(ipamDAddress, grpc.WithInsecure())
+
+	mocksGRPC.EXPECT().Dial(gomock.Any(), gomock.Any()).Return(conn, nil)
+	mockC := mock_rpc.NewMockCNIBackendClient(ctrl)
+	mocksRPC.EXPECT().NewCNIBackendClient(conn).Return(mockC)
+
+	addNetworkReply := &rpc.AddNetworkReply{Success: true, IPv4Addr: ipAddr, IPv6Addr: ipv6Addr, DeviceNumber: devNum}
+	mockC.EXPECT().AddNetwork(gomock.Any(), gomock.Any()).Return(addNetworkReply, nil)
+
+	addr := &net.IPNet{
+		IP:   net.ParseIP(ipAddr),
+		Mask: net.IPv4Mask(255, 255, 255, 255),
+	}
+	addr6 := &net.IPNet{
+		IP:   net.ParseIP(ipv6Addr),
+		Mask: net.CIDRMask(128, 128),
+	}
+
+	mocksNetwork.EXPECT().SetupNS(gomock.Any(), cmdArgs.IfName, cmdArgs.Netns,
+		addr, addr6, int(addNetworkReply.DeviceNumber), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Nil(), 0).Return(nil)
+
+	var result *current.Result
+	mocksTypes.EXPECT().PrintResult(gomock.Any(), gomock.Any()).Do(func(r types.Result, version string) {
+		result = r.(*current.Result)
+	}).Return(nil)
+
+	err := add(cmdArgs, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork)
+	assert.NoError(t, err)
+	assert.Equal(t, []*current.IPConfig{
+		{Version: "4", Address: *addr},
+		{Version: "6", Address: *addr6},
+	}, result.IPs)
+
+	// The IPv6 address comes first when ipamd prefers it for the pod
+	mocksTypes.EXPECT().LoadArgs(gomock.Any(), gomock.Any()).Return(nil)
+	mocksGRPC.EXPECT().Dial(gomock.Any(), gomock.Any()).Return(conn, nil)
+	mocksRPC.EXPECT().NewCNIBackendClient(conn).Return(mockC)
+	addNetworkReply.IPv6First = true
+	mockC.EXPECT().AddNetwork(gomock.Any(), gomock.Any()).Return(addNetworkReply, nil)
+	mocksNetwork.EXPECT().SetupNS(gomock.Any(), cmdArgs.IfName, cmdArgs.Netns,
+		addr, addr6, int(addNetworkReply.DeviceNumber), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Nil(), 0).Return(nil)
+	mocksTypes.EXPECT().PrintResult(gomock.Any(), gomock.Any()).Do(func(r types.Result, version string) {
+		result = r.(*current.Result)
+	}).Return(nil)
+
+	err = add(cmdArgs, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork)
+	assert.NoError(t, err)
+	assert.Equal(t, []*current.IPConfig{
+		{Version: "6", Address: *addr6},
+		{Version: "4", Address: *addr},
+	}, result.IPs)
+}
+
+func TestCmdAddVF(t *testing.T) {
+	ctrl, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork := setup(t)
+	defer ctrl.Finish()
+
+	netconf := &NetConf{CNIVersion: cniVersion,
+		Name: cniName,
+		Type: cniType}
+	stdinData, _ := json.Marshal(netconf)
+
+	cmdArgs := &skel.CmdArgs{ContainerID: containerID,
+		Netns:     netNS,
+		IfName:    ifName,
+		StdinData: stdinData}
+
+	mocksTypes.EXPECT().LoadArgs(gomock.Any(), gomock.Any()).Return(nil)
+
+	conn, _ := grpc.Dial(ipamDAddress, grpc.WithInsecure())
+
+	mocksGRPC.EXPECT().Dial(gomock.Any(), gomock.Any()).Return(conn, nil)
+	mockC := mock_rpc.NewMockCNIBackendClient(ctrl)
+	mocksRPC.EXPECT().NewCNIBackendClient(conn).Return(mockC)
+
+	addNetworkReply := &rpc.AddNetworkReply{Success: true, IPv4Addr: ipAddr, IPv4Subnet: "10.0.1.0/24",
+		DeviceNumber: devNum, VF: "eth4v0"}
+	mockC.EXPECT().AddNetwork(gomock.Any(), gomock.Any()).Return(addNetworkReply, nil)
+
+	// The pod gets the VF instead of a veth, with its IP in the subnet of the ENI
+	addr := &net.IPNet{
+		IP:   net.ParseIP(addNetworkReply.IPv4Addr),
+		Mask: net.IPv4Mask(255, 255, 255, 0),
+	}
+	_, subnet, _ := net.ParseCIDR(addNetworkReply.IPv4Subnet)
+	mocksNetwork.EXPECT().SetupVF("eth4v0", cmdArgs.IfName, cmdArgs.Netns, addr, subnet).Return(nil)
+
+	mocksTypes.EXPECT().PrintResult(gomock.Any(), gomock.Any()).Return(nil)
+
+	err := add(cmdArgs, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork)
+	assert.NoError(t, err)
+}
+
+func TestCmdAddBranchENI(t *testing.T) {
+	ctrl, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork := setup(t)
+	defer ctrl.Finish()
+
+	netconf := &NetConf{CNIVersion: cniVersion,
+		Name: cniName,
+		Type: cniType}
+	stdinData, _ := json.Marshal(netconf)
+
+	cmdArgs := &skel.CmdArgs{ContainerID: containerID,
+		Netns:     netNS,
+		IfName:    ifName,
+		StdinData: stdinData}
+
+	mocksTypes.EXPECT().LoadArgs(gomock.Any(), gomock.Any()).Return(nil)
+
+	conn, _ := grpc.Dial(ipamDAddress, grpc.WithInsecure())
+
+	mocksGRPC.EXPECT().Dial(gomock.Any(), gomock.Any()).Return(conn, nil)
+	mockC := mock_rpc.NewMockCNIBackendClient(ctrl)
+	mocksRPC.EXPECT().NewCNIBackendClient(conn).Return(mockC)
+
+	addNetworkReply := &rpc.AddNetworkReply{Success: true, IPv4Addr: ipAddr, IPv4Subnet: "10.0.1.0/24",
+		VlanID: 3, BranchENIMAC: "12:ef:2a:98:e5:5c", TrunkIfName: "eth2"}
+	mockC.EXPECT().AddNetwork(gomock.Any(), gomock.Any()).Return(addNetworkReply, nil)
+
+	// The pod is reached through the VLAN of its branch ENI on the trunk interface
+	addr := &net.IPNet{
+		IP:   net.ParseIP(addNetworkReply.IPv4Addr),
+		Mask: net.IPv4Mask(255, 255, 255, 255),
+	}
+	_, subnet, _ := net.ParseCIDR(addNetworkReply.IPv4Subnet)
+	mocksNetwork.EXPECT().SetupBranchENI(gomock.Any(), cmdArgs.IfName, cmdArgs.Netns, addr, 3, "12:ef:2a:98:e5:5c",
+		"eth2", subnet, 0).Return(nil)
+
+	mocksTypes.EXPECT().PrintResult(gomock.Any(), gomock.Any()).Return(nil)
+
+	err := add(cmdArgs, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork)
+	assert.NoError(t, err)
+}
+
 func TestCmdAddNetworkErr(t *testing.T) {
 	ctrl, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork := setup(t)
 	defer ctrl.Finish()
@@ -138,6 +337,131 @@ func TestCmdAddNetworkErr(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestCmdAddFastPath(t *testing.T) {
+	ctrl, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork := setup(t)
+	defer ctrl.Finish()
+
+	dir, err := ioutil.TempDir("", "leases")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(dir string) { fastPathDir = dir }(fastPathDir)
+	fastPathDir = dir
+	key, err := fastpath.NewKey(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, fastpath.WriteLease(dir, key, fastpath.Lease{IPv4: ipAddr, DeviceNumber: devNum,
+		VPCcidrs: []string{"10.0.0.0/16"}, Expiry: time.Now().Add(time.Minute)}))
+
+	netconf := &NetConf{CNIVersion: cniVersion,
+		Name: cniName,
+		Type: cniType}
+	stdinData, _ := json.Marshal(netconf)
+
+	cmdArgs := &skel.CmdArgs{ContainerID: containerID,
+		Netns:     netNS,
+		IfName:    ifName,
+		StdinData: stdinData}
+
+	mocksTypes.EXPECT().LoadArgs(gomock.Any(), gomock.Any()).Do(func(args string, container interface{}) {
+		container.(*K8sArgs).K8S_POD_NAME = "pod1"
+		container.(*K8sArgs).K8S_POD_NAMESPACE = "default"
+		container.(*K8sArgs).K8S_POD_INFRA_CONTAINER_ID = containerID
+	}).Return(nil)
+
+	conn, _ := grpc.Dial(ipamDAddress, grpc.WithInsecure())
+
+	mocksGRPC.EXPECT().Dial(gomock.Any(), gomock.Any()).Return(conn, nil)
+	mockC := mock_rpc.NewMockCNIBackendClient(ctrl)
+	mocksRPC.EXPECT().NewCNIBackendClient(conn).Return(mockC)
+
+	// ipamd does not answer in time, the pod is set up with the lease
+	mockC.EXPECT().AddNetwork(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, in *rpc.AddNetworkRequest, opts ...grpc.CallOption) (*rpc.AddNetworkReply, error) {
+			_, ok := ctx.Deadline()
+			assert.True(t, ok)
+			return nil, status.Error(codes.DeadlineExceeded, "context deadline exceeded")
+		})
+
+	addr := &net.IPNet{
+		IP:   net.ParseIP(ipAddr),
+		Mask: net.IPv4Mask(255, 255, 255, 255),
+	}
+	mocksNetwork.EXPECT().SetupNS(gomock.Any(), cmdArgs.IfName, cmdArgs.Netns,
+		addr, gomock.Nil(), devNum, []string{"10.0.0.0/16"}, false, gomock.Any(), gomock.Nil(), 0).Return(nil)
+	mocksTypes.EXPECT().PrintResult(gomock.Any(), gomock.Any()).Return(nil)
+
+	err = add(cmdArgs, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork)
+	assert.NoError(t, err)
+
+	// ipamd assigns the IP to the pod from the claim
+	claims, err := fastpath.Claims(dir)
+	assert.NoError(t, err)
+	assert.Len(t, claims, 1)
+	assert.Equal(t, ipAddr, claims[0].IPv4)
+	assert.Equal(t, "pod1", claims[0].PodName)
+	assert.Equal(t, containerID, claims[0].ContainerID)
+}
+
+func TestCmdAddTrace(t *testing.T) {
+	ctrl, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork := setup(t)
+	defer ctrl.Finish()
+
+	netconf := &NetConf{CNIVersion: cniVersion,
+		Name: cniName,
+		Type: cniType}
+	stdinData, _ := json.Marshal(netconf)
+
+	cmdArgs := &skel.CmdArgs{ContainerID: containerID,
+		Netns:     netNS,
+		IfName:    ifName,
+		StdinData: stdinData}
+
+	mocksTypes.EXPECT().LoadArgs(gomock.Any(), gomock.Any()).Do(func(args string, container interface{}) {
+		container.(*K8sArgs).K8S_POD_UID = "pod-uid-1"
+		container.(*K8sArgs).CNI_TRACE_ID = "trace-1"
+	}).Return(nil)
+
+	conn, _ := grpc.Dial(ipamDAddress, grpc.WithInsecure())
+
+	mocksGRPC.EXPECT().Dial(gomock.Any(), gomock.Any()).Return(conn, nil)
+	mockC := mock_rpc.NewMockCNIBackendClient(ctrl)
+	mocksRPC.EXPECT().NewCNIBackendClient(conn).Return(mockC)
+
+	mockC.EXPECT().AddNetwork(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, in *rpc.AddNetworkRequest, opts ...grpc.CallOption) (*rpc.AddNetworkReply, error) {
+			md, _ := metadata.FromOutgoingContext(ctx)
+			assert.Equal(t, []string{"pod-uid-1"}, md.Get(tracing.PodUIDKey))
+			assert.Equal(t, []string{"trace-1"}, md.Get(tracing.TraceIDKey))
+			return nil, errors.New("Error on AddNetworkReply")
+		})
+
+	err := add(cmdArgs, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork)
+
+	assert.EqualError(t, err, "trace=trace-1 pod-uid=pod-uid-1: Error on AddNetworkReply")
+}
+
+func TestCmdAddInvalidVethOffloads(t *testing.T) {
+	ctrl, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork := setup(t)
+	defer ctrl.Finish()
+
+	netconf := &NetConf{CNIVersion: cniVersion,
+		Name:         cniName,
+		Type:         cniType,
+		VethOffloads: "lro=off"}
+	stdinData, _ := json.Marshal(netconf)
+
+	cmdArgs := &skel.CmdArgs{ContainerID: containerID,
+		Netns:     netNS,
+		IfName:    ifName,
+		StdinData: stdinData}
+
+	mocksTypes.EXPECT().LoadArgs(gomock.Any(), gomock.Any()).Return(nil)
+
+	// No IP is requested from ipamd
+	err := add(cmdArgs, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork)
+
+	assert.Error(t, err)
+}
+
 func TestCmdAddErrSetupPodNetwork(t *testing.T) {
 	ctrl, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork := setup(t)
 	defer ctrl.Finish()
@@ -169,7 +493,7 @@ func TestCmdAddErrSetupPodNetwork(t *testing.T) {
 	}
 
 	mocksNetwork.EXPECT().SetupNS(gomock.Any(), cmdArgs.IfName, cmdArgs.Netns,
-		addr, int(addNetworkReply.DeviceNumber), gomock.Any(), gomock.Any()).Return(errors.New("error on SetupPodNetwork"))
+		addr, gomock.Nil(), int(addNetworkReply.DeviceNumber), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Nil(), 0).Return(errors.New("error on SetupPodNetwork"))
 
 	// when SetupPodNetwork fails, expect to return IP back to datastore
 	delNetworkReply := &rpc.DelNetworkReply{Success: true, IPv4Addr: ipAddr, DeviceNumber: devNum}
@@ -180,6 +504,89 @@ func TestCmdAddErrSetupPodNetwork(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestCmdAddRouteConvergence(t *testing.T) {
+	ctrl, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork := setup(t)
+	defer ctrl.Finish()
+
+	netconf := &NetConf{CNIVersion: cniVersion,
+		Name:                    cniName,
+		Type:                    cniType,
+		RouteConvergenceTimeout: "2s",
+		RouteConvergenceGateway: "true"}
+	stdinData, _ := json.Marshal(netconf)
+
+	cmdArgs := &skel.CmdArgs{ContainerID: containerID,
+		Netns:     netNS,
+		IfName:    ifName,
+		StdinData: stdinData}
+
+	mocksTypes.EXPECT().LoadArgs(gomock.Any(), gomock.Any()).Return(nil)
+
+	conn, _ := grpc.Dial(ipamDAddress, grpc.WithInsecure())
+
+	mocksGRPC.EXPECT().Dial(gomock.Any(), gomock.Any()).Return(conn, nil)
+	mockC := mock_rpc.NewMockCNIBackendClient(ctrl)
+	mocksRPC.EXPECT().NewCNIBackendClient(conn).Return(mockC)
+
+	addNetworkReply := &rpc.AddNetworkReply{Success: true, IPv4Addr: ipAddr, DeviceNumber: devNum}
+	mockC.EXPECT().AddNetwork(gomock.Any(), gomock.Any()).Return(addNetworkReply, nil)
+
+	addr := &net.IPNet{
+		IP:   net.ParseIP(addNetworkReply.IPv4Addr),
+		Mask: net.IPv4Mask(255, 255, 255, 255),
+	}
+
+	setupNS := mocksNetwork.EXPECT().SetupNS(gomock.Any(), cmdArgs.IfName, cmdArgs.Netns,
+		addr, gomock.Nil(), int(addNetworkReply.DeviceNumber), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Nil(), 0).Return(nil)
+	mocksNetwork.EXPECT().WaitForConvergence(gomock.Any(), cmdArgs.IfName, cmdArgs.Netns, addr,
+		int(addNetworkReply.DeviceNumber), true, 2*time.Second).Return(nil).After(setupNS)
+
+	mocksTypes.EXPECT().PrintResult(gomock.Any(), gomock.Any()).Return(nil)
+
+	err := add(cmdArgs, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork)
+	assert.NoError(t, err)
+}
+
+func TestCmdAddErrRouteConvergence(t *testing.T) {
+	ctrl, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork := setup(t)
+	defer ctrl.Finish()
+
+	netconf := &NetConf{CNIVersion: cniVersion,
+		Name:                    cniName,
+		Type:                    cniType,
+		RouteConvergenceTimeout: "2s"}
+	stdinData, _ := json.Marshal(netconf)
+
+	cmdArgs := &skel.CmdArgs{ContainerID: containerID,
+		Netns:     netNS,
+		IfName:    ifName,
+		StdinData: stdinData}
+
+	mocksTypes.EXPECT().LoadArgs(gomock.Any(), gomock.Any()).Return(nil)
+
+	conn, _ := grpc.Dial(ipamDAddress, grpc.WithInsecure())
+
+	mocksGRPC.EXPECT().Dial(gomock.Any(), gomock.Any()).Return(conn, nil)
+	mockC := mock_rpc.NewMockCNIBackendClient(ctrl)
+	mocksRPC.EXPECT().NewCNIBackendClient(conn).Return(mockC)
+
+	addNetworkReply := &rpc.AddNetworkReply{Success: true, IPv4Addr: ipAddr, DeviceNumber: devNum}
+	mockC.EXPECT().AddNetwork(gomock.Any(), gomock.Any()).Return(addNetworkReply, nil)
+
+	mocksNetwork.EXPECT().SetupNS(gomock.Any(), cmdArgs.IfName, cmdArgs.Netns,
+		gomock.Any(), gomock.Nil(), int(addNetworkReply.DeviceNumber), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Nil(), 0).Return(nil)
+	mocksNetwork.EXPECT().WaitForConvergence(gomock.Any(), cmdArgs.IfName, cmdArgs.Netns, gomock.Any(),
+		int(addNetworkReply.DeviceNumber), false, 2*time.Second).Return(errors.New("host route not ready"))
+
+	// when the routes do not converge, expect to return IP back to datastore
+	delNetworkReply := &rpc.DelNetworkReply{Success: true, IPv4Addr: ipAddr, DeviceNumber: devNum}
+	mockC.EXPECT().DelNetwork(gomock.Any(), gomock.Any()).Return(delNetworkReply, nil)
+
+	err := add(cmdArgs, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork)
+
+	assert.Error(t, err)
+}
+
 func TestCmdDel(t *testing.T) {
 	ctrl, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork := setup(t)
 	defer ctrl.Finish()
@@ -211,11 +618,109 @@ func TestCmdDel(t *testing.T) {
 		Mask: net.IPv4Mask(255, 255, 255, 255),
 	}
 
-	mocksNetwork.EXPECT().TeardownNS(addr, int(delNetworkReply.DeviceNumber)).Return(nil)
+	mocksNetwork.EXPECT().TeardownNS(addr, gomock.Nil(), int(delNetworkReply.DeviceNumber), false).Return(nil)
 
 	del(cmdArgs, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork)
 }
 
+func TestCmdDelVF(t *testing.T) {
+	ctrl, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork := setup(t)
+	defer ctrl.Finish()
+
+	netconf := &NetConf{CNIVersion: cniVersion,
+		Name: cniName,
+		Type: cniType}
+	stdinData, _ := json.Marshal(netconf)
+
+	cmdArgs := &skel.CmdArgs{ContainerID: containerID,
+		Netns:     netNS,
+		IfName:    ifName,
+		StdinData: stdinData}
+
+	mocksTypes.EXPECT().LoadArgs(gomock.Any(), gomock.Any()).Return(nil)
+
+	conn, _ := grpc.Dial(ipamDAddress, grpc.WithInsecure())
+
+	mocksGRPC.EXPECT().Dial(gomock.Any(), gomock.Any()).Return(conn, nil)
+	mockC := mock_rpc.NewMockCNIBackendClient(ctrl)
+	mocksRPC.EXPECT().NewCNIBackendClient(conn).Return(mockC)
+
+	delNetworkReply := &rpc.DelNetworkReply{Success: true, IPv4Addr: ipAddr, DeviceNumber: devNum, VF: "eth4v0"}
+	mockC.EXPECT().DelNetwork(gomock.Any(), gomock.Any()).Return(delNetworkReply, nil)
+
+	// The VF is moved back to the host, there are no host routes to tear down
+	mocksNetwork.EXPECT().TeardownVF("eth4v0", cmdArgs.IfName, cmdArgs.Netns).Return(nil)
+
+	err := del(cmdArgs, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork)
+	assert.NoError(t, err)
+}
+
+func TestCmdDelBranchENI(t *testing.T) {
+	ctrl, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork := setup(t)
+	defer ctrl.Finish()
+
+	netconf := &NetConf{CNIVersion: cniVersion,
+		Name: cniName,
+		Type: cniType}
+	stdinData, _ := json.Marshal(netconf)
+
+	cmdArgs := &skel.CmdArgs{ContainerID: containerID,
+		Netns:     netNS,
+		IfName:    ifName,
+		StdinData: stdinData}
+
+	mocksTypes.EXPECT().LoadArgs(gomock.Any(), gomock.Any()).Return(nil)
+
+	conn, _ := grpc.Dial(ipamDAddress, grpc.WithInsecure())
+
+	mocksGRPC.EXPECT().Dial(gomock.Any(), gomock.Any()).Return(conn, nil)
+	mockC := mock_rpc.NewMockCNIBackendClient(ctrl)
+	mocksRPC.EXPECT().NewCNIBackendClient(conn).Return(mockC)
+
+	delNetworkReply := &rpc.DelNetworkReply{Success: true, IPv4Addr: ipAddr, VlanID: 3}
+	mockC.EXPECT().DelNetwork(gomock.Any(), gomock.Any()).Return(delNetworkReply, nil)
+
+	addr := &net.IPNet{
+		IP:   net.ParseIP(delNetworkReply.IPv4Addr),
+		Mask: net.IPv4Mask(255, 255, 255, 255),
+	}
+	mocksNetwork.EXPECT().TeardownBranchENI(addr, 3).Return(nil)
+
+	err := del(cmdArgs, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork)
+	assert.NoError(t, err)
+}
+
+func TestCmdDelAlreadyReleased(t *testing.T) {
+	ctrl, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork := setup(t)
+	defer ctrl.Finish()
+
+	netconf := &NetConf{CNIVersion: cniVersion,
+		Name: cniName,
+		Type: cniType}
+	stdinData, _ := json.Marshal(netconf)
+
+	// DEL is retried after a kubelet crash, and the namespace is gone by then
+	cmdArgs := &skel.CmdArgs{ContainerID: containerID,
+		Netns:     "",
+		IfName:    ifName,
+		StdinData: stdinData}
+
+	mocksTypes.EXPECT().LoadArgs(gomock.Any(), gomock.Any()).Return(nil)
+
+	conn, _ := grpc.Dial(ipamDAddress, grpc.WithInsecure())
+
+	mocksGRPC.EXPECT().Dial(gomock.Any(), gomock.Any()).Return(conn, nil)
+	mockC := mock_rpc.NewMockCNIBackendClient(ctrl)
+	mocksRPC.EXPECT().NewCNIBackendClient(conn).Return(mockC)
+
+	// ipamd no longer knows the pod, so there is nothing to tear down
+	delNetworkReply := &rpc.DelNetworkReply{Success: true}
+	mockC.EXPECT().DelNetwork(gomock.Any(), gomock.Any()).Return(delNetworkReply, nil)
+
+	err := del(cmdArgs, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork)
+	assert.NoError(t, err)
+}
+
 func TestCmdDelErrDelNetwork(t *testing.T) {
 	ctrl, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork := setup(t)
 	defer ctrl.Finish()
@@ -276,7 +781,7 @@ func TestCmdDelErrTeardown(t *testing.T) {
 		Mask: net.IPv4Mask(255, 255, 255, 255),
 	}
 
-	mocksNetwork.EXPECT().TeardownNS(addr, int(delNetworkReply.DeviceNumber)).Return(errors.New("error on teardown"))
+	mocksNetwork.EXPECT().TeardownNS(addr, gomock.Nil(), int(delNetworkReply.DeviceNumber), false).Return(errors.New("error on teardown"))
 
 	del(cmdArgs, mocksTypes, mocksGRPC, mocksRPC, mocksNetwork)
 }
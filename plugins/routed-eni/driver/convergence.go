@@ -0,0 +1,152 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/netlinkwrapper"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/nswrapper"
+)
+
+// convergencePollInterval is how often the routes, rules and gateway neighbor of a pod are checked while waiting for
+// them to converge
+const convergencePollInterval = 10 * time.Millisecond
+
+// WaitForConvergence waits until the kernel has the host route and the rules of the pod and, if waitGateway is set, the
+// container resolves its gateway to the host veth
+func (os *linuxNetwork) WaitForConvergence(hostVethName string, contVethName string, netnsPath string, addr *net.IPNet,
+	table int, waitGateway bool, timeout time.Duration) error {
+	return waitForConvergence(hostVethName, contVethName, netnsPath, addr, table, waitGateway, timeout, os.netLink, os.ns)
+}
+
+func waitForConvergence(hostVethName string, contVethName string, netnsPath string, addr *net.IPNet, table int,
+	waitGateway bool, timeout time.Duration, netLink netlinkwrapper.NetLink, netNS nswrapper.NS) error {
+	start := time.Now()
+	deadline := start.Add(timeout)
+	for {
+		pending, err := convergencePending(hostVethName, contVethName, netnsPath, addr, table, waitGateway, netLink, netNS)
+		if err != nil {
+			return errors.Wrap(err, "wait for convergence")
+		}
+		if pending == "" {
+			log.Infof("Routes of %s converged after %v", addr.String(), time.Since(start))
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("wait for convergence: %s of %s not ready after %v", pending, addr.String(), timeout)
+		}
+		time.Sleep(convergencePollInterval)
+	}
+}
+
+// convergencePending returns what the pod is still waiting for, or empty once it has converged
+func convergencePending(hostVethName string, contVethName string, netnsPath string, addr *net.IPNet, table int,
+	waitGateway bool, netLink netlinkwrapper.NetLink, netNS nswrapper.NS) (string, error) {
+	hostVeth, err := netLink.LinkByName(hostVethName)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to find link %q", hostVethName)
+	}
+	routes, err := netLink.RouteListFiltered(unix.AF_INET, &netlink.Route{
+		Dst:   &net.IPNet{IP: addr.IP, Mask: net.CIDRMask(32, 32)},
+		Table: mainRouteTable,
+	}, netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to list the host routes")
+	}
+	if !hasRouteThrough(routes, hostVeth.Attrs().Index) {
+		return "host route", nil
+	}
+
+	rules, err := netLink.RuleList(unix.AF_INET)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to list the rules")
+	}
+	if !hasRule(rules, func(rule netlink.Rule) bool {
+		return rule.Priority == toContainerRulePriority && sameIPNet(rule.Dst, addr)
+	}) {
+		return "to-container rule", nil
+	}
+	// The traffic from pods of the primary ENI uses the main table, secondary ENIs need their from-container rules
+	if table > 0 && !hasRule(rules, func(rule netlink.Rule) bool {
+		return rule.Table == table && sameIPNet(rule.Src, addr)
+	}) {
+		return "from-container rule", nil
+	}
+
+	if waitGateway {
+		resolved := false
+		err = netNS.WithNetNSPath(netnsPath, func(ns.NetNS) error {
+			resolved, err = gatewayResolved(netLink, contVethName, hostVeth.Attrs().HardwareAddr)
+			return err
+		})
+		if err != nil {
+			return "", errors.Wrap(err, "failed to check the gateway neighbor")
+		}
+		if !resolved {
+			return "gateway neighbor", nil
+		}
+	}
+	return "", nil
+}
+
+// gatewayResolved returns whether the container resolves its gateway, 169.254.1.1, to the MAC address of the host veth
+func gatewayResolved(netLink netlinkwrapper.NetLink, contVethName string, hostMAC net.HardwareAddr) (bool, error) {
+	contVeth, err := netLink.LinkByName(contVethName)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to find link %q", contVethName)
+	}
+	neighs, err := netLink.NeighList(contVeth.Attrs().Index, unix.AF_INET)
+	if err != nil {
+		return false, err
+	}
+	gw := net.IPv4(169, 254, 1, 1)
+	for _, neigh := range neighs {
+		if neigh.IP.Equal(gw) && neigh.State&(netlink.NUD_PERMANENT|netlink.NUD_REACHABLE) != 0 &&
+			bytes.Equal(neigh.HardwareAddr, hostMAC) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func hasRouteThrough(routes []netlink.Route, linkIndex int) bool {
+	for _, route := range routes {
+		if route.LinkIndex == linkIndex {
+			return true
+		}
+	}
+	return false
+}
+
+func hasRule(rules []netlink.Rule, match func(netlink.Rule) bool) bool {
+	for _, rule := range rules {
+		if match(rule) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameIPNet(a *net.IPNet, b *net.IPNet) bool {
+	return a != nil && b != nil && a.String() == b.String()
+}
@@ -15,7 +15,9 @@ package driver
 
 import (
 	"net"
+	"sort"
 	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
@@ -25,10 +27,13 @@ import (
 
 	log "github.com/cihub/seelog"
 
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/ethtoolwrapper"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/ipwrapper"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/netlinkwrapper"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/networkutils"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/nswrapper"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/procsyswrapper"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/utils/cidr"
 )
 
 const (
@@ -36,26 +41,42 @@ const (
 	toContainerRulePriority = 512
 	// 1024 is reserved for (IP rule not to <VPC's subnet> table main)
 	fromContainerRulePriority = 1536
+	// egressGatewayRulePriority is the priority of the rule that sends the traffic of a pod with an egress gateway, other
+	// than the traffic to the VPC, to the route table of the pod
+	egressGatewayRulePriority = 1537
+	// egressGatewayTableBase is the first route table of the pods with an egress gateway, far from the tables of ENIs
+	egressGatewayTableBase = 0x10000000
 	// Main routing table number
 	mainRouteTable = unix.RT_TABLE_MAIN
 )
 
+// ipv6Gateway is the link-local next hop of the IPv6 default route in the container. Like 169.254.1.1 for IPv4, it is
+// never configured anywhere, a static neighbor entry resolves it to the MAC address of the host veth.
+var ipv6Gateway = net.ParseIP("fe80::1")
+
 // NetworkAPIs defines network API calls
 type NetworkAPIs interface {
-	SetupNS(hostVethName string, contVethName string, netnsPath string, addr *net.IPNet, table int, vpcCIDRs []string, useExternalSNAT bool) error
-	TeardownNS(addr *net.IPNet, table int) error
+	SetupNS(hostVethName string, contVethName string, netnsPath string, addr *net.IPNet, addr6 *net.IPNet, table int, vpcCIDRs []string, useExternalSNAT bool, vethOffloads map[string]bool, egressGateway net.IP, mtu int) error
+	TeardownNS(addr *net.IPNet, addr6 *net.IPNet, table int, egressGateway bool) error
+	WaitForConvergence(hostVethName string, contVethName string, netnsPath string, addr *net.IPNet, table int, waitGateway bool, timeout time.Duration) error
+	SetupVF(vfName string, contIfName string, netnsPath string, addr *net.IPNet, subnet *net.IPNet) error
+	TeardownVF(vfName string, contIfName string, netnsPath string) error
+	SetupBranchENI(hostVethName string, contVethName string, netnsPath string, addr *net.IPNet, vlanID int, branchMAC string, trunkIfName string, subnet *net.IPNet, mtu int) error
+	TeardownBranchENI(addr *net.IPNet, vlanID int) error
 }
 
 type linuxNetwork struct {
 	netLink netlinkwrapper.NetLink
 	ns      nswrapper.NS
+	procSys procsyswrapper.ProcSys
 }
 
-// New creates linuxNetwork object
+// New creates linuxNetwork object. Its route and rule changes take their tokens from the netlink throttle of ipamd.
 func New() NetworkAPIs {
 	return &linuxNetwork{
-		netLink: netlinkwrapper.NewNetLink(),
+		netLink: netlinkwrapper.NewThrottledNetLink(netlinkwrapper.NewNetLink(), netlinkwrapper.DefaultThrottlePath),
 		ns:      nswrapper.NewNS(),
+		procSys: procsyswrapper.NewProcSys(),
 	}
 }
 
@@ -68,16 +89,30 @@ type createVethPairContext struct {
 	netLink      netlinkwrapper.NetLink
 	ip           ipwrapper.IP
 	mtu          int
+	// addr6 is the IPv6 address of the container in dual-stack clusters, or nil
+	addr6 *net.IPNet
+	// offloads are turned on or off on both ends of the veth pair, other offloads keep the kernel defaults
+	offloads map[string]bool
+	ethtool  ethtoolwrapper.Ethtool
 }
 
-func newCreateVethPairContext(contVethName string, hostVethName string, addr *net.IPNet) *createVethPairContext {
+// newCreateVethPairContext returns the context creating the veth pair of a pod, with the MTU of the node when mtu is 0.
+// The routes of the pod are changed with netLink, so that they count against the same netlink throttle as the host.
+func newCreateVethPairContext(contVethName string, hostVethName string, addr *net.IPNet, addr6 *net.IPNet, offloads map[string]bool, mtu int,
+	netLink netlinkwrapper.NetLink) *createVethPairContext {
+	if mtu == 0 {
+		mtu = networkutils.GetEthernetMTU()
+	}
 	return &createVethPairContext{
 		contVethName: contVethName,
 		hostVethName: hostVethName,
 		addr:         addr,
-		netLink:      netlinkwrapper.NewNetLink(),
+		addr6:        addr6,
+		offloads:     offloads,
+		netLink:      netLink,
 		ip:           ipwrapper.NewIP(),
-		mtu:          networkutils.GetEthernetMTU(),
+		ethtool:      ethtoolwrapper.NewEthtool(),
+		mtu:          mtu,
 	}
 }
 
@@ -118,6 +153,11 @@ func (createVethContext *createVethPairContext) run(hostNS ns.NetNS) error {
 		return errors.Wrapf(err, "setup NS network: failed to set link %q up", createVethContext.contVethName)
 	}
 
+	// Both ends are still in the container's namespace, where the ethtool calls are made
+	if err = createVethContext.setOffloads(); err != nil {
+		return err
+	}
+
 	// Add a connected route to a dummy next hop (169.254.1.1)
 	// # ip route show
 	// default via 169.254.1.1 dev eth0
@@ -155,6 +195,12 @@ func (createVethContext *createVethPairContext) run(hostNS ns.NetNS) error {
 		return errors.Wrap(err, "setup NS network: failed to add static ARP")
 	}
 
+	if createVethContext.addr6 != nil {
+		if err = createVethContext.setupIPv6(contVeth, hostVeth); err != nil {
+			return err
+		}
+	}
+
 	// Now that the everything has been successfully set up in the container, move the "host" end of the
 	// veth into the host namespace.
 	if err = createVethContext.netLink.LinkSetNsFd(hostVeth, int(hostNS.Fd())); err != nil {
@@ -163,14 +209,92 @@ func (createVethContext *createVethPairContext) run(hostNS ns.NetNS) error {
 	return nil
 }
 
+// setOffloads turns the configured offloads on or off on both ends of the veth pair. Some kernel and ENA driver
+// combinations corrupt encapsulated traffic, e.g. of service meshes, unless some offloads are turned off.
+func (createVethContext *createVethPairContext) setOffloads() error {
+	var names []string
+	for name := range createVethContext.offloads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		on := createVethContext.offloads[name]
+		for _, vethName := range []string{createVethContext.hostVethName, createVethContext.contVethName} {
+			if err := createVethContext.ethtool.SetOffload(vethName, name, on); err != nil {
+				return errors.Wrapf(err, "setup NS network: failed to set offload of %q", vethName)
+			}
+		}
+	}
+	return nil
+}
+
+// setupIPv6 adds the IPv6 address of the container, and a default route via a link-local next hop that is resolved to the
+// host veth by a static neighbor entry
+func (createVethContext *createVethPairContext) setupIPv6(contVeth netlink.Link, hostVeth netlink.Link) error {
+	// The address is unique in the VPC, there is no need to wait for duplicate address detection before using it
+	if err := createVethContext.netLink.AddrAdd(contVeth, &netlink.Addr{
+		IPNet: createVethContext.addr6,
+		Flags: unix.IFA_F_NODAD}); err != nil {
+		return errors.Wrapf(err, "setup NS network: failed to add IPv6 addr to %q", createVethContext.contVethName)
+	}
+
+	neigh := &netlink.Neigh{
+		LinkIndex:    contVeth.Attrs().Index,
+		Family:       unix.AF_INET6,
+		State:        netlink.NUD_PERMANENT,
+		IP:           ipv6Gateway,
+		HardwareAddr: hostVeth.Attrs().HardwareAddr,
+	}
+	if err := createVethContext.netLink.NeighAdd(neigh); err != nil {
+		return errors.Wrap(err, "setup NS network: failed to add static IPv6 neighbor")
+	}
+
+	// # ip -6 route show
+	// default via fe80::1 dev eth0
+	if err := createVethContext.netLink.RouteReplace(&netlink.Route{
+		LinkIndex: contVeth.Attrs().Index,
+		Dst:       &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+		Gw:        ipv6Gateway}); err != nil {
+		return errors.Wrap(err, "setup NS network: failed to add IPv6 default route")
+	}
+	return nil
+}
+
 // SetupNS wires up linux networking for a pod's network
-func (os *linuxNetwork) SetupNS(hostVethName string, contVethName string, netnsPath string, addr *net.IPNet, table int, vpcCIDRs []string, useExternalSNAT bool) error {
-	log.Debugf("SetupNS: hostVethName=%s,contVethName=%s, netnsPath=%s table=%d\n", hostVethName, contVethName, netnsPath, table)
-	return setupNS(hostVethName, contVethName, netnsPath, addr, table, vpcCIDRs, useExternalSNAT, os.netLink, os.ns)
+func (os *linuxNetwork) SetupNS(hostVethName string, contVethName string, netnsPath string, addr *net.IPNet, addr6 *net.IPNet, table int, vpcCIDRs []string, useExternalSNAT bool, vethOffloads map[string]bool, egressGateway net.IP, mtu int) error {
+	log.Debugf("SetupNS: hostVethName=%s,contVethName=%s, netnsPath=%s table=%d egressGateway=%s mtu=%d\n", hostVethName, contVethName, netnsPath, table, egressGateway, mtu)
+	// The routes and rules of the pod are changed as one batch in the netlink throttle
+	changes := setupNSChanges(addr6, table, vpcCIDRs, useExternalSNAT, egressGateway)
+	return netlinkwrapper.Batch(os.netLink, changes, func(netLink netlinkwrapper.NetLink) error {
+		return setupNS(hostVethName, contVethName, netnsPath, addr, addr6, table, vpcCIDRs, useExternalSNAT, vethOffloads, egressGateway, mtu, netLink, os.ns)
+	})
+}
+
+// setupNSChanges returns how many route and rule changes setupNS makes
+func setupNSChanges(addr6 *net.IPNet, table int, vpcCIDRs []string, useExternalSNAT bool, egressGateway net.IP) int {
+	// The route to the gateway in the namespace of the pod, the host route, and the to-pod rule that is deleted and
+	// added again
+	changes := 4
+	if addr6 != nil {
+		changes += 4
+		if table > 0 {
+			changes += 2
+		}
+	}
+	if egressGateway != nil {
+		return changes + len(vpcCIDRs) + 1
+	}
+	if table > 0 {
+		if useExternalSNAT {
+			return changes + 2
+		}
+		return changes + len(vpcCIDRs)
+	}
+	return changes
 }
 
-func setupNS(hostVethName string, contVethName string, netnsPath string, addr *net.IPNet, table int, vpcCIDRs []string, useExternalSNAT bool,
-	netLink netlinkwrapper.NetLink, ns nswrapper.NS) error {
+func setupNS(hostVethName string, contVethName string, netnsPath string, addr *net.IPNet, addr6 *net.IPNet, table int, vpcCIDRs []string, useExternalSNAT bool,
+	vethOffloads map[string]bool, egressGateway net.IP, mtu int, netLink netlinkwrapper.NetLink, ns nswrapper.NS) error {
 	// Clean up if hostVeth exists.
 	if oldHostVeth, err := netLink.LinkByName(hostVethName); err == nil {
 		if err = netLink.LinkDel(oldHostVeth); err != nil {
@@ -179,7 +303,7 @@ func setupNS(hostVethName string, contVethName string, netnsPath string, addr *n
 		log.Debugf("Clean up old hostVeth: %v\n", hostVethName)
 	}
 
-	createVethContext := newCreateVethPairContext(contVethName, hostVethName, addr)
+	createVethContext := newCreateVethPairContext(contVethName, hostVethName, addr, addr6, vethOffloads, mtu, netLink)
 	if err := ns.WithNetNSPath(netnsPath, createVethContext.run); err != nil {
 		log.Errorf("Failed to setup NS network %v", err)
 		return errors.Wrap(err, "setupNS network: failed to setup NS network")
@@ -222,6 +346,16 @@ func setupNS(hostVethName string, contVethName string, netnsPath string, addr *n
 
 	log.Infof("Added toContainer rule for %s", addr.String())
 
+	if addr6 != nil {
+		if err = setupIPv6HostRoute(netLink, hostVeth, addr6, table); err != nil {
+			return err
+		}
+	}
+
+	if egressGateway != nil {
+		return setupEgressGateway(netLink, addr, table, vpcCIDRs, egressGateway)
+	}
+
 	// add from-pod rule, only need it when it is not primary ENI
 	if table > 0 {
 		if useExternalSNAT {
@@ -262,6 +396,34 @@ func setupNS(hostVethName string, contVethName string, netnsPath string, addr *n
 	return nil
 }
 
+// setupIPv6HostRoute routes the IPv6 address of a pod to its veth. The traffic from a pod on a secondary ENI is routed
+// with the route table of the ENI, which holds no IPv6 route if the address of the pod comes from the primary ENI, so
+// that the main table is used then.
+func setupIPv6HostRoute(netLink netlinkwrapper.NetLink, hostVeth netlink.Link, addr6 *net.IPNet, table int) error {
+	route := netlink.Route{
+		LinkIndex: hostVeth.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+		Dst:       &net.IPNet{IP: addr6.IP, Mask: net.CIDRMask(128, 128)}}
+	if err := netLink.RouteReplace(&route); err != nil {
+		return errors.Wrapf(err, "setupNS: unable to add or replace route entry for %s", route.Dst.IP.String())
+	}
+
+	if err := addContainerRule(netLink, true, addr6, toContainerRulePriority, mainRouteTable); err != nil {
+		log.Errorf("Failed to add toContainer rule for %s err=%v, ", addr6.String(), err)
+		return errors.Wrap(err, "setupNS network: failed to add IPv6 toContainer rule")
+	}
+	log.Infof("Added toContainer rule for %s", addr6.String())
+
+	if table > 0 {
+		if err := addContainerRule(netLink, false, addr6, fromContainerRulePriority, table); err != nil {
+			log.Errorf("Failed to add fromContainer rule for %s err: %v", addr6.String(), err)
+			return errors.Wrap(err, "setupNS network: failed to add IPv6 fromContainer rule")
+		}
+		log.Infof("Added rule priority %d from %s table %d", fromContainerRulePriority, addr6.String(), table)
+	}
+	return nil
+}
+
 func addContainerRule(netLink netlinkwrapper.NetLink, isToContainer bool, addr *net.IPNet, priority int, table int) error {
 	containerRule := netLink.NewRule()
 
@@ -286,26 +448,31 @@ func addContainerRule(netLink netlinkwrapper.NetLink, isToContainer bool, addr *
 }
 
 // TeardownPodNetwork cleanup ip rules
-func (os *linuxNetwork) TeardownNS(addr *net.IPNet, table int) error {
-	log.Debugf("TeardownNS: addr %s, table %d", addr.String(), table)
-	return tearDownNS(addr, table, os.netLink)
+func (os *linuxNetwork) TeardownNS(addr *net.IPNet, addr6 *net.IPNet, table int, egressGateway bool) error {
+	log.Debugf("TeardownNS: addr %s, addr6 %s, table %d, egressGateway %v", addr.String(), addr6.String(), table, egressGateway)
+	return tearDownNS(addr, addr6, table, egressGateway, netlinkwrapper.WithLane(os.netLink, netlinkwrapper.RegularLane))
 }
 
-func tearDownNS(addr *net.IPNet, table int, netLink netlinkwrapper.NetLink) error {
+// tearDownNS only changes the host namespace, so it works whether or not the network namespace of the pod still exists.
+// DEL can be retried after a teardown that was interrupted, e.g. by a kubelet crash, and the veth is deleted along with
+// the namespace, taking its routes with it, so rules and routes that are already gone are not errors.
+func tearDownNS(addr *net.IPNet, addr6 *net.IPNet, table int, egressGateway bool, netLink netlinkwrapper.NetLink) error {
 	// remove to-pod rule
 	toContainerRule := netLink.NewRule()
 	toContainerRule.Dst = addr
 	toContainerRule.Priority = toContainerRulePriority
 	err := netLink.RuleDel(toContainerRule)
 
-	if err != nil {
+	if containsNoSuchRule(err) {
+		log.Debugf("toContainer rule for %s is already deleted", addr.String())
+	} else if err != nil {
 		log.Errorf("Failed to delete toContainer rule for %s err %v", addr.String(), err)
 	} else {
 		log.Infof("Delete toContainer rule for %s ", addr.String())
 	}
 
-	if table > 0 {
-		// remove from-pod rule only for non main table
+	if table > 0 || egressGateway {
+		// remove from-pod rule only for non main table, or for the rules of the egress gateway
 		err := deleteRuleListBySrc(*addr)
 		if err != nil {
 			log.Errorf("Failed to delete fromContainer for %s %v", addr.String(), err)
@@ -319,17 +486,58 @@ func tearDownNS(addr *net.IPNet, table int, netLink netlinkwrapper.NetLink) erro
 		Mask: net.CIDRMask(32, 32)}
 
 	// cleanup host route:
-	if err = netLink.RouteDel(&netlink.Route{
+	err = netLink.RouteDel(&netlink.Route{
 		Scope: netlink.SCOPE_LINK,
-		Dst:   addrHostAddr}); err != nil {
+		Dst:   addrHostAddr})
+	if netlinkwrapper.IsNotExistsError(err) {
+		log.Debugf("Host route for %s is already deleted", addr.String())
+	} else if err != nil {
 		log.Errorf("delete NS network: failed to delete host route for %s, %v", addr.String(), err)
 	}
+
+	if egressGateway {
+		tearDownEgressGatewayRoute(netLink, addr)
+	}
+
+	if addr6 != nil {
+		tearDownIPv6HostRoute(addr6, netLink)
+		if table > 0 {
+			if err := deleteRuleListBySrc(*addr6); err != nil {
+				log.Errorf("Failed to delete fromContainer for %s %v", addr6.String(), err)
+				return errors.Wrapf(err, "delete NS network: failed to delete fromContainer rule for %s", addr6.String())
+			}
+			log.Infof("Delete fromContainer rule for %s in table %d", addr6.String(), table)
+		}
+	}
 	return nil
 }
 
+// tearDownIPv6HostRoute removes the to-pod rule and the host route of the IPv6 address of a pod
+func tearDownIPv6HostRoute(addr6 *net.IPNet, netLink netlinkwrapper.NetLink) {
+	toContainerRule := netLink.NewRule()
+	toContainerRule.Dst = addr6
+	toContainerRule.Priority = toContainerRulePriority
+	if err := netLink.RuleDel(toContainerRule); containsNoSuchRule(err) {
+		log.Debugf("toContainer rule for %s is already deleted", addr6.String())
+	} else if err != nil {
+		log.Errorf("Failed to delete toContainer rule for %s err %v", addr6.String(), err)
+	} else {
+		log.Infof("Delete toContainer rule for %s ", addr6.String())
+	}
+
+	err := netLink.RouteDel(&netlink.Route{
+		Scope: netlink.SCOPE_LINK,
+		Dst:   &net.IPNet{IP: addr6.IP, Mask: net.CIDRMask(128, 128)}})
+	if netlinkwrapper.IsNotExistsError(err) {
+		log.Debugf("Host route for %s is already deleted", addr6.String())
+	} else if err != nil {
+		log.Errorf("delete NS network: failed to delete host route for %s, %v", addr6.String(), err)
+	}
+}
+
 func deleteRuleListBySrc(src net.IPNet) error {
 	networkClient := networkutils.New()
-	return networkClient.DeleteRuleListBySrc(src)
+	return networkClient.DeleteRuleListBySrc(cidr.FromIPNet(&src))
 }
 
 func containsNoSuchRule(err error) bool {
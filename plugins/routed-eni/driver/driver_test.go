@@ -16,18 +16,24 @@ package driver
 import (
 	"errors"
 	"net"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/cninswrapper/mock_ns"
+	mock_ethtoolwrapper "github.com/aws/amazon-vpc-cni-k8s/pkg/ethtoolwrapper/mocks"
 	mocks_ip "github.com/aws/amazon-vpc-cni-k8s/pkg/ipwrapper/mocks"
 	"github.com/aws/amazon-vpc-cni-k8s/pkg/netlinkwrapper/mock_netlink"
 	mock_netlinkwrapper "github.com/aws/amazon-vpc-cni-k8s/pkg/netlinkwrapper/mocks"
 	mock_nswrapper "github.com/aws/amazon-vpc-cni-k8s/pkg/nswrapper/mocks"
+	mock_procsyswrapper "github.com/aws/amazon-vpc-cni-k8s/pkg/procsyswrapper/mocks"
 )
 
 const (
@@ -35,6 +41,7 @@ const (
 	testMAC1         = "01:23:45:67:89:a0"
 	testMAC2         = "01:23:45:67:89:a1"
 	testIP           = "10.0.10.10"
+	testIPv6         = "2001:db8::10"
 	testContVethName = "eth0"
 	testHostVethName = "aws-eth0"
 	testFD           = 10
@@ -115,6 +122,155 @@ func TestRun(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestRunIPv6(t *testing.T) {
+	ctrl, mockNetLink, mockIP, _ := setup(t)
+	defer ctrl.Finish()
+
+	addr6 := &net.IPNet{
+		IP:   net.ParseIP(testIPv6),
+		Mask: net.CIDRMask(128, 128),
+	}
+	mockContext := &createVethPairContext{
+		contVethName: testContVethName,
+		hostVethName: testHostVethName,
+		netLink:      mockNetLink,
+		ip:           mockIP,
+		addr: &net.IPNet{
+			IP:   net.ParseIP(testIP),
+			Mask: net.IPv4Mask(255, 255, 255, 255),
+		},
+		addr6: addr6,
+	}
+
+	hwAddr, err := net.ParseMAC(testMAC)
+	assert.NoError(t, err)
+
+	mockLinkAttrs := &netlink.LinkAttrs{
+		HardwareAddr: hwAddr,
+	}
+	mockHostVeth := mock_netlink.NewMockLink(ctrl)
+	mockContVeth := mock_netlink.NewMockLink(ctrl)
+	mockNS := mock_ns.NewMockNetNS(ctrl)
+	mockContVeth.EXPECT().Attrs().Return(mockLinkAttrs).AnyTimes()
+	mockHostVeth.EXPECT().Attrs().Return(mockLinkAttrs).AnyTimes()
+	gomock.InOrder(
+		mockNetLink.EXPECT().LinkAdd(gomock.Any()).Return(nil),
+		mockNetLink.EXPECT().LinkByName(gomock.Any()).Return(mockHostVeth, nil),
+		mockNetLink.EXPECT().LinkSetUp(mockHostVeth).Return(nil),
+		mockNetLink.EXPECT().LinkByName(gomock.Any()).Return(mockContVeth, nil),
+		mockNetLink.EXPECT().LinkSetUp(mockContVeth).Return(nil),
+		mockNetLink.EXPECT().RouteReplace(gomock.Any()).Return(nil),
+		mockIP.EXPECT().AddDefaultRoute(gomock.Any(), mockContVeth).Return(nil),
+		mockNetLink.EXPECT().AddrAdd(mockContVeth, gomock.Any()).Return(nil),
+		mockNetLink.EXPECT().NeighAdd(gomock.Any()).Return(nil),
+
+		// IPv6 address, without duplicate address detection
+		mockNetLink.EXPECT().AddrAdd(mockContVeth, &netlink.Addr{IPNet: addr6, Flags: unix.IFA_F_NODAD}).Return(nil),
+		// static neighbor for the IPv6 gateway
+		mockNetLink.EXPECT().NeighAdd(&netlink.Neigh{
+			Family:       unix.AF_INET6,
+			State:        netlink.NUD_PERMANENT,
+			IP:           ipv6Gateway,
+			HardwareAddr: hwAddr,
+		}).Return(nil),
+		// IPv6 default route
+		mockNetLink.EXPECT().RouteReplace(&netlink.Route{
+			Dst: &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+			Gw:  ipv6Gateway,
+		}).Return(nil),
+
+		mockNS.EXPECT().Fd().Return(uintptr(testFD)),
+		mockNetLink.EXPECT().LinkSetNsFd(mockHostVeth, testFD).Return(nil),
+	)
+
+	err = mockContext.run(mockNS)
+	assert.NoError(t, err)
+}
+
+func TestRunOffloads(t *testing.T) {
+	ctrl, mockNetLink, mockIP, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockEthtool := mock_ethtoolwrapper.NewMockEthtool(ctrl)
+	mockContext := &createVethPairContext{
+		contVethName: testContVethName,
+		hostVethName: testHostVethName,
+		netLink:      mockNetLink,
+		ip:           mockIP,
+		ethtool:      mockEthtool,
+		addr: &net.IPNet{
+			IP:   net.ParseIP(testIP),
+			Mask: net.IPv4Mask(255, 255, 255, 255),
+		},
+		offloads: map[string]bool{"tx-checksum": false, "gro": true},
+	}
+
+	hwAddr, err := net.ParseMAC(testMAC)
+	assert.NoError(t, err)
+
+	mockLinkAttrs := &netlink.LinkAttrs{
+		HardwareAddr: hwAddr,
+	}
+	mockHostVeth := mock_netlink.NewMockLink(ctrl)
+	mockContVeth := mock_netlink.NewMockLink(ctrl)
+	mockNS := mock_ns.NewMockNetNS(ctrl)
+	mockContVeth.EXPECT().Attrs().Return(mockLinkAttrs).AnyTimes()
+	mockHostVeth.EXPECT().Attrs().Return(mockLinkAttrs).AnyTimes()
+	gomock.InOrder(
+		mockNetLink.EXPECT().LinkAdd(gomock.Any()).Return(nil),
+		mockNetLink.EXPECT().LinkByName(gomock.Any()).Return(mockHostVeth, nil),
+		mockNetLink.EXPECT().LinkSetUp(mockHostVeth).Return(nil),
+		mockNetLink.EXPECT().LinkByName(gomock.Any()).Return(mockContVeth, nil),
+		mockNetLink.EXPECT().LinkSetUp(mockContVeth).Return(nil),
+
+		// offloads of both ends, before the host end leaves the container's namespace
+		mockEthtool.EXPECT().SetOffload(testHostVethName, "gro", true).Return(nil),
+		mockEthtool.EXPECT().SetOffload(testContVethName, "gro", true).Return(nil),
+		mockEthtool.EXPECT().SetOffload(testHostVethName, "tx-checksum", false).Return(nil),
+		mockEthtool.EXPECT().SetOffload(testContVethName, "tx-checksum", false).Return(nil),
+
+		mockNetLink.EXPECT().RouteReplace(gomock.Any()).Return(nil),
+		mockIP.EXPECT().AddDefaultRoute(gomock.Any(), mockContVeth).Return(nil),
+		mockNetLink.EXPECT().AddrAdd(mockContVeth, gomock.Any()).Return(nil),
+		mockNetLink.EXPECT().NeighAdd(gomock.Any()).Return(nil),
+		mockNS.EXPECT().Fd().Return(uintptr(testFD)),
+		mockNetLink.EXPECT().LinkSetNsFd(mockHostVeth, testFD).Return(nil),
+	)
+
+	err = mockContext.run(mockNS)
+	assert.NoError(t, err)
+}
+
+func TestRunErrSetOffload(t *testing.T) {
+	ctrl, mockNetLink, mockIP, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockEthtool := mock_ethtoolwrapper.NewMockEthtool(ctrl)
+	mockContext := &createVethPairContext{
+		contVethName: testContVethName,
+		hostVethName: testHostVethName,
+		netLink:      mockNetLink,
+		ip:           mockIP,
+		ethtool:      mockEthtool,
+		offloads:     map[string]bool{"tso": false},
+	}
+
+	mockHostVeth := mock_netlink.NewMockLink(ctrl)
+	mockContVeth := mock_netlink.NewMockLink(ctrl)
+	mockNS := mock_ns.NewMockNetNS(ctrl)
+	gomock.InOrder(
+		mockNetLink.EXPECT().LinkAdd(gomock.Any()).Return(nil),
+		mockNetLink.EXPECT().LinkByName(gomock.Any()).Return(mockHostVeth, nil),
+		mockNetLink.EXPECT().LinkSetUp(mockHostVeth).Return(nil),
+		mockNetLink.EXPECT().LinkByName(gomock.Any()).Return(mockContVeth, nil),
+		mockNetLink.EXPECT().LinkSetUp(mockContVeth).Return(nil),
+		mockEthtool.EXPECT().SetOffload(testHostVethName, "tso", false).Return(errors.New("error on SetOffload")),
+	)
+
+	err := mockContext.run(mockNS)
+	assert.Error(t, err)
+}
+
 func TestRunLinkAddErr(t *testing.T) {
 	ctrl, mockNetLink, mockIP, _ := setup(t)
 	defer ctrl.Finish()
@@ -529,10 +685,37 @@ func TestSetupPodNetwork(t *testing.T) {
 		Mask: net.IPv4Mask(255, 255, 255, 255),
 	}
 	var cidrs []string
-	err = setupNS(testHostVethName, testContVethName, testnetnsPath, addr, testTable, cidrs, true, mockNetLink, mockNS)
+	err = setupNS(testHostVethName, testContVethName, testnetnsPath, addr, nil, testTable, cidrs, true, nil, nil, 0, mockNetLink, mockNS)
 	assert.NoError(t, err)
 }
 
+func TestSetupIPv6HostRouteSecondaryENI(t *testing.T) {
+	ctrl, mockNetLink, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockHostVeth := mock_netlink.NewMockLink(ctrl)
+	mockHostVeth.EXPECT().Attrs().Return(&netlink.LinkAttrs{Index: 7})
+	addr6 := &net.IPNet{IP: net.ParseIP("2001:db8:0:2::11"), Mask: net.CIDRMask(128, 128)}
+	mockNetLink.EXPECT().RouteReplace(&netlink.Route{LinkIndex: 7, Scope: netlink.SCOPE_LINK, Dst: addr6}).Return(nil)
+
+	var rules []*netlink.Rule
+	mockNetLink.EXPECT().NewRule().DoAndReturn(func() *netlink.Rule {
+		rules = append(rules, netlink.NewRule())
+		return rules[len(rules)-1]
+	}).Times(2)
+	mockNetLink.EXPECT().RuleDel(gomock.Any()).Return(nil).Times(2)
+	mockNetLink.EXPECT().RuleAdd(gomock.Any()).Return(nil).Times(2)
+
+	err := setupIPv6HostRoute(mockNetLink, mockHostVeth, addr6, testTable)
+	assert.NoError(t, err)
+	// The traffic to the pod is routed with the main table, the traffic from the pod with the table of its ENI
+	assert.Equal(t, addr6, rules[0].Dst)
+	assert.Equal(t, mainRouteTable, rules[0].Table)
+	assert.Equal(t, addr6, rules[1].Src)
+	assert.Equal(t, testTable, rules[1].Table)
+	assert.Equal(t, fromContainerRulePriority, rules[1].Priority)
+}
+
 func TestSetupPodNetworkErrLinkByName(t *testing.T) {
 	ctrl, mockNetLink, _, mockNS := setup(t)
 	defer ctrl.Finish()
@@ -548,7 +731,7 @@ func TestSetupPodNetworkErrLinkByName(t *testing.T) {
 		Mask: net.IPv4Mask(255, 255, 255, 255),
 	}
 	var cidrs []string
-	err := setupNS(testHostVethName, testContVethName, testnetnsPath, addr, testTable, cidrs, false, mockNetLink, mockNS)
+	err := setupNS(testHostVethName, testContVethName, testnetnsPath, addr, nil, testTable, cidrs, false, nil, nil, 0, mockNetLink, mockNS)
 
 	assert.Error(t, err)
 }
@@ -570,7 +753,7 @@ func TestSetupPodNetworkErrLinkSetup(t *testing.T) {
 		Mask: net.IPv4Mask(255, 255, 255, 255),
 	}
 	var cidrs []string
-	err := setupNS(testHostVethName, testContVethName, testnetnsPath, addr, testTable, cidrs, false, mockNetLink, mockNS)
+	err := setupNS(testHostVethName, testContVethName, testnetnsPath, addr, nil, testTable, cidrs, false, nil, nil, 0, mockNetLink, mockNS)
 
 	assert.Error(t, err)
 }
@@ -603,7 +786,7 @@ func TestSetupPodNetworkErrRouteReplace(t *testing.T) {
 		Mask: net.IPv4Mask(255, 255, 255, 255),
 	}
 	var cidrs []string
-	err = setupNS(testHostVethName, testContVethName, testnetnsPath, addr, testTable, cidrs, false, mockNetLink, mockNS)
+	err = setupNS(testHostVethName, testContVethName, testnetnsPath, addr, nil, testTable, cidrs, false, nil, nil, 0, mockNetLink, mockNS)
 
 	assert.Error(t, err)
 }
@@ -651,7 +834,7 @@ func TestSetupPodNetworkPrimaryIntf(t *testing.T) {
 	}
 
 	var cidrs []string
-	err = setupNS(testHostVethName, testContVethName, testnetnsPath, addr, 0, cidrs, false, mockNetLink, mockNS)
+	err = setupNS(testHostVethName, testContVethName, testnetnsPath, addr, nil, 0, cidrs, false, nil, nil, 0, mockNetLink, mockNS)
 
 	assert.NoError(t, err)
 }
@@ -682,7 +865,36 @@ func TestTearDownPodNetwork(t *testing.T) {
 		IP:   net.ParseIP(testIP),
 		Mask: net.IPv4Mask(255, 255, 255, 255),
 	}
-	err := tearDownNS(addr, 0, mockNetLink)
+	err := tearDownNS(addr, nil, 0, false, mockNetLink)
+	assert.NoError(t, err)
+}
+
+func TestTearDownPodNetworkIPv6(t *testing.T) {
+	ctrl, mockNetLink, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	addr6 := &net.IPNet{
+		IP:   net.ParseIP(testIPv6),
+		Mask: net.CIDRMask(128, 128),
+	}
+	mockNetLink.EXPECT().NewRule().DoAndReturn(func() *netlink.Rule { return netlink.NewRule() }).Times(2)
+	gomock.InOrder(
+		mockNetLink.EXPECT().RuleDel(gomock.Any()).Return(nil),
+		mockNetLink.EXPECT().RouteDel(gomock.Any()).Return(nil),
+
+		// IPv6 to-pod rule and host route
+		mockNetLink.EXPECT().RuleDel(gomock.Any()).Do(func(rule *netlink.Rule) {
+			assert.Equal(t, addr6, rule.Dst)
+			assert.Equal(t, toContainerRulePriority, rule.Priority)
+		}).Return(nil),
+		mockNetLink.EXPECT().RouteDel(&netlink.Route{Scope: netlink.SCOPE_LINK, Dst: addr6}).Return(nil),
+	)
+
+	addr := &net.IPNet{
+		IP:   net.ParseIP(testIP),
+		Mask: net.IPv4Mask(255, 255, 255, 255),
+	}
+	err := tearDownNS(addr, addr6, 0, false, mockNetLink)
 	assert.NoError(t, err)
 }
 
@@ -711,6 +923,395 @@ func TestTearDownPodNetworkMain(t *testing.T) {
 		IP:   net.ParseIP(testIP),
 		Mask: net.IPv4Mask(255, 255, 255, 255),
 	}
-	err := tearDownNS(addr, 0, mockNetLink)
+	err := tearDownNS(addr, nil, 0, false, mockNetLink)
 	assert.NoError(t, err)
 }
+
+func TestTearDownPodNetworkPartiallyTornDown(t *testing.T) {
+	ctrl, mockNetLink, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	addr6 := &net.IPNet{
+		IP:   net.ParseIP(testIPv6),
+		Mask: net.CIDRMask(128, 128),
+	}
+	// The rules were deleted by a DEL that was interrupted, and the routes went away with the veth
+	mockNetLink.EXPECT().NewRule().DoAndReturn(func() *netlink.Rule { return netlink.NewRule() }).Times(2)
+	gomock.InOrder(
+		mockNetLink.EXPECT().RuleDel(gomock.Any()).Return(syscall.ENOENT),
+		mockNetLink.EXPECT().RouteDel(gomock.Any()).Return(syscall.ESRCH),
+		mockNetLink.EXPECT().RuleDel(gomock.Any()).Return(syscall.ENOENT),
+		mockNetLink.EXPECT().RouteDel(gomock.Any()).Return(syscall.ESRCH),
+	)
+
+	addr := &net.IPNet{
+		IP:   net.ParseIP(testIP),
+		Mask: net.IPv4Mask(255, 255, 255, 255),
+	}
+	err := tearDownNS(addr, addr6, 0, false, mockNetLink)
+	assert.NoError(t, err)
+}
+
+func TestSetupEgressGateway(t *testing.T) {
+	ctrl, mockNetLink, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	addr := &net.IPNet{
+		IP:   net.ParseIP(testIP),
+		Mask: net.IPv4Mask(255, 255, 255, 255),
+	}
+	gateway := net.ParseIP("10.0.10.5")
+	gatewayTable := egressGatewayTable(addr.IP)
+	assert.Equal(t, 0x10000000|0x0a000a0a, gatewayTable)
+
+	mockNetLink.EXPECT().NewRule().DoAndReturn(func() *netlink.Rule { return netlink.NewRule() }).Times(2)
+	gomock.InOrder(
+		// The traffic to the VPC goes through the ENI
+		mockNetLink.EXPECT().RuleAdd(gomock.Any()).Do(func(rule *netlink.Rule) {
+			assert.Equal(t, testeniSubnet, rule.Dst.String())
+			assert.Equal(t, addr, rule.Src)
+			assert.Equal(t, testTable, rule.Table)
+			assert.Equal(t, fromContainerRulePriority, rule.Priority)
+		}).Return(nil),
+		// The gateway is not a pod of the node, so it is reached through the ENI
+		mockNetLink.EXPECT().RouteListFiltered(unix.AF_INET, gomock.Any(), netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE).Return(nil, nil),
+		mockNetLink.EXPECT().RouteListFiltered(unix.AF_INET, &netlink.Route{Table: testTable}, netlink.RT_FILTER_TABLE).Return([]netlink.Route{
+			{LinkIndex: 3, Dst: &net.IPNet{IP: net.ParseIP("10.0.10.1"), Mask: net.CIDRMask(32, 32)}},
+			{LinkIndex: 4},
+		}, nil),
+		mockNetLink.EXPECT().RouteReplace(&netlink.Route{
+			LinkIndex: 4,
+			Gw:        gateway,
+			Table:     gatewayTable,
+			Flags:     int(netlink.FLAG_ONLINK),
+		}).Return(nil),
+		mockNetLink.EXPECT().RuleDel(gomock.Any()).Return(syscall.ENOENT),
+		mockNetLink.EXPECT().RuleAdd(gomock.Any()).Do(func(rule *netlink.Rule) {
+			assert.Equal(t, addr, rule.Src)
+			assert.Equal(t, gatewayTable, rule.Table)
+			assert.Equal(t, egressGatewayRulePriority, rule.Priority)
+		}).Return(nil),
+	)
+	err := setupEgressGateway(mockNetLink, addr, testTable, []string{testeniSubnet}, gateway)
+	assert.NoError(t, err)
+}
+
+func TestSetupEgressGatewayLocalPod(t *testing.T) {
+	ctrl, mockNetLink, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	addr := &net.IPNet{
+		IP:   net.ParseIP(testIP),
+		Mask: net.IPv4Mask(255, 255, 255, 255),
+	}
+	gateway := net.ParseIP("10.0.10.5")
+
+	mockNetLink.EXPECT().NewRule().DoAndReturn(func() *netlink.Rule { return netlink.NewRule() }).Times(2)
+	gomock.InOrder(
+		mockNetLink.EXPECT().RuleAdd(gomock.Any()).Do(func(rule *netlink.Rule) {
+			assert.Equal(t, mainRouteTable, rule.Table)
+		}).Return(syscall.EEXIST),
+		// The gateway is a pod of the node, and is reached through its veth
+		mockNetLink.EXPECT().RouteListFiltered(unix.AF_INET, &netlink.Route{
+			Dst:   &net.IPNet{IP: gateway, Mask: net.CIDRMask(32, 32)},
+			Table: mainRouteTable,
+		}, netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE).Return([]netlink.Route{{LinkIndex: 7, Scope: netlink.SCOPE_LINK}}, nil),
+		mockNetLink.EXPECT().RouteReplace(gomock.Any()).Do(func(route *netlink.Route) {
+			assert.Equal(t, 7, route.LinkIndex)
+		}).Return(nil),
+		mockNetLink.EXPECT().RuleDel(gomock.Any()).Return(nil),
+		mockNetLink.EXPECT().RuleAdd(gomock.Any()).Return(nil),
+	)
+	err := setupEgressGateway(mockNetLink, addr, 0, []string{testeniSubnet}, gateway)
+	assert.NoError(t, err)
+}
+
+func TestSetupEgressGatewayErrNoDefaultRoute(t *testing.T) {
+	ctrl, mockNetLink, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	addr := &net.IPNet{
+		IP:   net.ParseIP(testIP),
+		Mask: net.IPv4Mask(255, 255, 255, 255),
+	}
+	mockNetLink.EXPECT().RouteListFiltered(unix.AF_INET, gomock.Any(), gomock.Any()).Return(nil, nil).Times(2)
+	err := setupEgressGateway(mockNetLink, addr, testTable, nil, net.ParseIP("10.0.10.5"))
+	assert.Error(t, err)
+}
+
+func TestTearDownEgressGatewayRoute(t *testing.T) {
+	ctrl, mockNetLink, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	addr := &net.IPNet{
+		IP:   net.ParseIP(testIP),
+		Mask: net.IPv4Mask(255, 255, 255, 255),
+	}
+	mockNetLink.EXPECT().RouteDel(&netlink.Route{Table: egressGatewayTable(addr.IP)}).Return(syscall.ESRCH)
+	tearDownEgressGatewayRoute(mockNetLink, addr)
+}
+
+func TestSetupVF(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS := setup(t)
+	defer ctrl.Finish()
+
+	hostVF := mock_netlink.NewMockLink(ctrl)
+	contVF := mock_netlink.NewMockLink(ctrl)
+	podNS := mock_ns.NewMockNetNS(ctrl)
+	hostNS := mock_ns.NewMockNetNS(ctrl)
+	withNetNS := func(path string, toRun func(ns.NetNS) error) error { return toRun(hostNS) }
+	addr := &net.IPNet{IP: net.ParseIP(testeniIP), Mask: net.CIDRMask(32, 32)}
+	_, subnet, _ := net.ParseCIDR(testeniSubnet)
+
+	gomock.InOrder(
+		mockNetLink.EXPECT().LinkByName("eth1v0").Return(hostVF, nil),
+		mockNS.EXPECT().GetNS(testnetnsPath).Return(podNS, nil),
+		podNS.EXPECT().Fd().Return(uintptr(testFD)),
+		mockNetLink.EXPECT().LinkSetNsFd(hostVF, testFD).Return(nil),
+		mockNS.EXPECT().WithNetNSPath(testnetnsPath, gomock.Any()).DoAndReturn(withNetNS),
+		mockNetLink.EXPECT().LinkByName("eth1v0").Return(contVF, nil),
+		mockNetLink.EXPECT().LinkSetName(contVF, testContVethName).Return(nil),
+		// The pod gets its IP in the subnet of the ENI
+		mockNetLink.EXPECT().AddrAdd(contVF, &netlink.Addr{IPNet: &net.IPNet{IP: addr.IP, Mask: subnet.Mask}}).Return(nil),
+		mockNetLink.EXPECT().LinkSetUp(contVF).Return(nil),
+		contVF.EXPECT().Attrs().Return(&netlink.LinkAttrs{Index: 7}),
+		mockNetLink.EXPECT().RouteAdd(&netlink.Route{
+			LinkIndex: 7,
+			Dst:       &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+			Gw:        net.ParseIP("10.10.0.1").To4()}).Return(nil),
+		podNS.EXPECT().Close().Return(nil),
+	)
+	err := setupVF("eth1v0", testContVethName, testnetnsPath, addr, subnet, mockNetLink, mockNS)
+	assert.NoError(t, err)
+}
+
+func TestSetupVFErrRouteAdd(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS := setup(t)
+	defer ctrl.Finish()
+
+	hostVF := mock_netlink.NewMockLink(ctrl)
+	contVF := mock_netlink.NewMockLink(ctrl)
+	podNS := mock_ns.NewMockNetNS(ctrl)
+	hostNS := mock_ns.NewMockNetNS(ctrl)
+	withNetNS := func(path string, toRun func(ns.NetNS) error) error { return toRun(hostNS) }
+	addr := &net.IPNet{IP: net.ParseIP(testeniIP), Mask: net.CIDRMask(32, 32)}
+	_, subnet, _ := net.ParseCIDR(testeniSubnet)
+
+	gomock.InOrder(
+		mockNetLink.EXPECT().LinkByName("eth1v0").Return(hostVF, nil),
+		mockNS.EXPECT().GetNS(testnetnsPath).Return(podNS, nil),
+		podNS.EXPECT().Fd().Return(uintptr(testFD)),
+		mockNetLink.EXPECT().LinkSetNsFd(hostVF, testFD).Return(nil),
+		mockNS.EXPECT().WithNetNSPath(testnetnsPath, gomock.Any()).DoAndReturn(withNetNS),
+		mockNetLink.EXPECT().LinkByName("eth1v0").Return(contVF, nil),
+		mockNetLink.EXPECT().LinkSetName(contVF, testContVethName).Return(nil),
+		mockNetLink.EXPECT().AddrAdd(contVF, gomock.Any()).Return(nil),
+		mockNetLink.EXPECT().LinkSetUp(contVF).Return(nil),
+		contVF.EXPECT().Attrs().Return(&netlink.LinkAttrs{Index: 7}),
+		mockNetLink.EXPECT().RouteAdd(gomock.Any()).Return(errors.New("error on RouteAdd")),
+		// The VF is given back to the host
+		mockNS.EXPECT().WithNetNSPath(testnetnsPath, gomock.Any()).DoAndReturn(withNetNS),
+		mockNetLink.EXPECT().LinkByName(testContVethName).Return(contVF, nil),
+		mockNetLink.EXPECT().LinkSetDown(contVF).Return(nil),
+		mockNetLink.EXPECT().LinkSetName(contVF, "eth1v0").Return(nil),
+		hostNS.EXPECT().Fd().Return(uintptr(testFD+1)),
+		mockNetLink.EXPECT().LinkSetNsFd(contVF, testFD+1).Return(nil),
+		podNS.EXPECT().Close().Return(nil),
+	)
+	err := setupVF("eth1v0", testContVethName, testnetnsPath, addr, subnet, mockNetLink, mockNS)
+	assert.Error(t, err)
+}
+
+func TestTearDownVF(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS := setup(t)
+	defer ctrl.Finish()
+
+	contVF := mock_netlink.NewMockLink(ctrl)
+	hostNS := mock_ns.NewMockNetNS(ctrl)
+	withNetNS := func(path string, toRun func(ns.NetNS) error) error { return toRun(hostNS) }
+
+	gomock.InOrder(
+		mockNS.EXPECT().WithNetNSPath(testnetnsPath, gomock.Any()).DoAndReturn(withNetNS),
+		mockNetLink.EXPECT().LinkByName(testContVethName).Return(contVF, nil),
+		mockNetLink.EXPECT().LinkSetDown(contVF).Return(nil),
+		mockNetLink.EXPECT().LinkSetName(contVF, "eth1v0").Return(nil),
+		hostNS.EXPECT().Fd().Return(uintptr(testFD)),
+		mockNetLink.EXPECT().LinkSetNsFd(contVF, testFD).Return(nil),
+	)
+	err := tearDownVF("eth1v0", testContVethName, testnetnsPath, mockNetLink, mockNS)
+	assert.NoError(t, err)
+
+	// The kernel moves the VF back to the host when the netns of the pod is gone
+	mockNS.EXPECT().WithNetNSPath(testnetnsPath, gomock.Any()).Return(ns.NSPathNotExistErr{})
+	err = tearDownVF("eth1v0", testContVethName, testnetnsPath, mockNetLink, mockNS)
+	assert.NoError(t, err)
+	err = tearDownVF("eth1v0", testContVethName, "", mockNetLink, mockNS)
+	assert.NoError(t, err)
+}
+
+func TestSetupBranchENI(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS := setup(t)
+	defer ctrl.Finish()
+
+	mockProcSys := mock_procsyswrapper.NewMockProcSys(ctrl)
+	trunk := mock_netlink.NewMockLink(ctrl)
+	vlan := mock_netlink.NewMockLink(ctrl)
+	hostVeth := mock_netlink.NewMockLink(ctrl)
+	addr := &net.IPNet{IP: net.ParseIP(testIP), Mask: net.CIDRMask(32, 32)}
+	_, subnet, _ := net.ParseCIDR("10.0.10.0/24")
+
+	var rules []*netlink.Rule
+	gomock.InOrder(
+		mockNetLink.EXPECT().LinkByName("eth2").Return(trunk, nil),
+		mockNetLink.EXPECT().LinkSetUp(trunk).Return(nil),
+		mockNetLink.EXPECT().LinkByName("vlan.eth.3").Return(nil, errors.New("not found")),
+		mockNetLink.EXPECT().LinkByName(testHostVethName).Return(nil, errors.New("not found")),
+		trunk.EXPECT().Attrs().Return(&netlink.LinkAttrs{Index: 4}),
+		mockNetLink.EXPECT().LinkAdd(gomock.Any()).DoAndReturn(func(link netlink.Link) error {
+			assert.Equal(t, 3, link.(*netlink.Vlan).VlanId)
+			assert.Equal(t, 4, link.Attrs().ParentIndex)
+			assert.Equal(t, testMAC, link.Attrs().HardwareAddr.String())
+			return nil
+		}),
+		mockNetLink.EXPECT().LinkByName("vlan.eth.3").Return(vlan, nil),
+		mockNetLink.EXPECT().LinkSetUp(vlan).Return(nil),
+		mockProcSys.EXPECT().Set("net/ipv4/conf/vlan.eth.3/rp_filter", "2").Return(nil),
+		mockNS.EXPECT().WithNetNSPath(testnetnsPath, gomock.Any()).Return(nil),
+		mockNetLink.EXPECT().LinkByName(testHostVethName).Return(hostVeth, nil),
+		mockNetLink.EXPECT().LinkSetUp(hostVeth).Return(nil),
+	)
+	vlan.EXPECT().Attrs().Return(&netlink.LinkAttrs{Index: 5}).AnyTimes()
+	hostVeth.EXPECT().Attrs().Return(&netlink.LinkAttrs{Index: 6}).AnyTimes()
+	var routes []*netlink.Route
+	mockNetLink.EXPECT().RouteReplace(gomock.Any()).DoAndReturn(func(route *netlink.Route) error {
+		routes = append(routes, route)
+		return nil
+	}).Times(3)
+	mockNetLink.EXPECT().NewRule().DoAndReturn(netlink.NewRule).Times(2)
+	mockNetLink.EXPECT().RuleAdd(gomock.Any()).DoAndReturn(func(rule *netlink.Rule) error {
+		rules = append(rules, rule)
+		return nil
+	}).Times(2)
+
+	err := setupBranchENI(testHostVethName, testContVethName, testnetnsPath, addr, 3, testMAC, "eth2", subnet, 0,
+		mockNetLink, mockNS, mockProcSys)
+	assert.NoError(t, err)
+
+	// Table 103 routes to the VPC router through the VLAN interface, and to the pod through its veth
+	for _, route := range routes {
+		assert.Equal(t, 103, route.Table)
+	}
+	assert.Equal(t, "10.0.10.1", routes[1].Gw.String())
+	assert.Equal(t, 5, routes[1].LinkIndex)
+	assert.Equal(t, 6, routes[2].LinkIndex)
+	assert.Equal(t, "vlan.eth.3", rules[0].IifName)
+	assert.Equal(t, testHostVethName, rules[1].IifName)
+	assert.Equal(t, vlanRulePriority, rules[1].Priority)
+}
+
+func TestTearDownBranchENI(t *testing.T) {
+	ctrl, mockNetLink, _, _ := setup(t)
+	defer ctrl.Finish()
+
+	vlan := mock_netlink.NewMockLink(ctrl)
+	addr := &net.IPNet{IP: net.ParseIP(testIP), Mask: net.CIDRMask(32, 32)}
+	vlanRule := netlink.Rule{Table: 103, Priority: vlanRulePriority, IifName: "vlan.eth.3"}
+	gomock.InOrder(
+		mockNetLink.EXPECT().RuleList(unix.AF_INET).Return([]netlink.Rule{
+			{Table: 2, Priority: fromContainerRulePriority},
+			vlanRule,
+		}, nil),
+		mockNetLink.EXPECT().RuleDel(&vlanRule).Return(nil),
+		mockNetLink.EXPECT().RouteDel(gomock.Any()).Return(syscall.ESRCH),
+		mockNetLink.EXPECT().LinkByName("vlan.eth.3").Return(vlan, nil),
+		mockNetLink.EXPECT().LinkDel(vlan).Return(nil),
+	)
+	err := tearDownBranchENI(addr, 3, mockNetLink)
+	assert.NoError(t, err)
+
+	// A DEL that is retried finds the VLAN interface already gone
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return(nil, nil)
+	mockNetLink.EXPECT().RouteDel(gomock.Any()).Return(syscall.ESRCH)
+	mockNetLink.EXPECT().LinkByName("vlan.eth.3").Return(nil, errors.New("not found"))
+	err = tearDownBranchENI(addr, 3, mockNetLink)
+	assert.NoError(t, err)
+}
+
+func TestWaitForConvergence(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS := setup(t)
+	defer ctrl.Finish()
+
+	addr := &net.IPNet{
+		IP:   net.ParseIP(testIP),
+		Mask: net.IPv4Mask(255, 255, 255, 255),
+	}
+	hwAddr, err := net.ParseMAC(testMAC)
+	assert.NoError(t, err)
+	mockHostVeth := mock_netlink.NewMockLink(ctrl)
+	mockHostVeth.EXPECT().Attrs().Return(&netlink.LinkAttrs{Index: 7, HardwareAddr: hwAddr}).AnyTimes()
+	mockContVeth := mock_netlink.NewMockLink(ctrl)
+	mockContVeth.EXPECT().Attrs().Return(&netlink.LinkAttrs{Index: 2}).AnyTimes()
+
+	toContainer := netlink.Rule{Priority: toContainerRulePriority, Dst: addr, Table: mainRouteTable}
+	fromContainer := netlink.Rule{Priority: fromContainerRulePriority, Src: addr, Table: testTable}
+	gomock.InOrder(
+		// The host route is not there yet
+		mockNetLink.EXPECT().LinkByName(testHostVethName).Return(mockHostVeth, nil),
+		mockNetLink.EXPECT().RouteListFiltered(unix.AF_INET, &netlink.Route{
+			Dst:   addr,
+			Table: mainRouteTable,
+		}, netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE).Return(nil, nil),
+
+		mockNetLink.EXPECT().LinkByName(testHostVethName).Return(mockHostVeth, nil),
+		mockNetLink.EXPECT().RouteListFiltered(unix.AF_INET, gomock.Any(), gomock.Any()).Return([]netlink.Route{{LinkIndex: 7}}, nil),
+		mockNetLink.EXPECT().RuleList(unix.AF_INET).Return([]netlink.Rule{toContainer, fromContainer}, nil),
+		mockNS.EXPECT().WithNetNSPath(testnetnsPath, gomock.Any()).DoAndReturn(
+			func(_ string, toRun func(ns.NetNS) error) error { return toRun(nil) }),
+		mockNetLink.EXPECT().LinkByName(testContVethName).Return(mockContVeth, nil),
+		mockNetLink.EXPECT().NeighList(2, unix.AF_INET).Return([]netlink.Neigh{{
+			IP:           net.IPv4(169, 254, 1, 1),
+			State:        netlink.NUD_PERMANENT,
+			HardwareAddr: hwAddr,
+		}}, nil),
+	)
+	err = waitForConvergence(testHostVethName, testContVethName, testnetnsPath, addr, testTable, true, time.Second,
+		mockNetLink, mockNS)
+	assert.NoError(t, err)
+}
+
+func TestWaitForConvergenceTimeout(t *testing.T) {
+	ctrl, mockNetLink, _, mockNS := setup(t)
+	defer ctrl.Finish()
+
+	addr := &net.IPNet{
+		IP:   net.ParseIP(testIP),
+		Mask: net.IPv4Mask(255, 255, 255, 255),
+	}
+	mockHostVeth := mock_netlink.NewMockLink(ctrl)
+	mockHostVeth.EXPECT().Attrs().Return(&netlink.LinkAttrs{Index: 7}).AnyTimes()
+	mockNetLink.EXPECT().LinkByName(testHostVethName).Return(mockHostVeth, nil).MinTimes(1)
+	mockNetLink.EXPECT().RouteListFiltered(unix.AF_INET, gomock.Any(), gomock.Any()).Return([]netlink.Route{{LinkIndex: 7}}, nil).MinTimes(1)
+	// The from-container rule of the ENI never shows up
+	mockNetLink.EXPECT().RuleList(unix.AF_INET).Return([]netlink.Rule{
+		{Priority: toContainerRulePriority, Dst: addr, Table: mainRouteTable},
+	}, nil).MinTimes(1)
+
+	err := waitForConvergence(testHostVethName, testContVethName, testnetnsPath, addr, testTable, false, 0,
+		mockNetLink, mockNS)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "from-container rule")
+}
+
+func TestSetupNSChanges(t *testing.T) {
+	cidrs := []string{"10.0.0.0/16", "10.1.0.0/16"}
+	addr6 := &net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(128, 128)}
+
+	// The gateway route of the pod, the host route and the to-pod rule on the primary ENI
+	assert.Equal(t, 4, setupNSChanges(nil, 0, cidrs, false, nil))
+	// Plus a from-pod rule per VPC CIDR on a secondary ENI, or the one that is deleted and added with external SNAT
+	assert.Equal(t, 6, setupNSChanges(nil, testTable, cidrs, false, nil))
+	assert.Equal(t, 6, setupNSChanges(nil, testTable, cidrs, true, nil))
+	assert.Equal(t, 12, setupNSChanges(addr6, testTable, cidrs, true, nil))
+	// The egress gateway has a rule per VPC CIDR and its route
+	assert.Equal(t, 7, setupNSChanges(nil, testTable, cidrs, false, net.ParseIP("10.0.0.1")))
+}
@@ -0,0 +1,130 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package driver
+
+import (
+	"encoding/binary"
+	"net"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/netlinkwrapper"
+)
+
+// egressGatewayTable returns the route table of a pod with an egress gateway. It is derived from the IP of the pod, so
+// that it is found again on teardown, and is distinct for the pod IPs of a node.
+func egressGatewayTable(podIP net.IP) int {
+	return egressGatewayTableBase | int(binary.BigEndian.Uint32(podIP.To4())&(egressGatewayTableBase-1))
+}
+
+// setupEgressGateway routes the traffic of the pod to the VPC through its ENI, and the rest of its traffic through its
+// egress gateway:
+//
+//	1536: from <podIP> to <vpcCIDR> lookup <table of the ENI, or main>
+//	1537: from <podIP> lookup <table of the pod>, which only holds "default via <gateway> onlink"
+func setupEgressGateway(netLink netlinkwrapper.NetLink, addr *net.IPNet, table int, vpcCIDRs []string, gateway net.IP) error {
+	vpcTable := table
+	if vpcTable == 0 {
+		vpcTable = mainRouteTable
+	}
+	for _, cidr := range vpcCIDRs {
+		podRule := netLink.NewRule()
+		_, podRule.Dst, _ = net.ParseCIDR(cidr)
+		podRule.Src = addr
+		podRule.Table = vpcTable
+		podRule.Priority = fromContainerRulePriority
+		if err := netLink.RuleAdd(podRule); err != nil && !isRuleExistsError(err) {
+			return errors.Wrapf(err, "setupNS: failed to add pod rule [%v]", podRule)
+		}
+	}
+
+	linkIndex, err := egressGatewayLink(netLink, table, gateway)
+	if err != nil {
+		return errors.Wrap(err, "setupNS: failed to find the interface of the egress gateway")
+	}
+	gatewayTable := egressGatewayTable(addr.IP)
+	route := netlink.Route{
+		LinkIndex: linkIndex,
+		Gw:        gateway,
+		Table:     gatewayTable,
+		Flags:     int(netlink.FLAG_ONLINK),
+	}
+	if err := netLink.RouteReplace(&route); err != nil {
+		return errors.Wrapf(err, "setupNS: failed to add the route to egress gateway %s", gateway)
+	}
+	if err := addContainerRule(netLink, false, addr, egressGatewayRulePriority, gatewayTable); err != nil {
+		return errors.Wrap(err, "setupNS: failed to add egress gateway rule")
+	}
+	log.Infof("Added rule priority %d from %s table %d, through egress gateway %s", egressGatewayRulePriority,
+		addr.String(), gatewayTable, gateway)
+	return nil
+}
+
+// egressGatewayLink returns the interface the gateway is reached through. A gateway that is a pod of the node is
+// reached through its veth. Otherwise it is reached through the ENI of the pod, in whose subnet it must be, since the
+// VPC only delivers a packet to the next hop it was sent to in the same subnet.
+func egressGatewayLink(netLink netlinkwrapper.NetLink, table int, gateway net.IP) (int, error) {
+	hostRoutes, err := netLink.RouteListFiltered(unix.AF_INET, &netlink.Route{
+		Dst:   &net.IPNet{IP: gateway, Mask: net.CIDRMask(32, 32)},
+		Table: mainRouteTable,
+	}, netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return 0, err
+	}
+	for _, route := range hostRoutes {
+		if route.Scope == netlink.SCOPE_LINK {
+			return route.LinkIndex, nil
+		}
+	}
+
+	eniTable := table
+	if eniTable == 0 {
+		eniTable = mainRouteTable
+	}
+	routes, err := netLink.RouteListFiltered(unix.AF_INET, &netlink.Route{Table: eniTable}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return 0, err
+	}
+	for _, route := range routes {
+		if isDefaultRoute(route) {
+			return route.LinkIndex, nil
+		}
+	}
+	return 0, errors.Errorf("no default route in table %d", eniTable)
+}
+
+func isDefaultRoute(route netlink.Route) bool {
+	if route.Dst == nil {
+		return true
+	}
+	ones, _ := route.Dst.Mask.Size()
+	return ones == 0
+}
+
+// tearDownEgressGatewayRoute removes the route table of a pod with an egress gateway, its rules are removed with the
+// other rules of the pod
+func tearDownEgressGatewayRoute(netLink netlinkwrapper.NetLink, addr *net.IPNet) {
+	gatewayTable := egressGatewayTable(addr.IP)
+	err := netLink.RouteDel(&netlink.Route{Table: gatewayTable})
+	if netlinkwrapper.IsNotExistsError(err) {
+		log.Debugf("Egress gateway route of %s is already deleted", addr.String())
+	} else if err != nil {
+		log.Errorf("Failed to delete the egress gateway route of %s in table %d: %v", addr.String(), gatewayTable, err)
+	} else {
+		log.Infof("Delete egress gateway route of %s in table %d", addr.String(), gatewayTable)
+	}
+}
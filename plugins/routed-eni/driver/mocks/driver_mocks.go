@@ -20,6 +20,7 @@ package mock_driver
 import (
 	net "net"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 )
@@ -47,26 +48,86 @@ func (m *MockNetworkAPIs) EXPECT() *MockNetworkAPIsMockRecorder {
 	return m.recorder
 }
 
+// SetupBranchENI mocks base method
+func (m *MockNetworkAPIs) SetupBranchENI(arg0, arg1, arg2 string, arg3 *net.IPNet, arg4 int, arg5, arg6 string, arg7 *net.IPNet, arg8 int) error {
+	ret := m.ctrl.Call(m, "SetupBranchENI", arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7, arg8)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetupBranchENI indicates an expected call of SetupBranchENI
+func (mr *MockNetworkAPIsMockRecorder) SetupBranchENI(arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7, arg8 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetupBranchENI", reflect.TypeOf((*MockNetworkAPIs)(nil).SetupBranchENI), arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7, arg8)
+}
+
 // SetupNS mocks base method
-func (m *MockNetworkAPIs) SetupNS(arg0, arg1, arg2 string, arg3 *net.IPNet, arg4 int, arg5 []string, arg6 bool) error {
-	ret := m.ctrl.Call(m, "SetupNS", arg0, arg1, arg2, arg3, arg4, arg5, arg6)
+func (m *MockNetworkAPIs) SetupNS(arg0, arg1, arg2 string, arg3, arg4 *net.IPNet, arg5 int, arg6 []string, arg7 bool, arg8 map[string]bool, arg9 net.IP, arg10 int) error {
+	ret := m.ctrl.Call(m, "SetupNS", arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7, arg8, arg9, arg10)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // SetupNS indicates an expected call of SetupNS
-func (mr *MockNetworkAPIsMockRecorder) SetupNS(arg0, arg1, arg2, arg3, arg4, arg5, arg6 interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetupNS", reflect.TypeOf((*MockNetworkAPIs)(nil).SetupNS), arg0, arg1, arg2, arg3, arg4, arg5, arg6)
+func (mr *MockNetworkAPIsMockRecorder) SetupNS(arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7, arg8, arg9, arg10 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetupNS", reflect.TypeOf((*MockNetworkAPIs)(nil).SetupNS), arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7, arg8, arg9, arg10)
+}
+
+// SetupVF mocks base method
+func (m *MockNetworkAPIs) SetupVF(arg0, arg1, arg2 string, arg3, arg4 *net.IPNet) error {
+	ret := m.ctrl.Call(m, "SetupVF", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetupVF indicates an expected call of SetupVF
+func (mr *MockNetworkAPIsMockRecorder) SetupVF(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetupVF", reflect.TypeOf((*MockNetworkAPIs)(nil).SetupVF), arg0, arg1, arg2, arg3, arg4)
+}
+
+// TeardownBranchENI mocks base method
+func (m *MockNetworkAPIs) TeardownBranchENI(arg0 *net.IPNet, arg1 int) error {
+	ret := m.ctrl.Call(m, "TeardownBranchENI", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// TeardownBranchENI indicates an expected call of TeardownBranchENI
+func (mr *MockNetworkAPIsMockRecorder) TeardownBranchENI(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TeardownBranchENI", reflect.TypeOf((*MockNetworkAPIs)(nil).TeardownBranchENI), arg0, arg1)
 }
 
 // TeardownNS mocks base method
-func (m *MockNetworkAPIs) TeardownNS(arg0 *net.IPNet, arg1 int) error {
-	ret := m.ctrl.Call(m, "TeardownNS", arg0, arg1)
+func (m *MockNetworkAPIs) TeardownNS(arg0, arg1 *net.IPNet, arg2 int, arg3 bool) error {
+	ret := m.ctrl.Call(m, "TeardownNS", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // TeardownNS indicates an expected call of TeardownNS
-func (mr *MockNetworkAPIsMockRecorder) TeardownNS(arg0, arg1 interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TeardownNS", reflect.TypeOf((*MockNetworkAPIs)(nil).TeardownNS), arg0, arg1)
+func (mr *MockNetworkAPIsMockRecorder) TeardownNS(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TeardownNS", reflect.TypeOf((*MockNetworkAPIs)(nil).TeardownNS), arg0, arg1, arg2, arg3)
+}
+
+// TeardownVF mocks base method
+func (m *MockNetworkAPIs) TeardownVF(arg0, arg1, arg2 string) error {
+	ret := m.ctrl.Call(m, "TeardownVF", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// TeardownVF indicates an expected call of TeardownVF
+func (mr *MockNetworkAPIsMockRecorder) TeardownVF(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TeardownVF", reflect.TypeOf((*MockNetworkAPIs)(nil).TeardownVF), arg0, arg1, arg2)
+}
+
+// WaitForConvergence mocks base method
+func (m *MockNetworkAPIs) WaitForConvergence(arg0, arg1, arg2 string, arg3 *net.IPNet, arg4 int, arg5 bool, arg6 time.Duration) error {
+	ret := m.ctrl.Call(m, "WaitForConvergence", arg0, arg1, arg2, arg3, arg4, arg5, arg6)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// WaitForConvergence indicates an expected call of WaitForConvergence
+func (mr *MockNetworkAPIsMockRecorder) WaitForConvergence(arg0, arg1, arg2, arg3, arg4, arg5, arg6 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WaitForConvergence", reflect.TypeOf((*MockNetworkAPIs)(nil).WaitForConvergence), arg0, arg1, arg2, arg3, arg4, arg5, arg6)
 }
@@ -0,0 +1,136 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package driver
+
+import (
+	"net"
+
+	log "github.com/cihub/seelog"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/netlinkwrapper"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/nswrapper"
+)
+
+// SetupVF moves an SR-IOV virtual function into the network namespace of a pod in place of the veth
+func (os *linuxNetwork) SetupVF(vfName string, contIfName string, netnsPath string, addr *net.IPNet, subnet *net.IPNet) error {
+	log.Debugf("SetupVF: vfName=%s, contIfName=%s, netnsPath=%s, addr=%s, subnet=%s", vfName, contIfName, netnsPath, addr, subnet)
+	return setupVF(vfName, contIfName, netnsPath, addr, subnet, os.netLink, os.ns)
+}
+
+// setupVF moves the VF to the network namespace of the pod, where it is renamed to the interface name of the pod and
+// gets the IP of the pod in the subnet of its ENI, with a default route through the VPC router of the subnet. The
+// traffic of the pod does not go through the host, so there are no host routes or rules to add.
+func setupVF(vfName string, contIfName string, netnsPath string, addr *net.IPNet, subnet *net.IPNet,
+	netLink netlinkwrapper.NetLink, nsw nswrapper.NS) error {
+	vf, err := netLink.LinkByName(vfName)
+	if err != nil {
+		return errors.Wrapf(err, "setupVF: failed to find VF %q", vfName)
+	}
+	netns, err := nsw.GetNS(netnsPath)
+	if err != nil {
+		return errors.Wrapf(err, "setupVF: failed to open netns %q", netnsPath)
+	}
+	defer netns.Close()
+	if err := netLink.LinkSetNsFd(vf, int(netns.Fd())); err != nil {
+		return errors.Wrapf(err, "setupVF: failed to move VF %q to netns %q", vfName, netnsPath)
+	}
+
+	podAddr := &net.IPNet{IP: addr.IP, Mask: subnet.Mask}
+	err = nsw.WithNetNSPath(netnsPath, func(hostNS ns.NetNS) error {
+		vf, err := netLink.LinkByName(vfName)
+		if err != nil {
+			return errors.Wrapf(err, "failed to find VF %q", vfName)
+		}
+		if err := netLink.LinkSetName(vf, contIfName); err != nil {
+			return errors.Wrapf(err, "failed to rename VF %q to %q", vfName, contIfName)
+		}
+		if err := netLink.AddrAdd(vf, &netlink.Addr{IPNet: podAddr}); err != nil {
+			return errors.Wrapf(err, "failed to add IP %s to VF %q", podAddr, vfName)
+		}
+		if err := netLink.LinkSetUp(vf); err != nil {
+			return errors.Wrapf(err, "failed to set VF %q up", vfName)
+		}
+		if err := netLink.RouteAdd(&netlink.Route{
+			LinkIndex: vf.Attrs().Index,
+			Dst:       &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+			Gw:        subnetRouter(subnet)}); err != nil {
+			return errors.Wrap(err, "failed to add default route")
+		}
+		return nil
+	})
+	if err != nil {
+		// Give the VF back to the host, so that it can be assigned to another pod
+		if tearDownErr := tearDownVF(vfName, contIfName, netnsPath, netLink, nsw); tearDownErr != nil {
+			log.Errorf("Failed to move VF %q back to the host: %v", vfName, tearDownErr)
+		}
+		return errors.Wrap(err, "setupVF: failed to set up VF in netns")
+	}
+	log.Infof("Moved VF %s to netns %s as %s with %s", vfName, netnsPath, contIfName, podAddr)
+	return nil
+}
+
+// subnetRouter returns the VPC router of the subnet, which is its first address
+func subnetRouter(subnet *net.IPNet) net.IP {
+	router := make(net.IP, net.IPv4len)
+	copy(router, subnet.IP.To4())
+	router[3]++
+	return router
+}
+
+// TeardownVF moves the SR-IOV virtual function of a pod back to the host network namespace
+func (os *linuxNetwork) TeardownVF(vfName string, contIfName string, netnsPath string) error {
+	log.Debugf("TeardownVF: vfName=%s, contIfName=%s, netnsPath=%s", vfName, contIfName, netnsPath)
+	return tearDownVF(vfName, contIfName, netnsPath, os.netLink, os.ns)
+}
+
+// tearDownVF renames the VF back and moves it to the host network namespace, where its IP and routes are gone. When the
+// network namespace of the pod is already gone, the kernel has moved the VF back already.
+func tearDownVF(vfName string, contIfName string, netnsPath string, netLink netlinkwrapper.NetLink, nsw nswrapper.NS) error {
+	if netnsPath == "" {
+		log.Debugf("No netns for VF %s, it is back in the host netns", vfName)
+		return nil
+	}
+	err := nsw.WithNetNSPath(netnsPath, func(hostNS ns.NetNS) error {
+		vf, err := netLink.LinkByName(contIfName)
+		if err != nil {
+			// The VF may still have its own name, if the pod was not fully set up
+			if vf, err = netLink.LinkByName(vfName); err != nil {
+				log.Debugf("VF %s is not in netns %s", vfName, netnsPath)
+				return nil
+			}
+		}
+		if err := netLink.LinkSetDown(vf); err != nil {
+			return errors.Wrapf(err, "failed to set VF %q down", vfName)
+		}
+		if err := netLink.LinkSetName(vf, vfName); err != nil {
+			return errors.Wrapf(err, "failed to rename %q to VF %q", contIfName, vfName)
+		}
+		if err := netLink.LinkSetNsFd(vf, int(hostNS.Fd())); err != nil {
+			return errors.Wrapf(err, "failed to move VF %q to the host netns", vfName)
+		}
+		return nil
+	})
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		log.Debugf("Netns %s is gone, VF %s is back in the host netns", netnsPath, vfName)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "tearDownVF: failed to move VF out of netns")
+	}
+	log.Infof("Moved VF %s back from netns %s", vfName, netnsPath)
+	return nil
+}
@@ -0,0 +1,222 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package driver
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/netlinkwrapper"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/nswrapper"
+	"github.com/aws/amazon-vpc-cni-k8s/pkg/procsyswrapper"
+)
+
+const (
+	// vlanRulePriority is the priority of the rules that send the traffic of a pod with a branch ENI, in both
+	// directions, to the route table of its VLAN, before the rules of the other pods
+	vlanRulePriority = 10
+	// vlanTableBase is added to the VLAN of a branch ENI to get its route table, above the tables of the ENIs
+	vlanTableBase = 100
+	// vlanRPFilterLoose lets the replies to a pod with a branch ENI in through its VLAN interface, which the main route
+	// table does not route to
+	vlanRPFilterLoose = "2"
+)
+
+// vlanLinkName returns the name of the VLAN interface of a branch ENI
+func vlanLinkName(vlanID int) string {
+	return fmt.Sprintf("vlan.eth.%d", vlanID)
+}
+
+// vlanTable returns the route table of the VLAN of a branch ENI
+func vlanTable(vlanID int) int {
+	return vlanTableBase + vlanID
+}
+
+// SetupBranchENI wires up the network of a pod with a branch ENI, whose traffic goes through the trunk ENI tagged with
+// the VLAN of the branch ENI
+func (os *linuxNetwork) SetupBranchENI(hostVethName string, contVethName string, netnsPath string, addr *net.IPNet,
+	vlanID int, branchMAC string, trunkIfName string, subnet *net.IPNet, mtu int) error {
+	log.Debugf("SetupBranchENI: hostVethName=%s, contVethName=%s, netnsPath=%s, addr=%s, vlanID=%d, branchMAC=%s, trunkIfName=%s, subnet=%s",
+		hostVethName, contVethName, netnsPath, addr, vlanID, branchMAC, trunkIfName, subnet)
+	// The route to the gateway in the namespace of the pod, the three routes of the VLAN and its two rules are changed as
+	// one batch in the netlink throttle
+	return netlinkwrapper.Batch(os.netLink, 6, func(netLink netlinkwrapper.NetLink) error {
+		return setupBranchENI(hostVethName, contVethName, netnsPath, addr, vlanID, branchMAC, trunkIfName, subnet, mtu,
+			netLink, os.ns, os.procSys)
+	})
+}
+
+// setupBranchENI creates a VLAN interface on the trunk ENI with the MAC address of the branch ENI, and a veth pair to
+// the pod like for the other pods. The VLAN gets its own route table, which all the traffic of the VLAN interface and
+// of the veth of the pod is looked up in, so that the pod does not share the routes, SNAT and security groups of the
+// ENIs of the node:
+//
+//	10: from all iif vlan.eth.<vlan> lookup <100 + vlan>
+//	10: from all iif <host veth> lookup <100 + vlan>
+//
+// where table <100 + vlan> holds the route to the VPC router of the subnet, the default route through it, and the
+// route to the pod through its veth.
+func setupBranchENI(hostVethName string, contVethName string, netnsPath string, addr *net.IPNet, vlanID int,
+	branchMAC string, trunkIfName string, subnet *net.IPNet, mtu int,
+	netLink netlinkwrapper.NetLink, ns nswrapper.NS, procSys procsyswrapper.ProcSys) error {
+	mac, err := net.ParseMAC(branchMAC)
+	if err != nil {
+		return errors.Wrapf(err, "setupBranchENI: invalid MAC address %q of the branch ENI", branchMAC)
+	}
+	trunk, err := netLink.LinkByName(trunkIfName)
+	if err != nil {
+		return errors.Wrapf(err, "setupBranchENI: failed to find trunk interface %q", trunkIfName)
+	}
+	if err = netLink.LinkSetUp(trunk); err != nil {
+		return errors.Wrapf(err, "setupBranchENI: failed to set trunk interface %q up", trunkIfName)
+	}
+
+	// Clean up the VLAN interface and the veth of an earlier attempt
+	vlanName := vlanLinkName(vlanID)
+	for _, name := range []string{vlanName, hostVethName} {
+		if oldLink, err := netLink.LinkByName(name); err == nil {
+			if err = netLink.LinkDel(oldLink); err != nil {
+				return errors.Wrapf(err, "setupBranchENI: failed to delete old link %q", name)
+			}
+			log.Debugf("Clean up old link: %v", name)
+		}
+	}
+
+	if err = netLink.LinkAdd(&netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:         vlanName,
+			ParentIndex:  trunk.Attrs().Index,
+			HardwareAddr: mac,
+		},
+		VlanId: vlanID,
+	}); err != nil {
+		return errors.Wrapf(err, "setupBranchENI: failed to add VLAN interface %q", vlanName)
+	}
+	vlan, err := netLink.LinkByName(vlanName)
+	if err != nil {
+		return errors.Wrapf(err, "setupBranchENI: failed to find VLAN interface %q", vlanName)
+	}
+	if err = netLink.LinkSetUp(vlan); err != nil {
+		return errors.Wrapf(err, "setupBranchENI: failed to set VLAN interface %q up", vlanName)
+	}
+	if err = procSys.Set("net/ipv4/conf/"+vlanName+"/rp_filter", vlanRPFilterLoose); err != nil {
+		return errors.Wrapf(err, "setupBranchENI: failed to set rp_filter of %q", vlanName)
+	}
+
+	createVethContext := newCreateVethPairContext(contVethName, hostVethName, addr, nil, nil, mtu, netLink)
+	if err = ns.WithNetNSPath(netnsPath, createVethContext.run); err != nil {
+		log.Errorf("Failed to setup NS network %v", err)
+		return errors.Wrap(err, "setupBranchENI: failed to setup NS network")
+	}
+	hostVeth, err := netLink.LinkByName(hostVethName)
+	if err != nil {
+		return errors.Wrapf(err, "setupBranchENI: failed to find link %q", hostVethName)
+	}
+	if err = netLink.LinkSetUp(hostVeth); err != nil {
+		return errors.Wrapf(err, "setupBranchENI: failed to set link %q up", hostVethName)
+	}
+
+	table := vlanTable(vlanID)
+	router := subnetRouter(subnet)
+	routes := []netlink.Route{
+		{
+			LinkIndex: vlan.Attrs().Index,
+			Dst:       &net.IPNet{IP: router, Mask: net.CIDRMask(32, 32)},
+			Scope:     netlink.SCOPE_LINK,
+			Table:     table,
+		},
+		{
+			LinkIndex: vlan.Attrs().Index,
+			Dst:       &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+			Gw:        router,
+			Table:     table,
+		},
+		{
+			LinkIndex: hostVeth.Attrs().Index,
+			Dst:       &net.IPNet{IP: addr.IP, Mask: net.CIDRMask(32, 32)},
+			Scope:     netlink.SCOPE_LINK,
+			Table:     table,
+		},
+	}
+	for i := range routes {
+		if err = netLink.RouteReplace(&routes[i]); err != nil {
+			return errors.Wrapf(err, "setupBranchENI: unable to add or replace route entry for %s in table %d",
+				routes[i].Dst.String(), table)
+		}
+	}
+
+	for _, iif := range []string{vlanName, hostVethName} {
+		rule := netLink.NewRule()
+		rule.IifName = iif
+		rule.Table = table
+		rule.Priority = vlanRulePriority
+		if err = netLink.RuleAdd(rule); err != nil && !isRuleExistsError(err) {
+			return errors.Wrapf(err, "setupBranchENI: failed to add rule [%v]", rule)
+		}
+	}
+	log.Infof("Set up pod %s on VLAN %d of trunk interface %s, table %d", addr.String(), vlanID, trunkIfName, table)
+	return nil
+}
+
+// TeardownBranchENI removes the VLAN interface, route table and rules of a pod with a branch ENI
+func (os *linuxNetwork) TeardownBranchENI(addr *net.IPNet, vlanID int) error {
+	log.Debugf("TeardownBranchENI: addr %s, vlanID %d", addr.String(), vlanID)
+	return tearDownBranchENI(addr, vlanID, netlinkwrapper.WithLane(os.netLink, netlinkwrapper.RegularLane))
+}
+
+// tearDownBranchENI only changes the host namespace, so it works whether or not the network namespace of the pod still
+// exists. The routes of the VLAN interface are deleted along with it, and the veth along with the namespace of the pod.
+func tearDownBranchENI(addr *net.IPNet, vlanID int, netLink netlinkwrapper.NetLink) error {
+	table := vlanTable(vlanID)
+	rules, err := netLink.RuleList(unix.AF_INET)
+	if err != nil {
+		return errors.Wrap(err, "tearDownBranchENI: failed to list the rules")
+	}
+	for i := range rules {
+		if rules[i].Table != table || rules[i].Priority != vlanRulePriority {
+			continue
+		}
+		if err = netLink.RuleDel(&rules[i]); err != nil && !containsNoSuchRule(err) {
+			return errors.Wrapf(err, "tearDownBranchENI: failed to delete rule [%v]", rules[i])
+		}
+	}
+
+	err = netLink.RouteDel(&netlink.Route{
+		Dst:   &net.IPNet{IP: addr.IP, Mask: net.CIDRMask(32, 32)},
+		Scope: netlink.SCOPE_LINK,
+		Table: table,
+	})
+	if netlinkwrapper.IsNotExistsError(err) {
+		log.Debugf("Route to %s in table %d is already deleted", addr.String(), table)
+	} else if err != nil {
+		log.Errorf("Failed to delete the route to %s in table %d: %v", addr.String(), table, err)
+	}
+
+	vlanName := vlanLinkName(vlanID)
+	vlan, err := netLink.LinkByName(vlanName)
+	if err != nil {
+		log.Debugf("VLAN interface %s is already deleted", vlanName)
+		return nil
+	}
+	if err = netLink.LinkDel(vlan); err != nil {
+		return errors.Wrapf(err, "tearDownBranchENI: failed to delete VLAN interface %q", vlanName)
+	}
+	log.Infof("Deleted VLAN interface %s and the rules of table %d of pod %s", vlanName, table, addr.String())
+	return nil
+}
@@ -14,3 +14,4 @@
 package rpc
 
 //go:generate go run ../scripts/mockgen.go github.com/aws/amazon-vpc-cni-k8s/rpc CNIBackendClient  mocks/rpc_mocks.go
+//go:generate go run ../scripts/mockgen.go github.com/aws/amazon-vpc-cni-k8s/rpc ExternalIPAMClient  mocks/external_ipam_mocks.go
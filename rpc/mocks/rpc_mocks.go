@@ -67,6 +67,24 @@ func (mr *MockCNIBackendClientMockRecorder) AddNetwork(arg0, arg1 interface{}, a
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddNetwork", reflect.TypeOf((*MockCNIBackendClient)(nil).AddNetwork), varargs...)
 }
 
+// BulkAddNetwork mocks base method
+func (m *MockCNIBackendClient) BulkAddNetwork(arg0 context.Context, arg1 *rpc.BulkAddNetworkRequest, arg2 ...grpc.CallOption) (*rpc.BulkAddNetworkReply, error) {
+	varargs := []interface{}{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "BulkAddNetwork", varargs...)
+	ret0, _ := ret[0].(*rpc.BulkAddNetworkReply)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// BulkAddNetwork indicates an expected call of BulkAddNetwork
+func (mr *MockCNIBackendClientMockRecorder) BulkAddNetwork(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	varargs := append([]interface{}{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BulkAddNetwork", reflect.TypeOf((*MockCNIBackendClient)(nil).BulkAddNetwork), varargs...)
+}
+
 // DelNetwork mocks base method
 func (m *MockCNIBackendClient) DelNetwork(arg0 context.Context, arg1 *rpc.DelNetworkRequest, arg2 ...grpc.CallOption) (*rpc.DelNetworkReply, error) {
 	varargs := []interface{}{arg0, arg1}
@@ -12,6 +12,8 @@ It has these top-level messages:
 	AddNetworkReply
 	DelNetworkRequest
 	DelNetworkReply
+	BulkAddNetworkRequest
+	BulkAddNetworkReply
 */
 package rpc
 
@@ -90,6 +92,14 @@ type AddNetworkReply struct {
 	DeviceNumber    int32    `protobuf:"varint,4,opt,name=DeviceNumber" json:"DeviceNumber,omitempty"`
 	UseExternalSNAT bool     `protobuf:"varint,5,opt,name=UseExternalSNAT" json:"UseExternalSNAT,omitempty"`
 	VPCcidrs        []string `protobuf:"bytes,6,rep,name=VPCcidrs" json:"VPCcidrs,omitempty"`
+	IPv6Addr        string   `protobuf:"bytes,7,opt,name=IPv6Addr" json:"IPv6Addr,omitempty"`
+	EgressGateway   string   `protobuf:"bytes,8,opt,name=EgressGateway" json:"EgressGateway,omitempty"`
+	VF              string   `protobuf:"bytes,9,opt,name=VF" json:"VF,omitempty"`
+	IPv6First       bool     `protobuf:"varint,10,opt,name=IPv6First" json:"IPv6First,omitempty"`
+	MTU             int32    `protobuf:"varint,11,opt,name=MTU" json:"MTU,omitempty"`
+	VlanID          int32    `protobuf:"varint,12,opt,name=VlanID" json:"VlanID,omitempty"`
+	BranchENIMAC    string   `protobuf:"bytes,13,opt,name=BranchENIMAC" json:"BranchENIMAC,omitempty"`
+	TrunkIfName     string   `protobuf:"bytes,14,opt,name=TrunkIfName" json:"TrunkIfName,omitempty"`
 }
 
 func (m *AddNetworkReply) Reset()                    { *m = AddNetworkReply{} }
@@ -139,6 +149,62 @@ func (m *AddNetworkReply) GetVPCcidrs() []string {
 	return nil
 }
 
+func (m *AddNetworkReply) GetIPv6Addr() string {
+	if m != nil {
+		return m.IPv6Addr
+	}
+	return ""
+}
+
+func (m *AddNetworkReply) GetEgressGateway() string {
+	if m != nil {
+		return m.EgressGateway
+	}
+	return ""
+}
+
+func (m *AddNetworkReply) GetVF() string {
+	if m != nil {
+		return m.VF
+	}
+	return ""
+}
+
+func (m *AddNetworkReply) GetIPv6First() bool {
+	if m != nil {
+		return m.IPv6First
+	}
+	return false
+}
+
+func (m *AddNetworkReply) GetMTU() int32 {
+	if m != nil {
+		return m.MTU
+	}
+	return 0
+}
+
+func (m *AddNetworkReply) GetVlanID() int32 {
+	if m != nil {
+		return m.VlanID
+	}
+	return 0
+}
+
+func (m *AddNetworkReply) GetBranchENIMAC() string {
+	if m != nil {
+		return m.BranchENIMAC
+	}
+	return ""
+}
+
+func (m *AddNetworkReply) GetTrunkIfName() string {
+	if m != nil {
+		return m.TrunkIfName
+	}
+	return ""
+}
+
 type DelNetworkRequest struct {
 	K8S_POD_NAME               string `protobuf:"bytes,1,opt,name=K8S_POD_NAME,json=K8SPODNAME" json:"K8S_POD_NAME,omitempty"`
 	K8S_POD_NAMESPACE          string `protobuf:"bytes,2,opt,name=K8S_POD_NAMESPACE,json=K8SPODNAMESPACE" json:"K8S_POD_NAMESPACE,omitempty"`
@@ -188,9 +254,13 @@ func (m *DelNetworkRequest) GetReason() string {
 }
 
 type DelNetworkReply struct {
-	Success      bool   `protobuf:"varint,1,opt,name=Success" json:"Success,omitempty"`
-	IPv4Addr     string `protobuf:"bytes,2,opt,name=IPv4Addr" json:"IPv4Addr,omitempty"`
-	DeviceNumber int32  `protobuf:"varint,3,opt,name=DeviceNumber" json:"DeviceNumber,omitempty"`
+	Success       bool   `protobuf:"varint,1,opt,name=Success" json:"Success,omitempty"`
+	IPv4Addr      string `protobuf:"bytes,2,opt,name=IPv4Addr" json:"IPv4Addr,omitempty"`
+	DeviceNumber  int32  `protobuf:"varint,3,opt,name=DeviceNumber" json:"DeviceNumber,omitempty"`
+	IPv6Addr      string `protobuf:"bytes,4,opt,name=IPv6Addr" json:"IPv6Addr,omitempty"`
+	EgressGateway bool   `protobuf:"varint,5,opt,name=EgressGateway" json:"EgressGateway,omitempty"`
+	VF            string `protobuf:"bytes,6,opt,name=VF" json:"VF,omitempty"`
+	VlanID        int32  `protobuf:"varint,7,opt,name=VlanID" json:"VlanID,omitempty"`
 }
 
 func (m *DelNetworkReply) Reset()                    { *m = DelNetworkReply{} }
@@ -219,11 +289,73 @@ func (m *DelNetworkReply) GetDeviceNumber() int32 {
 	return 0
 }
 
+func (m *DelNetworkReply) GetIPv6Addr() string {
+	if m != nil {
+		return m.IPv6Addr
+	}
+	return ""
+}
+
+func (m *DelNetworkReply) GetEgressGateway() bool {
+	if m != nil {
+		return m.EgressGateway
+	}
+	return false
+}
+
+func (m *DelNetworkReply) GetVF() string {
+	if m != nil {
+		return m.VF
+	}
+	return ""
+}
+
+func (m *DelNetworkReply) GetVlanID() int32 {
+	if m != nil {
+		return m.VlanID
+	}
+	return 0
+}
+
+type BulkAddNetworkRequest struct {
+	Requests []*AddNetworkRequest `protobuf:"bytes,1,rep,name=Requests" json:"Requests,omitempty"`
+}
+
+func (m *BulkAddNetworkRequest) Reset()                    { *m = BulkAddNetworkRequest{} }
+func (m *BulkAddNetworkRequest) String() string            { return proto.CompactTextString(m) }
+func (*BulkAddNetworkRequest) ProtoMessage()               {}
+func (*BulkAddNetworkRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+func (m *BulkAddNetworkRequest) GetRequests() []*AddNetworkRequest {
+	if m != nil {
+		return m.Requests
+	}
+	return nil
+}
+
+type BulkAddNetworkReply struct {
+	Replies []*AddNetworkReply `protobuf:"bytes,1,rep,name=Replies" json:"Replies,omitempty"`
+}
+
+func (m *BulkAddNetworkReply) Reset()                    { *m = BulkAddNetworkReply{} }
+func (m *BulkAddNetworkReply) String() string            { return proto.CompactTextString(m) }
+func (*BulkAddNetworkReply) ProtoMessage()               {}
+func (*BulkAddNetworkReply) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+func (m *BulkAddNetworkReply) GetReplies() []*AddNetworkReply {
+	if m != nil {
+		return m.Replies
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*AddNetworkRequest)(nil), "rpc.AddNetworkRequest")
 	proto.RegisterType((*AddNetworkReply)(nil), "rpc.AddNetworkReply")
 	proto.RegisterType((*DelNetworkRequest)(nil), "rpc.DelNetworkRequest")
 	proto.RegisterType((*DelNetworkReply)(nil), "rpc.DelNetworkReply")
+	proto.RegisterType((*BulkAddNetworkRequest)(nil), "rpc.BulkAddNetworkRequest")
+	proto.RegisterType((*BulkAddNetworkReply)(nil), "rpc.BulkAddNetworkReply")
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -239,6 +371,7 @@ const _ = grpc.SupportPackageIsVersion4
 type CNIBackendClient interface {
 	AddNetwork(ctx context.Context, in *AddNetworkRequest, opts ...grpc.CallOption) (*AddNetworkReply, error)
 	DelNetwork(ctx context.Context, in *DelNetworkRequest, opts ...grpc.CallOption) (*DelNetworkReply, error)
+	BulkAddNetwork(ctx context.Context, in *BulkAddNetworkRequest, opts ...grpc.CallOption) (*BulkAddNetworkReply, error)
 }
 
 type cNIBackendClient struct {
@@ -267,11 +400,21 @@ func (c *cNIBackendClient) DelNetwork(ctx context.Context, in *DelNetworkRequest
 	return out, nil
 }
 
+func (c *cNIBackendClient) BulkAddNetwork(ctx context.Context, in *BulkAddNetworkRequest, opts ...grpc.CallOption) (*BulkAddNetworkReply, error) {
+	out := new(BulkAddNetworkReply)
+	err := grpc.Invoke(ctx, "/rpc.CNIBackend/BulkAddNetwork", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for CNIBackend service
 
 type CNIBackendServer interface {
 	AddNetwork(context.Context, *AddNetworkRequest) (*AddNetworkReply, error)
 	DelNetwork(context.Context, *DelNetworkRequest) (*DelNetworkReply, error)
+	BulkAddNetwork(context.Context, *BulkAddNetworkRequest) (*BulkAddNetworkReply, error)
 }
 
 func RegisterCNIBackendServer(s *grpc.Server, srv CNIBackendServer) {
@@ -314,6 +457,24 @@ func _CNIBackend_DelNetwork_Handler(srv interface{}, ctx context.Context, dec fu
 	return interceptor(ctx, in, info, handler)
 }
 
+func _CNIBackend_BulkAddNetwork_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BulkAddNetworkRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CNIBackendServer).BulkAddNetwork(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rpc.CNIBackend/BulkAddNetwork",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CNIBackendServer).BulkAddNetwork(ctx, req.(*BulkAddNetworkRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _CNIBackend_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "rpc.CNIBackend",
 	HandlerType: (*CNIBackendServer)(nil),
@@ -326,6 +487,10 @@ var _CNIBackend_serviceDesc = grpc.ServiceDesc{
 			MethodName: "DelNetwork",
 			Handler:    _CNIBackend_DelNetwork_Handler,
 		},
+		{
+			MethodName: "BulkAddNetwork",
+			Handler:    _CNIBackend_BulkAddNetwork_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "rpc.proto",
@@ -334,30 +499,42 @@ var _CNIBackend_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("rpc.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 391 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xcc, 0x53, 0x41, 0x8f, 0x9a, 0x40,
-	0x18, 0x95, 0xa2, 0x54, 0xbf, 0x98, 0x10, 0x27, 0x86, 0x10, 0x0f, 0x8d, 0xe1, 0x64, 0x7a, 0xf0,
-	0xd0, 0xf6, 0x60, 0x9a, 0x5e, 0x28, 0xd0, 0x84, 0x98, 0x8e, 0x64, 0xb0, 0xbd, 0x12, 0x84, 0xd9,
-	0xc4, 0x88, 0xc0, 0x0e, 0xe0, 0xae, 0xff, 0x60, 0xff, 0xdb, 0x9e, 0xf6, 0x1f, 0x6d, 0x18, 0x41,
-	0x59, 0xb8, 0xed, 0x69, 0x6f, 0xbc, 0x37, 0xef, 0x25, 0xef, 0xcd, 0x63, 0x60, 0xc4, 0xd2, 0x60,
-	0x99, 0xb2, 0x24, 0x4f, 0x90, 0xc8, 0xd2, 0x40, 0x7b, 0x16, 0x60, 0xa2, 0x87, 0x21, 0xa6, 0xf9,
-	0x43, 0xc2, 0x0e, 0x84, 0xde, 0x17, 0x34, 0xcb, 0xd1, 0x1c, 0xc6, 0xeb, 0x95, 0xeb, 0x39, 0x1b,
-	0xd3, 0xc3, 0xfa, 0x5f, 0x4b, 0x15, 0xe6, 0xc2, 0x62, 0x44, 0x60, 0xbd, 0x72, 0x9d, 0x8d, 0x59,
-	0x32, 0xe8, 0x2b, 0x4c, 0x9a, 0x0a, 0xd7, 0xd1, 0x0d, 0x4b, 0xfd, 0xc4, 0x65, 0xf2, 0x4d, 0xc6,
-	0x69, 0xf4, 0x13, 0x66, 0xb5, 0xd6, 0xc6, 0x7f, 0x88, 0xee, 0x19, 0x1b, 0xbc, 0xd5, 0x6d, 0x6c,
-	0x11, 0xcf, 0x36, 0x55, 0x91, 0x9b, 0x94, 0x8b, 0x89, 0x9f, 0x5f, 0x8f, 0x6d, 0x13, 0x4d, 0x61,
-	0x80, 0x69, 0x1e, 0x67, 0x6a, 0x9f, 0xcb, 0x2e, 0x00, 0x29, 0x20, 0xd9, 0x77, 0xd8, 0x3f, 0x52,
-	0x75, 0xc0, 0xe9, 0x0a, 0x69, 0x2f, 0x02, 0xc8, 0xcd, 0x36, 0x69, 0x74, 0x46, 0x2a, 0x7c, 0x76,
-	0x8b, 0x20, 0xa0, 0x59, 0xc6, 0x6b, 0x0c, 0x49, 0x0d, 0xd1, 0x0c, 0x86, 0xb6, 0x73, 0xfa, 0xa1,
-	0x87, 0x21, 0xab, 0xa2, 0x5f, 0x31, 0xfa, 0x02, 0x50, 0x7e, 0xbb, 0xc5, 0x2e, 0xa6, 0x79, 0x95,
-	0xb1, 0xc1, 0x20, 0x0d, 0xc6, 0x26, 0x3d, 0xed, 0x03, 0x8a, 0x8b, 0xe3, 0x8e, 0x32, 0x1e, 0x6f,
-	0x40, 0xde, 0x70, 0x68, 0x01, 0xf2, 0xbf, 0x8c, 0x5a, 0x8f, 0x39, 0x65, 0xb1, 0x1f, 0xb9, 0x58,
-	0xdf, 0xf2, 0xb8, 0x43, 0xd2, 0xa6, 0xcb, 0x24, 0xff, 0x1d, 0x23, 0xd8, 0x87, 0x2c, 0x53, 0xa5,
-	0xb9, 0x58, 0x26, 0xa9, 0x71, 0xd9, 0x69, 0x62, 0xd2, 0xe8, 0xc3, 0x2e, 0xd4, 0xbc, 0xc5, 0x7e,
-	0xeb, 0x16, 0x15, 0x90, 0x08, 0xf5, 0xb3, 0x24, 0xae, 0x77, 0xba, 0x20, 0xed, 0x00, 0x72, 0xb3,
-	0xd2, 0xfb, 0x67, 0x6a, 0xcf, 0x20, 0x76, 0x67, 0xf8, 0xf6, 0x24, 0x00, 0x18, 0xd8, 0xfe, 0xed,
-	0x07, 0x07, 0x1a, 0x87, 0xe8, 0x17, 0xc0, 0xed, 0x17, 0x41, 0xca, 0xb2, 0x7c, 0x10, 0x9d, 0x17,
-	0x30, 0x9b, 0x76, 0xf8, 0x34, 0x3a, 0x6b, 0xbd, 0xd2, 0x7d, 0x4b, 0x5e, 0xb9, 0x3b, 0xeb, 0x54,
-	0xee, 0x56, 0x45, 0xad, 0xb7, 0x93, 0xf8, 0xcb, 0xfb, 0xfe, 0x1a, 0x00, 0x00, 0xff, 0xff, 0x7c,
-	0x38, 0x53, 0x0e, 0x86, 0x03, 0x00, 0x00,
+	// 581 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xcc, 0x54, 0x5d, 0x8f, 0xd2, 0x40,
+	0x14, 0xb5, 0xdb, 0x5d, 0x3e, 0x2e, 0x2c, 0xc8, 0x88, 0x64, 0xd2, 0x18, 0x43, 0x1a, 0x1f, 0x88,
+	0x0f, 0x3c, 0xa0, 0x31, 0x1b, 0xe3, 0x4b, 0xa1, 0x45, 0x1b, 0xc2, 0x40, 0x5a, 0x96, 0x57, 0x52,
+	0xda, 0x51, 0x09, 0xdd, 0x82, 0xd3, 0x76, 0x57, 0x7e, 0x96, 0xbf, 0xc3, 0x27, 0x4d, 0xfc, 0x3f,
+	0x66, 0x86, 0x16, 0xca, 0x87, 0x31, 0xf1, 0xc9, 0xb7, 0x39, 0x67, 0xce, 0xbd, 0x3d, 0x77, 0xee,
+	0x49, 0xa1, 0xc8, 0xd6, 0x6e, 0x7b, 0xcd, 0x56, 0xd1, 0x0a, 0xc9, 0x6c, 0xed, 0xaa, 0xdf, 0x25,
+	0xa8, 0x69, 0x9e, 0x47, 0x68, 0xf4, 0xb0, 0x62, 0x4b, 0x8b, 0x7e, 0x89, 0x69, 0x18, 0xa1, 0x26,
+	0x94, 0x07, 0x37, 0xf6, 0x6c, 0x3c, 0xd2, 0x67, 0x44, 0x1b, 0x1a, 0x58, 0x6a, 0x4a, 0xad, 0xa2,
+	0x05, 0x83, 0x1b, 0x7b, 0x3c, 0xd2, 0x39, 0x83, 0x5e, 0x42, 0x2d, 0xab, 0xb0, 0xc7, 0x5a, 0xcf,
+	0xc0, 0x17, 0x42, 0x56, 0xdd, 0xcb, 0x04, 0x8d, 0xde, 0x82, 0x92, 0x6a, 0x4d, 0xd2, 0xb7, 0xb4,
+	0x59, 0x6f, 0x44, 0x26, 0x9a, 0x49, 0x0c, 0x6b, 0x66, 0xea, 0x58, 0x16, 0x45, 0x8d, 0x6d, 0x91,
+	0xb8, 0xdf, 0x5d, 0x9b, 0x3a, 0xaa, 0xc3, 0x15, 0xa1, 0x51, 0x10, 0xe2, 0x4b, 0x21, 0xdb, 0x02,
+	0xd4, 0x80, 0x9c, 0xf9, 0x91, 0x38, 0x77, 0x14, 0x5f, 0x09, 0x3a, 0x41, 0xea, 0x37, 0x19, 0xaa,
+	0xd9, 0x69, 0xd6, 0xfe, 0x06, 0x61, 0xc8, 0xdb, 0xb1, 0xeb, 0xd2, 0x30, 0x14, 0x63, 0x14, 0xac,
+	0x14, 0x22, 0x05, 0x0a, 0xe6, 0xf8, 0xfe, 0xb5, 0xe6, 0x79, 0x2c, 0xb1, 0xbe, 0xc3, 0xe8, 0x39,
+	0x00, 0x3f, 0xdb, 0xf1, 0x3c, 0xa0, 0x51, 0xe2, 0x31, 0xc3, 0x20, 0x15, 0xca, 0x3a, 0xbd, 0x5f,
+	0xb8, 0x94, 0xc4, 0x77, 0x73, 0xca, 0x84, 0xbd, 0x2b, 0xeb, 0x80, 0x43, 0x2d, 0xa8, 0xde, 0x86,
+	0xd4, 0xf8, 0x1a, 0x51, 0x16, 0x38, 0xbe, 0x4d, 0xb4, 0x89, 0xb0, 0x5b, 0xb0, 0x8e, 0x69, 0xee,
+	0x64, 0x3a, 0xee, 0xb9, 0x0b, 0x8f, 0x85, 0x38, 0xd7, 0x94, 0xb9, 0x93, 0x14, 0x27, 0x2e, 0xdf,
+	0x08, 0x97, 0xf9, 0x9d, 0x4b, 0x81, 0xd1, 0x0b, 0xb8, 0x36, 0x3e, 0x31, 0x1a, 0x86, 0xef, 0x9d,
+	0x88, 0x3e, 0x38, 0x1b, 0x5c, 0x10, 0x82, 0x43, 0x12, 0x55, 0xe0, 0x62, 0xda, 0xc7, 0x45, 0x71,
+	0x75, 0x31, 0xed, 0xa3, 0x67, 0x50, 0xe4, 0x1d, 0xfa, 0x0b, 0x16, 0x46, 0x18, 0x84, 0xa3, 0x3d,
+	0x81, 0x1e, 0x83, 0x3c, 0x9c, 0xdc, 0xe2, 0x92, 0x18, 0x88, 0x1f, 0xf9, 0x6b, 0x4f, 0x7d, 0x27,
+	0x30, 0x75, 0x5c, 0x16, 0x64, 0x82, 0xf8, 0x1b, 0x74, 0x99, 0x13, 0xb8, 0x9f, 0x0d, 0x62, 0x0e,
+	0xb5, 0x1e, 0xbe, 0x16, 0x5f, 0x38, 0xe0, 0x50, 0x13, 0x4a, 0x13, 0x16, 0x07, 0xcb, 0x64, 0x5d,
+	0x15, 0x21, 0xc9, 0x52, 0xea, 0x0f, 0x09, 0x6a, 0x3a, 0xf5, 0xff, 0xdb, 0x04, 0x66, 0x53, 0x72,
+	0x79, 0x94, 0x92, 0x06, 0xe4, 0x2c, 0xea, 0x84, 0xab, 0x20, 0xcd, 0xe1, 0x16, 0xa9, 0xbf, 0x24,
+	0xa8, 0x66, 0x67, 0xfa, 0xf7, 0x1c, 0x1e, 0xe7, 0x4c, 0x3e, 0x93, 0xb3, 0x6c, 0x42, 0x2e, 0xff,
+	0x96, 0x90, 0x6d, 0x02, 0xcf, 0x26, 0x24, 0xb7, 0x4b, 0xc8, 0x7e, 0xe3, 0xf9, 0xec, 0xc6, 0xd5,
+	0x01, 0x3c, 0xed, 0xc6, 0xfe, 0xf2, 0xf4, 0x87, 0xd1, 0x81, 0x42, 0x72, 0xe4, 0xd3, 0xc9, 0xad,
+	0x52, 0xa7, 0xd1, 0xe6, 0x7f, 0x9a, 0x13, 0xa5, 0xb5, 0xd3, 0xa9, 0x06, 0x3c, 0x39, 0x6e, 0xc6,
+	0xdf, 0xa9, 0x0d, 0x79, 0x7e, 0x58, 0xd0, 0xb4, 0x53, 0xfd, 0xa4, 0xd3, 0xda, 0xdf, 0x58, 0xa9,
+	0xa8, 0xf3, 0x53, 0x02, 0xe8, 0x11, 0xb3, 0xeb, 0xb8, 0x4b, 0x1a, 0x78, 0xe8, 0x1d, 0xc0, 0x5e,
+	0x8a, 0xfe, 0xe0, 0x42, 0x39, 0xdb, 0x53, 0x7d, 0xc4, 0xab, 0xf7, 0x7b, 0x4b, 0xaa, 0x4f, 0xc2,
+	0xa9, 0xd4, 0x4f, 0xf8, 0x6d, 0xf5, 0x07, 0xa8, 0x1c, 0x4e, 0x84, 0x14, 0xa1, 0x3c, 0xfb, 0x66,
+	0x0a, 0x3e, 0x7b, 0x27, 0x3a, 0xcd, 0x73, 0xe2, 0x17, 0xfd, 0xea, 0xf7, 0x00, 0x98, 0x43, 0x43,
+	0x78, 0xaf, 0x05, 0x00, 0x00,
 }
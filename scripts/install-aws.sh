@@ -1,6 +1,9 @@
 #!/usr/bin/env bash
 echo "====== Installing AWS-CNI ======"
 sed -i s/__VETHPREFIX__/"${AWS_VPC_K8S_CNI_VETHPREFIX:-"eni"}"/g /app/10-aws.conflist
+sed -i s/__VETHOFFLOADS__/"${AWS_VPC_K8S_CNI_VETH_OFFLOADS:-""}"/g /app/10-aws.conflist
+sed -i s/__ROUTECONVERGENCETIMEOUT__/"${AWS_VPC_K8S_CNI_ROUTE_CONVERGENCE_TIMEOUT:-""}"/g /app/10-aws.conflist
+sed -i s/__ROUTECONVERGENCEGATEWAY__/"${AWS_VPC_K8S_CNI_ROUTE_CONVERGENCE_GATEWAY:-"false"}"/g /app/10-aws.conflist
 cp /app/portmap /host/opt/cni/bin/
 cp /app/aws-cni-support.sh /host/opt/cni/bin/
 